@@ -1,19 +1,380 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/alux444/go-microserv-test/api-gateway/api"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/accesslog"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/apichanges"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/apikeys"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/attribution"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/clientip"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/contract"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/cors"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/dashboard"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/debuglog"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/faults"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/killswitch"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/policy"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/portal"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/priority"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/quota"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/ratelimit"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/responsecache"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/routing"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/secureheaders"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/storeforward"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/tokenexchange"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/topology"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/upstream"
+	"github.com/alux444/go-microserv-test/pkg/audit"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/coalesce"
+	"github.com/alux444/go-microserv-test/pkg/compress"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/deadline"
+	"github.com/alux444/go-microserv-test/pkg/degrade"
+	"github.com/alux444/go-microserv-test/pkg/docs"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+	"github.com/alux444/go-microserv-test/pkg/flags"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/alux444/go-microserv-test/pkg/loadshed"
+	"github.com/alux444/go-microserv-test/pkg/logger"
+	"github.com/alux444/go-microserv-test/pkg/middleware"
+	"github.com/alux444/go-microserv-test/pkg/ops"
+	"github.com/alux444/go-microserv-test/pkg/recovery"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/pkg/startup"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/pkg/tlsutil"
+	"github.com/alux444/go-microserv-test/pkg/tracing"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
 
+const (
+	defaultAttributionRules = "/api/users=identity/users,/api/dashboard=web/dashboard"
+	defaultCacheRules       = "/api/users=30s,/api/profiles=10m"
+	defaultPublicRateLimits = "/api/profiles=60/1m"
+	defaultPriorityRules    = "/api/orders=checkout,/api/cart/checkout=checkout,/api/payments=checkout,/api/orders/export=export,/api/orders/report=export,/api/users/export=export"
+	defaultCORSMethods      = "GET,POST,PUT,PATCH,DELETE"
+	defaultCORSHeaders      = "Authorization,Content-Type,Idempotency-Key,If-Match,If-None-Match,X-Request-ID,X-Request-Budget,X-Tenant-ID,X-API-Key,X-Cart-ID"
+	defaultCORSExposed      = "X-Request-ID,ETag,X-Cache,Retry-After,Idempotent-Replayed,X-Kill-Switch,X-Cart-ID,Deprecation,Sunset,Link"
+	defaultPortalKeyScopes  = "GET /api"
+)
+
+// configVars are the typed settings the startup self-check and
+// validate-config check.
+var configVars = []startup.Var{
+	startup.Duration("KILL_SWITCH_REFRESH_INTERVAL"), startup.Duration("DASHBOARD_TIMEOUT"),
+	startup.Int("CACHE_MAX_ENTRIES"), startup.Int("DEBUG_LOG_MAX_BODY"), startup.Duration("CORS_MAX_AGE"), startup.Duration("HSTS_MAX_AGE"),
+	startup.Duration("FEATURE_FLAGS_REFRESH_INTERVAL"), startup.Int("UPSTREAM_FAILOVER_THRESHOLD"), startup.Duration("UPSTREAM_PROBE_INTERVAL"),
+	startup.Int("UPSTREAM_RECOVERY_PROBES"), startup.Int("UPSTREAM_FAILBACK_LATENCY_PERCENT"),
+	startup.Int("PRIORITY_MAX_IN_FLIGHT"), startup.Int("PRIORITY_MAX_QUEUE"), startup.Duration("PRIORITY_QUEUE_TIMEOUT"),
+	startup.Duration("API_CHANGES_INTERVAL"), startup.Duration("GATEWAY_POLICY_RELOAD_INTERVAL"), startup.Duration("TOKEN_EXCHANGE_TTL"),
+	startup.Duration("PUBLIC_RATE_LIMIT_MAX_PENALTY"), startup.Int("PORTAL_MAX_KEYS"), startup.Int("PORTAL_MAX_DAILY_QUOTA"),
+	startup.Duration("CONFIG_RELOAD_INTERVAL"), startup.Int("STORE_AND_FORWARD_MAX"), startup.Duration("STORE_AND_FORWARD_INTERVAL"),
+	startup.Duration("MAINTENANCE_RETRY_AFTER"), startup.Duration("TOPOLOGY_PROBE_INTERVAL"), startup.Duration("TOPOLOGY_ERROR_WINDOW"),
+}
+
 func main() {
+	// validate-config reports a CONFIG_FILE that does not load rather than
+	// failing on it.
+	configErr := config.Load()
+	if err := logger.Init("api-gateway"); err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env found, using system vars.")
 	}
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if configErr != nil {
+		log.Fatalf("Invalid CONFIG_FILE: %v", configErr)
+	}
+	go config.Watch(context.Background(), config.GetDuration("CONFIG_RELOAD_INTERVAL", 30*time.Second))
+
+	// Backends authorize the original caller, so their token is forwarded.
+	forwarding := auth.NewForwardingClient()
+	// Beneath everything else, so injected faults reach the retries,
+	// circuit breakers and failover the way real ones do.
+	var injector *faults.Injector
+	if enabled, err := faultInjection(config.GetEnv("FAULT_INJECTION_ENABLED", "false")); err != nil {
+		log.Fatalf("Invalid FAULT_INJECTION_ENABLED: %v", err)
+	} else if enabled {
+		injector = faults.New()
+		if err := injector.Wrap(forwarding); err != nil {
+			log.Fatalf("Failed to install fault injection: %v", err)
+		}
+		log.Println("Fault injection is enabled; backend calls fail as set under /admin/faults")
+	}
+	validator, err := contract.NewValidator(config.GetEnv("CONTRACT_VALIDATION", contract.ModeOff))
+	if err != nil {
+		log.Fatalf("Invalid CONTRACT_VALIDATION: %v", err)
+	}
+	validator.Wrap(forwarding)
+
+	tokens, serviceToken, exchanger, err := serviceAuth()
+	if err != nil {
+		log.Fatalf("Invalid auth config: %v", err)
+	}
+	if exchanger != nil {
+		exchanger.Wrap(forwarding)
+	}
+	policies, err := policy.New(config.GetEnv("GATEWAY_POLICY_FILE", ""), serviceToken)
+	if err != nil {
+		log.Fatalf("Invalid GATEWAY_POLICY_FILE: %v", err)
+	}
+	go policies.Run(context.Background(), config.GetDuration("GATEWAY_POLICY_RELOAD_INTERVAL", 10*time.Second))
+	policies.Wrap(forwarding)
+
+	services := backends()
+	userServiceURL, orderServiceURL, notificationServiceURL := services[0].primary, services[1].primary, services[2].primary
+	upstreams := upstream.New(upstream.Options{
+		FailureThreshold: config.GetInt("UPSTREAM_FAILOVER_THRESHOLD", 5),
+		ProbeInterval:    config.GetDuration("UPSTREAM_PROBE_INTERVAL", 5*time.Second),
+		RecoveryProbes:   config.GetInt("UPSTREAM_RECOVERY_PROBES", 3),
+		LatencyTolerance: float64(config.GetInt("UPSTREAM_FAILBACK_LATENCY_PERCENT", 150)) / 100,
+	})
+	for _, u := range services {
+		if err := upstreams.Add(u.service, u.primary, u.secondary); err != nil {
+			log.Fatalf("Invalid secondary upstream: %v", err)
+		}
+		if exchanger != nil {
+			if err := exchanger.AddService(u.service, u.primary, u.secondary); err != nil {
+				log.Fatalf("Invalid token exchange audience: %v", err)
+			}
+		}
+	}
+	// Outermost, so contract validation and the circuit breakers see the
+	// region a call was actually sent to.
+	upstreams.Wrap(forwarding)
+	go upstreams.Run(context.Background())
+
+	// Routes from the file are proxied through the same transport as the
+	// gateway's own backend calls.
+	routes, err := routing.New(config.GetEnv("GATEWAY_ROUTES_FILE", ""), builtinBackends(services), forwarding.Transport)
+	if err != nil {
+		log.Fatalf("Invalid GATEWAY_ROUTES_FILE: %v", err)
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go routes.ReloadOn(context.Background(), hangup)
+	// Requests to store_and_forward routes wait here while their backend is
+	// down, and are replayed through the same transport.
+	forwardQueue, err := storeforward.New(forwarding.Transport, config.GetEnv("STORE_AND_FORWARD_FILE", ""), config.GetInt("STORE_AND_FORWARD_MAX", 10000))
+	if err != nil {
+		log.Fatalf("Failed to load STORE_AND_FORWARD_FILE: %v", err)
+	}
+	routes.SetQueue(forwardQueue)
+	websockets := &routing.WebSockets{
+		Tokens:       tokens,
+		MaxPerCaller: config.GetInt("WEBSOCKET_MAX_PER_CALLER", 5),
+		IdleTimeout:  config.GetDuration("WEBSOCKET_IDLE_TIMEOUT", time.Minute),
+	}
+	if exchanger != nil {
+		// The routing file's backends get tokens issued for them too.
+		exchanger.SetResolver(routes.BackendAt)
+		websockets.Exchange = exchanger.ExchangeFor
+	}
+	routes.SetWebSockets(websockets)
+	go forwardQueue.Run(context.Background(), config.GetDuration("STORE_AND_FORWARD_INTERVAL", 5*time.Second))
+	mesh := topology.New(routes, upstreams, topology.Options{
+		ProbeInterval: config.GetDuration("TOPOLOGY_PROBE_INTERVAL", 15*time.Second),
+		ErrorWindow:   config.GetDuration("TOPOLOGY_ERROR_WINDOW", 5*time.Minute),
+	})
+	go mesh.Run(context.Background())
+
+	userClient := clients.NewUserClient(userServiceURL, forwarding)
+	orderClient := clients.NewOrderClient(orderServiceURL, forwarding)
+	notificationClient := clients.NewNotificationClient(notificationServiceURL, forwarding)
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	log.Println("Connected to db successfully")
+
+	apiKeyStore := apikeys.NewPostgresStore(db)
+
+	rules, err := attribution.ParseRules(config.GetEnv("ATTRIBUTION_RULES", defaultAttributionRules))
+	if err != nil {
+		log.Fatalf("Invalid ATTRIBUTION_RULES: %v", err)
+	}
+	usage := attribution.NewMetrics()
+
+	publisher, subscriber, closeEvents := schema.Connect(config.GetEnv("RABBITMQ_URL", ""), "events")
+	defer closeEvents()
+
+	cacheRules, err := responsecache.ParseRules(config.GetEnv("CACHE_RULES", defaultCacheRules))
+	if err != nil {
+		log.Fatalf("Invalid CACHE_RULES: %v", err)
+	}
+	cacheIdentity := func(c *gin.Context) string {
+		return apikeys.CacheIdentity(c) + "\n" + policy.VersionOf(c.Request.Context())
+	}
+	cache := responsecache.New(cacheRules, cacheIdentity, config.GetInt("CACHE_MAX_ENTRIES", 10000))
+	if subscriber != nil {
+		go func() {
+			if err := cache.Run(context.Background(), subscriber); err != nil {
+				log.Printf("Cache invalidation stopped: %v", err)
+			}
+		}()
+	}
+
+	switches := killswitch.New(killswitch.NewPostgresStore(db), publisher)
+	if err := switches.Refresh(context.Background()); err != nil {
+		log.Fatalf("Failed to load kill switches: %v", err)
+	}
+	go switches.Run(context.Background(), config.GetDuration("KILL_SWITCH_REFRESH_INTERVAL", 5*time.Second))
+
+	featureFlags, err := flags.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid feature flags: %v", err)
+	}
+	if err := featureFlags.Refresh(context.Background()); err != nil {
+		log.Printf("Failed to load runtime feature flags, using the defaults: %v", err)
+	}
+	go featureFlags.Run(context.Background(), config.GetDuration("FEATURE_FLAGS_REFRESH_INTERVAL", 10*time.Second))
+
+	apiChanges := apichanges.NewTracker(apichanges.NewPostgresStore(db), publisher,
+		apichanges.Source{Service: "api-gateway", Spec: api.Spec},
+		apichanges.Source{Service: "user-service", BaseURL: userServiceURL},
+		apichanges.Source{Service: "order-service", BaseURL: orderServiceURL},
+		apichanges.Source{Service: "notification-service", BaseURL: notificationServiceURL})
+	go apiChanges.Run(context.Background(), config.GetDuration("API_CHANGES_INTERVAL", 10*time.Minute))
 
-	router := gin.Default()
+	selfCheck := startup.New("api-gateway",
+		startup.Config(configVars...),
+		startup.Tables(db, "gateway.api_keys", "gateway.api_key_usage", "gateway.kill_switches",
+			"gateway.api_snapshots", "gateway.api_changes", "gateway.audit_log", "gateway.quota_usage"),
+		startup.Service("user-service", userServiceURL),
+		startup.Service("order-service", orderServiceURL),
+		startup.Service("notification-service", notificationServiceURL),
+		startup.Broker(publisher, config.GetEnv("RABBITMQ_URL", "")),
+	)
+	go selfCheck.Run(context.Background())
+
+	debugRoutes, err := debuglog.ParseRoutes(config.GetEnv("DEBUG_LOG_ROUTES", ""))
+	if err != nil {
+		log.Fatalf("Invalid DEBUG_LOG_ROUTES: %v", err)
+	}
+	debugLogger := debuglog.New(debuglog.State{Enabled: config.GetEnv("DEBUG_LOG_ENABLED", "false") == "true", Routes: debugRoutes},
+		config.GetInt("DEBUG_LOG_MAX_BODY", 4096))
+
+	corsPolicy := corsFromEnv()
+	if err := corsPolicy.Validate(); err != nil {
+		log.Fatalf("Invalid CORS config: %v", err)
+	}
+
+	priorityRules, err := priority.ParseRules(config.GetEnv("PRIORITY_RULES", defaultPriorityRules))
+	if err != nil {
+		log.Fatalf("Invalid PRIORITY_RULES: %v", err)
+	}
+	shedAt, err := priority.ParseShedAt(config.GetEnv("PRIORITY_SHED_AT", ""))
+	if err != nil {
+		log.Fatalf("Invalid PRIORITY_SHED_AT: %v", err)
+	}
+	pools, err := priority.ParsePools(config.GetEnv("PRIORITY_POOLS", ""))
+	if err != nil {
+		log.Fatalf("Invalid PRIORITY_POOLS: %v", err)
+	}
+	priorities := priority.New(priorityRules, priority.Limits{MaxInFlight: config.GetInt("PRIORITY_MAX_IN_FLIGHT", 200), ShedAt: shedAt, Pools: pools,
+		MaxQueue: config.GetInt("PRIORITY_MAX_QUEUE", 0), QueueTimeoutMS: int(config.GetDuration("PRIORITY_QUEUE_TIMEOUT", 250*time.Millisecond).Milliseconds())})
+
+	publicRateLimits, err := ratelimit.ParseRules(config.GetEnv("PUBLIC_RATE_LIMITS", defaultPublicRateLimits))
+	if err != nil {
+		log.Fatalf("Invalid PUBLIC_RATE_LIMITS: %v", err)
+	}
+	publicLimiter := ratelimit.New(publicRateLimits, config.GetDuration("PUBLIC_RATE_LIMIT_MAX_PENALTY", time.Hour))
+
+	clientIPs, err := clientip.NewResolver(config.GetEnv("TRUSTED_PROXIES", ""), config.GetEnv("TRUSTED_PROXY_HEADER", clientip.XForwardedFor))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES or TRUSTED_PROXY_HEADER: %v", err)
+	}
+
+	accessRules, err := accesslog.ParseRules(config.GetEnv("ACCESS_LOG_SAMPLING", ""))
+	if err != nil {
+		log.Fatalf("Invalid ACCESS_LOG_SAMPLING: %v", err)
+	}
+
+	quotaRules, err := quota.ParseRules(config.GetEnv("QUOTA_RULES", ""))
+	if err != nil {
+		log.Fatalf("Invalid QUOTA_RULES: %v", err)
+	}
+	quotas := quota.New(quotaRules, quota.NewPostgresStore(db), publisher, tokens)
+
+	portalScopes, err := apikeys.ParseScopes(config.GetEnv("PORTAL_KEY_SCOPES", defaultPortalKeyScopes))
+	if err != nil {
+		log.Fatalf("Invalid PORTAL_KEY_SCOPES: %v", err)
+	}
+
+	reporter, err := recovery.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid SENTRY_DSN: %v", err)
+	}
+	router := gin.New()
+	router.Use(recovery.Middleware("api-gateway", reporter))
+	// gin's own forwarding header parsing trusts every peer; c.ClientIP()
+	// reads the address clientIPs resolved instead.
+	if err := router.SetTrustedProxies(nil); err != nil {
+		log.Fatalf("Failed to reset trusted proxies: %v", err)
+	}
+	router.TrustedPlatform = clientip.Header
+	// The access log reads the client IP and request ID once the chain has
+	// run, so it can wrap the middleware that set them.
+	router.Use(accesslog.New(os.Stdout, accessRules, routing.BackendOf).Middleware())
+	router.Use(clientIPs.Middleware())
+	router.Use(tracing.Middleware("api-gateway"))
+	router.Use(requestid.Middleware())
+	// Responses are compressed here rather than by the backends, so the
+	// cache and API version transforms below see them as they were
+	// written. Compressed request bodies are passed through for the
+	// backends to decode against their own body limits.
+	router.Use(compress.FromEnv())
+	// Every proxied call and backend call made for the request carries what
+	// is left of this budget, so backends stop when the gateway does.
+	router.Use(deadline.Middleware(config.GetDuration("GATEWAY_REQUEST_BUDGET", 30*time.Second)))
+	router.Use(ops.Middleware())
+	if injector != nil {
+		router.Use(injector.Middleware())
+	}
+	// Shedding before the rest of the chain keeps a rejected request from
+	// costing an API key lookup or a cache read. Low-priority traffic is shed
+	// gateway-wide before any one route reaches its own limit.
+	shedder := loadshed.FromEnv()
+	router.Use(priorities.Middleware())
+	router.Use(shedder.Middleware())
+	router.Use(secureheaders.Middleware(config.GetDuration("HSTS_MAX_AGE", 365*24*time.Hour),
+		config.GetEnv("HSTS_INCLUDE_SUBDOMAINS", "false") == "true"))
+	router.Use(debugLogger.Middleware())
+	router.Use(corsPolicy.Middleware())
+	router.Use(switches.Middleware())
+	// Ahead of the cache, so cached public answers count against the limit.
+	router.Use(publicLimiter.Middleware())
+	router.Use(auth.ForwardToken())
+	router.Use(tenant.Middleware())
+	router.Use(featureFlags.Middleware())
+	router.Use(apikeys.Middleware(apiKeyStore))
+	router.Use(quotas.Middleware())
+	router.Use(attribution.NewTagger(rules, apikeys.AttributionTags, usage).Middleware())
+	router.Use(cache.Middleware())
+	// Inside the cache, so cached responses are stored transformed.
+	router.Use(policies.Middleware())
 
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -22,12 +383,218 @@ func main() {
 		})
 	})
 
+	router.GET("/health/db", database.HealthHandler(db))
+	router.GET("/metrics/outbound", httpclient.Handler())
+	router.GET("/metrics/degraded", degrade.Handler())
+	router.GET("/metrics/coalesced", coalesce.Handler())
+	router.GET("/metrics/priority", priorities.Handler())
+	router.GET("/metrics/api-versions", policies.UsageHandler())
+	router.GET("/metrics/rate-limits", publicLimiter.Handler())
+	router.GET("/health/startup-report", selfCheck.Handler())
+	if exchanger != nil {
+		router.GET("/metrics/token-exchange", exchanger.Handler())
+		exchanger.RegisterRoutes(router)
+	}
+
+	quota.RegisterRoutes(router, quotas)
+	registerAPIRoutes(router, userClient, orderClient, notificationClient)
+
+	docs.Register(router, "api-gateway", api.Spec)
+	router.NoRoute(routes.Handler())
+
+	// The developer portal needs the caller's identity, so it is only served
+	// when the gateway can verify tokens itself.
+	if tokens != nil {
+		developers := router.Group("/portal", auth.Authenticate(tokens), auth.RequireRole(auth.RoleDeveloper, auth.RoleAdmin))
+		apikeys.NewPortalHandler(apiKeyStore, apikeys.PortalLimits{
+			Scopes:        portalScopes,
+			MaxKeys:       config.GetInt("PORTAL_MAX_KEYS", 5),
+			MaxDailyQuota: config.GetInt("PORTAL_MAX_DAILY_QUOTA", 10000),
+		}).RegisterRoutes(developers)
+		apichanges.NewHandler(apiChanges).RegisterPortalRoutes(developers)
+		portal.NewHandler(notificationClient).RegisterRoutes(developers)
+	}
+
+	// Proxied requests are logged by the services that handle them, so only
+	// the gateway's own admin routes are audited here.
+	auditLog := audit.NewPostgresStore(db, "gateway.audit_log")
+	admin := router.Group("/admin", middleware.RequireAdminToken(config.GetEnv("ADMIN_TOKEN", "")), audit.NewRecorder(auditLog).AdminMiddleware())
+	attribution.RegisterAdminRoutes(admin, usage)
+	apikeys.NewHandler(apiKeyStore).RegisterAdminRoutes(admin)
+	killswitch.NewHandler(switches).RegisterAdminRoutes(admin)
+	responsecache.RegisterAdminRoutes(admin, cache)
+	debuglog.NewHandler(debugLogger).RegisterAdminRoutes(admin)
+	if injector != nil {
+		faults.NewHandler(injector).RegisterAdminRoutes(admin)
+	}
+	flags.NewHandler(featureFlags).RegisterAdminRoutes(admin)
+	upstream.NewHandler(upstreams).RegisterAdminRoutes(admin)
+	ops.RegisterAdminRoutes(admin)
+	shedder.RegisterAdminRoutes(admin)
+	priorities.RegisterAdminRoutes(admin)
+	apichanges.NewHandler(apiChanges).RegisterAdminRoutes(admin)
+	policy.NewHandler(policies).RegisterAdminRoutes(admin)
+	routing.NewHandler(routes).RegisterAdminRoutes(admin)
+	topology.NewHandler(mesh).RegisterAdminRoutes(admin)
+	storeforward.RegisterAdminRoutes(admin, forwardQueue)
+	audit.NewHandler(auditLog).RegisterAdminRoutes(admin)
+
+	serverTLS, err := tlsutil.ServerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid TLS config: %v", err)
+	}
+	log.Println("API gateway starting on :8080")
+	// Paths are rewritten before the router sees them.
+	if err := tlsutil.ListenAndServe(&http.Server{Addr: ":8080", Handler: policies.Handler(router)}, serverTLS); err != nil {
+		log.Fatalf("API gateway failed: %v", err)
+	}
+}
+
+// backend is a service the gateway calls itself, with the region it fails
+// over to, if any.
+type backend struct{ service, primary, secondary string }
+
+// backends reads the URLs of the gateway's own backends: user, order and
+// notification service, in that order.
+func backends() []backend {
+	return []backend{
+		{"user-service", config.GetEnv("USER_SERVICE_URL", "http://user-service:50054"), config.GetEnv("USER_SERVICE_SECONDARY_URL", "")},
+		{"order-service", config.GetEnv("ORDER_SERVICE_URL", "http://order-service:50053"), config.GetEnv("ORDER_SERVICE_SECONDARY_URL", "")},
+		{"notification-service", config.GetEnv("NOTIFICATION_SERVICE_URL", "http://notification-service:50052"),
+			config.GetEnv("NOTIFICATION_SERVICE_SECONDARY_URL", "")},
+	}
+}
+
+// builtinBackends maps the backends to their primary URLs, for the routing
+// table.
+func builtinBackends(services []backend) map[string]string {
+	builtin := make(map[string]string, len(services))
+	for _, b := range services {
+		builtin[b.service] = b.primary
+	}
+	return builtin
+}
+
+// faultInjection reports whether FAULT_INJECTION_ENABLED turns fault
+// injection on. It must never be on in production.
+func faultInjection(enabled string) (bool, error) {
+	switch enabled {
+	case "false", "":
+		return false, nil
+	case "true":
+	default:
+		return false, fmt.Errorf("%q is not true or false", enabled)
+	}
+	if config.GetEnv("ENV", "") == "production" {
+		return false, errors.New("fault injection cannot be enabled when ENV is production")
+	}
+	return true, nil
+}
+
+func corsFromEnv() cors.Policy {
+	return cors.Policy{
+		AllowedOrigins:   cors.SplitList(config.GetEnv("CORS_ALLOWED_ORIGINS", "")),
+		AllowedMethods:   cors.SplitList(config.GetEnv("CORS_ALLOWED_METHODS", defaultCORSMethods)),
+		AllowedHeaders:   cors.SplitList(config.GetEnv("CORS_ALLOWED_HEADERS", defaultCORSHeaders)),
+		ExposedHeaders:   cors.SplitList(config.GetEnv("CORS_EXPOSED_HEADERS", defaultCORSExposed)),
+		AllowCredentials: config.GetEnv("CORS_ALLOW_CREDENTIALS", "false") == "true",
+		MaxAge:           config.GetDuration("CORS_MAX_AGE", 10*time.Minute),
+	}
+}
+
+// serviceAuth reads JWT_SECRET, and INTERNAL_AUTH_SECRET when the backends
+// require their own. It returns the token verifier, the gateway's own token
+// for service-auth routes, and the exchanger that swaps a caller's token for
+// one scoped to a backend; all are nil without a secret.
+func serviceAuth() (*auth.Tokens, func() (string, error), *tokenexchange.Exchanger, error) {
+	secret := config.GetEnv("JWT_SECRET", "")
+	if secret == "" {
+		return nil, nil, nil, nil
+	}
+	tokens, err := auth.NewTokens(secret, config.GetDuration("JWT_TTL", time.Hour))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("JWT_SECRET: %w", err)
+	}
+	if internal := config.GetEnv("INTERNAL_AUTH_SECRET", ""); internal != "" {
+		tokens = tokens.WithInternalSecret(internal)
+	}
+	serviceToken := (&auth.ServiceTransport{Tokens: tokens, Service: "api-gateway"}).Token
+	// Backends only accept tokens issued for them, so callers' tokens are
+	// always exchanged.
+	ttl := config.GetDuration("TOKEN_EXCHANGE_TTL", time.Minute)
+	if ttl <= 0 {
+		return nil, nil, nil, errors.New("TOKEN_EXCHANGE_TTL: must be positive, as backends reject tokens not issued for them")
+	}
+	return tokens, serviceToken, tokenexchange.New(tokens, ttl), nil
+}
+
+// registerAPIRoutes mounts the API the gateway serves itself rather than
+// proxying through the routing table.
+func registerAPIRoutes(router gin.IRouter, userClient *clients.UserClient, orderClient *clients.OrderClient, notificationClient *clients.NotificationClient) {
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Hello! - API Gateway",
 		})
 	})
 
-	log.Println("API gateway starting on :8080")
-	router.Run(":8080")
+	router.GET("/api/users", func(c *gin.Context) {
+		users, err := userClient.ListUsers(c.Request.Context())
+		if apiErr, ok := clients.IsAuthError(err); ok {
+			c.JSON(apiErr.StatusCode, gin.H{"error": apiErr.Message})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		cachetags.Set(c, cachetags.Users)
+		c.JSON(http.StatusOK, gin.H{"users": users})
+	})
+
+	// The tracking page needs no login, only the token from a tracking
+	// link. It is never cached, so a revoked link stops working at once.
+	router.GET("/api/track/:token", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		page, err := orderClient.GetTrackingPage(c.Request.Context(), c.Param("token"))
+		var apiErr *clients.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": apiErr.Message})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, page)
+	})
+
+	// Public profiles need no login either. Anyone may cache them for as
+	// long as user-service allows; the user's changes drop the gateway's
+	// copy through its cache tags.
+	router.GET("/api/profiles/:username", func(c *gin.Context) {
+		profile, err := userClient.GetPublicProfile(c.Request.Context(), c.Param("username"))
+		var apiErr *clients.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": apiErr.Message})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		cachetags.Set(c, profile.Tags...)
+		if profile.MaxAge > 0 {
+			c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(profile.MaxAge.Seconds())))
+		}
+		c.JSON(http.StatusOK, profile)
+	})
+
+	dashboard.NewHandler(userClient, orderClient, notificationClient,
+		config.GetDuration("DASHBOARD_TIMEOUT", 2*time.Second)).RegisterRoutes(router)
 }
@@ -0,0 +1,67 @@
+// Command smoke checks a running deployment from the outside, as a
+// post-deploy gate or a docker-compose wait script. It asks every service
+// for its health and readiness, then makes one representative call per
+// service, through the gateway for the services it fronts, and checks each
+// JSON answer against the spec its sender serves. It prints a line per
+// check and a summary, and exits 1 if any check failed.
+//
+//	smoke [-gateway url] [-token jwt] [-wait d] [-interval d] [-timeout d]
+//
+// The services are found at USER_SERVICE_URL, ORDER_SERVICE_URL,
+// INVENTORY_SERVICE_URL, NOTIFICATION_SERVICE_URL and PAYMENT_SERVICE_URL,
+// which default to their docker-compose addresses as the gateway's do.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("smoke", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	gateway := fs.String("gateway", config.GetEnv("API_GATEWAY_URL", "http://api-gateway:8080"), "gateway base URL")
+	token := fs.String("token", config.GetEnv("SMOKE_TOKEN", ""), "bearer token for the calls that need one; they are skipped without it")
+	wait := fs.Duration("wait", 0, "keep retrying failed checks for this long before giving up")
+	interval := fs.Duration("interval", 2*time.Second, "pause between retries")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long each request may take")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	services := []target{
+		{"user-service", config.GetEnv("USER_SERVICE_URL", "http://user-service:50054")},
+		{"order-service", config.GetEnv("ORDER_SERVICE_URL", "http://order-service:50053")},
+		{"inventory-service", config.GetEnv("INVENTORY_SERVICE_URL", "http://inventory-service:50051")},
+		{"notification-service", config.GetEnv("NOTIFICATION_SERVICE_URL", "http://notification-service:50052")},
+		{"payment-service", config.GetEnv("PAYMENT_SERVICE_URL", "http://payment-service:50055")},
+	}
+	checks := plan(target{gatewayName, *gateway}, services, *token)
+	runner := &runner{client: &http.Client{Timeout: *timeout}, token: *token}
+
+	deadline := time.Now().Add(*wait)
+	for attempt := 1; ; attempt++ {
+		results := runner.runAll(context.Background(), checks)
+		failed := failing(results)
+		if failed == 0 || !time.Now().Add(*interval).Before(deadline) {
+			report(stdout, results)
+			if failed > 0 {
+				return 1
+			}
+			return 0
+		}
+		fmt.Fprintf(stderr, "Attempt %d: %d checks failing, retrying in %s\n", attempt, failed, *interval)
+		time.Sleep(*interval)
+	}
+}
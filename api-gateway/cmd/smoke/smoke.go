@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/contract"
+)
+
+// Outcomes of a check.
+const (
+	pass = "PASS"
+	fail = "FAIL"
+	skip = "SKIP"
+)
+
+const gatewayName = "api-gateway"
+
+// target is a service and the base URL it answers on.
+type target struct {
+	Name string
+	URL  string
+}
+
+// check is one request and the statuses that pass it. Via is the target
+// the request is sent to, and whose spec documents the answer; for calls
+// through the gateway it is the gateway, while Service is the service the
+// call exercises.
+type check struct {
+	Service string
+	Kind    string
+	Via     target
+	Path    string
+	Want    []int
+	// Skip, when set, is why the check is not run.
+	Skip string
+	// Inspect looks at a passing JSON answer for failures the status does
+	// not show.
+	Inspect func(body []byte) error
+}
+
+func (c check) name() string {
+	return c.Service + " " + c.Kind
+}
+
+// result is how a check went on its last attempt.
+type result struct {
+	Check    check
+	Outcome  string
+	Status   int
+	Duration time.Duration
+	Detail   string
+}
+
+// plan is every service's health and readiness, then one call per service
+// that needs it to work: through the gateway for the services it fronts,
+// and straight to the rest. Calls that need a token are skipped without one.
+func plan(gateway target, services []target, token string) []check {
+	var checks []check
+	for _, t := range append([]target{gateway}, services...) {
+		checks = append(checks,
+			check{Service: t.Name, Kind: "health", Via: t, Path: "/health", Want: []int{http.StatusOK}},
+			// The startup report answers 503 until the self-checks have
+			// run and whenever one failed, so it doubles as readiness.
+			check{Service: t.Name, Kind: "ready", Via: t, Path: "/health/startup-report", Want: []int{http.StatusOK}},
+		)
+	}
+
+	// Lookups of a token nobody holds reach the backend and come back 404,
+	// while a backend that is down or unreachable comes back 502.
+	probe := "smoke-" + randomHex(8)
+	checks = append(checks, check{Service: gatewayName, Kind: "root", Via: gateway, Path: "/", Want: []int{http.StatusOK}})
+	for _, t := range services {
+		c := check{Service: t.Name, Kind: "api", Via: gateway}
+		switch t.Name {
+		case "user-service":
+			c.Path, c.Want = "/api/profiles/"+probe, []int{http.StatusNotFound}
+		case "order-service":
+			c.Path, c.Want = "/api/track/"+probe, []int{http.StatusNotFound}
+		case "notification-service":
+			// The dashboard fans out to user, order and notification
+			// services, and says which of them failed.
+			user := tokenUser(token)
+			c.Path, c.Want, c.Inspect = fmt.Sprintf("/api/dashboard/%d", user), []int{http.StatusOK}, noWarnings
+			if user == 0 {
+				c.Skip = "needs a user's -token"
+			}
+		case "inventory-service":
+			c.Via, c.Path, c.Want = t, "/items?limit=1", []int{http.StatusOK}
+		case "payment-service":
+			c.Via, c.Path, c.Want = t, "/payments/0", []int{http.StatusNotFound}
+			if token == "" {
+				c.Skip = "needs -token"
+			}
+		default:
+			continue
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// noWarnings fails a dashboard that left out a backend's section.
+func noWarnings(body []byte) error {
+	var dashboard struct {
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &dashboard); err != nil {
+		return err
+	}
+	if len(dashboard.Warnings) > 0 {
+		return fmt.Errorf("dashboard is partial: %s", strings.Join(dashboard.Warnings, "; "))
+	}
+	return nil
+}
+
+// runner sends checks and checks each JSON answer against the spec its
+// target serves at /docs/openapi.yaml.
+type runner struct {
+	client *http.Client
+	token  string
+
+	mu    sync.Mutex
+	specs map[string]*contract.Spec
+}
+
+// runAll runs every check at once and returns the results in the checks'
+// order.
+func (r *runner) runAll(ctx context.Context, checks []check) []result {
+	results := make([]result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = r.run(ctx, c)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (r *runner) run(ctx context.Context, c check) result {
+	res := result{Check: c, Outcome: fail}
+	if c.Skip != "" {
+		res.Outcome, res.Detail = skip, c.Skip
+		return res
+	}
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.Via.URL, "/")+c.Path, nil)
+	if err != nil {
+		res.Detail = err.Error()
+		return res
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		res.Duration, res.Detail = time.Since(start), err.Error()
+		return res
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	res.Status, res.Duration = resp.StatusCode, time.Since(start)
+	if err != nil {
+		res.Detail = err.Error()
+		return res
+	}
+
+	if !wanted(c.Want, resp.StatusCode) {
+		res.Detail = fmt.Sprintf("want %s: %s", statuses(c.Want), snippet(body))
+		return res
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		spec, err := r.spec(ctx, c.Via)
+		if err != nil {
+			res.Detail = "fetching spec: " + err.Error()
+			return res
+		}
+		path, _, _ := strings.Cut(c.Path, "?")
+		if problems := spec.Check(http.MethodGet, path, resp.StatusCode, body); len(problems) > 0 {
+			res.Detail = "breaks the spec: " + strings.Join(problems, "; ")
+			return res
+		}
+	}
+	if c.Inspect != nil {
+		if err := c.Inspect(body); err != nil {
+			res.Detail = err.Error()
+			return res
+		}
+	}
+	res.Outcome = pass
+	return res
+}
+
+// spec fetches a target's spec once per run of the command.
+func (r *runner) spec(ctx context.Context, t target) (*contract.Spec, error) {
+	r.mu.Lock()
+	spec, ok := r.specs[t.URL]
+	r.mu.Unlock()
+	if ok {
+		return spec, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(t.URL, "/")+"/docs/openapi.yaml", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if spec, err = contract.Parse(data); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	if r.specs == nil {
+		r.specs = map[string]*contract.Spec{}
+	}
+	r.specs[t.URL] = spec
+	r.mu.Unlock()
+	return spec, nil
+}
+
+// failing counts the failed checks. Skipped checks do not count.
+func failing(results []result) int {
+	n := 0
+	for _, res := range results {
+		if res.Outcome == fail {
+			n++
+		}
+	}
+	return n
+}
+
+// report prints one line per check and a summary line.
+func report(w io.Writer, results []result) {
+	counts := map[string]int{}
+	for _, res := range results {
+		counts[res.Outcome]++
+		line := fmt.Sprintf("%s  %-32s GET %s%s", res.Outcome, res.Check.name(), res.Check.Via.Name, res.Check.Path)
+		if res.Status != 0 {
+			line += fmt.Sprintf("  %d in %s", res.Status, res.Duration.Round(time.Millisecond))
+		}
+		if res.Detail != "" {
+			line += "  " + res.Detail
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", counts[pass], counts[fail], counts[skip])
+}
+
+// tokenUser returns the user a token was issued to, from its unverified
+// "user:<id>" subject, or 0 for service tokens and anything unreadable.
+// The services verify the token; the id only picks whose dashboard to ask
+// for.
+func tokenUser(token string) int {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return 0
+	}
+	id, ok := strings.CutPrefix(claims.Subject, "user:")
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(id)
+	return n
+}
+
+func wanted(want []int, status int) bool {
+	for _, w := range want {
+		if w == status {
+			return true
+		}
+	}
+	return false
+}
+
+func statuses(want []int) string {
+	s := make([]string, len(want))
+	for i, w := range want {
+		s[i] = strconv.Itoa(w)
+	}
+	return strings.Join(s, " or ")
+}
+
+// snippet shortens a body for the report.
+func snippet(body []byte) string {
+	s := strings.TrimSpace(string(body))
+	if len(s) > 200 {
+		s = s[:200] + "..."
+	}
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const fakeSpec = `
+paths:
+  /health:
+    get:
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [status]
+                properties:
+                  status:
+                    type: string
+  /health/startup-report:
+    get:
+      responses:
+        "200":
+          description: Report
+  /:
+    get:
+      responses:
+        "200":
+          description: Greeting
+  /api/profiles/{username}:
+    get:
+      responses:
+        "404":
+          $ref: "#/components/responses/Error"
+  /api/track/{token}:
+    get:
+      responses:
+        "404":
+          $ref: "#/components/responses/Error"
+  /api/dashboard/{user_id}:
+    get:
+      responses:
+        "200":
+          description: Dashboard
+  /items:
+    get:
+      responses:
+        "200":
+          description: Items
+  /payments/{id}:
+    get:
+      responses:
+        "404":
+          $ref: "#/components/responses/Error"
+components:
+  responses:
+    Error:
+      content:
+        application/json:
+          schema:
+            type: object
+            required: [error]
+            properties:
+              error:
+                type: string
+`
+
+// fakeDeployment answers for the gateway and every service at once.
+type fakeDeployment struct {
+	health   atomic.Value
+	ready    atomic.Int32
+	warnings string
+	token    string
+}
+
+func (d *fakeDeployment) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(status int, body string) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+	switch path := r.URL.Path; {
+	case path == "/docs/openapi.yaml":
+		w.Write([]byte(fakeSpec))
+	case path == "/health":
+		reply(http.StatusOK, d.health.Load().(string))
+	case path == "/health/startup-report":
+		if d.ready.Add(-1) >= 0 {
+			reply(http.StatusServiceUnavailable, `{"status": "starting"}`)
+			return
+		}
+		reply(http.StatusOK, `{"status": "pass"}`)
+	case path == "/", path == "/items":
+		reply(http.StatusOK, `{}`)
+	case strings.HasPrefix(path, "/api/profiles/"), strings.HasPrefix(path, "/api/track/"), strings.HasPrefix(path, "/payments/"):
+		reply(http.StatusNotFound, `{"error": "not found"}`)
+	case path == "/api/dashboard/7" && r.Header.Get("Authorization") == "Bearer "+d.token:
+		reply(http.StatusOK, `{"warnings": [`+d.warnings+`]}`)
+	default:
+		reply(http.StatusUnauthorized, `{"error": "unexpected request"}`)
+	}
+}
+
+func userToken(subject string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + subject + `"}`))
+	return "e30." + payload + ".sig"
+}
+
+func deploy(t *testing.T) *fakeDeployment {
+	d := &fakeDeployment{token: userToken("user:7")}
+	d.health.Store(`{"status": "healthy"}`)
+	server := httptest.NewServer(d)
+	t.Cleanup(server.Close)
+	for _, name := range []string{"API_GATEWAY_URL", "USER_SERVICE_URL", "ORDER_SERVICE_URL", "INVENTORY_SERVICE_URL", "NOTIFICATION_SERVICE_URL", "PAYMENT_SERVICE_URL"} {
+		t.Setenv(name, server.URL)
+	}
+	return d
+}
+
+func TestSmokePasses(t *testing.T) {
+	deploy(t)
+	var stdout, stderr bytes.Buffer
+	if code := run(nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit 0, got: %d\n%s%s", code, stdout.String(), stderr.String())
+	}
+	out := stdout.String()
+	for _, want := range []string{"PASS  user-service api", "PASS  payment-service ready", "SKIP  notification-service api", "needs a user's -token",
+		"SKIP  payment-service api", "16 passed, 0 failed, 2 skipped"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected the report to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestSmokeWithToken(t *testing.T) {
+	d := deploy(t)
+	var stdout bytes.Buffer
+	if code := run([]string{"-token", d.token}, &stdout, &bytes.Buffer{}); code != 0 || !strings.Contains(stdout.String(), "18 passed, 0 failed, 0 skipped") {
+		t.Fatalf("Expected every check to pass, got: %d\n%s", code, stdout.String())
+	}
+
+	d.warnings = `"orders unavailable"`
+	stdout.Reset()
+	if code := run([]string{"-token", d.token}, &stdout, &bytes.Buffer{}); code != 1 || !strings.Contains(stdout.String(), "dashboard is partial: orders unavailable") {
+		t.Errorf("Expected a partial dashboard to fail, got: %d\n%s", code, stdout.String())
+	}
+}
+
+func TestSmokeFails(t *testing.T) {
+	d := deploy(t)
+	d.health.Store(`{"status": 1}`)
+	d.ready.Store(1)
+	var stdout bytes.Buffer
+	if code := run(nil, &stdout, &bytes.Buffer{}); code != 1 {
+		t.Fatalf("Expected exit 1, got: %d\n%s", code, stdout.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "FAIL  api-gateway health") || !strings.Contains(out, "breaks the spec") {
+		t.Errorf("Expected a health answer that breaks the spec to fail, got:\n%s", out)
+	}
+	if !strings.Contains(out, "503") || !strings.Contains(out, "want 200") {
+		t.Errorf("Expected an unready service to fail, got:\n%s", out)
+	}
+}
+
+func TestSmokeWaits(t *testing.T) {
+	d := deploy(t)
+	d.ready.Store(12)
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-wait", "5s", "-interval", "10ms"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the checks to pass once the services are ready, got: %d\n%s", code, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Attempt 1:") {
+		t.Errorf("Expected the retries to be logged, got: %s", stderr.String())
+	}
+
+	d.ready.Store(1000)
+	start := time.Now()
+	if code := run([]string{"-wait", "50ms", "-interval", "10ms"}, &bytes.Buffer{}, &bytes.Buffer{}); code != 1 || time.Since(start) > 2*time.Second {
+		t.Errorf("Expected to give up after the wait, got: %d after %s", code, time.Since(start))
+	}
+}
+
+func TestTokenUser(t *testing.T) {
+	tests := map[string]int{
+		userToken("user:7"):         7,
+		userToken("service:orders"): 0,
+		"not-a-jwt":                 0,
+		"a.!!!.c":                   0,
+	}
+	for token, want := range tests {
+		if got := tokenUser(token); got != want {
+			t.Errorf("tokenUser(%q) = %d, want %d", token, got, want)
+		}
+	}
+}
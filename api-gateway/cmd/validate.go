@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/alux444/go-microserv-test/api-gateway/api"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/accesslog"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/apikeys"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/attribution"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/clientip"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/contract"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/debuglog"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/policy"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/priority"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/quota"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/ratelimit"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/responsecache"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/routing"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/upstream"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/docs"
+	"github.com/alux444/go-microserv-test/pkg/flags"
+	"github.com/alux444/go-microserv-test/pkg/recovery"
+	"github.com/alux444/go-microserv-test/pkg/startup"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// middlewareSettings are the environment settings validate-config parses
+// the way main does, with the defaults main falls back to.
+var middlewareSettings = []struct {
+	name, fallback string
+	check          func(value string) error
+}{
+	{"ACCESS_LOG_SAMPLING", "", func(v string) error { _, err := accesslog.ParseRules(v); return err }},
+	{"ATTRIBUTION_RULES", defaultAttributionRules, func(v string) error { _, err := attribution.ParseRules(v); return err }},
+	{"CACHE_RULES", defaultCacheRules, func(v string) error { _, err := responsecache.ParseRules(v); return err }},
+	{"CONTRACT_VALIDATION", contract.ModeOff, func(v string) error { _, err := contract.NewValidator(v); return err }},
+	{"DEBUG_LOG_ROUTES", "", func(v string) error { _, err := debuglog.ParseRoutes(v); return err }},
+	{"FAULT_INJECTION_ENABLED", "false", func(v string) error { _, err := faultInjection(v); return err }},
+	{"FEATURE_FLAGS", "", func(string) error { _, err := flags.FromEnv(); return err }},
+	{"PORTAL_KEY_SCOPES", defaultPortalKeyScopes, func(v string) error { _, err := apikeys.ParseScopes(v); return err }},
+	{"PRIORITY_POOLS", "", func(v string) error { _, err := priority.ParsePools(v); return err }},
+	{"PRIORITY_RULES", defaultPriorityRules, func(v string) error { _, err := priority.ParseRules(v); return err }},
+	{"PRIORITY_SHED_AT", "", func(v string) error { _, err := priority.ParseShedAt(v); return err }},
+	{"QUOTA_RULES", "", func(v string) error { _, err := quota.ParseRules(v); return err }},
+	{"PUBLIC_RATE_LIMITS", defaultPublicRateLimits, func(v string) error { _, err := ratelimit.ParseRules(v); return err }},
+	{"SENTRY_DSN", "", func(string) error { _, err := recovery.FromEnv(); return err }},
+	{"TRUSTED_PROXIES", "", func(v string) error { _, err := clientip.NewResolver(v, clientip.XForwardedFor); return err }},
+	{"TRUSTED_PROXY_HEADER", clientip.XForwardedFor, func(v string) error { _, err := clientip.NewResolver("", v); return err }},
+}
+
+// effectiveConfig is what the gateway would run with, as validate-config
+// prints it.
+type effectiveConfig struct {
+	Routing    routing.State     `json:"routing"`
+	Policies   policy.State      `json:"policies"`
+	Upstreams  []upstreamConfig  `json:"upstreams"`
+	CORS       corsConfig        `json:"cors"`
+	Middleware map[string]string `json:"middleware"`
+}
+
+type upstreamConfig struct {
+	Service   string `json:"service"`
+	Primary   string `json:"primary"`
+	Secondary string `json:"secondary,omitempty"`
+}
+
+type corsConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           string   `json:"max_age"`
+}
+
+// report collects what validate-config finds.
+type report struct {
+	errors, warnings []string
+}
+
+func (r *report) errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// validateConfig runs "api-gateway validate-config": it loads the routing
+// and policy files and the middleware settings as the gateway would at
+// startup, reports each problem on stderr and prints the config that would
+// be in force as YAML on stdout. It returns the exit code, 1 if anything is
+// invalid, or with -strict if anything is merely suspect.
+func validateConfig(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	routesFile := fs.String("routes", config.GetEnv("GATEWAY_ROUTES_FILE", ""), "routing file to check")
+	policyFile := fs.String("policies", config.GetEnv("GATEWAY_POLICY_FILE", ""), "policy file to check")
+	probe := fs.Bool("probe", false, "check that every backend answers /health")
+	probeTimeout := fs.Duration("probe-timeout", 3*time.Second, "how long to wait for each backend")
+	strict := fs.Bool("strict", false, "fail on warnings as well as errors")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	var r report
+	effective := effectiveConfig{Middleware: map[string]string{}}
+
+	if err := config.Load(); err != nil {
+		r.errorf("CONFIG_FILE: %v", err)
+	}
+	if err := startup.Config(configVars...).Run(context.Background()); err != nil {
+		r.errorf("%v", err)
+	}
+	_, serviceToken, exchanger, err := serviceAuth()
+	if err != nil {
+		r.errorf("%v", err)
+	}
+
+	services := backends()
+	upstreams := upstream.New(upstream.Options{})
+	for _, b := range services {
+		if err := upstreams.Add(b.service, b.primary, b.secondary); err != nil {
+			r.errorf("upstreams: %v", err)
+		}
+		effective.Upstreams = append(effective.Upstreams, upstreamConfig{Service: b.service, Primary: b.primary, Secondary: b.secondary})
+	}
+
+	builtin := builtinBackends(services)
+	if routes, err := routing.New(*routesFile, builtin, http.DefaultTransport); err != nil {
+		r.errorf("%s: %v", *routesFile, err)
+	} else {
+		effective.Routing = routes.State()
+		if *routesFile != "" {
+			r.warnings = append(r.warnings, routeConflicts(*routesFile, builtin, exchanger != nil, services)...)
+		}
+	}
+	if policies, err := policy.New(*policyFile, serviceToken); err != nil {
+		r.errorf("%s: %v", *policyFile, err)
+	} else {
+		effective.Policies = policies.State()
+	}
+
+	cors := corsFromEnv()
+	if err := cors.Validate(); err != nil {
+		r.errorf("CORS: %v", err)
+	}
+	effective.CORS = corsConfig{AllowedOrigins: cors.AllowedOrigins, AllowedMethods: cors.AllowedMethods, AllowedHeaders: cors.AllowedHeaders,
+		ExposedHeaders: cors.ExposedHeaders, AllowCredentials: cors.AllowCredentials, MaxAge: cors.MaxAge.String()}
+	for _, s := range middlewareSettings {
+		value := config.GetEnv(s.name, s.fallback)
+		if err := s.check(value); err != nil {
+			r.errorf("%s: %v", s.name, err)
+		}
+		effective.Middleware[s.name] = value
+	}
+
+	if *probe {
+		probeBackends(&r, effective, *probeTimeout)
+	}
+
+	out, err := marshalYAML(effective)
+	if err != nil {
+		r.errorf("printing the effective config: %v", err)
+	}
+	stdout.Write(out)
+	for _, msg := range r.errors {
+		fmt.Fprintln(stderr, "error:", msg)
+	}
+	for _, msg := range r.warnings {
+		fmt.Fprintln(stderr, "warning:", msg)
+	}
+	if len(r.errors) > 0 || (*strict && len(r.warnings) > 0) {
+		return 1
+	}
+	return 0
+}
+
+// routeConflicts reads the routing file again for its raw config, which has
+// already been validated, and checks it against the routes the gateway
+// serves itself.
+func routeConflicts(path string, builtin map[string]string, exchange bool, services []backend) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	cfg, err := routing.Parse(data, builtin)
+	if err != nil {
+		return nil
+	}
+	return routing.Conflicts(cfg, ownRoutes(exchange, services))
+}
+
+// ownRoutes lists the routes the gateway's router matches before falling
+// through to the routing table, as "METHOD /path".
+func ownRoutes(exchange bool, services []backend) []string {
+	engine := gin.New()
+	registerAPIRoutes(engine, clients.NewUserClient(services[0].primary, http.DefaultClient),
+		clients.NewOrderClient(services[1].primary, http.DefaultClient),
+		clients.NewNotificationClient(services[2].primary, http.DefaultClient))
+	docs.Register(engine, "api-gateway", api.Spec)
+	engine.GET("/health/*check", func(*gin.Context) {})
+	engine.GET("/metrics/*name", func(*gin.Context) {})
+	engine.Any("/admin/*path", func(*gin.Context) {})
+	if exchange {
+		engine.POST("/oauth/token", func(*gin.Context) {})
+	}
+	var own []string
+	for _, route := range engine.Routes() {
+		own = append(own, route.Method+" "+route.Path)
+	}
+	sort.Strings(own)
+	return own
+}
+
+// probeBackends checks every backend the effective config would call
+// answers its health check.
+func probeBackends(r *report, effective effectiveConfig, timeout time.Duration) {
+	targets := map[string]string{}
+	for _, u := range effective.Upstreams {
+		targets[u.Service] = u.Primary
+		if u.Secondary != "" {
+			targets[u.Service+" secondary"] = u.Secondary
+		}
+	}
+	for _, b := range effective.Routing.Backends {
+		if len(b.Instances) == 0 {
+			targets[b.Name] = b.URL
+		}
+		for i, instance := range b.Instances {
+			targets[fmt.Sprintf("%s instance %d", b.Name, i+1)] = instance.URL
+		}
+	}
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := startup.Service(name, targets[name]).Run(ctx); err != nil {
+			r.errorf("backend %s at %s is unreachable: %v", name, targets[name], err)
+		}
+		cancel()
+	}
+}
+
+// marshalYAML prints v as YAML with the field names its JSON tags give.
+func marshalYAML(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	blockStyle(&node)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// blockStyle undoes the flow style and quoting JSON parses into. The
+// encoder still quotes strings that would otherwise read as another type.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
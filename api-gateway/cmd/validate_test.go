@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeRoutes(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateConfig(t *testing.T) {
+	t.Setenv("GATEWAY_POLICY_FILE", "")
+
+	tests := []struct {
+		name     string
+		routes   string
+		args     []string
+		wantCode int
+		wantErr  string
+	}{
+		{
+			name:   "valid",
+			routes: "backends:\n  search:\n    url: http://search:9000\nroutes:\n  - prefix: /api/search\n    backend: search\n",
+		},
+		{
+			name:     "unknown field",
+			routes:   "routes:\n  - prefix: /api/search\n    backend: user-service\n    retries: 3\n",
+			wantCode: 1,
+			wantErr:  "error:",
+		},
+		{
+			name:    "conflict warns",
+			routes:  "routes:\n  - prefix: /api/profiles\n    backend: user-service\n",
+			wantErr: "warning: route /api/profiles: GET /api/profiles/:username is served by the gateway itself",
+		},
+		{
+			name:     "conflict fails when strict",
+			routes:   "routes:\n  - prefix: /api/profiles\n    backend: user-service\n",
+			args:     []string{"-strict"},
+			wantCode: 1,
+			wantErr:  "warning:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"-routes", writeRoutes(t, tt.routes)}, tt.args...)
+			if code := validateConfig(args, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("exit code = %d, want %d; stderr:\n%s", code, tt.wantCode, stderr.String())
+			}
+			if tt.wantErr == "" && stderr.Len() > 0 {
+				t.Errorf("stderr = %q, want nothing", stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.wantErr) {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.wantErr)
+			}
+			if err := yaml.Unmarshal(stdout.Bytes(), &map[string]any{}); err != nil {
+				t.Fatalf("stdout is not YAML: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateConfigPrintsMergedConfig(t *testing.T) {
+	t.Setenv("GATEWAY_POLICY_FILE", "")
+	t.Setenv("CACHE_RULES", "/api/users=1m")
+	path := writeRoutes(t, "backends:\n  search:\n    url: http://search:9000\nroutes:\n  - prefix: /api/search\n    backend: search\n    timeout: 5s\n")
+
+	var stdout, stderr bytes.Buffer
+	if code := validateConfig([]string{"-routes", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code = %d; stderr:\n%s", code, stderr.String())
+	}
+	var printed struct {
+		Routing struct {
+			Routes []struct {
+				Prefix  string `yaml:"prefix"`
+				Timeout string `yaml:"timeout"`
+				URL     string `yaml:"url"`
+			} `yaml:"routes"`
+		} `yaml:"routing"`
+		Middleware map[string]string `yaml:"middleware"`
+	}
+	if err := yaml.Unmarshal(stdout.Bytes(), &printed); err != nil {
+		t.Fatalf("stdout is not YAML: %v\n%s", err, stdout.String())
+	}
+	if len(printed.Routing.Routes) != 1 || printed.Routing.Routes[0].URL != "http://search:9000" || printed.Routing.Routes[0].Timeout != "5s" {
+		t.Errorf("routes = %+v", printed.Routing.Routes)
+	}
+	if got := printed.Middleware["CACHE_RULES"]; got != "/api/users=1m" {
+		t.Errorf("CACHE_RULES = %q, want the value from the environment", got)
+	}
+	if got := printed.Middleware["PUBLIC_RATE_LIMITS"]; got != defaultPublicRateLimits {
+		t.Errorf("PUBLIC_RATE_LIMITS = %q, want the default", got)
+	}
+}
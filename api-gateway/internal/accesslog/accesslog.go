@@ -0,0 +1,136 @@
+// Package accesslog writes one JSON line per gateway request, in place of
+// gin's console log, so log pipelines can index requests without parsing
+// text. Busy routes can be sampled; server errors are always logged.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/gin-gonic/gin"
+)
+
+// Rule logs Rate of the requests to paths starting with PathPrefix, from 0
+// (none) to 1 (all).
+type Rule struct {
+	PathPrefix string  `json:"path_prefix"`
+	Rate       float64 `json:"rate"`
+}
+
+// ParseRules parses "prefix=rate" pairs separated by commas, e.g.
+// "/api/products=0.1,/health=0".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, value, ok := strings.Cut(part, "=")
+		prefix = strings.TrimSpace(prefix)
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || !strings.HasPrefix(prefix, "/") || err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid access log sampling rule %q, want prefix=rate with a rate from 0 to 1", part)
+		}
+		rules = append(rules, Rule{PathPrefix: prefix, Rate: rate})
+	}
+	// The longest prefix wins, so /api/products/search can be logged in
+	// full while the rest of /api/products is sampled.
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].PathPrefix) > len(rules[j].PathPrefix) })
+	return rules, nil
+}
+
+// Entry is one logged request.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Upstream  string    `json:"upstream"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	Bytes     int       `json:"bytes"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	// SampleRate is set on sampled lines, so counts can be scaled back up.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+// Logger writes entries to out, one JSON object per line.
+type Logger struct {
+	rules    []Rule
+	upstream func(c *gin.Context) string
+	roll     func() float64
+	now      func() time.Time
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New returns a logger sampling by rules. upstream names the backend a
+// request went to, or "" for requests the gateway answered itself.
+func New(out io.Writer, rules []Rule, upstream func(c *gin.Context) string) *Logger {
+	return &Logger{rules: rules, upstream: upstream, roll: rand.Float64, now: time.Now, out: out}
+}
+
+// rate is the share of requests to path that are logged.
+func (l *Logger) rate(path string) float64 {
+	for _, r := range l.rules {
+		if strings.HasPrefix(path, r.PathPrefix) {
+			return r.Rate
+		}
+	}
+	return 1
+}
+
+// Middleware logs each request once the rest of the chain has answered it.
+// Mount it first, so its latency covers the whole chain and requests
+// turned away by other middleware are logged too. The query string is left
+// out, since it can carry tokens.
+func (l *Logger) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := l.now()
+		c.Next()
+
+		status := c.Writer.Status()
+		rate := l.rate(c.Request.URL.Path)
+		if status < 500 && rate < 1 && l.roll() >= rate {
+			return
+		}
+		e := Entry{
+			Time:      start.UTC(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Upstream:  "gateway",
+			Status:    status,
+			LatencyMS: float64(l.now().Sub(start).Microseconds()) / 1000,
+			Bytes:     max(c.Writer.Size(), 0),
+			RequestID: requestid.FromContext(c.Request.Context()),
+			ClientIP:  c.ClientIP(),
+		}
+		if name := l.upstream(c); name != "" {
+			e.Upstream = name
+		}
+		if status < 500 && rate < 1 {
+			e.SampleRate = rate
+		}
+		l.write(e)
+	}
+}
+
+func (l *Logger) write(e Entry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
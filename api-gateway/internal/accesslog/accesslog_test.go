@@ -0,0 +1,84 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRules(t *testing.T) {
+	for _, spec := range []string{"/api=2", "/api=-0.1", "api=0.5", "/api", "/api=half"} {
+		if _, err := ParseRules(spec); err == nil {
+			t.Errorf("ParseRules(%q): expected an error", spec)
+		}
+	}
+	rules, err := ParseRules("/api/products=0.1, /api/products/search=1,/health=0")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	if len(rules) != 3 || rules[0].PathPrefix != "/api/products/search" {
+		t.Errorf("Expected the longest prefix first, got: %+v", rules)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var out bytes.Buffer
+	rules, _ := ParseRules("/api/products=0.25,/health=0")
+	logger := New(&out, rules, func(c *gin.Context) string { return c.GetString("backend") })
+
+	router := gin.New()
+	router.Use(logger.Middleware(), requestid.Middleware())
+	router.GET("/api/orders/:id", func(c *gin.Context) {
+		c.Set("backend", "order-service")
+		c.String(http.StatusOK, "hello")
+	})
+	router.GET("/api/products", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusServiceUnavailable) })
+
+	entries := func(path string, roll float64) []Entry {
+		out.Reset()
+		logger.roll = func() float64 { return roll }
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(requestid.Header, "req-1")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		var got []Entry
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var e Entry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("Expected a JSON line, got: %q", line)
+			}
+			got = append(got, e)
+		}
+		return got
+	}
+
+	got := entries("/api/orders/7?token=secret", 0.99)
+	if len(got) != 1 {
+		t.Fatalf("Expected one line, got: %+v", got)
+	}
+	e := got[0]
+	if e.Method != "GET" || e.Path != "/api/orders/7" || e.Upstream != "order-service" || e.Status != 200 ||
+		e.Bytes != 5 || e.RequestID != "req-1" || e.ClientIP == "" || e.SampleRate != 0 {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	if got := entries("/api/products", 0.5); len(got) != 0 {
+		t.Errorf("Expected the request to be sampled out, got: %+v", got)
+	}
+	if got := entries("/api/products", 0.1); len(got) != 1 || got[0].SampleRate != 0.25 || got[0].Upstream != "gateway" {
+		t.Errorf("Expected a sampled line, got: %+v", got)
+	}
+	if got := entries("/health", 0.5); len(got) != 1 || got[0].Status != 503 {
+		t.Errorf("Expected a server error to be logged despite a zero rate, got: %+v", got)
+	}
+}
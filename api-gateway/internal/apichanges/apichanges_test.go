@@ -0,0 +1,440 @@
+package apichanges
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/api-gateway/api"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+type memStore struct {
+	snapshots []Snapshot
+	changes   []Change
+	// conflict makes the next Save lose to another replica.
+	conflict bool
+}
+
+func (s *memStore) Latest(ctx context.Context) (*Snapshot, error) {
+	if len(s.snapshots) == 0 {
+		return nil, ErrNotFound
+	}
+	snap := s.snapshots[len(s.snapshots)-1]
+	return &snap, nil
+}
+
+func (s *memStore) Save(ctx context.Context, previous int64, snap *Snapshot, changes []Change) error {
+	if s.conflict {
+		s.conflict = false
+		return ErrConflict
+	}
+	snap.ID = int64(len(s.snapshots) + 1)
+	s.snapshots = append(s.snapshots, *snap)
+	for i := range changes {
+		changes[i].ID, changes[i].SnapshotID = int64(len(s.changes)+1), snap.ID
+		s.changes = append(s.changes, changes[i])
+	}
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, q Query) ([]Change, error) {
+	out := []Change{}
+	for i := len(s.changes) - 1; i >= 0 && len(out) < q.Limit; i-- {
+		c := s.changes[i]
+		if (q.Service == "" || c.Service == q.Service) && (!q.Breaking || c.Breaking) && (q.Before == 0 || c.ID < q.Before) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, e)
+	return nil
+}
+
+const baseSpec = `
+openapi: 3.0.3
+paths:
+  /orders:
+    get:
+      parameters:
+        - name: limit
+          in: query
+          schema:
+            type: integer
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  orders:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/Order"
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [sku]
+              properties:
+                sku:
+                  type: string
+                gift:
+                  type: boolean
+      responses:
+        "201":
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Order"
+        "400":
+          $ref: "#/components/responses/Error"
+  /orders/{id}:
+    parameters:
+      - $ref: "#/components/parameters/ID"
+    get:
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Order"
+components:
+  parameters:
+    ID:
+      name: id
+      in: path
+      required: true
+      schema:
+        type: integer
+  responses:
+    Error:
+      description: Error
+      content:
+        application/json:
+          schema:
+            type: object
+            properties:
+              error:
+                type: string
+  schemas:
+    Base:
+      type: object
+      required: [id]
+      properties:
+        id:
+          type: integer
+    Order:
+      allOf:
+        - $ref: "#/components/schemas/Base"
+        - type: object
+          required: [status, total]
+          properties:
+            status:
+              type: string
+              enum: [pending, paid]
+            total:
+              type: number
+`
+
+func TestFlatten(t *testing.T) {
+	ops, err := Flatten([]byte(baseSpec))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(ops) != 3 {
+		t.Fatalf("Expected three operations, got: %v", ops)
+	}
+	get := ops["GET /orders/{id}"]
+	if get == nil || get.Parameters["path id"] == nil || !get.Parameters["path id"].Required {
+		t.Fatalf("Expected the path-level parameter to be resolved onto the operation, got: %+v", get)
+	}
+	order := get.Responses["200"]
+	if order.Type != "object" || strings.Join(order.Required, ",") != "id,status,total" || order.Properties["status"] == nil ||
+		strings.Join(order.Properties["status"].Enum, ",") != "paid,pending" {
+		t.Errorf("Expected allOf to be merged into one object, got: %+v", order)
+	}
+	if post := ops["POST /orders"]; !post.BodyRequired || post.Responses["400"].Properties["error"] == nil {
+		t.Errorf("Expected the body and the shared error response, got: %+v", post)
+	}
+
+	// The gateway's own spec must flatten, or its changelog would be empty.
+	if ops, err := Flatten(api.Spec); err != nil || len(ops) == 0 {
+		t.Errorf("Expected the gateway spec to flatten, got: %d operations, %v", len(ops), err)
+	}
+}
+
+func surface(t *testing.T, spec string) Surface {
+	ops, err := Flatten([]byte(spec))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	return Surface{"order-service": ops}
+}
+
+func TestDiff(t *testing.T) {
+	old := surface(t, baseSpec)
+	if changes := Diff(old, surface(t, baseSpec)); len(changes) != 0 {
+		t.Errorf("Expected no changes between equal specs, got: %+v", changes)
+	}
+
+	next := strings.NewReplacer(
+		// total is no longer returned.
+		`          required: [status, total]
+          properties:
+            status:
+              type: string
+              enum: [pending, paid]
+            total:
+              type: number`, `          required: [status]
+          properties:
+            status:
+              type: string
+              enum: [pending, paid, refunded]
+            note:
+              type: string`,
+		// limit is now required and orders gained a cursor.
+		`        - name: limit
+          in: query
+          schema:`, `        - name: limit
+          in: query
+          required: true
+          schema:`,
+		// POST /orders needs a quantity.
+		`              required: [sku]
+              properties:`, `              required: [sku, quantity]
+              properties:
+                quantity:
+                  type: integer`,
+		// GET /orders/{id} is on its way out.
+		`    get:
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Order"
+components:`, `    get:
+      deprecated: true
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Order"
+components:`,
+	).Replace(baseSpec)
+
+	got := map[string]Change{}
+	for _, c := range Diff(old, surface(t, next)) {
+		got[c.Method+" "+c.Path+" "+c.Kind+" "+c.Location] = c
+	}
+	for key, breaking := range map[string]bool{
+		"GET /orders parameter_required query limit":                  true,
+		"GET /orders property_removed response 200 $.orders[].total":  true,
+		"GET /orders property_added response 200 $.orders[].note":     false,
+		"GET /orders enum_value_added response 200 $.orders[].status": false,
+		"POST /orders property_added request body $.quantity":         true,
+		"POST /orders property_removed response 201 $.total":          true,
+		"GET /orders/{id} operation_deprecated ":                      false,
+		"GET /orders/{id} property_removed response 200 $.total":      true,
+		"GET /orders/{id} enum_value_added response 200 $.status":     false,
+		"POST /orders enum_value_added response 201 $.status":         false,
+		"GET /orders/{id} property_added response 200 $.note":         false,
+		"POST /orders property_added response 201 $.note":             false,
+	} {
+		c, ok := got[key]
+		if !ok {
+			t.Errorf("Expected %q, got: %v", key, got)
+			continue
+		}
+		if c.Breaking != breaking {
+			t.Errorf("Expected %q to be breaking=%t, got: %+v", key, breaking, c)
+		}
+	}
+	if len(got) != 12 {
+		t.Errorf("Expected exactly the listed changes, got: %v", got)
+	}
+
+	removed := Diff(old, Surface{"order-service": map[string]*Operation{"GET /orders": old["order-service"]["GET /orders"]}})
+	if len(removed) != 2 || !removed[0].Breaking || removed[0].Kind != KindOperationRemoved {
+		t.Errorf("Expected removed operations to break, breaking first, got: %+v", removed)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	spec := baseSpec
+	up := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up || r.URL.Path != "/docs/openapi.yaml" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(spec))
+	}))
+	defer backend.Close()
+
+	store := &memStore{}
+	publisher := &recordingPublisher{}
+	tracker := NewTracker(store, publisher, Source{Service: "order-service", BaseURL: backend.URL})
+	ctx := context.Background()
+
+	if _, err := tracker.Spec(); !errors.Is(err, ErrNoSpec) {
+		t.Errorf("Expected no spec before the first check, got: %v", err)
+	}
+	if changes, err := tracker.Check(ctx); err != nil || len(changes) != 0 || len(store.snapshots) != 1 {
+		t.Fatalf("Expected the first check to record a baseline, got: %+v, %v, %d snapshots", changes, err, len(store.snapshots))
+	}
+	if merged, err := tracker.Spec(); err != nil || !strings.Contains(string(merged), "order-service.") {
+		t.Errorf("Expected the spec read by the check to be merged, got: %v", err)
+	}
+	if changes, err := tracker.Check(ctx); err != nil || len(changes) != 0 || len(store.snapshots) != 1 {
+		t.Errorf("Expected an unchanged spec to record nothing, got: %+v, %v", changes, err)
+	}
+
+	up = false
+	if changes, err := tracker.Check(ctx); err != nil || len(changes) != 0 || len(store.snapshots) != 1 {
+		t.Errorf("Expected an unreadable spec not to read as removals, got: %+v, %v", changes, err)
+	}
+
+	up = true
+	spec = strings.Replace(baseSpec, "  /orders/{id}:\n    parameters:\n      - $ref: \"#/components/parameters/ID\"\n    get:\n", "  /orders/{id}:\n    parameters:\n      - $ref: \"#/components/parameters/ID\"\n    delete:\n", 1)
+	store.conflict = true
+	if changes, err := tracker.Check(ctx); err != nil || changes != nil || len(publisher.events) != 0 {
+		t.Errorf("Expected a change another replica recorded to be left to it, got: %+v, %v", changes, err)
+	}
+	changes, err := tracker.Check(ctx)
+	if err != nil || len(changes) != 2 || changes[0].Kind != KindOperationRemoved || changes[1].Kind != KindOperationAdded {
+		t.Fatalf("Expected GET to be replaced by DELETE, got: %+v, %v", changes, err)
+	}
+	if len(publisher.events) != 1 || publisher.events[0].Type != events.GatewayAPIChanged {
+		t.Fatalf("Expected the changes to be announced, got: %+v", publisher.events)
+	}
+	var payload events.APIChanged
+	publisher.events[0].Decode(&payload)
+	if payload.SnapshotID != 2 || payload.Breaking != 1 || len(payload.Changes) != 2 || payload.Changes[0].Path != "/orders/{id}" {
+		t.Errorf("Expected one breaking change in snapshot 2, got: %+v", payload)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{changes: []Change{
+		{ID: 1, Service: "order-service", Kind: KindOperationAdded},
+		{ID: 2, Service: "user-service", Kind: KindOperationRemoved, Breaking: true},
+		{ID: 3, Service: "order-service", Kind: KindPropertyRemoved, Breaking: true},
+	}}
+	router := gin.New()
+	NewHandler(NewTracker(store, &recordingPublisher{})).RegisterAdminRoutes(router)
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got: %d %s", path, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	if body := get("/api-changes?breaking=true&limit=1"); !strings.Contains(body, `"id":3`) || !strings.Contains(body, `"next_before":3`) {
+		t.Errorf("Expected the newest breaking change and a next page, got: %s", body)
+	}
+	if body := get("/api-changes?breaking=true&before=3"); !strings.Contains(body, `"id":2`) || strings.Contains(body, "next_before") {
+		t.Errorf("Expected the last breaking change, got: %s", body)
+	}
+	if body := get("/api-changes?service=order-service"); strings.Contains(body, "user-service") || !strings.Contains(body, `"id":1`) {
+		t.Errorf("Expected only order-service changes, got: %s", body)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	users := `openapi: 3.0.3
+paths:
+  /health:
+    get:
+      responses:
+        "200":
+          description: ok
+  /users:
+    get:
+      security:
+        - bearerAuth: []
+      responses:
+        "400":
+          $ref: "#/components/responses/Error"
+components:
+  securitySchemes:
+    bearerAuth:
+      type: http
+      scheme: bearer
+  responses:
+    Error:
+      description: An error
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Error"
+  schemas:
+    Error:
+      type: object
+`
+	orders := `openapi: 3.0.3
+paths:
+  /health:
+    get:
+      summary: order-service health
+      responses:
+        "200":
+          description: ok
+components:
+  schemas:
+    Error:
+      type: string
+`
+	data, err := Merge([]Source{{Service: "user-service", Spec: []byte(users)}, {Service: "order-service", Spec: []byte(orders)}})
+	if err != nil {
+		t.Fatalf("Expected the specs to merge, got: %v", err)
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Summary string   `yaml:"summary"`
+			Tags    []string `yaml:"tags"`
+		} `yaml:"paths"`
+		Components map[string]map[string]any `yaml:"components"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Expected valid YAML, got: %v", err)
+	}
+	if op := doc.Paths["/health"]["get"]; op.Summary != "" || len(op.Tags) != 1 || op.Tags[0] != "user-service" {
+		t.Errorf("Expected the first service's /health, tagged with it, got: %+v", op)
+	}
+	schemas := doc.Components["schemas"]
+	if len(schemas) != 2 || schemas["user-service.Error"] == nil || schemas["order-service.Error"] == nil {
+		t.Errorf("Expected both services' Error schemas under their own names, got: %v", schemas)
+	}
+	if doc.Components["securitySchemes"]["bearerAuth"] == nil {
+		t.Errorf("Expected security schemes to keep their names, got: %v", doc.Components["securitySchemes"])
+	}
+	if !strings.Contains(string(data), `$ref: '#/components/schemas/user-service.Error'`) || !strings.Contains(string(data), `$ref: '#/components/responses/user-service.Error'`) {
+		t.Errorf("Expected references to point at the renamed components, got:\n%s", data)
+	}
+}
@@ -0,0 +1,237 @@
+package apichanges
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of change. Whether one is breaking depends on which side of the
+// call it is on: a client must send what requests require and may rely on
+// what responses promise.
+const (
+	KindOperationAdded      = "operation_added"
+	KindOperationRemoved    = "operation_removed"
+	KindOperationDeprecated = "operation_deprecated"
+	KindParameterAdded      = "parameter_added"
+	KindParameterRemoved    = "parameter_removed"
+	KindParameterRequired   = "parameter_required"
+	KindBodyAdded           = "request_body_added"
+	KindBodyRequired        = "request_body_required"
+	KindResponseAdded       = "response_added"
+	KindResponseRemoved     = "response_removed"
+	KindPropertyAdded       = "property_added"
+	KindPropertyRemoved     = "property_removed"
+	KindPropertyRequired    = "property_required"
+	KindPropertyOptional    = "property_optional"
+	KindTypeChanged         = "type_changed"
+	KindNullable            = "nullable_changed"
+	KindEnumValueAdded      = "enum_value_added"
+	KindEnumValueRemoved    = "enum_value_removed"
+)
+
+// Change is one difference between two surfaces. Location is where in the
+// operation it is, such as "query limit" or "response 200 $.items[].id".
+type Change struct {
+	ID          int64     `json:"id"`
+	SnapshotID  int64     `json:"snapshot_id"`
+	Service     string    `json:"service"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Kind        string    `json:"kind"`
+	Breaking    bool      `json:"breaking"`
+	Location    string    `json:"location,omitempty"`
+	Description string    `json:"description"`
+	DetectedAt  time.Time `json:"detected_at"`
+}
+
+// Diff lists the changes from old to new, breaking ones first, then by
+// service, path and method.
+func Diff(old, new Surface) []Change {
+	var d differ
+	for _, service := range keys(old, new) {
+		for _, key := range keys(old[service], new[service]) {
+			d.service = service
+			d.method, d.path, _ = strings.Cut(key, " ")
+			d.operation(old[service][key], new[service][key])
+		}
+	}
+	sort.SliceStable(d.changes, func(i, j int) bool {
+		a, b := d.changes[i], d.changes[j]
+		if a.Breaking != b.Breaking {
+			return a.Breaking
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Method < b.Method
+	})
+	return d.changes
+}
+
+// keys returns the keys of both maps, sorted.
+func keys[V any](a, b map[string]V) []string {
+	seen := map[string]bool{}
+	for k := range a {
+		seen[k] = true
+	}
+	for k := range b {
+		seen[k] = true
+	}
+	out := make([]string, 0, len(seen))
+	for k := range seen {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type differ struct {
+	service, method, path string
+	changes               []Change
+}
+
+func (d *differ) add(kind string, breaking bool, location, format string, args ...any) {
+	d.changes = append(d.changes, Change{Service: d.service, Method: d.method, Path: d.path, Kind: kind, Breaking: breaking,
+		Location: location, Description: fmt.Sprintf(format, args...)})
+}
+
+func (d *differ) operation(old, new *Operation) {
+	switch {
+	case old == nil:
+		d.add(KindOperationAdded, false, "", "%s %s was added", d.method, d.path)
+		return
+	case new == nil:
+		d.add(KindOperationRemoved, true, "", "%s %s was removed", d.method, d.path)
+		return
+	}
+	if new.Deprecated && !old.Deprecated {
+		d.add(KindOperationDeprecated, false, "", "%s %s is deprecated and may be removed in a later release", d.method, d.path)
+	}
+
+	for _, key := range keys(old.Parameters, new.Parameters) {
+		was, now := old.Parameters[key], new.Parameters[key]
+		switch {
+		case was == nil:
+			d.add(KindParameterAdded, now.Required, key, "%s parameter was added%s", key, requiredNote(now.Required))
+		case now == nil:
+			d.add(KindParameterRemoved, false, key, "%s parameter was removed and is ignored", key)
+		default:
+			if now.Required && !was.Required {
+				d.add(KindParameterRequired, true, key, "%s parameter is now required", key)
+			}
+			d.shape(was.Schema, now.Schema, key, false)
+		}
+	}
+
+	switch {
+	case old.Body == nil && new.Body != nil:
+		d.add(KindBodyAdded, new.BodyRequired, "request body", "a request body was added%s", requiredNote(new.BodyRequired))
+	case old.Body != nil && new.Body != nil:
+		if new.BodyRequired && !old.BodyRequired {
+			d.add(KindBodyRequired, true, "request body", "the request body is now required")
+		}
+		d.shape(old.Body, new.Body, "request body $", false)
+	}
+
+	for _, status := range keys(old.Responses, new.Responses) {
+		was, now := old.Responses[status], new.Responses[status]
+		at := "response " + status
+		switch {
+		case was == nil:
+			d.add(KindResponseAdded, false, at, "status %s can now be returned", status)
+		case now == nil:
+			// Clients may depend on a documented success; a documented
+			// error they stop getting costs them nothing.
+			d.add(KindResponseRemoved, strings.HasPrefix(status, "2"), at, "status %s is no longer returned", status)
+		default:
+			d.shape(was, now, at+" $", true)
+		}
+	}
+}
+
+func requiredNote(required bool) string {
+	if required {
+		return " and is required"
+	}
+	return ""
+}
+
+// shape compares two schemas at at. In responses, clients lose what is
+// taken away; in requests, they must send what is newly asked for.
+func (d *differ) shape(old, new *Shape, at string, response bool) {
+	if old == nil || new == nil {
+		return
+	}
+	if old.Type != "" && new.Type != "" && old.Type != new.Type {
+		d.add(KindTypeChanged, true, at, "%s changed from %s to %s", at, old.Type, new.Type)
+		return
+	}
+	if response && new.Nullable && !old.Nullable {
+		d.add(KindNullable, true, at, "%s can now be null", at)
+	}
+	if !response && old.Nullable && !new.Nullable {
+		d.add(KindNullable, true, at, "%s can no longer be null", at)
+	}
+
+	// Clients are expected to tolerate response values they do not know,
+	// so only a request value that is no longer accepted breaks them.
+	if len(old.Enum) > 0 && len(new.Enum) > 0 {
+		for _, v := range missing(new.Enum, old.Enum) {
+			d.add(KindEnumValueAdded, false, at, "%s can now be %q", at, v)
+		}
+		for _, v := range missing(old.Enum, new.Enum) {
+			d.add(KindEnumValueRemoved, !response, at, "%s can no longer be %q", at, v)
+		}
+	}
+
+	wasRequired, nowRequired := set(old.Required), set(new.Required)
+	for _, name := range keys(old.Properties, new.Properties) {
+		was, now := old.Properties[name], new.Properties[name]
+		prop := at + "." + name
+		switch {
+		case !hasKey(old.Properties, name):
+			d.add(KindPropertyAdded, !response && nowRequired[name], prop, "%s was added%s", prop, requiredNote(!response && nowRequired[name]))
+		case !hasKey(new.Properties, name):
+			d.add(KindPropertyRemoved, response, prop, "%s was removed", prop)
+		default:
+			if response && wasRequired[name] && !nowRequired[name] {
+				d.add(KindPropertyOptional, true, prop, "%s may now be missing", prop)
+			}
+			if !response && nowRequired[name] && !wasRequired[name] {
+				d.add(KindPropertyRequired, true, prop, "%s is now required", prop)
+			}
+			d.shape(was, now, prop, response)
+		}
+	}
+	d.shape(old.Items, new.Items, at+"[]", response)
+}
+
+func hasKey(m map[string]*Shape, k string) bool {
+	_, ok := m[k]
+	return ok
+}
+
+// missing returns the values in a that are not in b.
+func missing(a, b []string) []string {
+	in := set(b)
+	var out []string
+	for _, v := range a {
+		if !in[v] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func set(values []string) map[string]bool {
+	out := make(map[string]bool, len(values))
+	for _, v := range values {
+		out[v] = true
+	}
+	return out
+}
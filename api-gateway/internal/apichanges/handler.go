@@ -0,0 +1,95 @@
+package apichanges
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 500
+)
+
+type Handler struct {
+	tracker *Tracker
+}
+
+func NewHandler(tracker *Tracker) *Handler {
+	return &Handler{tracker: tracker}
+}
+
+// RegisterAdminRoutes mounts the changelog on an admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/api-changes", h.list)
+	router.POST("/api-changes/check", h.check)
+}
+
+// RegisterPortalRoutes mounts the changelog and the merged spec on the
+// developer portal's group.
+func (h *Handler) RegisterPortalRoutes(router gin.IRouter) {
+	router.GET("/changelog", h.list)
+	router.GET("/openapi.yaml", h.spec)
+}
+
+// list pages through changes newest first. Pass next_before from a page as
+// ?before= to get the next one; ?breaking=true keeps only breaking changes.
+func (h *Handler) list(c *gin.Context) {
+	q := Query{Service: c.Query("service"), Breaking: c.Query("breaking") == "true"}
+	if raw := c.Query("before"); raw != "" {
+		var err error
+		if q.Before, err = strconv.ParseInt(raw, 10, 64); err != nil || q.Before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a change id"})
+			return
+		}
+	}
+	q.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if q.Limit <= 0 || q.Limit > maxLimit {
+		q.Limit = defaultLimit
+	}
+
+	// One extra change tells whether there is another page.
+	limit := q.Limit
+	q.Limit++
+	changes, err := h.tracker.store.List(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"changes": changes}
+	if len(changes) > limit {
+		changes = changes[:limit]
+		resp["changes"] = changes
+		resp["next_before"] = changes[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// check compares the specs now rather than waiting for the next interval,
+// such as right after a deploy.
+func (h *Handler) check(c *gin.Context) {
+	changes, err := h.tracker.Check(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if changes == nil {
+		changes = []Change{}
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": changes})
+}
+
+func (h *Handler) spec(c *gin.Context) {
+	spec, err := h.tracker.Spec()
+	if errors.Is(err, ErrNoSpec) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/yaml", spec)
+}
@@ -0,0 +1,140 @@
+package apichanges
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNoSpec is returned by Spec before any service's spec has been read.
+var ErrNoSpec = errors.New("no API spec has been read yet")
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Spec merges the specs the last check read into one OpenAPI document, so
+// integrators can browse or generate a client for the whole API at once.
+// Services whose spec could not be read yet are left out.
+func (t *Tracker) Spec() ([]byte, error) {
+	t.specsMu.RLock()
+	defer t.specsMu.RUnlock()
+	var sources []Source
+	for _, src := range t.sources {
+		if data, ok := t.specs[src.Service]; ok {
+			sources = append(sources, Source{Service: src.Service, Spec: data})
+		}
+	}
+	if len(sources) == 0 {
+		return nil, ErrNoSpec
+	}
+	return Merge(sources)
+}
+
+// Merge combines the specs of sources into one document. Each operation is
+// tagged with its service. Components are renamed "<service>.<name>", and
+// references to them rewritten, so two services' schemas of the same name
+// do not collide; security schemes keep their names, as operations refer
+// to them by name. An operation two services both define, such as GET
+// /health, is taken from the first.
+func Merge(sources []Source) ([]byte, error) {
+	paths := map[string]any{}
+	components := map[string]map[string]any{}
+	tags := []any{}
+	hash := sha256.New()
+	for _, src := range sources {
+		var doc map[string]any
+		if err := yaml.Unmarshal(src.Spec, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", src.Service, err)
+		}
+		hash.Write(src.Spec)
+		tags = append(tags, map[string]any{"name": src.Service})
+		renameRefs(doc, src.Service)
+
+		items, _ := doc["paths"].(map[string]any)
+		for path, v := range items {
+			item, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			merged, ok := paths[path].(map[string]any)
+			if !ok {
+				merged = map[string]any{}
+				paths[path] = merged
+			}
+			for key, op := range item {
+				if _, taken := merged[key]; taken {
+					continue
+				}
+				if o, ok := op.(map[string]any); ok && isMethod(key) {
+					o["tags"] = []any{src.Service}
+				}
+				merged[key] = op
+			}
+		}
+
+		defs, _ := doc["components"].(map[string]any)
+		for kind, v := range defs {
+			named, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			if components[kind] == nil {
+				components[kind] = map[string]any{}
+			}
+			for name, def := range named {
+				if kind != "securitySchemes" {
+					name = src.Service + "." + name
+				}
+				if _, taken := components[kind][name]; !taken {
+					components[kind][name] = def
+				}
+			}
+		}
+	}
+
+	return yaml.Marshal(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "API Gateway and services",
+			"description": "The specs of the gateway and its backends, merged. Each operation is tagged with its service.",
+			"version":     hex.EncodeToString(hash.Sum(nil))[:12],
+		},
+		"tags":       tags,
+		"paths":      paths,
+		"components": components,
+	})
+}
+
+func isMethod(key string) bool {
+	for _, m := range methods {
+		if key == m {
+			return true
+		}
+	}
+	return false
+}
+
+// renameRefs points every local component reference in v at the component's
+// merged name.
+func renameRefs(v any, service string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if ref, ok := child.(string); ok && key == "$ref" {
+				kind, name, ok := strings.Cut(strings.TrimPrefix(ref, "#/components/"), "/")
+				if ok && strings.HasPrefix(ref, "#/components/") {
+					v[key] = "#/components/" + kind + "/" + service + "." + name
+				}
+				continue
+			}
+			renameRefs(child, service)
+		}
+	case []any:
+		for _, child := range v {
+			renameRefs(child, service)
+		}
+	}
+}
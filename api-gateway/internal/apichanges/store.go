@@ -0,0 +1,144 @@
+package apichanges
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrNotFound = errors.New("no api snapshot")
+	// ErrConflict is returned by Save when another replica recorded a
+	// successor to the same snapshot first.
+	ErrConflict = errors.New("api snapshot already superseded")
+)
+
+// Snapshot is the surface as it stood at CreatedAt.
+type Snapshot struct {
+	ID        int64
+	Hash      string
+	Surface   Surface
+	CreatedAt time.Time
+}
+
+// Query narrows List. Before pages by change ID.
+type Query struct {
+	Service  string
+	Breaking bool
+	Before   int64
+	Limit    int
+}
+
+type Store interface {
+	// Latest returns ErrNotFound before the first snapshot.
+	Latest(ctx context.Context) (*Snapshot, error)
+	// Save records s with its changes from previous, 0 for the first
+	// snapshot, and sets their IDs and times.
+	Save(ctx context.Context, previous int64, s *Snapshot, changes []Change) error
+	// List returns changes newest first.
+	List(ctx context.Context, q Query) ([]Change, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Latest(ctx context.Context) (*Snapshot, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT id, hash, surface, created_at FROM gateway.api_snapshots ORDER BY id DESC LIMIT 1`
+	var snap Snapshot
+	var surface []byte
+	err := s.db.QueryRowContext(ctx, query).Scan(&snap.ID, &snap.Hash, &surface, &snap.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(surface, &snap.Surface); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// Save relies on the unique index over previous_id: only one snapshot can
+// follow another, however many replicas notice the change.
+func (s *PostgresStore) Save(ctx context.Context, previous int64, snap *Snapshot, changes []Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	surface, err := json.Marshal(snap.Surface)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const query string = `INSERT INTO gateway.api_snapshots (previous_id, hash, surface)
+		VALUES (NULLIF($1, 0), $2, $3) RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, query, previous, snap.Hash, surface).Scan(&snap.ID, &snap.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	const change string = `INSERT INTO gateway.api_changes
+		(snapshot_id, service, method, path, kind, breaking, location, description, detected_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+	for i := range changes {
+		c := &changes[i]
+		c.SnapshotID, c.DetectedAt = snap.ID, snap.CreatedAt
+		if err := tx.QueryRowContext(ctx, change, c.SnapshotID, c.Service, c.Method, c.Path, c.Kind, c.Breaking,
+			c.Location, c.Description, c.DetectedAt).Scan(&c.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) List(ctx context.Context, q Query) ([]Change, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT id, snapshot_id, service, method, path, kind, breaking, location, description, detected_at
+		FROM gateway.api_changes
+		WHERE ($1 = '' OR service = $1) AND (NOT $2 OR breaking) AND ($3 = 0 OR id < $3)
+		ORDER BY id DESC LIMIT $4`
+	rows, err := s.db.QueryContext(ctx, query, q.Service, q.Breaking, q.Before, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.ID, &c.SnapshotID, &c.Service, &c.Method, &c.Path, &c.Kind, &c.Breaking,
+			&c.Location, &c.Description, &c.DetectedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,261 @@
+package apichanges
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Surface is the API the gateway puts in front of integrators, flattened
+// from each service's OpenAPI spec so two can be compared: operations by
+// service, then by "METHOD /path". References are resolved, so a change to
+// a shared schema shows up on every operation using it.
+type Surface map[string]map[string]*Operation
+
+type Operation struct {
+	Deprecated bool `json:"deprecated,omitempty"`
+	// Parameters are keyed by "in name", such as "query limit".
+	Parameters   map[string]*Parameter `json:"parameters,omitempty"`
+	Body         *Shape                `json:"body,omitempty"`
+	BodyRequired bool                  `json:"body_required,omitempty"`
+	// Responses are keyed by status. A response without a JSON body has an
+	// empty Shape.
+	Responses map[string]*Shape `json:"responses,omitempty"`
+}
+
+type Parameter struct {
+	Required bool   `json:"required,omitempty"`
+	Schema   *Shape `json:"schema,omitempty"`
+}
+
+// Shape is a resolved schema, keeping what a client can depend on.
+type Shape struct {
+	Type       string            `json:"type,omitempty"`
+	Nullable   bool              `json:"nullable,omitempty"`
+	Enum       []string          `json:"enum,omitempty"`
+	Required   []string          `json:"required,omitempty"`
+	Properties map[string]*Shape `json:"properties,omitempty"`
+	Items      *Shape            `json:"items,omitempty"`
+}
+
+// Hash identifies the surface; equal surfaces hash the same, since
+// encoding/json sorts map keys.
+func (s Surface) Hash() string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type document struct {
+	Paths      map[string]*pathItem `yaml:"paths"`
+	Components struct {
+		Schemas       map[string]*schema      `yaml:"schemas"`
+		Parameters    map[string]*parameter   `yaml:"parameters"`
+		Responses     map[string]*response    `yaml:"responses"`
+		RequestBodies map[string]*requestBody `yaml:"requestBodies"`
+	} `yaml:"components"`
+}
+
+type pathItem struct {
+	Parameters []*parameter `yaml:"parameters"`
+	Get        *operation   `yaml:"get"`
+	Post       *operation   `yaml:"post"`
+	Put        *operation   `yaml:"put"`
+	Patch      *operation   `yaml:"patch"`
+	Delete     *operation   `yaml:"delete"`
+}
+
+type operation struct {
+	Deprecated  bool                 `yaml:"deprecated"`
+	Parameters  []*parameter         `yaml:"parameters"`
+	RequestBody *requestBody         `yaml:"requestBody"`
+	Responses   map[string]*response `yaml:"responses"`
+}
+
+type parameter struct {
+	Ref      string  `yaml:"$ref"`
+	Name     string  `yaml:"name"`
+	In       string  `yaml:"in"`
+	Required bool    `yaml:"required"`
+	Schema   *schema `yaml:"schema"`
+}
+
+type media struct {
+	Schema *schema `yaml:"schema"`
+}
+
+type requestBody struct {
+	Ref      string           `yaml:"$ref"`
+	Required bool             `yaml:"required"`
+	Content  map[string]media `yaml:"content"`
+}
+
+type response struct {
+	Ref     string           `yaml:"$ref"`
+	Content map[string]media `yaml:"content"`
+}
+
+type schema struct {
+	Ref        string             `yaml:"$ref"`
+	Type       string             `yaml:"type"`
+	Nullable   bool               `yaml:"nullable"`
+	Enum       []any              `yaml:"enum"`
+	Required   []string           `yaml:"required"`
+	Properties map[string]*schema `yaml:"properties"`
+	Items      *schema            `yaml:"items"`
+	AllOf      []*schema          `yaml:"allOf"`
+}
+
+// maxRefDepth bounds reference chains, so specs with recursive schemas
+// still flatten.
+const maxRefDepth = 10
+
+// Flatten reads one service's spec into its part of a Surface.
+func Flatten(data []byte) (map[string]*Operation, error) {
+	var doc document
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	ops := map[string]*Operation{}
+	for path, item := range doc.Paths {
+		if item == nil {
+			continue
+		}
+		for method, op := range map[string]*operation{"GET": item.Get, "POST": item.Post, "PUT": item.Put, "PATCH": item.Patch, "DELETE": item.Delete} {
+			if op != nil {
+				ops[method+" "+path] = doc.operation(item, op)
+			}
+		}
+	}
+	return ops, nil
+}
+
+// operation merges path-level parameters into op's, which override them.
+func (d *document) operation(item *pathItem, op *operation) *Operation {
+	out := &Operation{Deprecated: op.Deprecated, Parameters: map[string]*Parameter{}, Responses: map[string]*Shape{}}
+	for _, params := range [][]*parameter{item.Parameters, op.Parameters} {
+		for _, p := range params {
+			if p = d.parameter(p); p != nil && p.Name != "" {
+				out.Parameters[p.In+" "+p.Name] = &Parameter{Required: p.Required, Schema: d.shape(p.Schema, 0)}
+			}
+		}
+	}
+	if body := d.requestBody(op.RequestBody); body != nil {
+		out.BodyRequired = body.Required
+		out.Body = d.shape(jsonSchema(body.Content), 0)
+		if out.Body == nil {
+			out.Body = &Shape{}
+		}
+	}
+	for status, r := range op.Responses {
+		shape := &Shape{}
+		if r = d.response(r); r != nil {
+			if s := d.shape(jsonSchema(r.Content), 0); s != nil {
+				shape = s
+			}
+		}
+		out.Responses[status] = shape
+	}
+	return out
+}
+
+// jsonSchema picks the JSON media type's schema, or the first one's.
+func jsonSchema(content map[string]media) *schema {
+	if m, ok := content["application/json"]; ok {
+		return m.Schema
+	}
+	types := make([]string, 0, len(content))
+	for t := range content {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	if len(types) == 0 {
+		return nil
+	}
+	return content[types[0]].Schema
+}
+
+func (d *document) parameter(p *parameter) *parameter {
+	for i := 0; p != nil && p.Ref != "" && i < maxRefDepth; i++ {
+		p = d.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+func (d *document) requestBody(b *requestBody) *requestBody {
+	for i := 0; b != nil && b.Ref != "" && i < maxRefDepth; i++ {
+		b = d.Components.RequestBodies[strings.TrimPrefix(b.Ref, "#/components/requestBodies/")]
+	}
+	return b
+}
+
+func (d *document) response(r *response) *response {
+	for i := 0; r != nil && r.Ref != "" && i < maxRefDepth; i++ {
+		r = d.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+// shape resolves s. Past maxRefDepth references, as in a recursive schema,
+// only the type is kept.
+func (d *document) shape(s *schema, depth int) *Shape {
+	for s != nil && s.Ref != "" {
+		if depth++; depth > maxRefDepth {
+			return &Shape{Type: "object"}
+		}
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	if s == nil {
+		return nil
+	}
+	out := &Shape{Type: s.Type, Nullable: s.Nullable, Required: append([]string(nil), s.Required...)}
+	for _, e := range s.Enum {
+		out.Enum = append(out.Enum, fmt.Sprint(e))
+	}
+	for name, prop := range s.Properties {
+		if out.Properties == nil {
+			out.Properties = map[string]*Shape{}
+		}
+		out.Properties[name] = d.shape(prop, depth)
+	}
+	if s.Items != nil {
+		out.Items = d.shape(s.Items, depth)
+	}
+	// allOf parts are merged into one object.
+	for _, part := range s.AllOf {
+		merged := d.shape(part, depth)
+		if merged == nil {
+			continue
+		}
+		if out.Type == "" {
+			out.Type = merged.Type
+		}
+		out.Required = append(out.Required, merged.Required...)
+		for name, prop := range merged.Properties {
+			if out.Properties == nil {
+				out.Properties = map[string]*Shape{}
+			}
+			out.Properties[name] = prop
+		}
+	}
+	sort.Strings(out.Enum)
+	out.Required = unique(out.Required)
+	return out
+}
+
+// unique sorts names and drops repeats.
+func unique(names []string) []string {
+	sort.Strings(names)
+	out := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,184 @@
+// Package apichanges keeps a changelog of the API behind the gateway. It
+// flattens the OpenAPI specs of the gateway and its backends into a
+// Surface, compares it with the last snapshot, records what changed and
+// whether it breaks clients, and announces the changes as
+// gateway.api_changed events so integrators hear about them, deprecations
+// included, before they are caught out.
+package apichanges
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// Source is where one service's spec comes from: Spec when it is set, as
+// for the gateway's own, or else BaseURL's /docs/openapi.yaml.
+type Source struct {
+	Service string
+	BaseURL string
+	Spec    []byte
+}
+
+type Tracker struct {
+	store     Store
+	publisher events.Publisher
+	sources   []Source
+	client    *http.Client
+
+	// mu keeps this replica to one check at a time; Save settles races
+	// between replicas.
+	mu sync.Mutex
+
+	// specs are the raw specs last read from each service, for Spec.
+	specsMu sync.RWMutex
+	specs   map[string][]byte
+}
+
+func NewTracker(store Store, publisher events.Publisher, sources ...Source) *Tracker {
+	return &Tracker{store: store, publisher: publisher, sources: sources, client: httpclient.New(), specs: map[string][]byte{}}
+}
+
+// Check snapshots the surface and returns the changes since the last
+// snapshot. The first snapshot is the baseline and has none. A service
+// whose spec cannot be fetched keeps its last known operations, so an
+// outage does not read as every operation being removed. Nothing is
+// returned when another replica recorded the same change first.
+func (t *Tracker) Check(ctx context.Context) ([]Change, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev, err := t.store.Latest(ctx)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	surface := Surface{}
+	for _, src := range t.sources {
+		ops, err := t.load(ctx, src)
+		if err != nil {
+			log.Printf("Failed to read the API spec of %s: %v", src.Service, err)
+			if prev != nil && prev.Surface[src.Service] != nil {
+				surface[src.Service] = prev.Surface[src.Service]
+			}
+			continue
+		}
+		surface[src.Service] = ops
+	}
+	if len(surface) == 0 {
+		return nil, errors.New("no API spec could be read")
+	}
+
+	snap := &Snapshot{Hash: surface.Hash(), Surface: surface}
+	var previous int64
+	var changes []Change
+	if prev != nil {
+		if prev.Hash == snap.Hash {
+			return nil, nil
+		}
+		previous, changes = prev.ID, Diff(prev.Surface, surface)
+	}
+	if err := t.store.Save(ctx, previous, snap, changes); errors.Is(err, ErrConflict) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if prev == nil {
+		log.Printf("Recorded API snapshot %d as the changelog baseline", snap.ID)
+		return nil, nil
+	}
+	t.announce(ctx, snap, changes)
+	return changes, nil
+}
+
+// announce publishes an events.GatewayAPIChanged event for a snapshot's
+// changes. The changes are already recorded, so a failure is only logged.
+func (t *Tracker) announce(ctx context.Context, snap *Snapshot, changes []Change) {
+	payload := events.APIChanged{SnapshotID: snap.ID, DetectedAt: snap.CreatedAt, Changes: []events.APIChange{}}
+	for _, c := range changes {
+		if c.Breaking {
+			payload.Breaking++
+		}
+		payload.Changes = append(payload.Changes, events.APIChange{
+			Service:     c.Service,
+			Method:      c.Method,
+			Path:        c.Path,
+			Kind:        c.Kind,
+			Breaking:    c.Breaking,
+			Location:    c.Location,
+			Description: c.Description,
+		})
+	}
+	log.Printf("API snapshot %d has %d changes, %d breaking", snap.ID, len(changes), payload.Breaking)
+
+	e, err := events.New(events.GatewayAPIChanged, "api-gateway", payload)
+	if err == nil {
+		err = t.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish API changes for snapshot %d: %v", snap.ID, err)
+	}
+}
+
+// load refuses a spec without operations, which is more likely a broken
+// docs endpoint than a service that removed its whole API.
+func (t *Tracker) load(ctx context.Context, src Source) (map[string]*Operation, error) {
+	data := src.Spec
+	if data == nil {
+		var err error
+		if data, err = t.fetch(ctx, src.BaseURL); err != nil {
+			return nil, err
+		}
+	}
+	ops, err := Flatten(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("spec has no operations")
+	}
+	t.specsMu.Lock()
+	t.specs[src.Service] = data
+	t.specsMu.Unlock()
+	return ops, nil
+}
+
+func (t *Tracker) fetch(ctx context.Context, baseURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/docs/openapi.yaml", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching spec: status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Run checks every interval until ctx is cancelled.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := t.Check(ctx); err != nil {
+			log.Printf("API change check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package apikeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	keys  map[string]*Key
+	usage map[int]int
+}
+
+func (m *memStore) Create(ctx context.Context, k *Key, hash string) error {
+	k.ID = len(m.keys) + 1
+	m.keys[hash] = k
+	return nil
+}
+
+func (m *memStore) List(ctx context.Context) ([]Key, error) { return nil, nil }
+
+func (m *memStore) FindActive(ctx context.Context, hash string) (*Key, error) {
+	k, ok := m.keys[hash]
+	if !ok || k.RevokedAt != nil {
+		return nil, ErrNotFound
+	}
+	return k, nil
+}
+
+func (m *memStore) Revoke(ctx context.Context, id int) error {
+	for _, k := range m.keys {
+		if k.ID == id && k.RevokedAt == nil {
+			now := time.Now()
+			k.RevokedAt = &now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memStore) IncrementUsage(ctx context.Context, id int) (int, error) {
+	m.usage[id]++
+	return m.usage[id], nil
+}
+
+func (m *memStore) ListOwned(ctx context.Context, ownerID int) ([]Key, error) {
+	keys := []Key{}
+	for id := 1; id <= len(m.keys); id++ {
+		if k, err := m.GetOwned(ctx, ownerID, id); err == nil {
+			keys = append(keys, *k)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memStore) GetOwned(ctx context.Context, ownerID, id int) (*Key, error) {
+	for _, k := range m.keys {
+		if k.ID == id && k.OwnerID == ownerID {
+			return k, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Usage reports the counts IncrementUsage kept as today's.
+func (m *memStore) Usage(ctx context.Context, id int, since time.Time) ([]DailyUsage, error) {
+	if m.usage[id] == 0 {
+		return []DailyUsage{}, nil
+	}
+	return []DailyUsage{{Day: time.Now().UTC().Truncate(24 * time.Hour), Requests: m.usage[id]}}, nil
+}
+
+func TestAllows(t *testing.T) {
+	k := &Key{Scopes: []string{"GET /api/users", "/api/orders/"}}
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/api/users", true},
+		{"GET", "/api/users/1", true},
+		{"POST", "/api/users", false},
+		{"GET", "/api/usersx", false},
+		{"POST", "/api/orders/1", true},
+		{"GET", "/api/dashboard/1", false},
+	}
+	for _, tt := range tests {
+		if got := k.Allows(tt.method, tt.path); got != tt.want {
+			t.Errorf("Allows(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	for _, scope := range []string{"/api", "GET /api/users", "DELETE /api/x"} {
+		if err := validateScope(scope); err != nil {
+			t.Errorf("Expected %q to be valid: %v", scope, err)
+		}
+	}
+	for _, scope := range []string{"api", "FETCH /api"} {
+		if err := validateScope(scope); err == nil {
+			t.Errorf("Expected %q to be invalid", scope)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	allowed := []string{"GET /api/users", "/api/orders"}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{"GET /api/users", true},
+		{"GET /api/users/1", true},
+		{"POST /api/users", false},
+		{"/api/users", false},
+		{"/api/orders/1", true},
+		{"DELETE /api/orders", true},
+		{"/api", false},
+	}
+	for _, tt := range tests {
+		if got := within(tt.scope, allowed); got != tt.want {
+			t.Errorf("within(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{keys: map[string]*Key{}, usage: map[int]int{}}
+	secret, prefix, hash, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(context.Background(), &Key{Name: "partner", Prefix: prefix, Scopes: []string{"/api/users"}, DailyQuota: 2}, hash)
+
+	router := gin.New()
+	router.Use(Middleware(store))
+	router.GET("/api/users", func(c *gin.Context) {
+		if c.GetHeader(Header) != "" {
+			t.Error("Expected API key header to be stripped")
+		}
+		c.Status(http.StatusOK)
+	})
+	router.GET("/api/dashboard", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	do := func(path, key string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		if key != "" {
+			req.Header.Set(Header, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := do("/api/dashboard", ""); code != http.StatusOK {
+		t.Errorf("Expected unkeyed request to pass, got: %d", code)
+	}
+	if code := do("/api/users", "gk_wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for unknown key, got: %d", code)
+	}
+	if code := do("/api/dashboard", secret); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for out-of-scope route, got: %d", code)
+	}
+	if code := do("/api/users", secret); code != http.StatusOK {
+		t.Errorf("Expected 200 within quota, got: %d", code)
+	}
+	if code := do("/api/users", secret); code != http.StatusOK {
+		t.Errorf("Expected 200 within quota, got: %d", code)
+	}
+	if code := do("/api/users", secret); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 over quota, got: %d", code)
+	}
+}
+
+func TestPortal(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{keys: map[string]*Key{}, usage: map[int]int{}}
+	_, prefix, hash, _ := generate()
+	store.Create(context.Background(), &Key{Name: "someone else's", Prefix: prefix, Scopes: []string{"/api"}, OwnerID: 8}, hash)
+	handler := NewPortalHandler(store, PortalLimits{Scopes: []string{"GET /api/users", "/api/orders"}, MaxKeys: 1, MaxDailyQuota: 1000})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 7, Roles: []string{auth.RoleDeveloper}})
+	})
+	router.Use(Middleware(store))
+	handler.RegisterRoutes(router)
+	router.GET("/api/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	serve := func(method, path, body, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(Header, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(http.MethodPost, "/keys", `{"name": "ci", "scopes": ["POST /api/users"]}`, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a scope outside the portal's to be refused, got: %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "/keys", `{"name": "ci", "scopes": ["/api/orders"], "daily_quota": 5000}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a quota over the most allowed to be refused, got: %d", w.Code)
+	}
+	w := serve(http.MethodPost, "/keys", `{"name": "ci", "scopes": ["GET /api/users"]}`, "")
+	var created struct {
+		Key    Key    `json:"key"`
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("Expected the key to be created, got: %d %s", w.Code, w.Body)
+	}
+	if created.Key.OwnerID != 7 || created.Key.DailyQuota != 1000 {
+		t.Errorf("Expected a key owned by the developer with the most quota, got: %+v", created.Key)
+	}
+	if w := serve(http.MethodPost, "/keys", `{"name": "second", "scopes": ["/api/orders"]}`, ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a key over the limit to be refused, got: %d", w.Code)
+	}
+
+	serve(http.MethodGet, "/api/users", "", created.Secret)
+	serve(http.MethodGet, "/api/users", "", created.Secret)
+	w = serve(http.MethodGet, "/keys/2/usage?days=7", "", "")
+	var usage struct {
+		Days           []dayUsage `json:"days"`
+		Requests       int        `json:"requests"`
+		RemainingToday int        `json:"remaining_today"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the key's usage, got: %d %s", w.Code, w.Body)
+	}
+	if len(usage.Days) != 7 || usage.Days[6].Requests != 2 || usage.Requests != 2 || usage.RemainingToday != 998 {
+		t.Errorf("Expected a week of usage with today's 2 requests, got: %+v", usage)
+	}
+
+	if w := serve(http.MethodGet, "/keys/1/usage", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another developer's key to be hidden, got: %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/keys/1", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another developer's key not to be revoked, got: %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/keys/2", "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the developer's key to be revoked, got: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/api/users", "", created.Secret); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to stop working, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package apikeys
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterAdminRoutes mounts key management on an admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/apikeys", h.list)
+	router.POST("/apikeys", h.create)
+	router.DELETE("/apikeys/:id", h.revoke)
+}
+
+type createRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	Scopes     []string `json:"scopes" binding:"required,min=1"`
+	DailyQuota int      `json:"daily_quota" binding:"min=0"`
+	Team       string   `json:"team"`
+	Feature    string   `json:"feature"`
+}
+
+func (h *Handler) create(c *gin.Context) {
+	var req createRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if err := validateScope(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	secret, prefix, hash, err := generate()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	k := &Key{
+		Name:       req.Name,
+		Prefix:     prefix,
+		Scopes:     req.Scopes,
+		DailyQuota: req.DailyQuota,
+		Team:       req.Team,
+		Feature:    req.Feature,
+	}
+	if err := h.store.Create(c.Request.Context(), k, hash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The secret is only ever returned here; the gateway keeps just its hash.
+	c.JSON(http.StatusCreated, gin.H{"key": k, "secret": secret})
+}
+
+func (h *Handler) list(c *gin.Context) {
+	keys, err := h.store.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func (h *Handler) revoke(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	if err := h.store.Revoke(c.Request.Context(), id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "api key not found or already revoked"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
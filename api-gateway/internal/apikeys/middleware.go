@@ -0,0 +1,101 @@
+package apikeys
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/attribution"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	Header     = "X-API-Key"
+	contextKey = "api_key"
+)
+
+// Middleware authenticates requests carrying an X-API-Key header, enforcing
+// the key's scopes and daily quota. Requests without the header pass through
+// untouched.
+func Middleware(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := c.GetHeader(Header)
+		if secret == "" {
+			c.Next()
+			return
+		}
+		// Never forward the secret to backends.
+		c.Request.Header.Del(Header)
+
+		key, err := store.FindActive(c.Request.Context(), hashKey(secret))
+		if errors.Is(err, ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or revoked API key"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up API key: %v", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "API key validation unavailable"})
+			return
+		}
+
+		if !key.Allows(c.Request.Method, c.Request.URL.Path) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is not scoped for this route"})
+			return
+		}
+
+		if key.DailyQuota > 0 {
+			used, err := store.IncrementUsage(c.Request.Context(), key.ID)
+			if err != nil {
+				log.Printf("Failed to record usage for API key %d: %v", key.ID, err)
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "API key validation unavailable"})
+				return
+			}
+			remaining := key.DailyQuota - used
+			if remaining < 0 {
+				remaining = 0
+			}
+			c.Header("X-RateLimit-Limit", strconv.Itoa(key.DailyQuota))
+			c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			if used > key.DailyQuota {
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "daily API key quota exceeded"})
+				return
+			}
+		}
+
+		c.Set(contextKey, key)
+		c.Next()
+	}
+}
+
+// FromContext returns the API key that authenticated the request, if any.
+func FromContext(c *gin.Context) (*Key, bool) {
+	v, ok := c.Get(contextKey)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Key), true
+}
+
+// CacheIdentity keeps responses cached for one API key from being served to
+// another.
+func CacheIdentity(c *gin.Context) string {
+	if key, ok := FromContext(c); ok {
+		return "apikey:" + strconv.Itoa(key.ID)
+	}
+	return ""
+}
+
+// AttributionTags attributes keyed requests to the team and feature recorded
+// on the key.
+func AttributionTags(c *gin.Context) (attribution.Tags, bool) {
+	key, ok := FromContext(c)
+	if !ok || key.Team == "" {
+		return attribution.Tags{}, false
+	}
+	feature := key.Feature
+	if feature == "" {
+		feature = key.Name
+	}
+	return attribution.Tags{Team: key.Team, Feature: feature}, true
+}
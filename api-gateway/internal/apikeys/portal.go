@@ -0,0 +1,224 @@
+package apikeys
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultUsageDays = 30
+	maxUsageDays     = 90
+)
+
+// PortalLimits bound the keys developers issue themselves. Every scope of
+// such a key must fall within one of Scopes, and every key has a daily
+// quota of at most MaxDailyQuota, so its usage is always counted.
+type PortalLimits struct {
+	Scopes        []string
+	MaxKeys       int
+	MaxDailyQuota int
+}
+
+// ParseScopes reads a comma-separated list of scopes.
+func ParseScopes(raw string) ([]string, error) {
+	scopes := []string{}
+	for _, scope := range strings.Split(raw, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if err := validateScope(scope); err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// PortalHandler lets developers issue, revoke and watch the usage of their
+// own keys.
+type PortalHandler struct {
+	store  Store
+	limits PortalLimits
+	now    func() time.Time
+}
+
+func NewPortalHandler(store Store, limits PortalLimits) *PortalHandler {
+	return &PortalHandler{store: store, limits: limits, now: time.Now}
+}
+
+// RegisterRoutes mounts the routes on a group that has authenticated the
+// developer.
+func (h *PortalHandler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/keys", h.list)
+	router.POST("/keys", h.create)
+	router.DELETE("/keys/:id", h.revoke)
+	router.GET("/keys/:id/usage", h.usage)
+}
+
+func (h *PortalHandler) list(c *gin.Context) {
+	p, _ := auth.FromContext(c)
+	keys, err := h.store.ListOwned(c.Request.Context(), p.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys, "scopes": h.limits.Scopes, "max_daily_quota": h.limits.MaxDailyQuota})
+}
+
+type portalCreateRequest struct {
+	Name       string   `json:"name" binding:"required,max=255"`
+	Scopes     []string `json:"scopes" binding:"required,min=1"`
+	DailyQuota int      `json:"daily_quota" binding:"min=0"`
+}
+
+// create issues a key owned by the developer. A quota of 0 takes the most
+// allowed rather than none.
+func (h *PortalHandler) create(c *gin.Context) {
+	var req portalCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if err := validateScope(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !within(scope, h.limits.Scopes) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("scope %q is not open to developers", scope)})
+			return
+		}
+	}
+	if req.DailyQuota == 0 {
+		req.DailyQuota = h.limits.MaxDailyQuota
+	}
+	if req.DailyQuota > h.limits.MaxDailyQuota {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("daily_quota must be at most %d", h.limits.MaxDailyQuota)})
+		return
+	}
+
+	p, _ := auth.FromContext(c)
+	ctx := c.Request.Context()
+	keys, err := h.store.ListOwned(ctx, p.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	active := 0
+	for _, k := range keys {
+		if k.RevokedAt == nil {
+			active++
+		}
+	}
+	if active >= h.limits.MaxKeys {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("a developer may have at most %d active keys", h.limits.MaxKeys)})
+		return
+	}
+
+	secret, prefix, hash, err := generate()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	k := &Key{Name: req.Name, Prefix: prefix, Scopes: req.Scopes, DailyQuota: req.DailyQuota, OwnerID: p.UserID}
+	if err := h.store.Create(ctx, k, hash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"key": k, "secret": secret})
+}
+
+// key looks up the :id key among the developer's, writing an error
+// response if ok is false.
+func (h *PortalHandler) key(c *gin.Context) (*Key, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	p, _ := auth.FromContext(c)
+	k, err := h.store.GetOwned(c.Request.Context(), p.UserID, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return k, true
+}
+
+func (h *PortalHandler) revoke(c *gin.Context) {
+	k, ok := h.key(c)
+	if !ok {
+		return
+	}
+	if err := h.store.Revoke(c.Request.Context(), k.ID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "api key not found or already revoked"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type dayUsage struct {
+	Day      string `json:"day"`
+	Requests int    `json:"requests"`
+	Rejected int    `json:"rejected"`
+}
+
+// usage reports the key's requests for each of the last ?days= days,
+// today included, counting those turned away over its quota as rejected.
+// Days without requests are listed with none.
+func (h *PortalHandler) usage(c *gin.Context) {
+	k, ok := h.key(c)
+	if !ok {
+		return
+	}
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(defaultUsageDays)))
+	if err != nil || days <= 0 || days > maxUsageDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("days must be 1 to %d", maxUsageDays)})
+		return
+	}
+
+	today := h.now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, 1-days)
+	counts, err := h.store.Usage(c.Request.Context(), k.ID, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	byDay := map[string]int{}
+	for _, u := range counts {
+		byDay[u.Day.Format(time.DateOnly)] = u.Requests
+	}
+
+	series := make([]dayUsage, 0, days)
+	var requests, rejected int
+	for day := since; !day.After(today); day = day.AddDate(0, 0, 1) {
+		u := dayUsage{Day: day.Format(time.DateOnly), Requests: byDay[day.Format(time.DateOnly)]}
+		if k.DailyQuota > 0 && u.Requests > k.DailyQuota {
+			u.Rejected = u.Requests - k.DailyQuota
+		}
+		requests += u.Requests
+		rejected += u.Rejected
+		series = append(series, u)
+	}
+	resp := gin.H{"key": k, "days": series, "requests": requests, "rejected": rejected}
+	if k.DailyQuota > 0 {
+		resp["remaining_today"] = max(0, k.DailyQuota-series[len(series)-1].Requests)
+	}
+	c.JSON(http.StatusOK, resp)
+}
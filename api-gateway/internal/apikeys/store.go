@@ -0,0 +1,176 @@
+package apikeys
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("api key not found")
+
+type Store interface {
+	Create(ctx context.Context, k *Key, hash string) error
+	List(ctx context.Context) ([]Key, error)
+	// FindActive returns the unrevoked key with the given hash.
+	FindActive(ctx context.Context, hash string) (*Key, error)
+	Revoke(ctx context.Context, id int) error
+	// IncrementUsage counts one request against today's quota and returns
+	// today's total.
+	IncrementUsage(ctx context.Context, id int) (int, error)
+	// ListOwned returns the keys a developer created, revoked ones included.
+	ListOwned(ctx context.Context, ownerID int) ([]Key, error)
+	// GetOwned returns one of a developer's keys, or ErrNotFound.
+	GetOwned(ctx context.Context, ownerID, id int) (*Key, error)
+	// Usage returns the key's request counts for the days since since that
+	// had any, oldest first.
+	Usage(ctx context.Context, id int, since time.Time) ([]DailyUsage, error)
+}
+
+// DailyUsage is how many requests a key made in a day, those over its
+// quota included.
+type DailyUsage struct {
+	Day      time.Time
+	Requests int
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const keyColumns = "id, name, key_prefix, scopes, daily_quota, COALESCE(team, ''), COALESCE(feature, ''), COALESCE(owner_id, 0), created_at, last_used_at, revoked_at"
+
+func scanKey(row interface{ Scan(...any) error }) (*Key, error) {
+	var k Key
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.DailyQuota, &k.Team, &k.Feature, &k.OwnerID,
+		&k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s *PostgresStore) Create(ctx context.Context, k *Key, hash string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO gateway.api_keys (name, key_prefix, key_hash, scopes, daily_quota, team, feature, owner_id)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, 0)) RETURNING id, created_at`
+	return s.db.QueryRowContext(ctx, query, k.Name, k.Prefix, hash, pq.Array(k.Scopes), k.DailyQuota, k.Team, k.Feature, k.OwnerID).
+		Scan(&k.ID, &k.CreatedAt)
+}
+
+func (s *PostgresStore) List(ctx context.Context) ([]Key, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + keyColumns + ` FROM gateway.api_keys ORDER BY id`
+	return s.queryKeys(ctx, query)
+}
+
+func (s *PostgresStore) ListOwned(ctx context.Context, ownerID int) ([]Key, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + keyColumns + ` FROM gateway.api_keys WHERE owner_id = $1 ORDER BY id`
+	return s.queryKeys(ctx, query, ownerID)
+}
+
+func (s *PostgresStore) queryKeys(ctx context.Context, query string, args ...any) ([]Key, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgresStore) FindActive(ctx context.Context, hash string) (*Key, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE gateway.api_keys SET last_used_at = NOW()
+		WHERE key_hash = $1 AND revoked_at IS NULL RETURNING ` + keyColumns
+	k, err := scanKey(s.db.QueryRowContext(ctx, query, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return k, err
+}
+
+func (s *PostgresStore) Revoke(ctx context.Context, id int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE gateway.api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`
+	res, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) IncrementUsage(ctx context.Context, id int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO gateway.api_key_usage (key_id, day, requests) VALUES ($1, CURRENT_DATE, 1)
+		ON CONFLICT (key_id, day) DO UPDATE SET requests = gateway.api_key_usage.requests + 1
+		RETURNING requests`
+	var n int
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) GetOwned(ctx context.Context, ownerID, id int) (*Key, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + keyColumns + ` FROM gateway.api_keys WHERE id = $1 AND owner_id = $2`
+	k, err := scanKey(s.db.QueryRowContext(ctx, query, id, ownerID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return k, err
+}
+
+func (s *PostgresStore) Usage(ctx context.Context, id int, since time.Time) ([]DailyUsage, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT day, requests FROM gateway.api_key_usage WHERE key_id = $1 AND day >= $2 ORDER BY day`
+	rows, err := s.db.QueryContext(ctx, query, id, since.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []DailyUsage{}
+	for rows.Next() {
+		var u DailyUsage
+		if err := rows.Scan(&u.Day, &u.Requests); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
@@ -0,0 +1,201 @@
+// Package attribution tags every gateway request with the team and feature it
+// is billed to, and aggregates per-tag usage for chargeback reports.
+package attribution
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const contextKey = "attribution"
+
+type Tags struct {
+	Team    string `json:"team"`
+	Feature string `json:"feature"`
+}
+
+var Unattributed = Tags{Team: "unattributed", Feature: "unattributed"}
+
+type Rule struct {
+	PathPrefix string
+	Tags       Tags
+}
+
+// ParseRules parses "prefix=team/feature" pairs separated by commas, e.g.
+// "/api/users=identity/users,/api/dashboard=web/dashboard".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, tags, ok := strings.Cut(part, "=")
+		team, feature, ok2 := strings.Cut(tags, "/")
+		if !ok || !ok2 || prefix == "" || team == "" || feature == "" {
+			return nil, fmt.Errorf("invalid attribution rule %q, want prefix=team/feature", part)
+		}
+		rules = append(rules, Rule{PathPrefix: prefix, Tags: Tags{Team: team, Feature: feature}})
+	}
+	return rules, nil
+}
+
+// KeyTagger resolves tags from the caller's credentials (e.g. an API key).
+// Credential-derived tags take precedence over route rules.
+type KeyTagger func(c *gin.Context) (Tags, bool)
+
+type Tagger struct {
+	rules   []Rule
+	byKey   KeyTagger
+	metrics *Metrics
+}
+
+func NewTagger(rules []Rule, byKey KeyTagger, metrics *Metrics) *Tagger {
+	sorted := append([]Rule(nil), rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].PathPrefix) > len(sorted[j].PathPrefix)
+	})
+	return &Tagger{rules: sorted, byKey: byKey, metrics: metrics}
+}
+
+func (t *Tagger) resolve(c *gin.Context) Tags {
+	if t.byKey != nil {
+		if tags, ok := t.byKey(c); ok {
+			return tags
+		}
+	}
+	path := c.Request.URL.Path
+	for _, r := range t.rules {
+		if strings.HasPrefix(path, r.PathPrefix) {
+			return r.Tags
+		}
+	}
+	return Unattributed
+}
+
+// Middleware tags the request, forwards the tags to backends as X-Team and
+// X-Feature headers, and records usage once the request completes.
+func (t *Tagger) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tags := t.resolve(c)
+		c.Set(contextKey, tags)
+		c.Request.Header.Set("X-Team", tags.Team)
+		c.Request.Header.Set("X-Feature", tags.Feature)
+
+		start := time.Now()
+		c.Next()
+		t.metrics.Record(tags, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// FromContext returns the tags assigned to the request.
+func FromContext(c *gin.Context) Tags {
+	if v, ok := c.Get(contextKey); ok {
+		return v.(Tags)
+	}
+	return Unattributed
+}
+
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+type usage struct {
+	requests int64
+	errors   int64
+	total    time.Duration
+	max      time.Duration
+	buckets  []int64
+}
+
+// Metrics aggregates usage and latency per tag in memory since the last reset.
+type Metrics struct {
+	mu    sync.Mutex
+	since time.Time
+	usage map[Tags]*usage
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{since: time.Now(), usage: map[Tags]*usage{}}
+}
+
+func (m *Metrics) Record(tags Tags, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.usage[tags]
+	if !ok {
+		u = &usage{buckets: make([]int64, len(latencyBuckets)+1)}
+		m.usage[tags] = u
+	}
+	u.requests++
+	if status >= 500 {
+		u.errors++
+	}
+	u.total += latency
+	if latency > u.max {
+		u.max = latency
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return latency <= latencyBuckets[i] })
+	u.buckets[i]++
+}
+
+type ReportRow struct {
+	Tags
+	Requests     int64            `json:"requests"`
+	Errors       int64            `json:"errors"`
+	AvgLatencyMS float64          `json:"avg_latency_ms"`
+	MaxLatencyMS float64          `json:"max_latency_ms"`
+	Latency      map[string]int64 `json:"latency_buckets"`
+}
+
+type Report struct {
+	Since time.Time   `json:"since"`
+	Until time.Time   `json:"until"`
+	Rows  []ReportRow `json:"rows"`
+}
+
+// Snapshot returns the current report, sorted by request count, and resets
+// the counters when reset is true.
+func (m *Metrics) Snapshot(reset bool) Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := Report{Since: m.since, Until: time.Now(), Rows: []ReportRow{}}
+	for tags, u := range m.usage {
+		row := ReportRow{
+			Tags:         tags,
+			Requests:     u.requests,
+			Errors:       u.errors,
+			AvgLatencyMS: float64(u.total.Microseconds()) / 1000 / float64(u.requests),
+			MaxLatencyMS: float64(u.max.Microseconds()) / 1000,
+			Latency:      map[string]int64{},
+		}
+		for i, n := range u.buckets {
+			label := "+Inf"
+			if i < len(latencyBuckets) {
+				label = "le_" + latencyBuckets[i].String()
+			}
+			row.Latency[label] = n
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool {
+		if report.Rows[i].Requests != report.Rows[j].Requests {
+			return report.Rows[i].Requests > report.Rows[j].Requests
+		}
+		return report.Rows[i].Team+report.Rows[i].Feature < report.Rows[j].Team+report.Rows[j].Feature
+	})
+
+	if reset {
+		m.since = report.Until
+		m.usage = map[Tags]*usage{}
+	}
+	return report
+}
@@ -0,0 +1,72 @@
+package attribution
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("/api/users=identity/users, /api=web/misc")
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Tags != (Tags{Team: "identity", Feature: "users"}) {
+		t.Errorf("Unexpected rules: %+v", rules)
+	}
+
+	if _, err := ParseRules("/api/users=identity"); err == nil {
+		t.Error("Expected error for rule without feature")
+	}
+}
+
+func TestMiddlewareTagsAndRecords(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rules, _ := ParseRules("/api=web/misc,/api/users=identity/users")
+	metrics := NewMetrics()
+	keyTagger := func(c *gin.Context) (Tags, bool) {
+		if c.GetHeader("X-Api-Key") == "partner" {
+			return Tags{Team: "partners", Feature: "sync"}, true
+		}
+		return Tags{}, false
+	}
+
+	router := gin.New()
+	router.Use(NewTagger(rules, keyTagger, metrics).Middleware())
+	router.GET("/api/users", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetHeader("X-Team"))
+	})
+	router.GET("/other", func(c *gin.Context) {
+		c.Status(http.StatusInternalServerError)
+	})
+
+	for _, tc := range []struct{ path, key, wantTeam string }{
+		{"/api/users", "", "identity"},
+		{"/api/users", "partner", "partners"},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Header.Set("X-Api-Key", tc.key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Body.String() != tc.wantTeam {
+			t.Errorf("Expected team %q for key %q, got: %q", tc.wantTeam, tc.key, w.Body.String())
+		}
+	}
+	req, _ := http.NewRequest("GET", "/other", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	report := metrics.Snapshot(true)
+	if len(report.Rows) != 3 {
+		t.Fatalf("Expected 3 report rows, got: %+v", report.Rows)
+	}
+	for _, row := range report.Rows {
+		if row.Tags == Unattributed && row.Errors != 1 {
+			t.Errorf("Expected unattributed error to be counted: %+v", row)
+		}
+	}
+	if len(metrics.Snapshot(false).Rows) != 0 {
+		t.Error("Expected snapshot reset to clear usage")
+	}
+}
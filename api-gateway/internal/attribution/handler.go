@@ -0,0 +1,15 @@
+package attribution
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterAdminRoutes exposes the usage report. Pass ?reset=true to start a
+// new reporting period after reading it.
+func RegisterAdminRoutes(router gin.IRouter, metrics *Metrics) {
+	router.GET("/attribution", func(c *gin.Context) {
+		c.JSON(http.StatusOK, metrics.Snapshot(c.Query("reset") == "true"))
+	})
+}
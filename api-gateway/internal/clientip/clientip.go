@@ -0,0 +1,145 @@
+// Package clientip works out the address of the client behind the load
+// balancers in front of the gateway. Forwarding headers are only believed
+// when they come from a trusted proxy: any client can put whatever address
+// it likes in them.
+package clientip
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header carries the resolved address for the rest of the request. Set
+// gin's TrustedPlatform to it so that c.ClientIP() returns the same answer
+// everywhere: request logs, audit events and anything keyed by client.
+const Header = "X-Gateway-Client-IP"
+
+// Forwarding headers a proxy can append the client address to.
+const (
+	XForwardedFor = "X-Forwarded-For"
+	Forwarded     = "Forwarded"
+)
+
+type Resolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// NewResolver trusts the proxies in cidrs, separated by commas, such as
+// "10.0.0.0/8,192.168.1.10". A bare address trusts just that address. header
+// is the one header, XForwardedFor or Forwarded, that those proxies append
+// to; the other is ignored, since no trusted proxy vouches for it. With no
+// trusted proxies the peer address is always the client.
+func NewResolver(cidrs, header string) (*Resolver, error) {
+	if header != XForwardedFor && header != Forwarded {
+		return nil, fmt.Errorf("header must be %s or %s", XForwardedFor, Forwarded)
+	}
+	r := &Resolver{header: header}
+	for _, s := range strings.Split(cidrs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+	return r, nil
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address of req, or an invalid address if the
+// peer address cannot be parsed. Starting from the peer, it walks the
+// forwarding chain from the right for as long as each hop is a trusted
+// proxy, and returns the first address that is not. A malformed entry ends
+// the walk at the last hop that vouched for it.
+func (r *Resolver) Resolve(req *http.Request) netip.Addr {
+	addr, ok := parseNode(req.RemoteAddr)
+	if !ok || !r.isTrusted(addr) {
+		return addr
+	}
+	hops := r.hops(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseNode(hops[i])
+		if !ok {
+			return addr
+		}
+		addr = hop
+		if !r.isTrusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// hops returns the forwarded addresses in order, oldest first, across every
+// copy of the header.
+func (r *Resolver) hops(h http.Header) []string {
+	var hops []string
+	for _, value := range h.Values(r.header) {
+		for _, element := range strings.Split(value, ",") {
+			if r.header == XForwardedFor {
+				hops = append(hops, element)
+				continue
+			}
+			// Forwarded: for=192.0.2.60;proto=https;by=203.0.113.43. An
+			// element without for= is kept so it ends the walk.
+			node := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					node = value
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// parseNode parses an address with an optional port, as found in
+// RemoteAddr and forwarding headers: 192.0.2.1, 192.0.2.1:443, 2001:db8::1
+// or "[2001:db8::1]:443". Obfuscated and "unknown" nodes are not addresses.
+func parseNode(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// Middleware resolves the client address and puts it in Header, replacing
+// anything the client sent there. Install it before any middleware that
+// reads c.ClientIP().
+func (r *Resolver) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Header.Del(Header)
+		if addr := r.Resolve(c.Request); addr.IsValid() {
+			c.Request.Header.Set(Header, addr.String())
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,100 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolve(t *testing.T) {
+	xff, err := NewResolver("10.0.0.0/8, 192.168.1.10", XForwardedFor)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	forwarded, err := NewResolver("10.0.0.0/8,2001:db8::/32", Forwarded)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		resolver *Resolver
+		peer     string
+		headers  map[string][]string
+		want     string
+	}{
+		{name: "untrusted peer ignores headers", resolver: xff, peer: "203.0.113.7:5000",
+			headers: map[string][]string{XForwardedFor: {"198.51.100.1"}}, want: "203.0.113.7"},
+		{name: "trusted peer without headers", resolver: xff, peer: "10.0.0.2:5000", want: "10.0.0.2"},
+		{name: "one proxy", resolver: xff, peer: "10.0.0.2:5000",
+			headers: map[string][]string{XForwardedFor: {"198.51.100.1"}}, want: "198.51.100.1"},
+		{name: "spoofed entries left of the client are ignored", resolver: xff, peer: "10.0.0.2:5000",
+			headers: map[string][]string{XForwardedFor: {"1.2.3.4, 198.51.100.1, 192.168.1.10"}}, want: "198.51.100.1"},
+		{name: "repeated headers form one chain", resolver: xff, peer: "10.0.0.2:5000",
+			headers: map[string][]string{XForwardedFor: {"1.2.3.4", "198.51.100.1, 10.1.1.1"}}, want: "198.51.100.1"},
+		{name: "malformed entry stops at the last trusted hop", resolver: xff, peer: "10.0.0.2:5000",
+			headers: map[string][]string{XForwardedFor: {"1.2.3.4, garbage, 10.9.9.9"}}, want: "10.9.9.9"},
+		{name: "only trusted hops", resolver: xff, peer: "10.0.0.2:5000",
+			headers: map[string][]string{XForwardedFor: {"10.3.3.3, 10.4.4.4"}}, want: "10.3.3.3"},
+		{name: "Forwarded is ignored by an X-Forwarded-For resolver", resolver: xff, peer: "10.0.0.2:5000",
+			headers: map[string][]string{Forwarded: {"for=1.2.3.4"}}, want: "10.0.0.2"},
+		{name: "Forwarded with ports and IPv6", resolver: forwarded, peer: "[2001:db8::5]:443",
+			headers: map[string][]string{Forwarded: {`for=198.51.100.1:4711;proto=https, For="[2001:db8:cafe::17]:4711"`}}, want: "198.51.100.1"},
+		{name: "Forwarded obfuscated node", resolver: forwarded, peer: "10.0.0.2:5000",
+			headers: map[string][]string{Forwarded: {"for=_hidden, for=10.5.5.5"}}, want: "10.5.5.5"},
+		{name: "X-Forwarded-For is ignored by a Forwarded resolver", resolver: forwarded, peer: "10.0.0.2:5000",
+			headers: map[string][]string{XForwardedFor: {"1.2.3.4"}}, want: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		for k, values := range tt.headers {
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+		if got := tt.resolver.Resolve(req).String(); got != tt.want {
+			t.Errorf("%s: expected %s, got: %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestNewResolverRejectsBadConfig(t *testing.T) {
+	if _, err := NewResolver("10.0.0.0/33", XForwardedFor); err == nil {
+		t.Errorf("Expected an error for an invalid CIDR")
+	}
+	if _, err := NewResolver("", "X-Real-IP"); err == nil {
+		t.Errorf("Expected an error for an unsupported header")
+	}
+}
+
+func TestMiddlewareSetsClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	resolver, _ := NewResolver("10.0.0.0/8", XForwardedFor)
+	router := gin.New()
+	router.TrustedPlatform = Header
+	router.Use(resolver.Middleware())
+	router.GET("/", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+
+	tests := []struct {
+		peer string
+		want string
+	}{
+		{peer: "10.0.0.2:5000", want: "198.51.100.1"},
+		// A client writing the internal header itself gets it replaced.
+		{peer: "203.0.113.7:5000", want: "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		req.Header.Set(XForwardedFor, "198.51.100.1")
+		req.Header.Set(Header, "1.2.3.4")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Body.String() != tt.want {
+			t.Errorf("Peer %s: expected client IP %s, got: %s", tt.peer, tt.want, w.Body)
+		}
+	}
+}
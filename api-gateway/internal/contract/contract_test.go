@@ -0,0 +1,174 @@
+package contract
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/api-gateway/api"
+)
+
+const testSpec = `
+openapi: 3.0.3
+paths:
+  /users:
+    get:
+      responses:
+        "200":
+          description: Users
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [users]
+                properties:
+                  users:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/User"
+  /users/{id}:
+    get:
+      responses:
+        "200":
+          description: A user
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/User"
+        "404":
+          $ref: "#/components/responses/Error"
+  /users/export:
+    get:
+      responses:
+        "200":
+          description: CSV
+          content:
+            text/csv:
+              schema:
+                type: string
+components:
+  schemas:
+    User:
+      type: object
+      required: [id, email]
+      additionalProperties: false
+      properties:
+        id:
+          type: integer
+        email:
+          type: string
+        status:
+          type: string
+          enum: [active, deactivated]
+    Error:
+      type: object
+      required: [error]
+      properties:
+        error:
+          type: string
+  responses:
+    Error:
+      description: Error response
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Error"
+`
+
+func TestCheck(t *testing.T) {
+	spec, err := Parse([]byte(testSpec))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+		want   string
+	}{
+		{path: "/users", status: 200, body: `{"users":[{"id":1,"email":"a@example.com","status":"active"}]}`},
+		{path: "/users", status: 200, body: `{"users":null}`, want: "$.users: expected array, got null"},
+		{path: "/users/1", status: 200, body: `{"id":"1","email":"a@example.com"}`, want: "$.id: expected integer, got string"},
+		{path: "/users/1", status: 200, body: `{"id":1.5,"email":"a@example.com"}`, want: "$.id: expected integer, got number"},
+		{path: "/users/1", status: 200, body: `{"id":1}`, want: `$: missing required property "email"`},
+		{path: "/users/1", status: 200, body: `{"id":1,"email":"a","nick":"x"}`, want: `$: unexpected property "nick"`},
+		{path: "/users/1", status: 200, body: `{"id":1,"email":"a","status":"gone"}`, want: "$.status: gone is not one of [active deactivated]"},
+		{path: "/users/1", status: 404, body: `{"message":"nope"}`, want: `$: missing required property "error"`},
+		{path: "/users/1", status: 500, body: `{"message":"boom"}`},
+		{path: "/users/1", status: 201, body: `{}`, want: "status 201 is not documented for GET /users/{id}"},
+		{path: "/users/export", status: 200, body: `{"id":"not checked as a user"}`},
+		{path: "/orders", status: 200, body: `{}`, want: "no operation for GET /orders"},
+	}
+	for _, tt := range tests {
+		problems := spec.Check(http.MethodGet, tt.path, tt.status, []byte(tt.body))
+		got := strings.Join(problems, "; ")
+		if got != tt.want {
+			t.Errorf("%s %d %s: expected %q, got: %q", tt.path, tt.status, tt.body, tt.want, got)
+		}
+	}
+}
+
+func TestParseGatewaySpec(t *testing.T) {
+	spec, err := Parse(api.Spec)
+	if err != nil {
+		t.Fatalf("Failed to parse the gateway's own spec: %v", err)
+	}
+	if problems := spec.Check(http.MethodGet, "/health", http.StatusOK, []byte(`{"status":"healthy","service":"api-gateway"}`)); len(problems) != 0 {
+		t.Errorf("Expected the health response to match, got: %v", problems)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	specFetches := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/docs/openapi.yaml":
+			specFetches++
+			w.Write([]byte(testSpec))
+		case "/users/1":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"id":1}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"users":[]}`))
+		}
+	}))
+	defer backend.Close()
+
+	for _, mode := range []string{ModeLog, ModeReject} {
+		v, err := NewValidator(mode)
+		if err != nil {
+			t.Fatalf("NewValidator failed: %v", err)
+		}
+		client := &http.Client{}
+		v.Wrap(client)
+
+		resp, err := client.Get(backend.URL + "/users")
+		if err != nil {
+			t.Fatalf("%s: expected a matching response to pass, got: %v", mode, err)
+		}
+		resp.Body.Close()
+
+		resp, err = client.Get(backend.URL + "/users/1")
+		var mismatch *MismatchError
+		if mode == ModeLog && err != nil {
+			t.Errorf("Expected log mode to pass mismatches through, got: %v", err)
+		}
+		if mode == ModeReject && !errors.As(err, &mismatch) {
+			t.Errorf("Expected reject mode to fail with a MismatchError, got: %v", err)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	if specFetches != 2 {
+		t.Errorf("Expected the spec to be fetched once per validator, got: %d", specFetches)
+	}
+
+	if _, err := NewValidator("strict"); err == nil {
+		t.Error("Expected error for an unknown mode")
+	}
+}
@@ -0,0 +1,278 @@
+// Package contract checks backend responses against the OpenAPI spec each
+// backend serves at /docs/openapi.yaml, to catch contract drift between
+// services before clients do.
+package contract
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Spec is the part of an OpenAPI 3.0 document needed to check JSON responses.
+type Spec struct {
+	Paths      map[string]PathItem `yaml:"paths"`
+	Components struct {
+		Schemas   map[string]*Schema   `yaml:"schemas"`
+		Responses map[string]*Response `yaml:"responses"`
+	} `yaml:"components"`
+}
+
+type PathItem struct {
+	Get    *Operation `yaml:"get"`
+	Post   *Operation `yaml:"post"`
+	Put    *Operation `yaml:"put"`
+	Patch  *Operation `yaml:"patch"`
+	Delete *Operation `yaml:"delete"`
+}
+
+func (p PathItem) operation(method string) *Operation {
+	switch strings.ToUpper(method) {
+	case "GET":
+		return p.Get
+	case "POST":
+		return p.Post
+	case "PUT":
+		return p.Put
+	case "PATCH":
+		return p.Patch
+	case "DELETE":
+		return p.Delete
+	}
+	return nil
+}
+
+type Operation struct {
+	Responses map[string]*Response `yaml:"responses"`
+}
+
+type Response struct {
+	Ref     string `yaml:"$ref"`
+	Content map[string]struct {
+		Schema *Schema `yaml:"schema"`
+	} `yaml:"content"`
+}
+
+type Schema struct {
+	Ref                  string             `yaml:"$ref"`
+	Type                 string             `yaml:"type"`
+	Nullable             bool               `yaml:"nullable"`
+	Required             []string           `yaml:"required"`
+	Properties           map[string]*Schema `yaml:"properties"`
+	Items                *Schema            `yaml:"items"`
+	Enum                 []any              `yaml:"enum"`
+	AllOf                []*Schema          `yaml:"allOf"`
+	AdditionalProperties *Additional        `yaml:"additionalProperties"`
+}
+
+// Additional is additionalProperties, which is either a boolean or a schema.
+type Additional struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *Additional) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&a.Allowed)
+	}
+	a.Allowed = true
+	return node.Decode(&a.Schema)
+}
+
+func Parse(data []byte) (*Spec, error) {
+	var s Spec
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Check returns every way a JSON body for method and path with status
+// breaks the spec. Paths the spec does not know are reported; undocumented
+// error statuses are not, since the spec only lists the likely ones.
+func (s *Spec) Check(method, path string, status int, body []byte) []string {
+	op, template := s.find(method, path)
+	if op == nil {
+		return []string{fmt.Sprintf("no operation for %s %s", method, path)}
+	}
+	resp, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		resp, ok = op.Responses["default"]
+	}
+	if !ok {
+		if status < 300 {
+			return []string{fmt.Sprintf("status %d is not documented for %s %s", status, method, template)}
+		}
+		return nil
+	}
+	resp = s.response(resp)
+	if resp == nil {
+		return nil
+	}
+	media, ok := resp.Content["application/json"]
+	if !ok || media.Schema == nil {
+		return nil
+	}
+
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return []string{"body is not valid JSON: " + err.Error()}
+	}
+	var problems []string
+	s.validate(media.Schema, v, "$", &problems)
+	return problems
+}
+
+// find matches path against the spec's templates, preferring the one with
+// the fewest parameters so /users/export wins over /users/{id}.
+func (s *Spec) find(method, path string) (*Operation, string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var best *Operation
+	bestTemplate, bestParams := "", math.MaxInt
+	for template, item := range s.Paths {
+		op := item.operation(method)
+		if op == nil {
+			continue
+		}
+		parts := strings.Split(strings.Trim(template, "/"), "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		params := 0
+		matched := true
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				params++
+			} else if part != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched && (params < bestParams || params == bestParams && template < bestTemplate) {
+			best, bestTemplate, bestParams = op, template, params
+		}
+	}
+	return best, bestTemplate
+}
+
+func (s *Spec) response(r *Response) *Response {
+	for i := 0; r != nil && r.Ref != "" && i < 10; i++ {
+		r = s.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+func (s *Spec) schema(schema *Schema) *Schema {
+	for i := 0; schema != nil && schema.Ref != "" && i < 10; i++ {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+func (s *Spec) validate(schema *Schema, v any, at string, problems *[]string) {
+	schema = s.schema(schema)
+	if schema == nil {
+		return
+	}
+	for _, part := range schema.AllOf {
+		s.validate(part, v, at, problems)
+	}
+	if v == nil {
+		if schema.Type != "" && !schema.Nullable {
+			*problems = append(*problems, fmt.Sprintf("%s: expected %s, got null", at, schema.Type))
+		}
+		return
+	}
+	if schema.Type != "" && !hasType(schema.Type, v) {
+		*problems = append(*problems, fmt.Sprintf("%s: expected %s, got %s", at, schema.Type, typeOf(v)))
+		return
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, v) {
+		*problems = append(*problems, fmt.Sprintf("%s: %v is not one of %v", at, v, schema.Enum))
+	}
+
+	switch v := v.(type) {
+	case []any:
+		if schema.Items != nil {
+			for i, item := range v {
+				s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i), problems)
+			}
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: missing required property %q", at, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := schema.Properties[name]; ok {
+				s.validate(prop, v[name], at+"."+name, problems)
+			} else if extra := schema.AdditionalProperties; extra != nil {
+				if !extra.Allowed {
+					*problems = append(*problems, fmt.Sprintf("%s: unexpected property %q", at, name))
+				} else if extra.Schema != nil {
+					s.validate(extra.Schema, v[name], at+"."+name, problems)
+				}
+			}
+		}
+	}
+}
+
+func hasType(want string, v any) bool {
+	switch want {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	}
+	return true
+}
+
+func typeOf(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	}
+	return "null"
+}
+
+func inEnum(enum []any, v any) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package contract
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// Modes for CONTRACT_VALIDATION.
+const (
+	ModeOff    = "off"
+	ModeLog    = "log"
+	ModeReject = "reject"
+)
+
+// MismatchError is returned in reject mode in place of a response that
+// breaks its backend's spec.
+type MismatchError struct {
+	Method   string
+	URL      string
+	Status   int
+	Problems []string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s %s returned %d, which breaks its contract: %s", e.Method, e.URL, e.Status, strings.Join(e.Problems, "; "))
+}
+
+// Validator fetches each backend's spec the first time a response from it
+// is checked. A backend whose spec cannot be fetched is not checked, and
+// fetching is retried after retryAfter.
+type Validator struct {
+	mode       string
+	fetch      *http.Client
+	retryAfter time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	specs map[string]*hostSpec
+}
+
+type hostSpec struct {
+	spec     *Spec
+	failedAt time.Time
+}
+
+func NewValidator(mode string) (*Validator, error) {
+	switch mode {
+	case ModeOff, ModeLog, ModeReject:
+	default:
+		return nil, fmt.Errorf("unknown contract validation mode %q, want off, log or reject", mode)
+	}
+	return &Validator{
+		mode:       mode,
+		fetch:      httpclient.New(),
+		retryAfter: time.Minute,
+		now:        time.Now,
+		specs:      map[string]*hostSpec{},
+	}, nil
+}
+
+// Wrap adds response checking to client's transport. It changes nothing
+// when validation is off.
+func (v *Validator) Wrap(client *http.Client) {
+	if v.mode == ModeOff {
+		return
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &Transport{Base: base, Validator: v}
+}
+
+func (v *Validator) spec(ctx context.Context, u *url.URL) *Spec {
+	v.mu.Lock()
+	cached, ok := v.specs[u.Host]
+	v.mu.Unlock()
+	if ok && (cached.spec != nil || v.now().Sub(cached.failedAt) < v.retryAfter) {
+		return cached.spec
+	}
+
+	spec, err := v.load(ctx, u)
+	entry := &hostSpec{spec: spec}
+	if err != nil {
+		log.Printf("Skipping contract checks for %s: %v", u.Host, err)
+		entry.failedAt = v.now()
+	}
+	v.mu.Lock()
+	v.specs[u.Host] = entry
+	v.mu.Unlock()
+	return spec
+}
+
+func (v *Validator) load(ctx context.Context, u *url.URL) (*Spec, error) {
+	docs := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/docs/openapi.yaml"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docs.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.fetch.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching spec: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Transport checks JSON responses from Base against their backend's spec,
+// logging mismatches and, in reject mode, failing the request with a
+// *MismatchError. Other content types, such as event streams, pass through
+// untouched.
+type Transport struct {
+	Base      http.RoundTripper
+	Validator *Validator
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if media, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); media != "application/json" {
+		return resp, nil
+	}
+	spec := t.Validator.spec(req.Context(), req.URL)
+	if spec == nil {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	problems := spec.Check(req.Method, req.URL.Path, resp.StatusCode, body)
+	if len(problems) == 0 {
+		return resp, nil
+	}
+	mismatch := &MismatchError{Method: req.Method, URL: req.URL.Redacted(), Status: resp.StatusCode, Problems: problems}
+	log.Printf("Contract mismatch: %v", mismatch)
+	if t.Validator.mode == ModeReject {
+		return nil, mismatch
+	}
+	return resp, nil
+}
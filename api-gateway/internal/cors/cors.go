@@ -0,0 +1,171 @@
+// Package cors lets browser clients on other origins call the gateway. It
+// answers preflight requests itself and marks responses to allowed origins
+// so the browser hands them to the calling script.
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Policy says which cross-origin requests are allowed. A policy with no
+// AllowedOrigins allows none, and the middleware passes every request
+// through untouched.
+type Policy struct {
+	// AllowedOrigins are origins such as "https://app.example.com".
+	// "https://*.example.com" allows any subdomain, and "*" any origin.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight answer.
+	MaxAge time.Duration
+}
+
+// SplitList splits a comma-separated list, dropping empty entries.
+func SplitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Validate rejects origins that are not scheme://host[:port] and
+// credentials for any origin, which would let every site on the web make
+// authenticated calls on a visitor's behalf.
+func (p Policy) Validate() error {
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if p.AllowCredentials {
+				return errors.New("credentials cannot be allowed for every origin")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid allowed origin %q, want scheme://host", origin)
+		}
+	}
+	return nil
+}
+
+func (p Policy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "/"))
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok &&
+			strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware answers preflight requests from allowed origins with 204 and
+// rejects the rest with 403, before they reach kill switches or backends.
+// Other requests from allowed origins get Access-Control-Allow-Origin.
+// Install it before anything that can answer on its own, such as the
+// response cache, so those answers are marked too; the cache must not keep
+// the headers it sets.
+func (p Policy) Middleware() gin.HandlerFunc {
+	methods := strings.Join(p.AllowedMethods, ", ")
+	headers := strings.Join(p.AllowedHeaders, ", ")
+	exposed := strings.Join(p.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(p.MaxAge.Seconds()))
+	anyOrigin := containsFold(p.AllowedOrigins, "*")
+
+	return func(c *gin.Context) {
+		if len(p.AllowedOrigins) == 0 {
+			c.Next()
+			return
+		}
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		header := c.Writer.Header()
+		if !anyOrigin {
+			// The answer depends on the origin, so caches must not give one
+			// origin's response to another.
+			header.Add("Vary", "Origin")
+		}
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		allowed := p.allowsOrigin(origin)
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			if !allowed || !p.allowsPreflight(c) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		} else if !allowed {
+			c.Next()
+			return
+		}
+
+		if anyOrigin {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if exposed != "" {
+				header.Set("Access-Control-Expose-Headers", exposed)
+			}
+			c.Next()
+			return
+		}
+
+		header.Set("Access-Control-Allow-Methods", methods)
+		if headers != "" {
+			header.Set("Access-Control-Allow-Headers", headers)
+		}
+		if p.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", maxAge)
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// allowsPreflight reports whether the method and every header the browser
+// asks to send are allowed. CORS-safelisted methods are always allowed.
+func (p Policy) allowsPreflight(c *gin.Context) bool {
+	method := c.GetHeader("Access-Control-Request-Method")
+	if method != http.MethodGet && method != http.MethodHead && method != http.MethodPost && !containsFold(p.AllowedMethods, method) {
+		return false
+	}
+	for _, name := range SplitList(c.GetHeader("Access-Control-Request-Headers")) {
+		if !containsFold(p.AllowedHeaders, name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		valid  bool
+	}{
+		{Policy{AllowedOrigins: []string{"https://app.example.com", "https://*.example.com", "http://localhost:3000"}, AllowCredentials: true}, true},
+		{Policy{AllowedOrigins: []string{"*"}}, true},
+		{Policy{AllowedOrigins: []string{"*"}, AllowCredentials: true}, false},
+		{Policy{AllowedOrigins: []string{"app.example.com"}}, false},
+		{Policy{AllowedOrigins: []string{"https://app.example.com/path"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v): expected valid=%t, got: %v", tt.policy, tt.valid, err)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	policy := Policy{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.shop.example.com"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	router := gin.New()
+	router.Use(policy.Middleware())
+	router.GET("/api/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	do := func(method, origin string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/users", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "https://app.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Expose-Headers") != "X-Request-ID" {
+		t.Errorf("Expected an allowed origin to be marked, got: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Vary") != "Origin" {
+		t.Errorf("Expected Vary: Origin, got: %v", w.Header().Values("Vary"))
+	}
+	if w := do(http.MethodGet, "https://eu.shop.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "https://eu.shop.example.com" {
+		t.Errorf("Expected a wildcard subdomain to be allowed, got: %v", w.Header())
+	}
+	for _, origin := range []string{"https://evil.example.com", "https://shop.example.com.evil.com", ""} {
+		if w := do(http.MethodGet, origin); w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected %q to be passed through unmarked, got: %d %v", origin, w.Code, w.Header())
+		}
+	}
+
+	w = do(http.MethodOptions, "https://app.example.com", "Access-Control-Request-Method", "DELETE",
+		"Access-Control-Request-Headers", "authorization, content-type")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, DELETE" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Authorization, Content-Type" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("Expected the preflight to be answered, got: %d %v", w.Code, w.Header())
+	}
+	preflights := []struct {
+		origin, method, headers string
+	}{
+		{"https://evil.example.com", "GET", ""},
+		{"https://app.example.com", "PUT", ""},
+		{"https://app.example.com", "POST", "X-Debug"},
+	}
+	for _, tt := range preflights {
+		w := do(http.MethodOptions, tt.origin, "Access-Control-Request-Method", tt.method, "Access-Control-Request-Headers", tt.headers)
+		if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected preflight %+v to be rejected, got: %d %v", tt, w.Code, w.Header())
+		}
+	}
+
+	router = gin.New()
+	router.Use(Policy{}.Middleware())
+	router.GET("/api/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	if w := do(http.MethodGet, "https://app.example.com"); len(w.Header()) != 0 {
+		t.Errorf("Expected an empty policy to set no headers, got: %v", w.Header())
+	}
+}
+
+func TestAnyOrigin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Policy{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}}.Middleware())
+	router.GET("/api/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("Origin", "https://anywhere.example")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Vary") != "" {
+		t.Errorf("Expected * without Vary, got: %v", w.Header())
+	}
+}
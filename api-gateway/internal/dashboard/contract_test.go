@@ -0,0 +1,73 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/clients/contracttest"
+)
+
+// contracts are what the dashboard expects of each backend, decoded into
+// the pkg/clients types. The backends verify them in their own tests.
+func contracts() []*contracttest.Contract {
+	users := contracttest.New("api-gateway", "user-service")
+	users.Add(contracttest.Interaction{
+		Description: "the dashboard's user",
+		State:       "user 7 exists",
+		Method:      http.MethodGet,
+		Path:        "/users/7",
+		Status:      http.StatusOK,
+	}, clients.User{})
+
+	orders := contracttest.New("api-gateway", "order-service")
+	orders.Add(contracttest.Interaction{
+		Description: "the dashboard's recent orders",
+		State:       "user 7 has an order",
+		Method:      http.MethodGet,
+		Path:        "/orders?user_id=7",
+		Status:      http.StatusOK,
+	}, struct {
+		Orders []clients.Order `json:"orders"`
+	}{})
+
+	notifications := contracttest.New("api-gateway", "notification-service")
+	notifications.Add(contracttest.Interaction{
+		Description: "the dashboard's recent notifications",
+		State:       "user 7 has a notification",
+		Method:      http.MethodGet,
+		Path:        "/notifications?user_id=7",
+		Status:      http.StatusOK,
+	}, struct {
+		Notifications []clients.Notification `json:"notifications"`
+	}{})
+
+	return []*contracttest.Contract{users, orders, notifications}
+}
+
+func TestContracts(t *testing.T) {
+	all := contracts()
+	for _, c := range all {
+		contracttest.AssertGolden(t, c)
+	}
+
+	h := NewHandler(
+		clients.NewUserClient(contracttest.Stub(t, all[0]).URL, nil),
+		clients.NewOrderClient(contracttest.Stub(t, all[1]).URL, nil),
+		clients.NewNotificationClient(contracttest.Stub(t, all[2]).URL, nil),
+		time.Second,
+	)
+	w := serve(h, "/api/dashboard/7")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d %s", w.Code, w.Body.String())
+	}
+	var resp response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(resp.Warnings) != 0 || resp.User == nil || len(resp.Orders) != 1 || len(resp.Notifications) != 1 {
+		t.Errorf("Expected every section from the contract examples, got: %+v", resp)
+	}
+}
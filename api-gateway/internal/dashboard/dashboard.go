@@ -0,0 +1,120 @@
+// Package dashboard aggregates a user's data from several backends into a
+// single response for the frontend.
+package dashboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/gin-gonic/gin"
+)
+
+type UserSource interface {
+	GetUser(ctx context.Context, id int) (*clients.User, error)
+}
+
+type OrderSource interface {
+	ListOrders(ctx context.Context, userID int) ([]clients.Order, error)
+}
+
+type NotificationSource interface {
+	ListNotifications(ctx context.Context, userID int) ([]clients.Notification, error)
+}
+
+type Handler struct {
+	users         UserSource
+	orders        OrderSource
+	notifications NotificationSource
+	timeout       time.Duration
+}
+
+// NewHandler returns a dashboard handler that gives each backend at most
+// timeout to answer before its section is dropped from the response.
+func NewHandler(users UserSource, orders OrderSource, notifications NotificationSource, timeout time.Duration) *Handler {
+	return &Handler{users: users, orders: orders, notifications: notifications, timeout: timeout}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/api/dashboard/:user_id", h.get)
+}
+
+type response struct {
+	User          *clients.User          `json:"user"`
+	Orders        []clients.Order        `json:"orders"`
+	Notifications []clients.Notification `json:"notifications"`
+	Warnings      []string               `json:"warnings,omitempty"`
+}
+
+func (h *Handler) get(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeout)
+	defer cancel()
+
+	var (
+		wg                sync.WaitGroup
+		resp              response
+		userErr, orderErr error
+		notificationErr   error
+	)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		resp.User, userErr = h.users.GetUser(ctx, userID)
+	}()
+	go func() {
+		defer wg.Done()
+		resp.Orders, orderErr = h.orders.ListOrders(ctx, userID)
+	}()
+	go func() {
+		defer wg.Done()
+		resp.Notifications, notificationErr = h.notifications.ListNotifications(ctx, userID)
+	}()
+	wg.Wait()
+
+	if apiErr, ok := clients.IsAuthError(userErr); ok {
+		c.JSON(apiErr.StatusCode, gin.H{"error": apiErr.Message})
+		return
+	}
+	var apiErr *clients.APIError
+	if errors.As(userErr, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if userErr != nil && orderErr != nil && notificationErr != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "all backends failed"})
+		return
+	}
+
+	resp.Warnings = append(resp.Warnings, warning("user-service", userErr)...)
+	resp.Warnings = append(resp.Warnings, warning("order-service", orderErr)...)
+	resp.Warnings = append(resp.Warnings, warning("notification-service", notificationErr)...)
+	if orderErr != nil {
+		resp.Orders = nil
+	}
+	if notificationErr != nil {
+		resp.Notifications = nil
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func warning(service string, err error) []string {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return []string{fmt.Sprintf("%s: timed out", service)}
+	}
+	return []string{fmt.Sprintf("%s: %v", service, err)}
+}
@@ -0,0 +1,91 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/testfactory"
+	"github.com/gin-gonic/gin"
+)
+
+type fakeUsers struct{ err error }
+
+func (f fakeUsers) GetUser(ctx context.Context, id int) (*clients.User, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return testfactory.User(testfactory.UserID(id)), nil
+}
+
+type fakeOrders struct{}
+
+func (fakeOrders) ListOrders(ctx context.Context, userID int) ([]clients.Order, error) {
+	return []clients.Order{*testfactory.Order(testfactory.ForUser(userID))}, nil
+}
+
+type slowNotifications struct{}
+
+func (slowNotifications) ListNotifications(ctx context.Context, userID int) ([]clients.Notification, error) {
+	select {
+	case <-time.After(time.Second):
+		return []clients.Notification{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func serve(h *Handler, path string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	h.RegisterRoutes(router)
+
+	req, _ := http.NewRequest("GET", path, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestDashboardPartialOnTimeout(t *testing.T) {
+	h := NewHandler(fakeUsers{}, fakeOrders{}, slowNotifications{}, 50*time.Millisecond)
+	w := serve(h, "/api/dashboard/1")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", w.Code)
+	}
+
+	var resp response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if resp.User == nil || len(resp.Orders) != 1 {
+		t.Errorf("Expected user and orders to be present: %+v", resp)
+	}
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != "notification-service: timed out" {
+		t.Errorf("Expected a single notification timeout warning, got: %v", resp.Warnings)
+	}
+}
+
+func TestDashboardUserNotFound(t *testing.T) {
+	users := fakeUsers{err: &clients.APIError{StatusCode: http.StatusNotFound, Message: "user not found"}}
+	h := NewHandler(users, fakeOrders{}, slowNotifications{}, 10*time.Millisecond)
+	w := serve(h, "/api/dashboard/42")
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got: %d", w.Code)
+	}
+}
+
+func TestDashboardPassesThroughForbidden(t *testing.T) {
+	users := fakeUsers{err: &clients.APIError{StatusCode: http.StatusForbidden, Message: "not allowed to access another user's resources"}}
+	h := NewHandler(users, fakeOrders{}, slowNotifications{}, 10*time.Millisecond)
+	w := serve(h, "/api/dashboard/2")
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got: %d", w.Code)
+	}
+}
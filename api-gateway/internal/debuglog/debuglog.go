@@ -0,0 +1,173 @@
+// Package debuglog logs request and response bodies for chosen gateway
+// routes, to diagnose integration issues. Bodies are redacted before they
+// are logged (see RedactBody), and logging is switched on and off at
+// runtime through the admin API, so it only runs while someone is looking.
+package debuglog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/gin-gonic/gin"
+)
+
+// ParseRoutes parses comma-separated path prefixes, e.g.
+// "/api/orders,/api/dashboard".
+func ParseRoutes(s string) ([]string, error) {
+	var routes []string
+	for _, route := range strings.Split(s, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		if !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid debug log route %q, want a path prefix", route)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// State is what the logger is currently doing. Logging stops by itself at
+// ExpiresAt, when set.
+type State struct {
+	Enabled   bool       `json:"enabled"`
+	Routes    []string   `json:"routes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Logger holds its state in memory, so toggling it only affects the gateway
+// replica that served the admin request.
+type Logger struct {
+	maxBody int
+	now     func() time.Time
+	logf    func(format string, args ...any)
+
+	mu    sync.RWMutex
+	state State
+}
+
+// New returns a logger starting in state that logs bodies of up to maxBody
+// bytes.
+func New(state State, maxBody int) *Logger {
+	return &Logger{maxBody: maxBody, now: time.Now, logf: log.Printf, state: state}
+}
+
+// State returns the current state, reporting an expired one as disabled.
+func (l *Logger) State() State {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s := l.state
+	s.Routes = append([]string{}, s.Routes...)
+	if s.ExpiresAt != nil && !l.now().Before(*s.ExpiresAt) {
+		s.Enabled, s.ExpiresAt = false, nil
+	}
+	return s
+}
+
+func (l *Logger) Set(s State) {
+	l.mu.Lock()
+	l.state = s
+	l.mu.Unlock()
+}
+
+// covers reports whether path is one of the logged routes or below one, so
+// /api/orders covers /api/orders/1 but not /api/orders-archive.
+func (l *Logger) covers(path string) bool {
+	s := l.State()
+	if !s.Enabled {
+		return false
+	}
+	for _, route := range s.Routes {
+		route = strings.TrimSuffix(route, "/")
+		if path == route || strings.HasPrefix(path, route+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware logs covered requests once they have been answered. Install it
+// after requestid.Middleware so log lines carry the request ID, and before
+// anything that can answer from the gateway itself, such as the response
+// cache.
+func (l *Logger) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.covers(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		var request []byte
+		if c.Request.Body != nil {
+			// Read one byte past the limit to tell a body that fits from one
+			// that does not, then hand the handler the whole body again.
+			request, _ = io.ReadAll(io.LimitReader(c.Request.Body, int64(l.maxBody)+1))
+			c.Request.Body = replayBody{Reader: io.MultiReader(bytes.NewReader(request), c.Request.Body), Closer: c.Request.Body}
+		}
+
+		start := l.now()
+		original := c.Writer
+		w := &teeWriter{ResponseWriter: original, max: l.maxBody}
+		c.Writer = w
+		c.Next()
+		c.Writer = original
+
+		path := c.Request.URL.Path
+		if c.Request.URL.RawQuery != "" {
+			path += "?" + RedactQuery(c.Request.URL.RawQuery)
+		}
+		l.logf("Debug %s %s %d %s request_id=%s request=%s response=%s",
+			c.Request.Method, path, original.Status(), l.now().Sub(start).Round(time.Millisecond),
+			requestid.FromContext(c.Request.Context()),
+			l.describe(c.ContentType(), request), l.describe(original.Header().Get("Content-Type"), w.body.Bytes()))
+	}
+}
+
+func (l *Logger) describe(contentType string, body []byte) string {
+	if len(body) > l.maxBody {
+		return fmt.Sprintf("[over %d bytes, not logged]", l.maxBody)
+	}
+	if len(body) == 0 {
+		return "[empty]"
+	}
+	return RedactBody(contentType, body)
+}
+
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// teeWriter copies up to one byte past max of the response as it is
+// written through.
+type teeWriter struct {
+	gin.ResponseWriter
+	max  int
+	body bytes.Buffer
+}
+
+func (w *teeWriter) capture(b []byte) {
+	if room := w.max + 1 - w.body.Len(); room > 0 {
+		if len(b) > room {
+			b = b[:room]
+		}
+		w.body.Write(b)
+	}
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	w.capture(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *teeWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,105 @@
+package debuglog
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/json", `{"username": "ada", "password": "hunter2", "profile": {"Email": "ada@example.com"}}`,
+			`{"password":"[REDACTED]","profile":{"Email":"[REDACTED]"},"username":"ada"}`},
+		{"application/json; charset=utf-8", `{"tokens": [{"refreshToken": "abc"}], "note": "mail ada@example.com back"}`,
+			`{"note":"mail [REDACTED] back","tokens":"[REDACTED]"}`},
+		{"application/json", `[{"api_key": "k1"}, {"sku": "SKU-001"}]`, `[{"api_key":"[REDACTED]"},{"sku":"SKU-001"}]`},
+		{"application/x-www-form-urlencoded", "grant_type=password&client_secret=s3cret", "client_secret=%5BREDACTED%5D&grant_type=password"},
+		{"application/json", `{"password": "unterminated`, "[26 bytes of application/json]"},
+		{"text/plain", "password=hunter2", "[16 bytes of text/plain]"},
+	}
+	for _, tt := range tests {
+		if got := RedactBody(tt.contentType, []byte(tt.body)); got != tt.want {
+			t.Errorf("RedactBody(%s, %s): expected %s, got: %s", tt.contentType, tt.body, tt.want, got)
+		}
+	}
+	if got := RedactQuery("q=widgets&access_token=abc"); got != "access_token=%5BREDACTED%5D&q=widgets" {
+		t.Errorf("Expected the token to be redacted from the query, got: %s", got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	logger := New(State{Routes: []string{"/api/users"}}, 64)
+	logger.now = func() time.Time { return now }
+	var lines []string
+	logger.logf = func(format string, args ...any) { lines = append(lines, fmt.Sprintf(format, args...)) }
+
+	router := gin.New()
+	router.Use(logger.Middleware())
+	var received string
+	router.POST("/api/users/*rest", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		received = string(body)
+		c.JSON(http.StatusCreated, gin.H{"id": 1, "email": "ada@example.com"})
+	})
+	router.POST("/api/orders", func(c *gin.Context) { c.Status(http.StatusCreated) })
+	admin := router.Group("/admin")
+	NewHandler(logger).RegisterAdminRoutes(admin)
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	register := `{"username": "ada", "password": "hunter2"}`
+	do(http.MethodPost, "/api/users/register", "application/json", register)
+	if len(lines) != 0 {
+		t.Fatalf("Expected nothing to be logged while disabled, got: %v", lines)
+	}
+
+	if w := do(http.MethodPut, "/admin/debug-logging", "application/json", `{"enabled": true, "routes": []}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for enabling without routes, got: %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/admin/debug-logging", "application/json", `{"enabled": true, "duration": "15m"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", w.Code, w.Body)
+	}
+	do(http.MethodPost, "/api/users/register?invite=ada@example.com", "application/json", register)
+	do(http.MethodPost, "/api/orders", "application/json", `{"sku": "SKU-001"}`)
+	do(http.MethodPost, "/api/users/register", "application/json", `{"bio": "`+strings.Repeat("x", 64)+`"}`)
+
+	if received != `{"bio": "`+strings.Repeat("x", 64)+`"}` {
+		t.Errorf("Expected the handler to get the whole body, got: %s", received)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Expected only the two users requests to be logged, got: %v", lines)
+	}
+	want := `Debug POST /api/users/register?invite=%5BREDACTED%5D 201 0s request_id= request={"password":"[REDACTED]","username":"ada"} response={"email":"[REDACTED]","id":1}`
+	if lines[0] != want {
+		t.Errorf("Expected %s, got: %s", want, lines[0])
+	}
+	if !strings.Contains(lines[1], "request=[over 64 bytes, not logged]") {
+		t.Errorf("Expected an oversized body not to be logged, got: %s", lines[1])
+	}
+
+	now = now.Add(15 * time.Minute)
+	do(http.MethodPost, "/api/users/register", "application/json", register)
+	if len(lines) != 2 {
+		t.Errorf("Expected logging to stop once its duration ran out, got: %v", lines[2:])
+	}
+	if logger.State().Enabled {
+		t.Errorf("Expected the expired state to be reported as disabled")
+	}
+}
@@ -0,0 +1,74 @@
+package debuglog
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	logger *Logger
+}
+
+func NewHandler(logger *Logger) *Handler {
+	return &Handler{logger: logger}
+}
+
+// RegisterAdminRoutes mounts the debug logging toggle on an admin-protected
+// group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/debug-logging", h.get)
+	router.PUT("/debug-logging", h.set)
+}
+
+func (h *Handler) get(c *gin.Context) {
+	c.JSON(http.StatusOK, h.logger.State())
+}
+
+type setRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+	// Routes replaces the logged routes when set.
+	Routes []string `json:"routes"`
+	// Duration turns logging off again after it, e.g. "15m".
+	Duration string `json:"duration"`
+	Actor    string `json:"actor" binding:"max=255"`
+}
+
+func (h *Handler) set(c *gin.Context) {
+	var req setRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	state := h.logger.State()
+	state.Enabled, state.ExpiresAt = *req.Enabled, nil
+	if req.Routes != nil {
+		for _, route := range req.Routes {
+			if len(route) == 0 || route[0] != '/' {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "routes must be path prefixes, such as /api/orders"})
+				return
+			}
+		}
+		state.Routes = req.Routes
+	}
+	if state.Enabled && len(state.Routes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "routes are required to enable debug logging"})
+		return
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be a positive duration, such as 15m"})
+			return
+		}
+		expires := h.logger.now().Add(d)
+		state.ExpiresAt = &expires
+	}
+
+	h.logger.Set(state)
+	log.Printf("Debug logging enabled=%t for %v by %q from %s", state.Enabled, state.Routes, req.Actor, c.ClientIP())
+	c.JSON(http.StatusOK, h.logger.State())
+}
@@ -0,0 +1,104 @@
+package debuglog
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are matched against lower-cased field and parameter names
+// with the separators removed, so "refresh_token", "refreshToken" and
+// "Refresh-Token" all hit "token".
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "authorization", "apikey", "cookie", "ssn", "cardnumber", "cvc", "cvv", "email"}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+func sensitive(key string) bool {
+	key = strings.NewReplacer("_", "", "-", "", ".", "").Replace(strings.ToLower(key))
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue replaces the values of sensitive fields, at any depth, and any
+// email address found in other strings.
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if sensitive(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(child)
+			}
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = redactValue(child)
+		}
+		return v
+	case string:
+		return emailPattern.ReplaceAllString(v, redacted)
+	default:
+		return v
+	}
+}
+
+func redactForm(values url.Values) string {
+	for k, vs := range values {
+		for i := range vs {
+			if sensitive(k) {
+				vs[i] = redacted
+			} else {
+				vs[i] = emailPattern.ReplaceAllString(vs[i], redacted)
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// RedactQuery returns the query string with sensitive parameters and email
+// addresses redacted.
+func RedactQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return redacted
+	}
+	return redactForm(values)
+}
+
+// RedactBody returns body fit to log. JSON and form bodies are logged with
+// sensitive fields redacted. Anything else, or a body that does not parse as
+// its content type says, is described by size only: there is no telling
+// what it contains.
+func RedactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v any
+		if err := json.Unmarshal(body, &v); err == nil {
+			out, _ := json.Marshal(redactValue(v))
+			return string(out)
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			return redactForm(values)
+		}
+	}
+	if mediaType == "" {
+		mediaType = "unknown content type"
+	}
+	return fmt.Sprintf("[%d bytes of %s]", len(body), mediaType)
+}
@@ -0,0 +1,156 @@
+// Package faults injects latency, errors and dropped connections into the
+// gateway's backend calls, so integration tests can exercise its retries,
+// circuit breakers and failover against real traffic. It is for test
+// environments only: the gateway installs it when FAULT_INJECTION_ENABLED
+// is set and refuses to start with it when ENV is production.
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInjected is the cause of every dropped call.
+var ErrInjected = errors.New("connection dropped by fault injection")
+
+// Fault is what happens to a share of the backend calls made for requests
+// to Route. Each call, retries included, is affected with probability
+// Percent, so a retry can get through a fault the first attempt hit.
+type Fault struct {
+	// Route is a path prefix: /api/orders covers /api/orders/1 but not
+	// /api/orders-archive.
+	Route string `json:"route"`
+	// Method limits the fault to one method; empty matches every method.
+	Method  string  `json:"method,omitempty"`
+	Percent float64 `json:"percent"`
+	// LatencyMS delays an affected call before it goes out, or before it
+	// fails if Status or Drop is also set.
+	LatencyMS int `json:"latency_ms,omitempty"`
+	// Status answers an affected call with this status instead of sending
+	// it. 502, 503 and 504 count against the circuit breakers.
+	Status int `json:"status,omitempty"`
+	// Drop fails an affected call as if the connection was refused, which
+	// is retried and counted like a backend that is down.
+	Drop bool `json:"drop,omitempty"`
+}
+
+func (f Fault) Validate() error {
+	switch {
+	case !strings.HasPrefix(f.Route, "/"):
+		return fmt.Errorf("route %q must be a path prefix, such as /api/orders", f.Route)
+	case f.Percent <= 0 || f.Percent > 100:
+		return fmt.Errorf("percent for %s must be above 0 and at most 100", f.Route)
+	case f.LatencyMS < 0:
+		return fmt.Errorf("latency_ms for %s must not be negative", f.Route)
+	case f.Status != 0 && (f.Status < 400 || f.Status > 599):
+		return fmt.Errorf("status for %s must be a 4xx or 5xx status", f.Route)
+	case f.Status != 0 && f.Drop:
+		return fmt.Errorf("fault for %s can set status or drop, not both", f.Route)
+	case f.LatencyMS == 0 && f.Status == 0 && !f.Drop:
+		return fmt.Errorf("fault for %s must set latency_ms, status or drop", f.Route)
+	}
+	return nil
+}
+
+func (f Fault) matches(method, path string) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, method) {
+		return false
+	}
+	route := strings.TrimSuffix(f.Route, "/")
+	return path == route || strings.HasPrefix(path, route+"/")
+}
+
+// Stats counts one fault's backend calls since it was set.
+type Stats struct {
+	Fault
+	Calls    int64 `json:"calls"`
+	Injected int64 `json:"injected"`
+}
+
+// Injector holds its faults in memory, so setting them only affects the
+// gateway replica that served the admin request.
+type Injector struct {
+	roll func() float64
+
+	mu     sync.Mutex
+	faults []*Stats
+}
+
+func New() *Injector {
+	return &Injector{roll: rand.Float64}
+}
+
+// Faults returns the faults in the order they are matched, with their
+// counts.
+func (i *Injector) Faults() []Stats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	out := make([]Stats, 0, len(i.faults))
+	for _, s := range i.faults {
+		out = append(out, *s)
+	}
+	return out
+}
+
+// Set replaces every fault, resetting the counts. The first fault that
+// matches a request applies to it.
+func (i *Injector) Set(faults []Fault) error {
+	stats := make([]*Stats, 0, len(faults))
+	for _, f := range faults {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		stats = append(stats, &Stats{Fault: f})
+	}
+	i.mu.Lock()
+	i.faults = stats
+	i.mu.Unlock()
+	return nil
+}
+
+type contextKey struct{}
+
+// Middleware marks requests covered by a fault, for Transport to act on
+// their backend calls. Requests the gateway answers itself, such as from
+// the response cache, are never affected.
+func (i *Injector) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		i.mu.Lock()
+		var match *Stats
+		for _, s := range i.faults {
+			if s.matches(c.Request.Method, c.Request.URL.Path) {
+				match = s
+				break
+			}
+		}
+		i.mu.Unlock()
+
+		if match != nil {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), contextKey{}, match))
+		}
+		c.Next()
+	}
+}
+
+// decide counts a call for the fault on ctx and returns the fault if the
+// call is to be affected.
+func (i *Injector) decide(ctx context.Context) (Fault, bool) {
+	s, ok := ctx.Value(contextKey{}).(*Stats)
+	if !ok {
+		return Fault{}, false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	s.Calls++
+	if i.roll()*100 >= s.Percent {
+		return Fault{}, false
+	}
+	s.Injected++
+	return s.Fault, true
+}
@@ -0,0 +1,170 @@
+package faults
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		fault Fault
+		ok    bool
+	}{
+		{Fault{Route: "/api/orders", Percent: 50, Status: 503}, true},
+		{Fault{Route: "/api/orders", Percent: 100, Drop: true, LatencyMS: 200}, true},
+		{Fault{Route: "api/orders", Percent: 50, Status: 503}, false},
+		{Fault{Route: "/api/orders", Percent: 0, Status: 503}, false},
+		{Fault{Route: "/api/orders", Percent: 101, Status: 503}, false},
+		{Fault{Route: "/api/orders", Percent: 50, Status: 302}, false},
+		{Fault{Route: "/api/orders", Percent: 50, Status: 503, Drop: true}, false},
+		{Fault{Route: "/api/orders", Percent: 50}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.fault.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v, want ok %v", tt.fault, err, tt.ok)
+		}
+	}
+}
+
+// gateway proxies GET /api/* to backend through a forwarding client with
+// the injector wrapped in, like the real gateway.
+func gateway(t *testing.T, injector *Injector, backend string, cfg httpclient.Config) *gin.Engine {
+	t.Helper()
+	client := httpclient.NewWithConfig(cfg)
+	client.Transport = &auth.ForwardingTransport{Base: client.Transport}
+	if err := injector.Wrap(client); err != nil {
+		t.Fatalf("Failed to wrap the client: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(injector.Middleware())
+	router.GET("/api/*path", func(c *gin.Context) {
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, backend+c.Param("path"), nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		resp.Body.Close()
+		c.Header(Header, resp.Header.Get(Header))
+		c.Status(resp.StatusCode)
+	})
+	return router
+}
+
+func get(router http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestInjectedFaultsAreRetriedAndOpenBreakers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	injector := New()
+	router := gateway(t, injector, backend.URL, httpclient.Config{
+		Timeout: 5 * time.Second, Retries: 2, RetryBackoff: time.Millisecond, BreakerThreshold: 2, BreakerCooldown: time.Minute,
+	})
+	if err := injector.Set([]Fault{{Route: "/api/orders", Method: "GET", Percent: 50, Status: http.StatusServiceUnavailable}}); err != nil {
+		t.Fatalf("Failed to set faults: %v", err)
+	}
+
+	// The first attempt is hit and the retry gets through.
+	rolls := []float64{0.1, 0.9}
+	injector.roll = func() float64 { r := rolls[0]; rolls = rolls[1:]; return r }
+	if w := get(router, "/api/orders/1"); w.Code != http.StatusOK || calls.Load() != 1 {
+		t.Fatalf("Expected the retry to reach the backend, got: %d after %d calls", w.Code, calls.Load())
+	}
+	if got := injector.Faults()[0]; got.Calls != 2 || got.Injected != 1 {
+		t.Errorf("Expected 1 of 2 calls injected, got: %+v", got)
+	}
+
+	if w := get(router, "/api/users"); w.Code != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("Expected an uncovered route to pass, got: %d", w.Code)
+	}
+
+	// Every attempt fails, twice in a row, which opens the breaker.
+	injector.roll = func() float64 { return 0 }
+	for i := 0; i < 2; i++ {
+		if w := get(router, "/api/orders/1"); w.Code != http.StatusServiceUnavailable || w.Header().Get(Header) != "true" {
+			t.Fatalf("Expected an injected 503, got: %d", w.Code)
+		}
+	}
+	if w := get(router, "/api/orders/1"); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), httpclient.ErrCircuitOpen.Error()) {
+		t.Errorf("Expected the breaker to be open, got: %d %s", w.Code, w.Body)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected no injected call to reach the backend, got: %d calls", calls.Load())
+	}
+}
+
+func TestDropAndLatency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	injector := New()
+	injector.roll = func() float64 { return 0 }
+	router := gateway(t, injector, backend.URL, httpclient.Config{Timeout: 5 * time.Second})
+
+	injector.Set([]Fault{{Route: "/api/orders", Percent: 100, Drop: true}})
+	if w := get(router, "/api/orders"); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), ErrInjected.Error()) {
+		t.Errorf("Expected a dropped connection, got: %d %s", w.Code, w.Body)
+	}
+
+	injector.Set([]Fault{{Route: "/api/orders", Percent: 100, LatencyMS: 50}})
+	start := time.Now()
+	if w := get(router, "/api/orders"); w.Code != http.StatusOK || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected a delayed success, got: %d after %s", w.Code, time.Since(start))
+	}
+}
+
+func TestWrapNeedsHTTPClientTransport(t *testing.T) {
+	if err := New().Wrap(&http.Client{Transport: http.DefaultTransport}); err == nil {
+		t.Error("Expected a client not built by httpclient to be refused")
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	injector := New()
+	router := gin.New()
+	NewHandler(injector).RegisterAdminRoutes(router)
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/faults", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := put(`{"faults": [{"route": "/api/orders", "percent": 0, "status": 503}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid fault, got: %d", w.Code)
+	}
+	if w := put(`{"faults": [{"route": "/api/orders", "percent": 25, "status": 503}], "actor": "ci"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", w.Code, w.Body)
+	}
+	if w := get(router, "/faults"); !strings.Contains(w.Body.String(), `"percent":25`) {
+		t.Errorf("Expected the fault to be listed, got: %s", w.Body)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/faults", nil))
+	if w.Code != http.StatusOK || len(injector.Faults()) != 0 {
+		t.Errorf("Expected the faults to be cleared, got: %d %+v", w.Code, injector.Faults())
+	}
+}
@@ -0,0 +1,52 @@
+package faults
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	injector *Injector
+}
+
+func NewHandler(injector *Injector) *Handler {
+	return &Handler{injector: injector}
+}
+
+// RegisterAdminRoutes mounts fault management on an admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/faults", h.list)
+	router.PUT("/faults", h.set)
+	router.DELETE("/faults", h.clear)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"faults": h.injector.Faults()})
+}
+
+type setRequest struct {
+	Faults []Fault `json:"faults" binding:"required"`
+	Actor  string  `json:"actor" binding:"max=255"`
+}
+
+func (h *Handler) set(c *gin.Context) {
+	var req setRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.injector.Set(req.Faults); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Fault injection set to %d faults by %q from %s", len(req.Faults), req.Actor, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"faults": h.injector.Faults()})
+}
+
+func (h *Handler) clear(c *gin.Context) {
+	h.injector.Set(nil)
+	log.Printf("Fault injection cleared by %q from %s", c.Query("actor"), c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"faults": h.injector.Faults()})
+}
@@ -0,0 +1,97 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// Header marks the responses the injector makes up.
+const Header = "X-Fault-Injected"
+
+// Wrap installs the injector beneath client's retries and circuit
+// breakers, so injected failures are retried and counted like real ones.
+// client must be built by httpclient, optionally behind an
+// auth.ForwardingTransport; wrap it before anything else does.
+func (i *Injector) Wrap(client *http.Client) error {
+	rt := client.Transport
+	if forwarding, ok := rt.(*auth.ForwardingTransport); ok {
+		rt = forwarding.Base
+	}
+	t, ok := rt.(*httpclient.Transport)
+	if !ok {
+		return errors.New("fault injection needs a client built by httpclient")
+	}
+	t.Base = &Transport{Base: t.Base, Injector: i}
+	return nil
+}
+
+// Transport applies the fault a request was marked with by Middleware to
+// each call sent for it.
+type Transport struct {
+	Base     http.RoundTripper
+	Injector *Injector
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, ok := t.Injector.decide(req.Context())
+	if !ok {
+		return t.Base.RoundTrip(req)
+	}
+	if f.LatencyMS > 0 {
+		if err := sleep(req.Context(), time.Duration(f.LatencyMS)*time.Millisecond); err != nil {
+			closeBody(req)
+			return nil, err
+		}
+	}
+	switch {
+	case f.Drop:
+		closeBody(req)
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: ErrInjected}
+	case f.Status != 0:
+		closeBody(req)
+		return injectedResponse(req, f.Status), nil
+	}
+	return t.Base.RoundTrip(req)
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// sleep waits d unless ctx ends first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func injectedResponse(req *http.Request, status int) *http.Response {
+	body := fmt.Sprintf(`{"error":"injected fault: %d %s"}`, status, http.StatusText(status))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}, Header: {"true"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,69 @@
+package killswitch
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	switches *Switches
+}
+
+func NewHandler(switches *Switches) *Handler {
+	return &Handler{switches: switches}
+}
+
+// RegisterAdminRoutes mounts switch management on an admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/killswitches", h.list)
+	router.PUT("/killswitches/:name", h.toggle)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	switches, err := h.switches.store.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"kill_switches": switches})
+}
+
+type toggleRequest struct {
+	Engaged    *bool  `json:"engaged" binding:"required"`
+	Reason     string `json:"reason" binding:"required,max=500"`
+	Actor      string `json:"actor" binding:"max=255"`
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+}
+
+func (h *Handler) toggle(c *gin.Context) {
+	var req toggleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.StatusCode != 0 && (req.StatusCode < 400 || req.StatusCode > 599) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status_code must be a 4xx or 5xx status"})
+		return
+	}
+
+	sw, err := h.switches.Toggle(c.Request.Context(), c.Param("name"), Toggle{
+		Engaged:    *req.Engaged,
+		StatusCode: req.StatusCode,
+		Message:    req.Message,
+		Actor:      req.Actor,
+		Reason:     req.Reason,
+		ClientIP:   c.ClientIP(),
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sw)
+}
@@ -0,0 +1,114 @@
+// Package killswitch lets operators shut off individual gateway routes, such
+// as checkout or registration, during an incident without a deploy.
+package killswitch
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+// Switches serves the middleware from an in-memory copy of the store, so
+// checking a request never touches the database. Run keeps the copy fresh
+// when another gateway replica toggles a switch.
+type Switches struct {
+	store     Store
+	publisher events.Publisher
+
+	mu      sync.RWMutex
+	engaged []Switch
+}
+
+func New(store Store, publisher events.Publisher) *Switches {
+	return &Switches{store: store, publisher: publisher}
+}
+
+func (s *Switches) Refresh(ctx context.Context) error {
+	all, err := s.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	engaged := []Switch{}
+	for _, sw := range all {
+		if sw.Engaged {
+			engaged = append(engaged, sw)
+		}
+	}
+	s.mu.Lock()
+	s.engaged = engaged
+	s.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the switches every interval until ctx is cancelled. A failed
+// refresh keeps the last known state.
+func (s *Switches) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx); err != nil {
+			log.Printf("Kill switch refresh failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Toggle updates a switch, applies it on this replica immediately and
+// publishes an events.GatewayKillSwitchToggled audit event.
+func (s *Switches) Toggle(ctx context.Context, name string, t Toggle) (*Switch, error) {
+	sw, err := s.store.Toggle(ctx, name, t)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Refresh(ctx); err != nil {
+		log.Printf("Kill switch refresh failed: %v", err)
+	}
+
+	log.Printf("Kill switch %s engaged=%t by %q from %s: %s", sw.Name, sw.Engaged, t.Actor, t.ClientIP, t.Reason)
+	e, err := events.New(events.GatewayKillSwitchToggled, "api-gateway", events.KillSwitchToggled{
+		Name:     sw.Name,
+		Engaged:  sw.Engaged,
+		Actor:    t.Actor,
+		ClientIP: t.ClientIP,
+		Reason:   t.Reason,
+	})
+	if err == nil {
+		err = s.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish kill switch audit event for %s: %v", sw.Name, err)
+	}
+	return sw, nil
+}
+
+// Middleware rejects requests covered by an engaged switch with the
+// switch's configured response. Install it first so disabled routes cost
+// nothing further.
+func (s *Switches) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.mu.RLock()
+		engaged := s.engaged
+		s.mu.RUnlock()
+
+		for _, sw := range engaged {
+			if sw.Matches(c.Request.Method, c.Request.URL.Path) {
+				c.Header("X-Kill-Switch", sw.Name)
+				if sw.StatusCode == http.StatusServiceUnavailable {
+					c.Header("Retry-After", "60")
+				}
+				c.AbortWithStatusJSON(sw.StatusCode, gin.H{"error": sw.Message, "kill_switch": sw.Name})
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,130 @@
+package killswitch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	switches map[string]*Switch
+}
+
+func (m *memStore) List(ctx context.Context) ([]Switch, error) {
+	out := []Switch{}
+	for _, sw := range m.switches {
+		out = append(out, *sw)
+	}
+	return out, nil
+}
+
+func (m *memStore) Toggle(ctx context.Context, name string, t Toggle) (*Switch, error) {
+	sw, ok := m.switches[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	sw.Engaged = t.Engaged
+	if t.StatusCode != 0 {
+		sw.StatusCode = t.StatusCode
+	}
+	if t.Message != "" {
+		sw.Message = t.Message
+	}
+	out := *sw
+	return &out, nil
+}
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+func TestMatches(t *testing.T) {
+	sw := Switch{Method: "POST", PathPrefix: "/api/orders"}
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"POST", "/api/orders", true},
+		{"POST", "/api/orders/1/confirm", true},
+		{"POST", "/api/orders-archive", false},
+		{"GET", "/api/orders", false},
+	}
+	for _, tt := range tests {
+		if got := sw.Matches(tt.method, tt.path); got != tt.want {
+			t.Errorf("Matches(%s, %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+	if !(Switch{Method: "*", PathPrefix: "/api/"}).Matches("GET", "/api/users") {
+		t.Error("Expected * to match any method")
+	}
+}
+
+func TestToggleBlocksRouteAndAudits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{switches: map[string]*Switch{
+		"checkout": {Name: "checkout", Method: "POST", PathPrefix: "/api/orders", StatusCode: 503, Message: "Checkout is down"},
+	}}
+	publisher := &recordingPublisher{}
+	switches := New(store, publisher)
+	if err := switches.Refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(switches.Middleware())
+	router.POST("/api/orders", func(c *gin.Context) { c.Status(http.StatusCreated) })
+	admin := router.Group("/admin")
+	NewHandler(switches).RegisterAdminRoutes(admin)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do(http.MethodPost, "/api/orders", ""); w.Code != http.StatusCreated {
+		t.Fatalf("Expected orders to pass while the switch is released, got: %d", w.Code)
+	}
+
+	if w := do(http.MethodPut, "/admin/killswitches/checkout", `{"engaged": true}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a toggle without a reason to be rejected, got: %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/admin/killswitches/checkout", `{"engaged": true, "reason": "payments outage", "actor": "oncall"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d %s", w.Code, w.Body)
+	}
+
+	w := do(http.MethodPost, "/api/orders", "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Kill-Switch") != "checkout" || !strings.Contains(w.Body.String(), "Checkout is down") {
+		t.Errorf("Expected the configured 503, got: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	if len(publisher.published) != 1 {
+		t.Fatalf("Expected one audit event, got: %d", len(publisher.published))
+	}
+	var audit events.KillSwitchToggled
+	if err := publisher.published[0].Decode(&audit); err != nil || !audit.Engaged || audit.Actor != "oncall" || audit.Reason != "payments outage" || audit.ClientIP != "192.0.2.1" {
+		t.Errorf("Expected an engaged audit event from oncall at 192.0.2.1, got: %+v, %v", audit, err)
+	}
+
+	do(http.MethodPut, "/admin/killswitches/checkout", `{"engaged": false, "reason": "resolved"}`)
+	if w := do(http.MethodPost, "/api/orders", ""); w.Code != http.StatusCreated {
+		t.Errorf("Expected orders to pass after release, got: %d", w.Code)
+	}
+	if len(publisher.published) != 2 {
+		t.Errorf("Expected an audit event for the release, got: %d events", len(publisher.published))
+	}
+
+	if w := do(http.MethodPut, "/admin/killswitches/nope", `{"engaged": true, "reason": "x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown switch, got: %d", w.Code)
+	}
+}
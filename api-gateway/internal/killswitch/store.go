@@ -0,0 +1,111 @@
+package killswitch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+)
+
+var ErrNotFound = errors.New("kill switch not found")
+
+// Switch disables every request whose method and path match it while
+// Engaged, answering with StatusCode and Message instead of proxying.
+type Switch struct {
+	Name       string    `json:"name"`
+	Method     string    `json:"method"`
+	PathPrefix string    `json:"path_prefix"`
+	Engaged    bool      `json:"engaged"`
+	StatusCode int       `json:"status_code"`
+	Message    string    `json:"message"`
+	UpdatedBy  string    `json:"updated_by,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Matches reports whether the switch covers a request: the path is the
+// prefix itself or below it, so /api/orders covers /api/orders/1 but not
+// /api/orders-archive. A method of "*" matches any method.
+func (s Switch) Matches(method, path string) bool {
+	if s.Method != "*" && s.Method != method {
+		return false
+	}
+	prefix := strings.TrimSuffix(s.PathPrefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+type Store interface {
+	List(ctx context.Context) ([]Switch, error)
+	// Toggle engages or releases a switch, optionally replacing its
+	// response, and returns the updated switch.
+	Toggle(ctx context.Context, name string, t Toggle) (*Switch, error)
+}
+
+type Toggle struct {
+	Engaged    bool
+	StatusCode int
+	Message    string
+	Actor      string
+	Reason     string
+	// ClientIP is the address the toggle came from, for the audit event.
+	ClientIP string
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const switchColumns = "name, method, path_prefix, engaged, status_code, message, COALESCE(updated_by, ''), COALESCE(reason, ''), updated_at"
+
+func scanSwitch(row interface{ Scan(...any) error }) (*Switch, error) {
+	var s Switch
+	if err := row.Scan(&s.Name, &s.Method, &s.PathPrefix, &s.Engaged, &s.StatusCode, &s.Message,
+		&s.UpdatedBy, &s.Reason, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *PostgresStore) List(ctx context.Context) ([]Switch, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + switchColumns + ` FROM gateway.kill_switches ORDER BY name`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	switches := []Switch{}
+	for rows.Next() {
+		sw, err := scanSwitch(rows)
+		if err != nil {
+			return nil, err
+		}
+		switches = append(switches, *sw)
+	}
+	return switches, rows.Err()
+}
+
+func (s *PostgresStore) Toggle(ctx context.Context, name string, t Toggle) (*Switch, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE gateway.kill_switches
+		SET engaged = $2, status_code = COALESCE(NULLIF($3, 0), status_code), message = COALESCE(NULLIF($4, ''), message),
+			updated_by = NULLIF($5, ''), reason = NULLIF($6, ''), updated_at = NOW()
+		WHERE name = $1 RETURNING ` + switchColumns
+	sw, err := scanSwitch(s.db.QueryRowContext(ctx, query, name, t.Engaged, t.StatusCode, t.Message, t.Actor, t.Reason))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return sw, err
+}
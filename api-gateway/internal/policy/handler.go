@@ -0,0 +1,42 @@
+package policy
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	policies *Policies
+}
+
+func NewHandler(policies *Policies) *Handler {
+	return &Handler{policies: policies}
+}
+
+// RegisterAdminRoutes mounts policy inspection and reloading on an
+// admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/policies", h.get)
+	router.POST("/policies/reload", h.reload)
+}
+
+func (h *Handler) get(c *gin.Context) {
+	c.JSON(http.StatusOK, h.policies.State())
+}
+
+// reload reads the policy file now rather than at the next interval. A
+// file that fails to load leaves the previous rules in force.
+func (h *Handler) reload(c *gin.Context) {
+	if h.policies.path == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "gateway policies are not enabled"})
+		return
+	}
+	if err := h.policies.Reload(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Gateway policies reloaded by %q from %s", c.Query("actor"), c.ClientIP())
+	c.JSON(http.StatusOK, h.policies.State())
+}
@@ -0,0 +1,234 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/ndjson"
+	"github.com/gin-gonic/gin"
+)
+
+type resolvedKey struct{}
+
+type clientIPKey struct{}
+
+func fromContext(ctx context.Context) *Resolved {
+	res, _ := ctx.Value(resolvedKey{}).(*Resolved)
+	return res
+}
+
+// Handler applies the edge half of the policies before next routes the
+// request: it takes off the API version, strips the client's headers,
+// rewrites the path and transforms the request body. Rules are matched
+// against the path the client sent, less its version. While the file has
+// versions, every request is counted under its version, or as
+// unversioned.
+func (p *Policies) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.versioned() {
+			p.serve(w, r, next)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		name := p.serve(rec, r, next)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		p.usage.record(name, rec.status, time.Now().UTC())
+	})
+}
+
+// serve serves r and returns the API version it named.
+func (p *Policies) serve(w http.ResponseWriter, r *http.Request, next http.Handler) string {
+	res, v, path := p.resolve(r.Method, r.URL.Path)
+	if res == nil {
+		next.ServeHTTP(w, r)
+		return unversioned
+	}
+	name := unversioned
+	if v != nil {
+		name = v.Name
+		v.announce(w.Header())
+		if v.retired(time.Now()) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			io.WriteString(w, `{"error":"API `+v.Name+` was retired on `+v.Sunset.UTC().Format(time.DateOnly)+`"}`)
+			return name
+		}
+	}
+	r = r.Clone(context.WithValue(r.Context(), resolvedKey{}, res))
+	res.stripHeaders(r.Header)
+	if path = res.rewrite(path); path != r.URL.Path {
+		r.URL.Path, r.URL.RawPath = path, ""
+	}
+	if !res.request.empty() && r.Body != nil && isJSON(r.Header.Get("Content-Type")) {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"failed to read request body"}`)
+			return name
+		}
+		body = res.request.apply(body)
+		r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	next.ServeHTTP(w, r)
+	return name
+}
+
+// Middleware prepares the route's backend calls, which Transport applies,
+// and transforms its JSON response. It runs after the client IP and the
+// caller's token are known.
+func (p *Policies) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res := fromContext(c.Request.Context())
+		if res == nil {
+			c.Next()
+			return
+		}
+		ctx := c.Request.Context()
+		if res.forwardedFor {
+			ctx = context.WithValue(ctx, clientIPKey{}, c.ClientIP())
+		}
+		if res.service {
+			token, err := p.token()
+			if err != nil {
+				log.Printf("Failed to issue the gateway's service token: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to authorize backend calls"})
+				return
+			}
+			// Replacing the forwarded token makes the forwarding client
+			// call backends as the gateway rather than the caller.
+			ctx = auth.ContextWithToken(ctx, token)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		// Transforms only apply to JSON, so NDJSON streams and WebSocket
+		// upgrades are not held back.
+		if res.response.empty() || ndjson.Accepted(c.Request) || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+
+		original := c.Writer
+		w := &bufferedWriter{ResponseWriter: original}
+		c.Writer = w
+		c.Next()
+		c.Writer = original
+
+		body := w.body.Bytes()
+		if !original.Written() && isJSON(original.Header().Get("Content-Type")) {
+			body = res.response.apply(body)
+			original.Header().Del("Content-Length")
+		}
+		original.Write(body)
+	}
+}
+
+// bufferedWriter holds the body back until it has been transformed.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// Wrap applies the route's policy to client's backend calls. Wrap it
+// outside the forwarding transport, which sends the token Middleware chose.
+func (p *Policies) Wrap(client *http.Client) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &Transport{Base: base}
+}
+
+// Transport sets the headers of the route a backend call is made for.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := fromContext(req.Context())
+	if res == nil || (len(res.setHeaders) == 0 && !res.forwardedFor) {
+		return t.Base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for name, value := range res.setHeaders {
+		req.Header.Set(name, value)
+	}
+	if ip, _ := req.Context().Value(clientIPKey{}).(string); ip != "" {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	return t.Base.RoundTrip(req)
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(strings.ToLower(mediaType)) == "application/json"
+}
+
+// apply transforms body, or returns it unchanged if it is not JSON.
+func (t Transform) apply(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return body
+	}
+	for _, path := range t.Remove {
+		walk(doc, strings.Split(path, "."), func(obj map[string]any, field string) {
+			delete(obj, field)
+		})
+	}
+	for path, to := range t.Rename {
+		walk(doc, strings.Split(path, "."), func(obj map[string]any, field string) {
+			if v, ok := obj[field]; ok {
+				delete(obj, field)
+				obj[to] = v
+			}
+		})
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// walk calls fn with each object holding the last field of path, stepping
+// into every element of the arrays on the way.
+func walk(v any, path []string, fn func(obj map[string]any, field string)) {
+	switch v := v.(type) {
+	case []any:
+		for _, elem := range v {
+			walk(elem, path, fn)
+		}
+	case map[string]any:
+		if len(path) == 1 {
+			fn(v, path[0])
+			return
+		}
+		if next, ok := v[path[0]]; ok {
+			walk(next, path[1:], fn)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+// Package policy applies per-route request policies from a YAML file: which
+// client headers are stripped at the edge, how paths are rewritten before
+// routing, which JSON fields of requests and responses are removed or
+// renamed, and what the calls the gateway makes to backends on a route's
+// behalf carry, such as X-Forwarded-For or the gateway's own service token.
+//
+// The file is read at startup and again whenever it changes, so policies
+// can be changed without a restart.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Auth modes for a route's backend calls.
+const (
+	AuthForward = "forward"
+	AuthService = "service"
+)
+
+// Rule is one route's policy, for requests whose path starts with Prefix
+// and whose method is Method when set.
+type Rule struct {
+	Method string `yaml:"method" json:"method,omitempty"`
+	Prefix string `yaml:"prefix" json:"prefix"`
+	// StripHeaders are removed from the client's request. A trailing "*"
+	// matches every header with that prefix, such as "X-Internal-*".
+	StripHeaders []string `yaml:"strip_headers" json:"strip_headers,omitempty"`
+	// Rewrite replaces Prefix in the path before the request is routed.
+	Rewrite string `yaml:"rewrite" json:"rewrite,omitempty"`
+	// SetHeaders are set on backend calls.
+	SetHeaders map[string]string `yaml:"set_headers" json:"set_headers,omitempty"`
+	// ForwardedFor appends the client's address to X-Forwarded-For on
+	// backend calls.
+	ForwardedFor *bool `yaml:"forwarded_for" json:"forwarded_for,omitempty"`
+	// Auth is forward, the default, to pass the caller's token on, or
+	// service to call backends as the gateway instead.
+	Auth     string    `yaml:"auth" json:"auth,omitempty"`
+	Request  Transform `yaml:"request" json:"request,omitempty"`
+	Response Transform `yaml:"response" json:"response,omitempty"`
+}
+
+// Transform changes fields of a JSON object body. Fields are dotted paths
+// such as "user.password_hash"; a path through an array applies to each of
+// its elements. Rename maps a path to the field's new name in the same
+// object.
+type Transform struct {
+	Remove []string          `yaml:"remove" json:"remove,omitempty"`
+	Rename map[string]string `yaml:"rename" json:"rename,omitempty"`
+}
+
+func (t Transform) empty() bool {
+	return len(t.Remove) == 0 && len(t.Rename) == 0
+}
+
+// Config is the policy file.
+type Config struct {
+	Routes   []Rule    `yaml:"routes" json:"routes"`
+	Versions []Version `yaml:"versions" json:"versions,omitempty"`
+}
+
+// Parse reads and validates a policy file's contents. A service auth rule
+// needs a token source, so canIssue reports whether the gateway has one.
+func Parse(data []byte, canIssue bool) (*Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for i := range cfg.Routes {
+		if err := validateRule(i, &cfg.Routes[i], canIssue); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateVersions(cfg.Versions, canIssue); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func validateRule(i int, r *Rule, canIssue bool) error {
+	r.Method = strings.ToUpper(r.Method)
+	if !strings.HasPrefix(r.Prefix, "/") {
+		return fmt.Errorf("route %d: prefix %q must start with /", i, r.Prefix)
+	}
+	if r.Rewrite != "" && !strings.HasPrefix(r.Rewrite, "/") {
+		return fmt.Errorf("route %s: rewrite %q must start with /", r.Prefix, r.Rewrite)
+	}
+	switch r.Auth {
+	case "", AuthForward:
+	case AuthService:
+		if !canIssue {
+			return fmt.Errorf("route %s: auth service needs JWT_SECRET", r.Prefix)
+		}
+	default:
+		return fmt.Errorf("route %s: unknown auth %q, want forward or service", r.Prefix, r.Auth)
+	}
+	for _, name := range r.StripHeaders {
+		if strings.TrimSuffix(name, "*") == "" {
+			return fmt.Errorf("route %s: strip_headers entry %q matches every header", r.Prefix, name)
+		}
+	}
+	for _, t := range []Transform{r.Request, r.Response} {
+		for from, to := range t.Rename {
+			if from == "" || to == "" || strings.Contains(to, ".") {
+				return fmt.Errorf("route %s: rename %q to %q, want a path and a field name", r.Prefix, from, to)
+			}
+		}
+	}
+	return nil
+}
+
+// Resolved is every rule matching one request, merged. Rules apply from the
+// shortest prefix to the longest, so a longer one wins where they disagree
+// and lists such as StripHeaders add up.
+type Resolved struct {
+	// version is the API version the client chose, if any.
+	version      string
+	strip        []string
+	rewriteFrom  string
+	rewriteTo    string
+	setHeaders   map[string]string
+	forwardedFor bool
+	service      bool
+	request      Transform
+	response     Transform
+}
+
+// resolve merges the rules matching method and path. rules must be sorted
+// by prefix length.
+func resolve(rules []Rule, method, path string) *Resolved {
+	var res *Resolved
+	for _, r := range rules {
+		if !strings.HasPrefix(path, r.Prefix) || (r.Method != "" && r.Method != method) {
+			continue
+		}
+		if res == nil {
+			res = &Resolved{setHeaders: map[string]string{}}
+		}
+		res.strip = append(res.strip, r.StripHeaders...)
+		if r.Rewrite != "" {
+			res.rewriteFrom, res.rewriteTo = r.Prefix, r.Rewrite
+		}
+		for name, value := range r.SetHeaders {
+			res.setHeaders[name] = value
+		}
+		if r.ForwardedFor != nil {
+			res.forwardedFor = *r.ForwardedFor
+		}
+		if r.Auth != "" {
+			res.service = r.Auth == AuthService
+		}
+		res.request = merge(res.request, r.Request)
+		res.response = merge(res.response, r.Response)
+	}
+	return res
+}
+
+func merge(a, b Transform) Transform {
+	out := Transform{Remove: append(append([]string(nil), a.Remove...), b.Remove...)}
+	if len(a.Rename)+len(b.Rename) > 0 {
+		out.Rename = map[string]string{}
+		for from, to := range a.Rename {
+			out.Rename[from] = to
+		}
+		for from, to := range b.Rename {
+			out.Rename[from] = to
+		}
+	}
+	return out
+}
+
+// stripHeaders removes the resolved StripHeaders from h.
+func (res *Resolved) stripHeaders(h http.Header) {
+	for _, name := range res.strip {
+		prefix, wildcard := strings.CutSuffix(name, "*")
+		if !wildcard {
+			h.Del(name)
+			continue
+		}
+		prefix = http.CanonicalHeaderKey(prefix)
+		for key := range h {
+			if strings.HasPrefix(http.CanonicalHeaderKey(key), prefix) {
+				delete(h, key)
+			}
+		}
+	}
+}
+
+func (res *Resolved) rewrite(path string) string {
+	if res.rewriteFrom == "" {
+		return path
+	}
+	return res.rewriteTo + strings.TrimPrefix(path, res.rewriteFrom)
+}
+
+// Policies holds the rules in force. Run reloads them when the file
+// changes; a file that fails to load leaves the last good rules in force.
+type Policies struct {
+	path     string
+	canIssue bool
+	token    func() (string, error)
+	usage    *usage
+
+	mu       sync.RWMutex
+	rules    []Rule
+	versions map[string]*version
+	modTime  time.Time
+	loadedAt time.Time
+	lastErr  string
+}
+
+// New loads the policies at path. An empty path applies none. token issues
+// the gateway's service token for routes with auth service; nil disables
+// them.
+func New(path string, token func() (string, error)) (*Policies, error) {
+	p := &Policies{path: path, canIssue: token != nil, token: token, usage: newUsage()}
+	if path == "" {
+		return p, nil
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the file again.
+func (p *Policies) Reload() error {
+	err := p.load()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = ""
+	if err != nil {
+		p.lastErr = err.Error()
+	}
+	return err
+}
+
+func (p *Policies) load() error {
+	if p.path == "" {
+		return errors.New("no policy file configured")
+	}
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	cfg, err := Parse(data, p.canIssue)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.path, err)
+	}
+	sortRules(cfg.Routes)
+	versions := compileVersions(cfg.Routes, cfg.Versions)
+
+	p.mu.Lock()
+	p.rules, p.versions, p.modTime, p.loadedAt = cfg.Routes, versions, info.ModTime(), time.Now().UTC()
+	p.mu.Unlock()
+	return nil
+}
+
+// Run reloads the file each interval it has changed until ctx is cancelled.
+func (p *Policies) Run(ctx context.Context, interval time.Duration) {
+	if p.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(p.path)
+		p.mu.RLock()
+		changed := err == nil && !info.ModTime().Equal(p.modTime)
+		p.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := p.Reload(); err != nil {
+			// Not retried until the file changes again.
+			p.mu.Lock()
+			p.modTime = info.ModTime()
+			p.mu.Unlock()
+			log.Printf("Gateway policy reload failed, keeping the previous rules: %v", err)
+			continue
+		}
+		log.Printf("Reloaded gateway policies from %s", p.path)
+	}
+}
+
+func sortRules(rules []Rule) {
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].Prefix) < len(rules[j].Prefix) })
+}
+
+// resolve matches the request against the rules, after taking off the API
+// version its path starts with. It returns the version, if any, and the
+// path without it.
+func (p *Policies) resolve(method, path string) (*Resolved, *Version, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	v, rest := p.version(path)
+	if v == nil {
+		return resolve(p.rules, method, path), nil, path
+	}
+	res := resolve(v.rules, method, rest)
+	if res == nil {
+		res = &Resolved{setHeaders: map[string]string{}}
+	}
+	res.version = v.Name
+	announced := v.Version
+	return res, &announced, rest
+}
+
+// State is the policies as GET /admin/policies shows them.
+type State struct {
+	File      string     `json:"file,omitempty"`
+	Routes    []Rule     `json:"routes"`
+	Versions  []Version  `json:"versions"`
+	LoadedAt  *time.Time `json:"loaded_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+func (p *Policies) State() State {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	st := State{File: p.path, Routes: append([]Rule{}, p.rules...), Versions: p.versionList(), LastError: p.lastErr}
+	if !p.loadedAt.IsZero() {
+		loaded := p.loadedAt
+		st.LoadedAt = &loaded
+	}
+	return st
+}
@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const testPolicies = `
+routes:
+  - prefix: /
+    strip_headers: [X-Internal-*]
+  - prefix: /api/
+    forwarded_for: true
+    set_headers:
+      X-Gateway: api-gateway
+  - prefix: /api/v1/users
+    rewrite: /api/users
+    auth: service
+    request:
+      remove: [role]
+    response:
+      remove: [users.password_hash]
+      rename:
+        users.display_name: name
+`
+
+func TestParse(t *testing.T) {
+	if _, err := Parse([]byte(testPolicies), false); err == nil {
+		t.Error("Expected auth service without a token source to be refused")
+	}
+	for _, bad := range []string{
+		"routes:\n  - prefix: api\n",
+		"routes:\n  - prefix: /api\n    auth: basic\n",
+		"routes:\n  - prefix: /api\n    strip_headers: ['*']\n",
+		"routes:\n  - prefix: /api\n    response:\n      rename: {a: b.c}\n",
+		"routes:\n  - prefix: /api\n    strip: [X-Internal-*]\n",
+	} {
+		if _, err := Parse([]byte(bad), true); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+	if cfg, err := Parse(nil, false); err != nil || len(cfg.Routes) != 0 {
+		t.Errorf("Expected an empty file to have no routes, got: %+v, %v", cfg, err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	os.WriteFile(path, []byte(testPolicies), 0o600)
+	p, err := New(path, func() (string, error) { return "gateway-token", nil })
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var backend *http.Request
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backend = r
+	}))
+	defer users.Close()
+	client := auth.NewForwardingClient()
+	p.Wrap(client)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(auth.ContextWithToken(c.Request.Context(), "caller-token"))
+	})
+	router.Use(p.Middleware())
+	var body string
+	var internal string
+	router.POST("/api/users/:id", func(c *gin.Context) {
+		raw, _ := io.ReadAll(c.Request.Body)
+		body, internal = string(raw), c.GetHeader("X-Internal-User")
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, users.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		resp.Body.Close()
+		c.JSON(http.StatusOK, gin.H{"users": []gin.H{{"id": 7, "display_name": "Ana", "password_hash": "x"}}})
+	})
+	handler := p.Handler(router)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/users/7", strings.NewReader(`{"email":"a@example.com","role":"admin"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-User", "1")
+	req.RemoteAddr = "203.0.113.7:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the rewritten path to be routed, got: %d", w.Code)
+	}
+	if internal != "" || body != `{"email":"a@example.com"}` {
+		t.Errorf("Expected the internal header stripped and role removed, got: %q, %s", internal, body)
+	}
+	if got := w.Body.String(); got != `{"users":[{"id":7,"name":"Ana"}]}` {
+		t.Errorf("Expected the response transformed, got: %s", got)
+	}
+	if backend.Header.Get("Authorization") != "Bearer gateway-token" || backend.Header.Get("X-Gateway") != "api-gateway" ||
+		backend.Header.Get("X-Forwarded-For") != "203.0.113.7" {
+		t.Errorf("Expected the backend call to carry the route's headers, got: %v", backend.Header)
+	}
+
+	// A route without a policy is left alone.
+	router.GET("/health", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"display_name": "x"}) })
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("X-Internal-User", "1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Body.String() != `{"display_name":"x"}` {
+		t.Errorf("Expected an untransformed response, got: %s", w.Body.String())
+	}
+
+	// A broken file keeps the previous rules; a fixed one replaces them.
+	os.WriteFile(path, []byte("routes: [\n"), 0o600)
+	if err := p.Reload(); err == nil || p.State().LastError == "" || len(p.State().Routes) != 3 {
+		t.Errorf("Expected the previous rules kept, got: %+v, %v", p.State(), err)
+	}
+	os.WriteFile(path, []byte("routes:\n  - prefix: /api/\n"), 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	ctx, cancel := context.WithCancel(context.Background())
+	go p.Run(ctx, 10*time.Millisecond)
+	defer cancel()
+	deadline := time.Now().Add(time.Second)
+	for len(p.State().Routes) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := p.State(); len(st.Routes) != 1 || st.LastError != "" {
+		t.Errorf("Expected the changed file to be reloaded, got: %+v", st)
+	}
+}
@@ -0,0 +1,269 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var validVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// unversioned is the usage entry of requests that name no version.
+const unversioned = "unversioned"
+
+// Version is an API version that clients choose with a path prefix, such
+// as /v1 in /v1/api/orders. The prefix is taken off before the request is
+// matched or routed, and the version's Routes then apply on top of the
+// file's own rules, so a version can send its paths to other backend paths
+// and reshape bodies for the clients still on it.
+//
+// Deprecated and Sunset announce the version's retirement with the
+// Deprecation and Sunset headers on every response, and Link points
+// clients to the migration guide. From Sunset on, the version's requests
+// are turned away with 410.
+type Version struct {
+	Name       string     `yaml:"name" json:"name"`
+	Deprecated *time.Time `yaml:"deprecated" json:"deprecated,omitempty"`
+	Sunset     *time.Time `yaml:"sunset" json:"sunset,omitempty"`
+	Link       string     `yaml:"link" json:"link,omitempty"`
+	Routes     []Rule     `yaml:"routes" json:"routes,omitempty"`
+}
+
+// version is a Version with the rules its requests are matched against:
+// the file's own, then its own, each shortest prefix first.
+type version struct {
+	Version
+	rules []Rule
+}
+
+func validateVersions(versions []Version, canIssue bool) error {
+	seen := map[string]bool{}
+	for i := range versions {
+		v := &versions[i]
+		if !validVersion.MatchString(v.Name) {
+			return fmt.Errorf("version %d: name %q must be v and a number, such as v1", i, v.Name)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("version %s: defined twice", v.Name)
+		}
+		seen[v.Name] = true
+		if v.Deprecated != nil && v.Sunset != nil && !v.Sunset.After(*v.Deprecated) {
+			return fmt.Errorf("version %s: sunset must be after deprecated", v.Name)
+		}
+		if v.Link != "" {
+			if u, err := url.Parse(v.Link); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("version %s: link %q is not an absolute http or https URL", v.Name, v.Link)
+			}
+		}
+		for j := range v.Routes {
+			if err := validateRule(j, &v.Routes[j], canIssue); err != nil {
+				return fmt.Errorf("version %s: %w", v.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func compileVersions(rules []Rule, versions []Version) map[string]*version {
+	compiled := make(map[string]*version, len(versions))
+	for _, v := range versions {
+		own := append([]Rule(nil), v.Routes...)
+		sortRules(own)
+		compiled[v.Name] = &version{Version: v, rules: append(append([]Rule(nil), rules...), own...)}
+	}
+	return compiled
+}
+
+// version returns the version path starts with and the path without it.
+// p.mu must be held.
+func (p *Policies) version(path string) (*version, string) {
+	if len(p.versions) == 0 {
+		return nil, path
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	v, ok := p.versions[name]
+	if !ok {
+		return nil, path
+	}
+	return v, "/" + rest
+}
+
+// versionList returns the versions by name. p.mu must be held.
+func (p *Policies) versionList() []Version {
+	list := make([]Version, 0, len(p.versions))
+	for _, v := range p.versions {
+		list = append(list, v.Version)
+	}
+	sort.Slice(list, func(i, j int) bool { return versionLess(list[i].Name, list[j].Name) })
+	return list
+}
+
+func versionLess(a, b string) bool {
+	na, errA := strconv.Atoi(strings.TrimPrefix(a, "v"))
+	nb, errB := strconv.Atoi(strings.TrimPrefix(b, "v"))
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return na < nb
+}
+
+// VersionOf returns the API version the request named, or "" for an
+// unversioned one. A version can reshape responses, so caches that store
+// them must vary on it.
+func VersionOf(ctx context.Context) string {
+	if res := fromContext(ctx); res != nil {
+		return res.version
+	}
+	return ""
+}
+
+func (p *Policies) versioned() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.versions) > 0
+}
+
+// announce sets the headers announcing v's retirement: Deprecation as an
+// RFC 9745 date, Sunset as an RFC 8594 HTTP date, and Link to the
+// migration guide.
+func (v *Version) announce(h http.Header) {
+	if v.Deprecated != nil {
+		h.Set("Deprecation", "@"+strconv.FormatInt(v.Deprecated.Unix(), 10))
+	}
+	if v.Sunset != nil {
+		h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if v.Link != "" && (v.Deprecated != nil || v.Sunset != nil) {
+		h.Add("Link", "<"+v.Link+`>; rel="deprecation"`)
+	}
+}
+
+func (v *Version) retired(now time.Time) bool {
+	return v.Sunset != nil && !now.Before(*v.Sunset)
+}
+
+// usage counts requests per version since startup. It outlives reloads, so
+// a version dropped from the file keeps its counts.
+type usage struct {
+	mu       sync.Mutex
+	versions map[string]*VersionUsage
+}
+
+func newUsage() *usage {
+	return &usage{versions: map[string]*VersionUsage{}}
+}
+
+func (u *usage) record(name string, status int, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	vu, ok := u.versions[name]
+	if !ok {
+		vu = &VersionUsage{Version: name}
+		u.versions[name] = vu
+	}
+	vu.Requests++
+	switch {
+	case status == http.StatusGone && name != unversioned:
+		vu.Gone++
+	case status >= 500:
+		vu.ServerErrors++
+	case status >= 400:
+		vu.ClientErrors++
+	}
+	vu.LastRequestAt = &at
+}
+
+// VersionUsage is one version in GET /metrics/api-versions. Gone counts
+// requests turned away after the version's sunset.
+type VersionUsage struct {
+	Version       string     `json:"version"`
+	Deprecated    *time.Time `json:"deprecated,omitempty"`
+	Sunset        *time.Time `json:"sunset,omitempty"`
+	Requests      int64      `json:"requests"`
+	ClientErrors  int64      `json:"client_errors"`
+	ServerErrors  int64      `json:"server_errors"`
+	Gone          int64      `json:"gone"`
+	LastRequestAt *time.Time `json:"last_request_at,omitempty"`
+}
+
+// Usage returns the usage of every version in the file, and of any other
+// version or unversioned path requested since startup, by version.
+func (p *Policies) Usage() []VersionUsage {
+	p.mu.RLock()
+	versions := p.versionList()
+	p.mu.RUnlock()
+
+	p.usage.mu.Lock()
+	defer p.usage.mu.Unlock()
+	list := []VersionUsage{}
+	listed := map[string]bool{}
+	for _, v := range versions {
+		vu := VersionUsage{Version: v.Name}
+		if seen, ok := p.usage.versions[v.Name]; ok {
+			vu = *seen
+		}
+		vu.Deprecated, vu.Sunset = v.Deprecated, v.Sunset
+		list = append(list, vu)
+		listed[v.Name] = true
+	}
+	for name, vu := range p.usage.versions {
+		if !listed[name] {
+			list = append(list, *vu)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		// Unversioned requests come last.
+		if (list[i].Version == unversioned) != (list[j].Version == unversioned) {
+			return list[j].Version == unversioned
+		}
+		return versionLess(list[i].Version, list[j].Version)
+	})
+	return list
+}
+
+// UsageHandler serves GET /metrics/api-versions.
+func (p *Policies) UsageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"versions": p.Usage()})
+	}
+}
+
+// statusRecorder keeps the status of a response for the usage counts.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through, as the writer it wraps does.
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
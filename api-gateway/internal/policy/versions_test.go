@@ -0,0 +1,125 @@
+package policy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseVersions(t *testing.T) {
+	for _, bad := range []string{
+		"versions:\n  - name: 1\n",
+		"versions:\n  - name: v1\n  - name: v1\n",
+		"versions:\n  - name: v1\n    deprecated: 2026-06-01T00:00:00Z\n    sunset: 2026-01-01T00:00:00Z\n",
+		"versions:\n  - name: v1\n    link: /docs/migrate\n",
+		"versions:\n  - name: v1\n    routes:\n      - prefix: api\n",
+	} {
+		if _, err := Parse([]byte(bad), true); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	deprecated := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	sunset := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	file := `
+routes:
+  - prefix: /api/
+    set_headers:
+      X-Gateway: api-gateway
+versions:
+  - name: v1
+    deprecated: ` + deprecated.Format(time.RFC3339) + `
+    sunset: ` + sunset.Format(time.RFC3339) + `
+    link: https://docs.example.com/migrate-to-v2
+    routes:
+      - prefix: /api/users
+        response:
+          rename:
+            display_name: name
+  - name: v2
+  - name: v0
+    sunset: 2020-01-01T00:00:00Z
+`
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	os.WriteFile(path, []byte(file), 0o600)
+	p, err := New(path, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Header("X-Version", VersionOf(c.Request.Context()))
+	})
+	router.Use(p.Middleware())
+	router.GET("/api/users/:id", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "display_name": "Ana"})
+	})
+	handler := p.Handler(router)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/v1/api/users/7")
+	if w.Code != http.StatusOK || w.Body.String() != `{"id":"7","name":"Ana"}` {
+		t.Fatalf("Expected v1's prefix taken off and its rules applied, got: %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Version") != "v1" {
+		t.Errorf("Expected the version in the request context, got: %q", w.Header().Get("X-Version"))
+	}
+	if got := w.Header().Get("Deprecation"); got != "@"+strconv.FormatInt(deprecated.Unix(), 10) {
+		t.Errorf("Expected a Deprecation date, got: %q", got)
+	}
+	if got := w.Header().Get("Sunset"); got != sunset.Format(http.TimeFormat) {
+		t.Errorf("Expected a Sunset date, got: %q", got)
+	}
+	if got := w.Header().Get("Link"); got != `<https://docs.example.com/migrate-to-v2>; rel="deprecation"` {
+		t.Errorf("Expected a link to the migration guide, got: %q", got)
+	}
+
+	w = get("/v2/api/users/7")
+	if w.Code != http.StatusOK || w.Body.String() != `{"display_name":"Ana","id":"7"}` || w.Header().Get("Deprecation") != "" {
+		t.Errorf("Expected v2 served without v1's rules or headers, got: %d %s %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w = get("/api/users/7"); w.Code != http.StatusOK || w.Header().Get("X-Version") != "" {
+		t.Errorf("Expected an unversioned request served as before, got: %d %v", w.Code, w.Header())
+	}
+	if w = get("/v3/api/users/7"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown version left to 404, got: %d", w.Code)
+	}
+
+	w = get("/v0/api/users/7")
+	if w.Code != http.StatusGone || w.Body.String() != `{"error":"API v0 was retired on 2020-01-01"}` {
+		t.Errorf("Expected a retired version to be gone, got: %d %s", w.Code, w.Body.String())
+	}
+
+	want := map[string][4]int64{
+		"v0":          {1, 0, 0, 1},
+		"v1":          {1, 0, 0, 0},
+		"v2":          {1, 0, 0, 0},
+		"unversioned": {2, 1, 0, 0},
+	}
+	usage := p.Usage()
+	if len(usage) != len(want) || usage[0].Version != "v0" || usage[len(usage)-1].Version != "unversioned" {
+		t.Fatalf("Expected the versions in order with unversioned last, got: %+v", usage)
+	}
+	for _, vu := range usage {
+		if got := [4]int64{vu.Requests, vu.ClientErrors, vu.ServerErrors, vu.Gone}; got != want[vu.Version] || vu.LastRequestAt == nil {
+			t.Errorf("Expected %s usage %v, got: %+v", vu.Version, want[vu.Version], vu)
+		}
+	}
+	if usage[1].Sunset == nil || !usage[1].Sunset.Equal(sunset) {
+		t.Errorf("Expected v1's sunset in its usage, got: %+v", usage[1])
+	}
+}
@@ -0,0 +1,176 @@
+// Package portal serves the webhook half of the developer portal. Requests
+// are relayed to notification-service with the developer's own token, so
+// it is notification-service that decides which subscriptions they may
+// see: their own, or all of the tenant's for admins.
+package portal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+// Webhooks is the part of clients.NotificationClient the portal uses.
+type Webhooks interface {
+	ListWebhookEvents(ctx context.Context) ([]string, error)
+	ListWebhooks(ctx context.Context) ([]clients.Webhook, error)
+	CreateWebhook(ctx context.Context, req clients.WebhookRequest) (*clients.Webhook, error)
+	UpdateWebhook(ctx context.Context, id int64, req clients.WebhookRequest) (*clients.Webhook, error)
+	DeleteWebhook(ctx context.Context, id int64) error
+	RotateWebhookSecret(ctx context.Context, id int64) (string, error)
+	ListWebhookDeliveries(ctx context.Context, id, before int64, limit int) (*clients.WebhookDeliveries, error)
+}
+
+type Handler struct {
+	webhooks Webhooks
+}
+
+func NewHandler(webhooks Webhooks) *Handler {
+	return &Handler{webhooks: webhooks}
+}
+
+// RegisterRoutes mounts the routes on a group that has authenticated the
+// developer.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/webhooks/events", h.events)
+	router.GET("/webhooks", h.list)
+	router.POST("/webhooks", h.create)
+	router.PUT("/webhooks/:id", h.update)
+	router.DELETE("/webhooks/:id", h.remove)
+	router.POST("/webhooks/:id/rotate-secret", h.rotateSecret)
+	router.GET("/webhooks/:id/deliveries", h.deliveries)
+}
+
+// relayError passes on notification-service's answers to bad requests,
+// such as an invalid URL or another developer's subscription, and reports
+// anything else as the gateway failing to reach it.
+func relayError(c *gin.Context, err error) {
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode < http.StatusInternalServerError {
+		c.JSON(apiErr.StatusCode, gin.H{"error": apiErr.Message})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+}
+
+func subscriptionID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid subscription id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *Handler) events(c *gin.Context) {
+	types, err := h.webhooks.ListWebhookEvents(c.Request.Context())
+	if err != nil {
+		relayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": types})
+}
+
+func (h *Handler) list(c *gin.Context) {
+	subs, err := h.webhooks.ListWebhooks(c.Request.Context())
+	if err != nil {
+		relayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+// create responds with the subscription's signing secret, which is not
+// shown again.
+func (h *Handler) create(c *gin.Context) {
+	var req clients.WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sub, err := h.webhooks.CreateWebhook(c.Request.Context(), req)
+	if err != nil {
+		relayError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, sub)
+}
+
+func (h *Handler) update(c *gin.Context) {
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	var req clients.WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sub, err := h.webhooks.UpdateWebhook(c.Request.Context(), id, req)
+	if err != nil {
+		relayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, sub)
+}
+
+func (h *Handler) remove(c *gin.Context) {
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	if err := h.webhooks.DeleteWebhook(c.Request.Context(), id); err != nil {
+		relayError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) rotateSecret(c *gin.Context) {
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	secret, err := h.webhooks.RotateWebhookSecret(c.Request.Context(), id)
+	if err != nil {
+		relayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "secret": secret})
+}
+
+// deliveries pages through the subscription's deliveries newest first.
+// Pass next_before from a page as ?before= to get the next one.
+func (h *Handler) deliveries(c *gin.Context) {
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	var before int64
+	if raw := c.Query("before"); raw != "" {
+		var err error
+		if before, err = strconv.ParseInt(raw, 10, 64); err != nil || before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a delivery id"})
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDeliveryLimit)))
+	if limit <= 0 || limit > maxDeliveryLimit {
+		limit = defaultDeliveryLimit
+	}
+	page, err := h.webhooks.ListWebhookDeliveries(c.Request.Context(), id, before, limit)
+	if err != nil {
+		relayError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
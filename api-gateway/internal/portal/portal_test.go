@@ -0,0 +1,80 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/gin-gonic/gin"
+)
+
+// fakeWebhooks holds subscription 1; any other is another developer's.
+type fakeWebhooks struct {
+	Webhooks
+	created []clients.WebhookRequest
+	down    bool
+}
+
+func (f *fakeWebhooks) ListWebhooks(ctx context.Context) ([]clients.Webhook, error) {
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+	return []clients.Webhook{{ID: 1, URL: "https://example.com/hook", Events: []string{"order.placed"}, Active: true}}, nil
+}
+
+func (f *fakeWebhooks) CreateWebhook(ctx context.Context, req clients.WebhookRequest) (*clients.Webhook, error) {
+	if !strings.HasPrefix(req.URL, "https://") {
+		return nil, &clients.APIError{StatusCode: http.StatusBadRequest, Message: "url must be an absolute https URL without credentials"}
+	}
+	f.created = append(f.created, req)
+	return &clients.Webhook{ID: 2, URL: req.URL, Events: req.Events, Active: true, Secret: "whsec_new"}, nil
+}
+
+func (f *fakeWebhooks) RotateWebhookSecret(ctx context.Context, id int64) (string, error) {
+	if id != 1 {
+		return "", &clients.APIError{StatusCode: http.StatusNotFound, Message: "subscription not found"}
+	}
+	return "whsec_rotated", nil
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	webhooks := &fakeWebhooks{}
+	router := gin.New()
+	NewHandler(webhooks).RegisterRoutes(router)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		method, path, body string
+		want               int
+		contains           string
+	}{
+		{http.MethodGet, "/webhooks", "", http.StatusOK, `"subscriptions":[{"id":1`},
+		{http.MethodPost, "/webhooks", `{"url": "http://example.com", "events": ["order.placed"]}`, http.StatusBadRequest, "https URL"},
+		{http.MethodPost, "/webhooks", `{"url": "https://example.com/new", "events": ["order.placed"]}`, http.StatusCreated, `"secret":"whsec_new"`},
+		{http.MethodPost, "/webhooks/1/rotate-secret", "", http.StatusOK, `"secret":"whsec_rotated"`},
+		{http.MethodPost, "/webhooks/9/rotate-secret", "", http.StatusNotFound, "subscription not found"},
+		{http.MethodPost, "/webhooks/x/rotate-secret", "", http.StatusBadRequest, "invalid subscription id"},
+	}
+	for _, tt := range tests {
+		if w := serve(tt.method, tt.path, tt.body); w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected %d with %s, got: %d %s", tt.method, tt.path, tt.want, tt.contains, w.Code, w.Body)
+		}
+	}
+	if len(webhooks.created) != 1 || webhooks.created[0].Events[0] != "order.placed" {
+		t.Errorf("Expected the request to be relayed as sent, got: %+v", webhooks.created)
+	}
+
+	webhooks.down = true
+	if w := serve(http.MethodGet, "/webhooks", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected an unreachable notification-service to be a 502, got: %d", w.Code)
+	}
+}
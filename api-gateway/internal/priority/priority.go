@@ -0,0 +1,490 @@
+// Package priority sorts gateway requests into tiers and, when the gateway
+// is busy, turns away the least important ones first: exports go before
+// browsing, and browsing before checkout. Tiers can also be given
+// concurrency pools of their own, so a burst of one cannot starve another.
+// Health checks and the admin API are never turned away.
+package priority
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tier is how important a request is; lower is more important.
+type Tier int
+
+const (
+	Critical Tier = iota
+	Checkout
+	Browse
+	Export
+	tierCount
+)
+
+var tierNames = [tierCount]string{"critical", "checkout", "browse", "export"}
+
+func (t Tier) String() string {
+	return tierNames[t]
+}
+
+// ParseTier parses a tier name.
+func ParseTier(s string) (Tier, error) {
+	for t, name := range tierNames {
+		if s == name {
+			return Tier(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority tier %q, want critical, checkout, browse or export", s)
+}
+
+// retryAfter is the Retry-After, in seconds, sent with a shed request. Less
+// important tiers are asked to stay away longer.
+var retryAfter = [tierCount]int{1, 1, 5, 30}
+
+// Rule puts requests whose path starts with PathPrefix, and whose method is
+// Method when set, in Tier.
+type Rule struct {
+	Method     string `json:"method,omitempty"`
+	PathPrefix string `json:"path_prefix"`
+	Tier       string `json:"tier"`
+	tier       Tier
+}
+
+// ParseRules parses "[METHOD ]prefix=tier" pairs separated by commas, e.g.
+// "/api/orders=checkout,GET /api/orders/export=export".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		match, name, ok := strings.Cut(part, "=")
+		method, prefix, hasMethod := strings.Cut(strings.TrimSpace(match), " ")
+		if !hasMethod {
+			method, prefix = "", method
+		}
+		prefix = strings.TrimSpace(prefix)
+		tier, err := ParseTier(strings.TrimSpace(name))
+		if !ok || err != nil || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid priority rule %q, want [METHOD ]prefix=tier", part)
+		}
+		rules = append(rules, Rule{Method: strings.ToUpper(method), PathPrefix: prefix, Tier: tier.String(), tier: tier})
+	}
+	return rules, nil
+}
+
+// ParseShedAt parses "tier=percent" pairs, e.g. "browse=80,export=50": the
+// share of MaxInFlight at which a tier starts being shed. Tiers left out keep
+// their default.
+func ParseShedAt(s string) (map[string]int, error) {
+	shedAt := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		tier, err := ParseTier(strings.TrimSpace(name))
+		percent, perr := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || tier == Critical || perr != nil || percent < 1 || percent > 100 {
+			return nil, fmt.Errorf("invalid shed threshold %q, want tier=percent for checkout, browse or export", part)
+		}
+		shedAt[tier.String()] = percent
+	}
+	return shedAt, nil
+}
+
+// ParsePools parses "tier=slots" pairs, e.g. "checkout=100,export=10": the
+// tiers that get concurrency of their own instead of sharing MaxInFlight.
+func ParsePools(s string) (map[string]int, error) {
+	pools := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		tier, err := ParseTier(strings.TrimSpace(name))
+		slots, serr := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || tier == Critical || serr != nil || slots < 1 {
+			return nil, fmt.Errorf("invalid priority pool %q, want tier=slots for checkout, browse or export", part)
+		}
+		pools[tier.String()] = slots
+	}
+	return pools, nil
+}
+
+// critical reports whether path is always admitted: health checks, so a busy
+// gateway is not mistaken for a dead one, metrics, and the admin API, so the
+// limits can be raised while saturated.
+func critical(path string) bool {
+	return path == "/health" || strings.HasPrefix(path, "/health/") ||
+		strings.HasPrefix(path, "/metrics/") || strings.HasPrefix(path, "/admin/")
+}
+
+// Limits bound the gateway. MaxInFlight counts requests of every tier but
+// critical; zero turns shedding off. ShedAt is the percentage of MaxInFlight
+// at which each tier stops being admitted.
+//
+// A tier in Pools has that many slots of its own instead, so it is neither
+// counted against MaxInFlight nor held back by it: reports filling their
+// pool cannot take a slot checkout needs. A request that finds no slot
+// waits up to QueueTimeoutMS in its tier's queue of at most MaxQueue, and
+// freed shared slots go to the most important tier waiting.
+type Limits struct {
+	MaxInFlight    int            `json:"max_in_flight"`
+	ShedAt         map[string]int `json:"shed_at"`
+	Pools          map[string]int `json:"pools,omitempty"`
+	MaxQueue       int            `json:"max_queue"`
+	QueueTimeoutMS int            `json:"queue_timeout_ms"`
+}
+
+func (l Limits) queueTimeout() time.Duration {
+	return time.Duration(l.QueueTimeoutMS) * time.Millisecond
+}
+
+// DefaultShedAt sheds exports from half capacity and browsing from 80%,
+// keeping the rest for checkout.
+var DefaultShedAt = map[string]int{"checkout": 100, "browse": 80, "export": 50}
+
+type tierStats struct {
+	// shared and pooled are the tier's requests in flight on the shared
+	// slots and on its own pool.
+	shared   int
+	pooled   int
+	waiters  []chan bool
+	admitted int64
+	queued   int64
+	shed     int64
+}
+
+func (s tierStats) inFlight() int {
+	return s.shared + s.pooled
+}
+
+// Limiter classifies requests and admits them by tier.
+type Limiter struct {
+	rules []Rule
+
+	mu     sync.Mutex
+	limits Limits
+	stats  [tierCount]tierStats
+}
+
+// New sorts rules longest prefix first, with method-specific rules ahead of
+// others for the same prefix. Tiers missing from limits.ShedAt get their
+// DefaultShedAt.
+func New(rules []Rule, limits Limits) *Limiter {
+	sorted := append([]Rule(nil), rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if len(sorted[i].PathPrefix) != len(sorted[j].PathPrefix) {
+			return len(sorted[i].PathPrefix) > len(sorted[j].PathPrefix)
+		}
+		return sorted[i].Method != "" && sorted[j].Method == ""
+	})
+	return &Limiter{rules: sorted, limits: withDefaults(limits)}
+}
+
+func withDefaults(l Limits) Limits {
+	shedAt := make(map[string]int, len(DefaultShedAt))
+	for name, percent := range DefaultShedAt {
+		shedAt[name] = percent
+	}
+	for name, percent := range l.ShedAt {
+		shedAt[name] = percent
+	}
+	l.ShedAt = shedAt
+	pools := make(map[string]int, len(l.Pools))
+	for name, slots := range l.Pools {
+		pools[name] = slots
+	}
+	l.Pools = pools
+	return l
+}
+
+// Classify returns the tier of a request. Requests no rule matches are
+// browsing.
+func (l *Limiter) Classify(method, path string) Tier {
+	if critical(path) {
+		return Critical
+	}
+	for _, r := range l.rules {
+		if strings.HasPrefix(path, r.PathPrefix) && (r.Method == "" || r.Method == method) {
+			return r.tier
+		}
+	}
+	return Browse
+}
+
+// Middleware sheds a request with 503 and Retry-After when its tier has no
+// slot free, after waiting in its queue if queueing is on.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tier := l.Classify(c.Request.Method, c.Request.URL.Path)
+		pooled, ok := l.acquire(c.Request.Context(), tier)
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(retryAfter[tier]))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "gateway is overloaded, retry later", "tier": tier.String()})
+			return
+		}
+		defer l.release(tier, pooled)
+		c.Next()
+	}
+}
+
+// shared returns the requests in flight on the shared slots. l.mu must be
+// held.
+func (l *Limiter) shared() int {
+	n := 0
+	for t := Checkout; t < tierCount; t++ {
+		n += l.stats[t].shared
+	}
+	return n
+}
+
+// admits reports whether a request of tier can have a slot now. l.mu must
+// be held.
+func (l *Limiter) admits(tier Tier) bool {
+	if tier == Critical {
+		return true
+	}
+	if slots := l.limits.Pools[tier.String()]; slots > 0 {
+		return l.stats[tier].pooled < slots
+	}
+	return l.limits.MaxInFlight <= 0 || l.shared() < l.limits.MaxInFlight*l.limits.ShedAt[tier.String()]/100
+}
+
+// take gives a request of tier a slot, reporting whether it is from the
+// tier's pool. l.mu must be held.
+func (l *Limiter) take(tier Tier) bool {
+	s := &l.stats[tier]
+	s.admitted++
+	if tier != Critical && l.limits.Pools[tier.String()] > 0 {
+		s.pooled++
+		return true
+	}
+	s.shared++
+	return false
+}
+
+// acquire takes a slot for a request of tier, waiting in the tier's queue
+// for up to the queue timeout, and reports whether the slot is from the
+// tier's pool.
+func (l *Limiter) acquire(ctx context.Context, tier Tier) (pooled, ok bool) {
+	l.mu.Lock()
+	if l.admits(tier) {
+		pooled = l.take(tier)
+		l.mu.Unlock()
+		return pooled, true
+	}
+	s := &l.stats[tier]
+	if len(s.waiters) >= l.limits.MaxQueue || l.limits.QueueTimeoutMS <= 0 {
+		s.shed++
+		l.mu.Unlock()
+		return false, false
+	}
+	// The channel is buffered so a release can hand over a slot without
+	// waiting for the request to take it.
+	slot := make(chan bool, 1)
+	s.waiters = append(s.waiters, slot)
+	s.queued++
+	timeout := l.limits.queueTimeout()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case pooled = <-slot:
+		return pooled, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range s.waiters {
+		if w == slot {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.shed++
+			return false, false
+		}
+	}
+	// A release handed over the slot just as the wait ended.
+	return <-slot, true
+}
+
+func (l *Limiter) release(tier Tier, pooled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pooled {
+		l.stats[tier].pooled--
+	} else {
+		l.stats[tier].shared--
+	}
+	l.wake()
+}
+
+// wake hands free slots to waiting requests, most important tier first.
+// l.mu must be held.
+func (l *Limiter) wake() {
+	for t := Checkout; t < tierCount; t++ {
+		s := &l.stats[t]
+		for len(s.waiters) > 0 && l.admits(t) {
+			s.waiters[0] <- l.take(t)
+			s.waiters = s.waiters[1:]
+		}
+	}
+}
+
+// SetLimits changes the limits from the next request on. Requests already
+// admitted finish, and waiting ones are admitted if the new limits allow.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.UpdateLimits(func(Limits) Limits { return limits })
+}
+
+// UpdateLimits replaces the limits with what change makes of the current
+// ones, holding the limiter while it does, so concurrent updates each see
+// the other's changes. It returns the new limits.
+func (l *Limiter) UpdateLimits(change func(current Limits) Limits) Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = withDefaults(change(withDefaults(l.limits)))
+	l.wake()
+	return withDefaults(l.limits)
+}
+
+// TierStats is one tier in a Snapshot. A tier is limited either by its
+// Pool of slots or by the shared slots in flight at which it is shed, and
+// Utilization is the share of that limit in use. Queued is how many
+// requests are waiting now, and Waited how many have had to.
+type TierStats struct {
+	Tier        string  `json:"tier"`
+	ShedAt      int     `json:"shed_at_in_flight,omitempty"`
+	Pool        int     `json:"pool,omitempty"`
+	Utilization float64 `json:"utilization,omitempty"`
+	InFlight    int     `json:"in_flight"`
+	Queued      int     `json:"queued"`
+	Admitted    int64   `json:"admitted"`
+	Waited      int64   `json:"waited"`
+	Shed        int64   `json:"shed"`
+}
+
+// Snapshot is served by GET /metrics/priority and GET /admin/priority.
+// InFlight and Utilization are of the shared slots.
+type Snapshot struct {
+	Limits      Limits      `json:"limits"`
+	InFlight    int         `json:"in_flight"`
+	Utilization float64     `json:"utilization,omitempty"`
+	Tiers       []TierStats `json:"tiers"`
+	Rules       []Rule      `json:"rules"`
+}
+
+// Snapshot returns the limits and the per-tier counters since startup, most
+// important tier first.
+func (l *Limiter) Snapshot() Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	snap := Snapshot{
+		Limits:      withDefaults(l.limits),
+		InFlight:    l.shared(),
+		Utilization: utilization(l.shared(), l.limits.MaxInFlight),
+		Rules:       append([]Rule{}, l.rules...),
+	}
+	for t := Critical; t < tierCount; t++ {
+		s := l.stats[t]
+		ts := TierStats{Tier: t.String(), InFlight: s.inFlight(), Queued: len(s.waiters), Admitted: s.admitted, Waited: s.queued, Shed: s.shed}
+		switch slots := l.limits.Pools[t.String()]; {
+		case t == Critical:
+		case slots > 0:
+			ts.Pool = slots
+			ts.Utilization = utilization(s.pooled, slots)
+		case l.limits.MaxInFlight > 0:
+			ts.ShedAt = l.limits.MaxInFlight * l.limits.ShedAt[t.String()] / 100
+			ts.Utilization = utilization(s.shared, ts.ShedAt)
+		}
+		snap.Tiers = append(snap.Tiers, ts)
+	}
+	return snap
+}
+
+// utilization is inFlight as a share of capacity, to three decimal places.
+func utilization(inFlight, capacity int) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return math.Round(float64(inFlight)/float64(capacity)*1000) / 1000
+}
+
+// Handler serves the per-tier counters.
+func (l *Limiter) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, l.Snapshot())
+	}
+}
+
+// RegisterAdminRoutes mounts the limits on an admin-protected group. Changes
+// last until the next restart.
+func (l *Limiter) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/priority", l.Handler())
+	router.PUT("/priority", l.set)
+}
+
+func (l *Limiter) set(c *gin.Context) {
+	var req struct {
+		MaxInFlight *int           `json:"max_in_flight" binding:"required,min=0"`
+		ShedAt      map[string]int `json:"shed_at"`
+		// Pools, MaxQueue and QueueTimeoutMS keep their current values
+		// when left out.
+		Pools          map[string]int `json:"pools"`
+		MaxQueue       *int           `json:"max_queue" binding:"omitempty,min=0"`
+		QueueTimeoutMS *int           `json:"queue_timeout_ms" binding:"omitempty,min=0,max=60000"`
+		Actor          string         `json:"actor" binding:"max=255"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for name, percent := range req.ShedAt {
+		if tier, err := ParseTier(name); err != nil || tier == Critical || percent < 1 || percent > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "shed_at takes checkout, browse and export percentages from 1 to 100"})
+			return
+		}
+	}
+	for name, slots := range req.Pools {
+		if tier, err := ParseTier(name); err != nil || tier == Critical || slots < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "pools take checkout, browse and export slots, 0 to share the rest"})
+			return
+		}
+	}
+	limits := l.UpdateLimits(func(current Limits) Limits {
+		next := Limits{MaxInFlight: *req.MaxInFlight, ShedAt: req.ShedAt, Pools: current.Pools, MaxQueue: current.MaxQueue, QueueTimeoutMS: current.QueueTimeoutMS}
+		if req.Pools != nil {
+			next.Pools = map[string]int{}
+			for name, slots := range req.Pools {
+				if slots > 0 {
+					next.Pools[name] = slots
+				}
+			}
+		}
+		if req.MaxQueue != nil {
+			next.MaxQueue = *req.MaxQueue
+		}
+		if req.QueueTimeoutMS != nil {
+			next.QueueTimeoutMS = *req.QueueTimeoutMS
+		}
+		return next
+	})
+	log.Printf("Request priority limits set to %+v by %q from %s", limits, req.Actor, c.ClientIP())
+	c.JSON(http.StatusOK, l.Snapshot())
+}
@@ -0,0 +1,244 @@
+package priority
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("/api/orders=checkout, GET /api/orders/export=export")
+	if err != nil || len(rules) != 2 || rules[1].Method != "GET" || rules[1].PathPrefix != "/api/orders/export" || rules[1].tier != Export {
+		t.Fatalf("Expected two rules, got: %+v %v", rules, err)
+	}
+	for _, s := range []string{"/api/orders", "/api/orders=urgent", "api/orders=browse", "GET=browse"} {
+		if _, err := ParseRules(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+	if _, err := ParseShedAt("critical=50"); err == nil {
+		t.Error("Expected a critical threshold to be rejected")
+	}
+	if shedAt, err := ParseShedAt("export=25"); err != nil || shedAt["export"] != 25 {
+		t.Errorf("Expected the export threshold, got: %v %v", shedAt, err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	rules, _ := ParseRules("/api/orders=checkout,GET /api/orders/export=export,/admin=export")
+	l := New(rules, Limits{})
+	tests := []struct {
+		method, path string
+		want         Tier
+	}{
+		{http.MethodGet, "/health", Critical},
+		{http.MethodGet, "/health/db", Critical},
+		{http.MethodPut, "/admin/priority", Critical},
+		{http.MethodPost, "/api/orders", Checkout},
+		{http.MethodGet, "/api/orders/export", Export},
+		{http.MethodPost, "/api/orders/export", Checkout},
+		{http.MethodGet, "/api/users", Browse},
+	}
+	for _, tt := range tests {
+		if got := l.Classify(tt.method, tt.path); got != tt.want {
+			t.Errorf("Expected %s %s to be %s, got: %s", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestShedsLowPriorityFirst(t *testing.T) {
+	rules, _ := ParseRules("/checkout=checkout,/export=export")
+	l := New(rules, Limits{MaxInFlight: 10})
+	for i := 0; i < 5; i++ {
+		if _, ok := l.acquire(context.Background(), Checkout); !ok {
+			t.Fatalf("Expected checkout request %d to be admitted", i)
+		}
+	}
+
+	// 5 of 10 in flight: exports, shed from 50%, are turned away.
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(l.Middleware())
+	for _, path := range []string{"/checkout", "/browse", "/export", "/health"} {
+		router.GET(path, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+	l.RegisterAdminRoutes(router.Group("/admin"))
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := serve(http.MethodGet, "/export", ""); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected the export to be shed, got: %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve(http.MethodGet, "/browse", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected browsing to be admitted below 80%%, got: %d", w.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		l.acquire(context.Background(), Checkout)
+	}
+	// 8 of 10: browsing is shed too, checkout and health checks are not.
+	if w := serve(http.MethodGet, "/browse", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected browsing to be shed at 80%%, got: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/checkout", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected checkout to be admitted, got: %d", w.Code)
+	}
+	for i := 0; i < 2; i++ {
+		l.acquire(context.Background(), Checkout)
+	}
+	if w := serve(http.MethodGet, "/checkout", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected checkout to be shed at capacity, got: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected health checks never to be shed, got: %d", w.Code)
+	}
+
+	snap := l.Snapshot()
+	shed := map[string]int64{}
+	for _, ts := range snap.Tiers {
+		shed[ts.Tier] = ts.Shed
+	}
+	if snap.InFlight != 10 || shed["export"] != 1 || shed["browse"] != 1 || shed["checkout"] != 1 || shed["critical"] != 0 {
+		t.Errorf("Expected one shed request per tier but critical, got: %+v", snap)
+	}
+
+	// Raising the limit at runtime admits browsing again.
+	if w := serve(http.MethodPut, "/admin/priority", `{"max_in_flight": 20, "shed_at": {"critical": 10}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a critical threshold to be rejected, got: %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/admin/priority", `{"max_in_flight": 20, "shed_at": {"export": 10}, "actor": "ops"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the limits to change, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(http.MethodGet, "/browse", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected browsing to be admitted after raising the limit, got: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/export", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the lowered export threshold to apply, got: %d", w.Code)
+	}
+	for i := 0; i < 10; i++ {
+		l.release(Checkout, false)
+	}
+	if snap := l.Snapshot(); snap.InFlight != 0 {
+		t.Errorf("Expected nothing left in flight, got: %d", snap.InFlight)
+	}
+}
+
+func TestParsePools(t *testing.T) {
+	pools, err := ParsePools(" checkout=100, export=10 ")
+	if err != nil || pools["checkout"] != 100 || pools["export"] != 10 || len(pools) != 2 {
+		t.Errorf("Expected two pools, got: %v %v", pools, err)
+	}
+	for _, bad := range []string{"critical=5", "export=0", "export", "reports=5"} {
+		if _, err := ParsePools(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestPools(t *testing.T) {
+	l := New(nil, Limits{MaxInFlight: 4, Pools: map[string]int{"export": 2}})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if pooled, ok := l.acquire(ctx, Export); !ok || !pooled {
+			t.Fatalf("Expected export %d to take a pooled slot, got: %v %v", i, pooled, ok)
+		}
+	}
+	if _, ok := l.acquire(ctx, Export); ok {
+		t.Error("Expected exports to be shed once their pool is full")
+	}
+	// Exports filling their pool leave every shared slot to the others.
+	for i := 0; i < 4; i++ {
+		if pooled, ok := l.acquire(ctx, Checkout); !ok || pooled {
+			t.Fatalf("Expected checkout %d to take a shared slot, got: %v %v", i, pooled, ok)
+		}
+	}
+	snap := l.Snapshot()
+	if snap.InFlight != 4 || snap.Utilization != 1 {
+		t.Errorf("Expected the shared slots full, got: %d %v", snap.InFlight, snap.Utilization)
+	}
+	export := snap.Tiers[Export]
+	if export.Pool != 2 || export.InFlight != 2 || export.Utilization != 1 || export.Shed != 1 {
+		t.Errorf("Expected the export pool full with one shed, got: %+v", export)
+	}
+	l.release(Export, true)
+	if _, ok := l.acquire(ctx, Export); !ok {
+		t.Error("Expected a freed pool slot to admit an export")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	l := New(nil, Limits{MaxInFlight: 1, ShedAt: map[string]int{"browse": 100, "export": 100}, MaxQueue: 1, QueueTimeoutMS: 1000})
+	ctx := context.Background()
+	l.acquire(ctx, Checkout)
+
+	admitted := make(chan Tier, 2)
+	for _, tier := range []Tier{Export, Browse} {
+		go func(tier Tier) {
+			if _, ok := l.acquire(ctx, tier); ok {
+				admitted <- tier
+			}
+		}(tier)
+	}
+	waitFor := func(cond func(Snapshot) bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond(l.Snapshot()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out, got: %+v", l.Snapshot())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(func(s Snapshot) bool { return s.Tiers[Export].Queued == 1 && s.Tiers[Browse].Queued == 1 })
+	if _, ok := l.acquire(ctx, Browse); ok {
+		t.Error("Expected a request beyond the full queue to be shed")
+	}
+
+	// The freed slot goes to browsing, the more important tier waiting,
+	// and the next to the export.
+	l.release(Checkout, false)
+	if tier := <-admitted; tier != Browse {
+		t.Errorf("Expected browsing admitted first, got: %s", tier)
+	}
+	l.release(Browse, false)
+	if tier := <-admitted; tier != Export {
+		t.Errorf("Expected the export admitted next, got: %s", tier)
+	}
+
+	// A request that waits out the timeout is shed.
+	l.SetLimits(Limits{MaxInFlight: 1, MaxQueue: 1, QueueTimeoutMS: 10})
+	if _, ok := l.acquire(ctx, Checkout); ok {
+		t.Error("Expected the queued request to be shed after the timeout")
+	}
+	if s := l.Snapshot().Tiers[Checkout]; s.Waited != 1 || s.Queued != 0 {
+		t.Errorf("Expected one request to have waited and none left, got: %+v", s)
+	}
+}
+
+func TestUpdateLimitsConcurrently(t *testing.T) {
+	l := New(nil, Limits{MaxInFlight: 10})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.UpdateLimits(func(current Limits) Limits {
+				current.MaxQueue++
+				return current
+			})
+		}()
+	}
+	wg.Wait()
+	if got := l.Snapshot().Limits; got.MaxQueue != 50 || got.MaxInFlight != 10 {
+		t.Errorf("Expected every update applied on top of the others, got: %+v", got)
+	}
+}
@@ -0,0 +1,27 @@
+package quota
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterRoutes serves GET /usage, which shows callers how much of each
+// quota their API key or token has left.
+func RegisterRoutes(router gin.IRouter, q *Quotas) {
+	router.GET("/usage", func(c *gin.Context) {
+		consumer, ok := q.consumer(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "an API key or token is required"})
+			return
+		}
+		usage, err := q.Usage(c.Request.Context(), consumer)
+		if err != nil {
+			log.Printf("Failed to read quota usage for %s: %v", consumer.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read usage"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"consumer": consumer.ID, "quotas": usage})
+	})
+}
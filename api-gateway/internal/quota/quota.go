@@ -0,0 +1,245 @@
+// Package quota counts each API key's and user's requests against daily
+// and monthly quotas, beyond the burst limits of the rate limiter, and
+// turns a consumer away once a quota is used up until its period resets.
+//
+// Counts live in Postgres, so every replica sees the same totals. Crossing
+// 80% and then 100% of a quota publishes an events.GatewayQuotaThreshold
+// event, so the consumer can be told before and when they are cut off.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/apikeys"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// Quota periods. Both start at midnight UTC.
+const (
+	Day   = "day"
+	Month = "month"
+)
+
+var adjectives = map[string]string{Day: "daily", Month: "monthly"}
+
+// warnPercent is the share of a quota whose crossing is announced ahead of
+// the quota running out.
+const warnPercent = 80
+
+// Rule allows each consumer Limit requests to paths starting with
+// PathPrefix per Period.
+type Rule struct {
+	PathPrefix string `json:"path_prefix"`
+	Limit      int    `json:"limit"`
+	Period     string `json:"period"`
+}
+
+// ParseRules parses "prefix=limit/period" pairs separated by commas, where
+// period is day or month, e.g. "/api/orders=1000/day,/api=50000/month".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, spec, ok := strings.Cut(part, "=")
+		count, period, hasPeriod := strings.Cut(spec, "/")
+		limit, err := strconv.Atoi(strings.TrimSpace(count))
+		prefix, period = strings.TrimSpace(prefix), strings.TrimSpace(period)
+		if !ok || !hasPeriod || err != nil || limit < 1 || (period != Day && period != Month) || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid quota %q, want prefix=limit/day or prefix=limit/month", part)
+		}
+		rules = append(rules, Rule{PathPrefix: prefix, Limit: limit, Period: period})
+	}
+	return rules, nil
+}
+
+// Start returns the start of the period now falls in.
+func (r Rule) Start(now time.Time) time.Time {
+	now = now.UTC()
+	if r.Period == Month {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Reset returns when the period now falls in ends.
+func (r Rule) Reset(now time.Time) time.Time {
+	start := r.Start(now)
+	if r.Period == Month {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Consumer is who a request is counted against: the API key it carries,
+// or else the user its token names.
+type Consumer struct {
+	ID       string
+	APIKeyID int
+	UserID   int
+	Tenant   string
+}
+
+// Quotas enforces rules per consumer.
+type Quotas struct {
+	rules     []Rule
+	store     Store
+	publisher events.Publisher
+	tokens    *auth.Tokens
+	now       func() time.Time
+}
+
+// New counts requests by API key and, when tokens is not nil, by the user
+// their bearer token names. Without tokens the gateway cannot tell users
+// apart, so only keyed requests are counted.
+func New(rules []Rule, store Store, publisher events.Publisher, tokens *auth.Tokens) *Quotas {
+	return &Quotas{rules: rules, store: store, publisher: publisher, tokens: tokens, now: time.Now}
+}
+
+// consumer identifies who the request is counted against. Anonymous
+// requests, those from services and those with a token the gateway cannot
+// verify, which the backend will turn away, are not counted.
+func (q *Quotas) consumer(c *gin.Context) (Consumer, bool) {
+	t := tenant.FromContext(c.Request.Context())
+	if key, ok := apikeys.FromContext(c); ok {
+		return Consumer{ID: "apikey:" + strconv.Itoa(key.ID), APIKeyID: key.ID, UserID: key.OwnerID, Tenant: t}, true
+	}
+	if q.tokens == nil {
+		return Consumer{}, false
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return Consumer{}, false
+	}
+	p, err := q.tokens.Parse(token)
+	if err != nil || p.Service != "" || p.UserID == 0 {
+		return Consumer{}, false
+	}
+	if p.Tenant != "" {
+		t = p.Tenant
+	}
+	return Consumer{ID: "user:" + strconv.Itoa(p.UserID), UserID: p.UserID, Tenant: t}, true
+}
+
+// Middleware counts the request against every rule whose prefix it falls
+// under, and answers 429 with Retry-After once any of them is used up.
+// X-Quota-Limit, X-Quota-Remaining and X-Quota-Reset describe the rule
+// closest to running out. It runs after the API key middleware, so it
+// knows the key, and before the cache, so cached answers count too.
+//
+// A consumer is let through when its count cannot be recorded, so a
+// database outage does not take the API down with it.
+func (q *Quotas) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(q.rules) == 0 {
+			c.Next()
+			return
+		}
+		consumer, ok := q.consumer(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		now := q.now()
+		var tightest *Rule
+		remaining := 0
+		for i, r := range q.rules {
+			if !strings.HasPrefix(c.Request.URL.Path, r.PathPrefix) {
+				continue
+			}
+			used, err := q.store.Increment(c.Request.Context(), consumer.ID, r, r.Start(now))
+			if err != nil {
+				log.Printf("Failed to count %s against the %s quota for %s: %v", consumer.ID, r.Period, r.PathPrefix, err)
+				continue
+			}
+			q.announce(c.Request.Context(), consumer, r, now, used)
+			left := r.Limit - used
+			if tightest == nil || left < remaining {
+				tightest, remaining = &q.rules[i], left
+			}
+		}
+		if tightest == nil {
+			c.Next()
+			return
+		}
+		reset := tightest.Reset(now)
+		c.Header("X-Quota-Limit", strconv.Itoa(tightest.Limit))
+		c.Header("X-Quota-Remaining", strconv.Itoa(max(remaining, 0)))
+		c.Header("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if remaining < 0 {
+			c.Header("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":     adjectives[tightest.Period] + " quota for " + tightest.PathPrefix + " exceeded",
+				"resets_at": reset,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// announce publishes an events.GatewayQuotaThreshold event when used is
+// the request that reached 80% or 100% of r's limit. Counts only go up
+// within a period, so each threshold is announced once.
+func (q *Quotas) announce(ctx context.Context, consumer Consumer, r Rule, now time.Time, used int) {
+	var percent int
+	switch used {
+	case r.Limit:
+		percent = 100
+	case (r.Limit*warnPercent + 99) / 100:
+		percent = warnPercent
+	default:
+		return
+	}
+	e, err := events.New(events.GatewayQuotaThreshold, "api-gateway", events.QuotaThreshold{
+		Consumer:    consumer.ID,
+		APIKeyID:    consumer.APIKeyID,
+		UserID:      consumer.UserID,
+		Tenant:      consumer.Tenant,
+		PathPrefix:  r.PathPrefix,
+		Period:      r.Period,
+		PeriodStart: r.Start(now),
+		Limit:       r.Limit,
+		Used:        used,
+		Percent:     percent,
+	})
+	if err == nil {
+		err = q.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish %d%% quota event for %s: %v", percent, consumer.ID, err)
+	}
+}
+
+// Usage is how much of one quota a consumer has used this period.
+type Usage struct {
+	Rule
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Usage returns how much of each quota the consumer has used.
+func (q *Quotas) Usage(ctx context.Context, consumer Consumer) ([]Usage, error) {
+	now := q.now()
+	out := make([]Usage, 0, len(q.rules))
+	for _, r := range q.rules {
+		used, err := q.store.Used(ctx, consumer.ID, r, r.Start(now))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Usage{Rule: r, Used: used, Remaining: max(r.Limit-used, 0), ResetsAt: r.Reset(now)})
+	}
+	return out, nil
+}
@@ -0,0 +1,133 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	counts map[string]int
+}
+
+func (m *memStore) key(consumer string, r Rule, start time.Time) string {
+	return consumer + "\n" + r.PathPrefix + "\n" + r.Period + "\n" + start.Format(time.DateOnly)
+}
+
+func (m *memStore) Increment(ctx context.Context, consumer string, r Rule, start time.Time) (int, error) {
+	k := m.key(consumer, r, start)
+	m.counts[k]++
+	return m.counts[k], nil
+}
+
+func (m *memStore) Used(ctx context.Context, consumer string, r Rule, start time.Time) (int, error) {
+	return m.counts[m.key(consumer, r, start)], nil
+}
+
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.events = append(p.events, e)
+	return nil
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("/api/orders=5/day, /api=100/month")
+	if err != nil || len(rules) != 2 || rules[1] != (Rule{PathPrefix: "/api", Limit: 100, Period: Month}) {
+		t.Fatalf("Expected two rules, got: %+v, %v", rules, err)
+	}
+	for _, bad := range []string{"/api=5/week", "/api=0/day", "api=5/day", "/api=5"} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens, err := auth.NewTokens("test-secret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create tokens: %v", err)
+	}
+	token, _, _ := tokens.IssueTenantUser(42, "acme", nil)
+
+	rules, _ := ParseRules("/api/orders=5/day,/api=100/month")
+	publisher := &recordingPublisher{}
+	q := New(rules, &memStore{counts: map[string]int{}}, publisher, tokens)
+	q.now = func() time.Time { return time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC) }
+
+	router := gin.New()
+	router.Use(q.Middleware())
+	router.GET("/api/orders", func(c *gin.Context) { c.Status(http.StatusOK) })
+	RegisterRoutes(router, q)
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Anonymous requests are not counted.
+	if w := get("/api/orders", ""); w.Code != http.StatusOK || w.Header().Get("X-Quota-Limit") != "" {
+		t.Errorf("Expected an anonymous request through uncounted, got: %d %v", w.Code, w.Header())
+	}
+
+	for i := 1; i <= 5; i++ {
+		w := get("/api/orders", token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d within the quota, got: %d", i, w.Code)
+		}
+		if i == 1 && (w.Header().Get("X-Quota-Limit") != "5" || w.Header().Get("X-Quota-Remaining") != "4") {
+			t.Errorf("Expected the daily quota in the headers, got: %v", w.Header())
+		}
+	}
+	w := get("/api/orders", token)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "43201" {
+		t.Errorf("Expected the sixth request turned away until midnight, got: %d %v", w.Code, w.Header())
+	}
+
+	// The daily quota crossed 80% on the fourth request and 100% on the fifth.
+	var percents []int
+	for _, e := range publisher.events {
+		var payload events.QuotaThreshold
+		if err := json.Unmarshal(e.Data, &payload); err != nil {
+			t.Fatalf("Failed to decode event: %v", err)
+		}
+		if payload.Consumer != "user:42" || payload.Tenant != "acme" || payload.Period != Day {
+			t.Errorf("Unexpected event: %+v", payload)
+		}
+		percents = append(percents, payload.Percent)
+	}
+	if len(percents) != 2 || percents[0] != 80 || percents[1] != 100 {
+		t.Errorf("Expected 80%% then 100%% events, got: %v", percents)
+	}
+
+	w = get("/usage", token)
+	var body struct {
+		Consumer string  `json:"consumer"`
+		Quotas   []Usage `json:"quotas"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected usage, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(body.Quotas) != 2 || body.Quotas[0].Used != 6 || body.Quotas[0].Remaining != 0 || body.Quotas[1].Remaining != 94 ||
+		!body.Quotas[1].ResetsAt.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected usage: %+v", body)
+	}
+	if w := get("/usage", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous usage to be refused, got: %d", w.Code)
+	}
+}
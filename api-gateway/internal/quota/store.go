@@ -0,0 +1,53 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+)
+
+type Store interface {
+	// Increment counts one request by consumer against r for the period
+	// starting at start and returns the period's total.
+	Increment(ctx context.Context, consumer string, r Rule, start time.Time) (int, error)
+	// Used returns the consumer's total against r for the period starting
+	// at start.
+	Used(ctx context.Context, consumer string, r Rule, start time.Time) (int, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Increment(ctx context.Context, consumer string, r Rule, start time.Time) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO gateway.quota_usage (consumer, path_prefix, period, period_start, requests) VALUES ($1, $2, $3, $4, 1)
+		ON CONFLICT (consumer, path_prefix, period, period_start) DO UPDATE SET requests = gateway.quota_usage.requests + 1
+		RETURNING requests`
+	var n int
+	err := s.db.QueryRowContext(ctx, query, consumer, r.PathPrefix, r.Period, start).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) Used(ctx context.Context, consumer string, r Rule, start time.Time) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT requests FROM gateway.quota_usage
+		WHERE consumer = $1 AND path_prefix = $2 AND period = $3 AND period_start = $4`
+	var n int
+	err := s.db.QueryRowContext(ctx, query, consumer, r.PathPrefix, r.Period, start).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return n, err
+}
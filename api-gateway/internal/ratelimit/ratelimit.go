@@ -0,0 +1,212 @@
+// Package ratelimit limits how often each client address may call the
+// gateway's public routes, those that need no token, apart from the limits
+// on authenticated traffic. A client that keeps going over its limit is
+// turned away for longer each time, so scraping does not pay.
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rule allows each client Limit requests to paths starting with PathPrefix
+// per Window.
+type Rule struct {
+	PathPrefix string        `json:"path_prefix"`
+	Limit      int           `json:"limit"`
+	Window     time.Duration `json:"-"`
+	WindowText string        `json:"window"`
+}
+
+// ParseRules parses "prefix=limit/window" pairs separated by commas, e.g.
+// "/api/profiles=60/1m,/api/track=30/1m".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, spec, ok := strings.Cut(part, "=")
+		count, window, hasWindow := strings.Cut(spec, "/")
+		limit, err := strconv.Atoi(strings.TrimSpace(count))
+		d, derr := time.ParseDuration(strings.TrimSpace(window))
+		prefix = strings.TrimSpace(prefix)
+		if !ok || !hasWindow || err != nil || derr != nil || limit < 1 || d <= 0 || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid rate limit %q, want prefix=limit/window", part)
+		}
+		rules = append(rules, Rule{PathPrefix: prefix, Limit: limit, Window: d, WindowText: d.String()})
+	}
+	return rules, nil
+}
+
+// client is one address's use of one rule.
+type client struct {
+	windowStart  time.Time
+	count        int
+	strikes      int
+	blockedUntil time.Time
+}
+
+type ruleStats struct {
+	allowed int64
+	limited int64
+}
+
+// Limiter counts requests per rule and client address in fixed windows.
+type Limiter struct {
+	rules      []Rule
+	maxPenalty time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	stats     map[string]*ruleStats
+	lastSweep time.Time
+}
+
+// New sorts rules longest prefix first. A client over its limit is turned
+// away for a window, then twice as long each time it goes over again
+// straight after, up to maxPenalty; a window within the limit forgives it.
+func New(rules []Rule, maxPenalty time.Duration) *Limiter {
+	sorted := append([]Rule(nil), rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].PathPrefix) > len(sorted[j].PathPrefix)
+	})
+	stats := make(map[string]*ruleStats, len(sorted))
+	for _, r := range sorted {
+		stats[r.PathPrefix] = &ruleStats{}
+	}
+	return &Limiter{rules: sorted, maxPenalty: maxPenalty, now: time.Now, clients: map[string]*client{}, stats: stats}
+}
+
+func (l *Limiter) match(path string) (Rule, bool) {
+	for _, r := range l.rules {
+		if strings.HasPrefix(path, r.PathPrefix) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Middleware answers a client over its limit with 429 and Retry-After.
+// It runs after the client address is resolved and before the response
+// cache, so cached answers count too.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r, ok := l.match(c.Request.URL.Path)
+		if !ok {
+			c.Next()
+			return
+		}
+		remaining, wait := l.take(r, c.ClientIP())
+		c.Header("X-RateLimit-Limit", strconv.Itoa(r.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests, retry later"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// take counts a request by addr against r and returns the requests left in
+// the window, and how long the client must wait when it is turned away.
+func (l *Limiter) take(r Rule, addr string) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	key := r.PathPrefix + "\n" + addr
+	cl, ok := l.clients[key]
+	if !ok {
+		cl = &client{windowStart: now}
+		l.clients[key] = cl
+	}
+	stats := l.stats[r.PathPrefix]
+	if now.Before(cl.blockedUntil) {
+		stats.limited++
+		return 0, cl.blockedUntil.Sub(now)
+	}
+	if now.Sub(cl.windowStart) >= r.Window {
+		if cl.count <= r.Limit {
+			cl.strikes = 0
+		}
+		cl.windowStart, cl.count = now, 0
+	}
+	cl.count++
+	if cl.count <= r.Limit {
+		stats.allowed++
+		return r.Limit - cl.count, 0
+	}
+
+	penalty := r.Window << cl.strikes
+	if penalty > l.maxPenalty || penalty <= 0 {
+		penalty = l.maxPenalty
+	}
+	cl.strikes++
+	cl.blockedUntil = now.Add(penalty)
+	// A fresh window starts when the block ends. The strikes stay until a
+	// whole window passes within the limit.
+	cl.windowStart, cl.count = cl.blockedUntil, 0
+	stats.limited++
+	return 0, penalty
+}
+
+// sweep forgets clients that have been quiet for longer than any block, at
+// most once a minute. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, cl := range l.clients {
+		rule, _ := l.match(strings.SplitN(key, "\n", 2)[0])
+		if now.After(cl.blockedUntil) && now.Sub(cl.windowStart) > rule.Window+l.maxPenalty {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// RuleStats is one rule in GET /metrics/rate-limits. Blocked counts the
+// clients turned away right now.
+type RuleStats struct {
+	Rule
+	Allowed int64 `json:"allowed"`
+	Limited int64 `json:"limited"`
+	Blocked int   `json:"blocked"`
+}
+
+// Snapshot returns the counters of each rule since startup.
+func (l *Limiter) Snapshot() []RuleStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	blocked := map[string]int{}
+	for key, cl := range l.clients {
+		if now.Before(cl.blockedUntil) {
+			blocked[strings.SplitN(key, "\n", 2)[0]]++
+		}
+	}
+	out := make([]RuleStats, 0, len(l.rules))
+	for _, r := range l.rules {
+		s := l.stats[r.PathPrefix]
+		out = append(out, RuleStats{Rule: r, Allowed: s.allowed, Limited: s.limited, Blocked: blocked[r.PathPrefix]})
+	}
+	return out
+}
+
+// Handler serves GET /metrics/rate-limits.
+func (l *Limiter) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"rules": l.Snapshot(), "max_penalty": l.maxPenalty.String()})
+	}
+}
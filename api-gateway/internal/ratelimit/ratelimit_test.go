@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("/api/profiles=60/1m, /api/track=5/10s")
+	if err != nil || len(rules) != 2 || rules[0].Limit != 60 || rules[1].Window != 10*time.Second {
+		t.Errorf("Expected two rules, got: %+v, %v", rules, err)
+	}
+	for _, bad := range []string{"/api/profiles=60", "api/profiles=60/1m", "/api/profiles=0/1m", "/api/profiles=60/soon"} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rules, _ := ParseRules("/api/profiles=2/1m")
+	l := New(rules, 3*time.Minute)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	router := gin.New()
+	router.Use(l.Middleware())
+	router.GET("/api/profiles/:username", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/api/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func(path, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		if w := get("/api/profiles/ada", "203.0.113.7"); w.Code != want {
+			t.Fatalf("Request %d: expected %d, got: %d", i+1, want, w.Code)
+		}
+	}
+	if w := get("/api/profiles/ada", "203.0.113.7"); w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected a first block of one window, got: %q", w.Header().Get("Retry-After"))
+	}
+	if w := get("/api/profiles/ada", "198.51.100.1"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("Expected other clients unaffected, got: %d %v", w.Code, w.Header())
+	}
+	if w := get("/api/users", "203.0.113.7"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("Expected routes without a rule left alone, got: %d %v", w.Code, w.Header())
+	}
+
+	// Going over again straight after the block doubles it, up to the cap.
+	now = now.Add(time.Minute)
+	get("/api/profiles/ada", "203.0.113.7")
+	get("/api/profiles/ada", "203.0.113.7")
+	if w := get("/api/profiles/ada", "203.0.113.7"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "120" {
+		t.Errorf("Expected a second block of two windows, got: %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	now = now.Add(2 * time.Minute)
+	get("/api/profiles/ada", "203.0.113.7")
+	get("/api/profiles/ada", "203.0.113.7")
+	if w := get("/api/profiles/ada", "203.0.113.7"); w.Header().Get("Retry-After") != "180" {
+		t.Errorf("Expected the block capped, got: %q", w.Header().Get("Retry-After"))
+	}
+
+	// A window within the limit forgives the client.
+	now = now.Add(3 * time.Minute)
+	get("/api/profiles/ada", "203.0.113.7")
+	now = now.Add(time.Minute)
+	get("/api/profiles/ada", "203.0.113.7")
+	get("/api/profiles/ada", "203.0.113.7")
+	if w := get("/api/profiles/ada", "203.0.113.7"); w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected the block back to one window, got: %q", w.Header().Get("Retry-After"))
+	}
+
+	stats := l.Snapshot()
+	if len(stats) != 1 || stats[0].Allowed != 10 || stats[0].Limited != 6 || stats[0].Blocked != 1 {
+		t.Errorf("Expected the counters, got: %+v", stats)
+	}
+}
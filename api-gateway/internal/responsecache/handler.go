@@ -0,0 +1,21 @@
+package responsecache
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterAdminRoutes exposes cache purging. Pass ?prefix=/api/users to purge
+// only that route, or one or more ?tag= (with an optional ?tenant=) to purge
+// the responses carrying those tags; without either the whole cache is
+// dropped.
+func RegisterAdminRoutes(router gin.IRouter, cache *Cache) {
+	router.DELETE("/cache", func(c *gin.Context) {
+		if tags := c.QueryArray("tag"); len(tags) > 0 {
+			c.JSON(http.StatusOK, gin.H{"purged": cache.PurgeTags(c.Query("tenant"), tags...)})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"purged": cache.Purge(c.Query("prefix"))})
+	})
+}
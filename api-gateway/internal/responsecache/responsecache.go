@@ -0,0 +1,403 @@
+// Package responsecache caches successful GET responses at the gateway, per
+// route and per caller, so hot reads do not reach the backends every time.
+package responsecache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/coalesce"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/ndjson"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+type Rule struct {
+	PathPrefix string
+	TTL        time.Duration
+}
+
+// ParseRules parses "prefix=ttl" pairs separated by commas, e.g.
+// "/api/users=30s,/api/dashboard=5s".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, ttl, ok := strings.Cut(part, "=")
+		d, err := time.ParseDuration(ttl)
+		if !ok || err != nil || prefix == "" || d <= 0 {
+			return nil, fmt.Errorf("invalid cache rule %q, want prefix=ttl", part)
+		}
+		rules = append(rules, Rule{PathPrefix: prefix, TTL: d})
+	}
+	return rules, nil
+}
+
+// Identity names the caller a request is cached for, beyond its
+// Authorization header (e.g. the API key that authenticated it).
+type Identity func(c *gin.Context) string
+
+// Cache keeps responses in memory until their TTL runs out. The TTL comes
+// from the longest matching rule, shortened by the response's own max-age.
+type Cache struct {
+	rules      []Rule
+	identity   Identity
+	maxEntries int
+	now        func() time.Time
+	// flights lets one request per key fetch what is missing while the
+	// others asking for it wait for its response.
+	flights *coalesce.Group[*entry]
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	path    string
+	tenant  string
+	tags    []string
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	stored  time.Time
+	expires time.Time
+}
+
+func New(rules []Rule, identity Identity, maxEntries int) *Cache {
+	sorted := append([]Rule(nil), rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].PathPrefix) > len(sorted[j].PathPrefix)
+	})
+	return &Cache{
+		rules:      sorted,
+		identity:   identity,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		flights:    coalesce.New[*entry]("gateway.response_cache"),
+		entries:    map[string]*entry{},
+	}
+}
+
+func (c *Cache) ttl(path string) time.Duration {
+	for _, r := range c.rules {
+		if strings.HasPrefix(path, r.PathPrefix) {
+			return r.TTL
+		}
+	}
+	return 0
+}
+
+// key varies on the full request URI, on who is asking and on the language
+// they ask for, so one caller never sees a response rendered for another.
+func (c *Cache) key(ctx *gin.Context) string {
+	caller := tenant.FromContext(ctx.Request.Context()) + "\n" + ctx.GetHeader("Authorization") + "\n" + ctx.GetHeader("Accept-Language")
+	if c.identity != nil {
+		caller += "\n" + c.identity(ctx)
+	}
+	sum := sha256.Sum256([]byte(caller))
+	return ctx.Request.URL.RequestURI() + "\n" + hex.EncodeToString(sum[:])
+}
+
+// Middleware serves cached GET responses and stores new ones. Callers can
+// skip the cache with Cache-Control: no-cache (refetch) or no-store (refetch
+// and keep nothing). Backend responses marked no-store or no-cache are never
+// stored. Every cached response carries an ETag, taken from the backend when
+// it sets one, and a matching If-None-Match gets 304 Not Modified. The
+// backend's Cache-Tags are kept with the entry for PurgeTags and are not
+// passed on to the caller. Concurrent misses for the same key go to the
+// backend once: the rest wait and are answered from what it stored, with
+// X-Cache: COALESCED. Requests for NDJSON streams and WebSocket
+// upgrades pass straight through: holding one back would buffer the whole
+// listing, or the connection could not be taken over.
+func (c *Cache) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ttl := c.ttl(ctx.Request.URL.Path)
+		if ctx.Request.Method != http.MethodGet || ttl <= 0 || ndjson.Accepted(ctx.Request) || ctx.GetHeader("Upgrade") != "" {
+			ctx.Next()
+			return
+		}
+
+		directives := cacheControl(ctx.GetHeader("Cache-Control"))
+		_, noStore := directives["no-store"]
+		_, noCache := directives["no-cache"]
+		key := c.key(ctx)
+		if !noStore && !noCache {
+			if e, ok := c.get(key); ok {
+				ctx.Header("X-Cache", "HIT")
+				ctx.Header("Age", strconv.Itoa(int(c.now().Sub(e.stored).Seconds())))
+				c.serve(ctx, e)
+				ctx.Abort()
+				return
+			}
+
+			fetched := false
+			e, _ := c.flights.Do(coalesce.Allow(ctx.Request.Context()), key, func() (*entry, error) {
+				fetched = true
+				return c.fetch(ctx, key, ttl, noStore), nil
+			})
+			if fetched {
+				return
+			}
+			if e != nil {
+				ctx.Header("X-Cache", "COALESCED")
+				c.serve(ctx, e)
+				ctx.Abort()
+				return
+			}
+			// The response waited on was not stored, such as a 404 or one
+			// marked no-store, so it cannot be shared either.
+		}
+		c.fetch(ctx, key, ttl, noStore)
+	}
+}
+
+// fetch sends the request on, answers it and stores the response when it
+// may be. It returns the entry it stored, or nil.
+func (c *Cache) fetch(ctx *gin.Context, key string, ttl time.Duration, noStore bool) *entry {
+	ctx.Header("X-Cache", "MISS")
+
+	original := ctx.Writer
+	w := &bufferedWriter{ResponseWriter: original}
+	ctx.Writer = w
+	ctx.Next()
+	ctx.Writer = original
+
+	// Something flushed the headers already, so just pass the body on.
+	if original.Written() || original.Status() != http.StatusOK {
+		original.Write(w.body.Bytes())
+		return nil
+	}
+
+	e := &entry{
+		path:   ctx.Request.URL.Path,
+		tenant: tenant.FromContext(ctx.Request.Context()),
+		tags:   cachetags.Parse(original.Header().Get(cachetags.Header)),
+		status: original.Status(),
+		body:   w.body.Bytes(),
+		etag:   original.Header().Get("ETag"),
+		stored: c.now(),
+	}
+	if e.etag == "" {
+		sum := sha256.Sum256(e.body)
+		e.etag = `"` + hex.EncodeToString(sum[:8]) + `"`
+		original.Header().Set("ETag", e.etag)
+	}
+	original.Header().Del(cachetags.Header)
+	e.header = original.Header().Clone()
+	e.header.Del("X-Cache")
+	// CORS headers answer this request's Origin, which the key does not
+	// vary on; the CORS middleware sets them afresh on every hit.
+	for name := range e.header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			e.header.Del(name)
+		}
+	}
+
+	stored := false
+	if maxAge, ok := storable(original.Header().Get("Cache-Control")); ok && !noStore {
+		if maxAge >= 0 && maxAge < ttl {
+			ttl = maxAge
+		}
+		if ttl > 0 {
+			e.expires = e.stored.Add(ttl)
+			c.put(key, e)
+			stored = true
+		}
+	}
+	c.serve(ctx, e)
+	if !stored {
+		return nil
+	}
+	return e
+}
+
+func (c *Cache) serve(ctx *gin.Context, e *entry) {
+	header := ctx.Writer.Header()
+	for name, values := range e.header {
+		if _, ok := header[name]; !ok {
+			header[name] = values
+		}
+	}
+	if matches(ctx.GetHeader("If-None-Match"), e.etag) {
+		ctx.Writer.WriteHeader(http.StatusNotModified)
+		ctx.Writer.WriteHeaderNow()
+		return
+	}
+	ctx.Writer.WriteHeader(e.status)
+	ctx.Writer.Write(e.body)
+}
+
+func (c *Cache) get(key string) (*entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e, true
+}
+
+// put stores e, first dropping expired entries if the cache is full. A cache
+// that is still full skips storing rather than evicting live entries.
+func (c *Cache) put(key string, e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		now := c.now()
+		for k, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+	c.entries[key] = e
+}
+
+// Purge drops every cached response whose path starts with prefix, or all of
+// them when prefix is empty, and returns how many were dropped.
+func (c *Cache) Purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range c.entries {
+		if strings.HasPrefix(e.path, prefix) {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// PurgeTags drops every cached response tagged with one of tags, and returns
+// how many were dropped. When tenantID is set only that tenant's responses
+// are dropped.
+func (c *Cache) PurgeTags(tenantID string, tags ...string) int {
+	purge := map[string]bool{}
+	for _, tag := range tags {
+		purge[tag] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range c.entries {
+		if tenantID != "" && e.tenant != tenantID {
+			continue
+		}
+		for _, tag := range e.tags {
+			if purge[tag] {
+				delete(c.entries, k)
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// Handle purges the responses tagged with what e changed.
+func (c *Cache) Handle(ctx context.Context, e events.Event) error {
+	tenantID, tags := cachetags.FromEvent(e)
+	if len(tags) == 0 {
+		return nil
+	}
+	if n := c.PurgeTags(tenantID, tags...); n > 0 {
+		log.Printf("Purged %d cached responses after %s %s", n, e.Type, e.ID)
+	}
+	return nil
+}
+
+// Run purges the cache from the event bus until ctx is cancelled. Each
+// replica keeps its own cache, so each needs every event and subscribes
+// with a private queue.
+func (c *Cache) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, "", cachetags.Events, c.Handle)
+}
+
+// Len returns how many responses are cached, including expired ones not yet
+// dropped.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// bufferedWriter holds the body back so the ETag can be set, or a 304 sent,
+// once the handler has finished.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func cacheControl(header string) map[string]string {
+	directives := map[string]string{}
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		if name != "" {
+			directives[name] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// storable reports whether a response with this Cache-Control may be stored,
+// and the max-age it allows (s-maxage first), or -1 when it gives none.
+func storable(header string) (time.Duration, bool) {
+	directives := cacheControl(header)
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0, false
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return -1, true
+}
+
+func matches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
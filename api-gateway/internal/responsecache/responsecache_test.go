@@ -0,0 +1,234 @@
+package responsecache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/coalesce"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("/api/users=30s, /api=5s")
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	if len(rules) != 2 || rules[0].TTL != 30*time.Second {
+		t.Errorf("Unexpected rules: %+v", rules)
+	}
+
+	if _, err := ParseRules("/api/users=soon"); err == nil {
+		t.Error("Expected error for rule without a duration")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rules, _ := ParseRules("/api/users=1m,/api/stock=1m")
+	cache := New(rules, nil, 10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	calls := map[string]int{}
+	router := gin.New()
+	router.Use(cache.Middleware())
+	router.GET("/api/users", func(c *gin.Context) {
+		calls["users"]++
+		c.String(http.StatusOK, "users "+strconv.Itoa(calls["users"])+" for "+c.GetHeader("Authorization"))
+	})
+	router.GET("/api/stock", func(c *gin.Context) {
+		calls["stock"]++
+		c.Header("Cache-Control", "max-age=10")
+		c.Header("ETag", `"v1"`)
+		c.String(http.StatusOK, "stock")
+	})
+	router.GET("/api/users/missing", func(c *gin.Context) {
+		calls["missing"]++
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+	})
+
+	get := func(path, token string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	first := get("/api/users", "alice")
+	second := get("/api/users", "alice")
+	if calls["users"] != 1 || second.Body.String() != first.Body.String() || second.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected the second request to be served from cache, got %d calls and: %q", calls["users"], second.Body)
+	}
+	if w := get("/api/users", "bob"); calls["users"] != 2 || w.Body.String() != "users 2 for Bearer bob" {
+		t.Errorf("Expected another caller not to share the cached response, got: %q", w.Body)
+	}
+	etag := first.Header().Get("ETag")
+	if w := get("/api/users", "alice", "If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 for a matching ETag, got: %d %q", w.Code, w.Body)
+	}
+	if get("/api/users", "alice", "Cache-Control", "no-cache"); calls["users"] != 3 {
+		t.Errorf("Expected no-cache to reach the backend, got %d calls", calls["users"])
+	}
+	if w := get("/api/users", "alice", "Accept", "application/x-ndjson"); calls["users"] != 4 || w.Header().Get("X-Cache") != "" {
+		t.Errorf("Expected an NDJSON stream to bypass the cache, got %d calls and: %v", calls["users"], w.Header())
+	}
+
+	get("/api/stock", "alice")
+	if w := get("/api/stock", "alice", "If-None-Match", `"v1"`); calls["stock"] != 1 || w.Code != http.StatusNotModified {
+		t.Errorf("Expected the backend's ETag to be honored, got %d calls and status %d", calls["stock"], w.Code)
+	}
+	now = now.Add(11 * time.Second)
+	if get("/api/stock", "alice"); calls["stock"] != 2 {
+		t.Errorf("Expected the backend's max-age to shorten the TTL, got %d calls", calls["stock"])
+	}
+
+	get("/api/users/missing", "alice")
+	if get("/api/users/missing", "alice"); calls["missing"] != 2 {
+		t.Errorf("Expected errors not to be cached, got %d calls", calls["missing"])
+	}
+
+	if n := cache.Purge("/api/users"); n != 2 {
+		t.Errorf("Expected 2 purged user responses, got: %d", n)
+	}
+	if get("/api/users", "alice"); calls["users"] != 5 {
+		t.Errorf("Expected a purged response to be fetched again, got %d calls", calls["users"])
+	}
+
+	// A response first fetched cross-origin must not carry that origin's
+	// CORS headers when served from cache to a request without one.
+	cors := gin.New()
+	cors.Use(func(c *gin.Context) {
+		if origin := c.GetHeader("Origin"); origin != "" {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+	})
+	cors.Use(New(rules, nil, 10).Middleware())
+	cors.GET("/api/users", func(c *gin.Context) { c.String(http.StatusOK, "users") })
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	cors.ServeHTTP(httptest.NewRecorder(), req)
+	w := httptest.NewRecorder()
+	cors.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	if w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected a cache hit without CORS headers, got: %v", w.Header())
+	}
+}
+
+func TestTags(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rules, _ := ParseRules("/api=1h")
+	cache := New(rules, nil, 10)
+
+	calls := 0
+	router := gin.New()
+	router.Use(tenant.Middleware())
+	router.Use(cache.Middleware())
+	router.GET("/api/users/:id", func(c *gin.Context) {
+		calls++
+		id, _ := strconv.Atoi(c.Param("id"))
+		cachetags.Set(c, cachetags.User(id))
+		c.String(http.StatusOK, "user")
+	})
+	get := func(path, tenantID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(tenant.Header, tenantID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/api/users/42", "acme"); w.Header().Get(cachetags.Header) != "" {
+		t.Errorf("Expected the tags to be kept from the caller, got: %v", w.Header())
+	}
+	get("/api/users/42", "other")
+	get("/api/users/7", "acme")
+
+	profileUpdated, _ := events.New(events.UserProfileUpdated, "user-service", events.ProfileUpdate{UserID: 42, Tenant: "acme"})
+	if err := cache.Handle(context.Background(), profileUpdated); err != nil {
+		t.Fatalf("Handle failed: %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected only acme's copy of user 42 to be purged, got %d entries", cache.Len())
+	}
+	get("/api/users/42", "acme")
+	get("/api/users/7", "acme")
+	if calls != 4 {
+		t.Errorf("Expected only the purged response to be fetched again, got %d calls", calls)
+	}
+
+	roleChanged, _ := events.New(events.UserRoleChanged, "user-service", events.RoleChanged{UserID: 42})
+	cache.Handle(context.Background(), roleChanged)
+	if cache.Len() != 1 {
+		t.Errorf("Expected an event without a tenant to purge every tenant's copy, got %d entries", cache.Len())
+	}
+	if n := cache.PurgeTags("", cachetags.User(7)); n != 1 {
+		t.Errorf("Expected user 7's response to be purged by tag, got: %d", n)
+	}
+}
+
+func TestMiddlewareCoalescesMisses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rules, _ := ParseRules("/api/items=1m")
+	cache := New(rules, nil, 10)
+
+	var calls atomic.Int64
+	release := make(chan struct{})
+	router := gin.New()
+	router.Use(cache.Middleware())
+	router.GET("/api/items", func(c *gin.Context) {
+		calls.Add(1)
+		<-release
+		c.String(http.StatusOK, "items")
+	})
+
+	coalesced := func() int64 {
+		for _, s := range coalesce.Snapshot() {
+			if s.Name == "gateway.response_cache" {
+				return s.Coalesced
+			}
+		}
+		return 0
+	}
+	before := coalesced()
+	const callers = 5
+	responses := make(chan *httptest.ResponseRecorder, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/items", nil))
+			responses <- w
+		}()
+	}
+	// Let the first request reach the backend and the rest queue behind it.
+	for calls.Load() == 0 || coalesced()-before < callers-1 {
+		runtime.Gosched()
+	}
+	close(release)
+
+	seen := map[string]int{}
+	for i := 0; i < callers; i++ {
+		w := <-responses
+		if w.Body.String() != "items" {
+			t.Errorf("Expected every caller to get the response, got: %q", w.Body)
+		}
+		seen[w.Header().Get("X-Cache")]++
+	}
+	if calls.Load() != 1 || seen["MISS"] != 1 || seen["COALESCED"] != callers-1 {
+		t.Errorf("Expected one backend call shared by the rest, got %d calls and: %v", calls.Load(), seen)
+	}
+}
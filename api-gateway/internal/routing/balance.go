@@ -0,0 +1,150 @@
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Load balancing strategies a route may choose between its backend's
+// instances.
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+	BalanceConsistentHash   = "consistent_hash"
+)
+
+// Keys consistent_hash routes hash on: the caller's verified user or
+// service, or the value of a cookie named after the colon.
+const (
+	HashKeyUser   = "user"
+	hashKeyCookie = "cookie:"
+)
+
+// ringReplicas is how many points each instance has on the hash ring, so
+// keys spread evenly and an instance leaving moves only its own share.
+const ringReplicas = 100
+
+// pool is a backend's instances. Every route to the backend shares it, so
+// least_connections sees all the requests the gateway has open on each
+// instance, whichever route they came in on.
+type pool struct {
+	targets  []*url.URL
+	inFlight []atomic.Int64
+	next     atomic.Uint64
+	ring     []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint32
+	instance int
+}
+
+func newPool(urls []string) (*pool, error) {
+	p := &pool{inFlight: make([]atomic.Int64, len(urls))}
+	for i, raw := range urls {
+		target, err := parseTarget(raw)
+		if err != nil {
+			return nil, err
+		}
+		p.targets = append(p.targets, target)
+		for j := 0; j < ringReplicas; j++ {
+			p.ring = append(p.ring, ringPoint{hash: hashOf(target.String() + "#" + strconv.Itoa(j)), instance: i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p, nil
+}
+
+// hashOf uses SHA-256 rather than a faster hash, since keys such as user
+// IDs differ in a few bytes and need spreading over the whole ring.
+func hashOf(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func (p *pool) roundRobin() int {
+	return int((p.next.Add(1) - 1) % uint64(len(p.targets)))
+}
+
+// leastConnections picks the instance with the fewest requests open,
+// starting the search at the next instance in turn so ties spread out.
+func (p *pool) leastConnections() int {
+	start := p.roundRobin()
+	best := start
+	for i := 1; i < len(p.targets); i++ {
+		n := (start + i) % len(p.targets)
+		if p.inFlight[n].Load() < p.inFlight[best].Load() {
+			best = n
+		}
+	}
+	return best
+}
+
+// hash picks the instance owning key on the ring: the first point at or
+// after the key's hash, wrapping round.
+func (p *pool) hash(key string) int {
+	h := hashOf(key)
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.ring[i].instance
+}
+
+// pick chooses the instance of r's backend to send req to. A
+// consistent_hash request without its key, such as one with no valid token
+// or without the cookie yet, falls back to round robin.
+func (t *Table) pick(r *route, req *http.Request) int {
+	if len(r.pool.targets) == 1 {
+		return 0
+	}
+	switch r.Balance {
+	case BalanceLeastConnections:
+		return r.pool.leastConnections()
+	case BalanceConsistentHash:
+		if key := t.hashKey(r.HashKey, req); key != "" {
+			return r.pool.hash(key)
+		}
+	}
+	return r.pool.roundRobin()
+}
+
+// hashKey reads the value req is hashed on. The user comes from a token
+// the gateway verifies itself, so a caller cannot choose its instance by
+// forging one.
+func (t *Table) hashKey(key string, req *http.Request) string {
+	if name, ok := strings.CutPrefix(key, hashKeyCookie); ok {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+	if t.websockets == nil || t.websockets.Tokens == nil {
+		return ""
+	}
+	_, p, ok := t.websockets.authenticate(req)
+	if !ok {
+		return ""
+	}
+	return callerOf(p)
+}
+
+type targetKey struct{}
+
+// withTarget records the instance chosen for req, for the proxy to send it
+// to.
+func withTarget(req *http.Request, target *url.URL) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), targetKey{}, target))
+}
+
+func targetOf(req *http.Request) *url.URL {
+	return req.Context().Value(targetKey{}).(*url.URL)
+}
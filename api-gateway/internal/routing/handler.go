@@ -0,0 +1,42 @@
+package routing
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	table *Table
+}
+
+func NewHandler(table *Table) *Handler {
+	return &Handler{table: table}
+}
+
+// RegisterAdminRoutes mounts routing table inspection and reloading on an
+// admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/routes", h.get)
+	router.POST("/routes/reload", h.reload)
+}
+
+func (h *Handler) get(c *gin.Context) {
+	c.JSON(http.StatusOK, h.table.State())
+}
+
+// reload reads the routing file now, as SIGHUP does. A file that fails to
+// load leaves the previous table in force.
+func (h *Handler) reload(c *gin.Context) {
+	if h.table.path == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "gateway routing is not enabled"})
+		return
+	}
+	if err := h.table.Reload(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Gateway routes reloaded by %q from %s", c.Query("actor"), c.ClientIP())
+	c.JSON(http.StatusOK, h.table.State())
+}
@@ -0,0 +1,159 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/storeforward"
+	"github.com/alux444/go-microserv-test/pkg/idempotency"
+	"github.com/gin-gonic/gin"
+)
+
+// errUnavailable turns a backend's 502, 503 or 504 on a store_and_forward
+// route into a proxy error, so the request is queued like one the backend
+// never got.
+var errUnavailable = errors.New("backend unavailable")
+
+func (t *Table) newProxy(r *route) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path, pr.Out.URL.RawPath = r.rewrite(pr.In.URL.Path), ""
+			pr.SetURL(targetOf(pr.In))
+			// The gateway compresses what it answers itself. Without the
+			// client's Accept-Encoding, the transport asks backends for
+			// gzip and decodes it, so the hop stays compressed while the
+			// middleware sees plain bodies.
+			pr.Out.Header.Del("Accept-Encoding")
+		},
+		Transport: t.transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if r.StoreAndForward && t.hold(w, r, req, err) {
+				return
+			}
+			status := http.StatusBadGateway
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			log.Printf("Proxying %s %s to %s failed: %v", req.Method, req.URL.Path, r.Backend, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"backend ` + r.Backend + ` is unavailable"}`))
+		},
+	}
+	if r.StoreAndForward {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if storeforward.Unavailable(resp.StatusCode) {
+				return fmt.Errorf("%w: %s", errUnavailable, resp.Status)
+			}
+			return nil
+		}
+	}
+	return proxy
+}
+
+type bodyKey struct{}
+
+// hold queues a request to a store_and_forward route that its backend did
+// not take, and answers it with 202. It reports false, leaving the error
+// to be answered, when the caller has gone away or the queue cannot take
+// the request.
+func (t *Table) hold(w http.ResponseWriter, r *route, req *http.Request, err error) bool {
+	body, ok := req.Context().Value(bodyKey{}).([]byte)
+	if t.queue == nil || !ok || errors.Is(err, context.Canceled) {
+		return false
+	}
+	held := storeforward.Request{
+		ID:      req.Header.Get(idempotency.Header),
+		Backend: r.Backend,
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Header:  req.Header.Clone(),
+		Body:    body,
+	}
+	if qerr := t.queue.Enqueue(held); qerr != nil {
+		log.Printf("Failed to queue %s %s for %s: %v", req.Method, req.URL.Path, r.Backend, qerr)
+		return false
+	}
+	log.Printf("Backend %s did not take %s %s, queued as %s: %v", r.Backend, req.Method, req.URL.Path, held.ID, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"queued","id":"` + held.ID + `"}`))
+	return true
+}
+
+// Handler proxies requests the gateway has no route of its own for. Mount
+// it as the router's NoRoute handler, so the gateway's own routes and
+// middleware come first. The route is chosen once, so a reload never moves
+// a request that is already being proxied.
+func (t *Table) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := t.match(c.Request.Method, c.Request.URL.Path)
+		if r == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no route for " + c.Request.Method + " " + c.Request.URL.Path})
+			return
+		}
+		c.Set(backendKey, r.Backend)
+		// The instance is chosen once, and counted as busy until the
+		// request, or the WebSocket it upgrades to, is done.
+		instance := t.pick(r, c.Request)
+		r.pool.inFlight[instance].Add(1)
+		defer r.pool.inFlight[instance].Add(-1)
+		c.Request = withTarget(c.Request, r.pool.targets[instance])
+		if isUpgrade(c.Request) {
+			if !r.WebSocket || c.Request.Method != http.MethodGet {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "route " + r.Prefix + " does not accept WebSocket upgrades"})
+				return
+			}
+			// The route's timeout is for requests; a WebSocket stays open
+			// until a side closes it or it goes idle.
+			t.upgrade(c, r)
+			return
+		}
+		req := c.Request
+		if r.StoreAndForward && t.queue != nil {
+			// The body is kept to be queued, and the key lets the backend
+			// tell a replay from a new request if it did take the first.
+			body, err := io.ReadAll(http.MaxBytesReader(c.Writer, req.Body, storeforward.MaxBody))
+			if err != nil {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large to queue"})
+				return
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			if req.Header.Get(idempotency.Header) == "" {
+				req.Header.Set(idempotency.Header, storeforward.NewID())
+			}
+			req = req.WithContext(context.WithValue(req.Context(), bodyKey{}, body))
+		}
+		if r.timeout > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), r.timeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		r.proxy.ServeHTTP(unwrapper{c.Writer}, req)
+	}
+}
+
+const backendKey = "routing_backend"
+
+// BackendOf returns the backend Handler proxied the request to, or "" if
+// it did not proxy it.
+func BackendOf(c *gin.Context) string {
+	return c.GetString(backendKey)
+}
+
+// unwrapper hides gin's CloseNotify, which panics on writers without it,
+// from the proxy. The request context already reports the client going
+// away, and Unwrap still lets the proxy flush streamed responses.
+type unwrapper struct {
+	http.ResponseWriter
+}
+
+func (w unwrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,534 @@
+// Package routing proxies requests to backends by path prefix, from a
+// declarative YAML or JSON file of backends and the routes sent to them.
+//
+// The table is read at startup and again on SIGHUP or through the admin
+// API. A reload swaps the table in one step: requests already being proxied
+// finish on the route they started on, and the listener is never closed,
+// so no connection is dropped. A file that fails to load leaves the
+// previous table in force.
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/storeforward"
+	"gopkg.in/yaml.v3"
+)
+
+var validBackend = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+var validMethod = regexp.MustCompile(`^[A-Z]+$`)
+
+// reserved are the gateway's own paths, which always win over the table.
+var reserved = []string{"/admin", "/health", "/metrics", "/docs", "/portal", "/usage"}
+
+// Backend is a service routes send requests to, at one URL or spread over
+// several instances.
+type Backend struct {
+	URL string `yaml:"url" json:"url,omitempty"`
+	// Instances lists the URLs of a backend run as several instances, in
+	// place of URL. Each route chooses how its requests are spread.
+	Instances []string `yaml:"instances" json:"instances,omitempty"`
+}
+
+// urls returns the backend's instances, or its one URL.
+func (b Backend) urls() []string {
+	if len(b.Instances) > 0 {
+		return b.Instances
+	}
+	return []string{b.URL}
+}
+
+// Route sends requests whose path starts with Prefix, at a path segment
+// boundary, to Backend. Requests to the longest matching prefix win.
+type Route struct {
+	Prefix string `yaml:"prefix" json:"prefix"`
+	// Methods limits the route to these methods; empty means all. A route
+	// with methods wins over one without for the same prefix.
+	Methods []string `yaml:"methods" json:"methods,omitempty"`
+	Backend string   `yaml:"backend" json:"backend"`
+	// Rewrite replaces Prefix in the path sent to the backend; without it
+	// the path is sent unchanged.
+	Rewrite string `yaml:"rewrite" json:"rewrite,omitempty"`
+	// Timeout bounds the backend call, such as "5s"; empty means the
+	// forwarding client's own timeouts.
+	Timeout string `yaml:"timeout" json:"timeout,omitempty"`
+	// StoreAndForward queues requests the backend cannot take and answers
+	// them with 202, for fire-and-forget routes such as notification
+	// submissions. The route must be limited to methods that change
+	// something.
+	StoreAndForward bool `yaml:"store_and_forward" json:"store_and_forward,omitempty"`
+	// WebSocket lets GET requests to the route upgrade to a WebSocket,
+	// which is proxied for as long as it stays open. Other requests are
+	// proxied as usual.
+	WebSocket bool `yaml:"websocket" json:"websocket,omitempty"`
+	// Balance spreads requests over the backend's instances: round_robin,
+	// the default, least_connections, or consistent_hash, which keeps
+	// each HashKey on the same instance.
+	Balance string `yaml:"balance" json:"balance,omitempty"`
+	// HashKey is what consistent_hash routes hash: "user", the default,
+	// or "cookie:<name>".
+	HashKey string `yaml:"hash_key" json:"hash_key,omitempty"`
+}
+
+// Config is the routing file.
+type Config struct {
+	Backends map[string]Backend `yaml:"backends" json:"backends"`
+	Routes   []Route            `yaml:"routes" json:"routes"`
+}
+
+// route is a validated Route with its backend resolved.
+type route struct {
+	Route
+	pool    *pool
+	timeout time.Duration
+	proxy   http.Handler
+	// upgrades proxies WebSocket upgrades, on websocket routes only.
+	upgrades http.Handler
+}
+
+func (r *route) matches(method, path string) bool {
+	if !underPrefix(path, r.Prefix) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// underPrefix reports whether path is prefix or below it, so /api/orders
+// does not match /api/ordersx.
+func underPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (r *route) rewrite(path string) string {
+	if r.Rewrite == "" {
+		return path
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, r.Prefix), "/")
+	if rest == "" {
+		return r.Rewrite
+	}
+	return strings.TrimSuffix(r.Rewrite, "/") + "/" + rest
+}
+
+// Parse reads and validates a routing file's contents. Routes may name the
+// builtin backends, the services the gateway calls itself, which the file
+// cannot redefine.
+func Parse(data []byte, builtin map[string]string) (*Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for name, b := range cfg.Backends {
+		if !validBackend.MatchString(name) {
+			return nil, fmt.Errorf("backend %q: name must be lowercase letters, digits and dashes", name)
+		}
+		if _, ok := builtin[name]; ok {
+			return nil, fmt.Errorf("backend %s is built in and set by its environment variable", name)
+		}
+		if b.URL != "" && len(b.Instances) > 0 {
+			return nil, fmt.Errorf("backend %s: set url or instances, not both", name)
+		}
+		seenURL := map[string]bool{}
+		for _, u := range b.urls() {
+			target, err := parseTarget(u)
+			if err != nil {
+				return nil, fmt.Errorf("backend %s: %w", name, err)
+			}
+			if seenURL[target.String()] {
+				return nil, fmt.Errorf("backend %s: instance %s listed twice", name, target)
+			}
+			seenURL[target.String()] = true
+		}
+	}
+	seen := map[string]bool{}
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("route %d: prefix %q must start with /", i, r.Prefix)
+		}
+		for _, own := range reserved {
+			if underPrefix(r.Prefix, own) {
+				return nil, fmt.Errorf("route %s: %s is served by the gateway itself", r.Prefix, own)
+			}
+		}
+		_, known := cfg.Backends[r.Backend]
+		if _, ok := builtin[r.Backend]; !known && !ok {
+			return nil, fmt.Errorf("route %s: unknown backend %q", r.Prefix, r.Backend)
+		}
+		if r.Rewrite != "" && !strings.HasPrefix(r.Rewrite, "/") {
+			return nil, fmt.Errorf("route %s: rewrite %q must start with /", r.Prefix, r.Rewrite)
+		}
+		if r.Timeout != "" {
+			if d, err := time.ParseDuration(r.Timeout); err != nil || d <= 0 {
+				return nil, fmt.Errorf("route %s: timeout %q must be a positive duration", r.Prefix, r.Timeout)
+			}
+		}
+		if r.StoreAndForward && !forwardable(r.Methods) {
+			return nil, fmt.Errorf("route %s: store_and_forward needs methods, all of them POST, PUT, PATCH or DELETE", r.Prefix)
+		}
+		if r.WebSocket && !servesMethod(*r, http.MethodGet) {
+			return nil, fmt.Errorf("route %s: websocket needs the route to take GET", r.Prefix)
+		}
+		switch r.Balance {
+		case "", BalanceRoundRobin, BalanceLeastConnections:
+			if r.HashKey != "" {
+				return nil, fmt.Errorf("route %s: hash_key needs balance %s", r.Prefix, BalanceConsistentHash)
+			}
+		case BalanceConsistentHash:
+			if r.HashKey == "" {
+				r.HashKey = HashKeyUser
+			}
+			if cookie, ok := strings.CutPrefix(r.HashKey, hashKeyCookie); r.HashKey != HashKeyUser && (!ok || cookie == "") {
+				return nil, fmt.Errorf("route %s: hash_key %q must be user or cookie:<name>", r.Prefix, r.HashKey)
+			}
+		default:
+			return nil, fmt.Errorf("route %s: balance %q must be %s, %s or %s", r.Prefix, r.Balance,
+				BalanceRoundRobin, BalanceLeastConnections, BalanceConsistentHash)
+		}
+		methods := r.Methods
+		if len(methods) == 0 {
+			methods = []string{"*"}
+		}
+		for j, m := range methods {
+			m = strings.ToUpper(m)
+			if m != "*" && !validMethod.MatchString(m) {
+				return nil, fmt.Errorf("route %s: invalid method %q", r.Prefix, m)
+			}
+			if m != "*" {
+				r.Methods[j] = m
+			}
+			key := m + " " + r.Prefix
+			if seen[key] {
+				return nil, fmt.Errorf("route %s: defined twice for %s", r.Prefix, m)
+			}
+			seen[key] = true
+		}
+	}
+	return &cfg, nil
+}
+
+// forwardable reports whether every method is one whose caller can do
+// without the backend's answer.
+func forwardable(methods []string) bool {
+	if len(methods) == 0 {
+		return false
+	}
+	for _, m := range methods {
+		switch strings.ToUpper(m) {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Conflicts reports the parts of cfg requests can never reach: the paths
+// the gateway serves itself, given as "METHOD /path" with gin's :param and
+// *wildcard segments, and a prefix whose twin with a trailing slash takes
+// every path below it. A catch-all / route is meant to come last, so the
+// gateway's own paths winning over it is no conflict.
+func Conflicts(cfg *Config, own []string) []string {
+	var out []string
+	for _, r := range cfg.Routes {
+		if r.Prefix == "/" {
+			continue
+		}
+		for _, o := range own {
+			method, path, _ := strings.Cut(o, " ")
+			if underPrefix(samplePath(path), r.Prefix) && servesMethod(r, method) {
+				out = append(out, fmt.Sprintf("route %s: %s is served by the gateway itself and never reaches %s", r.Prefix, o, r.Backend))
+			}
+		}
+	}
+	for _, r := range cfg.Routes {
+		for _, other := range cfg.Routes {
+			if r.Prefix != "/" && other.Prefix == r.Prefix+"/" && overlap(r, other) {
+				out = append(out, fmt.Sprintf("route %s: only %s itself reaches %s, as route %s takes every path below it", r.Prefix, r.Prefix, r.Backend, other.Prefix))
+			}
+		}
+	}
+	return out
+}
+
+// samplePath fills a gin route's parameters in, giving a path it matches.
+func samplePath(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			segments[i] = "x"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func servesMethod(r Route, method string) bool {
+	return len(r.Methods) == 0 || slices.Contains(r.Methods, method)
+}
+
+func overlap(a, b Route) bool {
+	if len(a.Methods) == 0 || len(b.Methods) == 0 {
+		return true
+	}
+	for _, m := range a.Methods {
+		if slices.Contains(b.Methods, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTarget(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimRight(raw, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http or https URL", raw)
+	}
+	return u, nil
+}
+
+// Table holds the routes in force.
+type Table struct {
+	path       string
+	builtin    map[string]string
+	transport  http.RoundTripper
+	queue      *storeforward.Queue
+	websockets *WebSockets
+
+	mu       sync.RWMutex
+	backends map[string]*pool
+	routes   []*route
+	loadedAt time.Time
+	lastErr  string
+}
+
+// New loads the table at path. An empty path routes nothing. builtin maps
+// the services the gateway already calls to their URLs, and transport
+// carries every proxied request, so backends see the same token
+// forwarding, policies and failover as the gateway's own calls.
+func New(path string, builtin map[string]string, transport http.RoundTripper) (*Table, error) {
+	t := &Table{path: path, builtin: builtin, transport: transport, backends: map[string]*pool{}}
+	if path == "" {
+		return t, nil
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SetQueue holds requests to store_and_forward routes in q while their
+// backend is down. Without one, those routes proxy like any other. Call it
+// before serving.
+func (t *Table) SetQueue(q *storeforward.Queue) {
+	t.queue = q
+}
+
+// Reload reads the file again.
+func (t *Table) Reload() error {
+	err := t.load()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastErr = ""
+	if err != nil {
+		t.lastErr = err.Error()
+	}
+	return err
+}
+
+func (t *Table) load() error {
+	if t.path == "" {
+		return errors.New("no routing file configured")
+	}
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	cfg, err := Parse(data, t.builtin)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.path, err)
+	}
+
+	urls := map[string][]string{}
+	for name, u := range t.builtin {
+		urls[name] = []string{u}
+	}
+	for name, b := range cfg.Backends {
+		urls[name] = b.urls()
+	}
+	backends := map[string]*pool{}
+	for name, u := range urls {
+		p, err := newPool(u)
+		if err != nil {
+			return fmt.Errorf("%s: backend %s: %w", t.path, name, err)
+		}
+		backends[name] = p
+	}
+	routes := make([]*route, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		compiled := &route{Route: r, pool: backends[r.Backend]}
+		if r.Timeout != "" {
+			compiled.timeout, _ = time.ParseDuration(r.Timeout)
+		}
+		compiled.proxy = t.newProxy(compiled)
+		if r.WebSocket {
+			compiled.upgrades = newUpgradeProxy(compiled)
+		}
+		routes = append(routes, compiled)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if len(routes[i].Prefix) != len(routes[j].Prefix) {
+			return len(routes[i].Prefix) > len(routes[j].Prefix)
+		}
+		return len(routes[i].Methods) > 0 && len(routes[j].Methods) == 0
+	})
+
+	t.mu.Lock()
+	t.backends, t.routes, t.loadedAt = backends, routes, time.Now().UTC()
+	t.mu.Unlock()
+	return nil
+}
+
+// ReloadOn reloads the table each time a signal arrives on signals, such as
+// SIGHUP, until ctx is cancelled.
+func (t *Table) ReloadOn(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			if t.path == "" {
+				continue
+			}
+			if err := t.Reload(); err != nil {
+				log.Printf("Gateway routing reload on %v failed, keeping the previous table: %v", sig, err)
+				continue
+			}
+			log.Printf("Reloaded gateway routes from %s on %v", t.path, sig)
+		}
+	}
+}
+
+func (t *Table) match(method, path string) *route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.routes {
+		if r.matches(method, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// BackendState is a backend as GET /admin/routes shows it. URL is its
+// first instance.
+type BackendState struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	BuiltIn bool   `json:"built_in"`
+	// Instances is shown for backends with more than one.
+	Instances []InstanceState `json:"instances,omitempty"`
+}
+
+// InstanceState is one of a backend's instances, with the requests and
+// WebSockets the gateway has open on it.
+type InstanceState struct {
+	URL      string `json:"url"`
+	InFlight int64  `json:"in_flight"`
+}
+
+// RouteState is a route with its backend's URL, in the order routes are
+// matched.
+type RouteState struct {
+	Route
+	URL string `json:"url"`
+}
+
+// State is the table as GET /admin/routes shows it.
+type State struct {
+	File      string         `json:"file,omitempty"`
+	Backends  []BackendState `json:"backends"`
+	Routes    []RouteState   `json:"routes"`
+	LoadedAt  *time.Time     `json:"loaded_at,omitempty"`
+	LastError string         `json:"last_error,omitempty"`
+	// OpenWebSockets counts the WebSocket connections being proxied.
+	OpenWebSockets int `json:"open_websockets"`
+}
+
+// BackendAt returns the name of the backend with an instance at host, the
+// audience of the tokens the gateway sends there.
+func (t *Table) BackendAt(host string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for name, p := range t.backends {
+		for _, target := range p.targets {
+			if target.Host == host {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (t *Table) State() State {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	st := State{File: t.path, Backends: []BackendState{}, Routes: []RouteState{}, LastError: t.lastErr}
+	if len(t.backends) == 0 {
+		for name, u := range t.builtin {
+			st.Backends = append(st.Backends, BackendState{Name: name, URL: u, BuiltIn: true})
+		}
+	}
+	for name, p := range t.backends {
+		_, builtin := t.builtin[name]
+		b := BackendState{Name: name, URL: p.targets[0].String(), BuiltIn: builtin}
+		if len(p.targets) > 1 {
+			for i, target := range p.targets {
+				b.Instances = append(b.Instances, InstanceState{URL: target.String(), InFlight: p.inFlight[i].Load()})
+			}
+		}
+		st.Backends = append(st.Backends, b)
+	}
+	sort.Slice(st.Backends, func(i, j int) bool { return st.Backends[i].Name < st.Backends[j].Name })
+	for _, r := range t.routes {
+		st.Routes = append(st.Routes, RouteState{Route: r.Route, URL: r.pool.targets[0].String()})
+	}
+	if !t.loadedAt.IsZero() {
+		loaded := t.loadedAt
+		st.LoadedAt = &loaded
+	}
+	if t.websockets != nil {
+		st.OpenWebSockets = t.websockets.Open()
+	}
+	return st
+}
@@ -0,0 +1,504 @@
+package routing
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/storeforward"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/idempotency"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParse(t *testing.T) {
+	builtin := map[string]string{"order-service": "http://order-service:50053"}
+	for _, bad := range []string{
+		"routes:\n  - prefix: api\n    backend: order-service\n",
+		"routes:\n  - prefix: /api\n    backend: missing\n",
+		"routes:\n  - prefix: /admin/orders\n    backend: order-service\n",
+		"backends:\n  order-service: {url: http://elsewhere}\n",
+		"backends:\n  search: {url: search:8080}\n",
+		"routes:\n  - prefix: /api\n    backend: order-service\n    timeout: soon\n",
+		"routes:\n  - {prefix: /api, backend: order-service}\n  - {prefix: /api, backend: order-service}\n",
+		"routes:\n  - prefix: /api\n    target: order-service\n",
+		"routes:\n  - prefix: /api\n    backend: order-service\n    store_and_forward: true\n",
+		"routes:\n  - prefix: /api\n    methods: [GET, POST]\n    backend: order-service\n    store_and_forward: true\n",
+		"routes:\n  - prefix: /api\n    methods: [POST]\n    backend: order-service\n    websocket: true\n",
+		"backends:\n  search: {url: http://a, instances: [http://b]}\n",
+		"backends:\n  search: {instances: [http://a, http://a/]}\n",
+		"routes:\n  - {prefix: /api, backend: order-service, balance: random}\n",
+		"routes:\n  - {prefix: /api, backend: order-service, hash_key: user}\n",
+		"routes:\n  - {prefix: /api, backend: order-service, balance: consistent_hash, hash_key: header}\n",
+		"routes:\n  - {prefix: /api, backend: order-service, balance: consistent_hash, hash_key: \"cookie:\"}\n",
+	} {
+		if _, err := Parse([]byte(bad), builtin); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+	cfg, err := Parse([]byte(`{"routes": [{"prefix": "/api", "methods": ["get"], "backend": "order-service"},
+		{"prefix": "/api", "methods": ["post"], "backend": "order-service"}]}`), builtin)
+	if err != nil || cfg.Routes[0].Methods[0] != "GET" {
+		t.Errorf("Expected JSON with methods per route to load, got: %+v, %v", cfg, err)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	builtin := map[string]string{"order-service": "http://order-service:50053", "user-service": "http://user-service:50054"}
+	cfg, err := Parse([]byte(`routes:
+  - {prefix: /, backend: user-service}
+  - {prefix: /api/track, backend: order-service}
+  - {prefix: /api/users, methods: [POST], backend: user-service}
+  - {prefix: /api/orders, backend: order-service}
+  - {prefix: /api/orders/, methods: [GET], backend: user-service}
+`), builtin)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	got := Conflicts(cfg, []string{"GET /", "GET /api/users", "GET /api/track/:token"})
+	want := []string{
+		"route /api/track: GET /api/track/:token is served by the gateway itself and never reaches order-service",
+		"route /api/orders: only /api/orders itself reaches order-service, as route /api/orders/ takes every path below it",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected %q, got: %q", want, got)
+	}
+}
+
+func TestTable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var orders, search []string
+	started, release := make(chan struct{}), make(chan struct{})
+	orderBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		} else {
+			orders = append(orders, r.Method+" "+r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"backend":"orders"}`))
+	}))
+	defer orderBackend.Close()
+	searchBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		search = append(search, r.Method+" "+r.URL.RequestURI())
+	}))
+	defer searchBackend.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(path, []byte(`
+backends:
+  search:
+    url: `+searchBackend.URL+`
+routes:
+  - prefix: /api/orders
+    backend: order-service
+    rewrite: /orders
+  - prefix: /api/orders
+    methods: [DELETE]
+    backend: search
+  - prefix: /api/search
+    backend: search
+    rewrite: /
+  - prefix: /api/slow
+    backend: order-service
+    rewrite: /slow
+`), 0o600)
+	table, err := New(path, map[string]string{"order-service": orderBackend.URL}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	router := gin.New()
+	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	router.NoRoute(table.Handler())
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if w := serve(http.MethodGet, "/api/orders/7"); w.Code != http.StatusOK || w.Body.String() != `{"backend":"orders"}` {
+		t.Errorf("Expected the order backend's response, got: %d %s", w.Code, w.Body.String())
+	}
+	serve(http.MethodDelete, "/api/orders/7")
+	serve(http.MethodGet, "/api/search?q=shoes")
+	if w := serve(http.MethodGet, "/api/ordersx"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected prefixes to match whole path segments, got: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/health"); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the gateway's own routes to win, got: %d", w.Code)
+	}
+	if strings.Join(orders, ",") != "GET /orders/7" || strings.Join(search, ",") != "DELETE /api/orders/7,GET /?q=shoes" {
+		t.Errorf("Expected requests routed by prefix and method, got: %v, %v", orders, search)
+	}
+
+	// A request in flight during a reload finishes on its route.
+	done := make(chan int)
+	go func() { done <- serve(http.MethodGet, "/api/slow").Code }()
+	<-started
+	os.WriteFile(path, []byte("routes:\n  - prefix: /api/search\n    backend: order-service\n"), 0o600)
+	signals := make(chan os.Signal, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go table.ReloadOn(ctx, signals)
+	signals <- syscall.SIGHUP
+	deadline := time.Now().Add(time.Second)
+	for len(table.State().Routes) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the in-flight request to complete, got: %d", code)
+	}
+	if w := serve(http.MethodGet, "/api/orders/7"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the removed route to be gone, got: %d", w.Code)
+	}
+
+	// A broken file keeps the table in force.
+	os.WriteFile(path, []byte("routes:\n  - prefix: /api/x\n    backend: nowhere\n"), 0o600)
+	if err := table.Reload(); err == nil {
+		t.Error("Expected an unknown backend to fail the reload")
+	}
+	st := table.State()
+	if len(st.Routes) != 1 || st.LastError == "" || st.Routes[0].URL != orderBackend.URL {
+		t.Errorf("Expected the previous table kept with the error, got: %+v", st)
+	}
+	if _, err := json.Marshal(st); err != nil {
+		t.Errorf("Expected the state to encode, got: %v", err)
+	}
+}
+
+func TestBackendCompression(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var accepted string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "application/json")
+		if accepted != "gzip" {
+			w.Write([]byte(`{"id":7}`))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"id":7}`))
+		gz.Close()
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(path, []byte("routes:\n  - prefix: /api/orders\n    backend: order-service\n    rewrite: /orders\n"), 0o600)
+	table, err := New(path, map[string]string{"order-service": backend.URL}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	router := gin.New()
+	router.NoRoute(table.Handler())
+	req := httptest.NewRequest(http.MethodGet, "/api/orders/7", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if accepted != "gzip" || w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"id":7}` {
+		t.Errorf("Expected the hop compressed and the answer decoded for the gateway to encode, got: %q %q %s",
+			accepted, w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+}
+
+func TestStoreAndForward(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	down := true
+	var received []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Method+" "+r.URL.Path+" "+r.Header.Get(idempotency.Header)+" "+string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(path, []byte(`
+routes:
+  - prefix: /api/notifications
+    methods: [POST]
+    backend: notification-service
+    rewrite: /notifications
+    store_and_forward: true
+`), 0o600)
+	table, err := New(path, map[string]string{"notification-service": backend.URL}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	queue, _ := storeforward.New(http.DefaultTransport, "", 10)
+	table.SetQueue(queue)
+	router := gin.New()
+	router.NoRoute(table.Handler())
+	post := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/notifications", strings.NewReader(`{"user_id":1}`))
+		if key != "" {
+			req.Header.Set(idempotency.Header, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("")
+	var queued struct{ Status, ID string }
+	json.Unmarshal(w.Body.Bytes(), &queued)
+	if w.Code != http.StatusAccepted || queued.Status != "queued" || queued.ID == "" {
+		t.Fatalf("Expected the request to be queued, got: %d %s", w.Code, w.Body)
+	}
+	post("caller-key")
+	if n, err := queue.Flush(context.Background()); n != 0 || err == nil || queue.Pending() != 2 {
+		t.Errorf("Expected a backend still down to keep both, got: %d, %v", n, err)
+	}
+
+	down = false
+	if n, err := queue.Flush(context.Background()); n != 2 || err != nil {
+		t.Fatalf("Expected both replayed, got: %d, %v", n, err)
+	}
+	want := "POST /notifications " + queued.ID + ` {"user_id":1},POST /notifications caller-key {"user_id":1}`
+	if strings.Join(received, ",") != want {
+		t.Errorf("Expected %q, got: %q", want, received)
+	}
+	if w := post(""); w.Code != http.StatusCreated {
+		t.Errorf("Expected a healthy backend to answer itself, got: %d", w.Code)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var paths, sent []string
+	// The backend accepts the upgrade and echoes whatever it is sent.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		sent = append(sent, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")+"?"+r.URL.RawQuery)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(path, []byte(`
+routes:
+  - prefix: /api/notifications/stream
+    backend: notification-service
+    rewrite: /notifications/stream
+    websocket: true
+  - prefix: /api/orders
+    backend: notification-service
+`), 0o600)
+	table, err := New(path, map[string]string{"notification-service": backend.URL}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	tokens, _ := auth.NewTokens("test-secret", time.Hour)
+	table.SetWebSockets(&WebSockets{Tokens: tokens, MaxPerCaller: 1, IdleTimeout: 200 * time.Millisecond,
+		Exchange: func(token, host string) (string, error) {
+			service, _ := table.BackendAt(host)
+			exchanged, _, err := tokens.Exchange(token, service, "api-gateway", time.Minute)
+			return exchanged, err
+		}})
+	router := gin.New()
+	router.NoRoute(table.Handler())
+	gateway := httptest.NewServer(router)
+	defer gateway.Close()
+
+	alice, _, _ := tokens.IssueUser(1, []string{auth.RoleCustomer})
+	bob, _, _ := tokens.IssueUser(2, []string{auth.RoleCustomer})
+	dial := func(path, token string) (net.Conn, *bufio.Reader, int) {
+		conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial the gateway: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, _ := http.NewRequest(http.MethodGet, gateway.URL+path, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Write(conn)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("Failed to read the handshake: %v", err)
+		}
+		return conn, br, resp.StatusCode
+	}
+
+	if _, _, code := dial("/api/notifications/stream", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected an upgrade without a token to be refused, got: %d", code)
+	}
+	if _, _, code := dial("/api/orders", alice); code != http.StatusBadRequest {
+		t.Errorf("Expected an upgrade on a route without websocket to be refused, got: %d", code)
+	}
+
+	conn, br, code := dial("/api/notifications/stream", alice)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the upgrade to be proxied, got: %d", code)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	if line, err := br.ReadString('\n'); line != "hello\n" {
+		t.Errorf("Expected the backend's echo, got: %q, %v", line, err)
+	}
+	if paths[0] != "/notifications/stream" {
+		t.Errorf("Expected the path to be rewritten, got: %v", paths)
+	}
+	if _, _, code := dial("/api/notifications/stream", alice); code != http.StatusTooManyRequests {
+		t.Errorf("Expected a second connection for the same user to be refused, got: %d", code)
+	}
+	other, _, code := dial("/api/notifications/stream?access_token="+bob, "")
+	if code != http.StatusSwitchingProtocols {
+		t.Errorf("Expected another user with a token in the query to connect, got: %d", code)
+	}
+	defer other.Close()
+	for _, s := range sent {
+		token, query, _ := strings.Cut(s, "?")
+		if _, err := tokens.ForAudience("notification-service").Parse(token); err != nil || query != "" {
+			t.Errorf("Expected the backend to get a token exchanged for it in the header, got: %q, %v", s, err)
+		}
+	}
+	if n := table.State().OpenWebSockets; n != 2 {
+		t.Errorf("Expected 2 open connections, got: %d", n)
+	}
+
+	// Nothing is sent either way, so the gateway closes the connection.
+	if _, err := br.ReadString('\n'); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the idle connection to be closed, got: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); table.State().OpenWebSockets > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := table.State().OpenWebSockets; n != 0 {
+		t.Errorf("Expected closed connections to be released, got: %d", n)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hits := map[string]int{}
+	var mu sync.Mutex
+	release := make(chan struct{})
+	instance := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/slow") {
+				<-release
+			}
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			w.Write([]byte(name))
+		}))
+	}
+	a, b, c := instance("a"), instance("b"), instance("c")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	os.WriteFile(path, []byte(`
+backends:
+  search:
+    instances: [`+a.URL+`, `+b.URL+`, `+c.URL+`]
+routes:
+  - {prefix: /rr, backend: search}
+  - {prefix: /least, backend: search, balance: least_connections}
+  - {prefix: /user, backend: search, balance: consistent_hash}
+  - {prefix: /cookie, backend: search, balance: consistent_hash, hash_key: "cookie:session"}
+`), 0o600)
+	table, err := New(path, nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	tokens, _ := auth.NewTokens("test-secret", time.Hour)
+	table.SetWebSockets(&WebSockets{Tokens: tokens})
+	router := gin.New()
+	router.NoRoute(table.Handler())
+	send := func(path string, header ...string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	for i := 0; i < 6; i++ {
+		send("/rr")
+	}
+	if hits["a"] != 2 || hits["b"] != 2 || hits["c"] != 2 {
+		t.Errorf("Expected round robin to spread requests evenly, got: %v", hits)
+	}
+
+	// Two slow requests hold two instances, so the next goes to the third.
+	done := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- send("/least/slow") }()
+	}
+	for deadline := time.Now().Add(time.Second); busy(table) < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	idle := send("/least")
+	close(release)
+	if held := []string{<-done, <-done}; held[0] == idle || held[1] == idle {
+		t.Errorf("Expected the idle instance to be chosen, got %s while %v were busy", idle, held)
+	}
+
+	alice, _, _ := tokens.IssueUser(1, []string{auth.RoleCustomer})
+	first := send("/user", "Authorization", "Bearer "+alice)
+	for i := 0; i < 5; i++ {
+		if got := send("/user", "Authorization", "Bearer "+alice); got != first {
+			t.Fatalf("Expected the same user to stay on %s, got: %s", first, got)
+		}
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		seen[send("/cookie", "Cookie", "session=s"+strconv.Itoa(i))] = true
+		if got, again := send("/cookie", "Cookie", "session=s7"), send("/cookie", "Cookie", "session=s7"); got != again {
+			t.Fatalf("Expected the same session to stay on one instance, got: %s and %s", got, again)
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected sessions to spread over the instances, got: %v", seen)
+	}
+
+	st := table.State()
+	if len(st.Backends) != 1 || len(st.Backends[0].Instances) != 3 || st.Backends[0].Instances[1].URL != b.URL {
+		t.Errorf("Expected the instances to be shown, got: %+v", st.Backends)
+	}
+}
+
+func busy(table *Table) int64 {
+	var n int64
+	for _, b := range table.State().Backends {
+		for _, i := range b.Instances {
+			n += i.InFlight
+		}
+	}
+	return n
+}
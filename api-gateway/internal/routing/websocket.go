@@ -0,0 +1,191 @@
+package routing
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// handshakeTimeout bounds how long a backend may take to accept an
+// upgrade. The connection itself is bounded only by WebSockets.IdleTimeout.
+const handshakeTimeout = 10 * time.Second
+
+// WebSockets holds the settings and open connections of websocket routes.
+type WebSockets struct {
+	// Tokens verify callers at the edge. Without them, upgrades are
+	// refused, since the gateway cannot tell callers apart.
+	Tokens *auth.Tokens
+	// MaxPerCaller caps the connections one user or service holds open
+	// through this gateway at once; 0 means no cap.
+	MaxPerCaller int
+	// IdleTimeout closes a connection that has carried nothing either way
+	// for this long; 0 means never.
+	IdleTimeout time.Duration
+	// Exchange, if set, swaps the caller's token for one the backend at
+	// host accepts, as the forwarding client does for other requests. A
+	// token it cannot exchange is passed on as it is.
+	Exchange func(token, host string) (string, error)
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+// SetWebSockets lets websocket routes accept upgrades, with ws's settings.
+// Without it they refuse them. Call it before serving.
+func (t *Table) SetWebSockets(ws *WebSockets) {
+	t.websockets = ws
+}
+
+// newUpgradeProxy proxies upgrades with a plain transport: the forwarding
+// client's retries, validation and token exchange all read or replace the
+// response body, which an upgraded connection cannot go through. The
+// caller's token is exchanged by upgrade instead.
+func newUpgradeProxy(r *route) http.Handler {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = handshakeTimeout
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path, pr.Out.URL.RawPath = r.rewrite(pr.In.URL.Path), ""
+			pr.SetURL(targetOf(pr.In))
+		},
+		Transport: transport,
+	}
+}
+
+func isUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// upgrade proxies a WebSocket upgrade on r once the caller has a valid
+// token and a connection to spare, and returns when the connection closes.
+func (t *Table) upgrade(c *gin.Context, r *route) {
+	ws := t.websockets
+	if ws == nil || ws.Tokens == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "WebSocket proxying needs JWT_SECRET on the gateway"})
+		return
+	}
+	token, p, ok := ws.authenticate(c.Request)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid token is required to open a WebSocket"})
+		return
+	}
+	caller := callerOf(p)
+	if !ws.acquire(caller) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many open WebSocket connections"})
+		return
+	}
+	defer ws.release(caller)
+	if ws.Exchange != nil {
+		if exchanged, err := ws.Exchange(token, targetOf(c.Request).Host); err == nil {
+			query := c.Request.URL.Query()
+			query.Del("access_token")
+			c.Request.URL.RawQuery = query.Encode()
+			c.Request.Header.Set("Authorization", "Bearer "+exchanged)
+		}
+	}
+	r.upgrades.ServeHTTP(idleWriter{c.Writer, ws.IdleTimeout}, c.Request)
+}
+
+// callerOf names the user or service p is.
+func callerOf(p *auth.Principal) string {
+	if p.Service != "" {
+		return "service:" + p.Service
+	}
+	return "user:" + strconv.Itoa(p.UserID)
+}
+
+// authenticate accepts the token from ?access_token= as well, since the
+// browser WebSocket API cannot set request headers.
+func (ws *WebSockets) authenticate(req *http.Request) (string, *auth.Principal, bool) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		token = req.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return "", nil, false
+	}
+	p, err := ws.Tokens.Parse(token)
+	return token, p, err == nil
+}
+
+func (ws *WebSockets) acquire(caller string) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.MaxPerCaller > 0 && ws.open[caller] >= ws.MaxPerCaller {
+		return false
+	}
+	if ws.open == nil {
+		ws.open = map[string]int{}
+	}
+	ws.open[caller]++
+	return true
+}
+
+func (ws *WebSockets) release(caller string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.open[caller]--; ws.open[caller] <= 0 {
+		delete(ws.open, caller)
+	}
+}
+
+// Open returns the number of WebSocket connections being proxied.
+func (ws *WebSockets) Open() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	n := 0
+	for _, open := range ws.open {
+		n += open
+	}
+	return n
+}
+
+// idleWriter hands the proxy the client's connection with an idle
+// timeout once it is hijacked. Like unwrapper, it hides gin's CloseNotify.
+type idleWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+}
+
+func (w idleWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil || w.timeout <= 0 {
+		return conn, brw, err
+	}
+	idle := &idleConn{Conn: conn, timeout: w.timeout}
+	idle.touch()
+	return idle, brw, nil
+}
+
+// idleConn pushes its deadline back whenever data passes either way. The
+// proxy copies both directions through it, so a connection goes idle only
+// when neither side sends anything, pings included, and is then closed.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) touch() {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.touch()
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,50 @@
+package secureheaders
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/docs"
+	"github.com/gin-gonic/gin"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware(365*24*time.Hour, true))
+	router.GET("/api/users", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	docs.Register(router, "api-gateway", []byte("openapi: 3.0.3"))
+	get := func(path string) http.Header {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Header()
+	}
+
+	header := get("/api/users")
+	want := map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Content-Security-Policy":   APIContentSecurityPolicy,
+	}
+	for name, value := range want {
+		if got := header.Get(name); got != value {
+			t.Errorf("Expected %s: %s, got: %q", name, value, got)
+		}
+	}
+
+	csp := get("/docs").Get("Content-Security-Policy")
+	if csp != docs.ContentSecurityPolicy || !strings.Contains(csp, "script-src https://unpkg.com/swagger-ui-dist@5/ 'sha256-") {
+		t.Errorf("Expected the docs page to carry its own policy, got: %s", csp)
+	}
+
+	router = gin.New()
+	router.Use(Middleware(0, false))
+	router.GET("/api/users", func(c *gin.Context) {})
+	if hsts := get("/api/users").Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("Expected no HSTS with a zero max-age, got: %s", hsts)
+	}
+}
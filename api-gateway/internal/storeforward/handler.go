@@ -0,0 +1,23 @@
+package storeforward
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterAdminRoutes shows what is queued and replays it on demand, such
+// as right after a backend is back.
+func RegisterAdminRoutes(router gin.IRouter, q *Queue) {
+	router.GET("/store-and-forward", func(c *gin.Context) {
+		c.JSON(http.StatusOK, q.State())
+	})
+	router.POST("/store-and-forward/flush", func(c *gin.Context) {
+		sent, err := q.Flush(c.Request.Context())
+		resp := gin.H{"replayed": sent, "pending": q.Pending()}
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,325 @@
+// Package storeforward holds requests to fire-and-forget routes while their
+// backend is down, and replays them once it answers again.
+//
+// Requests are replayed oldest first, one backend at a time: a backend
+// still down keeps its requests in order for the next round without
+// holding up the others. Each request carries an Idempotency-Key, so one
+// the backend did take before timing out is not applied twice.
+package storeforward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+)
+
+// MaxBody is the largest request body a route can queue.
+const MaxBody = 1 << 20
+
+// ErrFull is returned by Enqueue once the queue holds its most requests.
+var ErrFull = errors.New("store-and-forward queue is full")
+
+// Request is a request as it was to be sent to its backend, with the
+// path already rewritten.
+type Request struct {
+	ID       string      `json:"id"`
+	Backend  string      `json:"backend"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body,omitempty"`
+	QueuedAt time.Time   `json:"queued_at"`
+}
+
+// NewID returns a random ID for a request, also used as its
+// Idempotency-Key when the caller sent none.
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Queue holds requests in memory and, with a path, in a file there, so a
+// restart replays them too.
+type Queue struct {
+	transport http.RoundTripper
+	path      string
+	max       int
+
+	mu       sync.Mutex
+	pending  []Request
+	replayed int
+	dropped  int
+	lastErr  string
+}
+
+// New loads the requests a previous run left in the file at path, if any.
+// An empty path keeps requests in memory only. transport should be the one
+// the routes proxy through, so replays get the same token forwarding,
+// policies and failover.
+func New(transport http.RoundTripper, path string, max int) (*Queue, error) {
+	q := &Queue{transport: transport, path: path, max: max}
+	if path != "" {
+		pending, err := readQueue(path)
+		if err != nil {
+			return nil, err
+		}
+		q.pending = pending
+	}
+	return q, nil
+}
+
+// Enqueue holds r until its backend takes it.
+func (q *Queue) Enqueue(r Request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= q.max {
+		return ErrFull
+	}
+	if r.QueuedAt.IsZero() {
+		r.QueuedAt = time.Now().UTC()
+	}
+	if q.path != "" {
+		if err := appendQueue(q.path, r); err != nil {
+			return fmt.Errorf("queue request %s: %w", r.ID, err)
+		}
+	}
+	q.pending = append(q.pending, r)
+	return nil
+}
+
+// Pending returns how many requests are waiting to be replayed.
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Unavailable reports whether a backend's status means it did not take the
+// request, so it should be held and tried again.
+func Unavailable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// Flush replays waiting requests and returns how many its backends took.
+// A request the backend rejects, such as one whose token has expired
+// since, is dropped with a log line, as there is no caller left to tell.
+func (q *Queue) Flush(ctx context.Context) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return 0, nil
+	}
+
+	down := map[string]error{}
+	kept := q.pending[:0:0]
+	sent := 0
+	for _, r := range q.pending {
+		if _, ok := down[r.Backend]; ok {
+			kept = append(kept, r)
+			continue
+		}
+		status, err := q.send(ctx, r)
+		switch {
+		case err != nil:
+			down[r.Backend] = err
+			kept = append(kept, r)
+		case Unavailable(status):
+			down[r.Backend] = fmt.Errorf("backend %s answered %d", r.Backend, status)
+			kept = append(kept, r)
+		case status >= http.StatusBadRequest:
+			log.Printf("Backend %s rejected queued request %s %s (%s) with %d, dropping it", r.Backend, r.Method, r.URL, r.ID, status)
+			q.dropped++
+		default:
+			sent++
+		}
+	}
+	if len(kept) == len(q.pending) {
+		return 0, q.fail(down)
+	}
+	q.replayed += sent
+	q.pending = kept
+	if q.path != "" {
+		if werr := writeQueue(q.path, q.pending); werr != nil {
+			// The file still holds replayed requests, so a restart before
+			// the next flush sends them again; their Idempotency-Key keeps
+			// that harmless.
+			log.Printf("Failed to rewrite store-and-forward queue %s: %v", q.path, werr)
+		}
+	}
+	return sent, q.fail(down)
+}
+
+// fail records why backends are still down, if any are.
+func (q *Queue) fail(down map[string]error) error {
+	if len(down) == 0 {
+		q.lastErr = ""
+		return nil
+	}
+	var errs []error
+	for _, err := range down {
+		errs = append(errs, err)
+	}
+	err := errors.Join(errs...)
+	q.lastErr = err.Error()
+	return err
+}
+
+func (q *Queue) send(ctx context.Context, r Request) (int, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		ctx = auth.ContextWithToken(ctx, token)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		// It can never be sent, so it is dropped like a rejected one.
+		log.Printf("Queued request %s is invalid: %v", r.ID, err)
+		return http.StatusBadRequest, nil
+	}
+	if r.Header != nil {
+		req.Header = r.Header.Clone()
+	}
+	resp, err := q.transport.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Run replays waiting requests every interval until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if n := q.Pending(); n > 0 && q.path == "" {
+				log.Printf("Stopping with %d queued requests not replayed", n)
+			}
+			return
+		case <-ticker.C:
+		}
+		n, err := q.Flush(ctx)
+		if n > 0 {
+			log.Printf("Replayed %d queued requests", n)
+		}
+		if err != nil {
+			log.Printf("Store-and-forward replay stopped, %d still queued: %v", q.Pending(), err)
+		}
+	}
+}
+
+// BackendState is what is waiting for one backend.
+type BackendState struct {
+	Pending int       `json:"pending"`
+	Oldest  time.Time `json:"oldest_queued_at"`
+}
+
+// State is the queue as GET /admin/store-and-forward shows it.
+type State struct {
+	Pending   int                     `json:"pending"`
+	Max       int                     `json:"max"`
+	Backends  map[string]BackendState `json:"backends"`
+	Replayed  int                     `json:"replayed"`
+	Dropped   int                     `json:"dropped"`
+	LastError string                  `json:"last_error,omitempty"`
+}
+
+func (q *Queue) State() State {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := State{Pending: len(q.pending), Max: q.max, Backends: map[string]BackendState{}, Replayed: q.replayed, Dropped: q.dropped, LastError: q.lastErr}
+	for _, r := range q.pending {
+		b, ok := st.Backends[r.Backend]
+		if !ok {
+			b.Oldest = r.QueuedAt
+		}
+		b.Pending++
+		st.Backends[r.Backend] = b
+	}
+	return st
+}
+
+// readQueue reads one JSON-encoded request per line. A missing file holds
+// no requests, and a torn last line from a crash mid-write is skipped.
+func readQueue(path string) ([]Request, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pending []Request
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*MaxBody)
+	for scanner.Scan() {
+		var r Request
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Printf("Skipping unreadable line in store-and-forward queue %s: %v", path, err)
+			continue
+		}
+		pending = append(pending, r)
+	}
+	return pending, scanner.Err()
+}
+
+func appendQueue(path string, r Request) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeQueue replaces the file with pending, through a rename so a crash
+// leaves either the old requests or the new ones.
+func writeQueue(path string, pending []Request) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range pending {
+		line, err := json.Marshal(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,62 @@
+package storeforward
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	statuses := map[string]int{"/down": http.StatusServiceUnavailable, "/rejected": http.StatusUnauthorized}
+	var sent []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.URL.Path)
+		if status, ok := statuses[r.URL.Path]; ok {
+			w.WriteHeader(status)
+		}
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	q, err := New(http.DefaultTransport, path, 3)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	for _, r := range []Request{
+		{ID: "1", Backend: "a", Method: http.MethodPost, URL: backend.URL + "/down"},
+		{ID: "2", Backend: "a", Method: http.MethodPost, URL: backend.URL + "/ok"},
+		{ID: "3", Backend: "b", Method: http.MethodPost, URL: backend.URL + "/rejected"},
+	} {
+		if err := q.Enqueue(r); err != nil {
+			t.Fatalf("Failed to enqueue %s: %v", r.ID, err)
+		}
+	}
+	if err := q.Enqueue(Request{ID: "4", Backend: "b"}); err != ErrFull {
+		t.Errorf("Expected a full queue to refuse, got: %v", err)
+	}
+
+	// Backend a is down, so its second request waits behind its first;
+	// backend b rejects its request, which is dropped.
+	if n, err := q.Flush(context.Background()); n != 0 || err == nil {
+		t.Errorf("Expected nothing replayed, got: %d, %v", n, err)
+	}
+	if len(sent) != 2 || sent[0] != "/down" || sent[1] != "/rejected" {
+		t.Errorf("Expected a's second request held back, got: %v", sent)
+	}
+	st := q.State()
+	if st.Pending != 2 || st.Dropped != 1 || st.Backends["a"].Pending != 2 || st.LastError == "" {
+		t.Errorf("Expected a's two requests pending, got: %+v", st)
+	}
+
+	// A restart picks up what was left.
+	restarted, err := New(http.DefaultTransport, path, 3)
+	if err != nil || restarted.Pending() != 2 {
+		t.Fatalf("Expected 2 requests read back, got: %d, %v", restarted.Pending(), err)
+	}
+	delete(statuses, "/down")
+	if n, err := restarted.Flush(context.Background()); n != 2 || err != nil || restarted.Pending() != 0 {
+		t.Errorf("Expected both replayed, got: %d, %v", n, err)
+	}
+}
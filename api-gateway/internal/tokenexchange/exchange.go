@@ -0,0 +1,142 @@
+// Package tokenexchange swaps callers' tokens for internal ones before the
+// gateway calls a backend, after OAuth 2.0 Token Exchange (RFC 8693).
+//
+// The internal token only works at the backend it was issued for, stops
+// working shortly after, and cannot be exchanged again, so one that leaks
+// from a backend's logs or a compromised service cannot be replayed
+// against the rest of the system. The same exchange is offered at
+// POST /oauth/token for clients that call backends themselves.
+package tokenexchange
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+)
+
+// actor is the act claim of the tokens the gateway issues.
+const actor = "api-gateway"
+
+var ErrUnknownAudience = errors.New("unknown audience")
+
+// Exchanger issues tokens for the backends it was told about.
+type Exchanger struct {
+	tokens *auth.Tokens
+	ttl    time.Duration
+	// hosts maps each host a backend is reached at to its service name,
+	// which is the audience of the tokens sent there.
+	hosts    map[string]string
+	services map[string]bool
+	resolve  func(host string) (string, bool)
+
+	exchanged atomic.Int64
+	forwarded atomic.Int64
+}
+
+// New issues tokens that live for ttl, or less when the caller's token
+// expires sooner.
+func New(tokens *auth.Tokens, ttl time.Duration) *Exchanger {
+	return &Exchanger{tokens: tokens, ttl: ttl, hosts: map[string]string{}, services: map[string]bool{}}
+}
+
+// AddService makes service an audience, reached at each of urls. Empty
+// URLs are skipped. Call it before the gateway serves requests.
+func (e *Exchanger) AddService(service string, urls ...string) error {
+	for _, raw := range urls {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%s: invalid url %q", service, raw)
+		}
+		if other, ok := e.hosts[u.Host]; ok && other != service {
+			return fmt.Errorf("%s: %s is already %s's address", service, u.Host, other)
+		}
+		e.hosts[u.Host] = service
+	}
+	e.services[service] = true
+	return nil
+}
+
+// SetResolver names the services at hosts AddService was not told about,
+// such as the routing file's backends, which change when it is reloaded.
+// Call it before the gateway serves requests.
+func (e *Exchanger) SetResolver(resolve func(host string) (service string, ok bool)) {
+	e.resolve = resolve
+}
+
+// serviceAt returns the service reached at host.
+func (e *Exchanger) serviceAt(host string) (string, bool) {
+	if service, ok := e.hosts[host]; ok {
+		return service, true
+	}
+	if e.resolve != nil {
+		return e.resolve(host)
+	}
+	return "", false
+}
+
+// ExchangeFor trades token for one the backend at host accepts. It
+// returns ErrUnknownAudience when host is not a backend's.
+func (e *Exchanger) ExchangeFor(token, host string) (string, error) {
+	service, ok := e.serviceAt(host)
+	if !ok {
+		return "", ErrUnknownAudience
+	}
+	exchanged, _, err := e.tokens.Exchange(token, service, actor, e.ttl)
+	return exchanged, err
+}
+
+// Exchange trades token for one only audience accepts. It returns
+// auth.ErrInvalidToken or auth.ErrAlreadyExchanged for tokens that cannot
+// be exchanged.
+func (e *Exchanger) Exchange(token, audience string) (string, time.Time, error) {
+	if !e.services[audience] {
+		return "", time.Time{}, ErrUnknownAudience
+	}
+	return e.tokens.Exchange(token, audience, actor, e.ttl)
+}
+
+// Wrap exchanges the token client's calls carry. Wrap it outside the
+// forwarding transport, which sends the token, and inside upstream
+// failover, so a call moved to a secondary region is matched by the host
+// it is really sent to.
+func (e *Exchanger) Wrap(client *http.Client) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &Transport{Base: base, Exchanger: e}
+}
+
+// Transport replaces the token on the request's context with one for the
+// backend it is addressed to. Calls to other hosts, and tokens that cannot
+// be exchanged, go out as they are, leaving it to the backend to reject a
+// bad token as it did before.
+type Transport struct {
+	Base      http.RoundTripper
+	Exchanger *Exchanger
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := auth.TokenFromContext(req.Context())
+	if token == "" {
+		return t.Base.RoundTrip(req)
+	}
+	exchanged, err := t.Exchanger.ExchangeFor(token, req.URL.Host)
+	if errors.Is(err, ErrUnknownAudience) {
+		return t.Base.RoundTrip(req)
+	}
+	if err != nil {
+		t.Exchanger.forwarded.Add(1)
+		return t.Base.RoundTrip(req)
+	}
+	t.Exchanger.exchanged.Add(1)
+	return t.Base.RoundTrip(req.Clone(auth.ContextWithToken(req.Context(), exchanged)))
+}
@@ -0,0 +1,101 @@
+package tokenexchange
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// RFC 8693 identifiers.
+const (
+	GrantType       = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeJWT    = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeAccess = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// RegisterRoutes mounts the token endpoint. It needs no prior auth: the
+// subject token is what is verified.
+func (e *Exchanger) RegisterRoutes(router gin.IRouter) {
+	router.POST("/oauth/token", e.token)
+}
+
+// oauthError writes an RFC 6749 error response.
+func oauthError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+func tokenType(t string) bool {
+	return t == TokenTypeJWT || t == TokenTypeAccess
+}
+
+// token exchanges a form-encoded subject_token for one scoped to audience.
+// Delegation with an actor_token is not supported; the gateway is always
+// the actor.
+func (e *Exchanger) token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	if c.PostForm("grant_type") != GrantType {
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be "+GrantType)
+		return
+	}
+	subject, audience := c.PostForm("subject_token"), c.PostForm("audience")
+	if subject == "" || audience == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "subject_token and audience are required")
+		return
+	}
+	if !tokenType(c.PostForm("subject_token_type")) {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "subject_token_type must be "+TokenTypeJWT+" or "+TokenTypeAccess)
+		return
+	}
+	requested := c.DefaultPostForm("requested_token_type", TokenTypeAccess)
+	if !tokenType(requested) {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "requested_token_type must be "+TokenTypeJWT+" or "+TokenTypeAccess)
+		return
+	}
+	if c.PostForm("actor_token") != "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "actor_token is not supported")
+		return
+	}
+
+	token, expires, err := e.Exchange(subject, audience)
+	if errors.Is(err, ErrUnknownAudience) {
+		oauthError(c, http.StatusBadRequest, "invalid_target", "unknown audience "+audience)
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrAlreadyExchanged) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	e.exchanged.Add(1)
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":      token,
+		"issued_token_type": requested,
+		"token_type":        "Bearer",
+		"expires_in":        int64(time.Until(expires).Round(time.Second).Seconds()),
+	})
+}
+
+// Handler reports the audiences tokens are exchanged for and how many
+// backend calls had their token exchanged or sent as it was.
+func (e *Exchanger) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		audiences := make([]string, 0, len(e.services))
+		for service := range e.services {
+			audiences = append(audiences, service)
+		}
+		sort.Strings(audiences)
+		c.JSON(http.StatusOK, gin.H{
+			"audiences":   audiences,
+			"ttl_seconds": int64(e.ttl.Seconds()),
+			"exchanged":   e.exchanged.Load(),
+			"unexchanged": e.forwarded.Load(),
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package tokenexchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func newExchanger(t *testing.T, urls ...string) (*Exchanger, *auth.Tokens) {
+	t.Helper()
+	tokens, err := auth.NewTokens("test-secret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create tokens: %v", err)
+	}
+	e := New(tokens, time.Minute)
+	if err := e.AddService("order-service", urls...); err != nil {
+		t.Fatalf("Failed to add order-service: %v", err)
+	}
+	return e, tokens
+}
+
+func TestTransport(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}))
+	defer backend.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}))
+	defer other.Close()
+
+	e, tokens := newExchanger(t, backend.URL, "")
+	client := auth.NewForwardingClient()
+	e.Wrap(client)
+	user, _, _ := tokens.IssueUser(42, []string{auth.RoleCustomer})
+
+	call := func(url, token string) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(auth.ContextWithToken(context.Background(), token), http.MethodGet, url, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	call(backend.URL, user)
+	p, err := tokens.ForAudience("order-service").Parse(got)
+	if err != nil || p.UserID != 42 || p.Actor != actor {
+		t.Errorf("Expected order-service to get customer 42 through the gateway, got: %+v, %v", p, err)
+	}
+	if _, err := tokens.ForAudience("user-service").Parse(got); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Expected the token sent to order-service to be scoped to it, got: %v", err)
+	}
+
+	call(other.URL, user)
+	if got != user {
+		t.Errorf("Expected calls to unknown hosts to carry the caller's token, got: %s", got)
+	}
+	call(backend.URL, "not-a-token")
+	if got != "not-a-token" {
+		t.Errorf("Expected an invalid token to be left for the backend to reject, got: %s", got)
+	}
+
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+	e.SetResolver(func(host string) (string, bool) { return "inventory-service", host == otherHost })
+	call(other.URL, user)
+	if p, err := tokens.ForAudience("inventory-service").Parse(got); err != nil || p.UserID != 42 {
+		t.Errorf("Expected a resolved backend to get a token scoped to it, got: %+v, %v", p, err)
+	}
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e, tokens := newExchanger(t, "http://order-service:50053")
+	router := gin.New()
+	e.RegisterRoutes(router)
+	user, _, _ := tokens.IssueUser(42, []string{auth.RoleCustomer})
+	exchanged, _, _ := e.Exchange(user, "order-service")
+
+	form := func(grant, subject, audience string) url.Values {
+		return url.Values{"grant_type": {grant}, "subject_token": {subject}, "subject_token_type": {TokenTypeAccess}, "audience": {audience}}
+	}
+	tests := []struct {
+		form url.Values
+		want int
+		code string
+	}{
+		{form: form(GrantType, user, "order-service"), want: http.StatusOK},
+		{form: form("client_credentials", user, "order-service"), want: http.StatusBadRequest, code: "unsupported_grant_type"},
+		{form: form(GrantType, "", "order-service"), want: http.StatusBadRequest, code: "invalid_request"},
+		{form: form(GrantType, user, "payment-service"), want: http.StatusBadRequest, code: "invalid_target"},
+		{form: form(GrantType, "not-a-token", "order-service"), want: http.StatusBadRequest, code: "invalid_grant"},
+		{form: form(GrantType, exchanged, "order-service"), want: http.StatusBadRequest, code: "invalid_grant"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(tt.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%v: expected status %d, got: %d %s", tt.form, tt.want, w.Code, w.Body)
+		}
+		var resp struct {
+			Error       string `json:"error"`
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Error != tt.code {
+			t.Errorf("%v: expected error %q, got: %s", tt.form, tt.code, w.Body)
+		}
+		if tt.want == http.StatusOK {
+			if _, err := tokens.ForAudience("order-service").Parse(resp.AccessToken); err != nil || resp.ExpiresIn != 60 {
+				t.Errorf("Expected a one minute token for order-service, got: %s, %v", w.Body, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package topology
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContentSecurityPolicy lets the HTML view style itself and load nothing.
+const ContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'"
+
+type Handler struct {
+	topology *Map
+}
+
+func NewHandler(topology *Map) *Handler {
+	return &Handler{topology: topology}
+}
+
+// RegisterAdminRoutes mounts the topology on an admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/topology", h.get)
+}
+
+// get answers JSON, or a page for a browser that prefers HTML or for
+// ?format=html.
+func (h *Handler) get(c *gin.Context) {
+	t := h.topology.Snapshot()
+	if c.Query("format") != "html" && c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) != gin.MIMEHTML {
+		c.JSON(http.StatusOK, t)
+		return
+	}
+	var page bytes.Buffer
+	if err := pageTemplate.Execute(&page, t); err != nil {
+		log.Printf("Failed to render topology: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "topology cannot be rendered"})
+		return
+	}
+	c.Header("Content-Security-Policy", ContentSecurityPolicy)
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+var pageTemplate = template.Must(template.New("topology").Funcs(template.FuncMap{
+	"percent": func(rate float64) float64 { return rate * 100 },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8" />
+  <meta http-equiv="refresh" content="15" />
+  <title>api-gateway - topology</title>
+  <style>
+    body { font-family: sans-serif; margin: 2em; }
+    table { border-collapse: collapse; margin-bottom: 2em; }
+    th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+    .healthy { color: #070; } .degraded { color: #a60; } .down { color: #c00; }
+  </style>
+</head>
+<body>
+  <h1>api-gateway topology</h1>
+  <p>Error rates over the last {{.ErrorWindow}}, as of {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}.</p>
+  {{range .Backends}}
+  <h2>{{.Name}} <span class="{{.Status}}">{{.Status}}</span></h2>
+  <table>
+    <tr><th>Instance</th><th>Role</th><th>Active</th><th>In flight</th><th>Calls</th><th>Errors</th><th>Breaker</th><th>Health</th></tr>
+    {{range .Instances}}
+    <tr>
+      <td>{{.URL}}</td>
+      <td>{{.Role}}</td>
+      <td>{{if .Active}}yes{{else}}no{{end}}</td>
+      <td>{{.InFlight}}</td>
+      <td>{{.RecentRequests}}</td>
+      <td>{{.RecentFailures}} ({{printf "%.1f" (percent .ErrorRate)}}%)</td>
+      <td>{{.Breaker}}</td>
+      <td>{{with .Readiness}}{{if .Ready}}ready{{else}}not ready{{if .Status}} ({{.Status}}){{end}}{{if .Error}}: {{.Error}}{{end}}{{end}}, {{printf "%.0f" .LatencyMS}} ms{{else}}not probed yet{{end}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+</body>
+</html>
+`))
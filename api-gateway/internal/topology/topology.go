@@ -0,0 +1,341 @@
+// Package topology maps the backends the gateway calls, for operators: each
+// backend with its instances, how the gateway's recent calls to them went,
+// their circuit breakers and what they last answered on /health.
+//
+// Instances come from the routing table, and a backend with a secondary
+// region shows both regions and which one is taking traffic. Error rates
+// are worked out from the outbound call counts, sampled every probe, so
+// they cover the last ErrorWindow rather than the whole process lifetime.
+package topology
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/routing"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/upstream"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// Instance roles.
+const (
+	RolePrimary   = upstream.Primary
+	RoleSecondary = upstream.Secondary
+	RoleInstance  = "instance"
+)
+
+// Backend statuses.
+const (
+	StatusHealthy  = "healthy"
+	StatusDegraded = "degraded"
+	StatusDown     = "down"
+)
+
+// degradedErrorRate is the share of recent calls to an instance that may
+// fail before its backend shows as degraded.
+const degradedErrorRate = 0.05
+
+// Options tune how often the map is refreshed.
+type Options struct {
+	// ProbeInterval is how often every instance's /health is checked and
+	// the call counts sampled.
+	ProbeInterval time.Duration
+	// ErrorWindow is how far back error rates look.
+	ErrorWindow time.Duration
+}
+
+// Map builds the topology from the routing table and the upstream groups.
+type Map struct {
+	routes    *routing.Table
+	upstreams *upstream.Router
+	metrics   *httpclient.Metrics
+	breakers  func() []httpclient.BreakerState
+	probe     *http.Client
+	opts      Options
+	now       func() time.Time
+
+	mu        sync.Mutex
+	samples   []sample
+	readiness map[string]Readiness
+}
+
+// sample is the outbound call counts per host at one moment.
+type sample struct {
+	at    time.Time
+	hosts map[string]counts
+}
+
+type counts struct{ requests, failures int64 }
+
+// New maps the backends of routes, with the regions of upstreams.
+func New(routes *routing.Table, upstreams *upstream.Router, opts Options) *Map {
+	// Probes are left out of the call counts and the breakers, so they do
+	// not water down the error rate of the traffic being mapped.
+	cfg := httpclient.ConfigFromEnv()
+	cfg.Retries, cfg.BreakerThreshold = 0, 0
+	probe := httpclient.NewWithConfig(cfg)
+	if t, ok := probe.Transport.(*httpclient.Transport); ok {
+		t.Metrics = nil
+	}
+	return &Map{
+		routes:    routes,
+		upstreams: upstreams,
+		metrics:   httpclient.DefaultMetrics,
+		breakers:  httpclient.BreakerSnapshot,
+		probe:     probe,
+		opts:      opts,
+		now:       time.Now,
+		readiness: map[string]Readiness{},
+	}
+}
+
+// Readiness is what an instance last answered on /health.
+type Readiness struct {
+	Ready     bool      `json:"ready"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Instance is one place a backend runs. Active is false for a region the
+// gateway is not sending traffic to. Readiness is left out until the
+// instance has been probed.
+type Instance struct {
+	URL            string     `json:"url"`
+	Role           string     `json:"role"`
+	Active         bool       `json:"active"`
+	InFlight       int64      `json:"in_flight"`
+	RecentRequests int64      `json:"recent_requests"`
+	RecentFailures int64      `json:"recent_failures"`
+	ErrorRate      float64    `json:"error_rate"`
+	Breaker        string     `json:"breaker"`
+	Readiness      *Readiness `json:"readiness,omitempty"`
+}
+
+// Backend is a service the gateway calls. It is down when none of its
+// active instances can take traffic, and degraded when any instance is
+// failing its probe, failing calls or has a breaker that is not closed.
+type Backend struct {
+	Name      string     `json:"name"`
+	BuiltIn   bool       `json:"built_in"`
+	Status    string     `json:"status"`
+	Instances []Instance `json:"instances"`
+}
+
+// Topology is the map as GET /admin/topology shows it.
+type Topology struct {
+	Backends    []Backend `json:"backends"`
+	ErrorWindow string    `json:"error_window"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// Snapshot returns the topology now, by backend name.
+func (m *Map) Snapshot() Topology {
+	recent := m.recent()
+	breakers := m.breakerStates()
+	m.mu.Lock()
+	readiness := make(map[string]Readiness, len(m.readiness))
+	for u, r := range m.readiness {
+		readiness[u] = r
+	}
+	m.mu.Unlock()
+
+	t := Topology{Backends: []Backend{}, ErrorWindow: m.opts.ErrorWindow.String(), GeneratedAt: m.now().UTC()}
+	for _, b := range m.backends() {
+		for i := range b.Instances {
+			in := &b.Instances[i]
+			host := hostOf(in.URL)
+			c := recent[host]
+			in.RecentRequests, in.RecentFailures = c.requests, c.failures
+			if c.requests > 0 {
+				in.ErrorRate = float64(c.failures) / float64(c.requests)
+			}
+			in.Breaker = httpclient.BreakerClosed
+			if state, ok := breakers[host]; ok {
+				in.Breaker = state
+			}
+			if r, ok := readiness[in.URL]; ok {
+				in.Readiness = &r
+			}
+		}
+		b.Status = status(b.Instances)
+		t.Backends = append(t.Backends, b)
+	}
+	return t
+}
+
+// status sums up a backend from its instances. Instances not probed yet
+// are taken to be ready.
+func status(instances []Instance) string {
+	usable, degraded := 0, false
+	for _, in := range instances {
+		ready := in.Readiness == nil || in.Readiness.Ready
+		if !ready || in.Breaker != httpclient.BreakerClosed || in.ErrorRate > degradedErrorRate {
+			degraded = true
+		}
+		if in.Active && ready && in.Breaker != httpclient.BreakerOpen {
+			usable++
+		}
+	}
+	switch {
+	case usable == 0:
+		return StatusDown
+	case degraded:
+		return StatusDegraded
+	}
+	return StatusHealthy
+}
+
+// backends lists the routing table's backends with their instances, and
+// both regions of those with a secondary.
+func (m *Map) backends() []Backend {
+	regions := map[string]upstream.Status{}
+	if m.upstreams != nil {
+		for _, s := range m.upstreams.Statuses() {
+			regions[s.Service] = s
+		}
+	}
+
+	var backends []Backend
+	for _, b := range m.routes.State().Backends {
+		backend := Backend{Name: b.Name, BuiltIn: b.BuiltIn}
+		switch s, ok := regions[b.Name]; {
+		case ok:
+			backend.Instances = []Instance{
+				{URL: s.Primary, Role: RolePrimary, Active: s.Active == upstream.Primary},
+				{URL: s.Secondary, Role: RoleSecondary, Active: s.Active == upstream.Secondary},
+			}
+		case len(b.Instances) > 0:
+			for _, in := range b.Instances {
+				backend.Instances = append(backend.Instances, Instance{URL: in.URL, Role: RoleInstance, Active: true, InFlight: in.InFlight})
+			}
+		default:
+			backend.Instances = []Instance{{URL: strings.TrimRight(b.URL, "/"), Role: RolePrimary, Active: true}}
+		}
+		backends = append(backends, backend)
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Name < backends[j].Name })
+	return backends
+}
+
+// breakerStates returns the worst breaker state of each host. Every
+// client has its own breakers, so a host may have several.
+func (m *Map) breakerStates() map[string]string {
+	rank := map[string]int{httpclient.BreakerClosed: 0, httpclient.BreakerHalfOpen: 1, httpclient.BreakerOpen: 2}
+	states := map[string]string{}
+	for _, b := range m.breakers() {
+		if current, ok := states[b.Host]; !ok || rank[b.State] > rank[current] {
+			states[b.Host] = b.State
+		}
+	}
+	return states
+}
+
+// recent returns each host's calls since the oldest sample in the window,
+// or since the process started before the first sample.
+func (m *Map) recent() map[string]counts {
+	current := countsOf(m.metrics)
+	m.mu.Lock()
+	var base map[string]counts
+	if len(m.samples) > 0 {
+		base = m.samples[0].hosts
+	}
+	m.mu.Unlock()
+	for host, c := range current {
+		b := base[host]
+		current[host] = counts{requests: c.requests - b.requests, failures: c.failures - b.failures}
+	}
+	return current
+}
+
+func countsOf(metrics *httpclient.Metrics) map[string]counts {
+	hosts := map[string]counts{}
+	for _, s := range metrics.Snapshot() {
+		hosts[s.Host] = counts{requests: s.Requests, failures: s.Failures}
+	}
+	return hosts
+}
+
+// record keeps a sample of the call counts, dropping those that have left
+// the window.
+func (m *Map) record() {
+	now := m.now()
+	s := sample{at: now, hosts: countsOf(m.metrics)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, s)
+	cutoff := now.Add(-m.opts.ErrorWindow)
+	for len(m.samples) > 1 && m.samples[0].at.Before(cutoff) {
+		m.samples = m.samples[1:]
+	}
+}
+
+// Run probes every ProbeInterval until ctx is done.
+func (m *Map) Run(ctx context.Context) {
+	m.Probe(ctx)
+	ticker := time.NewTicker(m.opts.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Probe(ctx)
+		}
+	}
+}
+
+// Probe samples the call counts and checks every instance's /health.
+func (m *Map) Probe(ctx context.Context) {
+	m.record()
+	var wg sync.WaitGroup
+	for _, b := range m.backends() {
+		for _, in := range b.Instances {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				r := m.check(ctx, target)
+				if ctx.Err() != nil {
+					return
+				}
+				m.mu.Lock()
+				m.readiness[target] = r
+				m.mu.Unlock()
+			}(in.URL)
+		}
+	}
+	wg.Wait()
+}
+
+func (m *Map) check(ctx context.Context, target string) Readiness {
+	start := m.now()
+	r := Readiness{CheckedAt: start.UTC()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target+"/health", nil)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	resp, err := m.probe.Do(req)
+	r.LatencyMS = float64(m.now().Sub(start).Microseconds()) / 1000
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	resp.Body.Close()
+	r.Status, r.Ready = resp.StatusCode, resp.StatusCode == http.StatusOK
+	return r
+}
+
+func hostOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
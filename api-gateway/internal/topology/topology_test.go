@@ -0,0 +1,129 @@
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/api-gateway/internal/routing"
+	"github.com/alux444/go-microserv-test/api-gateway/internal/upstream"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/gin-gonic/gin"
+)
+
+func backend(t *testing.T, healthStatus int) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(healthStatus)
+			return
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSnapshot(t *testing.T) {
+	users := backend(t, http.StatusOK)
+	ordersPrimary := backend(t, http.StatusServiceUnavailable)
+	ordersSecondary := backend(t, http.StatusOK)
+
+	routes, err := routing.New("", map[string]string{"user-service": users.URL, "order-service": ordersPrimary.URL}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create routing table: %v", err)
+	}
+	upstreams := upstream.New(upstream.Options{FailureThreshold: 1, ProbeInterval: time.Minute, RecoveryProbes: 1, LatencyTolerance: 1})
+	if err := upstreams.Add("order-service", ordersPrimary.URL, ordersSecondary.URL); err != nil {
+		t.Fatalf("Failed to add upstream: %v", err)
+	}
+	m := New(routes, upstreams, Options{ProbeInterval: time.Minute, ErrorWindow: 5 * time.Minute})
+	m.metrics = httpclient.NewMetrics()
+	m.breakers = func() []httpclient.BreakerState {
+		host := strings.TrimPrefix(ordersPrimary.URL, "http://")
+		return []httpclient.BreakerState{{Host: host, State: httpclient.BreakerClosed}, {Host: host, State: httpclient.BreakerOpen}}
+	}
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	client := &http.Client{Transport: &httpclient.Transport{Base: http.DefaultTransport, Metrics: m.metrics}}
+	call := func(url string) {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Failed to call %s: %v", url, err)
+		}
+		resp.Body.Close()
+	}
+	call(users.URL + "/fail")
+	m.Probe(context.Background())
+	now = now.Add(6 * time.Minute)
+	m.Probe(context.Background())
+	for i := 0; i < 3; i++ {
+		call(users.URL + "/users")
+	}
+	call(users.URL + "/fail")
+
+	topology := m.Snapshot()
+	if len(topology.Backends) != 2 || topology.Backends[0].Name != "order-service" || topology.Backends[1].Name != "user-service" {
+		t.Fatalf("Expected both backends by name, got: %+v", topology.Backends)
+	}
+	userService := topology.Backends[1]
+	in := userService.Instances[0]
+	if in.RecentRequests != 4 || in.RecentFailures != 1 || in.ErrorRate != 0.25 {
+		t.Errorf("Expected calls older than the window left out, got: %+v", in)
+	}
+	if in.Readiness == nil || !in.Readiness.Ready || userService.Status != StatusDegraded {
+		t.Errorf("Expected a ready instance failing calls to be degraded, got: %s %+v", userService.Status, in.Readiness)
+	}
+
+	orderService := topology.Backends[0]
+	primary, secondary := orderService.Instances[0], orderService.Instances[1]
+	if primary.Role != RolePrimary || !primary.Active || primary.Breaker != httpclient.BreakerOpen || primary.Readiness.Ready || primary.Readiness.Status != http.StatusServiceUnavailable {
+		t.Errorf("Expected the primary active, open and not ready, got: %+v %+v", primary, primary.Readiness)
+	}
+	if secondary.Role != RoleSecondary || secondary.Active || !secondary.Readiness.Ready {
+		t.Errorf("Expected an idle ready secondary, got: %+v", secondary)
+	}
+	if orderService.Status != StatusDown {
+		t.Errorf("Expected order-service down with its only active region unusable, got: %s", orderService.Status)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	users := backend(t, http.StatusOK)
+	routes, _ := routing.New("", map[string]string{"user-service": users.URL}, nil)
+	m := New(routes, nil, Options{ProbeInterval: time.Minute, ErrorWindow: 5 * time.Minute})
+	router := gin.New()
+	NewHandler(m).RegisterAdminRoutes(router.Group("/admin"))
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/admin/topology", "")
+	var topology Topology
+	if err := json.Unmarshal(w.Body.Bytes(), &topology); err != nil || len(topology.Backends) != 1 || topology.Backends[0].Status != StatusHealthy {
+		t.Errorf("Expected an unprobed backend to be healthy, got: %d %s", w.Code, w.Body)
+	}
+	if topology.Backends[0].Instances[0].Readiness != nil {
+		t.Errorf("Expected no readiness before the first probe, got: %+v", topology.Backends[0].Instances[0].Readiness)
+	}
+
+	m.Probe(context.Background())
+	for _, w := range []*httptest.ResponseRecorder{get("/admin/topology", "text/html,*/*;q=0.8"), get("/admin/topology?format=html", "")} {
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") ||
+			w.Header().Get("Content-Security-Policy") != ContentSecurityPolicy || !strings.Contains(w.Body.String(), users.URL) {
+			t.Errorf("Expected the HTML view, got: %d %v %s", w.Code, w.Header(), w.Body)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	router *Router
+}
+
+func NewHandler(router *Router) *Handler {
+	return &Handler{router: router}
+}
+
+// RegisterAdminRoutes mounts upstream inspection and pinning on an
+// admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/upstreams", h.list)
+	router.PUT("/upstreams/:service/pin", h.pin)
+	router.DELETE("/upstreams/:service/pin", h.unpin)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"upstreams": h.router.Statuses()})
+}
+
+type pinRequest struct {
+	Target string `json:"target" binding:"required,oneof=primary secondary"`
+	Actor  string `json:"actor" binding:"max=255"`
+}
+
+func (h *Handler) pin(c *gin.Context) {
+	var req pinRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.respond(c, req.Target, req.Actor)
+}
+
+func (h *Handler) unpin(c *gin.Context) {
+	h.respond(c, "", c.Query("actor"))
+}
+
+func (h *Handler) respond(c *gin.Context, target, actor string) {
+	status, err := h.router.Pin(c.Param("service"), target)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if target == "" {
+		log.Printf("Upstream %s unpinned by %q from %s", status.Service, actor, c.ClientIP())
+	} else {
+		log.Printf("Upstream %s pinned to %s by %q from %s", status.Service, target, actor, c.ClientIP())
+	}
+	c.JSON(http.StatusOK, status)
+}
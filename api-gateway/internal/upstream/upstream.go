@@ -0,0 +1,357 @@
+// Package upstream fails a backend over from its primary region to a
+// secondary one.
+//
+// Calls to a backend are addressed to its primary URL. While the primary is
+// failing, the gateway's transport sends them to the secondary instead, and
+// health probes decide when the primary is fit to take traffic back.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// Targets of a group.
+const (
+	Primary   = "primary"
+	Secondary = "secondary"
+)
+
+var ErrNotFound = errors.New("upstream not found")
+
+// Options tune when a group fails over and back.
+type Options struct {
+	// FailureThreshold is how many calls in a row to the primary may get no
+	// response, or a 502, 503 or 504, before traffic moves to the secondary.
+	FailureThreshold int
+	// ProbeInterval is how often both regions' /health are probed.
+	ProbeInterval time.Duration
+	// RecoveryProbes is how many probes in a row the primary must pass
+	// before traffic moves back to it.
+	RecoveryProbes int
+	// LatencyTolerance is how much slower than the secondary, as a multiple
+	// of its probe latency, the primary may be and still take traffic back.
+	LatencyTolerance float64
+}
+
+// Router holds the groups of every backend with a secondary region.
+type Router struct {
+	opts  Options
+	probe *http.Client
+	now   func() time.Time
+
+	mu     sync.Mutex
+	groups map[string]*group
+}
+
+type group struct {
+	service            string
+	primary, secondary *url.URL
+	active             string
+	pinned             string
+	failures           int
+	recovered          int
+	switchedAt         time.Time
+	reason             string
+	latency            map[string]time.Duration
+	healthy            map[string]bool
+}
+
+// Status is one group as GET /admin/upstreams shows it.
+type Status struct {
+	Service             string    `json:"service"`
+	Primary             string    `json:"primary"`
+	Secondary           string    `json:"secondary"`
+	Active              string    `json:"active"`
+	Pinned              string    `json:"pinned,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	PrimaryHealthy      bool      `json:"primary_healthy"`
+	SecondaryHealthy    bool      `json:"secondary_healthy"`
+	PrimaryLatencyMS    float64   `json:"primary_latency_ms"`
+	SecondaryLatencyMS  float64   `json:"secondary_latency_ms"`
+	SwitchedAt          time.Time `json:"switched_at"`
+	Reason              string    `json:"reason,omitempty"`
+}
+
+func New(opts Options) *Router {
+	return &Router{opts: opts, probe: httpclient.New(), now: time.Now, groups: map[string]*group{}}
+}
+
+// Add gives service a secondary region. Calls to primaryURL's host are then
+// routed by the group. A service without a secondary is left alone.
+func (r *Router) Add(service, primaryURL, secondaryURL string) error {
+	if secondaryURL == "" {
+		return nil
+	}
+	primary, err := parseTarget(primaryURL)
+	if err != nil {
+		return fmt.Errorf("%s primary: %w", service, err)
+	}
+	secondary, err := parseTarget(secondaryURL)
+	if err != nil {
+		return fmt.Errorf("%s secondary: %w", service, err)
+	}
+	if primary.Host == secondary.Host {
+		return fmt.Errorf("%s: primary and secondary are both %s", service, primary.Host)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.groups[primary.Host] = &group{
+		service:    service,
+		primary:    primary,
+		secondary:  secondary,
+		active:     Primary,
+		switchedAt: r.now().UTC(),
+		latency:    map[string]time.Duration{},
+		healthy:    map[string]bool{Primary: true, Secondary: true},
+	}
+	return nil
+}
+
+func parseTarget(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimRight(raw, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute URL", raw)
+	}
+	return u, nil
+}
+
+// Wrap routes client's calls through the groups.
+func (r *Router) Wrap(client *http.Client) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &Transport{Base: base, Router: r}
+}
+
+// Transport sends each call addressed to a group's primary to whichever
+// region the group is routing to, and counts the primary's failures.
+type Transport struct {
+	Base   http.RoundTripper
+	Router *Router
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g, target := t.Router.route(req.URL.Host)
+	if g == nil {
+		return t.Base.RoundTrip(req)
+	}
+	if target == Secondary {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host, req.Host = g.secondary.Scheme, g.secondary.Host, ""
+		req.URL.Path, req.URL.RawPath = g.secondary.Path+strings.TrimPrefix(req.URL.Path, g.primary.Path), ""
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if req.Context().Err() == nil {
+		t.Router.record(g, target, failed(resp, err))
+	}
+	return resp, err
+}
+
+// failed reports whether a call's outcome counts against its region. A 500
+// is the backend answering about one request, so it does not count.
+func failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (r *Router) route(host string) (*group, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.groups[host]
+	if !ok {
+		return nil, ""
+	}
+	if g.pinned != "" {
+		return g, g.pinned
+	}
+	return g, g.active
+}
+
+func (r *Router) record(g *group, target string, callFailed bool) {
+	if target != Primary {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !callFailed {
+		g.failures = 0
+		return
+	}
+	g.failures++
+	if g.active == Primary && g.failures >= r.opts.FailureThreshold {
+		r.switchTo(g, Secondary, fmt.Sprintf("%d failed calls in a row to the primary", g.failures))
+	}
+}
+
+// switchTo must be called with r.mu held.
+func (r *Router) switchTo(g *group, target, reason string) {
+	g.active, g.reason, g.switchedAt, g.recovered = target, reason, r.now().UTC(), 0
+	if target == Primary {
+		g.failures = 0
+	}
+	if g.pinned != "" {
+		log.Printf("Upstream %s would switch to %s (%s) but is pinned to %s", g.service, target, reason, g.pinned)
+		return
+	}
+	if target == Secondary {
+		log.Printf("Upstream %s failed over to %s: %s", g.service, g.secondary.Host, reason)
+		return
+	}
+	log.Printf("Upstream %s moved back to %s: %s", g.service, g.primary.Host, reason)
+}
+
+// Run probes every group each ProbeInterval until ctx is done.
+func (r *Router) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Probe(ctx)
+		}
+	}
+}
+
+// Probe checks both regions of every group and moves a group back to its
+// primary once the primary has passed RecoveryProbes probes in a row and is
+// not much slower than the secondary. A group whose secondary fails its
+// probe goes back as soon as the primary passes one.
+func (r *Router) Probe(ctx context.Context) {
+	r.mu.Lock()
+	groups := make([]*group, 0, len(r.groups))
+	for _, g := range r.groups {
+		groups = append(groups, g)
+	}
+	r.mu.Unlock()
+
+	for _, g := range groups {
+		primaryOK, primaryLatency := r.check(ctx, g.primary)
+		secondaryOK, secondaryLatency := r.check(ctx, g.secondary)
+		if ctx.Err() != nil {
+			return
+		}
+
+		r.mu.Lock()
+		g.healthy[Primary], g.healthy[Secondary] = primaryOK, secondaryOK
+		g.latency[Primary] = smooth(g.latency[Primary], primaryLatency)
+		g.latency[Secondary] = smooth(g.latency[Secondary], secondaryLatency)
+		if g.active == Secondary {
+			if primaryOK {
+				g.recovered++
+			} else {
+				g.recovered = 0
+			}
+			switch {
+			case primaryOK && !secondaryOK:
+				r.switchTo(g, Primary, "the secondary failed its health check")
+			case g.recovered >= r.opts.RecoveryProbes && r.fastEnough(g):
+				r.switchTo(g, Primary, fmt.Sprintf("passed %d health checks in a row", g.recovered))
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// fastEnough must be called with r.mu held.
+func (r *Router) fastEnough(g *group) bool {
+	return float64(g.latency[Primary]) <= float64(g.latency[Secondary])*r.opts.LatencyTolerance
+}
+
+// smooth averages probe latencies so one slow probe does not hold traffic
+// on the secondary.
+func smooth(previous, latest time.Duration) time.Duration {
+	if previous == 0 {
+		return latest
+	}
+	return (previous*7 + latest*3) / 10
+}
+
+func (r *Router) check(ctx context.Context, target *url.URL) (bool, time.Duration) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String()+"/health", nil)
+	if err != nil {
+		return false, 0
+	}
+	start := r.now()
+	resp, err := r.probe.Do(req)
+	latency := r.now().Sub(start)
+	if err != nil {
+		return false, latency
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, latency
+}
+
+// Pin sends every call for service to target, primary or secondary, until
+// it is unpinned with an empty target. Automatic switching resumes from
+// wherever the group would have been.
+func (r *Router) Pin(service, target string) (Status, error) {
+	if target != "" && target != Primary && target != Secondary {
+		return Status{}, fmt.Errorf("unknown target %q, want primary or secondary", target)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, g := range r.groups {
+		if g.service == service {
+			g.pinned = target
+			return g.status(), nil
+		}
+	}
+	return Status{}, ErrNotFound
+}
+
+// Statuses lists every group, by service.
+func (r *Router) Statuses() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]Status, 0, len(r.groups))
+	for _, g := range r.groups {
+		statuses = append(statuses, g.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Service < statuses[j].Service })
+	return statuses
+}
+
+// status must be called with the router's mutex held.
+func (g *group) status() Status {
+	active := g.active
+	if g.pinned != "" {
+		active = g.pinned
+	}
+	return Status{
+		Service:             g.service,
+		Primary:             g.primary.String(),
+		Secondary:           g.secondary.String(),
+		Active:              active,
+		Pinned:              g.pinned,
+		ConsecutiveFailures: g.failures,
+		PrimaryHealthy:      g.healthy[Primary],
+		SecondaryHealthy:    g.healthy[Secondary],
+		PrimaryLatencyMS:    float64(g.latency[Primary]) / float64(time.Millisecond),
+		SecondaryLatencyMS:  float64(g.latency[Secondary]) / float64(time.Millisecond),
+		SwitchedAt:          g.switchedAt,
+		Reason:              g.reason,
+	}
+}
@@ -0,0 +1,200 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type region struct {
+	server  *httptest.Server
+	down    atomic.Bool
+	hits    atomic.Int32
+	lastURI atomic.Value
+}
+
+func newRegion(t *testing.T, name string) *region {
+	r := &region{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.URL.Path != "/health" {
+			r.hits.Add(1)
+			r.lastURI.Store(req.URL.RequestURI())
+		}
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func newRouter(t *testing.T, opts Options) (*Router, *region, *region, *http.Client) {
+	primary, secondary := newRegion(t, "primary"), newRegion(t, "secondary")
+	r := New(opts)
+	clock := time.Unix(0, 0)
+	// Every reading is a millisecond later, so both regions probe at the
+	// same latency.
+	r.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+	if err := r.Add("order-service", primary.server.URL, secondary.server.URL+"/eu"); err != nil {
+		t.Fatalf("Failed to add the group: %v", err)
+	}
+	client := &http.Client{}
+	r.Wrap(client)
+	return r, primary, secondary, client
+}
+
+func call(t *testing.T, client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to call %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestFailover(t *testing.T) {
+	r, primary, secondary, client := newRouter(t, Options{FailureThreshold: 3, RecoveryProbes: 2, LatencyTolerance: 1.5})
+
+	primary.down.Store(true)
+	for i := 0; i < 3; i++ {
+		call(t, client, primary.server.URL+"/orders?status=open")
+	}
+	if got := call(t, client, primary.server.URL+"/orders?status=open"); got != "secondary" {
+		t.Fatalf("Expected calls to fail over after 3 failures, got: %q", got)
+	}
+	if got := secondary.lastURI.Load(); got != "/eu/orders?status=open" {
+		t.Errorf("Expected the secondary's path and the query to be kept, got: %v", got)
+	}
+	if s := r.Statuses()[0]; s.Active != Secondary || s.Reason == "" {
+		t.Errorf("Expected the status to show the failover, got: %+v", s)
+	}
+
+	r.Probe(context.Background())
+	if got := call(t, client, primary.server.URL+"/orders"); got != "secondary" {
+		t.Fatalf("Expected traffic to stay on the secondary while the primary is down, got: %q", got)
+	}
+
+	primary.down.Store(false)
+	r.Probe(context.Background())
+	if got := call(t, client, primary.server.URL+"/orders"); got != "secondary" {
+		t.Fatalf("Expected one healthy probe not to be enough, got: %q", got)
+	}
+	r.Probe(context.Background())
+	if got := call(t, client, primary.server.URL+"/orders"); got != "primary" {
+		t.Fatalf("Expected traffic back on the primary after 2 healthy probes, got: %q", got)
+	}
+}
+
+func TestFailbackWaitsForLatency(t *testing.T) {
+	r, primary, _, client := newRouter(t, Options{FailureThreshold: 1, RecoveryProbes: 1, LatencyTolerance: 0.5})
+
+	primary.down.Store(true)
+	call(t, client, primary.server.URL+"/orders")
+	primary.down.Store(false)
+	for i := 0; i < 3; i++ {
+		r.Probe(context.Background())
+	}
+	if got := call(t, client, primary.server.URL+"/orders"); got != "secondary" {
+		t.Errorf("Expected a primary no faster than half the secondary's latency to wait, got: %q", got)
+	}
+
+	r.opts.LatencyTolerance = 1.5
+	r.Probe(context.Background())
+	if got := call(t, client, primary.server.URL+"/orders"); got != "primary" {
+		t.Errorf("Expected a primary within tolerance to take traffic back, got: %q", got)
+	}
+}
+
+func TestFailbackWhenSecondaryFails(t *testing.T) {
+	r, primary, secondary, client := newRouter(t, Options{FailureThreshold: 1, RecoveryProbes: 5, LatencyTolerance: 1.5})
+
+	primary.down.Store(true)
+	call(t, client, primary.server.URL+"/orders")
+	primary.down.Store(false)
+	secondary.down.Store(true)
+	r.Probe(context.Background())
+	if got := call(t, client, primary.server.URL+"/orders"); got != "primary" {
+		t.Errorf("Expected a failing secondary to hand back to a healthy primary at once, got: %q", got)
+	}
+}
+
+func TestOtherHostsAreUntouched(t *testing.T) {
+	_, _, _, client := newRouter(t, Options{FailureThreshold: 1})
+	other := newRegion(t, "other")
+	if got := call(t, client, other.server.URL+"/users"); got != "other" || other.hits.Load() != 1 {
+		t.Errorf("Expected calls to other hosts to pass through, got: %q", got)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	r := New(Options{})
+	if err := r.Add("user-service", "http://user-service:50054", ""); err != nil || len(r.Statuses()) != 0 {
+		t.Errorf("Expected a service without a secondary to be skipped, got: %v", err)
+	}
+	if err := r.Add("user-service", "http://user-service:50054", "user-service:50054"); err == nil {
+		t.Error("Expected a relative secondary URL to be rejected")
+	}
+	if err := r.Add("user-service", "http://user-service:50054", "https://user-service:50054"); err == nil {
+		t.Error("Expected a secondary on the primary's host to be rejected")
+	}
+}
+
+func TestPinHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r, primary, _, client := newRouter(t, Options{FailureThreshold: 3})
+	router := gin.New()
+	NewHandler(r).RegisterAdminRoutes(router)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := serve(http.MethodPut, "/upstreams/order-service/pin", `{"target": "secondary", "actor": "ana"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"pinned":"secondary"`) {
+		t.Fatalf("Expected the pin to be accepted, got: %d %s", w.Code, w.Body.String())
+	}
+	if got := call(t, client, primary.server.URL+"/orders"); got != "secondary" {
+		t.Errorf("Expected a healthy primary to be bypassed while pinned, got: %q", got)
+	}
+
+	primary.down.Store(true)
+	if w := serve(http.MethodPut, "/upstreams/order-service/pin", `{"target": "primary"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the pin to move, got: %d", w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		call(t, client, primary.server.URL+"/orders")
+	}
+	if s := r.Statuses()[0]; s.Active != Primary {
+		t.Errorf("Expected failures not to move a pinned group, got: %+v", s)
+	}
+
+	if w := serve(http.MethodDelete, "/upstreams/order-service/pin?actor=ana", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "pinned") {
+		t.Fatalf("Expected the pin to be removed, got: %d %s", w.Code, w.Body.String())
+	}
+	if got := call(t, client, primary.server.URL+"/orders"); got != "secondary" {
+		t.Errorf("Expected the failover held back by the pin to apply once unpinned, got: %q", got)
+	}
+
+	if w := serve(http.MethodPut, "/upstreams/order-service/pin", `{"target": "tertiary"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown target to be rejected, got: %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/upstreams/user-service/pin", `{"target": "primary"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown service to be 404, got: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/upstreams", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"service":"order-service"`) {
+		t.Errorf("Expected the upstream list, got: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,307 @@
+// Package audit records every mutating request a service handles: who made
+// it, the route and the entity it touched, how it ended and, where it is
+// cheap to tell, which fields it changed. Compliance reads the log back
+// through Handler.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	contextKey = "audit.entry"
+	// maxBody is the largest JSON request body whose fields are recorded.
+	// Larger bodies, and bodies of other types, are passed through unread.
+	maxBody = 64 << 10
+	// Redacted replaces the value of a sensitive field.
+	Redacted = "[redacted]"
+)
+
+// sensitive are field names whose values are never recorded. A field whose
+// name contains "password", "secret" or "token" is redacted as well.
+var sensitive = map[string]bool{
+	"code":        true,
+	"otp":         true,
+	"card_number": true,
+	"cvc":         true,
+	"cvv":         true,
+	"api_key":     true,
+}
+
+// Entry is one request. Changes maps each field the request set to its
+// value after the request and, when the handler reported it, before.
+type Entry struct {
+	ID         int64             `json:"id"`
+	Tenant     string            `json:"tenant"`
+	Actor      string            `json:"actor"`
+	Method     string            `json:"method"`
+	Route      string            `json:"route"`
+	Path       string            `json:"path"`
+	EntityType string            `json:"entity_type,omitempty"`
+	EntityID   string            `json:"entity_id,omitempty"`
+	StatusCode int               `json:"status_code"`
+	RequestID  string            `json:"request_id,omitempty"`
+	ClientIP   string            `json:"client_ip,omitempty"`
+	Changes    map[string]Change `json:"changes,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// Change is one field's value before and after the request. Before is
+// omitted when the handler did not report it.
+type Change struct {
+	Before any `json:"before,omitempty"`
+	After  any `json:"after,omitempty"`
+}
+
+// pending is what handlers add to the entry while the request runs.
+type pending struct {
+	entityType, entityID string
+	before, after        any
+}
+
+// Recorder installs the middleware that writes entries to a store.
+type Recorder struct {
+	store  Store
+	redact map[string]bool
+}
+
+// NewRecorder also redacts the fields named in redact, such as personal
+// data a service keeps encrypted.
+func NewRecorder(store Store, redact ...string) *Recorder {
+	r := &Recorder{store: store, redact: map[string]bool{}}
+	for _, field := range redact {
+		r.redact[field] = true
+	}
+	return r
+}
+
+// Middleware records POST, PUT, PATCH and DELETE requests that matched a
+// route, whether they succeeded or not. It must run after auth.Authenticate
+// and tenant.Middleware.
+func (r *Recorder) Middleware() gin.HandlerFunc {
+	return r.middleware("")
+}
+
+// AdminMiddleware records requests on routes behind the admin token, which
+// carry no principal, as made by "admin".
+func (r *Recorder) AdminMiddleware() gin.HandlerFunc {
+	return r.middleware("admin")
+}
+
+func (r *Recorder) middleware(actor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+		body := peekJSON(c.Request)
+		p := &pending{}
+		c.Set(contextKey, p)
+		c.Next()
+
+		if c.FullPath() == "" {
+			return
+		}
+		e := &Entry{
+			Tenant:     tenant.FromContext(c.Request.Context()),
+			Actor:      actorOf(c, actor),
+			Method:     c.Request.Method,
+			Route:      c.FullPath(),
+			Path:       c.Request.URL.Path,
+			EntityType: p.entityType,
+			EntityID:   p.entityID,
+			StatusCode: c.Writer.Status(),
+			RequestID:  requestid.FromContext(c.Request.Context()),
+			ClientIP:   c.ClientIP(),
+		}
+		if e.EntityType == "" {
+			e.EntityType, e.EntityID = entityOf(c)
+		}
+		e.Changes = r.changes(p, body)
+		// Written against a detached context, so a client hanging up does
+		// not lose the entry.
+		if err := r.store.Record(context.WithoutCancel(c.Request.Context()), e); err != nil {
+			log.Printf("Failed to record audit entry for %s %s: %v", e.Method, e.Path, err)
+		}
+	}
+}
+
+// SetEntity names the entity the request touched, for handlers whose route
+// does not name it, such as creates.
+func SetEntity(c *gin.Context, entityType, id string) {
+	if p := current(c); p != nil {
+		p.entityType, p.entityID = entityType, id
+	}
+}
+
+// SetBefore reports the entity as it was before the request, so its entry
+// shows the old value of each field the request set.
+func SetBefore(c *gin.Context, v any) {
+	if p := current(c); p != nil {
+		p.before = v
+	}
+}
+
+// SetAfter reports the entity as the request left it, for handlers whose
+// request body does not say, such as state transitions. Without it the
+// fields of the request body are taken as the new values.
+func SetAfter(c *gin.Context, v any) {
+	if p := current(c); p != nil {
+		p.after = v
+	}
+}
+
+func current(c *gin.Context) *pending {
+	v, ok := c.Get(contextKey)
+	if !ok {
+		return nil
+	}
+	return v.(*pending)
+}
+
+func actorOf(c *gin.Context, fallback string) string {
+	p, ok := auth.FromContext(c)
+	switch {
+	case ok && p.Service != "":
+		return "service:" + p.Service
+	case ok:
+		return "user:" + strconv.Itoa(p.UserID)
+	case fallback != "":
+		return fallback
+	default:
+		return "anonymous"
+	}
+}
+
+// entityOf guesses the entity from the route: the last literal segment
+// before the first parameter, and that parameter's value. For
+// /orders/:id/cancel it is orders and the order's id; for /admin/drain
+// it is drain.
+func entityOf(c *gin.Context) (string, string) {
+	entityType := ""
+	for _, segment := range strings.Split(strings.Trim(c.FullPath(), "/"), "/") {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			return entityType, c.Param(segment[1:])
+		}
+		if segment != "admin" {
+			entityType = segment
+		}
+	}
+	return entityType, ""
+}
+
+// peekJSON returns the fields of a JSON object body, leaving the body for
+// the handler to read.
+func peekJSON(req *http.Request) map[string]any {
+	if req.Body == nil || req.ContentLength > maxBody || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	head, err := io.ReadAll(io.LimitReader(req.Body, maxBody+1))
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+	if err != nil || len(head) > maxBody {
+		return nil
+	}
+	var fields map[string]any
+	if json.Unmarshal(head, &fields) != nil {
+		return nil
+	}
+	return fields
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// changes pairs the request's fields, or the reported after, with the
+// reported before. Only fields the request set are listed, and fields whose
+// value did not change are dropped.
+func (r *Recorder) changes(p *pending, body map[string]any) map[string]Change {
+	after := body
+	if p.after != nil {
+		after = fieldsOf(p.after)
+	}
+	if len(after) == 0 {
+		return nil
+	}
+	before := fieldsOf(p.before)
+	changes := map[string]Change{}
+	for field, value := range after {
+		if r.sensitive(field) {
+			changes[field] = Change{After: Redacted}
+			continue
+		}
+		old, known := before[field]
+		if known && jsonEqual(old, value) {
+			continue
+		}
+		changes[field] = Change{Before: r.scrub(old), After: r.scrub(value)}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// scrub redacts sensitive fields nested in v, such as the answers in a list
+// of security questions.
+func (r *Recorder) scrub(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for field, value := range v {
+			if r.sensitive(field) {
+				v[field] = Redacted
+			} else {
+				v[field] = r.scrub(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = r.scrub(value)
+		}
+	}
+	return v
+}
+
+func (r *Recorder) sensitive(field string) bool {
+	lower := strings.ToLower(field)
+	return r.redact[field] || sensitive[lower] ||
+		strings.Contains(lower, "password") || strings.Contains(lower, "secret") || strings.Contains(lower, "token")
+}
+
+// fieldsOf turns a struct or map into its JSON fields.
+func fieldsOf(v any) map[string]any {
+	if v == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]any
+	if json.Unmarshal(raw, &fields) != nil {
+		return nil
+	}
+	return fields
+}
+
+func jsonEqual(a, b any) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func (s *memStore) Record(ctx context.Context, e *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, *e)
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, f Filter) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []Entry{}
+	for i := len(s.entries) - 1; i >= 0 && len(entries) < f.Limit; i-- {
+		e := s.entries[i]
+		if (f.Tenant == "" || e.Tenant == f.Tenant) && (f.Actor == "" || e.Actor == f.Actor) && (f.Before == 0 || e.ID < f.Before) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+type item struct {
+	SKU      string `json:"sku"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+}
+
+func newRouter(store Store) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	recorder := NewRecorder(store, "phone")
+	handler := NewHandler(store)
+	admin := router.Group("/admin", recorder.AdminMiddleware())
+	admin.POST("/drain", func(c *gin.Context) { c.Status(http.StatusAccepted) })
+	handler.RegisterAdminRoutes(admin)
+
+	router.Use(requestid.Middleware())
+	router.Use(func(c *gin.Context) {
+		if role := c.GetHeader("X-Test-Role"); role != "" {
+			auth.WithPrincipal(c, &auth.Principal{UserID: 7, Roles: []string{role}})
+		}
+	})
+	router.Use(tenant.Middleware())
+	router.Use(recorder.Middleware())
+	router.GET("/items/:sku", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.PUT("/items/:sku", func(c *gin.Context) {
+		SetBefore(c, item{SKU: c.Param("sku"), Name: "Widget", Quantity: 3})
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Data(http.StatusOK, "application/json", body)
+	})
+	router.POST("/items", func(c *gin.Context) {
+		SetEntity(c, "items", "NEW-1")
+		c.Status(http.StatusCreated)
+	})
+	router.POST("/items/:sku/ship", func(c *gin.Context) {
+		SetAfter(c, gin.H{"status": "shipped"})
+		c.JSON(http.StatusConflict, gin.H{"error": "already shipped"})
+	})
+	handler.RegisterRoutes(router)
+	return router
+}
+
+func serve(router *gin.Engine, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRecordsMutatingRequests(t *testing.T) {
+	store := &memStore{}
+	router := newRouter(store)
+
+	w := serve(router, http.MethodPut, "/items/SKU-1", `{"name": "Gadget", "quantity": 3, "password": "hunter2", "phone": "555",
+		"contacts": [{"role": "buyer", "phone": "556"}]}`,
+		"X-Test-Role", auth.RoleAdmin, tenant.Header, "acme", requestid.Header, "req-1")
+	if !strings.Contains(w.Body.String(), "hunter2") {
+		t.Fatalf("Expected the handler to read the whole body, got: %s", w.Body)
+	}
+	serve(router, http.MethodGet, "/items/SKU-1", "")
+	serve(router, http.MethodPost, "/nowhere", `{}`)
+	serve(router, http.MethodPost, "/items", `{"sku": "NEW-1"}`, "X-Test-Role", auth.RoleCustomer)
+	serve(router, http.MethodPost, "/items/SKU-1/ship", "")
+	serve(router, http.MethodPost, "/admin/drain", "")
+
+	if len(store.entries) != 4 {
+		t.Fatalf("Expected four entries, got: %+v", store.entries)
+	}
+	put := store.entries[0]
+	if put.Tenant != "acme" || put.Actor != "user:7" || put.Route != "/items/:sku" || put.EntityType != "items" ||
+		put.EntityID != "SKU-1" || put.StatusCode != http.StatusOK || put.RequestID != "req-1" {
+		t.Errorf("Expected the request's details, got: %+v", put)
+	}
+	if c := put.Changes["name"]; c.Before != "Widget" || c.After != "Gadget" {
+		t.Errorf("Expected the name to change from Widget to Gadget, got: %+v", put.Changes)
+	}
+	if _, ok := put.Changes["quantity"]; ok {
+		t.Errorf("Expected an unchanged field to be left out, got: %+v", put.Changes)
+	}
+	if put.Changes["password"].After != Redacted || put.Changes["phone"].After != Redacted {
+		t.Errorf("Expected sensitive fields to be redacted, got: %+v", put.Changes)
+	}
+	if contacts, _ := put.Changes["contacts"].After.([]any); len(contacts) != 1 || contacts[0].(map[string]any)["phone"] != Redacted {
+		t.Errorf("Expected nested sensitive fields to be redacted, got: %+v", put.Changes["contacts"])
+	}
+
+	if create := store.entries[1]; create.EntityID != "NEW-1" || create.Changes["sku"].After != "NEW-1" || create.Tenant != tenant.Default {
+		t.Errorf("Expected the created entity, got: %+v", create)
+	}
+	if ship := store.entries[2]; ship.Actor != "anonymous" || ship.StatusCode != http.StatusConflict || ship.Changes["status"].After != "shipped" {
+		t.Errorf("Expected the failed transition to be recorded, got: %+v", ship)
+	}
+	if drain := store.entries[3]; drain.Actor != "admin" || drain.EntityType != "drain" {
+		t.Errorf("Expected the admin request, got: %+v", drain)
+	}
+}
+
+func TestListsEntries(t *testing.T) {
+	store := &memStore{entries: []Entry{
+		{ID: 1, Tenant: "acme", Actor: "user:1"},
+		{ID: 2, Tenant: "other", Actor: "user:2"},
+		{ID: 3, Tenant: "acme", Actor: "user:1"},
+		{ID: 4, Tenant: "acme", Actor: "user:3"},
+	}}
+	router := newRouter(store)
+
+	if w := serve(router, http.MethodGet, "/audit-log", "", "X-Test-Role", auth.RoleCustomer); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be refused, got: %d", w.Code)
+	}
+	if w := serve(router, http.MethodGet, "/audit-log?since=yesterday", "", "X-Test-Role", auth.RoleAdmin); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad timestamp to be refused, got: %d", w.Code)
+	}
+
+	var page struct {
+		Entries    []Entry `json:"entries"`
+		NextBefore int64   `json:"next_before"`
+	}
+	w := serve(router, http.MethodGet, "/audit-log?actor=user:1&limit=1", "", "X-Test-Role", auth.RoleAdmin, tenant.Header, "acme")
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a page, got: %d %s", w.Code, w.Body)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].ID != 3 || page.NextBefore != 3 {
+		t.Errorf("Expected the newest of the actor's entries and a next page, got: %+v", page)
+	}
+
+	page.Entries, page.NextBefore = nil, 0
+	w = serve(router, http.MethodGet, "/admin/audit-log", "")
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Entries) != 4 || page.NextBefore != 0 {
+		t.Errorf("Expected every tenant's entries, got: %+v", page)
+	}
+}
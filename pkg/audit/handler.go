@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Handler serves the log. Tenant admins read their tenant's entries; the
+// admin token reads every tenant's.
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/audit-log", auth.RequireRole(auth.RoleAdmin), func(c *gin.Context) {
+		h.list(c, tenant.FromContext(c.Request.Context()))
+	})
+}
+
+// RegisterAdminRoutes mounts the platform-wide listing, which takes
+// ?tenant= to narrow it to one tenant.
+func (h *Handler) RegisterAdminRoutes(admin gin.IRouter) {
+	admin.GET("/audit-log", func(c *gin.Context) { h.list(c, c.Query("tenant")) })
+}
+
+// list pages through entries newest first, filtered by ?actor=,
+// ?entity_type=, ?entity_id=, ?method= and an RFC 3339 ?since= and ?until=.
+// Pass next_before from a page as ?before= to get the next one.
+func (h *Handler) list(c *gin.Context, tenantID string) {
+	f := Filter{
+		Tenant:     tenantID,
+		Actor:      c.Query("actor"),
+		EntityType: c.Query("entity_type"),
+		EntityID:   c.Query("entity_id"),
+		Method:     strings.ToUpper(c.Query("method")),
+	}
+	for _, bound := range []struct {
+		name string
+		into *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if raw := c.Query(bound.name); raw != "" {
+			t, err := time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": bound.name + " must be an RFC 3339 timestamp"})
+				return
+			}
+			*bound.into = t
+		}
+	}
+	if raw := c.Query("before"); raw != "" {
+		var err error
+		if f.Before, err = strconv.ParseInt(raw, 10, 64); err != nil || f.Before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be an entry id"})
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if limit <= 0 || limit > maxLimit {
+		limit = defaultLimit
+	}
+
+	// One extra entry tells whether there is another page.
+	f.Limit = limit + 1
+	entries, err := h.store.List(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"entries": entries}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		resp["entries"] = entries
+		resp["next_before"] = entries[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
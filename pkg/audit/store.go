@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+)
+
+// Filter narrows a listing. Empty fields match everything; Tenant is only
+// left empty for the platform-wide admin listing. Before is an entry ID.
+type Filter struct {
+	Tenant     string
+	Actor      string
+	EntityType string
+	EntityID   string
+	Method     string
+	Since      time.Time
+	Until      time.Time
+	Before     int64
+	Limit      int
+}
+
+type Store interface {
+	Record(ctx context.Context, e *Entry) error
+	// List returns entries newest first.
+	List(ctx context.Context, f Filter) ([]Entry, error)
+}
+
+// PostgresStore keeps entries in a table of each service's schema, created
+// with the layout in scripts/init-db.sql.
+type PostgresStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewPostgresStore(db *sql.DB, table string) *PostgresStore {
+	return &PostgresStore{db: db, table: table}
+}
+
+func (s *PostgresStore) Record(ctx context.Context, e *Entry) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var changes []byte
+	if len(e.Changes) > 0 {
+		var err error
+		if changes, err = json.Marshal(e.Changes); err != nil {
+			return err
+		}
+	}
+	return s.db.QueryRowContext(ctx, "INSERT INTO "+s.table+` (tenant_id, actor, method, route, path, entity_type, entity_id,
+		status_code, request_id, client_ip, changes)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, NULLIF($9, ''), NULLIF($10, ''), $11)
+		RETURNING id, created_at`,
+		e.Tenant, e.Actor, e.Method, e.Route, e.Path, e.EntityType, e.EntityID, e.StatusCode, e.RequestID, e.ClientIP, changes).
+		Scan(&e.ID, &e.CreatedAt)
+}
+
+func (s *PostgresStore) List(ctx context.Context, f Filter) ([]Entry, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var where []string
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		where = append(where, clause+" $"+strconv.Itoa(len(args)))
+	}
+	if f.Tenant != "" {
+		add("tenant_id =", f.Tenant)
+	}
+	if f.Actor != "" {
+		add("actor =", f.Actor)
+	}
+	if f.EntityType != "" {
+		add("entity_type =", f.EntityType)
+	}
+	if f.EntityID != "" {
+		add("entity_id =", f.EntityID)
+	}
+	if f.Method != "" {
+		add("method =", f.Method)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >=", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at <", f.Until)
+	}
+	if f.Before > 0 {
+		add("id <", f.Before)
+	}
+	query := `SELECT id, tenant_id, actor, method, route, path, COALESCE(entity_type, ''), COALESCE(entity_id, ''),
+		status_code, COALESCE(request_id, ''), COALESCE(client_ip, ''), changes, created_at FROM ` + s.table
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var changes []byte
+		if err := rows.Scan(&e.ID, &e.Tenant, &e.Actor, &e.Method, &e.Route, &e.Path, &e.EntityType, &e.EntityID,
+			&e.StatusCode, &e.RequestID, &e.ClientIP, &changes, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if len(changes) > 0 {
+			if err := json.Unmarshal(changes, &e.Changes); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
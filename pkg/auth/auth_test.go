@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+func newTokens(t *testing.T) *Tokens {
+	tokens, err := NewTokens("test-secret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create tokens: %v", err)
+	}
+	return tokens
+}
+
+func TestIssueAndParse(t *testing.T) {
+	tokens := newTokens(t)
+
+	token, _, err := tokens.IssueUser(42, []string{RoleCustomer})
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	p, err := tokens.Parse(token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	if p.UserID != 42 || p.Service != "" || !p.HasRole(RoleCustomer) || p.HasRole(RoleAdmin) {
+		t.Errorf("Expected customer 42, got: %+v", p)
+	}
+
+	token, _, _ = tokens.IssueService("order-service")
+	p, err = tokens.Parse(token)
+	if err != nil || p.Service != "order-service" || !p.HasRole(RoleService) {
+		t.Errorf("Expected order-service principal, got: %+v, %v", p, err)
+	}
+}
+
+func TestParseRejectsBadTokens(t *testing.T) {
+	tokens := newTokens(t)
+	token, _, _ := tokens.IssueUser(1, []string{RoleAdmin})
+
+	other, _ := NewTokens("other-secret", time.Hour)
+	if _, err := other.Parse(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected token signed with another secret to be rejected, got: %v", err)
+	}
+
+	tokens.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := tokens.Parse(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected expired token to be rejected, got: %v", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	tokens := newTokens(t)
+	subject, _, _ := tokens.IssueTenantUser(42, "acme", []string{RoleCustomer})
+
+	exchanged, expires, err := tokens.Exchange(subject, "order-service", "api-gateway", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to exchange token: %v", err)
+	}
+	if time.Until(expires) > time.Minute {
+		t.Errorf("Expected the exchanged token to expire within a minute, got: %v", expires)
+	}
+	p, err := tokens.ForAudience("order-service").Parse(exchanged)
+	if err != nil {
+		t.Fatalf("Expected order-service to accept the exchanged token, got: %v", err)
+	}
+	if p.UserID != 42 || p.Tenant != "acme" || !p.HasRole(RoleCustomer) || p.Actor != "api-gateway" {
+		t.Errorf("Expected customer 42 of acme acting through api-gateway, got: %+v", p)
+	}
+	if _, err := tokens.ForAudience("payment-service").Parse(exchanged); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected payment-service to reject a token for order-service, got: %v", err)
+	}
+	if _, err := tokens.ForAudience("payment-service").Parse(subject); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected payment-service to reject a token without an audience, got: %v", err)
+	}
+	if _, err := tokens.Parse(subject); err != nil {
+		t.Errorf("Expected unscoped tokens to accept a token without an audience, got: %v", err)
+	}
+	if _, _, err := tokens.Exchange(exchanged, "payment-service", "api-gateway", time.Minute); !errors.Is(err, ErrAlreadyExchanged) {
+		t.Errorf("Expected an exchanged token not to be exchanged again, got: %v", err)
+	}
+
+	short, _ := NewTokens("test-secret", time.Second)
+	subject, subjectExpires, _ := short.IssueUser(42, []string{RoleCustomer})
+	if _, expires, _ := tokens.Exchange(subject, "order-service", "api-gateway", time.Minute); expires.After(subjectExpires) {
+		t.Errorf("Expected the exchanged token to expire with its subject at %v, got: %v", subjectExpires, expires)
+	}
+
+	internal := tokens.WithInternalSecret("internal-secret")
+	service, _, _ := internal.IssueService("api-gateway")
+	exchanged, _, _ = internal.Exchange(service, "order-service", "api-gateway", time.Minute)
+	if p, err := internal.ForAudience("order-service").Parse(exchanged); err != nil || p.Service != "api-gateway" {
+		t.Errorf("Expected an exchanged service token to stay signed with the internal secret, got: %+v, %v", p, err)
+	}
+}
+
+func TestCanActFor(t *testing.T) {
+	tests := []struct {
+		p    Principal
+		want bool
+	}{
+		{p: Principal{UserID: 1, Roles: []string{RoleCustomer}}, want: true},
+		{p: Principal{UserID: 2, Roles: []string{RoleCustomer}}, want: false},
+		{p: Principal{UserID: 2, Roles: []string{RoleAdmin}}, want: true},
+		{p: Principal{Service: "order-service", Roles: []string{RoleService}}, want: true},
+		{p: Principal{UserID: 2, Roles: []string{RoleService}}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.p.CanActFor(1); got != tt.want {
+			t.Errorf("CanActFor(1) for %+v = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTokens(t)
+	router := gin.New()
+	router.Use(Authenticate(tokens))
+	router.GET("/public", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/admin", RequireRole(RoleAdmin), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	admin, _, _ := tokens.IssueUser(1, []string{RoleAdmin})
+	customer, _, _ := tokens.IssueUser(2, []string{RoleCustomer})
+
+	tests := []struct {
+		path, token string
+		want        int
+	}{
+		{path: "/public", want: http.StatusOK},
+		{path: "/public", token: "garbage", want: http.StatusUnauthorized},
+		{path: "/admin", want: http.StatusUnauthorized},
+		{path: "/admin", token: customer, want: http.StatusForbidden},
+		{path: "/admin", token: admin, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("GET %s (token set: %v): expected status %d, got: %d", tt.path, tt.token != "", tt.want, w.Code)
+		}
+	}
+}
+
+func TestInternalOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTokens(t).WithInternalSecret("internal-secret")
+	router := gin.New()
+	router.Use(Authenticate(tokens))
+	router.GET("/internal", InternalOnly(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	svc, _, _ := tokens.IssueService("order-service")
+	// A user assigned the service role, or a service token signed with
+	// only the shared secret, is not a service identity.
+	user, _, _ := tokens.IssueUser(1, []string{RoleAdmin, RoleService})
+	forged, _, _ := newTokens(t).IssueService("order-service")
+
+	tests := []struct {
+		name, token string
+		want        int
+	}{
+		{name: "anonymous", want: http.StatusUnauthorized},
+		{name: "user", token: user, want: http.StatusForbidden},
+		{name: "shared secret", token: forged, want: http.StatusUnauthorized},
+		{name: "service", token: svc, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/internal", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected status %d, got: %d", tt.name, tt.want, w.Code)
+		}
+	}
+
+	// Services without the internal secret cannot verify the token at all.
+	if _, err := newTokens(t).Parse(svc); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected an internal token to need the internal secret, got: %v", err)
+	}
+	if p, err := newTokens(t).Parse(forged); err != nil || !p.Internal {
+		t.Errorf("Expected service tokens to be internal without an internal secret, got: %+v, %v", p, err)
+	}
+}
+
+func TestServiceTransportAddsToken(t *testing.T) {
+	tokens := newTokens(t)
+	var got *Principal
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := bearer(r.Header.Get("Authorization"))
+		got, _ = tokens.Parse(token)
+	}))
+	defer server.Close()
+
+	resp, err := NewServiceClient(tokens, "order-service", "payment-service").Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if got == nil || got.Service != "order-service" {
+		t.Errorf("Expected order-service token, got: %+v", got)
+	}
+
+	token, _ := (&ServiceTransport{Tokens: tokens, Service: "order-service", Audience: "payment-service"}).Token()
+	if _, err := tokens.ForAudience("payment-service").Parse(token); err != nil {
+		t.Errorf("Expected payment-service to accept a token issued for it, got: %v", err)
+	}
+	if _, err := tokens.ForAudience("user-service").Parse(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected user-service to reject a token issued for payment-service, got: %v", err)
+	}
+}
+
+func TestTenantFromTokenOrHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newTokens(t)
+	router := gin.New()
+	router.Use(Authenticate(tokens), tenant.Middleware())
+	router.GET("/", func(c *gin.Context) { c.String(http.StatusOK, tenant.FromContext(c.Request.Context())) })
+
+	acme, _, _ := tokens.IssueTenantUser(1, "acme", []string{RoleCustomer})
+	service, _, _ := tokens.IssueService("order-service")
+
+	tests := []struct {
+		token, header string
+		want          int
+		wantTenant    string
+	}{
+		{want: http.StatusOK, wantTenant: tenant.Default},
+		{header: "globex", want: http.StatusOK, wantTenant: "globex"},
+		{header: "Not Valid", want: http.StatusBadRequest},
+		{token: acme, want: http.StatusOK, wantTenant: "acme"},
+		{token: acme, header: "acme", want: http.StatusOK, wantTenant: "acme"},
+		{token: acme, header: "globex", want: http.StatusForbidden},
+		{token: service, header: "globex", want: http.StatusOK, wantTenant: "globex"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.header != "" {
+			req.Header.Set(tenant.Header, tt.header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want || tt.want == http.StatusOK && w.Body.String() != tt.wantTenant {
+			t.Errorf("Token set %v, header %q: expected %d %q, got: %d %q", tt.token != "", tt.header, tt.want, tt.wantTenant, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package auth issues and verifies the bearer tokens services use to identify
+// users and each other, and enforces role-based access on gin routes.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleCustomer = "customer"
+	// RoleService is held by other services calling internal endpoints.
+	RoleService = "service"
+	// RoleWarehouse is held by warehouse staff picking and packing orders.
+	RoleWarehouse = "warehouse"
+	// RoleDeveloper is held by integrators managing their own API keys and
+	// webhooks through the gateway's developer portal.
+	RoleDeveloper = "developer"
+)
+
+// Roles lists every role that can be assigned.
+var Roles = []string{RoleAdmin, RoleCustomer, RoleService, RoleWarehouse, RoleDeveloper}
+
+// GrantableRoles lists the roles a user account can be granted. The
+// service role is left out: it lets its holder act for every user, and
+// belongs to services' own tokens alone.
+var GrantableRoles = []string{RoleAdmin, RoleCustomer, RoleWarehouse, RoleDeveloper}
+
+func ValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// Grantable reports whether role is one of GrantableRoles.
+func Grantable(role string) bool {
+	return slices.Contains(GrantableRoles, role)
+}
+
+const issuer = "go-microserv-test"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Principal is the verified identity behind a request: a user (UserID set)
+// or a service (Service set). Users' tokens are bound to their Tenant;
+// services act for whichever tenant their request names. Actor names the
+// service that exchanged the caller's token for this one, if any. Internal
+// is set for a service's own identity token, which InternalOnly requires.
+type Principal struct {
+	UserID   int
+	Service  string
+	Tenant   string
+	Roles    []string
+	Actor    string
+	Internal bool
+}
+
+func (p *Principal) HasRole(roles ...string) bool {
+	for _, want := range roles {
+		for _, have := range p.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanActFor reports whether p may read or act on userID's resources: the
+// user themselves, an admin, or a service. A user holding the service
+// role is not a service.
+func (p *Principal) CanActFor(userID int) bool {
+	if p.Service == "" {
+		return p.UserID == userID || p.HasRole(RoleAdmin)
+	}
+	return p.HasRole(RoleAdmin, RoleService)
+}
+
+type claims struct {
+	Roles  []string `json:"roles"`
+	Tenant string   `json:"tenant,omitempty"`
+	Act    *actor   `json:"act,omitempty"`
+	jwt.RegisteredClaims
+	// internal is set by parse for tokens signed with the internal secret.
+	internal bool
+}
+
+// actor is RFC 8693's act claim, naming who a token was exchanged by.
+type actor struct {
+	Subject string `json:"sub"`
+}
+
+// internalKeyID is the kid header of service tokens signed with the
+// internal secret.
+const internalKeyID = "internal"
+
+// Tokens signs and verifies HS256 tokens with a secret shared by all services.
+type Tokens struct {
+	secret   []byte
+	internal []byte
+	ttl      time.Duration
+	now      func() time.Time
+	audience string
+}
+
+func NewTokens(secret string, ttl time.Duration) (*Tokens, error) {
+	if secret == "" {
+		return nil, errors.New("token secret must not be empty")
+	}
+	return &Tokens{secret: []byte(secret), ttl: ttl, now: time.Now}, nil
+}
+
+// ForAudience returns Tokens that only accept tokens issued for service,
+// for a service to verify its callers with. Tokens without an audience
+// are rejected too: callers reach a service through the gateway, which
+// exchanges their token for one naming it, or as another service whose
+// token names it.
+func (t *Tokens) ForAudience(service string) *Tokens {
+	scoped := *t
+	scoped.audience = service
+	return &scoped
+}
+
+// WithInternalSecret returns Tokens that sign service tokens with secret
+// instead of the shared one, and only trust service tokens signed with it.
+// Anything that can issue user tokens knows the shared secret, but only
+// the services know this one, so a service token cannot be forged from it.
+func (t *Tokens) WithInternalSecret(secret string) *Tokens {
+	scoped := *t
+	scoped.internal = []byte(secret)
+	return &scoped
+}
+
+func (t *Tokens) IssueUser(userID int, roles []string) (string, time.Time, error) {
+	return t.issue("user:"+strconv.Itoa(userID), "", roles)
+}
+
+// IssueTenantUser issues a user token bound to tenant, so it cannot be used
+// against another tenant's data.
+func (t *Tokens) IssueTenantUser(userID int, tenant string, roles []string) (string, time.Time, error) {
+	return t.issue("user:"+strconv.Itoa(userID), tenant, roles)
+}
+
+// IssueService issues name's token, accepted by the services in audience.
+func (t *Tokens) IssueService(name string, audience ...string) (string, time.Time, error) {
+	return t.issue("service:"+name, "", []string{RoleService}, audience...)
+}
+
+func (t *Tokens) issue(subject, tenant string, roles []string, audience ...string) (string, time.Time, error) {
+	secret := t.secret
+	now := t.now()
+	expires := now.Add(t.ttl)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		Roles:  roles,
+		Tenant: tenant,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   subject,
+			Audience:  audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	if strings.HasPrefix(subject, "service:") && len(t.internal) > 0 {
+		token.Header["kid"] = internalKeyID
+		secret = t.internal
+	}
+	signed, err := token.SignedString(secret)
+	return signed, expires, err
+}
+
+// ErrAlreadyExchanged rejects exchanging a token that was itself issued by
+// an exchange, so a token scoped to one service cannot be widened again.
+var ErrAlreadyExchanged = errors.New("token was already exchanged")
+
+// Exchange trades subjectToken for a token that only audience accepts,
+// after RFC 8693: same caller, roles and tenant, with actorService as the
+// act claim. It expires after ttl, or with subjectToken if that is sooner.
+func (t *Tokens) Exchange(subjectToken, audience, actorService string, ttl time.Duration) (string, time.Time, error) {
+	c, err := t.parse(subjectToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if c.Act != nil || len(c.Audience) > 0 {
+		return "", time.Time{}, ErrAlreadyExchanged
+	}
+	now := t.now()
+	expires := now.Add(ttl)
+	if c.ExpiresAt.Time.Before(expires) {
+		expires = c.ExpiresAt.Time
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		Roles:  c.Roles,
+		Tenant: c.Tenant,
+		Act:    &actor{Subject: "service:" + actorService},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   c.Subject,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	// A service's token stays signed with the internal secret, so services
+	// that require it still take the exchanged one as a service's.
+	secret := t.secret
+	if c.internal {
+		token.Header["kid"] = internalKeyID
+		secret = t.internal
+	}
+	signed, err := token.SignedString(secret)
+	return signed, expires, err
+}
+
+func (t *Tokens) parse(token string) (*claims, error) {
+	var c claims
+	parsed, err := jwt.ParseWithClaims(token, &c, func(token *jwt.Token) (any, error) {
+		if token.Header["kid"] != internalKeyID {
+			return t.secret, nil
+		}
+		if len(t.internal) == 0 {
+			return nil, errors.New("no internal secret to verify with")
+		}
+		return t.internal, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(t.now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if t.audience != "" && !slices.Contains(c.Audience, t.audience) {
+		if len(c.Audience) == 0 {
+			return nil, fmt.Errorf("%w: no audience, not issued for %s", ErrInvalidToken, t.audience)
+		}
+		return nil, fmt.Errorf("%w: issued for %s, not %s", ErrInvalidToken, strings.Join(c.Audience, ", "), t.audience)
+	}
+	c.internal = parsed.Header["kid"] == internalKeyID
+	return &c, nil
+}
+
+func (t *Tokens) Parse(token string) (*Principal, error) {
+	c, err := t.parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, id, _ := strings.Cut(c.Subject, ":")
+	if c.internal && kind != "service" {
+		return nil, fmt.Errorf("%w: internal secret used for %q", ErrInvalidToken, c.Subject)
+	}
+	p := &Principal{Roles: c.Roles, Tenant: c.Tenant}
+	if c.Act != nil {
+		_, p.Actor, _ = strings.Cut(c.Act.Subject, ":")
+	}
+	switch kind {
+	case "user":
+		if p.UserID, err = strconv.Atoi(id); err != nil {
+			return nil, fmt.Errorf("%w: bad subject %q", ErrInvalidToken, c.Subject)
+		}
+	case "service":
+		// Without an internal secret, every service token is trusted as
+		// one; with it, only those signed with it are.
+		if len(t.internal) > 0 && !c.internal {
+			return nil, fmt.Errorf("%w: service token not signed with the internal secret", ErrInvalidToken)
+		}
+		p.Service = id
+		p.Internal = c.Act == nil
+	default:
+		return nil, fmt.Errorf("%w: bad subject %q", ErrInvalidToken, c.Subject)
+	}
+	return p, nil
+}
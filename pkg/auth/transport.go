@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// ServiceTransport authenticates every outbound request as the named
+// service, reusing its token until shortly before it expires. The token
+// is only accepted by Audience, the service the requests are sent to.
+type ServiceTransport struct {
+	Base     http.RoundTripper
+	Tokens   *Tokens
+	Service  string
+	Audience string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewServiceClient returns a client calling audience as service.
+func NewServiceClient(tokens *Tokens, service, audience string) *http.Client {
+	client := httpclient.New()
+	client.Transport = &ServiceTransport{Base: client.Transport, Tokens: tokens, Service: service, Audience: audience}
+	return client
+}
+
+func (t *ServiceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.current()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.Base.RoundTrip(req)
+}
+
+// Token returns the service's current token, issuing a new one when it is
+// close to expiring, for callers that send it some other way.
+func (t *ServiceTransport) Token() (string, error) {
+	return t.current()
+}
+
+func (t *ServiceTransport) current() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+	token, expires, err := t.Tokens.IssueService(t.Service, t.Audience)
+	if err != nil {
+		return "", err
+	}
+	t.token, t.expires = token, expires
+	return token, nil
+}
+
+// ForwardingTransport sends the token stored by ForwardToken or
+// Authenticate, so downstream services authorize the original caller.
+// Requests without one go out anonymously.
+type ForwardingTransport struct {
+	Base http.RoundTripper
+}
+
+func NewForwardingClient() *http.Client {
+	client := httpclient.New()
+	client.Transport = &ForwardingTransport{Base: client.Transport}
+	return client
+}
+
+func (t *ForwardingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := TokenFromContext(req.Context())
+	if token == "" {
+		return t.Base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,157 @@
+// Package bodylimit guards the request bodies a service accepts. Each route
+// has a size limit and a list of content types; a body over the limit is
+// turned away with 413, one of another type with 415, and a JSON body that
+// does not parse with 400 naming where it broke, all before the handler
+// reads it.
+package bodylimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/gin-gonic/gin"
+)
+
+// AnyType accepts a body of any content type, or none, and leaves a JSON
+// one for the handler to parse. It is for routes such as webhooks, whose
+// senders are not ours to fix and whose signatures are checked first.
+const AnyType = "*/*"
+
+// Rule is what one route accepts. MaxBytes zero takes the default limit,
+// and no Types accepts only JSON.
+type Rule struct {
+	MaxBytes int64
+	Types    []string
+}
+
+func (r Rule) types() []string {
+	if len(r.Types) == 0 {
+		return []string{"application/json"}
+	}
+	return r.Types
+}
+
+func (r Rule) accepts(mediaType string) bool {
+	for _, t := range r.types() {
+		if t == AnyType || t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits holds the default size limit and the rules of the routes that
+// differ from it. Routes are set while the router is built, before it
+// serves.
+type Limits struct {
+	maxBytes int64
+	routes   map[string]Rule
+}
+
+func New(maxBytes int64) *Limits {
+	return &Limits{maxBytes: maxBytes, routes: map[string]Rule{}}
+}
+
+// FromEnv reads the default limit from MAX_REQUEST_BODY.
+func FromEnv() *Limits {
+	return New(config.GetBytes("MAX_REQUEST_BODY", 1<<20))
+}
+
+// SetRoute sets the rule of one route, such as "POST /items/adjustments".
+func (l *Limits) SetRoute(key string, r Rule) {
+	l.routes[key] = r
+}
+
+func (l *Limits) rule(key string) Rule {
+	r := l.routes[key]
+	if r.MaxBytes <= 0 {
+		r.MaxBytes = l.maxBytes
+	}
+	return r
+}
+
+// Middleware checks the body of each matched request that has one.
+// Unmatched paths are left alone: they 404 without reading the body.
+func (l *Limits) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() == "" || c.Request.Body == nil || c.Request.Body == http.NoBody || c.Request.ContentLength == 0 {
+			c.Next()
+			return
+		}
+		r := l.rule(c.Request.Method + " " + c.FullPath())
+		if c.Request.ContentLength > r.MaxBytes {
+			tooLarge(c, r.MaxBytes)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err != nil {
+			mediaType = ""
+		}
+		if !r.accepts(mediaType) {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be " + strings.Join(r.types(), " or ")})
+			return
+		}
+
+		// Bodies sent without a length are cut off at the limit as they
+		// are read.
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, r.MaxBytes)
+		if !isJSON(mediaType) || r.accepts(AnyType) {
+			c.Next()
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			tooLarge(c, r.MaxBytes)
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			return
+		}
+		if msg := malformed(body); msg != "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+func tooLarge(c *gin.Context, maxBytes int64) {
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body exceeds " + config.FormatBytes(maxBytes)})
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// malformed describes what is wrong with a JSON body, or returns "" when
+// it holds exactly one JSON value.
+func malformed(body []byte) string {
+	if json.Valid(body) {
+		return ""
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var v json.RawMessage
+	err := dec.Decode(&v)
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "request body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "malformed JSON: request body ends too early"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at byte %d: %s", syntaxErr.Offset, syntaxErr.Error())
+	case err == nil:
+		return fmt.Sprintf("malformed JSON at byte %d: request body must hold a single JSON value", dec.InputOffset())
+	}
+	return "malformed JSON: " + err.Error()
+}
@@ -0,0 +1,83 @@
+package bodylimit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limits := New(64)
+	limits.SetRoute("POST /import", Rule{MaxBytes: 128, Types: []string{"text/csv"}})
+	limits.SetRoute("POST /webhook", Rule{Types: []string{AnyType}})
+	router := gin.New()
+	router.Use(limits.Middleware())
+	echo := func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.String(http.StatusOK, string(body))
+	}
+	router.POST("/items", echo)
+	router.POST("/import", echo)
+	router.POST("/webhook", echo)
+	router.POST("/commit", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	tests := []struct {
+		name, path, contentType, body string
+		want                          int
+		wantError                     string
+	}{
+		{"json", "/items", "application/json; charset=utf-8", `{"sku": "SKU-001"}`, http.StatusOK, ""},
+		{"no body", "/commit", "", "", http.StatusNoContent, ""},
+		{"too large", "/items", "application/json", `{"name": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, "request body exceeds 64B"},
+		{"no content type", "/items", "", `{}`, http.StatusUnsupportedMediaType, "content type must be application/json"},
+		{"wrong content type", "/items", "text/plain", `{}`, http.StatusUnsupportedMediaType, "content type must be application/json"},
+		{"malformed", "/items", "application/json", `{"sku": SKU-001}`, http.StatusBadRequest, "malformed JSON at byte 9"},
+		{"truncated", "/items", "application/json", `{"sku": "SKU`, http.StatusBadRequest, "ends too early"},
+		{"trailing", "/items", "application/json", `{} {}`, http.StatusBadRequest, "single JSON value"},
+		{"route type", "/import", "text/csv", "sku,delta\nSKU-001,4\n", http.StatusOK, ""},
+		{"route limit", "/import", "text/csv", strings.Repeat("x", 100), http.StatusOK, ""},
+		{"route rejects json", "/import", "application/json", `{}`, http.StatusUnsupportedMediaType, "content type must be text/csv"},
+		{"any type", "/webhook", "", `not json`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.wantError) {
+				t.Errorf("Expected %d with %q, got: %d %s", tt.want, tt.wantError, w.Code, w.Body.String())
+			}
+			if tt.want == http.StatusOK && w.Body.String() != tt.body {
+				t.Errorf("Expected the handler to read the body as sent, got: %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUnknownLength(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(New(16).Middleware())
+	router.POST("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"name": "`+strings.Repeat("x", 32)+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a body without a length to be cut off at the limit, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,92 @@
+// Package cachetags names the data a response was built from, so the
+// gateway can drop its cached copies when domain events say that data
+// changed, instead of waiting for their TTL.
+package cachetags
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+// Header carries a response's tags, separated by commas.
+const Header = "Cache-Tags"
+
+// Users tags listings of users, which any user's change can make stale.
+const Users = "users"
+
+func User(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+func Order(id int) string {
+	return "order:" + strconv.Itoa(id)
+}
+
+func SKU(sku string) string {
+	return "sku:" + sku
+}
+
+// Events are the events that change tagged data.
+var Events = []string{
+	events.UserProfileUpdated, events.UserRoleChanged,
+	events.OrderPlaced, events.OrderCancelled, events.PaymentSucceeded, events.PaymentFailed,
+	events.InventoryStockChanged, events.InventorySKUMerged,
+}
+
+// Set adds tags to the response.
+func Set(c *gin.Context, tags ...string) {
+	if len(tags) == 0 {
+		return
+	}
+	if existing := c.Writer.Header().Get(Header); existing != "" {
+		tags = append([]string{existing}, tags...)
+	}
+	c.Header(Header, strings.Join(tags, ","))
+}
+
+// Parse splits a Cache-Tags header.
+func Parse(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// FromEvent returns the tags an event makes stale, read from the user_id,
+// order_id, sku, survivor and skus fields of its payload, and the tenant
+// they belong to. The tenant is empty when the event does not say.
+func FromEvent(e events.Event) (string, []string) {
+	var payload struct {
+		Tenant   string   `json:"tenant"`
+		UserID   int      `json:"user_id"`
+		OrderID  int      `json:"order_id"`
+		SKU      string   `json:"sku"`
+		Survivor string   `json:"survivor"`
+		SKUs     []string `json:"skus"`
+	}
+	if err := e.Decode(&payload); err != nil {
+		return "", nil
+	}
+	var tags []string
+	if payload.UserID != 0 {
+		tags = append(tags, User(payload.UserID))
+		if strings.HasPrefix(e.Type, "user.") {
+			tags = append(tags, Users)
+		}
+	}
+	if payload.OrderID != 0 {
+		tags = append(tags, Order(payload.OrderID))
+	}
+	for _, sku := range append([]string{payload.SKU, payload.Survivor}, payload.SKUs...) {
+		if sku != "" {
+			tags = append(tags, SKU(sku))
+		}
+	}
+	return payload.Tenant, tags
+}
@@ -0,0 +1,46 @@
+package cachetags
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSetAndParse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	Set(c, User(42))
+	Set(c, Order(7), SKU("ABC"))
+	if got := Parse(c.Writer.Header().Get(Header)); strings.Join(got, " ") != "user:42 order:7 sku:ABC" {
+		t.Errorf("Expected every tag set, got: %v", got)
+	}
+	if got := Parse(" , user:1 ,"); len(got) != 1 || got[0] != "user:1" {
+		t.Errorf("Expected blank tags to be dropped, got: %v", got)
+	}
+}
+
+func TestFromEvent(t *testing.T) {
+	tests := []struct {
+		eventType string
+		payload   any
+		tenant    string
+		tags      string
+	}{
+		{events.UserProfileUpdated, events.ProfileUpdate{UserID: 42, Tenant: "acme"}, "acme", "user:42 users"},
+		{events.OrderCancelled, events.OrderCancellation{OrderID: 7, UserID: 42, Tenant: "acme", SKUs: []string{"A", "B"}}, "acme", "user:42 order:7 sku:A sku:B"},
+		{events.InventorySKUMerged, events.SKUMerged{SKU: "OLD", Survivor: "NEW"}, "", "sku:OLD sku:NEW"},
+	}
+	for _, tt := range tests {
+		e, err := events.New(tt.eventType, "test", tt.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tenant, tags := FromEvent(e)
+		if tenant != tt.tenant || strings.Join(tags, " ") != tt.tags {
+			t.Errorf("%s: expected %q %q, got: %q %v", tt.eventType, tt.tenant, tt.tags, tenant, tags)
+		}
+	}
+}
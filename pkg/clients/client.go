@@ -0,0 +1,123 @@
+// Package clients provides typed HTTP clients for each service, mirroring the
+// OpenAPI definitions under each service's api/ directory.
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// APIError is returned when a service responds with a non-2xx status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// IsAuthError reports whether err is a 401 or 403 from the service, which
+// callers relaying a user's request should pass through rather than treat as
+// an upstream failure.
+func IsAuthError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) {
+		return apiErr, true
+	}
+	return nil, false
+}
+
+// Health is the payload returned by every service's /health endpoint.
+type Health struct {
+	Status  string `json:"status"`
+	Service string `json:"service"`
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey makes POSTs issued with ctx send key as their
+// Idempotency-Key, so retries of the same logical request are deduplicated by
+// the receiving service.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+type baseClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func newBaseClient(baseURL string, httpClient *http.Client) baseClient {
+	if httpClient == nil {
+		httpClient = httpclient.New()
+	}
+	return baseClient{baseURL: strings.TrimRight(baseURL, "/"), httpClient: httpClient}
+}
+
+func (c baseClient) do(ctx context.Context, method, path string, body, out any) error {
+	_, err := c.send(ctx, method, path, body, out)
+	return err
+}
+
+// send is do for callers that also need the response headers.
+func (c baseClient) send(ctx context.Context, method, path string, body, out any) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key, ok := ctx.Value(idempotencyKey{}).(string); ok && method == http.MethodPost {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+
+	if out == nil {
+		return resp.Header, nil
+	}
+	return resp.Header, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c baseClient) health(ctx context.Context) (*Health, error) {
+	var h Health
+	if err := c.do(ctx, http.MethodGet, "/health", nil, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
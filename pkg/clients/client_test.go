@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListUsers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users" {
+			t.Errorf("Expected path /users, got: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"users":[{"id":1,"email":"john.doe@example.com","username":"johndoe"}]}`))
+	}))
+	defer srv.Close()
+
+	users, err := NewUserClient(srv.URL, nil).ListUsers(context.Background())
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if len(users) != 1 || users[0].Username != "johndoe" {
+		t.Errorf("Unexpected users: %+v", users)
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IDs []int `json:"ids"`
+		}
+		if r.URL.Path != "/internal/users/batch" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			t.Errorf("Unexpected lookup: %s", r.URL.Path)
+		}
+		sizes = append(sizes, len(req.IDs))
+		users := map[string]User{}
+		for _, id := range req.IDs {
+			if id != 7 {
+				users[strconv.Itoa(id)] = User{ID: id, Username: "user" + strconv.Itoa(id)}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"users": users})
+	}))
+	defer srv.Close()
+
+	ids := []int{1, 1}
+	for id := 2; id <= MaxUserBatch+5; id++ {
+		ids = append(ids, id)
+	}
+	users, err := NewUserClient(srv.URL, nil).GetUsers(context.Background(), ids)
+	if err != nil {
+		t.Fatalf("GetUsers failed: %v", err)
+	}
+	if len(sizes) != 2 || sizes[0] != MaxUserBatch || sizes[1] != 5 {
+		t.Errorf("Expected IDs deduplicated and sent in batches of %d, got: %v", MaxUserBatch, sizes)
+	}
+	if _, ok := users[7]; ok || len(users) != MaxUserBatch+4 || users[42].Username != "user42" {
+		t.Errorf("Expected every known user keyed by ID, got %d users", len(users))
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"boom"}`))
+	}))
+	defer srv.Close()
+
+	_, err := NewOrderClient(srv.URL, nil).Health(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected APIError, got: %v", err)
+	}
+	if apiErr.StatusCode != http.StatusInternalServerError || apiErr.Message != "boom" {
+		t.Errorf("Unexpected error: %+v", apiErr)
+	}
+}
+
+func TestIdempotencyKeyHeader(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Idempotency-Key")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer srv.Close()
+
+	ctx := WithIdempotencyKey(context.Background(), "order-7-approval-3")
+	if _, err := NewNotificationClient(srv.URL, nil).Send(ctx, SendNotificationRequest{Recipient: "a@example.com"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if got != "order-7-approval-3" {
+		t.Errorf("Expected Idempotency-Key order-7-approval-3, got: %q", got)
+	}
+}
+
+func TestStockMaxAge(t *testing.T) {
+	cacheControl := "max-age=30"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Write([]byte(`{"sku":"SKU-001","available":120,"in_unit":{"unit":"case","factor":12,"available":10}}`))
+	}))
+	defer srv.Close()
+	client := NewInventoryClient(srv.URL, nil)
+
+	s, err := client.GetStockInUnit(context.Background(), "SKU-001", "case")
+	if err != nil {
+		t.Fatalf("GetStockInUnit failed: %v", err)
+	}
+	if s.MaxAge != 30*time.Second || s.InUnit == nil || s.InUnit.Available != 10 {
+		t.Errorf("Expected 10 cases cacheable for 30s, got: %+v", s)
+	}
+
+	cacheControl = "no-cache"
+	if s, err := client.GetStock(context.Background(), "SKU-001"); err != nil || s.MaxAge != 0 {
+		t.Errorf("Expected no-cache stock to have no max age, got: %+v %v", s, err)
+	}
+}
@@ -0,0 +1,399 @@
+// Package contracttest runs consumer-driven contract tests between services.
+// A consumer states the requests it makes and the JSON shapes it decodes,
+// derived from the Go types it decodes into, and keeps them as a golden file
+// under contracts/<consumer>/<provider>.json. The provider's tests replay
+// each request against its real handlers and check the answers have those
+// shapes, so a provider change that would break a consumer fails the
+// provider's own go test.
+//
+// On the consumer side:
+//
+//	c := contracttest.New("api-gateway", "order-service")
+//	c.Add(contracttest.Interaction{
+//		Description: "a user's recent orders",
+//		State:       "user 7 has an order",
+//		Method:      http.MethodGet,
+//		Path:        "/orders?user_id=7",
+//		Status:      http.StatusOK,
+//	}, struct {
+//		Orders []clients.Order `json:"orders"`
+//	}{})
+//	contracttest.AssertGolden(t, c)
+//
+// On the provider side, with the states set up in the handler's fake store:
+//
+//	contracttest.Verify(t, router, contracttest.Load(t, "api-gateway", "order-service"))
+package contracttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Shape is the part of a JSON value a consumer relies on, in the terms of
+// an OpenAPI schema. Properties the consumer does not decode are left out,
+// so providers may add fields freely.
+type Shape struct {
+	// Type is object, array, string, integer, number or boolean. An empty
+	// Type accepts any value.
+	Type string `json:"type,omitempty"`
+	// Format is date-time for timestamps, which must parse as RFC 3339.
+	Format     string            `json:"format,omitempty"`
+	Nullable   bool              `json:"nullable,omitempty"`
+	Properties map[string]*Shape `json:"properties,omitempty"`
+	Required   []string          `json:"required,omitempty"`
+	Items      *Shape            `json:"items,omitempty"`
+}
+
+// Interaction is one request a consumer makes and the answer it expects.
+// State names what the provider must hold for the answer to be realistic,
+// such as "user 7 exists".
+type Interaction struct {
+	Description string `json:"description"`
+	State       string `json:"state,omitempty"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Status      int    `json:"status"`
+	Body        *Shape `json:"body,omitempty"`
+}
+
+type Contract struct {
+	Consumer     string        `json:"consumer"`
+	Provider     string        `json:"provider"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+func New(consumer, provider string) *Contract {
+	return &Contract{Consumer: consumer, Provider: provider, Interactions: []Interaction{}}
+}
+
+// Add records i with the shape of body, a value of the type the consumer
+// decodes the response into.
+func (c *Contract) Add(i Interaction, body any) {
+	i.Body = ShapeOf(reflect.TypeOf(body))
+	c.Interactions = append(c.Interactions, i)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// ShapeOf derives the shape encoding/json reads into t. Fields tagged
+// omitempty are optional, and pointers, slices and maps may be null.
+func ShapeOf(t reflect.Type) *Shape {
+	switch {
+	case t == nil || t.Kind() == reflect.Interface:
+		return &Shape{}
+	case t == timeType:
+		return &Shape{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := ShapeOf(t.Elem())
+		s.Nullable = true
+		return s
+	case reflect.Struct:
+		s := &Shape{Type: "object", Properties: map[string]*Shape{}}
+		addFields(s, t)
+		sort.Strings(s.Required)
+		return s
+	case reflect.Map:
+		return &Shape{Type: "object", Nullable: true}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Shape{Type: "string", Nullable: true}
+		}
+		return &Shape{Type: "array", Nullable: true, Items: ShapeOf(t.Elem())}
+	case reflect.Array:
+		return &Shape{Type: "array", Items: ShapeOf(t.Elem())}
+	case reflect.String:
+		return &Shape{Type: "string"}
+	case reflect.Bool:
+		return &Shape{Type: "boolean"}
+	case reflect.Float32, reflect.Float64:
+		return &Shape{Type: "number"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Shape{Type: "integer"}
+	}
+	panic(fmt.Sprintf("contracttest: no JSON shape for %s", t))
+}
+
+func addFields(s *Shape, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addFields(s, embedded)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = ShapeOf(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// Check lists the ways v, decoded with json.Decoder.UseNumber, differs from
+// s. An empty array is a problem too, since its items go unchecked: the
+// provider state should fill it.
+func Check(s *Shape, v any, at string) []string {
+	var problems []string
+	check(s, v, at, &problems)
+	return problems
+}
+
+func check(s *Shape, v any, at string, problems *[]string) {
+	if s.Type == "" {
+		return
+	}
+	if v == nil {
+		if !s.Nullable {
+			*problems = append(*problems, at+": is null")
+		}
+		return
+	}
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: want object, got %s", at, typeOf(v)))
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: missing %q", at, name))
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if pv, ok := obj[name]; ok {
+				check(s.Properties[name], pv, at+"."+name, problems)
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: want array, got %s", at, typeOf(v)))
+			return
+		}
+		if len(arr) == 0 && s.Items != nil && s.Items.Type != "" {
+			*problems = append(*problems, at+": is empty, so its items were not checked")
+		}
+		for i, item := range arr {
+			check(s.Items, item, fmt.Sprintf("%s[%d]", at, i), problems)
+		}
+	default:
+		if got := typeOf(v); got != s.Type && !(s.Type == "number" && got == "integer") {
+			*problems = append(*problems, fmt.Sprintf("%s: want %s, got %s", at, s.Type, got))
+			return
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v.(string)); err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s: %q is not an RFC 3339 timestamp", at, v))
+			}
+		}
+	}
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Example builds a value of shape s, for stubbing the provider on the
+// consumer side.
+func Example(s *Shape) any {
+	switch s.Type {
+	case "object":
+		obj := map[string]any{}
+		for name, p := range s.Properties {
+			obj[name] = Example(p)
+		}
+		return obj
+	case "array":
+		if s.Items == nil {
+			return []any{}
+		}
+		return []any{Example(s.Items)}
+	case "string":
+		if s.Format == "date-time" {
+			return "2026-01-01T12:00:00Z"
+		}
+		return "string"
+	case "integer":
+		return 1
+	case "number":
+		return 1.5
+	case "boolean":
+		return true
+	}
+	return nil
+}
+
+// Stub serves c's interactions with example bodies, so a consumer test can
+// check its client makes exactly the requests in the contract. Any other
+// request fails the test.
+func Stub(t testing.TB, c *Contract) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, i := range c.Interactions {
+			if i.Method == r.Method && i.Path == r.URL.RequestURI() {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(i.Status)
+				if i.Body != nil {
+					json.NewEncoder(w).Encode(Example(i.Body))
+				}
+				return
+			}
+		}
+		t.Errorf("%s called %s %s, which is not in its contract with %s", c.Consumer, r.Method, r.URL.RequestURI(), c.Provider)
+		http.Error(w, "not in contract", http.StatusNotImplemented)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Verify replays c's interactions against the provider's handler and fails
+// the test for every answer without the expected status or shape. Requests
+// carry no credentials: the handler should set the caller up, as the
+// provider's other handler tests do.
+func Verify(t *testing.T, handler http.Handler, c *Contract) {
+	t.Helper()
+	for _, i := range c.Interactions {
+		t.Run(i.Description, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(i.Method, i.Path, nil))
+			if w.Code != i.Status {
+				t.Fatalf("%s %s (given %s): expected status %d for %s, got: %d %s",
+					i.Method, i.Path, i.State, i.Status, c.Consumer, w.Code, w.Body.String())
+			}
+			if i.Body == nil {
+				return
+			}
+			dec := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+			dec.UseNumber()
+			var body any
+			if err := dec.Decode(&body); err != nil {
+				t.Fatalf("%s %s: expected JSON, got: %v", i.Method, i.Path, err)
+			}
+			for _, p := range Check(i.Body, body, "$") {
+				t.Errorf("%s %s (given %s) breaks %s: %s", i.Method, i.Path, i.State, c.Consumer, p)
+			}
+		})
+	}
+}
+
+// Path is where the contract between consumer and provider is kept, found
+// by walking up from the test's working directory to the contracts
+// directory at the repository root.
+func Path(consumer, provider string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if info, err := os.Stat(filepath.Join(dir, "contracts")); err == nil && info.IsDir() {
+			return filepath.Join(dir, "contracts", consumer, provider+".json"), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no contracts directory above the working directory")
+		}
+		dir = parent
+	}
+}
+
+// Load reads the contract a provider verifies.
+func Load(t testing.TB, consumer, provider string) *Contract {
+	t.Helper()
+	path, err := Path(consumer, provider)
+	if err != nil {
+		t.Fatalf("Failed to find the %s contract: %v", consumer, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the %s contract: %v", consumer, err)
+	}
+	var c Contract
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("Failed to parse %s: %v", path, err)
+	}
+	return &c
+}
+
+// AssertGolden fails the consumer's test when c differs from the stored
+// contract, so changing what a consumer expects is a reviewed change to
+// the file its providers verify. UPDATE_CONTRACTS=1 rewrites the file.
+func AssertGolden(t testing.TB, c *Contract) {
+	t.Helper()
+	path, err := Path(c.Consumer, c.Provider)
+	if err != nil {
+		t.Fatalf("Failed to find the contracts directory: %v", err)
+	}
+	want, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to encode the contract: %v", err)
+	}
+	want = append(want, '\n')
+
+	if os.Getenv("UPDATE_CONTRACTS") == "1" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, want, 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		return
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s (run with UPDATE_CONTRACTS=1 to create it): %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s is out of date with what %s decodes. Run its tests with UPDATE_CONTRACTS=1, "+
+			"then run %s's tests against the new contract", path, c.Consumer, c.Provider)
+	}
+}
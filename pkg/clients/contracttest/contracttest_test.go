@@ -0,0 +1,72 @@
+package contracttest
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type item struct {
+	SKU   string `json:"sku"`
+	Label string `json:"label,omitempty"`
+}
+
+type order struct {
+	ID        int       `json:"id"`
+	OrgID     *int      `json:"org_id,omitempty"`
+	Items     []item    `json:"items"`
+	CreatedAt time.Time `json:"created_at"`
+	internal  string
+	Secret    string `json:"-"`
+}
+
+func decode(t *testing.T, body string) any {
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("Failed to decode %s: %v", body, err)
+	}
+	return v
+}
+
+func TestShapeOf(t *testing.T) {
+	s := ShapeOf(reflect.TypeOf(order{}))
+	if got := strings.Join(s.Required, ","); got != "created_at,id,items" {
+		t.Errorf("Expected omitempty and skipped fields not to be required, got: %s", got)
+	}
+	if len(s.Properties) != 4 || !s.Properties["org_id"].Nullable || s.Properties["created_at"].Format != "date-time" {
+		t.Errorf("Unexpected shape: %+v", s)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s := ShapeOf(reflect.TypeOf(order{}))
+	tests := []struct {
+		name, body, want string
+	}{
+		{"matches, with extra fields", `{"id": 1, "org_id": null, "items": [{"sku": "A", "extra": true}], "created_at": "2026-01-01T00:00:00Z", "new": 1}`, ""},
+		{"missing field", `{"id": 1, "items": [{"sku": "A"}]}`, `$: missing "created_at"`},
+		{"renamed item field", `{"id": 1, "items": [{"code": "A"}], "created_at": "2026-01-01T00:00:00Z"}`, `$.items[0]: missing "sku"`},
+		{"string id", `{"id": "1", "items": [{"sku": "A"}], "created_at": "2026-01-01T00:00:00Z"}`, "$.id: want integer, got string"},
+		{"fractional id", `{"id": 1.5, "items": [{"sku": "A"}], "created_at": "2026-01-01T00:00:00Z"}`, "$.id: want integer, got number"},
+		{"unix timestamp", `{"id": 1, "items": [{"sku": "A"}], "created_at": "1767225600"}`, "is not an RFC 3339 timestamp"},
+		{"empty array", `{"id": 1, "items": [], "created_at": "2026-01-01T00:00:00Z"}`, "$.items: is empty"},
+	}
+	for _, tt := range tests {
+		problems := strings.Join(Check(s, decode(t, tt.body), "$"), "; ")
+		if tt.want == "" && problems != "" || !strings.Contains(problems, tt.want) {
+			t.Errorf("%s: expected %q, got: %q", tt.name, tt.want, problems)
+		}
+	}
+}
+
+func TestExampleMatchesShape(t *testing.T) {
+	s := ShapeOf(reflect.TypeOf(order{}))
+	data, _ := json.Marshal(Example(s))
+	if problems := Check(s, decode(t, string(data)), "$"); len(problems) != 0 {
+		t.Errorf("Expected the example to match its shape, got: %v", problems)
+	}
+}
@@ -0,0 +1,236 @@
+package clients
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/models"
+)
+
+type Stock struct {
+	models.Stock
+	// MaxAge is how long inventory-service says the answer may be reused,
+	// from its Cache-Control header. Zero means it should not be cached.
+	MaxAge time.Duration `json:"-"`
+}
+
+type UnitStock = models.UnitStock
+
+// Unit is a unit a SKU is sold in, Factor base units each.
+type Unit struct {
+	Name   string `json:"unit"`
+	Factor int    `json:"factor"`
+}
+
+type Product = models.Product
+
+// Dimensions are one base unit of a SKU as packed for shipping.
+type Dimensions struct {
+	SKU         string `json:"sku"`
+	LengthMM    int    `json:"length_mm"`
+	WidthMM     int    `json:"width_mm"`
+	HeightMM    int    `json:"height_mm"`
+	WeightGrams int    `json:"weight_grams"`
+}
+
+// Location is where in the warehouse a SKU is kept.
+type Location struct {
+	SKU  string `json:"sku"`
+	Zone string `json:"zone"`
+	Bin  string `json:"bin"`
+}
+
+// Reservation holds Quantity base units of a SKU's available stock until it
+// is committed, released or, past ExpiresAt, expires.
+type Reservation struct {
+	ID           int64      `json:"id"`
+	SKU          string     `json:"sku"`
+	Quantity     int        `json:"quantity"`
+	Unit         string     `json:"unit"`
+	UnitQuantity int        `json:"unit_quantity"`
+	Reference    string     `json:"reference,omitempty"`
+	Status       string     `json:"status"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// InventoryClient talks to inventory-service.
+type InventoryClient struct {
+	baseClient
+}
+
+func NewInventoryClient(baseURL string, httpClient *http.Client) *InventoryClient {
+	return &InventoryClient{newBaseClient(baseURL, httpClient)}
+}
+
+func (c *InventoryClient) Health(ctx context.Context) (*Health, error) {
+	return c.health(ctx)
+}
+
+func (c *InventoryClient) GetStock(ctx context.Context, sku string) (*Stock, error) {
+	return c.getStock(ctx, "/stock/"+url.PathEscape(sku))
+}
+
+// GetStockInUnit also reports the stock in whole units of unit, in InUnit.
+func (c *InventoryClient) GetStockInUnit(ctx context.Context, sku, unit string) (*Stock, error) {
+	return c.getStock(ctx, "/stock/"+url.PathEscape(sku)+"?unit="+url.QueryEscape(unit))
+}
+
+// GetProduct reads a SKU's catalog entry. Service callers are shown
+// inactive products too, so check Active.
+func (c *InventoryClient) GetProduct(ctx context.Context, sku string) (*Product, error) {
+	var p Product
+	if _, err := c.send(ctx, http.MethodGet, "/products/"+url.PathEscape(sku), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetUnits lists the units the SKU is sold in, the base unit "each"
+// first.
+func (c *InventoryClient) GetUnits(ctx context.Context, sku string) ([]Unit, error) {
+	var resp struct {
+		Units []Unit `json:"units"`
+	}
+	if _, err := c.send(ctx, http.MethodGet, "/items/"+url.PathEscape(sku)+"/units", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Units, nil
+}
+
+// GetDimensions reads the dimensions of up to 100 SKUs in one call, and
+// lists the SKUs that have none recorded in missing.
+func (c *InventoryClient) GetDimensions(ctx context.Context, skus []string) (found []Dimensions, missing []string, err error) {
+	query := url.Values{"sku": skus}
+	var resp struct {
+		Dimensions []Dimensions `json:"dimensions"`
+		Missing    []string     `json:"missing"`
+	}
+	if _, err := c.send(ctx, http.MethodGet, "/items/dimensions?"+query.Encode(), nil, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Dimensions, resp.Missing, nil
+}
+
+// GetLocations reads the locations of up to 100 SKUs in one call, in zone
+// and bin order, and lists the SKUs that have none recorded in missing.
+func (c *InventoryClient) GetLocations(ctx context.Context, skus []string) (found []Location, missing []string, err error) {
+	query := url.Values{"sku": skus}
+	var resp struct {
+		Locations []Location `json:"locations"`
+		Missing   []string   `json:"missing"`
+	}
+	if _, err := c.send(ctx, http.MethodGet, "/items/locations?"+query.Encode(), nil, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Locations, resp.Missing, nil
+}
+
+// Reserve holds quantity base units of the SKU. Without enough available
+// stock it fails with a 409 *APIError.
+func (c *InventoryClient) Reserve(ctx context.Context, sku string, quantity int, reference string) (*Reservation, error) {
+	return c.ReserveFor(ctx, sku, quantity, "", reference, 0)
+}
+
+// ReserveFor holds quantity of the SKU in unit, "each" when empty, for ttl,
+// or inventory's default TTL when zero. An unknown unit fails with a 400
+// *APIError.
+func (c *InventoryClient) ReserveFor(ctx context.Context, sku string, quantity int, unit, reference string, ttl time.Duration) (*Reservation, error) {
+	req := struct {
+		Quantity   int    `json:"quantity"`
+		Unit       string `json:"unit,omitempty"`
+		Reference  string `json:"reference,omitempty"`
+		TTLSeconds int    `json:"ttl_seconds,omitempty"`
+	}{quantity, unit, reference, int(ttl.Seconds())}
+	var resp struct {
+		Reservation Reservation `json:"reservation"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/stock/"+url.PathEscape(sku)+"/reservations", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Reservation, nil
+}
+
+// ReportShortage books quantity of the SKU, in unit, off on-hand stock as
+// missing at pick time. Reports with the same reference are booked once,
+// so a failed report can be retried.
+func (c *InventoryClient) ReportShortage(ctx context.Context, sku string, quantity int, unit, reference string) error {
+	req := struct {
+		Quantity  int    `json:"quantity"`
+		Unit      string `json:"unit,omitempty"`
+		Reference string `json:"reference"`
+	}{quantity, unit, reference}
+	return c.do(ctx, http.MethodPost, "/stock/"+url.PathEscape(sku)+"/shortages", req, nil)
+}
+
+// RecordMovement books delta of the SKU, in unit, into (positive) or out of
+// (negative) on-hand stock. Taking more than is available gives a 409
+// *APIError.
+func (c *InventoryClient) RecordMovement(ctx context.Context, sku string, delta int, unit, reason, reference string) error {
+	req := struct {
+		Delta     int    `json:"delta"`
+		Unit      string `json:"unit,omitempty"`
+		Reason    string `json:"reason"`
+		Reference string `json:"reference"`
+	}{delta, unit, reason, reference}
+	return c.do(ctx, http.MethodPost, "/stock/"+url.PathEscape(sku)+"/movements", req, nil)
+}
+
+// ReleaseReservation returns a reservation's stock. A reservation released
+// already gives a 409 *APIError.
+func (c *InventoryClient) ReleaseReservation(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/reservations/"+strconv.FormatInt(id, 10), nil, nil)
+}
+
+// CommitReservation books a reservation's stock out as sold. A reservation
+// already settled, or expired, gives a 409 *APIError.
+func (c *InventoryClient) CommitReservation(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodPost, "/reservations/"+strconv.FormatInt(id, 10)+"/commit", nil, nil)
+}
+
+// ExtendReservation holds an active reservation for ttl from now, unless
+// it was already held longer.
+func (c *InventoryClient) ExtendReservation(ctx context.Context, id int64, ttl time.Duration) (*Reservation, error) {
+	req := struct {
+		TTLSeconds int `json:"ttl_seconds"`
+	}{int(ttl.Seconds())}
+	var resp struct {
+		Reservation Reservation `json:"reservation"`
+	}
+	if err := c.do(ctx, http.MethodPatch, "/reservations/"+strconv.FormatInt(id, 10)+"/extend", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Reservation, nil
+}
+
+func (c *InventoryClient) getStock(ctx context.Context, path string) (*Stock, error) {
+	var s Stock
+	header, err := c.send(ctx, http.MethodGet, path, nil, &s)
+	if err != nil {
+		return nil, err
+	}
+	s.MaxAge = maxAge(header.Get("Cache-Control"))
+	return &s, nil
+}
+
+// maxAge reads max-age from a Cache-Control header. no-cache, no-store and a
+// missing or malformed max-age all give zero.
+func maxAge(cacheControl string) time.Duration {
+	var age time.Duration
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-cache", "no-store":
+			return 0
+		case "max-age":
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				age = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return age
+}
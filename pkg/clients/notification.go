@@ -0,0 +1,172 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/models"
+)
+
+type SendNotificationRequest struct {
+	UserID    *int   `json:"user_id,omitempty"`
+	Recipient string `json:"recipient"`
+	Channel   string `json:"channel,omitempty"`
+	// Type is the kind of notification users opt in and out of, general
+	// when empty.
+	Type    string `json:"type,omitempty"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Format  string `json:"format,omitempty"`
+	Data    any    `json:"data,omitempty"`
+	// ContextType and ContextID say what the notification is about, so
+	// replies to it reach the right place (e.g. "order", "42").
+	ContextType string `json:"context_type,omitempty"`
+	ContextID   string `json:"context_id,omitempty"`
+}
+
+type Notification = models.Notification
+
+// WebhookRequest creates or replaces a webhook subscription. Active pauses
+// or resumes it, and defaults to true.
+type WebhookRequest struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Description string   `json:"description,omitempty"`
+	Active      *bool    `json:"active,omitempty"`
+}
+
+// Webhook is a subscription sending events to URL. Secret is only set when
+// it is created or its secret rotated.
+type Webhook struct {
+	ID          int64     `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description,omitempty"`
+	Active      bool      `json:"active"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookDeliveries is a page of deliveries, newest first. NextBefore is
+// set when there are older ones.
+type WebhookDeliveries struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	NextBefore int64             `json:"next_before,omitempty"`
+}
+
+// NotificationClient talks to notification-service.
+type NotificationClient struct {
+	baseClient
+}
+
+func NewNotificationClient(baseURL string, httpClient *http.Client) *NotificationClient {
+	return &NotificationClient{newBaseClient(baseURL, httpClient)}
+}
+
+func (c *NotificationClient) Health(ctx context.Context) (*Health, error) {
+	return c.health(ctx)
+}
+
+func (c *NotificationClient) Send(ctx context.Context, req SendNotificationRequest) (*Notification, error) {
+	var n Notification
+	if err := c.do(ctx, http.MethodPost, "/notifications", req, &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (c *NotificationClient) ListNotifications(ctx context.Context, userID int) ([]Notification, error) {
+	var resp struct {
+		Notifications []Notification `json:"notifications"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/notifications?user_id=%d", userID), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Notifications, nil
+}
+
+// ListWebhookEvents returns the event types webhooks may subscribe to.
+func (c *NotificationClient) ListWebhookEvents(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Events []string `json:"events"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/webhooks/events", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Events, nil
+}
+
+// ListWebhooks returns the subscriptions the caller may manage: all of the
+// tenant's for admins, and their own for developers.
+func (c *NotificationClient) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	var resp struct {
+		Subscriptions []Webhook `json:"subscriptions"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/webhooks", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Subscriptions, nil
+}
+
+func (c *NotificationClient) CreateWebhook(ctx context.Context, req WebhookRequest) (*Webhook, error) {
+	var w Webhook
+	if err := c.do(ctx, http.MethodPost, "/webhooks", req, &w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (c *NotificationClient) UpdateWebhook(ctx context.Context, id int64, req WebhookRequest) (*Webhook, error) {
+	var w Webhook
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("/webhooks/%d", id), req, &w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (c *NotificationClient) DeleteWebhook(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/webhooks/%d", id), nil, nil)
+}
+
+// RotateWebhookSecret returns the subscription's new signing secret.
+func (c *NotificationClient) RotateWebhookSecret(ctx context.Context, id int64) (string, error) {
+	var resp struct {
+		Secret string `json:"secret"`
+	}
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/webhooks/%d/rotate-secret", id), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Secret, nil
+}
+
+// ListWebhookDeliveries pages through a subscription's deliveries. before
+// is the previous page's NextBefore, or 0 for the first page.
+func (c *NotificationClient) ListWebhookDeliveries(ctx context.Context, id, before int64, limit int) (*WebhookDeliveries, error) {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if before > 0 {
+		query.Set("before", strconv.FormatInt(before, 10))
+	}
+	var page WebhookDeliveries
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/webhooks/%d/deliveries?%s", id, query.Encode()), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
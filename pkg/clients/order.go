@@ -0,0 +1,77 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/alux444/go-microserv-test/pkg/models"
+)
+
+type (
+	OrderItem    = models.OrderItem
+	Order        = models.Order
+	TrackingPage = models.TrackingPage
+	TrackingItem = models.TrackingItem
+	Shipment     = models.Shipment
+	TrackingStep = models.TrackingStep
+)
+
+type CreateOrderRequest struct {
+	UserID int  `json:"user_id"`
+	OrgID  *int `json:"org_id,omitempty"`
+	// Currency is order-service's default when empty.
+	Currency string      `json:"currency,omitempty"`
+	Items    []OrderItem `json:"items"`
+}
+
+// OrderClient talks to order-service.
+type OrderClient struct {
+	baseClient
+}
+
+func NewOrderClient(baseURL string, httpClient *http.Client) *OrderClient {
+	return &OrderClient{newBaseClient(baseURL, httpClient)}
+}
+
+func (c *OrderClient) Health(ctx context.Context) (*Health, error) {
+	return c.health(ctx)
+}
+
+func (c *OrderClient) CreateOrder(ctx context.Context, req CreateOrderRequest) (*Order, error) {
+	var o Order
+	if err := c.do(ctx, http.MethodPost, "/orders", req, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (c *OrderClient) GetOrder(ctx context.Context, id int) (*Order, error) {
+	var o Order
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/orders/%d", id), nil, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// ListOrders returns the user's most recent orders, without their items.
+func (c *OrderClient) ListOrders(ctx context.Context, userID int) ([]Order, error) {
+	var resp struct {
+		Orders []Order `json:"orders"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/orders?user_id=%d", userID), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Orders, nil
+}
+
+// GetTrackingPage opens a tracking link's page. It needs no user token, and
+// a malformed, expired or revoked token is a 404 APIError.
+func (c *OrderClient) GetTrackingPage(ctx context.Context, token string) (*TrackingPage, error) {
+	var p TrackingPage
+	if err := c.do(ctx, http.MethodGet, "/tracking/"+url.PathEscape(token), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
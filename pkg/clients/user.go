@@ -0,0 +1,165 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/models"
+)
+
+type User = models.User
+
+type Membership = models.Membership
+
+// Address is an entry in a user's address book. Country is an ISO 3166-1
+// alpha-2 code.
+type Address struct {
+	ID         int    `json:"id"`
+	UserID     int    `json:"user_id"`
+	Label      string `json:"label,omitempty"`
+	Recipient  string `json:"recipient"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone,omitempty"`
+}
+
+// PublicProfile is what a user chose to show to anyone. Fields they did
+// not choose are empty.
+type PublicProfile struct {
+	Username    string     `json:"username"`
+	FirstName   string     `json:"first_name,omitempty"`
+	LastName    string     `json:"last_name,omitempty"`
+	AvatarURL   string     `json:"avatar_url,omitempty"`
+	Locale      string     `json:"locale,omitempty"`
+	MemberSince *time.Time `json:"member_since,omitempty"`
+	// MaxAge is how long user-service lets the profile be cached, and Tags
+	// name the data it was built from.
+	MaxAge time.Duration `json:"-"`
+	Tags   []string      `json:"-"`
+}
+
+// UserClient talks to user-service.
+type UserClient struct {
+	baseClient
+}
+
+func NewUserClient(baseURL string, httpClient *http.Client) *UserClient {
+	return &UserClient{newBaseClient(baseURL, httpClient)}
+}
+
+func (c *UserClient) Health(ctx context.Context) (*Health, error) {
+	return c.health(ctx)
+}
+
+func (c *UserClient) ListUsers(ctx context.Context) ([]User, error) {
+	var resp struct {
+		Users []User `json:"users"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/users", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+// ListOrgAdmins returns the users holding the admin role in an organization.
+func (c *UserClient) ListOrgAdmins(ctx context.Context, orgID int) ([]User, error) {
+	var resp struct {
+		Admins []User `json:"admins"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/orgs/%d/admins", orgID), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Admins, nil
+}
+
+// GetMembership returns the organization a user belongs to, with no OrgID
+// if they belong to none.
+func (c *UserClient) GetMembership(ctx context.Context, userID int) (*Membership, error) {
+	var m Membership
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/users/%d/org", userID), nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *UserClient) GetUser(ctx context.Context, id int) (*User, error) {
+	var u User
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/users/%d", id), nil, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// MaxUserBatch is the most IDs user-service resolves in one lookup.
+const MaxUserBatch = 100
+
+// GetUsers resolves many user IDs at once, for callers acting as a
+// service. It sends MaxUserBatch IDs per request, and unknown users are
+// absent from the result.
+func (c *UserClient) GetUsers(ctx context.Context, ids []int) (map[int]User, error) {
+	users := make(map[int]User, len(ids))
+	seen := make(map[int]bool, len(ids))
+	var batch []int
+	flush := func() error {
+		var resp struct {
+			Users map[int]User `json:"users"`
+		}
+		if err := c.do(ctx, http.MethodPost, "/internal/users/batch", map[string][]int{"ids": batch}, &resp); err != nil {
+			return err
+		}
+		for id, u := range resp.Users {
+			users[id] = u
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		batch = append(batch, id)
+		if len(batch) == MaxUserBatch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// DefaultAddress returns the address the user ships to by default. A user
+// without one gets a 404 *APIError.
+func (c *UserClient) DefaultAddress(ctx context.Context, userID int) (*Address, error) {
+	var a Address
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/users/%d/addresses/default", userID), nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetPublicProfile returns a user's public profile by username. It needs
+// no user token, and a user who has not enabled one is a 404 *APIError.
+func (c *UserClient) GetPublicProfile(ctx context.Context, username string) (*PublicProfile, error) {
+	var p PublicProfile
+	header, err := c.send(ctx, http.MethodGet, "/profiles/"+url.PathEscape(username), nil, &p)
+	if err != nil {
+		return nil, err
+	}
+	p.MaxAge = maxAge(header.Get("Cache-Control"))
+	p.Tags = cachetags.Parse(header.Get(cachetags.Header))
+	return &p, nil
+}
@@ -0,0 +1,118 @@
+// Command replay rebuilds historical order and payment events from the
+// database named by the POSTGRES_* variables and sends them to one
+// consumer's queue on the broker at RABBITMQ_URL, to backfill a consumer
+// that started after they were published. The queue must exist, so start
+// its consumer once first. Times are RFC 3339 or YYYY-MM-DD.
+//
+//	replay -queue name [-types t1,t2] [-tenant name] [-since time] [-until time] [-rate n] [-dry-run]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+	"github.com/alux444/go-microserv-test/pkg/replay"
+	"github.com/alux444/go-microserv-test/pkg/service"
+)
+
+func main() {
+	var opts replay.Options
+	var types, since, until string
+	flag.StringVar(&opts.Queue, "queue", "", "consumer queue to replay into, e.g. user-service.activity")
+	flag.StringVar(&types, "types", "", "comma-separated event types to replay; all of them when empty")
+	flag.StringVar(&opts.Filter.Tenant, "tenant", "", "tenant to replay; every tenant when empty")
+	flag.StringVar(&since, "since", "", "replay events that occurred at or after this time")
+	flag.StringVar(&until, "until", "", "replay events that occurred before this time, such as when the consumer went live")
+	flag.Float64Var(&opts.Rate, "rate", 50, "events sent per second at most; 0 for no limit")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "count the events that would be replayed without sending them")
+	flag.Parse()
+
+	ctx, stop := service.Init("replay")
+	defer stop()
+
+	var err error
+	if opts.Filter.Since, err = parseTime(since); err != nil {
+		log.Fatalf("Invalid -since: %v", err)
+	}
+	if opts.Filter.Until, err = parseTime(until); err != nil {
+		log.Fatalf("Invalid -until: %v", err)
+	}
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	source := replay.NewOrderHistory(db)
+	if types != "" {
+		opts.Filter.Types = strings.Split(types, ",")
+		for _, t := range opts.Filter.Types {
+			if !contains(source.Types(), t) {
+				log.Fatalf("Cannot replay %s, only %s", t, strings.Join(source.Types(), ", "))
+			}
+		}
+	}
+
+	var broker *events.RabbitMQ
+	if !opts.DryRun {
+		if opts.Queue == "" {
+			log.Fatal("-queue is required unless -dry-run is set")
+		}
+		broker, err = events.DialRabbitMQ(config.GetEnv("RABBITMQ_URL", ""), "events")
+		if err != nil {
+			log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+		}
+		defer broker.Close()
+		backlog, err := broker.QueueDepth(opts.Queue)
+		if err != nil {
+			log.Fatalf("Cannot replay into queue %s, start its consumer first: %v", opts.Queue, err)
+		}
+		log.Printf("Replaying into %s, which holds %d messages", opts.Queue, backlog)
+	}
+
+	res, err := replay.Run(ctx, source, broker, schema.Default, opts)
+	verb := "Replayed"
+	if opts.DryRun {
+		verb = "Would replay"
+	}
+	if res != nil {
+		fmt.Printf("%s %d events\n", verb, res.Total)
+		names := make([]string, 0, len(res.ByType))
+		for t := range res.ByType {
+			names = append(names, t)
+		}
+		sort.Strings(names)
+		for _, t := range names {
+			fmt.Printf("  %-28s %d\n", t, res.ByType[t])
+		}
+	}
+	if err != nil {
+		log.Fatalf("Replay stopped: %v", err)
+	}
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
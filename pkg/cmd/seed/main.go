@@ -0,0 +1,42 @@
+// Command seed fills the database named by the POSTGRES_* variables with
+// generated users, products, stock and orders, for local demos. Every user
+// signs in with -password.
+//
+//	seed [-tenant name] [-users n] [-products n] [-orders n] [-seed n] [-password p]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/seed"
+	"github.com/alux444/go-microserv-test/pkg/service"
+)
+
+func main() {
+	cfg := seed.Defaults
+	flag.StringVar(&cfg.Tenant, "tenant", cfg.Tenant, "tenant to seed")
+	flag.IntVar(&cfg.Users, "users", cfg.Users, "users to generate")
+	flag.IntVar(&cfg.Products, "products", cfg.Products, "products to generate, with their stock")
+	flag.IntVar(&cfg.Orders, "orders", cfg.Orders, "orders to add")
+	flag.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed; the same seed generates the same data")
+	flag.StringVar(&cfg.Password, "password", cfg.Password, "password of every generated user")
+	flag.Parse()
+
+	ctx, stop := service.Init("seed")
+	defer stop()
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	res, err := seed.Run(ctx, db, cfg)
+	if err != nil {
+		log.Fatalf("Failed to seed: %v", err)
+	}
+	fmt.Printf("Seeded tenant %s: %d new users, %d new products, %d orders\n", cfg.Tenant, res.Users, res.Products, res.Orders)
+}
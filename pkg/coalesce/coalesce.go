@@ -0,0 +1,159 @@
+// Package coalesce collapses concurrent identical reads into one. While a
+// read of a key is running, callers asking for the same key wait for it and
+// share its result instead of running their own, so a burst of requests for
+// one hot record, such as after a deploy empties the caches, costs one
+// query. Only reads made for GET and HEAD requests are shared; anything
+// else may need to see a write it just made, so it always runs its own.
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// Group shares the results of one kind of read, such as fetching a user by
+// ID. Callers get the same value, so they must copy it before changing it.
+type Group[T any] struct {
+	stats *counters
+
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+type call[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+type counters struct {
+	calls     atomic.Int64
+	coalesced atomic.Int64
+	inFlight  atomic.Int64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*counters{}
+)
+
+// New returns a group whose counts are reported under name. Groups with the
+// same name, such as one per store instance, share their counts.
+func New[T any](name string) *Group[T] {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	stats, ok := registry[name]
+	if !ok {
+		stats = &counters{}
+		registry[name] = stats
+	}
+	return &Group[T]{stats: stats, calls: map[string]*call[T]{}}
+}
+
+// Do runs fn for key, or waits for the run already in progress for key in
+// the same tenant and returns its result. A waiter stops waiting when its
+// own ctx is done. If the run it waited for failed only because the first
+// caller's context was cancelled, the waiter runs fn itself rather than
+// inherit someone else's disconnect. Outside a GET or HEAD request, Do
+// just runs fn.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func() (T, error)) (T, error) {
+	if !Allowed(ctx) {
+		return fn()
+	}
+	key = tenant.FromContext(ctx) + "\x00" + key
+
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		g.stats.coalesced.Add(1)
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+		if (errors.Is(c.err, context.Canceled) || errors.Is(c.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+			return fn()
+		}
+		return c.value, c.err
+	}
+	c := &call[T]{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	g.stats.calls.Add(1)
+	g.stats.inFlight.Add(1)
+	defer func() {
+		g.stats.inFlight.Add(-1)
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	// Waiters get errPanicked if fn panics, and the panic goes on up the
+	// first caller's stack.
+	c.err = errPanicked
+	c.value, c.err = fn()
+	return c.value, c.err
+}
+
+var errPanicked = errors.New("coalesce: shared read panicked")
+
+type allowedKey struct{}
+
+// Middleware lets the reads a GET or HEAD request makes be shared, the way
+// database.Replicas.Middleware lets them go to a replica.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			c.Request = c.Request.WithContext(Allow(c.Request.Context()))
+		}
+		c.Next()
+	}
+}
+
+// Allow marks ctx's reads as safe to share.
+func Allow(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allowedKey{}, true)
+}
+
+// Allowed reports whether ctx's reads may be shared.
+func Allowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(allowedKey{}).(bool)
+	return allowed
+}
+
+// Stats is one group's counts as GET /metrics/coalesced shows them. Calls
+// is the reads that ran and Coalesced the callers that shared one instead.
+type Stats struct {
+	Name      string `json:"name"`
+	Calls     int64  `json:"calls"`
+	Coalesced int64  `json:"coalesced"`
+	InFlight  int64  `json:"in_flight"`
+}
+
+// Snapshot returns every group's counts, sorted by name.
+func Snapshot() []Stats {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	out := make([]Stats, 0, len(registry))
+	for name, c := range registry {
+		out = append(out, Stats{Name: name, Calls: c.calls.Load(), Coalesced: c.coalesced.Load(), InFlight: c.inFlight.Load()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Handler serves Snapshot.
+func Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"groups": Snapshot()})
+	}
+}
@@ -0,0 +1,111 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// flight starts n callers of g.Do for key, each with its own context, and
+// waits until all but the first are waiting on it. release lets the first
+// one's read finish with value and err.
+func flight(t *testing.T, g *Group[int], ctxs []context.Context, key string) (release func(int, error), results chan [2]any, runs *atomic.Int64) {
+	t.Helper()
+	runs = &atomic.Int64{}
+	started, finish := make(chan struct{}), make(chan [2]any)
+	results = make(chan [2]any, len(ctxs))
+	before := g.stats.coalesced.Load()
+	var once sync.Once
+	for _, ctx := range ctxs {
+		go func(ctx context.Context) {
+			v, err := g.Do(ctx, key, func() (int, error) {
+				runs.Add(1)
+				once.Do(func() { close(started) })
+				r := <-finish
+				err, _ := r[1].(error)
+				return r[0].(int), err
+			})
+			results <- [2]any{v, err}
+		}(ctx)
+		if ctx == ctxs[0] {
+			<-started
+		}
+	}
+	for g.stats.coalesced.Load()-before < int64(len(ctxs)-1) {
+		runtime.Gosched()
+	}
+	return func(v int, err error) { finish <- [2]any{v, err} }, results, runs
+}
+
+func TestDoSharesConcurrentReads(t *testing.T) {
+	g := New[int]("test.shared")
+	calls, coalesced := g.stats.calls.Load(), g.stats.coalesced.Load()
+	ctx := Allow(tenant.NewContext(context.Background(), "acme"))
+	release, results, runs := flight(t, g, []context.Context{ctx, ctx, ctx}, "7")
+	release(42, nil)
+	for i := 0; i < 3; i++ {
+		if r := <-results; r[0] != 42 || r[1] != nil {
+			t.Errorf("Expected every caller to get the shared read, got: %v", r)
+		}
+	}
+	if runs.Load() != 1 {
+		t.Errorf("Expected one read, got: %d", runs.Load())
+	}
+	for _, s := range Snapshot() {
+		if s.Name == "test.shared" && (s.Calls-calls != 1 || s.Coalesced-coalesced != 2 || s.InFlight != 0) {
+			t.Errorf("Expected 1 call and 2 coalesced, got: %+v", s)
+		}
+	}
+}
+
+func TestDoKeepsTenantsApart(t *testing.T) {
+	g := New[int]("test.tenants")
+	runs := 0
+	block := make(chan struct{})
+	done := make(chan struct{})
+	acme := Allow(tenant.NewContext(context.Background(), "acme"))
+	go func() {
+		g.Do(acme, "7", func() (int, error) { <-block; return 1, nil })
+		close(done)
+	}()
+	for g.stats.inFlight.Load() == 0 {
+		runtime.Gosched()
+	}
+	other := Allow(tenant.NewContext(context.Background(), "globex"))
+	if v, _ := g.Do(other, "7", func() (int, error) { runs++; return 2, nil }); v != 2 || runs != 1 {
+		t.Errorf("Expected another tenant to run its own read, got: %d", v)
+	}
+	close(block)
+	<-done
+}
+
+func TestDoOutsideReads(t *testing.T) {
+	g := New[int]("test.writes")
+	runs := 0
+	for i := 0; i < 2; i++ {
+		g.Do(context.Background(), "7", func() (int, error) { runs++; return 0, nil })
+	}
+	if runs != 2 || g.stats.inFlight.Load() != 0 || g.stats.coalesced.Load() != 0 {
+		t.Errorf("Expected reads outside a GET to run on their own, got %d runs", runs)
+	}
+}
+
+func TestDoRerunsAfterCancelledLeader(t *testing.T) {
+	g := New[int]("test.cancelled")
+	ctx := Allow(context.Background())
+	release, results, runs := flight(t, g, []context.Context{ctx, ctx}, "7")
+	release(0, context.Canceled)
+	var got [][2]any
+	got = append(got, <-results)
+	// The waiter runs the read again itself, and the test answers it.
+	release(9, nil)
+	got = append(got, <-results)
+	if runs.Load() != 2 || !errors.Is(got[0][1].(error), context.Canceled) || got[1][0] != 9 || got[1][1] != nil {
+		t.Errorf("Expected the waiter to read again, got %d runs and: %v", runs.Load(), got)
+	}
+}
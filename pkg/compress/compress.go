@@ -0,0 +1,243 @@
+// Package compress negotiates compressed bodies in both directions.
+// Responses are compressed with zstd or gzip, whichever the client's
+// Accept-Encoding prefers, once they are large enough to be worth it, and
+// request bodies sent with a Content-Encoding are decoded before anything
+// reads them.
+package compress
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings are the content codings supported, in the order they are
+// preferred when a client accepts more than one equally.
+var Encodings = []string{"zstd", "gzip"}
+
+// DefaultMinSize is the smallest body compressed by default. Below it the
+// encoding's framing costs about as much as it saves.
+const DefaultMinSize = 1 << 10
+
+// FromEnv compresses responses of at least COMPRESSION_MIN_SIZE, or none
+// when COMPRESSION_ENABLED is "false", e.g. behind a proxy that compresses
+// them itself.
+func FromEnv() gin.HandlerFunc {
+	if config.GetEnv("COMPRESSION_ENABLED", "true") == "false" {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return Middleware(config.GetBytes("COMPRESSION_MIN_SIZE", DefaultMinSize))
+}
+
+// Middleware compresses responses of at least minSize bytes in the
+// encoding the request's Accept-Encoding prefers. A response that flushes,
+// or sends its headers, before the handler returns is a stream and is
+// compressed whatever its size, flushing as the handler does.
+//
+// Responses that are already encoded, have no body, or are of a type that
+// is compressed already (images, audio, video and archives) are sent as
+// they are, as are event streams, which must reach the client as each
+// event is written. A compressed response's strong ETag is weakened, since
+// its bytes differ from the other encodings'; If-None-Match compares
+// ETags weakly anyway, and etag.IfMatch takes the weak form of a version.
+func Middleware(minSize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := Negotiate(c.GetHeader("Accept-Encoding"))
+		if encoding == "" || c.Request.Method == http.MethodHead || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		w := &writer{ResponseWriter: c.Writer, encoding: encoding, minSize: int(minSize)}
+		c.Writer = w
+		defer func() {
+			w.close()
+			c.Writer = w.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// Negotiate returns the supported encoding an Accept-Encoding header
+// prefers, or "" when it accepts none of them.
+func Negotiate(acceptEncoding string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		weights[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range Encodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// encoder is what gzip.Writer and zstd.Encoder have in common.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	"zstd": {New: func() any {
+		// One goroutine and a 1 MiB window per response keep the
+		// encoder's memory in line with gzip's.
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return w
+	}},
+}
+
+// writer holds a response back until it reaches minSize, the handler
+// returns or the response is flushed, then decides whether to compress it.
+type writer struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+	buf      []byte
+	decided  bool
+	enc      encoder
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *writer) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeaderNow sends the headers ahead of the body, as streams do, so
+// the response is compressed if it can be.
+func (w *writer) WriteHeaderNow() {
+	if !w.decided {
+		w.decide(true)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *writer) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide compresses the response from here on if worth is set and the
+// response can be, and writes what was held back.
+func (w *writer) decide(worth bool) error {
+	w.decided = true
+	header := w.Header()
+	if compressible(header, w.Status()) && !w.ResponseWriter.Written() {
+		addVary(header)
+		if worth {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", w.encoding)
+			if tag := header.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+				header.Set("ETag", "W/"+tag)
+			}
+			w.enc = encoders[w.encoding].Get().(encoder)
+			w.enc.Reset(w.ResponseWriter)
+		}
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.Write(buf)
+	return err
+}
+
+// close writes out a response the handler returned before it was decided,
+// and ends the encoding of a compressed one.
+func (w *writer) close() {
+	if !w.decided {
+		w.decide(len(w.buf) >= w.minSize)
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(nil)
+		encoders[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// compressible reports whether a response with this status and these
+// headers may be sent compressed.
+func compressible(header http.Header, status int) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case mediaType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return false
+	}
+	switch mediaType {
+	case "text/event-stream", "application/zip", "application/gzip", "application/x-gzip", "application/zstd", "application/pdf":
+		return false
+	}
+	return true
+}
+
+func addVary(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
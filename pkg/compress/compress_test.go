@@ -0,0 +1,222 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/bodylimit"
+	"github.com/alux444/go-microserv-test/pkg/ndjson"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                         "",
+		"identity":                 "",
+		"gzip":                     "gzip",
+		"gzip, deflate, br, zstd":  "zstd",
+		"zstd;q=0.5, gzip":         "gzip",
+		"gzip;q=0.5, zstd;q=0.5":   "zstd",
+		"*":                        "zstd",
+		"*;q=0.5, zstd;q=0":        "gzip",
+		"GZIP;q=0.8":               "gzip",
+		"gzip;q=0, zstd;q=bad, br": "",
+		" gzip ; q=1.0 ,deflate":   "gzip",
+	}
+	for header, want := range tests {
+		if got := Negotiate(header); got != want {
+			t.Errorf("Negotiate(%q): expected %q, got %q", header, want, got)
+		}
+	}
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to read gzip: %v", err)
+		}
+		r = gz
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to read zstd: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(body)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to decompress %s: %v", encoding, err)
+	}
+	return string(out)
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	large := strings.Repeat(`{"id": 1, "email": "user@example.com"}`, 100)
+	router := gin.New()
+	router.Use(Middleware(256))
+	router.GET("/large", func(c *gin.Context) { c.Data(http.StatusOK, "application/json", []byte(large)) })
+	router.GET("/small", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "ok"}) })
+	router.GET("/image", func(c *gin.Context) { c.Data(http.StatusOK, "image/png", []byte(large)) })
+	router.GET("/encoded", func(c *gin.Context) {
+		c.Header("Content-Encoding", "br")
+		c.Data(http.StatusOK, "application/json", []byte(large))
+	})
+	router.GET("/empty", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	router.GET("/stream", func(c *gin.Context) {
+		s := ndjson.Start(c)
+		s.Write(gin.H{"id": 1})
+		s.Close(nil)
+	})
+
+	tests := []struct {
+		name, path, accept, wantEncoding, wantBody string
+		wantVary                                   bool
+	}{
+		{"zstd", "/large", "gzip, zstd", "zstd", large, true},
+		{"gzip", "/large", "gzip", "gzip", large, true},
+		{"not accepted", "/large", "", "", large, false},
+		{"below minimum", "/small", "gzip", "", `{"status":"ok"}`, true},
+		{"compressed type", "/image", "gzip", "", large, false},
+		{"already encoded", "/encoded", "gzip", "br", large, false},
+		{"no body", "/empty", "gzip", "", "", false},
+		{"stream", "/stream", "gzip", "gzip", "{\"id\":1}\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Expected encoding %q, got: %q", tt.wantEncoding, got)
+			}
+			if tt.wantEncoding != "" && tt.wantEncoding != "br" && w.Header().Get("Content-Length") != "" {
+				t.Errorf("Expected no Content-Length on a compressed response, got: %q", w.Header().Get("Content-Length"))
+			}
+			if got := w.Header().Get("Vary") == "Accept-Encoding"; got != tt.wantVary {
+				t.Errorf("Expected Vary on negotiated responses only, got: %q", w.Header().Get("Vary"))
+			}
+			if tt.wantEncoding == "br" {
+				return
+			}
+			if got := decompress(t, tt.wantEncoding, w.Body.Bytes()); got != tt.wantBody {
+				t.Errorf("Expected the body back, got: %.80q", got)
+			}
+		})
+	}
+}
+
+func TestMiddlewareReusesEncoders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware(1))
+	router.GET("/items/:id", func(c *gin.Context) { c.String(http.StatusOK, "item "+c.Param("id")) })
+	for _, encoding := range Encodings {
+		for _, id := range []string{"1", "2"} {
+			req := httptest.NewRequest(http.MethodGet, "/items/"+id, nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if got := decompress(t, encoding, w.Body.Bytes()); got != "item "+id {
+				t.Errorf("Expected item %s in %s, got: %q", id, encoding, got)
+			}
+		}
+	}
+}
+
+func compressed(t *testing.T, encoding, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(body))
+		w.Close()
+	case "zstd":
+		w, _ := zstd.NewWriter(&buf)
+		w.Write([]byte(body))
+		w.Close()
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Decode())
+	router.Use(bodylimit.New(1 << 10).Middleware())
+	router.POST("/users/import", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.String(http.StatusOK, string(body))
+	})
+
+	bomb := `{"name": "` + strings.Repeat("x", 4<<10) + `"}`
+	tests := []struct {
+		name, encoding string
+		body           []byte
+		want           int
+		wantBody       string
+	}{
+		{"gzip", "gzip", compressed(t, "gzip", `{"email": "a@example.com"}`), http.StatusOK, `{"email": "a@example.com"}`},
+		{"zstd", "zstd", compressed(t, "zstd", `{"email": "a@example.com"}`), http.StatusOK, `{"email": "a@example.com"}`},
+		{"identity", "", []byte(`{}`), http.StatusOK, `{}`},
+		{"inflates past the limit", "gzip", compressed(t, "gzip", bomb), http.StatusRequestEntityTooLarge, "request body exceeds 1KB"},
+		{"unsupported", "br", []byte(`{}`), http.StatusUnsupportedMediaType, "content encoding must be zstd or gzip"},
+		{"corrupt", "gzip", []byte(`{}`), http.StatusBadRequest, "request body is not valid gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/users/import", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("Expected %d with %q, got: %d %s", tt.want, tt.wantBody, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMiddlewareWeakensETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware(1))
+	router.GET("/orders/:id", func(c *gin.Context) {
+		c.Header("ETag", `"7"`)
+		c.JSON(http.StatusOK, gin.H{"id": c.Param("id")})
+	})
+	for accept, want := range map[string]string{"gzip": `W/"7"`, "zstd": `W/"7"`, "": `"7"`} {
+		req := httptest.NewRequest(http.MethodGet, "/orders/7", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if got := w.Header().Get("ETag"); got != want {
+			t.Errorf("Expected ETag %s with Accept-Encoding %q, got: %s", want, accept, got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package compress
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Decode decodes request bodies sent with a gzip or zstd Content-Encoding,
+// so handlers read them as they were before being compressed. A body in
+// any other encoding is refused with 415, naming the encodings accepted.
+//
+// The decoded body has no known length, so installed ahead of
+// bodylimit.Middleware it is limited as it is decoded: a small body that
+// inflates past the route's limit is turned away with 413 like any other.
+func Decode() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding")))
+		if encoding == "" || encoding == "identity" || c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		body, err := decoder(encoding, c.Request.Body)
+		if err != nil {
+			c.Header("Accept-Encoding", strings.Join(Encodings, ", "))
+			if errors.Is(err, errUnsupported) {
+				c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "content encoding must be " + strings.Join(Encodings, " or ")})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "request body is not valid " + encoding + ": " + err.Error()})
+			return
+		}
+		c.Request.Body = body
+		c.Request.ContentLength = -1
+		c.Request.Header.Del("Content-Length")
+		c.Request.Header.Del("Content-Encoding")
+		c.Next()
+	}
+}
+
+var errUnsupported = errors.New("unsupported content encoding")
+
+// decoder reads body in encoding, closing both the decoder and body when
+// it is closed.
+func decoder(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return &decoded{Reader: r, close: func() { r.Close() }, body: body}, nil
+	case "zstd":
+		r, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return &decoded{Reader: r, close: r.Close, body: body}, nil
+	}
+	return nil, errUnsupported
+}
+
+type decoded struct {
+	io.Reader
+	close func()
+	body  io.ReadCloser
+}
+
+func (d *decoded) Close() error {
+	d.close()
+	return d.body.Close()
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GetEnv returns the value of the variable key, or fallback when it is
+// unset or empty. Variables are read from the environment and then from
+// CONFIG_FILE; see Load.
+func GetEnv(key, fallback string) string {
+	v, ok := lookup(key)
+	used := v.value
+	if !ok {
+		used = fallback
+	}
+	remember(key, v, ok, used, fallback)
+	return used
+}
+
+// GetInt returns the environment variable key parsed as an int, or fallback
+// when it is unset or not a valid integer.
+func GetInt(key string, fallback int) int {
+	v, ok := lookup(key)
+	n, err := strconv.Atoi(v.value)
+	if err != nil {
+		n = fallback
+	}
+	remember(key, v, ok, strconv.Itoa(n), strconv.Itoa(fallback))
+	return n
+}
+
+// GetDuration returns the environment variable key parsed with
+// time.ParseDuration (e.g. "500ms", "2s"), or fallback when it is unset or
+// invalid.
+func GetDuration(key string, fallback time.Duration) time.Duration {
+	v, ok := lookup(key)
+	d, err := time.ParseDuration(v.value)
+	if err != nil {
+		d = fallback
+	}
+	remember(key, v, ok, d.String(), fallback.String())
+	return d
+}
+
+// GetBytes returns the environment variable key parsed as a size in bytes,
+// either a plain number or one with a KB, MB or GB suffix in powers of 1024
+// (e.g. "512KB", "10MB"), or fallback when it is unset or invalid.
+func GetBytes(key string, fallback int64) int64 {
+	v, ok := lookup(key)
+	n, err := ParseBytes(v.value)
+	if err != nil || n <= 0 {
+		n = fallback
+	}
+	remember(key, v, ok, FormatBytes(n), FormatBytes(fallback))
+	return n
+}
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// ParseBytes parses a size as GetBytes reads it.
+func ParseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	size := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, size = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * size, nil
+}
+
+// FormatBytes writes n in the largest unit that divides it, such as "1MB".
+func FormatBytes(n int64) string {
+	for _, u := range byteUnits {
+		if n != 0 && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// Setting is a variable the service has read and the value it used.
+type Setting struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Default string `json:"default"`
+	// Set is false when the variable is unset and the default applies.
+	Set bool `json:"set"`
+	// Source is "env" or "file" (CONFIG_FILE) for a variable that is set.
+	Source string `json:"source,omitempty"`
+	// SecretRef is the file a secretRef value was read from. Value is
+	// then always redacted.
+	SecretRef string `json:"secret_ref,omitempty"`
+}
+
+var (
+	mu   sync.Mutex
+	seen = map[string]Setting{}
+)
+
+func remember(key string, v value, ok bool, used, fallback string) {
+	mu.Lock()
+	seen[key] = Setting{Name: key, Value: used, Default: fallback, Set: ok, Source: v.source, SecretRef: v.ref}
+	mu.Unlock()
+}
+
+// refresh records a value applied by a reload, keeping the default the
+// service read the variable with.
+func refresh(key string, v value, ok bool) {
+	mu.Lock()
+	s := seen[key]
+	s.Name, s.Value, s.Set, s.Source, s.SecretRef = key, v.value, ok, v.source, v.ref
+	if !ok {
+		s.Value = s.Default
+	}
+	seen[key] = s
+	mu.Unlock()
+}
+
+func wasRead(key string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := seen[key]
+	return ok
+}
+
+// Snapshot lists every variable read through this package, by name, with
+// secrets redacted. Variables read only when a feature is used appear once
+// it has been.
+func Snapshot() []Setting {
+	mu.Lock()
+	defer mu.Unlock()
+	settings := make([]Setting, 0, len(seen))
+	for _, s := range seen {
+		s.Value, s.Default = Redact(s.Name, s.Value), Redact(s.Name, s.Default)
+		if s.SecretRef != "" {
+			s.Value = "[redacted]"
+		}
+		settings = append(settings, s)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	return settings
+}
+
+var secretWords = []string{"SECRET", "PASSWORD", "PASS", "TOKEN", "KEY", "CREDENTIAL"}
+
+// Redact hides the value of a variable whose name suggests a secret, such as
+// JWT_SECRET or POSTGRES_PASSWORD, and the passwords in connection strings
+// such as RABBITMQ_URL or POSTGRES_DSN: in each URL of a comma-separated
+// list, as DB_REPLICA_DSNS holds, and in a key=value DSN's password=.
+// Variables naming a file, such as TLS_KEY_FILE, are shown.
+func Redact(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if !strings.HasSuffix(name, "_FILE") {
+		for _, word := range secretWords {
+			if strings.Contains(name, word) {
+				return "[redacted]"
+			}
+		}
+	}
+	if !strings.Contains(value, "://") {
+		return dsnPassword.ReplaceAllString(value, "${1}xxxxx")
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		u, err := url.Parse(trimmed)
+		if err != nil {
+			// It may hold a password that cannot be picked out.
+			parts[i] = "[redacted]"
+			continue
+		}
+		_, redacted := u.User.Password()
+		if q := u.Query(); q.Has("password") {
+			q.Set("password", "xxxxx")
+			u.RawQuery = q.Encode()
+			redacted = true
+		}
+		if redacted {
+			parts[i] = strings.Replace(part, trimmed, u.Redacted(), 1)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// dsnPassword matches the password of a key=value DSN, quoted or not.
+var dsnPassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s']\S*)`)
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SecretRefPrefix marks a value to be read from a file, such as
+// "secretRef:/var/run/secrets/db/password", so a Kubernetes secret can be
+// mounted rather than put in the environment. Trailing newlines are
+// dropped.
+const SecretRefPrefix = "secretRef:"
+
+// value is a variable as found, before any fallback applies.
+type value struct {
+	value string
+	// ref is the file the value was read from, when it was a secretRef.
+	ref    string
+	source string
+}
+
+var (
+	fileMu     sync.RWMutex
+	fileValues = map[string]string{}
+	// fileResolved holds fileValues with their secretRefs read, as of the
+	// last load, so a reload can tell which settings changed.
+	fileResolved = map[string]string{}
+
+	reloadMu  sync.Mutex
+	reloaders = map[string][]func(string) error{}
+)
+
+// Lookup returns the variable key from the environment or, when it is unset
+// there, from CONFIG_FILE, with a secretRef read. ok is false when it is
+// set in neither, or its secretRef cannot be read.
+func Lookup(key string) (string, bool) {
+	v, ok := lookup(key)
+	return v.value, ok
+}
+
+func lookup(key string) (value, bool) {
+	raw, source := os.Getenv(key), "env"
+	if raw == "" {
+		fileMu.RLock()
+		raw = fileValues[key]
+		fileMu.RUnlock()
+		source = "file"
+	}
+	if raw == "" {
+		return value{}, false
+	}
+	ref, ok := strings.CutPrefix(raw, SecretRefPrefix)
+	if !ok {
+		return value{value: raw, source: source}, true
+	}
+	secret, err := readSecret(ref)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", key, err)
+		return value{}, false
+	}
+	return value{value: secret, ref: ref, source: source}, true
+}
+
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(strings.TrimSpace(path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Load reads CONFIG_FILE, a YAML or JSON object of variable names to
+// values, such as a mounted ConfigMap. Variables set in the environment
+// take precedence over it. Load fails when the file cannot be read or any
+// secretRef, in it or in the environment, names a file that cannot be, so
+// a bad mount stops the service on start rather than leaving it without a
+// credential. Without CONFIG_FILE only the environment is used.
+func Load() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	values, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolve(values)
+	if err != nil {
+		return err
+	}
+	var unreadable []string
+	for _, env := range os.Environ() {
+		key, raw, _ := strings.Cut(env, "=")
+		if ref, ok := strings.CutPrefix(raw, SecretRefPrefix); ok {
+			if _, err := readSecret(ref); err != nil {
+				unreadable = append(unreadable, fmt.Sprintf("%s: %v", key, err))
+			}
+		}
+	}
+	if len(unreadable) > 0 {
+		sort.Strings(unreadable)
+		return fmt.Errorf("unreadable secretRef for %s", strings.Join(unreadable, ", "))
+	}
+
+	fileMu.Lock()
+	fileValues, fileResolved = values, resolved
+	fileMu.Unlock()
+	return nil
+}
+
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string, len(doc))
+	for key, v := range doc {
+		switch v := v.(type) {
+		case map[string]any, []any:
+			return nil, fmt.Errorf("%s: %s must be a single value", path, key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// resolve reads the secretRefs among values.
+func resolve(values map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(values))
+	var unreadable []string
+	for key, raw := range values {
+		ref, ok := strings.CutPrefix(raw, SecretRefPrefix)
+		if !ok {
+			resolved[key] = raw
+			continue
+		}
+		secret, err := readSecret(ref)
+		if err != nil {
+			unreadable = append(unreadable, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		resolved[key] = secret
+	}
+	if len(unreadable) > 0 {
+		sort.Strings(unreadable)
+		return nil, fmt.Errorf("unreadable secretRef for %s", strings.Join(unreadable, ", "))
+	}
+	return resolved, nil
+}
+
+// OnChange registers fn to apply a new value of key without a restart,
+// when a reload of CONFIG_FILE changes it. fn gets "" when the key is
+// removed from the file, and should then fall back to its default.
+// Settings without a reloader are only read on start, so a reload just
+// logs that they changed.
+func OnChange(key string, fn func(string) error) {
+	reloadMu.Lock()
+	reloaders[key] = append(reloaders[key], fn)
+	reloadMu.Unlock()
+}
+
+// Watch reloads CONFIG_FILE every interval until ctx is done. Kubernetes
+// updates a mounted ConfigMap or secret in place, so the file is re-read
+// rather than watched for events. It does nothing without CONFIG_FILE.
+func Watch(ctx context.Context, interval time.Duration) {
+	if os.Getenv("CONFIG_FILE") == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := Reload(); err != nil {
+				log.Printf("Failed to reload CONFIG_FILE, keeping the last values: %v", err)
+			}
+		}
+	}
+}
+
+// Reload re-reads CONFIG_FILE and the secrets it refers to, and passes each
+// setting that changed to its reloaders. Settings set in the environment
+// are left alone, as they take precedence. When the file does not load,
+// the last values stay in force.
+func Reload() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	values, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolve(values)
+	if err != nil {
+		return err
+	}
+
+	fileMu.Lock()
+	old := fileResolved
+	fileValues, fileResolved = values, resolved
+	fileMu.Unlock()
+
+	for _, key := range changed(old, resolved) {
+		if os.Getenv(key) != "" {
+			continue
+		}
+		reloadMu.Lock()
+		fns := reloaders[key]
+		reloadMu.Unlock()
+		if len(fns) == 0 {
+			if wasRead(key) {
+				log.Printf("%s changed in CONFIG_FILE; restart to apply it", key)
+			}
+			continue
+		}
+		applied := true
+		for _, fn := range fns {
+			if err := fn(resolved[key]); err != nil {
+				log.Printf("Failed to apply %s from CONFIG_FILE: %v", key, err)
+				applied = false
+			}
+		}
+		if applied {
+			v, ok := lookup(key)
+			refresh(key, v, ok)
+			log.Printf("Applied %s from CONFIG_FILE", key)
+		}
+	}
+	return nil
+}
+
+// changed lists the keys whose value differs between a and b, including
+// those only one has.
+func changed(a, b map[string]string) []string {
+	var keys []string
+	for key, v := range a {
+		if w, ok := b[key]; !ok || w != v {
+			keys = append(keys, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
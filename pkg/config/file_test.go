@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestLoadAndReload(t *testing.T) {
+	dir := t.TempDir()
+	password := filepath.Join(dir, "password")
+	writeFile(t, password, "s3cret\n")
+	file := filepath.Join(dir, "config.yaml")
+	writeFile(t, file, "TEST_CFG_LEVEL: info\nTEST_CFG_PORT: 8081\nTEST_CFG_PASSWORD: secretRef:"+password+"\nTEST_CFG_OVERRIDDEN: file\n")
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("TEST_CFG_OVERRIDDEN", "env")
+	t.Cleanup(func() { fileValues, fileResolved = map[string]string{}, map[string]string{} })
+
+	if err := Load(); err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if v := GetEnv("TEST_CFG_PASSWORD", ""); v != "s3cret" {
+		t.Errorf("Expected the secret without its newline, got: %q", v)
+	}
+	if v := GetInt("TEST_CFG_PORT", 0); v != 8081 {
+		t.Errorf("Expected the port from the file, got: %d", v)
+	}
+	if v := GetEnv("TEST_CFG_OVERRIDDEN", ""); v != "env" {
+		t.Errorf("Expected the environment to win, got: %q", v)
+	}
+	for _, s := range Snapshot() {
+		if s.Name == "TEST_CFG_PASSWORD" && (s.Value != "[redacted]" || s.SecretRef != password || s.Source != "file") {
+			t.Errorf("Expected the secret redacted with its ref, got: %+v", s)
+		}
+	}
+
+	var applied []string
+	OnChange("TEST_CFG_LEVEL", func(v string) error {
+		applied = append(applied, v)
+		return nil
+	})
+	GetEnv("TEST_CFG_LEVEL", "")
+	writeFile(t, file, "TEST_CFG_LEVEL: debug\nTEST_CFG_PORT: 8081\nTEST_CFG_PASSWORD: secretRef:"+password+"\n")
+	if err := Reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if len(applied) != 1 || applied[0] != "debug" {
+		t.Errorf("Expected debug to be applied once, got: %v", applied)
+	}
+	if v, _ := Lookup("TEST_CFG_LEVEL"); v != "debug" {
+		t.Errorf("Expected lookups to see the reload, got: %q", v)
+	}
+
+	writeFile(t, file, "TEST_CFG_LEVEL: [debug]\n")
+	if err := Reload(); err == nil {
+		t.Error("Expected a list value to be rejected")
+	}
+	if v, _ := Lookup("TEST_CFG_PORT"); v != "8081" {
+		t.Errorf("Expected a bad file to leave the last values, got: %q", v)
+	}
+}
+
+func TestLoadFailsOnUnreadableSecret(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	writeFile(t, file, `{"TEST_CFG_PORT": 8081}`)
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("TEST_CFG_TOKEN", "secretRef:"+filepath.Join(dir, "missing"))
+	t.Cleanup(func() { fileValues, fileResolved = map[string]string{}, map[string]string{} })
+
+	if err := Load(); err == nil || !strings.Contains(err.Error(), "TEST_CFG_TOKEN") {
+		t.Errorf("Expected the missing secret to be reported, got: %v", err)
+	}
+}
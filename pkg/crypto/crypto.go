@@ -0,0 +1,159 @@
+// Package crypto is the envelope encryption services use for data they must
+// not store in the clear. Values are sealed with AES-256-GCM under a data
+// key, and data keys are stored wrapped by a master key that a KeyProvider
+// holds: keys from the environment (LocalKeys) or a key that never leaves
+// Vault (Transit). A database dump alone reveals nothing.
+package crypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// ErrUnknownKey is returned for a data key wrapped by a master key the
+// provider does not hold.
+var ErrUnknownKey = errors.New("unknown master key")
+
+// WrappedKey is a data key as stored: sealed under the master key
+// MasterKeyID.
+type WrappedKey struct {
+	MasterKeyID string
+	Wrapped     []byte
+}
+
+// KeyProvider wraps and unwraps data keys. The additional data is bound into
+// the wrapping, so a key wrapped for one use does not unwrap for another.
+type KeyProvider interface {
+	// Primary names the master key new data keys are wrapped under.
+	Primary() string
+	Wrap(ctx context.Context, key, additional []byte) (WrappedKey, error)
+	// Unwrap returns ErrUnknownKey for a master key the provider does not
+	// hold.
+	Unwrap(ctx context.Context, k WrappedKey, additional []byte) ([]byte, error)
+	// Rewrap moves k under the primary master key, and reports false when
+	// it already was.
+	Rewrap(ctx context.Context, k WrappedKey, additional []byte) (WrappedKey, bool, error)
+}
+
+// ProviderFromEnv reads the provider from prefix+"KEY_PROVIDER": "local"
+// (the default) for the keys in prefix+"MASTER_KEYS", or "vault" for the
+// transit key prefix+"VAULT_KEY" at VAULT_ADDR. With Vault, keys in
+// prefix+"MASTER_KEYS" still unwrap data keys wrapped before the switch
+// until they are rewrapped.
+func ProviderFromEnv(prefix string) (KeyProvider, error) {
+	masterKeys := config.GetEnv(prefix+"MASTER_KEYS", "")
+	switch provider := config.GetEnv(prefix+"KEY_PROVIDER", "local"); provider {
+	case "local":
+		keys, err := ParseMasterKeys(masterKeys)
+		if err != nil {
+			return nil, fmt.Errorf("%sMASTER_KEYS: %w", prefix, err)
+		}
+		return NewLocalKeys(keys)
+	case "vault":
+		addr, token, key := config.GetEnv("VAULT_ADDR", ""), config.GetEnv("VAULT_TOKEN", ""), config.GetEnv(prefix+"VAULT_KEY", "")
+		if addr == "" || token == "" || key == "" {
+			return nil, fmt.Errorf("the vault key provider needs VAULT_ADDR, VAULT_TOKEN and %sVAULT_KEY", prefix)
+		}
+		transit := NewTransit(httpclient.New(), addr, token, config.GetEnv("VAULT_TRANSIT_MOUNT", "transit"), key)
+		if masterKeys == "" {
+			return transit, nil
+		}
+		keys, err := ParseMasterKeys(masterKeys)
+		if err != nil {
+			return nil, fmt.Errorf("%sMASTER_KEYS: %w", prefix, err)
+		}
+		local, err := NewLocalKeys(keys)
+		if err != nil {
+			return nil, err
+		}
+		return WithFallback(transit, local), nil
+	default:
+		return nil, fmt.Errorf("unknown %sKEY_PROVIDER %q, want local or vault", prefix, provider)
+	}
+}
+
+// NewDataKey returns a random 256-bit data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewAEAD returns AES-GCM under key.
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext under a random nonce, which it prepends.
+func Seal(aead cipher.AEAD, plaintext, additional []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional)
+}
+
+// Open decrypts what Seal returned.
+func Open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], additional)
+}
+
+type fallback struct {
+	primary KeyProvider
+	older   []KeyProvider
+}
+
+// WithFallback wraps new data keys with primary, and unwraps those wrapped
+// by older providers until they are rewrapped, for moving from one provider
+// to another.
+func WithFallback(primary KeyProvider, older ...KeyProvider) KeyProvider {
+	return fallback{primary: primary, older: older}
+}
+
+func (f fallback) Primary() string {
+	return f.primary.Primary()
+}
+
+func (f fallback) Wrap(ctx context.Context, key, additional []byte) (WrappedKey, error) {
+	return f.primary.Wrap(ctx, key, additional)
+}
+
+func (f fallback) Unwrap(ctx context.Context, k WrappedKey, additional []byte) ([]byte, error) {
+	for _, p := range append([]KeyProvider{f.primary}, f.older...) {
+		key, err := p.Unwrap(ctx, k, additional)
+		if !errors.Is(err, ErrUnknownKey) {
+			return key, err
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+func (f fallback) Rewrap(ctx context.Context, k WrappedKey, additional []byte) (WrappedKey, bool, error) {
+	rewrapped, ok, err := f.primary.Rewrap(ctx, k, additional)
+	if !errors.Is(err, ErrUnknownKey) {
+		return rewrapped, ok, err
+	}
+	key, err := f.Unwrap(ctx, k, additional)
+	if err != nil {
+		return k, false, err
+	}
+	rewrapped, err = f.primary.Wrap(ctx, key, additional)
+	return rewrapped, err == nil, err
+}
@@ -0,0 +1,149 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func masterKey(id string, b byte) MasterKey {
+	return MasterKey{ID: id, Key: bytes.Repeat([]byte{b}, 32)}
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	keys, err := ParseMasterKeys("2024:" + key + ", 2023:" + key)
+	if err != nil || len(keys) != 2 || keys[0].ID != "2024" || keys[1].ID != "2023" {
+		t.Errorf("Expected two keys with the first as primary, got: %+v %v", keys, err)
+	}
+	for _, s := range []string{"", "2024", "2024:" + base64.StdEncoding.EncodeToString(make([]byte, 16)), "a:" + key + ",a:" + key} {
+		if _, err := ParseMasterKeys(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestLocalKeys(t *testing.T) {
+	ctx := context.Background()
+	ad := []byte("test")
+	old, _ := NewLocalKeys([]MasterKey{masterKey("k1", 1)})
+	wrapped, err := old.Wrap(ctx, []byte("data key"), ad)
+	if err != nil || wrapped.MasterKeyID != "k1" {
+		t.Fatalf("Expected a key wrapped under k1, got: %+v %v", wrapped, err)
+	}
+
+	keys, _ := NewLocalKeys([]MasterKey{masterKey("k2", 2), masterKey("k1", 1)})
+	if _, err := keys.Unwrap(ctx, wrapped, []byte("other")); err == nil {
+		t.Error("Expected other additional data not to unwrap")
+	}
+	rewrapped, ok, err := keys.Rewrap(ctx, wrapped, ad)
+	if err != nil || !ok || rewrapped.MasterKeyID != "k2" {
+		t.Fatalf("Expected the key rewrapped under k2, got: %+v %v %v", rewrapped, ok, err)
+	}
+	if _, ok, _ := keys.Rewrap(ctx, rewrapped, ad); ok {
+		t.Error("Expected a key under the primary to be left alone")
+	}
+
+	retired, _ := NewLocalKeys([]MasterKey{masterKey("k2", 2)})
+	if key, err := retired.Unwrap(ctx, rewrapped, ad); err != nil || string(key) != "data key" {
+		t.Errorf("Expected the rewrapped key to unwrap under k2 alone, got: %q %v", key, err)
+	}
+	if _, err := retired.Unwrap(ctx, wrapped, ad); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey without k1, got: %v", err)
+	}
+}
+
+// fakeVault is a transit engine whose ciphertext is the plaintext, the
+// additional data and the key version in the clear.
+func fakeVault(t *testing.T, version *int) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		var in map[string]string
+		json.NewDecoder(r.Body).Decode(&in)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/pii":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{
+				"ciphertext": fmt.Sprintf("vault:v%d:%s:%s", *version, in["plaintext"], in["associated_data"]),
+			}})
+		case "/v1/transit/decrypt/pii":
+			parts := strings.Split(in["ciphertext"], ":")
+			if len(parts) != 4 || parts[3] != in["associated_data"] {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]any{"errors": []string{"cipher: message authentication failed"}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"plaintext": parts[2]}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestTransit(t *testing.T) {
+	ctx := context.Background()
+	ad := []byte("test")
+	version := 1
+	vault := fakeVault(t, &version)
+	transit := NewTransit(vault.Client(), vault.URL+"/", "token", "/transit/", "pii")
+
+	wrapped, err := transit.Wrap(ctx, []byte("data key"), ad)
+	if err != nil || wrapped.MasterKeyID != "vault:pii" || !strings.HasPrefix(string(wrapped.Wrapped), "vault:v1:") {
+		t.Fatalf("Expected a key wrapped by Vault, got: %+v %v", wrapped, err)
+	}
+	if key, err := transit.Unwrap(ctx, wrapped, ad); err != nil || string(key) != "data key" {
+		t.Errorf("Expected the key to unwrap, got: %q %v", key, err)
+	}
+	if _, err := transit.Unwrap(ctx, wrapped, []byte("other")); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected Vault's error for other additional data, got: %v", err)
+	}
+	if _, ok, err := transit.Rewrap(ctx, wrapped, ad); ok || err != nil {
+		t.Errorf("Expected no rewrap before Vault rotates the key, got: %v %v", ok, err)
+	}
+	version = 2
+	if rewrapped, ok, err := transit.Rewrap(ctx, wrapped, ad); !ok || err != nil || !strings.HasPrefix(string(rewrapped.Wrapped), "vault:v2:") {
+		t.Errorf("Expected a rewrap under the rotated key, got: %+v %v %v", rewrapped, ok, err)
+	}
+
+	denied := NewTransit(vault.Client(), vault.URL, "wrong", "transit", "pii")
+	if _, err := denied.Wrap(ctx, []byte("data key"), ad); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected Vault's error, got: %v", err)
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	ctx := context.Background()
+	ad := []byte("test")
+	version := 1
+	vault := fakeVault(t, &version)
+	local, _ := NewLocalKeys([]MasterKey{masterKey("k1", 1)})
+	before, _ := local.Wrap(ctx, []byte("data key"), ad)
+
+	keys := WithFallback(NewTransit(vault.Client(), vault.URL, "token", "transit", "pii"), local)
+	if keys.Primary() != "vault:pii" {
+		t.Errorf("Expected Vault to be primary, got: %s", keys.Primary())
+	}
+	if key, err := keys.Unwrap(ctx, before, ad); err != nil || string(key) != "data key" {
+		t.Errorf("Expected a locally wrapped key to unwrap, got: %q %v", key, err)
+	}
+	rewrapped, ok, err := keys.Rewrap(ctx, before, ad)
+	if err != nil || !ok || rewrapped.MasterKeyID != "vault:pii" {
+		t.Errorf("Expected the key moved to Vault, got: %+v %v %v", rewrapped, ok, err)
+	}
+	if _, err := keys.Unwrap(ctx, WrappedKey{MasterKeyID: "k9"}, ad); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got: %v", err)
+	}
+}
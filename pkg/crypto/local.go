@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MasterKey is a 256-bit key-encryption key.
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// ParseMasterKeys parses comma-separated id:base64 pairs, primary first.
+// The others only unwrap data keys until they are rewrapped under the
+// primary.
+func ParseMasterKeys(s string) ([]MasterKey, error) {
+	var keys []MasterKey
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || len(id) > 32 {
+			return nil, fmt.Errorf("master key %q: want id:base64", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %s: want 32 bytes of base64", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("master key %s listed twice", id)
+		}
+		seen[id] = true
+		keys = append(keys, MasterKey{ID: id, Key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no master keys")
+	}
+	return keys, nil
+}
+
+// LocalKeys wraps data keys under master keys the service holds itself.
+type LocalKeys struct {
+	master  map[string]cipher.AEAD
+	primary string
+}
+
+// NewLocalKeys wraps new data keys under the first master key.
+func NewLocalKeys(master []MasterKey) (*LocalKeys, error) {
+	if len(master) == 0 {
+		return nil, errors.New("no master keys")
+	}
+	l := &LocalKeys{master: map[string]cipher.AEAD{}, primary: master[0].ID}
+	for _, k := range master {
+		aead, err := NewAEAD(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s: %w", k.ID, err)
+		}
+		l.master[k.ID] = aead
+	}
+	return l, nil
+}
+
+func (l *LocalKeys) Primary() string {
+	return l.primary
+}
+
+func (l *LocalKeys) Wrap(ctx context.Context, key, additional []byte) (WrappedKey, error) {
+	return WrappedKey{MasterKeyID: l.primary, Wrapped: Seal(l.master[l.primary], key, additional)}, nil
+}
+
+func (l *LocalKeys) Unwrap(ctx context.Context, k WrappedKey, additional []byte) ([]byte, error) {
+	kek, ok := l.master[k.MasterKeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return Open(kek, k.Wrapped, additional)
+}
+
+func (l *LocalKeys) Rewrap(ctx context.Context, k WrappedKey, additional []byte) (WrappedKey, bool, error) {
+	if k.MasterKeyID == l.primary {
+		return k, false, nil
+	}
+	key, err := l.Unwrap(ctx, k, additional)
+	if err != nil {
+		return k, false, err
+	}
+	rewrapped, err := l.Wrap(ctx, key, additional)
+	return rewrapped, err == nil, err
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Transit wraps data keys with a key in Vault's transit secrets engine, so
+// the master key never leaves Vault. The key must be an AEAD type, such as
+// the default aes256-gcm96, for the additional data to be bound. Rotating
+// it in Vault is picked up by Rewrap.
+type Transit struct {
+	client *http.Client
+	addr   string
+	token  string
+	mount  string
+	key    string
+}
+
+// NewTransit uses the transit key named key, mounted at mount on the Vault
+// server at addr.
+func NewTransit(client *http.Client, addr, token, mount, key string) *Transit {
+	return &Transit{client: client, addr: strings.TrimRight(addr, "/"), token: token, mount: strings.Trim(mount, "/"), key: key}
+}
+
+// Primary is "vault:" and the key's name. Which version of the key wrapped
+// a data key is kept in the wrapped key itself.
+func (t *Transit) Primary() string {
+	return "vault:" + t.key
+}
+
+func (t *Transit) Wrap(ctx context.Context, key, additional []byte) (WrappedKey, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := t.call(ctx, "encrypt", map[string]string{
+		"plaintext":       base64.StdEncoding.EncodeToString(key),
+		"associated_data": base64.StdEncoding.EncodeToString(additional),
+	}, &out)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return WrappedKey{MasterKeyID: t.Primary(), Wrapped: []byte(out.Ciphertext)}, nil
+}
+
+func (t *Transit) Unwrap(ctx context.Context, k WrappedKey, additional []byte) ([]byte, error) {
+	if k.MasterKeyID != t.Primary() {
+		return nil, ErrUnknownKey
+	}
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	err := t.call(ctx, "decrypt", map[string]string{
+		"ciphertext":      string(k.Wrapped),
+		"associated_data": base64.StdEncoding.EncodeToString(additional),
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// Rewrap wraps k again, and keeps the result only if the key has been
+// rotated in Vault since k was wrapped.
+func (t *Transit) Rewrap(ctx context.Context, k WrappedKey, additional []byte) (WrappedKey, bool, error) {
+	key, err := t.Unwrap(ctx, k, additional)
+	if err != nil {
+		return k, false, err
+	}
+	rewrapped, err := t.Wrap(ctx, key, additional)
+	if err != nil {
+		return k, false, err
+	}
+	if keyVersion(rewrapped.Wrapped) == keyVersion(k.Wrapped) {
+		return k, false, nil
+	}
+	return rewrapped, true, nil
+}
+
+// keyVersion returns the "v3" of a "vault:v3:..." ciphertext.
+func keyVersion(ciphertext []byte) string {
+	parts := strings.SplitN(string(ciphertext), ":", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+func (t *Transit) call(ctx context.Context, op string, in map[string]string, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", t.addr, t.mount, op, t.key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", t.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault transit %s: %w", op, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+		return fmt.Errorf("vault transit %s: status %d: %s", op, resp.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("vault transit %s: %w", op, err)
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	os.Setenv("POSTGRES_HOST", "db")
+	os.Setenv("DB_MAX_OPEN_CONNS", "50")
+	os.Setenv("DB_STATEMENT_TIMEOUT", "2s")
+	defer os.Unsetenv("POSTGRES_HOST")
+	defer os.Unsetenv("DB_MAX_OPEN_CONNS")
+	defer os.Unsetenv("DB_STATEMENT_TIMEOUT")
+
+	cfg := ConfigFromEnv()
+	if cfg.Host != "db" || cfg.MaxOpenConns != 50 || cfg.StatementTimeout != 2*time.Second {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	want := "host=db port=5432 user=postgres password= dbname=postgres sslmode=disable statement_timeout=2000"
+	if cfg.Port != "5432" || cfg.dsn() != want {
+		t.Errorf("Expected dsn %q, got: %q", want, cfg.dsn())
+	}
+}
+
+func TestPingWithRetry(t *testing.T) {
+	attempts := 0
+	ping := func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	if err := pingWithRetry(ping, 5, time.Millisecond); err != nil {
+		t.Fatalf("Expected ping to succeed, got: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got: %d", attempts)
+	}
+}
+
+func TestPingWithRetryGivesUp(t *testing.T) {
+	attempts := 0
+	ping := func(ctx context.Context) error {
+		attempts++
+		return errors.New("connection refused")
+	}
+
+	if err := pingWithRetry(ping, 2, time.Millisecond); err == nil {
+		t.Fatal("Expected ping to fail")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got: %d", attempts)
+	}
+}
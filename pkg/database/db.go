@@ -0,0 +1,225 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/gin-gonic/gin"
+	_ "github.com/lib/pq"
+)
+
+type Config struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	// DSN, when set, is used instead of the fields above. It may be a
+	// key=value string or a postgres:// URL.
+	DSN string
+	// ReplicaDSNs are read replicas of the database, in either DSN form.
+	// See Replicas.
+	ReplicaDSNs []string
+	// ReplicaMaxLag is how far behind a replica may be and still serve
+	// reads; ReplicaCheckInterval is how often the lag is measured.
+	ReplicaMaxLag        time.Duration
+	ReplicaCheckInterval time.Duration
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// StatementTimeout is enforced server-side by Postgres; zero disables it.
+	StatementTimeout time.Duration
+	// QueryTimeout bounds each query issued through WithTimeout, on top of
+	// the caller's context (usually the request context).
+	QueryTimeout time.Duration
+
+	// ConnectRetries is how many times the initial ping is retried before
+	// giving up, waiting RetryInterval (doubling each attempt) in between.
+	ConnectRetries int
+	RetryInterval  time.Duration
+}
+
+// ConfigFromEnv reads the connection settings from POSTGRES_* and the pool
+// settings from DB_* environment variables.
+func ConfigFromEnv() Config {
+	return Config{
+		Host:     config.GetEnv("POSTGRES_HOST", "localhost"),
+		Port:     config.GetEnv("POSTGRES_PORT", "5432"),
+		User:     config.GetEnv("POSTGRES_USER", "postgres"),
+		Password: config.GetEnv("POSTGRES_PASSWORD", ""),
+		Name:     config.GetEnv("POSTGRES_DB", "postgres"),
+		DSN:      config.GetEnv("POSTGRES_DSN", ""),
+
+		ReplicaDSNs:          splitDSNs(config.GetEnv("DB_REPLICA_DSNS", "")),
+		ReplicaMaxLag:        config.GetDuration("DB_REPLICA_MAX_LAG", 5*time.Second),
+		ReplicaCheckInterval: config.GetDuration("DB_REPLICA_CHECK_INTERVAL", 5*time.Second),
+
+		MaxOpenConns:     config.GetInt("DB_MAX_OPEN_CONNS", 25),
+		MaxIdleConns:     config.GetInt("DB_MAX_IDLE_CONNS", 5),
+		ConnMaxLifetime:  config.GetDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		ConnMaxIdleTime:  config.GetDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+		StatementTimeout: config.GetDuration("DB_STATEMENT_TIMEOUT", 30*time.Second),
+		QueryTimeout:     config.GetDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+
+		ConnectRetries: config.GetInt("DB_CONNECT_RETRIES", 5),
+		RetryInterval:  config.GetDuration("DB_CONNECT_RETRY_INTERVAL", time.Second),
+	}
+}
+
+// splitDSNs splits a comma-separated list, so DSNs must not contain
+// commas themselves.
+func splitDSNs(s string) []string {
+	var dsns []string
+	for _, dsn := range strings.Split(s, ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			dsns = append(dsns, dsn)
+		}
+	}
+	return dsns
+}
+
+func (c Config) dsn() string {
+	if c.DSN != "" {
+		return c.withStatementTimeout(c.DSN)
+	}
+	return c.withStatementTimeout(fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		c.Host, c.Port, c.User, c.Password, c.Name))
+}
+
+// withStatementTimeout adds the statement timeout to dsn, which lib/pq
+// sends to the server as a run-time parameter in either DSN form.
+func (c Config) withStatementTimeout(dsn string) string {
+	if c.StatementTimeout <= 0 {
+		return dsn
+	}
+	ms := c.StatementTimeout.Milliseconds()
+	if !strings.Contains(dsn, "://") {
+		return dsn + fmt.Sprintf(" statement_timeout=%d", ms)
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + fmt.Sprintf("&statement_timeout=%d", ms)
+	}
+	return dsn + fmt.Sprintf("?statement_timeout=%d", ms)
+}
+
+// Connect opens a pool configured from the environment. See ConfigFromEnv.
+func Connect() (*sql.DB, error) {
+	return ConnectWithConfig(ConfigFromEnv())
+}
+
+func ConnectWithConfig(cfg Config) (*sql.DB, error) {
+	db, err := cfg.open(cfg.dsn())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.QueryTimeout > 0 {
+		queryTimeout = cfg.QueryTimeout
+	}
+
+	if err := pingWithRetry(db.PingContext, cfg.ConnectRetries, cfg.RetryInterval); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// open opens a pool for dsn with the configured pool settings.
+func (c Config) open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	return db, nil
+}
+
+var queryTimeout = 5 * time.Second
+
+// WithTimeout derives a context for a single query (or transaction) from ctx,
+// bounded by the configured query timeout. Cancellation of ctx, e.g. when the
+// client disconnects, still propagates.
+//
+//	ctx, cancel := database.WithTimeout(ctx)
+//	defer cancel()
+func WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, queryTimeout)
+}
+
+func pingWithRetry(ping func(context.Context) error, retries int, interval time.Duration) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = ping(ctx)
+		cancel()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		log.Printf("Database not ready (attempt %d/%d): %v", attempt+1, retries+1, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// StatsProvider exposes connection pool statistics. *sql.DB implements it.
+type StatsProvider interface {
+	Stats() sql.DBStats
+}
+
+type PoolStats struct {
+	MaxOpenConnections int           `json:"max_open_connections"`
+	OpenConnections    int           `json:"open_connections"`
+	InUse              int           `json:"in_use"`
+	Idle               int           `json:"idle"`
+	WaitCount          int64         `json:"wait_count"`
+	WaitDuration       time.Duration `json:"wait_duration_ns"`
+	MaxIdleClosed      int64         `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64         `json:"max_lifetime_closed"`
+}
+
+func Stats(p StatsProvider) PoolStats {
+	s := p.Stats()
+	return PoolStats{
+		MaxOpenConnections: s.MaxOpenConnections,
+		OpenConnections:    s.OpenConnections,
+		InUse:              s.InUse,
+		Idle:               s.Idle,
+		WaitCount:          s.WaitCount,
+		WaitDuration:       s.WaitDuration,
+		MaxIdleClosed:      s.MaxIdleClosed,
+		MaxLifetimeClosed:  s.MaxLifetimeClosed,
+	}
+}
+
+// HealthHandler reports database reachability along with pool statistics.
+func HealthHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		defer cancel()
+
+		if err := db.PingContext(ctx); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "unhealthy",
+				"error":  err.Error(),
+				"pool":   Stats(db),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "healthy",
+			"pool":   Stats(db),
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build integration
+
+package database_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/testfactory"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(testfactory.Main(m))
+}
+
+// TestConnect reaches Connect through testfactory.DB, which configures it
+// from the POSTGRES_* variables.
+func TestConnect(t *testing.T) {
+	db := testfactory.DB(t)
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Failed to ping database: %v", err)
+	}
+}
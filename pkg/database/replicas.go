@@ -0,0 +1,263 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Replicas spreads reads over read replicas of the primary. Only reads a
+// request marks as safe to serve stale go to a replica: Middleware marks GET
+// and HEAD requests, and a store routes a query through Reader to let it
+// use one. Each replica's replication lag is measured every check interval,
+// and a replica further behind than the maximum lag, or that failed its
+// last check, is skipped until it catches up. With no replica to use, reads
+// fall back to the primary.
+//
+// A nil *Replicas sends every read to the primary.
+type Replicas struct {
+	maxLag time.Duration
+	nodes  []*replica
+	next   atomic.Uint64
+	// fallbacks counts reads that could have gone to a replica but went
+	// to the primary because none was usable.
+	fallbacks atomic.Int64
+}
+
+type replica struct {
+	name  string
+	db    *sql.DB
+	probe func(ctx context.Context) (time.Duration, error)
+	reads atomic.Int64
+
+	mu        sync.Mutex
+	checked   bool
+	lag       time.Duration
+	lastErr   string
+	checkedAt time.Time
+}
+
+// ConnectReplicas opens the replicas configured from the environment. See
+// ConfigFromEnv.
+func ConnectReplicas() (*Replicas, error) {
+	return ConnectReplicasWithConfig(ConfigFromEnv())
+}
+
+// ConnectReplicasWithConfig opens a pool per cfg.ReplicaDSNs, with the same
+// pool settings as the primary, and measures their lag once. A replica that
+// cannot be reached yet is not an error: it serves no reads until a check
+// succeeds. It returns nil when no replicas are configured.
+func ConnectReplicasWithConfig(cfg Config) (*Replicas, error) {
+	if len(cfg.ReplicaDSNs) == 0 {
+		return nil, nil
+	}
+	r := &Replicas{maxLag: cfg.ReplicaMaxLag}
+	for i, dsn := range cfg.ReplicaDSNs {
+		db, err := cfg.open(cfg.withStatementTimeout(dsn))
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("replica %d: %w", i+1, err)
+		}
+		r.nodes = append(r.nodes, newReplica(fmt.Sprintf("replica-%d", i+1), db))
+	}
+	r.Check(context.Background())
+	return r, nil
+}
+
+func newReplica(name string, db *sql.DB) *replica {
+	n := &replica{name: name, db: db}
+	n.probe = n.measureLag
+	return n
+}
+
+// measureLag reports how far the replica's replay is behind. A replica that
+// has replayed everything it received counts as caught up, so an idle
+// primary does not make it look ever further behind.
+func (n *replica) measureLag(ctx context.Context) (time.Duration, error) {
+	const query string = `SELECT pg_is_in_recovery(), CASE
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END`
+	var recovering bool
+	var seconds float64
+	if err := n.db.QueryRowContext(ctx, query).Scan(&recovering, &seconds); err != nil {
+		return 0, err
+	}
+	if !recovering {
+		return 0, errors.New("not a replica: the server is not in recovery")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Check measures every replica's lag now.
+func (r *Replicas) Check(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	for _, n := range r.nodes {
+		probeCtx, cancel := WithTimeout(ctx)
+		lag, err := n.probe(probeCtx)
+		cancel()
+
+		n.mu.Lock()
+		wasUsable := n.usable(r.maxLag)
+		n.checked, n.lag, n.checkedAt, n.lastErr = true, lag, time.Now().UTC(), ""
+		if err != nil {
+			n.lastErr = err.Error()
+		}
+		usable := n.usable(r.maxLag)
+		n.mu.Unlock()
+
+		switch {
+		case err != nil && wasUsable:
+			log.Printf("Database %s check failed, reading from the primary instead: %v", n.name, err)
+		case err == nil && !usable && wasUsable:
+			log.Printf("Database %s is %v behind, reading from the primary instead", n.name, lag)
+		case usable && !wasUsable:
+			log.Printf("Database %s is serving reads, %v behind", n.name, lag)
+		}
+	}
+}
+
+// usable reports whether the replica may serve reads. Call with mu held.
+func (n *replica) usable(maxLag time.Duration) bool {
+	return n.checked && n.lastErr == "" && n.lag <= maxLag
+}
+
+// Run checks the replicas every interval until ctx is cancelled.
+func (r *Replicas) Run(ctx context.Context, interval time.Duration) {
+	if r == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Check(ctx)
+		}
+	}
+}
+
+// pick returns the next usable replica in turn, or nil if there is none.
+func (r *Replicas) pick() *replica {
+	for range r.nodes {
+		n := r.nodes[r.next.Add(1)%uint64(len(r.nodes))]
+		n.mu.Lock()
+		ok := n.usable(r.maxLag)
+		n.mu.Unlock()
+		if ok {
+			return n
+		}
+	}
+	return nil
+}
+
+func (r *Replicas) Close() error {
+	if r == nil {
+		return nil
+	}
+	var errs []error
+	for _, n := range r.nodes {
+		errs = append(errs, n.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type replicasKey struct{}
+
+// Middleware lets GET and HEAD requests read from a replica, through Reader.
+// Other requests, which may read back what they just wrote, always read
+// from the primary.
+func (r *Replicas) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r != nil && (c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), replicasKey{}, r))
+		}
+		c.Next()
+	}
+}
+
+// Reader returns the pool a read-only query should use: a usable replica
+// when ctx allows reading from one, and primary otherwise. Queries that
+// must see the caller's own writes, and anything in a transaction, use
+// the primary directly instead.
+func Reader(ctx context.Context, primary *sql.DB) *sql.DB {
+	r, _ := ctx.Value(replicasKey{}).(*Replicas)
+	if r == nil {
+		return primary
+	}
+	n := r.pick()
+	if n == nil {
+		r.fallbacks.Add(1)
+		return primary
+	}
+	n.reads.Add(1)
+	return n.db
+}
+
+// ReplicaStats is a replica as GET /metrics/database shows it.
+type ReplicaStats struct {
+	Name      string     `json:"name"`
+	Usable    bool       `json:"usable"`
+	LagMillis int64      `json:"lag_ms"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Reads     int64      `json:"reads"`
+	Pool      PoolStats  `json:"pool"`
+}
+
+// Pools returns each replica's connection pool by name.
+func (r *Replicas) Pools() map[string]StatsProvider {
+	if r == nil {
+		return nil
+	}
+	pools := make(map[string]StatsProvider, len(r.nodes))
+	for _, n := range r.nodes {
+		pools[n.name] = n.db
+	}
+	return pools
+}
+
+// MetricsHandler reports the primary's pool and, per replica, its lag,
+// whether it is serving reads, how many it has served and its pool.
+func (r *Replicas) MetricsHandler(primary *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		resp := gin.H{"primary": gin.H{"pool": Stats(primary)}, "replicas": []ReplicaStats{}}
+		if r == nil {
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		replicas := make([]ReplicaStats, len(r.nodes))
+		for i, n := range r.nodes {
+			n.mu.Lock()
+			replicas[i] = ReplicaStats{
+				Name:      n.name,
+				Usable:    n.usable(r.maxLag),
+				LagMillis: n.lag.Milliseconds(),
+				LastError: n.lastErr,
+				Reads:     n.reads.Load(),
+				Pool:      Stats(n.db),
+			}
+			if n.checked {
+				at := n.checkedAt
+				replicas[i].CheckedAt = &at
+			}
+			n.mu.Unlock()
+		}
+		resp["replicas"] = replicas
+		resp["max_lag_ms"] = r.maxLag.Milliseconds()
+		resp["primary_fallbacks"] = r.fallbacks.Load()
+		c.JSON(http.StatusOK, resp)
+	}
+}
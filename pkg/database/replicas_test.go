@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReplicaDSNs(t *testing.T) {
+	cfg := Config{StatementTimeout: time.Second}
+	if got := cfg.withStatementTimeout("postgres://u:p@replica:5432/db?sslmode=disable"); got != "postgres://u:p@replica:5432/db?sslmode=disable&statement_timeout=1000" {
+		t.Errorf("Expected the timeout added as a URL parameter, got: %q", got)
+	}
+	cfg.DSN = "host=primary dbname=db"
+	if got := cfg.dsn(); got != "host=primary dbname=db statement_timeout=1000" {
+		t.Errorf("Expected DSN to replace the connection fields, got: %q", got)
+	}
+	if dsns := splitDSNs(" host=a , ,host=b"); len(dsns) != 2 || dsns[1] != "host=b" {
+		t.Errorf("Expected two DSNs, got: %q", dsns)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	open := func() *sql.DB {
+		db, _ := sql.Open("postgres", "host=nowhere")
+		return db
+	}
+	primary := open()
+	lags := map[string]time.Duration{"replica-1": 0, "replica-2": 0}
+	var failing string
+	r := &Replicas{maxLag: time.Second}
+	for _, name := range []string{"replica-1", "replica-2"} {
+		name := name
+		n := newReplica(name, open())
+		n.probe = func(ctx context.Context) (time.Duration, error) {
+			if failing == name {
+				return 0, errors.New("connection refused")
+			}
+			return lags[name], nil
+		}
+		r.nodes = append(r.nodes, n)
+	}
+	defer r.Close()
+
+	router := gin.New()
+	router.Use(r.Middleware())
+	var used *sql.DB
+	router.Any("/read", func(c *gin.Context) { used = Reader(c.Request.Context(), primary) })
+	router.GET("/metrics/database", r.MetricsHandler(primary))
+	read := func(method string) *sql.DB {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/read", nil))
+		return used
+	}
+
+	if read(http.MethodGet) != primary {
+		t.Error("Expected replicas not yet checked to be skipped")
+	}
+	r.Check(context.Background())
+	first, second := read(http.MethodGet), read(http.MethodGet)
+	if first == primary || second == primary || first == second {
+		t.Error("Expected GETs spread over both replicas")
+	}
+	if read(http.MethodPost) != primary {
+		t.Error("Expected writes' reads to stay on the primary")
+	}
+	if Reader(context.Background(), primary) != primary {
+		t.Error("Expected reads outside a request to use the primary")
+	}
+
+	lags["replica-1"] = 2 * time.Second
+	failing = "replica-2"
+	r.Check(context.Background())
+	if read(http.MethodGet) != primary {
+		t.Error("Expected a lagging and a failing replica to fall back to the primary")
+	}
+	lags["replica-1"] = 500 * time.Millisecond
+	r.Check(context.Background())
+	if read(http.MethodGet) != r.nodes[0].db || read(http.MethodGet) != r.nodes[0].db {
+		t.Error("Expected only the caught-up replica to serve reads")
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics/database", nil))
+	var metrics struct {
+		Replicas         []ReplicaStats `json:"replicas"`
+		PrimaryFallbacks int64          `json:"primary_fallbacks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(metrics.Replicas) != 2 || metrics.Replicas[0].Reads != 3 || metrics.Replicas[0].LagMillis != 500 ||
+		metrics.Replicas[1].Usable || metrics.Replicas[1].LastError != "connection refused" || metrics.PrimaryFallbacks != 2 {
+		t.Errorf("Unexpected metrics: %s", w.Body)
+	}
+
+	var none *Replicas
+	router = gin.New()
+	router.Use(none.Middleware())
+	router.GET("/read", func(c *gin.Context) { used = Reader(c.Request.Context(), primary) })
+	if read(http.MethodGet) != primary {
+		t.Error("Expected no replicas to read from the primary")
+	}
+}
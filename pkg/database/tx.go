@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TxAttempts is how many times WithTx runs a transaction that Postgres
+// aborted with a serialization failure or deadlock.
+const TxAttempts = 3
+
+type txKey struct{}
+
+// txState is the transaction on a WithTx callback's context.
+type txState struct {
+	db    *sql.DB
+	tx    *sql.Tx
+	depth int
+}
+
+// WithTx runs fn in a transaction on db, committing if fn returns nil and
+// rolling back otherwise, or if fn panics or ctx is cancelled.
+//
+// Called with the context of another WithTx callback, it nests: fn runs in
+// a savepoint of the outer transaction, and an error from fn rolls back to
+// the savepoint only, leaving the outer fn to decide whether to carry on.
+//
+// A transaction that fails with a serialization failure or deadlock is
+// retried from the start, up to TxAttempts times, so fn must not have
+// effects outside the transaction. Only the outermost call retries, as
+// such an error aborts the whole transaction.
+//
+//	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+//		...
+//	})
+func WithTx(ctx context.Context, db *sql.DB, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	if outer, ok := ctx.Value(txKey{}).(*txState); ok && outer.db == db {
+		return withSavepoint(ctx, outer, fn)
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = runTx(ctx, db, fn); err == nil || !retryable(err) || attempt == TxAttempts {
+			return err
+		}
+		backoff := time.Duration(attempt*attempt) * 10 * time.Millisecond
+		log.Printf("Retrying transaction in %v after attempt %d failed: %v", backoff, attempt, err)
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, fn func(ctx context.Context, tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = fn(context.WithValue(ctx, txKey{}, &txState{db: db, tx: tx}), tx); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func withSavepoint(ctx context.Context, outer *txState, fn func(ctx context.Context, tx *sql.Tx) error) (err error) {
+	inner := &txState{db: outer.db, tx: outer.tx, depth: outer.depth + 1}
+	name := fmt.Sprintf("sp_%d", inner.depth)
+	if _, err := outer.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	defer func() {
+		p := recover()
+		// A serialization failure aborts the whole transaction, which the
+		// outermost WithTx retries; there is nothing to roll back to.
+		if (p != nil || err != nil) && !retryable(err) {
+			if _, rbErr := outer.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+				err = errors.Join(err, rbErr)
+			}
+		}
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	if err = fn(context.WithValue(ctx, txKey{}, inner), outer.tx); err != nil {
+		return err
+	}
+	_, err = outer.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
+
+// retryable reports whether err is Postgres aborting a transaction that
+// may succeed if run again.
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
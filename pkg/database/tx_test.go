@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// recorder is a driver that logs the statements it is sent and fails the
+// ones queued in fail, in order.
+type recorder struct {
+	mu   sync.Mutex
+	log  []string
+	fail map[string][]error
+}
+
+func (r *recorder) exec(stmt string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log = append(r.log, stmt)
+	if errs := r.fail[stmt]; len(errs) > 0 {
+		r.fail[stmt] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (r *recorder) Connect(context.Context) (driver.Conn, error) { return recorderConn{r}, nil }
+func (r *recorder) Driver() driver.Driver                        { return nil }
+
+type recorderConn struct{ r *recorder }
+
+func (c recorderConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c recorderConn) Close() error                        { return nil }
+func (c recorderConn) Begin() (driver.Tx, error)           { return c, c.r.exec("BEGIN") }
+func (c recorderConn) Commit() error                       { return c.r.exec("COMMIT") }
+func (c recorderConn) Rollback() error                     { return c.r.exec("ROLLBACK") }
+
+func (c recorderConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), c.r.exec(query)
+}
+
+func TestWithTx(t *testing.T) {
+	errBoom := errors.New("boom")
+	serialization := &pq.Error{Code: "40001"}
+	exec := func(stmt string) func(ctx context.Context, tx *sql.Tx) error {
+		return func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, stmt)
+			return err
+		}
+	}
+
+	tests := []struct {
+		name string
+		fail map[string][]error
+		fn   func(db *sql.DB) func(ctx context.Context, tx *sql.Tx) error
+		want []string
+		err  error
+	}{
+		{
+			name: "commits",
+			fn:   func(*sql.DB) func(context.Context, *sql.Tx) error { return exec("INSERT a") },
+			want: []string{"BEGIN", "INSERT a", "COMMIT"},
+		},
+		{
+			name: "rolls back on error",
+			fn: func(*sql.DB) func(context.Context, *sql.Tx) error {
+				return func(context.Context, *sql.Tx) error { return errBoom }
+			},
+			want: []string{"BEGIN", "ROLLBACK"},
+			err:  errBoom,
+		},
+		{
+			name: "nested calls use savepoints",
+			fail: map[string][]error{"INSERT c": {errBoom}},
+			fn: func(db *sql.DB) func(context.Context, *sql.Tx) error {
+				return func(ctx context.Context, tx *sql.Tx) error {
+					if err := WithTx(ctx, db, exec("INSERT b")); err != nil {
+						return err
+					}
+					if err := WithTx(ctx, db, exec("INSERT c")); !errors.Is(err, errBoom) {
+						return errors.New("expected the savepoint's error")
+					}
+					return exec("INSERT d")(ctx, tx)
+				}
+			},
+			want: []string{"BEGIN", "SAVEPOINT sp_1", "INSERT b", "RELEASE SAVEPOINT sp_1",
+				"SAVEPOINT sp_1", "INSERT c", "ROLLBACK TO SAVEPOINT sp_1", "INSERT d", "COMMIT"},
+		},
+		{
+			name: "retries serialization failures",
+			fail: map[string][]error{"COMMIT": {serialization}},
+			fn:   func(*sql.DB) func(context.Context, *sql.Tx) error { return exec("INSERT a") },
+			want: []string{"BEGIN", "INSERT a", "COMMIT", "BEGIN", "INSERT a", "COMMIT"},
+		},
+		{
+			name: "retries the whole transaction from a savepoint",
+			fail: map[string][]error{"INSERT b": {serialization}},
+			fn: func(db *sql.DB) func(context.Context, *sql.Tx) error {
+				return func(ctx context.Context, tx *sql.Tx) error {
+					return WithTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+						return WithTx(ctx, db, exec("INSERT b"))
+					})
+				}
+			},
+			want: []string{"BEGIN", "SAVEPOINT sp_1", "SAVEPOINT sp_2", "INSERT b", "ROLLBACK",
+				"BEGIN", "SAVEPOINT sp_1", "SAVEPOINT sp_2", "INSERT b", "RELEASE SAVEPOINT sp_2", "RELEASE SAVEPOINT sp_1", "COMMIT"},
+		},
+		{
+			name: "gives up after TxAttempts",
+			fail: map[string][]error{"INSERT a": {serialization, serialization, serialization}},
+			fn:   func(*sql.DB) func(context.Context, *sql.Tx) error { return exec("INSERT a") },
+			want: []string{"BEGIN", "INSERT a", "ROLLBACK", "BEGIN", "INSERT a", "ROLLBACK", "BEGIN", "INSERT a", "ROLLBACK"},
+			err:  serialization,
+		},
+	}
+	for _, tt := range tests {
+		r := &recorder{fail: tt.fail}
+		db := sql.OpenDB(r)
+		err := WithTx(context.Background(), db, tt.fn(db))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected error %v, got: %v", tt.name, tt.err, err)
+		}
+		if !reflect.DeepEqual(r.log, tt.want) {
+			t.Errorf("%s: expected statements %q, got: %q", tt.name, tt.want, r.log)
+		}
+		db.Close()
+	}
+}
+
+func TestWithTxCancelled(t *testing.T) {
+	r := &recorder{}
+	db := sql.OpenDB(r)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := WithTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled transaction to fail, got: %v", err)
+	}
+	for _, stmt := range r.log {
+		if stmt == "COMMIT" {
+			t.Errorf("Expected a cancelled transaction not to commit, got: %q", r.log)
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to be passed on")
+			}
+		}()
+		WithTx(context.Background(), db, func(ctx context.Context, tx *sql.Tx) error { panic("boom") })
+	}()
+	if last := r.log[len(r.log)-1]; last != "ROLLBACK" {
+		t.Errorf("Expected a panicking transaction to roll back, got: %q", r.log)
+	}
+}
@@ -0,0 +1,90 @@
+// Package deadline passes a request's time budget from hop to hop, so no
+// service keeps working on a request after the client has given up on it.
+// The gateway gives each request a budget, and every outbound call (see
+// httpclient) sends what is left of it in X-Request-Budget as whole
+// milliseconds. The receiving service's Middleware turns that back into a
+// context deadline. The budget is relative rather than a wall clock time,
+// so hosts whose clocks disagree still agree on it; the time a call spends
+// on the wire is the only thing it does not account for.
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/ndjson"
+	"github.com/gin-gonic/gin"
+)
+
+const Header = "X-Request-Budget"
+
+// Middleware sets the request context's deadline from the caller's
+// X-Request-Budget, capped at limit when limit is positive. Without the
+// header, a positive limit is the budget and 0 leaves the request without a
+// deadline. A request whose budget has already run out gets 504 without
+// reaching the handler.
+//
+// WebSocket upgrades, NDJSON listings and event streams are meant to
+// outlive any budget, so they are left without a deadline.
+func Middleware(limit time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if longLived(c.Request) {
+			c.Next()
+			return
+		}
+		budget := limit
+		if raw := c.GetHeader(Header); raw != "" {
+			ms, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": Header + " must be a whole number of milliseconds"})
+				return
+			}
+			if requested := time.Duration(ms) * time.Millisecond; limit <= 0 || requested < limit {
+				budget = requested
+			}
+			if budget <= 0 {
+				c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "the request's time budget has run out"})
+				return
+			}
+		}
+		if budget <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), budget)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// Remaining returns what is left of ctx's budget, and false when ctx has no
+// deadline.
+func Remaining(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(d), true
+}
+
+// Propagate returns req with X-Request-Budget set to what is left of its
+// context's budget, replacing any budget copied from an incoming request. A
+// request without a deadline is returned as it is.
+func Propagate(req *http.Request) *http.Request {
+	remaining, ok := Remaining(req.Context())
+	if !ok {
+		return req
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(Header, strconv.FormatInt(max(remaining.Milliseconds(), 0), 10))
+	return req
+}
+
+func longLived(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" || ndjson.Accepted(r) ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
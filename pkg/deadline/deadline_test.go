@@ -0,0 +1,79 @@
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name    string
+		limit   time.Duration
+		headers map[string]string
+		code    int
+		// budget is the deadline the handler sees, or 0 for none.
+		budget time.Duration
+	}{
+		{name: "no budget", code: http.StatusOK},
+		{name: "limit only", limit: 30 * time.Second, code: http.StatusOK, budget: 30 * time.Second},
+		{name: "caller's budget", headers: map[string]string{Header: "1500"}, code: http.StatusOK, budget: 1500 * time.Millisecond},
+		{name: "shorter than the limit", limit: 30 * time.Second, headers: map[string]string{Header: "1500"}, code: http.StatusOK, budget: 1500 * time.Millisecond},
+		{name: "capped at the limit", limit: time.Second, headers: map[string]string{Header: "60000"}, code: http.StatusOK, budget: time.Second},
+		{name: "run out", limit: time.Second, headers: map[string]string{Header: "0"}, code: http.StatusGatewayTimeout},
+		{name: "invalid", headers: map[string]string{Header: "1.5s"}, code: http.StatusBadRequest},
+		{name: "websocket", limit: time.Second, headers: map[string]string{"Upgrade": "websocket"}, code: http.StatusOK},
+		{name: "ndjson", limit: time.Second, headers: map[string]string{"Accept": "application/x-ndjson"}, code: http.StatusOK},
+		{name: "event stream", limit: time.Second, headers: map[string]string{"Accept": "text/event-stream"}, code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		var budget time.Duration
+		router := gin.New()
+		router.Use(Middleware(tt.limit))
+		router.GET("/", func(c *gin.Context) {
+			budget, _ = Remaining(c.Request.Context())
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got: %d", tt.name, tt.code, w.Code)
+		}
+		if budget > tt.budget || budget < tt.budget-100*time.Millisecond {
+			t.Errorf("%s: expected a budget of %v, got: %v", tt.name, tt.budget, budget)
+		}
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if Propagate(req).Header.Get(Header) != "" {
+		t.Error("Expected no budget on a request without a deadline")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set(Header, "60000")
+	out := Propagate(req)
+	if got := out.Header.Get(Header); got > "2000" || got < "1900" || len(got) != 4 {
+		t.Errorf("Expected the remaining budget to replace the copied one, got: %q", got)
+	}
+	if req.Header.Get(Header) != "60000" {
+		t.Error("Expected the original request to be left alone")
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if got := Propagate(req.WithContext(expired)).Header.Get(Header); got != "0" {
+		t.Errorf("Expected a budget that has run out to be sent as 0, got: %q", got)
+	}
+}
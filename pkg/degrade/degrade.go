@@ -0,0 +1,181 @@
+// Package degrade tracks the dependencies a service can run without, such as
+// the broker and Redis. While one is down its callers fall back instead of
+// failing, try it again at most once per retry interval, and report how long
+// it has spent degraded.
+package degrade
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrUnavailable is returned, wrapped with the dependency's name, by callers
+// that skip a degraded dependency rather than wait on it.
+var ErrUnavailable = errors.New("dependency degraded")
+
+// Dependency is one dependency's health as its callers last saw it. A
+// failure marks it degraded, and the first success after that marks it
+// healthy again.
+type Dependency struct {
+	Name  string
+	Retry time.Duration
+	now   func() time.Time
+
+	mu       sync.Mutex
+	degraded bool
+	since    time.Time
+	lastTry  time.Time
+	lastErr  string
+	total    time.Duration
+	episodes int
+	backlog  func() int
+}
+
+// Status is one dependency as GET /metrics/degraded shows it. Degraded
+// seconds include the current episode.
+type Status struct {
+	Name            string     `json:"name"`
+	Degraded        bool       `json:"degraded"`
+	Since           *time.Time `json:"degraded_since,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	DegradedSeconds float64    `json:"degraded_seconds_total"`
+	Episodes        int        `json:"episodes"`
+	Backlog         *int       `json:"backlog,omitempty"`
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*Dependency{}
+)
+
+// Register returns the dependency called name, creating it with retry if
+// this is the first caller to ask, so everything in the process that uses a
+// dependency shares one view of it.
+func Register(name string, retry time.Duration) *Dependency {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if d, ok := registry[name]; ok {
+		return d
+	}
+	d := &Dependency{Name: name, Retry: retry, now: time.Now}
+	registry[name] = d
+	return d
+}
+
+// Available reports whether a call to the dependency should be attempted:
+// always while it is healthy, and once per Retry while it is degraded.
+func (d *Dependency) Available() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.degraded {
+		return true
+	}
+	now := d.now()
+	if now.Before(d.lastTry.Add(d.Retry)) {
+		return false
+	}
+	d.lastTry = now
+	return true
+}
+
+func (d *Dependency) Degraded() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.degraded
+}
+
+// Fail records a failed call, starting a degraded episode if the dependency
+// was healthy.
+func (d *Dependency) Fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	if err != nil {
+		d.lastErr = err.Error()
+	}
+	d.lastTry = now
+	if d.degraded {
+		return
+	}
+	d.degraded, d.since = true, now
+	d.episodes++
+}
+
+// Recover records a successful call, ending the degraded episode if there
+// is one.
+func (d *Dependency) Recover() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.degraded {
+		return
+	}
+	d.total += d.now().Sub(d.since)
+	d.degraded, d.lastErr = false, ""
+}
+
+// Track records the outcome of a call: err nil recovers the dependency and
+// anything else fails it.
+func (d *Dependency) Track(err error) {
+	if err != nil {
+		d.Fail(err)
+		return
+	}
+	d.Recover()
+}
+
+// SetBacklog reports n, such as the events waiting to be replayed, with the
+// dependency's status.
+func (d *Dependency) SetBacklog(n func() int) {
+	d.mu.Lock()
+	d.backlog = n
+	d.mu.Unlock()
+}
+
+func (d *Dependency) Status() Status {
+	d.mu.Lock()
+	st := Status{Name: d.Name, Degraded: d.degraded, LastError: d.lastErr, Episodes: d.episodes}
+	total := d.total
+	if d.degraded {
+		since := d.since
+		st.Since = &since
+		total += d.now().Sub(d.since)
+	}
+	backlog := d.backlog
+	d.mu.Unlock()
+
+	st.DegradedSeconds = total.Seconds()
+	if backlog != nil {
+		n := backlog()
+		st.Backlog = &n
+	}
+	return st
+}
+
+// Snapshot returns every registered dependency, sorted by name.
+func Snapshot() []Status {
+	registryMu.Lock()
+	deps := make([]*Dependency, 0, len(registry))
+	for _, d := range registry {
+		deps = append(deps, d)
+	}
+	registryMu.Unlock()
+
+	out := make([]Status, 0, len(deps))
+	for _, d := range deps {
+		out = append(out, d.Status())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Handler serves Snapshot.
+func Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"dependencies": Snapshot()})
+	}
+}
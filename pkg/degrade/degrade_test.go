@@ -0,0 +1,54 @@
+package degrade
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDependency(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := Register("test-dependency", time.Minute)
+	d.now = func() time.Time { return now }
+	if Register("test-dependency", time.Hour) != d {
+		t.Fatal("Expected the same dependency for the same name")
+	}
+
+	if !d.Available() || d.Degraded() {
+		t.Fatal("Expected a new dependency to be healthy")
+	}
+	d.Fail(errors.New("connection refused"))
+	if d.Available() {
+		t.Error("Expected a degraded dependency to be skipped until the retry interval passes")
+	}
+	now = now.Add(time.Minute)
+	if !d.Available() || d.Available() {
+		t.Error("Expected one attempt once the retry interval passed")
+	}
+	d.Fail(errors.New("connection refused"))
+
+	now = now.Add(30 * time.Second)
+	st := d.Status()
+	if !st.Degraded || st.Episodes != 1 || st.DegradedSeconds != 90 || st.LastError != "connection refused" || st.Since == nil {
+		t.Errorf("Expected one ongoing 90s episode, got: %+v", st)
+	}
+
+	d.Recover()
+	now = now.Add(time.Hour)
+	d.SetBacklog(func() int { return 3 })
+	st = d.Status()
+	if st.Degraded || st.DegradedSeconds != 90 || st.LastError != "" || st.Backlog == nil || *st.Backlog != 3 {
+		t.Errorf("Expected a recovered dependency to keep its degraded time, got: %+v", st)
+	}
+	if !d.Available() {
+		t.Error("Expected a recovered dependency to be available")
+	}
+
+	found := false
+	for _, s := range Snapshot() {
+		found = found || s.Name == "test-dependency"
+	}
+	if !found {
+		t.Error("Expected the dependency in the snapshot")
+	}
+}
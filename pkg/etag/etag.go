@@ -0,0 +1,80 @@
+// Package etag ties responses to the version of the record they were built
+// from. Reads send the version as an ETag and answer a matching
+// If-None-Match with 304 Not Modified; writes must send If-Match with the
+// version they read, so two edits made from the same read cannot both
+// succeed and the second silently undo the first.
+package etag
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrMismatch is returned by stores when the record's version is no longer
+// the one the caller read.
+var ErrMismatch = errors.New("the record has changed since it was read; fetch it again and retry")
+
+// Any is the version IfMatch returns for If-Match: *, which applies the
+// write to whatever version is current.
+const Any int64 = 0
+
+// Format returns the ETag for a version.
+func Format(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// NotModified sets the ETag for version and, when If-None-Match names it,
+// responds 304 Not Modified and returns true.
+func NotModified(c *gin.Context, version int64) bool {
+	tag := Format(version)
+	c.Header("ETag", tag)
+	if !matches(c.GetHeader("If-None-Match"), tag) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// IfMatch returns the version named by If-Match. A missing header is 428
+// Precondition Required and one that names no version 412 Precondition
+// Failed; both respond and return false. The weak form of a version's
+// ETag names the version too: a response is only weakened when it is sent
+// compressed (see compress.Middleware), which does not change the record
+// it was built from.
+func IfMatch(c *gin.Context) (int64, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match is required; send the ETag from a GET"})
+		return 0, false
+	}
+	if header == "*" {
+		return Any, true
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match must be an ETag from a GET"})
+		return 0, false
+	}
+	return version, true
+}
+
+// Failed responds 412 Precondition Failed for ErrMismatch.
+func Failed(c *gin.Context) {
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": ErrMismatch.Error()})
+}
+
+// matches reports whether an If-None-Match header names tag. Weak
+// comparison applies, as it does for If-None-Match.
+func matches(ifNoneMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
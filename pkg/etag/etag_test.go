@@ -0,0 +1,66 @@
+package etag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func request(header, value string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		c.Request.Header.Set(header, value)
+	}
+	return c, w
+}
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{`"3"`, true},
+		{`W/"3"`, true},
+		{`"1", "3"`, true},
+		{"*", true},
+		{`"2"`, false},
+	}
+	for _, tt := range tests {
+		c, w := request("If-None-Match", tt.ifNoneMatch)
+		if got := NotModified(c, 3); got != tt.want {
+			t.Errorf("If-None-Match %q: expected %v, got: %v", tt.ifNoneMatch, tt.want, got)
+		}
+		c.Writer.WriteHeaderNow()
+		if w.Header().Get("ETag") != `"3"` || (tt.want && w.Code != http.StatusNotModified) {
+			t.Errorf("If-None-Match %q: expected ETag \"3\" and a 304 on a match, got: %d %s", tt.ifNoneMatch, w.Code, w.Header())
+		}
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		ifMatch string
+		version int64
+		status  int
+	}{
+		{`"4"`, 4, 0},
+		{"*", Any, 0},
+		{"", 0, http.StatusPreconditionRequired},
+		{`W/"4"`, 4, 0},
+		{`W/"abc"`, 0, http.StatusPreconditionFailed},
+		{`"abc"`, 0, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		c, w := request("If-Match", tt.ifMatch)
+		version, ok := IfMatch(c)
+		if ok != (tt.status == 0) || version != tt.version || (!ok && w.Code != tt.status) {
+			t.Errorf("If-Match %q: expected %d (status %d), got: %d %v %d", tt.ifMatch, tt.version, tt.status, version, ok, w.Code)
+		}
+	}
+}
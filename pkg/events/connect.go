@@ -0,0 +1,45 @@
+package events
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/degrade"
+)
+
+// Connect dials the broker at url and publishes through a Spool, so events
+// published while the broker is down are kept and replayed when it is back
+// rather than lost or failing the request. EVENT_SPOOL_FILE keeps them
+// across restarts too. The spool stays in front of the broker when it is
+// unreachable at startup, but there is no subscriber until a restart
+// reaches it. An empty url falls back to a LogPublisher, so a missing
+// broker degrades event delivery instead of preventing startup.
+func Connect(url, exchange string) (Publisher, Subscriber, func()) {
+	if url == "" {
+		log.Println("RABBITMQ_URL not set, events will only be logged")
+		return LogPublisher{}, nil, func() {}
+	}
+
+	broker, err := DialRabbitMQ(url, exchange)
+	dep := degrade.Register("rabbitmq", config.GetDuration("EVENT_SPOOL_RETRY", 5*time.Second))
+	var subscriber Subscriber = broker
+	if err != nil {
+		log.Printf("Failed to connect to RabbitMQ, spooling events until it is reachable: %v", err)
+		broker, subscriber = &RabbitMQ{url: url, exchange: exchange}, nil
+		dep.Fail(err)
+	}
+	spool, err := NewSpool(broker, dep, config.GetEnv("EVENT_SPOOL_FILE", ""), config.GetInt("EVENT_SPOOL_MAX", 10000))
+	if err != nil {
+		log.Printf("Failed to read event spool, events will only be logged: %v", err)
+		broker.Close()
+		return LogPublisher{}, nil, func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go spool.Run(ctx, dep.Retry)
+	return spool, subscriber, func() {
+		cancel()
+		broker.Close()
+	}
+}
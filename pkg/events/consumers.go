@@ -0,0 +1,91 @@
+package events
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConsumerStats is how far behind one subscription is. Backlog is what the
+// broker holds for the queue, and LagSeconds how long the last event
+// handled had waited since it was published.
+type ConsumerStats struct {
+	Queue string `json:"queue"`
+	// Backlog is -1 when the broker could not be asked.
+	Backlog       int        `json:"backlog"`
+	LagSeconds    float64    `json:"lag_seconds"`
+	Handled       int64      `json:"handled"`
+	Failures      int64      `json:"failures"`
+	LastHandledAt *time.Time `json:"last_handled_at,omitempty"`
+}
+
+// consumer tracks one running Subscribe call.
+type consumer struct {
+	backlog func() (int, error)
+
+	mu    sync.Mutex
+	stats ConsumerStats
+}
+
+var consumers = struct {
+	sync.Mutex
+	running map[*consumer]bool
+}{running: map[*consumer]bool{}}
+
+// track registers a subscription on queue until stop is called. backlog
+// asks the broker how many messages the queue holds.
+func track(queue string, backlog func() (int, error)) *consumer {
+	c := &consumer{backlog: backlog, stats: ConsumerStats{Queue: queue}}
+	consumers.Lock()
+	consumers.running[c] = true
+	consumers.Unlock()
+	return c
+}
+
+func (c *consumer) stop() {
+	consumers.Lock()
+	delete(consumers.running, c)
+	consumers.Unlock()
+}
+
+// handled records an event handled at now, successfully unless err is set.
+func (c *consumer) handled(e Event, now time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Handled++
+	if err != nil {
+		c.stats.Failures++
+	}
+	c.stats.LastHandledAt = &now
+	if !e.OccurredAt.IsZero() {
+		c.stats.LagSeconds = max(now.Sub(e.OccurredAt).Seconds(), 0)
+	}
+}
+
+// Consumers reports every subscription running in this process, by queue.
+// It asks the broker for each queue's backlog, so it costs a round trip per
+// subscription.
+func Consumers() []ConsumerStats {
+	consumers.Lock()
+	running := make([]*consumer, 0, len(consumers.running))
+	for c := range consumers.running {
+		running = append(running, c)
+	}
+	consumers.Unlock()
+
+	stats := make([]ConsumerStats, len(running))
+	for i, c := range running {
+		backlog := -1
+		if c.backlog != nil {
+			if n, err := c.backlog(); err == nil {
+				backlog = n
+			}
+		}
+		c.mu.Lock()
+		stats[i] = c.stats
+		c.mu.Unlock()
+		stats[i].Backlog = backlog
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Queue < stats[j].Queue })
+	return stats
+}
@@ -0,0 +1,30 @@
+package events
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConsumers(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	orders := track("notification-service.orders", func() (int, error) { return 12, nil })
+	defer orders.stop()
+	private := track("amq.gen-1", func() (int, error) { return 0, errors.New("channel closed") })
+
+	orders.handled(Event{OccurredAt: now.Add(-3 * time.Second)}, now, nil)
+	orders.handled(Event{OccurredAt: now.Add(-time.Second)}, now, errors.New("failed"))
+
+	stats := Consumers()
+	if len(stats) != 2 || stats[0].Queue != "amq.gen-1" || stats[0].Backlog != -1 {
+		t.Fatalf("Expected both queues, with an unknown backlog for the first, got: %+v", stats)
+	}
+	if s := stats[1]; s.Backlog != 12 || s.Handled != 2 || s.Failures != 1 || s.LagSeconds != 1 || !s.LastHandledAt.Equal(now) {
+		t.Errorf("Expected 2 events handled 1s behind with 12 waiting, got: %+v", s)
+	}
+
+	private.stop()
+	if stats := Consumers(); len(stats) != 1 {
+		t.Errorf("Expected a stopped subscription to be dropped, got: %+v", stats)
+	}
+}
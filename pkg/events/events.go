@@ -0,0 +1,87 @@
+// Package events defines the envelope for domain events exchanged between
+// services and the publisher/subscriber abstractions used to move them.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+type Event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Version is the version of Type's payload schema Data follows; see
+	// package schema. Events from before versioning have none, and are read
+	// as version 1.
+	Version    int             `json:"version,omitempty"`
+	Source     string          `json:"source"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+	// Replayed is set on events the replay tool rebuilt from history and
+	// sent to one consumer, rather than published as they happened.
+	Replayed bool `json:"replayed,omitempty"`
+}
+
+// New builds an event of the given type with data marshalled as its payload.
+func New(eventType, source string, data any) (Event, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:         hex.EncodeToString(id),
+		Type:       eventType,
+		Source:     source,
+		OccurredAt: time.Now().UTC(),
+		Data:       payload,
+	}, nil
+}
+
+// Decode unmarshals the event payload into v.
+func (e Event) Decode(v any) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Handler processes one event. Returning an error requeues it.
+type Handler func(ctx context.Context, e Event) error
+
+// IgnoreReplays acknowledges replayed events without handling them, for
+// consumers whose side effects, such as sending an email, must not happen
+// again or late.
+func IgnoreReplays(handler Handler) Handler {
+	return func(ctx context.Context, e Event) error {
+		if e.Replayed {
+			return nil
+		}
+		return handler(ctx, e)
+	}
+}
+
+type Subscriber interface {
+	// Subscribe consumes events whose type matches one of patterns from the
+	// named durable queue until ctx is cancelled. Subscribers sharing a queue
+	// split its events; an empty queue name gets a private queue that lives
+	// as long as the subscription, so every such subscriber sees every event.
+	Subscribe(ctx context.Context, queue string, patterns []string, handler Handler) error
+}
+
+// LogPublisher only logs events. Services fall back to it when the broker is
+// not configured.
+type LogPublisher struct{}
+
+func (LogPublisher) Publish(ctx context.Context, e Event) error {
+	log.Printf("Event %s %s from %s: %s", e.Type, e.ID, e.Source, e.Data)
+	return nil
+}
@@ -0,0 +1,193 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RabbitMQ publishes events to a topic exchange using the event type as the
+// routing key, so consumers can bind with patterns like "order.*".
+// Publishing on a lost connection dials the broker again first.
+type RabbitMQ struct {
+	url      string
+	exchange string
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+func DialRabbitMQ(url, exchange string) (*RabbitMQ, error) {
+	r := &RabbitMQ{url: url, exchange: exchange}
+	if err := r.dial(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// dial connects and declares the exchange. r.mu must be held, or r not yet
+// shared.
+func (r *RabbitMQ) dial() error {
+	conn, err := amqp.Dial(r.url)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := ch.ExchangeDeclare(r.exchange, "topic", true, false, false, false, nil); err != nil {
+		conn.Close()
+		return err
+	}
+	r.conn, r.ch = conn, ch
+	return nil
+}
+
+func (r *RabbitMQ) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+func (r *RabbitMQ) Publish(ctx context.Context, e Event) error {
+	return r.publish(ctx, r.exchange, e.Type, e)
+}
+
+// SendTo delivers e to queue alone, through the broker's default exchange,
+// rather than to every queue bound to its type. It is for replaying events
+// into one consumer; see QueueDepth to check the queue exists first.
+func (r *RabbitMQ) SendTo(ctx context.Context, queue string, e Event) error {
+	return r.publish(ctx, "", queue, e)
+}
+
+// QueueDepth returns how many messages queue holds, or an error if it does
+// not exist.
+func (r *RabbitMQ) QueueDepth(queue string) (int, error) {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+	if conn == nil {
+		return 0, amqp.ErrClosed
+	}
+	// A failed passive declare closes its channel, so it gets one of its
+	// own.
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	return q.Messages, err
+}
+
+func (r *RabbitMQ) publish(ctx context.Context, exchange, key string, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil || r.conn.IsClosed() || r.ch.IsClosed() {
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		if err := r.dial(); err != nil {
+			r.conn, r.ch = nil, nil
+			return err
+		}
+	}
+	return r.ch.PublishWithContext(ctx, exchange, key, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    e.ID,
+		Type:         e.Type,
+		Timestamp:    e.OccurredAt,
+		Body:         body,
+	})
+}
+
+func (r *RabbitMQ) Subscribe(ctx context.Context, queue string, patterns []string, handler Handler) error {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+	if conn == nil {
+		return amqp.ErrClosed
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	durable, autoDelete, exclusive := true, false, false
+	if queue == "" {
+		durable, autoDelete, exclusive = false, true, true
+	}
+	q, err := ch.QueueDeclare(queue, durable, autoDelete, exclusive, false, nil)
+	if err != nil {
+		return err
+	}
+	queue = q.Name
+	for _, pattern := range patterns {
+		if err := ch.QueueBind(queue, pattern, r.exchange, false, nil); err != nil {
+			return err
+		}
+	}
+	if err := ch.Qos(10, 0, false); err != nil {
+		return err
+	}
+
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	// The backlog is read on a channel of its own, since a failed passive
+	// declare closes the channel it was sent on.
+	tracked := track(queue, func() (int, error) {
+		inspect, err := conn.Channel()
+		if err != nil {
+			return 0, err
+		}
+		defer inspect.Close()
+		q, err := inspect.QueueDeclarePassive(queue, durable, autoDelete, exclusive, false, nil)
+		return q.Messages, err
+	})
+	defer tracked.stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				return fmt.Errorf("delivery channel for queue %s closed", queue)
+			}
+			var e Event
+			if err := json.Unmarshal(d.Body, &e); err != nil {
+				log.Printf("Dropping malformed event on %s: %v", queue, err)
+				d.Nack(false, false)
+				continue
+			}
+			err := handler(ctx, e)
+			tracked.handled(e, time.Now(), err)
+			if err != nil {
+				log.Printf("Failed to handle event %s %s: %v", e.Type, e.ID, err)
+				d.Nack(false, !d.Redelivered)
+				continue
+			}
+			d.Ack(false)
+		}
+	}
+}
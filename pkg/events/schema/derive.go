@@ -0,0 +1,79 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// Derive returns the schema of what encoding/json makes of v's type: a
+// field is required unless it is omitempty, and nil slices, maps and
+// pointers that are not omitempty are nullable. Tests compare it with the
+// latest registered schema of each event, to catch payload changes that
+// were not given a new version.
+func Derive(title string, v any) *Schema {
+	s := derive(reflect.TypeOf(v), false)
+	s.Title = title
+	return s
+}
+
+func derive(t reflect.Type, nullable bool) *Schema {
+	orNull := func(name string) Types {
+		if nullable {
+			return Types{name, "null"}
+		}
+		return Types{name}
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: orNull("string"), Format: "date-time"}
+	case t == rawType:
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return derive(t.Elem(), nullable)
+	case reflect.Bool:
+		return &Schema{Type: orNull("boolean")}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: orNull("integer")}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: orNull("number")}
+	case reflect.String:
+		return &Schema{Type: orNull("string")}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: orNull("array"), Items: derive(t.Elem(), t.Elem().Kind() == reflect.Pointer)}
+	case reflect.Map:
+		return &Schema{Type: orNull("object")}
+	case reflect.Struct:
+		s := &Schema{Type: orNull("object"), Properties: map[string]*Schema{}}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			omitempty := strings.Contains(","+opts+",", ",omitempty,")
+			kind := f.Type.Kind()
+			s.Properties[name] = derive(f.Type, !omitempty && (kind == reflect.Pointer || kind == reflect.Slice || kind == reflect.Map))
+			if !omitempty {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s
+	}
+	return &Schema{}
+}
@@ -0,0 +1,191 @@
+package schema
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+)
+
+var (
+	// ErrUnknownType is returned for publishing an event type that has no
+	// schema.
+	ErrUnknownType = errors.New("event type has no schema")
+	// ErrInvalid is returned for an event whose payload breaks its schema.
+	ErrInvalid = errors.New("event payload breaks its schema")
+)
+
+//go:embed schemas/*.json
+var files embed.FS
+
+// Default holds the schemas in schemas/.
+var Default = mustLoad(files, "schemas")
+
+func mustLoad(fsys fs.FS, dir string) *Registry {
+	r, err := Load(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+var fileName = regexp.MustCompile(`^(.+)\.v([1-9][0-9]*)\.json$`)
+
+// Registry is every version of every event type's schema.
+type Registry struct {
+	// versions holds version n of a type at index n-1.
+	versions map[string][]*Schema
+}
+
+// Load reads the <event type>.v<N>.json files in dir. Each type's versions
+// must run from 1 without gaps.
+func Load(fsys fs.FS, dir string) (*Registry, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byType := map[string]map[int]*Schema{}
+	for _, entry := range entries {
+		m := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			return nil, fmt.Errorf("schema file %s: want <event type>.v<N>.json", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[2])
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var s Schema
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("schema file %s: %w", entry.Name(), err)
+		}
+		if byType[m[1]] == nil {
+			byType[m[1]] = map[int]*Schema{}
+		}
+		byType[m[1]][version] = &s
+	}
+	r := &Registry{versions: map[string][]*Schema{}}
+	for eventType, versions := range byType {
+		for v := 1; v <= len(versions); v++ {
+			s, ok := versions[v]
+			if !ok {
+				return nil, fmt.Errorf("schema for %s: version %d is missing", eventType, v)
+			}
+			r.versions[eventType] = append(r.versions[eventType], s)
+		}
+	}
+	return r, nil
+}
+
+// Types returns the event types with a schema, sorted.
+func (r *Registry) Types() []string {
+	types := make([]string, 0, len(r.versions))
+	for t := range r.versions {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Latest returns the newest version of eventType's schema.
+func (r *Registry) Latest(eventType string) (int, *Schema, bool) {
+	versions := r.versions[eventType]
+	if len(versions) == 0 {
+		return 0, nil, false
+	}
+	return len(versions), versions[len(versions)-1], true
+}
+
+// Breaking returns, by event type, every change between consecutive
+// versions that breaks consumers of the older one.
+func (r *Registry) Breaking() map[string][]string {
+	breaking := map[string][]string{}
+	for eventType, versions := range r.versions {
+		for i := 1; i < len(versions); i++ {
+			for _, change := range versions[i].Compatible(versions[i-1]) {
+				breaking[eventType] = append(breaking[eventType], fmt.Sprintf("v%d: %s", i+1, change))
+			}
+		}
+	}
+	return breaking
+}
+
+// Validate checks e's payload against the version of its schema it names.
+// A version newer than any registered is checked against the latest, which
+// it is compatible with; versions only ever add optional properties.
+func (r *Registry) Validate(e events.Event) error {
+	versions := r.versions[e.Type]
+	if len(versions) == 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownType, e.Type)
+	}
+	version := min(max(e.Version, 1), len(versions))
+	if problems := versions[version-1].Validate(e.Data); len(problems) > 0 {
+		return fmt.Errorf("%w: %s v%d: %s", ErrInvalid, e.Type, version, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Connect is events.Connect with every event validated against the
+// Default registry as it is published and consumed.
+func Connect(url, exchange string) (events.Publisher, events.Subscriber, func()) {
+	publisher, subscriber, closeEvents := events.Connect(url, exchange)
+	if subscriber != nil {
+		subscriber = Default.Subscriber(subscriber)
+	}
+	return Default.Publisher(publisher), subscriber, closeEvents
+}
+
+type publisher struct {
+	registry *Registry
+	next     events.Publisher
+}
+
+// Publisher stamps each event with the latest version of its schema and
+// refuses it, with ErrUnknownType or ErrInvalid, unless its payload follows
+// that version.
+func (r *Registry) Publisher(next events.Publisher) events.Publisher {
+	return publisher{registry: r, next: next}
+}
+
+func (p publisher) Publish(ctx context.Context, e events.Event) error {
+	if e.Version == 0 {
+		e.Version, _, _ = p.registry.Latest(e.Type)
+	}
+	if err := p.registry.Validate(e); err != nil {
+		return err
+	}
+	return p.next.Publish(ctx, e)
+}
+
+type subscriber struct {
+	registry *Registry
+	next     events.Subscriber
+}
+
+// Subscriber drops events whose payload breaks the version of the schema
+// they name, since handling them again would fail the same way. Events of
+// a type with no schema, from a producer newer than this registry, are
+// handled as they are.
+func (r *Registry) Subscriber(next events.Subscriber) events.Subscriber {
+	return subscriber{registry: r, next: next}
+}
+
+func (s subscriber) Subscribe(ctx context.Context, queue string, patterns []string, handler events.Handler) error {
+	return s.next.Subscribe(ctx, queue, patterns, func(ctx context.Context, e events.Event) error {
+		if err := s.registry.Validate(e); errors.Is(err, ErrInvalid) {
+			log.Printf("Dropping event %s from %s: %v", e.ID, e.Source, err)
+			return nil
+		}
+		return handler(ctx, e)
+	})
+}
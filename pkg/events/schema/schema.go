@@ -0,0 +1,190 @@
+// Package schema keeps a versioned JSON Schema for the payload of every
+// event type, so a producer cannot change an event's shape without its
+// consumers finding out. Payloads are validated as they are published and
+// as they are consumed, and tests check that the Go payload types still
+// match their latest schema and that each version can be read by consumers
+// of the one before.
+//
+// Schemas live in schemas/<event type>.v<N>.json and use a subset of JSON
+// Schema: type (a name or a list of names, "null" among them for a nullable
+// value), properties, required, items and format "date-time". Properties a
+// schema does not list are allowed, so adding one is never breaking.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schema is one JSON Schema, or one of its properties.
+type Schema struct {
+	Title      string             `json:"title,omitempty"`
+	Type       Types              `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+}
+
+// Types is the type keyword: a single name, or a list of them.
+type Types []string
+
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = Types{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("type must be a name or a list of names: %w", err)
+	}
+	*t = names
+	return nil
+}
+
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t Types) has(name string) bool {
+	for _, n := range t {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns every way the JSON document data breaks s.
+func (s *Schema) Validate(data []byte) []string {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []string{"payload is not JSON: " + err.Error()}
+	}
+	var problems []string
+	s.validate(v, "$", &problems)
+	return problems
+}
+
+func (s *Schema) validate(v any, at string, problems *[]string) {
+	if len(s.Type) > 0 && !s.Type.has(typeOf(v)) && !(typeOf(v) == "integer" && s.Type.has("number")) {
+		*problems = append(*problems, fmt.Sprintf("%s: want %s, got %s", at, strings.Join(s.Type, " or "), typeOf(v)))
+		return
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: missing required property %s", at, name))
+			}
+		}
+		for _, name := range sortedKeys(s.Properties) {
+			if pv, ok := v[name]; ok {
+				s.Properties[name].validate(pv, at+"."+name, problems)
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", at, i), problems)
+			}
+		}
+	case string:
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s: %q is not a date-time", at, v))
+			}
+		}
+	}
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// Compatible returns every change from old to s that breaks consumers of
+// old: a payload valid under s must be valid under old, so types may only
+// narrow, required properties stay required, and properties that are added
+// must be optional, since events published before s do not have them.
+func (s *Schema) Compatible(old *Schema) []string {
+	var breaking []string
+	s.compatible(old, "$", &breaking)
+	return breaking
+}
+
+func (s *Schema) compatible(old *Schema, at string, breaking *[]string) {
+	if len(old.Type) > 0 {
+		if len(s.Type) == 0 {
+			*breaking = append(*breaking, fmt.Sprintf("%s: type %s dropped", at, strings.Join(old.Type, " or ")))
+		}
+		for _, t := range s.Type {
+			if !old.Type.has(t) && !(t == "integer" && old.Type.has("number")) {
+				*breaking = append(*breaking, fmt.Sprintf("%s: type %s was not allowed before", at, t))
+			}
+		}
+	}
+	if old.Format != "" && s.Format != old.Format {
+		*breaking = append(*breaking, fmt.Sprintf("%s: format %s changed to %q", at, old.Format, s.Format))
+	}
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	wasRequired := map[string]bool{}
+	for _, name := range old.Required {
+		wasRequired[name] = true
+		if !required[name] {
+			*breaking = append(*breaking, fmt.Sprintf("%s: property %s is no longer required", at, name))
+		}
+	}
+	for _, name := range s.Required {
+		if !wasRequired[name] {
+			*breaking = append(*breaking, fmt.Sprintf("%s: new property %s is required", at, name))
+		}
+	}
+	for _, name := range sortedKeys(old.Properties) {
+		if p, ok := s.Properties[name]; ok {
+			p.compatible(old.Properties[name], at+"."+name, breaking)
+		}
+	}
+	if old.Items != nil {
+		if s.Items == nil {
+			*breaking = append(*breaking, fmt.Sprintf("%s: items schema dropped", at))
+		} else {
+			s.Items.compatible(old.Items, at+"[]", breaking)
+		}
+	}
+}
+
+func sortedKeys(m map[string]*Schema) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,209 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+)
+
+// payloads is the Go type each event type is published with.
+var payloads = map[string]any{
+	events.UserProfileIncomplete:       events.ProfileIncomplete{},
+	events.GatewayKillSwitchToggled:    events.KillSwitchToggled{},
+	events.GatewayAPIChanged:           events.APIChanged{},
+	events.GatewayQuotaThreshold:       events.QuotaThreshold{},
+	events.EmailReplyReceived:          events.ReplyReceived{},
+	events.NotificationCreated:         events.NotificationRecord{},
+	events.InventoryLowStock:           events.LowStock{},
+	events.InventoryStockChanged:       events.StockChange{},
+	events.InventoryStockNegative:      events.StockNegative{},
+	events.InventoryLotExpiring:        events.LotExpiring{},
+	events.InventorySKUMerged:          events.SKUMerged{},
+	events.UserRoleChanged:             events.RoleChanged{},
+	events.PaymentSucceeded:            events.PaymentResult{},
+	events.PaymentFailed:               events.PaymentResult{},
+	events.PaymentRefunded:             events.PaymentResult{},
+	events.OrderPlaced:                 events.OrderPlacement{},
+	events.UserLoggedIn:                events.Login{},
+	events.UserProfileUpdated:          events.ProfileUpdate{},
+	events.OrderCancelled:              events.OrderCancellation{},
+	events.OrderDeliveryAtRisk:         events.DeliveryAtRisk{},
+	events.UserLoginChallenged:         events.LoginChallenge{},
+	events.UserLoginAnomaly:            events.LoginAnomaly{},
+	events.InventoryReservationExpired: events.ReservationExpired{},
+	events.UserEmailVerified:           events.EmailVerification{},
+	events.UserVerificationRequested:   events.VerificationRequest{},
+	events.UserOnboardingStalled:       events.OnboardingStalled{},
+	events.UserPasswordResetRequested:  events.PasswordResetRequest{},
+	events.OrderShipmentDelivered:      events.ShipmentDelivered{},
+}
+
+// TestPayloadsMatchSchemas fails when a payload type changes without a new
+// version of its schema, or a new event type comes without one.
+func TestPayloadsMatchSchemas(t *testing.T) {
+	for eventType, payload := range payloads {
+		version, latest, ok := Default.Latest(eventType)
+		if !ok {
+			t.Errorf("%s has no schema: add schemas/%s.v1.json", eventType, eventType)
+			continue
+		}
+		derived := Derive(eventType, payload)
+		want, _ := json.Marshal(derived)
+		got, _ := json.Marshal(latest)
+		if string(want) != string(got) {
+			t.Errorf("%T no longer matches schemas/%s.v%d.json: add v%d with\n%s", payload, eventType, version, version+1, want)
+		}
+		data, _ := json.Marshal(payload)
+		if problems := latest.Validate(data); len(problems) > 0 {
+			t.Errorf("Expected an empty %T to be valid, got: %v", payload, problems)
+		}
+	}
+	for _, eventType := range Default.Types() {
+		if _, ok := payloads[eventType]; !ok {
+			t.Errorf("Schema for %s has no payload type in this test", eventType)
+		}
+	}
+}
+
+// TestCompatibility fails when a schema version breaks consumers of the one
+// before it.
+func TestCompatibility(t *testing.T) {
+	for eventType, changes := range Default.Breaking() {
+		t.Errorf("%s has breaking changes, publish a new event type instead: %s", eventType, strings.Join(changes, "; "))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := Derive("order.placed", events.OrderPlacement{})
+	if problems := s.Validate([]byte(`{"order_id":1,"user_id":2,"tenant":"t","status":"paid","currency":"GBP","total_cents":100,"item_count":1,"extra":true}`)); len(problems) > 0 {
+		t.Errorf("Expected a valid payload with an extra property, got: %v", problems)
+	}
+	problems := s.Validate([]byte(`{"order_id":"1","user_id":2.5,"tenant":"t","status":"paid","currency":"GBP","total_cents":100}`))
+	want := []string{"$: missing required property item_count", "$.order_id: want integer, got string", "$.user_id: want integer, got number"}
+	if strings.Join(problems, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %v, got: %v", want, problems)
+	}
+
+	s = Derive("order.shipment_delivered", events.ShipmentDelivered{})
+	problems = s.Validate([]byte(`{"shipment_id":1,"order_id":1,"user_id":1,"tenant":"t","carrier":"c","tracking_number":"x","delivered_at":"yesterday","items":[{"sku":"A","unit":"each"}]}`))
+	want = []string{"$.delivered_at: \"yesterday\" is not a date-time", "$.items[0]: missing required property quantity"}
+	if strings.Join(problems, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %v, got: %v", want, problems)
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	type v1 struct {
+		ID    int       `json:"id"`
+		Note  string    `json:"note,omitempty"`
+		At    time.Time `json:"at"`
+		Items []string  `json:"items"`
+	}
+	type added struct {
+		ID    int       `json:"id"`
+		Note  string    `json:"note,omitempty"`
+		At    time.Time `json:"at"`
+		Items []string  `json:"items"`
+		Extra string    `json:"extra,omitempty"`
+	}
+	type broken struct {
+		ID    string   `json:"id"`
+		Note  string   `json:"note"`
+		At    string   `json:"at,omitempty"`
+		Items []int    `json:"items"`
+		Extra string   `json:"extra"`
+		More  []string `json:"more,omitempty"`
+	}
+	old := Derive("t", v1{})
+	if changes := Derive("t", added{}).Compatible(old); len(changes) > 0 {
+		t.Errorf("Expected an optional property to be compatible, got: %v", changes)
+	}
+	changes := Derive("t", broken{}).Compatible(old)
+	want := []string{
+		"$: property at is no longer required",
+		"$: new property note is required",
+		"$: new property extra is required",
+		"$.at: format date-time changed to \"\"",
+		"$.id: type string was not allowed before",
+		"$.items[]: type integer was not allowed before",
+	}
+	if strings.Join(changes, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %v, got: %v", want, changes)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	schema := &fstest.MapFile{Data: []byte(`{"type":"object"}`)}
+	if _, err := Load(fstest.MapFS{"s/a.v1.json": schema, "s/a.v3.json": schema}, "s"); err == nil || !strings.Contains(err.Error(), "version 2 is missing") {
+		t.Errorf("Expected a gap in versions to be rejected, got: %v", err)
+	}
+	if _, err := Load(fstest.MapFS{"s/a.json": schema}, "s"); err == nil {
+		t.Error("Expected an unversioned file to be rejected")
+	}
+	r, err := Load(fstest.MapFS{"s/a.v1.json": schema, "s/a.v2.json": schema, "s/b.v1.json": schema}, "s")
+	if err != nil {
+		t.Fatalf("Failed to load schemas: %v", err)
+	}
+	if v, _, ok := r.Latest("a"); !ok || v != 2 || strings.Join(r.Types(), ",") != "a,b" {
+		t.Errorf("Expected a at v2 and b, got: %d %v", v, r.Types())
+	}
+}
+
+type recorder struct {
+	published []events.Event
+	handler   events.Handler
+}
+
+func (r *recorder) Publish(ctx context.Context, e events.Event) error {
+	r.published = append(r.published, e)
+	return nil
+}
+
+func (r *recorder) Subscribe(ctx context.Context, queue string, patterns []string, handler events.Handler) error {
+	r.handler = handler
+	return nil
+}
+
+func TestPublisherAndSubscriber(t *testing.T) {
+	ctx := context.Background()
+	next := &recorder{}
+	publisher := Default.Publisher(next)
+
+	e, _ := events.New(events.InventoryStockChanged, "inventory-service", events.StockChange{SKU: "A"})
+	if err := publisher.Publish(ctx, e); err != nil || len(next.published) != 1 || next.published[0].Version != 1 {
+		t.Fatalf("Expected the event published as v1, got: %+v %v", next.published, err)
+	}
+	e, _ = events.New(events.InventoryStockChanged, "inventory-service", map[string]int{"sku": 1})
+	if err := publisher.Publish(ctx, e); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got: %v", err)
+	}
+	e, _ = events.New("inventory.unknown", "inventory-service", struct{}{})
+	if err := publisher.Publish(ctx, e); !errors.Is(err, ErrUnknownType) || len(next.published) != 1 {
+		t.Errorf("Expected ErrUnknownType and nothing published, got: %v", err)
+	}
+
+	var handled []string
+	Default.Subscriber(next).Subscribe(ctx, "q", []string{"#"}, func(ctx context.Context, e events.Event) error {
+		handled = append(handled, e.Type)
+		return nil
+	})
+	for _, e := range []events.Event{
+		{Type: events.InventoryStockChanged, Data: json.RawMessage(`{"sku":"A"}`)},
+		{Type: events.InventoryStockChanged, Version: 7, Data: json.RawMessage(`{"sku":"A","new_field":1}`)},
+		{Type: events.InventoryStockChanged, Data: json.RawMessage(`{}`)},
+		{Type: "inventory.unknown", Data: json.RawMessage(`{}`)},
+	} {
+		if err := next.handler(ctx, e); err != nil {
+			t.Errorf("Expected no error for %+v, got: %v", e, err)
+		}
+	}
+	if strings.Join(handled, ",") != "inventory.stock_changed,inventory.stock_changed,inventory.unknown" {
+		t.Errorf("Expected the invalid event dropped, got: %v", handled)
+	}
+}
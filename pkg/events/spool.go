@@ -0,0 +1,212 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/degrade"
+)
+
+// Spool is a Publisher that keeps the events its broker cannot take and
+// replays them, in the order they were published, once it can. Events are
+// kept in memory and, with a path, appended to a file there so a restart
+// replays them too. Publishing only fails once max events are waiting.
+type Spool struct {
+	next Publisher
+	dep  *degrade.Dependency
+	path string
+	max  int
+
+	mu      sync.Mutex
+	pending []Event
+}
+
+// NewSpool loads the events a previous run left in the file at path, if
+// any. An empty path keeps events in memory only.
+func NewSpool(next Publisher, dep *degrade.Dependency, path string, max int) (*Spool, error) {
+	s := &Spool{next: next, dep: dep, path: path, max: max}
+	if path != "" {
+		pending, err := readSpool(path)
+		if err != nil {
+			return nil, err
+		}
+		s.pending = pending
+	}
+	dep.SetBacklog(s.Pending)
+	return s, nil
+}
+
+// Publish sends e to the broker while it is healthy, replaying any waiting
+// events first so e never overtakes them, and spools it otherwise.
+func (s *Spool) Publish(ctx context.Context, e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dep.Available() {
+		return s.keep(e)
+	}
+	if len(s.pending) > 0 {
+		if _, err := s.flush(ctx); err != nil {
+			return s.keep(e)
+		}
+	}
+	err := s.next.Publish(ctx, e)
+	s.dep.Track(err)
+	if err == nil {
+		return nil
+	}
+	log.Printf("Broker unavailable, spooling events: %v", err)
+	return s.keep(e)
+}
+
+func (s *Spool) keep(e Event) error {
+	if len(s.pending) >= s.max {
+		return fmt.Errorf("event spool full with %d events, dropping %s %s", len(s.pending), e.Type, e.ID)
+	}
+	if s.path != "" {
+		if err := appendSpool(s.path, e); err != nil {
+			return fmt.Errorf("spool event %s: %w", e.ID, err)
+		}
+	}
+	s.pending = append(s.pending, e)
+	return nil
+}
+
+// Pending returns how many events are waiting to be replayed.
+func (s *Spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Flush replays waiting events in order until the broker refuses one, and
+// returns how many it replayed.
+func (s *Spool) Flush(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 || !s.dep.Available() {
+		return 0, nil
+	}
+	return s.flush(ctx)
+}
+
+func (s *Spool) flush(ctx context.Context) (int, error) {
+	sent := 0
+	var err error
+	for _, e := range s.pending {
+		if err = s.next.Publish(ctx, e); err != nil {
+			break
+		}
+		sent++
+	}
+	s.dep.Track(err)
+	if sent == 0 {
+		return 0, err
+	}
+	s.pending = append([]Event(nil), s.pending[sent:]...)
+	if s.path != "" {
+		if werr := writeSpool(s.path, s.pending); werr != nil {
+			// The file still holds replayed events, so a restart before the
+			// next flush sends them again, as a broker redelivery would.
+			log.Printf("Failed to rewrite event spool %s: %v", s.path, werr)
+		}
+	}
+	return sent, err
+}
+
+// Run replays waiting events every interval until ctx is cancelled.
+func (s *Spool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if n := s.Pending(); n > 0 && s.path == "" {
+				log.Printf("Stopping with %d spooled events not replayed", n)
+			}
+			return
+		case <-ticker.C:
+		}
+		n, err := s.Flush(ctx)
+		if n > 0 {
+			log.Printf("Replayed %d spooled events", n)
+		}
+		if err != nil {
+			log.Printf("Event replay stopped, %d still spooled: %v", s.Pending(), err)
+		}
+	}
+}
+
+// readSpool reads one JSON-encoded event per line. A missing file holds no
+// events, and a torn last line from a crash mid-write is skipped.
+func readSpool(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pending []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("Skipping unreadable line in event spool %s: %v", path, err)
+			continue
+		}
+		pending = append(pending, e)
+	}
+	return pending, scanner.Err()
+}
+
+func appendSpool(path string, e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSpool replaces the file with pending, through a rename so a crash
+// leaves either the old events or the new ones.
+func writeSpool(path string, pending []Event) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range pending {
+		line, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
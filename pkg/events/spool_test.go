@@ -0,0 +1,86 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/degrade"
+)
+
+type flakyPublisher struct {
+	down bool
+	sent []string
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, e Event) error {
+	if p.down {
+		return errors.New("connection refused")
+	}
+	p.sent = append(p.sent, e.ID)
+	return nil
+}
+
+func TestSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	broker := &flakyPublisher{}
+	dep := degrade.Register("test-broker", 0)
+	s, err := NewSpool(broker, dep, path, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := s.Publish(ctx, Event{ID: "1"}); err != nil || len(broker.sent) != 1 {
+		t.Fatalf("Expected a healthy broker to get the event directly, got: %v", err)
+	}
+
+	broker.down = true
+	for _, id := range []string{"2", "3", "4"} {
+		if err := s.Publish(ctx, Event{ID: id}); err != nil {
+			t.Fatalf("Expected event %s to be spooled, got: %v", id, err)
+		}
+	}
+	if !dep.Degraded() || s.Pending() != 3 {
+		t.Fatalf("Expected a degraded broker and 3 spooled events, got: %t, %d", dep.Degraded(), s.Pending())
+	}
+	if err := s.Publish(ctx, Event{ID: "5"}); err == nil {
+		t.Error("Expected a full spool to refuse the event")
+	}
+	if n, err := s.Flush(ctx); n != 0 || err == nil {
+		t.Errorf("Expected nothing replayed while the broker is down, got: %d, %v", n, err)
+	}
+
+	// A restart picks the spooled events up from the file.
+	restarted, err := NewSpool(broker, dep, path, 3)
+	if err != nil || restarted.Pending() != 3 {
+		t.Fatalf("Expected 3 events read back, got: %d, %v", restarted.Pending(), err)
+	}
+
+	broker.down = false
+	if n, err := restarted.Flush(ctx); n != 3 || err != nil {
+		t.Fatalf("Expected 3 events replayed, got: %d, %v", n, err)
+	}
+	restarted.keep(Event{ID: "5"})
+	if err := restarted.Publish(ctx, Event{ID: "6"}); err != nil || restarted.Pending() != 0 {
+		t.Fatalf("Expected waiting events replayed before a new one, got: %d, %v", restarted.Pending(), err)
+	}
+	want := []string{"1", "2", "3", "4", "5", "6"}
+	for i, id := range want {
+		if i >= len(broker.sent) || broker.sent[i] != id {
+			t.Fatalf("Expected events in order %v, got: %v", want, broker.sent)
+		}
+	}
+	if dep.Degraded() {
+		t.Error("Expected a replay to recover the broker")
+	}
+	if left, _ := readSpool(path); len(left) != 0 {
+		t.Errorf("Expected an empty spool file, got: %d events", len(left))
+	}
+
+	if _, err := NewSpool(broker, degrade.Register("test-broker-memory", time.Minute), "", 1); err != nil {
+		t.Errorf("Expected an in-memory spool, got: %v", err)
+	}
+}
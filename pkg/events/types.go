@@ -0,0 +1,372 @@
+package events
+
+import "time"
+
+// Event types and payloads shared between producers and consumers.
+const (
+	UserProfileIncomplete       = "user.profile_incomplete"
+	GatewayKillSwitchToggled    = "gateway.kill_switch_toggled"
+	GatewayAPIChanged           = "gateway.api_changed"
+	GatewayQuotaThreshold       = "gateway.quota_threshold"
+	EmailReplyReceived          = "email.reply_received"
+	NotificationCreated         = "notification.created"
+	InventoryLowStock           = "inventory.low_stock"
+	InventoryStockChanged       = "inventory.stock_changed"
+	InventoryStockNegative      = "inventory.stock_negative"
+	InventoryLotExpiring        = "inventory.lot_expiring"
+	InventorySKUMerged          = "inventory.sku_merged"
+	UserRoleChanged             = "user.role_changed"
+	PaymentSucceeded            = "payment.succeeded"
+	PaymentFailed               = "payment.failed"
+	PaymentRefunded             = "payment.refunded"
+	OrderPlaced                 = "order.placed"
+	UserLoggedIn                = "user.logged_in"
+	UserProfileUpdated          = "user.profile_updated"
+	OrderCancelled              = "order.cancelled"
+	OrderDeliveryAtRisk         = "order.delivery_at_risk"
+	UserLoginChallenged         = "user.login_challenged"
+	UserLoginAnomaly            = "user.login_anomaly"
+	InventoryReservationExpired = "inventory.reservation_expired"
+	UserEmailVerified           = "user.email_verified"
+	UserVerificationRequested   = "user.verification_requested"
+	UserOnboardingStalled       = "user.onboarding_stalled"
+	UserPasswordResetRequested  = "user.password_reset_requested"
+	OrderShipmentDelivered      = "order.shipment_delivered"
+)
+
+type MissingField struct {
+	Field string `json:"field"`
+	Hint  string `json:"hint"`
+}
+
+// ProfileIncomplete nudges a user to fill in the profile fields their
+// organization requires.
+type ProfileIncomplete struct {
+	UserID   int            `json:"user_id"`
+	Email    string         `json:"email"`
+	Username string         `json:"username"`
+	Percent  int            `json:"percent"`
+	Missing  []MissingField `json:"missing"`
+}
+
+// KillSwitchToggled audits an operator engaging or releasing a gateway kill
+// switch.
+type KillSwitchToggled struct {
+	Name     string `json:"name"`
+	Engaged  bool   `json:"engaged"`
+	Actor    string `json:"actor,omitempty"`
+	ClientIP string `json:"client_ip,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// APIChanged announces changes found between two snapshots of the API
+// behind the gateway, so integrators can adapt before breaking ones reach
+// them. Breaking counts the changes that can break existing clients.
+type APIChanged struct {
+	SnapshotID int64       `json:"snapshot_id"`
+	DetectedAt time.Time   `json:"detected_at"`
+	Breaking   int         `json:"breaking"`
+	Changes    []APIChange `json:"changes"`
+}
+
+type APIChange struct {
+	Service     string `json:"service"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Kind        string `json:"kind"`
+	Breaking    bool   `json:"breaking"`
+	Location    string `json:"location,omitempty"`
+	Description string `json:"description"`
+}
+
+// QuotaThreshold warns that a consumer of the gateway, an API key or a
+// user, has used Percent (80 or 100) of one of its quotas for the period
+// starting at PeriodStart. It is published once per threshold and period.
+type QuotaThreshold struct {
+	Consumer    string    `json:"consumer"`
+	APIKeyID    int       `json:"api_key_id,omitempty"`
+	UserID      int       `json:"user_id,omitempty"`
+	Tenant      string    `json:"tenant"`
+	PathPrefix  string    `json:"path_prefix"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"period_start"`
+	Limit       int       `json:"limit"`
+	Used        int       `json:"used"`
+	Percent     int       `json:"percent"`
+}
+
+// ReplyReceived is a reply to a notification email, with quotes and
+// signature stripped. ContextType and ContextID are copied from the
+// notification so consumers can file the reply, e.g. on an order's support
+// thread.
+type ReplyReceived struct {
+	ReplyID        int64     `json:"reply_id"`
+	NotificationID int       `json:"notification_id"`
+	UserID         *int      `json:"user_id,omitempty"`
+	From           string    `json:"from"`
+	FromRecipient  bool      `json:"from_recipient"`
+	Subject        string    `json:"subject"`
+	Body           string    `json:"body"`
+	ContextType    string    `json:"context_type,omitempty"`
+	ContextID      string    `json:"context_id,omitempty"`
+	ThreadID       int64     `json:"thread_id,omitempty"`
+	ReceivedAt     time.Time `json:"received_at"`
+}
+
+// NotificationRecord announces a notification after its delivery attempt,
+// so it can be pushed to the user's open streams.
+type NotificationRecord struct {
+	ID        int       `json:"id"`
+	UserID    *int      `json:"user_id,omitempty"`
+	Channel   string    `json:"channel"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ThreadID  int64     `json:"thread_id,omitempty"`
+}
+
+// LowStock reports a SKU whose available stock fell below its reorder
+// point. Quantities are in base units. Tenant owns the SKU.
+type LowStock struct {
+	SKU             string `json:"sku"`
+	Name            string `json:"name"`
+	Available       int    `json:"available"`
+	ReorderPoint    int    `json:"reorder_point"`
+	ReorderQuantity int    `json:"reorder_quantity"`
+	NotifyEmail     string `json:"notify_email,omitempty"`
+	Tenant          string `json:"tenant,omitempty"`
+}
+
+// StockChange says a SKU's stock changed. It carries no levels: consumers
+// caching stock drop the SKU and read it again when they next need it.
+// Tenant is set when the change was made on a tenant's behalf, rather than
+// by a job sweeping every tenant.
+type StockChange struct {
+	SKU    string `json:"sku"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// StockNegative reports an override movement that left a SKU with negative
+// available stock. Quantities are in base units.
+type StockNegative struct {
+	SKU        string `json:"sku"`
+	Name       string `json:"name"`
+	OnHand     int    `json:"on_hand"`
+	Reserved   int    `json:"reserved"`
+	Available  int    `json:"available"`
+	MovementID int64  `json:"movement_id"`
+	Delta      int    `json:"delta"`
+	Actor      string `json:"actor"`
+	Reason     string `json:"reason"`
+}
+
+// LotExpiring warns that a lot of a SKU expires soon. ExpiresOn is the
+// last day it may be sold, as YYYY-MM-DD; Quantity is in base units.
+type LotExpiring struct {
+	LotID       int64  `json:"lot_id"`
+	SKU         string `json:"sku"`
+	Name        string `json:"name"`
+	LotCode     string `json:"lot_code"`
+	ExpiresOn   string `json:"expires_on"`
+	Quantity    int    `json:"quantity"`
+	NotifyEmail string `json:"notify_email,omitempty"`
+}
+
+// SKUMerged says SKU was merged into Survivor: its stock and history now
+// belong to Survivor, and services holding references to SKU should move
+// them over.
+type SKUMerged struct {
+	SKU      string `json:"sku"`
+	Survivor string `json:"survivor"`
+	Tenant   string `json:"tenant,omitempty"`
+}
+
+// ReservationExpired says a reservation ran past its TTL unsettled and its
+// stock went back to available. Reference is the one the holder gave when
+// reserving. Quantity is in base units.
+type ReservationExpired struct {
+	ReservationID int64     `json:"reservation_id"`
+	SKU           string    `json:"sku"`
+	Quantity      int       `json:"quantity"`
+	Reference     string    `json:"reference,omitempty"`
+	ExpiredAt     time.Time `json:"expired_at"`
+	Tenant        string    `json:"tenant,omitempty"`
+}
+
+// RoleChanged audits a bulk role change granting or revoking a user's role.
+// A rollback publishes the reverse change with RolledBack set.
+type RoleChanged struct {
+	UserID     int    `json:"user_id"`
+	Role       string `json:"role"`
+	Granted    bool   `json:"granted"`
+	JobID      int    `json:"job_id"`
+	RolledBack bool   `json:"rolled_back"`
+	Actor      string `json:"actor"`
+	Reason     string `json:"reason"`
+}
+
+// PaymentResult settles a payment for an order, published as
+// payment.succeeded or payment.failed once the provider confirms it, and as
+// payment.refunded once a succeeded payment is refunded. Tenant is the
+// order's tenant, since provider webhooks carry none.
+type PaymentResult struct {
+	PaymentID   int    `json:"payment_id"`
+	OrderID     int    `json:"order_id"`
+	UserID      int    `json:"user_id"`
+	Tenant      string `json:"tenant"`
+	AmountCents int64  `json:"amount_cents"`
+	Currency    string `json:"currency"`
+	Provider    string `json:"provider"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// OrderPlacement announces a new order, whatever status it starts in.
+type OrderPlacement struct {
+	OrderID    int    `json:"order_id"`
+	UserID     int    `json:"user_id"`
+	Tenant     string `json:"tenant"`
+	Status     string `json:"status"`
+	Currency   string `json:"currency"`
+	TotalCents int64  `json:"total_cents"`
+	ItemCount  int    `json:"item_count"`
+}
+
+// Login records a successful sign-in.
+type Login struct {
+	UserID    int    `json:"user_id"`
+	Tenant    string `json:"tenant"`
+	ClientIP  string `json:"client_ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// LoginChallenge carries the one-time code a risky sign-in must be
+// confirmed with, for notification-service to send to the user. The code
+// stops working at ExpiresAt or after a few wrong guesses.
+type LoginChallenge struct {
+	UserID    int       `json:"user_id"`
+	Tenant    string    `json:"tenant"`
+	Email     string    `json:"email"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+	ClientIP  string    `json:"client_ip"`
+	Country   string    `json:"country,omitempty"`
+}
+
+// LoginAnomaly warns a user about an unusual sign-in. Reasons name the
+// login rules it tripped, such as new_country, and Challenged is set when
+// it must be confirmed with a code before it succeeds.
+type LoginAnomaly struct {
+	UserID     int      `json:"user_id"`
+	Tenant     string   `json:"tenant"`
+	Email      string   `json:"email"`
+	ClientIP   string   `json:"client_ip"`
+	UserAgent  string   `json:"user_agent,omitempty"`
+	Country    string   `json:"country,omitempty"`
+	Score      int      `json:"score"`
+	Reasons    []string `json:"reasons"`
+	Challenged bool     `json:"challenged"`
+}
+
+// ProfileUpdate names the profile fields a user changed, without their
+// values.
+type ProfileUpdate struct {
+	UserID int      `json:"user_id"`
+	Tenant string   `json:"tenant"`
+	Fields []string `json:"fields"`
+}
+
+// OrderCancellation records why a customer cancelled an order. Reason is one
+// of order-service's cancellation reason codes, and CustomerTier the
+// customer's tier when they cancelled. RefundedCents is set when the order
+// had been paid and its payment was refunded.
+type OrderCancellation struct {
+	OrderID       int      `json:"order_id"`
+	UserID        int      `json:"user_id"`
+	Tenant        string   `json:"tenant"`
+	Reason        string   `json:"reason"`
+	Note          string   `json:"note,omitempty"`
+	CustomerTier  string   `json:"customer_tier"`
+	TotalCents    int64    `json:"total_cents"`
+	RefundedCents int64    `json:"refunded_cents,omitempty"`
+	SKUs          []string `json:"skus"`
+}
+
+// DeliveryAtRisk warns that an order may miss the delivery date it was
+// promised: it has not shipped by, or is close to, its ShipBy cutoff, or
+// it shipped too late and now arrives on ExpectedDate. Dates are in the
+// warehouse's time zone.
+type DeliveryAtRisk struct {
+	OrderID      int       `json:"order_id"`
+	UserID       int       `json:"user_id"`
+	Tenant       string    `json:"tenant"`
+	Carrier      string    `json:"carrier"`
+	ShipBy       time.Time `json:"ship_by"`
+	PromisedDate string    `json:"promised_date"`
+	ExpectedDate string    `json:"expected_date,omitempty"`
+	Reason       string    `json:"reason"`
+}
+
+// ShipmentDelivered announces that the carrier delivered one of an order's
+// shipments, with the items it carried.
+type ShipmentDelivered struct {
+	ShipmentID     int64          `json:"shipment_id"`
+	OrderID        int            `json:"order_id"`
+	UserID         int            `json:"user_id"`
+	Tenant         string         `json:"tenant"`
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"tracking_number"`
+	DeliveredAt    time.Time      `json:"delivered_at"`
+	Items          []ShipmentItem `json:"items"`
+}
+
+type ShipmentItem struct {
+	SKU      string `json:"sku"`
+	Name     string `json:"name,omitempty"`
+	Unit     string `json:"unit"`
+	Quantity int    `json:"quantity"`
+}
+
+// EmailVerification records that a user proved they own their email
+// address.
+type EmailVerification struct {
+	UserID int    `json:"user_id"`
+	Tenant string `json:"tenant"`
+	Email  string `json:"email"`
+}
+
+// VerificationRequest carries the link a user follows to prove they own
+// their email address, for notification-service to send to that address.
+// The link stops working at ExpiresAt or once the user's email changes.
+type VerificationRequest struct {
+	UserID    int       `json:"user_id"`
+	Tenant    string    `json:"tenant"`
+	Email     string    `json:"email"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PasswordResetRequest carries the single-use link a user follows to set a
+// new password, for notification-service to send to their email address.
+type PasswordResetRequest struct {
+	UserID    int       `json:"user_id"`
+	Tenant    string    `json:"tenant"`
+	Email     string    `json:"email"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// OnboardingStalled nudges a user about an onboarding step they have not
+// done in the time their tenant allows for it. Completed and Total count
+// the steps of their checklist.
+type OnboardingStalled struct {
+	UserID    int    `json:"user_id"`
+	Tenant    string `json:"tenant"`
+	Email     string `json:"email"`
+	Username  string `json:"username"`
+	Step      string `json:"step"`
+	Title     string `json:"title"`
+	Hint      string `json:"hint,omitempty"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+}
@@ -0,0 +1,92 @@
+// Package fields lets clients ask for only some of a resource's fields with
+// ?fields=id,email, so mobile clients and the gateway fetch no more than
+// they use. Each resource lists the fields that may be selected. A field
+// added to a struct later cannot be selected until it is listed, and a
+// selected response never carries a field that is not.
+package fields
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Allowlist is the fields of one resource that clients may select, by
+// their JSON names.
+type Allowlist []string
+
+// Allow lists a resource's selectable fields.
+func Allow(names ...string) Allowlist {
+	return Allowlist(names)
+}
+
+// Selection is the fields a request selected, or nil for all of them.
+type Selection []string
+
+// Bind reads the request's ?fields= against a. It writes a 400 naming the
+// first field not on the list and returns false, so the handler can stop
+// before doing any work.
+func (a Allowlist) Bind(c *gin.Context) (Selection, bool) {
+	raw, ok := c.GetQuery("fields")
+	if !ok {
+		return nil, true
+	}
+	var s Selection
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(a, name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown field " + name, "fields": a})
+			return nil, false
+		}
+		if !slices.Contains(s, name) {
+			s = append(s, name)
+		}
+	}
+	if len(s) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fields must name at least one field", "fields": a})
+		return nil, false
+	}
+	return s, true
+}
+
+// Apply returns v, which must encode as a JSON object, with only the
+// selected fields. A nil selection returns v unchanged.
+func (s Selection) Apply(v any) any {
+	if s == nil {
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Rendering v fails the same way, so let that report it.
+		return v
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return v
+	}
+	selected := make(map[string]json.RawMessage, len(s))
+	for _, name := range s {
+		if value, ok := all[name]; ok {
+			selected[name] = value
+		}
+	}
+	return selected
+}
+
+// ApplyEach applies s to every item, for list responses.
+func ApplyEach[T any](s Selection, items []T) any {
+	if s == nil {
+		return items
+	}
+	out := make([]any, len(items))
+	for i, item := range items {
+		out[i] = s.Apply(item)
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+package fields
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type user struct {
+	ID       int    `json:"id"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	// Secret is not on the allowlist below.
+	Secret string `json:"secret"`
+}
+
+var userFields = Allow("id", "email", "username")
+
+func bind(query string) (Selection, bool, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/users"+query, nil)
+	s, ok := userFields.Bind(c)
+	return s, ok, w
+}
+
+func render(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Selection
+		ok    bool
+	}{
+		{query: "", want: nil, ok: true},
+		{query: "?fields=id,email", want: Selection{"id", "email"}, ok: true},
+		{query: "?fields=id,+id,", want: Selection{"id"}, ok: true},
+		{query: "?fields=id,secret", ok: false},
+		{query: "?fields=", ok: false},
+	}
+	for _, tt := range tests {
+		s, ok, w := bind(tt.query)
+		if ok != tt.ok || render(s) != render(tt.want) {
+			t.Errorf("%q: expected %v %v, got: %v %v", tt.query, tt.want, tt.ok, s, ok)
+		}
+		if !ok && w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got: %d", tt.query, w.Code)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	u := user{ID: 1, Email: "a@example.com", Username: "a", Secret: "s"}
+	if got := render(Selection(nil).Apply(u)); got != render(u) {
+		t.Errorf("Expected no selection to keep every field, got: %s", got)
+	}
+	if got := render(Selection{"email", "id"}.Apply(&u)); got != `{"email":"a@example.com","id":1}` {
+		t.Errorf("Expected only the selected fields, got: %s", got)
+	}
+	if got := render(ApplyEach(Selection{"username"}, []user{u, {ID: 2, Username: "b"}})); got != `[{"username":"a"},{"username":"b"}]` {
+		t.Errorf("Expected the selection applied to every item, got: %s", got)
+	}
+}
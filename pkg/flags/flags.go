@@ -0,0 +1,248 @@
+// Package flags gates new behavior behind feature flags that can be flipped
+// at runtime, for some tenants or a percentage of them, without a deploy.
+//
+// Defaults come from the FEATURE_FLAGS variable and FEATURE_FLAGS_FILE.
+// Changes made through the admin API are kept in a Store on top of them; with
+// Redis, every replica and service sharing it sees the same changes.
+package flags
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// Where a flag's current value came from.
+const (
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceRuntime = "runtime"
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// ValidName reports whether name can be used as a flag name: lowercase
+// letters, digits, dots, dashes and underscores, such as "new-order-flow".
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Flag is on for a request when it is enabled, the request's tenant is one
+// of Tenants (or Tenants is empty), and the request's rollout key falls in
+// the first Percent of 100 buckets.
+type Flag struct {
+	Name      string     `json:"name"`
+	Enabled   bool       `json:"enabled"`
+	Percent   int        `json:"percent"`
+	Tenants   []string   `json:"tenants,omitempty"`
+	Source    string     `json:"source"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// On evaluates the flag for a tenant. key picks the rollout bucket, so the
+// same key always gets the same answer for a given percentage, and raising
+// the percentage only adds keys.
+func (f Flag) On(tenantID, key string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if len(f.Tenants) > 0 {
+		found := false
+		for _, t := range f.Tenants {
+			if t == tenantID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Percent >= 100 {
+		return true
+	}
+	return bucket(f.Name, key) < f.Percent
+}
+
+// bucket hashes the flag name in too, so each flag rolls out to a different
+// set of keys.
+func bucket(name, key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + key))
+	return int(h.Sum32() % 100)
+}
+
+// Store keeps the flags changed at runtime.
+type Store interface {
+	List(ctx context.Context) (map[string]Flag, error)
+	Set(ctx context.Context, f Flag) error
+	Delete(ctx context.Context, name string) error
+}
+
+// Flags evaluates requests against an in-memory copy of the defaults and the
+// runtime changes, so checking a flag never leaves the process. Run keeps
+// the copy fresh when another replica changes a flag.
+type Flags struct {
+	defaults map[string]Flag
+	store    Store
+	now      func() time.Time
+
+	mu      sync.RWMutex
+	runtime map[string]Flag
+}
+
+func New(defaults map[string]Flag, store Store) *Flags {
+	return &Flags{defaults: defaults, store: store, now: time.Now, runtime: map[string]Flag{}}
+}
+
+func (f *Flags) Refresh(ctx context.Context) error {
+	runtime, err := f.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.runtime = runtime
+	f.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the runtime changes every interval until ctx is cancelled. A
+// failed refresh keeps the last known state.
+func (f *Flags) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := f.Refresh(ctx); err != nil {
+			log.Printf("Feature flag refresh failed: %v", err)
+		}
+	}
+}
+
+func (f *Flags) Get(name string) (Flag, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if flag, ok := f.runtime[name]; ok {
+		return flag, true
+	}
+	flag, ok := f.defaults[name]
+	return flag, ok
+}
+
+// List returns every known flag, runtime changes in place of defaults,
+// sorted by name.
+func (f *Flags) List() []Flag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	merged := map[string]Flag{}
+	for name, flag := range f.defaults {
+		merged[name] = flag
+	}
+	for name, flag := range f.runtime {
+		merged[name] = flag
+	}
+	list := make([]Flag, 0, len(merged))
+	for _, flag := range merged {
+		list = append(list, flag)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Set stores flag as a runtime change and applies it on this replica
+// immediately.
+func (f *Flags) Set(ctx context.Context, flag Flag) (Flag, error) {
+	if !ValidName(flag.Name) {
+		return Flag{}, fmt.Errorf("invalid flag name %q", flag.Name)
+	}
+	now := f.now().UTC()
+	flag.Source, flag.UpdatedAt = SourceRuntime, &now
+	if err := f.store.Set(ctx, flag); err != nil {
+		return Flag{}, err
+	}
+	f.mu.Lock()
+	f.runtime[flag.Name] = flag
+	f.mu.Unlock()
+	return flag, nil
+}
+
+// Reset drops the runtime change to name, so its default applies again, and
+// returns the flag as it now stands.
+func (f *Flags) Reset(ctx context.Context, name string) (Flag, bool, error) {
+	if err := f.store.Delete(ctx, name); err != nil {
+		return Flag{}, false, err
+	}
+	f.mu.Lock()
+	delete(f.runtime, name)
+	f.mu.Unlock()
+	flag, ok := f.Get(name)
+	return flag, ok, nil
+}
+
+// On reports whether the flag is on for the tenant in ctx, rolling out by
+// tenant: a tenant is either in the percentage or not, for all its users.
+// Unknown flags are off.
+func (f *Flags) On(ctx context.Context, name string) bool {
+	id := tenant.FromContext(ctx)
+	return f.OnFor(ctx, name, id)
+}
+
+// OnFor is On with another rollout key, such as the user ID, for a
+// per-user rollout within the flag's tenants.
+func (f *Flags) OnFor(ctx context.Context, name, key string) bool {
+	flag, ok := f.Get(name)
+	return ok && flag.On(tenant.FromContext(ctx), key)
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, f *Flags) context.Context {
+	return context.WithValue(ctx, contextKey{}, f)
+}
+
+func FromContext(ctx context.Context) (*Flags, bool) {
+	f, ok := ctx.Value(contextKey{}).(*Flags)
+	return f, ok
+}
+
+// Enabled is Flags.On for the flags Middleware put in ctx. It is false when
+// there are none, so code gated on a flag stays off in tests and tools that
+// do not set flags up.
+func Enabled(ctx context.Context, name string) bool {
+	f, ok := FromContext(ctx)
+	return ok && f.On(ctx, name)
+}
+
+// Middleware makes the flags available to handlers through Enabled and
+// Require. Install it after tenant.Middleware.
+func (f *Flags) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(NewContext(c.Request.Context(), f))
+		c.Next()
+	}
+}
+
+// Require answers 404 for routes behind a flag that is off, as if the route
+// did not exist yet.
+func Require(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !Enabled(c.Request.Context(), name) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.Next()
+	}
+}
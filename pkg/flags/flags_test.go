@@ -0,0 +1,271 @@
+package flags
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/redis"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseSpec(t *testing.T) {
+	flags, err := ParseSpec("new-order-flow, checkout-v2=25%,legacy-export=off")
+	if err != nil {
+		t.Fatalf("Expected the spec to parse, got: %v", err)
+	}
+	if f := flags["new-order-flow"]; !f.Enabled || f.Percent != 100 {
+		t.Errorf("Expected a bare name to be fully on, got: %+v", f)
+	}
+	if f := flags["checkout-v2"]; !f.Enabled || f.Percent != 25 {
+		t.Errorf("Expected checkout-v2 at 25%%, got: %+v", f)
+	}
+	if f := flags["legacy-export"]; f.Enabled {
+		t.Errorf("Expected legacy-export to be off, got: %+v", f)
+	}
+
+	for _, spec := range []string{"Bad Name", "beta=120%", "beta=25", "beta=maybe"} {
+		if _, err := ParseSpec(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestLoadFileOverridesEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	os.WriteFile(path, []byte(`{"new-order-flow": {"enabled": true, "percent": 10, "tenants": ["acme"]}}`), 0o600)
+	t.Setenv("FEATURE_FLAGS", "new-order-flow=off,beta")
+	t.Setenv("FEATURE_FLAGS_FILE", path)
+	t.Setenv("REDIS_HOST", "")
+
+	f, err := FromEnv()
+	if err != nil {
+		t.Fatalf("Expected the flags to load, got: %v", err)
+	}
+	flag, _ := f.Get("new-order-flow")
+	if !flag.Enabled || flag.Percent != 10 || flag.Source != SourceFile || len(flag.Tenants) != 1 {
+		t.Errorf("Expected the file's new-order-flow, got: %+v", flag)
+	}
+	if flag, _ := f.Get("beta"); !flag.Enabled || flag.Source != SourceEnv {
+		t.Errorf("Expected beta from the env, got: %+v", flag)
+	}
+}
+
+func TestFlagOn(t *testing.T) {
+	if (Flag{Name: "x", Enabled: false, Percent: 100}).On("acme", "acme") {
+		t.Error("Expected a disabled flag to be off")
+	}
+	scoped := Flag{Name: "x", Enabled: true, Percent: 100, Tenants: []string{"acme"}}
+	if !scoped.On("acme", "acme") || scoped.On("globex", "globex") {
+		t.Error("Expected a tenant-scoped flag to be on only for its tenants")
+	}
+
+	half := Flag{Name: "x", Enabled: true, Percent: 50}
+	on := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("tenant-%d", i)
+		got := half.On(key, key)
+		if got != half.On(key, key) {
+			t.Fatalf("Expected %s to get the same answer every time", key)
+		}
+		if got {
+			on++
+		}
+		// Raising the percentage only adds keys.
+		if got && !(Flag{Name: "x", Enabled: true, Percent: 75}).On(key, key) {
+			t.Fatalf("Expected %s to stay on at a higher percentage", key)
+		}
+	}
+	if on < 400 || on > 600 {
+		t.Errorf("Expected about half the keys on at 50%%, got: %d of 1000", on)
+	}
+}
+
+func TestSetAndReset(t *testing.T) {
+	store := NewMemoryStore()
+	f := New(map[string]Flag{"beta": {Name: "beta", Enabled: false, Percent: 100, Source: SourceEnv}}, store)
+	ctx := tenant.NewContext(context.Background(), "acme")
+
+	if f.On(ctx, "beta") {
+		t.Error("Expected beta to start off")
+	}
+	if _, err := f.Set(ctx, Flag{Name: "beta", Enabled: true, Percent: 100}); err != nil {
+		t.Fatalf("Expected the flag to be set, got: %v", err)
+	}
+	if !f.On(ctx, "beta") {
+		t.Error("Expected beta to be on after being set")
+	}
+
+	// Another replica sharing the store picks the change up on refresh.
+	other := New(map[string]Flag{"beta": {Name: "beta", Percent: 100, Source: SourceEnv}}, store)
+	if err := other.Refresh(ctx); err != nil {
+		t.Fatalf("Expected the refresh to succeed, got: %v", err)
+	}
+	if !other.On(ctx, "beta") {
+		t.Error("Expected the other replica to see beta on")
+	}
+
+	flag, ok, err := f.Reset(ctx, "beta")
+	if err != nil || !ok || flag.Source != SourceEnv || f.On(ctx, "beta") {
+		t.Errorf("Expected reset to restore the env default, got: %+v, %v", flag, err)
+	}
+	if f.On(ctx, "unknown") {
+		t.Error("Expected an unknown flag to be off")
+	}
+}
+
+func newRouter(f *Flags) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tenant.Middleware(), f.Middleware())
+	NewHandler(f).RegisterAdminRoutes(router.Group("/admin"))
+	router.GET("/orders/v2", Require("new-order-flow"), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"flow": "new"})
+	})
+	return router
+}
+
+func serve(router *gin.Engine, method, path, tenantID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if tenantID != "" {
+		req.Header.Set(tenant.Header, tenantID)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRequireAndAdminRoutes(t *testing.T) {
+	router := newRouter(New(map[string]Flag{}, NewMemoryStore()))
+
+	if w := serve(router, http.MethodGet, "/orders/v2", "acme", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 while the flag is off, got: %d", w.Code)
+	}
+	w := serve(router, http.MethodPut, "/admin/flags/new-order-flow", "", `{"enabled": true, "tenants": ["acme"], "actor": "ops"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"source":"runtime"`) {
+		t.Fatalf("Expected the flag to be set, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(router, http.MethodGet, "/orders/v2", "acme", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected acme to get the new flow, got: %d", w.Code)
+	}
+	if w := serve(router, http.MethodGet, "/orders/v2", "globex", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected globex not to get the new flow, got: %d", w.Code)
+	}
+
+	if w := serve(router, http.MethodPut, "/admin/flags/new-order-flow", "", `{"enabled": true, "percent": 101}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an out-of-range percent to be rejected, got: %d", w.Code)
+	}
+	if w := serve(router, http.MethodPut, "/admin/flags/New_Flow", "", `{"enabled": true}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid name to be rejected, got: %d", w.Code)
+	}
+	if w := serve(router, http.MethodPut, "/admin/flags/beta", "", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected enabled to be required, got: %d", w.Code)
+	}
+
+	if w := serve(router, http.MethodDelete, "/admin/flags/new-order-flow", "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected a flag without a default to be gone after reset, got: %d", w.Code)
+	}
+	if w := serve(router, http.MethodGet, "/orders/v2", "acme", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after reset, got: %d", w.Code)
+	}
+}
+
+func TestEnabledWithoutMiddleware(t *testing.T) {
+	if Enabled(context.Background(), "new-order-flow") {
+		t.Error("Expected flags to be off without the middleware")
+	}
+}
+
+// fakeRedis answers AUTH, HGETALL, HSET and HDEL on one hash.
+func fakeRedis(t *testing.T, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	hash := map[string]string{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					reply, err := redis.ReadReply(r)
+					if err != nil {
+						return
+					}
+					args := []string{}
+					for _, a := range reply.([]any) {
+						args = append(args, a.(string))
+					}
+					mu.Lock()
+					switch {
+					case args[0] == "AUTH" && args[1] == password:
+						authed = true
+						fmt.Fprint(conn, "+OK\r\n")
+					case args[0] == "AUTH":
+						fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+					case !authed:
+						fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+					case args[0] == "HGETALL":
+						fmt.Fprintf(conn, "*%d\r\n", 2*len(hash))
+						for k, v := range hash {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+						}
+					case args[0] == "HSET":
+						hash[args[2]] = args[3]
+						fmt.Fprint(conn, ":1\r\n")
+					case args[0] == "HDEL":
+						delete(hash, args[2])
+						fmt.Fprint(conn, ":1\r\n")
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	addr := fakeRedis(t, "secret")
+	store := NewRedisStore(redis.NewClient(addr, "secret"))
+
+	if err := store.Set(ctx, Flag{Name: "beta", Enabled: true, Percent: 30, Tenants: []string{"acme"}}); err != nil {
+		t.Fatalf("Expected HSET to succeed, got: %v", err)
+	}
+	flags, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("Expected HGETALL to succeed, got: %v", err)
+	}
+	if f := flags["beta"]; !f.Enabled || f.Percent != 30 || len(f.Tenants) != 1 {
+		t.Errorf("Expected beta to round-trip, got: %+v", f)
+	}
+	if err := store.Delete(ctx, "beta"); err != nil {
+		t.Fatalf("Expected HDEL to succeed, got: %v", err)
+	}
+	if flags, _ := store.List(ctx); len(flags) != 0 {
+		t.Errorf("Expected no flags after delete, got: %v", flags)
+	}
+
+	if _, err := NewRedisStore(redis.NewClient(addr, "wrong")).List(ctx); err == nil {
+		t.Error("Expected a wrong password to fail")
+	}
+}
@@ -0,0 +1,89 @@
+package flags
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/alux444/go-microserv-test/pkg/degrade"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	flags *Flags
+}
+
+func NewHandler(flags *Flags) *Handler {
+	return &Handler{flags: flags}
+}
+
+// RegisterAdminRoutes mounts the flag admin API on an admin-protected group.
+func (h *Handler) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/flags", h.list)
+	router.PUT("/flags/:name", h.set)
+	router.DELETE("/flags/:name", h.reset)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"flags": h.flags.List()})
+}
+
+type setRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+	// Percent defaults to 100.
+	Percent *int     `json:"percent" binding:"omitempty,min=0,max=100"`
+	Tenants []string `json:"tenants"`
+	Actor   string   `json:"actor" binding:"max=255"`
+}
+
+func (h *Handler) set(c *gin.Context) {
+	name := c.Param("name")
+	if !ValidName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "flag names are lowercase letters, digits, '.', '-' and '_'"})
+		return
+	}
+	var req setRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	flag := Flag{Name: name, Enabled: *req.Enabled, Percent: 100, Tenants: req.Tenants}
+	if req.Percent != nil {
+		flag.Percent = *req.Percent
+	}
+	flag, err := h.flags.Set(c.Request.Context(), flag)
+	if err != nil {
+		log.Printf("Failed to set flag %s: %v", name, err)
+		if errors.Is(err, degrade.ErrUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "flag store is unavailable, try again shortly"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set flag"})
+		return
+	}
+	log.Printf("Flag %s enabled=%t percent=%d tenants=%v by %q from %s", name, flag.Enabled, flag.Percent, flag.Tenants, req.Actor, c.ClientIP())
+	c.JSON(http.StatusOK, flag)
+}
+
+// reset drops the runtime change, reverting the flag to its env or file
+// default. A flag without a default no longer exists afterwards.
+func (h *Handler) reset(c *gin.Context) {
+	name := c.Param("name")
+	flag, ok, err := h.flags.Reset(c.Request.Context(), name)
+	if err != nil {
+		log.Printf("Failed to reset flag %s: %v", name, err)
+		if errors.Is(err, degrade.ErrUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "flag store is unavailable, try again shortly"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset flag"})
+		return
+	}
+	log.Printf("Flag %s reset by %q from %s", name, c.Query("actor"), c.ClientIP())
+	if !ok {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, flag)
+}
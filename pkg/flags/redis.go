@@ -0,0 +1,60 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alux444/go-microserv-test/pkg/redis"
+)
+
+// redisKey is the Redis hash runtime changes are kept in, one JSON-encoded
+// flag per field.
+const redisKey = "feature_flags"
+
+// RedisStore keeps runtime changes in Redis. Flags are read every refresh
+// interval, so while Redis is unreachable refreshes keep the last known
+// flags (see redis.Client).
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (s *RedisStore) List(ctx context.Context) (map[string]Flag, error) {
+	reply, err := s.client.Do(ctx, "HGETALL", redisKey)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]any)
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("unexpected HGETALL reply %v", reply)
+	}
+	flags := map[string]Flag{}
+	for i := 0; i < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		var flag Flag
+		if err := json.Unmarshal([]byte(value), &flag); err != nil {
+			return nil, fmt.Errorf("decode flag %s: %w", name, err)
+		}
+		flags[name] = flag
+	}
+	return flags, nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, f Flag) error {
+	value, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Do(ctx, "HSET", redisKey, f.Name, string(value))
+	return err
+}
+
+func (s *RedisStore) Delete(ctx context.Context, name string) error {
+	_, err := s.client.Do(ctx, "HDEL", redisKey, name)
+	return err
+}
@@ -0,0 +1,142 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/redis"
+)
+
+// ParseSpec parses comma-separated flags such as
+// "new-order-flow=on,checkout-v2=25%,legacy-export=off". A bare name is
+// on. A percentage turns the flag on for that share of tenants.
+func ParseSpec(spec string) (map[string]Flag, error) {
+	flags := map[string]Flag{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ValidName(name) {
+			return nil, fmt.Errorf("invalid flag name %q", name)
+		}
+		flag := Flag{Name: name, Enabled: true, Percent: 100, Source: SourceEnv}
+		switch value = strings.TrimSpace(value); value {
+		case "", "on", "true":
+		case "off", "false":
+			flag.Enabled = false
+		default:
+			percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || !strings.HasSuffix(value, "%") || percent < 0 || percent > 100 {
+				return nil, fmt.Errorf("invalid value %q for flag %s, want on, off or a percentage", value, name)
+			}
+			flag.Percent = percent
+		}
+		flags[name] = flag
+	}
+	return flags, nil
+}
+
+// fileFlag is a flag in a flags file. Percent defaults to 100.
+type fileFlag struct {
+	Enabled bool     `json:"enabled"`
+	Percent *int     `json:"percent"`
+	Tenants []string `json:"tenants"`
+}
+
+// LoadFile reads a JSON object of flags keyed by name, for example
+//
+//	{"new-order-flow": {"enabled": true, "percent": 25, "tenants": ["acme"]}}
+func LoadFile(path string) (map[string]Flag, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]fileFlag
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	flags := map[string]Flag{}
+	for name, f := range file {
+		if !ValidName(name) {
+			return nil, fmt.Errorf("invalid flag name %q in %s", name, path)
+		}
+		flag := Flag{Name: name, Enabled: f.Enabled, Percent: 100, Tenants: f.Tenants, Source: SourceFile}
+		if f.Percent != nil {
+			if *f.Percent < 0 || *f.Percent > 100 {
+				return nil, fmt.Errorf("invalid percent %d for flag %s in %s", *f.Percent, name, path)
+			}
+			flag.Percent = *f.Percent
+		}
+		flags[name] = flag
+	}
+	return flags, nil
+}
+
+// FromEnv builds the flags from FEATURE_FLAGS, then FEATURE_FLAGS_FILE,
+// whose flags win over the variable's. Runtime changes are kept in Redis at
+// REDIS_HOST, when set, and otherwise only in this process.
+func FromEnv() (*Flags, error) {
+	defaults, err := ParseSpec(config.GetEnv("FEATURE_FLAGS", ""))
+	if err != nil {
+		return nil, err
+	}
+	if path := config.GetEnv("FEATURE_FLAGS_FILE", ""); path != "" {
+		file, err := LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, flag := range file {
+			defaults[name] = flag
+		}
+	}
+
+	var store Store = NewMemoryStore()
+	if client := redis.FromEnv(); client != nil {
+		store = NewRedisStore(client)
+	}
+	return New(defaults, store), nil
+}
+
+// MemoryStore keeps runtime changes in this process, so they only affect
+// the replica that served the admin request and are lost on restart.
+type MemoryStore struct {
+	mu    sync.Mutex
+	flags map[string]Flag
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{flags: map[string]Flag{}}
+}
+
+func (s *MemoryStore) List(ctx context.Context) (map[string]Flag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flags := make(map[string]Flag, len(s.flags))
+	for name, flag := range s.flags {
+		flags[name] = flag
+	}
+	return flags, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, f Flag) error {
+	s.mu.Lock()
+	s.flags[f.Name] = f
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	delete(s.flags, name)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,149 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrCircuitOpen is returned, wrapped with the host, for calls to a host
+// whose breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// Breakers fails calls fast to hosts that keep failing. After Threshold
+// calls in a row get no response or a 502, 503 or 504, retries included,
+// a host's breaker opens and calls fail with ErrCircuitOpen for Cooldown.
+// Then one call is let through: if it succeeds the breaker closes,
+// otherwise it opens again.
+type Breakers struct {
+	Threshold int
+	Cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*breaker
+}
+
+type breaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+// BreakerState is one host's breaker as GET /admin/breakers shows it.
+type BreakerState struct {
+	Host     string     `json:"host"`
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Breakers
+)
+
+// NewBreakers registers the breakers with BreakerSnapshot.
+func NewBreakers(threshold int, cooldown time.Duration) *Breakers {
+	b := &Breakers{Threshold: threshold, Cooldown: cooldown, now: time.Now, hosts: map[string]*breaker{}}
+	registryMu.Lock()
+	registry = append(registry, b)
+	registryMu.Unlock()
+	return b
+}
+
+// allow reports whether a call to host may go out, moving an open breaker
+// whose cooldown has passed to half open for a single trial call.
+func (b *Breakers) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.hosts[host]
+	if !ok || br.state == BreakerClosed {
+		return nil
+	}
+	if br.state == BreakerOpen && !b.now().Before(br.openedAt.Add(b.Cooldown)) {
+		br.state = BreakerHalfOpen
+		return nil
+	}
+	return fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+}
+
+func (b *Breakers) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.hosts[host]
+	if !ok {
+		br = &breaker{state: BreakerClosed}
+		b.hosts[host] = br
+	}
+	if !failed {
+		br.state, br.failures = BreakerClosed, 0
+		return
+	}
+	br.failures++
+	if br.state == BreakerHalfOpen || br.failures >= b.Threshold {
+		br.state, br.openedAt = BreakerOpen, b.now()
+	}
+}
+
+func (b *Breakers) snapshot() []BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	states := make([]BreakerState, 0, len(b.hosts))
+	for host, br := range b.hosts {
+		s := BreakerState{Host: host, State: br.state, Failures: br.failures}
+		if br.state != BreakerClosed {
+			opened, retry := br.openedAt, br.openedAt.Add(b.Cooldown)
+			s.OpenedAt, s.RetryAt = &opened, &retry
+		}
+		states = append(states, s)
+	}
+	return states
+}
+
+// BreakerSnapshot returns the breaker of every host called through a client
+// from this package, by host.
+func BreakerSnapshot() []BreakerState {
+	registryMu.Lock()
+	sets := append([]*Breakers(nil), registry...)
+	registryMu.Unlock()
+	states := []BreakerState{}
+	for _, b := range sets {
+		states = append(states, b.snapshot()...)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Host < states[j].Host })
+	return states
+}
+
+// BreakerHandler serves BreakerSnapshot.
+func BreakerHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"breakers": BreakerSnapshot()})
+	}
+}
+
+// breakerFailure reports whether a call's outcome counts against the host.
+// A 500 is the host answering about one request, so it does not count.
+func breakerFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
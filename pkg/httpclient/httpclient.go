@@ -0,0 +1,226 @@
+// Package httpclient builds the *http.Client services use for every outbound
+// call, so timeouts, connection pooling, retries, tracing, metrics and
+// request-ID propagation behave the same everywhere.
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/deadline"
+	"github.com/alux444/go-microserv-test/pkg/i18n"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/pkg/tlsutil"
+	"github.com/alux444/go-microserv-test/pkg/tracing"
+)
+
+type Config struct {
+	// Timeout bounds a whole call, retries included.
+	Timeout               time.Duration
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	// Retries is how many times a request that got a 502 or 503, or could
+	// not connect, is sent again, waiting RetryBackoff (doubling each
+	// attempt) in between. Only requests that are safe to repeat are
+	// retried; see retryable.
+	Retries      int
+	RetryBackoff time.Duration
+	// BreakerThreshold is how many failed calls in a row open a host's
+	// circuit breaker, which then fails calls for BreakerCooldown; see
+	// Breakers. 0 turns breakers off.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// TLS is the client certificate presented to services that require
+	// mutual TLS and the CA their certificates are verified against.
+	TLS tlsutil.Files
+}
+
+// ConfigFromEnv reads the settings from HTTP_CLIENT_* environment variables.
+func ConfigFromEnv() Config {
+	return Config{
+		Timeout:               config.GetDuration("HTTP_CLIENT_TIMEOUT", 10*time.Second),
+		DialTimeout:           config.GetDuration("HTTP_CLIENT_DIAL_TIMEOUT", 2*time.Second),
+		ResponseHeaderTimeout: config.GetDuration("HTTP_CLIENT_RESPONSE_HEADER_TIMEOUT", 5*time.Second),
+		MaxIdleConns:          config.GetInt("HTTP_CLIENT_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:   config.GetInt("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", 10),
+		IdleConnTimeout:       config.GetDuration("HTTP_CLIENT_IDLE_CONN_TIMEOUT", 90*time.Second),
+		Retries:               config.GetInt("HTTP_CLIENT_RETRIES", 2),
+		RetryBackoff:          config.GetDuration("HTTP_CLIENT_RETRY_BACKOFF", 100*time.Millisecond),
+		BreakerThreshold:      config.GetInt("HTTP_CLIENT_BREAKER_THRESHOLD", 5),
+		BreakerCooldown:       config.GetDuration("HTTP_CLIENT_BREAKER_COOLDOWN", 30*time.Second),
+		TLS:                   tlsutil.FilesFromEnv("HTTP_CLIENT_TLS_"),
+	}
+}
+
+// New returns a client configured from the environment. See ConfigFromEnv.
+func New() *http.Client {
+	return NewWithConfig(ConfigFromEnv())
+}
+
+func NewWithConfig(cfg Config) *http.Client {
+	pool := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.DialTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+	}
+	var base http.RoundTripper = pool
+	if cfg.TLS.Enabled() {
+		certs, err := tlsutil.Load(cfg.TLS)
+		if err != nil {
+			// Calls fail rather than go out without the configured
+			// certificates.
+			log.Printf("Failed to load outbound TLS certificates: %v", err)
+			base = failingTransport{err: fmt.Errorf("outbound TLS certificates: %w", err)}
+		} else {
+			pool.TLSClientConfig = certs.ClientConfig()
+		}
+	}
+	transport := &Transport{Base: tracing.Transport(base), Retries: cfg.Retries, Backoff: cfg.RetryBackoff, Metrics: DefaultMetrics}
+	if cfg.BreakerThreshold > 0 {
+		transport.Breakers = NewBreakers(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	return &http.Client{Timeout: cfg.Timeout, Transport: transport}
+}
+
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
+
+// Transport sends the request ID, tenant and locale from the request
+// context as X-Request-ID, X-Tenant-ID and Accept-Language, and what is
+// left of its deadline as X-Request-Budget on every attempt, retries
+// transient failures, fails fast to hosts whose breaker is open when
+// Breakers is set, and records each call in Metrics.
+type Transport struct {
+	Base     http.RoundTripper
+	Retries  int
+	Backoff  time.Duration
+	Metrics  *Metrics
+	Breakers *Breakers
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestid.FromContext(req.Context()); id != "" && req.Header.Get(requestid.Header) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(requestid.Header, id)
+	}
+	if id, ok := tenant.Lookup(req.Context()); ok && req.Header.Get(tenant.Header) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(tenant.Header, id)
+	}
+	if locale, ok := i18n.Lookup(req.Context()); ok && req.Header.Get(i18n.Header) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(i18n.Header, locale)
+	}
+
+	if t.Breakers != nil {
+		if err := t.Breakers.allow(req.URL.Host); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	retries := 0
+	resp, err := t.Base.RoundTrip(deadline.Propagate(req))
+	for attempt := 0; attempt < t.Retries && retryable(req, resp, err); attempt++ {
+		// If the retry cannot go out, the last response is returned as it
+		// is, so it is only closed once another attempt is sent.
+		next, rewindErr := rewind(req)
+		if rewindErr != nil || !sleep(req.Context(), t.Backoff<<attempt) {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		req = next
+		retries++
+		resp, err = t.Base.RoundTrip(deadline.Propagate(req))
+	}
+
+	// A call the caller gave up on says nothing about the host.
+	if t.Breakers != nil && req.Context().Err() == nil {
+		t.Breakers.record(req.URL.Host, breakerFailure(resp, err))
+	}
+	if t.Metrics != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Metrics.record(req.URL.Host, status, retries, time.Since(start))
+	}
+	return resp, err
+}
+
+// retryable reports whether req may be sent again after resp or err. A
+// request is safe to repeat when its method is idempotent or it carries an
+// Idempotency-Key the receiving service deduplicates on.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		if req.Header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	}
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// rewind gives the retry a fresh copy of the request body.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,181 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/deadline"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRetries(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := ConfigFromEnv()
+	cfg.RetryBackoff = time.Millisecond
+	client := NewWithConfig(cfg)
+
+	resp, err := client.Get(srv.URL)
+	if err != nil || resp.StatusCode != http.StatusOK || len(bodies) != 3 {
+		t.Fatalf("Expected a GET to succeed on its third attempt, got %d attempts: %v", len(bodies), err)
+	}
+	resp.Body.Close()
+
+	bodies = nil
+	resp, err = client.Post(srv.URL, "application/json", strings.NewReader(`{"a":1}`))
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || len(bodies) != 1 {
+		t.Errorf("Expected a POST without an idempotency key not to be retried, got %d attempts: %v", len(bodies), err)
+	}
+	resp.Body.Close()
+
+	bodies = nil
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{"a":1}`))
+	req.Header.Set("Idempotency-Key", "k1")
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK || strings.Join(bodies, "|") != `{"a":1}|{"a":1}|{"a":1}` {
+		t.Errorf("Expected an idempotent POST to be retried with its body, got: %q, %v", bodies, err)
+	}
+	resp.Body.Close()
+
+	stats := DefaultMetrics.Snapshot()
+	if len(stats) == 0 || stats[0].Requests != 3 || stats[0].Retries != 4 || stats[0].Failures != 1 {
+		t.Errorf("Expected 3 requests with 4 retries and 1 failure, got: %+v", stats)
+	}
+}
+
+func TestRequestIDIsPropagated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(requestid.Header)
+	}))
+	defer backend.Close()
+
+	client := New()
+	router := gin.New()
+	router.Use(requestid.Middleware())
+	router.GET("/", func(c *gin.Context) {
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, backend.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			c.Status(http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestid.Header, "abc123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got != "abc123" || w.Header().Get(requestid.Header) != "abc123" {
+		t.Errorf("Expected the caller's request ID to reach the backend and come back, got: %q, %q", got, w.Header().Get(requestid.Header))
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got == "" || got == "abc123" || w.Header().Get(requestid.Header) != got {
+		t.Errorf("Expected a fresh request ID to be generated and sent, got: %q", got)
+	}
+
+	if requestid.FromContext(context.Background()) != "" {
+		t.Error("Expected no request ID on a bare context")
+	}
+}
+
+func TestBudgetIsPropagated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var budgets []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budgets = append(budgets, r.Header.Get(deadline.Header))
+		if len(budgets) == 1 {
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	cfg := ConfigFromEnv()
+	cfg.RetryBackoff = time.Millisecond
+	client := NewWithConfig(cfg)
+	router := gin.New()
+	router.Use(deadline.Middleware(0))
+	router.GET("/", func(c *gin.Context) {
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, backend.URL, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(deadline.Header, "5000")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if len(budgets) != 2 || budgets[0] > "5000" || budgets[0] < "4900" || budgets[1] >= budgets[0] {
+		t.Errorf("Expected each attempt to carry what was left of the caller's budget, got: %q", budgets)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	cfg := ConfigFromEnv()
+	cfg.Retries, cfg.BreakerThreshold, cfg.BreakerCooldown = 0, 2, time.Minute
+	client := NewWithConfig(cfg)
+	breakers := client.Transport.(*Transport).Breakers
+	now := time.Now()
+	breakers.now = func() time.Time { return now }
+	get := func() error {
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	get()
+	get()
+	if err := get(); !errors.Is(err, ErrCircuitOpen) || calls != 2 {
+		t.Fatalf("Expected the breaker to open after 2 failures, got %d calls: %v", calls, err)
+	}
+	if states := breakers.snapshot(); len(states) != 1 || states[0].State != BreakerOpen || states[0].RetryAt == nil {
+		t.Errorf("Expected the host's breaker to show open, got: %+v", states)
+	}
+
+	now = now.Add(time.Minute)
+	get()
+	if err := get(); !errors.Is(err, ErrCircuitOpen) || calls != 3 {
+		t.Errorf("Expected a failed trial call to reopen the breaker, got %d calls: %v", calls, err)
+	}
+
+	status = http.StatusOK
+	now = now.Add(time.Minute)
+	if err := get(); err != nil {
+		t.Fatalf("Expected the trial call to go out, got: %v", err)
+	}
+	if states := breakers.snapshot(); states[0].State != BreakerClosed || states[0].Failures != 0 {
+		t.Errorf("Expected a successful trial call to close the breaker, got: %+v", states)
+	}
+}
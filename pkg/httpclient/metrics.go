@@ -0,0 +1,80 @@
+package httpclient
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultMetrics records every call made by clients from New.
+var DefaultMetrics = NewMetrics()
+
+// Metrics counts outbound calls per host in memory since the process
+// started.
+type Metrics struct {
+	mu    sync.Mutex
+	hosts map[string]*HostStats
+}
+
+type HostStats struct {
+	Host     string `json:"host"`
+	Requests int64  `json:"requests"`
+	// Failures counts calls that got no response or a 5xx after retries.
+	Failures     int64   `json:"failures"`
+	Retries      int64   `json:"retries"`
+	AvgLatencyMS float64 `json:"avg_latency_ms"`
+	MaxLatencyMS float64 `json:"max_latency_ms"`
+
+	total time.Duration
+	max   time.Duration
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{hosts: map[string]*HostStats{}}
+}
+
+func (m *Metrics) record(host string, status, retries int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.hosts[host]
+	if !ok {
+		s = &HostStats{Host: host}
+		m.hosts[host] = s
+	}
+	s.Requests++
+	if status == 0 || status >= 500 {
+		s.Failures++
+	}
+	s.Retries += int64(retries)
+	s.total += latency
+	if latency > s.max {
+		s.max = latency
+	}
+}
+
+// Snapshot returns the stats for every host, by host.
+func (m *Metrics) Snapshot() []HostStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]HostStats, 0, len(m.hosts))
+	for _, s := range m.hosts {
+		row := *s
+		row.AvgLatencyMS = float64(s.total.Microseconds()) / 1000 / float64(s.Requests)
+		row.MaxLatencyMS = float64(s.max.Microseconds()) / 1000
+		out = append(out, row)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// Handler serves DefaultMetrics.
+func Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"hosts": DefaultMetrics.Snapshot()})
+	}
+}
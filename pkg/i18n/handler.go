@@ -0,0 +1,19 @@
+package i18n
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Handler serves GET /locales: the locales c has, the default, and the one
+// the request was answered in.
+func (c *Catalog) Handler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{
+			"locales": c.Locales(),
+			"default": DefaultLocale,
+			"locale":  FromContext(ctx.Request.Context()),
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Package i18n localizes what the services say to people. Middleware picks
+// the locale a request prefers from its Accept-Language header, among the
+// ones the service's catalog has, and translates the "error" message of
+// JSON error responses into it. Messages are looked up by their English
+// text, so handlers go on writing English and a message nobody has
+// translated yet, or one built from values, is sent as it is.
+package i18n
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is the locale messages are written in, used when a request
+// prefers none the catalog has.
+const DefaultLocale = "en"
+
+// Header is the request header preferred locales are read from, and the
+// one outbound calls pass the request's locale on in.
+const Header = "Accept-Language"
+
+// shared translates the messages pkg itself writes, such as those of
+// auth, tenant and loadshed, for every service.
+//
+//go:embed messages/*.json
+var shared embed.FS
+
+// Catalog holds the translations of one service's messages, by locale and
+// then by their English text.
+type Catalog struct {
+	messages map[string]map[string]string
+}
+
+// Load reads the <locale>.json files at the root of fsys, each an object
+// from English message to its translation, over the shared messages. A nil
+// fsys loads the shared messages alone.
+func Load(fsys fs.FS) (*Catalog, error) {
+	c := &Catalog{messages: map[string]map[string]string{DefaultLocale: {}}}
+	sub, err := fs.Sub(shared, "messages")
+	if err != nil {
+		return nil, err
+	}
+	sources := []fs.FS{sub}
+	if fsys != nil {
+		sources = append(sources, fsys)
+	}
+	for _, source := range sources {
+		paths, err := fs.Glob(source, "*.json")
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			locale := strings.ToLower(strings.TrimSuffix(path.Base(p), ".json"))
+			raw, err := fs.ReadFile(source, p)
+			if err != nil {
+				return nil, err
+			}
+			var messages map[string]string
+			if err := json.Unmarshal(raw, &messages); err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			if c.messages[locale] == nil {
+				c.messages[locale] = map[string]string{}
+			}
+			for message, translated := range messages {
+				c.messages[locale][message] = translated
+			}
+		}
+	}
+	return c, nil
+}
+
+// Locales lists the locales c has, DefaultLocale first and the rest sorted.
+func (c *Catalog) Locales() []string {
+	locales := []string{DefaultLocale}
+	for locale := range c.messages {
+		if locale != DefaultLocale {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales[1:])
+	return locales
+}
+
+// Match picks the locale c has that an Accept-Language header prefers,
+// trying each preference as given and then its language, so es-MX is
+// answered in es. It returns DefaultLocale when c has none of them.
+func (c *Catalog) Match(header string) string {
+	for _, preferred := range Parse(header) {
+		for _, candidate := range Chain(preferred) {
+			if candidate == DefaultLocale {
+				// Reached through the chain, en only matches when asked for.
+				if preferred == DefaultLocale || strings.HasPrefix(preferred, DefaultLocale+"-") {
+					return DefaultLocale
+				}
+				continue
+			}
+			if _, ok := c.messages[candidate]; ok {
+				return candidate
+			}
+		}
+	}
+	return DefaultLocale
+}
+
+// Translate returns message in locale, falling back along Chain, and the
+// message itself when nothing along it translates it.
+func (c *Catalog) Translate(locale, message string) string {
+	for _, candidate := range Chain(locale) {
+		if translated, ok := c.messages[candidate][message]; ok {
+			return translated
+		}
+	}
+	return message
+}
+
+// Chain is the order a locale is looked up in: the locale, its language
+// and then DefaultLocale, so es-MX falls back to es and then to en.
+func Chain(locale string) []string {
+	locale = strings.ToLower(locale)
+	chain := []string{}
+	if locale != "" {
+		chain = append(chain, locale)
+	}
+	if language, _, ok := strings.Cut(locale, "-"); ok && language != "" {
+		chain = append(chain, language)
+	}
+	if len(chain) == 0 || chain[len(chain)-1] != DefaultLocale {
+		chain = append(chain, DefaultLocale)
+	}
+	return chain
+}
+
+// Parse reads an Accept-Language header such as "es-MX, es;q=0.9, *;q=0.5"
+// into the locales it names, lowercased, most preferred first. Wildcards,
+// locales refused with q=0 and malformed entries are left out.
+func Parse(header string) []string {
+	type preference struct {
+		locale string
+		q      float64
+	}
+	var prefs []preference
+	for _, entry := range strings.Split(header, ",") {
+		locale, params, _ := strings.Cut(entry, ";")
+		locale = strings.ToLower(strings.TrimSpace(locale))
+		if locale == "" || locale == "*" || !validLocale(locale) {
+			continue
+		}
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{locale: locale, q: q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	locales := make([]string, len(prefs))
+	for i, p := range prefs {
+		locales[i] = p.locale
+	}
+	return locales
+}
+
+// validLocale accepts language tags such as en, es-MX or zh-Hant-TW.
+func validLocale(s string) bool {
+	for i, part := range strings.Split(s, "-") {
+		if len(part) == 0 || len(part) > 8 || (i == 0 && len(part) > 3) {
+			return false
+		}
+		for _, r := range part {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, contextKey{}, locale)
+}
+
+// Lookup returns the locale stored by Middleware or NewContext, and
+// whether there was one.
+func Lookup(ctx context.Context) (string, bool) {
+	locale, ok := ctx.Value(contextKey{}).(string)
+	return locale, ok
+}
+
+// FromContext returns the request's locale, or DefaultLocale outside a
+// request.
+func FromContext(ctx context.Context) string {
+	if locale, ok := Lookup(ctx); ok {
+		return locale
+	}
+	return DefaultLocale
+}
@@ -0,0 +1,117 @@
+package i18n
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testCatalog(t *testing.T) *Catalog {
+	t.Helper()
+	c, err := Load(fstest.MapFS{
+		"es.json":    {Data: []byte(`{"order not found": "pedido no encontrado"}`)},
+		"es-mx.json": {Data: []byte(`{"order not found": "orden no encontrada"}`)},
+		"fr.json":    {Data: []byte(`{"order not found": "commande introuvable"}`)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load catalog: %v", err)
+	}
+	return c
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string][]string{
+		"":                                   {},
+		"es":                                 {"es"},
+		"fr;q=0.5, es-MX, es;q=0.9, *;q=0.1": {"es-mx", "es", "fr"},
+		"de;q=0, en":                         {"en"},
+		"en;q=2, es;q=abc, x_y, fr":          {"fr"},
+	}
+	for header, want := range tests {
+		if got := Parse(header); !reflect.DeepEqual(got, want) {
+			t.Errorf("Parse(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c := testCatalog(t)
+	tests := map[string]string{
+		"":                 "en",
+		"es-AR":            "es",
+		"es-MX":            "es-mx",
+		"de, fr;q=0.8":     "fr",
+		"en-GB, fr;q=0.8":  "en",
+		"de, en;q=0.1, fr": "fr",
+		"de":               "en",
+	}
+	for header, want := range tests {
+		if got := c.Match(header); got != want {
+			t.Errorf("Match(%q) = %s, want %s", header, got, want)
+		}
+	}
+	if got := c.Locales(); !reflect.DeepEqual(got, []string{"en", "es", "es-mx", "fr"}) {
+		t.Errorf("Expected en first and the rest sorted, got: %v", got)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	c := testCatalog(t)
+	if got := c.Translate("es-mx", "authentication required"); got != "se requiere autenticación" {
+		t.Errorf("Expected a shared message to fall back to its language, got: %s", got)
+	}
+	if got := c.Translate("es-mx", "order not found"); got != "orden no encontrada" {
+		t.Errorf("Expected the regional translation first, got: %s", got)
+	}
+	if got := c.Translate("fr", "user 7 not found"); got != "user 7 not found" {
+		t.Errorf("Expected an untranslated message as it is, got: %s", got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c := testCatalog(t)
+	router := gin.New()
+	router.Use(c.Middleware())
+	router.GET("/locales", c.Handler())
+	router.GET("/orders/1", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "order not found", "id": 1})
+	})
+	router.GET("/orders/2", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"error": "order not found"})
+	})
+	send := func(path, language string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(Header, language)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("/orders/1", "es-AR,en;q=0.5")
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"error":"pedido no encontrado","id":1}` ||
+		w.Header().Get("Content-Language") != "es" || w.Header().Get("Vary") != Header {
+		t.Errorf("Expected the error in Spanish, got: %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	if w := send("/orders/1", ""); w.Body.String() != `{"error":"order not found","id":1}` || w.Header().Get("Content-Language") != "en" {
+		t.Errorf("Expected the error in English, got: %v %s", w.Header(), w.Body.String())
+	}
+	if w := send("/orders/2", "fr"); w.Body.String() != `{"error":"order not found"}` {
+		t.Errorf("Expected a success response untouched, got: %s", w.Body.String())
+	}
+
+	var locales struct {
+		Locales []string `json:"locales"`
+		Default string   `json:"default"`
+		Locale  string   `json:"locale"`
+	}
+	w = send("/locales", "fr-CA")
+	if err := json.Unmarshal(w.Body.Bytes(), &locales); err != nil || len(locales.Locales) != 4 || locales.Default != "en" || locales.Locale != "fr" {
+		t.Errorf("Expected the catalog's locales, got: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,83 @@
+package i18n
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware stores the locale the request prefers on its context, names
+// it in Content-Language, and translates the "error" of JSON responses of
+// 400 and above into it. Only error responses are buffered; everything
+// else streams through untouched.
+func (c *Catalog) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		locale := c.Match(ctx.GetHeader(Header))
+		ctx.Request = ctx.Request.WithContext(NewContext(ctx.Request.Context(), locale))
+		ctx.Header("Content-Language", locale)
+		ctx.Writer.Header().Add("Vary", Header)
+		if locale == DefaultLocale {
+			ctx.Next()
+			return
+		}
+
+		w := &translator{ResponseWriter: ctx.Writer}
+		ctx.Writer = w
+		ctx.Next()
+		w.flush(c, locale)
+	}
+}
+
+// translator holds back the body of JSON error responses until the
+// handlers are done, so their message can be replaced.
+type translator struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	buffered bool
+}
+
+func (w *translator) holds() bool {
+	if w.buffered {
+		return true
+	}
+	w.buffered = w.Status() >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	return w.buffered
+}
+
+func (w *translator) Write(b []byte) (int, error) {
+	if w.holds() {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *translator) WriteString(s string) (int, error) {
+	if w.holds() {
+		return w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// flush writes the held body with its message translated. A body that is
+// not an object with a string "error" is written as it was.
+func (w *translator) flush(c *Catalog, locale string) {
+	if !w.buffered {
+		return
+	}
+	body := w.body.Bytes()
+	var fields map[string]json.RawMessage
+	var message string
+	if json.Unmarshal(body, &fields) == nil && json.Unmarshal(fields["error"], &message) == nil {
+		if translated := c.Translate(locale, message); translated != message {
+			fields["error"], _ = json.Marshal(translated)
+			if b, err := json.Marshal(fields); err == nil {
+				body = b
+			}
+		}
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.Write(body)
+}
@@ -0,0 +1,135 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	mu      sync.Mutex
+	records map[string]*Record
+}
+
+func newMemStore() *memStore {
+	return &memStore{records: map[string]*Record{}}
+}
+
+func (s *memStore) Reserve(ctx context.Context, scope, key, hash string, notBefore time.Time) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[scope+"|"+key]; ok {
+		out := *r
+		return &out, nil
+	}
+	s.records[scope+"|"+key] = &Record{RequestHash: hash}
+	return nil, nil
+}
+
+func (s *memStore) Complete(ctx context.Context, scope, key string, r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[scope+"|"+key] = r
+	return nil
+}
+
+func (s *memStore) Release(ctx context.Context, scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, scope+"|"+key)
+	return nil
+}
+
+func (s *memStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func newRouter(store Store, calls *int, status int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware(store, time.Hour))
+	router.POST("/orders", func(c *gin.Context) {
+		*calls++
+		c.JSON(status, gin.H{"id": *calls})
+	})
+	return router
+}
+
+func post(router *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(Header, key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestReplaysFirstResponse(t *testing.T) {
+	calls := 0
+	router := newRouter(newMemStore(), &calls, http.StatusCreated)
+
+	first := post(router, "abc", `{"sku":"A"}`)
+	second := post(router, "abc", `{"sku":"A"}`)
+
+	if calls != 1 {
+		t.Errorf("Expected handler to run once, got: %d", calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Errorf("Expected replay of %d %s, got: %d %s", first.Code, first.Body, second.Code, second.Body)
+	}
+	if second.Header().Get(ReplayedHeader) != "true" || first.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("Expected only the replay to carry %s", ReplayedHeader)
+	}
+}
+
+func TestRejectsKeyReuseWithDifferentBody(t *testing.T) {
+	calls := 0
+	router := newRouter(newMemStore(), &calls, http.StatusCreated)
+
+	post(router, "abc", `{"sku":"A"}`)
+	w := post(router, "abc", `{"sku":"B"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422, got: %d", w.Code)
+	}
+}
+
+func TestInProgressKeyConflicts(t *testing.T) {
+	store := newMemStore()
+	store.records["anonymous|abc"] = &Record{RequestHash: requestHash(httptest.NewRequest(http.MethodPost, "/orders", nil), []byte(`{}`))}
+	calls := 0
+	router := newRouter(store, &calls, http.StatusCreated)
+
+	w := post(router, "abc", `{}`)
+	if w.Code != http.StatusConflict || calls != 0 {
+		t.Errorf("Expected status 409 without running the handler, got: %d (calls %d)", w.Code, calls)
+	}
+}
+
+func TestServerErrorsAreNotCached(t *testing.T) {
+	calls := 0
+	router := newRouter(newMemStore(), &calls, http.StatusInternalServerError)
+
+	post(router, "abc", `{}`)
+	post(router, "abc", `{}`)
+	if calls != 2 {
+		t.Errorf("Expected retry after a 500 to run the handler again, got: %d calls", calls)
+	}
+}
+
+func TestWithoutKeyPassesThrough(t *testing.T) {
+	calls := 0
+	router := newRouter(newMemStore(), &calls, http.StatusCreated)
+
+	post(router, "", `{}`)
+	post(router, "", `{}`)
+	if calls != 2 {
+		t.Errorf("Expected 2 calls without a key, got: %d", calls)
+	}
+}
@@ -0,0 +1,149 @@
+// Package idempotency lets clients safely retry POST requests by sending an
+// Idempotency-Key header: the first response for a key is stored and replayed
+// for repeats within the TTL.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+	maxKeyLength   = 255
+)
+
+// Middleware must run after auth.Authenticate so keys are scoped to the
+// caller and one client cannot replay another's response.
+func Middleware(store Store, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+		if c.Request.Method != http.MethodPost || key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := scopeFor(c)
+		hash := requestHash(c.Request, body)
+		existing, err := store.Reserve(c.Request.Context(), scope, key, hash, time.Now().Add(-ttl))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "idempotency check unavailable"})
+			return
+		}
+		if existing != nil {
+			replay(c, existing, hash)
+			return
+		}
+
+		w := &recorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		// Reservations are stored against a background context so a client
+		// disconnecting mid-request does not leave the key stuck.
+		ctx := context.Background()
+		if w.Status() >= http.StatusInternalServerError {
+			if err := store.Release(ctx, scope, key); err != nil {
+				log.Printf("Failed to release idempotency key %q: %v", key, err)
+			}
+			return
+		}
+		err = store.Complete(ctx, scope, key, &Record{
+			RequestHash: hash,
+			Completed:   true,
+			StatusCode:  w.Status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+		})
+		if err != nil {
+			log.Printf("Failed to store response for idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+func replay(c *gin.Context, r *Record, hash string) {
+	if r.RequestHash != hash {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		return
+	}
+	if !r.Completed {
+		c.Header("Retry-After", "1")
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is still in progress"})
+		return
+	}
+	c.Header(ReplayedHeader, "true")
+	c.Data(r.StatusCode, r.ContentType, r.Body)
+	c.Abort()
+}
+
+func scopeFor(c *gin.Context) string {
+	p, ok := auth.FromContext(c)
+	switch {
+	case !ok:
+		return "anonymous"
+	case p.Service != "":
+		return "service:" + p.Service
+	default:
+		return "user:" + strconv.Itoa(p.UserID)
+	}
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Purger deletes expired keys every interval until ctx is cancelled.
+func Purger(ctx context.Context, store Store, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := store.Purge(ctx, time.Now().Add(-ttl)); err != nil {
+				log.Printf("Failed to purge idempotency keys: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+)
+
+// Record is the stored outcome of the first request made with a key.
+// Completed is false while that request is still being handled.
+type Record struct {
+	RequestHash string
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+type Store interface {
+	// Reserve claims scope/key for a new request unless a record created
+	// after notBefore exists, in which case that record is returned.
+	Reserve(ctx context.Context, scope, key, requestHash string, notBefore time.Time) (*Record, error)
+	Complete(ctx context.Context, scope, key string, r *Record) error
+	// Release drops a reservation so the request can be retried.
+	Release(ctx context.Context, scope, key string) error
+	Purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+// PostgresStore keeps keys in a table of each service's schema, created
+// with the layout in scripts/init-db.sql.
+type PostgresStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewPostgresStore(db *sql.DB, table string) *PostgresStore {
+	return &PostgresStore{db: db, table: table}
+}
+
+func (s *PostgresStore) Reserve(ctx context.Context, scope, key, requestHash string, notBefore time.Time) (*Record, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE scope = $1 AND key = $2 AND created_at < $3",
+		scope, key, notBefore); err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.ExecContext(ctx, "INSERT INTO "+s.table+` (scope, key, request_hash)
+		VALUES ($1, $2, $3) ON CONFLICT (scope, key) DO NOTHING`, scope, key, requestHash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 1 {
+		return nil, nil
+	}
+
+	var r Record
+	var status sql.NullInt64
+	err = s.db.QueryRowContext(ctx, "SELECT request_hash, completed, status_code, COALESCE(content_type, ''), body FROM "+s.table+
+		" WHERE scope = $1 AND key = $2", scope, key).
+		Scan(&r.RequestHash, &r.Completed, &status, &r.ContentType, &r.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Expired and purged between the insert and now; treat as reserved
+		// by someone else so the client retries.
+		return &Record{RequestHash: requestHash}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.StatusCode = int(status.Int64)
+	return &r, nil
+}
+
+func (s *PostgresStore) Complete(ctx context.Context, scope, key string, r *Record) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, "UPDATE "+s.table+` SET completed = TRUE, status_code = $3, content_type = $4, body = $5
+		WHERE scope = $1 AND key = $2`, scope, key, r.StatusCode, r.ContentType, r.Body)
+	return err
+}
+
+func (s *PostgresStore) Release(ctx context.Context, scope, key string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE scope = $1 AND key = $2 AND NOT completed", scope, key)
+	return err
+}
+
+func (s *PostgresStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,165 @@
+// Package jobs runs a service's background work: jobs on a schedule, and
+// queues of tasks drained by a pool of workers. Every run is counted in
+// Metrics, and Stop lets running work finish so a shutdown does not cut a
+// job off halfway.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Func is one run of a job or one queued task.
+type Func func(ctx context.Context) error
+
+type job struct {
+	name     string
+	schedule Schedule
+	run      Func
+	stats    *JobStats
+}
+
+// Runner owns a service's scheduled jobs and queues. Register everything
+// before calling Start.
+type Runner struct {
+	jobs    []*job
+	queues  []*Queue
+	metrics *Metrics
+	now     func() time.Time
+
+	// loop stops scheduling new runs; work is the context runs get, which is
+	// only cancelled when Stop gives up waiting.
+	loop, work           context.Context
+	stopLoop, cancelWork context.CancelFunc
+	wg                   sync.WaitGroup
+}
+
+func New() *Runner {
+	return &Runner{metrics: NewMetrics(), now: time.Now}
+}
+
+// Schedule runs fn on schedule. Runs of one job never overlap: a run that
+// takes longer than the interval delays the next one.
+func (r *Runner) Schedule(name string, schedule Schedule, fn Func) {
+	r.jobs = append(r.jobs, &job{name: name, schedule: schedule, run: fn, stats: r.metrics.job(name, schedule.String())})
+}
+
+// Cron is Schedule with a spec parsed by ParseCron.
+func (r *Runner) Cron(name, spec string, fn Func) error {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", name, err)
+	}
+	r.Schedule(name, schedule, fn)
+	return nil
+}
+
+// Start runs the jobs and queue workers until Stop is called or ctx is
+// cancelled.
+func (r *Runner) Start(ctx context.Context) {
+	r.loop, r.stopLoop = context.WithCancel(ctx)
+	r.work, r.cancelWork = context.WithCancel(context.WithoutCancel(ctx))
+	for _, j := range r.jobs {
+		r.wg.Add(1)
+		go r.runJob(j)
+	}
+	for _, q := range r.queues {
+		for i := 0; i < q.workers; i++ {
+			r.wg.Add(1)
+			go r.runWorker(q)
+		}
+	}
+	log.Printf("Started %d background jobs and %d queues", len(r.jobs), len(r.queues))
+}
+
+// Stop stops scheduling, closes the queues and waits for running jobs and
+// already queued tasks to finish. If ctx expires first, their context is
+// cancelled and ctx's error returned.
+func (r *Runner) Stop(ctx context.Context) error {
+	if r.stopLoop == nil {
+		return nil
+	}
+	r.stopLoop()
+	for _, q := range r.queues {
+		q.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		r.cancelWork()
+		return nil
+	case <-ctx.Done():
+		r.cancelWork()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (r *Runner) runJob(j *job) {
+	defer r.wg.Done()
+	next := j.schedule.Next(r.now())
+	for {
+		j.stats.setNext(next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-r.loop.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := r.call(j.stats, j.run)
+		if err != nil {
+			log.Printf("Job %s failed: %v", j.name, err)
+		}
+		next = j.schedule.Next(next)
+		// A run that overran skips the slots it missed instead of firing
+		// them back to back.
+		if now := r.now(); next.Before(now) {
+			next = j.schedule.Next(now)
+		}
+	}
+}
+
+func (r *Runner) call(stats *JobStats, fn Func) error {
+	start := r.now()
+	stats.started(start)
+	err := safely(r.work, fn)
+	stats.finished(r.now().Sub(start), err)
+	return err
+}
+
+// safely runs fn, turning a panic into an error so one bad run does not take
+// the service down.
+func safely(ctx context.Context, fn Func) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn(ctx)
+}
+
+// Metrics returns the runner's job and queue stats.
+func (r *Runner) Metrics() *Metrics {
+	return r.metrics
+}
+
+// Handler serves the runner's metrics.
+func (r *Runner) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobs, queues := r.metrics.Snapshot()
+		c.JSON(http.StatusOK, gin.H{"jobs": jobs, "queues": queues})
+	}
+}
@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 22, 47, 30, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 23, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, time.February, 1, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2024, time.February, 1, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2024, time.February, 29, 12, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either may match.
+		{"0 0 15 * 5", time.Date(2024, time.February, 2, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+	}
+	for _, tt := range tests {
+		s, err := ParseCron(tt.spec)
+		if err != nil {
+			t.Errorf("Expected %q to parse, got: %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Expected %q to run next at %v, got: %v", tt.spec, tt.want, got)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "@every -1m", "@yearly"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestRunner(t *testing.T) {
+	r := New()
+	var runs atomic.Int32
+	r.Schedule("tick", Every(5*time.Millisecond), func(ctx context.Context) error {
+		if runs.Add(1) == 2 {
+			panic("boom")
+		}
+		return nil
+	})
+
+	release := make(chan struct{})
+	var finished atomic.Bool
+	q := r.Queue("work", 1, 2)
+	if !q.Enqueue("a", func(ctx context.Context) error {
+		<-release
+		finished.Store(true)
+		return errors.New("failed")
+	}) {
+		t.Fatal("Expected the first task to be queued")
+	}
+	if q.Enqueue("a", func(ctx context.Context) error { return nil }) {
+		t.Error("Expected a task with a pending key not to be queued twice")
+	}
+
+	r.Start(context.Background())
+	deadline := time.Now().Add(time.Second)
+	for runs.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if runs.Load() < 3 {
+		t.Fatalf("Expected the job to keep running after a panic, got %d runs", runs.Load())
+	}
+	for _, queues := r.metrics.Snapshot(); queues[0].Busy != 1; _, queues = r.metrics.Snapshot() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the worker to be busy, got: %+v", queues)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	if err := r.Stop(context.Background()); err != nil || !finished.Load() {
+		t.Errorf("Expected Stop to wait for the running task, got: %v", err)
+	}
+	if q.Enqueue("b", func(ctx context.Context) error { return nil }) {
+		t.Error("Expected a stopped queue to refuse tasks")
+	}
+
+	jobs, queues := r.metrics.Snapshot()
+	if len(jobs) != 1 || jobs[0].Failures != 1 || jobs[0].Runs < 3 {
+		t.Errorf("Expected one job with a single failure, got: %+v", jobs)
+	}
+	if len(queues) != 1 || queues[0].Processed != 1 || queues[0].Failures != 1 || queues[0].Depth != 0 ||
+		queues[0].Busy != 0 || queues[0].Capacity != 2 {
+		t.Errorf("Expected one failed task, got: %+v", queues)
+	}
+}
+
+func TestStopTimesOut(t *testing.T) {
+	r := New()
+	started := make(chan struct{})
+	q := r.Queue("slow", 1, 1)
+	q.Enqueue("slow", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	r.Start(context.Background())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Stop to give up and cancel the task, got: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package jobs
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics counts job runs and queued tasks in memory since the process
+// started.
+type Metrics struct {
+	mu     sync.Mutex
+	jobs   map[string]*JobStats
+	queues map[string]*QueueStats
+}
+
+type JobStats struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Runs     int64  `json:"runs"`
+	Failures int64  `json:"failures"`
+	Running  bool   `json:"running"`
+	// LastError is the error of the last run, and is cleared by a run that
+	// succeeds.
+	LastError      string     `json:"last_error,omitempty"`
+	LastStartedAt  *time.Time `json:"last_started_at,omitempty"`
+	LastDurationMS float64    `json:"last_duration_ms"`
+	NextRunAt      *time.Time `json:"next_run_at,omitempty"`
+
+	mu *sync.Mutex
+}
+
+type QueueStats struct {
+	Name    string `json:"name"`
+	Workers int    `json:"workers"`
+	// Busy is how many workers are running a task.
+	Busy int `json:"busy"`
+	// Depth is how many tasks are waiting for a worker, out of Capacity.
+	Depth     int   `json:"depth"`
+	Capacity  int   `json:"capacity"`
+	Enqueued  int64 `json:"enqueued"`
+	Processed int64 `json:"processed"`
+	Failures  int64 `json:"failures"`
+	// Dropped counts tasks turned away because the queue was full.
+	Dropped      int64   `json:"dropped"`
+	AvgLatencyMS float64 `json:"avg_latency_ms"`
+
+	total time.Duration
+	mu    *sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{jobs: map[string]*JobStats{}, queues: map[string]*QueueStats{}}
+}
+
+func (m *Metrics) job(name, schedule string) *JobStats {
+	s := &JobStats{Name: name, Schedule: schedule, mu: &m.mu}
+	m.mu.Lock()
+	m.jobs[name] = s
+	m.mu.Unlock()
+	return s
+}
+
+func (m *Metrics) queue(name string, workers, capacity int) *QueueStats {
+	s := &QueueStats{Name: name, Workers: workers, Capacity: capacity, mu: &m.mu}
+	m.mu.Lock()
+	m.queues[name] = s
+	m.mu.Unlock()
+	return s
+}
+
+func (s *JobStats) setNext(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.NextRunAt = &at
+}
+
+func (s *JobStats) started(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Running = true
+	s.LastStartedAt = &at
+	s.NextRunAt = nil
+}
+
+func (s *JobStats) finished(took time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Running = false
+	s.Runs++
+	s.LastDurationMS = float64(took.Microseconds()) / 1000
+	s.LastError = ""
+	if err != nil {
+		s.Failures++
+		s.LastError = err.Error()
+	}
+}
+
+func (s *QueueStats) enqueued(depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Enqueued++
+	s.Depth = depth
+}
+
+func (s *QueueStats) dropped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Dropped++
+}
+
+func (s *QueueStats) depth(depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Depth = depth
+}
+
+func (s *QueueStats) started() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Busy++
+}
+
+func (s *QueueStats) processed(took time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Busy--
+	s.Processed++
+	s.total += took
+	if err != nil {
+		s.Failures++
+	}
+}
+
+// Snapshot returns the stats of every job and queue, by name.
+func (m *Metrics) Snapshot() ([]JobStats, []QueueStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]JobStats, 0, len(m.jobs))
+	for _, s := range m.jobs {
+		jobs = append(jobs, *s)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	queues := make([]QueueStats, 0, len(m.queues))
+	for _, s := range m.queues {
+		row := *s
+		if s.Processed > 0 {
+			row.AvgLatencyMS = float64(s.total.Microseconds()) / 1000 / float64(s.Processed)
+		}
+		queues = append(queues, row)
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name < queues[j].Name })
+	return jobs, queues
+}
@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Queue hands tasks to a fixed pool of workers. Each task has a key, and a
+// key that is already waiting or running is not queued again, so a job that
+// re-queues the same work on every run does not pile it up.
+type Queue struct {
+	name    string
+	workers int
+	tasks   chan task
+	stats   *QueueStats
+
+	mu     sync.Mutex
+	keys   map[string]bool
+	closed bool
+}
+
+type task struct {
+	key string
+	run Func
+}
+
+// Queue adds a queue of up to size waiting tasks, drained by workers
+// goroutines once the runner starts.
+func (r *Runner) Queue(name string, workers, size int) *Queue {
+	q := &Queue{
+		name:    name,
+		workers: workers,
+		tasks:   make(chan task, size),
+		stats:   r.metrics.queue(name, workers, size),
+		keys:    map[string]bool{},
+	}
+	r.queues = append(r.queues, q)
+	return q
+}
+
+// Enqueue queues fn under key without blocking. It returns false when key
+// is already queued or running, the queue is full or it has been stopped.
+func (q *Queue) Enqueue(key string, fn Func) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.keys[key] {
+		return false
+	}
+	select {
+	case q.tasks <- task{key: key, run: fn}:
+		q.keys[key] = true
+		q.stats.enqueued(len(q.tasks))
+		return true
+	default:
+		q.stats.dropped()
+		return false
+	}
+}
+
+func (q *Queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+}
+
+func (q *Queue) done(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.keys, key)
+	q.stats.depth(len(q.tasks))
+}
+
+func (r *Runner) runWorker(q *Queue) {
+	defer r.wg.Done()
+	for t := range q.tasks {
+		start := time.Now()
+		q.stats.started()
+		err := safely(r.work, t.run)
+		q.stats.processed(time.Since(start), err)
+		if err != nil {
+			log.Printf("Queue %s task %s failed: %v", q.name, t.key, err)
+		}
+		q.done(t.key)
+	}
+}
@@ -0,0 +1,339 @@
+// Package loadshed caps how many requests each route serves at once. A
+// request over the cap waits briefly in a bounded queue for a slot and is
+// turned away with 503 and Retry-After when none frees up, so a spike is
+// shed at the edge instead of piling up on the database's connection pool.
+package loadshed
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Limits bound one route. MaxInFlight zero leaves the route unlimited;
+// MaxQueue zero sheds as soon as the route is at MaxInFlight.
+type Limits struct {
+	MaxInFlight    int `json:"max_in_flight"`
+	MaxQueue       int `json:"max_queue"`
+	QueueTimeoutMS int `json:"queue_timeout_ms"`
+}
+
+func (l Limits) queueTimeout() time.Duration {
+	return time.Duration(l.QueueTimeoutMS) * time.Millisecond
+}
+
+// maxRetryAfter caps the Retry-After hint.
+const maxRetryAfter = 30
+
+// latencyWeight is how much each finished request moves a route's average
+// latency.
+const latencyWeight = 0.1
+
+// route is the state of one route, keyed by method and route pattern.
+type route struct {
+	inFlight int
+	waiters  []chan struct{}
+	served   int64
+	shed     int64
+	// latency is an exponentially weighted average of how long requests
+	// take to serve, in seconds.
+	latency float64
+}
+
+// Shedder tracks in-flight requests per route. Limits can be changed at
+// runtime, for every route or per route, and apply to requests arriving
+// from then on; requests already in flight always finish.
+type Shedder struct {
+	mu        sync.Mutex
+	defaults  Limits
+	overrides map[string]Limits
+	routes    map[string]*route
+}
+
+func New(defaults Limits) *Shedder {
+	return &Shedder{defaults: defaults, overrides: map[string]Limits{}, routes: map[string]*route{}}
+}
+
+// FromEnv reads the default limits from LOAD_SHED_MAX_IN_FLIGHT,
+// LOAD_SHED_MAX_QUEUE and LOAD_SHED_QUEUE_TIMEOUT, and reads them again
+// when a reload of CONFIG_FILE changes one.
+func FromEnv() *Shedder {
+	s := New(defaultsFromEnv())
+	for _, key := range []string{"LOAD_SHED_MAX_IN_FLIGHT", "LOAD_SHED_MAX_QUEUE", "LOAD_SHED_QUEUE_TIMEOUT"} {
+		config.OnChange(key, func(string) error {
+			s.SetDefaults(defaultsFromEnv())
+			return nil
+		})
+	}
+	return s
+}
+
+func defaultsFromEnv() Limits {
+	return Limits{
+		MaxInFlight:    config.GetInt("LOAD_SHED_MAX_IN_FLIGHT", 50),
+		MaxQueue:       config.GetInt("LOAD_SHED_MAX_QUEUE", 100),
+		QueueTimeoutMS: int(config.GetDuration("LOAD_SHED_QUEUE_TIMEOUT", 250*time.Millisecond).Milliseconds()),
+	}
+}
+
+func (s *Shedder) limits(key string) Limits {
+	if l, ok := s.overrides[key]; ok {
+		return l
+	}
+	return s.defaults
+}
+
+func (s *Shedder) route(key string) *route {
+	r, ok := s.routes[key]
+	if !ok {
+		r = &route{}
+		s.routes[key] = r
+	}
+	return r
+}
+
+// exempt reports whether path bypasses shedding: health checks, so a busy
+// instance is not mistaken for a dead one, and the admin API, so limits can
+// be raised while saturated.
+func exempt(path string) bool {
+	return path == "/health" || strings.HasPrefix(path, "/health/") || strings.HasPrefix(path, "/admin/")
+}
+
+// Middleware limits each matched route. Unmatched paths are not limited:
+// they 404 without doing any work.
+func (s *Shedder) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() == "" || exempt(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		key := c.Request.Method + " " + c.FullPath()
+		if retryAfter, ok := s.acquire(c, key); !ok {
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is overloaded, retry later"})
+			return
+		}
+		start := time.Now()
+		defer func() { s.release(key, time.Since(start)) }()
+		c.Next()
+	}
+}
+
+// acquire takes a slot on the route, waiting in its queue for up to the
+// queue timeout. When it fails it returns the Retry-After to send.
+func (s *Shedder) acquire(c *gin.Context, key string) (int, bool) {
+	s.mu.Lock()
+	l := s.limits(key)
+	r := s.route(key)
+	if l.MaxInFlight <= 0 || r.inFlight < l.MaxInFlight {
+		r.inFlight++
+		s.mu.Unlock()
+		return 0, true
+	}
+	if len(r.waiters) >= l.MaxQueue || l.QueueTimeoutMS <= 0 {
+		r.shed++
+		retryAfter := r.retryAfter(l)
+		s.mu.Unlock()
+		return retryAfter, false
+	}
+	slot := make(chan struct{})
+	r.waiters = append(r.waiters, slot)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout())
+	defer timer.Stop()
+	select {
+	case <-slot:
+		return 0, true
+	case <-timer.C:
+	case <-c.Request.Context().Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range r.waiters {
+		if w == slot {
+			r.waiters = append(r.waiters[:i], r.waiters[i+1:]...)
+			r.shed++
+			return r.retryAfter(l), false
+		}
+	}
+	// A release handed over the slot just as the wait ended.
+	return 0, true
+}
+
+// release frees the slot, handing it straight to the longest waiter if the
+// route is still within its limit, and records how long the request took.
+func (s *Shedder) release(key string, took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.limits(key)
+	r := s.route(key)
+	r.served++
+	if r.latency == 0 {
+		r.latency = took.Seconds()
+	} else {
+		r.latency += latencyWeight * (took.Seconds() - r.latency)
+	}
+	if len(r.waiters) > 0 && (l.MaxInFlight <= 0 || r.inFlight <= l.MaxInFlight) {
+		close(r.waiters[0])
+		r.waiters = r.waiters[1:]
+		return
+	}
+	r.inFlight--
+}
+
+// retryAfter estimates, in whole seconds, how long the route needs to work
+// through its in-flight and queued requests at its recent latency.
+func (r *route) retryAfter(l Limits) int {
+	if l.MaxInFlight <= 0 {
+		return 1
+	}
+	backlog := float64(r.inFlight + len(r.waiters))
+	seconds := int(math.Ceil(r.latency * backlog / float64(l.MaxInFlight)))
+	return min(max(seconds, 1), maxRetryAfter)
+}
+
+// wake hands free slots to waiters after a limit was raised. s.mu must be
+// held.
+func (s *Shedder) wake(key string) {
+	r, ok := s.routes[key]
+	if !ok {
+		return
+	}
+	l := s.limits(key)
+	for len(r.waiters) > 0 && (l.MaxInFlight <= 0 || r.inFlight < l.MaxInFlight) {
+		close(r.waiters[0])
+		r.waiters = r.waiters[1:]
+		r.inFlight++
+	}
+}
+
+// SetDefaults changes the limits of every route without an override.
+func (s *Shedder) SetDefaults(l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaults = l
+	for key := range s.routes {
+		s.wake(key)
+	}
+}
+
+// SetRoute overrides the limits of one route, such as "GET /orders/:id".
+func (s *Shedder) SetRoute(key string, l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides[key] = l
+	s.wake(key)
+}
+
+// ResetRoute puts the route back on the default limits.
+func (s *Shedder) ResetRoute(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.overrides, key)
+	s.wake(key)
+}
+
+// RouteState is one route in GET /admin/load-shedding.
+type RouteState struct {
+	Route      string  `json:"route"`
+	Limits     Limits  `json:"limits"`
+	Override   bool    `json:"override"`
+	InFlight   int     `json:"in_flight"`
+	Queued     int     `json:"queued"`
+	Served     int64   `json:"served"`
+	Shed       int64   `json:"shed"`
+	AvgLatency float64 `json:"avg_latency_ms"`
+}
+
+// State is served by GET /admin/load-shedding.
+type State struct {
+	Defaults Limits       `json:"defaults"`
+	Routes   []RouteState `json:"routes"`
+}
+
+// Snapshot returns the limits and counters of every route seen so far and
+// of every overridden route, sorted by route.
+func (s *Shedder) Snapshot() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := map[string]bool{}
+	for key := range s.routes {
+		keys[key] = true
+	}
+	for key := range s.overrides {
+		keys[key] = true
+	}
+	state := State{Defaults: s.defaults, Routes: []RouteState{}}
+	for key := range keys {
+		_, override := s.overrides[key]
+		rs := RouteState{Route: key, Limits: s.limits(key), Override: override}
+		if r, ok := s.routes[key]; ok {
+			rs.InFlight, rs.Queued, rs.Served, rs.Shed = r.inFlight, len(r.waiters), r.served, r.shed
+			rs.AvgLatency = math.Round(r.latency*1e6) / 1e3
+		}
+		state.Routes = append(state.Routes, rs)
+	}
+	sort.Slice(state.Routes, func(i, j int) bool { return state.Routes[i].Route < state.Routes[j].Route })
+	return state
+}
+
+// RegisterAdminRoutes mounts the limits on an admin-protected group.
+// Changes last until the next restart.
+func (s *Shedder) RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/load-shedding", s.get)
+	router.PUT("/load-shedding", s.set)
+	router.DELETE("/load-shedding", s.reset)
+}
+
+func (s *Shedder) get(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Snapshot())
+}
+
+type limitsRequest struct {
+	// Route is the method and route pattern, as listed by GET; empty
+	// changes the defaults.
+	Route          string `json:"route" binding:"max=255"`
+	MaxInFlight    *int   `json:"max_in_flight" binding:"required,min=0"`
+	MaxQueue       *int   `json:"max_queue" binding:"required,min=0"`
+	QueueTimeoutMS *int   `json:"queue_timeout_ms" binding:"required,min=0,max=60000"`
+	Actor          string `json:"actor" binding:"max=255"`
+}
+
+func (s *Shedder) set(c *gin.Context) {
+	var req limitsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	l := Limits{MaxInFlight: *req.MaxInFlight, MaxQueue: *req.MaxQueue, QueueTimeoutMS: *req.QueueTimeoutMS}
+	if req.Route == "" {
+		s.SetDefaults(l)
+		log.Printf("Load shedding defaults set to %+v by %q from %s", l, req.Actor, c.ClientIP())
+	} else {
+		s.SetRoute(req.Route, l)
+		log.Printf("Load shedding limits of %s set to %+v by %q from %s", req.Route, l, req.Actor, c.ClientIP())
+	}
+	c.JSON(http.StatusOK, s.Snapshot())
+}
+
+// reset removes the override of the ?route= route.
+func (s *Shedder) reset(c *gin.Context) {
+	key := c.Query("route")
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "route is required"})
+		return
+	}
+	s.ResetRoute(key)
+	log.Printf("Load shedding limits of %s reset to the defaults from %s", key, c.ClientIP())
+	c.JSON(http.StatusOK, s.Snapshot())
+}
@@ -0,0 +1,169 @@
+package loadshed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRouter serves GET /slow, which signals started and then blocks until
+// it receives from release, and GET /fast.
+func newRouter(s *Shedder, release chan struct{}, started chan struct{}) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(s.Middleware())
+	router.GET("/slow", func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	router.GET("/fast", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.GET("/health", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	s.RegisterAdminRoutes(router.Group("/admin"))
+	return router
+}
+
+func serve(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestShedsOverTheLimit(t *testing.T) {
+	s := New(Limits{MaxInFlight: 1, MaxQueue: 0})
+	release, started := make(chan struct{}), make(chan struct{}, 10)
+	router := newRouter(s, release, started)
+
+	done := make(chan int)
+	go func() { done <- serve(router, http.MethodGet, "/slow", "").Code }()
+	<-started
+
+	w := serve(router, http.MethodGet, "/slow", "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After while the route is saturated, got: %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve(router, http.MethodGet, "/fast", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected other routes to be unaffected, got: %d", w.Code)
+	}
+	if w := serve(router, http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected health checks to be exempt, got: %d", w.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the in-flight request to finish, got: %d", code)
+	}
+	if w := serve(router, http.MethodGet, "/fast", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the route to recover, got: %d", w.Code)
+	}
+	state := s.Snapshot()
+	if len(state.Routes) != 2 || state.Routes[1].Route != "GET /slow" || state.Routes[1].Shed != 1 || state.Routes[1].InFlight != 0 {
+		t.Errorf("Expected the shed request to be counted, got: %+v", state.Routes)
+	}
+}
+
+func TestQueuesBriefly(t *testing.T) {
+	s := New(Limits{MaxInFlight: 1, MaxQueue: 1, QueueTimeoutMS: 5000})
+	release, started := make(chan struct{}), make(chan struct{}, 10)
+	router := newRouter(s, release, started)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serve(router, http.MethodGet, "/slow", "").Code
+		}(i)
+		if i == 0 {
+			<-started
+		}
+	}
+	waitFor(t, func() bool { return s.Snapshot().Routes[0].Queued == 1 })
+
+	if w := serve(router, http.MethodGet, "/slow", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a full queue to shed, got: %d", w.Code)
+	}
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	wg.Wait()
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK {
+		t.Errorf("Expected the queued request to be served once a slot freed up, got: %v", codes)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	s := New(Limits{MaxInFlight: 1, MaxQueue: 1, QueueTimeoutMS: 10})
+	release, started := make(chan struct{}), make(chan struct{}, 10)
+	router := newRouter(s, release, started)
+	defer close(release)
+
+	go serve(router, http.MethodGet, "/slow", "")
+	<-started
+	start := time.Now()
+	if w := serve(router, http.MethodGet, "/slow", ""); w.Code != http.StatusServiceUnavailable || time.Since(start) < 10*time.Millisecond {
+		t.Errorf("Expected the request to wait out the queue timeout and be shed, got: %d after %s", w.Code, time.Since(start))
+	}
+	if q := s.Snapshot().Routes[0].Queued; q != 0 {
+		t.Errorf("Expected the timed-out request to leave the queue, got: %d", q)
+	}
+}
+
+func TestRuntimeLimits(t *testing.T) {
+	s := New(Limits{MaxInFlight: 1, MaxQueue: 1, QueueTimeoutMS: 5000})
+	release, started := make(chan struct{}), make(chan struct{}, 10)
+	router := newRouter(s, release, started)
+	defer close(release)
+
+	go serve(router, http.MethodGet, "/slow", "")
+	<-started
+	queued := make(chan int)
+	go func() { queued <- serve(router, http.MethodGet, "/slow", "").Code }()
+	waitFor(t, func() bool { return s.Snapshot().Routes[0].Queued == 1 })
+
+	if w := serve(router, http.MethodPut, "/admin/load-shedding", `{"route": "GET /slow", "max_queue": 0, "queue_timeout_ms": 0}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a request without max_in_flight to be rejected, got: %d", w.Code)
+	}
+	w := serve(router, http.MethodPut, "/admin/load-shedding",
+		`{"route": "GET /slow", "max_in_flight": 2, "max_queue": 0, "queue_timeout_ms": 0, "actor": "ops"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"override":true`) {
+		t.Fatalf("Expected the override to be applied, got: %d %s", w.Code, w.Body.String())
+	}
+	<-started
+	if s.Snapshot().Routes[0].InFlight != 2 {
+		t.Errorf("Expected raising the limit to let the queued request in, got: %+v", s.Snapshot().Routes[0])
+	}
+	if w := serve(router, http.MethodGet, "/slow", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the new limit to shed a third request, got: %d", w.Code)
+	}
+
+	if w := serve(router, http.MethodDelete, "/admin/load-shedding?route=GET%20%2Fslow", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"override":true`) {
+		t.Errorf("Expected the override to be removed, got: %d %s", w.Code, w.Body.String())
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("Expected the queued request to be served, got: %d", code)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the shedder")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,95 @@
+// Package logger sends the standard log package's output through slog with
+// a level that can be changed at runtime.
+//
+// Services log with log.Printf. Lines that mention a failure or an error are
+// logged at error level and the rest at info, so raising the level to warn
+// or error quiets routine lines without hiding failures.
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+)
+
+var level = new(slog.LevelVar)
+
+// Init installs the handler for service at LOG_LEVEL (debug, info, warn or
+// error; info by default), writing JSON when LOG_FORMAT is json and text
+// otherwise. It should be the first thing main does after config.Load.
+// LOG_LEVEL follows reloads of CONFIG_FILE.
+func Init(service string) error {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if config.GetEnv("LOG_FORMAT", "text") == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	handler = handler.WithAttrs([]slog.Attr{slog.String("service", service)})
+	slog.SetDefault(slog.New(handler))
+	// SetDefault routes the log package through the handler at info; the
+	// bridge replaces that to pick the level per line.
+	log.SetFlags(0)
+	log.SetOutput(bridge{handler: handler})
+	config.OnChange("LOG_LEVEL", SetLevel)
+	return SetLevel(config.GetEnv("LOG_LEVEL", "info"))
+}
+
+// Level returns the current level's name, such as "info".
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
+
+// SetLevel changes the level of every logger from then on.
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", name)
+}
+
+// levelOf guesses a log.Printf line's level from its wording.
+func levelOf(msg string) slog.Level {
+	lower := strings.ToLower(msg)
+	if strings.Contains(lower, "fail") || strings.Contains(lower, "error") {
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+type bridge struct {
+	handler slog.Handler
+}
+
+func (b bridge) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	l := levelOf(msg)
+	if !b.handler.Enabled(context.Background(), l) {
+		return len(p), nil
+	}
+	if err := b.handler.Handle(context.Background(), slog.NewRecord(time.Now(), l, msg, 0)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
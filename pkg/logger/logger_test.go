@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetLevel(t *testing.T) {
+	defer level.Set(slog.LevelInfo)
+	if err := SetLevel("WARN"); err != nil || Level() != "warn" {
+		t.Errorf("Expected the level to be warn, got: %s, %v", Level(), err)
+	}
+	if err := SetLevel("verbose"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+	if Level() != "warn" {
+		t.Errorf("Expected a rejected level to keep the current one, got: %s", Level())
+	}
+}
+
+func TestBridgeLevels(t *testing.T) {
+	defer level.Set(slog.LevelInfo)
+	var out bytes.Buffer
+	b := bridge{handler: slog.NewTextHandler(&out, &slog.HandlerOptions{Level: level})}
+
+	level.Set(slog.LevelWarn)
+	b.Write([]byte("Connected to db successfully\n"))
+	b.Write([]byte("Failed to publish order 7 placed: broker closed\n"))
+	got := out.String()
+	if strings.Contains(got, "Connected") {
+		t.Errorf("Expected routine lines to be hidden at warn, got: %s", got)
+	}
+	if !strings.Contains(got, "level=ERROR") || !strings.Contains(got, "Failed to publish") {
+		t.Errorf("Expected failures to log at error, got: %s", got)
+	}
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Stock is a SKU's stock in base units. Quarantined stock is on hand but
+// held back from sale, such as expired lots awaiting disposal, so it is not
+// available.
+type Stock struct {
+	SKU         string `json:"sku"`
+	Name        string `json:"name"`
+	OnHand      int    `json:"on_hand"`
+	Reserved    int    `json:"reserved"`
+	Quarantined int    `json:"quarantined"`
+	// SafetyStock is held back from Available by the SKU's safety stock
+	// policy, so it stays on the shelf for demand above the usual.
+	SafetyStock int `json:"safety_stock"`
+	Available   int `json:"available"`
+	// InUnit is only set when the stock is asked for in a unit.
+	InUnit    *UnitStock `json:"in_unit,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// UnitStock is stock in whole units of a larger unit, such as cases.
+type UnitStock struct {
+	Unit      string `json:"unit"`
+	Factor    int    `json:"factor"`
+	OnHand    int    `json:"on_hand"`
+	Reserved  int    `json:"reserved"`
+	Available int    `json:"available"`
+}
+
+// Product is a SKU as the catalog sells it. Prices are in the currency's
+// minor unit, per base unit of stock.
+type Product struct {
+	SKU         string    `json:"sku"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	PriceCents  int64     `json:"price_cents"`
+	Currency    string    `json:"currency"`
+	Images      []string  `json:"images"`
+	Categories  []string  `json:"categories"`
+	Active      bool      `json:"active"`
+	Available   int       `json:"available"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
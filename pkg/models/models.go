@@ -0,0 +1,20 @@
+// Package models defines the JSON bodies services exchange: each service
+// answers with these types and pkg/clients decodes into them, so a field
+// is named and typed in one place. Services embed a model in their own
+// type to keep fields that never leave the service, such as the version
+// sent as an ETag.
+//
+// The models are versioned with the APIs that carry them, which are
+// unversioned today, so every change must be one old clients can read:
+//
+//   - Adding a field is compatible. Make it omitempty unless every
+//     producer sets it, since older producers leave it out.
+//   - Removing, renaming or retyping a field, or changing what its values
+//     mean, is not. Add the new field next to the old one and remove the
+//     old one only once no consumer reads it, or give the route a new
+//     version through the gateway's version policies and a new type here.
+//
+// The wire format of each model is kept in testdata/<Type>.json; the
+// tests fail when it changes, so the change is reviewed. Run them with
+// UPDATE_MODELS=1 to rewrite the files.
+package models
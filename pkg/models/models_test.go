@@ -0,0 +1,133 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	at     = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	later  = at.Add(time.Hour)
+	userID = 7
+	orgID  = 3
+	digest = 11
+)
+
+// examples set every field of every model, so the golden files show the
+// whole wire format and a field the round trip drops is caught.
+var examples = map[string]any{
+	"User":       &User{ID: 7, Email: "ada@example.com", Username: "ada", Status: "active", DeactivatedAt: &at, VerifiedAt: &later},
+	"Membership": &Membership{UserID: 7, OrgID: &orgID, OrgRole: "admin"},
+	"OrderItem":  &OrderItem{SKU: "WIDGET-1", Name: "Widget", Unit: "case", Quantity: 2, UnitPriceCents: 1200},
+	"Order": &Order{ID: 42, UserID: 7, OrgID: &orgID, Status: "paid", Currency: "USD",
+		SubtotalCents: 2400, ShippingCents: 500, TaxCents: 240, TotalCents: 3140,
+		Items:       []OrderItem{{SKU: "WIDGET-1", Name: "Widget", Unit: "case", Quantity: 2, UnitPriceCents: 1200}},
+		DuplicateOf: &orgID, Tags: []string{"vip"}, InvoiceNumber: "INV-2026-000001", Archived: true,
+		CreatedAt: at, UpdatedAt: later},
+	"TrackingPage": &TrackingPage{OrderID: 42, Status: "shipped",
+		Items:     []TrackingItem{{SKU: "WIDGET-1", Name: "Widget", Unit: "each", Quantity: 2}},
+		Shipment:  Shipment{Status: "shipped", Carrier: "ups", PromisedDate: "2026-01-03", ShippedAt: &later},
+		History:   []TrackingStep{{Status: "paid", At: at}, {Status: "shipped", At: later}},
+		CreatedAt: at, UpdatedAt: later},
+	"Stock": &Stock{SKU: "WIDGET-1", Name: "Widget", OnHand: 120, Reserved: 24, Quarantined: 6, SafetyStock: 10, Available: 80,
+		InUnit:    &UnitStock{Unit: "case", Factor: 12, OnHand: 10, Reserved: 2, Available: 6},
+		UpdatedAt: at},
+	"Product": &Product{SKU: "WIDGET-1", Name: "Widget", Description: "A widget", PriceCents: 100, Currency: "USD",
+		Images: []string{"https://cdn.example.com/widget.png"}, Categories: []string{"widgets"},
+		Active: true, Available: 80, CreatedAt: at, UpdatedAt: later},
+	"Notification": &Notification{ID: 5, UserID: &userID, Recipient: "ada@example.com", Channel: "email", Type: "shipment",
+		Subject: "Delivered", Body: "Order #42", Status: "sent", CreatedAt: at, SentAt: &later, Attempts: 2,
+		Provider: "smtp", LastError: "timeout", ContextType: "order", ContextID: "42",
+		ReplyTo: "reply+abc@replies.example.com", MessageID: "<abc@replies.example.com>", From: "orders@example.com",
+		ThreadID: 9, InReplyTo: "<prev@replies.example.com>", References: []string{"<prev@replies.example.com>"},
+		DeliverAfter: &later, DigestID: &digest},
+}
+
+// TestWireFormat keeps each model's JSON in testdata, so a change to what
+// services send is a reviewed change to those files.
+func TestWireFormat(t *testing.T) {
+	for name, v := range examples {
+		t.Run(name, func(t *testing.T) {
+			assertSet(t, reflect.ValueOf(v).Elem(), name)
+			got, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				t.Fatalf("Failed to encode %s: %v", name, err)
+			}
+			got = append(got, '\n')
+			path := filepath.Join("testdata", name+".json")
+			if os.Getenv("UPDATE_MODELS") == "1" {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatalf("Failed to write %s: %v", path, err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read %s (run with UPDATE_MODELS=1 to create it): %v", path, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s's wire format changed; see the versioning rules in the package doc, "+
+					"then run with UPDATE_MODELS=1 if the change is compatible.\nwant: %s\ngot: %s", name, want, got)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, v := range examples {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				t.Fatalf("Failed to encode %s: %v", name, err)
+			}
+			back := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+			if err := json.Unmarshal(data, back); err != nil {
+				t.Fatalf("Failed to decode %s: %v", name, err)
+			}
+			if !reflect.DeepEqual(back, v) {
+				t.Errorf("Expected %s back as it was sent, got: %+v", name, back)
+			}
+		})
+	}
+}
+
+// TestDecodesOlderProducers decodes bodies without the optional fields, as
+// producers that predate them send.
+func TestDecodesOlderProducers(t *testing.T) {
+	var u User
+	if err := json.Unmarshal([]byte(`{"id": 7, "email": "ada@example.com", "username": "ada"}`), &u); err != nil {
+		t.Fatalf("Failed to decode a user: %v", err)
+	}
+	if u.Status != "" || u.VerifiedAt != nil {
+		t.Errorf("Expected the missing fields left zero, got: %+v", u)
+	}
+	var o Order
+	if err := json.Unmarshal([]byte(`{"id": 42, "user_id": 7, "status": "pending", "total_cents": 100, "unknown": true}`), &o); err != nil {
+		t.Fatalf("Failed to decode an order with an unknown field: %v", err)
+	}
+	if o.ID != 42 || o.TotalCents != 100 || o.Items != nil {
+		t.Errorf("Expected the known fields decoded, got: %+v", o)
+	}
+}
+
+// assertSet fails on fields the example leaves zero, which the golden file
+// would otherwise leave out or show empty.
+func assertSet(t *testing.T, v reflect.Value, path string) {
+	t.Helper()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		name := path + "." + v.Type().Field(i).Name
+		if f.IsZero() {
+			t.Errorf("Expected the example to set %s", name)
+			continue
+		}
+		if f.Kind() == reflect.Struct && f.Type() != reflect.TypeOf(time.Time{}) {
+			assertSet(t, f, name)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+type Notification struct {
+	ID        int    `json:"id"`
+	UserID    *int   `json:"user_id,omitempty"`
+	Recipient string `json:"recipient"`
+	Channel   string `json:"channel"`
+	// Type is what users choose to receive notifications by, such as
+	// order_updates.
+	Type      string     `json:"type"`
+	Subject   string     `json:"subject"`
+	Body      string     `json:"body"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	// Attempts counts delivery attempts, retries included.
+	Attempts int `json:"attempts"`
+	// Provider and LastError are from the latest delivery attempt.
+	Provider  string `json:"provider,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	// ContextType and ContextID name what the notification is about, such as
+	// an order, so replies to it can be routed back there.
+	ContextType string `json:"context_type,omitempty"`
+	ContextID   string `json:"context_id,omitempty"`
+	// ReplyTo and MessageID identify the notification when a reply comes
+	// back through the inbound webhook.
+	ReplyTo   string `json:"reply_to,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	// From is the tenant's sending address, settled on each delivery
+	// attempt.
+	From string `json:"from,omitempty"`
+	// ThreadID groups notifications to the same recipient about the same
+	// context; notifications without a context start a thread of their own.
+	ThreadID int64 `json:"thread_id"`
+	// InReplyTo and References thread emails in the recipient's mail client.
+	InReplyTo  string   `json:"in_reply_to,omitempty"`
+	References []string `json:"references,omitempty"`
+	// DeliverAfter is when a deferred notification is next tried, or when
+	// a batched one's digest is due.
+	DeliverAfter *time.Time `json:"deliver_after,omitempty"`
+	// DigestID is the digest a digested notification was sent in.
+	DigestID *int `json:"digest_id,omitempty"`
+}
@@ -0,0 +1,83 @@
+package models
+
+import "time"
+
+// OrderItem is an order line. Quantity and UnitPriceCents are per Unit, one
+// of the SKU's inventory units ("each" unless the customer ordered by the
+// case or pallet). Name and UnitPriceCents are the product's name and price
+// in the catalog when the order was placed, so they survive the product
+// being renamed or repriced. Clients placing an order leave them out.
+type OrderItem struct {
+	SKU            string `json:"sku"`
+	Name           string `json:"name,omitempty"`
+	Unit           string `json:"unit,omitempty"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+}
+
+// Order amounts are integers in the minor unit of Currency, cents for
+// dollars and yen for yen, whatever their names say. TotalCents is what the
+// customer pays: SubtotalCents, the lines' price, plus ShippingCents and
+// TaxCents.
+type Order struct {
+	ID            int         `json:"id"`
+	UserID        int         `json:"user_id"`
+	OrgID         *int        `json:"org_id,omitempty"`
+	Status        string      `json:"status"`
+	Currency      string      `json:"currency"`
+	SubtotalCents int64       `json:"subtotal_cents"`
+	ShippingCents int64       `json:"shipping_cents"`
+	TaxCents      int64       `json:"tax_cents"`
+	TotalCents    int64       `json:"total_cents"`
+	Items         []OrderItem `json:"items,omitempty"`
+	// DuplicateOf points at an earlier order this one likely duplicates.
+	DuplicateOf *int `json:"duplicate_of,omitempty"`
+	// Tags are free-form labels admins put on orders for triage. They are
+	// only shown to admins and services.
+	Tags []string `json:"tags,omitempty"`
+	// InvoiceNumber is issued when the order is paid, gapless within its
+	// tenant and fiscal year.
+	InvoiceNumber string `json:"invoice_number,omitempty"`
+	// Archived is set on an order read back from the archive, which can no
+	// longer change. It is only loaded with a single order.
+	Archived  bool      `json:"archived,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TrackingPage is what an order's tracking link shows. It carries nothing
+// about the customer or what they paid.
+type TrackingPage struct {
+	OrderID   int            `json:"order_id"`
+	Status    string         `json:"status"`
+	Items     []TrackingItem `json:"items"`
+	Shipment  Shipment       `json:"shipment"`
+	History   []TrackingStep `json:"history"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// TrackingItem is an order line without its price.
+type TrackingItem struct {
+	SKU      string `json:"sku"`
+	Name     string `json:"name,omitempty"`
+	Unit     string `json:"unit"`
+	Quantity int    `json:"quantity"`
+}
+
+// Shipment is pending until the warehouse has a pick list for the order,
+// picking until it ships, then shipped. Carrier and PromisedDate are empty
+// for orders placed without a delivery promise.
+type Shipment struct {
+	Status       string     `json:"status"`
+	Carrier      string     `json:"carrier,omitempty"`
+	PromisedDate string     `json:"promised_date,omitempty"`
+	ShippedAt    *time.Time `json:"shipped_at,omitempty"`
+}
+
+// TrackingStep is one status the order reached. Who moved it there and why
+// are left out.
+type TrackingStep struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+}
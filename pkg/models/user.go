@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// User is a user-service account. Only active users are listed and can
+// sign in; deleted users are anonymized but keep their ID.
+type User struct {
+	ID            int        `json:"id"`
+	Email         string     `json:"email"`
+	Username      string     `json:"username"`
+	Status        string     `json:"status,omitempty"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	// VerifiedAt is when the user proved they own Email, or nil if they
+	// have not.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// Membership is the organization a user belongs to, if any, and their
+// role in it, admin or member. Services take a user's org from here rather
+// than from what a client says.
+type Membership struct {
+	UserID  int    `json:"user_id"`
+	OrgID   *int   `json:"org_id"`
+	OrgRole string `json:"org_role"`
+}
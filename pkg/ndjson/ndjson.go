@@ -0,0 +1,88 @@
+// Package ndjson streams list endpoints as newline-delimited JSON, one row
+// per line, for clients that send Accept: application/x-ndjson. Rows are
+// written as the store scans them, so a listing of any size is served
+// without holding it in memory.
+package ndjson
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ContentType = "application/x-ndjson"
+
+// A stream is flushed to the client every FlushRows rows, or on the first
+// row written FlushInterval after the last flush, whichever comes first.
+var (
+	FlushRows     = 500
+	FlushInterval = 250 * time.Millisecond
+)
+
+// Accepted reports whether r's Accept header asks for NDJSON, as
+// application/x-ndjson or application/ndjson.
+func Accepted(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && (mediaType == ContentType || mediaType == "application/ndjson") {
+			return true
+		}
+	}
+	return false
+}
+
+// Stream writes rows to an NDJSON response.
+type Stream struct {
+	c       *gin.Context
+	enc     *json.Encoder
+	pending int
+	flushed time.Time
+	now     func() time.Time
+}
+
+// Start sends the 200 and headers. The response has no length and is
+// marked no-store, so proxies pass rows on as they come and keep none.
+func Start(c *gin.Context) *Stream {
+	c.Header("Content-Type", ContentType)
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	return &Stream{c: c, enc: json.NewEncoder(c.Writer), flushed: time.Now(), now: time.Now}
+}
+
+// Write encodes v as one line. Once the client has gone away it returns
+// the request context's error instead, so the scan feeding it stops.
+func (s *Stream) Write(v any) error {
+	if err := s.c.Request.Context().Err(); err != nil {
+		return err
+	}
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	s.pending++
+	if now := s.now(); s.pending >= FlushRows || now.Sub(s.flushed) >= FlushInterval {
+		s.c.Writer.Flush()
+		s.pending, s.flushed = 0, now
+	}
+	return nil
+}
+
+// Close ends the stream after the scan returned err. The 200 has been sent
+// by then, so a scan that failed part way ends the body with an
+// {"error": "..."} line, telling the client the listing is incomplete.
+func (s *Stream) Close(err error) {
+	if s.c.Request.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Printf("%s %s: stream aborted: %v", s.c.Request.Method, s.c.Request.URL.Path, err)
+		s.enc.Encode(gin.H{"error": err.Error()})
+	}
+	s.c.Writer.Flush()
+}
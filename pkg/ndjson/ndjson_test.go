@@ -0,0 +1,84 @@
+package ndjson
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccepted(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/x-ndjson", true},
+		{"application/json;q=0.5, application/ndjson", true},
+		{"application/x-ndjson; charset=utf-8", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := Accepted(r); got != tt.want {
+			t.Errorf("Accept %q: expected %v, got: %v", tt.accept, tt.want, got)
+		}
+	}
+}
+
+func newStream(ctx context.Context) (*Stream, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/items", nil).WithContext(ctx)
+	return Start(c), w
+}
+
+func TestStream(t *testing.T) {
+	s, w := newStream(context.Background())
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentType || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected the NDJSON headers to be sent, got: %d %v", w.Code, w.Header())
+	}
+
+	for i := 0; i < FlushRows-1; i++ {
+		if err := s.Write(map[string]int{"id": i}); err != nil {
+			t.Fatalf("Failed to write row %d: %v", i, err)
+		}
+	}
+	if w.Flushed {
+		t.Error("Expected rows to be held until FlushRows are pending")
+	}
+	now = now.Add(FlushInterval)
+	s.Write(map[string]int{"id": FlushRows})
+	if !w.Flushed {
+		t.Error("Expected the rows to be flushed after FlushInterval")
+	}
+
+	s.Close(errors.New("connection reset"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != FlushRows+1 || lines[0] != `{"id":0}` || lines[FlushRows] != `{"error":"connection reset"}` {
+		t.Errorf("Expected a row per line and the error last, got %d lines ending: %s", len(lines), lines[len(lines)-1])
+	}
+}
+
+func TestStreamStopsWhenClientLeaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, w := newStream(ctx)
+	s.Write(1)
+	cancel()
+	if err := s.Write(2); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected writes to stop once the client left, got: %v", err)
+	}
+	s.Close(context.Canceled)
+	if w.Body.String() != "1\n" {
+		t.Errorf("Expected nothing written after the client left, got: %q", w.Body.String())
+	}
+}
@@ -0,0 +1,130 @@
+package ops
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaintenanceMessage = "down for maintenance"
+
+var (
+	maintenance     MaintenanceState
+	maintenanceOnce sync.Once
+)
+
+// MaintenanceState is served by GET /admin/maintenance.
+type MaintenanceState struct {
+	Maintenance bool       `json:"maintenance"`
+	Since       *time.Time `json:"since,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	// RetryAfter is sent in the Retry-After header of refused requests,
+	// in seconds; 0 sends none.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+func Maintenance() MaintenanceState {
+	mu.Lock()
+	defer mu.Unlock()
+	return maintenance
+}
+
+// SetMaintenance turns maintenance mode on or off for this process. The
+// message and retryAfter, in seconds, replace the previous ones while it
+// stays on.
+func SetMaintenance(on bool, message string, retryAfter int) MaintenanceState {
+	mu.Lock()
+	defer mu.Unlock()
+	if !on {
+		maintenance = MaintenanceState{}
+		return maintenance
+	}
+	if maintenance.Since == nil {
+		now := time.Now().UTC()
+		maintenance.Since = &now
+	}
+	maintenance.Maintenance, maintenance.Message, maintenance.RetryAfter = true, message, retryAfter
+	return maintenance
+}
+
+// watchMaintenance starts maintenance mode when MAINTENANCE_MODE is true,
+// and follows the setting on reloads of CONFIG_FILE, so a ConfigMap change
+// takes every replica in or out at once.
+func watchMaintenance() {
+	apply := func(value string) error {
+		on, err := strconv.ParseBool(strings.TrimSpace(value))
+		if value == "" {
+			on, err = false, nil
+		}
+		if err != nil {
+			return err
+		}
+		if on != Maintenance().Maintenance {
+			SetMaintenance(on, config.GetEnv("MAINTENANCE_MESSAGE", ""), int(config.GetDuration("MAINTENANCE_RETRY_AFTER", 0).Seconds()))
+			log.Printf("Maintenance mode maintenance=%t from MAINTENANCE_MODE", on)
+		}
+		return nil
+	}
+	if err := apply(config.GetEnv("MAINTENANCE_MODE", "false")); err != nil {
+		log.Printf("Failed to read MAINTENANCE_MODE, leaving maintenance mode off: %v", err)
+	}
+	config.OnChange("MAINTENANCE_MODE", apply)
+}
+
+// refuseForMaintenance answers a request while in maintenance mode and
+// reports whether it did. /health and /health/startup-report answer 503,
+// so load balancers and deploy tooling take the service out of rotation.
+// Other /health routes, /metrics and /admin are served as usual, so the
+// service can still be inspected and maintenance turned off. Everything
+// else is refused with 503 and "maintenance": true.
+func refuseForMaintenance(c *gin.Context, m MaintenanceState) bool {
+	path := c.Request.URL.Path
+	switch {
+	case path == "/health" || path == "/health/startup-report":
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"status": "maintenance", "maintenance": true})
+		return true
+	case under(path, "/health") || under(path, "/metrics") || under(path, "/admin"):
+		return false
+	}
+	message := m.Message
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if m.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(m.RetryAfter))
+	}
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": message, "maintenance": true, "since": m.Since})
+	return true
+}
+
+func under(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func getMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, Maintenance())
+}
+
+type maintenanceRequest struct {
+	Maintenance *bool  `json:"maintenance" binding:"required"`
+	Message     string `json:"message" binding:"max=500"`
+	RetryAfter  int    `json:"retry_after" binding:"min=0"`
+	Actor       string `json:"actor" binding:"max=255"`
+}
+
+func setMaintenance(c *gin.Context) {
+	var req maintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	state := SetMaintenance(*req.Maintenance, req.Message, req.RetryAfter)
+	log.Printf("Maintenance mode maintenance=%t by %q from %s", state.Maintenance, req.Actor, c.ClientIP())
+	c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,152 @@
+// Package ops serves the operational controls every service mounts on its
+// /admin group: the log level, pprof profiles, the configuration in use,
+// drain mode, maintenance mode and the outbound circuit breakers.
+package ops
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/alux444/go-microserv-test/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	mu           sync.Mutex
+	drainingFrom *time.Time
+)
+
+// DrainState is served by GET /admin/drain.
+type DrainState struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+func Drain() DrainState {
+	mu.Lock()
+	defer mu.Unlock()
+	return DrainState{Draining: drainingFrom != nil, Since: drainingFrom}
+}
+
+// SetDraining turns drain mode on or off for this process.
+func SetDraining(on bool) DrainState {
+	mu.Lock()
+	switch {
+	case on && drainingFrom == nil:
+		now := time.Now().UTC()
+		drainingFrom = &now
+	case !on:
+		drainingFrom = nil
+	}
+	mu.Unlock()
+	return Drain()
+}
+
+// Middleware takes the service out of its load balancer while draining:
+// GET /health answers 503, so health checks fail, and every response asks
+// the client to close its connection, so keep-alive clients reconnect
+// elsewhere. Requests are still served in the meantime. In maintenance
+// mode, requests are refused instead; see refuseForMaintenance. Install it
+// before the /health and /admin routes.
+func Middleware() gin.HandlerFunc {
+	maintenanceOnce.Do(watchMaintenance)
+	return func(c *gin.Context) {
+		if m := Maintenance(); m.Maintenance && refuseForMaintenance(c, m) {
+			return
+		}
+		if !Drain().Draining {
+			c.Next()
+			return
+		}
+		c.Header("Connection", "close")
+		if c.Request.URL.Path == "/health" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RegisterAdminRoutes mounts the controls on an admin-protected group.
+func RegisterAdminRoutes(router gin.IRouter) {
+	router.GET("/log-level", getLogLevel)
+	router.PUT("/log-level", setLogLevel)
+	router.GET("/config", getConfig)
+	router.GET("/drain", getDrain)
+	router.PUT("/drain", setDrain)
+	router.GET("/maintenance", getMaintenance)
+	router.PUT("/maintenance", setMaintenance)
+	router.GET("/breakers", httpclient.BreakerHandler())
+	router.GET("/pprof/", gin.WrapF(pprof.Index))
+	router.GET("/pprof/:profile", profile)
+}
+
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level()})
+}
+
+type logLevelRequest struct {
+	Level string `json:"level" binding:"required"`
+	Actor string `json:"actor" binding:"max=255"`
+}
+
+func setLogLevel(c *gin.Context) {
+	var req logLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	previous := logger.Level()
+	if err := logger.SetLevel(req.Level); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Log level changed from %s to %s by %q from %s", previous, logger.Level(), req.Actor, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level()})
+}
+
+func getConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"settings": config.Snapshot()})
+}
+
+func getDrain(c *gin.Context) {
+	c.JSON(http.StatusOK, Drain())
+}
+
+type drainRequest struct {
+	Draining *bool  `json:"draining" binding:"required"`
+	Actor    string `json:"actor" binding:"max=255"`
+}
+
+func setDrain(c *gin.Context) {
+	var req drainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	state := SetDraining(*req.Draining)
+	log.Printf("Drain mode draining=%t by %q from %s", state.Draining, req.Actor, c.ClientIP())
+	c.JSON(http.StatusOK, state)
+}
+
+// profile serves one pprof profile, such as heap, goroutine or, for CPU,
+// profile?seconds=30.
+func profile(c *gin.Context) {
+	switch name := c.Param("profile"); name {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,169 @@
+// Package recovery turns a panic in a handler into a 500 with the usual
+// error body instead of a dropped connection, logs it with its stack and the
+// request it happened in, and hands it to a Reporter, such as Sentry, so
+// production panics are seen rather than lost in the logs.
+package recovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Reporter captures panics somewhere they can be followed up, such as an
+// error tracker. Report is called after the 500 is written and must not
+// block the request for long; the context is the request's.
+type Reporter interface {
+	Report(ctx context.Context, p Panic)
+}
+
+// Panic is a recovered panic and the request it happened in.
+type Panic struct {
+	Service string
+	Value   any
+	// Stack is the goroutine's stack as debug.Stack prints it, and Frames
+	// the same frames, innermost first.
+	Stack  string
+	Frames []Frame
+	Method string
+	// Route is the matched route, such as "/orders/:id", and Path the path
+	// requested.
+	Route     string
+	Path      string
+	RequestID string
+	TraceID   string
+	Tenant    string
+	UserID    int
+	At        time.Time
+}
+
+// Frame is one function call on a panic's stack.
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// Message describes the panic's value, as the log line does.
+func (p Panic) Message() string {
+	if err, ok := p.Value.(error); ok {
+		return err.Error()
+	}
+	return fmt.Sprint(p.Value)
+}
+
+// Type is the Go type of the panic's value, such as "runtime.boundsError".
+func (p Panic) Type() string {
+	return fmt.Sprintf("%T", p.Value)
+}
+
+// Middleware recovers panics in the handlers after it, answers 500 unless a
+// response was already started, and reports the panic through reporter,
+// which may be nil. It should be installed first, so panics in other
+// middleware are caught too; the request context it reports is the one the
+// chain had built by the time of the panic.
+//
+// http.ErrAbortHandler is re-panicked, so net/http aborts the response as
+// its sender intended, and a client that went away is only logged, as there
+// is no one left to answer.
+func Middleware(service string, reporter Reporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			p := capture(c, service, v)
+			if brokenPipe(v) {
+				log.Printf("Client went away during %s %s (request %s): %s", p.Method, p.Path, p.RequestID, p.Message())
+				c.Abort()
+				return
+			}
+
+			log.Printf("Failed %s %s (request %s, trace %s, tenant %q, user %d): panic: %s\n%s",
+				p.Method, p.Path, p.RequestID, p.TraceID, p.Tenant, p.UserID, p.Message(), p.Stack)
+			if c.Writer.Written() {
+				c.Abort()
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			}
+			if reporter != nil {
+				reporter.Report(c.Request.Context(), p)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// capture runs in the deferred function, while the panicking frames are
+// still on the stack.
+func capture(c *gin.Context, service string, v any) Panic {
+	ctx := c.Request.Context()
+	p := Panic{
+		Service:   service,
+		Value:     v,
+		Stack:     string(debug.Stack()),
+		Frames:    frames(),
+		Method:    c.Request.Method,
+		Route:     c.FullPath(),
+		Path:      c.Request.URL.Path,
+		RequestID: requestid.FromContext(ctx),
+		Tenant:    tenant.FromContext(ctx),
+		At:        time.Now(),
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		p.TraceID = sc.TraceID().String()
+	}
+	if principal, ok := auth.FromContext(c); ok {
+		p.UserID = principal.UserID
+	}
+	return p
+}
+
+// frames returns the stack from the panic inwards: the frames below
+// runtime.gopanic, less the runtime's own helpers, such as
+// runtime.panicIndex, that raised it.
+func frames() []Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(1, pcs)
+	it := runtime.CallersFrames(pcs[:n])
+	var out []Frame
+	for {
+		f, more := it.Next()
+		switch {
+		case f.Function == "runtime.gopanic":
+			out = out[:0]
+		case len(out) > 0 || !strings.HasPrefix(f.Function, "runtime."):
+			out = append(out, Frame{Function: f.Function, File: f.File, Line: f.Line})
+		}
+		if !more {
+			return out
+		}
+	}
+}
+
+// brokenPipe reports whether the panic came from writing to a client that
+// closed the connection.
+func brokenPipe(v any) bool {
+	err, ok := v.(error)
+	if !ok {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection reset by peer")
+}
@@ -0,0 +1,184 @@
+package recovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+type recordingReporter struct {
+	reported []Panic
+}
+
+func (r *recordingReporter) Report(ctx context.Context, p Panic) {
+	r.reported = append(r.reported, p)
+}
+
+func crash(c *gin.Context) {
+	var items []string
+	c.String(http.StatusOK, items[c.GetInt("index")+1])
+}
+
+func newRouter(reporter Reporter) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware("order-service", reporter))
+	router.Use(requestid.Middleware())
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 7})
+		c.Request = c.Request.WithContext(tenant.NewContext(c.Request.Context(), "acme"))
+	})
+	router.GET("/orders/:id", crash)
+	router.GET("/streamed", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		panic("after writing")
+	})
+	router.GET("/aborted", func(c *gin.Context) { panic(http.ErrAbortHandler) })
+	return router
+}
+
+func TestMiddlewareReportsPanics(t *testing.T) {
+	reporter := &recordingReporter{}
+	router := newRouter(reporter)
+
+	req := httptest.NewRequest(http.MethodGet, "/orders/42", nil)
+	req.Header.Set(requestid.Header, "req-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError || w.Body.String() != `{"error":"internal server error"}` {
+		t.Errorf("Expected a 500 with the error body, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(reporter.reported) != 1 {
+		t.Fatalf("Expected one report, got: %d", len(reporter.reported))
+	}
+	p := reporter.reported[0]
+	if p.Service != "order-service" || p.Method != http.MethodGet || p.Route != "/orders/:id" || p.Path != "/orders/42" ||
+		p.RequestID != "req-1" || p.Tenant != "acme" || p.UserID != 7 {
+		t.Errorf("Expected the request's details, got: %+v", p)
+	}
+	if p.Type() != "runtime.boundsError" || !strings.Contains(p.Message(), "index out of range") {
+		t.Errorf("Expected the bounds error, got: %s %s", p.Type(), p.Message())
+	}
+	if len(p.Frames) == 0 || !strings.HasSuffix(p.Frames[0].Function, "recovery.crash") || !strings.Contains(p.Stack, "recovery.crash") {
+		t.Errorf("Expected the stack to start at the panicking handler, got: %+v", p.Frames)
+	}
+}
+
+func TestMiddlewareKeepsStartedResponse(t *testing.T) {
+	reporter := &recordingReporter{}
+	w := httptest.NewRecorder()
+	newRouter(reporter).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/streamed", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Errorf("Expected the started response to be left alone, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(reporter.reported) != 1 || reporter.reported[0].Message() != "after writing" {
+		t.Errorf("Expected the panic to be reported, got: %+v", reporter.reported)
+	}
+}
+
+func TestMiddlewareRepanicsAbort(t *testing.T) {
+	reporter := &recordingReporter{}
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("Expected http.ErrAbortHandler to reach net/http, got: %v", v)
+		}
+		if len(reporter.reported) != 0 {
+			t.Errorf("Expected an abort not to be reported, got: %d", len(reporter.reported))
+		}
+	}()
+	newRouter(reporter).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/aborted", nil))
+}
+
+func TestNewSentry(t *testing.T) {
+	tests := []struct {
+		dsn, endpoint string
+	}{
+		{"https://abc@o1.ingest.sentry.io/42", "https://o1.ingest.sentry.io/api/42/store/"},
+		{"http://abc@sentry.internal:9000/tracker/7", "http://sentry.internal:9000/tracker/api/7/store/"},
+		{"https://o1.ingest.sentry.io/42", ""},
+		{"https://abc@o1.ingest.sentry.io", ""},
+		{"abc@sentry", ""},
+	}
+	for _, tt := range tests {
+		s, err := NewSentry(tt.dsn, "", "")
+		if tt.endpoint == "" {
+			if err == nil {
+				t.Errorf("Expected %q to be refused", tt.dsn)
+			}
+			continue
+		}
+		if err != nil || s.endpoint != tt.endpoint || s.key != "abc" {
+			t.Errorf("NewSentry(%q) = %+v, %v; want endpoint %s", tt.dsn, s, err, tt.endpoint)
+		}
+	}
+}
+
+func TestSentryReport(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		header string
+		event  sentryEvent
+		called = make(chan struct{})
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		header = r.Header.Get("X-Sentry-Auth")
+		if r.URL.Path != "/api/42/store/" {
+			t.Errorf("Expected the project's store endpoint, got: %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Failed to decode event: %v", err)
+		}
+		close(called)
+	}))
+	defer server.Close()
+
+	s, err := NewSentry(strings.Replace(server.URL, "://", "://abc@", 1)+"/42", "staging", "v1.2.0")
+	if err != nil {
+		t.Fatalf("Failed to build reporter: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Report(ctx, Panic{
+		Service: "order-service", Value: errors.New("nil map"), Method: http.MethodGet, Route: "/orders/:id", Path: "/orders/42",
+		RequestID: "req-1", Tenant: "acme", UserID: 7,
+		Frames: []Frame{
+			{Function: "github.com/alux444/go-microserv-test/services/order-service/internal/orders.(*Handler).get", File: "handler.go", Line: 12},
+			{Function: "github.com/gin-gonic/gin.(*Context).Next", File: "context.go", Line: 174},
+		},
+	})
+	cancel()
+	<-called
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(header, "sentry_key=abc") {
+		t.Errorf("Expected the DSN's key, got: %s", header)
+	}
+	if event.Environment != "staging" || event.Release != "v1.2.0" || event.Transaction != "GET /orders/:id" ||
+		event.Tags["request_id"] != "req-1" || event.Tags["tenant"] != "acme" || event.User == nil || event.User.ID != "7" {
+		t.Errorf("Expected the request's details, got: %+v", event)
+	}
+	ex := event.Exception.Values[0]
+	if ex.Type != "*errors.errorString" || ex.Value != "nil map" || len(ex.Stacktrace.Frames) != 2 {
+		t.Fatalf("Expected the error and its two frames, got: %+v", ex)
+	}
+	if f := ex.Stacktrace.Frames[1]; f.Function != "(*Handler).get" || !f.InApp || f.Module != "github.com/alux444/go-microserv-test/services/order-service/internal/orders" {
+		t.Errorf("Expected the handler last and in-app, got: %+v", f)
+	}
+	if f := ex.Stacktrace.Frames[0]; f.InApp {
+		t.Errorf("Expected gin's frame not to be in-app, got: %+v", f)
+	}
+}
@@ -0,0 +1,213 @@
+package recovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+)
+
+// maxPendingReports caps the reports being sent at once. Beyond it panics
+// are only logged, so a panicking hot path cannot pile up goroutines.
+const maxPendingReports = 16
+
+// Sentry reports panics to a Sentry project, or anything that accepts
+// Sentry's store API, in the background.
+type Sentry struct {
+	endpoint    string
+	key         string
+	environment string
+	release     string
+	client      *http.Client
+	pending     chan struct{}
+}
+
+// NewSentry reports to the project of dsn, such as
+// "https://key@o1.ingest.sentry.io/42", tagging events with environment and
+// release when they are set.
+func NewSentry(dsn, environment, release string) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.Scheme == "" || u.Host == "" || u.User == nil || u.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("want https://<key>@<host>/<project>, got %q", dsn)
+	}
+	prefix := ""
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	return &Sentry{
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		key:         u.User.Username(),
+		environment: environment,
+		release:     release,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		pending:     make(chan struct{}, maxPendingReports),
+	}, nil
+}
+
+// FromEnv reports to SENTRY_DSN, tagged with SENTRY_ENVIRONMENT and
+// SENTRY_RELEASE. It returns nil, so panics are only logged, when
+// SENTRY_DSN is not set.
+func FromEnv() (Reporter, error) {
+	dsn := config.GetEnv("SENTRY_DSN", "")
+	if dsn == "" {
+		return nil, nil
+	}
+	s, err := NewSentry(dsn, config.GetEnv("SENTRY_ENVIRONMENT", ""), config.GetEnv("SENTRY_RELEASE", ""))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Report sends p without waiting for Sentry to answer. The request's
+// cancellation does not stop the send.
+func (s *Sentry) Report(ctx context.Context, p Panic) {
+	select {
+	case s.pending <- struct{}{}:
+	default:
+		log.Printf("Failed to report panic in request %s: too many reports in flight", p.RequestID)
+		return
+	}
+	body, err := json.Marshal(s.event(p))
+	if err != nil {
+		<-s.pending
+		log.Printf("Failed to encode panic report for request %s: %v", p.RequestID, err)
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() { <-s.pending }()
+		if err := s.send(ctx, body); err != nil {
+			log.Printf("Failed to report panic in request %s: %v", p.RequestID, err)
+		}
+	}()
+}
+
+func (s *Sentry) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=go-microserv-test/1.0, sentry_key=%s", s.key))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Transaction string            `json:"transaction,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	User        *sentryUser       `json:"user,omitempty"`
+	Request     sentryRequest     `json:"request"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+}
+
+type sentryUser struct {
+	ID string `json:"id"`
+}
+
+type sentryRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// modulePath marks the repo's own frames as in-app, so Sentry groups panics
+// by where they happened in this code rather than in gin.
+const modulePath = "github.com/alux444/go-microserv-test/"
+
+func (s *Sentry) event(p Panic) sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	host, _ := os.Hostname()
+	e := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   p.At.UTC(),
+		Level:       "fatal",
+		Platform:    "go",
+		Logger:      p.Service,
+		ServerName:  host,
+		Environment: s.environment,
+		Release:     s.release,
+		Transaction: strings.TrimSpace(p.Method + " " + p.Route),
+		Tags:        map[string]string{"service": p.Service},
+		Request:     sentryRequest{Method: p.Method, URL: p.Path},
+	}
+	for k, v := range map[string]string{"request_id": p.RequestID, "trace_id": p.TraceID, "tenant": p.Tenant} {
+		if v != "" {
+			e.Tags[k] = v
+		}
+	}
+	if p.UserID != 0 {
+		e.User = &sentryUser{ID: fmt.Sprint(p.UserID)}
+	}
+
+	ex := sentryException{Type: p.Type(), Value: p.Message()}
+	// Sentry lists frames outermost first.
+	for i := len(p.Frames) - 1; i >= 0; i-- {
+		f := p.Frames[i]
+		module, function := splitFunction(f.Function)
+		ex.Stacktrace.Frames = append(ex.Stacktrace.Frames, sentryFrame{
+			Function: function, Module: module, AbsPath: f.File, Lineno: f.Line, InApp: strings.HasPrefix(f.Function, modulePath),
+		})
+	}
+	e.Exception.Values = []sentryException{ex}
+	return e
+}
+
+// splitFunction splits "github.com/x/y/pkg.(*T).Method" into its package and
+// "(*T).Method".
+func splitFunction(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		i := slash + 1 + dot
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
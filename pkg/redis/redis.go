@@ -0,0 +1,163 @@
+// Package redis is a minimal Redis client. It speaks just enough of the
+// Redis protocol to send commands and read their replies, over a connection
+// per call: its callers make a handful of small calls per request, so there
+// is little to gain from pooling.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/degrade"
+)
+
+// Client runs commands against one Redis server.
+//
+// While Redis is unreachable, calls fail fast with degrade.ErrUnavailable
+// except for one attempt every retry interval, so callers fall back without
+// each waiting out the timeout.
+type Client struct {
+	addr     string
+	password string
+	timeout  time.Duration
+	dep      *degrade.Dependency
+}
+
+func NewClient(addr, password string) *Client {
+	return &Client{addr: addr, password: password, timeout: 3 * time.Second, dep: degrade.Register("redis", 30*time.Second)}
+}
+
+// FromEnv returns a client for REDIS_HOST and REDIS_PORT, or nil when
+// REDIS_HOST is not set.
+func FromEnv() *Client {
+	host := config.GetEnv("REDIS_HOST", "")
+	if host == "" {
+		return nil
+	}
+	return NewClient(net.JoinHostPort(host, config.GetEnv("REDIS_PORT", "6379")), config.GetEnv("REDIS_PASSWORD", ""))
+}
+
+// Do runs one command. Transport failures degrade the client; an error
+// reply means Redis is up. Replies are as ReadReply returns them.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	if !c.dep.Available() {
+		return nil, fmt.Errorf("redis %s: %w", c.addr, degrade.ErrUnavailable)
+	}
+	reply, err := c.command(ctx, args...)
+	var replyErr Error
+	if errors.As(err, &replyErr) {
+		c.dep.Recover()
+	} else {
+		c.dep.Track(err)
+	}
+	return reply, err
+}
+
+func (c *Client) command(ctx context.Context, args ...string) (any, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	r := bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := roundTrip(conn, r, "AUTH", c.password); err != nil {
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	return roundTrip(conn, r, args...)
+}
+
+// Error is an error reply from Redis.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+func roundTrip(w io.Writer, r *bufio.Reader, args ...string) (any, error) {
+	if err := WriteCommand(w, args); err != nil {
+		return nil, err
+	}
+	return ReadReply(r)
+}
+
+// WriteCommand sends args as an array of bulk strings, the form Redis
+// expects commands in.
+func WriteCommand(w io.Writer, args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ReadReply reads one reply: a string for simple and bulk strings, an int64
+// for integers, nil for a null bulk string and []any for arrays. An error
+// reply is returned as an Error. Commands are arrays too, so fake servers in
+// tests read them with it.
+func ReadReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, Error(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
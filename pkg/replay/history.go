@@ -0,0 +1,205 @@
+package replay
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/lib/pq"
+)
+
+// batchSize is how many records each query reads, so a slow, rate-limited
+// replay never holds a query open.
+const batchSize = 500
+
+// OrderHistory rebuilds order and payment events from order-service's and
+// payment-service's tables, archived orders included. Events come type by
+// type, each oldest first. They say what the records say now, which may
+// differ in detail from what was published at the time:
+//
+//   - order.placed carries the status the order's history starts with.
+//   - order.cancelled carries the amount refunded since.
+//   - payment.succeeded occurred when the payment was created if it has
+//     since been refunded, since the refund overwrote when it succeeded.
+type OrderHistory struct {
+	db *sql.DB
+}
+
+func NewOrderHistory(db *sql.DB) *OrderHistory {
+	return &OrderHistory{db: db}
+}
+
+// rebuild is one event type's query. It selects the event's time as
+// event_at, a unique record_key and the tenant, then the payload's columns,
+// which scan reads.
+type rebuild struct {
+	eventType string
+	source    string
+	query     string
+	scan      func(rows *sql.Rows) (at time.Time, key int64, tenant string, payload any, err error)
+}
+
+var rebuilds = []rebuild{
+	{
+		eventType: events.OrderPlaced,
+		source:    "order-service",
+		query: `SELECT o.created_at AS event_at, o.id AS record_key, o.tenant_id, o.user_id,
+				COALESCE((SELECT h.to_status FROM order_service.all_order_status_history h WHERE h.order_id = o.id
+					ORDER BY h.created_at, h.id LIMIT 1), o.status),
+				o.currency, o.total_cents,
+				(SELECT COUNT(*) FROM order_service.all_order_items i WHERE i.order_id = o.id)
+			FROM order_service.all_orders o`,
+		scan: func(rows *sql.Rows) (time.Time, int64, string, any, error) {
+			var at time.Time
+			var p events.OrderPlacement
+			err := rows.Scan(&at, &p.OrderID, &p.Tenant, &p.UserID, &p.Status, &p.Currency, &p.TotalCents, &p.ItemCount)
+			return at, int64(p.OrderID), p.Tenant, p, err
+		},
+	},
+	{
+		eventType: events.OrderCancelled,
+		source:    "order-service",
+		query: `SELECT c.cancelled_at AS event_at, c.order_id AS record_key, c.tenant_id, o.user_id, c.reason, COALESCE(c.note, ''),
+				c.customer_tier, o.total_cents,
+				COALESCE((SELECT SUM(p.amount_cents) FROM payment_service.payments p
+					WHERE p.order_id = c.order_id AND p.tenant_id = c.tenant_id AND p.status = 'refunded'), 0),
+				ARRAY(SELECT i.sku FROM order_service.all_order_items i WHERE i.order_id = c.order_id
+					GROUP BY i.sku ORDER BY MIN(i.id))
+			FROM order_service.order_cancellations c JOIN order_service.all_orders o ON o.id = c.order_id`,
+		scan: func(rows *sql.Rows) (time.Time, int64, string, any, error) {
+			var at time.Time
+			var c events.OrderCancellation
+			err := rows.Scan(&at, &c.OrderID, &c.Tenant, &c.UserID, &c.Reason, &c.Note, &c.CustomerTier, &c.TotalCents,
+				&c.RefundedCents, pq.Array(&c.SKUs))
+			return at, int64(c.OrderID), c.Tenant, c, err
+		},
+	},
+	{
+		eventType: events.OrderShipmentDelivered,
+		source:    "order-service",
+		query: `SELECT s.delivered_at AS event_at, s.id AS record_key, s.tenant_id, s.order_id, o.user_id, s.carrier, s.tracking_number,
+				COALESCE((SELECT json_agg(json_build_object('sku', i.sku, 'name', i.name, 'unit', i.unit, 'quantity', l.quantity) ORDER BY i.id)
+					FROM order_service.shipment_lines l JOIN order_service.order_items i ON i.id = l.item_id
+					WHERE l.shipment_id = s.id), '[]')
+			FROM order_service.shipments s JOIN order_service.orders o ON o.id = s.order_id
+			WHERE s.status = 'delivered' AND s.delivered_at IS NOT NULL`,
+		scan: func(rows *sql.Rows) (time.Time, int64, string, any, error) {
+			var items []byte
+			var d events.ShipmentDelivered
+			err := rows.Scan(&d.DeliveredAt, &d.ShipmentID, &d.Tenant, &d.OrderID, &d.UserID, &d.Carrier, &d.TrackingNumber, &items)
+			if err == nil {
+				err = json.Unmarshal(items, &d.Items)
+			}
+			return d.DeliveredAt, d.ShipmentID, d.Tenant, d, err
+		},
+	},
+	paymentRebuild(events.PaymentSucceeded, "CASE WHEN status = 'refunded' THEN created_at ELSE updated_at END",
+		"status IN ('succeeded', 'refunded')", "''"),
+	paymentRebuild(events.PaymentFailed, "updated_at", "status = 'failed'", "COALESCE(failure_reason, '')"),
+	paymentRebuild(events.PaymentRefunded, "refunded_at", "status = 'refunded' AND refunded_at IS NOT NULL", "COALESCE(refund_reason, '')"),
+}
+
+func paymentRebuild(eventType, at, where, reason string) rebuild {
+	return rebuild{
+		eventType: eventType,
+		source:    "payment-service",
+		query: fmt.Sprintf(`SELECT %s AS event_at, id AS record_key, tenant_id, order_id, user_id, amount_cents, currency, provider, %s
+			FROM payment_service.payments WHERE %s`, at, reason, where),
+		scan: func(rows *sql.Rows) (time.Time, int64, string, any, error) {
+			var at time.Time
+			var p events.PaymentResult
+			err := rows.Scan(&at, &p.PaymentID, &p.Tenant, &p.OrderID, &p.UserID, &p.AmountCents, &p.Currency, &p.Provider, &p.Reason)
+			return at, int64(p.PaymentID), p.Tenant, p, err
+		},
+	}
+}
+
+func (h *OrderHistory) Types() []string {
+	types := make([]string, len(rebuilds))
+	for i, r := range rebuilds {
+		types[i] = r.eventType
+	}
+	return types
+}
+
+func (h *OrderHistory) Events(ctx context.Context, filter Filter, yield func(events.Event) error) error {
+	for _, r := range rebuilds {
+		if !filter.wants(r.eventType) {
+			continue
+		}
+		if err := h.replay(ctx, r, filter, yield); err != nil {
+			return fmt.Errorf("%s: %w", r.eventType, err)
+		}
+	}
+	return nil
+}
+
+// replay pages through r's records by (event_at, record_key).
+func (h *OrderHistory) replay(ctx context.Context, r rebuild, filter Filter, yield func(events.Event) error) error {
+	// r.query is one of rebuilds, never input.
+	query := `SELECT * FROM (` + r.query + `) r
+		WHERE ($1 = '' OR r.tenant_id = $1) AND ($2::timestamptz IS NULL OR r.event_at >= $2)
+			AND ($3::timestamptz IS NULL OR r.event_at < $3) AND (r.event_at, r.record_key) > ($4, $5)
+		ORDER BY r.event_at, r.record_key LIMIT $6`
+	afterAt, afterKey := time.Time{}, int64(0)
+	for {
+		batch, err := h.batch(ctx, r, query, filter, afterAt, afterKey)
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			if err := yield(e.event); err != nil {
+				return err
+			}
+			afterAt, afterKey = e.at, e.key
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+	}
+}
+
+type rebuilt struct {
+	event events.Event
+	at    time.Time
+	key   int64
+}
+
+func (h *OrderHistory) batch(ctx context.Context, r rebuild, query string, filter Filter, afterAt time.Time, afterKey int64) ([]rebuilt, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, query, filter.Tenant, nullTime(filter.Since), nullTime(filter.Until), afterAt, afterKey, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []rebuilt
+	for rows.Next() {
+		at, key, tenant, payload, err := r.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		e, err := events.New(r.eventType, r.source, payload)
+		if err != nil {
+			return nil, err
+		}
+		e.ID = eventID(r.eventType, tenant, strconv.FormatInt(key, 10))
+		e.OccurredAt = at.UTC()
+		batch = append(batch, rebuilt{event: e, at: at, key: key})
+	}
+	return batch, rows.Err()
+}
+
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
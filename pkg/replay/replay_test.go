@@ -0,0 +1,122 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+)
+
+type fakeSource []events.Event
+
+func (s fakeSource) Types() []string {
+	return []string{events.OrderPlaced, events.PaymentSucceeded}
+}
+
+func (s fakeSource) Events(ctx context.Context, filter Filter, yield func(events.Event) error) error {
+	for _, e := range s {
+		if !filter.wants(e.Type) {
+			continue
+		}
+		if err := yield(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sent struct {
+	queue string
+	event events.Event
+}
+
+type fakeSender []sent
+
+func (s *fakeSender) SendTo(ctx context.Context, queue string, e events.Event) error {
+	*s = append(*s, sent{queue: queue, event: e})
+	return nil
+}
+
+func history(t *testing.T) fakeSource {
+	t.Helper()
+	placed, err := events.New(events.OrderPlaced, "order-service", events.OrderPlacement{OrderID: 1, Tenant: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid, err := events.New(events.PaymentSucceeded, "payment-service", events.PaymentResult{PaymentID: 1, OrderID: 1, Tenant: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fakeSource{placed, paid}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	var sender fakeSender
+	res, err := Run(ctx, history(t), &sender, schema.Default, Options{Queue: "q"})
+	if err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if res.Total != 2 || res.ByType[events.OrderPlaced] != 1 || res.ByType[events.PaymentSucceeded] != 1 {
+		t.Errorf("Expected one event of each type, got: %+v", res)
+	}
+	if len(sender) != 2 {
+		t.Fatalf("Expected 2 events sent, got %d", len(sender))
+	}
+	for _, s := range sender {
+		latest, _, _ := schema.Default.Latest(s.event.Type)
+		if s.queue != "q" || !s.event.Replayed || s.event.Version != latest {
+			t.Errorf("Expected a replayed v%d event sent to q, got: %s %+v", latest, s.queue, s.event)
+		}
+	}
+}
+
+func TestRunFilterAndDryRun(t *testing.T) {
+	ctx := context.Background()
+	var sender fakeSender
+	opts := Options{Filter: Filter{Types: []string{events.PaymentSucceeded}}, DryRun: true}
+	res, err := Run(ctx, history(t), &sender, schema.Default, opts)
+	if err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if res.Total != 1 || res.ByType[events.PaymentSucceeded] != 1 || len(sender) != 0 {
+		t.Errorf("Expected one payment counted and nothing sent, got: %+v, %d sent", res, len(sender))
+	}
+	if _, err := Run(ctx, history(t), &sender, schema.Default, Options{}); err == nil {
+		t.Error("Expected an error without a queue")
+	}
+}
+
+func TestRunStopsAtInvalidEvent(t *testing.T) {
+	ctx := context.Background()
+	source := history(t)
+	bad, _ := events.New(events.OrderPlaced, "order-service", map[string]string{"order_id": "1"})
+	source = append(fakeSource{source[0], bad}, source[1:]...)
+
+	var sender fakeSender
+	res, err := Run(ctx, source, &sender, schema.Default, Options{Queue: "q"})
+	if !errors.Is(err, schema.ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got: %v", err)
+	}
+	if res.Total != 1 || len(sender) != 1 {
+		t.Errorf("Expected only the event before the invalid one sent, got: %+v", res)
+	}
+}
+
+func TestEventID(t *testing.T) {
+	id := eventID(events.OrderPlaced, "t", "1")
+	if id != eventID(events.OrderPlaced, "t", "1") {
+		t.Error("Expected the same record to give the same ID")
+	}
+	for _, other := range []string{
+		eventID(events.OrderCancelled, "t", "1"),
+		eventID(events.OrderPlaced, "u", "1"),
+		eventID(events.OrderPlaced, "t", "2"),
+	} {
+		if other == id {
+			t.Errorf("Expected different records to give different IDs, got %s twice", id)
+		}
+	}
+}
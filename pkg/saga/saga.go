@@ -0,0 +1,90 @@
+// Package saga runs an operation that spans services as a sequence of
+// steps, each of which may name a compensation that undoes it. When a step
+// fails, the steps already done are compensated, newest first, so the
+// operation either completes or leaves nothing half done.
+//
+// A step with no compensation cannot be undone, such as a refund once the
+// provider has taken it. Put it last: any step after it that fails leaves
+// it, and the steps before it, done.
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Step is one part of a saga. Compensate, when not nil, undoes Do.
+type Step struct {
+	Name       string
+	Do         func(ctx context.Context) error
+	Compensate func(ctx context.Context) error
+}
+
+// Error is how a saga failed: the step that failed and what became of the
+// steps done before it. It unwraps to the step's error.
+type Error struct {
+	Saga string
+	Step string
+	Err  error
+	// Compensated are the steps undone. Stuck are those left done, because
+	// their compensation failed or a step after them cannot be undone.
+	Compensated []string
+	Stuck       []string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s failed: %v", e.Saga, e.Step, e.Err)
+	if len(e.Stuck) > 0 {
+		msg += fmt.Sprintf(" (left done: %v)", e.Stuck)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Run does the steps in order and returns an *Error if one fails.
+// Compensations run even if ctx is cancelled, since a caller going away
+// must not leave the saga half done.
+func Run(ctx context.Context, name string, steps ...Step) error {
+	for i, step := range steps {
+		err := step.Do(ctx)
+		if err == nil {
+			continue
+		}
+		serr := &Error{Saga: name, Step: step.Name, Err: err}
+		compensate(context.WithoutCancel(ctx), serr, steps[:i])
+		return serr
+	}
+	return nil
+}
+
+// compensate undoes done newest first, stopping at a step that cannot be
+// undone.
+func compensate(ctx context.Context, serr *Error, done []Step) {
+	for i := len(done) - 1; i >= 0; i-- {
+		step := done[i]
+		if step.Compensate == nil {
+			for j := i; j >= 0; j-- {
+				serr.Stuck = append(serr.Stuck, done[j].Name)
+			}
+			log.Printf("Saga %s cannot undo %s, leaving %v done after %s failed", serr.Saga, step.Name, serr.Stuck, serr.Step)
+			return
+		}
+		if err := step.Compensate(ctx); err != nil {
+			log.Printf("Saga %s failed to undo %s after %s failed: %v", serr.Saga, step.Name, serr.Step, err)
+			serr.Stuck = append(serr.Stuck, step.Name)
+			continue
+		}
+		serr.Compensated = append(serr.Compensated, step.Name)
+	}
+}
+
+// Failed reports whether err is a saga failure at the named step.
+func Failed(err error, step string) bool {
+	var serr *Error
+	return errors.As(err, &serr) && serr.Step == step
+}
@@ -0,0 +1,45 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	var log []string
+	step := func(name string, fail, undoable bool) Step {
+		s := Step{Name: name, Do: func(ctx context.Context) error {
+			log = append(log, "do "+name)
+			if fail {
+				return errors.New(name + " broke")
+			}
+			return nil
+		}}
+		if undoable {
+			s.Compensate = func(ctx context.Context) error {
+				log = append(log, "undo "+name)
+				return nil
+			}
+		}
+		return s
+	}
+
+	if err := Run(context.Background(), "ok", step("a", false, true), step("b", false, false)); err != nil {
+		t.Fatalf("Expected the saga to complete, got: %v", err)
+	}
+
+	log = nil
+	err := Run(context.Background(), "undone", step("a", false, true), step("b", false, true), step("c", true, true))
+	if !Failed(err, "c") || strings.Join(log, ",") != "do a,do b,do c,undo b,undo a" {
+		t.Errorf("Expected b then a undone after c failed, got: %v, %v", err, log)
+	}
+
+	log = nil
+	err = Run(context.Background(), "pivot", step("a", false, true), step("refund", false, false), step("c", true, true))
+	var serr *Error
+	if !errors.As(err, &serr) || len(serr.Compensated) != 0 || strings.Join(serr.Stuck, ",") != "refund,a" {
+		t.Errorf("Expected nothing undone past the refund, got: %+v", serr)
+	}
+}
@@ -0,0 +1,125 @@
+package saturation
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metric is one Prometheus metric family with a sample per label set.
+type metric struct {
+	name, kind, help string
+	samples          []point
+}
+
+type point struct {
+	labels [][2]string
+	value  float64
+}
+
+// metrics lays the report out as Prometheus metric families. Every sample
+// is labelled with the service.
+func (r Report) metrics() []metric {
+	svc := [2]string{"service", r.Service}
+	gauge := func(name, help string) *metric { return &metric{name: name, kind: "gauge", help: help} }
+	counter := func(name, help string) *metric { return &metric{name: name, kind: "counter", help: help} }
+
+	overall := gauge("saturation", "Highest utilization of any worker queue or connection pool.")
+	overall.samples = []point{{[][2]string{svc}, r.Saturation}}
+
+	qWorkers := gauge("saturation_queue_workers", "Workers draining the queue.")
+	qBusy := gauge("saturation_queue_busy_workers", "Workers running a task.")
+	qDepth := gauge("saturation_queue_depth", "Tasks waiting for a worker.")
+	qCapacity := gauge("saturation_queue_capacity", "Tasks the queue holds before turning more away.")
+	qDropped := counter("saturation_queue_dropped_total", "Tasks turned away because the queue was full.")
+	qUtil := gauge("saturation_queue_utilization", "Busy workers plus waiting tasks over workers.")
+	for _, q := range r.Queues {
+		l := [][2]string{svc, {"queue", q.Name}}
+		qWorkers.samples = append(qWorkers.samples, point{l, float64(q.Workers)})
+		qBusy.samples = append(qBusy.samples, point{l, float64(q.Busy)})
+		qDepth.samples = append(qDepth.samples, point{l, float64(q.Depth)})
+		qCapacity.samples = append(qCapacity.samples, point{l, float64(q.Capacity)})
+		qDropped.samples = append(qDropped.samples, point{l, float64(q.Dropped)})
+		qUtil.samples = append(qUtil.samples, point{l, q.Utilization})
+	}
+
+	pMax := gauge("saturation_db_pool_max_open", "Most connections the pool opens, 0 for no limit.")
+	pInUse := gauge("saturation_db_pool_in_use", "Connections in use.")
+	pIdle := gauge("saturation_db_pool_idle", "Idle connections.")
+	pUtil := gauge("saturation_db_pool_utilization", "Connections in use over the pool's maximum.")
+	pWaits := counter("saturation_db_pool_waits_total", "Queries that waited for a connection.")
+	pWait := counter("saturation_db_pool_wait_seconds_total", "Time queries spent waiting for a connection.")
+	for _, p := range r.Pools {
+		l := [][2]string{svc, {"pool", p.Name}}
+		pMax.samples = append(pMax.samples, point{l, float64(p.MaxOpen)})
+		pInUse.samples = append(pInUse.samples, point{l, float64(p.InUse)})
+		pIdle.samples = append(pIdle.samples, point{l, float64(p.Idle)})
+		pUtil.samples = append(pUtil.samples, point{l, p.Utilization})
+		pWaits.samples = append(pWaits.samples, point{l, float64(p.WaitCount)})
+		pWait.samples = append(pWait.samples, point{l, p.WaitSeconds})
+	}
+
+	cBacklog := gauge("saturation_consumer_backlog", "Messages waiting in the consumer's broker queue.")
+	cLag := gauge("saturation_consumer_lag_seconds", "How long the last event handled waited since it was published.")
+	cHandled := counter("saturation_consumer_handled_total", "Events handled.")
+	cFailures := counter("saturation_consumer_failures_total", "Events whose handler failed.")
+	for _, c := range r.Consumers {
+		l := [][2]string{svc, {"queue", c.Queue}}
+		if c.Backlog >= 0 {
+			cBacklog.samples = append(cBacklog.samples, point{l, float64(c.Backlog)})
+		}
+		cLag.samples = append(cLag.samples, point{l, c.LagSeconds})
+		cHandled.samples = append(cHandled.samples, point{l, float64(c.Handled)})
+		cFailures.samples = append(cFailures.samples, point{l, float64(c.Failures)})
+	}
+
+	return []metric{*overall, *qWorkers, *qBusy, *qDepth, *qCapacity, *qDropped, *qUtil,
+		*pMax, *pInUse, *pIdle, *pUtil, *pWaits, *pWait,
+		*cBacklog, *cLag, *cHandled, *cFailures}
+}
+
+// WritePrometheus writes the report in Prometheus' text exposition format.
+// Families without samples are left out.
+func (r Report) WritePrometheus(w io.Writer) error {
+	var b strings.Builder
+	for _, m := range r.metrics() {
+		if len(m.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, p := range m.samples {
+			b.WriteString(m.name)
+			b.WriteByte('{')
+			for i, l := range p.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%s=\"%s\"", l[0], escapeLabel(l[1]))
+			}
+			b.WriteString("} ")
+			b.WriteString(strconv.FormatFloat(p.value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// PrometheusHandler serves the report for Prometheus to scrape.
+func (m *Monitor) PrometheusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		m.Report().WritePrometheus(c.Writer)
+	}
+}
@@ -0,0 +1,172 @@
+// Package saturation reports how close a service is to the limits of its
+// worker queues, database connection pools and event consumers, so an
+// autoscaler such as a Kubernetes HPA on external metrics or KEDA can scale
+// on the work waiting rather than on CPU alone. GET /internal/saturation
+// serves the report as JSON and GET /metrics/prometheus the same numbers in
+// Prometheus' text format.
+package saturation
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/gin-gonic/gin"
+)
+
+// waitWindow is how far back a pool's recent waits reach, give or take
+// the time between reports.
+const waitWindow = time.Minute
+
+// Report is a service's saturation at one moment.
+type Report struct {
+	Service string `json:"service"`
+	// Saturation is the highest utilization of any queue or pool. Above 1,
+	// work is waiting for a worker.
+	Saturation float64                `json:"saturation"`
+	Queues     []Queue                `json:"queues"`
+	Pools      []Pool                 `json:"pools"`
+	Consumers  []events.ConsumerStats `json:"consumers"`
+	At         time.Time              `json:"at"`
+}
+
+// Queue is a jobs queue. Utilization is busy workers plus waiting tasks
+// over workers.
+type Queue struct {
+	Name        string  `json:"name"`
+	Workers     int     `json:"workers"`
+	Busy        int     `json:"busy"`
+	Depth       int     `json:"depth"`
+	Capacity    int     `json:"capacity"`
+	Dropped     int64   `json:"dropped"`
+	Utilization float64 `json:"utilization"`
+}
+
+// Pool is a database connection pool. Utilization is connections in use
+// over the pool's maximum, and 0 for an unlimited pool. WaitCount and
+// WaitSeconds count every wait for a connection since startup, and
+// RecentWaits and RecentWaitMS the waits and their average over about the
+// last minute.
+type Pool struct {
+	Name         string  `json:"name"`
+	MaxOpen      int     `json:"max_open"`
+	InUse        int     `json:"in_use"`
+	Idle         int     `json:"idle"`
+	Utilization  float64 `json:"utilization"`
+	WaitCount    int64   `json:"wait_count"`
+	WaitSeconds  float64 `json:"wait_seconds"`
+	RecentWaits  int64   `json:"recent_waits"`
+	RecentWaitMS float64 `json:"recent_wait_ms"`
+}
+
+// Monitor collects a service's saturation signals. Event consumers are
+// found by themselves; pools and job runners are added as they are opened.
+type Monitor struct {
+	service string
+	now     func() time.Time
+
+	mu        sync.Mutex
+	pools     map[string]database.StatsProvider
+	jobs      []*jobs.Metrics
+	baselines map[string]sample
+}
+
+// sample is a pool's wait counters at a point in time.
+type sample struct {
+	count int64
+	wait  time.Duration
+	at    time.Time
+}
+
+func New(service string) *Monitor {
+	return &Monitor{service: service, now: time.Now, pools: map[string]database.StatsProvider{}, baselines: map[string]sample{}}
+}
+
+// AddPool reports pool under name. A nil pool is ignored.
+func (m *Monitor) AddPool(name string, pool database.StatsProvider) {
+	if pool == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pools[name] = pool
+}
+
+// AddJobs reports the queues of a job runner's metrics.
+func (m *Monitor) AddJobs(metrics *jobs.Metrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs = append(m.jobs, metrics)
+}
+
+// Report takes a reading of every signal.
+func (m *Monitor) Report() Report {
+	now := m.now()
+	r := Report{Service: m.service, Queues: []Queue{}, Pools: []Pool{}, Consumers: events.Consumers(), At: now.UTC()}
+
+	m.mu.Lock()
+	for _, metrics := range m.jobs {
+		_, queues := metrics.Snapshot()
+		for _, q := range queues {
+			row := Queue{Name: q.Name, Workers: q.Workers, Busy: q.Busy, Depth: q.Depth, Capacity: q.Capacity, Dropped: q.Dropped}
+			if q.Workers > 0 {
+				row.Utilization = float64(q.Busy+q.Depth) / float64(q.Workers)
+			}
+			r.Queues = append(r.Queues, row)
+		}
+	}
+	for name, pool := range m.pools {
+		r.Pools = append(r.Pools, m.pool(name, database.Stats(pool), now))
+	}
+	m.mu.Unlock()
+
+	sort.Slice(r.Queues, func(i, j int) bool { return r.Queues[i].Name < r.Queues[j].Name })
+	sort.Slice(r.Pools, func(i, j int) bool { return r.Pools[i].Name < r.Pools[j].Name })
+	for _, q := range r.Queues {
+		r.Saturation = max(r.Saturation, q.Utilization)
+	}
+	for _, p := range r.Pools {
+		r.Saturation = max(r.Saturation, p.Utilization)
+	}
+	return r
+}
+
+// pool reads one pool, measuring recent waits against a baseline that is
+// moved up once it is waitWindow old. The caller holds m.mu.
+func (m *Monitor) pool(name string, s database.PoolStats, now time.Time) Pool {
+	p := Pool{
+		Name:        name,
+		MaxOpen:     s.MaxOpenConnections,
+		InUse:       s.InUse,
+		Idle:        s.Idle,
+		WaitCount:   s.WaitCount,
+		WaitSeconds: s.WaitDuration.Seconds(),
+	}
+	if s.MaxOpenConnections > 0 {
+		p.Utilization = float64(s.InUse) / float64(s.MaxOpenConnections)
+	}
+	current := sample{count: s.WaitCount, wait: s.WaitDuration, at: now}
+	base, ok := m.baselines[name]
+	if !ok {
+		m.baselines[name] = current
+		return p
+	}
+	if p.RecentWaits = current.count - base.count; p.RecentWaits > 0 {
+		p.RecentWaitMS = float64((current.wait - base.wait).Microseconds()) / 1000 / float64(p.RecentWaits)
+	}
+	if now.Sub(base.at) >= waitWindow {
+		m.baselines[name] = current
+	}
+	return p
+}
+
+// Handler serves the report as JSON.
+func (m *Monitor) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, m.Report())
+	}
+}
@@ -0,0 +1,106 @@
+package saturation
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/gin-gonic/gin"
+)
+
+type fakePool struct {
+	stats sql.DBStats
+}
+
+func (p *fakePool) Stats() sql.DBStats {
+	return p.stats
+}
+
+func TestReport(t *testing.T) {
+	now := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	m := New("order-service")
+	m.now = func() time.Time { return now }
+
+	runner := jobs.New()
+	q := runner.Queue("fulfillment", 2, 10)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		q.Enqueue(key, func(ctx context.Context) error { return nil })
+	}
+	m.AddJobs(runner.Metrics())
+
+	pool := &fakePool{sql.DBStats{MaxOpenConnections: 20, InUse: 5, Idle: 3, WaitCount: 4, WaitDuration: 40 * time.Millisecond}}
+	m.AddPool("primary", pool)
+	m.AddPool("replica-1", &fakePool{sql.DBStats{InUse: 50}})
+	m.AddPool("missing", nil)
+
+	r := m.Report()
+	if len(r.Queues) != 1 || r.Queues[0].Depth != 5 || r.Queues[0].Capacity != 10 || r.Queues[0].Utilization != 2.5 {
+		t.Errorf("Expected 5 tasks waiting on 2 workers, got: %+v", r.Queues)
+	}
+	if len(r.Pools) != 2 || r.Pools[0].Name != "primary" || r.Pools[0].Utilization != 0.25 || r.Pools[0].WaitSeconds != 0.04 {
+		t.Errorf("Expected the primary at a quarter of its pool, got: %+v", r.Pools)
+	}
+	if r.Pools[1].Utilization != 0 {
+		t.Errorf("Expected an unlimited pool never to be saturated, got: %+v", r.Pools[1])
+	}
+	if r.Saturation != 2.5 {
+		t.Errorf("Expected the queue to set the saturation, got: %v", r.Saturation)
+	}
+
+	now = now.Add(30 * time.Second)
+	pool.stats.WaitCount, pool.stats.WaitDuration = 6, 100*time.Millisecond
+	if p := m.Report().Pools[0]; p.RecentWaits != 2 || p.RecentWaitMS != 30 {
+		t.Errorf("Expected 2 recent waits of 30ms, got: %+v", p)
+	}
+	now = now.Add(time.Minute)
+	pool.stats.WaitCount = 8
+	m.Report()
+	if p := m.Report().Pools[0]; p.RecentWaits != 0 {
+		t.Errorf("Expected waits older than a minute to be forgotten, got: %+v", p)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := New("inventory-service")
+	m.AddPool("primary", &fakePool{sql.DBStats{MaxOpenConnections: 10, InUse: 10, WaitCount: 3, WaitDuration: 1500 * time.Millisecond}})
+	router := gin.New()
+	router.GET("/internal/saturation", m.Handler())
+	router.GET("/metrics/prometheus", m.PrometheusHandler())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/internal/saturation", nil))
+	var report Report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK || report.Saturation != 1 || report.Service != "inventory-service" {
+		t.Errorf("Expected a saturated pool, got: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics/prometheus", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE saturation gauge\nsaturation{service=\"inventory-service\"} 1\n",
+		"# TYPE saturation_db_pool_wait_seconds_total counter\n",
+		"saturation_db_pool_wait_seconds_total{service=\"inventory-service\",pool=\"primary\"} 1.5\n",
+		"saturation_db_pool_waits_total{service=\"inventory-service\",pool=\"primary\"} 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "saturation_queue_depth") || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Expected Prometheus text without empty families, got: %s %s", w.Header().Get("Content-Type"), body)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %s", got)
+	}
+}
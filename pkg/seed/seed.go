@@ -0,0 +1,358 @@
+// Package seed fills a database that has the scripts/init-db.sql schema
+// with generated users, products, stock and orders, for local demos and
+// integration tests. It writes the services' tables directly, so none of
+// them need to be running.
+//
+// The data comes from a seeded random source: the same Config generates
+// the same users, products and orders. Users and products are keyed by
+// email and SKU, so seeding again leaves existing ones as they are, while
+// orders are added on every run.
+package seed
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config is what to generate, and for which tenant.
+type Config struct {
+	Tenant   string
+	Users    int
+	Products int
+	Orders   int
+	// Seed picks the data. Runs with the same seed generate the same data.
+	Seed int64
+	// Password is every generated user's password, so demos can sign in.
+	Password string
+}
+
+// Defaults are a small shop, enough to click through.
+var Defaults = Config{Tenant: "default", Users: 50, Products: 100, Orders: 200, Seed: 1, Password: "seed-password"}
+
+// Result counts the rows a run added. Users and products that were already
+// there are not counted.
+type Result struct {
+	Users    int
+	Products int
+	Orders   int
+}
+
+// Actor is recorded against the seeded orders' status changes.
+const Actor = "seed"
+
+// Run generates cfg's data and writes it in one transaction, as of now.
+func Run(ctx context.Context, db *sql.DB, cfg Config) (*Result, error) {
+	if cfg.Users < 1 || cfg.Products < 1 {
+		return nil, fmt.Errorf("need at least one user and one product, got %d users and %d products", cfg.Users, cfg.Products)
+	}
+	if cfg.Orders < 0 {
+		return nil, fmt.Errorf("orders must not be negative, got %d", cfg.Orders)
+	}
+	if cfg.Tenant == "" {
+		cfg.Tenant = Defaults.Tenant
+	}
+	if cfg.Password == "" {
+		cfg.Password = Defaults.Password
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(cfg.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	data := generate(cfg, time.Now().UTC())
+
+	var res *Result
+	err = database.WithTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		res = &Result{}
+		userIDs := make([]int, len(data.users))
+		for i, u := range data.users {
+			created, err := insertUser(ctx, tx, cfg.Tenant, u, string(hash), &userIDs[i])
+			if err != nil {
+				return fmt.Errorf("user %s: %w", u.email, err)
+			}
+			if created {
+				res.Users++
+			}
+		}
+		for i := range data.products {
+			p := &data.products[i]
+			created, err := insertProduct(ctx, tx, cfg.Tenant, p)
+			if err != nil {
+				return fmt.Errorf("product %s: %w", p.sku, err)
+			}
+			if created {
+				res.Products++
+			}
+		}
+		for _, o := range data.orders {
+			if err := insertOrder(ctx, tx, cfg.Tenant, o, userIDs[o.user], data.products); err != nil {
+				return fmt.Errorf("order: %w", err)
+			}
+			res.Orders++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// insertUser adds u unless its email is taken, and sets id either way.
+func insertUser(ctx context.Context, tx *sql.Tx, tenant string, u user, hash string, id *int) (bool, error) {
+	const insert string = `INSERT INTO user_service.users (tenant_id, email, username, password_hash, first_name, last_name, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING RETURNING id`
+	err := tx.QueryRowContext(ctx, insert, tenant, u.email, u.username, hash, u.firstName, u.lastName, u.createdAt).Scan(id)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	const existing string = `SELECT id FROM user_service.users WHERE tenant_id = $1 AND LOWER(email) = LOWER($2)`
+	return false, tx.QueryRowContext(ctx, existing, tenant, u.email).Scan(id)
+}
+
+// insertProduct adds the item with its opening stock, booked through the
+// ledger, and its catalog entry. If the SKU exists, p takes its name and
+// price instead, so orders are priced as the catalog has it.
+func insertProduct(ctx context.Context, tx *sql.Tx, tenant string, p *product) (bool, error) {
+	const item string = `INSERT INTO inventory_service.items (sku, tenant_id, name, on_hand, safety_stock)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (sku) DO NOTHING`
+	r, err := tx.ExecContext(ctx, item, p.sku, tenant, p.name, p.onHand, p.safetyStock)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		const existing string = `SELECT i.name, COALESCE(p.price_cents, $2) FROM inventory_service.items i
+			LEFT JOIN inventory_service.products p ON p.sku = i.sku WHERE i.sku = $1`
+		return false, tx.QueryRowContext(ctx, existing, p.sku, p.priceCents).Scan(&p.name, &p.priceCents)
+	}
+	if p.onHand > 0 {
+		const ledger string = `INSERT INTO inventory_service.stock_ledger (sku, delta, unit, unit_quantity, reason, reference)
+			VALUES ($1, $2, 'each', $2, 'seed', 'seed')`
+		if _, err := tx.ExecContext(ctx, ledger, p.sku, p.onHand); err != nil {
+			return false, err
+		}
+	}
+	const catalog string = `INSERT INTO inventory_service.products (sku, description, price_cents, currency, categories)
+		VALUES ($1, $2, $3, 'USD', $4)`
+	if _, err := tx.ExecContext(ctx, catalog, p.sku, p.description, p.priceCents, pq.Array(p.categories)); err != nil {
+		return false, err
+	}
+	const price string = `INSERT INTO inventory_service.product_prices (sku, price_cents, currency) VALUES ($1, $2, 'USD')`
+	_, err = tx.ExecContext(ctx, price, p.sku, p.priceCents)
+	return err == nil, err
+}
+
+// insertOrder adds the order, its lines and its status history, and the
+// cancellation of a cancelled one.
+func insertOrder(ctx context.Context, tx *sql.Tx, tenant string, o order, userID int, products []product) error {
+	var subtotal int64
+	for _, l := range o.lines {
+		subtotal += int64(l.quantity) * products[l.product].priceCents
+	}
+	updatedAt := o.createdAt
+	if len(o.history) > 0 {
+		updatedAt = o.history[len(o.history)-1].at
+	}
+
+	const insert string = `INSERT INTO order_service.orders (tenant_id, user_id, status, currency, subtotal_cents, total_cents, created_at, updated_at)
+		VALUES ($1, $2, $3, 'USD', $4, $4, $5, $6) RETURNING id`
+	var id int
+	if err := tx.QueryRowContext(ctx, insert, tenant, userID, o.status, subtotal, o.createdAt, updatedAt).Scan(&id); err != nil {
+		return err
+	}
+	const item string = `INSERT INTO order_service.order_items (order_id, sku, name, unit, quantity, unit_price_cents)
+		VALUES ($1, $2, $3, 'each', $4, $5)`
+	for _, l := range o.lines {
+		p := products[l.product]
+		if _, err := tx.ExecContext(ctx, item, id, p.sku, p.name, l.quantity, p.priceCents); err != nil {
+			return err
+		}
+	}
+	const history string = `INSERT INTO order_service.order_status_history (order_id, from_status, to_status, actor, reason, created_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), $6)`
+	from := ""
+	for _, t := range o.history {
+		if _, err := tx.ExecContext(ctx, history, id, from, t.status, Actor, t.reason, t.at); err != nil {
+			return err
+		}
+		from = t.status
+	}
+	if o.status == statusCancelled {
+		const cancellation string = `INSERT INTO order_service.order_cancellations (order_id, tenant_id, reason, customer_tier, cancelled_at)
+			VALUES ($1, $2, $3, 'new', $4)`
+		if _, err := tx.ExecContext(ctx, cancellation, id, tenant, o.cancelReason, updatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type user struct {
+	email, username     string
+	firstName, lastName string
+	createdAt           time.Time
+}
+
+type product struct {
+	sku, name, description string
+	priceCents             int64
+	categories             []string
+	onHand, safetyStock    int
+}
+
+type line struct {
+	product, quantity int
+}
+
+type change struct {
+	status, reason string
+	at             time.Time
+}
+
+type order struct {
+	user         int
+	status       string
+	lines        []line
+	history      []change
+	cancelReason string
+	createdAt    time.Time
+}
+
+type dataset struct {
+	users    []user
+	products []product
+	orders   []order
+}
+
+const (
+	statusPending       = "pending"
+	statusPaid          = "paid"
+	statusPaymentFailed = "payment_failed"
+	statusCancelled     = "cancelled"
+)
+
+// statusWeights is how often each final status comes up, out of 20.
+var statusWeights = []struct {
+	status string
+	weight int
+}{{statusPaid, 12}, {statusPending, 4}, {statusCancelled, 3}, {statusPaymentFailed, 1}}
+
+var (
+	firstNames = []string{"Ada", "Grace", "Alan", "Linus", "Margaret", "Ken", "Barbara", "Dennis", "Radia", "Edsger",
+		"Frances", "Donald", "Hedy", "John", "Katherine", "Tim", "Sophie", "Guido", "Anita", "Niklaus"}
+	lastNames = []string{"Lovelace", "Hopper", "Turing", "Torvalds", "Hamilton", "Thompson", "Liskov", "Ritchie", "Perlman", "Dijkstra",
+		"Allen", "Knuth", "Lamarr", "McCarthy", "Johnson", "Berners-Lee", "Wilson", "van Rossum", "Borg", "Wirth"}
+	adjectives = []string{"Classic", "Compact", "Deluxe", "Eco", "Heavy-Duty", "Lightweight", "Premium", "Rugged", "Slim", "Vintage"}
+	materials  = []string{"Bamboo", "Canvas", "Ceramic", "Cotton", "Glass", "Leather", "Oak", "Steel", "Wool", "Copper"}
+	nouns      = map[string][]string{
+		"kitchen": {"Mug", "Teapot", "Cutting Board", "Knife Set", "Skillet"},
+		"outdoor": {"Backpack", "Water Bottle", "Camp Stool", "Lantern", "Hammock"},
+		"office":  {"Notebook", "Desk Lamp", "Pen Holder", "Monitor Stand", "Desk Mat"},
+		"home":    {"Throw Blanket", "Vase", "Candle", "Picture Frame", "Cushion"},
+		"apparel": {"Beanie", "Scarf", "Tote Bag", "Wallet", "Belt"},
+	}
+	categories          = []string{"apparel", "home", "kitchen", "office", "outdoor"}
+	cancellationReasons = []string{"changed_mind", "found_cheaper", "delivery_too_slow", "ordered_by_mistake", "payment_issue"}
+)
+
+// generate builds cfg's data, dated up to now.
+func generate(cfg Config, now time.Time) dataset {
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	var d dataset
+	// SKUs are global, so another tenant's products need their own.
+	prefix := "SEED-"
+	if cfg.Tenant != "" && cfg.Tenant != Defaults.Tenant {
+		prefix += strings.ToUpper(cfg.Tenant) + "-"
+	}
+
+	for i := 0; i < cfg.Users; i++ {
+		first, last := firstNames[rng.Intn(len(firstNames))], lastNames[rng.Intn(len(lastNames))]
+		handle := strings.ToLower(first + "." + strings.ReplaceAll(strings.ReplaceAll(last, " ", ""), "-", ""))
+		d.users = append(d.users, user{
+			email:     fmt.Sprintf("%s%d@example.com", handle, i+1),
+			username:  fmt.Sprintf("%s%d", strings.ReplaceAll(handle, ".", "_"), i+1),
+			firstName: first,
+			lastName:  last,
+			createdAt: now.Add(-time.Duration(90+rng.Intn(275)) * 24 * time.Hour),
+		})
+	}
+
+	for i := 0; i < cfg.Products; i++ {
+		category := categories[rng.Intn(len(categories))]
+		adjective, material := adjectives[rng.Intn(len(adjectives))], materials[rng.Intn(len(materials))]
+		noun := nouns[category][rng.Intn(len(nouns[category]))]
+		p := product{
+			sku:         fmt.Sprintf("%s%05d", prefix, i+1),
+			name:        adjective + " " + material + " " + noun,
+			description: fmt.Sprintf("%s %s in %s.", adjective, strings.ToLower(noun), strings.ToLower(material)),
+			// Prices end in 99, from 4.99 to 199.99.
+			priceCents:  int64(5+rng.Intn(196))*100 - 1,
+			categories:  []string{category},
+			safetyStock: rng.Intn(3) * 5,
+		}
+		// One product in ten is out of stock, and one in five low.
+		switch n := rng.Intn(10); {
+		case n == 0:
+		case n < 3:
+			p.onHand = 1 + rng.Intn(10)
+		default:
+			p.onHand = 20 + rng.Intn(480)
+		}
+		d.products = append(d.products, p)
+	}
+
+	for i := 0; i < cfg.Orders; i++ {
+		o := order{
+			user:      rng.Intn(cfg.Users),
+			status:    pickStatus(rng),
+			createdAt: now.Add(-time.Duration(rng.Int63n(int64(90 * 24 * time.Hour)))).Truncate(time.Second),
+		}
+		// One to four lines, each for a different product.
+		for _, p := range rng.Perm(cfg.Products)[:min(1+rng.Intn(4), cfg.Products)] {
+			o.lines = append(o.lines, line{product: p, quantity: 1 + rng.Intn(3)})
+		}
+		o.history = []change{{status: statusPending, at: o.createdAt}}
+		settled := o.createdAt.Add(time.Duration(1+rng.Intn(120)) * time.Minute)
+		switch o.status {
+		case statusPaid:
+			o.history = append(o.history, change{status: statusPaid, reason: "payment succeeded", at: settled})
+		case statusPaymentFailed:
+			o.history = append(o.history, change{status: statusPaymentFailed, reason: "card declined", at: settled})
+		case statusCancelled:
+			o.cancelReason = cancellationReasons[rng.Intn(len(cancellationReasons))]
+			o.history = append(o.history, change{status: statusCancelled, reason: "cancelled by the customer: " + o.cancelReason, at: settled})
+		}
+		d.orders = append(d.orders, o)
+	}
+	return d
+}
+
+func pickStatus(rng *rand.Rand) string {
+	total := 0
+	for _, w := range statusWeights {
+		total += w.weight
+	}
+	n := rng.Intn(total)
+	for _, w := range statusWeights {
+		if n < w.weight {
+			return w.status
+		}
+		n -= w.weight
+	}
+	return statusPending
+}
@@ -0,0 +1,46 @@
+//go:build integration
+
+package seed_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/seed"
+	"github.com/alux444/go-microserv-test/pkg/testfactory"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(testfactory.Main(m))
+}
+
+func TestRunIntegration(t *testing.T) {
+	db := testfactory.DB(t)
+	cfg := seed.Config{Tenant: "seedtest", Users: 5, Products: 10, Orders: 20, Seed: 1}
+
+	res, err := seed.Run(context.Background(), db, cfg)
+	if err != nil {
+		t.Fatalf("Failed to seed: %v", err)
+	}
+	if *res != (seed.Result{Users: 5, Products: 10, Orders: 20}) {
+		t.Errorf("Expected every row to be new, got: %+v", res)
+	}
+
+	// Seeding again keeps the users and products and adds orders.
+	res, err = seed.Run(context.Background(), db, cfg)
+	if err != nil {
+		t.Fatalf("Failed to seed again: %v", err)
+	}
+	if *res != (seed.Result{Orders: 20}) {
+		t.Errorf("Expected only new orders, got: %+v", res)
+	}
+
+	var orders int
+	var mismatched int
+	err = db.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE o.subtotal_cents <> (SELECT SUM(quantity * unit_price_cents)
+		FROM order_service.order_items i WHERE i.order_id = o.id)) FROM order_service.orders o WHERE tenant_id = $1`, cfg.Tenant).Scan(&orders, &mismatched)
+	if err != nil || orders != 40 || mismatched != 0 {
+		t.Errorf("Expected 40 orders with their totals summed from their lines, got: %d, %d mismatched, %v", orders, mismatched, err)
+	}
+}
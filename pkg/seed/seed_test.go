@@ -0,0 +1,51 @@
+package seed
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	cfg := Config{Tenant: "acme", Users: 20, Products: 30, Orders: 100, Seed: 7}
+	d := generate(cfg, now)
+	if !reflect.DeepEqual(d, generate(cfg, now)) {
+		t.Fatal("Expected the same seed to generate the same data")
+	}
+	if cfg.Seed = 8; reflect.DeepEqual(d, generate(cfg, now)) {
+		t.Error("Expected another seed to generate other data")
+	}
+
+	emails := map[string]bool{}
+	for _, u := range d.users {
+		if emails[u.email] {
+			t.Errorf("Expected unique emails, got %s twice", u.email)
+		}
+		emails[u.email] = true
+	}
+	if d.products[0].sku != "SEED-ACME-00001" {
+		t.Errorf("Expected the tenant in the SKUs, got: %s", d.products[0].sku)
+	}
+
+	statuses := map[string]int{}
+	for _, o := range d.orders {
+		statuses[o.status]++
+		if len(o.lines) == 0 || len(o.lines) > 4 || o.createdAt.After(now) {
+			t.Errorf("Unexpected order: %+v", o)
+		}
+		if last := o.history[len(o.history)-1]; last.status != o.status || (o.status == statusCancelled) != (o.cancelReason != "") {
+			t.Errorf("Expected the history to end in the order's status, got: %+v", o)
+		}
+		seen := map[int]bool{}
+		for _, l := range o.lines {
+			if seen[l.product] {
+				t.Errorf("Expected each line for a different product, got: %+v", o.lines)
+			}
+			seen[l.product] = true
+		}
+	}
+	if len(statuses) != len(statusWeights) {
+		t.Errorf("Expected orders in every status, got: %v", statuses)
+	}
+}
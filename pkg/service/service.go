@@ -0,0 +1,227 @@
+// Package service is the bootstrap the backends share: logging, the router
+// with the standard middleware, the health, metrics and admin endpoints
+// every service exposes, and serving until a shutdown signal. A service's
+// main only adds its own routes and domain wiring.
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/audit"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/bodylimit"
+	"github.com/alux444/go-microserv-test/pkg/coalesce"
+	"github.com/alux444/go-microserv-test/pkg/compress"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/deadline"
+	"github.com/alux444/go-microserv-test/pkg/degrade"
+	"github.com/alux444/go-microserv-test/pkg/docs"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/alux444/go-microserv-test/pkg/i18n"
+	"github.com/alux444/go-microserv-test/pkg/loadshed"
+	"github.com/alux444/go-microserv-test/pkg/logger"
+	"github.com/alux444/go-microserv-test/pkg/middleware"
+	"github.com/alux444/go-microserv-test/pkg/ops"
+	"github.com/alux444/go-microserv-test/pkg/recovery"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/pkg/saturation"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/pkg/tlsutil"
+	"github.com/alux444/go-microserv-test/pkg/tracing"
+	"github.com/gin-gonic/gin"
+)
+
+// Init loads CONFIG_FILE and sets up logging for the named service, and
+// returns a context that is cancelled on SIGINT or SIGTERM. Until then,
+// CONFIG_FILE is reloaded every CONFIG_RELOAD_INTERVAL.
+func Init(name string) (context.Context, context.CancelFunc) {
+	if err := config.Load(); err != nil {
+		log.Fatalf("Invalid CONFIG_FILE: %v", err)
+	}
+	if err := logger.Init(name); err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go config.Watch(ctx, config.GetDuration("CONFIG_RELOAD_INTERVAL", 30*time.Second))
+	return ctx, stop
+}
+
+// Tokens verifies tokens signed with JWT_SECRET for the named service's
+// audience, and issues them with JWT_TTL. Service tokens are signed with
+// INTERNAL_AUTH_SECRET instead when it is set.
+func Tokens(name string) *auth.Tokens {
+	tokens, err := auth.NewTokens(config.GetEnv("JWT_SECRET", ""), config.GetDuration("JWT_TTL", time.Hour))
+	if err != nil {
+		log.Fatalf("Invalid JWT_SECRET: %v", err)
+	}
+	if secret := config.GetEnv("INTERNAL_AUTH_SECRET", ""); secret != "" {
+		tokens = tokens.WithInternalSecret(secret)
+	}
+	return tokens.ForAudience(name)
+}
+
+// Config describes what NewRouter wires.
+type Config struct {
+	Name     string
+	DB       *sql.DB
+	Replicas *database.Replicas
+	Tokens   *auth.Tokens
+	Spec     []byte
+	// Messages holds the service's translations of its error messages,
+	// one <locale>.json per locale (see i18n.Load).
+	Messages fs.FS
+	// AuditLog is the table the audit log is kept in, and Redact the fields
+	// kept out of it besides the usual secrets.
+	AuditLog string
+	Redact   []string
+	// Middleware runs on every authenticated route after the tenant is
+	// resolved and before the request is recorded, and AdminMiddleware on
+	// admin routes after the admin token is checked.
+	Middleware      []gin.HandlerFunc
+	AdminMiddleware []gin.HandlerFunc
+}
+
+// Router is a service's router. Admin holds the routes behind ADMIN_TOKEN,
+// which carry no user token. Bodies holds the body rules of routes that
+// take something other than JSON up to MAX_REQUEST_BODY. Saturation
+// already reports the database pools and event consumers; a service adds
+// its job runners to it.
+type Router struct {
+	*gin.Engine
+	Admin      *gin.RouterGroup
+	Shedder    *loadshed.Shedder
+	Bodies     *bodylimit.Limits
+	AuditLog   audit.Store
+	Saturation *saturation.Monitor
+}
+
+// NewRouter installs panic recovery, reporting to SENTRY_DSN when it is set,
+// then tracing, request IDs, response compression, the locale from
+// Accept-Language, the caller's deadline, decoding of compressed request
+// bodies, request body limits, load shedding, authentication, tenants,
+// read replicas, read coalescing and the audit log, in that order, and
+// serves /health, /health/db, /metrics/database, /metrics/outbound,
+// /metrics/degraded, /metrics/coalesced, the audit log, the API docs and the
+// ops and load shedding admin routes. GET /locales lists the locales error
+// messages are translated into. GET /internal/saturation and
+// GET /metrics/prometheus report the service's saturation for autoscalers.
+func NewRouter(cfg Config) *Router {
+	reporter, err := recovery.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid SENTRY_DSN: %v", err)
+	}
+	router := gin.New()
+	router.Use(gin.Logger())
+	router.Use(recovery.Middleware(cfg.Name, reporter))
+	router.Use(tracing.Middleware(cfg.Name))
+	router.Use(requestid.Middleware())
+	router.Use(compress.FromEnv())
+	catalog, err := i18n.Load(cfg.Messages)
+	if err != nil {
+		log.Fatalf("Invalid message catalog: %v", err)
+	}
+	router.Use(catalog.Middleware())
+	router.Use(deadline.Middleware(0))
+	router.Use(ops.Middleware())
+	r := &Router{Engine: router, Shedder: loadshed.FromEnv(), Bodies: bodylimit.FromEnv(), AuditLog: audit.NewPostgresStore(cfg.DB, cfg.AuditLog),
+		Saturation: saturation.New(cfg.Name)}
+	if cfg.DB != nil {
+		r.Saturation.AddPool("primary", cfg.DB)
+	}
+	for name, pool := range cfg.Replicas.Pools() {
+		r.Saturation.AddPool(name, pool)
+	}
+	// Decoded ahead of the limits, so a body is limited by the size it
+	// inflates to rather than the size it was sent at.
+	router.Use(compress.Decode())
+	router.Use(r.Bodies.Middleware())
+	recorder := audit.NewRecorder(r.AuditLog, cfg.Redact...)
+	auditHandler := audit.NewHandler(r.AuditLog)
+
+	// The admin group is created before auth.Authenticate is installed,
+	// which would reject the admin token as an invalid user token.
+	admin := append([]gin.HandlerFunc{middleware.RequireAdminToken(config.GetEnv("ADMIN_TOKEN", ""))}, cfg.AdminMiddleware...)
+	r.Admin = router.Group("/admin", append(admin, recorder.AdminMiddleware())...)
+	ops.RegisterAdminRoutes(r.Admin)
+	r.Shedder.RegisterAdminRoutes(r.Admin)
+	auditHandler.RegisterAdminRoutes(r.Admin)
+
+	router.Use(r.Shedder.Middleware())
+	router.Use(auth.Authenticate(cfg.Tokens))
+	router.Use(tenant.Middleware())
+	router.Use(cfg.Replicas.Middleware())
+	router.Use(coalesce.Middleware())
+	router.Use(cfg.Middleware...)
+	router.Use(recorder.Middleware())
+
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "healthy",
+			"service": cfg.Name,
+		})
+	})
+	router.GET("/health/db", database.HealthHandler(cfg.DB))
+	router.GET("/metrics/database", cfg.Replicas.MetricsHandler(cfg.DB))
+	router.GET("/metrics/outbound", httpclient.Handler())
+	router.GET("/metrics/degraded", degrade.Handler())
+	router.GET("/metrics/coalesced", coalesce.Handler())
+	router.GET("/metrics/prometheus", r.Saturation.PrometheusHandler())
+	router.GET("/internal/saturation", r.Saturation.Handler())
+	router.GET("/locales", catalog.Handler())
+
+	auditHandler.RegisterRoutes(router)
+	docs.Register(router, cfg.Name, cfg.Spec)
+	return r
+}
+
+// Serve serves handler on addr, over TLS when it is configured, until ctx is
+// cancelled. It then drains connections for up to SHUTDOWN_TIMEOUT and
+// calls each stop function, such as a job runner's Stop, with what is left
+// of it.
+func Serve(ctx context.Context, name, addr string, handler http.Handler, stop ...func(context.Context) error) {
+	serverTLS, err := tlsutil.ServerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid TLS config: %v", err)
+	}
+	title := displayName(name)
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		log.Printf("%s starting on %s", title, addr)
+		if err := tlsutil.ListenAndServe(server, serverTLS); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("%s failed: %v", title, err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Printf("%s shutting down", title)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.GetDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to drain HTTP connections: %v", err)
+	}
+	for _, fn := range stop {
+		if err := fn(shutdownCtx); err != nil {
+			log.Printf("%s did not stop in time: %v", title, err)
+		}
+	}
+}
+
+// displayName turns "user-service" into "User service" for log lines.
+func displayName(name string) string {
+	name = strings.ReplaceAll(name, "-", " ")
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestNewRouter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	tokens, err := auth.NewTokens("0123456789abcdef0123456789abcdef", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ran []string
+	mark := func(name string) gin.HandlerFunc {
+		return func(c *gin.Context) { ran = append(ran, name) }
+	}
+	router := NewRouter(Config{
+		Name:            "test-service",
+		Tokens:          tokens,
+		AuditLog:        "test_service.audit_log",
+		Middleware:      []gin.HandlerFunc{mark("service")},
+		AdminMiddleware: []gin.HandlerFunc{mark("admin")},
+	})
+	router.Admin.GET("/widgets", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/widgets", func(c *gin.Context) { c.Status(http.StatusOK) })
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		ran = nil
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("/health", ""); w.Code != http.StatusOK || w.Body.String() != `{"service":"test-service","status":"healthy"}` {
+		t.Errorf("Expected the service to report healthy, got: %d %s", w.Code, w.Body)
+	}
+	if w := serve("/widgets", ""); w.Code != http.StatusOK || len(ran) != 1 || ran[0] != "service" {
+		t.Errorf("Expected service middleware on service routes, got: %d %v", w.Code, ran)
+	}
+	if w := serve("/widgets", "not-a-token"); w.Code != http.StatusUnauthorized || len(ran) != 0 {
+		t.Errorf("Expected an invalid user token to be refused, got: %d %v", w.Code, ran)
+	}
+	if w := serve("/admin/widgets", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected admin routes to need the admin token, got: %d", w.Code)
+	}
+	if w := serve("/admin/widgets", "admin-secret"); w.Code != http.StatusOK || len(ran) != 1 || ran[0] != "admin" {
+		t.Errorf("Expected the admin token to reach admin routes with admin middleware only, got: %d %v", w.Code, ran)
+	}
+	if w := serve("/admin/load-shedding", "admin-secret"); w.Code != http.StatusOK {
+		t.Errorf("Expected the load shedding admin routes, got: %d", w.Code)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	if got := displayName("user-service"); got != "User service" {
+		t.Errorf("Expected %q, got: %q", "User service", got)
+	}
+}
@@ -0,0 +1,258 @@
+// Package startup runs a service's self-checks on boot, logs the report as
+// one JSON line and serves the last report at /health/startup-report, so a
+// bad deploy can be diagnosed without digging through logs.
+package startup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	StatusPass = "pass"
+	// StatusWarn is reported for optional checks that failed; the service
+	// works, but degraded (e.g. events are only logged).
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+type Check struct {
+	Name     string
+	Optional bool
+	Run      func(ctx context.Context) error
+}
+
+type Result struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+type Report struct {
+	Service    string    `json:"service"`
+	Status     string    `json:"status"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Checks     []Result  `json:"checks"`
+}
+
+// SelfCheck holds a service's checks and the report from their last run.
+type SelfCheck struct {
+	service string
+	checks  []Check
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	report *Report
+}
+
+func New(service string, checks ...Check) *SelfCheck {
+	return &SelfCheck{service: service, checks: checks, timeout: 5 * time.Second}
+}
+
+// Run runs every check in order, each bounded by its own timeout, then
+// stores and logs the report.
+func (s *SelfCheck) Run(ctx context.Context) Report {
+	report := Report{Service: s.service, Status: StatusPass, StartedAt: time.Now(), Checks: []Result{}}
+	for _, check := range s.checks {
+		checkCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		start := time.Now()
+		err := check.Run(checkCtx)
+		cancel()
+
+		result := Result{Name: check.Name, Status: StatusPass, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			result.Error = err.Error()
+			result.Status = StatusFail
+			if check.Optional {
+				result.Status = StatusWarn
+			}
+		}
+		if result.Status == StatusFail || result.Status == StatusWarn && report.Status == StatusPass {
+			report.Status = result.Status
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	report.FinishedAt = time.Now()
+
+	s.mu.Lock()
+	s.report = &report
+	s.mu.Unlock()
+
+	if b, err := json.Marshal(report); err == nil {
+		log.Printf("Startup self-check: %s", b)
+	}
+	return report
+}
+
+// Report returns the last report, or false if the checks have not finished.
+func (s *SelfCheck) Report() (Report, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.report == nil {
+		return Report{}, false
+	}
+	return *s.report, true
+}
+
+// Handler serves the last report, with 503 while the checks are still
+// running or when a required check failed.
+func (s *SelfCheck) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, ok := s.Report()
+		if !ok {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"service": s.service, "status": "pending"})
+			return
+		}
+		status := http.StatusOK
+		if report.Status == StatusFail {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, report)
+	}
+}
+
+// Env fails unless every named variable is set, in the environment or
+// CONFIG_FILE.
+func Env(names ...string) Check {
+	return Check{Name: "env", Run: func(ctx context.Context) error {
+		var missing []string
+		for _, name := range names {
+			if _, ok := config.Lookup(name); !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}}
+}
+
+// Var is a setting whose value, when set, has to parse.
+type Var struct {
+	Name  string
+	Parse func(string) error
+}
+
+func Duration(name string) Var {
+	return Var{Name: name, Parse: func(v string) error {
+		_, err := time.ParseDuration(v)
+		return err
+	}}
+}
+
+func Int(name string) Var {
+	return Var{Name: name, Parse: func(v string) error {
+		_, err := strconv.Atoi(v)
+		return err
+	}}
+}
+
+func Bytes(name string) Var {
+	return Var{Name: name, Parse: func(v string) error {
+		_, err := config.ParseBytes(v)
+		return err
+	}}
+}
+
+// Config fails when a set variable does not parse. config.GetDuration,
+// config.GetInt and config.GetBytes fall back to their defaults silently in that case, so a typo
+// would otherwise go unnoticed.
+func Config(vars ...Var) Check {
+	return Check{Name: "config", Run: func(ctx context.Context) error {
+		var invalid []string
+		for _, v := range vars {
+			if value, ok := config.Lookup(v.Name); ok && v.Parse(value) != nil {
+				invalid = append(invalid, fmt.Sprintf("%s=%q", v.Name, value))
+			}
+		}
+		if len(invalid) > 0 {
+			return fmt.Errorf("invalid %s, using defaults", strings.Join(invalid, ", "))
+		}
+		return nil
+	}}
+}
+
+// Tables fails unless every schema-qualified table exists, which is how a
+// service finds out scripts/init-db.sql was not applied in full.
+func Tables(db *sql.DB, tables ...string) Check {
+	return Check{Name: "migrations", Run: func(ctx context.Context) error {
+		var missing []string
+		for _, table := range tables {
+			var found sql.NullString
+			if err := db.QueryRowContext(ctx, "SELECT to_regclass($1)::text", table).Scan(&found); err != nil {
+				return err
+			}
+			if !found.Valid {
+				missing = append(missing, table)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing tables %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}}
+}
+
+var healthClient = httpclient.New()
+
+// Service warns unless the service at baseURL answers its /health endpoint.
+func Service(name, baseURL string) Check {
+	return Check{Name: name, Optional: true, Run: func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(baseURL, "/")+"/health", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := healthClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("health check returned %d", resp.StatusCode)
+		}
+		return nil
+	}}
+}
+
+// Broker warns when events.Connect fell back to logging events, and checks
+// the broker still accepts connections otherwise.
+func Broker(publisher events.Publisher, rawURL string) Check {
+	return Check{Name: "rabbitmq", Optional: true, Run: func(ctx context.Context) error {
+		if _, ok := publisher.(events.LogPublisher); ok {
+			return errors.New("not connected, events are only logged")
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "5672")
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}}
+}
@@ -0,0 +1,73 @@
+package startup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSelfCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	os.Setenv("STARTUP_TEST_SECRET", "x")
+	os.Setenv("STARTUP_TEST_TTL", "1 hour")
+	defer os.Unsetenv("STARTUP_TEST_SECRET")
+	defer os.Unsetenv("STARTUP_TEST_TTL")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	check := New("test-service",
+		Env("STARTUP_TEST_SECRET"),
+		Config(Duration("STARTUP_TEST_TTL"), Int("STARTUP_TEST_UNSET")),
+		Service("user-service", backend.URL),
+		Broker(events.LogPublisher{}, ""),
+	)
+	router := gin.New()
+	router.GET("/health/startup-report", check.Handler())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/startup-report", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 before the checks ran, got: %d", w.Code)
+	}
+
+	report := check.Run(context.Background())
+	want := []string{StatusPass, StatusFail, StatusWarn, StatusWarn}
+	if report.Status != StatusFail || len(report.Checks) != len(want) {
+		t.Fatalf("Expected a failed report with %d checks, got: %+v", len(want), report)
+	}
+	for i, result := range report.Checks {
+		if result.Status != want[i] {
+			t.Errorf("Expected %s to %s, got: %+v", result.Name, want[i], result)
+		}
+	}
+	if report.Checks[1].Error != `invalid STARTUP_TEST_TTL="1 hour", using defaults` {
+		t.Errorf("Unexpected config error: %q", report.Checks[1].Error)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/startup-report", nil))
+	var served Report
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || w.Code != http.StatusServiceUnavailable || served.Service != "test-service" {
+		t.Errorf("Expected the failed report with status 503, got: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOptionalFailuresOnlyWarn(t *testing.T) {
+	report := New("test-service",
+		Check{Name: "ok", Run: func(ctx context.Context) error { return nil }},
+		Check{Name: "cache", Optional: true, Run: func(ctx context.Context) error { return errors.New("unreachable") }},
+	).Run(context.Background())
+	if report.Status != StatusWarn {
+		t.Errorf("Expected status warn, got: %+v", report)
+	}
+}
@@ -0,0 +1,77 @@
+// Package tenant carries the storefront a request belongs to. Services take
+// it from the verified token (see auth.Authenticate) or, for anonymous and
+// service-to-service calls, the X-Tenant-ID header, and their stores filter
+// every tenant-scoped table by it.
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+const Header = "X-Tenant-ID"
+
+// Default is the tenant of requests that name none, so a single-storefront
+// deployment never has to send the header.
+const Default = "default"
+
+var validID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Valid reports whether id is a usable tenant ID: lowercase letters, digits
+// and dashes, up to 63 characters.
+func Valid(id string) bool {
+	return validID.MatchString(id)
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// Lookup returns the tenant stored on ctx, if any.
+func Lookup(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok
+}
+
+// FromContext returns the tenant stored on ctx, or Default.
+func FromContext(ctx context.Context) string {
+	if id, ok := Lookup(ctx); ok {
+		return id
+	}
+	return Default
+}
+
+// Middleware settles the request's tenant. It must run after
+// auth.Authenticate: a tenant bound by the caller's token wins, and a header
+// naming another tenant is rejected with 403. Otherwise the header, or
+// Default, is used.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader(Header)
+		if header != "" && !Valid(header) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid tenant id"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		if bound, ok := Lookup(ctx); ok {
+			if header != "" && header != bound {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "tenant does not match the token"})
+				return
+			}
+			c.Next()
+			return
+		}
+		id := header
+		if id == "" {
+			id = Default
+		}
+		c.Request = c.Request.WithContext(NewContext(ctx, id))
+		c.Next()
+	}
+}
@@ -0,0 +1,119 @@
+package testfactory
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// containerLabel marks every container the harness starts, so leftovers
+// from a killed test run can be found with
+// docker ps --filter label=go-microserv-test.testfactory.
+const containerLabel = "go-microserv-test.testfactory"
+
+// container is a throwaway docker container started for a test binary.
+type container struct {
+	id   string
+	addr string
+}
+
+var started struct {
+	sync.Mutex
+	containers []*container
+}
+
+// startContainer runs image with env and publishes port on a random
+// loopback port, returned as the container's addr. It goes through the
+// docker CLI so the harness pulls in no client library.
+func startContainer(image, port string, env map[string]string) (*container, error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil, errors.New("docker not found: install it, or set TEST_POSTGRES=external to use the POSTGRES_* database")
+	}
+	args := []string{"run", "--detach", "--rm", "--label", containerLabel, "--publish", "127.0.0.1::" + port}
+	for k, v := range env {
+		args = append(args, "--env", k+"="+v)
+	}
+	out, err := exec.Command("docker", append(args, image)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("start %s: %w", image, commandError(err))
+	}
+	c := &container{id: strings.TrimSpace(string(out))}
+	started.Lock()
+	started.containers = append(started.containers, c)
+	started.Unlock()
+
+	out, err = exec.Command("docker", "port", c.id, port+"/tcp").Output()
+	if err != nil {
+		return nil, fmt.Errorf("find the port of %s: %w", image, commandError(err))
+	}
+	// docker port prints one line per address family.
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("find the port of %s: unexpected %q", image, addr)
+	}
+	c.addr = addr
+	return c, nil
+}
+
+func commandError(err error) error {
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exit.Stderr)))
+	}
+	return err
+}
+
+// Main runs a package's tests and removes the containers they started.
+// Integration test packages call it from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(testfactory.Main(m))
+//	}
+func Main(m *testing.M) int {
+	code := m.Run()
+	started.Lock()
+	defer started.Unlock()
+	for _, c := range started.containers {
+		if err := exec.Command("docker", "rm", "--force", c.id).Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "testfactory: failed to remove container %s: %v\n", c.id, err)
+		}
+	}
+	started.containers = nil
+	return code
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// repoFile finds path relative to the repository root by walking up from
+// the test's working directory, which go test sets to the package's.
+func repoFile(path string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		candidate := filepath.Join(dir, path)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("%s not found above the working directory", path)
+		}
+		dir = parent
+	}
+}
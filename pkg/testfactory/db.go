@@ -0,0 +1,182 @@
+package testfactory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/lib/pq"
+)
+
+// dbDefaults point at the docker-compose database from the host, for
+// TEST_POSTGRES=external.
+var dbDefaults = map[string]string{
+	"POSTGRES_HOST":      "localhost",
+	"POSTGRES_PORT":      "5432",
+	"POSTGRES_USER":      "postgres",
+	"POSTGRES_PASSWORD":  "postgres",
+	"POSTGRES_DB":        "microservice_db",
+	"DB_CONNECT_RETRIES": "0",
+}
+
+// postgresImage matches the docker-compose database.
+const postgresImage = "postgres:18"
+
+var postgres struct {
+	once sync.Once
+	env  map[string]string
+	err  error
+}
+
+// DB connects to a Postgres for the test binary, with the schema from
+// scripts/init-db.sql, and closes the connection when the test ends. The
+// first call starts the database in a container (TEST_POSTGRES_IMAGE,
+// default postgres:18), which Main removes once the package's tests are
+// done. With TEST_POSTGRES=external it connects to the database named by
+// the POSTGRES_* variables instead, defaulting to the docker-compose one,
+// and expects the schema to be there. The test fails when no database is
+// available.
+func DB(t testing.TB) *sql.DB {
+	t.Helper()
+	postgres.once.Do(func() {
+		if os.Getenv("TEST_POSTGRES") == "external" {
+			postgres.env = map[string]string{}
+			for k, v := range dbDefaults {
+				if os.Getenv(k) == "" {
+					postgres.env[k] = v
+				}
+			}
+			return
+		}
+		postgres.env, postgres.err = startPostgres()
+	})
+	if postgres.err != nil {
+		t.Fatalf("Database not available: %v", postgres.err)
+	}
+	for k, v := range postgres.env {
+		t.Setenv(k, v)
+	}
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatalf("Database not available: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// startPostgres starts a database with fresh credentials, waits for it and
+// applies the schema.
+func startPostgres() (map[string]string, error) {
+	schema, err := repoFile("scripts/init-db.sql")
+	if err != nil {
+		return nil, err
+	}
+	ddl, err := os.ReadFile(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	password := randomHex(16)
+	image := os.Getenv("TEST_POSTGRES_IMAGE")
+	if image == "" {
+		image = postgresImage
+	}
+	c, err := startContainer(image, "5432", map[string]string{"POSTGRES_PASSWORD": password, "POSTGRES_DB": "test"})
+	if err != nil {
+		return nil, err
+	}
+	host, port, _ := net.SplitHostPort(c.addr)
+
+	cfg := database.Config{
+		Host: host, Port: port, User: "postgres", Password: password, Name: "test",
+		MaxOpenConns: 1,
+		// The image restarts the server once after initialising it, so the
+		// first pings are refused.
+		ConnectRetries: 8, RetryInterval: 250 * time.Millisecond,
+	}
+	db, err := database.ConnectWithConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("wait for %s: %w", image, err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(ddl)); err != nil {
+		return nil, fmt.Errorf("apply %s: %w", schema, err)
+	}
+
+	return map[string]string{
+		"POSTGRES_HOST":      host,
+		"POSTGRES_PORT":      port,
+		"POSTGRES_USER":      cfg.User,
+		"POSTGRES_PASSWORD":  password,
+		"POSTGRES_DB":        cfg.Name,
+		"DB_CONNECT_RETRIES": "0",
+	}, nil
+}
+
+// Row is a table row by column name.
+type Row map[string]any
+
+// quoteTable quotes a schema-qualified table name such as
+// "user_service.users".
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Insert adds row to table and returns its id column. The row is deleted
+// again when the test ends, so tests can seed a shared database.
+func Insert(t testing.TB, db *sql.DB, table string, row Row) int {
+	t.Helper()
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	args := make([]any, len(columns))
+	for i, column := range columns {
+		quoted[i] = pq.QuoteIdentifier(column)
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = row[column]
+	}
+
+	query := "INSERT INTO " + quoteTable(table) + " (" + strings.Join(quoted, ", ") + ") VALUES (" +
+		strings.Join(placeholders, ", ") + ") RETURNING id"
+	var id int
+	if err := db.QueryRowContext(context.Background(), query, args...).Scan(&id); err != nil {
+		t.Fatalf("Failed to seed %s: %v", table, err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec("DELETE FROM "+quoteTable(table)+" WHERE id = $1", id); err != nil {
+			t.Errorf("Failed to remove seeded %s row %d: %v", table, id, err)
+		}
+	})
+	return id
+}
+
+// Truncate empties tables and restarts their id sequences. It removes every
+// row, seeded or not, so with TEST_POSTGRES=external only use it against a
+// database kept for tests.
+func Truncate(t testing.TB, db *sql.DB, tables ...string) {
+	t.Helper()
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		quoted[i] = quoteTable(table)
+	}
+	if _, err := db.Exec("TRUNCATE " + strings.Join(quoted, ", ") + " RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatalf("Failed to truncate %s: %v", strings.Join(tables, ", "), err)
+	}
+}
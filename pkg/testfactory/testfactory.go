@@ -0,0 +1,140 @@
+// Package testfactory builds the types services exchange through
+// pkg/clients with sensible defaults, so tests only spell out the fields
+// they care about, and sets up tests that run against a real database.
+//
+// Builders take functional options, applied in order:
+//
+//	order := testfactory.Order(testfactory.ForUser(7), testfactory.WithItems(
+//		testfactory.Item(testfactory.SKU("SKU-002"), testfactory.Quantity(3)),
+//	))
+//
+// Any func(*T) is an option, so one-off fields need no helper:
+//
+//	user := testfactory.User(func(u *clients.User) { u.Username = "ada" })
+package testfactory
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+)
+
+// Option changes one field of a built value.
+type Option[T any] func(*T)
+
+// Time is the timestamp builders set, so built values compare equal across
+// runs.
+var Time = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+var seq atomic.Int64
+
+// next returns a number no other builder call in this test binary has
+// returned, for IDs and unique fields.
+func next() int {
+	return int(seq.Add(1))
+}
+
+func build[T any](v T, opts []Option[T]) *T {
+	for _, opt := range opts {
+		opt(&v)
+	}
+	return &v
+}
+
+// User is a user with a unique ID, email and username.
+func User(opts ...Option[clients.User]) *clients.User {
+	n := next()
+	return build(clients.User{
+		ID:       n,
+		Email:    fmt.Sprintf("user%d@example.com", n),
+		Username: fmt.Sprintf("user%d", n),
+	}, opts)
+}
+
+func UserID(id int) Option[clients.User] {
+	return func(u *clients.User) { u.ID = id }
+}
+
+func Email(email string) Option[clients.User] {
+	return func(u *clients.User) { u.Email = email }
+}
+
+// Item is an order line for one SKU-001, sold by the each at 1999 cents.
+func Item(opts ...Option[clients.OrderItem]) clients.OrderItem {
+	return *build(clients.OrderItem{SKU: "SKU-001", Unit: "each", Quantity: 1, UnitPriceCents: 1999}, opts)
+}
+
+func SKU(sku string) Option[clients.OrderItem] {
+	return func(i *clients.OrderItem) { i.SKU = sku }
+}
+
+func Quantity(n int) Option[clients.OrderItem] {
+	return func(i *clients.OrderItem) { i.Quantity = n }
+}
+
+func UnitPrice(cents int64) Option[clients.OrderItem] {
+	return func(i *clients.OrderItem) { i.UnitPriceCents = cents }
+}
+
+// Order is a pending order for user 1 with a unique ID and one default
+// Item. TotalCents is the sum of its items unless an option sets it.
+func Order(opts ...Option[clients.Order]) *clients.Order {
+	o := build(clients.Order{
+		ID:        next(),
+		UserID:    1,
+		Status:    "pending",
+		Items:     []clients.OrderItem{Item()},
+		CreatedAt: Time,
+		UpdatedAt: Time,
+	}, opts)
+	if o.TotalCents == 0 {
+		for _, item := range o.Items {
+			o.TotalCents += int64(item.Quantity) * item.UnitPriceCents
+		}
+	}
+	return o
+}
+
+func OrderID(id int) Option[clients.Order] {
+	return func(o *clients.Order) { o.ID = id }
+}
+
+func ForUser(id int) Option[clients.Order] {
+	return func(o *clients.Order) { o.UserID = id }
+}
+
+func OrderStatus(status string) Option[clients.Order] {
+	return func(o *clients.Order) { o.Status = status }
+}
+
+func WithItems(items ...clients.OrderItem) Option[clients.Order] {
+	return func(o *clients.Order) { o.Items = items }
+}
+
+// Notification is an email already sent to a unique recipient, not tied to
+// a user.
+func Notification(opts ...Option[clients.Notification]) *clients.Notification {
+	n := next()
+	sent := Time
+	return build(clients.Notification{
+		ID:        n,
+		Recipient: fmt.Sprintf("user%d@example.com", n),
+		Channel:   "email",
+		Subject:   "Test notification",
+		Body:      "This is a test notification.",
+		Status:    "sent",
+		CreatedAt: Time,
+		SentAt:    &sent,
+	}, opts)
+}
+
+// ToUser ties the notification to a user.
+func ToUser(id int) Option[clients.Notification] {
+	return func(n *clients.Notification) { n.UserID = &id }
+}
+
+func NotificationStatus(status string) Option[clients.Notification] {
+	return func(n *clients.Notification) { n.Status = status }
+}
@@ -0,0 +1,39 @@
+package testfactory
+
+import (
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+)
+
+func TestBuilders(t *testing.T) {
+	a, b := User(), User(Email("ada@example.com"))
+	if a.ID == b.ID || a.Username == b.Username {
+		t.Errorf("Expected users to be unique, got: %+v and %+v", a, b)
+	}
+	if b.Email != "ada@example.com" {
+		t.Errorf("Expected the option to set the email, got: %s", b.Email)
+	}
+
+	order := Order(ForUser(7), WithItems(Item(), Item(SKU("SKU-002"), Quantity(3), UnitPrice(500))))
+	if order.UserID != 7 || order.Status != "pending" || len(order.Items) != 2 {
+		t.Errorf("Expected a pending order for user 7 with two items, got: %+v", order)
+	}
+	if order.TotalCents != 1999+3*500 {
+		t.Errorf("Expected the total to be summed from the items, got: %d", order.TotalCents)
+	}
+	if o := Order(func(o *clients.Order) { o.TotalCents = 42 }); o.TotalCents != 42 {
+		t.Errorf("Expected an explicit total to be kept, got: %d", o.TotalCents)
+	}
+
+	n := Notification(ToUser(3), NotificationStatus("failed"))
+	if n.UserID == nil || *n.UserID != 3 || n.Status != "failed" || n.Channel != "email" {
+		t.Errorf("Expected a failed email to user 3, got: %+v", n)
+	}
+}
+
+func TestQuoteTable(t *testing.T) {
+	if got := quoteTable("user_service.users"); got != `"user_service"."users"` {
+		t.Errorf(`Expected "user_service"."users", got: %s`, got)
+	}
+}
@@ -0,0 +1,238 @@
+// Package tlsutil loads the certificates services use to serve HTTPS and to
+// call each other over mutual TLS. Certificates are read from PEM files and
+// re-read when the files change, so they can be rotated without a restart.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+)
+
+// reloadInterval is how often the files are checked for changes, at most.
+const reloadInterval = time.Minute
+
+// Files names the PEM files of one side of a connection.
+type Files struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the other side. A server requires client certificates
+	// signed by it, which makes the connection mutual TLS; a client trusts
+	// servers signed by it instead of the system roots.
+	CAFile string
+}
+
+// FilesFromEnv reads prefix+"CERT_FILE", prefix+"KEY_FILE" and
+// prefix+"CA_FILE", e.g. TLS_CERT_FILE for prefix "TLS_".
+func FilesFromEnv(prefix string) Files {
+	return Files{
+		CertFile: config.GetEnv(prefix+"CERT_FILE", ""),
+		KeyFile:  config.GetEnv(prefix+"KEY_FILE", ""),
+		CAFile:   config.GetEnv(prefix+"CA_FILE", ""),
+	}
+}
+
+func (f Files) Enabled() bool {
+	return f.CertFile != "" || f.KeyFile != "" || f.CAFile != ""
+}
+
+// Certs holds the loaded files. If a reload fails, for example because a
+// rotation has written the certificate but not yet the key, the error is
+// logged and the previous certificates stay in use.
+type Certs struct {
+	files Files
+	now   func() time.Time
+	logf  func(format string, args ...any)
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes []time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+// Load reads files, failing if they cannot be read or do not match.
+func Load(files Files) (*Certs, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("a certificate file needs a key file, and the other way round")
+	}
+	c := &Certs{files: files, now: time.Now, logf: log.Printf}
+	modTimes, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTimes); err != nil {
+		return nil, err
+	}
+	c.checked = c.now()
+	return c, nil
+}
+
+// ServerFromEnv loads the certificate a service serves HTTPS with from
+// TLS_CERT_FILE and TLS_KEY_FILE, requiring client certificates signed by
+// TLS_CA_FILE when set. It returns nil when none of them are set.
+func ServerFromEnv() (*Certs, error) {
+	files := FilesFromEnv("TLS_")
+	if !files.Enabled() {
+		return nil, nil
+	}
+	if files.CertFile == "" {
+		return nil, errors.New("TLS_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	return Load(files)
+}
+
+func (c *Certs) paths() []string {
+	var paths []string
+	for _, path := range []string{c.files.CertFile, c.files.KeyFile, c.files.CAFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func (c *Certs) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, path := range c.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (c *Certs) load(modTimes []time.Time) error {
+	var cert *tls.Certificate
+	if c.files.CertFile != "" {
+		loaded, err := tls.LoadX509KeyPair(c.files.CertFile, c.files.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &loaded
+	}
+	var pool *x509.CertPool
+	if c.files.CAFile != "" {
+		pem, err := os.ReadFile(c.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.files.CAFile)
+		}
+	}
+	c.cert, c.pool, c.modTimes = cert, pool, modTimes
+	return nil
+}
+
+// current returns the certificate and CA pool, first reloading them if the
+// files changed since they were last checked.
+func (c *Certs) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := c.now(); now.Sub(c.checked) >= reloadInterval {
+		c.checked = now
+		if err := c.reload(); err != nil {
+			c.logf("Failed to reload TLS certificates, keeping the current ones: %v", err)
+		}
+	}
+	return c.cert, c.pool
+}
+
+func (c *Certs) reload() error {
+	modTimes, err := c.stat()
+	if err != nil {
+		return err
+	}
+	for i, t := range modTimes {
+		if !t.Equal(c.modTimes[i]) {
+			if err := c.load(modTimes); err != nil {
+				return err
+			}
+			c.logf("Reloaded TLS certificates from %v", c.paths())
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *Certs) certificate() (*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
+
+// ServerConfig serves the certificate and, when there is a CA, requires and
+// verifies a client certificate signed by it.
+func (c *Certs) ServerConfig() *tls.Config {
+	base := func() *tls.Config {
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return c.certificate() },
+		}
+	}
+	cfg := base()
+	if c.files.CAFile != "" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		// The CA pool is per connection, so a rotated CA applies to new
+		// connections without restarting the listener.
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, pool := c.current()
+			conn := base()
+			conn.ClientAuth = tls.RequireAndVerifyClientCert
+			conn.ClientCAs = pool
+			return conn, nil
+		}
+	}
+	return cfg
+}
+
+// ClientConfig presents the certificate, when there is one, to servers that
+// ask for it, and verifies servers against the CA, when there is one, or
+// the system roots otherwise.
+func (c *Certs) ClientConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.files.CertFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return c.certificate() }
+	}
+	if c.files.CAFile != "" {
+		// The standard verification only takes a fixed pool, so it is
+		// replaced by the same checks against the current one.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = c.verifyServer
+	}
+	return cfg
+}
+
+func (c *Certs) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	_, pool := c.current()
+	opts := x509.VerifyOptions{Roots: pool, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// ListenAndServe serves server over TLS with certs, or over plain HTTP when
+// certs is nil.
+func ListenAndServe(server *http.Server, certs *Certs) error {
+	if certs == nil {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = certs.ServerConfig()
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,187 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newAuthority(t *testing.T) *authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &authority{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for name signed by a, and its key, to dir.
+func (a *authority) issue(t *testing.T, dir, name string, serial int64) Files {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	files := Files{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	write(t, files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	write(t, files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	write(t, files.CAFile, a.pem)
+	return files
+}
+
+func write(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func newServer(t *testing.T, certs *Certs) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = certs.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newClient(t *testing.T, files Files) *http.Client {
+	t.Helper()
+	certs, err := Load(files)
+	if err != nil {
+		t.Fatalf("Failed to load client files: %v", err)
+	}
+	// httptest listens on 127.0.0.1; the server certificate is for
+	// "localhost", so dial the listener under that name.
+	tlsConfig := certs.ClientConfig()
+	tlsConfig.ServerName = "localhost"
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	serverCerts, err := Load(ca.issue(t, dir, "localhost", 2))
+	if err != nil {
+		t.Fatalf("Failed to load server files: %v", err)
+	}
+	server := newServer(t, serverCerts)
+
+	resp, err := newClient(t, ca.issue(t, dir, "order-service", 3)).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected a client with a certificate to connect, got: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := newClient(t, Files{CAFile: filepath.Join(dir, "ca.crt")}).Get(server.URL); err == nil {
+		t.Error("Expected a client without a certificate to be refused")
+	}
+
+	other := t.TempDir()
+	if _, err := newClient(t, newAuthority(t).issue(t, other, "order-service", 4)).Get(server.URL); err == nil {
+		t.Error("Expected a client trusting another CA to refuse the server")
+	}
+}
+
+func TestReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	files := ca.issue(t, dir, "localhost", 2)
+	certs, err := Load(files)
+	if err != nil {
+		t.Fatalf("Failed to load files: %v", err)
+	}
+	now := time.Now()
+	certs.now = func() time.Time { return now }
+	certs.logf = t.Logf
+	serial := func() int64 {
+		cert, _ := certs.current()
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Failed to parse certificate: %v", err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	ca.issue(t, dir, "localhost", 5)
+	future := now.Add(time.Hour)
+	for _, path := range []string{files.CertFile, files.KeyFile} {
+		os.Chtimes(path, future, future)
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("Expected the old certificate until the reload interval passes, got serial: %d", got)
+	}
+	now = now.Add(reloadInterval)
+	if got := serial(); got != 5 {
+		t.Errorf("Expected the rotated certificate, got serial: %d", got)
+	}
+
+	write(t, files.KeyFile, []byte("not a key"))
+	os.Chtimes(files.KeyFile, future.Add(time.Hour), future.Add(time.Hour))
+	now = now.Add(reloadInterval)
+	if got := serial(); got != 5 {
+		t.Errorf("Expected a failed reload to keep the current certificate, got serial: %d", got)
+	}
+}
+
+func TestLoadRejectsIncompleteFiles(t *testing.T) {
+	if _, err := Load(Files{CertFile: "server.crt"}); err == nil {
+		t.Error("Expected a certificate without a key to be rejected")
+	}
+	if _, err := Load(Files{CAFile: filepath.Join(t.TempDir(), "missing.crt")}); err == nil {
+		t.Error("Expected a missing CA file to be rejected")
+	}
+}
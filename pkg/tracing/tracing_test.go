@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/tracing/tracingtest"
+	"github.com/gin-gonic/gin"
+)
+
+func TestTraceCrossesServices(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	spans := tracingtest.Record(t)
+
+	downstream := gin.New()
+	downstream.Use(Middleware("inventory-service"))
+	downstream.GET("/stock/:sku", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	srv := httptest.NewServer(downstream)
+	defer srv.Close()
+
+	client := &http.Client{Transport: Transport(nil)}
+	upstream := gin.New()
+	upstream.Use(Middleware("order-service"))
+	upstream.POST("/orders", func(c *gin.Context) {
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, srv.URL+"/stock/SKU-001", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			c.Status(http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+		c.Status(http.StatusCreated)
+	})
+
+	w := httptest.NewRecorder()
+	upstream.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got: %d", w.Code)
+	}
+
+	create := spans.Span("order-service", "POST /orders")
+	call := spans.Span(ClientScope, "GET /stock/SKU-001")
+	stock := spans.Span("inventory-service", "GET /stock/:sku")
+	spans.AssertWithin(call, create)
+	spans.AssertWithin(stock, create)
+	spans.AssertAttribute(stock, "http.response.status_code", "200")
+	spans.AssertAttribute(create, "http.route", "/orders")
+}
@@ -0,0 +1,91 @@
+// Package tracingtest collects spans in memory so tests can assert on the
+// path a request took through the services, e.g. that creating an order
+// called inventory within the same trace.
+package tracingtest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type Recorder struct {
+	t        testing.TB
+	recorder *tracetest.SpanRecorder
+}
+
+// Record installs an in-memory tracer provider for the rest of the test.
+// The provider is global, so tests using it must not run in parallel.
+func Record(t testing.TB) *Recorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		provider.Shutdown(context.Background())
+	})
+	return &Recorder{t: t, recorder: recorder}
+}
+
+// Spans returns the spans that have ended, in the order they ended.
+func (r *Recorder) Spans() []sdktrace.ReadOnlySpan {
+	return r.recorder.Ended()
+}
+
+// Span returns the first ended span named name recorded under scope, the
+// service name for server spans. It fails the test if there is none.
+func (r *Recorder) Span(scope, name string) sdktrace.ReadOnlySpan {
+	r.t.Helper()
+	var seen []string
+	for _, s := range r.Spans() {
+		if s.InstrumentationScope().Name == scope && s.Name() == name {
+			return s
+		}
+		seen = append(seen, s.InstrumentationScope().Name+": "+s.Name())
+	}
+	r.t.Fatalf("Expected a %q span from %s, got: [%s]", name, scope, strings.Join(seen, ", "))
+	return nil
+}
+
+// AssertWithin checks that span was started inside ancestor, directly or
+// through other spans. Across services this only holds if trace context was
+// propagated.
+func (r *Recorder) AssertWithin(span, ancestor sdktrace.ReadOnlySpan) {
+	r.t.Helper()
+	byID := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range r.Spans() {
+		byID[s.SpanContext().SpanID().String()] = s
+	}
+	for s := span; s != nil; s = byID[s.Parent().SpanID().String()] {
+		if s.Parent().SpanID() == ancestor.SpanContext().SpanID() && s.SpanContext().TraceID() == ancestor.SpanContext().TraceID() {
+			return
+		}
+		if !s.Parent().IsValid() {
+			break
+		}
+	}
+	r.t.Errorf("Expected %q to be within %q, got trace %s parent %s", span.Name(), ancestor.Name(),
+		span.SpanContext().TraceID(), span.Parent().SpanID())
+}
+
+// AssertAttribute checks that span has attribute key set to want, compared
+// in its string form.
+func (r *Recorder) AssertAttribute(span sdktrace.ReadOnlySpan, key, want string) {
+	r.t.Helper()
+	for _, kv := range span.Attributes() {
+		if kv.Key == attribute.Key(key) {
+			if got := kv.Value.Emit(); got != want {
+				r.t.Errorf("Expected %s on %q to be %q, got: %q", key, span.Name(), want, got)
+			}
+			return
+		}
+	}
+	r.t.Errorf("Expected %q to have attribute %s", span.Name(), key)
+}
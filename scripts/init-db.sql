@@ -1,19 +1,1786 @@
 -- User Service
 CREATE SCHEMA IF NOT EXISTS user_service;
 
+-- Users Service - Organizations Table
+CREATE TABLE IF NOT EXISTS user_service.organizations (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
 -- Users Service - Users Table
 CREATE TABLE IF NOT EXISTS user_service.users (
     id SERIAL PRIMARY KEY,
-    email VARCHAR(255) UNIQUE NOT NULL,
-    username VARCHAR(255) UNIQUE NOT NULL,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    email VARCHAR(255) NOT NULL,
+    username VARCHAR(255) NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
     created_at TIMESTAMPTZ DEFAULT NOW(),
     first_name VARCHAR(255),
-    last_name VARCHAR(255)
+    last_name VARCHAR(255),
+    org_id INTEGER REFERENCES user_service.organizations(id),
+    org_role VARCHAR(32) NOT NULL DEFAULT 'member',
+    phone TEXT, -- encrypted
+    avatar_url TEXT,
+    locale VARCHAR(16),
+    status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'deactivated', 'deleted')),
+    deactivated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    -- When the user proved they own email
+    verified_at TIMESTAMPTZ,
+    -- Bumped on every update; sent as the ETag and checked against If-Match
+    version BIGINT NOT NULL DEFAULT 1
+);
+
+-- Users Service - Bump the row's version on every update
+CREATE OR REPLACE FUNCTION user_service.bump_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_bump_version ON user_service.users;
+CREATE TRIGGER users_bump_version
+    BEFORE UPDATE ON user_service.users
+    FOR EACH ROW EXECUTE FUNCTION user_service.bump_version();
+
+-- Users Service - Emails and usernames are unique per tenant regardless of case
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_email_key
+    ON user_service.users (tenant_id, lower(email));
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_username_key
+    ON user_service.users (tenant_id, lower(username));
+
+-- Users Service - Trigram indexes behind GET /users/search, for fragments and near misses
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS idx_users_email_trgm
+    ON user_service.users USING gin (email gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_username_trgm
+    ON user_service.users USING gin (username gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_name_trgm
+    ON user_service.users USING gin ((coalesce(first_name, '') || ' ' || coalesce(last_name, '')) gin_trgm_ops);
+
+-- Users Service - Profile Requirements Table
+CREATE TABLE IF NOT EXISTS user_service.profile_requirements (
+    org_id INTEGER PRIMARY KEY REFERENCES user_service.organizations(id),
+    fields TEXT[] NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Users Service - Profile Nudges Table
+CREATE TABLE IF NOT EXISTS user_service.profile_nudges (
+    user_id INTEGER PRIMARY KEY REFERENCES user_service.users(id),
+    last_nudged_at TIMESTAMPTZ NOT NULL
+);
+
+-- Users Service - Public Profiles Table
+CREATE TABLE IF NOT EXISTS user_service.public_profiles (
+    user_id INTEGER PRIMARY KEY REFERENCES user_service.users(id) ON DELETE CASCADE,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    -- The profile fields shown to anyone, such as first_name or avatar_url
+    fields TEXT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Users Service - User Roles Table
+CREATE TABLE IF NOT EXISTS user_service.user_roles (
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    role VARCHAR(32) NOT NULL CHECK (role IN ('admin', 'customer', 'service', 'warehouse')),
+    granted_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, role)
+);
+
+-- Users Service - Account recovery codes (SHA-256 of the normalized code; shown to the user once)
+CREATE TABLE IF NOT EXISTS user_service.recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMPTZ,
+    UNIQUE (user_id, code_hash)
+);
+
+-- Users Service - Security questions, asked alongside a recovery code (answers bcrypt-hashed)
+CREATE TABLE IF NOT EXISTS user_service.security_questions (
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    position SMALLINT NOT NULL,
+    question VARCHAR(255) NOT NULL,
+    answer_hash VARCHAR(255) NOT NULL,
+    PRIMARY KEY (user_id, position)
+);
+
+-- Users Service - Recovery attempts, for locking out guessing
+CREATE TABLE IF NOT EXISTS user_service.recovery_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    succeeded BOOLEAN NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS recovery_attempts_user_idx ON user_service.recovery_attempts (user_id, created_at);
+
+-- Users Service - Password reset links; only the token's hash is kept
+CREATE TABLE IF NOT EXISTS user_service.password_resets (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS password_resets_user_idx ON user_service.password_resets (user_id, created_at);
+
+-- Users Service - Address book; at most one default address per user
+CREATE TABLE IF NOT EXISTS user_service.addresses (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    label VARCHAR(64),
+    -- recipient through postal_code and phone are encrypted
+    recipient TEXT NOT NULL,
+    line1 TEXT NOT NULL,
+    line2 TEXT,
+    city TEXT NOT NULL,
+    region TEXT,
+    postal_code TEXT,
+    country CHAR(2) NOT NULL,
+    phone TEXT,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS addresses_user_idx ON user_service.addresses (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_one_default_idx ON user_service.addresses (user_id) WHERE is_default;
+
+-- Users Service - Bulk role changes, applied in the background to the users a filter matched
+CREATE TABLE IF NOT EXISTS user_service.role_change_jobs (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    action VARCHAR(16) NOT NULL CHECK (action IN ('grant', 'revoke')),
+    role VARCHAR(32) NOT NULL CHECK (role IN ('admin', 'customer', 'service', 'warehouse')),
+    filter JSONB NOT NULL,
+    reason TEXT NOT NULL,
+    actor VARCHAR(128) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'completed', 'rolling_back', 'rolled_back')),
+    total INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS role_change_jobs_unfinished_idx ON user_service.role_change_jobs (id) WHERE status IN ('running', 'rolling_back');
+
+-- Users Service - One row per user a bulk role change covers; applied rows are what a rollback reverses
+CREATE TABLE IF NOT EXISTS user_service.role_change_results (
+    job_id INTEGER NOT NULL REFERENCES user_service.role_change_jobs(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'applied', 'unchanged', 'failed', 'rolled_back')),
+    error TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (job_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS role_change_results_status_idx ON user_service.role_change_results (job_id, status);
+
+-- Users Service - Activity feed, recorded from domain events (event_id dedupes redeliveries)
+CREATE TABLE IF NOT EXISTS user_service.activity (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    category VARCHAR(16) NOT NULL CHECK (category IN ('orders', 'shipping', 'notifications', 'profile', 'security')),
+    type VARCHAR(64) NOT NULL,
+    summary TEXT NOT NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    occurred_at TIMESTAMPTZ NOT NULL,
+    event_id VARCHAR(64) NOT NULL UNIQUE
+);
+CREATE INDEX IF NOT EXISTS activity_user_idx ON user_service.activity (user_id, id DESC);
+
+-- Users Service - Data keys that encrypt PII columns, wrapped by a master key from PII_MASTER_KEYS; the newest is current
+CREATE TABLE IF NOT EXISTS user_service.data_keys (
+    id SERIAL PRIMARY KEY,
+    master_key_id VARCHAR(32) NOT NULL,
+    wrapped BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Users Service - PII decryption audit log; kept when the user is deleted
+CREATE TABLE IF NOT EXISTS user_service.pii_access_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(255) NOT NULL,
+    user_id INTEGER NOT NULL,
+    fields TEXT[] NOT NULL,
+    request_id VARCHAR(128),
+    accessed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
+CREATE INDEX IF NOT EXISTS pii_access_log_user_idx ON user_service.pii_access_log (tenant_id, user_id, accessed_at DESC);
+
+-- Users Service - Sign-ins that passed the password check, with their risk; challenged ones count as the user's own only once verified
+CREATE TABLE IF NOT EXISTS user_service.login_history (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    client_ip VARCHAR(45) NOT NULL,
+    user_agent TEXT,
+    country CHAR(2),
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    risk_score SMALLINT NOT NULL DEFAULT 0,
+    reasons TEXT[] NOT NULL DEFAULT '{}',
+    outcome VARCHAR(16) NOT NULL CHECK (outcome IN ('allowed', 'challenged', 'verified')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS login_history_user_idx ON user_service.login_history (user_id, created_at DESC);
+
+-- Users Service - One-time codes confirming challenged sign-ins (SHA-256 of the code)
+CREATE TABLE IF NOT EXISTS user_service.login_challenges (
+    id CHAR(32) PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    login_id BIGINT NOT NULL REFERENCES user_service.login_history(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    verified_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Users Service - Identity provider accounts linked to users
+CREATE TABLE IF NOT EXISTS user_service.user_identities (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, provider, subject)
+);
+
+-- Users Service - Sign-ins waiting for an identity provider's callback (SHA-256 of the state)
+CREATE TABLE IF NOT EXISTS user_service.oidc_states (
+    state_hash CHAR(64) PRIMARY KEY,
+    provider VARCHAR(64) NOT NULL,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    verifier VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Users Service - Sessions, one per sign-in, kept alive by refreshing before expires_at
+CREATE TABLE IF NOT EXISTS user_service.sessions (
+    id VARCHAR(32) PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    client_ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON user_service.sessions (tenant_id, user_id);
+
+-- Users Service - Refresh tokens, rotated on every use (SHA-256 of the token)
+CREATE TABLE IF NOT EXISTS user_service.refresh_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    session_id VARCHAR(32) NOT NULL REFERENCES user_service.sessions(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON user_service.refresh_tokens (session_id);
+
+-- Users Service - Referral codes, one per user, created the first time they look at their referrals
+CREATE TABLE IF NOT EXISTS user_service.referral_codes (
+    user_id INTEGER PRIMARY KEY REFERENCES user_service.users(id) ON DELETE CASCADE,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    code VARCHAR(16) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, code)
+);
+
+-- Users Service - Referrals, one per referred user; first_order_id is set by their first order.placed event
+CREATE TABLE IF NOT EXISTS user_service.referrals (
+    user_id INTEGER PRIMARY KEY REFERENCES user_service.users(id) ON DELETE CASCADE,
+    referrer_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    referred_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    first_order_id INTEGER,
+    first_ordered_at TIMESTAMPTZ,
+    reward_cents BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON user_service.referrals (referrer_id, user_id DESC);
+
+-- Users Service - Store credit ledger; the balance is the sum, and each order earns or reverses a reward once
+CREATE TABLE IF NOT EXISTS user_service.store_credit (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    amount_cents BIGINT NOT NULL,
+    reason VARCHAR(32) NOT NULL CHECK (reason IN ('referral', 'referral_reversed')),
+    order_id INTEGER,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (reason, order_id)
+);
+CREATE INDEX IF NOT EXISTS idx_store_credit_user ON user_service.store_credit (user_id, id DESC);
+
+-- Users Service - Onboarding checklists, one ordered set of steps per tenant; tenants without rows use the defaults
+CREATE TABLE IF NOT EXISTS user_service.onboarding_steps (
+    tenant_id VARCHAR(63) NOT NULL,
+    position INTEGER NOT NULL,
+    key VARCHAR(64) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    hint VARCHAR(1000) NOT NULL DEFAULT '',
+    trigger VARCHAR(32) NOT NULL CHECK (trigger IN ('email_verified', 'profile_complete', 'first_order')),
+    -- Hours after sign-up before a user who has not done the step is nudged; 0 never nudges
+    nudge_after_hours INTEGER NOT NULL DEFAULT 0 CHECK (nudge_after_hours >= 0),
+    PRIMARY KEY (tenant_id, position),
+    UNIQUE (tenant_id, key)
+);
+
+-- Users Service - Onboarding progress, the first time each user fired each trigger
+CREATE TABLE IF NOT EXISTS user_service.onboarding_progress (
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    trigger VARCHAR(32) NOT NULL,
+    completed_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, trigger)
+);
+
+-- Users Service - Onboarding nudges, so each user is nudged about each step once
+CREATE TABLE IF NOT EXISTS user_service.onboarding_nudges (
+    user_id INTEGER NOT NULL REFERENCES user_service.users(id) ON DELETE CASCADE,
+    step_key VARCHAR(64) NOT NULL,
+    nudged_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, step_key)
+);
+
+-- Users Service - Audit log of every mutating request, with the fields it changed where cheap to tell
+CREATE TABLE IF NOT EXISTS user_service.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(255) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    entity_type VARCHAR(64),
+    entity_id VARCHAR(255),
+    status_code INTEGER NOT NULL,
+    request_id VARCHAR(128),
+    client_ip VARCHAR(45),
+    changes JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON user_service.audit_log (tenant_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON user_service.audit_log (tenant_id, entity_type, entity_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON user_service.audit_log (tenant_id, actor, id DESC);
+
+-- Users Service - Field-level changes to each account and the rows it owns, written by
+-- capture_account_change. Values of redacted columns are kept only as "[redacted]"
+CREATE TABLE IF NOT EXISTS user_service.account_changes (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL, -- no foreign key, so the trail outlives the account
+    entity VARCHAR(64) NOT NULL,
+    entity_key VARCHAR(255),
+    operation VARCHAR(16) NOT NULL CHECK (operation IN ('insert', 'update', 'delete')),
+    actor VARCHAR(128) NOT NULL,
+    request_id VARCHAR(128),
+    changes JSONB NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS account_changes_user_idx ON user_service.account_changes (tenant_id, user_id, id DESC);
+
+-- Users Service - Capture account changes. The arguments are the column naming the user,
+-- the column naming the row within the account ('' for none) and a comma-separated list of
+-- columns to redact. Writers name themselves with set_config('app.actor', ..., true) and
+-- set_config('app.request_id', ..., true); setting app.capture to 'off' skips the capture,
+-- for rewrites that change no data such as re-encryption
+CREATE OR REPLACE FUNCTION user_service.capture_account_change() RETURNS trigger AS $$
+DECLARE
+    old_row JSONB := CASE WHEN TG_OP <> 'INSERT' THEN to_jsonb(OLD) END;
+    new_row JSONB := CASE WHEN TG_OP <> 'DELETE' THEN to_jsonb(NEW) END;
+    row_data JSONB := COALESCE(new_row, old_row);
+    redacted TEXT[] := string_to_array(TG_ARGV[2], ',');
+    account INTEGER := (row_data ->> TG_ARGV[0])::INTEGER;
+    diff JSONB := '{}';
+    field TEXT;
+    old_value JSONB;
+    new_value JSONB;
+BEGIN
+    IF current_setting('app.capture', true) = 'off' THEN
+        RETURN NULL;
+    END IF;
+    FOR field IN SELECT jsonb_object_keys(row_data) LOOP
+        CONTINUE WHEN field IN ('id', 'user_id', 'tenant_id', 'created_at', 'updated_at', 'granted_at', 'version');
+        old_value := NULLIF(old_row -> field, 'null');
+        new_value := NULLIF(new_row -> field, 'null');
+        CONTINUE WHEN old_value IS NOT DISTINCT FROM new_value;
+        IF field = ANY (redacted) THEN
+            old_value := CASE WHEN old_value IS NOT NULL THEN '"[redacted]"' END;
+            new_value := CASE WHEN new_value IS NOT NULL THEN '"[redacted]"' END;
+        END IF;
+        diff := diff || jsonb_build_object(field, jsonb_strip_nulls(jsonb_build_object('before', old_value, 'after', new_value)));
+    END LOOP;
+    IF diff = '{}' THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO user_service.account_changes (tenant_id, user_id, entity, entity_key, operation, actor, request_id, changes)
+    VALUES (
+        COALESCE(row_data ->> 'tenant_id', (SELECT tenant_id FROM user_service.users WHERE id = account), 'default'),
+        account,
+        TG_TABLE_NAME,
+        CASE WHEN TG_ARGV[1] <> '' THEN row_data ->> TG_ARGV[1] END,
+        lower(TG_OP),
+        COALESCE(NULLIF(current_setting('app.actor', true), ''), 'system'),
+        NULLIF(current_setting('app.request_id', true), ''),
+        diff
+    );
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_capture_change ON user_service.users;
+CREATE TRIGGER users_capture_change
+    AFTER INSERT OR UPDATE OR DELETE ON user_service.users
+    FOR EACH ROW EXECUTE FUNCTION user_service.capture_account_change('id', '', 'password_hash,phone');
+
+DROP TRIGGER IF EXISTS user_roles_capture_change ON user_service.user_roles;
+CREATE TRIGGER user_roles_capture_change
+    AFTER INSERT OR UPDATE OR DELETE ON user_service.user_roles
+    FOR EACH ROW EXECUTE FUNCTION user_service.capture_account_change('user_id', 'role', '');
+
+DROP TRIGGER IF EXISTS addresses_capture_change ON user_service.addresses;
+CREATE TRIGGER addresses_capture_change
+    AFTER INSERT OR UPDATE OR DELETE ON user_service.addresses
+    FOR EACH ROW EXECUTE FUNCTION user_service.capture_account_change('user_id', 'id', 'recipient,line1,line2,city,region,postal_code,phone');
+
+DROP TRIGGER IF EXISTS security_questions_capture_change ON user_service.security_questions;
+CREATE TRIGGER security_questions_capture_change
+    AFTER INSERT OR UPDATE OR DELETE ON user_service.security_questions
+    FOR EACH ROW EXECUTE FUNCTION user_service.capture_account_change('user_id', 'position', 'answer_hash');
+
+DROP TRIGGER IF EXISTS user_identities_capture_change ON user_service.user_identities;
+CREATE TRIGGER user_identities_capture_change
+    AFTER INSERT OR UPDATE OR DELETE ON user_service.user_identities
+    FOR EACH ROW EXECUTE FUNCTION user_service.capture_account_change('user_id', 'provider', '');
+
+-- Random data (every seeded user's password is "password123")
+INSERT INTO user_service.organizations (name) VALUES
+('Acme Corp')
+ON CONFLICT (name) DO NOTHING;
 
--- Random data
 INSERT INTO user_service.users (email, username, password_hash, first_name, last_name) VALUES
-('john.doe@example.com', 'johndoe', 'hashed_password_1', 'John', 'Doe'),
-('jane.doe@example.com', 'janedoe', 'hashed_password_2', 'Jane', 'Doe')
-ON CONFLICT (email) DO NOTHING;
\ No newline at end of file
+('john.doe@example.com', 'johndoe', '$2a$10$h6KWOWfaO4MEeK0Dteo12OJRjvmKcCxPIKuCsjMTAgEYKwRqxrfD.', 'John', 'Doe'),
+('jane.doe@example.com', 'janedoe', '$2a$10$h6KWOWfaO4MEeK0Dteo12OJRjvmKcCxPIKuCsjMTAgEYKwRqxrfD.', 'Jane', 'Doe')
+ON CONFLICT (tenant_id, lower(email)) DO NOTHING;
+
+INSERT INTO user_service.users (email, username, password_hash, first_name, last_name, org_id, org_role)
+SELECT 'procurement@acme.example.com', 'acmeadmin', '$2a$10$h6KWOWfaO4MEeK0Dteo12OJRjvmKcCxPIKuCsjMTAgEYKwRqxrfD.', 'Ada', 'Admin', id, 'admin'
+FROM user_service.organizations WHERE name = 'Acme Corp'
+ON CONFLICT (tenant_id, lower(email)) DO NOTHING;
+
+INSERT INTO user_service.users (email, username, password_hash, first_name, last_name) VALUES
+('admin@example.com', 'admin', '$2a$10$h6KWOWfaO4MEeK0Dteo12OJRjvmKcCxPIKuCsjMTAgEYKwRqxrfD.', 'Site', 'Admin')
+ON CONFLICT (tenant_id, lower(email)) DO NOTHING;
+
+INSERT INTO user_service.user_roles (user_id, role)
+SELECT id, CASE WHEN username = 'admin' THEN 'admin' ELSE 'customer' END FROM user_service.users
+ON CONFLICT DO NOTHING;
+
+-- Order Service
+CREATE SCHEMA IF NOT EXISTS order_service;
+
+-- Order Service - Orders Table
+CREATE TABLE IF NOT EXISTS order_service.orders (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL,
+    org_id INTEGER,
+    status VARCHAR(32) NOT NULL DEFAULT 'pending',
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    subtotal_cents BIGINT NOT NULL DEFAULT 0,
+    shipping_cents BIGINT NOT NULL DEFAULT 0,
+    tax_cents BIGINT NOT NULL DEFAULT 0,
+    total_cents BIGINT NOT NULL DEFAULT 0,
+    fingerprint VARCHAR(64),
+    duplicate_of INTEGER REFERENCES order_service.orders(id),
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    invoice_number VARCHAR(32),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    -- Bumped on every update, and when the order's delivery promise changes; sent as the ETag
+    version BIGINT NOT NULL DEFAULT 1
+);
+
+-- Order Service - Bump the row's version on every update
+CREATE OR REPLACE FUNCTION order_service.bump_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS orders_bump_version ON order_service.orders;
+CREATE TRIGGER orders_bump_version
+    BEFORE UPDATE ON order_service.orders
+    FOR EACH ROW EXECUTE FUNCTION order_service.bump_version();
+
+-- Order Service - Invoice numbers are unique per tenant
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_tenant_invoice
+    ON order_service.orders (tenant_id, invoice_number);
+
+-- Order Service - Last invoice number issued per tenant and fiscal year.
+-- Numbers are taken by incrementing the row inside the paying transaction,
+-- so they stay gapless where a SEQUENCE would not.
+CREATE TABLE IF NOT EXISTS order_service.invoice_sequences (
+    tenant_id VARCHAR(63) NOT NULL,
+    fiscal_year INTEGER NOT NULL,
+    last_number INTEGER NOT NULL CHECK (last_number > 0),
+    PRIMARY KEY (tenant_id, fiscal_year)
+);
+
+-- Order Service - Duplicate lookup by customer and item fingerprint
+CREATE INDEX IF NOT EXISTS idx_orders_user_fingerprint
+    ON order_service.orders (user_id, fingerprint, created_at);
+
+-- Order Service - Per-tenant order listing
+CREATE INDEX IF NOT EXISTS idx_orders_tenant_user
+    ON order_service.orders (tenant_id, user_id);
+
+-- Order Service - Tag filtering
+CREATE INDEX IF NOT EXISTS idx_orders_tags
+    ON order_service.orders USING GIN (tags);
+
+-- Order Service - Admin search, newest first, by status and by total
+CREATE INDEX IF NOT EXISTS idx_orders_tenant_created
+    ON order_service.orders (tenant_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_orders_tenant_status_created
+    ON order_service.orders (tenant_id, status, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_orders_tenant_total
+    ON order_service.orders (tenant_id, total_cents);
+
+-- Order Service - Order searches saved by admins
+CREATE TABLE IF NOT EXISTS order_service.saved_views (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    owner_id INTEGER NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    filter JSONB NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (tenant_id, owner_id, name)
+);
+
+-- Order Service - Order Items Table
+CREATE TABLE IF NOT EXISTS order_service.order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    sku VARCHAR(64) NOT NULL,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    unit VARCHAR(32) NOT NULL DEFAULT 'each',
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price_cents BIGINT NOT NULL CHECK (unit_price_cents >= 0)
+);
+
+-- Order Service - Order lookup by item, for searches by SKU
+CREATE INDEX IF NOT EXISTS idx_order_items_sku
+    ON order_service.order_items (sku, order_id);
+
+-- Order Service - Inventory reservations holding an order's stock until it is paid
+CREATE TABLE IF NOT EXISTS order_service.order_reservations (
+    reservation_id BIGINT PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    sku VARCHAR(64) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_order_reservations_order
+    ON order_service.order_reservations (order_id);
+
+-- Order Service - Per-organization approval thresholds
+CREATE TABLE IF NOT EXISTS order_service.org_approval_policies (
+    org_id INTEGER PRIMARY KEY,
+    threshold_cents BIGINT NOT NULL CHECK (threshold_cents >= 0),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Order Service - Approval requests for org orders above threshold
+CREATE TABLE IF NOT EXISTS order_service.order_approvals (
+    order_id INTEGER PRIMARY KEY REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    org_id INTEGER NOT NULL,
+    status VARCHAR(32) NOT NULL DEFAULT 'pending',
+    decided_by INTEGER,
+    reason TEXT,
+    requested_at TIMESTAMPTZ DEFAULT NOW(),
+    decided_at TIMESTAMPTZ
+);
+
+-- Order Service - Append-only audit trail of order status transitions
+CREATE TABLE IF NOT EXISTS order_service.order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES order_service.orders(id),
+    from_status VARCHAR(32),
+    to_status VARCHAR(32) NOT NULL,
+    actor VARCHAR(128) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Order Service - History lookup by order
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order
+    ON order_service.order_status_history (order_id, created_at);
+
+-- Order Service - Reject changes to recorded transitions. The archive job
+-- alone may delete them, having copied them to the archive in the same
+-- transaction.
+CREATE OR REPLACE FUNCTION order_service.reject_history_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' AND current_setting('order_service.archiving', true) = 'on' THEN
+        RETURN OLD;
+    END IF;
+    RAISE EXCEPTION 'order status history is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS order_status_history_immutable ON order_service.order_status_history;
+CREATE TRIGGER order_status_history_immutable
+    BEFORE UPDATE OR DELETE ON order_service.order_status_history
+    FOR EACH ROW EXECUTE FUNCTION order_service.reject_history_change();
+
+-- Order Service - Generations of the read models projected from the status history.
+-- Each generation's rows live in order_service.<projection>_g<generation>, and the
+-- view order_service.<projection> points at the live one. last_event_id is the
+-- checkpoint: the last history row applied.
+CREATE TABLE IF NOT EXISTS order_service.projection_generations (
+    projection VARCHAR(64) NOT NULL,
+    generation INTEGER NOT NULL,
+    state VARCHAR(16) NOT NULL DEFAULT 'building',
+    last_event_id BIGINT NOT NULL DEFAULT 0,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    swapped_at TIMESTAMPTZ,
+    PRIMARY KEY (projection, generation)
+);
+
+-- Order Service - At most one live and one building generation per projection
+CREATE UNIQUE INDEX IF NOT EXISTS idx_projection_generations_state
+    ON order_service.projection_generations (projection, state) WHERE state <> 'retired';
+
+-- Order Service - Sales reports built in the background, with their file until they expire
+CREATE TABLE IF NOT EXISTS order_service.report_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    format VARCHAR(8) NOT NULL CHECK (format IN ('csv', 'xlsx')),
+    range_from DATE NOT NULL,
+    range_to DATE NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    error TEXT,
+    content BYTEA,
+    size_bytes INTEGER,
+    requested_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ
+);
+
+-- Order Service - Pending reports for the sweep to queue
+CREATE INDEX IF NOT EXISTS idx_report_jobs_pending
+    ON order_service.report_jobs (id) WHERE status = 'pending';
+
+-- Order Service - Completed orders moved out of the hot tables by the archive
+-- job, with their items and status history. Each table has its hot table's
+-- columns, in the same order.
+CREATE TABLE IF NOT EXISTS order_service.orders_archive (
+    LIKE order_service.orders,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_orders_archive_tenant_user
+    ON order_service.orders_archive (tenant_id, user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_orders_archive_tenant_created
+    ON order_service.orders_archive (tenant_id, created_at);
+
+CREATE TABLE IF NOT EXISTS order_service.order_items_archive (
+    LIKE order_service.order_items,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_order_items_archive_order
+    ON order_service.order_items_archive (order_id);
+
+CREATE TABLE IF NOT EXISTS order_service.order_status_history_archive (
+    LIKE order_service.order_status_history,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_order_status_history_archive_order
+    ON order_service.order_status_history_archive (order_id, created_at);
+
+-- Order Service - Hot and archived rows together, for reads that reach back
+-- past the archive cutoff. archived_at is NULL for hot orders.
+CREATE OR REPLACE VIEW order_service.all_orders AS
+    SELECT o.*, NULL::TIMESTAMPTZ AS archived_at FROM order_service.orders o
+    UNION ALL
+    SELECT * FROM order_service.orders_archive;
+
+CREATE OR REPLACE VIEW order_service.all_order_items AS
+    SELECT * FROM order_service.order_items
+    UNION ALL
+    SELECT * FROM order_service.order_items_archive;
+
+CREATE OR REPLACE VIEW order_service.all_order_status_history AS
+    SELECT * FROM order_service.order_status_history
+    UNION ALL
+    SELECT * FROM order_service.order_status_history_archive;
+
+-- Order Service - Why customers cancelled orders, with their tier at the time.
+-- Rows stay here when their order is archived, so order_id may point into
+-- order_service.orders_archive.
+CREATE TABLE IF NOT EXISTS order_service.order_cancellations (
+    order_id INTEGER PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    reason VARCHAR(32) NOT NULL,
+    note TEXT,
+    customer_tier VARCHAR(16) NOT NULL,
+    cancelled_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Order Service - Cancellation reports by period
+CREATE INDEX IF NOT EXISTS idx_order_cancellations_tenant_time
+    ON order_service.order_cancellations (tenant_id, cancelled_at);
+
+-- Order Service - Delivery dates promised at checkout; at_risk_since is set once the promise is alerted on
+CREATE TABLE IF NOT EXISTS order_service.delivery_promises (
+    order_id INTEGER PRIMARY KEY REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    carrier VARCHAR(32) NOT NULL,
+    ship_by TIMESTAMPTZ NOT NULL,
+    promised_date DATE NOT NULL,
+    shipped_at TIMESTAMPTZ,
+    at_risk_since TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS delivery_promises_unshipped_idx
+    ON order_service.delivery_promises (ship_by) WHERE shipped_at IS NULL AND at_risk_since IS NULL;
+
+-- Order Service - The promise is part of the order as read, so changing it bumps the order's version
+CREATE OR REPLACE FUNCTION order_service.bump_order_version() RETURNS trigger AS $$
+BEGIN
+    UPDATE order_service.orders SET version = version + 1 WHERE id = NEW.order_id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS delivery_promises_bump_order_version ON order_service.delivery_promises;
+CREATE TRIGGER delivery_promises_bump_order_version
+    AFTER UPDATE ON order_service.delivery_promises
+    FOR EACH ROW EXECUTE FUNCTION order_service.bump_order_version();
+
+-- Order Service - Wishlists; notify items alert the user once when the SKU is back in stock, optionally holding a reservation for them until hold_expires_at
+CREATE TABLE IF NOT EXISTS order_service.wishlist_items (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL,
+    sku VARCHAR(64) NOT NULL,
+    notify BOOLEAN NOT NULL DEFAULT FALSE,
+    channel VARCHAR(32) NOT NULL DEFAULT 'email',
+    notified_at TIMESTAMPTZ,
+    hold_reservation_id BIGINT,
+    hold_expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, user_id, sku)
+);
+CREATE INDEX IF NOT EXISTS idx_wishlist_items_waiting
+    ON order_service.wishlist_items (tenant_id, sku, created_at) WHERE notify AND notified_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_wishlist_items_holds
+    ON order_service.wishlist_items (hold_expires_at) WHERE hold_reservation_id IS NOT NULL;
+
+-- Order Service - Warehouse pick lists of paid orders, in walking order: by zone, then bin
+CREATE TABLE IF NOT EXISTS order_service.pick_lines (
+    id BIGSERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    sku VARCHAR(64) NOT NULL,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    unit VARCHAR(32) NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    zone VARCHAR(32) NOT NULL,
+    bin VARCHAR(32) NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'picked', 'short')),
+    picked_quantity INTEGER NOT NULL DEFAULT 0 CHECK (picked_quantity >= 0),
+    picked_by VARCHAR(128),
+    picked_at TIMESTAMPTZ,
+    -- When a short line was booked off inventory
+    shortage_reported_at TIMESTAMPTZ,
+    UNIQUE (order_id, position)
+);
+CREATE INDEX IF NOT EXISTS idx_pick_lines_unreported
+    ON order_service.pick_lines (id) WHERE status = 'short' AND shortage_reported_at IS NULL;
+
+-- Order Service - Printable pick lists and packing slips; the slip is reprinted when a shortage is reported
+CREATE TABLE IF NOT EXISTS order_service.fulfillment_documents (
+    order_id INTEGER NOT NULL REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('pick-list', 'packing-slip')),
+    content BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (order_id, kind)
+);
+
+-- Order Service - Public tracking links; tokens name the generation they were issued in, and revoking moves the order to the next
+CREATE TABLE IF NOT EXISTS order_service.tracking_links (
+    order_id INTEGER PRIMARY KEY REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    generation INTEGER NOT NULL DEFAULT 1,
+    revoked_at TIMESTAMPTZ
+);
+
+-- Order Service - Parcels an order ships in; tracking numbers are unique per carrier across tenants, for carrier webhooks
+CREATE TABLE IF NOT EXISTS order_service.shipments (
+    id BIGSERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES order_service.orders(id) ON DELETE CASCADE,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    carrier VARCHAR(32) NOT NULL,
+    tracking_number VARCHAR(64) NOT NULL,
+    status VARCHAR(32) NOT NULL CHECK (status IN ('label_created', 'in_transit', 'out_for_delivery', 'delivered', 'exception', 'returned')),
+    created_by VARCHAR(128),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMPTZ,
+    UNIQUE (carrier, tracking_number)
+);
+CREATE INDEX IF NOT EXISTS idx_shipments_order ON order_service.shipments (order_id);
+
+-- Order Service - Order lines each shipment carries
+CREATE TABLE IF NOT EXISTS order_service.shipment_lines (
+    shipment_id BIGINT NOT NULL REFERENCES order_service.shipments(id) ON DELETE CASCADE,
+    item_id INTEGER NOT NULL REFERENCES order_service.order_items(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (shipment_id, item_id)
+);
+CREATE INDEX IF NOT EXISTS idx_shipment_lines_item ON order_service.shipment_lines (item_id);
+
+-- Order Service - Status checkpoints of each shipment, recorded by hand or by carrier webhook
+CREATE TABLE IF NOT EXISTS order_service.shipment_events (
+    id BIGSERIAL PRIMARY KEY,
+    shipment_id BIGINT NOT NULL REFERENCES order_service.shipments(id) ON DELETE CASCADE,
+    status VARCHAR(32) NOT NULL,
+    location VARCHAR(255),
+    note TEXT,
+    source VARCHAR(16) NOT NULL CHECK (source IN ('manual', 'webhook')),
+    actor VARCHAR(128),
+    occurred_at TIMESTAMPTZ NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_shipment_events_shipment ON order_service.shipment_events (shipment_id, occurred_at);
+
+-- Order Service - Idempotency Keys Table
+CREATE TABLE IF NOT EXISTS order_service.idempotency_keys (
+    scope VARCHAR(128) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    completed BOOLEAN NOT NULL DEFAULT FALSE,
+    status_code INTEGER,
+    content_type VARCHAR(255),
+    body BYTEA,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (scope, key)
+);
+
+-- Order Service - Audit log of every mutating request, with the fields it changed where cheap to tell
+CREATE TABLE IF NOT EXISTS order_service.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(255) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    entity_type VARCHAR(64),
+    entity_id VARCHAR(255),
+    status_code INTEGER NOT NULL,
+    request_id VARCHAR(128),
+    client_ip VARCHAR(45),
+    changes JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON order_service.audit_log (tenant_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON order_service.audit_log (tenant_id, entity_type, entity_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON order_service.audit_log (tenant_id, actor, id DESC);
+
+-- Notification Service
+CREATE SCHEMA IF NOT EXISTS notification_service;
+
+-- Notification Service - Conversation threads grouping notifications to a recipient about one context
+CREATE TABLE IF NOT EXISTS notification_service.notification_threads (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER,
+    recipient VARCHAR(255) NOT NULL,
+    context_type VARCHAR(32),
+    context_id VARCHAR(64),
+    subject VARCHAR(255) NOT NULL,
+    message_count INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_message_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, recipient, context_type, context_id)
+);
+
+-- Notification Service - Threaded inbox listing
+CREATE INDEX IF NOT EXISTS idx_notification_threads_tenant_user
+    ON notification_service.notification_threads (tenant_id, user_id, last_message_at DESC);
+
+-- Notification Service - Notifications Table
+CREATE TABLE IF NOT EXISTS notification_service.notifications (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER,
+    recipient VARCHAR(255) NOT NULL,
+    channel VARCHAR(32) NOT NULL DEFAULT 'email',
+    type VARCHAR(32) NOT NULL DEFAULT 'general',
+    subject VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    status VARCHAR(32) NOT NULL DEFAULT 'queued',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    sent_at TIMESTAMPTZ,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_attempt_at TIMESTAMPTZ,
+    context_type VARCHAR(32),
+    context_id VARCHAR(64),
+    reply_token CHAR(32) UNIQUE,
+    thread_id BIGINT NOT NULL REFERENCES notification_service.notification_threads(id),
+    deliver_after TIMESTAMPTZ,
+    provider VARCHAR(64),
+    last_error TEXT,
+    digest_id INTEGER REFERENCES notification_service.notifications(id)
+);
+
+-- Notification Service - Deferred notifications waiting out quiet hours
+CREATE INDEX IF NOT EXISTS idx_notifications_deferred
+    ON notification_service.notifications (deliver_after) WHERE status = 'deferred';
+
+-- Notification Service - Batched notifications waiting for their recipient's digest
+CREATE INDEX IF NOT EXISTS idx_notifications_batched
+    ON notification_service.notifications (deliver_after) WHERE status = 'batched';
+
+-- Notification Service - Failed notifications the retry sweep dead-letters once out of attempts
+CREATE INDEX IF NOT EXISTS idx_notifications_failed
+    ON notification_service.notifications (attempts) WHERE status = 'failed';
+
+-- Notification Service - Every delivery attempt of a notification, with the provider that made it
+CREATE TABLE IF NOT EXISTS notification_service.notification_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    notification_id INTEGER NOT NULL REFERENCES notification_service.notifications(id),
+    status VARCHAR(32) NOT NULL,
+    provider VARCHAR(64) NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_attempts_notification
+    ON notification_service.notification_attempts (notification_id, id);
+
+-- Notification Service - Dead-letter queue of notifications that failed every attempt, kept until re-driven
+CREATE TABLE IF NOT EXISTS notification_service.dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    notification_id INTEGER NOT NULL REFERENCES notification_service.notifications(id),
+    provider VARCHAR(64) NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL,
+    dead_lettered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    redriven_at TIMESTAMPTZ
+);
+
+-- Notification Service - Pending dead letters by tenant and provider
+CREATE INDEX IF NOT EXISTS idx_dead_letters_pending
+    ON notification_service.dead_letters (tenant_id, provider, id) WHERE redriven_at IS NULL;
+
+-- Notification Service - Notifications in a thread
+CREATE INDEX IF NOT EXISTS idx_notifications_thread
+    ON notification_service.notifications (thread_id, id);
+
+-- Notification Service - Per-tenant notification listing
+CREATE INDEX IF NOT EXISTS idx_notifications_tenant_user
+    ON notification_service.notifications (tenant_id, user_id);
+
+-- Notification Service - Per-user opt-outs by notification type and channel; absent rows are opted in
+CREATE TABLE IF NOT EXISTS notification_service.notification_preferences (
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    channel VARCHAR(32) NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    digest VARCHAR(16) CHECK (digest IN ('hourly', 'daily')),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tenant_id, user_id, type, channel)
+);
+
+-- Notification Service - Devices users get push notifications (fcm, apns) or SMS (a phone number as token) on
+CREATE TABLE IF NOT EXISTS notification_service.devices (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL,
+    platform VARCHAR(8) NOT NULL CHECK (platform IN ('fcm', 'apns', 'sms')),
+    token VARCHAR(4096) NOT NULL,
+    name VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    registered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, platform, token)
+);
+CREATE INDEX IF NOT EXISTS idx_devices_user ON notification_service.devices (tenant_id, user_id);
+
+-- Notification Service - Per-user quiet hours, local times in time_zone; empty channels means all
+CREATE TABLE IF NOT EXISTS notification_service.quiet_hours (
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL,
+    starts_at TIME NOT NULL,
+    ends_at TIME NOT NULL,
+    time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    channels TEXT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tenant_id, user_id)
+);
+
+-- Notification Service - Compliance suppression lists checked before every send; a NULL tenant_id is the global list
+CREATE TABLE IF NOT EXISTS notification_service.suppressions (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63),
+    channel VARCHAR(32) NOT NULL,
+    recipient VARCHAR(320) NOT NULL,
+    reason VARCHAR(32) NOT NULL CHECK (reason IN ('unsubscribed', 'bounced', 'complained', 'legal_hold')),
+    source VARCHAR(16) NOT NULL,
+    note VARCHAR(500) NOT NULL DEFAULT '',
+    created_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Notification Service - One entry per list, recipient and reason
+CREATE UNIQUE INDEX IF NOT EXISTS idx_suppressions_entry
+    ON notification_service.suppressions ((COALESCE(tenant_id, '')), channel, recipient, reason);
+
+-- Notification Service - Suppression lookups on send
+CREATE INDEX IF NOT EXISTS idx_suppressions_recipient
+    ON notification_service.suppressions (channel, recipient);
+
+-- Notification Service - Webhook subscriptions of external integrators, per tenant
+CREATE TABLE IF NOT EXISTS notification_service.webhook_subscriptions (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    url VARCHAR(2048) NOT NULL,
+    events TEXT[] NOT NULL,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    -- Signs deliveries; only shown when created or rotated
+    secret VARCHAR(128) NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by VARCHAR(128),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_subscriptions_tenant
+    ON notification_service.webhook_subscriptions (tenant_id) WHERE active;
+
+-- Notification Service - Webhook deliveries, one per subscription and event
+CREATE TABLE IF NOT EXISTS notification_service.webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT NOT NULL REFERENCES notification_service.webhook_subscriptions(id) ON DELETE CASCADE,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    event_id VARCHAR(64) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    -- The event envelope, exactly as it is sent
+    payload JSONB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ,
+    last_status_code INTEGER,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMPTZ,
+    UNIQUE (subscription_id, event_id)
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due
+    ON notification_service.webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription
+    ON notification_service.webhook_deliveries (subscription_id, id DESC);
+
+-- Notification Service - Webhook delivery attempts, with the response each got
+CREATE TABLE IF NOT EXISTS notification_service.webhook_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id BIGINT NOT NULL REFERENCES notification_service.webhook_deliveries(id) ON DELETE CASCADE,
+    attempted_at TIMESTAMPTZ NOT NULL,
+    status_code INTEGER,
+    error TEXT,
+    response TEXT NOT NULL DEFAULT '',
+    duration_ms BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery
+    ON notification_service.webhook_attempts (delivery_id, attempted_at);
+
+-- Notification Service - Routing rules sending a notification for each matching event, per tenant
+CREATE TABLE IF NOT EXISTS notification_service.routing_rules (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    name VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    -- Condition over the event payload; empty matches every event
+    condition TEXT NOT NULL DEFAULT '',
+    channel VARCHAR(50) NOT NULL DEFAULT 'email',
+    type VARCHAR(50) NOT NULL DEFAULT 'general',
+    template VARCHAR(100) NOT NULL,
+    -- These may reference payload fields as {{field}}
+    locale VARCHAR(100) NOT NULL DEFAULT '',
+    recipient VARCHAR(255) NOT NULL,
+    user_id VARCHAR(100) NOT NULL DEFAULT '',
+    context_type VARCHAR(50) NOT NULL DEFAULT '',
+    context_id VARCHAR(255) NOT NULL DEFAULT '',
+    priority INTEGER NOT NULL DEFAULT 100,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    version BIGINT NOT NULL DEFAULT 1,
+    updated_by VARCHAR(128),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_routing_rules_event
+    ON notification_service.routing_rules (tenant_id, event_type, priority) WHERE enabled;
+
+-- Notification Service - Every saved version of a routing rule, for its history and restores
+CREATE TABLE IF NOT EXISTS notification_service.routing_rule_versions (
+    rule_id BIGINT NOT NULL REFERENCES notification_service.routing_rules(id) ON DELETE CASCADE,
+    version BIGINT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    condition TEXT NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    template VARCHAR(100) NOT NULL,
+    locale VARCHAR(100) NOT NULL,
+    recipient VARCHAR(255) NOT NULL,
+    user_id VARCHAR(100) NOT NULL,
+    context_type VARCHAR(50) NOT NULL,
+    context_id VARCHAR(255) NOT NULL,
+    priority INTEGER NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    changed_by VARCHAR(128),
+    changed_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (rule_id, version)
+);
+
+-- Low-stock alerts go to the address on the SKU's reorder rule
+INSERT INTO notification_service.routing_rules (name, event_type, condition, type, template, recipient, context_type, context_id)
+SELECT 'Low stock alerts', 'inventory.low_stock', 'notify_email != ""', 'stock_alert', 'low_stock', '{{notify_email}}', 'sku', '{{sku}}'
+WHERE NOT EXISTS (SELECT 1 FROM notification_service.routing_rules WHERE tenant_id = 'default' AND event_type = 'inventory.low_stock');
+
+INSERT INTO notification_service.routing_rule_versions
+    (rule_id, version, name, event_type, condition, channel, type, template, locale, recipient, user_id,
+     context_type, context_id, priority, enabled, changed_by, changed_at)
+SELECT id, version, name, event_type, condition, channel, type, template, locale, recipient, user_id,
+    context_type, context_id, priority, enabled, updated_by, updated_at
+FROM notification_service.routing_rules
+ON CONFLICT (rule_id, version) DO NOTHING;
+
+-- Notification Service - Replies to notification emails received via the inbound webhook
+CREATE TABLE IF NOT EXISTS notification_service.inbound_replies (
+    id BIGSERIAL PRIMARY KEY,
+    notification_id INTEGER NOT NULL REFERENCES notification_service.notifications(id),
+    message_id VARCHAR(998) UNIQUE NOT NULL,
+    from_address VARCHAR(255) NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL,
+    raw_body TEXT NOT NULL,
+    published BOOLEAN NOT NULL DEFAULT FALSE,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Notification Service - Versioned template assets (logos, stylesheets)
+CREATE TABLE IF NOT EXISTS notification_service.assets (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    version VARCHAR(64) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    object_key VARCHAR(512) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (name, version)
+);
+
+-- Notification Service - Asset uploads and inbound attachments flagged by the virus scanner
+CREATE TABLE IF NOT EXISTS notification_service.quarantined_files (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    source VARCHAR(16) NOT NULL CHECK (source IN ('asset', 'inbound')),
+    reference VARCHAR(998) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL DEFAULT '',
+    size INTEGER NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    scanner VARCHAR(32) NOT NULL,
+    signature TEXT NOT NULL DEFAULT '',
+    content BYTEA,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'released', 'deleted')),
+    reviewed_by VARCHAR(64),
+    reviewed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, source, reference, sha256)
+);
+
+CREATE INDEX IF NOT EXISTS idx_quarantined_files_status
+    ON notification_service.quarantined_files (tenant_id, status, id DESC);
+
+-- Notification Service - Per-tenant sending domains and their DKIM keys
+CREATE TABLE IF NOT EXISTS notification_service.sending_domains (
+    tenant_id VARCHAR(63) PRIMARY KEY,
+    domain VARCHAR(253) NOT NULL,
+    from_address VARCHAR(255) NOT NULL,
+    from_name VARCHAR(100),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    last_error TEXT,
+    checked_at TIMESTAMPTZ,
+    verified_at TIMESTAMPTZ,
+    verification_token CHAR(32) NOT NULL,
+    dkim_selector VARCHAR(63) NOT NULL,
+    dkim_private_key TEXT NOT NULL,
+    pending_selector VARCHAR(63),
+    pending_private_key TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Notification Service - Idempotency Keys Table
+CREATE TABLE IF NOT EXISTS notification_service.idempotency_keys (
+    scope VARCHAR(128) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    completed BOOLEAN NOT NULL DEFAULT FALSE,
+    status_code INTEGER,
+    content_type VARCHAR(255),
+    body BYTEA,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (scope, key)
+);
+
+-- Notification Service - Audit log of every mutating request, with the fields it changed where cheap to tell
+CREATE TABLE IF NOT EXISTS notification_service.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(255) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    entity_type VARCHAR(64),
+    entity_id VARCHAR(255),
+    status_code INTEGER NOT NULL,
+    request_id VARCHAR(128),
+    client_ip VARCHAR(45),
+    changes JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON notification_service.audit_log (tenant_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON notification_service.audit_log (tenant_id, entity_type, entity_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON notification_service.audit_log (tenant_id, actor, id DESC);
+
+-- Inventory Service
+CREATE SCHEMA IF NOT EXISTS inventory_service;
+
+-- Inventory Service - Items Table
+CREATE TABLE IF NOT EXISTS inventory_service.items (
+    -- SKUs stay globally unique; tenant_id only scopes which tenant sees
+    -- the item.
+    sku VARCHAR(64) PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    name VARCHAR(255) NOT NULL,
+    on_hand INTEGER NOT NULL DEFAULT 0,
+    reserved INTEGER NOT NULL DEFAULT 0,
+    -- Stock held back from sale, such as expired lots awaiting disposal
+    quarantined INTEGER NOT NULL DEFAULT 0,
+    -- Stock held back as a buffer by the SKU's safety stock policy
+    safety_stock INTEGER NOT NULL DEFAULT 0 CHECK (safety_stock >= 0),
+    -- EAN, UPC or supplier barcode; not unique, so duplicates can be found
+    barcode VARCHAR(32),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    -- Bumped on every update, stock movements included; sent as the ETag and checked against If-Match
+    version BIGINT NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS items_barcode_idx ON inventory_service.items (tenant_id, barcode) WHERE barcode IS NOT NULL;
+
+-- Inventory Service - Bump the row's version on every update
+CREATE OR REPLACE FUNCTION inventory_service.bump_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS items_bump_version ON inventory_service.items;
+CREATE TRIGGER items_bump_version
+    BEFORE UPDATE ON inventory_service.items
+    FOR EACH ROW EXECUTE FUNCTION inventory_service.bump_version();
+
+-- Inventory Service - Lots of a SKU sharing an expiry date; quantity is what is left, in base units
+CREATE TABLE IF NOT EXISTS inventory_service.stock_lots (
+    id BIGSERIAL PRIMARY KEY,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    lot_code VARCHAR(64) NOT NULL,
+    -- Last day the lot may be sold
+    expires_on DATE NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+    status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'quarantined', 'disposed')),
+    -- Set once an expiry warning has been sent
+    alerted_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    disposed_at TIMESTAMPTZ,
+    UNIQUE (sku, lot_code)
+);
+CREATE INDEX IF NOT EXISTS stock_lots_expiry_idx ON inventory_service.stock_lots (expires_on) WHERE status <> 'disposed';
+
+-- Inventory Service - Stock ledger, one row per stock movement
+CREATE TABLE IF NOT EXISTS inventory_service.stock_ledger (
+    id BIGSERIAL PRIMARY KEY,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    delta INTEGER NOT NULL,
+    unit VARCHAR(32) NOT NULL DEFAULT 'each',
+    unit_quantity INTEGER NOT NULL,
+    reason VARCHAR(64) NOT NULL,
+    reference VARCHAR(255),
+    -- Who overrode the negative-stock guard for this movement, if anyone
+    override_by VARCHAR(128),
+    lot_id BIGINT REFERENCES inventory_service.stock_lots(id),
+    warehouse VARCHAR(32) NOT NULL DEFAULT 'MAIN',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Inventory Service - Latest change per SKU, maintained alongside the ledger
+CREATE TABLE IF NOT EXISTS inventory_service.stock_changes (
+    sku VARCHAR(64) PRIMARY KEY REFERENCES inventory_service.items(sku),
+    ledger_id BIGINT NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS stock_changes_changed_at_idx ON inventory_service.stock_changes (changed_at);
+
+-- Inventory Service - Units of measure per SKU, as a number of base units ("each")
+CREATE TABLE IF NOT EXISTS inventory_service.item_units (
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    unit VARCHAR(32) NOT NULL CHECK (unit <> 'each'),
+    factor INTEGER NOT NULL CHECK (factor > 1),
+    PRIMARY KEY (sku, unit)
+);
+
+-- Inventory Service - Holds on available stock, in base units, until committed, released or expired
+CREATE TABLE IF NOT EXISTS inventory_service.stock_reservations (
+    id BIGSERIAL PRIMARY KEY,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit VARCHAR(32) NOT NULL DEFAULT 'each',
+    unit_quantity INTEGER NOT NULL,
+    reference VARCHAR(255),
+    -- Who made the hold: user:<id> or service:<name>
+    reserved_by VARCHAR(128),
+    status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'committed', 'released', 'expired')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    settled_at TIMESTAMPTZ,
+    -- The warehouse the hold was allocated to
+    warehouse VARCHAR(32) NOT NULL DEFAULT 'MAIN'
+);
+
+-- Inventory Service - Active reservations the expiry sweep is due to expire
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_expiry
+    ON inventory_service.stock_reservations (expires_at) WHERE status = 'active' AND expires_at IS NOT NULL;
+
+-- Inventory Service - Reservation reports by when reservations were made
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_created
+    ON inventory_service.stock_reservations (created_at, sku);
+
+-- Inventory Service - Settled reservations moved out of the hot table by the
+-- archive job, with the hot table's columns in the same order
+CREATE TABLE IF NOT EXISTS inventory_service.stock_reservations_archive (
+    LIKE inventory_service.stock_reservations,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_archive_created
+    ON inventory_service.stock_reservations_archive (created_at, sku);
+
+-- Inventory Service - Hot and archived reservations together, for reports
+-- reaching back past the archive cutoff. archived_at is NULL for hot rows.
+CREATE OR REPLACE VIEW inventory_service.all_stock_reservations AS
+    SELECT r.*, NULL::TIMESTAMPTZ AS archived_at FROM inventory_service.stock_reservations r
+    UNION ALL
+    SELECT * FROM inventory_service.stock_reservations_archive;
+
+-- Inventory Service - Purchase orders from suppliers, received into stock
+CREATE TABLE IF NOT EXISTS inventory_service.purchase_orders (
+    id BIGSERIAL PRIMARY KEY,
+    supplier VARCHAR(255) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'received')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    received_at TIMESTAMPTZ
+);
+
+-- Inventory Service - Purchase order lines; quantity is in base units
+CREATE TABLE IF NOT EXISTS inventory_service.purchase_order_lines (
+    id BIGSERIAL PRIMARY KEY,
+    purchase_order_id BIGINT NOT NULL REFERENCES inventory_service.purchase_orders(id) ON DELETE CASCADE,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit VARCHAR(32) NOT NULL DEFAULT 'each',
+    unit_quantity INTEGER NOT NULL
+);
+
+-- Inventory Service - Reorder thresholds; alerted_at is set while an alert is outstanding
+CREATE TABLE IF NOT EXISTS inventory_service.stock_thresholds (
+    sku VARCHAR(64) PRIMARY KEY REFERENCES inventory_service.items(sku),
+    reorder_point INTEGER NOT NULL CHECK (reorder_point > 0),
+    reorder_quantity INTEGER NOT NULL DEFAULT 0 CHECK (reorder_quantity >= 0),
+    notify_email VARCHAR(255),
+    alerted_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Inventory Service - Safety stock targets; the demand figures and the item's safety_stock come from the last calculation
+CREATE TABLE IF NOT EXISTS inventory_service.safety_stock_policies (
+    sku VARCHAR(64) PRIMARY KEY REFERENCES inventory_service.items(sku),
+    service_level NUMERIC(5, 4) NOT NULL CHECK (service_level >= 0.5 AND service_level < 1),
+    lead_time_days INTEGER NOT NULL CHECK (lead_time_days > 0),
+    demand_mean DOUBLE PRECISION NOT NULL DEFAULT 0,
+    demand_stddev DOUBLE PRECISION NOT NULL DEFAULT 0,
+    demand_days INTEGER NOT NULL DEFAULT 0,
+    calculated_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Inventory Service - Packed size and weight of one base unit, for shipping quotes
+CREATE TABLE IF NOT EXISTS inventory_service.item_dimensions (
+    sku VARCHAR(64) PRIMARY KEY REFERENCES inventory_service.items(sku),
+    length_mm INTEGER NOT NULL CHECK (length_mm > 0),
+    width_mm INTEGER NOT NULL CHECK (width_mm > 0),
+    height_mm INTEGER NOT NULL CHECK (height_mm > 0),
+    weight_grams INTEGER NOT NULL CHECK (weight_grams > 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Inventory Service - Where each item is kept in the warehouse, for pick lists
+CREATE TABLE IF NOT EXISTS inventory_service.item_locations (
+    sku VARCHAR(64) PRIMARY KEY REFERENCES inventory_service.items(sku),
+    zone VARCHAR(32) NOT NULL,
+    bin VARCHAR(32) NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Inventory Service - Product catalog; the item's name doubles as the product name
+CREATE TABLE IF NOT EXISTS inventory_service.products (
+    sku VARCHAR(64) PRIMARY KEY REFERENCES inventory_service.items(sku),
+    description TEXT NOT NULL DEFAULT '',
+    price_cents BIGINT NOT NULL CHECK (price_cents >= 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    images TEXT[] NOT NULL DEFAULT '{}',
+    categories TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS products_categories_idx ON inventory_service.products USING GIN (categories);
+
+-- Inventory Service - Product price history, one row per price change
+CREATE TABLE IF NOT EXISTS inventory_service.product_prices (
+    id BIGSERIAL PRIMARY KEY,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.products(sku),
+    price_cents BIGINT NOT NULL CHECK (price_cents >= 0),
+    currency CHAR(3) NOT NULL,
+    effective_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS product_prices_sku_idx ON inventory_service.product_prices (sku, effective_at DESC);
+
+-- Inventory Service - Batch stock adjustments; each line is also a ledger movement referencing adjustment-<id>
+CREATE TABLE IF NOT EXISTS inventory_service.stock_adjustments (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(128),
+    source VARCHAR(8) NOT NULL CHECK (source IN ('csv', 'json')),
+    override BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS stock_adjustments_tenant_idx ON inventory_service.stock_adjustments (tenant_id, id DESC);
+
+-- Inventory Service - Batch stock adjustment lines, with the on-hand stock either side of each
+CREATE TABLE IF NOT EXISTS inventory_service.stock_adjustment_lines (
+    adjustment_id BIGINT NOT NULL REFERENCES inventory_service.stock_adjustments(id) ON DELETE CASCADE,
+    line INTEGER NOT NULL,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    delta INTEGER NOT NULL CHECK (delta <> 0),
+    reason VARCHAR(64) NOT NULL,
+    movement_id BIGINT NOT NULL REFERENCES inventory_service.stock_ledger(id),
+    on_hand_before INTEGER NOT NULL,
+    on_hand_after INTEGER NOT NULL,
+    PRIMARY KEY (adjustment_id, line)
+);
+
+-- Inventory Service - SKUs merged into another, with the stock they brought; requests for them redirect to the survivor
+CREATE TABLE IF NOT EXISTS inventory_service.item_merges (
+    sku VARCHAR(64) PRIMARY KEY REFERENCES inventory_service.items(sku),
+    survivor_sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    on_hand INTEGER NOT NULL,
+    reserved INTEGER NOT NULL,
+    quarantined INTEGER NOT NULL,
+    merged_by VARCHAR(128),
+    merged_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS item_merges_survivor_idx ON inventory_service.item_merges (survivor_sku);
+CREATE INDEX IF NOT EXISTS item_merges_tenant_idx ON inventory_service.item_merges (tenant_id, merged_at DESC);
+
+-- Inventory Service - Moving average cost of each item per warehouse, in the currency of its first receipt; average_total is in minor units
+CREATE TABLE IF NOT EXISTS inventory_service.item_costs (
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    warehouse VARCHAR(32) NOT NULL,
+    currency CHAR(3) NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity >= 0),
+    average_total BIGINT NOT NULL CHECK (average_total >= 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (sku, warehouse)
+);
+
+-- Inventory Service - FIFO cost layers, one per receipt; issues draw down remaining oldest first
+CREATE TABLE IF NOT EXISTS inventory_service.cost_layers (
+    id BIGSERIAL PRIMARY KEY,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    warehouse VARCHAR(32) NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    remaining INTEGER NOT NULL CHECK (remaining >= 0 AND remaining <= quantity),
+    unit_cost BIGINT NOT NULL CHECK (unit_cost >= 0),
+    reference VARCHAR(255),
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS cost_layers_open_idx ON inventory_service.cost_layers (sku, warehouse, received_at, id) WHERE remaining > 0;
+
+-- Inventory Service - Warehouses stock can be booked to besides MAIN, which holds the rest and is not listed
+CREATE TABLE IF NOT EXISTS inventory_service.warehouses (
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    code VARCHAR(32) NOT NULL CHECK (code <> 'MAIN'),
+    name VARCHAR(255) NOT NULL,
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tenant_id, code)
+);
+
+-- Inventory Service - Stock booked to each warehouse; MAIN's is the item's totals less these
+CREATE TABLE IF NOT EXISTS inventory_service.warehouse_stock (
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    warehouse VARCHAR(32) NOT NULL,
+    on_hand INTEGER NOT NULL DEFAULT 0,
+    reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (sku, warehouse)
+);
+CREATE INDEX IF NOT EXISTS warehouse_stock_warehouse_idx ON inventory_service.warehouse_stock (warehouse, sku);
+
+-- Inventory Service - Stock moved between warehouses, in base units; the item's totals do not change
+CREATE TABLE IF NOT EXISTS inventory_service.stock_transfers (
+    id BIGSERIAL PRIMARY KEY,
+    sku VARCHAR(64) NOT NULL REFERENCES inventory_service.items(sku),
+    from_warehouse VARCHAR(32) NOT NULL,
+    to_warehouse VARCHAR(32) NOT NULL CHECK (to_warehouse <> from_warehouse),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit VARCHAR(32) NOT NULL DEFAULT 'each',
+    unit_quantity INTEGER NOT NULL,
+    reference VARCHAR(255),
+    transferred_by VARCHAR(128),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS stock_transfers_sku_idx ON inventory_service.stock_transfers (sku, id DESC);
+
+-- Inventory Service - Audit log of every mutating request, with the fields it changed where cheap to tell
+CREATE TABLE IF NOT EXISTS inventory_service.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(255) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    entity_type VARCHAR(64),
+    entity_id VARCHAR(255),
+    status_code INTEGER NOT NULL,
+    request_id VARCHAR(128),
+    client_ip VARCHAR(45),
+    changes JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON inventory_service.audit_log (tenant_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON inventory_service.audit_log (tenant_id, entity_type, entity_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON inventory_service.audit_log (tenant_id, actor, id DESC);
+
+INSERT INTO inventory_service.items (sku, name, on_hand) VALUES
+('SKU-001', 'Widget', 100),
+('SKU-002', 'Gadget', 25)
+ON CONFLICT (sku) DO NOTHING;
+
+-- Opening balances, so the seeded stock reconciles against the ledger
+INSERT INTO inventory_service.stock_ledger (sku, delta, unit_quantity, reason, reference)
+SELECT i.sku, i.on_hand, i.on_hand, 'opening_balance', 'seed' FROM inventory_service.items i
+WHERE i.on_hand <> 0 AND NOT EXISTS (SELECT 1 FROM inventory_service.stock_ledger l WHERE l.sku = i.sku);
+
+INSERT INTO inventory_service.item_units (sku, unit, factor) VALUES
+('SKU-001', 'case', 12),
+('SKU-001', 'pallet', 480)
+ON CONFLICT (sku, unit) DO NOTHING;
+
+INSERT INTO inventory_service.stock_thresholds (sku, reorder_point, reorder_quantity) VALUES
+('SKU-001', 24, 96)
+ON CONFLICT (sku) DO NOTHING;
+
+INSERT INTO inventory_service.products (sku, description, price_cents, categories) VALUES
+('SKU-001', 'A sturdy general-purpose widget.', 1999, '{widgets,tools}'),
+('SKU-002', 'A pocket-sized gadget with three settings.', 4999, '{gadgets}')
+ON CONFLICT (sku) DO NOTHING;
+
+-- Payment Service
+CREATE SCHEMA IF NOT EXISTS payment_service;
+
+-- Payment Service - Payments, one per attempt to pay an order
+CREATE TABLE IF NOT EXISTS payment_service.payments (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    order_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    amount_cents BIGINT NOT NULL CHECK (amount_cents >= 0),
+    currency CHAR(3) NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    provider_ref VARCHAR(255),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed', 'refunded')),
+    failure_reason TEXT,
+    refund_ref VARCHAR(255),
+    refund_reason TEXT,
+    refunded_at TIMESTAMPTZ,
+    published BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (provider, provider_ref)
+);
+
+-- Payment Service - Payments by order
+CREATE INDEX IF NOT EXISTS idx_payments_tenant_order
+    ON payment_service.payments (tenant_id, order_id);
+
+-- Payment Service - Idempotency Keys Table
+CREATE TABLE IF NOT EXISTS payment_service.idempotency_keys (
+    scope VARCHAR(128) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    completed BOOLEAN NOT NULL DEFAULT FALSE,
+    status_code INTEGER,
+    content_type VARCHAR(255),
+    body BYTEA,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (scope, key)
+);
+
+-- Payment Service - Audit log of every mutating request, with the fields it changed where cheap to tell
+CREATE TABLE IF NOT EXISTS payment_service.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(255) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    entity_type VARCHAR(64),
+    entity_id VARCHAR(255),
+    status_code INTEGER NOT NULL,
+    request_id VARCHAR(128),
+    client_ip VARCHAR(45),
+    changes JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON payment_service.audit_log (tenant_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON payment_service.audit_log (tenant_id, entity_type, entity_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON payment_service.audit_log (tenant_id, actor, id DESC);
+
+-- API Gateway
+CREATE SCHEMA IF NOT EXISTS gateway;
+
+-- API Gateway - API keys for machine-to-machine consumers (only hashes stored)
+CREATE TABLE IF NOT EXISTS gateway.api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    key_prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL,
+    daily_quota INTEGER NOT NULL DEFAULT 0,
+    team VARCHAR(64),
+    feature VARCHAR(64),
+    owner_id INTEGER, -- the developer who issued it through the portal; NULL for admin-issued keys
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_keys_owner_idx ON gateway.api_keys (owner_id) WHERE owner_id IS NOT NULL;
+
+-- API Gateway - Daily request counts per API key, for quota enforcement and usage reports
+CREATE TABLE IF NOT EXISTS gateway.api_key_usage (
+    key_id INTEGER NOT NULL REFERENCES gateway.api_keys(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (key_id, day)
+);
+
+-- API Gateway - Requests per consumer (apikey:ID or user:ID) against each quota rule and period
+CREATE TABLE IF NOT EXISTS gateway.quota_usage (
+    consumer VARCHAR(64) NOT NULL,
+    path_prefix VARCHAR(255) NOT NULL,
+    period VARCHAR(8) NOT NULL,
+    period_start DATE NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (consumer, path_prefix, period, period_start)
+);
+
+-- API Gateway - Kill switches that disable routes at the edge while engaged
+CREATE TABLE IF NOT EXISTS gateway.kill_switches (
+    name VARCHAR(64) PRIMARY KEY,
+    method VARCHAR(8) NOT NULL,
+    path_prefix VARCHAR(255) NOT NULL,
+    engaged BOOLEAN NOT NULL DEFAULT FALSE,
+    status_code INTEGER NOT NULL DEFAULT 503 CHECK (status_code BETWEEN 400 AND 599),
+    message TEXT NOT NULL,
+    updated_by VARCHAR(255),
+    reason TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO gateway.kill_switches (name, method, path_prefix, message) VALUES
+('checkout', 'POST', '/api/orders', 'Checkout is temporarily unavailable. Please try again shortly.'),
+('registration', 'POST', '/api/users', 'Registration is temporarily unavailable. Please try again shortly.')
+ON CONFLICT (name) DO NOTHING;
+
+-- API Gateway - Flattened OpenAPI surfaces of the gateway and its backends, each following the one before
+CREATE TABLE IF NOT EXISTS gateway.api_snapshots (
+    id BIGSERIAL PRIMARY KEY,
+    previous_id BIGINT REFERENCES gateway.api_snapshots(id),
+    hash CHAR(64) NOT NULL,
+    surface JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- API Gateway - One successor per snapshot, however many replicas notice a change
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_snapshots_previous
+    ON gateway.api_snapshots ((COALESCE(previous_id, 0)));
+
+-- API Gateway - API changelog, the differences between successive snapshots
+CREATE TABLE IF NOT EXISTS gateway.api_changes (
+    id BIGSERIAL PRIMARY KEY,
+    snapshot_id BIGINT NOT NULL REFERENCES gateway.api_snapshots(id),
+    service VARCHAR(64) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    path VARCHAR(255) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    breaking BOOLEAN NOT NULL,
+    location TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL,
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- API Gateway - Changelog by service
+CREATE INDEX IF NOT EXISTS idx_api_changes_service
+    ON gateway.api_changes (service, id DESC);
+
+-- API Gateway - Audit log of requests to the gateway's own admin routes; proxied requests are logged by the service that handles them
+CREATE TABLE IF NOT EXISTS gateway.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL DEFAULT 'default',
+    actor VARCHAR(255) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    entity_type VARCHAR(64),
+    entity_id VARCHAR(255),
+    status_code INTEGER NOT NULL,
+    request_id VARCHAR(128),
+    client_ip VARCHAR(45),
+    changes JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON gateway.audit_log (tenant_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON gateway.audit_log (tenant_id, entity_type, entity_id, id DESC);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON gateway.audit_log (tenant_id, actor, id DESC);
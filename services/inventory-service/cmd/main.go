@@ -1,22 +1,146 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"log"
-	"net/http"
+	"time"
 
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/bodylimit"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/service"
+	"github.com/alux444/go-microserv-test/pkg/startup"
+	"github.com/alux444/go-microserv-test/services/inventory-service/api"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/catalog"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/costing"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/dimensions"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/graphql"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/inventory"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/locations"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/messages"
 	"github.com/gin-gonic/gin"
 )
 
+func setupRouter(db *sql.DB, replicas *database.Replicas, watcher *inventory.Watcher, publisher events.Publisher, planner *inventory.SafetyStockPlanner,
+	rates *costing.Rates, tokens *auth.Tokens) *service.Router {
+	router := service.NewRouter(service.Config{
+		Name:       "inventory-service",
+		DB:         db,
+		Replicas:   replicas,
+		Tokens:     tokens,
+		Spec:       api.Spec,
+		Messages:   messages.Files,
+		AuditLog:   "inventory_service.audit_log",
+		Middleware: []gin.HandlerFunc{inventory.RedirectMerged(inventory.NewPostgresStore(db))},
+	})
+	batch := bodylimit.Rule{Types: []string{"text/csv", "application/json"}}
+	router.Bodies.SetRoute("POST /items/adjustments", batch)
+	router.Bodies.SetRoute("POST /items/dimensions", batch)
+	safety := inventory.NewSafetyStockHandler(planner)
+	safety.RegisterAdminRoutes(router.Admin)
+
+	handler := inventory.NewHandler(inventory.NewPostgresStore(db), watcher, publisher,
+		config.GetDuration("STOCK_MAX_AGE", 30*time.Second), config.GetDuration("RESERVATION_TTL", 0))
+	handler.RegisterRoutes(router)
+	safety.RegisterRoutes(router)
+	catalog.NewHandler(catalog.NewPostgresStore(db)).RegisterRoutes(router)
+	dimensions.NewHandler(dimensions.NewPostgresStore(db)).RegisterRoutes(router)
+	locations.NewHandler(locations.NewPostgresStore(db)).RegisterRoutes(router)
+	costing.NewHandler(costing.NewPostgresStore(db), rates, config.GetEnv("INVENTORY_COST_METHOD", costing.MethodFIFO)).RegisterRoutes(router)
+	schema := graphql.NewSchema(inventory.NewPostgresStore(db), catalog.NewPostgresStore(db),
+		config.GetInt("INVENTORY_GRAPHQL_MAX_COMPLEXITY", 5000), config.GetInt("INVENTORY_GRAPHQL_MAX_DEPTH", 8))
+	graphql.NewHandler(schema).RegisterRoutes(router)
+
+	return router
+}
+
 func main() {
-	router := gin.Default()
+	ctx, stop := service.Init("inventory-service")
+	defer stop()
 
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "healthy",
-			"service": "inventory-service",
-		})
-	})
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	log.Println("Connected to db successfully")
+	replicas, err := database.ConnectReplicas()
+	if err != nil {
+		log.Fatalf("Failed to open database replicas: %v", err)
+	}
+	defer replicas.Close()
+
+	publisher, _, closeEvents := schema.Connect(config.GetEnv("RABBITMQ_URL", ""), "events")
+	defer closeEvents()
+
+	go replicas.Run(ctx, config.GetDuration("DB_REPLICA_CHECK_INTERVAL", 5*time.Second))
+
+	stockRecipient := config.GetEnv("LOW_STOCK_NOTIFY_EMAIL", "")
+	watcher := inventory.NewWatcher(inventory.NewPostgresStore(db), publisher, stockRecipient)
+	go watcher.Run(ctx, config.GetDuration("LOW_STOCK_INTERVAL", time.Minute))
+
+	runner := jobs.New()
+	if err := runner.Cron("inventory-reconcile", config.GetEnv("INVENTORY_RECONCILE_SCHEDULE", "0 3 * * *"),
+		inventory.ReconcileJob(inventory.NewPostgresStore(db))); err != nil {
+		log.Fatalf("Invalid INVENTORY_RECONCILE_SCHEDULE: %v", err)
+	}
+	expiry := inventory.NewExpiryMonitor(inventory.NewPostgresStore(db), publisher, watcher,
+		config.GetEnv("LOT_EXPIRY_NOTIFY_EMAIL", stockRecipient), config.GetInt("LOT_EXPIRY_WARN_DAYS", 30))
+	if err := runner.Cron("lot-expiry", config.GetEnv("LOT_EXPIRY_SCHEDULE", "5 0 * * *"), expiry.Job()); err != nil {
+		log.Fatalf("Invalid LOT_EXPIRY_SCHEDULE: %v", err)
+	}
+	planner := inventory.NewSafetyStockPlanner(inventory.NewPostgresStore(db), publisher, watcher,
+		config.GetInt("SAFETY_STOCK_DEMAND_DAYS", 90))
+	if err := runner.Cron("safety-stock", config.GetEnv("SAFETY_STOCK_SCHEDULE", "15 0 * * *"), planner.Job()); err != nil {
+		log.Fatalf("Invalid SAFETY_STOCK_SCHEDULE: %v", err)
+	}
+	runner.Schedule("reservation-expiry", jobs.Every(config.GetDuration("RESERVATION_EXPIRY_INTERVAL", time.Minute)),
+		inventory.ReservationExpiryJob(inventory.NewPostgresStore(db), publisher, 100))
+	// Settled reservations leave the hot table after
+	// RESERVATION_ARCHIVE_AFTER_MONTHS; 0 keeps them there.
+	if months := config.GetInt("RESERVATION_ARCHIVE_AFTER_MONTHS", 6); months > 0 {
+		runner.Schedule("reservation-archive", jobs.Every(config.GetDuration("RESERVATION_ARCHIVE_INTERVAL", time.Hour)),
+			inventory.ReservationArchiveJob(inventory.NewPostgresStore(db), months, 1000))
+	}
+	runner.Start(ctx)
+
+	tokens := service.Tokens("inventory-service")
+
+	if method := config.GetEnv("INVENTORY_COST_METHOD", costing.MethodFIFO); !costing.ValidMethod(method) {
+		log.Fatalf("Invalid INVENTORY_COST_METHOD %q, want fifo or average", method)
+	}
+	rates, err := costing.ParseRates(config.GetEnv("INVENTORY_BASE_CURRENCY", "USD"), config.GetEnv("INVENTORY_FX_RATES", ""))
+	if err != nil {
+		log.Fatalf("Invalid INVENTORY_FX_RATES: %v", err)
+	}
+
+	selfCheck := startup.New("inventory-service",
+		startup.Env("JWT_SECRET"),
+		startup.Config(startup.Duration("JWT_TTL"), startup.Duration("STOCK_MAX_AGE"), startup.Duration("LOW_STOCK_INTERVAL"), startup.Duration("SHUTDOWN_TIMEOUT"),
+			startup.Bytes("MAX_REQUEST_BODY"), startup.Duration("MAINTENANCE_RETRY_AFTER"),
+			startup.Duration("RESERVATION_TTL"), startup.Duration("RESERVATION_EXPIRY_INTERVAL"),
+			startup.Int("RESERVATION_ARCHIVE_AFTER_MONTHS"), startup.Duration("RESERVATION_ARCHIVE_INTERVAL"),
+			startup.Int("LOT_EXPIRY_WARN_DAYS"), startup.Int("SAFETY_STOCK_DEMAND_DAYS"),
+			startup.Int("INVENTORY_GRAPHQL_MAX_COMPLEXITY"), startup.Int("INVENTORY_GRAPHQL_MAX_DEPTH")),
+		startup.Tables(db, "inventory_service.items", "inventory_service.stock_ledger", "inventory_service.stock_changes",
+			"inventory_service.item_units", "inventory_service.stock_reservations", "inventory_service.stock_reservations_archive", "inventory_service.purchase_orders",
+			"inventory_service.purchase_order_lines", "inventory_service.stock_thresholds", "inventory_service.products", "inventory_service.product_prices", "inventory_service.stock_lots",
+			"inventory_service.safety_stock_policies", "inventory_service.stock_adjustments", "inventory_service.stock_adjustment_lines",
+			"inventory_service.item_dimensions", "inventory_service.item_locations", "inventory_service.item_merges",
+			"inventory_service.item_costs", "inventory_service.cost_layers", "inventory_service.audit_log"),
+		startup.Broker(publisher, config.GetEnv("RABBITMQ_URL", "")),
+	)
+	go selfCheck.Run(context.Background())
+
+	router := setupRouter(db, replicas, watcher, publisher, planner, rates, tokens)
+	router.Saturation.AddJobs(runner.Metrics())
+	router.GET("/health/startup-report", selfCheck.Handler())
+	router.GET("/metrics/jobs", runner.Handler())
 
-	log.Println("Inventory service starting on :50051")
-	router.Run(":50051")
+	service.Serve(ctx, "inventory-service", ":50051", router, runner.Stop)
 }
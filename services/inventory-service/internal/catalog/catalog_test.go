@@ -0,0 +1,110 @@
+package catalog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore knows the items SKU-001 and SKU-002, and applies only the
+// active filter when searching.
+type memStore struct {
+	Store
+	products map[string]*Product
+	queries  []Query
+}
+
+func (s *memStore) Search(ctx context.Context, q Query) ([]Product, error) {
+	s.queries = append(s.queries, q)
+	found := []Product{}
+	for _, p := range s.products {
+		if p.Active || q.IncludeInactive {
+			found = append(found, *p)
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) Get(ctx context.Context, sku string) (*Product, error) {
+	p, ok := s.products[sku]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memStore) Put(ctx context.Context, p *Product) (bool, error) {
+	if p.SKU != "SKU-001" && p.SKU != "SKU-002" {
+		return false, ErrNotFound
+	}
+	_, exists := s.products[p.SKU]
+	s.products[p.SKU] = p
+	return !exists, nil
+}
+
+func TestCatalog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{products: map[string]*Product{}}
+	admin := &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}}
+	do := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		if p != nil {
+			router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		}
+		NewHandler(store).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	widget := `{"name": "Widget", "price_cents": 1999, "currency": "eur", "images": ["https://cdn.example.com/widget.png"], "categories": ["Tools", "tools", "widgets"]}`
+	tests := []struct {
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		want      int
+		contains  string
+	}{
+		{principal: admin, method: http.MethodPut, path: "/products/SKU-001", body: widget, want: http.StatusCreated,
+			contains: `"currency":"EUR","images":["https://cdn.example.com/widget.png"],"categories":["tools","widgets"],"active":true`},
+		{principal: admin, method: http.MethodPut, path: "/products/SKU-001", body: widget, want: http.StatusOK},
+		{principal: admin, method: http.MethodPut, path: "/products/SKU-002", body: `{"name": "Gadget", "price_cents": 4999, "active": false}`, want: http.StatusCreated},
+		{principal: admin, method: http.MethodPut, path: "/products/SKU-404", body: widget, want: http.StatusNotFound},
+		{principal: admin, method: http.MethodPut, path: "/products/SKU-001", body: `{"name": "Widget"}`, want: http.StatusBadRequest},
+		{principal: admin, method: http.MethodPut, path: "/products/SKU-001", body: `{"name": "Widget", "price_cents": 1, "images": ["javascript:alert(1)"]}`, want: http.StatusBadRequest},
+		{principal: admin, method: http.MethodPut, path: "/products/SKU-001", body: `{"name": "Widget", "price_cents": 1, "categories": ["garden tools"]}`, want: http.StatusBadRequest},
+		{method: http.MethodPut, path: "/products/SKU-001", body: widget, want: http.StatusUnauthorized},
+
+		{method: http.MethodGet, path: "/products/SKU-001", want: http.StatusOK, contains: `"name":"Widget"`},
+		{method: http.MethodGet, path: "/products/SKU-002", want: http.StatusNotFound},
+		{principal: admin, method: http.MethodGet, path: "/products/SKU-002", want: http.StatusOK, contains: `"active":false`},
+		{method: http.MethodGet, path: "/products", want: http.StatusOK, contains: `"sku":"SKU-001"`},
+		{method: http.MethodGet, path: "/products?include_inactive=true", want: http.StatusForbidden},
+		{principal: admin, method: http.MethodGet, path: "/products?include_inactive=true", want: http.StatusOK, contains: `"sku":"SKU-002"`},
+		{method: http.MethodGet, path: "/products?sort=popular", want: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/products?min_price_cents=-1", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := do(tt.principal, tt.method, tt.path, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %d, got: %d %s", tt.method, tt.path, tt.want, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected body to contain %s, got: %s", tt.method, tt.path, tt.contains, w.Body)
+		}
+	}
+
+	store.queries = nil
+	do(nil, http.MethodGet, "/products?q=+widget+&category=tools&min_price_cents=100&in_stock=true&sort=price_desc&limit=500", "")
+	q := store.queries[0]
+	if q.Text != "widget" || q.Category != "tools" || q.MinPriceCents == nil || *q.MinPriceCents != 100 || q.MaxPriceCents != nil ||
+		!q.InStock || q.Sort != SortPriceDesc || q.Limit != 50 {
+		t.Errorf("Expected the search filters to be passed through, got: %+v", q)
+	}
+}
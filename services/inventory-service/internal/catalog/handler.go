@@ -0,0 +1,200 @@
+package catalog
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/audit"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// categorySlug is the shape of a category: lowercase letters, digits and
+// dashes, such as "garden-tools".
+var categorySlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,47}$`)
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Anyone can browse active products; only admins edit the catalog.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/products", h.search)
+	router.GET("/products/:sku", h.get)
+	router.PUT("/products/:sku", auth.RequireRole(auth.RoleAdmin), h.put)
+	router.GET("/categories", h.categories)
+}
+
+// seesInactive reports whether the caller may see products that are not on
+// sale: admins managing the catalog, and services checking an order.
+func seesInactive(c *gin.Context) bool {
+	p, ok := auth.FromContext(c)
+	return ok && p.HasRole(auth.RoleAdmin, auth.RoleService)
+}
+
+func queryPrice(c *gin.Context, name string) (*int64, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, true
+	}
+	cents, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || cents < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a non-negative number of cents"})
+		return nil, false
+	}
+	return &cents, true
+}
+
+func (h *Handler) search(c *gin.Context) {
+	q := Query{
+		Text:     strings.TrimSpace(c.Query("q")),
+		Category: c.Query("category"),
+		InStock:  c.Query("in_stock") == "true",
+		Sort:     c.DefaultQuery("sort", SortName),
+	}
+	if _, ok := orderBy[q.Sort]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be name, price_asc, price_desc or newest"})
+		return
+	}
+	var ok bool
+	if q.MinPriceCents, ok = queryPrice(c, "min_price_cents"); !ok {
+		return
+	}
+	if q.MaxPriceCents, ok = queryPrice(c, "max_price_cents"); !ok {
+		return
+	}
+	if c.Query("include_inactive") == "true" {
+		if !seesInactive(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can list inactive products"})
+			return
+		}
+		q.IncludeInactive = true
+	}
+	q.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	q.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if q.Limit <= 0 || q.Limit > 200 {
+		q.Limit = 50
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	found, err := h.store.Search(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"products": found})
+}
+
+func (h *Handler) get(c *gin.Context) {
+	p, err := h.store.Get(c.Request.Context(), c.Param("sku"))
+	if err == nil && !p.Active && !seesInactive(c) {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+type productRequest struct {
+	Name        string   `json:"name" binding:"required,max=255"`
+	Description string   `json:"description" binding:"max=5000"`
+	PriceCents  *int64   `json:"price_cents" binding:"required,min=0"`
+	Currency    string   `json:"currency" binding:"omitempty,len=3,alpha"`
+	Images      []string `json:"images" binding:"max=10"`
+	Categories  []string `json:"categories" binding:"max=10"`
+	Active      *bool    `json:"active"`
+}
+
+// validImage accepts absolute http and https URLs.
+func validImage(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// put creates or replaces a product. Currency defaults to USD and active to
+// true; categories are lowercased and deduplicated.
+func (h *Handler) put(c *gin.Context) {
+	var req productRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p := &Product{
+		SKU:         c.Param("sku"),
+		Name:        strings.TrimSpace(req.Name),
+		Description: strings.TrimSpace(req.Description),
+		PriceCents:  *req.PriceCents,
+		Currency:    strings.ToUpper(req.Currency),
+		Images:      []string{},
+		Categories:  []string{},
+		Active:      req.Active == nil || *req.Active,
+	}
+	if p.Currency == "" {
+		p.Currency = "USD"
+	}
+	for _, image := range req.Images {
+		if !validImage(image) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "images must be http or https URLs"})
+			return
+		}
+		p.Images = append(p.Images, image)
+	}
+	seen := map[string]bool{}
+	for _, category := range req.Categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if !categorySlug.MatchString(category) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "categories must be lowercase letters, digits and dashes, up to 48 characters"})
+			return
+		}
+		if !seen[category] {
+			seen[category] = true
+			p.Categories = append(p.Categories, category)
+		}
+	}
+
+	// Price changes matter to compliance, so the audit log gets the
+	// product as it was.
+	if old, err := h.store.Get(c.Request.Context(), p.SKU); err == nil {
+		audit.SetBefore(c, old)
+	}
+	created, err := h.store.Put(c.Request.Context(), p)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found; create it with POST /items first"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, p)
+}
+
+func (h *Handler) categories(c *gin.Context) {
+	categories, err := h.store.Categories(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"categories": categories})
+}
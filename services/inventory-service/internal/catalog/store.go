@@ -0,0 +1,247 @@
+// Package catalog describes the items inventory stocks as products that can
+// be sold: a description, a price, images and categories. A product shares
+// its SKU and name with its inventory item, so orders that reference a SKU
+// reference a real product.
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Product prices are in the currency's minor unit, per base unit of stock.
+type Product = models.Product
+
+// PricePoint is a product's price from EffectiveAt until the next point.
+type PricePoint struct {
+	PriceCents  int64     `json:"price_cents"`
+	Currency    string    `json:"currency"`
+	EffectiveAt time.Time `json:"effective_at"`
+}
+
+type Category struct {
+	Slug     string `json:"slug"`
+	Products int    `json:"products"`
+}
+
+// Sort orders for Query.Sort.
+const (
+	SortName      = "name"
+	SortPriceAsc  = "price_asc"
+	SortPriceDesc = "price_desc"
+	SortNewest    = "newest"
+)
+
+// Query filters a product search. Zero fields match everything, and only
+// active products match unless IncludeInactive is set.
+type Query struct {
+	Text            string
+	Category        string
+	MinPriceCents   *int64
+	MaxPriceCents   *int64
+	InStock         bool
+	IncludeInactive bool
+	Sort            string
+	Limit, Offset   int
+}
+
+type Store interface {
+	Search(ctx context.Context, q Query) ([]Product, error)
+	Get(ctx context.Context, sku string) (*Product, error)
+	// Put creates or replaces the product for an existing item, renaming
+	// the item to p.Name and recording a price point if its price changed.
+	// It reports whether the product is new, and returns ErrNotFound if
+	// there is no such item.
+	Put(ctx context.Context, p *Product) (bool, error)
+	// PriceHistory returns the product's latest price points, newest first.
+	PriceHistory(ctx context.Context, sku string, limit int) ([]PricePoint, error)
+	// Categories returns every category in use by active products, with
+	// how many products are in it.
+	Categories(ctx context.Context) ([]Category, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const productColumns = `p.sku, i.name, p.description, p.price_cents, p.currency, p.images, p.categories, p.active,
+	i.on_hand - i.reserved - i.quarantined, p.created_at, p.updated_at`
+
+const products = `inventory_service.products p JOIN inventory_service.items i ON i.sku = p.sku`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(row scanner) (*Product, error) {
+	var p Product
+	if err := row.Scan(&p.SKU, &p.Name, &p.Description, &p.PriceCents, &p.Currency, pq.Array(&p.Images), pq.Array(&p.Categories),
+		&p.Active, &p.Available, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if p.Images == nil {
+		p.Images = []string{}
+	}
+	if p.Categories == nil {
+		p.Categories = []string{}
+	}
+	return &p, nil
+}
+
+var orderBy = map[string]string{
+	SortName:      "i.name, p.sku",
+	SortPriceAsc:  "p.price_cents, p.sku",
+	SortPriceDesc: "p.price_cents DESC, p.sku",
+	SortNewest:    "p.created_at DESC, p.sku",
+}
+
+func (s *PostgresStore) Search(ctx context.Context, q Query) ([]Product, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	order, ok := orderBy[q.Sort]
+	if !ok {
+		order = orderBy[SortName]
+	}
+	query := "SELECT " + productColumns + " FROM " + products + `
+		WHERE i.tenant_id = $1
+			AND ($2 = '' OR to_tsvector('english', i.name || ' ' || p.description) @@ plainto_tsquery('english', $2))
+			AND ($3 = '' OR $3 = ANY(p.categories))
+			AND ($4::BIGINT IS NULL OR p.price_cents >= $4)
+			AND ($5::BIGINT IS NULL OR p.price_cents <= $5)
+			AND (NOT $6 OR i.on_hand - i.reserved - i.quarantined > 0)
+			AND ($7 OR p.active)
+		ORDER BY ` + order + " LIMIT $8 OFFSET $9"
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), q.Text, q.Category, q.MinPriceCents, q.MaxPriceCents,
+		q.InStock, q.IncludeInactive, q.Limit, q.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := []Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, *p)
+	}
+	return found, rows.Err()
+}
+
+func (s *PostgresStore) Get(ctx context.Context, sku string) (*Product, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + productColumns + " FROM " + products + " WHERE p.sku = $1 AND i.tenant_id = $2"
+	p, err := scanProduct(s.db.QueryRowContext(ctx, query, sku, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *PostgresStore) Put(ctx context.Context, p *Product) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	const rename string = `UPDATE inventory_service.items SET name = $3 WHERE sku = $1 AND tenant_id = $2
+		RETURNING on_hand - reserved - quarantined`
+	err = tx.QueryRowContext(ctx, rename, p.SKU, tenant.FromContext(ctx), p.Name).Scan(&p.Available)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// xmax is zero for a row this statement inserted rather than updated.
+	const upsert string = `INSERT INTO inventory_service.products (sku, description, price_cents, currency, images, categories, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (sku) DO UPDATE SET description = EXCLUDED.description, price_cents = EXCLUDED.price_cents,
+			currency = EXCLUDED.currency, images = EXCLUDED.images, categories = EXCLUDED.categories,
+			active = EXCLUDED.active, updated_at = NOW()
+		RETURNING created_at, updated_at, xmax = 0`
+	var created bool
+	if err := tx.QueryRowContext(ctx, upsert, p.SKU, p.Description, p.PriceCents, p.Currency, pq.Array(p.Images),
+		pq.Array(p.Categories), p.Active).Scan(&p.CreatedAt, &p.UpdatedAt, &created); err != nil {
+		return false, err
+	}
+
+	const price string = `INSERT INTO inventory_service.product_prices (sku, price_cents, currency)
+		SELECT $1, $2, $3 WHERE NOT EXISTS (
+			SELECT 1 FROM (SELECT price_cents, currency FROM inventory_service.product_prices
+				WHERE sku = $1 ORDER BY effective_at DESC, id DESC LIMIT 1) latest
+			WHERE latest.price_cents = $2 AND latest.currency = $3)`
+	if _, err := tx.ExecContext(ctx, price, p.SKU, p.PriceCents, p.Currency); err != nil {
+		return false, err
+	}
+	return created, tx.Commit()
+}
+
+func (s *PostgresStore) PriceHistory(ctx context.Context, sku string, limit int) ([]PricePoint, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT pp.price_cents, pp.currency, pp.effective_at FROM inventory_service.product_prices pp
+		JOIN inventory_service.items i ON i.sku = pp.sku
+		WHERE pp.sku = $1 AND i.tenant_id = $2 ORDER BY pp.effective_at DESC, pp.id DESC LIMIT $3`
+	rows, err := s.db.QueryContext(ctx, query, sku, tenant.FromContext(ctx), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []PricePoint{}
+	for rows.Next() {
+		var pp PricePoint
+		if err := rows.Scan(&pp.PriceCents, &pp.Currency, &pp.EffectiveAt); err != nil {
+			return nil, err
+		}
+		points = append(points, pp)
+	}
+	return points, rows.Err()
+}
+
+func (s *PostgresStore) Categories(ctx context.Context) ([]Category, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT c.slug, COUNT(*) FROM ` + products + `, UNNEST(p.categories) AS c(slug)
+		WHERE i.tenant_id = $1 AND p.active GROUP BY c.slug ORDER BY c.slug`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.Slug, &c.Products); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
@@ -0,0 +1,336 @@
+// Package costing tracks what each item's stock cost, per warehouse and in
+// the currency it was bought in, and values the stock on hand in a base
+// currency. Every receipt adds a FIFO cost layer and updates the moving
+// average, and every issue draws from both, so a valuation can use either
+// method without replaying history.
+package costing
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Costing methods.
+const (
+	MethodFIFO    = "fifo"
+	MethodAverage = "average"
+)
+
+// DefaultWarehouse is the warehouse of receipts and issues that name none.
+const DefaultWarehouse = "MAIN"
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInsufficient is returned for an issue of more than the warehouse
+	// has costed.
+	ErrInsufficient = errors.New("not enough costed stock in the warehouse")
+	// ErrCurrencyMismatch is returned for a receipt in another currency
+	// than the item's earlier receipts at the same warehouse.
+	ErrCurrencyMismatch = errors.New("the item's costs at this warehouse are in another currency")
+)
+
+// validCurrency reports whether code looks like an ISO 4217 code.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// minorDigits are the currencies whose minor unit is not a hundredth.
+var minorDigits = map[string]int{
+	"JPY": 0, "KRW": 0, "VND": 0, "CLP": 0, "ISK": 0, "HUF": 2,
+	"BHD": 3, "KWD": 3, "OMR": 3, "JOD": 3, "TND": 3,
+}
+
+// exponent is how many decimal places the currency's minor unit has.
+func exponent(currency string) int {
+	if d, ok := minorDigits[currency]; ok {
+		return d
+	}
+	return 2
+}
+
+// Rates converts amounts into a base currency. Each rate is how much one
+// unit of a currency is worth in the base currency.
+type Rates struct {
+	Base  string
+	rates map[string]*big.Rat
+}
+
+// ParseRates parses "currency=rate" pairs separated by commas, e.g.
+// "EUR=1.08,GBP=1.27" for a base where a euro is worth 1.08. The base
+// currency itself needs no rate.
+func ParseRates(base, s string) (*Rates, error) {
+	base = strings.ToUpper(strings.TrimSpace(base))
+	if !validCurrency(base) {
+		return nil, fmt.Errorf("invalid base currency %q", base)
+	}
+	r := &Rates{Base: base, rates: map[string]*big.Rat{base: big.NewRat(1, 1)}}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(part, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		rate, valid := new(big.Rat).SetString(strings.TrimSpace(value))
+		if !ok || !validCurrency(code) || !valid || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q, want currency=rate", part)
+		}
+		if _, ok := r.rates[code]; ok {
+			return nil, fmt.Errorf("exchange rate for %s given twice", code)
+		}
+		r.rates[code] = rate
+	}
+	return r, nil
+}
+
+// Snapshot returns the rates as decimal strings, by currency.
+func (r *Rates) Snapshot() map[string]string {
+	out := make(map[string]string, len(r.rates))
+	for code, rate := range r.rates {
+		out[code] = rate.FloatString(6)
+	}
+	return out
+}
+
+// Convert turns amount, in the minor unit of currency, into the minor unit
+// of the base currency, rounding half away from zero. ok is false if there
+// is no rate for currency.
+func (r *Rates) Convert(amount int64, currency string) (int64, bool) {
+	rate, ok := r.rates[currency]
+	if !ok {
+		return 0, false
+	}
+	v := new(big.Rat).Mul(big.NewRat(amount, 1), rate)
+	shift := exponent(r.Base) - exponent(currency)
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(shift))), nil)
+	if shift >= 0 {
+		v.Mul(v, new(big.Rat).SetInt(scale))
+	} else {
+		v.Quo(v, new(big.Rat).SetInt(scale))
+	}
+	return roundRat(v), true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// roundRat rounds v to the nearest integer, half away from zero.
+func roundRat(v *big.Rat) int64 {
+	num, den := new(big.Int).Abs(v.Num()), v.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if v.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q.Int64()
+}
+
+// Receipt is stock bought at a unit cost, in the minor unit of currency per
+// base unit.
+type Receipt struct {
+	ID         int64     `json:"id"`
+	SKU        string    `json:"sku"`
+	Warehouse  string    `json:"warehouse"`
+	Quantity   int       `json:"quantity"`
+	UnitCost   int64     `json:"unit_cost"`
+	Currency   string    `json:"currency"`
+	Reference  string    `json:"reference,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// Issue is stock taken out of a warehouse, with what it cost under each
+// method, in the warehouse's currency for the item.
+type Issue struct {
+	SKU         string `json:"sku"`
+	Warehouse   string `json:"warehouse"`
+	Quantity    int    `json:"quantity"`
+	Reference   string `json:"reference,omitempty"`
+	Currency    string `json:"currency"`
+	FIFOCost    int64  `json:"fifo_cost"`
+	AverageCost int64  `json:"average_cost"`
+}
+
+// normalize trims and upper-cases the codes, filling in the default
+// warehouse.
+func normalize(sku, warehouse *string) {
+	*sku = strings.TrimSpace(*sku)
+	*warehouse = strings.ToUpper(strings.TrimSpace(*warehouse))
+	if *warehouse == "" {
+		*warehouse = DefaultWarehouse
+	}
+}
+
+func (r *Receipt) validate() error {
+	normalize(&r.SKU, &r.Warehouse)
+	r.Currency = strings.ToUpper(strings.TrimSpace(r.Currency))
+	switch {
+	case r.SKU == "" || len(r.SKU) > 64:
+		return errors.New("sku must be 1 to 64 characters")
+	case len(r.Warehouse) > 32:
+		return errors.New("warehouse must be at most 32 characters")
+	case r.Quantity <= 0:
+		return errors.New("quantity must be positive")
+	case r.UnitCost < 0:
+		return errors.New("unit_cost must not be negative")
+	case !validCurrency(r.Currency):
+		return errors.New("currency must be an ISO 4217 code, such as EUR")
+	}
+	return nil
+}
+
+func (i *Issue) validate() error {
+	normalize(&i.SKU, &i.Warehouse)
+	switch {
+	case i.SKU == "" || len(i.SKU) > 64:
+		return errors.New("sku must be 1 to 64 characters")
+	case len(i.Warehouse) > 32:
+		return errors.New("warehouse must be at most 32 characters")
+	case i.Quantity <= 0:
+		return errors.New("quantity must be positive")
+	}
+	return nil
+}
+
+// Layer is the part of one receipt still in stock.
+type Layer struct {
+	ID         int64     `json:"id"`
+	Quantity   int       `json:"quantity"`
+	Remaining  int       `json:"remaining"`
+	UnitCost   int64     `json:"unit_cost"`
+	Reference  string    `json:"reference,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// Position is an item's costed stock at one warehouse. FIFOValue is the
+// remaining layers at their own cost; AverageValue is the moving average
+// total, whose unit cost AverageUnitCost rounds.
+type Position struct {
+	SKU             string    `json:"sku"`
+	Name            string    `json:"name,omitempty"`
+	Warehouse       string    `json:"warehouse"`
+	Currency        string    `json:"currency"`
+	Quantity        int       `json:"quantity"`
+	FIFOValue       int64     `json:"fifo_value"`
+	AverageValue    int64     `json:"average_value"`
+	AverageUnitCost int64     `json:"average_unit_cost"`
+	Layers          []Layer   `json:"layers,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// averageIssueCost is the moving average cost of taking quantity out of a
+// position holding total for onHand, rounded half up.
+func averageIssueCost(total int64, onHand, quantity int) int64 {
+	if quantity == onHand {
+		return total
+	}
+	return roundRat(big.NewRat(total*int64(quantity), int64(onHand)))
+}
+
+// ValuationLine is one item at one warehouse in a valuation.
+type ValuationLine struct {
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	Warehouse string `json:"warehouse"`
+	Quantity  int    `json:"quantity"`
+	Currency  string `json:"currency"`
+	// Value is in Currency; BaseValue in the report's base currency.
+	Value     int64 `json:"value"`
+	BaseValue int64 `json:"base_value"`
+}
+
+type WarehouseTotal struct {
+	Warehouse string `json:"warehouse"`
+	Quantity  int    `json:"quantity"`
+	BaseValue int64  `json:"base_value"`
+}
+
+type Valuation struct {
+	Method       string            `json:"method"`
+	BaseCurrency string            `json:"base_currency"`
+	Rates        map[string]string `json:"rates"`
+	Lines        []ValuationLine   `json:"lines"`
+	Warehouses   []WarehouseTotal  `json:"warehouses"`
+	Total        int64             `json:"total"`
+	GeneratedAt  time.Time         `json:"generated_at"`
+}
+
+// MissingRatesError lists the currencies a valuation needs rates for.
+type MissingRatesError struct {
+	Currencies []string
+}
+
+func (e *MissingRatesError) Error() string {
+	return "no exchange rate for " + strings.Join(e.Currencies, ", ")
+}
+
+// Value values positions by method in the rates' base currency. Positions
+// without stock are left out.
+func Value(positions []Position, method string, rates *Rates, now time.Time) (*Valuation, error) {
+	v := &Valuation{Method: method, BaseCurrency: rates.Base, Rates: rates.Snapshot(), Lines: []ValuationLine{},
+		Warehouses: []WarehouseTotal{}, GeneratedAt: now}
+	totals := map[string]*WarehouseTotal{}
+	missing := map[string]bool{}
+	for _, p := range positions {
+		if p.Quantity == 0 {
+			continue
+		}
+		line := ValuationLine{SKU: p.SKU, Name: p.Name, Warehouse: p.Warehouse, Quantity: p.Quantity, Currency: p.Currency, Value: p.FIFOValue}
+		if method == MethodAverage {
+			line.Value = p.AverageValue
+		}
+		base, ok := rates.Convert(line.Value, p.Currency)
+		if !ok {
+			missing[p.Currency] = true
+			continue
+		}
+		line.BaseValue = base
+		v.Lines = append(v.Lines, line)
+
+		t, ok := totals[p.Warehouse]
+		if !ok {
+			t = &WarehouseTotal{Warehouse: p.Warehouse}
+			totals[p.Warehouse] = t
+		}
+		t.Quantity += p.Quantity
+		t.BaseValue += base
+		v.Total += base
+	}
+	if len(missing) > 0 {
+		err := &MissingRatesError{}
+		for code := range missing {
+			err.Currencies = append(err.Currencies, code)
+		}
+		sort.Strings(err.Currencies)
+		return nil, err
+	}
+
+	for _, t := range totals {
+		v.Warehouses = append(v.Warehouses, *t)
+	}
+	sort.Slice(v.Warehouses, func(i, j int) bool { return v.Warehouses[i].Warehouse < v.Warehouses[j].Warehouse })
+	sort.Slice(v.Lines, func(i, j int) bool {
+		if v.Lines[i].Warehouse != v.Lines[j].Warehouse {
+			return v.Lines[i].Warehouse < v.Lines[j].Warehouse
+		}
+		return v.Lines[i].SKU < v.Lines[j].SKU
+	})
+	return v, nil
+}
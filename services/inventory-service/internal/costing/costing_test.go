@@ -0,0 +1,201 @@
+package costing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRates(t *testing.T) {
+	for _, spec := range []string{"EUR", "EUR=0", "EUR=-1", "EURO=1.1", "EUR=x", "EUR=1.1,eur=1.2"} {
+		if _, err := ParseRates("USD", spec); err == nil {
+			t.Errorf("ParseRates(%q): expected an error", spec)
+		}
+	}
+	if _, err := ParseRates("dollars", ""); err == nil {
+		t.Error("Expected an invalid base currency to be refused")
+	}
+	rates, err := ParseRates("usd", " eur=1.08, JPY=0.0067 ,")
+	if err != nil {
+		t.Fatalf("Failed to parse rates: %v", err)
+	}
+	if got := rates.Snapshot(); rates.Base != "USD" || got["EUR"] != "1.080000" || got["USD"] != "1.000000" {
+		t.Errorf("Unexpected rates: %s %v", rates.Base, got)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	rates, err := ParseRates("USD", "EUR=1.08,JPY=0.0067,KWD=3.25,GBP=1.01")
+	if err != nil {
+		t.Fatalf("Failed to parse rates: %v", err)
+	}
+	tests := []struct {
+		amount   int64
+		currency string
+		want     int64
+	}{
+		{1000, "USD", 1000},
+		{1000, "EUR", 1080},
+		{15000, "JPY", 10050}, // ¥15,000 is $100.50.
+		{1234, "KWD", 401},    // 1.234 KWD is $4.0105.
+		{50, "GBP", 51},       // 50.5 cents rounds away from zero.
+		{-50, "GBP", -51},
+	}
+	for _, tt := range tests {
+		if got, ok := rates.Convert(tt.amount, tt.currency); !ok || got != tt.want {
+			t.Errorf("Convert(%d %s) = %d, %v, want %d", tt.amount, tt.currency, got, ok, tt.want)
+		}
+	}
+	if _, ok := rates.Convert(100, "CHF"); ok {
+		t.Error("Expected no conversion without a rate")
+	}
+
+	yen, _ := ParseRates("JPY", "USD=149.5")
+	if got, _ := yen.Convert(1001, "USD"); got != 1496 {
+		t.Errorf("Expected $10.01 to be ¥1,496, got: %d", got)
+	}
+}
+
+func TestAverageIssueCost(t *testing.T) {
+	// Three units bought for 1000 in total: issuing one at a time costs
+	// 333, 334 and the 333 left, never more or less than was paid.
+	total, onHand := int64(1000), 3
+	var issued int64
+	for onHand > 0 {
+		cost := averageIssueCost(total, onHand, 1)
+		issued += cost
+		total -= cost
+		onHand--
+	}
+	if issued != 1000 || total != 0 {
+		t.Errorf("Expected the whole 1000 to be issued, got: %d with %d left", issued, total)
+	}
+}
+
+func TestValue(t *testing.T) {
+	rates, _ := ParseRates("USD", "EUR=1.10")
+	positions := []Position{
+		{SKU: "SKU-002", Warehouse: "MAIN", Currency: "EUR", Quantity: 10, FIFOValue: 1000, AverageValue: 1100},
+		{SKU: "SKU-001", Warehouse: "MAIN", Currency: "USD", Quantity: 4, FIFOValue: 400, AverageValue: 420},
+		{SKU: "SKU-001", Warehouse: "EAST", Currency: "USD", Quantity: 2, FIFOValue: 300, AverageValue: 300},
+		{SKU: "SKU-003", Warehouse: "EAST", Currency: "EUR", Quantity: 0},
+	}
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	v, err := Value(positions, MethodFIFO, rates, now)
+	if err != nil {
+		t.Fatalf("Failed to value: %v", err)
+	}
+	if v.Total != 1100+400+300 || len(v.Lines) != 3 {
+		t.Errorf("Unexpected FIFO valuation: %+v", v)
+	}
+	if v.Lines[0].Warehouse != "EAST" || v.Lines[1].SKU != "SKU-001" || v.Lines[2].BaseValue != 1100 {
+		t.Errorf("Expected lines by warehouse then SKU, got: %+v", v.Lines)
+	}
+	if len(v.Warehouses) != 2 || v.Warehouses[1] != (WarehouseTotal{Warehouse: "MAIN", Quantity: 14, BaseValue: 1500}) {
+		t.Errorf("Unexpected warehouse totals: %+v", v.Warehouses)
+	}
+
+	if v, _ := Value(positions, MethodAverage, rates, now); v.Total != 1210+420+300 {
+		t.Errorf("Unexpected average valuation: %d", v.Total)
+	}
+
+	positions = append(positions, Position{SKU: "SKU-004", Warehouse: "MAIN", Currency: "GBP", Quantity: 1, FIFOValue: 1})
+	_, err = Value(positions, MethodFIFO, rates, now)
+	if missing, ok := err.(*MissingRatesError); !ok || len(missing.Currencies) != 1 || missing.Currencies[0] != "GBP" {
+		t.Errorf("Expected GBP to be missing a rate, got: %v", err)
+	}
+}
+
+// memStore knows only SKU-001, costed in EUR, and values whatever
+// positions it holds.
+type memStore struct {
+	positions []Position
+}
+
+func (s *memStore) Receive(ctx context.Context, r *Receipt) error {
+	if r.SKU != "SKU-001" {
+		return ErrNotFound
+	}
+	if r.Currency != "EUR" {
+		return ErrCurrencyMismatch
+	}
+	return nil
+}
+
+func (s *memStore) Issue(ctx context.Context, i *Issue) error {
+	if i.Quantity > 10 {
+		return ErrInsufficient
+	}
+	return nil
+}
+
+func (s *memStore) Positions(ctx context.Context, sku string) ([]Position, error) {
+	return s.positions, nil
+}
+
+func (s *memStore) Valuation(ctx context.Context, warehouse, sku string) ([]Position, error) {
+	return s.positions, nil
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rates, _ := ParseRates("USD", "EUR=1.10")
+	store := &memStore{positions: []Position{{SKU: "SKU-001", Warehouse: "MAIN", Currency: "EUR", Quantity: 2, FIFOValue: 200, AverageValue: 210}}}
+	admin := &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}}
+	customer := &auth.Principal{UserID: 2, Roles: []string{auth.RoleCustomer}}
+
+	tests := []struct {
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		want      int
+		contains  string
+	}{
+		{principal: admin, method: http.MethodPost, path: "/costs/receipts", body: `{"sku": "SKU-001", "quantity": 2, "unit_cost": 100, "currency": "eur"}`,
+			want: http.StatusCreated, contains: `"warehouse":"MAIN","quantity":2,"unit_cost":100,"currency":"EUR"`},
+		{principal: admin, method: http.MethodPost, path: "/costs/receipts", body: `{"sku": "SKU-001", "quantity": 2, "unit_cost": 100, "currency": "GBP"}`,
+			want: http.StatusConflict},
+		{principal: admin, method: http.MethodPost, path: "/costs/receipts", body: `{"sku": "SKU-404", "quantity": 2, "unit_cost": 100, "currency": "EUR"}`,
+			want: http.StatusNotFound},
+		{principal: admin, method: http.MethodPost, path: "/costs/receipts", body: `{"sku": "SKU-001", "quantity": 0, "unit_cost": 100, "currency": "EUR"}`,
+			want: http.StatusBadRequest},
+		{principal: customer, method: http.MethodPost, path: "/costs/receipts", body: `{"sku": "SKU-001", "quantity": 2, "unit_cost": 100, "currency": "EUR"}`,
+			want: http.StatusForbidden},
+		{principal: admin, method: http.MethodPost, path: "/costs/issues", body: `{"sku": "SKU-001", "quantity": 11}`, want: http.StatusConflict},
+
+		{principal: admin, method: http.MethodGet, path: "/reports/valuation", want: http.StatusOK, contains: `"method":"fifo","base_currency":"USD"`},
+		{principal: admin, method: http.MethodGet, path: "/reports/valuation?method=average", want: http.StatusOK, contains: `"total":231`},
+		{principal: admin, method: http.MethodGet, path: "/reports/valuation?method=lifo", want: http.StatusBadRequest},
+		{principal: customer, method: http.MethodGet, path: "/reports/valuation", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, tt.principal) })
+		NewHandler(store, rates, MethodFIFO).RegisterRoutes(router)
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected status %d with %s, got: %d %s", tt.method, tt.path, tt.want, tt.contains, w.Code, w.Body)
+		}
+	}
+
+	store.positions[0].Currency = "GBP"
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, admin) })
+	NewHandler(store, rates, MethodFIFO).RegisterRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reports/valuation", nil))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"currencies":["GBP"]`) {
+		t.Errorf("Expected 422 for a currency without a rate, got: %d %s", w.Code, w.Body)
+	}
+}
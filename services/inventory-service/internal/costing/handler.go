@@ -0,0 +1,146 @@
+package costing
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store  Store
+	rates  *Rates
+	method string
+	now    func() time.Time
+}
+
+// NewHandler values stock by method unless a report asks for the other.
+func NewHandler(store Store, rates *Rates, method string) *Handler {
+	return &Handler{store: store, rates: rates, method: method, now: time.Now}
+}
+
+// ValidMethod reports whether method is a costing method.
+func ValidMethod(method string) bool {
+	return method == MethodFIFO || method == MethodAverage
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Receipts and issues come from admins or the services moving the stock.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/costs/receipts", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.receive)
+	router.POST("/costs/issues", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.issue)
+	router.GET("/items/:sku/costs", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.positions)
+	router.GET("/reports/valuation", auth.RequireRole(auth.RoleAdmin), h.valuation)
+}
+
+type receiptRequest struct {
+	SKU       string `json:"sku"`
+	Warehouse string `json:"warehouse"`
+	Quantity  int    `json:"quantity"`
+	UnitCost  int64  `json:"unit_cost"`
+	Currency  string `json:"currency"`
+	Reference string `json:"reference" binding:"max=255"`
+}
+
+func (h *Handler) receive(c *gin.Context) {
+	var req receiptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r := Receipt{SKU: req.SKU, Warehouse: req.Warehouse, Quantity: req.Quantity, UnitCost: req.UnitCost,
+		Currency: req.Currency, Reference: strings.TrimSpace(req.Reference)}
+	if err := r.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.store.Receive(c.Request.Context(), &r)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+	case errors.Is(err, ErrCurrencyMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusCreated, r)
+	}
+}
+
+type issueRequest struct {
+	SKU       string `json:"sku"`
+	Warehouse string `json:"warehouse"`
+	Quantity  int    `json:"quantity"`
+	Reference string `json:"reference" binding:"max=255"`
+}
+
+func (h *Handler) issue(c *gin.Context) {
+	var req issueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	i := Issue{SKU: req.SKU, Warehouse: req.Warehouse, Quantity: req.Quantity, Reference: strings.TrimSpace(req.Reference)}
+	if err := i.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.store.Issue(c.Request.Context(), &i)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "item has no costs at this warehouse"})
+	case errors.Is(err, ErrInsufficient):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, i)
+	}
+}
+
+func (h *Handler) positions(c *gin.Context) {
+	positions, err := h.store.Positions(c.Request.Context(), c.Param("sku"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sku": c.Param("sku"), "positions": positions})
+}
+
+// valuation values the stock on hand in the base currency, by ?method=
+// (fifo or average, defaulting to the configured method), optionally for
+// one ?warehouse= or ?sku=.
+func (h *Handler) valuation(c *gin.Context) {
+	method := c.DefaultQuery("method", h.method)
+	if !ValidMethod(method) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "method must be fifo or average"})
+		return
+	}
+	positions, err := h.store.Valuation(c.Request.Context(), strings.ToUpper(strings.TrimSpace(c.Query("warehouse"))),
+		strings.TrimSpace(c.Query("sku")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := Value(positions, method, h.rates, h.now().UTC())
+	var missing *MissingRatesError
+	if errors.As(err, &missing) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "currencies": missing.Currencies})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,226 @@
+package costing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+type Store interface {
+	// Receive adds a cost layer for r and folds it into the moving average,
+	// filling in ID and ReceivedAt. It returns ErrNotFound if there is no
+	// such item and ErrCurrencyMismatch if the warehouse holds the item's
+	// costs in another currency.
+	Receive(ctx context.Context, r *Receipt) error
+	// Issue takes i.Quantity out of the oldest layers and the moving
+	// average, filling in the currency and what it cost. It returns
+	// ErrNotFound if the item has no costs at the warehouse and
+	// ErrInsufficient if it has fewer than i.Quantity.
+	Issue(ctx context.Context, i *Issue) error
+	// Positions returns the item's positions by warehouse, with their
+	// layers still in stock, or ErrNotFound if there is no such item.
+	Positions(ctx context.Context, sku string) ([]Position, error)
+	// Valuation returns every position with stock, narrowed to one
+	// warehouse and SKU when they are not empty.
+	Valuation(ctx context.Context, warehouse, sku string) ([]Position, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Receive(ctx context.Context, r *Receipt) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const item string = `SELECT EXISTS (SELECT 1 FROM inventory_service.items WHERE sku = $1 AND tenant_id = $2)`
+		var exists bool
+		if err := tx.QueryRowContext(ctx, item, r.SKU, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+
+		// The position's currency is set by its first receipt and kept
+		// while it holds stock or history.
+		const position string = `INSERT INTO inventory_service.item_costs (sku, warehouse, currency, quantity, average_total)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (sku, warehouse) DO UPDATE SET quantity = item_costs.quantity + EXCLUDED.quantity,
+				average_total = item_costs.average_total + EXCLUDED.average_total, updated_at = NOW()
+				WHERE item_costs.currency = EXCLUDED.currency
+			RETURNING updated_at`
+		err := tx.QueryRowContext(ctx, position, r.SKU, r.Warehouse, r.Currency, r.Quantity, int64(r.Quantity)*r.UnitCost).
+			Scan(&r.ReceivedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCurrencyMismatch
+		}
+		if err != nil {
+			return err
+		}
+
+		const layer string = `INSERT INTO inventory_service.cost_layers (sku, warehouse, quantity, remaining, unit_cost, reference, received_at)
+			VALUES ($1, $2, $3, $3, $4, NULLIF($5, ''), $6) RETURNING id`
+		return tx.QueryRowContext(ctx, layer, r.SKU, r.Warehouse, r.Quantity, r.UnitCost, r.Reference, r.ReceivedAt).Scan(&r.ID)
+	})
+}
+
+func (s *PostgresStore) Issue(ctx context.Context, i *Issue) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const lockPosition string = `SELECT c.currency, c.quantity, c.average_total FROM inventory_service.item_costs c
+			JOIN inventory_service.items it ON it.sku = c.sku
+			WHERE c.sku = $1 AND c.warehouse = $2 AND it.tenant_id = $3 FOR UPDATE OF c`
+		var onHand int
+		var total int64
+		err := tx.QueryRowContext(ctx, lockPosition, i.SKU, i.Warehouse, tenant.FromContext(ctx)).Scan(&i.Currency, &onHand, &total)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if onHand < i.Quantity {
+			return ErrInsufficient
+		}
+
+		const layers string = `SELECT id, remaining, unit_cost FROM inventory_service.cost_layers
+			WHERE sku = $1 AND warehouse = $2 AND remaining > 0 ORDER BY received_at, id FOR UPDATE`
+		rows, err := tx.QueryContext(ctx, layers, i.SKU, i.Warehouse)
+		if err != nil {
+			return err
+		}
+		type draw struct {
+			id       int64
+			quantity int
+		}
+		var draws []draw
+		left := i.Quantity
+		i.FIFOCost = 0
+		for rows.Next() && left > 0 {
+			var d draw
+			var remaining int
+			var unitCost int64
+			if err := rows.Scan(&d.id, &remaining, &unitCost); err != nil {
+				rows.Close()
+				return err
+			}
+			d.quantity = min(remaining, left)
+			left -= d.quantity
+			i.FIFOCost += int64(d.quantity) * unitCost
+			draws = append(draws, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if left > 0 {
+			return ErrInsufficient
+		}
+		for _, d := range draws {
+			const consume string = "UPDATE inventory_service.cost_layers SET remaining = remaining - $2 WHERE id = $1"
+			if _, err := tx.ExecContext(ctx, consume, d.id, d.quantity); err != nil {
+				return err
+			}
+		}
+
+		i.AverageCost = averageIssueCost(total, onHand, i.Quantity)
+		const reduce string = `UPDATE inventory_service.item_costs SET quantity = quantity - $3, average_total = average_total - $4,
+			updated_at = NOW() WHERE sku = $1 AND warehouse = $2`
+		_, err = tx.ExecContext(ctx, reduce, i.SKU, i.Warehouse, i.Quantity, i.AverageCost)
+		return err
+	})
+}
+
+// positionColumns reads a position with its FIFO value from the layers
+// still in stock.
+const positionColumns string = `c.sku, it.name, c.warehouse, c.currency, c.quantity, c.average_total, c.updated_at,
+	COALESCE((SELECT SUM(l.remaining::BIGINT * l.unit_cost) FROM inventory_service.cost_layers l
+		WHERE l.sku = c.sku AND l.warehouse = c.warehouse AND l.remaining > 0), 0)`
+
+func scanPositions(rows *sql.Rows) ([]Position, error) {
+	defer rows.Close()
+	positions := []Position{}
+	for rows.Next() {
+		var p Position
+		if err := rows.Scan(&p.SKU, &p.Name, &p.Warehouse, &p.Currency, &p.Quantity, &p.AverageValue, &p.UpdatedAt, &p.FIFOValue); err != nil {
+			return nil, err
+		}
+		if p.Quantity > 0 {
+			p.AverageUnitCost = averageIssueCost(p.AverageValue, p.Quantity, 1)
+		}
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
+
+func (s *PostgresStore) Positions(ctx context.Context, sku string) ([]Position, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const item string = `SELECT EXISTS (SELECT 1 FROM inventory_service.items WHERE sku = $1 AND tenant_id = $2)`
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, item, sku, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	query := `SELECT ` + positionColumns + ` FROM inventory_service.item_costs c
+		JOIN inventory_service.items it ON it.sku = c.sku WHERE c.sku = $1 ORDER BY c.warehouse`
+	rows, err := s.db.QueryContext(ctx, query, sku)
+	if err != nil {
+		return nil, err
+	}
+	positions, err := scanPositions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	const layers string = `SELECT warehouse, id, quantity, remaining, unit_cost, COALESCE(reference, ''), received_at
+		FROM inventory_service.cost_layers WHERE sku = $1 AND remaining > 0 ORDER BY received_at, id`
+	lrows, err := s.db.QueryContext(ctx, layers, sku)
+	if err != nil {
+		return nil, err
+	}
+	defer lrows.Close()
+	byWarehouse := map[string][]Layer{}
+	for lrows.Next() {
+		var warehouse string
+		var l Layer
+		if err := lrows.Scan(&warehouse, &l.ID, &l.Quantity, &l.Remaining, &l.UnitCost, &l.Reference, &l.ReceivedAt); err != nil {
+			return nil, err
+		}
+		byWarehouse[warehouse] = append(byWarehouse[warehouse], l)
+	}
+	for i := range positions {
+		positions[i].Layers = byWarehouse[positions[i].Warehouse]
+	}
+	return positions, lrows.Err()
+}
+
+func (s *PostgresStore) Valuation(ctx context.Context, warehouse, sku string) ([]Position, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + positionColumns + ` FROM inventory_service.item_costs c
+		JOIN inventory_service.items it ON it.sku = c.sku
+		WHERE it.tenant_id = $1 AND c.quantity > 0 AND ($2 = '' OR c.warehouse = $2) AND ($3 = '' OR c.sku = $3)
+		ORDER BY c.warehouse, c.sku`
+	rows, err := database.Reader(ctx, s.db).QueryContext(ctx, query, tenant.FromContext(ctx), warehouse, sku)
+	if err != nil {
+		return nil, err
+	}
+	return scanPositions(rows)
+}
@@ -0,0 +1,157 @@
+package dimensions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore knows the items SKU-001 to SKU-003; SKU-003 is not on sale.
+type memStore struct {
+	recorded map[string]Dimensions
+}
+
+var items = []Missing{{SKU: "SKU-001", Name: "Widget", OnSale: true}, {SKU: "SKU-002", Name: "Gadget", OnSale: true}, {SKU: "SKU-003", Name: "Spare"}}
+
+func known(sku string) bool {
+	for _, it := range items {
+		if it.SKU == sku {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memStore) Get(ctx context.Context, skus []string) ([]Dimensions, error) {
+	found := []Dimensions{}
+	for _, sku := range skus {
+		if d, ok := s.recorded[sku]; ok {
+			found = append(found, d)
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) Put(ctx context.Context, d *Dimensions) error {
+	if !known(d.SKU) {
+		return ErrNotFound
+	}
+	s.recorded[d.SKU] = *d
+	return nil
+}
+
+func (s *memStore) PutBatch(ctx context.Context, batch []Dimensions, onlyMissing bool) (int, []string, error) {
+	var unknown []string
+	for _, d := range batch {
+		if !known(d.SKU) {
+			unknown = append(unknown, d.SKU)
+		}
+	}
+	if len(unknown) > 0 {
+		return 0, unknown, nil
+	}
+	written := 0
+	for _, d := range batch {
+		if _, ok := s.recorded[d.SKU]; ok && onlyMissing {
+			continue
+		}
+		s.recorded[d.SKU] = d
+		written++
+	}
+	return written, nil, nil
+}
+
+func (s *memStore) Missing(ctx context.Context, afterSKU string, onSaleOnly bool, limit int) ([]Missing, error) {
+	found := []Missing{}
+	for _, it := range items {
+		if _, ok := s.recorded[it.SKU]; ok || it.SKU <= afterSKU || (onSaleOnly && !it.OnSale) {
+			continue
+		}
+		if len(found) < limit {
+			found = append(found, it)
+		}
+	}
+	return found, nil
+}
+
+func TestDimensions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{recorded: map[string]Dimensions{}}
+	admin := &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}}
+	customer := &auth.Principal{UserID: 2, Roles: []string{auth.RoleCustomer}}
+	do := func(p *auth.Principal, method, path, contentType, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store).RegisterRoutes(router)
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		principal   *auth.Principal
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        int
+		contains    string
+	}{
+		{principal: admin, method: http.MethodPut, path: "/items/SKU-001/dimensions", body: `{"length_mm": 300, "width_mm": 200, "height_mm": 100, "weight_grams": 1500}`,
+			want: http.StatusOK, contains: `"sku":"SKU-001","length_mm":300`},
+		{principal: admin, method: http.MethodPut, path: "/items/SKU-001/dimensions", body: `{"length_mm": 0, "width_mm": 200, "height_mm": 100, "weight_grams": 1500}`, want: http.StatusBadRequest},
+		{principal: admin, method: http.MethodPut, path: "/items/SKU-001/dimensions", body: `{"length_mm": 300, "width_mm": 200, "height_mm": 100, "weight_grams": 5000000}`, want: http.StatusBadRequest},
+		{principal: admin, method: http.MethodPut, path: "/items/SKU-404/dimensions", body: `{"length_mm": 1, "width_mm": 1, "height_mm": 1, "weight_grams": 1}`, want: http.StatusNotFound},
+		{principal: customer, method: http.MethodPut, path: "/items/SKU-001/dimensions", body: `{"length_mm": 1, "width_mm": 1, "height_mm": 1, "weight_grams": 1}`, want: http.StatusForbidden},
+
+		{principal: customer, method: http.MethodGet, path: "/items/SKU-001/dimensions", want: http.StatusOK, contains: `"weight_grams":1500`},
+		{principal: customer, method: http.MethodGet, path: "/items/SKU-002/dimensions", want: http.StatusNotFound},
+		{principal: customer, method: http.MethodGet, path: "/items/dimensions?sku=SKU-001&sku=SKU-002&sku=SKU-001", want: http.StatusOK,
+			contains: `"missing":["SKU-002"]`},
+		{principal: customer, method: http.MethodGet, path: "/items/dimensions", want: http.StatusBadRequest},
+
+		{principal: admin, method: http.MethodGet, path: "/items/dimensions/missing?limit=1", want: http.StatusOK,
+			contains: `{"items":[{"sku":"SKU-002","name":"Gadget","on_sale":true}],"next_after":"SKU-002"}`},
+		{principal: admin, method: http.MethodGet, path: "/items/dimensions/missing?on_sale=true", want: http.StatusOK,
+			contains: `{"items":[{"sku":"SKU-002","name":"Gadget","on_sale":true}]}`},
+		{principal: customer, method: http.MethodGet, path: "/items/dimensions/missing", want: http.StatusForbidden},
+
+		// A backfill with any bad line records nothing.
+		{principal: admin, method: http.MethodPost, path: "/items/dimensions", contentType: "text/csv",
+			body: "sku,weight_grams,length_mm,width_mm,height_mm\nSKU-002,900,10,10,10\nSKU-003,heavy,10,10,10\nSKU-002,900,10,10,10\n",
+			want: http.StatusBadRequest, contains: `"lines":[{"line":2,"sku":"SKU-003","error":"weight_grams must be a whole number"},{"line":3,"sku":"SKU-002","error":"sku already given on line 1"}]`},
+		{principal: admin, method: http.MethodPost, path: "/items/dimensions", contentType: "application/json",
+			body: `[{"sku": "SKU-002", "length_mm": 10, "width_mm": 10, "height_mm": 10, "weight_grams": 900}, {"sku": "SKU-404", "length_mm": 10, "width_mm": 10, "height_mm": 10, "weight_grams": 900}]`,
+			want: http.StatusUnprocessableEntity, contains: `"skus":["SKU-404"]`},
+		{principal: admin, method: http.MethodPost, path: "/items/dimensions", contentType: "text/plain", body: "x", want: http.StatusUnsupportedMediaType},
+		{principal: admin, method: http.MethodPost, path: "/items/dimensions?only_missing=true", contentType: "text/csv",
+			body: "sku,length_mm,width_mm,height_mm,weight_grams\nSKU-001,1,1,1,1\nSKU-002,400,300,200,2500\n",
+			want: http.StatusOK, contains: `"skipped":1,"written":1`},
+	}
+	for _, tt := range tests {
+		if tt.contentType == "" {
+			tt.contentType = "application/json"
+		}
+		w := do(tt.principal, tt.method, tt.path, tt.contentType, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %d, got: %d %s", tt.method, tt.path, tt.want, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected body to contain %s, got: %s", tt.method, tt.path, tt.contains, w.Body)
+		}
+	}
+
+	if store.recorded["SKU-001"].WeightGrams != 1500 || store.recorded["SKU-002"].WeightGrams != 2500 {
+		t.Errorf("Expected the backfill to fill only missing items, got: %+v", store.recorded)
+	}
+	if w := do(admin, http.MethodGet, "/items/dimensions/missing?on_sale=true", "", ""); w.Body.String() != `{"items":[]}` {
+		t.Errorf("Expected no items on sale left without dimensions, got: %s", w.Body)
+	}
+}
@@ -0,0 +1,288 @@
+package dimensions
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MaxLookup bounds the SKUs in one GET /items/dimensions.
+	MaxLookup = 100
+	// MaxBackfill bounds one backfill, which runs in a single transaction.
+	MaxBackfill     = 1000
+	maxBackfillBody = 1 << 20
+)
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Anyone signed in can read dimensions; only admins record them.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/items/dimensions", h.lookup)
+	router.POST("/items/dimensions", auth.RequireRole(auth.RoleAdmin), h.backfill)
+	router.GET("/items/dimensions/missing", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.missing)
+	router.GET("/items/:sku/dimensions", h.get)
+	router.PUT("/items/:sku/dimensions", auth.RequireRole(auth.RoleAdmin), h.put)
+}
+
+// lookup returns the dimensions of each ?sku= and lists those without any,
+// so a shipping quote for several SKUs takes one call.
+func (h *Handler) lookup(c *gin.Context) {
+	skus := []string{}
+	seen := map[string]bool{}
+	for _, sku := range c.QueryArray("sku") {
+		if sku = strings.TrimSpace(sku); sku != "" && !seen[sku] {
+			seen[sku] = true
+			skus = append(skus, sku)
+		}
+	}
+	if len(skus) == 0 || len(skus) > MaxLookup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("give 1 to %d sku parameters", MaxLookup)})
+		return
+	}
+
+	found, err := h.store.Get(c.Request.Context(), skus)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, d := range found {
+		delete(seen, d.SKU)
+	}
+	missing := []string{}
+	for _, sku := range skus {
+		if seen[sku] {
+			missing = append(missing, sku)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"dimensions": found, "missing": missing})
+}
+
+func (h *Handler) get(c *gin.Context) {
+	found, err := h.store.Get(c.Request.Context(), []string{c.Param("sku")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(found) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no dimensions recorded for this item"})
+		return
+	}
+	c.JSON(http.StatusOK, found[0])
+}
+
+type dimensionsRequest struct {
+	SKU         string `json:"sku"`
+	LengthMM    int    `json:"length_mm"`
+	WidthMM     int    `json:"width_mm"`
+	HeightMM    int    `json:"height_mm"`
+	WeightGrams int    `json:"weight_grams"`
+}
+
+func (r dimensionsRequest) dimensions() Dimensions {
+	return Dimensions{SKU: strings.TrimSpace(r.SKU), LengthMM: r.LengthMM, WidthMM: r.WidthMM, HeightMM: r.HeightMM, WeightGrams: r.WeightGrams}
+}
+
+func (h *Handler) put(c *gin.Context) {
+	var req dimensionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.SKU = c.Param("sku")
+	d := req.dimensions()
+	if err := d.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.store.Put(c.Request.Context(), &d)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+type lineError struct {
+	Line  int    `json:"line"`
+	SKU   string `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+// line is one item of a backfill, numbered from 1 in the order sent.
+type line struct {
+	n int
+	Dimensions
+}
+
+var csvColumns = []string{"sku", "length_mm", "width_mm", "height_mm", "weight_grams"}
+
+// parseCSV reads a header row naming the five columns, in any order, then
+// one item per row.
+func parseCSV(body io.Reader) ([]line, []lineError, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading csv header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, col := range header {
+		columns[strings.TrimSpace(strings.ToLower(col))] = i
+	}
+	for _, col := range csvColumns {
+		if _, ok := columns[col]; !ok {
+			return nil, nil, errors.New("csv header must name " + strings.Join(csvColumns, ", "))
+		}
+	}
+	if len(columns) != len(csvColumns) {
+		return nil, nil, errors.New("csv header must name only " + strings.Join(csvColumns, ", "))
+	}
+
+	var lines []line
+	var invalid []lineError
+	for n := 1; ; n++ {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			invalid = append(invalid, lineError{Line: n, Error: "wrong number of fields"})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		d := Dimensions{SKU: strings.TrimSpace(row[columns["sku"]])}
+		var bad string
+		for _, f := range []struct {
+			col string
+			dst *int
+		}{{"length_mm", &d.LengthMM}, {"width_mm", &d.WidthMM}, {"height_mm", &d.HeightMM}, {"weight_grams", &d.WeightGrams}} {
+			if *f.dst, err = strconv.Atoi(strings.TrimSpace(row[columns[f.col]])); err != nil {
+				bad = f.col
+				break
+			}
+		}
+		if bad != "" {
+			invalid = append(invalid, lineError{Line: n, SKU: d.SKU, Error: bad + " must be a whole number"})
+			continue
+		}
+		lines = append(lines, line{n, d})
+	}
+	return lines, invalid, nil
+}
+
+func parseJSON(body io.Reader) ([]line, error) {
+	var req []dimensionsRequest
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("body must be a json array of {sku, length_mm, width_mm, height_mm, weight_grams}: %w", err)
+	}
+	lines := make([]line, len(req))
+	for i, r := range req {
+		lines[i] = line{i + 1, r.dimensions()}
+	}
+	return lines, nil
+}
+
+// backfill records dimensions for many items from a CSV (text/csv) or JSON
+// array body, all or nothing. ?only_missing=true leaves items that already
+// have dimensions as they are, so a catalog export can be loaded without
+// undoing corrections made since.
+func (h *Handler) backfill(c *gin.Context) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxBackfillBody)
+	var lines []line
+	var invalid []lineError
+	var err error
+	switch c.ContentType() {
+	case "text/csv":
+		lines, invalid, err = parseCSV(body)
+	case "application/json":
+		lines, err = parseJSON(body)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be text/csv or application/json"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	batch := make([]Dimensions, 0, len(lines))
+	seen := map[string]int{}
+	for _, l := range lines {
+		if err := l.validate(); err != nil {
+			invalid = append(invalid, lineError{Line: l.n, SKU: l.SKU, Error: err.Error()})
+			continue
+		}
+		if first, ok := seen[l.SKU]; ok {
+			invalid = append(invalid, lineError{Line: l.n, SKU: l.SKU, Error: fmt.Sprintf("sku already given on line %d", first)})
+			continue
+		}
+		seen[l.SKU] = l.n
+		batch = append(batch, l.Dimensions)
+	}
+	if len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid lines, nothing was recorded", "lines": invalid})
+		return
+	}
+	if len(lines) == 0 || len(lines) > MaxBackfill {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a backfill must have 1 to %d lines", MaxBackfill)})
+		return
+	}
+
+	onlyMissing := c.Query("only_missing") == "true"
+	written, unknown, err := h.store.PutBatch(c.Request.Context(), batch, onlyMissing)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(unknown) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown items, nothing was recorded", "skus": unknown})
+		return
+	}
+	log.Printf("Backfilled dimensions for %d of %d items", written, len(batch))
+	c.JSON(http.StatusOK, gin.H{"written": written, "skipped": len(batch) - written, "only_missing": onlyMissing})
+}
+
+// missing lists items whose shipping cannot be quoted for lack of
+// dimensions. ?on_sale=true narrows it to items customers can order.
+func (h *Handler) missing(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	items, err := h.store.Missing(c.Request.Context(), c.Query("after"), c.Query("on_sale") == "true", limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"items": items}
+	if len(items) > limit {
+		resp["items"] = items[:limit]
+		resp["next_after"] = items[limit-1].SKU
+	}
+	c.JSON(http.StatusOK, resp)
+}
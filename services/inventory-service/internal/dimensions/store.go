@@ -0,0 +1,211 @@
+// Package dimensions records the packed size and weight of one base unit of
+// each item. order-service needs them to quote shipping, so an item without
+// them cannot be shipped at a quoted rate until they are filled in.
+package dimensions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Bounds on one base unit: generous enough for freight, small enough to
+// catch figures entered in the wrong unit.
+const (
+	MaxSideMM      = 5000
+	MaxWeightGrams = 2_000_000
+)
+
+// Dimensions are one base unit of an item as packed for shipping.
+type Dimensions struct {
+	SKU         string    `json:"sku"`
+	LengthMM    int       `json:"length_mm"`
+	WidthMM     int       `json:"width_mm"`
+	HeightMM    int       `json:"height_mm"`
+	WeightGrams int       `json:"weight_grams"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (d *Dimensions) validate() error {
+	switch {
+	case d.SKU == "" || len(d.SKU) > 64:
+		return errors.New("sku must be 1 to 64 characters")
+	case d.LengthMM <= 0 || d.WidthMM <= 0 || d.HeightMM <= 0:
+		return errors.New("length_mm, width_mm and height_mm must be positive")
+	case d.LengthMM > MaxSideMM || d.WidthMM > MaxSideMM || d.HeightMM > MaxSideMM:
+		return fmt.Errorf("length_mm, width_mm and height_mm must be at most %d", MaxSideMM)
+	case d.WeightGrams <= 0 || d.WeightGrams > MaxWeightGrams:
+		return fmt.Errorf("weight_grams must be 1 to %d", MaxWeightGrams)
+	}
+	return nil
+}
+
+// Missing is an item with no dimensions recorded. OnSale items are the ones
+// blocking shipping quotes for orders customers can place.
+type Missing struct {
+	SKU    string `json:"sku"`
+	Name   string `json:"name"`
+	OnSale bool   `json:"on_sale"`
+}
+
+type Store interface {
+	// Get returns the dimensions recorded for whichever of skus have them.
+	Get(ctx context.Context, skus []string) ([]Dimensions, error)
+	// Put records d, filling in UpdatedAt, and returns ErrNotFound if there
+	// is no such item.
+	Put(ctx context.Context, d *Dimensions) error
+	// PutBatch records every entry in one transaction, or none of them if
+	// any SKU is not an item, in which case it returns the unknown SKUs.
+	// With onlyMissing, items that already have dimensions keep them. It
+	// returns how many items were written.
+	PutBatch(ctx context.Context, batch []Dimensions, onlyMissing bool) (int, []string, error)
+	// Missing returns items without dimensions in SKU order after afterSKU,
+	// only those on sale when onSaleOnly is set.
+	Missing(ctx context.Context, afterSKU string, onSaleOnly bool, limit int) ([]Missing, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Get(ctx context.Context, skus []string) ([]Dimensions, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT d.sku, d.length_mm, d.width_mm, d.height_mm, d.weight_grams, d.updated_at
+		FROM inventory_service.item_dimensions d JOIN inventory_service.items i ON i.sku = d.sku
+		WHERE d.sku = ANY($1) AND i.tenant_id = $2 ORDER BY d.sku`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(skus), tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := []Dimensions{}
+	for rows.Next() {
+		var d Dimensions
+		if err := rows.Scan(&d.SKU, &d.LengthMM, &d.WidthMM, &d.HeightMM, &d.WeightGrams, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		found = append(found, d)
+	}
+	return found, rows.Err()
+}
+
+// upsert writes a row for an item of the request tenant only, so it
+// affects no rows for an unknown SKU. $7 keeps existing rows untouched.
+const upsert string = `INSERT INTO inventory_service.item_dimensions (sku, length_mm, width_mm, height_mm, weight_grams)
+	SELECT i.sku, $2, $3, $4, $5 FROM inventory_service.items i WHERE i.sku = $1 AND i.tenant_id = $6
+	ON CONFLICT (sku) DO UPDATE SET length_mm = EXCLUDED.length_mm, width_mm = EXCLUDED.width_mm,
+		height_mm = EXCLUDED.height_mm, weight_grams = EXCLUDED.weight_grams, updated_at = NOW()
+		WHERE NOT $7
+	RETURNING updated_at`
+
+func (s *PostgresStore) Put(ctx context.Context, d *Dimensions) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, upsert, d.SKU, d.LengthMM, d.WidthMM, d.HeightMM, d.WeightGrams, tenant.FromContext(ctx), false).
+		Scan(&d.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) PutBatch(ctx context.Context, batch []Dimensions, onlyMissing bool) (int, []string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	skus := make([]string, len(batch))
+	for i, d := range batch {
+		skus[i] = d.SKU
+	}
+	const unknown string = `SELECT s.sku FROM UNNEST($1::TEXT[]) AS s(sku)
+		WHERE NOT EXISTS (SELECT 1 FROM inventory_service.items i WHERE i.sku = s.sku AND i.tenant_id = $2)
+		ORDER BY s.sku`
+	rows, err := s.db.QueryContext(ctx, unknown, pq.Array(skus), tenant.FromContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	var missing []string
+	for rows.Next() {
+		var sku string
+		if err := rows.Scan(&sku); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		missing = append(missing, sku)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(missing) > 0 {
+		return 0, missing, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, upsert)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer stmt.Close()
+
+	written := 0
+	for _, d := range batch {
+		res, err := stmt.ExecContext(ctx, d.SKU, d.LengthMM, d.WidthMM, d.HeightMM, d.WeightGrams, tenant.FromContext(ctx), onlyMissing)
+		if err != nil {
+			return 0, nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, nil, err
+		}
+		written += int(n)
+	}
+	return written, nil, tx.Commit()
+}
+
+func (s *PostgresStore) Missing(ctx context.Context, afterSKU string, onSaleOnly bool, limit int) ([]Missing, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT i.sku, i.name, COALESCE(p.active, FALSE) FROM inventory_service.items i
+		LEFT JOIN inventory_service.products p ON p.sku = i.sku
+		WHERE i.tenant_id = $1 AND i.sku > $2 AND (NOT $3 OR p.active)
+			AND NOT EXISTS (SELECT 1 FROM inventory_service.item_dimensions d WHERE d.sku = i.sku)
+		ORDER BY i.sku LIMIT $4`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), afterSKU, onSaleOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Missing{}
+	for rows.Next() {
+		var m Missing
+		if err := rows.Scan(&m.SKU, &m.Name, &m.OnSale); err != nil {
+			return nil, err
+		}
+		items = append(items, m)
+	}
+	return items, rows.Err()
+}
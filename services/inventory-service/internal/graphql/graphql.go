@@ -0,0 +1,691 @@
+// Package graphql serves a read-only GraphQL API over the catalog and stock,
+// for internal dashboards that need to combine them in ways the REST
+// endpoints do not.
+//
+// It carries its own small executor rather than a library: types are Go
+// structs described by Object and Field, queries are validated and planned
+// before anything is resolved, and a plan whose complexity or depth is over
+// the schema's limits is refused without touching the database.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Args are a field's arguments, coerced to their declared types: Int as
+// int, Float as float64, String as string and Boolean as bool. Arguments
+// that were not given and have no default are absent.
+type Args map[string]any
+
+func (a Args) Int(name string, def int) int {
+	if v, ok := a[name].(int); ok {
+		return v
+	}
+	return def
+}
+
+func (a Args) String(name string) string {
+	s, _ := a[name].(string)
+	return s
+}
+
+func (a Args) Bool(name string) bool {
+	b, _ := a[name].(bool)
+	return b
+}
+
+// Argument types are the built-in scalars, with a trailing ! if required.
+type Arg struct {
+	Name, Type, Description string
+	Default                 any
+}
+
+// Field is a field of an Object. Its value is a scalar named by Scalar or,
+// if Object is set, that object; List makes it a list of them.
+//
+// Resolve gets the value of the object the field is on. Without one, the
+// field reads the struct field or map key of the same JSON name from it.
+//
+// PageSize is how many items a list field returns at most for its
+// arguments; its selection's complexity is multiplied by it. It must be set
+// on list fields.
+type Field struct {
+	Name, Description string
+	Scalar            string
+	Object            *Object
+	List              bool
+	Args              []Arg
+	Resolve           func(ctx context.Context, source any, args Args) (any, error)
+	PageSize          func(args Args) int
+}
+
+type Object struct {
+	Name, Description string
+	Fields            []*Field
+}
+
+func (o *Object) field(name string) *Field {
+	for _, f := range o.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Schema is a read-only schema: it has a query type and no mutations.
+//
+// A query's complexity is the number of fields it can resolve: each field
+// counts one, and the fields under a list count once per item it can
+// return. Depth is how deeply selections are nested.
+type Schema struct {
+	Query         *Object
+	MaxComplexity int
+	MaxDepth      int
+}
+
+// Error is an error in the response, with the path of the field it was
+// raised on if execution had started.
+type Error struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// Response is the result of a request. Data is nil if the request could not
+// be executed at all, and otherwise holds every field, with null for those
+// that failed.
+type Response struct {
+	Data   *orderedMap `json:"data,omitempty"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+func failed(err error) *Response {
+	return &Response{Errors: []Error{{Message: err.Error()}}}
+}
+
+// Execute validates, plans and runs the named operation, or the only one in
+// the document if operationName is empty.
+func (s *Schema) Execute(ctx context.Context, query, operationName string, variables map[string]any) *Response {
+	doc, err := parse(query)
+	if err != nil {
+		return failed(err)
+	}
+	op, err := doc.operation(operationName)
+	if err != nil {
+		return failed(err)
+	}
+	if op.kind != "query" {
+		return failed(fmt.Errorf("%s operations are not supported, this API is read-only", op.kind))
+	}
+	vars, err := coerceVariables(op, variables)
+	if err != nil {
+		return failed(err)
+	}
+
+	pl := &planner{doc: doc, vars: vars, defined: map[string]bool{}, used: map[string]bool{}}
+	for _, d := range op.vars {
+		pl.defined[d.name] = true
+	}
+	root, err := pl.plan(s.Query, op.sel, nil, 1)
+	if err != nil {
+		return failed(err)
+	}
+	if err := pl.checkVariables(op); err != nil {
+		return failed(err)
+	}
+	if s.MaxDepth > 0 && pl.depth > s.MaxDepth {
+		return failed(fmt.Errorf("query depth %d is over the limit of %d", pl.depth, s.MaxDepth))
+	}
+	if c := complexity(root); s.MaxComplexity > 0 && c > s.MaxComplexity {
+		return failed(fmt.Errorf("query complexity %d is over the limit of %d; request fewer fields or smaller pages", c, s.MaxComplexity))
+	}
+
+	ex := &executor{}
+	data := ex.object(ctx, s.Query, root, nil, nil)
+	return &Response{Data: data, Errors: ex.errors}
+}
+
+func (d *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, fmt.Errorf("operationName is required when the document has more than one operation")
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// planned is a field to resolve, with its arguments coerced and its
+// fragments and directives already applied to its selection.
+type planned struct {
+	key   string
+	field *Field
+	args  Args
+	sel   []*planned
+}
+
+type planner struct {
+	doc           *document
+	vars          map[string]any
+	defined, used map[string]bool
+	depth         int
+	// spreading holds the fragments being expanded, to catch cycles.
+	spreading []string
+}
+
+func (p *planner) plan(obj *Object, set []*selection, into []*planned, depth int) ([]*planned, error) {
+	if depth > p.depth {
+		p.depth = depth
+	}
+	for _, s := range set {
+		include, err := p.included(s.directives)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+
+		switch {
+		case s.spread != "":
+			f, ok := p.doc.fragments[s.spread]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %q", s.spread)
+			}
+			for _, name := range p.spreading {
+				if name == f.name {
+					return nil, fmt.Errorf("fragment %q spreads itself", f.name)
+				}
+			}
+			if f.on != obj.Name {
+				return nil, fmt.Errorf("fragment %q on %s cannot be spread within %s", f.name, f.on, obj.Name)
+			}
+			p.spreading = append(p.spreading, f.name)
+			if into, err = p.plan(obj, f.sel, into, depth); err != nil {
+				return nil, err
+			}
+			p.spreading = p.spreading[:len(p.spreading)-1]
+			continue
+		case s.inline:
+			if s.on != "" && s.on != obj.Name {
+				return nil, fmt.Errorf("fragment on %s cannot be spread within %s", s.on, obj.Name)
+			}
+			if into, err = p.plan(obj, s.sel, into, depth); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		key := s.name
+		if s.alias != "" {
+			key = s.alias
+		}
+		var f *Field
+		if s.name == "__typename" {
+			if len(s.args) > 0 || s.sel != nil {
+				return nil, fmt.Errorf("__typename takes no arguments or selections")
+			}
+		} else if f = obj.field(s.name); f == nil {
+			return nil, fmt.Errorf("cannot query field %q on type %s", s.name, obj.Name)
+		}
+		args, err := p.arguments(obj, f, s.args)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil && f.Object == nil && s.sel != nil {
+			return nil, fmt.Errorf("field %q of type %s must not have a selection", s.name, f.Scalar)
+		}
+		if f != nil && f.Object != nil && s.sel == nil {
+			return nil, fmt.Errorf("field %q of type %s must have a selection of subfields", s.name, f.Object.Name)
+		}
+
+		// Selections with the same response key are merged, as long as
+		// they are the same field with the same arguments.
+		var existing *planned
+		for _, e := range into {
+			if e.key == key {
+				existing = e
+			}
+		}
+		if existing == nil {
+			existing = &planned{key: key, field: f, args: args}
+			into = append(into, existing)
+		} else if existing.field != f || fmt.Sprint(existing.args) != fmt.Sprint(args) {
+			return nil, fmt.Errorf("fields %q conflict because they are different fields or have different arguments; use aliases", key)
+		}
+		if f != nil && f.Object != nil {
+			if existing.sel, err = p.plan(f.Object, s.sel, existing.sel, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return into, nil
+}
+
+// included applies @skip(if:) and @include(if:).
+func (p *planner) included(ds []directive) (bool, error) {
+	include := true
+	for _, d := range ds {
+		if d.name != "skip" && d.name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		if len(d.args) != 1 || d.args[0].name != "if" {
+			return false, fmt.Errorf("directive @%s takes exactly one argument, if", d.name)
+		}
+		v, err := p.coerce(d.args[0].val, "Boolean!")
+		if err != nil {
+			return false, fmt.Errorf("directive @%s: %w", d.name, err)
+		}
+		if v.(bool) == (d.name == "skip") {
+			include = false
+		}
+	}
+	return include, nil
+}
+
+func (p *planner) arguments(obj *Object, f *Field, given []argument) (Args, error) {
+	args := Args{}
+	if f == nil {
+		return args, nil
+	}
+	values := map[string]value{}
+	for _, a := range given {
+		known := false
+		for _, d := range f.Args {
+			known = known || d.Name == a.name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown argument %q on field %s.%s", a.name, obj.Name, f.Name)
+		}
+		values[a.name] = a.val
+	}
+	for _, d := range f.Args {
+		val, ok := values[d.Name]
+		// An argument set to a variable that was not provided counts as
+		// not given, so the default applies.
+		if ok && val.kind == varValue && p.defined[val.raw] {
+			if _, provided := p.vars[val.raw]; !provided {
+				p.used[val.raw] = true
+				ok = false
+			}
+		}
+		if !ok {
+			if d.Default != nil {
+				args[d.Name] = d.Default
+			} else if strings.HasSuffix(d.Type, "!") {
+				return nil, fmt.Errorf("field %s.%s requires argument %q of type %s", obj.Name, f.Name, d.Name, d.Type)
+			}
+			continue
+		}
+		v, err := p.coerce(val, d.Type)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q on field %s.%s: %w", d.Name, obj.Name, f.Name, err)
+		}
+		if v != nil {
+			args[d.Name] = v
+		}
+	}
+	return args, nil
+}
+
+// coerce converts a literal or variable to typ, one of the built-in scalars.
+func (p *planner) coerce(v value, typ string) (any, error) {
+	base, required := strings.TrimSuffix(typ, "!"), strings.HasSuffix(typ, "!")
+	switch v.kind {
+	case varValue:
+		p.used[v.raw] = true
+		if !p.defined[v.raw] {
+			return nil, fmt.Errorf("variable $%s is not defined", v.raw)
+		}
+		val := p.vars[v.raw]
+		if val == nil && required {
+			return nil, fmt.Errorf("expected a value of type %s, got null", typ)
+		}
+		if val != nil && reflect.TypeOf(val) != reflect.TypeOf(zero[base]) {
+			return nil, fmt.Errorf("variable $%s is not of type %s", v.raw, typ)
+		}
+		return val, nil
+	case nullValue:
+		if required {
+			return nil, fmt.Errorf("expected a value of type %s, got null", typ)
+		}
+		return nil, nil
+	}
+	return literal(v, base)
+}
+
+var zero = map[string]any{"Int": 0, "Float": 0.0, "String": "", "ID": "", "Boolean": false}
+
+func literal(v value, base string) (any, error) {
+	switch {
+	case base == "Int" && v.kind == intValue:
+		n, err := strconv.ParseInt(v.raw, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s is out of range for Int", v.raw)
+		}
+		return int(n), nil
+	case base == "Float" && (v.kind == intValue || v.kind == floatValue):
+		return strconv.ParseFloat(v.raw, 64)
+	case base == "String" && v.kind == stringValue, base == "ID" && (v.kind == stringValue || v.kind == intValue):
+		return v.raw, nil
+	case base == "Boolean" && v.kind == boolValue:
+		return v.raw == "true", nil
+	}
+	return nil, fmt.Errorf("expected a value of type %s", base)
+}
+
+// coerceVariables checks the variables given against the operation's
+// definitions, applying defaults. Values arrive decoded from JSON.
+func coerceVariables(op *operation, given map[string]any) (map[string]any, error) {
+	vars := map[string]any{}
+	for _, d := range op.vars {
+		if _, dup := vars[d.name]; dup {
+			return nil, fmt.Errorf("there can be only one variable named $%s", d.name)
+		}
+		base, required := strings.TrimSuffix(d.typ, "!"), strings.HasSuffix(d.typ, "!")
+		if _, ok := zero[base]; !ok {
+			return nil, fmt.Errorf("variable $%s cannot be of type %s; only Int, Float, String, ID and Boolean are supported", d.name, d.typ)
+		}
+		raw, ok := given[d.name]
+		if !ok && d.def != nil {
+			v, err := literal(*d.def, base)
+			if err != nil && d.def.kind != nullValue {
+				return nil, fmt.Errorf("default of variable $%s: %w", d.name, err)
+			}
+			vars[d.name] = v
+			continue
+		}
+		if !ok || raw == nil {
+			if required {
+				return nil, fmt.Errorf("variable $%s of type %s is required", d.name, d.typ)
+			}
+			if ok {
+				vars[d.name] = nil
+			}
+			continue
+		}
+		v, err := coerceInput(raw, base)
+		if err != nil {
+			return nil, fmt.Errorf("variable $%s: %w", d.name, err)
+		}
+		vars[d.name] = v
+	}
+	for name := range given {
+		found := false
+		for _, d := range op.vars {
+			found = found || d.name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("variable $%s is not defined by the operation", name)
+		}
+	}
+	return vars, nil
+}
+
+func coerceInput(raw any, base string) (any, error) {
+	switch v := raw.(type) {
+	case float64:
+		switch base {
+		case "Float":
+			return v, nil
+		case "Int":
+			if v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+				return int(v), nil
+			}
+		case "ID":
+			if v == math.Trunc(v) {
+				return strconv.FormatFloat(v, 'f', 0, 64), nil
+			}
+		}
+	case string:
+		if base == "String" || base == "ID" {
+			return v, nil
+		}
+	case bool:
+		if base == "Boolean" {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a value of type %s", base)
+}
+
+// checkVariables rejects variables that were defined but never used.
+func (p *planner) checkVariables(op *operation) error {
+	for _, d := range op.vars {
+		if !p.used[d.name] {
+			return fmt.Errorf("variable $%s is never used", d.name)
+		}
+	}
+	return nil
+}
+
+func complexity(set []*planned) int {
+	total := 0
+	for _, p := range set {
+		total++
+		if p.sel == nil {
+			continue
+		}
+		n := 1
+		if p.field.List {
+			n = p.field.PageSize(p.args)
+		}
+		total += n * complexity(p.sel)
+	}
+	return total
+}
+
+type executor struct {
+	errors []Error
+}
+
+func (e *executor) fail(path []any, err error) {
+	e.errors = append(e.errors, Error{Message: err.Error(), Path: append([]any(nil), path...)})
+}
+
+func (e *executor) object(ctx context.Context, obj *Object, set []*planned, source any, path []any) *orderedMap {
+	out := &orderedMap{}
+	for _, p := range set {
+		fieldPath := append(path, p.key)
+		if p.field == nil {
+			out.set(p.key, obj.Name)
+			continue
+		}
+		v, err := resolve(ctx, p.field, source, p.args)
+		if err != nil {
+			e.fail(fieldPath, err)
+			out.set(p.key, nil)
+			continue
+		}
+		out.set(p.key, e.value(ctx, p, v, fieldPath))
+	}
+	return out
+}
+
+func (e *executor) value(ctx context.Context, p *planned, v any, path []any) any {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil
+	}
+	if p.field.List {
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			e.fail(path, fmt.Errorf("expected a list for %s", p.field.Name))
+			return nil
+		}
+		items := make([]any, rv.Len())
+		for i := range items {
+			item := rv.Index(i)
+			if item.Kind() == reflect.Struct && item.CanAddr() {
+				item = item.Addr()
+			}
+			items[i] = e.single(ctx, p, item.Interface(), append(path, i))
+		}
+		return items
+	}
+	return e.single(ctx, p, v, path)
+}
+
+func (e *executor) single(ctx context.Context, p *planned, v any, path []any) any {
+	if p.field.Object == nil {
+		return v
+	}
+	if rv := reflect.ValueOf(v); !rv.IsValid() || (rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		return nil
+	}
+	return e.object(ctx, p.field.Object, p.sel, v, path)
+}
+
+func resolve(ctx context.Context, f *Field, source any, args Args) (any, error) {
+	if f.Resolve != nil {
+		return f.Resolve(ctx, source, args)
+	}
+	if m, ok := source.(map[string]any); ok {
+		return m[f.Name], nil
+	}
+	rv := reflect.ValueOf(source)
+	for rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct {
+		if index, ok := jsonField(rv.Type(), f.Name); ok {
+			return rv.FieldByIndex(index).Interface(), nil
+		}
+	}
+	return nil, fmt.Errorf("no value for field %s", f.Name)
+}
+
+// jsonField finds the struct field encoded under name, looking into
+// embedded structs as encoding/json does.
+func jsonField(t reflect.Type, name string) ([]int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name || (tag == "" && field.Name == name) {
+			return []int{i}, true
+		}
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			if index, ok := jsonField(field.Type, name); ok {
+				return append([]int{i}, index...), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// orderedMap encodes as a JSON object with its keys in the order the query
+// selected them.
+type orderedMap struct {
+	keys   []string
+	values []any
+}
+
+func (m *orderedMap) set(key string, v any) {
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, v)
+}
+
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(m.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// SDL describes the schema in the GraphQL schema definition language, for
+// clients and code generators; introspection queries are not supported.
+func (s *Schema) SDL() string {
+	var b strings.Builder
+	b.WriteString("schema {\n  query: " + s.Query.Name + "\n}\n")
+
+	objects := map[string]*Object{}
+	var collect func(o *Object)
+	collect = func(o *Object) {
+		if objects[o.Name] != nil {
+			return
+		}
+		objects[o.Name] = o
+		for _, f := range o.Fields {
+			if f.Object != nil {
+				collect(f.Object)
+			}
+		}
+	}
+	collect(s.Query)
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		if name != s.Query.Name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range append([]string{s.Query.Name}, names...) {
+		o := objects[name]
+		b.WriteString("\n")
+		writeDescription(&b, "", o.Description)
+		b.WriteString("type " + o.Name + " {\n")
+		for _, f := range o.Fields {
+			writeDescription(&b, "  ", f.Description)
+			b.WriteString("  " + f.Name)
+			if len(f.Args) > 0 {
+				args := make([]string, len(f.Args))
+				for i, a := range f.Args {
+					args[i] = a.Name + ": " + a.Type
+					if a.Default != nil {
+						def, _ := json.Marshal(a.Default)
+						args[i] += " = " + string(def)
+					}
+				}
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			typ := f.Scalar
+			if f.Object != nil {
+				typ = f.Object.Name
+			}
+			if f.List {
+				typ = "[" + typ + "!]"
+			}
+			b.WriteString(": " + typ + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+func writeDescription(b *strings.Builder, indent, description string) {
+	if description != "" {
+		b.WriteString(indent + `"""` + description + `"""` + "\n")
+	}
+}
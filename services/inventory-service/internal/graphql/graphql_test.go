@@ -0,0 +1,276 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/catalog"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/inventory"
+	"github.com/gin-gonic/gin"
+)
+
+type stockStore struct {
+	inventory.Store
+	items  map[string]*inventory.Stock
+	lots   map[string][]inventory.Lot
+	levels map[string][]inventory.WarehouseStock
+	gets   int
+	// inventories records each WarehouseInventory call's code, limit and
+	// offset.
+	inventories []string
+}
+
+func (s *stockStore) Get(ctx context.Context, sku string) (*inventory.Stock, error) {
+	s.gets++
+	item, ok := s.items[sku]
+	if !ok {
+		return nil, inventory.ErrNotFound
+	}
+	return item, nil
+}
+
+func (s *stockStore) List(ctx context.Context, limit, offset int) ([]inventory.Stock, error) {
+	return []inventory.Stock{*s.items["SKU-001"], *s.items["SKU-002"]}, nil
+}
+
+func (s *stockStore) ListLots(ctx context.Context, sku string) ([]inventory.Lot, error) {
+	if sku == "SKU-002" {
+		return nil, errors.New("lots unavailable")
+	}
+	return s.lots[sku], nil
+}
+
+func (s *stockStore) StockByWarehouse(ctx context.Context, sku string) ([]inventory.WarehouseStock, error) {
+	return s.levels[sku], nil
+}
+
+func (s *stockStore) ListWarehouses(ctx context.Context) ([]inventory.Warehouse, error) {
+	lat, lng, at := 40.7, -74.0, time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	return []inventory.Warehouse{
+		{Code: "east", Name: "East", Latitude: &lat, Longitude: &lng, CreatedAt: at},
+		{Code: "west", Name: "West", CreatedAt: at},
+	}, nil
+}
+
+func (s *stockStore) WarehouseInventory(ctx context.Context, code string, limit, offset int) ([]inventory.WarehouseStock, error) {
+	s.inventories = append(s.inventories, fmt.Sprintf("%s %d %d", code, limit, offset))
+	var held []inventory.WarehouseStock
+	for _, levels := range s.levels {
+		for _, l := range levels {
+			if l.Warehouse == code {
+				held = append(held, l)
+			}
+		}
+	}
+	return held, nil
+}
+
+type productStore struct {
+	catalog.Store
+	products map[string]*catalog.Product
+	queries  []catalog.Query
+}
+
+func (s *productStore) Search(ctx context.Context, q catalog.Query) ([]catalog.Product, error) {
+	s.queries = append(s.queries, q)
+	return []catalog.Product{*s.products["SKU-001"]}, nil
+}
+
+func (s *productStore) Get(ctx context.Context, sku string) (*catalog.Product, error) {
+	p, ok := s.products[sku]
+	if !ok {
+		return nil, catalog.ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *productStore) PriceHistory(ctx context.Context, sku string, limit int) ([]catalog.PricePoint, error) {
+	at := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	return []catalog.PricePoint{{PriceCents: 1999, Currency: "USD", EffectiveAt: at}, {PriceCents: 2499, Currency: "USD", EffectiveAt: at.AddDate(0, -1, 0)}}, nil
+}
+
+func newTestSchema() (*Schema, *stockStore, *productStore) {
+	stock := &stockStore{
+		items: map[string]*inventory.Stock{
+			"SKU-001": {Stock: models.Stock{SKU: "SKU-001", Name: "Widget", OnHand: 10, Reserved: 2, Available: 8}},
+			"SKU-002": {Stock: models.Stock{SKU: "SKU-002", Name: "Gadget", OnHand: 5, Available: 5}},
+		},
+		lots: map[string][]inventory.Lot{"SKU-001": {{ID: 1, SKU: "SKU-001", Code: "L1", ExpiresOn: "2027-01-01", Quantity: 10}}},
+		levels: map[string][]inventory.WarehouseStock{"SKU-001": {
+			{Warehouse: inventory.DefaultWarehouse, SKU: "SKU-001", OnHand: 4, Reserved: 2, Available: 2},
+			{Warehouse: "east", SKU: "SKU-001", OnHand: 6, Available: 6},
+		}},
+	}
+	products := &productStore{products: map[string]*catalog.Product{
+		"SKU-001": {SKU: "SKU-001", Name: "Widget", PriceCents: 1999, Currency: "USD", Images: []string{}, Categories: []string{"tools"}, Active: true},
+	}}
+	return NewSchema(stock, products, 1000, 5), stock, products
+}
+
+func encode(t *testing.T, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	return string(b)
+}
+
+func TestExecute(t *testing.T) {
+	schema, _, products := newTestSchema()
+
+	resp := schema.Execute(context.Background(), `
+		query Dashboard($sku: String!, $withLots: Boolean = true) {
+			widget: item(sku: $sku) {
+				sku
+				available
+				lots @include(if: $withLots) { lot_code quantity }
+				product { ...price }
+			}
+			missing: item(sku: "SKU-404") { sku }
+		}
+		fragment price on Product { __typename price_cents price_history(limit: 1) { price_cents } }`,
+		"", map[string]any{"sku": "SKU-001"})
+	want := `{"data":{"widget":{"sku":"SKU-001","available":8,"lots":[{"lot_code":"L1","quantity":10}],` +
+		`"product":{"__typename":"Product","price_cents":1999,"price_history":[{"price_cents":1999},{"price_cents":2499}]}},"missing":null}}`
+	if got := encode(t, resp); got != want {
+		t.Errorf("Expected %s, got: %s", want, got)
+	}
+
+	resp = schema.Execute(context.Background(), `{ products(category: "tools", in_stock: true, min_price_cents: 1000, limit: 500) { sku } }`, "", nil)
+	if len(resp.Errors) != 0 {
+		t.Fatalf("Expected no errors, got: %v", resp.Errors)
+	}
+	q := products.queries[len(products.queries)-1]
+	if q.Category != "tools" || !q.InStock || q.MinPriceCents == nil || *q.MinPriceCents != 1000 || q.MaxPriceCents != nil || q.Limit != 50 || q.Sort != catalog.SortName {
+		t.Errorf("Expected the filters with the default limit and sort, got: %+v", q)
+	}
+}
+
+func TestExecuteLevels(t *testing.T) {
+	schema, _, _ := newTestSchema()
+	resp := schema.Execute(context.Background(), `{
+		widget: item(sku: "SKU-001") { levels { warehouse on_hand reserved available } }
+		first: item(sku: "SKU-001") { levels(limit: 1) { warehouse } }
+		gadget: item(sku: "SKU-002") { levels { warehouse } }
+	}`, "", nil)
+	want := `{"data":{"widget":{"levels":[{"warehouse":"` + inventory.DefaultWarehouse + `","on_hand":4,"reserved":2,"available":2},` +
+		`{"warehouse":"east","on_hand":6,"reserved":0,"available":6}]},` +
+		`"first":{"levels":[{"warehouse":"` + inventory.DefaultWarehouse + `"}]},"gadget":{"levels":[]}}}`
+	if got := encode(t, resp); got != want {
+		t.Errorf("Expected %s, got: %s", want, got)
+	}
+}
+
+func TestExecuteWarehouses(t *testing.T) {
+	schema, stock, _ := newTestSchema()
+	resp := schema.Execute(context.Background(), `{
+		warehouses { code name latitude longitude created_at }
+		east: warehouse(code: "east") { name stock(limit: 500, offset: 10) { sku on_hand available } }
+		missing: warehouse(code: "north") { name }
+	}`, "", nil)
+	want := `{"data":{"warehouses":[{"code":"east","name":"East","latitude":40.7,"longitude":-74,"created_at":"2026-09-01T00:00:00Z"},` +
+		`{"code":"west","name":"West","latitude":null,"longitude":null,"created_at":"2026-09-01T00:00:00Z"}],` +
+		`"east":{"name":"East","stock":[{"sku":"SKU-001","on_hand":6,"available":6}]},"missing":null}}`
+	if got := encode(t, resp); got != want {
+		t.Errorf("Expected %s, got: %s", want, got)
+	}
+	if len(stock.inventories) != 1 || stock.inventories[0] != "east 50 10" {
+		t.Errorf("Expected the stock page with the default limit, got: %v", stock.inventories)
+	}
+}
+
+func TestExecuteFieldErrors(t *testing.T) {
+	schema, _, _ := newTestSchema()
+	resp := schema.Execute(context.Background(), `{ items(limit: 2) { sku lots { lot_code } } }`, "", nil)
+	if resp.Data == nil {
+		t.Fatalf("Expected data alongside the field error, got: %v", resp.Errors)
+	}
+	want := `{"data":{"items":[{"sku":"SKU-001","lots":[{"lot_code":"L1"}]},{"sku":"SKU-002","lots":null}]},` +
+		`"errors":[{"message":"lots unavailable","path":["items",1,"lots"]}]}`
+	if got := encode(t, resp); got != want {
+		t.Errorf("Expected %s, got: %s", want, got)
+	}
+}
+
+func TestExecuteRejects(t *testing.T) {
+	schema, stock, _ := newTestSchema()
+	for name, query := range map[string]string{
+		"syntax":           `{ item(sku: "SKU-001") { sku }`,
+		"mutation":         `mutation { item(sku: "SKU-001") { sku } }`,
+		"unknown field":    `{ item(sku: "SKU-001") { price } }`,
+		"unknown argument": `{ item(sku: "SKU-001", warehouse: "A") { sku } }`,
+		"missing argument": `{ item { sku } }`,
+		"wrong type":       `{ item(sku: 1) { sku } }`,
+		"no selection":     `{ item(sku: "SKU-001") }`,
+		"scalar selection": `{ item(sku: "SKU-001") { sku { name } } }`,
+		"undefined var":    `{ item(sku: $sku) { sku } }`,
+		"unused var":       `query ($sku: String) { items { sku } }`,
+		"fragment cycle":   `{ item(sku: "SKU-001") { ...a } } fragment a on Item { product { item { ...a } } }`,
+		"wrong fragment":   `{ item(sku: "SKU-001") { ...p } } fragment p on Product { sku }`,
+		"conflict":         `{ item(sku: "SKU-001") { sku: name sku } }`,
+		"depth":            `{ item(sku: "SKU-001") { product { item { product { item { product { sku } } } } } } }`,
+		"complexity":       `{ items(limit: 200) { sku lots(limit: 100) { lot_code } } }`,
+	} {
+		resp := schema.Execute(context.Background(), query, "", nil)
+		if resp.Data != nil || len(resp.Errors) != 1 {
+			t.Errorf("Expected %s to be refused with one error, got: %s", name, encode(t, resp))
+		}
+	}
+	if stock.gets != 0 {
+		t.Errorf("Expected refused queries to resolve nothing, got: %d gets", stock.gets)
+	}
+
+	resp := schema.Execute(context.Background(), `{ items(limit: 200) { sku lots(limit: 100) { lot_code } } }`, "", nil)
+	if !strings.Contains(resp.Errors[0].Message, "complexity 20401 is over the limit of 1000") {
+		t.Errorf("Expected the complexity in the error, got: %s", resp.Errors[0].Message)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	schema, _, _ := newTestSchema()
+	do := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(schema).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	service := &auth.Principal{Roles: []string{auth.RoleService}}
+
+	w := do(service, http.MethodPost, "/graphql", `{"query":"query ($n: Int) { items(limit: $n) { sku } }","variables":{"n":1}}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"data":{"items":[{"sku":"SKU-001"},{"sku":"SKU-002"}]}}` {
+		t.Errorf("Expected the items, got: %d %s", w.Code, w.Body.String())
+	}
+	w = do(service, http.MethodGet, "/graphql?query="+url.QueryEscape(`query ($sku: String!) { product(sku: $sku) { name } }`)+
+		"&variables="+url.QueryEscape(`{"sku":"SKU-001"}`), "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"data":{"product":{"name":"Widget"}}}` {
+		t.Errorf("Expected the product, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(service, http.MethodPost, "/graphql", `{"query":"{ item { sku } }"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid query to be 400, got: %d", w.Code)
+	}
+	if w := do(&auth.Principal{UserID: 7, Roles: []string{"customer"}}, http.MethodPost, "/graphql", `{"query":"{ items { sku } }"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be forbidden, got: %d", w.Code)
+	}
+
+	w = do(service, http.MethodGet, "/graphql/schema", "")
+	for _, want := range []string{"type Query {", "  items(limit: Int = 50, offset: Int = 0): [Item!]\n", "type PricePoint {"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected the SDL to contain %q, got: %s", want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package graphql
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	schema *Schema
+}
+
+func NewHandler(schema *Schema) *Handler {
+	return &Handler{schema: schema}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes. The
+// API is for internal dashboards, so only admins and services may use it.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/graphql", auth.RequireRole(auth.RoleAdmin, auth.RoleService))
+	group.POST("", h.post)
+	group.GET("", h.get)
+	group.GET("/schema", h.sdl)
+}
+
+type request struct {
+	Query         string         `json:"query" binding:"required"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+func (h *Handler) post(c *gin.Context) {
+	var req request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{Errors: []Error{{Message: err.Error()}}})
+		return
+	}
+	h.execute(c, req)
+}
+
+// get takes the query, operationName and variables as query parameters,
+// variables as JSON, so dashboards can link to a query.
+func (h *Handler) get(c *gin.Context) {
+	req := request{Query: c.Query("query"), OperationName: c.Query("operationName")}
+	if req.Query == "" {
+		c.JSON(http.StatusBadRequest, Response{Errors: []Error{{Message: "query parameter is required"}}})
+		return
+	}
+	if v := c.Query("variables"); v != "" {
+		if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+			c.JSON(http.StatusBadRequest, Response{Errors: []Error{{Message: "variables must be a JSON object"}}})
+			return
+		}
+	}
+	h.execute(c, req)
+}
+
+// execute answers 400 for a query that could not be run, such as one that
+// does not parse or is over the limits, and 200 once it has run, with any
+// field errors alongside the data.
+func (h *Handler) execute(c *gin.Context, req request) {
+	resp := h.schema.Execute(c.Request.Context(), req.Query, req.OperationName, req.Variables)
+	if resp.Data == nil {
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) sdl(c *gin.Context) {
+	c.String(http.StatusOK, h.schema.SDL())
+}
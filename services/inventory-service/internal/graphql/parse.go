@@ -0,0 +1,679 @@
+package graphql
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parser reads the query language's executable documents: operations,
+// fragments, aliases, arguments, variables and directives. Type system
+// definitions are not accepted, as the schema is defined in Go.
+
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind, name string
+	vars       []varDef
+	sel        []*selection
+}
+
+type varDef struct {
+	name, typ string
+	def       *value
+}
+
+type fragment struct {
+	name, on string
+	sel      []*selection
+}
+
+// selection is a field, a fragment spread (spread is set) or an inline
+// fragment (inline is set, with an optional type condition on).
+type selection struct {
+	alias, name string
+	args        []argument
+	directives  []directive
+	sel         []*selection
+
+	spread string
+	inline bool
+	on     string
+}
+
+type argument struct {
+	name string
+	val  value
+}
+
+type directive struct {
+	name string
+	args []argument
+}
+
+type valueKind int
+
+const (
+	intValue valueKind = iota
+	floatValue
+	stringValue
+	boolValue
+	nullValue
+	enumValue
+	varValue
+	listValue
+	objectValue
+)
+
+type value struct {
+	kind   valueKind
+	raw    string
+	list   []value
+	fields []argument
+}
+
+type tokenKind int
+
+const (
+	eof tokenKind = iota
+	punct
+	name
+	intToken
+	floatToken
+	stringToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) errorf(pos int, format string, args ...any) error {
+	line, col := 1, 1
+	for _, r := range l.src[:pos] {
+		if r == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("syntax error at %d:%d: %s", line, col, fmt.Sprintf(format, args...))
+}
+
+// next skips whitespace, commas and comments, which are all insignificant.
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		}
+		if strings.HasPrefix(l.src[l.pos:], "\ufeff") {
+			l.pos += len("\ufeff")
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: eof, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: punct, text: "...", pos: start}, nil
+	case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+		l.pos++
+		return token{kind: punct, text: string(c), pos: start}, nil
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: name, text: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || isDigit(c):
+		return l.number(start)
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			return l.blockString(start)
+		}
+		return l.string(start)
+	}
+	return token{}, l.errorf(start, "unexpected character %q", c)
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+func (l *lexer) digits() int {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+func (l *lexer) number(start int) (token, error) {
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	intStart := l.pos
+	if l.digits() == 0 {
+		return token{}, l.errorf(start, "invalid number")
+	}
+	if l.src[intStart] == '0' && l.pos-intStart > 1 {
+		return token{}, l.errorf(start, "invalid number, unexpected leading zero")
+	}
+	kind := intToken
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		l.pos++
+		if l.digits() == 0 {
+			return token{}, l.errorf(start, "invalid number")
+		}
+		kind = floatToken
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if l.digits() == 0 {
+			return token{}, l.errorf(start, "invalid number")
+		}
+		kind = floatToken
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == '_' || l.src[l.pos] == '.' || isLetter(l.src[l.pos])) {
+		return token{}, l.errorf(start, "invalid number")
+	}
+	return token{kind: kind, text: l.src[start:l.pos], pos: start}, nil
+}
+
+var escapes = map[byte]string{'"': `"`, '\\': `\`, '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}
+
+func (l *lexer) string(start int) (token, error) {
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return token{kind: stringToken, text: b.String(), pos: start}, nil
+		case c == '\n' || c == '\r':
+			return token{}, l.errorf(start, "unterminated string")
+		case c == '\\' && l.pos+1 < len(l.src):
+			e := l.src[l.pos+1]
+			if s, ok := escapes[e]; ok {
+				b.WriteString(s)
+				l.pos += 2
+				continue
+			}
+			if e == 'u' && l.pos+6 <= len(l.src) {
+				var r rune
+				if _, err := fmt.Sscanf(l.src[l.pos+2:l.pos+6], "%04x", &r); err == nil {
+					b.WriteRune(r)
+					l.pos += 6
+					continue
+				}
+			}
+			return token{}, l.errorf(l.pos, "invalid escape sequence")
+		default:
+			r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+			b.WriteRune(r)
+			l.pos += size
+		}
+	}
+	return token{}, l.errorf(start, "unterminated string")
+}
+
+// blockString reads a """ string and strips its common indentation, as the
+// specification's BlockStringValue does.
+func (l *lexer) blockString(start int) (token, error) {
+	l.pos += 3
+	var raw strings.Builder
+	for l.pos < len(l.src) {
+		switch {
+		case strings.HasPrefix(l.src[l.pos:], `\"""`):
+			raw.WriteString(`"""`)
+			l.pos += 4
+		case strings.HasPrefix(l.src[l.pos:], `"""`):
+			l.pos += 3
+			return token{kind: stringToken, text: blockStringValue(raw.String()), pos: start}, nil
+		default:
+			raw.WriteByte(l.src[l.pos])
+			l.pos++
+		}
+	}
+	return token{}, l.errorf(start, "unterminated block string")
+}
+
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for i := range lines {
+		if i > 0 && indent > 0 && len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+func parse(src string) (*document, error) {
+	p := &parser{lex: &lexer{src: src}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &document{fragments: map[string]*fragment{}}
+	for p.tok.kind != eof {
+		switch {
+		case p.peek("{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", sel: sel})
+		case p.tok.kind == name && p.tok.text == "fragment":
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[f.name]; ok {
+				return nil, fmt.Errorf("there can be only one fragment named %q", f.name)
+			}
+			doc.fragments[f.name] = f
+		case p.tok.kind == name && (p.tok.text == "query" || p.tok.text == "mutation" || p.tok.text == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("document contains no operations")
+	}
+	seen := map[string]bool{}
+	for _, op := range doc.operations {
+		if op.name == "" && len(doc.operations) > 1 {
+			return nil, fmt.Errorf("an anonymous operation must be the only operation in the document")
+		}
+		if seen[op.name] {
+			return nil, fmt.Errorf("there can be only one operation named %q", op.name)
+		}
+		seen[op.name] = true
+	}
+	return doc, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) peek(text string) bool {
+	return p.tok.kind == punct && p.tok.text == text
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == eof {
+		return p.lex.errorf(p.tok.pos, "unexpected end of document")
+	}
+	return p.lex.errorf(p.tok.pos, "unexpected %q", p.tok.text)
+}
+
+func (p *parser) expect(text string) error {
+	if !p.peek(text) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != name {
+		return "", p.unexpected()
+	}
+	text := p.tok.text
+	return text, p.advance()
+}
+
+func (p *parser) operation() (*operation, error) {
+	op := &operation{kind: p.tok.text}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.tok.kind == name {
+		if op.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		for !p.peek(")") {
+			v, err := p.varDef()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = append(op.vars, v)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	op.sel, err = p.selectionSet()
+	return op, err
+}
+
+func (p *parser) varDef() (varDef, error) {
+	var v varDef
+	if err := p.expect("$"); err != nil {
+		return v, err
+	}
+	var err error
+	if v.name, err = p.name(); err != nil {
+		return v, err
+	}
+	if err := p.expect(":"); err != nil {
+		return v, err
+	}
+	if v.typ, err = p.typeRef(); err != nil {
+		return v, err
+	}
+	if p.peek("=") {
+		if err := p.advance(); err != nil {
+			return v, err
+		}
+		def, err := p.value(true)
+		if err != nil {
+			return v, err
+		}
+		v.def = &def
+	}
+	return v, nil
+}
+
+// typeRef reads a type such as Int, String! or [ID!] as written.
+func (p *parser) typeRef() (string, error) {
+	var typ string
+	if p.peek("[") {
+		if err := p.advance(); err != nil {
+			return "", err
+		}
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		var err error
+		if typ, err = p.name(); err != nil {
+			return "", err
+		}
+	}
+	if p.peek("!") {
+		typ += "!"
+		return typ, p.advance()
+	}
+	return typ, nil
+}
+
+func (p *parser) fragment() (*fragment, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	f := &fragment{}
+	var err error
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.name == "on" {
+		return nil, p.lex.errorf(p.tok.pos, "a fragment cannot be named \"on\"")
+	}
+	if p.tok.kind != name || p.tok.text != "on" {
+		return nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if f.on, err = p.name(); err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	f.sel, err = p.selectionSet()
+	return f, err
+}
+
+func (p *parser) selectionSet() ([]*selection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var set []*selection
+	for !p.peek("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, s)
+	}
+	if len(set) == 0 {
+		return nil, p.unexpected()
+	}
+	return set, p.advance()
+}
+
+func (p *parser) selection() (*selection, error) {
+	s := &selection{}
+	var err error
+	if p.peek("...") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == name && p.tok.text != "on" {
+			if s.spread, err = p.name(); err != nil {
+				return nil, err
+			}
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s.inline = true
+		if p.tok.kind == name {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if s.on, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+
+	if s.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.peek(":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if s.args, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek("{") {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *parser) arguments(constant bool) ([]argument, error) {
+	if !p.peek("(") {
+		return nil, nil
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var args []argument
+	for !p.peek(")") {
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range args {
+			if a.name == n {
+				return nil, fmt.Errorf("there can be only one argument named %q", n)
+			}
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(constant)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, argument{name: n, val: v})
+	}
+	if len(args) == 0 {
+		return nil, p.unexpected()
+	}
+	return args, p.advance()
+}
+
+func (p *parser) directives() ([]directive, error) {
+	var ds []directive
+	for p.peek("@") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments(false)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, directive{name: n, args: args})
+	}
+	return ds, nil
+}
+
+// value reads an input value. Variables are not allowed in constant
+// values, such as a variable's default.
+func (p *parser) value(constant bool) (value, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == intToken:
+		return value{kind: intValue, raw: tok.text}, p.advance()
+	case tok.kind == floatToken:
+		return value{kind: floatValue, raw: tok.text}, p.advance()
+	case tok.kind == stringToken:
+		return value{kind: stringValue, raw: tok.text}, p.advance()
+	case tok.kind == name:
+		kind := enumValue
+		switch tok.text {
+		case "true", "false":
+			kind = boolValue
+		case "null":
+			kind = nullValue
+		}
+		return value{kind: kind, raw: tok.text}, p.advance()
+	case p.peek("$") && !constant:
+		if err := p.advance(); err != nil {
+			return value{}, err
+		}
+		n, err := p.name()
+		return value{kind: varValue, raw: n}, err
+	case p.peek("["):
+		if err := p.advance(); err != nil {
+			return value{}, err
+		}
+		v := value{kind: listValue}
+		for !p.peek("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return value{}, err
+			}
+			v.list = append(v.list, item)
+		}
+		return v, p.advance()
+	case p.peek("{"):
+		if err := p.advance(); err != nil {
+			return value{}, err
+		}
+		v := value{kind: objectValue}
+		for !p.peek("}") {
+			n, err := p.name()
+			if err != nil {
+				return value{}, err
+			}
+			if err := p.expect(":"); err != nil {
+				return value{}, err
+			}
+			field, err := p.value(constant)
+			if err != nil {
+				return value{}, err
+			}
+			v.fields = append(v.fields, argument{name: n, val: field})
+		}
+		return v, p.advance()
+	}
+	return value{}, p.unexpected()
+}
@@ -0,0 +1,269 @@
+package graphql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/catalog"
+	"github.com/alux444/go-microserv-test/services/inventory-service/internal/inventory"
+)
+
+// pageArgs are the limit and offset of a paginated list, with the REST
+// endpoints' defaults: a limit outside 1 to max is taken as def.
+func pageArgs(def int) []Arg {
+	return []Arg{
+		{Name: "limit", Type: "Int", Default: def},
+		{Name: "offset", Type: "Int", Default: 0},
+	}
+}
+
+func limitArg(def int) []Arg {
+	return []Arg{{Name: "limit", Type: "Int", Default: def}}
+}
+
+func limit(args Args, def, max int) int {
+	if n := args.Int("limit", def); n > 0 && n <= max {
+		return n
+	}
+	return def
+}
+
+func offset(args Args) int {
+	if n := args.Int("offset", 0); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// pageSize is the PageSize of a list field limited by limit.
+func pageSize(def, max int) func(Args) int {
+	return func(args Args) int { return limit(args, def, max) }
+}
+
+// truncate applies a limit to lists the stores return in full.
+func truncate[T any](items []T, n int) []T {
+	if len(items) > n {
+		return items[:n]
+	}
+	return items
+}
+
+func scalar(name, typ, description string) *Field {
+	return &Field{Name: name, Scalar: typ, Description: description}
+}
+
+// sorts are catalog's product sort orders.
+var sorts = map[string]bool{catalog.SortName: true, catalog.SortPriceAsc: true, catalog.SortPriceDesc: true, catalog.SortNewest: true}
+
+// NewSchema describes stock items, their units, lots and levels at each
+// warehouse, the warehouses, and the catalog's products, categories and
+// price history.
+func NewSchema(stock inventory.Store, products catalog.Store, maxComplexity, maxDepth int) *Schema {
+	unit := &Object{Name: "Unit", Description: "A unit the item is counted in, factor base units each.", Fields: []*Field{
+		scalar("unit", "String", ""),
+		scalar("factor", "Int", ""),
+	}}
+	lot := &Object{Name: "Lot", Description: "An active lot with stock left.", Fields: []*Field{
+		scalar("id", "Int", ""),
+		scalar("lot_code", "String", ""),
+		scalar("expires_on", "String", "The expiry date, YYYY-MM-DD."),
+		scalar("quantity", "Int", ""),
+		scalar("status", "String", ""),
+		scalar("created_at", "String", ""),
+	}}
+	level := &Object{Name: "Level", Description: "A SKU's stock at one warehouse, in base units.", Fields: []*Field{
+		scalar("warehouse", "String", "The warehouse's code."),
+		scalar("sku", "String", ""),
+		scalar("on_hand", "Int", ""),
+		scalar("reserved", "Int", ""),
+		scalar("available", "Int", ""),
+	}}
+	warehouse := &Object{Name: "Warehouse", Description: "A registered fulfillment center.", Fields: []*Field{
+		scalar("code", "String", ""),
+		scalar("name", "String", ""),
+		scalar("latitude", "Float", ""),
+		scalar("longitude", "Float", ""),
+		scalar("created_at", "String", ""),
+		{Name: "stock", Object: level, List: true, Args: pageArgs(50), PageSize: pageSize(50, 200),
+			Description: "The SKUs held at the warehouse, by SKU.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return stock.WarehouseInventory(ctx, source.(*inventory.Warehouse).Code, limit(args, 50, 200), offset(args))
+			}},
+	}}
+	pricePoint := &Object{Name: "PricePoint", Description: "The product's price from effective_at until the next point.", Fields: []*Field{
+		scalar("price_cents", "Int", ""),
+		scalar("currency", "String", ""),
+		scalar("effective_at", "String", ""),
+	}}
+	item := &Object{Name: "Item", Description: "A stocked SKU. Quantities are in base units.", Fields: []*Field{
+		scalar("sku", "String", ""),
+		scalar("name", "String", ""),
+		scalar("on_hand", "Int", ""),
+		scalar("reserved", "Int", ""),
+		scalar("quarantined", "Int", ""),
+		scalar("safety_stock", "Int", ""),
+		scalar("available", "Int", ""),
+		scalar("updated_at", "String", ""),
+	}}
+	product := &Object{Name: "Product", Description: "An item as it is sold. Prices are in minor units per base unit.", Fields: []*Field{
+		scalar("sku", "String", ""),
+		scalar("name", "String", ""),
+		scalar("description", "String", ""),
+		scalar("price_cents", "Int", ""),
+		scalar("currency", "String", ""),
+		{Name: "images", Scalar: "String", List: true},
+		{Name: "categories", Scalar: "String", List: true},
+		scalar("active", "Boolean", ""),
+		scalar("available", "Int", ""),
+		scalar("created_at", "String", ""),
+		scalar("updated_at", "String", ""),
+	}}
+	category := &Object{Name: "Category", Fields: []*Field{
+		scalar("slug", "String", ""),
+		{Name: "product_count", Scalar: "Int", Description: "How many active products are in the category.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return source.(*catalog.Category).Products, nil
+			}},
+	}}
+
+	item.Fields = append(item.Fields,
+		&Field{Name: "units", Object: unit, List: true, Args: limitArg(20), PageSize: pageSize(20, 100),
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				units, err := stock.ListUnits(ctx, source.(*inventory.Stock).SKU)
+				return truncate(units, limit(args, 20, 100)), err
+			}},
+		&Field{Name: "lots", Object: lot, List: true, Args: limitArg(20), PageSize: pageSize(20, 100),
+			Description: "Active lots with stock left, soonest expiry first.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				lots, err := stock.ListLots(ctx, source.(*inventory.Stock).SKU)
+				return truncate(lots, limit(args, 20, 100)), err
+			}},
+		&Field{Name: "levels", Object: level, List: true, Args: limitArg(20), PageSize: pageSize(20, 100),
+			Description: "The item's stock at the default warehouse and every other warehouse holding it.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				levels, err := stock.StockByWarehouse(ctx, source.(*inventory.Stock).SKU)
+				return truncate(levels, limit(args, 20, 100)), err
+			}},
+		&Field{Name: "product", Object: product, Description: "The item's product, null if it is not in the catalog.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return orNil(products.Get(ctx, source.(*inventory.Stock).SKU))
+			}},
+	)
+	product.Fields = append(product.Fields,
+		&Field{Name: "item", Object: item,
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return orNil(stock.Get(ctx, source.(*catalog.Product).SKU))
+			}},
+		&Field{Name: "price_history", Object: pricePoint, List: true, Args: limitArg(20), PageSize: pageSize(20, 100),
+			Description: "Price points, newest first.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return products.PriceHistory(ctx, source.(*catalog.Product).SKU, limit(args, 20, 100))
+			}},
+	)
+	category.Fields = append(category.Fields,
+		&Field{Name: "products", Object: product, List: true, Args: pageArgs(50), PageSize: pageSize(50, 200),
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return products.Search(ctx, catalog.Query{Category: source.(*catalog.Category).Slug, Sort: catalog.SortName,
+					Limit: limit(args, 50, 200), Offset: offset(args)})
+			}},
+	)
+
+	searchArgs := append([]Arg{
+		{Name: "text", Type: "String", Description: "Words to match in the name and description."},
+		{Name: "category", Type: "String"},
+		{Name: "min_price_cents", Type: "Int"},
+		{Name: "max_price_cents", Type: "Int"},
+		{Name: "in_stock", Type: "Boolean", Default: false},
+		{Name: "include_inactive", Type: "Boolean", Default: false},
+		{Name: "sort", Type: "String", Default: catalog.SortName, Description: "name, price_asc, price_desc or newest."},
+	}, pageArgs(50)...)
+	query := &Object{Name: "Query", Fields: []*Field{
+		{Name: "item", Object: item, Args: []Arg{{Name: "sku", Type: "String!"}},
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return orNil(stock.Get(ctx, args.String("sku")))
+			}},
+		{Name: "items", Object: item, List: true, Args: pageArgs(50), PageSize: pageSize(50, 200),
+			Description: "Stock items by SKU.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return stock.List(ctx, limit(args, 50, 200), offset(args))
+			}},
+		{Name: "warehouse", Object: warehouse, Args: []Arg{{Name: "code", Type: "String!"}},
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				warehouses, err := stock.ListWarehouses(ctx)
+				if err != nil {
+					return nil, err
+				}
+				for i := range warehouses {
+					if warehouses[i].Code == args.String("code") {
+						return &warehouses[i], nil
+					}
+				}
+				return nil, nil
+			}},
+		{Name: "warehouses", Object: warehouse, List: true, Args: limitArg(100), PageSize: pageSize(100, 200),
+			Description: "Registered warehouses by code. The default warehouse is not registered; its stock is in each item's levels.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				warehouses, err := stock.ListWarehouses(ctx)
+				return truncate(warehouses, limit(args, 100, 200)), err
+			}},
+		{Name: "product", Object: product, Args: []Arg{{Name: "sku", Type: "String!"}},
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				return orNil(products.Get(ctx, args.String("sku")))
+			}},
+		{Name: "products", Object: product, List: true, Args: searchArgs, PageSize: pageSize(50, 200),
+			Description: "Products matching every filter given, active ones only unless include_inactive is set.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				q := catalog.Query{
+					Text:            args.String("text"),
+					Category:        args.String("category"),
+					InStock:         args.Bool("in_stock"),
+					IncludeInactive: args.Bool("include_inactive"),
+					Sort:            args.String("sort"),
+					Limit:           limit(args, 50, 200),
+					Offset:          offset(args),
+				}
+				if !sorts[q.Sort] {
+					return nil, fmt.Errorf("sort must be name, price_asc, price_desc or newest")
+				}
+				var err error
+				if q.MinPriceCents, err = cents(args, "min_price_cents"); err != nil {
+					return nil, err
+				}
+				if q.MaxPriceCents, err = cents(args, "max_price_cents"); err != nil {
+					return nil, err
+				}
+				return products.Search(ctx, q)
+			}},
+		{Name: "categories", Object: category, List: true, Args: limitArg(100), PageSize: pageSize(100, 200),
+			Description: "Categories in use by active products.",
+			Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+				categories, err := products.Categories(ctx)
+				return truncate(categories, limit(args, 100, 200)), err
+			}},
+	}}
+	return &Schema{Query: query, MaxComplexity: maxComplexity, MaxDepth: maxDepth}
+}
+
+func cents(args Args, name string) (*int64, error) {
+	v, ok := args[name].(int)
+	if !ok {
+		return nil, nil
+	}
+	if v < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative number of cents", name)
+	}
+	c := int64(v)
+	return &c, nil
+}
+
+// orNil turns a store's not found error into a null field.
+func orNil[T any](v *T, err error) (any, error) {
+	if errors.Is(err, inventory.ErrNotFound) || errors.Is(err, catalog.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
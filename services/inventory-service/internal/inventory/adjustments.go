@@ -0,0 +1,293 @@
+package inventory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MaxAdjustmentLines bounds one adjustment, which runs in a single
+	// transaction.
+	MaxAdjustmentLines = 1000
+	maxAdjustmentBody  = 1 << 20
+)
+
+// AdjustmentLine is one stock correction: Delta base units of SKU. Lines are
+// numbered from 1 in the order they were sent.
+type AdjustmentLine struct {
+	Line         int    `json:"line"`
+	SKU          string `json:"sku"`
+	Delta        int    `json:"delta"`
+	Reason       string `json:"reason"`
+	MovementID   int64  `json:"movement_id,omitempty"`
+	OnHandBefore int    `json:"on_hand_before"`
+	OnHandAfter  int    `json:"on_hand_after"`
+	// Stock is the SKU's stock after the line, only when it was just
+	// applied or dry-run.
+	Stock *Stock `json:"stock,omitempty"`
+	// Err is why the line could not be applied.
+	Err error `json:"-"`
+}
+
+// Adjustment is a batch of stock corrections applied together, each as a
+// ledger movement referencing "adjustment-<id>".
+type Adjustment struct {
+	ID        int64            `json:"id,omitempty"`
+	Actor     string           `json:"actor,omitempty"`
+	Source    string           `json:"source"`
+	DryRun    bool             `json:"dry_run"`
+	Override  bool             `json:"override"`
+	LineCount int              `json:"line_count"`
+	Lines     []AdjustmentLine `json:"lines,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// movement is the ledger movement the line books. overrideBy, when set,
+// lets it take available stock below zero.
+func (l *AdjustmentLine) movement(adjustmentID int64, overrideBy string) *Movement {
+	return &Movement{
+		SKU:          l.SKU,
+		Delta:        l.Delta,
+		Unit:         BaseUnit,
+		UnitQuantity: l.Delta,
+		Reason:       l.Reason,
+		Reference:    fmt.Sprintf("adjustment-%d", adjustmentID),
+		OverrideBy:   overrideBy,
+	}
+}
+
+func validateAdjustmentLine(l *AdjustmentLine) error {
+	switch {
+	case l.SKU == "" || len(l.SKU) > 64:
+		return errors.New("sku must be 1 to 64 characters")
+	case l.Delta == 0:
+		return errors.New("delta must not be zero")
+	case l.Reason == "" || len(l.Reason) > 64:
+		return errors.New("reason must be 1 to 64 characters")
+	}
+	return nil
+}
+
+type adjustmentLineError struct {
+	Line      int    `json:"line"`
+	SKU       string `json:"sku,omitempty"`
+	Error     string `json:"error"`
+	Code      string `json:"code,omitempty"`
+	Available *int   `json:"available,omitempty"`
+}
+
+// parseAdjustmentCSV reads a header row naming sku, delta and reason, in any
+// order, then one line per row.
+func parseAdjustmentCSV(body io.Reader) ([]AdjustmentLine, []adjustmentLineError, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading csv header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, col := range header {
+		col = strings.TrimSpace(strings.ToLower(col))
+		if col != "sku" && col != "delta" && col != "reason" {
+			return nil, nil, fmt.Errorf("unknown csv column %q", col)
+		}
+		columns[col] = i
+	}
+	if len(columns) != 3 {
+		return nil, nil, errors.New("csv header must name sku, delta and reason")
+	}
+
+	var lines []AdjustmentLine
+	var invalid []adjustmentLineError
+	for n := 1; ; n++ {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			invalid = append(invalid, adjustmentLineError{Line: n, Error: "wrong number of fields"})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		l := AdjustmentLine{Line: n, SKU: strings.TrimSpace(row[columns["sku"]]), Reason: strings.TrimSpace(row[columns["reason"]])}
+		if l.Delta, err = strconv.Atoi(strings.TrimSpace(row[columns["delta"]])); err != nil {
+			invalid = append(invalid, adjustmentLineError{Line: n, SKU: l.SKU, Error: "delta must be an integer"})
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines, invalid, nil
+}
+
+func parseAdjustmentJSON(body io.Reader) ([]AdjustmentLine, error) {
+	var req []struct {
+		SKU    string `json:"sku"`
+		Delta  int    `json:"delta"`
+		Reason string `json:"reason"`
+	}
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("body must be a json array of {sku, delta, reason}: %w", err)
+	}
+	lines := make([]AdjustmentLine, len(req))
+	for i, l := range req {
+		lines[i] = AdjustmentLine{Line: i + 1, SKU: strings.TrimSpace(l.SKU), Delta: l.Delta, Reason: strings.TrimSpace(l.Reason)}
+	}
+	return lines, nil
+}
+
+// requestActor names who sent the request, or "" when nobody signed in.
+func requestActor(c *gin.Context) string {
+	p, ok := auth.FromContext(c)
+	switch {
+	case !ok:
+		return ""
+	case p.Service != "":
+		return "service:" + p.Service
+	default:
+		return "user:" + strconv.Itoa(p.UserID)
+	}
+}
+
+// createAdjustment applies a CSV (text/csv) or JSON array body of stock
+// corrections, all or nothing. ?dry_run=true reports the resulting stock
+// without keeping any of it; ?override=true lets an admin take available
+// stock below zero.
+func (h *Handler) createAdjustment(c *gin.Context) {
+	a := &Adjustment{DryRun: c.Query("dry_run") == "true", Override: c.Query("override") == "true", Actor: requestActor(c)}
+	overrideBy := ""
+	if a.Override {
+		var ok bool
+		if overrideBy, ok = overrideActor(c); !ok {
+			return
+		}
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxAdjustmentBody)
+	var invalid []adjustmentLineError
+	var err error
+	switch c.ContentType() {
+	case "text/csv":
+		a.Source = "csv"
+		a.Lines, invalid, err = parseAdjustmentCSV(body)
+	case "application/json":
+		a.Source = "json"
+		a.Lines, err = parseAdjustmentJSON(body)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be text/csv or application/json"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range a.Lines {
+		if err := validateAdjustmentLine(&a.Lines[i]); err != nil {
+			invalid = append(invalid, adjustmentLineError{Line: a.Lines[i].Line, SKU: a.Lines[i].SKU, Error: err.Error()})
+		}
+	}
+	if len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid adjustment lines, nothing was applied", "lines": invalid})
+		return
+	}
+	if len(a.Lines) == 0 || len(a.Lines) > MaxAdjustmentLines {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("an adjustment must have 1 to %d lines", MaxAdjustmentLines)})
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = h.store.ApplyAdjustment(ctx, a, overrideBy)
+	if errors.Is(err, ErrAdjustmentRejected) {
+		c.JSON(http.StatusConflict, gin.H{"error": "adjustment rejected, nothing was applied", "lines": h.rejectedLines(c, a)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if a.DryRun {
+		c.JSON(http.StatusOK, a)
+		return
+	}
+
+	decreased := false
+	skus := []string{}
+	seen := map[string]bool{}
+	for i := range a.Lines {
+		l := &a.Lines[i]
+		decreased = decreased || l.Delta < 0
+		if !seen[l.SKU] {
+			seen[l.SKU] = true
+			skus = append(skus, l.SKU)
+		}
+		h.stockWentNegative(ctx, &Movement{ID: l.MovementID, SKU: l.SKU, Delta: l.Delta, Reason: l.Reason, OverrideBy: overrideBy}, l.Stock)
+	}
+	h.stockChanged(ctx, decreased, skus...)
+	c.JSON(http.StatusCreated, a)
+}
+
+// rejectedLines explains each line that could not be applied. Available
+// stock is as of now, without the batch's earlier lines.
+func (h *Handler) rejectedLines(c *gin.Context, a *Adjustment) []adjustmentLineError {
+	rejected := []adjustmentLineError{}
+	for _, l := range a.Lines {
+		switch {
+		case l.Err == nil:
+		case errors.Is(l.Err, ErrNotFound):
+			rejected = append(rejected, adjustmentLineError{Line: l.Line, SKU: l.SKU, Error: "item not found"})
+		case errors.Is(l.Err, ErrInsufficientStock):
+			e := adjustmentLineError{Line: l.Line, SKU: l.SKU, Error: "insufficient available stock", Code: codeInsufficientStock}
+			if stock, err := h.store.Get(c.Request.Context(), l.SKU); err == nil {
+				e.Available = &stock.Available
+			}
+			rejected = append(rejected, e)
+		default:
+			rejected = append(rejected, adjustmentLineError{Line: l.Line, SKU: l.SKU, Error: l.Err.Error()})
+		}
+	}
+	return rejected
+}
+
+func (h *Handler) listAdjustments(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	adjustments, err := h.store.ListAdjustments(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"adjustments": adjustments})
+}
+
+func (h *Handler) getAdjustment(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid adjustment id"})
+		return
+	}
+	a, err := h.store.GetAdjustment(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "adjustment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
@@ -0,0 +1,106 @@
+package inventory
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+)
+
+// ExpiryMonitor quarantines lots once they expire and publishes a
+// LotExpiring event for each lot that will expire within its warning
+// window. Each lot is alerted on once.
+type ExpiryMonitor struct {
+	store     Store
+	publisher events.Publisher
+	watcher   *Watcher
+	recipient string
+	warnDays  int
+	batchSize int
+	now       func() time.Time
+}
+
+// NewExpiryMonitor warns warnDays ahead of a lot's expiry, emailing
+// recipient if set. Quarantining stock takes it out of availability, so
+// watcher, when non-nil, is triggered to check reorder points.
+func NewExpiryMonitor(store Store, publisher events.Publisher, watcher *Watcher, recipient string, warnDays int) *ExpiryMonitor {
+	return &ExpiryMonitor{
+		store:     store,
+		publisher: publisher,
+		watcher:   watcher,
+		recipient: recipient,
+		warnDays:  warnDays,
+		batchSize: 100,
+		now:       time.Now,
+	}
+}
+
+// Job runs Sweep and logs what it did. Dates are in UTC, so it is meant to
+// run daily shortly after midnight UTC.
+func (m *ExpiryMonitor) Job() jobs.Func {
+	return func(ctx context.Context) error {
+		quarantined, alerted, err := m.Sweep(ctx)
+		if quarantined > 0 || alerted > 0 {
+			log.Printf("Quarantined %d expired lots and sent %d lot expiry alerts", quarantined, alerted)
+		}
+		return err
+	}
+}
+
+// Sweep quarantines lots that expired before today, then alerts on every
+// lot expiring within the warning window, and returns how many lots it
+// quarantined and alerted on.
+func (m *ExpiryMonitor) Sweep(ctx context.Context) (int, int, error) {
+	today := m.now().UTC()
+	expired, err := m.store.QuarantineExpired(ctx, today)
+	if err != nil {
+		return 0, 0, err
+	}
+	skus := []string{}
+	seen := map[string]bool{}
+	for _, l := range expired {
+		log.Printf("Quarantined lot %s of %s: %d expired on %s", l.Code, l.SKU, l.Quantity, l.ExpiresOn)
+		if l.Quantity > 0 && !seen[l.SKU] {
+			seen[l.SKU] = true
+			skus = append(skus, l.SKU)
+		}
+	}
+	if len(skus) > 0 {
+		announce(ctx, m.publisher, m.watcher, true, skus...)
+	}
+
+	alerted := 0
+	through := today.AddDate(0, 0, m.warnDays)
+	for {
+		lots, err := m.store.ExpiringLots(ctx, through, m.batchSize)
+		if err != nil {
+			return len(expired), alerted, err
+		}
+		for _, l := range lots {
+			e, err := events.New(events.InventoryLotExpiring, "inventory-service", events.LotExpiring{
+				LotID:       l.ID,
+				SKU:         l.SKU,
+				Name:        l.Name,
+				LotCode:     l.Code,
+				ExpiresOn:   l.ExpiresOn,
+				Quantity:    l.Quantity,
+				NotifyEmail: m.recipient,
+			})
+			if err != nil {
+				return len(expired), alerted, err
+			}
+			if err := m.publisher.Publish(ctx, e); err != nil {
+				return len(expired), alerted, err
+			}
+			if err := m.store.MarkLotAlerted(ctx, l.ID, m.now()); err != nil {
+				return len(expired), alerted, err
+			}
+			alerted++
+		}
+		if len(lots) < m.batchSize {
+			return len(expired), alerted, nil
+		}
+	}
+}
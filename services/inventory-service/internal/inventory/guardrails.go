@@ -0,0 +1,76 @@
+package inventory
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+// codeInsufficientStock marks 409 responses for requests that would take
+// available stock below zero.
+const codeInsufficientStock = "INSUFFICIENT_STOCK"
+
+// insufficientStock responds 409 with the SKU's current available stock,
+// in base units, next to the requested quantity.
+func (h *Handler) insufficientStock(c *gin.Context, sku string, requested int) {
+	body := gin.H{"error": "insufficient available stock", "code": codeInsufficientStock, "sku": sku, "requested": requested}
+	if stock, err := h.store.Get(c.Request.Context(), sku); err == nil {
+		body["available"] = stock.Available
+	}
+	c.JSON(http.StatusConflict, body)
+}
+
+// overrideActor returns who is overriding the negative-stock guard. Only
+// admins may; anyone else gets a 403.
+func overrideActor(c *gin.Context) (string, bool) {
+	p, ok := auth.FromContext(c)
+	if !ok || !p.HasRole(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "overriding the stock guard requires the admin role"})
+		return "", false
+	}
+	return actor(p), true
+}
+
+// actor names p in the ledger: the calling service, or the user.
+func actor(p *auth.Principal) string {
+	if p.Service != "" {
+		return "service:" + p.Service
+	}
+	return "user:" + strconv.Itoa(p.UserID)
+}
+
+// stockWentNegative alerts on an override that left the SKU with negative
+// available stock, not counting safety stock: dipping into safety stock is
+// what it is for. Publishing failures are only logged, like other stock
+// events; the ledger keeps the override either way.
+func (h *Handler) stockWentNegative(ctx context.Context, m *Movement, stock *Stock) {
+	if m.OverrideBy == "" || m.Delta >= 0 || stock.Available+stock.SafetyStock >= 0 {
+		return
+	}
+	log.Printf("Override by %s took %s to %d available: %s", m.OverrideBy, m.SKU, stock.Available, m.Reason)
+	if h.publisher == nil {
+		return
+	}
+	e, err := events.New(events.InventoryStockNegative, "inventory-service", events.StockNegative{
+		SKU:        stock.SKU,
+		Name:       stock.Name,
+		OnHand:     stock.OnHand,
+		Reserved:   stock.Reserved,
+		Available:  stock.Available,
+		MovementID: m.ID,
+		Delta:      m.Delta,
+		Actor:      m.OverrideBy,
+		Reason:     m.Reason,
+	})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish negative stock alert for %s: %v", m.SKU, err)
+	}
+}
@@ -0,0 +1,344 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/fields"
+	"github.com/alux444/go-microserv-test/pkg/ndjson"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const maxChangesPage = 500
+
+type Handler struct {
+	store          Store
+	watcher        *Watcher
+	publisher      events.Publisher
+	maxAge         time.Duration
+	reservationTTL time.Duration
+}
+
+// NewHandler triggers watcher, when non-nil, after every stock change that
+// could take a SKU below its reorder point, and announces every stock change
+// on publisher, when non-nil. Stock reads tell clients they may reuse the
+// answer for maxAge; zero sends no hint. Reservations that ask for no TTL
+// expire after reservationTTL; zero keeps them until they are settled.
+func NewHandler(store Store, watcher *Watcher, publisher events.Publisher, maxAge, reservationTTL time.Duration) *Handler {
+	return &Handler{store: store, watcher: watcher, publisher: publisher, maxAge: maxAge, reservationTTL: reservationTTL}
+}
+
+// stockChanged publishes a StockChange for each SKU and, when stock went
+// down, wakes the low-stock watcher.
+func (h *Handler) stockChanged(ctx context.Context, decreased bool, skus ...string) {
+	announce(ctx, h.publisher, h.watcher, decreased, skus...)
+}
+
+// announce publishes a StockChange for each SKU on publisher and, when stock
+// went down, triggers watcher; either may be nil. Publishing failures are
+// only logged: cached copies still expire by their max-age.
+func announce(ctx context.Context, publisher events.Publisher, watcher *Watcher, decreased bool, skus ...string) {
+	if decreased && watcher != nil {
+		watcher.Trigger()
+	}
+	if publisher == nil {
+		return
+	}
+	id, _ := tenant.Lookup(ctx)
+	for _, sku := range skus {
+		e, err := events.New(events.InventoryStockChanged, "inventory-service", events.StockChange{SKU: sku, Tenant: id})
+		if err == nil {
+			err = publisher.Publish(ctx, e)
+		}
+		if err != nil {
+			log.Printf("Failed to publish stock change for %s: %v", sku, err)
+		}
+	}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/items", h.list)
+	router.POST("/items", h.createItem)
+	router.GET("/stock/changes", h.changes)
+	router.GET("/stock/:sku", h.getStock)
+	router.POST("/stock/:sku/movements", h.recordMovement)
+	router.POST("/stock/:sku/shortages", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.reportShortage)
+	router.POST("/stock/:sku/reservations", auth.InternalOnly(), h.reserve)
+	router.DELETE("/reservations/:id", auth.InternalOnly(), h.releaseReservation)
+	router.POST("/reservations/:id/commit", auth.InternalOnly(), h.commitReservation)
+	router.PATCH("/reservations/:id/extend", auth.InternalOnly(), h.extendReservation)
+	router.GET("/reports/reservations", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.reservationReport)
+	router.GET("/items/:sku/units", h.listUnits)
+	router.PUT("/items/:sku/units/:unit", h.setUnit)
+	router.POST("/items/adjustments", h.createAdjustment)
+	router.GET("/items/adjustments", h.listAdjustments)
+	router.GET("/items/adjustments/:id", h.getAdjustment)
+	router.POST("/purchase-orders", h.createPurchaseOrder)
+	router.GET("/purchase-orders/:id", h.getPurchaseOrder)
+	router.POST("/purchase-orders/:id/receive", h.receivePurchaseOrder)
+	router.GET("/thresholds", h.listThresholds)
+	router.GET("/items/:sku/threshold", h.getThreshold)
+	router.PUT("/items/:sku/threshold", h.setThreshold)
+	router.DELETE("/items/:sku/threshold", h.deleteThreshold)
+	router.POST("/stock/:sku/lots", h.receiveLot)
+	router.GET("/stock/:sku/lots", h.listLots)
+	router.POST("/lots/:id/dispose", h.disposeLot)
+	router.GET("/reports/expiring-lots", h.expiryReport)
+	router.GET("/items/duplicates", auth.RequireRole(auth.RoleAdmin), h.findDuplicates)
+	router.PUT("/items/:sku/barcode", auth.RequireRole(auth.RoleAdmin), h.setBarcode)
+	router.POST("/items/merges", auth.RequireRole(auth.RoleAdmin), h.mergeItems)
+	router.GET("/items/merges", auth.RequireRole(auth.RoleAdmin), h.listMerges)
+	router.GET("/stock/:sku/warehouses", h.stockByWarehouse)
+	router.GET("/warehouses", h.listWarehouses)
+	router.POST("/warehouses", auth.RequireRole(auth.RoleAdmin), h.createWarehouse)
+	router.GET("/warehouses/:code/stock", h.warehouseStock)
+	router.GET("/warehouses/transfers", h.listTransfers)
+	router.POST("/warehouses/transfers", auth.RequireRole(auth.RoleAdmin, auth.RoleWarehouse), h.transfer)
+}
+
+// stockFields are the fields of an item's stock ?fields= may select.
+// in_unit is only sent with ?unit=.
+var stockFields = fields.Allow("sku", "name", "on_hand", "reserved", "quarantined", "safety_stock", "available", "updated_at", "in_unit")
+
+// list answers a page of items, or every item as NDJSON when the client
+// accepts it.
+func (h *Handler) list(c *gin.Context) {
+	sel, ok := stockFields.Bind(c)
+	if !ok {
+		return
+	}
+	if ndjson.Accepted(c.Request) {
+		s := ndjson.Start(c)
+		s.Close(h.store.Stream(c.Request.Context(), func(st Stock) error { return s.Write(sel.Apply(st)) }))
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	items, err := h.store.List(c.Request.Context(), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": fields.ApplyEach(sel, items)})
+}
+
+func (h *Handler) createItem(c *gin.Context) {
+	var req struct {
+		SKU  string `json:"sku" binding:"required,max=64"`
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stock, err := h.store.CreateItem(c.Request.Context(), req.SKU, req.Name)
+	if errors.Is(err, ErrAlreadyExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "item already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, stock)
+}
+
+// getStock supports conditional reads: clients polling a SKU send back the
+// Last-Modified value as If-Modified-Since and get a 304 until stock changes.
+// With ?unit= the response also carries the stock in whole units of it.
+func (h *Handler) getStock(c *gin.Context) {
+	sel, ok := stockFields.Bind(c)
+	if !ok {
+		return
+	}
+	sku := c.Param("sku")
+	stock, err := h.store.Get(c.Request.Context(), sku)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Last-Modified", stock.UpdatedAt.UTC().Format(http.TimeFormat))
+	cachetags.Set(c, cachetags.SKU(stock.SKU))
+	if !h.cacheHint(c, stock) {
+		return
+	}
+	if etag.NotModified(c, stock.Version) {
+		return
+	}
+	// If-None-Match, when sent, takes precedence over If-Modified-Since.
+	if c.GetHeader("If-None-Match") == "" && notModified(c.GetHeader("If-Modified-Since"), stock.UpdatedAt) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	unit := c.Query("unit")
+	if unit == "" {
+		c.JSON(http.StatusOK, sel.Apply(stock))
+		return
+	}
+	unit, factor, ok := h.toBase(c, sku, unit, 1)
+	if !ok {
+		return
+	}
+	in := inUnit(stock, Unit{Name: unit, Factor: factor})
+	stock.InUnit = &in
+	c.JSON(http.StatusOK, sel.Apply(stock))
+}
+
+func (h *Handler) recordMovement(c *gin.Context) {
+	var req struct {
+		Delta     int    `json:"delta" binding:"required"`
+		Unit      string `json:"unit"`
+		Reason    string `json:"reason" binding:"required,max=64"`
+		Reference string `json:"reference"`
+		// Override lets an admin correction take available stock below
+		// zero.
+		Override bool `json:"override"`
+		// LotID books the movement into or out of that lot, e.g. a pick.
+		LotID int64 `json:"lot_id" binding:"min=0"`
+		// Warehouse is where the stock comes in or leaves; lots are kept
+		// in DefaultWarehouse.
+		Warehouse string `json:"warehouse" binding:"max=32"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sku := c.Param("sku")
+	unit, delta, ok := h.toBase(c, sku, req.Unit, req.Delta)
+	if !ok {
+		return
+	}
+	m := &Movement{SKU: sku, Delta: delta, Unit: unit, UnitQuantity: req.Delta, Reason: req.Reason, Reference: req.Reference, LotID: req.LotID,
+		Warehouse: normalizeWarehouse(req.Warehouse)}
+	if m.LotID != 0 && m.Warehouse != DefaultWarehouse {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "lots are kept in " + DefaultWarehouse})
+		return
+	}
+	if req.Override {
+		if m.OverrideBy, ok = overrideActor(c); !ok {
+			return
+		}
+	}
+	stock, err := h.store.RecordMovement(c.Request.Context(), m)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if errors.Is(err, ErrInsufficientStock) {
+		h.insufficientStock(c, sku, -delta)
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "lot is not active or holds too little stock"})
+		return
+	}
+	if errors.Is(err, ErrUnknownWarehouse) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.stockChanged(c.Request.Context(), m.Delta < 0, sku)
+	h.stockWentNegative(c.Request.Context(), m, stock)
+	c.JSON(http.StatusCreated, gin.H{"movement": m, "stock": stock})
+}
+
+// changes returns SKUs whose stock changed after ?since= (RFC 3339). Clients
+// pass the returned next_since on their next poll; omitting since returns
+// changes from the beginning.
+func (h *Handler) changes(c *gin.Context) {
+	var since time.Time
+	if raw := c.Query("since"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC 3339 timestamp"})
+			return
+		}
+		since = parsed
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > maxChangesPage {
+		limit = 100
+	}
+
+	changes, err := h.store.ChangesSince(c.Request.Context(), since, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	nextSince := since
+	if len(changes) > 0 {
+		nextSince = changes[len(changes)-1].UpdatedAt
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"changes":    changes,
+		"next_since": nextSince.UTC().Format(time.RFC3339Nano),
+		"has_more":   len(changes) == limit,
+	})
+}
+
+// notModified reports whether a resource last modified at lastModified is
+// unchanged since the If-Modified-Since header value. HTTP dates have second
+// precision, so lastModified is truncated before comparing.
+func notModified(ifModifiedSince string, lastModified time.Time) bool {
+	if ifModifiedSince == "" {
+		return false
+	}
+	t, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(t)
+}
+
+// cacheHint sets Cache-Control on a stock read. Stock that is out or below
+// its reorder point is no-cache, since a stale answer there is the one most
+// likely to be wrong; the rest may be reused for maxAge.
+func (h *Handler) cacheHint(c *gin.Context, stock *Stock) bool {
+	if h.maxAge <= 0 {
+		return true
+	}
+	scarce := stock.Available <= 0
+	if !scarce {
+		t, err := h.store.GetThreshold(c.Request.Context(), stock.SKU)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		scarce = err == nil && stock.Available < t.ReorderPoint
+	}
+	if scarce {
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		c.Header("Cache-Control", "max-age="+strconv.Itoa(int(h.maxAge.Seconds())))
+	}
+	return true
+}
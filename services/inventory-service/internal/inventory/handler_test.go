@@ -0,0 +1,1277 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	header := lastModified.Format(http.TimeFormat)
+
+	if !notModified(header, lastModified) {
+		t.Error("Expected resource to be unmodified for its own Last-Modified value")
+	}
+	if notModified(header, lastModified.Add(time.Second)) {
+		t.Error("Expected resource modified a second later to be reported as modified")
+	}
+	if notModified("", lastModified) {
+		t.Error("Expected missing header to never be not-modified")
+	}
+	if notModified("yesterday", lastModified) {
+		t.Error("Expected invalid header to be ignored")
+	}
+}
+
+type fakeStore struct {
+	Store
+	stock     Stock
+	units     map[string]int
+	recorded  *Movement
+	reserved  *Reservation
+	threshold *Threshold
+}
+
+func (f *fakeStore) Get(ctx context.Context, sku string) (*Stock, error) {
+	s := f.stock
+	return &s, nil
+}
+
+func (f *fakeStore) UnitFactor(ctx context.Context, sku, unit string) (int, error) {
+	if unit == BaseUnit {
+		return 1, nil
+	}
+	factor, ok := f.units[unit]
+	if !ok {
+		return 0, ErrUnknownUnit
+	}
+	return factor, nil
+}
+
+func (f *fakeStore) RecordMovement(ctx context.Context, m *Movement) (*Stock, error) {
+	if m.Delta < 0 && m.OverrideBy == "" && f.stock.Available+m.Delta < 0 {
+		return nil, ErrInsufficientStock
+	}
+	f.recorded = m
+	s := f.stock
+	s.OnHand += m.Delta
+	s.Available += m.Delta
+	return &s, nil
+}
+
+func (f *fakeStore) RecordOnce(ctx context.Context, m *Movement) (*Stock, bool, error) {
+	if r := f.recorded; r != nil && r.Reason == m.Reason && r.Reference == m.Reference {
+		*m = *r
+		s := f.stock
+		return &s, false, nil
+	}
+	s, err := f.RecordMovement(ctx, m)
+	return s, err == nil, err
+}
+
+// ApplyAdjustment applies lines for the fake's one SKU; any other SKU is
+// not found.
+func (f *fakeStore) ApplyAdjustment(ctx context.Context, a *Adjustment, overrideBy string) error {
+	s, rejected := f.stock, false
+	for i := range a.Lines {
+		l := &a.Lines[i]
+		switch {
+		case l.SKU != s.SKU:
+			l.Err, rejected = ErrNotFound, true
+		case l.Delta < 0 && overrideBy == "" && s.Available+l.Delta < 0:
+			l.Err, rejected = ErrInsufficientStock, true
+		default:
+			l.OnHandBefore = s.OnHand
+			s.OnHand += l.Delta
+			s.Available += l.Delta
+			l.OnHandAfter = s.OnHand
+			st := s
+			l.Stock = &st
+		}
+	}
+	if rejected {
+		return ErrAdjustmentRejected
+	}
+	if !a.DryRun {
+		a.ID = 1
+		f.stock = s
+	}
+	return nil
+}
+
+func (f *fakeStore) Reserve(ctx context.Context, r *Reservation) (*Stock, error) {
+	if r.Quantity > f.stock.Available {
+		return nil, ErrInsufficientStock
+	}
+	f.reserved = r
+	s := f.stock
+	return &s, nil
+}
+
+func (f *fakeStore) SetThreshold(ctx context.Context, t *Threshold) error {
+	f.threshold = t
+	return nil
+}
+
+func (f *fakeStore) GetThreshold(ctx context.Context, sku string) (*Threshold, error) {
+	if f.threshold == nil {
+		return nil, ErrNotFound
+	}
+	return f.threshold, nil
+}
+
+func newTestRouter(store Store) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	NewHandler(store, nil, nil, 0, 0).RegisterRoutes(router)
+	return router
+}
+
+// orderService is order-service calling with its own token, as the
+// reservation endpoints require.
+var orderService = &auth.Principal{Service: "order-service", Roles: []string{auth.RoleService}, Internal: true}
+
+func newServiceRouter(store Store) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, orderService) })
+	NewHandler(store, nil, nil, 0, 0).RegisterRoutes(router)
+	return router
+}
+
+type streamStore struct {
+	fakeStore
+	items []Stock
+}
+
+func (s *streamStore) Stream(ctx context.Context, fn func(Stock) error) error {
+	for _, st := range s.items {
+		if err := fn(st); err != nil {
+			return err
+		}
+	}
+	return errors.New("replica went away")
+}
+
+func TestListNDJSON(t *testing.T) {
+	router := newTestRouter(&streamStore{items: []Stock{{Stock: models.Stock{SKU: "SKU-001", OnHand: 4}}, {Stock: models.Stock{SKU: "SKU-002"}}}})
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || len(lines) != 3 || !strings.HasPrefix(lines[0], `{"sku":"SKU-001",`) {
+		t.Fatalf("Expected an item per line, got: %d %s", w.Code, w.Body)
+	}
+	if lines[2] != `{"error":"replica went away"}` {
+		t.Errorf("Expected a failed scan to end the stream with an error line, got: %s", lines[2])
+	}
+}
+
+func TestUnitConversions(t *testing.T) {
+	store := &fakeStore{
+		stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 130, Reserved: 10, Available: 120}},
+		units: map[string]int{"case": 12},
+	}
+	router := newServiceRouter(store)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/movements",
+		strings.NewReader(`{"delta": 2, "unit": "case", "reason": "restock"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got: %d %s", w.Code, w.Body)
+	}
+	if m := store.recorded; m.Delta != 24 || m.Unit != "case" || m.UnitQuantity != 2 {
+		t.Errorf("Expected 2 cases booked as 24 each, got: %+v", m)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/movements",
+		strings.NewReader(`{"delta": 1, "reason": "restock"}`)))
+	if m := store.recorded; w.Code != http.StatusCreated || m.Delta != 1 || m.Unit != BaseUnit {
+		t.Errorf("Expected a movement without unit to be in base units, got: %d %+v", w.Code, m)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/movements",
+		strings.NewReader(`{"delta": 1, "unit": "pallet", "reason": "restock"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown unit, got: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stock/SKU-001?unit=case", nil))
+	var body struct {
+		OnHand int       `json:"on_hand"`
+		InUnit UnitStock `json:"in_unit"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected JSON body, got: %v", err)
+	}
+	if body.OnHand != 130 || body.InUnit.OnHand != 10 || body.InUnit.Available != 10 {
+		t.Errorf("Expected 130 each as 10 whole cases, got: %+v", body)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stock/SKU-001?unit=case&fields=available,in_unit", nil))
+	if !strings.HasPrefix(w.Body.String(), `{"available":120,"in_unit":{`) || strings.Contains(w.Body.String(), "on_hand\":130") {
+		t.Errorf("Expected only the available stock and the stock in cases, got: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/reservations",
+		strings.NewReader(`{"quantity": 11, "unit": "case"}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 11 cases to exceed 120 available, got: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/reservations",
+		strings.NewReader(`{"quantity": 10, "unit": "case"}`)))
+	if r := store.reserved; w.Code != http.StatusCreated || r.Quantity != 120 {
+		t.Errorf("Expected 10 cases reserved as 120 each, got: %d %+v", w.Code, r)
+	}
+}
+
+func TestNegativeStockGuard(t *testing.T) {
+	store := &fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 5, Reserved: 2, Available: 3}}}
+	publisher := &recordingPublisher{}
+	post := func(p *auth.Principal, body string) *httptest.ResponseRecorder {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		if p != nil {
+			router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		}
+		NewHandler(store, nil, publisher, 0, 0).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/movements", strings.NewReader(body)))
+		return w
+	}
+	admin := &auth.Principal{UserID: 7, Roles: []string{auth.RoleAdmin}}
+
+	w := post(nil, `{"delta": -4, "reason": "damaged"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"code":"INSUFFICIENT_STOCK"`) ||
+		!strings.Contains(w.Body.String(), `"available":3`) {
+		t.Errorf("Expected an INSUFFICIENT_STOCK conflict, got: %d %s", w.Code, w.Body)
+	}
+
+	w = post(&auth.Principal{UserID: 8, Roles: []string{auth.RoleCustomer}}, `{"delta": -4, "reason": "damaged", "override": true}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a customer override to be forbidden, got: %d", w.Code)
+	}
+
+	w = post(admin, `{"delta": -4, "reason": "count correction", "override": true}`)
+	if w.Code != http.StatusCreated || store.recorded.OverrideBy != "user:7" {
+		t.Fatalf("Expected the admin override to be recorded, got: %d %s", w.Code, w.Body)
+	}
+	var alerts []events.StockNegative
+	for _, e := range publisher.published {
+		if e.Type == events.InventoryStockNegative {
+			var alert events.StockNegative
+			if err := e.Decode(&alert); err != nil {
+				t.Fatalf("Expected a decodable alert, got: %v", err)
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+	if len(alerts) != 1 || alerts[0].Available != -1 || alerts[0].Actor != "user:7" {
+		t.Errorf("Expected one negative stock alert at -1 available, got: %+v", alerts)
+	}
+
+	publisher.published = nil
+	if w := post(admin, `{"delta": -1, "reason": "count correction", "override": true}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the override to be allowed, got: %d", w.Code)
+	}
+	for _, e := range publisher.published {
+		if e.Type == events.InventoryStockNegative {
+			t.Errorf("Expected no alert for an override that stays non-negative, got: %+v", e)
+		}
+	}
+}
+
+func TestPickShortage(t *testing.T) {
+	store := &fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 5, Reserved: 5}}, units: map[string]int{"case": 12}}
+	publisher := &recordingPublisher{}
+	post := func(p *auth.Principal, body string) *httptest.ResponseRecorder {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, nil, publisher, 0, 0).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/shortages", strings.NewReader(body)))
+		return w
+	}
+	service := &auth.Principal{Service: "order-service", Roles: []string{auth.RoleService}}
+
+	if w := post(&auth.Principal{UserID: 8, Roles: []string{auth.RoleCustomer}}, `{"quantity": 1, "reference": "order-1-line-1"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers not to report shortages, got: %d", w.Code)
+	}
+	if w := post(service, `{"quantity": 1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a shortage without a reference to be rejected, got: %d", w.Code)
+	}
+
+	w := post(service, `{"quantity": 1, "unit": "case", "reference": "order-1-line-1"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the shortage to be booked, got: %d %s", w.Code, w.Body)
+	}
+	m := store.recorded
+	if m.Delta != -12 || m.UnitQuantity != -1 || m.Reason != ReasonPickShortage || m.OverrideBy != "service:order-service" {
+		t.Errorf("Expected 12 each booked off as a pick shortage by order-service, got: %+v", m)
+	}
+	if len(publisher.published) != 2 {
+		t.Errorf("Expected a stock change and a negative stock alert, got: %+v", publisher.published)
+	}
+
+	publisher.published = nil
+	w = post(service, `{"quantity": 1, "unit": "case", "reference": "order-1-line-1"}`)
+	if w.Code != http.StatusOK || store.recorded != m || len(publisher.published) != 0 {
+		t.Errorf("Expected a retried report to return the booked movement quietly, got: %d %s", w.Code, w.Body)
+	}
+}
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+// thresholdStore keeps thresholds in memory and evaluates them against a
+// fixed available quantity per SKU.
+type thresholdStore struct {
+	Store
+	available  map[string]int
+	thresholds map[string]*Threshold
+}
+
+func (s *thresholdStore) LowStock(ctx context.Context, limit int) ([]Threshold, error) {
+	low := []Threshold{}
+	for sku, t := range s.thresholds {
+		if t.AlertedAt == nil && s.available[sku] < t.ReorderPoint {
+			low = append(low, Threshold{SKU: sku, ReorderPoint: t.ReorderPoint, Available: s.available[sku]})
+		}
+	}
+	return low, nil
+}
+
+func (s *thresholdStore) MarkAlerted(ctx context.Context, sku string, at time.Time) error {
+	s.thresholds[sku].AlertedAt = &at
+	return nil
+}
+
+func (s *thresholdStore) ClearRecovered(ctx context.Context) (int, error) {
+	n := 0
+	for sku, t := range s.thresholds {
+		if t.AlertedAt != nil && s.available[sku] >= t.ReorderPoint {
+			t.AlertedAt = nil
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestBatchAdjustment(t *testing.T) {
+	store := &fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 10, Available: 10}}}
+	router := newTestRouter(store)
+	post := func(query, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/items/adjustments"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	csvBody := "sku,delta,reason\nSKU-001,5,found in aisle 4\nSKU-001,-12,cycle count\n"
+	w := post("?dry_run=true", "text/csv", csvBody)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the dry run to succeed, got: %d %s", w.Code, w.Body)
+	}
+	var dry Adjustment
+	if err := json.Unmarshal(w.Body.Bytes(), &dry); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !dry.DryRun || dry.ID != 0 || dry.Source != "csv" || len(dry.Lines) != 2 || dry.Lines[1].OnHandBefore != 15 || dry.Lines[1].Stock.OnHand != 3 {
+		t.Errorf("Expected the quantities after each line, got: %+v", dry)
+	}
+	if store.stock.OnHand != 10 {
+		t.Errorf("Expected the dry run to change nothing, got: %d on hand", store.stock.OnHand)
+	}
+
+	w = post("", "application/json", `[{"sku": "SKU-001", "delta": -4, "reason": "damaged"}, {"sku": "SKU-404", "delta": 1, "reason": "found"}, {"sku": "SKU-001", "delta": -20, "reason": "lost"}]`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected the adjustment to be rejected, got: %d %s", w.Code, w.Body)
+	}
+	var rejected struct {
+		Lines []adjustmentLineError `json:"lines"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rejected); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(rejected.Lines) != 2 || rejected.Lines[0].Line != 2 || rejected.Lines[1].Code != codeInsufficientStock {
+		t.Errorf("Expected lines 2 and 3 to be rejected, got: %+v", rejected.Lines)
+	}
+	if store.stock.OnHand != 10 {
+		t.Errorf("Expected a rejected adjustment to change nothing, got: %d on hand", store.stock.OnHand)
+	}
+
+	if w := post("", "text/csv", "sku,delta,reason\nSKU-001,lots,recount\nSKU-001,3,\n"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"line":2`) {
+		t.Errorf("Expected each invalid line to be reported, got: %d %s", w.Code, w.Body)
+	}
+	if w := post("", "text/csv", "sku,qty\nSKU-001,3\n"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown column to be rejected, got: %d", w.Code)
+	}
+	if w := post("", "text/plain", "SKU-001 +3"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected other content types to be rejected, got: %d", w.Code)
+	}
+	if w := post("?override=true", "application/json", `[{"sku": "SKU-001", "delta": -20, "reason": "lost"}]`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected an override without the admin role to be forbidden, got: %d", w.Code)
+	}
+
+	w = post("", "application/json", `[{"sku": "SKU-001", "delta": -4, "reason": "damaged"}]`)
+	if w.Code != http.StatusCreated || store.stock.OnHand != 6 {
+		t.Errorf("Expected the adjustment to be applied, got: %d %d on hand", w.Code, store.stock.OnHand)
+	}
+}
+
+func TestWatcherAlertsOncePerDip(t *testing.T) {
+	store := &thresholdStore{
+		available:  map[string]int{"SKU-001": 30},
+		thresholds: map[string]*Threshold{"SKU-001": {ReorderPoint: 24}},
+	}
+	publisher := &recordingPublisher{}
+	watcher := NewWatcher(store, publisher, "buyer@example.com")
+	ctx := context.Background()
+
+	sweep := func(available, want int) {
+		t.Helper()
+		store.available["SKU-001"] = available
+		sent, err := watcher.Sweep(ctx)
+		if err != nil || sent != want {
+			t.Fatalf("Expected %d alerts at %d available, got: %d %v", want, available, sent, err)
+		}
+	}
+	sweep(30, 0)
+	sweep(20, 1)
+	sweep(10, 0)
+	sweep(24, 0)
+	sweep(23, 1)
+
+	var alert events.LowStock
+	if err := publisher.published[0].Decode(&alert); err != nil {
+		t.Fatalf("Failed to decode alert: %v", err)
+	}
+	if alert.SKU != "SKU-001" || alert.Available != 20 || alert.NotifyEmail != "buyer@example.com" {
+		t.Errorf("Expected alert for SKU-001 at 20 to the default recipient, got: %+v", alert)
+	}
+}
+
+func TestSetThresholdInUnits(t *testing.T) {
+	store := &fakeStore{units: map[string]int{"case": 12}}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	watcher := NewWatcher(store, &recordingPublisher{}, "")
+	NewHandler(store, watcher, nil, 0, 0).RegisterRoutes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/items/SKU-001/threshold",
+		strings.NewReader(`{"reorder_point": 2, "reorder_quantity": 8, "unit": "case"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", w.Code, w.Body)
+	}
+	if th := store.threshold; th.ReorderPoint != 24 || th.ReorderQuantity != 96 {
+		t.Errorf("Expected 2 and 8 cases stored as 24 and 96 each, got: %+v", th)
+	}
+	if len(watcher.wake) != 1 {
+		t.Error("Expected a changed threshold to trigger a sweep")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/items/SKU-001/threshold",
+		strings.NewReader(`{"reorder_point": 0}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a zero reorder point, got: %d", w.Code)
+	}
+}
+
+func TestStockCacheHints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 30, Available: 30}}}
+	publisher := &recordingPublisher{}
+	router := gin.New()
+	NewHandler(store, nil, publisher, 30*time.Second, 0).RegisterRoutes(router)
+
+	cacheControl := func() string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stock/SKU-001", nil))
+		return w.Header().Get("Cache-Control")
+	}
+	if got := cacheControl(); got != "max-age=30" {
+		t.Errorf("Expected max-age=30 without a threshold, got: %q", got)
+	}
+	store.threshold = &Threshold{SKU: "SKU-001", ReorderPoint: 24}
+	if got := cacheControl(); got != "max-age=30" {
+		t.Errorf("Expected max-age=30 above the reorder point, got: %q", got)
+	}
+	store.stock.Available = 20
+	if got := cacheControl(); got != "no-cache" {
+		t.Errorf("Expected no-cache below the reorder point, got: %q", got)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/movements",
+		strings.NewReader(`{"delta": 5, "reason": "adjustment"}`)))
+	if w.Code != http.StatusCreated || len(publisher.published) != 1 {
+		t.Fatalf("Expected one stock change published, got: %d %d", w.Code, len(publisher.published))
+	}
+	var change events.StockChange
+	if err := publisher.published[0].Decode(&change); err != nil || change.SKU != "SKU-001" {
+		t.Errorf("Expected a stock change for SKU-001, got: %+v %v", change, err)
+	}
+}
+
+// lotStore keeps lots in memory for the expiry monitor.
+type lotStore struct {
+	Store
+	lots []Lot
+}
+
+func (s *lotStore) QuarantineExpired(ctx context.Context, today time.Time) ([]Lot, error) {
+	expired := []Lot{}
+	for i, l := range s.lots {
+		if l.Status == LotActive && l.ExpiresOn < today.Format(time.DateOnly) {
+			s.lots[i].Status = LotQuarantined
+			expired = append(expired, s.lots[i])
+		}
+	}
+	return expired, nil
+}
+
+func (s *lotStore) ExpiringLots(ctx context.Context, through time.Time, limit int) ([]Lot, error) {
+	lots := []Lot{}
+	for _, l := range s.lots {
+		if l.Status == LotActive && l.AlertedAt == nil && l.ExpiresOn <= through.Format(time.DateOnly) && len(lots) < limit {
+			lots = append(lots, l)
+		}
+	}
+	return lots, nil
+}
+
+func (s *lotStore) MarkLotAlerted(ctx context.Context, id int64, at time.Time) error {
+	for i := range s.lots {
+		if s.lots[i].ID == id {
+			s.lots[i].AlertedAt = &at
+		}
+	}
+	return nil
+}
+
+func TestExpiryMonitor(t *testing.T) {
+	store := &lotStore{lots: []Lot{
+		{ID: 1, SKU: "SKU-001", Code: "L-1", ExpiresOn: "2026-10-13", Quantity: 5, Status: LotActive},
+		{ID: 2, SKU: "SKU-001", Code: "L-2", ExpiresOn: "2026-10-14", Quantity: 8, Status: LotActive},
+		{ID: 3, SKU: "SKU-002", Code: "L-3", ExpiresOn: "2026-11-13", Quantity: 3, Status: LotActive},
+		{ID: 4, SKU: "SKU-002", Code: "L-4", ExpiresOn: "2026-11-14", Quantity: 3, Status: LotActive},
+	}}
+	publisher := &recordingPublisher{}
+	monitor := NewExpiryMonitor(store, publisher, nil, "buyer@example.com", 30)
+	monitor.now = func() time.Time { return time.Date(2026, 10, 14, 0, 5, 0, 0, time.UTC) }
+	monitor.batchSize = 1
+
+	quarantined, alerted, err := monitor.Sweep(context.Background())
+	if err != nil || quarantined != 1 || alerted != 2 {
+		t.Fatalf("Expected 1 lot quarantined and 2 alerted, got: %d %d %v", quarantined, alerted, err)
+	}
+	if store.lots[0].Status != LotQuarantined || store.lots[1].Status != LotActive {
+		t.Errorf("Expected only the lot that expired yesterday to be quarantined, got: %+v", store.lots[:2])
+	}
+
+	var alerts []events.LotExpiring
+	changed := 0
+	for _, e := range publisher.published {
+		switch e.Type {
+		case events.InventoryLotExpiring:
+			var alert events.LotExpiring
+			if err := e.Decode(&alert); err != nil {
+				t.Fatalf("Failed to decode alert: %v", err)
+			}
+			alerts = append(alerts, alert)
+		case events.InventoryStockChanged:
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Errorf("Expected a stock change for the quarantined SKU, got: %d", changed)
+	}
+	if len(alerts) != 2 || alerts[0].LotCode != "L-2" || alerts[1].LotCode != "L-3" || alerts[0].NotifyEmail != "buyer@example.com" {
+		t.Errorf("Expected alerts for L-2 and L-3 to the recipient, got: %+v", alerts)
+	}
+
+	if _, alerted, _ := monitor.Sweep(context.Background()); alerted != 0 {
+		t.Errorf("Expected lots to be alerted on once, got: %d", alerted)
+	}
+}
+
+// barcodeStore is fakeStore with a version bumped by every barcode set.
+type barcodeStore struct {
+	fakeStore
+}
+
+func (s *barcodeStore) SetBarcode(ctx context.Context, sku string, version int64, barcode string) (int64, error) {
+	if sku != s.stock.SKU {
+		return 0, ErrNotFound
+	}
+	if version != etag.Any && version != s.stock.Version {
+		return 0, etag.ErrMismatch
+	}
+	s.stock.Version++
+	return s.stock.Version, nil
+}
+
+func TestBarcodeRequiresCurrentVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &barcodeStore{fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 30, Available: 30}, Version: 4}}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 3, Roles: []string{auth.RoleAdmin}})
+	})
+	NewHandler(store, nil, nil, 0, 0).RegisterRoutes(router)
+	do := func(method, path, header, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"barcode": "4006381333931"}`))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	read := do(http.MethodGet, "/stock/SKU-001", "", "").Header().Get("ETag")
+	if read != `"4"` {
+		t.Fatalf("Expected the item's version as its ETag, got: %q", read)
+	}
+	if w := do(http.MethodGet, "/stock/SKU-001", "If-None-Match", read); w.Code != http.StatusNotModified {
+		t.Errorf("Expected the current version to be not modified, got: %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/items/SKU-001/barcode", "", ""); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected a barcode set without If-Match to be refused, got: %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/items/SKU-001/barcode", "If-Match", read); w.Code != http.StatusOK || w.Header().Get("ETag") != `"5"` {
+		t.Fatalf("Expected the barcode set and the new version returned, got: %d %s", w.Code, w.Header())
+	}
+	if w := do(http.MethodPut, "/items/SKU-001/barcode", "If-Match", read); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a second set from the same read to be refused, got: %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/stock/SKU-001", "If-None-Match", read); w.Code != http.StatusOK {
+		t.Errorf("Expected a changed item to be sent again, got: %d", w.Code)
+	}
+}
+
+func TestMovementIntoLot(t *testing.T) {
+	store := &fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 10, Available: 10}}}
+	router := newTestRouter(store)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/movements",
+		strings.NewReader(`{"delta": -2, "reason": "pick", "lot_id": 7}`)))
+	if w.Code != http.StatusCreated || store.recorded.LotID != 7 {
+		t.Errorf("Expected the pick to be booked out of lot 7, got: %d %+v", w.Code, store.recorded)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/lots",
+		strings.NewReader(`{"lot_code": "L-1", "expires_on": "2026-02-30", "quantity": 5}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid expiry date to be rejected, got: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestSafetyStockCalculation(t *testing.T) {
+	mean, stddev, units := safetyStock(0.95, 4, []int{10, 20, 10, 20})
+	if mean != 15 || math.Abs(stddev-5.7735) > 0.0001 || units != 19 {
+		t.Errorf("Expected mean 15, σ 5.77 and 19 units (1.645 × 5.77 × √4), got: %v %v %d", mean, stddev, units)
+	}
+	if _, _, units := safetyStock(0.5, 4, []int{10, 20, 10, 20}); units != 0 {
+		t.Errorf("Expected no safety stock at a 50%% service level, got: %d", units)
+	}
+	if _, _, units := safetyStock(0.99, 4, []int{12, 12, 12}); units != 0 {
+		t.Errorf("Expected no safety stock for steady demand, got: %d", units)
+	}
+	if mean, _, units := safetyStock(0.99, 4, []int{30}); mean != 30 || units != 0 {
+		t.Errorf("Expected one day of history to give no safety stock yet, got: %v %d", mean, units)
+	}
+}
+
+// safetyStore keeps policies in memory and serves the same demand history
+// for every SKU.
+type safetyStore struct {
+	Store
+	policies map[string]*SafetyPolicy
+	safety   map[string]int
+	demand   []int
+	tenants  []string
+	from, to time.Time
+}
+
+func (s *safetyStore) SetSafetyPolicy(ctx context.Context, p *SafetyPolicy) error {
+	if _, ok := s.safety[p.SKU]; !ok {
+		return ErrNotFound
+	}
+	p.Tenant = tenant.FromContext(ctx)
+	s.policies[p.SKU] = p
+	return nil
+}
+
+func (s *safetyStore) SafetyPolicies(ctx context.Context) ([]SafetyPolicy, error) {
+	policies := []SafetyPolicy{}
+	for _, p := range s.policies {
+		policies = append(policies, *p)
+	}
+	return policies, nil
+}
+
+func (s *safetyStore) DailyDemand(ctx context.Context, sku string, from, to time.Time) ([]int, error) {
+	s.tenants = append(s.tenants, tenant.FromContext(ctx))
+	s.from, s.to = from, to
+	return s.demand, nil
+}
+
+func (s *safetyStore) SaveSafetyStock(ctx context.Context, p *SafetyPolicy) (bool, error) {
+	changed := s.safety[p.SKU] != p.SafetyStock
+	s.safety[p.SKU] = p.SafetyStock
+	return changed, nil
+}
+
+func TestSafetyStockPlanner(t *testing.T) {
+	store := &safetyStore{
+		policies: map[string]*SafetyPolicy{},
+		safety:   map[string]int{"SKU-001": 0},
+		demand:   []int{10, 20, 10, 20},
+	}
+	publisher := &recordingPublisher{}
+	planner := NewSafetyStockPlanner(store, publisher, nil, 90)
+	planner.now = func() time.Time { return time.Date(2026, 10, 14, 0, 15, 0, 0, time.UTC) }
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(tenant.NewContext(c.Request.Context(), "acme"))
+	})
+	NewSafetyStockHandler(planner).RegisterRoutes(router)
+	serve := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := serve("/items/SKU-001/safety-stock", `{"service_level": 1, "lead_time_days": 4}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 100%% service level to be rejected, got: %d", w.Code)
+	}
+	if w := serve("/items/SKU-404/safety-stock", `{"service_level": 0.95, "lead_time_days": 4}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown SKU, got: %d", w.Code)
+	}
+	w := serve("/items/SKU-001/safety-stock", `{"service_level": 0.95, "lead_time_days": 4}`)
+	var policy SafetyPolicy
+	if err := json.Unmarshal(w.Body.Bytes(), &policy); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the policy to be saved, got: %d %s", w.Code, w.Body)
+	}
+	if policy.SafetyStock != 19 || policy.DemandDays != 4 || policy.CalculatedAt == nil || store.safety["SKU-001"] != 19 {
+		t.Errorf("Expected the policy to be calculated straight away, got: %+v", policy)
+	}
+	if !store.from.Equal(time.Date(2026, 7, 16, 0, 0, 0, 0, time.UTC)) || !store.to.Equal(time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the 90 days up to yesterday, got: %s to %s", store.from, store.to)
+	}
+	if len(publisher.published) != 1 {
+		t.Errorf("Expected the safety stock change to be published, got: %d", len(publisher.published))
+	}
+
+	store.demand = []int{10, 30, 10, 30}
+	calculated, changed, err := planner.Recalculate(context.Background())
+	if err != nil || calculated != 1 || changed != 1 || store.safety["SKU-001"] != 38 {
+		t.Fatalf("Expected the recalculation to raise safety stock to 38, got: %d %d %v %d", calculated, changed, err, store.safety["SKU-001"])
+	}
+	if store.tenants[len(store.tenants)-1] != "acme" {
+		t.Errorf("Expected the recalculation to run as the policy's tenant, got: %v", store.tenants)
+	}
+	if _, changed, _ := planner.Recalculate(context.Background()); changed != 0 || len(publisher.published) != 2 {
+		t.Errorf("Expected an unchanged calculation to publish nothing, got: %d %d", changed, len(publisher.published))
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	items := []ItemName{
+		{SKU: "SKU-001", Name: "Blue Widget", Barcode: "0012345678905"},
+		{SKU: "SKU-002", Name: "Widget, blue"},
+		{SKU: "SKU-003", Name: "Red Gadget", Barcode: "0012345678905"},
+		{SKU: "SKU-004", Name: "Blue Widgets"},
+		{SKU: "SKU-005", Name: "Green Gizmo"},
+	}
+	got := FindDuplicates(items, 0.6)
+	if len(got) != 4 {
+		t.Fatalf("Expected 4 candidate pairs, got: %+v", got)
+	}
+	if got[0].Score != 1 || got[0].Items[0].SKU != "SKU-001" || got[0].Items[1].SKU != "SKU-002" || strings.Join(got[0].Reasons, ",") != "name" {
+		t.Errorf("Expected reordered words to match exactly, got: %+v", got[0])
+	}
+	if got[1].Items[0].SKU != "SKU-001" || got[1].Items[1].SKU != "SKU-003" || strings.Join(got[1].Reasons, ",") != "barcode" {
+		t.Errorf("Expected the shared barcode next, got: %+v", got[1])
+	}
+	for _, d := range got[2:] {
+		if d.Items[1].SKU != "SKU-004" || d.Score < 0.6 || d.Score >= 1 {
+			t.Errorf("Expected the plural to be a close match, got: %+v", d)
+		}
+	}
+	if got := FindDuplicates(items, 0.95); len(got) != 2 {
+		t.Errorf("Expected a higher bar to leave the exact matches, got: %+v", got)
+	}
+}
+
+type mergeStore struct {
+	Store
+	merged map[string]string
+	merge  *Merge
+}
+
+func (s *mergeStore) MergeItem(ctx context.Context, m *Merge) (*Stock, error) {
+	if _, ok := s.merged[m.SKU]; ok {
+		return nil, ErrInvalidState
+	}
+	s.merged[m.SKU] = m.Survivor
+	m.OnHand, m.MergedAt = 4, time.Now()
+	s.merge = m
+	return &Stock{Stock: models.Stock{SKU: m.Survivor, OnHand: 10}}, nil
+}
+
+func (s *mergeStore) MergedInto(ctx context.Context, sku string) (string, error) {
+	survivor, ok := s.merged[sku]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return survivor, nil
+}
+
+func (s *mergeStore) Get(ctx context.Context, sku string) (*Stock, error) {
+	return &Stock{Stock: models.Stock{SKU: sku}}, nil
+}
+
+func TestMergeItems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &mergeStore{merged: map[string]string{}}
+	publisher := &recordingPublisher{}
+	router := gin.New()
+	var roles []string
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, &auth.Principal{UserID: 3, Roles: roles}) })
+	router.Use(RedirectMerged(store))
+	NewHandler(store, nil, publisher, 0, 0).RegisterRoutes(router)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	roles = []string{auth.RoleCustomer}
+	if w := serve(http.MethodPost, "/items/merges", `{"sku": "SKU-002", "into": "SKU-001"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers not to merge items, got: %d", w.Code)
+	}
+	roles = []string{auth.RoleAdmin}
+	if w := serve(http.MethodPost, "/items/merges", `{"sku": "SKU-001", "into": "SKU-001"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a SKU not to merge into itself, got: %d", w.Code)
+	}
+	w := serve(http.MethodPost, "/items/merges", `{"sku": "SKU-002", "into": "SKU-001"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the merge to succeed, got: %d %s", w.Code, w.Body)
+	}
+	if store.merge.MergedBy != "user:3" {
+		t.Errorf("Expected the merge to record who made it, got: %+v", store.merge)
+	}
+	types := []string{}
+	for _, e := range publisher.published {
+		types = append(types, e.Type)
+	}
+	if strings.Join(types, ",") != events.InventorySKUMerged+","+events.InventoryStockChanged+","+events.InventoryStockChanged {
+		t.Errorf("Expected the merge and both stock changes to be published, got: %v", types)
+	}
+	if w := serve(http.MethodPost, "/items/merges", `{"sku": "SKU-002", "into": "SKU-003"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second merge of the SKU to conflict, got: %d", w.Code)
+	}
+
+	w = serve(http.MethodPost, "/stock/SKU-002/movements?unit=case", `{"delta": 1}`)
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "../SKU-001/movements?unit=case" {
+		t.Errorf("Expected the merged SKU to redirect to the survivor, got: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := serve(http.MethodGet, "/stock/SKU-002", ""); w.Header().Get("Location") != "./SKU-001" {
+		t.Errorf("Expected a relative redirect to the survivor, got: %q", w.Header().Get("Location"))
+	}
+	if w := serve(http.MethodGet, "/stock/SKU-001", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the survivor to be served, got: %d", w.Code)
+	}
+}
+
+// reservationStore is fakeStore keeping reservations until they settle.
+type reservationStore struct {
+	fakeStore
+	reservations map[int64]*Reservation
+	filter       ReservationFilter
+}
+
+func (s *reservationStore) CommitReservation(ctx context.Context, id int64) (*Reservation, *Stock, error) {
+	r, ok := s.reservations[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	if r.Status != ReservationActive {
+		return nil, nil, ErrInvalidState
+	}
+	r.Status = ReservationCommitted
+	s.stock.OnHand -= r.Quantity
+	st := s.stock
+	return r, &st, nil
+}
+
+func (s *reservationStore) ExtendReservation(ctx context.Context, id int64, expiresAt time.Time) (*Reservation, error) {
+	r, ok := s.reservations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if r.Status != ReservationActive {
+		return nil, ErrInvalidState
+	}
+	if r.ExpiresAt != nil && expiresAt.After(*r.ExpiresAt) {
+		r.ExpiresAt = &expiresAt
+	}
+	return r, nil
+}
+
+// ExpireReservations expires one reservation per call, so a sweep takes
+// several batches.
+func (s *reservationStore) ExpireReservations(ctx context.Context, now time.Time, limit int) ([]Reservation, error) {
+	for _, r := range s.reservations {
+		if r.Status == ReservationActive && r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+			r.Status = ReservationExpired
+			return []Reservation{*r}, nil
+		}
+	}
+	return nil, nil
+}
+
+// ArchiveReservations drops archived reservations from the map, one per
+// call whatever the limit, so the job has to come back for the rest.
+func (s *reservationStore) ArchiveReservations(ctx context.Context, before time.Time, limit int) (int, error) {
+	for id, r := range s.reservations {
+		if r.Status != ReservationActive && r.SettledAt != nil && r.SettledAt.Before(before) {
+			delete(s.reservations, id)
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *reservationStore) ReservationReport(ctx context.Context, f ReservationFilter) (*ReservationReport, error) {
+	s.filter = f
+	report := &ReservationReport{From: f.From, To: f.To, Totals: ReservationCounts{Reservations: 5, Committed: 3, Released: 1, Expired: 1}}
+	report.Totals.convert()
+	return report, nil
+}
+
+func TestReservationCommitAndTTL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &reservationStore{fakeStore: fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 10, Available: 10}}}}
+	publisher := &recordingPublisher{}
+	router := gin.New()
+	principal := orderService
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, principal) })
+	NewHandler(store, nil, publisher, 0, 15*time.Minute).RegisterRoutes(router)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	before := time.Now()
+	if w := send(http.MethodPost, "/stock/SKU-001/reservations", `{"quantity": 2}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected reservation to be created, got: %d %s", w.Code, w.Body.String())
+	}
+	r := store.reserved
+	if r.ReservedBy != "service:order-service" || r.ExpiresAt == nil || r.ExpiresAt.Before(before.Add(15*time.Minute)) {
+		t.Errorf("Expected the holder and default TTL to be recorded, got: %+v", r)
+	}
+	if w := send(http.MethodPost, "/stock/SKU-001/reservations", `{"quantity": 2, "ttl_seconds": 60}`); w.Code != http.StatusCreated ||
+		store.reserved.ExpiresAt.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected ttl_seconds to override the default, got: %d %+v", w.Code, store.reserved)
+	}
+	if w := send(http.MethodPost, "/stock/SKU-001/reservations", `{"quantity": 2, "ttl_seconds": 604801}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a TTL over a week to be rejected, got: %d", w.Code)
+	}
+	principal = &auth.Principal{UserID: 3, Roles: []string{auth.RoleAdmin, auth.RoleService}}
+	if w := send(http.MethodPost, "/stock/SKU-001/reservations", `{"quantity": 2}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected users to be kept out of reservations, got: %d", w.Code)
+	}
+	principal = orderService
+
+	store.reservations = map[int64]*Reservation{1: {ID: 1, SKU: "SKU-001", Quantity: 2, Status: ReservationActive}}
+	publisher.published = nil
+	if w := send(http.MethodPost, "/reservations/1/commit", ""); w.Code != http.StatusOK || store.stock.OnHand != 8 {
+		t.Errorf("Expected the commit to book the stock out, got: %d %d", w.Code, store.stock.OnHand)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].Type != events.InventoryStockChanged {
+		t.Errorf("Expected the commit to announce a stock change, got: %+v", publisher.published)
+	}
+	if w := send(http.MethodPost, "/reservations/1/commit", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected committing twice to conflict, got: %d", w.Code)
+	}
+	if w := send(http.MethodPost, "/reservations/2/commit", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown reservation to be not found, got: %d", w.Code)
+	}
+}
+
+func TestExtendReservation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	soon := time.Now().Add(time.Minute)
+	store := &reservationStore{reservations: map[int64]*Reservation{
+		1: {ID: 1, SKU: "SKU-001", Quantity: 2, Status: ReservationActive, ExpiresAt: &soon},
+		2: {ID: 2, SKU: "SKU-001", Quantity: 1, Status: ReservationCommitted},
+	}}
+	router := newServiceRouter(store)
+	extend := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := extend("/reservations/1/extend", `{"ttl_seconds": 1800}`); w.Code != http.StatusOK ||
+		store.reservations[1].ExpiresAt.Before(time.Now().Add(29*time.Minute)) {
+		t.Errorf("Expected the reservation to be held 30 more minutes, got: %d %+v", w.Code, store.reservations[1])
+	}
+	if w := extend("/reservations/1/extend", `{"ttl_seconds": 0}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a TTL to be required, got: %d", w.Code)
+	}
+	if w := extend("/reservations/1/extend", `{"ttl_seconds": 604801}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a TTL over a week to be rejected, got: %d", w.Code)
+	}
+	if w := extend("/reservations/2/extend", `{"ttl_seconds": 60}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a committed reservation not to be extended, got: %d", w.Code)
+	}
+	if w := extend("/reservations/3/extend", `{"ttl_seconds": 60}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown reservation to be not found, got: %d", w.Code)
+	}
+}
+
+func TestReservationArchiveJob(t *testing.T) {
+	old, recent := time.Now().AddDate(0, -7, 0), time.Now().AddDate(0, -1, 0)
+	store := &reservationStore{reservations: map[int64]*Reservation{
+		1: {ID: 1, Status: ReservationCommitted, SettledAt: &old},
+		2: {ID: 2, Status: ReservationExpired, SettledAt: &old},
+		3: {ID: 3, Status: ReservationReleased, SettledAt: &recent},
+		4: {ID: 4, Status: ReservationActive},
+	}}
+	if err := ReservationArchiveJob(store, 6, 1)(context.Background()); err != nil {
+		t.Fatalf("Expected the archive job to succeed, got: %v", err)
+	}
+	if len(store.reservations) != 2 || store.reservations[3] == nil || store.reservations[4] == nil {
+		t.Errorf("Expected only reservations settled over 6 months ago to be archived, got: %v", store.reservations)
+	}
+}
+
+func TestReservationExpiryJob(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	store := &reservationStore{reservations: map[int64]*Reservation{
+		1: {ID: 1, SKU: "SKU-001", Status: ReservationActive, ExpiresAt: &past, Tenant: "acme", Reference: "order:7"},
+		2: {ID: 2, SKU: "SKU-002", Status: ReservationActive, ExpiresAt: &past, Tenant: "globex"},
+		3: {ID: 3, SKU: "SKU-003", Status: ReservationActive},
+	}}
+	publisher := &recordingPublisher{}
+
+	if err := ReservationExpiryJob(store, publisher, 1)(context.Background()); err != nil {
+		t.Fatalf("Expected the sweep to succeed, got: %v", err)
+	}
+	if store.reservations[1].Status != ReservationExpired || store.reservations[2].Status != ReservationExpired ||
+		store.reservations[3].Status != ReservationActive {
+		t.Errorf("Expected only reservations past their TTL to expire, got: %+v %+v %+v",
+			store.reservations[1], store.reservations[2], store.reservations[3])
+	}
+	tenants := map[string]string{}
+	var expiries []events.ReservationExpired
+	for _, e := range publisher.published {
+		if e.Type == events.InventoryReservationExpired {
+			var expiry events.ReservationExpired
+			if err := e.Decode(&expiry); err != nil {
+				t.Fatalf("Failed to decode reservation expiry: %v", err)
+			}
+			expiries = append(expiries, expiry)
+			continue
+		}
+		var change events.StockChange
+		if err := e.Decode(&change); err != nil {
+			t.Fatalf("Failed to decode stock change: %v", err)
+		}
+		tenants[change.SKU] = change.Tenant
+	}
+	if len(tenants) != 2 || tenants["SKU-001"] != "acme" || tenants["SKU-002"] != "globex" {
+		t.Errorf("Expected a stock change per expired reservation under its tenant, got: %v", tenants)
+	}
+	if len(expiries) != 2 {
+		t.Fatalf("Expected an expiry event per expired reservation, got: %+v", expiries)
+	}
+	for _, expiry := range expiries {
+		if expiry.ReservationID == 1 && (expiry.Reference != "order:7" || expiry.Tenant != "acme") {
+			t.Errorf("Expected the expiry to carry the holder's reference and tenant, got: %+v", expiry)
+		}
+	}
+}
+
+func TestReservationReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &reservationStore{}
+	get := func(p *auth.Principal, query string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, nil, nil, 0, 0).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reports/reservations"+query, nil))
+		return w
+	}
+	admin := &auth.Principal{UserID: 7, Roles: []string{auth.RoleAdmin}}
+
+	if w := get(&auth.Principal{UserID: 8, Roles: []string{auth.RoleCustomer}}, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be forbidden, got: %d", w.Code)
+	}
+	for _, query := range []string{"?from=yesterday", "?to=2026-10-01T00:00:00Z&from=2026-10-02T00:00:00Z"} {
+		if w := get(admin, query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got: %d", query, w.Code)
+		}
+	}
+
+	w := get(admin, "?to=2026-10-14T00:00:00Z&sku=SKU-001&limit=1000")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the report, got: %d %s", w.Code, w.Body.String())
+	}
+	f := store.filter
+	if !f.From.Equal(time.Date(2026, 9, 14, 0, 0, 0, 0, time.UTC)) || f.SKU != "SKU-001" || f.Limit != 20 {
+		t.Errorf("Expected 30 days up to to, the SKU and the default limit, got: %+v", f)
+	}
+	var report ReservationReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Totals.ConversionRate == nil || *report.Totals.ConversionRate != 0.6 {
+		t.Errorf("Expected three of five settled reservations to convert, got: %+v", report.Totals)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	at := func(code string, available int, lat, lon float64) WarehouseStock {
+		return WarehouseStock{Warehouse: code, Available: available,
+			latitude: sql.NullFloat64{Float64: lat, Valid: true}, longitude: sql.NullFloat64{Float64: lon, Valid: true}}
+	}
+	stock := []WarehouseStock{{Warehouse: DefaultWarehouse, Available: 4}, at("AKL", 9, -36.85, 174.76), at("CHC", 6, -43.53, 172.63)}
+
+	tests := []struct {
+		name     string
+		quantity int
+		a        Allocation
+		want     string
+	}{
+		{"most stocked", 5, Allocation{Strategy: AllocateMostStocked}, "AKL"},
+		{"default is most stocked", 1, Allocation{}, "AKL"},
+		{"nearest to Hamilton", 5, Allocation{Strategy: AllocateNearest, Latitude: -37.79, Longitude: 175.28}, "AKL"},
+		{"nearest to Wellington", 5, Allocation{Strategy: AllocateNearest, Latitude: -41.29, Longitude: 174.78}, "CHC"},
+		{"nearest with enough stock", 7, Allocation{Strategy: AllocateNearest, Latitude: -41.29, Longitude: 174.78}, "AKL"},
+	}
+	for _, tt := range tests {
+		if got, ok := allocate(stock, tt.quantity, tt.a); !ok || got != tt.want {
+			t.Errorf("%s: expected %s, got: %q %v", tt.name, tt.want, got, ok)
+		}
+	}
+	if got, ok := allocate(stock[:2], 3, Allocation{Strategy: AllocateNearest}); !ok || got != "AKL" {
+		t.Errorf("Expected a located warehouse before MAIN, got: %q %v", got, ok)
+	}
+	if got, ok := allocate(stock, 10, Allocation{}); ok {
+		t.Errorf("Expected no single warehouse to hold 10, got: %s", got)
+	}
+}
+
+func TestReserveAllocation(t *testing.T) {
+	store := &fakeStore{stock: Stock{Stock: models.Stock{SKU: "SKU-001", OnHand: 10, Available: 10}}}
+	router := newServiceRouter(store)
+	reserve := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stock/SKU-001/reservations", strings.NewReader(body)))
+		return w
+	}
+
+	if w := reserve(`{"quantity": 1, "latitude": -41.29, "longitude": 174.78}`); w.Code != http.StatusCreated ||
+		store.reserved.Allocation != (Allocation{Strategy: AllocateNearest, Latitude: -41.29, Longitude: 174.78}) {
+		t.Errorf("Expected coordinates to allocate to the nearest warehouse, got: %d %+v", w.Code, store.reserved)
+	}
+	if w := reserve(`{"quantity": 1, "allocation": "most_stocked"}`); w.Code != http.StatusCreated ||
+		store.reserved.Allocation.Strategy != AllocateMostStocked {
+		t.Errorf("Expected the strategy to be passed on, got: %d %+v", w.Code, store.reserved)
+	}
+	for _, body := range []string{
+		`{"quantity": 1, "allocation": "nearest"}`,
+		`{"quantity": 1, "latitude": -41.29}`,
+		`{"quantity": 1, "allocation": "cheapest"}`,
+		`{"quantity": 1, "latitude": 91, "longitude": 0}`,
+	} {
+		if w := reserve(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got: %d", body, w.Code)
+		}
+	}
+}
+
+type warehouseStore struct {
+	fakeStore
+	transfer *Transfer
+}
+
+func (s *warehouseStore) Transfer(ctx context.Context, t *Transfer) ([]WarehouseStock, error) {
+	if t.From == "CHC" {
+		return nil, ErrUnknownWarehouse
+	}
+	s.transfer = t
+	return []WarehouseStock{{Warehouse: DefaultWarehouse}, {Warehouse: t.To, OnHand: t.Quantity, Available: t.Quantity}}, nil
+}
+
+func TestTransfer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &warehouseStore{fakeStore: fakeStore{units: map[string]int{"case": 12}}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 7, Roles: []string{auth.RoleAdmin}})
+	})
+	NewHandler(store, nil, nil, 0, 0).RegisterRoutes(router)
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/warehouses/transfers", strings.NewReader(body)))
+		return w
+	}
+
+	if w := send(`{"sku": "SKU-001", "to": " main ", "quantity": 1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a transfer within MAIN to be rejected, got: %d", w.Code)
+	}
+	if w := send(`{"sku": "SKU-001", "from": "CHC", "to": "AKL", "quantity": 1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown warehouse to be rejected, got: %d", w.Code)
+	}
+	w := send(`{"sku": "SKU-001", "to": "akl", "quantity": 2, "unit": "case"}`)
+	if tr := store.transfer; w.Code != http.StatusCreated || tr.From != DefaultWarehouse || tr.To != "AKL" ||
+		tr.Quantity != 24 || tr.TransferredBy != "user:7" {
+		t.Errorf("Expected 2 cases moved from MAIN to AKL as 24 each, got: %d %+v", w.Code, tr)
+	}
+}
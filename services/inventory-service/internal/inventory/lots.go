@@ -0,0 +1,143 @@
+package inventory
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LotActive      = "active"
+	LotQuarantined = "quarantined"
+	LotDisposed    = "disposed"
+)
+
+// maxExpiryReportDays bounds how far ahead the expiry report looks.
+const maxExpiryReportDays = 366
+
+// Lot is a batch of a SKU sharing an expiry date. ExpiresOn is the last day
+// it may be sold, as YYYY-MM-DD; from the day after, the lot is quarantined
+// and its stock no longer counts as available until it is disposed of.
+// Quantity is what is left of it, in base units.
+type Lot struct {
+	ID         int64      `json:"id"`
+	SKU        string     `json:"sku"`
+	Name       string     `json:"name"`
+	Code       string     `json:"lot_code"`
+	ExpiresOn  string     `json:"expires_on"`
+	Quantity   int        `json:"quantity"`
+	Status     string     `json:"status"`
+	AlertedAt  *time.Time `json:"alerted_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DisposedAt *time.Time `json:"disposed_at,omitempty"`
+}
+
+// receiveLot books stock into a new lot with a ledger movement.
+func (h *Handler) receiveLot(c *gin.Context) {
+	var req struct {
+		Code      string `json:"lot_code" binding:"required,max=64"`
+		ExpiresOn string `json:"expires_on" binding:"required,datetime=2006-01-02"`
+		Quantity  int    `json:"quantity" binding:"required,min=1"`
+		Unit      string `json:"unit"`
+		Reference string `json:"reference"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sku := c.Param("sku")
+	unit, quantity, ok := h.toBase(c, sku, req.Unit, req.Quantity)
+	if !ok {
+		return
+	}
+	lot := &Lot{SKU: sku, Code: req.Code, ExpiresOn: req.ExpiresOn}
+	m := &Movement{SKU: sku, Delta: quantity, Unit: unit, UnitQuantity: req.Quantity, Reason: "lot_receipt", Reference: req.Reference}
+	stock, err := h.store.ReceiveLot(c.Request.Context(), lot, m)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if errors.Is(err, ErrAlreadyExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "lot already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.stockChanged(c.Request.Context(), false, sku)
+	c.JSON(http.StatusCreated, gin.H{"lot": lot, "movement": m, "stock": stock})
+}
+
+// listLots returns the SKU's sellable lots in first-expired, first-out
+// order: pickers take stock from the first lot before the next.
+func (h *Handler) listLots(c *gin.Context) {
+	sku := c.Param("sku")
+	if _, err := h.store.Get(c.Request.Context(), sku); errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	lots, err := h.store.ListLots(c.Request.Context(), sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lots": lots})
+}
+
+// expiryReport lists lots expiring within ?days= (default 30), soonest
+// first, including expired lots awaiting disposal.
+func (h *Handler) expiryReport(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 0 || days > maxExpiryReportDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 0 and " + strconv.Itoa(maxExpiryReportDays)})
+		return
+	}
+
+	through := time.Now().UTC().AddDate(0, 0, days)
+	lots, err := h.store.ExpiryReport(c.Request.Context(), through)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"through": through.Format(time.DateOnly), "lots": lots})
+}
+
+// disposeLot writes off what is left of a lot, expired or not, as a
+// "disposal" ledger movement referencing the lot.
+func (h *Handler) disposeLot(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid lot id"})
+		return
+	}
+
+	m := &Movement{Unit: BaseUnit, Reason: "disposal"}
+	lot, stock, err := h.store.DisposeLot(c.Request.Context(), id, m)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "lot not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "lot already disposed"})
+		return
+	}
+	if errors.Is(err, ErrInsufficientStock) {
+		h.insufficientStock(c, m.SKU, -m.Delta)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.stockChanged(c.Request.Context(), true, lot.SKU)
+	c.JSON(http.StatusOK, gin.H{"lot": lot, "movement": m, "stock": stock})
+}
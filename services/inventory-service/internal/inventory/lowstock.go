@@ -0,0 +1,102 @@
+package inventory
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+)
+
+// Watcher publishes a LowStock event when a SKU's available stock drops
+// below its reorder point. Each SKU is alerted on once until it recovers,
+// so a SKU hovering below its threshold does not repeat the alert.
+type Watcher struct {
+	store     Store
+	publisher events.Publisher
+	recipient string
+	batchSize int
+	wake      chan struct{}
+	now       func() time.Time
+}
+
+// NewWatcher sends alerts for rules without a notify_email to recipient;
+// with neither, the event is still published but nobody is emailed.
+func NewWatcher(store Store, publisher events.Publisher, recipient string) *Watcher {
+	return &Watcher{
+		store:     store,
+		publisher: publisher,
+		recipient: recipient,
+		batchSize: 100,
+		wake:      make(chan struct{}, 1),
+		now:       time.Now,
+	}
+}
+
+// Trigger asks for a sweep without waiting for the next interval. It never
+// blocks; triggers that arrive while one is pending are merged.
+func (w *Watcher) Trigger() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sweeps every interval, and whenever triggered, until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if sent, err := w.Sweep(ctx); err != nil {
+			log.Printf("Low stock sweep failed: %v", err)
+		} else if sent > 0 {
+			log.Printf("Sent %d low stock alerts", sent)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// Sweep re-arms recovered SKUs, then alerts on one batch of newly low ones
+// and returns how many were alerted.
+func (w *Watcher) Sweep(ctx context.Context) (int, error) {
+	if _, err := w.store.ClearRecovered(ctx); err != nil {
+		return 0, err
+	}
+	low, err := w.store.LowStock(ctx, w.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, t := range low {
+		recipient := t.NotifyEmail
+		if recipient == "" {
+			recipient = w.recipient
+		}
+		e, err := events.New(events.InventoryLowStock, "inventory-service", events.LowStock{
+			SKU:             t.SKU,
+			Name:            t.Name,
+			Available:       t.Available,
+			ReorderPoint:    t.ReorderPoint,
+			ReorderQuantity: t.ReorderQuantity,
+			NotifyEmail:     recipient,
+			Tenant:          t.Tenant,
+		})
+		if err != nil {
+			return sent, err
+		}
+		if err := w.publisher.Publish(ctx, e); err != nil {
+			return sent, err
+		}
+		if err := w.store.MarkAlerted(ctx, t.SKU, w.now()); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,651 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxDuplicateScan is how many items a duplicate scan compares.
+	maxDuplicateScan = 5000
+	// maxBlockSize skips name words shared by more items than this when
+	// pairing up candidates, as comparing every item with a word as common
+	// as "black" costs more than it finds.
+	maxBlockSize = 200
+)
+
+var validBarcode = regexp.MustCompile(`^[0-9A-Za-z-]{1,32}$`)
+
+// ItemName is what a duplicate scan compares an item by.
+type ItemName struct {
+	SKU     string `json:"sku"`
+	Name    string `json:"name"`
+	Barcode string `json:"barcode,omitempty"`
+	OnHand  int    `json:"on_hand"`
+}
+
+// Duplicate is a pair of items that may be the same product, ordered by SKU.
+// Score runs from 0 to 1; a shared barcode scores 1.
+type Duplicate struct {
+	Items   [2]ItemName `json:"items"`
+	Score   float64     `json:"score"`
+	Reasons []string    `json:"reasons"`
+}
+
+// Merge records that SKU was merged into Survivor, with the stock it
+// brought over in base units. Requests for SKU are redirected to Survivor.
+type Merge struct {
+	SKU         string    `json:"sku"`
+	Survivor    string    `json:"survivor"`
+	OnHand      int       `json:"on_hand"`
+	Reserved    int       `json:"reserved"`
+	Quarantined int       `json:"quarantined"`
+	MergedBy    string    `json:"merged_by,omitempty"`
+	MergedAt    time.Time `json:"merged_at"`
+}
+
+// FindDuplicates pairs up items sharing a barcode, or whose names are at
+// least minScore similar. Names are compared by the trigrams of their
+// words, as pg_trgm's similarity does, which forgives typos, plurals and
+// reordered words. Only items sharing a word are compared.
+func FindDuplicates(items []ItemName, minScore float64) []Duplicate {
+	type pair struct{ a, b int }
+	found := map[pair]*Duplicate{}
+	add := func(a, b int, score float64, reason string) {
+		if items[a].SKU > items[b].SKU {
+			a, b = b, a
+		}
+		d, ok := found[pair{a, b}]
+		if !ok {
+			d = &Duplicate{Items: [2]ItemName{items[a], items[b]}}
+			found[pair{a, b}] = d
+		}
+		d.Score = max(d.Score, score)
+		d.Reasons = append(d.Reasons, reason)
+	}
+
+	barcodes := map[string][]int{}
+	for i, it := range items {
+		if it.Barcode != "" {
+			barcodes[it.Barcode] = append(barcodes[it.Barcode], i)
+		}
+	}
+	for _, group := range barcodes {
+		for x := range group {
+			for y := x + 1; y < len(group); y++ {
+				add(group[x], group[y], 1, "barcode")
+			}
+		}
+	}
+
+	grams := make([]map[string]bool, len(items))
+	blocks := map[string][]int{}
+	for i, it := range items {
+		words := nameWords(it.Name)
+		grams[i] = trigrams(words)
+		seen := map[string]bool{}
+		for _, w := range words {
+			if !seen[w] {
+				seen[w] = true
+				blocks[w] = append(blocks[w], i)
+			}
+		}
+	}
+	compared := map[pair]bool{}
+	for _, block := range blocks {
+		if len(block) > maxBlockSize {
+			continue
+		}
+		for x := range block {
+			for y := x + 1; y < len(block); y++ {
+				p := pair{block[x], block[y]}
+				if compared[p] {
+					continue
+				}
+				compared[p] = true
+				if score := similarity(grams[p.a], grams[p.b]); score >= minScore {
+					add(p.a, p.b, score, "name")
+				}
+			}
+		}
+	}
+
+	duplicates := make([]Duplicate, 0, len(found))
+	for _, d := range found {
+		sort.Strings(d.Reasons)
+		duplicates = append(duplicates, *d)
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		a, b := duplicates[i], duplicates[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Items[0].SKU != b.Items[0].SKU {
+			return a.Items[0].SKU < b.Items[0].SKU
+		}
+		return a.Items[1].SKU < b.Items[1].SKU
+	})
+	return duplicates
+}
+
+// nameWords lowercases name and splits it into words of letters and digits.
+func nameWords(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// trigrams returns the three-letter runs of each word, padded as pg_trgm
+// pads them so that word starts weigh more than word ends.
+func trigrams(words []string) map[string]bool {
+	grams := map[string]bool{}
+	for _, w := range words {
+		r := []rune("  " + w + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			grams[string(r[i:i+3])] = true
+		}
+	}
+	return grams
+}
+
+// similarity is the share of a's and b's trigrams that both have.
+func similarity(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for g := range a {
+		if b[g] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// findDuplicates lists candidate duplicates among the tenant's items, most
+// likely first. ?min_score= sets how similar names must be, from 0 to 1.
+func (h *Handler) findDuplicates(c *gin.Context) {
+	minScore, err := strconv.ParseFloat(c.DefaultQuery("min_score", "0.6"), 64)
+	if err != nil || minScore <= 0 || minScore > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_score must be above 0 and at most 1"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	items, err := h.store.ItemNames(c.Request.Context(), maxDuplicateScan)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	duplicates := FindDuplicates(items, minScore)
+	if len(duplicates) > limit {
+		duplicates = duplicates[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"duplicates": duplicates, "scanned": len(items), "truncated": len(items) == maxDuplicateScan})
+}
+
+// setBarcode sets the item's barcode, such as its EAN or UPC; an empty one
+// clears it. Barcodes need not be unique: two items sharing one are what
+// the duplicate scan looks for. If-Match must name the item version the
+// caller read.
+func (h *Handler) setBarcode(c *gin.Context) {
+	var req struct {
+		Barcode string `json:"barcode"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Barcode = strings.TrimSpace(req.Barcode)
+	if req.Barcode != "" && !validBarcode.MatchString(req.Barcode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "barcode must be at most 32 letters, digits and dashes"})
+		return
+	}
+
+	version, ok := etag.IfMatch(c)
+	if !ok {
+		return
+	}
+
+	sku := c.Param("sku")
+	version, err := h.store.SetBarcode(c.Request.Context(), sku, version, req.Barcode)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if errors.Is(err, etag.ErrMismatch) {
+		etag.Failed(c)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("ETag", etag.Format(version))
+	c.JSON(http.StatusOK, gin.H{"sku": sku, "barcode": req.Barcode})
+}
+
+// mergeItems merges one SKU into another: see Store.MergeItem.
+func (h *Handler) mergeItems(c *gin.Context) {
+	var req struct {
+		SKU  string `json:"sku" binding:"required"`
+		Into string `json:"into" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.SKU == req.Into {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot merge a SKU into itself"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	m := &Merge{SKU: req.SKU, Survivor: req.Into, MergedBy: requestActor(c)}
+	stock, err := h.store.MergeItem(ctx, m)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	case errors.Is(err, ErrInvalidState):
+		c.JSON(http.StatusConflict, gin.H{"error": "item was already merged"})
+		return
+	case errors.Is(err, ErrAlreadyExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Merged %s into %s for %s", m.SKU, m.Survivor, m.MergedBy)
+	h.skuMerged(ctx, m)
+	h.stockChanged(ctx, false, m.SKU, m.Survivor)
+	c.JSON(http.StatusCreated, gin.H{"merge": m, "stock": stock})
+}
+
+// skuMerged tells other services to move their references to the merged
+// SKU over. Publishing failures are only logged: the merge stands, and
+// inventory redirects requests for the merged SKU either way.
+func (h *Handler) skuMerged(ctx context.Context, m *Merge) {
+	if h.publisher == nil {
+		return
+	}
+	id, _ := tenant.Lookup(ctx)
+	e, err := events.New(events.InventorySKUMerged, "inventory-service", events.SKUMerged{SKU: m.SKU, Survivor: m.Survivor, Tenant: id})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish merge of %s into %s: %v", m.SKU, m.Survivor, err)
+	}
+}
+
+func (h *Handler) listMerges(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	merges, err := h.store.ListMerges(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"merges": merges})
+}
+
+// RedirectMerged answers requests for a merged SKU, on any route with a
+// :sku parameter, with a permanent redirect to the same request for the
+// SKU it was merged into. The Location is relative, so it holds however
+// the gateway prefixed the path, and 308 keeps the method and body.
+func RedirectMerged(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sku := c.Param("sku")
+		if sku == "" {
+			c.Next()
+			return
+		}
+		survivor, err := store.MergedInto(c.Request.Context(), sku)
+		if errors.Is(err, ErrNotFound) {
+			c.Next()
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		c.Header("Location", mergedLocation(c, survivor))
+		c.JSON(http.StatusPermanentRedirect, gin.H{"error": "item was merged", "sku": sku, "merged_into": survivor})
+		c.Abort()
+	}
+}
+
+// mergedLocation is the request's path, relative to itself, with survivor
+// in place of the :sku segment.
+func mergedLocation(c *gin.Context, survivor string) string {
+	route := strings.Split(c.FullPath(), "/")
+	path := strings.Split(c.Request.URL.EscapedPath(), "/")
+	rest := []string{}
+	for i, seg := range route {
+		if seg == ":sku" && len(path) == len(route) {
+			rest = path[i+1:]
+		}
+	}
+	// "./" keeps a survivor with a colon from reading as a URL scheme.
+	location := "./"
+	if len(rest) > 0 {
+		location = strings.Repeat("../", len(rest))
+	}
+	location += url.PathEscape(survivor)
+	for _, seg := range rest {
+		location += "/" + seg
+	}
+	if c.Request.URL.RawQuery != "" {
+		location += "?" + c.Request.URL.RawQuery
+	}
+	return location
+}
+
+func (s *PostgresStore) SetBarcode(ctx context.Context, sku string, version int64, barcode string) (int64, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const update string = `UPDATE inventory_service.items SET barcode = NULLIF($2, ''), updated_at = NOW()
+		WHERE sku = $1 AND tenant_id = $3 AND ($4 = 0 OR version = $4) RETURNING version`
+	err := s.db.QueryRowContext(ctx, update, sku, barcode, tenant.FromContext(ctx), version).Scan(&version)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return version, err
+	}
+	if version == etag.Any {
+		return 0, ErrNotFound
+	}
+	// Tell a stale version apart from a missing item.
+	const exists string = `SELECT EXISTS (SELECT 1 FROM inventory_service.items WHERE sku = $1 AND tenant_id = $2)`
+	var found bool
+	if err := s.db.QueryRowContext(ctx, exists, sku, tenant.FromContext(ctx)).Scan(&found); err != nil {
+		return 0, err
+	}
+	if found {
+		return 0, etag.ErrMismatch
+	}
+	return 0, ErrNotFound
+}
+
+func (s *PostgresStore) ItemNames(ctx context.Context, limit int) ([]ItemName, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT sku, name, COALESCE(barcode, ''), on_hand FROM inventory_service.items i
+		WHERE tenant_id = $1 AND NOT EXISTS (SELECT 1 FROM inventory_service.item_merges m WHERE m.sku = i.sku)
+		ORDER BY sku LIMIT $2`
+	rows, err := database.Reader(ctx, s.db).QueryContext(ctx, query, tenant.FromContext(ctx), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ItemName{}
+	for rows.Next() {
+		var it ItemName
+		if err := rows.Scan(&it.SKU, &it.Name, &it.Barcode, &it.OnHand); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// mergedSettings are the per-SKU settings tables, with their columns
+// besides sku. The survivor keeps its own settings; the merged SKU's fill
+// in any it lacks.
+var mergedSettings = []struct{ table, columns string }{
+	{"inventory_service.item_units", "unit, factor"},
+	{"inventory_service.stock_thresholds", "reorder_point, reorder_quantity, notify_email, alerted_at, updated_at"},
+	{"inventory_service.safety_stock_policies", "service_level, lead_time_days, demand_mean, demand_stddev, demand_days, calculated_at, updated_at"},
+	{"inventory_service.item_dimensions", "length_mm, width_mm, height_mm, weight_grams, updated_at"},
+	{"inventory_service.item_locations", "zone, bin, updated_at"},
+}
+
+// mergedHistory are the tables whose rows for the merged SKU move to the
+// survivor as they are.
+var mergedHistory = []string{
+	"inventory_service.stock_ledger",
+	"inventory_service.stock_lots",
+	"inventory_service.stock_reservations",
+	"inventory_service.stock_reservations_archive",
+	"inventory_service.purchase_order_lines",
+	"inventory_service.stock_adjustment_lines",
+	"inventory_service.cost_layers",
+}
+
+func (s *PostgresStore) MergeItem(ctx context.Context, m *Merge) (*Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var stock *Stock
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		// Lock both items in SKU order, so merges crossing each other
+		// cannot deadlock.
+		const lockItems string = `SELECT sku, on_hand, reserved, quarantined, barcode FROM inventory_service.items
+			WHERE sku IN ($1, $2) AND tenant_id = $3 ORDER BY sku FOR UPDATE`
+		rows, err := tx.QueryContext(ctx, lockItems, m.SKU, m.Survivor, tenant.FromContext(ctx))
+		if err != nil {
+			return err
+		}
+		found := 0
+		var barcode sql.NullString
+		for rows.Next() {
+			var sku string
+			var onHand, reserved, quarantined int
+			var code sql.NullString
+			if err := rows.Scan(&sku, &onHand, &reserved, &quarantined, &code); err != nil {
+				rows.Close()
+				return err
+			}
+			if sku == m.SKU {
+				m.OnHand, m.Reserved, m.Quarantined, barcode = onHand, reserved, quarantined, code
+			}
+			found++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if found != 2 {
+			return ErrNotFound
+		}
+
+		const merged string = `SELECT EXISTS (SELECT 1 FROM inventory_service.item_merges WHERE sku IN ($1, $2))`
+		var already bool
+		if err := tx.QueryRowContext(ctx, merged, m.SKU, m.Survivor).Scan(&already); err != nil {
+			return err
+		}
+		if already {
+			return ErrInvalidState
+		}
+
+		const lotClash string = `SELECT lot_code FROM inventory_service.stock_lots
+			WHERE sku = $1 AND lot_code IN (SELECT lot_code FROM inventory_service.stock_lots WHERE sku = $2)
+			ORDER BY lot_code LIMIT 1`
+		var lot string
+		err = tx.QueryRowContext(ctx, lotClash, m.SKU, m.Survivor).Scan(&lot)
+		if err == nil {
+			return fmt.Errorf("%w: lot %s is on both SKUs", ErrAlreadyExists, lot)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if err := mergeCosts(ctx, tx, m.SKU, m.Survivor); err != nil {
+			return err
+		}
+		if err := mergeWarehouseStock(ctx, tx, m.SKU, m.Survivor); err != nil {
+			return err
+		}
+		for _, table := range mergedHistory {
+			if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET sku = $2 WHERE sku = $1", m.SKU, m.Survivor); err != nil {
+				return err
+			}
+		}
+		for _, t := range mergedSettings {
+			copySettings := "INSERT INTO " + t.table + " (sku, " + t.columns + ") SELECT $2, " + t.columns +
+				" FROM " + t.table + " WHERE sku = $1 ON CONFLICT DO NOTHING"
+			if _, err := tx.ExecContext(ctx, copySettings, m.SKU, m.Survivor); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+t.table+" WHERE sku = $1", m.SKU); err != nil {
+				return err
+			}
+		}
+		if err := mergeProduct(ctx, tx, m.SKU, m.Survivor); err != nil {
+			return err
+		}
+
+		const emptyItem string = `UPDATE inventory_service.items SET on_hand = 0, reserved = 0, quarantined = 0, safety_stock = 0,
+			barcode = NULL, updated_at = NOW() WHERE sku = $1`
+		if _, err := tx.ExecContext(ctx, emptyItem, m.SKU); err != nil {
+			return err
+		}
+		const fillSurvivor string = `UPDATE inventory_service.items SET on_hand = on_hand + $2, reserved = reserved + $3,
+			quarantined = quarantined + $4, barcode = COALESCE(barcode, $5), updated_at = NOW()
+			WHERE sku = $1 RETURNING ` + stockColumns
+		stock, err = scanStock(tx.QueryRowContext(ctx, fillSurvivor, m.Survivor, m.OnHand, m.Reserved, m.Quarantined, barcode))
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM inventory_service.stock_changes WHERE sku = $1", m.SKU); err != nil {
+			return err
+		}
+		if err := recordChange(ctx, tx, m.Survivor, stock.UpdatedAt); err != nil {
+			return err
+		}
+
+		// SKUs merged into this one earlier now redirect straight to the
+		// survivor.
+		const repoint string = "UPDATE inventory_service.item_merges SET survivor_sku = $2 WHERE survivor_sku = $1"
+		if _, err := tx.ExecContext(ctx, repoint, m.SKU, m.Survivor); err != nil {
+			return err
+		}
+		const insert string = `INSERT INTO inventory_service.item_merges (sku, survivor_sku, tenant_id, on_hand, reserved, quarantined, merged_by)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')) RETURNING merged_at`
+		return tx.QueryRowContext(ctx, insert, m.SKU, m.Survivor, tenant.FromContext(ctx), m.OnHand, m.Reserved, m.Quarantined, m.MergedBy).
+			Scan(&m.MergedAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// mergeCosts adds the merged SKU's cost positions to the survivor's at
+// each warehouse. Positions there in different currencies cannot be added,
+// so they block the merge.
+func mergeCosts(ctx context.Context, tx *sql.Tx, sku, survivor string) error {
+	const clash string = `SELECT c.warehouse FROM inventory_service.item_costs c
+		JOIN inventory_service.item_costs s ON s.sku = $2 AND s.warehouse = c.warehouse AND s.currency <> c.currency
+		WHERE c.sku = $1 ORDER BY c.warehouse LIMIT 1`
+	var warehouse string
+	err := tx.QueryRowContext(ctx, clash, sku, survivor).Scan(&warehouse)
+	if err == nil {
+		return fmt.Errorf("%w: costs at warehouse %s are in different currencies", ErrAlreadyExists, warehouse)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	const add string = `INSERT INTO inventory_service.item_costs (sku, warehouse, currency, quantity, average_total)
+		SELECT $2, warehouse, currency, quantity, average_total FROM inventory_service.item_costs WHERE sku = $1
+		ON CONFLICT (sku, warehouse) DO UPDATE SET quantity = item_costs.quantity + EXCLUDED.quantity,
+			average_total = item_costs.average_total + EXCLUDED.average_total, updated_at = NOW()`
+	if _, err := tx.ExecContext(ctx, add, sku, survivor); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM inventory_service.item_costs WHERE sku = $1", sku)
+	return err
+}
+
+// mergeProduct moves the merged SKU's catalog entry, with its price
+// history, to a survivor without one. Otherwise the survivor's entry wins
+// and the merged one is deactivated, keeping its history.
+func mergeProduct(ctx context.Context, tx *sql.Tx, sku, survivor string) error {
+	const copyProduct string = `INSERT INTO inventory_service.products
+			(sku, description, price_cents, currency, images, categories, active, created_at, updated_at)
+		SELECT $2, description, price_cents, currency, images, categories, active, created_at, NOW()
+		FROM inventory_service.products WHERE sku = $1
+		ON CONFLICT (sku) DO NOTHING`
+	res, err := tx.ExecContext(ctx, copyProduct, sku, survivor)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		const deactivate string = "UPDATE inventory_service.products SET active = FALSE, updated_at = NOW() WHERE sku = $1"
+		_, err := tx.ExecContext(ctx, deactivate, sku)
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE inventory_service.product_prices SET sku = $2 WHERE sku = $1", sku, survivor); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM inventory_service.products WHERE sku = $1", sku)
+	return err
+}
+
+func (s *PostgresStore) MergedInto(ctx context.Context, sku string) (string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// Read from the primary: a replica behind a fresh merge would let
+	// writes through to the merged SKU.
+	const query string = "SELECT survivor_sku FROM inventory_service.item_merges WHERE sku = $1 AND tenant_id = $2"
+	var survivor string
+	err := s.db.QueryRowContext(ctx, query, sku, tenant.FromContext(ctx)).Scan(&survivor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return survivor, err
+}
+
+func (s *PostgresStore) ListMerges(ctx context.Context, limit int) ([]Merge, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT sku, survivor_sku, on_hand, reserved, quarantined, COALESCE(merged_by, ''), merged_at
+		FROM inventory_service.item_merges WHERE tenant_id = $1 ORDER BY merged_at DESC, sku LIMIT $2`
+	rows, err := database.Reader(ctx, s.db).QueryContext(ctx, query, tenant.FromContext(ctx), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	merges := []Merge{}
+	for rows.Next() {
+		var m Merge
+		if err := rows.Scan(&m.SKU, &m.Survivor, &m.OnHand, &m.Reserved, &m.Quarantined, &m.MergedBy, &m.MergedAt); err != nil {
+			return nil, err
+		}
+		merges = append(merges, m)
+	}
+	return merges, rows.Err()
+}
@@ -0,0 +1,115 @@
+package inventory
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PurchaseOrderOpen     = "open"
+	PurchaseOrderReceived = "received"
+)
+
+type PurchaseOrderLine struct {
+	SKU          string `json:"sku"`
+	Quantity     int    `json:"quantity"`
+	Unit         string `json:"unit"`
+	UnitQuantity int    `json:"unit_quantity"`
+}
+
+type PurchaseOrder struct {
+	ID         int64               `json:"id"`
+	Supplier   string              `json:"supplier"`
+	Status     string              `json:"status"`
+	Lines      []PurchaseOrderLine `json:"lines"`
+	CreatedAt  time.Time           `json:"created_at"`
+	ReceivedAt *time.Time          `json:"received_at,omitempty"`
+}
+
+func (h *Handler) createPurchaseOrder(c *gin.Context) {
+	var req struct {
+		Supplier string `json:"supplier" binding:"required,max=255"`
+		Lines    []struct {
+			SKU      string `json:"sku" binding:"required"`
+			Quantity int    `json:"quantity" binding:"required,min=1"`
+			Unit     string `json:"unit"`
+		} `json:"lines" binding:"required,min=1,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	po := &PurchaseOrder{Supplier: req.Supplier}
+	for _, l := range req.Lines {
+		unit, quantity, ok := h.toBase(c, l.SKU, l.Unit, l.Quantity)
+		if !ok {
+			return
+		}
+		po.Lines = append(po.Lines, PurchaseOrderLine{SKU: l.SKU, Quantity: quantity, Unit: unit, UnitQuantity: l.Quantity})
+	}
+
+	err := h.store.CreatePurchaseOrder(c.Request.Context(), po)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, po)
+}
+
+func (h *Handler) getPurchaseOrder(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid purchase order id"})
+		return
+	}
+
+	po, err := h.store.GetPurchaseOrder(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "purchase order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, po)
+}
+
+// receivePurchaseOrder books every line into stock, each as a ledger movement
+// referencing the purchase order.
+func (h *Handler) receivePurchaseOrder(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid purchase order id"})
+		return
+	}
+
+	po, err := h.store.ReceivePurchaseOrder(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "purchase order not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "purchase order already received"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	skus := make([]string, len(po.Lines))
+	for i, line := range po.Lines {
+		skus[i] = line.SKU
+	}
+	h.stockChanged(c.Request.Context(), false, skus...)
+	c.JSON(http.StatusOK, po)
+}
@@ -0,0 +1,38 @@
+package inventory
+
+import (
+	"context"
+	"log"
+
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+)
+
+// Drift is an item whose stored stock disagreed with its ledger, its
+// active reservations or its quarantined lots.
+type Drift struct {
+	SKU            string
+	OnHand         int
+	LedgerOnHand   int
+	Reserved       int
+	ActiveReserved int
+	Quarantined    int
+	LotQuarantined int
+}
+
+// ReconcileJob corrects items whose stock drifted from the ledger and logs
+// each correction. It is meant to run nightly: it briefly blocks stock
+// changes while it runs.
+func ReconcileJob(store Store) jobs.Func {
+	return func(ctx context.Context) error {
+		drift, err := store.Reconcile(ctx)
+		if err != nil {
+			return err
+		}
+		for _, d := range drift {
+			log.Printf("Reconciled %s: on hand %d -> %d, reserved %d -> %d, quarantined %d -> %d",
+				d.SKU, d.OnHand, d.LedgerOnHand, d.Reserved, d.ActiveReserved, d.Quarantined, d.LotQuarantined)
+		}
+		log.Printf("Inventory reconciliation corrected %d items", len(drift))
+		return nil
+	}
+}
@@ -0,0 +1,378 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ReservationActive    = "active"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+
+	// maxReservationTTL bounds the ttl_seconds a reservation may ask for.
+	maxReservationTTL = 7 * 24 * time.Hour
+)
+
+// Reservation holds Quantity base units of a SKU's available stock until it
+// is committed, released or expires, at Warehouse. ReservedBy names who
+// made it, as the ledger names actors.
+type Reservation struct {
+	ID           int64      `json:"id"`
+	SKU          string     `json:"sku"`
+	Quantity     int        `json:"quantity"`
+	Unit         string     `json:"unit"`
+	UnitQuantity int        `json:"unit_quantity"`
+	Reference    string     `json:"reference,omitempty"`
+	ReservedBy   string     `json:"reserved_by,omitempty"`
+	Status       string     `json:"status"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	SettledAt    *time.Time `json:"settled_at,omitempty"`
+	Warehouse    string     `json:"warehouse"`
+	Tenant       string     `json:"-"`
+	// Allocation picks Warehouse when the reservation is made.
+	Allocation Allocation `json:"-"`
+}
+
+func (h *Handler) reserve(c *gin.Context) {
+	var req struct {
+		Quantity  int    `json:"quantity" binding:"required,min=1"`
+		Unit      string `json:"unit"`
+		Reference string `json:"reference"`
+		// TTLSeconds overrides the default reservation TTL; zero keeps it.
+		TTLSeconds int `json:"ttl_seconds" binding:"min=0"`
+		// Allocation picks the warehouse: nearest to the coordinates, which
+		// it needs, or the most stocked. It defaults to nearest when
+		// coordinates are given.
+		Allocation string   `json:"allocation" binding:"omitempty,oneof=most_stocked nearest"`
+		Latitude   *float64 `json:"latitude" binding:"omitempty,min=-90,max=90"`
+		Longitude  *float64 `json:"longitude" binding:"omitempty,min=-180,max=180"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sku := c.Param("sku")
+	unit, quantity, ok := h.toBase(c, sku, req.Unit, req.Quantity)
+	if !ok {
+		return
+	}
+
+	ttl := h.reservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > maxReservationTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds may be at most " + strconv.Itoa(int(maxReservationTTL.Seconds()))})
+		return
+	}
+
+	located := req.Latitude != nil && req.Longitude != nil
+	r := &Reservation{SKU: sku, Quantity: quantity, Unit: unit, UnitQuantity: req.Quantity, Reference: req.Reference,
+		Allocation: Allocation{Strategy: req.Allocation}}
+	switch {
+	case located:
+		r.Allocation.Latitude, r.Allocation.Longitude = *req.Latitude, *req.Longitude
+		if r.Allocation.Strategy == "" {
+			r.Allocation.Strategy = AllocateNearest
+		}
+	case req.Latitude != nil || req.Longitude != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "latitude and longitude must be given together"})
+		return
+	case r.Allocation.Strategy == AllocateNearest:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "nearest allocation needs latitude and longitude"})
+		return
+	}
+	if p, ok := auth.FromContext(c); ok {
+		r.ReservedBy = actor(p)
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		r.ExpiresAt = &expiresAt
+	}
+	stock, err := h.store.Reserve(c.Request.Context(), r)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if errors.Is(err, ErrInsufficientStock) {
+		h.insufficientStock(c, sku, quantity)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.stockChanged(c.Request.Context(), true, sku)
+	c.JSON(http.StatusCreated, gin.H{"reservation": r, "stock": stock})
+}
+
+func (h *Handler) releaseReservation(c *gin.Context) {
+	h.settleReservation(c, h.store.ReleaseReservation, false)
+}
+
+// commitReservation turns the reservation into a sale: its stock leaves on
+// hand through the ledger instead of going back to available.
+func (h *Handler) commitReservation(c *gin.Context) {
+	h.settleReservation(c, h.store.CommitReservation, true)
+}
+
+// extendReservation keeps an active reservation for ttl_seconds from now,
+// for a holder that needs longer to settle it, such as an order waiting on
+// an approval.
+func (h *Handler) extendReservation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reservation id"})
+		return
+	}
+	var req struct {
+		TTLSeconds int `json:"ttl_seconds" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl > maxReservationTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds may be at most " + strconv.Itoa(int(maxReservationTTL.Seconds()))})
+		return
+	}
+
+	r, err := h.store.ExtendReservation(c.Request.Context(), id, time.Now().Add(ttl))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "reservation already committed, released or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reservation": r})
+}
+
+func (h *Handler) settleReservation(c *gin.Context, settle func(context.Context, int64) (*Reservation, *Stock, error), decreased bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reservation id"})
+		return
+	}
+
+	r, stock, err := settle(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "reservation already committed, released or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.stockChanged(c.Request.Context(), decreased, r.SKU)
+	c.JSON(http.StatusOK, gin.H{"reservation": r, "stock": stock})
+}
+
+// ReservationExpiryJob expires reservations past their TTL, in batches of
+// batchSize, and announces each expiry, so its holder can give up on it,
+// and the stock it gave back.
+func ReservationExpiryJob(store Store, publisher events.Publisher, batchSize int) jobs.Func {
+	return func(ctx context.Context) error {
+		total := 0
+		for {
+			now := time.Now()
+			expired, err := store.ExpireReservations(ctx, now, batchSize)
+			if err != nil {
+				return err
+			}
+			for _, r := range expired {
+				ctx := tenant.NewContext(ctx, r.Tenant)
+				announceExpiry(ctx, publisher, r, now)
+				announce(ctx, publisher, nil, false, r.SKU)
+			}
+			total += len(expired)
+			if len(expired) < batchSize {
+				if total > 0 {
+					log.Printf("Expired %d stock reservations", total)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// ReservationArchiveJob moves reservations settled more than months months
+// ago to the archive, in batches of batchSize, keeping the hot table to the
+// reservations still in play and those reports most often ask about.
+// Reservation reports read the archive too.
+func ReservationArchiveJob(store Store, months, batchSize int) jobs.Func {
+	return func(ctx context.Context) error {
+		before := time.Now().AddDate(0, -months, 0)
+		total := 0
+		for {
+			n, err := store.ArchiveReservations(ctx, before, batchSize)
+			total += n
+			if err != nil || n < batchSize {
+				if total > 0 {
+					log.Printf("Archived %d stock reservations settled over %d months ago", total, months)
+				}
+				return err
+			}
+		}
+	}
+}
+
+// announceExpiry publishes a ReservationExpired event. The reservation is
+// already expired, so a failure is only logged.
+func announceExpiry(ctx context.Context, publisher events.Publisher, r Reservation, at time.Time) {
+	if publisher == nil {
+		return
+	}
+	e, err := events.New(events.InventoryReservationExpired, "inventory-service", events.ReservationExpired{
+		ReservationID: r.ID,
+		SKU:           r.SKU,
+		Quantity:      r.Quantity,
+		Reference:     r.Reference,
+		ExpiredAt:     at,
+		Tenant:        r.Tenant,
+	})
+	if err == nil {
+		err = publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish expiry of reservation %d: %v", r.ID, err)
+	}
+}
+
+// reservationBuckets are the upper bounds, in seconds, of the histogram of
+// how long reservations were held before they were settled.
+var reservationBuckets = []float64{60, 300, 900, 3600, 14400, 86400}
+
+// ReservationFilter picks the reservations a report covers: those created
+// in [From, To), of SKU when set. Limit bounds the SKUs and holders listed.
+type ReservationFilter struct {
+	From  time.Time
+	To    time.Time
+	SKU   string
+	Limit int
+}
+
+// ReservationCounts tallies reservations by outcome. ConversionRate is the
+// share of settled reservations that were committed, nil until any are.
+type ReservationCounts struct {
+	Reservations   int      `json:"reservations"`
+	Active         int      `json:"active"`
+	Committed      int      `json:"committed"`
+	Released       int      `json:"released"`
+	Expired        int      `json:"expired"`
+	ConversionRate *float64 `json:"conversion_rate"`
+}
+
+func (c *ReservationCounts) convert() {
+	c.ConversionRate = nil
+	if settled := c.Committed + c.Released + c.Expired; settled > 0 {
+		rate := float64(c.Committed) / float64(settled)
+		c.ConversionRate = &rate
+	}
+}
+
+// TimingBucket counts the settled reservations held for at most
+// UpToSeconds, and longer than the bucket before; the last bucket has no
+// bound.
+type TimingBucket struct {
+	UpToSeconds *float64 `json:"up_to_seconds"`
+	Count       int      `json:"count"`
+}
+
+// OutcomeTiming describes how long reservations that ended in Outcome were
+// held, from creation to settlement.
+type OutcomeTiming struct {
+	Outcome    string         `json:"outcome"`
+	Count      int            `json:"count"`
+	P50Seconds float64        `json:"p50_seconds"`
+	P90Seconds float64        `json:"p90_seconds"`
+	Buckets    []TimingBucket `json:"buckets"`
+}
+
+type SKUReservations struct {
+	SKU string `json:"sku"`
+	ReservationCounts
+}
+
+// HolderReservations tallies one holder's reservations. AbandonedQuantity
+// is the stock they held without buying it, released or expired; holders
+// who abandon the most come first, since that is what hoarding looks like.
+type HolderReservations struct {
+	ReservedBy string `json:"reserved_by"`
+	ReservationCounts
+	AbandonedQuantity int `json:"abandoned_quantity"`
+}
+
+type ReservationReport struct {
+	From    time.Time            `json:"from"`
+	To      time.Time            `json:"to"`
+	SKU     string               `json:"sku,omitempty"`
+	Totals  ReservationCounts    `json:"totals"`
+	Timing  []OutcomeTiming      `json:"timing"`
+	SKUs    []SKUReservations    `json:"skus"`
+	Holders []HolderReservations `json:"holders"`
+}
+
+// reservationReport reports how the reservations created in a window
+// turned out, for tuning reservation TTLs and spotting holders who reserve
+// stock only to let it go.
+func (h *Handler) reservationReport(c *gin.Context) {
+	to := time.Now()
+	if raw := c.Query("to"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 timestamp"})
+			return
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -30)
+	if raw := c.Query("from"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 timestamp"})
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit <= 0 || limit > 200 {
+		limit = 20
+	}
+
+	report, err := h.store.ReservationReport(c.Request.Context(), ReservationFilter{From: from, To: to, SKU: c.Query("sku"), Limit: limit})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,228 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// SafetyPolicy is a SKU's safety stock target: enough stock to cover demand
+// over LeadTimeDays with probability ServiceLevel. SafetyStock, in base
+// units, is held back from availability; it and the demand figures are
+// from the last calculation, which CalculatedAt is nil before.
+type SafetyPolicy struct {
+	SKU          string     `json:"sku"`
+	Name         string     `json:"name"`
+	ServiceLevel float64    `json:"service_level"`
+	LeadTimeDays int        `json:"lead_time_days"`
+	SafetyStock  int        `json:"safety_stock"`
+	DemandMean   float64    `json:"daily_demand_mean"`
+	DemandStdDev float64    `json:"daily_demand_stddev"`
+	DemandDays   int        `json:"demand_days"`
+	CalculatedAt *time.Time `json:"calculated_at,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	Tenant       string     `json:"-"`
+}
+
+// safetyStock returns the mean and sample standard deviation of daily
+// demand and the safety stock for level over leadTimeDays: z·σ·√L, rounded
+// up, where z is the standard normal quantile of level. It assumes days are
+// independent; with fewer than two days there is no variability to cover.
+func safetyStock(level float64, leadTimeDays int, demand []int) (float64, float64, int) {
+	if len(demand) == 0 {
+		return 0, 0, 0
+	}
+	var sum float64
+	for _, d := range demand {
+		sum += float64(d)
+	}
+	mean := sum / float64(len(demand))
+	if len(demand) < 2 {
+		return mean, 0, 0
+	}
+	var squares float64
+	for _, d := range demand {
+		squares += (float64(d) - mean) * (float64(d) - mean)
+	}
+	stddev := math.Sqrt(squares / float64(len(demand)-1))
+
+	z := math.Sqrt2 * math.Erfinv(2*level-1)
+	units := math.Ceil(z * stddev * math.Sqrt(float64(leadTimeDays)))
+	if units <= 0 || math.IsNaN(units) {
+		return mean, stddev, 0
+	}
+	return mean, stddev, int(units)
+}
+
+// SafetyStockPlanner recalculates safety stock from each SKU's recent
+// demand.
+type SafetyStockPlanner struct {
+	store      Store
+	publisher  events.Publisher
+	watcher    *Watcher
+	windowDays int
+	now        func() time.Time
+}
+
+// NewSafetyStockPlanner looks at the last windowDays of demand. Raising
+// safety stock takes it out of availability, so watcher, when non-nil, is
+// triggered to check reorder points.
+func NewSafetyStockPlanner(store Store, publisher events.Publisher, watcher *Watcher, windowDays int) *SafetyStockPlanner {
+	return &SafetyStockPlanner{
+		store:      store,
+		publisher:  publisher,
+		watcher:    watcher,
+		windowDays: windowDays,
+		now:        time.Now,
+	}
+}
+
+// Job runs Recalculate and logs what it did. Demand is counted in whole UTC
+// days, so it is meant to run daily shortly after midnight UTC.
+func (p *SafetyStockPlanner) Job() jobs.Func {
+	return func(ctx context.Context) error {
+		calculated, changed, err := p.Recalculate(ctx)
+		log.Printf("Recalculated safety stock for %d SKUs, %d changed", calculated, changed)
+		return err
+	}
+}
+
+// Recalculate recalculates every policy, across tenants, and returns how
+// many it calculated and how many SKUs' safety stock changed.
+func (p *SafetyStockPlanner) Recalculate(ctx context.Context) (int, int, error) {
+	policies, err := p.store.SafetyPolicies(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	changed := 0
+	for i := range policies {
+		policy := &policies[i]
+		ok, err := p.Calculate(tenant.NewContext(ctx, policy.Tenant), policy)
+		if err != nil {
+			return i, changed, err
+		}
+		if ok {
+			changed++
+		}
+	}
+	return len(policies), changed, nil
+}
+
+// Calculate recalculates policy from the SKU's demand over the window up to
+// yesterday, stores it and, if the SKU's safety stock changed, announces the
+// change. It reports whether it did.
+func (p *SafetyStockPlanner) Calculate(ctx context.Context, policy *SafetyPolicy) (bool, error) {
+	now := p.now()
+	today := now.UTC().Truncate(24 * time.Hour)
+	demand, err := p.store.DailyDemand(ctx, policy.SKU, today.AddDate(0, 0, -p.windowDays), today)
+	if err != nil {
+		return false, err
+	}
+	before := policy.SafetyStock
+	policy.DemandMean, policy.DemandStdDev, policy.SafetyStock = safetyStock(policy.ServiceLevel, policy.LeadTimeDays, demand)
+	policy.DemandDays = len(demand)
+	policy.CalculatedAt = &now
+	changed, err := p.store.SaveSafetyStock(ctx, policy)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		log.Printf("Safety stock of %s: %d -> %d", policy.SKU, before, policy.SafetyStock)
+		announce(ctx, p.publisher, p.watcher, policy.SafetyStock > before, policy.SKU)
+	}
+	return changed, nil
+}
+
+type SafetyStockHandler struct {
+	planner *SafetyStockPlanner
+}
+
+func NewSafetyStockHandler(planner *SafetyStockPlanner) *SafetyStockHandler {
+	return &SafetyStockHandler{planner: planner}
+}
+
+func (h *SafetyStockHandler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/items/:sku/safety-stock", h.get)
+	router.PUT("/items/:sku/safety-stock", h.set)
+	router.DELETE("/items/:sku/safety-stock", h.remove)
+}
+
+// RegisterAdminRoutes mounts the recalculation trigger on an
+// admin-token-protected group.
+func (h *SafetyStockHandler) RegisterAdminRoutes(admin gin.IRouter) {
+	admin.POST("/safety-stock/recalculate", h.recalculate)
+}
+
+func (h *SafetyStockHandler) get(c *gin.Context) {
+	p, err := h.planner.store.GetSafetyPolicy(c.Request.Context(), c.Param("sku"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "safety stock policy not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// set stores the policy and calculates it straight away, so the SKU's
+// availability reflects it without waiting for the nightly job.
+func (h *SafetyStockHandler) set(c *gin.Context) {
+	var req struct {
+		ServiceLevel float64 `json:"service_level" binding:"required,gte=0.5,lte=0.9999"`
+		LeadTimeDays int     `json:"lead_time_days" binding:"required,min=1,max=365"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	p := &SafetyPolicy{SKU: c.Param("sku"), ServiceLevel: req.ServiceLevel, LeadTimeDays: req.LeadTimeDays}
+	err := h.planner.store.SetSafetyPolicy(ctx, p)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err == nil {
+		_, err = h.planner.Calculate(ctx, p)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func (h *SafetyStockHandler) remove(c *gin.Context) {
+	sku := c.Param("sku")
+	err := h.planner.store.DeleteSafetyPolicy(c.Request.Context(), sku)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "safety stock policy not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	announce(c.Request.Context(), h.planner.publisher, h.planner.watcher, false, sku)
+	c.Status(http.StatusNoContent)
+}
+
+func (h *SafetyStockHandler) recalculate(c *gin.Context) {
+	calculated, changed, err := h.planner.Recalculate(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "calculated": calculated, "changed": changed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"calculated": calculated, "changed": changed})
+}
@@ -0,0 +1,55 @@
+package inventory
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// ReasonPickShortage is the ledger reason of stock found missing at pick
+// time.
+const ReasonPickShortage = "pick_shortage"
+
+// reportShortage books stock a picker could not find off on-hand stock. A
+// shortage is a fact rather than a request, so it is booked even when it
+// takes available stock negative, with the reporter as the override, and
+// alerts like any other override that does. Reports are deduplicated by
+// reference: a retry gets the movement already booked and a 200.
+func (h *Handler) reportShortage(c *gin.Context) {
+	var req struct {
+		Quantity  int    `json:"quantity" binding:"required,min=1"`
+		Unit      string `json:"unit"`
+		Reference string `json:"reference" binding:"required,max=255"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sku := c.Param("sku")
+	unit, quantity, ok := h.toBase(c, sku, req.Unit, req.Quantity)
+	if !ok {
+		return
+	}
+	p, _ := auth.FromContext(c)
+	m := &Movement{SKU: sku, Delta: -quantity, Unit: unit, UnitQuantity: -req.Quantity, Reason: ReasonPickShortage,
+		Reference: req.Reference, OverrideBy: actor(p)}
+	stock, recorded, err := h.store.RecordOnce(c.Request.Context(), m)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !recorded {
+		c.JSON(http.StatusOK, gin.H{"movement": m, "stock": stock})
+		return
+	}
+	h.stockChanged(c.Request.Context(), true, sku)
+	h.stockWentNegative(c.Request.Context(), m, stock)
+	c.JSON(http.StatusCreated, gin.H{"movement": m, "stock": stock})
+}
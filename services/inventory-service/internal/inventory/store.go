@@ -0,0 +1,1711 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/coalesce"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrAlreadyExists     = errors.New("already exists")
+	ErrUnknownUnit       = errors.New("unknown unit")
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrInvalidState is returned when a reservation, purchase order or lot
+	// is not in a status that allows the requested transition.
+	ErrInvalidState = errors.New("invalid state")
+	// ErrAdjustmentRejected is returned when a line of a stock adjustment
+	// cannot be applied, so none were.
+	ErrAdjustmentRejected = errors.New("adjustment rejected")
+)
+
+type Stock struct {
+	models.Stock
+	// Version is sent as the item's ETag. Every change to the item bumps
+	// it, stock movements included.
+	Version int64 `json:"-"`
+}
+
+// Movement is a change to on-hand stock. Delta is always in base units;
+// Unit and UnitQuantity record what the caller actually sent. OverrideBy
+// names who overrode the negative-stock guard for it, if anyone. LotID, when
+// set, books the movement into or out of that lot too. Warehouse is where
+// the stock came in or left, DefaultWarehouse when none is named.
+type Movement struct {
+	ID           int64     `json:"id"`
+	SKU          string    `json:"sku"`
+	Delta        int       `json:"delta"`
+	Unit         string    `json:"unit"`
+	UnitQuantity int       `json:"unit_quantity"`
+	Reason       string    `json:"reason"`
+	Reference    string    `json:"reference,omitempty"`
+	OverrideBy   string    `json:"override_by,omitempty"`
+	LotID        int64     `json:"lot_id,omitempty"`
+	Warehouse    string    `json:"warehouse"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type Store interface {
+	CreateItem(ctx context.Context, sku, name string) (*Stock, error)
+	Get(ctx context.Context, sku string) (*Stock, error)
+	List(ctx context.Context, limit, offset int) ([]Stock, error)
+	// Stream calls fn with every item List would list, by SKU, as the rows
+	// are scanned, and stops at fn's first error.
+	Stream(ctx context.Context, fn func(Stock) error) error
+	// RecordMovement appends m to the ledger, applies it to the item's stock
+	// and records the change in the change log, atomically. A decrease that
+	// would leave available stock negative, not counting safety stock, fails
+	// with ErrInsufficientStock unless m.OverrideBy is set. A movement for a lot that is not active, or
+	// that would take the lot below zero, fails with ErrInvalidState.
+	RecordMovement(ctx context.Context, m *Movement) (*Stock, error)
+	// RecordOnce records m like RecordMovement unless the SKU's ledger
+	// already holds a movement with m's reason and reference. Then it fills
+	// in m from that movement, returns the current stock and reports false.
+	RecordOnce(ctx context.Context, m *Movement) (*Stock, bool, error)
+	// ChangesSince returns the current stock of SKUs changed after since,
+	// oldest change first.
+	ChangesSince(ctx context.Context, since time.Time, limit int) ([]Stock, error)
+
+	// ListUnits returns the SKU's units, including the implicit base unit.
+	ListUnits(ctx context.Context, sku string) ([]Unit, error)
+	SetUnit(ctx context.Context, sku string, u Unit) error
+	// UnitFactor returns how many base units one unit holds.
+	UnitFactor(ctx context.Context, sku, unit string) (int, error)
+
+	// Reserve holds r.Quantity base units of available stock at the
+	// warehouse r.Allocation picks, and sets r.Warehouse. Stock available
+	// in total but at no single warehouse is ErrInsufficientStock.
+	Reserve(ctx context.Context, r *Reservation) (*Stock, error)
+	// ReleaseReservation gives an active reservation's stock back;
+	// CommitReservation books it out of stock with a ledger movement.
+	// Either on a settled reservation is ErrInvalidState.
+	ReleaseReservation(ctx context.Context, id int64) (*Reservation, *Stock, error)
+	CommitReservation(ctx context.Context, id int64) (*Reservation, *Stock, error)
+	// ExtendReservation moves an active reservation's expiry out to
+	// expiresAt, never closer; one that does not expire is left as it is.
+	// A settled reservation is ErrInvalidState.
+	ExtendReservation(ctx context.Context, id int64, expiresAt time.Time) (*Reservation, error)
+	// ExpireReservations expires up to limit active reservations whose
+	// expiry is at or before now, across tenants, gives their stock back
+	// and returns them.
+	ExpireReservations(ctx context.Context, now time.Time, limit int) ([]Reservation, error)
+	// ArchiveReservations moves up to limit reservations, across tenants,
+	// settled before the given time to the archive, and returns how many
+	// it moved.
+	ArchiveReservations(ctx context.Context, before time.Time, limit int) (int, error)
+	// ReservationReport summarizes the outcomes of reservations made in f's
+	// window.
+	ReservationReport(ctx context.Context, f ReservationFilter) (*ReservationReport, error)
+
+	CreatePurchaseOrder(ctx context.Context, po *PurchaseOrder) error
+	GetPurchaseOrder(ctx context.Context, id int64) (*PurchaseOrder, error)
+	// ReceivePurchaseOrder books every line into stock as a movement.
+	ReceivePurchaseOrder(ctx context.Context, id int64) (*PurchaseOrder, error)
+
+	// ApplyAdjustment books every line of a into stock as a movement and
+	// logs a, in one transaction. If any line cannot be applied, its Err is
+	// set and nothing is applied: ErrAdjustmentRejected. A dry run fills in
+	// each line's resulting stock and rolls everything back.
+	ApplyAdjustment(ctx context.Context, a *Adjustment, overrideBy string) error
+	GetAdjustment(ctx context.Context, id int64) (*Adjustment, error)
+	// ListAdjustments returns the latest adjustments, without their lines.
+	ListAdjustments(ctx context.Context, limit int) ([]Adjustment, error)
+
+	ListThresholds(ctx context.Context) ([]Threshold, error)
+	GetThreshold(ctx context.Context, sku string) (*Threshold, error)
+	// SetThreshold creates or replaces the SKU's threshold and clears any
+	// outstanding alert, so the new rule is evaluated from scratch.
+	SetThreshold(ctx context.Context, t *Threshold) error
+	DeleteThreshold(ctx context.Context, sku string) error
+	// LowStock returns thresholds whose SKU is below its reorder point and
+	// has not been alerted on yet.
+	LowStock(ctx context.Context, limit int) ([]Threshold, error)
+	MarkAlerted(ctx context.Context, sku string, at time.Time) error
+	// ClearRecovered clears the alert of SKUs back at or above their reorder
+	// point and returns how many there were.
+	ClearRecovered(ctx context.Context) (int, error)
+
+	// ReceiveLot creates lot and books m, which must be for the same SKU,
+	// into it.
+	ReceiveLot(ctx context.Context, lot *Lot, m *Movement) (*Stock, error)
+	// ListLots returns the SKU's active lots with stock left, in the order
+	// they should be picked: soonest expiry first.
+	ListLots(ctx context.Context, sku string) ([]Lot, error)
+	// ExpiryReport returns active and quarantined lots with stock left that
+	// expire on or before through, soonest first.
+	ExpiryReport(ctx context.Context, through time.Time) ([]Lot, error)
+	// DisposeLot writes off the lot's remaining stock with a ledger movement
+	// and marks it disposed.
+	DisposeLot(ctx context.Context, id int64, m *Movement) (*Lot, *Stock, error)
+	// ExpiringLots returns active lots with stock left that expire on or
+	// before through and have not been alerted on yet, across tenants.
+	ExpiringLots(ctx context.Context, through time.Time, limit int) ([]Lot, error)
+	MarkLotAlerted(ctx context.Context, id int64, at time.Time) error
+	// QuarantineExpired quarantines active lots that expired before today,
+	// across tenants, and returns them.
+	QuarantineExpired(ctx context.Context, today time.Time) ([]Lot, error)
+
+	// Reconcile recomputes every item's on-hand stock from the ledger, its
+	// reserved stock from active reservations and its quarantined stock
+	// from quarantined lots, corrects items that drifted and returns them.
+	Reconcile(ctx context.Context) ([]Drift, error)
+
+	GetSafetyPolicy(ctx context.Context, sku string) (*SafetyPolicy, error)
+	// SetSafetyPolicy creates or replaces the SKU's service level and lead
+	// time, keeping the last calculation until the next one.
+	SetSafetyPolicy(ctx context.Context, p *SafetyPolicy) error
+	// DeleteSafetyPolicy removes the policy and releases its safety stock.
+	DeleteSafetyPolicy(ctx context.Context, sku string) error
+	// SafetyPolicies returns every policy, across tenants.
+	SafetyPolicies(ctx context.Context) ([]SafetyPolicy, error)
+	// DailyDemand returns the SKU's outbound base units per UTC day from
+	// from up to but excluding to, starting at its first ledger entry if
+	// that is later. Disposals are write-offs, not demand.
+	DailyDemand(ctx context.Context, sku string, from, to time.Time) ([]int, error)
+	// SaveSafetyStock stores p's calculation and applies p.SafetyStock to
+	// the item, reporting whether the item's safety stock changed.
+	SaveSafetyStock(ctx context.Context, p *SafetyPolicy) (bool, error)
+
+	// SetBarcode sets the item's barcode, an empty one clearing it, and
+	// returns the item's new version. Unless version is etag.Any, an item
+	// whose version has moved on is etag.ErrMismatch.
+	SetBarcode(ctx context.Context, sku string, version int64, barcode string) (int64, error)
+	// ItemNames returns up to limit items that have not been merged away,
+	// by SKU.
+	ItemNames(ctx context.Context, limit int) ([]ItemName, error)
+	// MergeItem merges m.SKU into m.Survivor in one transaction and returns
+	// the survivor's stock. The survivor takes over the merged SKU's stock,
+	// ledger, lots, reservations and purchase order and adjustment lines,
+	// and any units, rules, dimensions, location, barcode and catalog entry
+	// it lacks; the merged item is left empty and listed no more. Either SKU
+	// missing is ErrNotFound, either already merged ErrInvalidState, and a
+	// lot code on both ErrAlreadyExists.
+	MergeItem(ctx context.Context, m *Merge) (*Stock, error)
+	// MergedInto returns the SKU that sku was merged into, or ErrNotFound.
+	MergedInto(ctx context.Context, sku string) (string, error)
+	// ListMerges returns the latest merges first.
+	ListMerges(ctx context.Context, limit int) ([]Merge, error)
+
+	// CreateWarehouse registers w, or returns ErrAlreadyExists.
+	CreateWarehouse(ctx context.Context, w *Warehouse) error
+	ListWarehouses(ctx context.Context) ([]Warehouse, error)
+	// StockByWarehouse returns the SKU's stock at DefaultWarehouse and at
+	// every warehouse that has held any.
+	StockByWarehouse(ctx context.Context, sku string) ([]WarehouseStock, error)
+	// WarehouseInventory returns a page of the SKUs held at a warehouse, by
+	// SKU, or ErrUnknownWarehouse.
+	WarehouseInventory(ctx context.Context, code string, limit, offset int) ([]WarehouseStock, error)
+	// Transfer moves t's stock between warehouses and returns the SKU's
+	// stock at each after. More than the source has available is
+	// ErrInsufficientStock, and a warehouse not registered
+	// ErrUnknownWarehouse.
+	Transfer(ctx context.Context, t *Transfer) ([]WarehouseStock, error)
+	// ListTransfers returns the latest transfers first, of sku when it is
+	// not empty.
+	ListTransfers(ctx context.Context, sku string, limit int) ([]Transfer, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const stockColumns = "sku, name, on_hand, reserved, quarantined, safety_stock, on_hand - reserved - quarantined - safety_stock, updated_at, version"
+
+func scanStock(row interface{ Scan(...any) error }) (*Stock, error) {
+	var s Stock
+	if err := row.Scan(&s.SKU, &s.Name, &s.OnHand, &s.Reserved, &s.Quarantined, &s.SafetyStock, &s.Available, &s.UpdatedAt, &s.Version); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *PostgresStore) CreateItem(ctx context.Context, sku, name string) (*Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// SKUs are unique across tenants, so a SKU taken by another tenant is
+	// reported as already existing too.
+	const query string = `INSERT INTO inventory_service.items (sku, name, tenant_id) VALUES ($1, $2, $3)
+		ON CONFLICT (sku) DO NOTHING RETURNING ` + stockColumns
+	stock, err := scanStock(s.db.QueryRowContext(ctx, query, sku, name, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAlreadyExists
+	}
+	return stock, err
+}
+
+// gets shares concurrent reads of one SKU's stock, which a popular item's
+// product page and every cart holding it ask for at once.
+var gets = coalesce.New[*Stock]("inventory.get")
+
+// Get reads the item once for any number of concurrent GET requests for
+// it, each getting its own copy.
+func (s *PostgresStore) Get(ctx context.Context, sku string) (*Stock, error) {
+	shared, err := gets.Do(ctx, sku, func() (*Stock, error) {
+		ctx, cancel := database.WithTimeout(ctx)
+		defer cancel()
+
+		const query string = `SELECT ` + stockColumns + ` FROM inventory_service.items WHERE sku = $1 AND tenant_id = $2`
+		stock, err := scanStock(database.Reader(ctx, s.db).QueryRowContext(ctx, query, sku, tenant.FromContext(ctx)))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return stock, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	stock := *shared
+	return &stock, nil
+}
+
+func (s *PostgresStore) List(ctx context.Context, limit, offset int) ([]Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + stockColumns + ` FROM inventory_service.items i
+		WHERE tenant_id = $3 AND NOT EXISTS (SELECT 1 FROM inventory_service.item_merges m WHERE m.sku = i.sku)
+		ORDER BY sku LIMIT $1 OFFSET $2`
+	return s.queryStock(ctx, database.Reader(ctx, s.db), query, limit, offset, tenant.FromContext(ctx))
+}
+
+// Stream is not bound by the query timeout, which is meant for single
+// queries, since a large listing takes as long as the client reads it.
+// The client going away still cancels it.
+func (s *PostgresStore) Stream(ctx context.Context, fn func(Stock) error) error {
+	const query string = `SELECT ` + stockColumns + ` FROM inventory_service.items i
+		WHERE tenant_id = $1 AND NOT EXISTS (SELECT 1 FROM inventory_service.item_merges m WHERE m.sku = i.sku)
+		ORDER BY sku`
+	rows, err := database.Reader(ctx, s.db).QueryContext(ctx, query, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		st, err := scanStock(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(*st); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *PostgresStore) RecordMovement(ctx context.Context, m *Movement) (*Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stock, err := recordMovement(ctx, tx, m)
+	if err != nil {
+		return nil, err
+	}
+	return stock, tx.Commit()
+}
+
+// RecordOnce locks the item first, so concurrent retries of one movement
+// cannot both miss each other in the ledger.
+func (s *PostgresStore) RecordOnce(ctx context.Context, m *Movement) (*Stock, bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var stock *Stock
+	var recorded bool
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		recorded = false
+		const lockItem string = `SELECT ` + stockColumns + ` FROM inventory_service.items
+			WHERE sku = $1 AND tenant_id = $2 FOR UPDATE`
+		var err error
+		stock, err = scanStock(tx.QueryRowContext(ctx, lockItem, m.SKU, tenant.FromContext(ctx)))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		const existing string = `SELECT id, delta, unit, unit_quantity, COALESCE(override_by, ''), COALESCE(lot_id, 0), warehouse, created_at
+			FROM inventory_service.stock_ledger WHERE sku = $1 AND reason = $2 AND reference = $3 ORDER BY id LIMIT 1`
+		err = tx.QueryRowContext(ctx, existing, m.SKU, m.Reason, m.Reference).
+			Scan(&m.ID, &m.Delta, &m.Unit, &m.UnitQuantity, &m.OverrideBy, &m.LotID, &m.Warehouse, &m.CreatedAt)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		stock, err = recordMovement(ctx, tx, m)
+		recorded = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return stock, recorded, nil
+}
+
+func recordMovement(ctx context.Context, tx *sql.Tx, m *Movement) (*Stock, error) {
+	m.Warehouse = normalizeWarehouse(m.Warehouse)
+	if err := registered(ctx, tx, m.Warehouse); err != nil {
+		return nil, err
+	}
+	const insertLedger string = `INSERT INTO inventory_service.stock_ledger (sku, delta, unit, unit_quantity, reason, reference, override_by, lot_id, warehouse)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, 0), $9) RETURNING id, created_at`
+	if err := tx.QueryRowContext(ctx, insertLedger, m.SKU, m.Delta, m.Unit, m.UnitQuantity, m.Reason, m.Reference, m.OverrideBy, m.LotID, m.Warehouse).
+		Scan(&m.ID, &m.CreatedAt); err != nil {
+		if isForeignKeyViolation(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	if m.LotID != 0 {
+		const updateLot string = `UPDATE inventory_service.stock_lots SET quantity = quantity + $2
+			WHERE id = $1 AND sku = $3 AND status = 'active' AND quantity + $2 >= 0`
+		res, err := tx.ExecContext(ctx, updateLot, m.LotID, m.Delta, m.SKU)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, ErrInvalidState
+		}
+	}
+
+	const updateItem string = `UPDATE inventory_service.items SET on_hand = on_hand + $2, updated_at = $3
+		WHERE sku = $1 AND tenant_id = $4 AND ($2 >= 0 OR $5 OR on_hand + $2 - reserved - quarantined >= 0)
+		RETURNING ` + stockColumns
+	stock, err := scanStock(tx.QueryRowContext(ctx, updateItem, m.SKU, m.Delta, m.CreatedAt, tenant.FromContext(ctx), m.OverrideBy != ""))
+	if errors.Is(err, sql.ErrNoRows) {
+		const existsQuery string = `SELECT EXISTS (SELECT 1 FROM inventory_service.items WHERE sku = $1 AND tenant_id = $2)`
+		var exists bool
+		if err := tx.QueryRowContext(ctx, existsQuery, m.SKU, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, ErrInsufficientStock
+		}
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The item's totals allow the movement; so must the warehouse's stock.
+	var available int
+	if m.Warehouse == DefaultWarehouse {
+		if m.Delta < 0 {
+			available, err = defaultAvailable(ctx, tx, m.SKU)
+		}
+	} else {
+		available, err = bookStock(ctx, tx, m.SKU, m.Warehouse, m.Delta, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Delta < 0 && m.OverrideBy == "" && available < 0 {
+		return nil, ErrInsufficientStock
+	}
+
+	const upsertChange string = `INSERT INTO inventory_service.stock_changes (sku, ledger_id, changed_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (sku) DO UPDATE SET ledger_id = EXCLUDED.ledger_id, changed_at = EXCLUDED.changed_at`
+	if _, err := tx.ExecContext(ctx, upsertChange, m.SKU, m.ID, m.CreatedAt); err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+func (s *PostgresStore) ChangesSince(ctx context.Context, since time.Time, limit int) ([]Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT i.sku, i.name, i.on_hand, i.reserved, i.quarantined, i.safety_stock,
+			i.on_hand - i.reserved - i.quarantined - i.safety_stock, c.changed_at
+		FROM inventory_service.stock_changes c
+		JOIN inventory_service.items i ON i.sku = c.sku
+		WHERE c.changed_at > $1 AND i.tenant_id = $3
+		ORDER BY c.changed_at, c.sku
+		LIMIT $2`
+	return s.queryStock(ctx, s.db, query, since, limit, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) queryStock(ctx context.Context, db *sql.DB, query string, args ...any) ([]Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stock := []Stock{}
+	for rows.Next() {
+		st, err := scanStock(rows)
+		if err != nil {
+			return nil, err
+		}
+		stock = append(stock, *st)
+	}
+	return stock, rows.Err()
+}
+
+func (s *PostgresStore) ListUnits(ctx context.Context, sku string) ([]Unit, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.Get(ctx, sku); err != nil {
+		return nil, err
+	}
+
+	const query string = `SELECT unit, factor FROM inventory_service.item_units WHERE sku = $1 ORDER BY factor, unit`
+	rows, err := s.db.QueryContext(ctx, query, sku)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	units := []Unit{{Name: BaseUnit, Factor: 1}}
+	for rows.Next() {
+		var u Unit
+		if err := rows.Scan(&u.Name, &u.Factor); err != nil {
+			return nil, err
+		}
+		units = append(units, u)
+	}
+	return units, rows.Err()
+}
+
+func (s *PostgresStore) SetUnit(ctx context.Context, sku string, u Unit) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO inventory_service.item_units (sku, unit, factor) VALUES ($1, $2, $3)
+		ON CONFLICT (sku, unit) DO UPDATE SET factor = EXCLUDED.factor`
+	_, err := s.db.ExecContext(ctx, query, sku, u.Name, u.Factor)
+	if isForeignKeyViolation(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) UnitFactor(ctx context.Context, sku, unit string) (int, error) {
+	if unit == BaseUnit {
+		return 1, nil
+	}
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT factor FROM inventory_service.item_units WHERE sku = $1 AND unit = $2`
+	var factor int
+	err := s.db.QueryRowContext(ctx, query, sku, unit).Scan(&factor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUnknownUnit
+	}
+	return factor, err
+}
+
+func (s *PostgresStore) Reserve(ctx context.Context, r *Reservation) (*Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the item before reading its warehouses' stock, so what is
+	// allocated is still there once reserved.
+	if err := lockItem(ctx, tx, r.SKU); err != nil {
+		return nil, err
+	}
+	warehouses, err := stockByWarehouse(ctx, tx, r.SKU)
+	if err != nil {
+		return nil, err
+	}
+	warehouse, ok := allocate(warehouses, r.Quantity, r.Allocation)
+	if !ok {
+		return nil, ErrInsufficientStock
+	}
+
+	const reserve string = `UPDATE inventory_service.items SET reserved = reserved + $2, updated_at = NOW()
+		WHERE sku = $1 AND tenant_id = $3 AND on_hand - reserved - quarantined - safety_stock >= $2 RETURNING ` + stockColumns
+	stock, err := scanStock(tx.QueryRowContext(ctx, reserve, r.SKU, r.Quantity, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInsufficientStock
+	}
+	if err != nil {
+		return nil, err
+	}
+	if warehouse != DefaultWarehouse {
+		if _, err := bookStock(ctx, tx, r.SKU, warehouse, 0, r.Quantity); err != nil {
+			return nil, err
+		}
+	}
+
+	r.Warehouse = warehouse
+	const insert string = `INSERT INTO inventory_service.stock_reservations (sku, quantity, unit, unit_quantity, reference, reserved_by, expires_at, warehouse)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, $8) RETURNING id, status, created_at`
+	if err := tx.QueryRowContext(ctx, insert, r.SKU, r.Quantity, r.Unit, r.UnitQuantity, r.Reference, r.ReservedBy, r.ExpiresAt, r.Warehouse).
+		Scan(&r.ID, &r.Status, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := recordChange(ctx, tx, r.SKU, stock.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return stock, tx.Commit()
+}
+
+// reservationColumns reads a reservation r joined to its item i.
+const reservationColumns = `r.id, r.sku, r.quantity, r.unit, r.unit_quantity, COALESCE(r.reference, ''), COALESCE(r.reserved_by, ''),
+	r.status, r.created_at, r.expires_at, r.settled_at, r.warehouse, i.tenant_id`
+
+func scanReservation(row interface{ Scan(...any) error }) (*Reservation, error) {
+	var r Reservation
+	var expiresAt, settledAt sql.NullTime
+	if err := row.Scan(&r.ID, &r.SKU, &r.Quantity, &r.Unit, &r.UnitQuantity, &r.Reference, &r.ReservedBy,
+		&r.Status, &r.CreatedAt, &expiresAt, &settledAt, &r.Warehouse, &r.Tenant); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		r.ExpiresAt = &expiresAt.Time
+	}
+	if settledAt.Valid {
+		r.SettledAt = &settledAt.Time
+	}
+	return &r, nil
+}
+
+func (s *PostgresStore) ReleaseReservation(ctx context.Context, id int64) (*Reservation, *Stock, error) {
+	return s.settleReservation(ctx, id, ReservationReleased)
+}
+
+func (s *PostgresStore) CommitReservation(ctx context.Context, id int64) (*Reservation, *Stock, error) {
+	return s.settleReservation(ctx, id, ReservationCommitted)
+}
+
+// settleReservation moves an active reservation to status and takes its
+// quantity off the item's reserved stock. A committed reservation's stock
+// then leaves on hand through the ledger, referencing the reservation.
+func (s *PostgresStore) settleReservation(ctx context.Context, id int64, status string) (*Reservation, *Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var r *Reservation
+	var stock *Stock
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const settle string = `UPDATE inventory_service.stock_reservations r SET status = $2, settled_at = NOW()
+			FROM inventory_service.items i
+			WHERE i.sku = r.sku AND r.id = $1 AND r.status = 'active' AND i.tenant_id = $3
+			RETURNING ` + reservationColumns
+		var err error
+		r, err = scanReservation(tx.QueryRowContext(ctx, settle, id, status, tenant.FromContext(ctx)))
+		if errors.Is(err, sql.ErrNoRows) {
+			const existsQuery string = `SELECT EXISTS (SELECT 1 FROM inventory_service.stock_reservations r
+				JOIN inventory_service.items i ON i.sku = r.sku WHERE r.id = $1 AND i.tenant_id = $2)`
+			var exists bool
+			if err := tx.QueryRowContext(ctx, existsQuery, id, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				return ErrInvalidState
+			}
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if stock, err = unreserve(ctx, tx, r); err != nil {
+			return err
+		}
+		if status == ReservationCommitted {
+			m := &Movement{SKU: r.SKU, Delta: -r.Quantity, Unit: r.Unit, UnitQuantity: -r.UnitQuantity,
+				Reason: "reservation_commit", Reference: "reservation:" + strconv.FormatInt(r.ID, 10), Warehouse: r.Warehouse}
+			if stock, err = recordMovement(ctx, tx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, stock, nil
+}
+
+func (s *PostgresStore) ExtendReservation(ctx context.Context, id int64, expiresAt time.Time) (*Reservation, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const extend string = `UPDATE inventory_service.stock_reservations r
+		SET expires_at = CASE WHEN r.expires_at IS NULL THEN NULL ELSE GREATEST(r.expires_at, $2) END
+		FROM inventory_service.items i
+		WHERE i.sku = r.sku AND r.id = $1 AND r.status = 'active' AND i.tenant_id = $3
+		RETURNING ` + reservationColumns
+	r, err := scanReservation(s.db.QueryRowContext(ctx, extend, id, expiresAt, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		const existsQuery string = `SELECT EXISTS (SELECT 1 FROM inventory_service.stock_reservations r
+			JOIN inventory_service.items i ON i.sku = r.sku WHERE r.id = $1 AND i.tenant_id = $2)`
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, existsQuery, id, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, ErrInvalidState
+		}
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// unreserve gives r's quantity back to the item's available stock, at the
+// warehouse it was reserved at.
+func unreserve(ctx context.Context, tx *sql.Tx, r *Reservation) (*Stock, error) {
+	const query string = `UPDATE inventory_service.items SET reserved = reserved - $2, updated_at = NOW()
+		WHERE sku = $1 RETURNING ` + stockColumns
+	stock, err := scanStock(tx.QueryRowContext(ctx, query, r.SKU, r.Quantity))
+	if err != nil {
+		return nil, err
+	}
+	if r.Warehouse != DefaultWarehouse {
+		if _, err := bookStock(ctx, tx, r.SKU, r.Warehouse, 0, -r.Quantity); err != nil {
+			return nil, err
+		}
+	}
+	if err := recordChange(ctx, tx, r.SKU, stock.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+func (s *PostgresStore) ExpireReservations(ctx context.Context, now time.Time, limit int) ([]Reservation, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var expired []Reservation
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const expire string = `UPDATE inventory_service.stock_reservations r SET status = 'expired', settled_at = $1
+			FROM inventory_service.items i
+			WHERE i.sku = r.sku AND r.id IN (
+				SELECT id FROM inventory_service.stock_reservations
+				WHERE status = 'active' AND expires_at <= $1
+				ORDER BY expires_at LIMIT $2 FOR UPDATE SKIP LOCKED)
+			RETURNING ` + reservationColumns
+		rows, err := tx.QueryContext(ctx, expire, now, limit)
+		if err != nil {
+			return err
+		}
+		expired = []Reservation{}
+		for rows.Next() {
+			r, err := scanReservation(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			expired = append(expired, *r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range expired {
+			if _, err := unreserve(ctx, tx, &expired[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// ArchiveReservations moves the rows in one statement, so a reservation is
+// never in both tables or in neither. Active reservations hold stock, so
+// they are never archived.
+func (s *PostgresStore) ArchiveReservations(ctx context.Context, before time.Time, limit int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `WITH moved AS (
+			DELETE FROM inventory_service.stock_reservations WHERE id IN (
+				SELECT id FROM inventory_service.stock_reservations
+				WHERE status <> 'active' AND settled_at < $1
+				ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED)
+			RETURNING *)
+		INSERT INTO inventory_service.stock_reservations_archive SELECT *, NOW() FROM moved`
+	res, err := s.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// reservationWindow limits a report's queries to the tenant's reservations
+// created in [$2, $3), of SKU $4 when it is not empty, archived ones
+// included.
+const reservationWindow = `FROM inventory_service.all_stock_reservations r
+	JOIN inventory_service.items i ON i.sku = r.sku
+	WHERE i.tenant_id = $1 AND r.created_at >= $2 AND r.created_at < $3 AND ($4 = '' OR r.sku = $4)`
+
+const reservationCounts = `COUNT(*), COUNT(*) FILTER (WHERE r.status = 'active'), COUNT(*) FILTER (WHERE r.status = 'committed'),
+	COUNT(*) FILTER (WHERE r.status = 'released'), COUNT(*) FILTER (WHERE r.status = 'expired')`
+
+// heldSeconds is how long a settled reservation was held.
+const heldSeconds = `EXTRACT(EPOCH FROM r.settled_at - r.created_at)::float8`
+
+func (s *PostgresStore) ReservationReport(ctx context.Context, f ReservationFilter) (*ReservationReport, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tenantID := tenant.FromContext(ctx)
+	report := &ReservationReport{From: f.From, To: f.To, SKU: f.SKU, Timing: []OutcomeTiming{}, SKUs: []SKUReservations{}, Holders: []HolderReservations{}}
+
+	const totals string = `SELECT ` + reservationCounts + ` ` + reservationWindow
+	t := &report.Totals
+	if err := s.db.QueryRowContext(ctx, totals, tenantID, f.From, f.To, f.SKU).
+		Scan(&t.Reservations, &t.Active, &t.Committed, &t.Released, &t.Expired); err != nil {
+		return nil, err
+	}
+	t.convert()
+
+	const timing string = `SELECT r.status, COUNT(*),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY ` + heldSeconds + `),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY ` + heldSeconds + `)
+		` + reservationWindow + ` AND r.status <> 'active' AND r.settled_at IS NOT NULL
+		GROUP BY r.status ORDER BY r.status`
+	rows, err := s.db.QueryContext(ctx, timing, tenantID, f.From, f.To, f.SKU)
+	if err != nil {
+		return nil, err
+	}
+	byOutcome := map[string]int{}
+	for rows.Next() {
+		var o OutcomeTiming
+		if err := rows.Scan(&o.Outcome, &o.Count, &o.P50Seconds, &o.P90Seconds); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		o.Buckets = make([]TimingBucket, len(reservationBuckets)+1)
+		for i := range reservationBuckets {
+			o.Buckets[i].UpToSeconds = &reservationBuckets[i]
+		}
+		byOutcome[o.Outcome] = len(report.Timing)
+		report.Timing = append(report.Timing, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// width_bucket puts a reservation held for less than the first bound in
+	// bucket 0 and one held for at least the last in the unbounded bucket.
+	const buckets string = `SELECT r.status, width_bucket(` + heldSeconds + `, $5::float8[]), COUNT(*)
+		` + reservationWindow + ` AND r.status <> 'active' AND r.settled_at IS NOT NULL
+		GROUP BY 1, 2`
+	rows, err = s.db.QueryContext(ctx, buckets, tenantID, f.From, f.To, f.SKU, pq.Array(reservationBuckets))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var outcome string
+		var bucket, count int
+		if err := rows.Scan(&outcome, &bucket, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if i, ok := byOutcome[outcome]; ok && bucket >= 0 && bucket <= len(reservationBuckets) {
+			report.Timing[i].Buckets[bucket].Count = count
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	const skus string = `SELECT r.sku, ` + reservationCounts + ` ` + reservationWindow + `
+		GROUP BY r.sku ORDER BY COUNT(*) DESC, r.sku LIMIT $5`
+	rows, err = s.db.QueryContext(ctx, skus, tenantID, f.From, f.To, f.SKU, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var r SKUReservations
+		if err := rows.Scan(&r.SKU, &r.Reservations, &r.Active, &r.Committed, &r.Released, &r.Expired); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.convert()
+		report.SKUs = append(report.SKUs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	const holders string = `SELECT r.reserved_by, ` + reservationCounts + `,
+			COALESCE(SUM(r.quantity) FILTER (WHERE r.status IN ('released', 'expired')), 0) AS abandoned
+		` + reservationWindow + ` AND r.reserved_by IS NOT NULL
+		GROUP BY r.reserved_by ORDER BY abandoned DESC, COUNT(*) DESC, r.reserved_by LIMIT $5`
+	rows, err = s.db.QueryContext(ctx, holders, tenantID, f.From, f.To, f.SKU, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h HolderReservations
+		if err := rows.Scan(&h.ReservedBy, &h.Reservations, &h.Active, &h.Committed, &h.Released, &h.Expired, &h.AbandonedQuantity); err != nil {
+			return nil, err
+		}
+		h.convert()
+		report.Holders = append(report.Holders, h)
+	}
+	return report, rows.Err()
+}
+
+// recordChange bumps the SKU in the change log for stock changes that do
+// not go through the ledger, such as reservations.
+func recordChange(ctx context.Context, tx *sql.Tx, sku string, at time.Time) error {
+	const query string = `INSERT INTO inventory_service.stock_changes (sku, ledger_id, changed_at)
+		VALUES ($1, 0, $2)
+		ON CONFLICT (sku) DO UPDATE SET changed_at = EXCLUDED.changed_at`
+	_, err := tx.ExecContext(ctx, query, sku, at)
+	return err
+}
+
+func (s *PostgresStore) CreatePurchaseOrder(ctx context.Context, po *PurchaseOrder) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const insert string = `INSERT INTO inventory_service.purchase_orders (supplier) VALUES ($1)
+		RETURNING id, status, created_at`
+	if err := tx.QueryRowContext(ctx, insert, po.Supplier).Scan(&po.ID, &po.Status, &po.CreatedAt); err != nil {
+		return err
+	}
+
+	const insertLine string = `INSERT INTO inventory_service.purchase_order_lines (purchase_order_id, sku, quantity, unit, unit_quantity)
+		VALUES ($1, $2, $3, $4, $5)`
+	for _, l := range po.Lines {
+		if _, err := tx.ExecContext(ctx, insertLine, po.ID, l.SKU, l.Quantity, l.Unit, l.UnitQuantity); err != nil {
+			if isForeignKeyViolation(err) {
+				return ErrNotFound
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetPurchaseOrder(ctx context.Context, id int64) (*PurchaseOrder, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return getPurchaseOrder(ctx, s.db, id, "")
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func getPurchaseOrder(ctx context.Context, q queryer, id int64, lock string) (*PurchaseOrder, error) {
+	query := `SELECT id, supplier, status, created_at, received_at FROM inventory_service.purchase_orders WHERE id = $1 ` + lock
+	var po PurchaseOrder
+	var receivedAt sql.NullTime
+	err := q.QueryRowContext(ctx, query, id).Scan(&po.ID, &po.Supplier, &po.Status, &po.CreatedAt, &receivedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if receivedAt.Valid {
+		po.ReceivedAt = &receivedAt.Time
+	}
+
+	const linesQuery string = `SELECT sku, quantity, unit, unit_quantity FROM inventory_service.purchase_order_lines
+		WHERE purchase_order_id = $1 ORDER BY id`
+	rows, err := q.QueryContext(ctx, linesQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	po.Lines = []PurchaseOrderLine{}
+	for rows.Next() {
+		var l PurchaseOrderLine
+		if err := rows.Scan(&l.SKU, &l.Quantity, &l.Unit, &l.UnitQuantity); err != nil {
+			return nil, err
+		}
+		po.Lines = append(po.Lines, l)
+	}
+	return &po, rows.Err()
+}
+
+func (s *PostgresStore) ReceivePurchaseOrder(ctx context.Context, id int64) (*PurchaseOrder, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	po, err := getPurchaseOrder(ctx, tx, id, "FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+	if po.Status != PurchaseOrderOpen {
+		return nil, ErrInvalidState
+	}
+
+	for _, l := range po.Lines {
+		m := &Movement{
+			SKU:          l.SKU,
+			Delta:        l.Quantity,
+			Unit:         l.Unit,
+			UnitQuantity: l.UnitQuantity,
+			Reason:       "purchase_order",
+			Reference:    fmt.Sprintf("po-%d", po.ID),
+		}
+		if _, err := recordMovement(ctx, tx, m); err != nil {
+			return nil, err
+		}
+	}
+
+	const receive string = `UPDATE inventory_service.purchase_orders SET status = 'received', received_at = NOW()
+		WHERE id = $1 RETURNING status, received_at`
+	var receivedAt time.Time
+	if err := tx.QueryRowContext(ctx, receive, id).Scan(&po.Status, &receivedAt); err != nil {
+		return nil, err
+	}
+	po.ReceivedAt = &receivedAt
+	return po, tx.Commit()
+}
+
+func (s *PostgresStore) ApplyAdjustment(ctx context.Context, a *Adjustment, overrideBy string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const insert string = `INSERT INTO inventory_service.stock_adjustments (tenant_id, actor, source, override)
+		VALUES ($1, NULLIF($2, ''), $3, $4) RETURNING id, created_at`
+	if err := tx.QueryRowContext(ctx, insert, tenant.FromContext(ctx), a.Actor, a.Source, a.Override).Scan(&a.ID, &a.CreatedAt); err != nil {
+		return err
+	}
+	a.LineCount = len(a.Lines)
+
+	// Each line runs in a savepoint, so a line for a missing item rolls back
+	// alone and the rest are still checked and reported on.
+	const insertLine string = `INSERT INTO inventory_service.stock_adjustment_lines
+		(adjustment_id, line, sku, delta, reason, movement_id, on_hand_before, on_hand_after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	rejected := false
+	for i := range a.Lines {
+		l := &a.Lines[i]
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT adjustment_line"); err != nil {
+			return err
+		}
+		m := l.movement(a.ID, overrideBy)
+		stock, err := recordMovement(ctx, tx, m)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInsufficientStock) {
+			l.Err, rejected = err, true
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT adjustment_line"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		l.MovementID, l.Stock = m.ID, stock
+		l.OnHandBefore, l.OnHandAfter = stock.OnHand-l.Delta, stock.OnHand
+		if _, err := tx.ExecContext(ctx, insertLine, a.ID, l.Line, l.SKU, l.Delta, l.Reason, l.MovementID, l.OnHandBefore, l.OnHandAfter); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT adjustment_line"); err != nil {
+			return err
+		}
+	}
+	if rejected {
+		return ErrAdjustmentRejected
+	}
+	if a.DryRun {
+		// Nothing was kept, so there is no adjustment or movement to point at.
+		a.ID = 0
+		for i := range a.Lines {
+			a.Lines[i].MovementID = 0
+		}
+		return nil
+	}
+	return tx.Commit()
+}
+
+const adjustmentColumns = `a.id, COALESCE(a.actor, ''), a.source, a.override, a.created_at,
+	(SELECT COUNT(*) FROM inventory_service.stock_adjustment_lines l WHERE l.adjustment_id = a.id)`
+
+func scanAdjustment(row interface{ Scan(...any) error }) (*Adjustment, error) {
+	var a Adjustment
+	if err := row.Scan(&a.ID, &a.Actor, &a.Source, &a.Override, &a.CreatedAt, &a.LineCount); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *PostgresStore) GetAdjustment(ctx context.Context, id int64) (*Adjustment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + adjustmentColumns + ` FROM inventory_service.stock_adjustments a WHERE a.id = $1 AND a.tenant_id = $2`
+	a, err := scanAdjustment(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	const linesQuery string = `SELECT line, sku, delta, reason, movement_id, on_hand_before, on_hand_after
+		FROM inventory_service.stock_adjustment_lines WHERE adjustment_id = $1 ORDER BY line`
+	rows, err := s.db.QueryContext(ctx, linesQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	a.Lines = []AdjustmentLine{}
+	for rows.Next() {
+		var l AdjustmentLine
+		if err := rows.Scan(&l.Line, &l.SKU, &l.Delta, &l.Reason, &l.MovementID, &l.OnHandBefore, &l.OnHandAfter); err != nil {
+			return nil, err
+		}
+		a.Lines = append(a.Lines, l)
+	}
+	return a, rows.Err()
+}
+
+func (s *PostgresStore) ListAdjustments(ctx context.Context, limit int) ([]Adjustment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + adjustmentColumns + ` FROM inventory_service.stock_adjustments a
+		WHERE a.tenant_id = $2 ORDER BY a.id DESC LIMIT $1`
+	rows, err := s.db.QueryContext(ctx, query, limit, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	adjustments := []Adjustment{}
+	for rows.Next() {
+		a, err := scanAdjustment(rows)
+		if err != nil {
+			return nil, err
+		}
+		adjustments = append(adjustments, *a)
+	}
+	return adjustments, rows.Err()
+}
+
+const thresholdColumns = `t.sku, i.name, t.reorder_point, t.reorder_quantity, COALESCE(t.notify_email, ''),
+	i.on_hand - i.reserved - i.quarantined - i.safety_stock, t.alerted_at, t.updated_at, i.tenant_id`
+
+const thresholdJoin = ` FROM inventory_service.stock_thresholds t
+	JOIN inventory_service.items i ON i.sku = t.sku`
+
+func scanThreshold(row interface{ Scan(...any) error }) (*Threshold, error) {
+	var t Threshold
+	var alertedAt sql.NullTime
+	if err := row.Scan(&t.SKU, &t.Name, &t.ReorderPoint, &t.ReorderQuantity, &t.NotifyEmail,
+		&t.Available, &alertedAt, &t.UpdatedAt, &t.Tenant); err != nil {
+		return nil, err
+	}
+	if alertedAt.Valid {
+		t.AlertedAt = &alertedAt.Time
+	}
+	t.Low = t.Available < t.ReorderPoint
+	return &t, nil
+}
+
+func (s *PostgresStore) queryThresholds(ctx context.Context, query string, args ...any) ([]Threshold, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	thresholds := []Threshold{}
+	for rows.Next() {
+		t, err := scanThreshold(rows)
+		if err != nil {
+			return nil, err
+		}
+		thresholds = append(thresholds, *t)
+	}
+	return thresholds, rows.Err()
+}
+
+func (s *PostgresStore) ListThresholds(ctx context.Context) ([]Threshold, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + thresholdColumns + thresholdJoin + ` ORDER BY t.sku`
+	return s.queryThresholds(ctx, query)
+}
+
+func (s *PostgresStore) GetThreshold(ctx context.Context, sku string) (*Threshold, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + thresholdColumns + thresholdJoin + ` WHERE t.sku = $1`
+	t, err := scanThreshold(s.db.QueryRowContext(ctx, query, sku))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return t, err
+}
+
+func (s *PostgresStore) SetThreshold(ctx context.Context, t *Threshold) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const upsert string = `INSERT INTO inventory_service.stock_thresholds (sku, reorder_point, reorder_quantity, notify_email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (sku) DO UPDATE SET reorder_point = EXCLUDED.reorder_point,
+			reorder_quantity = EXCLUDED.reorder_quantity, notify_email = EXCLUDED.notify_email,
+			alerted_at = NULL, updated_at = NOW()`
+	if _, err := s.db.ExecContext(ctx, upsert, t.SKU, t.ReorderPoint, t.ReorderQuantity, t.NotifyEmail); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	const query string = `SELECT ` + thresholdColumns + thresholdJoin + ` WHERE t.sku = $1`
+	stored, err := scanThreshold(s.db.QueryRowContext(ctx, query, t.SKU))
+	if err != nil {
+		return err
+	}
+	*t = *stored
+	return nil
+}
+
+func (s *PostgresStore) DeleteThreshold(ctx context.Context, sku string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM inventory_service.stock_thresholds WHERE sku = $1`
+	res, err := s.db.ExecContext(ctx, query, sku)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) LowStock(ctx context.Context, limit int) ([]Threshold, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + thresholdColumns + thresholdJoin + `
+		WHERE t.alerted_at IS NULL AND i.on_hand - i.reserved - i.quarantined - i.safety_stock < t.reorder_point
+		ORDER BY t.sku LIMIT $1`
+	return s.queryThresholds(ctx, query, limit)
+}
+
+func (s *PostgresStore) MarkAlerted(ctx context.Context, sku string, at time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE inventory_service.stock_thresholds SET alerted_at = $2 WHERE sku = $1`
+	_, err := s.db.ExecContext(ctx, query, sku, at)
+	return err
+}
+
+func (s *PostgresStore) ClearRecovered(ctx context.Context) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE inventory_service.stock_thresholds t SET alerted_at = NULL
+		FROM inventory_service.items i
+		WHERE i.sku = t.sku AND t.alerted_at IS NOT NULL AND i.on_hand - i.reserved - i.quarantined - i.safety_stock >= t.reorder_point`
+	res, err := s.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *PostgresStore) Reconcile(ctx context.Context) ([]Drift, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Writers update the item row after their ledger or reservation row, so
+	// with item writes blocked, any movement still in flight applies its
+	// delta on top of the corrected totals once the lock is released.
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE inventory_service.items IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return nil, err
+	}
+
+	const query string = `WITH expected AS (
+			SELECT i.sku, i.on_hand AS old_on_hand, i.reserved AS old_reserved, i.quarantined AS old_quarantined,
+				COALESCE((SELECT SUM(l.delta) FROM inventory_service.stock_ledger l WHERE l.sku = i.sku), 0) AS on_hand,
+				COALESCE((SELECT SUM(r.quantity) FROM inventory_service.stock_reservations r
+					WHERE r.sku = i.sku AND r.status = 'active'), 0) AS reserved,
+				COALESCE((SELECT SUM(q.quantity) FROM inventory_service.stock_lots q
+					WHERE q.sku = i.sku AND q.status = 'quarantined'), 0) AS quarantined
+			FROM inventory_service.items i
+		)
+		UPDATE inventory_service.items i SET on_hand = e.on_hand, reserved = e.reserved, quarantined = e.quarantined, updated_at = NOW()
+		FROM expected e
+		WHERE i.sku = e.sku AND (e.old_on_hand <> e.on_hand OR e.old_reserved <> e.reserved OR e.old_quarantined <> e.quarantined)
+		RETURNING i.sku, e.old_on_hand, e.on_hand, e.old_reserved, e.reserved, e.old_quarantined, e.quarantined`
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drift := []Drift{}
+	for rows.Next() {
+		var d Drift
+		if err := rows.Scan(&d.SKU, &d.OnHand, &d.LedgerOnHand, &d.Reserved, &d.ActiveReserved, &d.Quarantined, &d.LotQuarantined); err != nil {
+			return nil, err
+		}
+		drift = append(drift, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return drift, tx.Commit()
+}
+
+const lotColumns = `l.id, l.sku, i.name, l.lot_code, l.expires_on, l.quantity, l.status, l.alerted_at, l.created_at, l.disposed_at`
+
+const lotJoin = ` FROM inventory_service.stock_lots l
+	JOIN inventory_service.items i ON i.sku = l.sku`
+
+func scanLot(row interface{ Scan(...any) error }) (*Lot, error) {
+	var l Lot
+	var expiresOn time.Time
+	var alertedAt, disposedAt sql.NullTime
+	if err := row.Scan(&l.ID, &l.SKU, &l.Name, &l.Code, &expiresOn, &l.Quantity, &l.Status,
+		&alertedAt, &l.CreatedAt, &disposedAt); err != nil {
+		return nil, err
+	}
+	l.ExpiresOn = expiresOn.Format(time.DateOnly)
+	if alertedAt.Valid {
+		l.AlertedAt = &alertedAt.Time
+	}
+	if disposedAt.Valid {
+		l.DisposedAt = &disposedAt.Time
+	}
+	return &l, nil
+}
+
+func queryLots(ctx context.Context, q queryer, query string, args ...any) ([]Lot, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lots := []Lot{}
+	for rows.Next() {
+		l, err := scanLot(rows)
+		if err != nil {
+			return nil, err
+		}
+		lots = append(lots, *l)
+	}
+	return lots, rows.Err()
+}
+
+func (s *PostgresStore) ReceiveLot(ctx context.Context, lot *Lot, m *Movement) (*Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const insert string = `INSERT INTO inventory_service.stock_lots (sku, lot_code, expires_on) VALUES ($1, $2, $3)
+		RETURNING id, status, created_at`
+	if err := tx.QueryRowContext(ctx, insert, lot.SKU, lot.Code, lot.ExpiresOn).Scan(&lot.ID, &lot.Status, &lot.CreatedAt); err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrAlreadyExists
+		}
+		if isForeignKeyViolation(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	m.LotID = lot.ID
+	stock, err := recordMovement(ctx, tx, m)
+	if err != nil {
+		return nil, err
+	}
+	lot.Name, lot.Quantity = stock.Name, m.Delta
+	return stock, tx.Commit()
+}
+
+func (s *PostgresStore) ListLots(ctx context.Context, sku string) ([]Lot, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + lotColumns + lotJoin + `
+		WHERE l.sku = $1 AND i.tenant_id = $2 AND l.status = 'active' AND l.quantity > 0
+		ORDER BY l.expires_on, l.id`
+	return queryLots(ctx, s.db, query, sku, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) ExpiryReport(ctx context.Context, through time.Time) ([]Lot, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + lotColumns + lotJoin + `
+		WHERE i.tenant_id = $2 AND l.status IN ('active', 'quarantined') AND l.quantity > 0 AND l.expires_on <= $1
+		ORDER BY l.expires_on, l.sku, l.id`
+	return queryLots(ctx, s.db, query, through.Format(time.DateOnly), tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) DisposeLot(ctx context.Context, id int64, m *Movement) (*Lot, *Stock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	const query string = `SELECT ` + lotColumns + lotJoin + ` WHERE l.id = $1 AND i.tenant_id = $2 FOR UPDATE OF l`
+	lot, err := scanLot(tx.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch lot.Status {
+	case LotDisposed:
+		return nil, nil, ErrInvalidState
+	case LotQuarantined:
+		// Lift the quarantine first, so the write-off below books the stock
+		// out of an active lot and the item's quarantined total drops with it.
+		const release string = `UPDATE inventory_service.items SET quarantined = quarantined - $2 WHERE sku = $1`
+		if _, err := tx.ExecContext(ctx, release, lot.SKU, lot.Quantity); err != nil {
+			return nil, nil, err
+		}
+		const activate string = `UPDATE inventory_service.stock_lots SET status = 'active' WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, activate, lot.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	m.SKU, m.Delta, m.UnitQuantity, m.LotID = lot.SKU, -lot.Quantity, lot.Quantity, lot.ID
+	m.Reference = "lot-" + lot.Code
+	stock, err := recordMovement(ctx, tx, m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	const dispose string = `UPDATE inventory_service.stock_lots SET status = 'disposed', disposed_at = $2
+		WHERE id = $1 RETURNING status, quantity`
+	if err := tx.QueryRowContext(ctx, dispose, lot.ID, m.CreatedAt).Scan(&lot.Status, &lot.Quantity); err != nil {
+		return nil, nil, err
+	}
+	lot.DisposedAt = &m.CreatedAt
+	return lot, stock, tx.Commit()
+}
+
+func (s *PostgresStore) ExpiringLots(ctx context.Context, through time.Time, limit int) ([]Lot, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + lotColumns + lotJoin + `
+		WHERE l.status = 'active' AND l.alerted_at IS NULL AND l.quantity > 0 AND l.expires_on <= $1
+		ORDER BY l.expires_on, l.id LIMIT $2`
+	return queryLots(ctx, s.db, query, through.Format(time.DateOnly), limit)
+}
+
+func (s *PostgresStore) MarkLotAlerted(ctx context.Context, id int64, at time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE inventory_service.stock_lots SET alerted_at = $2 WHERE id = $1`
+	_, err := s.db.ExecContext(ctx, query, id, at)
+	return err
+}
+
+func (s *PostgresStore) QuarantineExpired(ctx context.Context, today time.Time) ([]Lot, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const expire string = `UPDATE inventory_service.stock_lots l SET status = 'quarantined'
+		FROM inventory_service.items i
+		WHERE i.sku = l.sku AND l.status = 'active' AND l.expires_on < $1
+		RETURNING ` + lotColumns
+	lots, err := queryLots(ctx, tx, expire, today.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+
+	const hold string = `UPDATE inventory_service.items SET quarantined = quarantined + $2, updated_at = NOW()
+		WHERE sku = $1 RETURNING updated_at`
+	for _, l := range lots {
+		if l.Quantity == 0 {
+			continue
+		}
+		var updatedAt time.Time
+		if err := tx.QueryRowContext(ctx, hold, l.SKU, l.Quantity).Scan(&updatedAt); err != nil {
+			return nil, err
+		}
+		if err := recordChange(ctx, tx, l.SKU, updatedAt); err != nil {
+			return nil, err
+		}
+	}
+	return lots, tx.Commit()
+}
+
+const safetyPolicyColumns = `p.sku, i.name, p.service_level, p.lead_time_days, i.safety_stock,
+	p.demand_mean, p.demand_stddev, p.demand_days, p.calculated_at, p.updated_at, i.tenant_id`
+
+const safetyPolicyJoin = ` FROM inventory_service.safety_stock_policies p
+	JOIN inventory_service.items i ON i.sku = p.sku`
+
+func scanSafetyPolicy(row interface{ Scan(...any) error }) (*SafetyPolicy, error) {
+	var p SafetyPolicy
+	var calculatedAt sql.NullTime
+	if err := row.Scan(&p.SKU, &p.Name, &p.ServiceLevel, &p.LeadTimeDays, &p.SafetyStock,
+		&p.DemandMean, &p.DemandStdDev, &p.DemandDays, &calculatedAt, &p.UpdatedAt, &p.Tenant); err != nil {
+		return nil, err
+	}
+	if calculatedAt.Valid {
+		p.CalculatedAt = &calculatedAt.Time
+	}
+	return &p, nil
+}
+
+func (s *PostgresStore) GetSafetyPolicy(ctx context.Context, sku string) (*SafetyPolicy, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + safetyPolicyColumns + safetyPolicyJoin + ` WHERE p.sku = $1 AND i.tenant_id = $2`
+	p, err := scanSafetyPolicy(s.db.QueryRowContext(ctx, query, sku, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *PostgresStore) SetSafetyPolicy(ctx context.Context, p *SafetyPolicy) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const upsert string = `INSERT INTO inventory_service.safety_stock_policies (sku, service_level, lead_time_days)
+		SELECT sku, $2, $3 FROM inventory_service.items WHERE sku = $1 AND tenant_id = $4
+		ON CONFLICT (sku) DO UPDATE SET service_level = EXCLUDED.service_level,
+			lead_time_days = EXCLUDED.lead_time_days, updated_at = NOW()`
+	res, err := s.db.ExecContext(ctx, upsert, p.SKU, p.ServiceLevel, p.LeadTimeDays, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	const query string = `SELECT ` + safetyPolicyColumns + safetyPolicyJoin + ` WHERE p.sku = $1`
+	stored, err := scanSafetyPolicy(s.db.QueryRowContext(ctx, query, p.SKU))
+	if err != nil {
+		return err
+	}
+	*p = *stored
+	return nil
+}
+
+func (s *PostgresStore) DeleteSafetyPolicy(ctx context.Context, sku string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const remove string = `DELETE FROM inventory_service.safety_stock_policies p
+		USING inventory_service.items i
+		WHERE i.sku = p.sku AND p.sku = $1 AND i.tenant_id = $2`
+	res, err := tx.ExecContext(ctx, remove, sku, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	const release string = `UPDATE inventory_service.items SET safety_stock = 0, updated_at = NOW()
+		WHERE sku = $1 AND safety_stock <> 0 RETURNING updated_at`
+	var updatedAt time.Time
+	err = tx.QueryRowContext(ctx, release, sku).Scan(&updatedAt)
+	if err == nil {
+		err = recordChange(ctx, tx, sku, updatedAt)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) SafetyPolicies(ctx context.Context) ([]SafetyPolicy, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + safetyPolicyColumns + safetyPolicyJoin + ` ORDER BY p.sku`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []SafetyPolicy{}
+	for rows.Next() {
+		p, err := scanSafetyPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, *p)
+	}
+	return policies, rows.Err()
+}
+
+func (s *PostgresStore) DailyDemand(ctx context.Context, sku string, from, to time.Time) ([]int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// GREATEST ignores NULL, so a SKU with no ledger yet gets the whole
+	// window of zero demand.
+	const query string = `WITH days AS (
+			SELECT generate_series(
+				GREATEST($2::date, (SELECT MIN(created_at AT TIME ZONE 'UTC')::date
+					FROM inventory_service.stock_ledger WHERE sku = $1)),
+				$3::date - 1, INTERVAL '1 day')::date AS day
+		)
+		SELECT COALESCE(SUM(-l.delta), 0) FROM days d
+		LEFT JOIN inventory_service.stock_ledger l ON l.sku = $1 AND l.delta < 0
+			AND l.reason <> 'disposal' AND (l.created_at AT TIME ZONE 'UTC')::date = d.day
+		GROUP BY d.day ORDER BY d.day`
+	rows, err := s.db.QueryContext(ctx, query, sku, from.UTC().Format(time.DateOnly), to.UTC().Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	demand := []int{}
+	for rows.Next() {
+		var units int
+		if err := rows.Scan(&units); err != nil {
+			return nil, err
+		}
+		demand = append(demand, units)
+	}
+	return demand, rows.Err()
+}
+
+func (s *PostgresStore) SaveSafetyStock(ctx context.Context, p *SafetyPolicy) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	const save string = `UPDATE inventory_service.safety_stock_policies
+		SET demand_mean = $2, demand_stddev = $3, demand_days = $4, calculated_at = $5
+		WHERE sku = $1`
+	if _, err := tx.ExecContext(ctx, save, p.SKU, p.DemandMean, p.DemandStdDev, p.DemandDays, p.CalculatedAt); err != nil {
+		return false, err
+	}
+
+	const apply string = `UPDATE inventory_service.items SET safety_stock = $2, updated_at = NOW()
+		WHERE sku = $1 AND safety_stock <> $2 RETURNING updated_at`
+	var updatedAt time.Time
+	err = tx.QueryRowContext(ctx, apply, p.SKU, p.SafetyStock).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, tx.Commit()
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := recordChange(ctx, tx, p.SKU, updatedAt); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,110 @@
+package inventory
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Threshold is a SKU's reorder rule. ReorderPoint and ReorderQuantity are in
+// base units; the SKU is low while its available stock is below the
+// reorder point. AlertedAt is set while a low-stock alert is outstanding.
+type Threshold struct {
+	SKU             string     `json:"sku"`
+	Name            string     `json:"name"`
+	ReorderPoint    int        `json:"reorder_point"`
+	ReorderQuantity int        `json:"reorder_quantity"`
+	NotifyEmail     string     `json:"notify_email,omitempty"`
+	Available       int        `json:"available"`
+	Low             bool       `json:"low"`
+	AlertedAt       *time.Time `json:"alerted_at,omitempty"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	// Tenant owns the SKU, for alerts swept across tenants.
+	Tenant string `json:"-"`
+}
+
+// listThresholds returns every rule, or with ?low=true only the SKUs that
+// are currently below their reorder point.
+func (h *Handler) listThresholds(c *gin.Context) {
+	thresholds, err := h.store.ListThresholds(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("low") == "true" {
+		low := []Threshold{}
+		for _, t := range thresholds {
+			if t.Low {
+				low = append(low, t)
+			}
+		}
+		thresholds = low
+	}
+	c.JSON(http.StatusOK, gin.H{"thresholds": thresholds})
+}
+
+func (h *Handler) getThreshold(c *gin.Context) {
+	t, err := h.store.GetThreshold(c.Request.Context(), c.Param("sku"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "threshold not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// setThreshold accepts quantities in any of the SKU's units.
+func (h *Handler) setThreshold(c *gin.Context) {
+	var req struct {
+		ReorderPoint    int    `json:"reorder_point" binding:"required,min=1"`
+		ReorderQuantity int    `json:"reorder_quantity" binding:"min=0"`
+		Unit            string `json:"unit"`
+		NotifyEmail     string `json:"notify_email" binding:"omitempty,email,max=255"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sku := c.Param("sku")
+	_, factor, ok := h.toBase(c, sku, req.Unit, 1)
+	if !ok {
+		return
+	}
+
+	t := &Threshold{
+		SKU:             sku,
+		ReorderPoint:    req.ReorderPoint * factor,
+		ReorderQuantity: req.ReorderQuantity * factor,
+		NotifyEmail:     req.NotifyEmail,
+	}
+	err := h.store.SetThreshold(c.Request.Context(), t)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.stockChanged(c.Request.Context(), true)
+	c.JSON(http.StatusOK, t)
+}
+
+func (h *Handler) deleteThreshold(c *gin.Context) {
+	err := h.store.DeleteThreshold(c.Request.Context(), c.Param("sku"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "threshold not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package inventory
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// BaseUnit is the unit stock is kept in. Every SKU has it with factor 1;
+// other units such as case or pallet are defined per SKU as a number of
+// base units.
+const BaseUnit = "each"
+
+type Unit struct {
+	Name   string `json:"unit"`
+	Factor int    `json:"factor"`
+}
+
+// UnitStock is stock expressed in whole units of a larger unit; partial
+// units are left out, so the figures never overstate what can be shipped.
+type UnitStock = models.UnitStock
+
+func inUnit(s *Stock, u Unit) UnitStock {
+	return UnitStock{
+		Unit:      u.Name,
+		Factor:    u.Factor,
+		OnHand:    s.OnHand / u.Factor,
+		Reserved:  s.Reserved / u.Factor,
+		Available: s.Available / u.Factor,
+	}
+}
+
+// toBase converts quantity in unit to base units, writing a 400 when the
+// SKU has no such unit. An empty unit means the base unit.
+func (h *Handler) toBase(c *gin.Context, sku, unit string, quantity int) (string, int, bool) {
+	if unit == "" {
+		unit = BaseUnit
+	}
+	factor, err := h.store.UnitFactor(c.Request.Context(), sku, unit)
+	if errors.Is(err, ErrUnknownUnit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown unit " + unit + " for " + sku})
+		return "", 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", 0, false
+	}
+	return unit, quantity * factor, true
+}
+
+func (h *Handler) listUnits(c *gin.Context) {
+	units, err := h.store.ListUnits(c.Request.Context(), c.Param("sku"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"units": units})
+}
+
+func (h *Handler) setUnit(c *gin.Context) {
+	var req struct {
+		Factor int `json:"factor" binding:"required,min=2"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	unit := Unit{Name: c.Param("unit"), Factor: req.Factor}
+	if unit.Name == BaseUnit || len(unit.Name) > 32 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unit must be at most 32 characters and not " + BaseUnit})
+		return
+	}
+
+	err := h.store.SetUnit(c.Request.Context(), c.Param("sku"), unit)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, unit)
+}
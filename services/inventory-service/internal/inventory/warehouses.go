@@ -0,0 +1,532 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultWarehouse holds whatever stock of an item is not booked to another
+// warehouse: all of it until some is, and everything movements naming no
+// warehouse bring in, lots included. Its stock is what is left of the
+// item's totals, so it needs no registering. It matches costing's default.
+const DefaultWarehouse = "MAIN"
+
+// Allocation strategies: the warehouse with the most available stock, or
+// the one nearest to where the reservation ships.
+const (
+	AllocateMostStocked = "most_stocked"
+	AllocateNearest     = "nearest"
+)
+
+// ErrUnknownWarehouse is returned for a warehouse code the tenant has not
+// registered.
+var ErrUnknownWarehouse = errors.New("unknown warehouse")
+
+// Warehouse is a fulfillment center stock can be booked to. Its location
+// lets reservations be filled from the nearest one.
+type Warehouse struct {
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Latitude  *float64  `json:"latitude,omitempty"`
+	Longitude *float64  `json:"longitude,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WarehouseStock is a SKU's stock at one warehouse. Quarantined stock is
+// held in DefaultWarehouse, where lots are kept, and taken off its
+// Available; safety stock only comes off the item's total.
+type WarehouseStock struct {
+	Warehouse string `json:"warehouse"`
+	SKU       string `json:"sku"`
+	OnHand    int    `json:"on_hand"`
+	Reserved  int    `json:"reserved"`
+	Available int    `json:"available"`
+
+	latitude, longitude sql.NullFloat64
+}
+
+// Allocation picks the warehouse a reservation is filled from. Latitude
+// and Longitude are where it ships to, for AllocateNearest.
+type Allocation struct {
+	Strategy  string
+	Latitude  float64
+	Longitude float64
+}
+
+// allocate picks the warehouse among stock to fill a reservation of
+// quantity from, and reports false when no single warehouse has that much
+// available. A reservation is never split across warehouses.
+func allocate(stock []WarehouseStock, quantity int, a Allocation) (string, bool) {
+	best := -1
+	for i, s := range stock {
+		if s.Available >= quantity && (best < 0 || a.prefers(s, stock[best])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return stock[best].Warehouse, true
+}
+
+// prefers reports whether a would rather fill from x than y. Nearest puts
+// warehouses without a location last; ties go to the most stocked.
+func (a Allocation) prefers(x, y WarehouseStock) bool {
+	if a.Strategy == AllocateNearest {
+		dx, xOK := a.distanceKM(x)
+		dy, yOK := a.distanceKM(y)
+		if xOK != yOK {
+			return xOK
+		}
+		if xOK && dx != dy {
+			return dx < dy
+		}
+	}
+	return x.Available > y.Available
+}
+
+func (a Allocation) distanceKM(s WarehouseStock) (float64, bool) {
+	if !s.latitude.Valid || !s.longitude.Valid {
+		return 0, false
+	}
+	const earthRadiusKM = 6371
+	lat1, lat2 := a.Latitude*math.Pi/180, s.latitude.Float64*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (s.longitude.Float64 - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKM * math.Asin(math.Min(1, math.Sqrt(h))), true
+}
+
+// normalizeWarehouse makes codes match regardless of case and spacing, an
+// empty code meaning DefaultWarehouse.
+func normalizeWarehouse(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return DefaultWarehouse
+	}
+	return code
+}
+
+// Transfer moves Quantity base units of a SKU's stock between warehouses.
+// The item's totals do not change, so it is not a ledger movement.
+type Transfer struct {
+	ID            int64     `json:"id"`
+	SKU           string    `json:"sku"`
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	Quantity      int       `json:"quantity"`
+	Unit          string    `json:"unit"`
+	UnitQuantity  int       `json:"unit_quantity"`
+	Reference     string    `json:"reference,omitempty"`
+	TransferredBy string    `json:"transferred_by,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (h *Handler) createWarehouse(c *gin.Context) {
+	var req struct {
+		Code      string   `json:"code" binding:"required,max=32"`
+		Name      string   `json:"name" binding:"required,max=255"`
+		Latitude  *float64 `json:"latitude" binding:"omitempty,min=-90,max=90"`
+		Longitude *float64 `json:"longitude" binding:"omitempty,min=-180,max=180"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Latitude == nil) != (req.Longitude == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "latitude and longitude must be given together"})
+		return
+	}
+
+	w := &Warehouse{Code: normalizeWarehouse(req.Code), Name: req.Name, Latitude: req.Latitude, Longitude: req.Longitude}
+	err := h.store.CreateWarehouse(c.Request.Context(), w)
+	if errors.Is(err, ErrAlreadyExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "warehouse already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, w)
+}
+
+func (h *Handler) listWarehouses(c *gin.Context) {
+	warehouses, err := h.store.ListWarehouses(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"warehouses": warehouses})
+}
+
+// stockByWarehouse shows where a SKU's stock is, alongside its totals.
+func (h *Handler) stockByWarehouse(c *gin.Context) {
+	sku := c.Param("sku")
+	stock, err := h.store.Get(c.Request.Context(), sku)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	warehouses, err := h.store.StockByWarehouse(c.Request.Context(), sku)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stock": stock, "warehouses": warehouses})
+}
+
+// warehouseStock lists a page of the SKUs held at one warehouse.
+func (h *Handler) warehouseStock(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	code := normalizeWarehouse(c.Param("code"))
+	stock, err := h.store.WarehouseInventory(c.Request.Context(), code, limit, offset)
+	if errors.Is(err, ErrUnknownWarehouse) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "warehouse not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"warehouse": code, "items": stock})
+}
+
+func (h *Handler) transfer(c *gin.Context) {
+	var req struct {
+		SKU       string `json:"sku" binding:"required"`
+		From      string `json:"from" binding:"max=32"`
+		To        string `json:"to" binding:"max=32"`
+		Quantity  int    `json:"quantity" binding:"required,min=1"`
+		Unit      string `json:"unit"`
+		Reference string `json:"reference"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t := &Transfer{SKU: req.SKU, From: normalizeWarehouse(req.From), To: normalizeWarehouse(req.To), UnitQuantity: req.Quantity, Reference: req.Reference}
+	if t.From == t.To {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be different warehouses"})
+		return
+	}
+	var ok bool
+	if t.Unit, t.Quantity, ok = h.toBase(c, req.SKU, req.Unit, req.Quantity); !ok {
+		return
+	}
+	if p, ok := auth.FromContext(c); ok {
+		t.TransferredBy = actor(p)
+	}
+
+	warehouses, err := h.store.Transfer(c.Request.Context(), t)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+	case errors.Is(err, ErrUnknownWarehouse):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInsufficientStock):
+		c.JSON(http.StatusConflict, gin.H{"error": "not enough available stock at " + t.From, "code": codeInsufficientStock,
+			"sku": t.SKU, "requested": t.Quantity})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusCreated, gin.H{"transfer": t, "warehouses": warehouses})
+	}
+}
+
+func (h *Handler) listTransfers(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	transfers, err := h.store.ListTransfers(c.Request.Context(), c.Query("sku"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"transfers": transfers})
+}
+
+func (s *PostgresStore) CreateWarehouse(ctx context.Context, w *Warehouse) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO inventory_service.warehouses (tenant_id, code, name, latitude, longitude)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (tenant_id, code) DO NOTHING RETURNING created_at`
+	err := s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), w.Code, w.Name, w.Latitude, w.Longitude).Scan(&w.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *PostgresStore) ListWarehouses(ctx context.Context) ([]Warehouse, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT code, name, latitude, longitude, created_at FROM inventory_service.warehouses
+		WHERE tenant_id = $1 ORDER BY code`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warehouses := []Warehouse{}
+	for rows.Next() {
+		var w Warehouse
+		var lat, lon sql.NullFloat64
+		if err := rows.Scan(&w.Code, &w.Name, &lat, &lon, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		if lat.Valid && lon.Valid {
+			w.Latitude, w.Longitude = &lat.Float64, &lon.Float64
+		}
+		warehouses = append(warehouses, w)
+	}
+	return warehouses, rows.Err()
+}
+
+func (s *PostgresStore) StockByWarehouse(ctx context.Context, sku string) ([]WarehouseStock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	return stockByWarehouse(ctx, database.Reader(ctx, s.db), sku)
+}
+
+// stockByWarehouse returns the SKU's stock at DefaultWarehouse, first, and
+// at every other warehouse that has held any, with their locations.
+func stockByWarehouse(ctx context.Context, q queryer, sku string) ([]WarehouseStock, error) {
+	const query string = `SELECT s.warehouse, s.on_hand, s.reserved, s.available, w.latitude, w.longitude FROM (
+			SELECT $3 AS warehouse, i.on_hand - COALESCE(SUM(ws.on_hand), 0) AS on_hand,
+				i.reserved - COALESCE(SUM(ws.reserved), 0) AS reserved,
+				i.on_hand - i.reserved - i.quarantined - COALESCE(SUM(ws.on_hand - ws.reserved), 0) AS available
+			FROM inventory_service.items i LEFT JOIN inventory_service.warehouse_stock ws ON ws.sku = i.sku
+			WHERE i.sku = $1 AND i.tenant_id = $2
+			GROUP BY i.sku, i.on_hand, i.reserved, i.quarantined
+			UNION ALL
+			SELECT ws.warehouse, ws.on_hand, ws.reserved, ws.on_hand - ws.reserved
+			FROM inventory_service.warehouse_stock ws JOIN inventory_service.items i ON i.sku = ws.sku
+			WHERE ws.sku = $1 AND i.tenant_id = $2
+		) s LEFT JOIN inventory_service.warehouses w ON w.tenant_id = $2 AND w.code = s.warehouse
+		ORDER BY s.warehouse <> $3, s.warehouse`
+	rows, err := q.QueryContext(ctx, query, sku, tenant.FromContext(ctx), DefaultWarehouse)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stock := []WarehouseStock{}
+	for rows.Next() {
+		ws := WarehouseStock{SKU: sku}
+		if err := rows.Scan(&ws.Warehouse, &ws.OnHand, &ws.Reserved, &ws.Available, &ws.latitude, &ws.longitude); err != nil {
+			return nil, err
+		}
+		stock = append(stock, ws)
+	}
+	return stock, rows.Err()
+}
+
+// registered returns ErrUnknownWarehouse unless code is DefaultWarehouse or
+// one of the tenant's warehouses.
+func registered(ctx context.Context, q queryer, code string) error {
+	if code == DefaultWarehouse {
+		return nil
+	}
+	const query string = `SELECT EXISTS (SELECT 1 FROM inventory_service.warehouses WHERE tenant_id = $1 AND code = $2)`
+	var exists bool
+	if err := q.QueryRowContext(ctx, query, tenant.FromContext(ctx), code).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUnknownWarehouse
+	}
+	return nil
+}
+
+func (s *PostgresStore) WarehouseInventory(ctx context.Context, code string, limit, offset int) ([]WarehouseStock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	db := database.Reader(ctx, s.db)
+	if err := registered(ctx, db, code); err != nil {
+		return nil, err
+	}
+	query := `SELECT ws.warehouse, ws.sku, ws.on_hand, ws.reserved, ws.on_hand - ws.reserved
+		FROM inventory_service.warehouse_stock ws JOIN inventory_service.items i ON i.sku = ws.sku
+		WHERE i.tenant_id = $1 AND ws.warehouse = $2 AND (ws.on_hand <> 0 OR ws.reserved <> 0)
+		ORDER BY ws.sku LIMIT $3 OFFSET $4`
+	if code == DefaultWarehouse {
+		query = `SELECT $2, i.sku, i.on_hand - COALESCE(SUM(ws.on_hand), 0), i.reserved - COALESCE(SUM(ws.reserved), 0),
+				i.on_hand - i.reserved - i.quarantined - COALESCE(SUM(ws.on_hand - ws.reserved), 0)
+			FROM inventory_service.items i LEFT JOIN inventory_service.warehouse_stock ws ON ws.sku = i.sku
+			WHERE i.tenant_id = $1 AND NOT EXISTS (SELECT 1 FROM inventory_service.item_merges m WHERE m.sku = i.sku)
+			GROUP BY i.sku, i.on_hand, i.reserved, i.quarantined
+			ORDER BY i.sku LIMIT $3 OFFSET $4`
+	}
+	rows, err := db.QueryContext(ctx, query, tenant.FromContext(ctx), code, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stock := []WarehouseStock{}
+	for rows.Next() {
+		var ws WarehouseStock
+		if err := rows.Scan(&ws.Warehouse, &ws.SKU, &ws.OnHand, &ws.Reserved, &ws.Available); err != nil {
+			return nil, err
+		}
+		stock = append(stock, ws)
+	}
+	return stock, rows.Err()
+}
+
+// Transfer locks the item first, like every other change to its stock, so
+// the source's available stock cannot change while it is checked.
+func (s *PostgresStore) Transfer(ctx context.Context, t *Transfer) ([]WarehouseStock, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var stock []WarehouseStock
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		if err := lockItem(ctx, tx, t.SKU); err != nil {
+			return err
+		}
+		for _, code := range []string{t.From, t.To} {
+			if err := registered(ctx, tx, code); err != nil {
+				return err
+			}
+		}
+		before, err := stockByWarehouse(ctx, tx, t.SKU)
+		if err != nil {
+			return err
+		}
+		available := 0
+		for _, ws := range before {
+			if ws.Warehouse == t.From {
+				available = ws.Available
+			}
+		}
+		if available < t.Quantity {
+			return ErrInsufficientStock
+		}
+
+		for code, delta := range map[string]int{t.From: -t.Quantity, t.To: t.Quantity} {
+			if code == DefaultWarehouse {
+				continue
+			}
+			if _, err := bookStock(ctx, tx, t.SKU, code, delta, 0); err != nil {
+				return err
+			}
+		}
+		const insert string = `INSERT INTO inventory_service.stock_transfers
+			(sku, from_warehouse, to_warehouse, quantity, unit, unit_quantity, reference, transferred_by)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, '')) RETURNING id, created_at`
+		if err := tx.QueryRowContext(ctx, insert, t.SKU, t.From, t.To, t.Quantity, t.Unit, t.UnitQuantity, t.Reference, t.TransferredBy).
+			Scan(&t.ID, &t.CreatedAt); err != nil {
+			return err
+		}
+		stock, err = stockByWarehouse(ctx, tx, t.SKU)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+func (s *PostgresStore) ListTransfers(ctx context.Context, sku string, limit int) ([]Transfer, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT t.id, t.sku, t.from_warehouse, t.to_warehouse, t.quantity, t.unit, t.unit_quantity,
+			COALESCE(t.reference, ''), COALESCE(t.transferred_by, ''), t.created_at
+		FROM inventory_service.stock_transfers t JOIN inventory_service.items i ON i.sku = t.sku
+		WHERE i.tenant_id = $1 AND ($2 = '' OR t.sku = $2)
+		ORDER BY t.id DESC LIMIT $3`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), sku, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		var t Transfer
+		if err := rows.Scan(&t.ID, &t.SKU, &t.From, &t.To, &t.Quantity, &t.Unit, &t.UnitQuantity,
+			&t.Reference, &t.TransferredBy, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+func lockItem(ctx context.Context, tx *sql.Tx, sku string) error {
+	const query string = `SELECT sku FROM inventory_service.items WHERE sku = $1 AND tenant_id = $2 FOR UPDATE`
+	err := tx.QueryRowContext(ctx, query, sku, tenant.FromContext(ctx)).Scan(&sku)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// bookStock adds onHand and reserved to the SKU's stock at warehouse and
+// returns its available stock after. It is never called for
+// DefaultWarehouse, whose stock follows from the item's totals.
+func bookStock(ctx context.Context, tx *sql.Tx, sku, warehouse string, onHand, reserved int) (int, error) {
+	const query string = `INSERT INTO inventory_service.warehouse_stock (sku, warehouse, on_hand, reserved)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (sku, warehouse) DO UPDATE SET on_hand = warehouse_stock.on_hand + EXCLUDED.on_hand,
+			reserved = warehouse_stock.reserved + EXCLUDED.reserved, updated_at = NOW()
+		RETURNING on_hand - reserved`
+	var available int
+	err := tx.QueryRowContext(ctx, query, sku, warehouse, onHand, reserved).Scan(&available)
+	return available, err
+}
+
+// defaultAvailable returns the SKU's available stock at DefaultWarehouse.
+func defaultAvailable(ctx context.Context, tx *sql.Tx, sku string) (int, error) {
+	const query string = `SELECT i.on_hand - i.reserved - i.quarantined - COALESCE(SUM(ws.on_hand - ws.reserved), 0)
+		FROM inventory_service.items i LEFT JOIN inventory_service.warehouse_stock ws ON ws.sku = i.sku
+		WHERE i.sku = $1 GROUP BY i.sku, i.on_hand, i.reserved, i.quarantined`
+	var available int
+	err := tx.QueryRowContext(ctx, query, sku).Scan(&available)
+	return available, err
+}
+
+// mergeWarehouseStock adds the merged SKU's stock at each warehouse to the
+// survivor's, as part of MergeItem.
+func mergeWarehouseStock(ctx context.Context, tx *sql.Tx, sku, survivor string) error {
+	const move string = `INSERT INTO inventory_service.warehouse_stock (sku, warehouse, on_hand, reserved)
+		SELECT $2, warehouse, on_hand, reserved FROM inventory_service.warehouse_stock WHERE sku = $1
+		ON CONFLICT (sku, warehouse) DO UPDATE SET on_hand = warehouse_stock.on_hand + EXCLUDED.on_hand,
+			reserved = warehouse_stock.reserved + EXCLUDED.reserved, updated_at = NOW()`
+	if _, err := tx.ExecContext(ctx, move, sku, survivor); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM inventory_service.warehouse_stock WHERE sku = $1", sku)
+	return err
+}
@@ -0,0 +1,103 @@
+package locations
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// MaxLookup bounds the SKUs in one GET /items/locations.
+const MaxLookup = 100
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Anyone signed in can read locations; only admins record them.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/items/locations", h.lookup)
+	router.GET("/items/:sku/location", h.get)
+	router.PUT("/items/:sku/location", auth.RequireRole(auth.RoleAdmin), h.put)
+}
+
+// lookup returns the location of each ?sku=, in zone and bin order, and
+// lists those without one, so a pick list takes one call.
+func (h *Handler) lookup(c *gin.Context) {
+	skus := []string{}
+	seen := map[string]bool{}
+	for _, sku := range c.QueryArray("sku") {
+		if sku = strings.TrimSpace(sku); sku != "" && !seen[sku] {
+			seen[sku] = true
+			skus = append(skus, sku)
+		}
+	}
+	if len(skus) == 0 || len(skus) > MaxLookup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("give 1 to %d sku parameters", MaxLookup)})
+		return
+	}
+
+	found, err := h.store.Get(c.Request.Context(), skus)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, l := range found {
+		delete(seen, l.SKU)
+	}
+	missing := []string{}
+	for _, sku := range skus {
+		if seen[sku] {
+			missing = append(missing, sku)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"locations": found, "missing": missing})
+}
+
+func (h *Handler) get(c *gin.Context) {
+	found, err := h.store.Get(c.Request.Context(), []string{c.Param("sku")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(found) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no location recorded for this item"})
+		return
+	}
+	c.JSON(http.StatusOK, found[0])
+}
+
+func (h *Handler) put(c *gin.Context) {
+	var req struct {
+		Zone string `json:"zone"`
+		Bin  string `json:"bin"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	l := Location{SKU: c.Param("sku"), Zone: req.Zone, Bin: req.Bin}
+	if err := l.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.store.Put(c.Request.Context(), &l)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
@@ -0,0 +1,75 @@
+package locations
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore knows the items SKU-001 to SKU-003.
+type memStore struct {
+	recorded map[string]Location
+}
+
+func (s *memStore) Get(ctx context.Context, skus []string) ([]Location, error) {
+	found := []Location{}
+	for _, sku := range skus {
+		if l, ok := s.recorded[sku]; ok {
+			found = append(found, l)
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) Put(ctx context.Context, l *Location) error {
+	if l.SKU != "SKU-001" && l.SKU != "SKU-002" && l.SKU != "SKU-003" {
+		return ErrNotFound
+	}
+	s.recorded[l.SKU] = *l
+	return nil
+}
+
+func TestLocations(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{recorded: map[string]Location{}}
+	admin := &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}}
+	customer := &auth.Principal{UserID: 2, Roles: []string{auth.RoleCustomer}}
+
+	tests := []struct {
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		want      int
+		contains  string
+	}{
+		{principal: admin, method: http.MethodPut, path: "/items/SKU-001/location", body: `{"zone": " a ", "bin": "a-03-2"}`,
+			want: http.StatusOK, contains: `"sku":"SKU-001","zone":"A","bin":"A-03-2"`},
+		{principal: admin, method: http.MethodPut, path: "/items/SKU-002/location", body: `{"zone": "A", "bin": ""}`, want: http.StatusBadRequest},
+		{principal: admin, method: http.MethodPut, path: "/items/SKU-404/location", body: `{"zone": "A", "bin": "1"}`, want: http.StatusNotFound},
+		{principal: customer, method: http.MethodPut, path: "/items/SKU-001/location", body: `{"zone": "B", "bin": "1"}`, want: http.StatusForbidden},
+
+		{principal: customer, method: http.MethodGet, path: "/items/SKU-001/location", want: http.StatusOK, contains: `"bin":"A-03-2"`},
+		{principal: customer, method: http.MethodGet, path: "/items/SKU-002/location", want: http.StatusNotFound},
+		{principal: customer, method: http.MethodGet, path: "/items/locations?sku=SKU-001&sku=SKU-002&sku=SKU-001", want: http.StatusOK,
+			contains: `"missing":["SKU-002"]`},
+		{principal: customer, method: http.MethodGet, path: "/items/locations", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, tt.principal) })
+		NewHandler(store).RegisterRoutes(router)
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected status %d with %s, got: %d %s", tt.method, tt.path, tt.want, tt.contains, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Package locations records where in the warehouse each item is kept: a
+// zone, such as an aisle or the cold room, and a bin within it.
+// order-service groups pick lists by zone and sorts them by bin, so a picker
+// walks each zone once.
+package locations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type Location struct {
+	SKU       string    `json:"sku"`
+	Zone      string    `json:"zone"`
+	Bin       string    `json:"bin"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (l *Location) validate() error {
+	l.Zone, l.Bin = strings.ToUpper(strings.TrimSpace(l.Zone)), strings.ToUpper(strings.TrimSpace(l.Bin))
+	if l.Zone == "" || len(l.Zone) > 32 || l.Bin == "" || len(l.Bin) > 32 {
+		return errors.New("zone and bin must be 1 to 32 characters")
+	}
+	return nil
+}
+
+type Store interface {
+	// Get returns the locations recorded for whichever of skus have one.
+	Get(ctx context.Context, skus []string) ([]Location, error)
+	// Put records l, filling in UpdatedAt, and returns ErrNotFound if there
+	// is no such item.
+	Put(ctx context.Context, l *Location) error
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Get(ctx context.Context, skus []string) ([]Location, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT l.sku, l.zone, l.bin, l.updated_at
+		FROM inventory_service.item_locations l JOIN inventory_service.items i ON i.sku = l.sku
+		WHERE l.sku = ANY($1) AND i.tenant_id = $2 ORDER BY l.zone, l.bin, l.sku`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(skus), tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := []Location{}
+	for rows.Next() {
+		var l Location
+		if err := rows.Scan(&l.SKU, &l.Zone, &l.Bin, &l.UpdatedAt); err != nil {
+			return nil, err
+		}
+		found = append(found, l)
+	}
+	return found, rows.Err()
+}
+
+func (s *PostgresStore) Put(ctx context.Context, l *Location) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO inventory_service.item_locations (sku, zone, bin)
+		SELECT i.sku, $2, $3 FROM inventory_service.items i WHERE i.sku = $1 AND i.tenant_id = $4
+		ON CONFLICT (sku) DO UPDATE SET zone = EXCLUDED.zone, bin = EXCLUDED.bin, updated_at = NOW()
+		RETURNING updated_at`
+	err := s.db.QueryRowContext(ctx, query, l.SKU, l.Zone, l.Bin, tenant.FromContext(ctx)).Scan(&l.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
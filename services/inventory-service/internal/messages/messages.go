@@ -0,0 +1,9 @@
+// Package messages holds the translations of the service's error messages,
+// one <locale>.json file per locale mapping each English message to its
+// translation. See pkg/i18n for how they are applied.
+package messages
+
+import "embed"
+
+//go:embed *.json
+var Files embed.FS
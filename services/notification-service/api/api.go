@@ -0,0 +1,8 @@
+package api
+
+import _ "embed"
+
+// Spec is the OpenAPI definition served at /docs.
+//
+//go:embed openapi.yaml
+var Spec []byte
@@ -1,22 +1,332 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"log"
-	"net/http"
+	"net"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/bodylimit"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+	"github.com/alux444/go-microserv-test/pkg/idempotency"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/loadshed"
+	"github.com/alux444/go-microserv-test/pkg/service"
+	"github.com/alux444/go-microserv-test/pkg/startup"
+	"github.com/alux444/go-microserv-test/services/notification-service/api"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/assets"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/deliveries"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/devices"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/domains"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/inbound"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/messages"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/nudges"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/preferences"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/providers"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/render"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/routing"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/scanning"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/securityalerts"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/stockalerts"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/stream"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/suppression"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/templates"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/webhooks"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/winback"
 	"github.com/gin-gonic/gin"
 )
 
+// setupRouter mounts the inbound email and feedback webhooks only when
+// replies and feedback are non-nil, and the quarantine only when guard is.
+func setupRouter(db *sql.DB, storage assets.Storage, library *assets.Library, guard *scanning.Guard, renderer *render.Renderer, emailTemplates *templates.Library, rules *routing.Engine, dispatcher *notifications.Dispatcher, hub *stream.Hub, replies *inbound.Handler, feedback *suppression.FeedbackHandler, sendingDomains *domains.Manager, prefs *preferences.Manager, registry *devices.Registry, hooks *webhooks.Handler, tokens *auth.Tokens, keys idempotency.Store) *service.Router {
+	router := service.NewRouter(service.Config{
+		Name:       "notification-service",
+		DB:         db,
+		Tokens:     tokens,
+		Spec:       api.Spec,
+		Messages:   messages.Files,
+		AuditLog:   "notification_service.audit_log",
+		Middleware: []gin.HandlerFunc{idempotency.Middleware(keys, idempotencyTTL())},
+	})
+	// Streams stay open for as long as their client is connected, so a cap
+	// on them would count subscribers rather than load.
+	router.Shedder.SetRoute("GET /notifications/stream", loadshed.Limits{})
+	router.Shedder.SetRoute("GET /metrics/deliveries/stream", loadshed.Limits{})
+	// Uploads are multipart with a 5MB file, suppression imports are CSV,
+	// and the webhooks check their signature before they parse anything.
+	router.Bodies.SetRoute("POST /assets", bodylimit.Rule{MaxBytes: 6 << 20, Types: []string{"multipart/form-data"}})
+	csvImport := bodylimit.Rule{MaxBytes: config.GetBytes("SUPPRESSION_IMPORT_MAX_BODY", 10<<20), Types: []string{"text/csv"}}
+	router.Bodies.SetRoute("POST /notifications/suppressions/import", csvImport)
+	router.Bodies.SetRoute("POST /admin/suppressions/import", csvImport)
+	router.Bodies.SetRoute("POST /inbound/email", bodylimit.Rule{MaxBytes: 10 << 20, Types: []string{bodylimit.AnyType}})
+	router.Bodies.SetRoute("POST /inbound/feedback", bodylimit.Rule{Types: []string{bodylimit.AnyType}})
+	suppressions := suppression.NewHandler(suppression.NewPostgresStore(db))
+	suppressions.RegisterAdminRoutes(router.Admin)
+
+	router.GET("/metrics/providers", dispatcher.Metrics().Handler())
+
+	assets.NewHandler(library, storage, guard).RegisterRoutes(router)
+	if guard != nil {
+		// A released asset upload is published as if it had passed the scan.
+		scanning.NewHandler(scanning.NewPostgresStore(db), map[string]scanning.Releaser{
+			scanning.SourceAsset: func(ctx context.Context, item *scanning.Item) error {
+				_, err := library.Upload(ctx, item.Reference, item.ContentType, item.Content)
+				return err
+			},
+		}).RegisterRoutes(router)
+		router.GET("/metrics/scans", guard.Metrics().Handler())
+	}
+
+	notifications.NewHandler(notifications.NewPostgresStore(db), dispatcher, renderer, emailTemplates).RegisterRoutes(router)
+	notifications.NewDeadLetterHandler(notifications.NewPostgresStore(db)).RegisterRoutes(router)
+	templates.NewHandler(emailTemplates).RegisterRoutes(router)
+	routing.NewHandler(rules).RegisterRoutes(router)
+	stream.NewHandler(hub, tokens, config.GetDuration("STREAM_HEARTBEAT", 25*time.Second)).RegisterRoutes(router)
+	domains.NewHandler(sendingDomains).RegisterRoutes(router)
+	preferences.NewHandler(prefs).RegisterRoutes(router)
+	devices.NewHandler(registry).RegisterRoutes(router)
+	suppressions.RegisterRoutes(router)
+	hooks.RegisterRoutes(router)
+	if replies != nil {
+		replies.RegisterRoutes(router)
+	}
+	if feedback != nil {
+		feedback.RegisterRoutes(router)
+	}
+
+	return router
+}
+
+func idempotencyTTL() time.Duration {
+	return config.GetDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+}
+
+// scanner picks clamd when CLAMAV_ADDRESS is set, then the external API at
+// SCAN_API_URL, and returns nil if neither is.
+func scanner() scanning.Scanner {
+	timeout := config.GetDuration("SCAN_TIMEOUT", 30*time.Second)
+	if address := config.GetEnv("CLAMAV_ADDRESS", ""); address != "" {
+		return scanning.NewClamAV(address, timeout)
+	}
+	if url := config.GetEnv("SCAN_API_URL", ""); url != "" {
+		return scanning.NewAPI(url, config.GetEnv("SCAN_API_KEY", ""), timeout)
+	}
+	return nil
+}
+
+// senders sends SMS through SMS_API_URL, and push through FCM and APNs,
+// when their credentials are configured. Everything else is logged.
+func senders(tokens providers.Tokens) notifications.ChannelSenders {
+	timeout := config.GetDuration("PROVIDER_TIMEOUT", 10*time.Second)
+	senders := notifications.ChannelSenders{Default: notifications.LogSender{}, ByChannel: map[string]notifications.Sender{}}
+	if url := config.GetEnv("SMS_API_URL", ""); url != "" {
+		senders.ByChannel["sms"] = providers.NewSMS(url, config.GetEnv("SMS_ACCOUNT_ID", ""), config.GetEnv("SMS_AUTH_TOKEN", ""),
+			config.GetEnv("SMS_FROM", ""), timeout)
+	} else {
+		log.Println("SMS_API_URL not set, SMS notifications are logged instead of sent")
+	}
+
+	var fcm *providers.FCM
+	if path := config.GetEnv("FCM_CREDENTIALS_FILE", ""); path != "" {
+		credentials, err := os.ReadFile(path)
+		if err == nil {
+			fcm, err = providers.NewFCM(credentials, timeout)
+		}
+		if err != nil {
+			log.Fatalf("Failed to load FCM credentials: %v", err)
+		}
+	}
+	var apns *providers.APNs
+	if path := config.GetEnv("APNS_KEY_FILE", ""); path != "" {
+		key, err := os.ReadFile(path)
+		if err == nil {
+			apns, err = providers.NewAPNs(key, config.GetEnv("APNS_KEY_ID", ""), config.GetEnv("APNS_TEAM_ID", ""),
+				config.GetEnv("APNS_TOPIC", ""), config.GetEnv("APNS_PRODUCTION", "false") == "true", timeout)
+		}
+		if err != nil {
+			log.Fatalf("Failed to load APNs key: %v", err)
+		}
+	}
+	if fcm != nil || apns != nil {
+		senders.ByChannel["push"] = providers.NewPush(fcm, apns, tokens)
+	} else {
+		log.Println("FCM_CREDENTIALS_FILE and APNS_KEY_FILE not set, push notifications are logged instead of sent")
+	}
+	return senders
+}
+
 func main() {
-	router := gin.Default()
+	ctx, stop := service.Init("notification-service")
+	defer stop()
 
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "healthy",
-			"service": "notification-service",
-		})
-	})
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	log.Println("Connected to db successfully")
+
+	storage, err := assets.NewLocalStorage(
+		config.GetEnv("ASSET_DIR", "./data/assets"),
+		config.GetEnv("ASSET_BASE_URL", "http://localhost:50052/assets/files"),
+	)
+	if err != nil {
+		log.Fatalf("Failed to initialize asset storage: %v", err)
+	}
+
+	publisher, subscriber, closeEvents := schema.Connect(config.GetEnv("RABBITMQ_URL", ""), "events")
+	defer closeEvents()
+
+	notificationStore := notifications.NewPostgresStore(db)
+	replyDomain := config.GetEnv("INBOUND_REPLY_DOMAIN", "")
+	sendingDomains := domains.NewManager(domains.NewPostgresStore(db), net.DefaultResolver,
+		notifications.Identity{From: config.GetEnv("EMAIL_FROM", "Notifications <notifications@example.com>")})
+	unsubscribeSecret := config.GetEnv("UNSUBSCRIBE_SECRET", "")
+	if unsubscribeSecret == "" {
+		log.Println("UNSUBSCRIBE_SECRET not set, emails carry no unsubscribe link")
+	}
+	prefs := preferences.NewManager(preferences.NewPostgresStore(db), unsubscribeSecret,
+		config.GetEnv("UNSUBSCRIBE_URL", "http://localhost:50052/notifications/unsubscribe"))
+	suppressionStore := suppression.NewPostgresStore(db)
+	registry := devices.NewRegistry(devices.NewPostgresStore(db))
+	dispatcher := notifications.NewDispatcher(notificationStore, senders(registry), publisher, sendingDomains, prefs,
+		suppression.NewChecker(suppressionStore), replyDomain)
+	dispatcher.CopyToChannels(prefs, registry)
+
+	library := assets.NewLibrary(assets.NewPostgresStore(db), storage)
+	renderer := render.NewRenderer(library)
+	emailTemplates := templates.NewLibrary(renderer)
+	rules := routing.NewEngine(routing.NewPostgresStore(db), emailTemplates, dispatcher)
+
+	runner := jobs.New()
+	retrier := notifications.NewRetrier(notificationStore, dispatcher,
+		runner.Queue("notification-retries", config.GetInt("NOTIFICATION_RETRY_WORKERS", 2), 100),
+		config.GetInt("NOTIFICATION_MAX_ATTEMPTS", 5), config.GetDuration("NOTIFICATION_RETRY_BACKOFF", time.Minute))
+	runner.Schedule("notification-retry-sweep", jobs.Every(config.GetDuration("NOTIFICATION_RETRY_INTERVAL", time.Minute)), retrier.Sweep)
+	digester := notifications.NewDigester(notificationStore, dispatcher, emailTemplates)
+	runner.Schedule("notification-digests", jobs.Every(config.GetDuration("NOTIFICATION_DIGEST_INTERVAL", time.Minute)), digester.Sweep)
+	runner.Schedule("sending-domain-checks", jobs.Every(config.GetDuration("SENDING_DOMAIN_CHECK_INTERVAL", time.Hour)), sendingDomains.Sweep)
+	webhookStore := webhooks.NewPostgresStore(db)
+	webhookInsecure := config.GetEnv("WEBHOOK_ALLOW_INSECURE", "false") == "true"
+	deliverer := webhooks.NewDeliverer(webhookStore, webhooks.NewClient(config.GetDuration("WEBHOOK_TIMEOUT", 10*time.Second), webhookInsecure),
+		runner.Queue("webhook-deliveries", config.GetInt("WEBHOOK_WORKERS", 4), 500),
+		config.GetInt("WEBHOOK_MAX_ATTEMPTS", 8), config.GetDuration("WEBHOOK_RETRY_BACKOFF", 30*time.Second))
+	runner.Schedule("webhook-delivery-sweep", jobs.Every(config.GetDuration("WEBHOOK_RETRY_INTERVAL", 30*time.Second)), deliverer.Sweep)
+	runner.Start(ctx)
+
+	var guard *scanning.Guard
+	if s := scanner(); s != nil {
+		guard = scanning.NewGuard(s, scanning.NewPostgresStore(db))
+	} else {
+		log.Println("CLAMAV_ADDRESS or SCAN_API_URL not set, attachments are not scanned")
+	}
+
+	var replies *inbound.Handler
+	if secret := config.GetEnv("INBOUND_EMAIL_SECRET", ""); replyDomain != "" && secret != "" {
+		replies = inbound.NewHandler(inbound.NewPostgresStore(db), notificationStore, publisher, guard, replyDomain, secret)
+	} else {
+		log.Println("INBOUND_REPLY_DOMAIN or INBOUND_EMAIL_SECRET not set, inbound email is disabled")
+	}
+	var feedback *suppression.FeedbackHandler
+	if secret := config.GetEnv("FEEDBACK_WEBHOOK_SECRET", ""); secret != "" {
+		feedback = suppression.NewFeedbackHandler(suppressionStore, notificationStore, dispatcher.Feed(), replyDomain, secret)
+	} else {
+		log.Println("FEEDBACK_WEBHOOK_SECRET not set, provider feedback loops are disabled")
+	}
+
+	tokens := service.Tokens("notification-service")
+
+	hub := stream.NewHub(config.GetInt("STREAM_BUFFER", 64))
+	if subscriber != nil {
+		users := clients.NewUserClient(config.GetEnv("USER_SERVICE_URL", "http://user-service:50054"),
+			auth.NewServiceClient(tokens, "notification-service", "user-service"))
+		go func() {
+			reasons := strings.Split(config.GetEnv("WINBACK_REASONS", "found_cheaper,delivery_too_slow,changed_mind"), ",")
+			if err := winback.NewConsumer(dispatcher, users, reasons).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Win-back consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			if err := deliveries.NewConsumer(dispatcher, users).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Delivery notice consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			if err := nudges.NewConsumer(dispatcher).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Profile nudge consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			if err := stockalerts.NewConsumer(dispatcher).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Lot expiry alert consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			patterns := strings.Split(config.GetEnv("ROUTING_EVENT_PATTERNS", "#"), ",")
+			if err := rules.Run(context.Background(), subscriber, patterns); err != nil {
+				log.Printf("Routing rule consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			if err := securityalerts.NewConsumer(dispatcher).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Security alert consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			if err := webhooks.NewConsumer(webhookStore, deliverer).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Webhook consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			patterns := strings.Split(config.GetEnv("STREAM_EVENT_PATTERNS", events.NotificationCreated), ",")
+			if err := hub.Run(context.Background(), subscriber, patterns); err != nil {
+				log.Printf("Notification stream consumer stopped: %v", err)
+			}
+		}()
+	}
+
+	keys := idempotency.NewPostgresStore(db, "notification_service.idempotency_keys")
+	go idempotency.Purger(context.Background(), keys, idempotencyTTL(), time.Hour)
+
+	selfCheck := startup.New("notification-service",
+		startup.Env("JWT_SECRET"),
+		startup.Config(startup.Duration("JWT_TTL"), startup.Duration("IDEMPOTENCY_TTL"), startup.Duration("STREAM_HEARTBEAT"),
+			startup.Bytes("MAX_REQUEST_BODY"), startup.Duration("MAINTENANCE_RETRY_AFTER"), startup.Bytes("SUPPRESSION_IMPORT_MAX_BODY"),
+			startup.Int("STREAM_BUFFER"), startup.Int("NOTIFICATION_MAX_ATTEMPTS"), startup.Int("NOTIFICATION_RETRY_WORKERS"),
+			startup.Duration("NOTIFICATION_RETRY_INTERVAL"), startup.Duration("NOTIFICATION_RETRY_BACKOFF"), startup.Duration("NOTIFICATION_DIGEST_INTERVAL"),
+			startup.Duration("SHUTDOWN_TIMEOUT"),
+			startup.Duration("SENDING_DOMAIN_CHECK_INTERVAL"), startup.Duration("DELIVERY_STREAM_INTERVAL"),
+			startup.Duration("WEBHOOK_TIMEOUT"), startup.Int("WEBHOOK_WORKERS"), startup.Int("WEBHOOK_MAX_ATTEMPTS"),
+			startup.Duration("WEBHOOK_RETRY_BACKOFF"), startup.Duration("WEBHOOK_RETRY_INTERVAL"), startup.Duration("SCAN_TIMEOUT"),
+			startup.Duration("PROVIDER_TIMEOUT")),
+		startup.Tables(db, "notification_service.notifications", "notification_service.notification_threads", "notification_service.inbound_replies",
+			"notification_service.assets", "notification_service.idempotency_keys", "notification_service.sending_domains",
+			"notification_service.notification_preferences", "notification_service.quiet_hours",
+			"notification_service.notification_attempts", "notification_service.dead_letters", "notification_service.suppressions",
+			"notification_service.webhook_subscriptions", "notification_service.webhook_deliveries", "notification_service.webhook_attempts",
+			"notification_service.routing_rules", "notification_service.routing_rule_versions", "notification_service.audit_log",
+			"notification_service.quarantined_files", "notification_service.devices"),
+		startup.Service("user-service", config.GetEnv("USER_SERVICE_URL", "http://user-service:50054")),
+		startup.Broker(publisher, config.GetEnv("RABBITMQ_URL", "")),
+	)
+	go selfCheck.Run(context.Background())
+
+	router := setupRouter(db, storage, library, guard, renderer, emailTemplates, rules, dispatcher, hub, replies, feedback, sendingDomains, prefs, registry,
+		webhooks.NewHandler(webhookStore, deliverer, webhookInsecure), tokens, keys)
+	router.Saturation.AddJobs(runner.Metrics())
+	router.GET("/health/startup-report", selfCheck.Handler())
+	router.GET("/metrics/jobs", runner.Handler())
+	notifications.NewFeedHandler(dispatcher, runner.Metrics(), config.GetDuration("DELIVERY_STREAM_INTERVAL", 5*time.Second)).RegisterRoutes(router)
+	notifications.NewDigestHandler(digester).RegisterRoutes(router)
 
-	log.Println("Notification service starting on :50052")
-	router.Run(":50052")
+	service.Serve(ctx, "notification-service", ":50052", router, runner.Stop)
 }
@@ -0,0 +1,77 @@
+// Package assets hosts shared email assets (logos, stylesheets) in object
+// storage under content-addressed, versioned keys.
+package assets
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+)
+
+type Library struct {
+	store   Store
+	storage Storage
+}
+
+func NewLibrary(store Store, storage Storage) *Library {
+	return &Library{store: store, storage: storage}
+}
+
+// Upload stores a new version of the named asset. The version is derived from
+// the content, so re-uploading identical bytes yields the same URL.
+func (l *Library) Upload(ctx context.Context, name, contentType string, data []byte) (*Asset, error) {
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:])[:12]
+
+	a := &Asset{
+		Name:        name,
+		Version:     version,
+		ContentType: contentType,
+		Key:         versionedKey(name, version),
+	}
+	if err := l.storage.Put(ctx, a.Key, data); err != nil {
+		return nil, err
+	}
+	if err := l.store.Create(ctx, a); err != nil {
+		return nil, err
+	}
+	a.URL = l.storage.URL(a.Key)
+	return a, nil
+}
+
+// URL resolves an asset name to the URL of its latest version.
+func (l *Library) URL(ctx context.Context, name string) (string, error) {
+	a, err := l.store.Latest(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return l.storage.URL(a.Key), nil
+}
+
+// Content returns the bytes of the latest version of an asset.
+func (l *Library) Content(ctx context.Context, name string) ([]byte, error) {
+	a, err := l.store.Latest(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return l.storage.Get(ctx, a.Key)
+}
+
+func (l *Library) List(ctx context.Context) ([]Asset, error) {
+	assets, err := l.store.ListLatest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range assets {
+		assets[i].URL = l.storage.URL(assets[i].Key)
+	}
+	return assets, nil
+}
+
+// versionedKey turns "logo.png" into "logo.<version>.png".
+func versionedKey(name, version string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + version + ext
+}
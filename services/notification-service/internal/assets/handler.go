@@ -0,0 +1,123 @@
+package assets
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/scanning"
+	"github.com/gin-gonic/gin"
+)
+
+const maxAssetSize = 5 << 20
+
+type Handler struct {
+	library *Library
+	storage Storage
+	guard   *scanning.Guard
+}
+
+// NewHandler scans uploads with guard before publishing them, unless it is
+// nil.
+func NewHandler(library *Library, storage Storage, guard *scanning.Guard) *Handler {
+	return &Handler{library: library, storage: storage, guard: guard}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/assets", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.list)
+	router.POST("/assets", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.upload)
+	// Files stay public: emails link to them directly.
+	router.GET("/assets/files/*key", h.serve)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	assets, err := h.library.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"assets": assets})
+}
+
+func (h *Handler) upload(c *gin.Context) {
+	name := c.PostForm("name")
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required and must not contain path separators"})
+		return
+	}
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAssetSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(data) > maxAssetSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "asset exceeds 5MB"})
+		return
+	}
+
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(path.Ext(name)); byExt != "" {
+			contentType = byExt
+		} else {
+			contentType = http.DetectContentType(data)
+		}
+	}
+
+	if h.guard != nil {
+		item, err := h.guard.Check(c.Request.Context(), scanning.File{
+			Source: scanning.SourceAsset, Reference: name, Filename: header.Filename, ContentType: contentType, Data: data,
+		})
+		if err != nil {
+			log.Printf("Failed to scan asset %s: %v", name, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the file could not be scanned, try again later"})
+			return
+		}
+		if item != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "the file was flagged by the virus scanner and is held for review", "quarantine_id": item.ID})
+			return
+		}
+	}
+
+	a, err := h.library.Upload(c.Request.Context(), name, contentType, data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, a)
+}
+
+// serve returns an asset file. Keys are content-versioned, so responses can be
+// cached forever.
+func (h *Handler) serve(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	data, err := h.storage.Get(c.Request.Context(), key)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "asset not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Data(http.StatusOK, contentType, data)
+}
@@ -0,0 +1,86 @@
+package assets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+)
+
+type Asset struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	ContentType string    `json:"content_type"`
+	Key         string    `json:"key"`
+	URL         string    `json:"url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Store records the versions of each asset; the newest version of a name is
+// the one templates resolve to.
+type Store interface {
+	Create(ctx context.Context, a *Asset) error
+	Latest(ctx context.Context, name string) (*Asset, error)
+	ListLatest(ctx context.Context) ([]Asset, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Create(ctx context.Context, a *Asset) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO notification_service.assets (name, version, content_type, object_key)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name, version) DO UPDATE SET created_at = NOW()
+		RETURNING created_at`
+	return s.db.QueryRowContext(ctx, query, a.Name, a.Version, a.ContentType, a.Key).Scan(&a.CreatedAt)
+}
+
+func (s *PostgresStore) Latest(ctx context.Context, name string) (*Asset, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT name, version, content_type, object_key, created_at
+		FROM notification_service.assets WHERE name = $1 ORDER BY created_at DESC LIMIT 1`
+	var a Asset
+	err := s.db.QueryRowContext(ctx, query, name).Scan(&a.Name, &a.Version, &a.ContentType, &a.Key, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *PostgresStore) ListLatest(ctx context.Context) ([]Asset, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT DISTINCT ON (name) name, version, content_type, object_key, created_at
+		FROM notification_service.assets ORDER BY name, created_at DESC`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []Asset{}
+	for rows.Next() {
+		var a Asset
+		if err := rows.Scan(&a.Name, &a.Version, &a.ContentType, &a.Key, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		assets = append(assets, a)
+	}
+	return assets, rows.Err()
+}
@@ -0,0 +1,95 @@
+// Package deliveries emails customers when order-service reports that a
+// shipment of their order was delivered.
+package deliveries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+const queue = "notification-service.deliveries"
+
+// Directory looks up the customer to email.
+type Directory interface {
+	GetUser(ctx context.Context, id int) (*clients.User, error)
+}
+
+var _ Directory = (*clients.UserClient)(nil)
+
+type Consumer struct {
+	dispatcher *notifications.Dispatcher
+	directory  Directory
+}
+
+func NewConsumer(dispatcher *notifications.Dispatcher, directory Directory) *Consumer {
+	return &Consumer{dispatcher: dispatcher, directory: directory}
+}
+
+// Run consumes delivery events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, queue, []string{events.OrderShipmentDelivered}, events.IgnoreReplays(c.Handle))
+}
+
+// Handle skips customers who no longer exist or have no email. A failed
+// lookup is retried by returning the error.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	if e.Type != events.OrderShipmentDelivered {
+		return nil
+	}
+	var payload events.ShipmentDelivered
+	if err := e.Decode(&payload); err != nil {
+		return err
+	}
+	if payload.Tenant != "" {
+		ctx = tenant.NewContext(ctx, payload.Tenant)
+	}
+	user, err := c.directory.GetUser(ctx, payload.UserID)
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		log.Printf("Delivery notice for shipment %d skipped: user %d not found", payload.ShipmentID, payload.UserID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("look up user %d: %w", payload.UserID, err)
+	}
+	if user.Email == "" {
+		log.Printf("Delivery notice for shipment %d skipped: user %d has no email", payload.ShipmentID, payload.UserID)
+		return nil
+	}
+	return c.dispatcher.Dispatch(ctx, delivered(payload, user.Email))
+}
+
+func delivered(p events.ShipmentDelivered, email string) *notifications.Notification {
+	var b strings.Builder
+	fmt.Fprintf(&b, "A parcel from your order #%d was delivered on %s:\n\n", p.OrderID, p.DeliveredAt.Format("Monday 2 January"))
+	for _, item := range p.Items {
+		name := item.Name
+		if name == "" {
+			name = item.SKU
+		}
+		fmt.Fprintf(&b, "- %d %s x %s\n", item.Quantity, item.Unit, name)
+	}
+	fmt.Fprintf(&b, "\n%s tracking number: %s", p.Carrier, p.TrackingNumber)
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:      &userID,
+		Recipient:   email,
+		Channel:     "email",
+		Type:        notifications.TypeShipment,
+		Subject:     fmt.Sprintf("Your order #%d has been delivered", p.OrderID),
+		Body:        b.String(),
+		ContextType: "order",
+		ContextID:   strconv.Itoa(p.OrderID),
+	}}
+}
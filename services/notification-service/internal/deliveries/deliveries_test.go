@@ -0,0 +1,106 @@
+package deliveries
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+type memStore struct {
+	notifications.Store
+	created []notifications.Notification
+}
+
+func (s *memStore) Create(ctx context.Context, n *notifications.Notification) error {
+	n.ID = len(s.created) + 1
+	s.created = append(s.created, *n)
+	return nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, id int, a notifications.Attempt) error {
+	s.created[id-1].Status = a.Status
+	return nil
+}
+
+type directory struct {
+	users  map[int]*clients.User
+	tenant string
+	err    error
+}
+
+func (d *directory) GetUser(ctx context.Context, id int) (*clients.User, error) {
+	d.tenant = tenant.FromContext(ctx)
+	if d.err != nil {
+		return nil, d.err
+	}
+	u, ok := d.users[id]
+	if !ok {
+		return nil, &clients.APIError{StatusCode: http.StatusNotFound, Message: "user not found"}
+	}
+	return u, nil
+}
+
+func delivery(t *testing.T, userID int) events.Event {
+	e, err := events.New(events.OrderShipmentDelivered, "order-service", events.ShipmentDelivered{
+		ShipmentID: 3, OrderID: 42, UserID: userID, Tenant: "acme", Carrier: "nzpost", TrackingNumber: "NZ1",
+		DeliveredAt: time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC),
+		Items:       []events.ShipmentItem{{SKU: "SKU-001", Name: "Flat white beans", Unit: "bag", Quantity: 2}, {SKU: "SKU-002", Unit: "each", Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	return e
+}
+
+func TestHandleSendsDeliveryNotice(t *testing.T) {
+	store := &memStore{}
+	dir := &directory{users: map[int]*clients.User{7: {ID: 7, Email: "ada@example.com"}}}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, ""), dir)
+
+	if err := consumer.Handle(context.Background(), delivery(t, 7)); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(store.created) != 1 {
+		t.Fatalf("Expected 1 notification, got: %d", len(store.created))
+	}
+	n := store.created[0]
+	if n.Recipient != "ada@example.com" || *n.UserID != 7 || n.Type != notifications.TypeShipment || n.ContextType != "order" || n.ContextID != "42" {
+		t.Errorf("Expected a shipment notice to user 7 about order 42, got: %+v", n)
+	}
+	for _, want := range []string{"Wednesday 14 October", "2 bag x Flat white beans", "1 each x SKU-002", "nzpost tracking number: NZ1"} {
+		if !strings.Contains(n.Body, want) {
+			t.Errorf("Expected the body to contain %q, got: %s", want, n.Body)
+		}
+	}
+	if dir.tenant != "acme" {
+		t.Errorf("Expected the user to be looked up in the order's tenant, got: %q", dir.tenant)
+	}
+}
+
+func TestHandleLookupFailures(t *testing.T) {
+	store := &memStore{}
+	dir := &directory{users: map[int]*clients.User{9: {ID: 9}}}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, ""), dir)
+
+	if err := consumer.Handle(context.Background(), delivery(t, 8)); err != nil {
+		t.Errorf("Expected a deleted user to be skipped, got: %v", err)
+	}
+	if err := consumer.Handle(context.Background(), delivery(t, 9)); err != nil {
+		t.Errorf("Expected a user without an email to be skipped, got: %v", err)
+	}
+	dir.err = errors.New("connection refused")
+	if err := consumer.Handle(context.Background(), delivery(t, 8)); err == nil {
+		t.Error("Expected a failed lookup to be retried")
+	}
+	if len(store.created) != 0 {
+		t.Errorf("Expected no notifications, got: %d", len(store.created))
+	}
+}
@@ -0,0 +1,92 @@
+// Package devices keeps where users receive notifications besides email:
+// app installs and browsers with a push token from FCM or APNs, and phone
+// numbers for SMS. Apps register their push token every time they start,
+// since tokens change, and tokens the provider no longer knows are
+// forgotten when a push to them is rejected.
+package devices
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Platforms. FCM and APNs devices receive the push channel, SMS ones the
+// sms channel.
+const (
+	PlatformFCM  = "fcm"
+	PlatformAPNs = "apns"
+	PlatformSMS  = "sms"
+)
+
+var Platforms = []string{PlatformFCM, PlatformAPNs, PlatformSMS}
+
+// validPhone accepts E.164 numbers, which SMS providers expect.
+var validPhone = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// Device is one place a user receives notifications. Token is the push
+// token, or the phone number on PlatformSMS.
+type Device struct {
+	ID       int64  `json:"id"`
+	UserID   int    `json:"user_id"`
+	Platform string `json:"platform"`
+	Token    string `json:"token"`
+	// Name tells the user's devices apart, such as "Work phone".
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// RegisteredAt is when the device was last registered.
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// Channel is the notification channel the device receives.
+func (d *Device) Channel() string {
+	if d.Platform == PlatformSMS {
+		return "sms"
+	}
+	return "push"
+}
+
+// Recipient is the device's address on its channel: the phone number for
+// SMS, and the token after its platform for push, such as "fcm:<token>".
+func (d *Device) Recipient() string {
+	if d.Platform == PlatformSMS {
+		return d.Token
+	}
+	return d.Platform + ":" + d.Token
+}
+
+// Registry finds users' devices for the dispatcher and forgets the tokens
+// push providers reject.
+type Registry struct {
+	store Store
+}
+
+var _ notifications.Contacts = (*Registry)(nil)
+
+func NewRegistry(store Store) *Registry {
+	return &Registry{store: store}
+}
+
+func (r *Registry) Recipients(ctx context.Context, userID int, channel string) ([]string, error) {
+	devices, err := r.store.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []string
+	for _, d := range devices {
+		if d.Channel() == channel {
+			recipients = append(recipients, d.Recipient())
+		}
+	}
+	return recipients, nil
+}
+
+// Forget removes the device with the push token, if it is registered.
+func (r *Registry) Forget(ctx context.Context, platform, token string) error {
+	return r.store.DeleteToken(ctx, platform, token)
+}
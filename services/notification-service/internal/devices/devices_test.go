@@ -0,0 +1,148 @@
+package devices
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps devices in registration order.
+type memStore struct {
+	devices []Device
+	nextID  int64
+}
+
+func (s *memStore) Register(ctx context.Context, d *Device) error {
+	now := time.Now()
+	for i := range s.devices {
+		if s.devices[i].Platform == d.Platform && s.devices[i].Token == d.Token {
+			s.devices[i].UserID, s.devices[i].Name, s.devices[i].RegisteredAt = d.UserID, d.Name, now
+			*d = s.devices[i]
+			return nil
+		}
+	}
+	s.nextID++
+	d.ID, d.CreatedAt, d.RegisteredAt = s.nextID, now, now
+	s.devices = append(s.devices, *d)
+	return nil
+}
+
+func (s *memStore) ListByUser(ctx context.Context, userID int) ([]Device, error) {
+	devices := []Device{}
+	for _, d := range s.devices {
+		if d.UserID == userID {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (s *memStore) Get(ctx context.Context, id int64) (*Device, error) {
+	for _, d := range s.devices {
+		if d.ID == id {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Delete(ctx context.Context, id int64) error {
+	for i, d := range s.devices {
+		if d.ID == id {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memStore) DeleteToken(ctx context.Context, platform, token string) error {
+	for i, d := range s.devices {
+		if d.Platform == platform && d.Token == token {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func TestRecipients(t *testing.T) {
+	ctx := context.Background()
+	store := &memStore{}
+	registry := NewRegistry(store)
+	store.Register(ctx, &Device{UserID: 7, Platform: PlatformFCM, Token: "f1"})
+	store.Register(ctx, &Device{UserID: 7, Platform: PlatformAPNs, Token: "a1"})
+	store.Register(ctx, &Device{UserID: 7, Platform: PlatformSMS, Token: "+447700900123"})
+	store.Register(ctx, &Device{UserID: 8, Platform: PlatformFCM, Token: "f2"})
+
+	if push, err := registry.Recipients(ctx, 7, "push"); err != nil || strings.Join(push, ",") != "fcm:f1,apns:a1" {
+		t.Errorf("Expected both push tokens, got: %v, %v", push, err)
+	}
+	if sms, _ := registry.Recipients(ctx, 7, "sms"); strings.Join(sms, ",") != "+447700900123" {
+		t.Errorf("Expected the phone number, got: %v", sms)
+	}
+	registry.Forget(ctx, PlatformFCM, "f1")
+	if push, _ := registry.Recipients(ctx, 7, "push"); strings.Join(push, ",") != "apns:a1" {
+		t.Errorf("Expected the forgotten token gone, got: %v", push)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	do := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(NewRegistry(store)).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	ada := &auth.Principal{UserID: 7, Roles: []string{"customer"}}
+	bob := &auth.Principal{UserID: 8, Roles: []string{"customer"}}
+
+	if w := do(ada, http.MethodPost, "/notifications/devices", `{"user_id": 7, "platform": "fcm", "token": "tok-1", "name": "Pixel"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the device to be registered, got: %d %s", w.Code, w.Body.String())
+	}
+	for _, body := range []string{
+		`{"user_id": 7, "platform": "pager", "token": "tok"}`,
+		`{"user_id": 7, "platform": "sms", "token": "07700 900123"}`,
+		`{"user_id": 7, "platform": "apns", "token": "two words"}`,
+	} {
+		if w := do(ada, http.MethodPost, "/notifications/devices", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be 400, got: %d", body, w.Code)
+		}
+	}
+	if w := do(ada, http.MethodPost, "/notifications/devices", `{"user_id": 8, "platform": "fcm", "token": "tok-2"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected registering for another user to be forbidden, got: %d", w.Code)
+	}
+
+	// The same install signed into another account moves to it.
+	if w := do(bob, http.MethodPost, "/notifications/devices", `{"user_id": 8, "platform": "fcm", "token": "tok-1"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the device to be re-registered, got: %d %s", w.Code, w.Body.String())
+	}
+	w := do(ada, http.MethodGet, "/notifications/devices?user_id=7", "")
+	var list struct {
+		Devices []Device `json:"devices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Devices) != 0 {
+		t.Errorf("Expected the device to have moved to bob, got: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do(ada, http.MethodDelete, "/notifications/devices/1", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected removing another user's device to be forbidden, got: %d", w.Code)
+	}
+	if w := do(bob, http.MethodDelete, "/notifications/devices/1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the device to be removed, got: %d", w.Code)
+	}
+	if w := do(bob, http.MethodDelete, "/notifications/devices/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a second removal to be 404, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,136 @@
+package devices
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// maxDevices bounds how many devices a user may register.
+const maxDevices = 20
+
+type Handler struct {
+	registry *Registry
+}
+
+func NewHandler(registry *Registry) *Handler {
+	return &Handler{registry: registry}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Users manage their own devices.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/notifications/devices", h.list)
+	router.POST("/notifications/devices", h.register)
+	router.DELETE("/notifications/devices/:id", h.remove)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id query parameter is required"})
+		return
+	}
+	if !auth.AuthorizeUser(c, userID) {
+		return
+	}
+	devices, err := h.registry.store.ListByUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+type registerRequest struct {
+	UserID   int    `json:"user_id" binding:"required"`
+	Platform string `json:"platform" binding:"required"`
+	Token    string `json:"token" binding:"required,max=4096"`
+	Name     string `json:"name" binding:"max=64"`
+}
+
+// validate checks the token is a phone number in E.164 form for SMS, and
+// a single printable word for push.
+func (r *registerRequest) validate() error {
+	switch r.Platform {
+	case PlatformSMS:
+		if !validPhone.MatchString(r.Token) {
+			return errors.New("token must be a phone number in E.164 form, such as +447700900123, for sms")
+		}
+	case PlatformFCM, PlatformAPNs:
+		for _, ch := range r.Token {
+			if ch <= ' ' || ch > '~' {
+				return errors.New("token must be printable ASCII without spaces")
+			}
+		}
+	default:
+		return errors.New("platform must be one of " + strings.Join(Platforms, ", "))
+	}
+	return nil
+}
+
+// register adds a device, or refreshes it if its token is registered
+// already, which apps do every time they start.
+func (h *Handler) register(c *gin.Context) {
+	var req registerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, req.UserID) {
+		return
+	}
+	req.Token, req.Name = strings.TrimSpace(req.Token), strings.TrimSpace(req.Name)
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	existing, err := h.registry.store.ListByUser(c.Request.Context(), req.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	known := false
+	for _, d := range existing {
+		known = known || (d.Platform == req.Platform && d.Token == req.Token)
+	}
+	if !known && len(existing) >= maxDevices {
+		c.JSON(http.StatusConflict, gin.H{"error": "a user may register at most " + strconv.Itoa(maxDevices) + " devices; remove one first"})
+		return
+	}
+	d := &Device{UserID: req.UserID, Platform: req.Platform, Token: req.Token, Name: req.Name}
+	if err := h.registry.store.Register(c.Request.Context(), d); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func (h *Handler) remove(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device id"})
+		return
+	}
+	d, err := h.registry.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, d.UserID) {
+		return
+	}
+	if err := h.registry.store.Delete(c.Request.Context(), id); err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
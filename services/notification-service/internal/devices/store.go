@@ -0,0 +1,116 @@
+package devices
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+type Store interface {
+	// Register adds d, filling in its ID and timestamps. A token that is
+	// registered already moves to d's user and takes d's name, since the
+	// device changed hands or was signed into another account.
+	Register(ctx context.Context, d *Device) error
+	// ListByUser returns the user's devices, most recently registered
+	// first.
+	ListByUser(ctx context.Context, userID int) ([]Device, error)
+	Get(ctx context.Context, id int64) (*Device, error)
+	Delete(ctx context.Context, id int64) error
+	// DeleteToken removes the device with the token, if there is one.
+	DeleteToken(ctx context.Context, platform, token string) error
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const deviceColumns = `id, user_id, platform, token, name, created_at, registered_at`
+
+func scanDevice(row interface{ Scan(...any) error }) (*Device, error) {
+	var d Device
+	if err := row.Scan(&d.ID, &d.UserID, &d.Platform, &d.Token, &d.Name, &d.CreatedAt, &d.RegisteredAt); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *PostgresStore) Register(ctx context.Context, d *Device) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO notification_service.devices (tenant_id, user_id, platform, token, name)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id, platform, token) DO UPDATE
+		SET user_id = EXCLUDED.user_id, name = EXCLUDED.name, registered_at = NOW()
+		RETURNING id, created_at, registered_at`
+	return s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), d.UserID, d.Platform, d.Token, d.Name).
+		Scan(&d.ID, &d.CreatedAt, &d.RegisteredAt)
+}
+
+func (s *PostgresStore) ListByUser(ctx context.Context, userID int) ([]Device, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + deviceColumns + ` FROM notification_service.devices
+		WHERE tenant_id = $1 AND user_id = $2 ORDER BY registered_at DESC, id DESC`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *d)
+	}
+	return devices, rows.Err()
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int64) (*Device, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + deviceColumns + ` FROM notification_service.devices WHERE tenant_id = $1 AND id = $2`
+	d, err := scanDevice(s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return d, err
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM notification_service.devices WHERE tenant_id = $1 AND id = $2`
+	res, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteToken(ctx context.Context, platform, token string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM notification_service.devices WHERE tenant_id = $1 AND platform = $2 AND token = $3`
+	_, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx), platform, token)
+	return err
+}
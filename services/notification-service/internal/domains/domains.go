@@ -0,0 +1,311 @@
+// Package domains lets a tenant send email from its own domain. A tenant
+// names the domain and from-address, publishes the DNS records it is given,
+// and its mail is signed with its DKIM key once the records check out. Until
+// then, or whenever a later check fails, mail goes out from the platform
+// domain instead.
+package domains
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+// Domain statuses. A failed domain was verified before and has lost a
+// record since.
+const (
+	StatusPending  = "pending"
+	StatusVerified = "verified"
+	StatusFailed   = "failed"
+)
+
+// verifyPrefix names the TXT record that proves the tenant controls the
+// domain.
+const verifyPrefix = "_msvc-verify."
+
+// keyBits is the DKIM key size. Tests lower it to keep key generation quick.
+var keyBits = 2048
+
+var validDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// Domain is a tenant's sending domain. PendingKey is a rotated DKIM key
+// that replaces Key once its record is found in DNS, so mail stays signed
+// with a published key throughout the rotation.
+type Domain struct {
+	Tenant          string          `json:"-"`
+	Domain          string          `json:"domain"`
+	FromAddress     string          `json:"from_address"`
+	FromName        string          `json:"from_name,omitempty"`
+	Status          string          `json:"status"`
+	LastError       string          `json:"last_error,omitempty"`
+	CheckedAt       *time.Time      `json:"checked_at,omitempty"`
+	VerifiedAt      *time.Time      `json:"verified_at,omitempty"`
+	Token           string          `json:"-"`
+	Selector        string          `json:"dkim_selector"`
+	Key             *rsa.PrivateKey `json:"-"`
+	PendingSelector string          `json:"pending_dkim_selector,omitempty"`
+	PendingKey      *rsa.PrivateKey `json:"-"`
+}
+
+// Record is a DNS record the tenant must publish.
+type Record struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Purpose string `json:"purpose"`
+}
+
+// Records lists the ownership record and a DKIM record for each key in use.
+func (d *Domain) Records() []Record {
+	records := []Record{
+		{Type: "TXT", Name: verifyPrefix + d.Domain, Value: verifyValue(d.Token), Purpose: "ownership"},
+		{Type: "TXT", Name: dkimName(d.Selector, d.Domain), Value: dkimValue(d.Key), Purpose: "dkim"},
+	}
+	if d.PendingKey != nil {
+		records = append(records, Record{Type: "TXT", Name: dkimName(d.PendingSelector, d.Domain), Value: dkimValue(d.PendingKey), Purpose: "dkim_rotation"})
+	}
+	return records
+}
+
+func verifyValue(token string) string {
+	return "msvc-verify=" + token
+}
+
+func dkimName(selector, domain string) string {
+	return selector + "._domainkey." + domain
+}
+
+func dkimValue(key *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		// An RSA public key always marshals.
+		panic(err)
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+// Resolver looks up TXT records. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var _ Resolver = (*net.Resolver)(nil)
+
+var (
+	ErrNotFound = errors.New("no sending domain")
+	ErrInvalid  = errors.New("invalid sending domain")
+)
+
+// Manager keeps each tenant's sending domain and picks the identity its
+// mail goes out as.
+type Manager struct {
+	store    Store
+	resolver Resolver
+	platform notifications.Identity
+	now      func() time.Time
+}
+
+// NewManager falls back to platform for tenants without a verified domain.
+func NewManager(store Store, resolver Resolver, platform notifications.Identity) *Manager {
+	return &Manager{store: store, resolver: resolver, platform: platform, now: time.Now}
+}
+
+var _ notifications.Identities = (*Manager)(nil)
+
+// Identity is the tenant's domain when it is verified and the platform's
+// otherwise. A failed lookup also falls back, so mail is never held up.
+func (m *Manager) Identity(ctx context.Context) notifications.Identity {
+	d, err := m.store.Get(ctx)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("Failed to load the sending domain for tenant %s, using the platform domain: %v", tenant.FromContext(ctx), err)
+		}
+		return m.platform
+	}
+	if d.Status != StatusVerified {
+		return m.platform
+	}
+	from := mail.Address{Name: d.FromName, Address: d.FromAddress}
+	return notifications.Identity{
+		From: from.String(),
+		DKIM: &notifications.DKIM{Domain: d.Domain, Selector: d.Selector, Key: d.Key},
+	}
+}
+
+// Configure sets the tenant's domain and from-address. A new domain gets a
+// new ownership token and DKIM key and starts out pending; changing only
+// the from-address keeps the domain's status.
+func (m *Manager) Configure(ctx context.Context, domain, fromAddress, fromName string) (*Domain, error) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if !validDomain.MatchString(domain) {
+		return nil, fmt.Errorf("%w: %q is not a domain name", ErrInvalid, domain)
+	}
+	addr, err := mail.ParseAddress(fromAddress)
+	if err != nil || addr.Name != "" {
+		return nil, fmt.Errorf("%w: %q is not an email address", ErrInvalid, fromAddress)
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	if !strings.EqualFold(addr.Address[at+1:], domain) {
+		return nil, fmt.Errorf("%w: the from address must be at %s", ErrInvalid, domain)
+	}
+
+	d, err := m.store.Get(ctx)
+	if errors.Is(err, ErrNotFound) || (err == nil && d.Domain != domain) {
+		d, err = m.newDomain(ctx, domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.FromAddress, d.FromName = addr.Address, strings.TrimSpace(fromName)
+	if err := m.store.Save(ctx, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (m *Manager) newDomain(ctx context.Context, domain string) (*Domain, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	return &Domain{
+		Tenant:   tenant.FromContext(ctx),
+		Domain:   domain,
+		Status:   StatusPending,
+		Token:    hex.EncodeToString(token),
+		Selector: m.selector(),
+		Key:      key,
+	}, nil
+}
+
+// selector names a key by when it was made, so every rotation publishes
+// under a fresh name.
+func (m *Manager) selector() string {
+	return "msvc" + strconv.FormatInt(m.now().Unix(), 36)
+}
+
+// Rotate makes a new DKIM key. Mail is signed with the current key until
+// a check finds the new key's record; rotating again replaces a key that
+// has not been published yet.
+func (m *Manager) Rotate(ctx context.Context) (*Domain, error) {
+	d, err := m.store.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	d.PendingSelector, d.PendingKey = m.selector(), key
+	if d.PendingSelector == d.Selector {
+		d.PendingSelector += "r"
+	}
+	if err := m.store.Save(ctx, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Remove deletes the tenant's domain, so its mail goes out from the
+// platform domain.
+func (m *Manager) Remove(ctx context.Context) error {
+	return m.store.Delete(ctx)
+}
+
+// Verify checks the tenant's DNS records now.
+func (m *Manager) Verify(ctx context.Context) (*Domain, error) {
+	d, err := m.store.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.check(ctx, d)
+	if err := m.store.Save(ctx, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Sweep rechecks every tenant's domain. It runs as a scheduled job, so a
+// domain whose records are removed stops being used.
+func (m *Manager) Sweep(ctx context.Context) error {
+	all, err := m.store.ListAll(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range all {
+		d := &all[i]
+		tenantCtx := tenant.NewContext(ctx, d.Tenant)
+		was := d.Status
+		m.check(tenantCtx, d)
+		if err := m.store.Save(tenantCtx, d); err != nil {
+			return err
+		}
+		if d.Status != was {
+			log.Printf("Sending domain %s for tenant %s is now %s: %s", d.Domain, d.Tenant, d.Status, d.LastError)
+		}
+	}
+	return nil
+}
+
+// check looks up d's records and updates its status. A published pending
+// key is promoted to the signing key.
+func (m *Manager) check(ctx context.Context, d *Domain) {
+	now := m.now()
+	d.CheckedAt = &now
+
+	err := m.lookup(ctx, verifyPrefix+d.Domain, verifyValue(d.Token))
+	if err == nil {
+		err = m.lookup(ctx, dkimName(d.Selector, d.Domain), dkimValue(d.Key))
+	}
+	if err != nil {
+		d.LastError = err.Error()
+		if d.Status == StatusVerified {
+			d.Status = StatusFailed
+		}
+		return
+	}
+
+	if d.PendingKey != nil && m.lookup(ctx, dkimName(d.PendingSelector, d.Domain), dkimValue(d.PendingKey)) == nil {
+		d.Selector, d.Key = d.PendingSelector, d.PendingKey
+		d.PendingSelector, d.PendingKey = "", nil
+	}
+	d.LastError = ""
+	if d.Status != StatusVerified {
+		d.Status, d.VerifiedAt = StatusVerified, &now
+	}
+}
+
+// lookup reports whether name has a TXT record with want. DKIM records are
+// compared without whitespace, since DNS providers split and space long
+// values differently.
+func (m *Manager) lookup(ctx context.Context, name, want string) error {
+	values, err := m.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("look up %s: %w", name, err)
+	}
+	for _, v := range values {
+		if strings.Join(strings.Fields(v), "") == strings.Join(strings.Fields(want), "") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no TXT record %q", name, want)
+}
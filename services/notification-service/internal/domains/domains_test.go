@@ -0,0 +1,238 @@
+package domains
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	keyBits = 1024
+}
+
+type memStore struct {
+	domains map[string]Domain
+	err     error
+}
+
+func (s *memStore) Get(ctx context.Context) (*Domain, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	d, ok := s.domains[tenant.FromContext(ctx)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &d, nil
+}
+
+func (s *memStore) Save(ctx context.Context, d *Domain) error {
+	d.Tenant = tenant.FromContext(ctx)
+	s.domains[d.Tenant] = *d
+	return nil
+}
+
+func (s *memStore) Delete(ctx context.Context) error {
+	delete(s.domains, tenant.FromContext(ctx))
+	return nil
+}
+
+func (s *memStore) ListAll(ctx context.Context) ([]Domain, error) {
+	all := []Domain{}
+	for _, d := range s.domains {
+		all = append(all, d)
+	}
+	return all, nil
+}
+
+// dns serves the records a test has published.
+type dns map[string][]string
+
+func (r dns) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if v, ok := r[name]; ok {
+		return v, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+// publish adds d's records, splitting DKIM values the way DNS providers do.
+func (r dns) publish(d *Domain) {
+	for _, rec := range d.Records() {
+		v := rec.Value
+		if rec.Purpose != "ownership" {
+			v = strings.Replace(v, "; ", ";  ", 1)
+		}
+		r[rec.Name] = append(r[rec.Name], v)
+	}
+}
+
+var platform = notifications.Identity{From: "notifications@platform.example"}
+
+func newManager(t *testing.T) (*Manager, *memStore, dns) {
+	store := &memStore{domains: map[string]Domain{}}
+	records := dns{}
+	m := NewManager(store, records, platform)
+	clock := time.Unix(1700000000, 0)
+	m.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+	return m, store, records
+}
+
+func TestVerifyAndFallback(t *testing.T) {
+	m, _, records := newManager(t)
+	ctx := tenant.NewContext(context.Background(), "acme")
+
+	d, err := m.Configure(ctx, "Mail.Acme.com.", "orders@mail.acme.com", "Acme Orders")
+	if err != nil {
+		t.Fatalf("Expected the domain to be configured, got: %v", err)
+	}
+	if d.Domain != "mail.acme.com" || d.Status != StatusPending || d.Key == nil || d.Token == "" {
+		t.Fatalf("Expected a pending domain with a key and token, got: %+v", d)
+	}
+	if id := m.Identity(ctx); id.From != platform.From || id.DKIM != nil {
+		t.Errorf("Expected a pending domain to fall back to the platform, got: %+v", id)
+	}
+
+	if d, _ = m.Verify(ctx); d.Status != StatusPending || d.LastError == "" {
+		t.Errorf("Expected verification to fail without records, got: %+v", d)
+	}
+
+	records.publish(d)
+	if d, _ = m.Verify(ctx); d.Status != StatusVerified || d.VerifiedAt == nil {
+		t.Fatalf("Expected the domain to verify once its records are published, got: %+v", d)
+	}
+	id := m.Identity(ctx)
+	if id.From != `"Acme Orders" <orders@mail.acme.com>` || id.DKIM == nil || id.DKIM.Domain != "mail.acme.com" || id.DKIM.Selector != d.Selector {
+		t.Errorf("Expected mail to go out signed from the tenant's domain, got: %+v", id)
+	}
+	if id := m.Identity(context.Background()); id.From != platform.From {
+		t.Errorf("Expected other tenants to keep the platform domain, got: %+v", id)
+	}
+
+	delete(records, dkimName(d.Selector, d.Domain))
+	if err := m.Sweep(context.Background()); err != nil {
+		t.Fatalf("Expected the sweep to succeed, got: %v", err)
+	}
+	if id := m.Identity(ctx); id.From != platform.From {
+		t.Errorf("Expected a domain that lost its DKIM record to fall back, got: %+v", id)
+	}
+	if d, _ := m.store.Get(ctx); d.Status != StatusFailed {
+		t.Errorf("Expected the domain to be marked failed, got: %s", d.Status)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	m, _, records := newManager(t)
+	ctx := context.Background()
+	d, _ := m.Configure(ctx, "acme.com", "orders@acme.com", "")
+	records.publish(d)
+	m.Verify(ctx)
+	old := d.Selector
+
+	d, err := m.Rotate(ctx)
+	if err != nil || d.PendingKey == nil || d.PendingSelector == old {
+		t.Fatalf("Expected a pending key under a new selector, got: %+v, %v", d, err)
+	}
+	if len(d.Records()) != 3 {
+		t.Errorf("Expected the rotated key's record to be listed, got: %+v", d.Records())
+	}
+	if d, _ = m.Verify(ctx); d.Selector != old || d.Status != StatusVerified {
+		t.Errorf("Expected signing to stay on the old key until the new one is published, got: %+v", d)
+	}
+
+	records.publish(d)
+	if d, _ = m.Verify(ctx); d.Selector == old || d.PendingKey != nil {
+		t.Errorf("Expected the published key to take over, got: %+v", d)
+	}
+	if id := m.Identity(ctx); id.DKIM.Selector != d.Selector {
+		t.Errorf("Expected mail to be signed with the new key, got: %s", id.DKIM.Selector)
+	}
+
+	if d, _ := m.Configure(ctx, "acme.com", "support@acme.com", "Support"); d.Status != StatusVerified {
+		t.Errorf("Expected a new from-address on the same domain to stay verified, got: %s", d.Status)
+	}
+	if d, _ := m.Configure(ctx, "shop.acme.com", "orders@shop.acme.com", ""); d.Status != StatusPending {
+		t.Errorf("Expected a new domain to start over, got: %s", d.Status)
+	}
+}
+
+func TestConfigureValidation(t *testing.T) {
+	m, _, _ := newManager(t)
+	tests := []struct {
+		name, domain, from string
+	}{
+		{"not a domain", "acme", "orders@acme"},
+		{"address elsewhere", "acme.com", "orders@gmail.com"},
+		{"address with a name", "acme.com", "Orders <orders@acme.com>"},
+		{"not an address", "acme.com", "orders"},
+	}
+	for _, tt := range tests {
+		if _, err := m.Configure(context.Background(), tt.domain, tt.from, ""); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, got: %v", tt.name, err)
+		}
+	}
+}
+
+func TestIdentityLookupFailure(t *testing.T) {
+	m, store, _ := newManager(t)
+	store.err = errors.New("connection refused")
+	if id := m.Identity(context.Background()); id.From != platform.From {
+		t.Errorf("Expected a failed lookup to fall back to the platform, got: %+v", id)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m, _, _ := newManager(t)
+
+	serve := func(roles []string, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: roles}) })
+		NewHandler(m).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	admin := []string{auth.RoleAdmin}
+
+	if w := serve([]string{"customer"}, http.MethodGet, "/sending-domain", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be forbidden, got: %d", w.Code)
+	}
+	if w := serve(admin, http.MethodGet, "/sending-domain", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 before a domain is configured, got: %d", w.Code)
+	}
+	if w := serve(admin, http.MethodPut, "/sending-domain", `{"domain": "acme.com", "from_address": "orders@gmail.com"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a from-address off the domain to be rejected, got: %d", w.Code)
+	}
+
+	w := serve(admin, http.MethodPut, "/sending-domain", `{"domain": "acme.com", "from_address": "orders@acme.com"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the domain to be configured, got: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Status  string   `json:"status"`
+		Records []Record `json:"dns_records"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Status != StatusPending || len(resp.Records) != 2 || strings.Contains(w.Body.String(), "PRIVATE") {
+		t.Errorf("Expected the pending domain with its DNS records and no private key, got: %s", w.Body.String())
+	}
+
+	if w := serve(admin, http.MethodDelete, "/sending-domain", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the domain to be removed, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package domains
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	manager *Manager
+}
+
+func NewHandler(manager *Manager) *Handler {
+	return &Handler{manager: manager}
+}
+
+// RegisterRoutes mounts the tenant's sending domain. Tenant admins manage
+// their own tenant's domain only.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	admin := auth.RequireRole(auth.RoleAdmin)
+	router.GET("/sending-domain", admin, h.get)
+	router.PUT("/sending-domain", admin, h.configure)
+	router.DELETE("/sending-domain", admin, h.remove)
+	router.POST("/sending-domain/verify", admin, h.verify)
+	router.POST("/sending-domain/dkim/rotate", admin, h.rotate)
+}
+
+type domainResponse struct {
+	*Domain
+	Records []Record `json:"dns_records"`
+}
+
+func (h *Handler) respond(c *gin.Context, d *Domain, err error) {
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no sending domain is configured"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, domainResponse{Domain: d, Records: d.Records()})
+}
+
+func (h *Handler) get(c *gin.Context) {
+	d, err := h.manager.store.Get(c.Request.Context())
+	h.respond(c, d, err)
+}
+
+type configureRequest struct {
+	Domain      string `json:"domain" binding:"required"`
+	FromAddress string `json:"from_address" binding:"required"`
+	FromName    string `json:"from_name" binding:"max=100"`
+}
+
+func (h *Handler) configure(c *gin.Context) {
+	var req configureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	d, err := h.manager.Configure(c.Request.Context(), req.Domain, req.FromAddress, req.FromName)
+	if errors.Is(err, ErrInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.respond(c, d, err)
+}
+
+func (h *Handler) remove(c *gin.Context) {
+	err := h.manager.Remove(c.Request.Context())
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no sending domain is configured"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) verify(c *gin.Context) {
+	d, err := h.manager.Verify(c.Request.Context())
+	h.respond(c, d, err)
+}
+
+func (h *Handler) rotate(c *gin.Context) {
+	d, err := h.manager.Rotate(c.Request.Context())
+	h.respond(c, d, err)
+}
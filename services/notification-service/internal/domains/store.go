@@ -0,0 +1,144 @@
+package domains
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// Store keeps one sending domain per tenant, with its DKIM keys.
+type Store interface {
+	Get(ctx context.Context) (*Domain, error)
+	Save(ctx context.Context, d *Domain) error
+	Delete(ctx context.Context) error
+	// ListAll returns every tenant's domain, for the verification sweep.
+	ListAll(ctx context.Context) ([]Domain, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const domainColumns = `tenant_id, domain, from_address, COALESCE(from_name, ''), status, COALESCE(last_error, ''),
+	checked_at, verified_at, verification_token, dkim_selector, dkim_private_key,
+	COALESCE(pending_selector, ''), COALESCE(pending_private_key, '')`
+
+func scanDomain(row interface{ Scan(...any) error }) (*Domain, error) {
+	var d Domain
+	var key, pendingKey string
+	if err := row.Scan(&d.Tenant, &d.Domain, &d.FromAddress, &d.FromName, &d.Status, &d.LastError,
+		&d.CheckedAt, &d.VerifiedAt, &d.Token, &d.Selector, &key, &d.PendingSelector, &pendingKey); err != nil {
+		return nil, err
+	}
+	var err error
+	if d.Key, err = parseKey(key); err != nil {
+		return nil, err
+	}
+	if pendingKey != "" {
+		if d.PendingKey, err = parseKey(pendingKey); err != nil {
+			return nil, err
+		}
+	}
+	return &d, nil
+}
+
+func encodeKey(key *rsa.PrivateKey) string {
+	if key == nil {
+		return ""
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func parseKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("stored DKIM key is not PEM")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("stored DKIM key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context) (*Domain, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + domainColumns + ` FROM notification_service.sending_domains WHERE tenant_id = $1`
+	d, err := scanDomain(s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return d, err
+}
+
+func (s *PostgresStore) Save(ctx context.Context, d *Domain) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO notification_service.sending_domains
+		(tenant_id, domain, from_address, from_name, status, last_error, checked_at, verified_at,
+			verification_token, dkim_selector, dkim_private_key, pending_selector, pending_private_key, updated_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, ''), NOW())
+		ON CONFLICT (tenant_id) DO UPDATE SET
+			domain = EXCLUDED.domain, from_address = EXCLUDED.from_address, from_name = EXCLUDED.from_name,
+			status = EXCLUDED.status, last_error = EXCLUDED.last_error, checked_at = EXCLUDED.checked_at,
+			verified_at = EXCLUDED.verified_at, verification_token = EXCLUDED.verification_token,
+			dkim_selector = EXCLUDED.dkim_selector, dkim_private_key = EXCLUDED.dkim_private_key,
+			pending_selector = EXCLUDED.pending_selector, pending_private_key = EXCLUDED.pending_private_key,
+			updated_at = NOW()`
+	_, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx), d.Domain, d.FromAddress, d.FromName, d.Status, d.LastError,
+		d.CheckedAt, d.VerifiedAt, d.Token, d.Selector, encodeKey(d.Key), d.PendingSelector, encodeKey(d.PendingKey))
+	return err
+}
+
+func (s *PostgresStore) Delete(ctx context.Context) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM notification_service.sending_domains WHERE tenant_id = $1`
+	res, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) ListAll(ctx context.Context) ([]Domain, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + domainColumns + ` FROM notification_service.sending_domains ORDER BY tenant_id`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := []Domain{}
+	for rows.Next() {
+		d, err := scanDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *d)
+	}
+	return all, rows.Err()
+}
@@ -0,0 +1,250 @@
+// Package inbound receives replies to notification emails from the mail
+// provider's inbound webhook and publishes them as email.reply_received
+// events.
+package inbound
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/scanning"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SignatureHeader = "X-Inbound-Signature"
+	maxEmailBytes   = 10 << 20
+)
+
+// Email is the provider-neutral webhook payload. Providers that post a
+// different shape need a small adapter in front of this endpoint.
+type Email struct {
+	MessageID   string       `json:"message_id"`
+	From        string       `json:"from"`
+	To          []string     `json:"to"`
+	Cc          []string     `json:"cc"`
+	Subject     string       `json:"subject"`
+	Text        string       `json:"text"`
+	HTML        string       `json:"html"`
+	InReplyTo   string       `json:"in_reply_to"`
+	References  []string     `json:"references"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment is a file attached to an inbound email, with its content
+// base64-encoded in the payload.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// Notifications finds the notification a reply token was issued for.
+type Notifications interface {
+	FindByReplyToken(ctx context.Context, token string) (*notifications.Notification, error)
+}
+
+type Handler struct {
+	store         Store
+	notifications Notifications
+	publisher     events.Publisher
+	secret        []byte
+	guard         *scanning.Guard
+	replyAddress  *regexp.Regexp
+	messageID     *regexp.Regexp
+}
+
+// NewHandler accepts webhooks signed with secret for replies addressed to
+// replyDomain, the domain notifications.Dispatcher puts in Reply-To. The
+// attachments of matched replies are scanned with guard, unless it is nil.
+func NewHandler(store Store, notifications Notifications, publisher events.Publisher, guard *scanning.Guard, replyDomain, secret string) *Handler {
+	domain := regexp.QuoteMeta(strings.ToLower(replyDomain))
+	return &Handler{
+		store:         store,
+		notifications: notifications,
+		publisher:     publisher,
+		guard:         guard,
+		secret:        []byte(secret),
+		replyAddress:  regexp.MustCompile(`reply\+([0-9a-f]{32})@` + domain),
+		messageID:     regexp.MustCompile(`<([0-9a-f]{32})@` + domain + `>`),
+	}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/inbound/email", h.receive)
+}
+
+// verify checks the hex HMAC-SHA256 of the raw body in SignatureHeader.
+func (h *Handler) verify(body []byte, signature string) bool {
+	want, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// replyToken looks for the token in the recipients first, then in the
+// threading headers, since some clients drop Reply-To on reply-all.
+func (h *Handler) replyToken(e Email) string {
+	for _, addr := range append(append([]string{}, e.To...), e.Cc...) {
+		if m := h.replyAddress.FindStringSubmatch(strings.ToLower(addr)); m != nil {
+			return m[1]
+		}
+	}
+	for _, id := range append([]string{e.InReplyTo}, e.References...) {
+		if m := h.messageID.FindStringSubmatch(strings.ToLower(id)); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// receive always answers 2xx for emails it cannot match, so the provider
+// does not retry them, and 5xx only when retrying can help. Retries of a
+// recorded reply are deduplicated by Message-ID.
+func (h *Handler) receive(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxEmailBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.verify(body, c.GetHeader(SignatureHeader)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid webhook signature"})
+		return
+	}
+
+	var e Email
+	if err := json.Unmarshal(body, &e); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if e.MessageID == "" || e.From == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message_id and from are required"})
+		return
+	}
+
+	token := h.replyToken(e)
+	if token == "" {
+		log.Printf("Inbound email %s from %s matches no notification", e.MessageID, e.From)
+		c.JSON(http.StatusOK, gin.H{"status": "unmatched"})
+		return
+	}
+	n, err := h.notifications.FindByReplyToken(c.Request.Context(), token)
+	if errors.Is(err, notifications.ErrNotFound) {
+		log.Printf("Inbound email %s from %s has unknown reply token", e.MessageID, e.From)
+		c.JSON(http.StatusOK, gin.H{"status": "unmatched"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	quarantined, err := h.scan(c.Request.Context(), e)
+	if err != nil {
+		log.Printf("Failed to scan attachments of inbound email %s: %v", e.MessageID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "attachments could not be scanned"})
+		return
+	}
+
+	text := e.Text
+	if strings.TrimSpace(text) == "" {
+		text = htmlToText(e.HTML)
+	}
+	r := &Reply{
+		NotificationID: n.ID,
+		MessageID:      e.MessageID,
+		From:           e.From,
+		Subject:        e.Subject,
+		Body:           ExtractReply(text),
+	}
+	created, err := h.store.Record(c.Request.Context(), r, text)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !created && r.Published {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate", "reply": r})
+		return
+	}
+
+	if err := h.publish(c.Request.Context(), r, n); err != nil {
+		log.Printf("Failed to publish reply %d: %v", r.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to publish reply event"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": "received", "reply": r, "quarantined": quarantined})
+}
+
+// scan checks e's attachments and returns the IDs of the ones quarantined.
+// An attachment that cannot be scanned fails the whole email, so the
+// provider delivers it again later; the ones already quarantined are
+// found again rather than queued twice.
+func (h *Handler) scan(ctx context.Context, e Email) ([]int64, error) {
+	quarantined := []int64{}
+	if h.guard == nil {
+		return quarantined, nil
+	}
+	for _, a := range e.Attachments {
+		item, err := h.guard.Check(ctx, scanning.File{
+			Source: scanning.SourceInbound, Reference: e.MessageID, Filename: a.Filename, ContentType: a.ContentType, Data: a.Content,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			log.Printf("Quarantined attachment %q of inbound email %s from %s: %s", a.Filename, e.MessageID, e.From, item.Signature)
+			quarantined = append(quarantined, item.ID)
+		}
+	}
+	return quarantined, nil
+}
+
+func (h *Handler) publish(ctx context.Context, r *Reply, n *notifications.Notification) error {
+	e, err := events.New(events.EmailReplyReceived, "notification-service", events.ReplyReceived{
+		ReplyID:        r.ID,
+		NotificationID: n.ID,
+		UserID:         n.UserID,
+		From:           r.From,
+		FromRecipient:  sameAddress(r.From, n.Recipient),
+		Subject:        r.Subject,
+		Body:           r.Body,
+		ContextType:    n.ContextType,
+		ContextID:      n.ContextID,
+		ThreadID:       n.ThreadID,
+		ReceivedAt:     r.ReceivedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if err := h.publisher.Publish(ctx, e); err != nil {
+		return err
+	}
+	return h.store.MarkPublished(ctx, r.ID)
+}
+
+// sameAddress compares the address parts of two emails, ignoring display
+// names and case.
+func sameAddress(a, b string) bool {
+	parse := func(s string) string {
+		if addr, err := mail.ParseAddress(s); err == nil {
+			return strings.ToLower(addr.Address)
+		}
+		return strings.ToLower(strings.TrimSpace(s))
+	}
+	return parse(a) == parse(b)
+}
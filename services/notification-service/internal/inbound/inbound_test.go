@@ -0,0 +1,166 @@
+package inbound
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/gin-gonic/gin"
+)
+
+const token = "0123456789abcdef0123456789abcdef"
+
+func TestExtractReply(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{
+			name: "gmail quote wrapped over two lines",
+			text: "Yes, please ship it.\r\n\r\nOn Mon, 6 May 2024 at 10:00, Orders <reply+x@example.com>\r\nwrote:\r\n> Order #42 needs your approval\r\n",
+			want: "Yes, please ship it.",
+		},
+		{
+			name: "signature and inline quotes",
+			text: "> Order #42 needs your approval\nApproved.\n\nThanks\n-- \nJane Doe\nAcme Corp",
+			want: "Approved.\n\nThanks",
+		},
+		{
+			name: "outlook original message",
+			text: "Looks fine\n\n-----Original Message-----\nFrom: Orders\nSent: Monday\n",
+			want: "Looks fine",
+		},
+		{
+			name: "outlook header block",
+			text: "Go ahead\n\nFrom: Orders <orders@example.com>\nSent: Monday, May 6, 2024\nSubject: Order #42\n",
+			want: "Go ahead",
+		},
+		{
+			name: "mobile signature",
+			text: "ok\n\nSent from my iPhone",
+			want: "ok",
+		},
+	}
+	for _, tt := range tests {
+		if got := ExtractReply(tt.text); got != tt.want {
+			t.Errorf("%s: ExtractReply() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+type memStore struct {
+	replies map[string]*Reply
+}
+
+func (s *memStore) Record(ctx context.Context, r *Reply, rawBody string) (bool, error) {
+	if existing, ok := s.replies[r.MessageID]; ok {
+		*r = *existing
+		return false, nil
+	}
+	r.ID = int64(len(s.replies) + 1)
+	s.replies[r.MessageID] = r
+	return true, nil
+}
+
+func (s *memStore) MarkPublished(ctx context.Context, id int64) error {
+	for _, r := range s.replies {
+		if r.ID == id {
+			r.Published = true
+		}
+	}
+	return nil
+}
+
+type lookup map[string]*notifications.Notification
+
+func (l lookup) FindByReplyToken(ctx context.Context, token string) (*notifications.Notification, error) {
+	n, ok := l[token]
+	if !ok {
+		return nil, notifications.ErrNotFound
+	}
+	return n, nil
+}
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+func sign(body string) string {
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestReceive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	userID := 7
+	publisher := &recordingPublisher{}
+	h := NewHandler(&memStore{replies: map[string]*Reply{}}, lookup{token: {Notification: models.Notification{
+		ID: 3, UserID: &userID, Recipient: "admin@example.com", ContextType: "order", ContextID: "42",
+	}}}, publisher, nil, "replies.example.com", "webhook-secret")
+	router := gin.New()
+	h.RegisterRoutes(router)
+
+	post := func(body, signature string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/inbound/email", strings.NewReader(body))
+		req.Header.Set(SignatureHeader, signature)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	reply := `{"message_id": "<abc@mail.example.com>", "from": "Admin <Admin@Example.com>",
+		"to": ["Orders <reply+` + token + `@replies.example.com>"], "subject": "Re: Order #42",
+		"text": "Approved\n\nOn Mon, Orders wrote:\n> Order #42 needs your approval"}`
+
+	if w := post(reply, "sha256=00"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a bad signature, got: %d", w.Code)
+	}
+
+	if w := post(reply, sign(reply)); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got: %d %s", w.Code, w.Body)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].Type != events.EmailReplyReceived {
+		t.Fatalf("Expected one email.reply_received event, got: %+v", publisher.published)
+	}
+	var got events.ReplyReceived
+	if err := publisher.published[0].Decode(&got); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if got.Body != "Approved" || got.ContextType != "order" || got.ContextID != "42" || !got.FromRecipient || got.NotificationID != 3 {
+		t.Errorf("Expected the stripped reply routed to order 42, got: %+v", got)
+	}
+
+	if w := post(reply, sign(reply)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "duplicate") {
+		t.Errorf("Expected a redelivery to be a duplicate, got: %d %s", w.Code, w.Body)
+	}
+	if len(publisher.published) != 1 {
+		t.Errorf("Expected no event for a redelivery, got: %d events", len(publisher.published))
+	}
+
+	threaded := `{"message_id": "<def@mail.example.com>", "from": "other@example.com", "to": ["orders@example.com"],
+		"in_reply_to": "<` + token + `@replies.example.com>", "html": "<p>Fine by me</p>"}`
+	if w := post(threaded, sign(threaded)); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected a reply matched by In-Reply-To to be accepted, got: %d %s", w.Code, w.Body)
+	}
+	if err := publisher.published[1].Decode(&got); err != nil || got.Body != "Fine by me" || got.FromRecipient {
+		t.Errorf("Expected the HTML reply from another sender, got: %+v, %v", got, err)
+	}
+
+	unmatched := `{"message_id": "<ghi@mail.example.com>", "from": "x@example.com", "to": ["orders@example.com"], "text": "hi"}`
+	if w := post(unmatched, sign(unmatched)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "unmatched") {
+		t.Errorf("Expected an unmatched email to be acknowledged, got: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,56 @@
+package inbound
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// quoteHeaders mark where a client starts quoting the original message.
+	quoteHeaders = []*regexp.Regexp{
+		// Gmail and Apple Mail, which may wrap the attribution onto two lines.
+		regexp.MustCompile(`(?m)^On\b[^\n]*(\n[^\n]*)?\bwrote:[ \t]*$`),
+		regexp.MustCompile(`(?mi)^-{2,}[ \t]*Original Message[ \t]*-{2,}[ \t]*$`),
+		// Outlook's header block.
+		regexp.MustCompile(`(?m)^_{10,}[ \t]*$`),
+		regexp.MustCompile(`(?m)^From: [^\n]+\n(?:[^\n]+\n)*?(?:Sent|Date): `),
+	}
+	signatureLines = regexp.MustCompile(`(?mi)^(?:--[ \t]?|Sent from my [^\n]+|Get Outlook for [^\n]+)$`)
+	lineBreakTags  = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>`)
+	htmlTags       = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLines     = regexp.MustCompile(`\n{3,}`)
+)
+
+// ExtractReply returns only what the sender wrote: the quoted original
+// message, quoted lines and the signature are removed.
+func ExtractReply(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	cut := len(text)
+	for _, re := range quoteHeaders {
+		if loc := re.FindStringIndex(text); loc != nil && loc[0] < cut {
+			cut = loc[0]
+		}
+	}
+	if loc := signatureLines.FindStringIndex(text[:cut]); loc != nil {
+		cut = loc[0]
+	}
+	text = text[:cut]
+
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), ">") {
+			continue
+		}
+		kept = append(kept, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(kept, "\n"), "\n\n"))
+}
+
+// htmlToText is a fallback for providers that only deliver an HTML part.
+func htmlToText(s string) string {
+	s = lineBreakTags.ReplaceAllString(s, "\n")
+	return html.UnescapeString(htmlTags.ReplaceAllString(s, ""))
+}
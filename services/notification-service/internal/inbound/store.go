@@ -0,0 +1,71 @@
+package inbound
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+)
+
+// Reply is an inbound email matched to the notification it answers.
+type Reply struct {
+	ID             int64     `json:"id"`
+	NotificationID int       `json:"notification_id"`
+	MessageID      string    `json:"message_id"`
+	From           string    `json:"from"`
+	Subject        string    `json:"subject"`
+	Body           string    `json:"body"`
+	ReceivedAt     time.Time `json:"received_at"`
+	Published      bool      `json:"-"`
+}
+
+type Store interface {
+	// Record stores r unless a reply with its MessageID exists, in which case
+	// the existing reply is returned with created false.
+	Record(ctx context.Context, r *Reply, rawBody string) (created bool, err error)
+	MarkPublished(ctx context.Context, id int64) error
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Record(ctx context.Context, r *Reply, rawBody string) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const insert string = `INSERT INTO notification_service.inbound_replies
+		(notification_id, message_id, from_address, subject, body, raw_body)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (message_id) DO NOTHING
+		RETURNING id, received_at`
+	err := s.db.QueryRowContext(ctx, insert, r.NotificationID, r.MessageID, r.From, r.Subject, r.Body, rawBody).
+		Scan(&r.ID, &r.ReceivedAt)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	const existing string = `SELECT id, notification_id, from_address, subject, body, received_at, published
+		FROM notification_service.inbound_replies WHERE message_id = $1`
+	err = s.db.QueryRowContext(ctx, existing, r.MessageID).
+		Scan(&r.ID, &r.NotificationID, &r.From, &r.Subject, &r.Body, &r.ReceivedAt, &r.Published)
+	return false, err
+}
+
+func (s *PostgresStore) MarkPublished(ctx context.Context, id int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.inbound_replies SET published = TRUE WHERE id = $1`
+	_, err := s.db.ExecContext(ctx, query, id)
+	return err
+}
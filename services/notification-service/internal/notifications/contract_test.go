@@ -0,0 +1,39 @@
+package notifications
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients/contracttest"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+type listStore struct {
+	Store
+	notifications []Notification
+}
+
+func (s *listStore) ListByUser(ctx context.Context, userID, limit int) ([]Notification, error) {
+	return s.notifications, nil
+}
+
+// TestGatewayContract checks the answers the gateway's dashboard relies on.
+// The gateway forwards the customer's own token.
+func TestGatewayContract(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	userID := 7
+	sent := time.Date(2026, 1, 1, 12, 0, 5, 0, time.UTC)
+	store := &listStore{notifications: []Notification{{Notification: models.Notification{
+		ID: 1, UserID: &userID, Recipient: "ada@example.com", Channel: "email", Subject: "Order #42 shipped",
+		Body: "On its way", Status: StatusSent, CreatedAt: sent.Add(-5 * time.Second), SentAt: &sent,
+		ContextType: "order", ContextID: "42", ReplyTo: "reply+abc@replies.example.com",
+	}}}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, &auth.Principal{UserID: 7, Roles: []string{"customer"}}) })
+	NewHandler(store, nil, nil, nil).RegisterRoutes(router)
+
+	contracttest.Verify(t, router, contracttest.Load(t, "api-gateway", "notification-service"))
+}
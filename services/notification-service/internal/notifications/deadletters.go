@@ -0,0 +1,243 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// ErrRedriven is returned for a dead letter that was already re-driven.
+var ErrRedriven = errors.New("dead letter already re-driven")
+
+// Attempt is one delivery attempt of a notification. At is set by the
+// store.
+type Attempt struct {
+	Status   string    `json:"status"`
+	Provider string    `json:"provider,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"attempted_at"`
+}
+
+// DeadLetter is a notification that failed every delivery attempt, as it
+// stood when it was dead-lettered.
+type DeadLetter struct {
+	ID             int64  `json:"id"`
+	NotificationID int    `json:"notification_id"`
+	Recipient      string `json:"recipient"`
+	Channel        string `json:"channel"`
+	Type           string `json:"type"`
+	Subject        string `json:"subject"`
+	// Provider and Error are from the last attempt.
+	Provider       string     `json:"provider"`
+	Error          string     `json:"error"`
+	Attempts       int        `json:"attempts"`
+	DeadLetteredAt time.Time  `json:"dead_lettered_at"`
+	RedrivenAt     *time.Time `json:"redriven_at,omitempty"`
+	// Notification and History are only loaded by GetDeadLetter.
+	Notification *Notification `json:"notification,omitempty"`
+	History      []Attempt     `json:"history,omitempty"`
+}
+
+// Dead letter states to filter by.
+const (
+	DeadLetterPending  = "pending"
+	DeadLetterRedriven = "redriven"
+)
+
+// DeadLetterFilter narrows ListDeadLetters. Empty fields match everything;
+// Before pages by ID.
+type DeadLetterFilter struct {
+	Provider string
+	State    string
+	Before   int64
+	Limit    int
+}
+
+// DeadLetterStore reads the tenant's dead-letter queue and re-drives it. A
+// re-driven notification goes back to failed with no attempts, so the
+// Retrier picks it up on its next sweep with its full attempt budget.
+type DeadLetterStore interface {
+	// ListDeadLetters returns dead letters newest first.
+	ListDeadLetters(ctx context.Context, f DeadLetterFilter) ([]DeadLetter, error)
+	// GetDeadLetter returns the dead letter with its notification and every
+	// attempt to deliver it, oldest first.
+	GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error)
+	// Redrive returns ErrRedriven if the dead letter was already re-driven.
+	Redrive(ctx context.Context, id int64) (*DeadLetter, error)
+	// RedriveAll re-drives up to limit pending dead letters from provider,
+	// or from every provider if it is empty, and returns how many.
+	RedriveAll(ctx context.Context, provider string, limit int) (int, error)
+}
+
+const deadLetterColumns = `d.id, d.notification_id, n.recipient, n.channel, n.type, n.subject,
+	d.provider, d.error, d.attempts, d.dead_lettered_at, d.redriven_at`
+
+func scanDeadLetter(row interface{ Scan(...any) error }) (*DeadLetter, error) {
+	var d DeadLetter
+	if err := row.Scan(&d.ID, &d.NotificationID, &d.Recipient, &d.Channel, &d.Type, &d.Subject,
+		&d.Provider, &d.Error, &d.Attempts, &d.DeadLetteredAt, &d.RedrivenAt); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// DeadLetter moves up to limit failed notifications with maxAttempts
+// attempts or more, from every tenant, into the dead-letter queue. Rows
+// another sweep is moving are skipped.
+func (s *PostgresStore) DeadLetter(ctx context.Context, maxAttempts, limit int) ([]DeadLetter, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `WITH dead AS (
+			UPDATE notification_service.notifications SET status = 'dead_lettered'
+			WHERE id IN (SELECT id FROM notification_service.notifications
+				WHERE status = 'failed' AND attempts >= $1 ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED)
+			RETURNING id, tenant_id, COALESCE(provider, '') AS provider, COALESCE(last_error, '') AS error, attempts)
+		INSERT INTO notification_service.dead_letters (notification_id, tenant_id, provider, error, attempts)
+		SELECT id, tenant_id, provider, error, attempts FROM dead
+		RETURNING id, notification_id, provider, error, attempts, dead_lettered_at`
+	rows, err := s.db.QueryContext(ctx, query, maxAttempts, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dead := []DeadLetter{}
+	for rows.Next() {
+		var d DeadLetter
+		if err := rows.Scan(&d.ID, &d.NotificationID, &d.Provider, &d.Error, &d.Attempts, &d.DeadLetteredAt); err != nil {
+			return nil, err
+		}
+		dead = append(dead, d)
+	}
+	return dead, rows.Err()
+}
+
+func (s *PostgresStore) ListDeadLetters(ctx context.Context, f DeadLetterFilter) ([]DeadLetter, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + deadLetterColumns + `
+		FROM notification_service.dead_letters d
+		JOIN notification_service.notifications n ON n.id = d.notification_id
+		WHERE d.tenant_id = $1 AND ($2 = '' OR d.provider = $2)
+			AND ($3 = '' OR ($3 = 'pending') = (d.redriven_at IS NULL))
+			AND ($4 = 0 OR d.id < $4)
+		ORDER BY d.id DESC LIMIT $5`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), f.Provider, f.State, f.Before, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dead := []DeadLetter{}
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		dead = append(dead, *d)
+	}
+	return dead, rows.Err()
+}
+
+func (s *PostgresStore) GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + deadLetterColumns + `
+		FROM notification_service.dead_letters d
+		JOIN notification_service.notifications n ON n.id = d.notification_id
+		WHERE d.id = $1 AND d.tenant_id = $2`
+	d, err := scanDeadLetter(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	const notification string = `SELECT ` + notificationColumns + ` FROM notification_service.notifications WHERE id = $1`
+	if d.Notification, err = scanNotification(s.db.QueryRowContext(ctx, notification, d.NotificationID)); err != nil {
+		return nil, err
+	}
+
+	const attempts string = `SELECT status, provider, error, attempted_at FROM notification_service.notification_attempts
+		WHERE notification_id = $1 ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, attempts, d.NotificationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	d.History = []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		if err := rows.Scan(&a.Status, &a.Provider, &a.Error, &a.At); err != nil {
+			return nil, err
+		}
+		d.History = append(d.History, a)
+	}
+	return d, rows.Err()
+}
+
+func (s *PostgresStore) Redrive(ctx context.Context, id int64) (*DeadLetter, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const query string = `SELECT ` + deadLetterColumns + `
+		FROM notification_service.dead_letters d
+		JOIN notification_service.notifications n ON n.id = d.notification_id
+		WHERE d.id = $1 AND d.tenant_id = $2 FOR UPDATE OF d`
+	d, err := scanDeadLetter(tx.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.RedrivenAt != nil {
+		return nil, ErrRedriven
+	}
+
+	const redrive string = `UPDATE notification_service.dead_letters SET redriven_at = NOW() WHERE id = $1 RETURNING redriven_at`
+	if err := tx.QueryRowContext(ctx, redrive, id).Scan(&d.RedrivenAt); err != nil {
+		return nil, err
+	}
+	const reset string = `UPDATE notification_service.notifications SET status = 'failed', attempts = 0, last_attempt_at = NULL
+		WHERE id = $1 AND status = 'dead_lettered'`
+	if _, err := tx.ExecContext(ctx, reset, d.NotificationID); err != nil {
+		return nil, err
+	}
+	return d, tx.Commit()
+}
+
+func (s *PostgresStore) RedriveAll(ctx context.Context, provider string, limit int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `WITH redriven AS (
+			UPDATE notification_service.dead_letters SET redriven_at = NOW()
+			WHERE id IN (SELECT id FROM notification_service.dead_letters
+				WHERE tenant_id = $1 AND redriven_at IS NULL AND ($2 = '' OR provider = $2)
+				ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED)
+			RETURNING notification_id)
+		UPDATE notification_service.notifications SET status = 'failed', attempts = 0, last_attempt_at = NULL
+		WHERE id IN (SELECT notification_id FROM redriven) AND status = 'dead_lettered'`
+	res, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx), provider, limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,140 @@
+package notifications
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDeadLetterLimit = 50
+	maxDeadLetterLimit     = 200
+	// maxRedriveAll bounds one bulk re-drive; repeat it to drain more.
+	maxRedriveAll = 500
+)
+
+// DeadLetterHandler lets admins and services inspect the tenant's
+// dead-letter queue and re-drive it.
+type DeadLetterHandler struct {
+	store DeadLetterStore
+}
+
+func NewDeadLetterHandler(store DeadLetterStore) *DeadLetterHandler {
+	return &DeadLetterHandler{store: store}
+}
+
+func (h *DeadLetterHandler) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/notifications/dead-letters", auth.RequireRole(auth.RoleAdmin, auth.RoleService))
+	group.GET("", h.list)
+	group.GET("/:id", h.get)
+	group.POST("/:id/redrive", h.redrive)
+	group.POST("/redrive", h.redriveAll)
+}
+
+// list pages through dead letters newest first. Pass next_before from a
+// page as ?before= to get the next one. ?state= is pending, redriven or
+// omitted for both.
+func (h *DeadLetterHandler) list(c *gin.Context) {
+	f := DeadLetterFilter{Provider: c.Query("provider"), State: c.Query("state")}
+	switch f.State {
+	case "", DeadLetterPending, DeadLetterRedriven:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state must be pending or redriven"})
+		return
+	}
+	if raw := c.Query("before"); raw != "" {
+		var err error
+		if f.Before, err = strconv.ParseInt(raw, 10, 64); err != nil || f.Before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a dead letter id"})
+			return
+		}
+	}
+	f.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDeadLetterLimit)))
+	if f.Limit <= 0 || f.Limit > maxDeadLetterLimit {
+		f.Limit = defaultDeadLetterLimit
+	}
+
+	// One extra entry tells whether there is another page.
+	limit := f.Limit
+	f.Limit++
+	dead, err := h.store.ListDeadLetters(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"dead_letters": dead}
+	if len(dead) > limit {
+		dead = dead[:limit]
+		resp["dead_letters"] = dead
+		resp["next_before"] = dead[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *DeadLetterHandler) get(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dead letter id"})
+		return
+	}
+	d, err := h.store.GetDeadLetter(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// redrive answers 202: the notification is delivered by the next retry
+// sweep, not by the request.
+func (h *DeadLetterHandler) redrive(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dead letter id"})
+		return
+	}
+	d, err := h.store.Redrive(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return
+	}
+	if errors.Is(err, ErrRedriven) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, d)
+}
+
+type redriveAllRequest struct {
+	// Provider limits the re-drive to one provider's dead letters, such as
+	// after its outage ends.
+	Provider string `json:"provider"`
+}
+
+// redriveAll takes an optional body; without one it re-drives every
+// provider's dead letters.
+func (h *DeadLetterHandler) redriveAll(c *gin.Context) {
+	var req redriveAllRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	n, err := h.store.RedriveAll(c.Request.Context(), req.Provider, maxRedriveAll)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"redriven": n, "more": n == maxRedriveAll})
+}
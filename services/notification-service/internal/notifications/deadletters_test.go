@@ -0,0 +1,157 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+func (s *memStore) ListDeadLetters(ctx context.Context, f DeadLetterFilter) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []DeadLetter{}
+	for i := len(s.dead) - 1; i >= 0 && len(out) < f.Limit; i-- {
+		d := s.dead[i]
+		pending := d.RedrivenAt == nil
+		if f.Provider != "" && d.Provider != f.Provider || f.State != "" && (f.State == DeadLetterPending) != pending ||
+			f.Before != 0 && d.ID >= f.Before {
+			continue
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func (s *memStore) GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || int(id) > len(s.dead) {
+		return nil, ErrNotFound
+	}
+	d := s.dead[id-1]
+	n := s.created[d.NotificationID-1]
+	d.Notification, d.History = &n, s.history[n.ID]
+	return &d, nil
+}
+
+func (s *memStore) Redrive(ctx context.Context, id int64) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || int(id) > len(s.dead) {
+		return nil, ErrNotFound
+	}
+	d := &s.dead[id-1]
+	if d.RedrivenAt != nil {
+		return nil, ErrRedriven
+	}
+	now := time.Now()
+	d.RedrivenAt = &now
+	s.created[d.NotificationID-1].Status, s.created[d.NotificationID-1].Attempts = StatusFailed, 0
+	redriven := *d
+	return &redriven, nil
+}
+
+func (s *memStore) RedriveAll(ctx context.Context, provider string, limit int) (int, error) {
+	redriven := 0
+	for _, d := range s.dead {
+		if d.RedrivenAt == nil && (provider == "" || d.Provider == provider) && redriven < limit {
+			if _, err := s.Redrive(ctx, d.ID); err != nil {
+				return redriven, err
+			}
+			redriven++
+		}
+	}
+	return redriven, nil
+}
+
+func TestDeadLetters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	sender := &flakySender{failures: 2}
+	dispatcher := NewDispatcher(store, sender, events.LogPublisher{}, nil, nil, nil, "")
+	retrier := NewRetrier(store, dispatcher, nil, 2, time.Minute)
+	if err := dispatcher.Dispatch(context.Background(), &Notification{Notification: models.Notification{Recipient: "a@example.com", Channel: "email", Subject: "Hi", Body: "Hi"}}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	// The queue is skipped so the attempts happen in order.
+	n := store.get(1)
+	if err := retrier.retry(context.Background(), &n); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := retrier.Sweep(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if n := store.get(1); n.Status != StatusDeadLettered || n.Attempts != 2 || n.LastError != "provider unavailable" {
+		t.Fatalf("Expected the notification to be dead-lettered after two failures, got: %+v", n)
+	}
+	stats := dispatcher.Metrics().Snapshot()
+	if len(stats) != 1 || stats[0].Provider != "default" || stats[0].Attempts != 2 || stats[0].Failures != 2 ||
+		stats[0].FailureRate != 1 || stats[0].DeadLettered != 1 || stats[0].LastError != "provider unavailable" {
+		t.Errorf("Expected two failed attempts and a dead letter for the provider, got: %+v", stats)
+	}
+
+	do := func(p *auth.Principal, method, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewDeadLetterHandler(store).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	admin := &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}}
+
+	if w := do(&auth.Principal{UserID: 2, Roles: []string{auth.RoleCustomer}}, http.MethodGet, "/notifications/dead-letters"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be kept out of the dead-letter queue, got: %d", w.Code)
+	}
+	w := do(admin, http.MethodGet, "/notifications/dead-letters?state=pending&provider=default")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"error":"provider unavailable"`) {
+		t.Errorf("Expected the dead letter to be listed, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(admin, http.MethodGet, "/notifications/dead-letters?state=stuck"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown state to be rejected, got: %d", w.Code)
+	}
+
+	w = do(admin, http.MethodGet, "/notifications/dead-letters/1")
+	var d DeadLetter
+	json.Unmarshal(w.Body.Bytes(), &d)
+	if w.Code != http.StatusOK || d.Notification == nil || d.Notification.Recipient != "a@example.com" || len(d.History) != 2 ||
+		d.History[1].Provider != "default" || d.History[1].Error != "provider unavailable" {
+		t.Errorf("Expected the dead letter with its notification and attempts, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(admin, http.MethodGet, "/notifications/dead-letters/9"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown dead letter to be not found, got: %d", w.Code)
+	}
+
+	if w := do(admin, http.MethodPost, "/notifications/dead-letters/1/redrive"); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the re-drive to be accepted, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(admin, http.MethodPost, "/notifications/dead-letters/1/redrive"); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second re-drive to conflict, got: %d", w.Code)
+	}
+	if w := do(admin, http.MethodPost, "/notifications/dead-letters/redrive"); w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"redriven":0`) {
+		t.Errorf("Expected nothing left to re-drive, got: %d %s", w.Code, w.Body.String())
+	}
+
+	runner := jobs.New()
+	retrier.queue = runner.Queue("retries", 1, 10)
+	runner.Start(context.Background())
+	if err := retrier.Sweep(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatalf("Expected the runner to stop, got: %v", err)
+	}
+	if n := store.get(1); n.Status != StatusSent || n.Attempts != 1 || sender.sent != 1 {
+		t.Errorf("Expected the re-driven notification to be delivered by the next sweep, got: %+v", n)
+	}
+}
@@ -0,0 +1,323 @@
+package notifications
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/templates"
+	"github.com/lib/pq"
+)
+
+// DigestTemplate is the template digests are rendered from. It is given
+// count, the number of notifications gathered, and items, each with their
+// subject, type and when they were received.
+const DigestTemplate = "digest"
+
+// DigestKey is a recipient whose batched notifications are gathered into
+// one digest.
+type DigestKey struct {
+	Tenant    string
+	UserID    int
+	Channel   string
+	Recipient string
+}
+
+// DigestStore finds recipients whose digest is due and claims what it
+// gathers.
+type DigestStore interface {
+	// DueDigests returns up to limit recipients, from every tenant, with
+	// batched notifications whose DeliverAfter has passed.
+	DueDigests(ctx context.Context, limit int) ([]DigestKey, error)
+	// PendingDigest returns the user's batched notifications in the
+	// request's tenant, due or not, on every channel.
+	PendingDigest(ctx context.Context, userID int) ([]Notification, error)
+	// ClaimDigest moves the recipient's due batched notifications, or all
+	// of them if early is set, to digested and returns them, so concurrent
+	// digesters never gather one twice.
+	ClaimDigest(ctx context.Context, key DigestKey, early bool) ([]Notification, error)
+	// LinkDigest records the digest that gathered the notifications.
+	LinkDigest(ctx context.Context, digestID int, ids []int) error
+	// ReleaseDigest moves claimed notifications back to batched, for the
+	// next sweep to gather.
+	ReleaseDigest(ctx context.Context, ids []int) error
+}
+
+// DigestRenderer renders the digest template. *templates.Library is one.
+type DigestRenderer interface {
+	Render(ctx context.Context, name, locale string, data map[string]any) (*templates.Message, error)
+}
+
+// Digester sends the digests users chose over being notified of each
+// low-priority notification as it happens. Sweep runs as a scheduled job
+// and sends each recipient whose digest is due one notification of
+// TypeDigest, through the dispatcher, gathering everything batched for
+// them so far.
+type Digester struct {
+	store      DigestStore
+	dispatcher *Dispatcher
+	templates  DigestRenderer
+	batchSize  int
+}
+
+func NewDigester(store DigestStore, dispatcher *Dispatcher, templates DigestRenderer) *Digester {
+	return &Digester{store: store, dispatcher: dispatcher, templates: templates, batchSize: 100}
+}
+
+// Sweep sends one batch of due digests. A digest that cannot be rendered
+// or recorded leaves its notifications batched for the next sweep.
+func (g *Digester) Sweep(ctx context.Context) error {
+	due, err := g.store.DueDigests(ctx, g.batchSize)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for _, key := range due {
+		ctx := ctx
+		if key.Tenant != "" {
+			ctx = tenant.NewContext(ctx, key.Tenant)
+		}
+		digest, _, err := g.send(ctx, key, false)
+		if err != nil {
+			log.Printf("Failed to send digest to user %d on %s: %v", key.UserID, key.Channel, err)
+			continue
+		}
+		if digest != nil {
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Printf("Sent %d notification digests", sent)
+	}
+	return nil
+}
+
+// Digest is a recipient's digest, as a preview or dry run would send it
+// or as it was sent.
+type Digest struct {
+	// ID and Status are the digest notification's, once it is sent. A
+	// digest sent during the user's quiet hours is deferred like any other
+	// notification.
+	ID        int    `json:"id,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Channel   string `json:"channel"`
+	Recipient string `json:"recipient"`
+	// DueAt is when the sweep sends the digest: when the first of its
+	// items falls due.
+	DueAt   time.Time `json:"due_at"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	// Items are the notifications gathered, oldest first.
+	Items []Notification `json:"items"`
+}
+
+// Preview renders the user's pending digests in the request's tenant, one
+// per channel and recipient, as they would be sent now, without claiming
+// or sending anything.
+func (g *Digester) Preview(ctx context.Context, userID int) ([]Digest, error) {
+	pending, err := g.store.PendingDigest(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	byKey := map[DigestKey][]Notification{}
+	keys := []DigestKey{}
+	for _, n := range pending {
+		key := DigestKey{Tenant: n.Tenant, UserID: userID, Channel: n.Channel, Recipient: n.Recipient}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], n)
+	}
+	digests := make([]Digest, 0, len(keys))
+	for _, key := range keys {
+		n, err := g.digest(ctx, key, byKey[key])
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, describe(key, n, byKey[key]))
+	}
+	return digests, nil
+}
+
+// SendNow sends the user's pending digests in the request's tenant at
+// once, gathering everything batched for them whether it is due or not,
+// and returns what it sent.
+func (g *Digester) SendNow(ctx context.Context, userID int) ([]Digest, error) {
+	pending, err := g.Preview(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	sent := []Digest{}
+	for _, p := range pending {
+		key := DigestKey{Tenant: tenant.FromContext(ctx), UserID: userID, Channel: p.Channel, Recipient: p.Recipient}
+		n, items, err := g.send(ctx, key, true)
+		if err != nil {
+			return sent, err
+		}
+		if n != nil {
+			sent = append(sent, describe(key, n, items))
+		}
+	}
+	return sent, nil
+}
+
+func describe(key DigestKey, n *Notification, items []Notification) Digest {
+	d := Digest{ID: n.ID, Status: n.Status, Channel: key.Channel, Recipient: key.Recipient, Subject: n.Subject, Body: n.Body, Items: items}
+	for _, item := range items {
+		if item.DeliverAfter != nil && (d.DueAt.IsZero() || item.DeliverAfter.Before(d.DueAt)) {
+			d.DueAt = *item.DeliverAfter
+		}
+	}
+	return d
+}
+
+// send returns the digest it sent and the notifications it gathered, or
+// no digest if another sweep gathered them first.
+func (g *Digester) send(ctx context.Context, key DigestKey, early bool) (*Notification, []Notification, error) {
+	items, err := g.store.ClaimDigest(ctx, key, early)
+	if err != nil || len(items) == 0 {
+		return nil, nil, err
+	}
+	ids := make([]int, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+
+	digest, err := g.digest(ctx, key, items)
+	if err == nil {
+		err = g.dispatcher.Dispatch(ctx, digest)
+	}
+	if err != nil {
+		if err := g.store.ReleaseDigest(ctx, ids); err != nil {
+			log.Printf("Failed to release notifications %v for the next digest: %v", ids, err)
+		}
+		return nil, nil, err
+	}
+	if err := g.store.LinkDigest(ctx, digest.ID, ids); err != nil {
+		log.Printf("Failed to link notifications %v to digest %d: %v", ids, digest.ID, err)
+	}
+	return digest, items, nil
+}
+
+// digest renders items, oldest first, into the recipient's digest.
+func (g *Digester) digest(ctx context.Context, key DigestKey, items []Notification) (*Notification, error) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+	entries := make([]map[string]any, len(items))
+	for i, item := range items {
+		entries[i] = map[string]any{
+			"subject":  item.Subject,
+			"type":     item.Type,
+			"received": item.CreatedAt.UTC().Format("Jan 2, 15:04 UTC"),
+		}
+	}
+	msg, err := g.templates.Render(ctx, DigestTemplate, templates.DefaultLocale, map[string]any{"count": len(items), "items": entries})
+	if err != nil {
+		return nil, err
+	}
+	userID := key.UserID
+	return &Notification{Notification: models.Notification{UserID: &userID, Recipient: key.Recipient, Channel: key.Channel, Type: TypeDigest,
+		Subject: msg.Subject, Body: msg.Body}}, nil
+}
+
+func (s *PostgresStore) DueDigests(ctx context.Context, limit int) ([]DigestKey, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT DISTINCT tenant_id, user_id, channel, recipient FROM notification_service.notifications
+		WHERE status = 'batched' AND deliver_after <= NOW() AND user_id IS NOT NULL LIMIT $1`
+	rows, err := s.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []DigestKey{}
+	for rows.Next() {
+		var k DigestKey
+		if err := rows.Scan(&k.Tenant, &k.UserID, &k.Channel, &k.Recipient); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgresStore) PendingDigest(ctx context.Context, userID int) ([]Notification, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + notificationColumns + `
+		FROM notification_service.notifications WHERE tenant_id = $1 AND user_id = $2 AND status = 'batched'
+		ORDER BY channel, recipient, created_at, id`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, *n)
+	}
+	return pending, rows.Err()
+}
+
+// ClaimDigest skips rows another sweep is claiming.
+func (s *PostgresStore) ClaimDigest(ctx context.Context, key DigestKey, early bool) ([]Notification, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.notifications SET status = 'digested'
+		WHERE id IN (SELECT id FROM notification_service.notifications
+			WHERE tenant_id = $1 AND user_id = $2 AND channel = $3 AND recipient = $4
+				AND status = 'batched' AND ($5 OR deliver_after <= NOW())
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, type, subject, created_at, deliver_after`
+	rows, err := s.db.QueryContext(ctx, query, key.Tenant, key.UserID, key.Channel, key.Recipient, early)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Notification{}
+	for rows.Next() {
+		n := Notification{Notification: models.Notification{UserID: &key.UserID, Recipient: key.Recipient, Channel: key.Channel, Status: StatusDigested}, Tenant: key.Tenant}
+		if err := rows.Scan(&n.ID, &n.Type, &n.Subject, &n.CreatedAt, &n.DeliverAfter); err != nil {
+			return nil, err
+		}
+		items = append(items, n)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) LinkDigest(ctx context.Context, digestID int, ids []int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.notifications SET digest_id = $1 WHERE id = ANY($2)`
+	_, err := s.db.ExecContext(ctx, query, digestID, pq.Array(ids))
+	return err
+}
+
+func (s *PostgresStore) ReleaseDigest(ctx context.Context, ids []int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.notifications SET status = 'batched'
+		WHERE id = ANY($1) AND status = 'digested'`
+	_, err := s.db.ExecContext(ctx, query, pq.Array(ids))
+	return err
+}
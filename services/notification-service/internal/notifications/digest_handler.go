@@ -0,0 +1,69 @@
+package notifications
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// DigestHandler lets admins see what a user's next digests hold and send
+// them early, for support looking into digests that never arrived.
+type DigestHandler struct {
+	digester *Digester
+}
+
+func NewDigestHandler(digester *Digester) *DigestHandler {
+	return &DigestHandler{digester: digester}
+}
+
+func (h *DigestHandler) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/notifications/digests", auth.RequireRole(auth.RoleAdmin))
+	group.GET("/:user_id", h.preview)
+	group.POST("/:user_id/send", h.send)
+}
+
+func (h *DigestHandler) preview(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil || userID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	digests, err := h.digester.Preview(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"digests": digests})
+}
+
+// send takes ?dry_run=true to answer what it would send, as preview does,
+// without sending it. A user with nothing batched is not found.
+func (h *DigestHandler) send(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil || userID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+		return
+	}
+	var digests []Digest
+	if dryRun {
+		digests, err = h.digester.Preview(c.Request.Context(), userID)
+	} else {
+		digests, err = h.digester.SendNow(c.Request.Context(), userID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "digests": digests})
+		return
+	}
+	if len(digests) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user has no pending digest"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"digests": digests, "dry_run": dryRun})
+}
@@ -0,0 +1,225 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/render"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/templates"
+	"github.com/gin-gonic/gin"
+)
+
+func (s *memStore) DueDigests(ctx context.Context, limit int) ([]DigestKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := map[DigestKey]bool{}
+	out := []DigestKey{}
+	for _, n := range s.created {
+		key := DigestKey{Tenant: n.Tenant, UserID: *n.UserID, Channel: n.Channel, Recipient: n.Recipient}
+		if n.Status == StatusBatched && !n.DeliverAfter.After(time.Now()) && !seen[key] {
+			seen[key] = true
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) PendingDigest(ctx context.Context, userID int) ([]Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Notification{}
+	for _, n := range s.created {
+		if n.Status == StatusBatched && *n.UserID == userID {
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) ClaimDigest(ctx context.Context, key DigestKey, early bool) ([]Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Notification{}
+	for i := range s.created {
+		n := &s.created[i]
+		if n.Status == StatusBatched && (early || !n.DeliverAfter.After(time.Now())) && *n.UserID == key.UserID && n.Recipient == key.Recipient {
+			n.Status = StatusDigested
+			out = append(out, *n)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) LinkDigest(ctx context.Context, digestID int, ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		s.created[id-1].DigestID = &digestID
+	}
+	return nil
+}
+
+func (s *memStore) ReleaseDigest(ctx context.Context, ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		s.created[id-1].Status = StatusBatched
+	}
+	return nil
+}
+
+type noAssets struct{}
+
+func (noAssets) URL(ctx context.Context, name string) (string, error) {
+	return "https://cdn.example.com/" + name, nil
+}
+
+func (noAssets) Content(ctx context.Context, name string) ([]byte, error) {
+	return nil, nil
+}
+
+// recordingSender keeps what it sends.
+type recordingSender struct {
+	sent []Notification
+}
+
+func (s *recordingSender) Send(ctx context.Context, n *Notification) error {
+	s.sent = append(s.sent, *n)
+	return nil
+}
+
+func TestDigester(t *testing.T) {
+	userID := 7
+	store := &memStore{}
+	sender := &recordingSender{}
+	due := time.Now().Add(-time.Second)
+	prefs := &stubPreferences{decisions: []Decision{
+		{Digest: due},
+		{Digest: due},
+		{Digest: time.Now().Add(time.Hour)},
+	}}
+	dispatcher := NewDispatcher(store, sender, events.LogPublisher{}, nil, prefs, nil, "")
+	for _, subject := range []string{"Your order shipped", "Finish your profile", "Later"} {
+		if err := dispatcher.Dispatch(context.Background(), &Notification{Notification: models.Notification{UserID: &userID, Recipient: "a@example.com", Channel: "email", Subject: subject, Body: subject}}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if len(sender.sent) != 0 || store.get(1).Status != StatusBatched || store.get(1).DeliverAfter == nil {
+		t.Fatalf("Expected the notifications to be batched unsent, got: %+v, %d sends", store.get(1), len(sender.sent))
+	}
+
+	digester := NewDigester(store, dispatcher, templates.NewLibrary(render.NewRenderer(noAssets{})))
+	for i := 0; i < 2; i++ {
+		if err := digester.Sweep(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected one digest, got %d sends", len(sender.sent))
+	}
+	digest := sender.sent[0]
+	if digest.Type != TypeDigest || digest.Subject != "Your digest: 2 new notifications" || *digest.UserID != userID {
+		t.Errorf("Expected a digest of two notifications, got: %+v", digest)
+	}
+	first, second := strings.Index(digest.Body, "Your order shipped"), strings.Index(digest.Body, "Finish your profile")
+	if first < 0 || second < first || strings.Contains(digest.Body, "Later") {
+		t.Errorf("Expected the due notifications in the body, oldest first, got: %s", digest.Body)
+	}
+	for _, id := range []int{1, 2} {
+		if n := store.get(id); n.Status != StatusDigested || n.DigestID == nil || *n.DigestID != digest.ID {
+			t.Errorf("Expected notification %d to be digested in %d, got: %+v", id, digest.ID, n)
+		}
+	}
+	if n := store.get(3); n.Status != StatusBatched {
+		t.Errorf("Expected the notification not yet due to wait for the next digest, got: %+v", n)
+	}
+}
+
+func TestDigestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	userID := 7
+	store := &memStore{}
+	sender := &recordingSender{}
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	prefs := &stubPreferences{decisions: []Decision{{Digest: later}, {Digest: later.Add(time.Hour)}}}
+	dispatcher := NewDispatcher(store, sender, events.LogPublisher{}, nil, prefs, nil, "")
+	for _, subject := range []string{"Your order shipped", "Finish your profile"} {
+		if err := dispatcher.Dispatch(context.Background(), &Notification{Notification: models.Notification{UserID: &userID, Recipient: "a@example.com", Channel: "email", Subject: subject, Body: subject}}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	digester := NewDigester(store, dispatcher, templates.NewLibrary(render.NewRenderer(noAssets{})))
+
+	do := func(p *auth.Principal, method, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewDigestHandler(digester).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	admin := &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}}
+	decode := func(w *httptest.ResponseRecorder) []Digest {
+		var resp struct {
+			Digests []Digest `json:"digests"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Digests
+	}
+
+	for _, path := range []string{"/notifications/digests/7", "/notifications/digests/7/send"} {
+		method := http.MethodGet
+		if strings.HasSuffix(path, "/send") {
+			method = http.MethodPost
+		}
+		if w := do(&auth.Principal{UserID: 7, Roles: []string{auth.RoleCustomer}}, method, path); w.Code != http.StatusForbidden {
+			t.Errorf("Expected customers to be kept out of %s, got: %d", path, w.Code)
+		}
+	}
+	if w := do(admin, http.MethodGet, "/notifications/digests/abc"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid user id to be rejected, got: %d", w.Code)
+	}
+	if w := do(admin, http.MethodPost, "/notifications/digests/7/send?dry_run=maybe"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid dry_run to be rejected, got: %d", w.Code)
+	}
+
+	w := do(admin, http.MethodGet, "/notifications/digests/7")
+	digests := decode(w)
+	if w.Code != http.StatusOK || len(digests) != 1 || len(digests[0].Items) != 2 || digests[0].Recipient != "a@example.com" ||
+		digests[0].Subject != "Your digest: 2 new notifications" || !digests[0].DueAt.Equal(later) || digests[0].ID != 0 {
+		t.Fatalf("Expected a preview of one digest of two notifications due at %s, got: %d %s", later, w.Code, w.Body.String())
+	}
+	if w := do(admin, http.MethodGet, "/notifications/digests/8"); w.Code != http.StatusOK || len(decode(w)) != 0 {
+		t.Errorf("Expected no digests for a user with nothing batched, got: %d %s", w.Code, w.Body.String())
+	}
+
+	w = do(admin, http.MethodPost, "/notifications/digests/7/send?dry_run=true")
+	if w.Code != http.StatusOK || len(decode(w)) != 1 || !strings.Contains(w.Body.String(), `"dry_run":true`) {
+		t.Errorf("Expected the dry run to answer the digest, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(sender.sent) != 0 || store.get(1).Status != StatusBatched {
+		t.Fatalf("Expected the dry run to send and claim nothing, got %d sends, %+v", len(sender.sent), store.get(1))
+	}
+
+	w = do(admin, http.MethodPost, "/notifications/digests/7/send")
+	digests = decode(w)
+	if w.Code != http.StatusOK || len(digests) != 1 || digests[0].ID == 0 || digests[0].Status != StatusSent || len(sender.sent) != 1 {
+		t.Fatalf("Expected the digest to be sent ahead of time, got: %d %s, %d sends", w.Code, w.Body.String(), len(sender.sent))
+	}
+	for _, id := range []int{1, 2} {
+		if n := store.get(id); n.Status != StatusDigested || n.DigestID == nil || *n.DigestID != digests[0].ID {
+			t.Errorf("Expected notification %d to be digested in %d, got: %+v", id, digests[0].ID, n)
+		}
+	}
+	if w := do(admin, http.MethodPost, "/notifications/digests/7/send"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected nothing left to send, got: %d %s", w.Code, w.Body.String())
+	}
+}
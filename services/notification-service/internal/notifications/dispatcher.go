@@ -0,0 +1,223 @@
+package notifications
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+)
+
+// Dispatcher records a notification, hands it to the sender, stores the
+// outcome and announces it as a notification.created event. Both the HTTP
+// API and event consumers send through it.
+type Dispatcher struct {
+	store        Store
+	sender       Sender
+	publisher    events.Publisher
+	identities   Identities
+	preferences  Preferences
+	suppressions Suppressions
+	replyDomain  string
+	metrics      *ProviderMetrics
+	feed         *Feed
+	selector     ChannelSelector
+	contacts     Contacts
+}
+
+// NewDispatcher gives every notification a reply token. With a replyDomain,
+// emails also get a Reply-To and Message-ID on that domain carrying the
+// token, so replies can be matched by the inbound webhook, and In-Reply-To
+// and References pointing at the earlier emails in their thread. Emails are sent
+// as the tenant's identity from identities, unless it is nil. Users'
+// notifications are checked against preferences, and every recipient
+// against suppressions, on every delivery attempt, unless they are nil.
+func NewDispatcher(store Store, sender Sender, publisher events.Publisher, identities Identities, preferences Preferences, suppressions Suppressions, replyDomain string) *Dispatcher {
+	return &Dispatcher{store: store, sender: sender, publisher: publisher, identities: identities, preferences: preferences, suppressions: suppressions,
+		replyDomain: replyDomain, metrics: NewProviderMetrics(), feed: NewFeed()}
+}
+
+// CopyToChannels also sends each email to a user, as it is dispatched, on
+// the channels selector says the user wants its type on too, to each of
+// their recipients there from contacts. Copies carry the subject alone,
+// leaving the detail to the email.
+func (d *Dispatcher) CopyToChannels(selector ChannelSelector, contacts Contacts) {
+	d.selector, d.contacts = selector, contacts
+}
+
+// Metrics counts the dispatcher's delivery attempts by provider.
+func (d *Dispatcher) Metrics() *ProviderMetrics {
+	return d.metrics
+}
+
+// Feed carries the outcome of every delivery attempt and hold as it
+// happens.
+func (d *Dispatcher) Feed() *Feed {
+	return d.feed
+}
+
+// ReplyAddress is the Reply-To address for a reply token.
+func ReplyAddress(token, domain string) string {
+	return "reply+" + token + "@" + domain
+}
+
+// MessageID is the Message-ID header value for a reply token.
+func MessageID(token, domain string) string {
+	return "<" + token + "@" + domain + ">"
+}
+
+// Dispatch returns an error only if the notification could not be recorded;
+// delivery failures are reflected in its status.
+func (d *Dispatcher) Dispatch(ctx context.Context, n *Notification) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	n.ReplyToken = hex.EncodeToString(token)
+	if n.Type == "" {
+		n.Type = TypeGeneral
+	}
+
+	n.Status = StatusQueued
+	if err := d.store.Create(ctx, n); err != nil {
+		return err
+	}
+	d.deliver(ctx, n)
+
+	e, err := events.New(events.NotificationCreated, "notification-service", events.NotificationRecord{
+		ID:        n.ID,
+		UserID:    n.UserID,
+		Channel:   n.Channel,
+		Subject:   n.Subject,
+		Body:      n.Body,
+		Status:    n.Status,
+		CreatedAt: n.CreatedAt,
+		ThreadID:  n.ThreadID,
+	})
+	if err == nil {
+		err = d.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish notification %d: %v", n.ID, err)
+	}
+	if d.selector != nil && n.UserID != nil && n.Channel == "email" {
+		d.sendCopies(ctx, n)
+	}
+	return nil
+}
+
+// sendCopies dispatches copies of n on the user's other channels. A
+// failure to look those up loses the copies but not the email, so it is
+// only logged.
+func (d *Dispatcher) sendCopies(ctx context.Context, n *Notification) {
+	channels, err := d.selector.Channels(ctx, *n.UserID, n.Type)
+	if err != nil {
+		log.Printf("Failed to select channels for notification %d: %v", n.ID, err)
+		return
+	}
+	for _, channel := range channels {
+		recipients, err := d.contacts.Recipients(ctx, *n.UserID, channel)
+		if err != nil {
+			log.Printf("Failed to look up %s recipients for notification %d: %v", channel, n.ID, err)
+			continue
+		}
+		for _, recipient := range recipients {
+			c := &Notification{Notification: models.Notification{UserID: n.UserID, Recipient: recipient, Channel: channel, Type: n.Type, Subject: n.Subject,
+				ContextType: n.ContextType, ContextID: n.ContextID}}
+			if err := d.Dispatch(ctx, c); err != nil {
+				log.Printf("Failed to copy notification %d to %s: %v", n.ID, channel, err)
+			}
+		}
+	}
+}
+
+// deliver hands n to the sender and stores the outcome as its status. A
+// notification to a suppressed recipient is recorded as suppressed, and one
+// the user's preferences suppress, batch into a digest or defer is held
+// instead. If either cannot be read, the attempt fails and is retried.
+// Security notifications skip preferences and are always sent straight
+// away. A recipient the provider rejects as unknown is suppressed too,
+// since retrying would fail the same way.
+func (d *Dispatcher) deliver(ctx context.Context, n *Notification) {
+	if d.suppressions != nil {
+		reason, err := d.suppressions.Suppressed(ctx, n)
+		if err != nil {
+			log.Printf("Failed to check suppressions for notification %d: %v", n.ID, err)
+			d.finish(ctx, n, Attempt{Status: StatusFailed, Error: "check suppressions: " + err.Error()})
+			return
+		}
+		if reason != "" {
+			d.finish(ctx, n, Attempt{Status: StatusSuppressed, Error: "recipient suppressed: " + reason})
+			return
+		}
+	}
+	if d.preferences != nil && n.UserID != nil && n.Type != TypeSecurity {
+		decision, err := d.preferences.Decide(ctx, n, time.Now())
+		if err != nil {
+			log.Printf("Failed to check preferences for notification %d: %v", n.ID, err)
+			d.finish(ctx, n, Attempt{Status: StatusFailed, Error: "check preferences: " + err.Error()})
+			return
+		}
+		switch {
+		case decision.Suppress:
+			d.hold(ctx, n, StatusSuppressed, nil)
+			return
+		case !decision.Digest.IsZero():
+			d.hold(ctx, n, StatusBatched, &decision.Digest)
+			return
+		case !decision.Until.IsZero():
+			d.hold(ctx, n, StatusDeferred, &decision.Until)
+			return
+		}
+		n.UnsubscribeURL = decision.UnsubscribeURL
+	}
+	if d.replyDomain != "" && n.Channel == "email" {
+		n.ReplyTo = ReplyAddress(n.ReplyToken, d.replyDomain)
+		n.MessageID = MessageID(n.ReplyToken, d.replyDomain)
+		n.References = nil
+		for _, token := range n.ThreadTokens {
+			n.References = append(n.References, MessageID(token, d.replyDomain))
+		}
+		if len(n.References) > 0 {
+			n.InReplyTo = n.References[len(n.References)-1]
+		}
+	}
+	if d.identities != nil && n.Channel == "email" {
+		id := d.identities.Identity(ctx)
+		n.From, n.DKIM = id.From, id.DKIM
+	}
+
+	a := Attempt{Status: StatusSent, Provider: providerName(d.sender, n.Channel)}
+	if err := d.sender.Send(ctx, n); errors.Is(err, ErrInvalidRecipient) {
+		log.Printf("Suppressing notification %d: %v", n.ID, err)
+		a.Status, a.Error = StatusSuppressed, err.Error()
+	} else if err != nil {
+		log.Printf("Failed to send notification %d: %v", n.ID, err)
+		a.Status, a.Error = StatusFailed, err.Error()
+	}
+	d.metrics.attempt(a)
+	d.finish(ctx, n, a)
+}
+
+// finish records a delivery attempt and its outcome. An attempt that never
+// reached the sender has no provider.
+func (d *Dispatcher) finish(ctx context.Context, n *Notification, a Attempt) {
+	n.Status, n.Provider, n.LastError = a.Status, a.Provider, a.Error
+	n.Attempts++
+	if err := d.store.RecordAttempt(ctx, n.ID, a); err != nil {
+		log.Printf("Failed to update notification %d status: %v", n.ID, err)
+	}
+	d.feed.Record(Outcome{Status: a.Status, NotificationID: n.ID, Channel: n.Channel, Provider: a.Provider, Detail: a.Error})
+}
+
+func (d *Dispatcher) hold(ctx context.Context, n *Notification, status string, until *time.Time) {
+	n.Status, n.DeliverAfter = status, until
+	if err := d.store.Hold(ctx, n.ID, status, until); err != nil {
+		log.Printf("Failed to hold notification %d: %v", n.ID, err)
+	}
+	d.feed.Record(Outcome{Status: status, NotificationID: n.ID, Channel: n.Channel})
+}
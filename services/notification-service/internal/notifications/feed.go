@@ -0,0 +1,214 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/gin-gonic/gin"
+)
+
+// Outcome statuses that are not notification statuses.
+const (
+	OutcomeBounced      = "bounced"
+	OutcomeComplained   = "complained"
+	OutcomeDeadLettered = "dead_lettered"
+)
+
+// feedBuffer is how many outcomes a subscriber may fall behind by.
+const feedBuffer = 256
+
+// Outcome is something that happened to a delivery: an attempt, a hold, a
+// dead letter, or bounce or complaint feedback from a provider.
+type Outcome struct {
+	Status         string `json:"status"`
+	NotificationID int    `json:"notification_id,omitempty"`
+	Channel        string `json:"channel"`
+	Provider       string `json:"provider,omitempty"`
+	// Detail is the attempt's error, or the kind of bounce.
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Feed fans delivery outcomes out to live subscribers. Like stream.Hub,
+// each subscriber has a bounded buffer and is dropped rather than allowed
+// to slow deliveries down when it falls that far behind.
+type Feed struct {
+	mu   sync.Mutex
+	subs map[*feedSubscription]struct{}
+}
+
+type feedSubscription struct {
+	outcomes chan Outcome
+	// done is closed when the feed drops the subscription.
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *feedSubscription) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func NewFeed() *Feed {
+	return &Feed{subs: map[*feedSubscription]struct{}{}}
+}
+
+// Record hands o to every subscriber without blocking.
+func (f *Feed) Record(o Outcome) {
+	if o.At.IsZero() {
+		o.At = time.Now()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.subs {
+		select {
+		case s.outcomes <- o:
+		default:
+			delete(f.subs, s)
+			s.close()
+		}
+	}
+}
+
+func (f *Feed) subscribe() *feedSubscription {
+	s := &feedSubscription{outcomes: make(chan Outcome, feedBuffer), done: make(chan struct{})}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[s] = struct{}{}
+	return s
+}
+
+func (f *Feed) unsubscribe(s *feedSubscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, s)
+	s.close()
+}
+
+// Subscribers returns the number of open subscriptions.
+func (f *Feed) Subscribers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs)
+}
+
+// FeedSummary is sent every interval: the outcomes that matched the
+// subscriber's filters since the last summary, counted by channel and
+// status, with the providers' and queues' stats as they stand.
+type FeedSummary struct {
+	Since     time.Time                 `json:"since"`
+	Until     time.Time                 `json:"until"`
+	Channels  map[string]map[string]int `json:"channels"`
+	Providers []ProviderStats           `json:"providers"`
+	Queues    []jobs.QueueStats         `json:"queues"`
+}
+
+// FeedHandler streams the dispatcher's outcomes to ops dashboards as
+// server-sent events.
+type FeedHandler struct {
+	dispatcher *Dispatcher
+	queues     *jobs.Metrics
+	interval   time.Duration
+}
+
+// NewFeedHandler sends a summary every interval, which doubles as the
+// heartbeat. Queue depths are read from queues, unless it is nil.
+func NewFeedHandler(dispatcher *Dispatcher, queues *jobs.Metrics, interval time.Duration) *FeedHandler {
+	return &FeedHandler{dispatcher: dispatcher, queues: queues, interval: interval}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+func (h *FeedHandler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/metrics/deliveries/stream", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.stream)
+}
+
+// feedFilter keeps outcomes on any of its channels, statuses and
+// providers. An empty list matches everything.
+type feedFilter struct {
+	channels, statuses, providers map[string]bool
+}
+
+func newFeedFilter(c *gin.Context) feedFilter {
+	set := func(key string) map[string]bool {
+		values := c.QueryArray(key)
+		if len(values) == 0 {
+			return nil
+		}
+		m := map[string]bool{}
+		for _, v := range values {
+			m[v] = true
+		}
+		return m
+	}
+	return feedFilter{channels: set("channel"), statuses: set("status"), providers: set("provider")}
+}
+
+func (f feedFilter) match(o Outcome) bool {
+	return (f.channels == nil || f.channels[o.Channel]) &&
+		(f.statuses == nil || f.statuses[o.Status]) &&
+		(f.providers == nil || f.providers[o.Provider])
+}
+
+func (h *FeedHandler) stream(c *gin.Context) {
+	filter := newFeedFilter(c)
+	feed := h.dispatcher.Feed()
+	sub := feed.subscribe()
+	defer feed.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// Tell the client how long to wait before reconnecting.
+	fmt.Fprintf(c.Writer, "retry: 3000\n\n")
+	c.Writer.Flush()
+
+	summary := FeedSummary{Since: time.Now(), Channels: map[string]map[string]int{}}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-sub.done:
+			return
+		case now := <-ticker.C:
+			summary.Until = now
+			summary.Providers = h.dispatcher.Metrics().Snapshot()
+			if h.queues != nil {
+				_, summary.Queues = h.queues.Snapshot()
+			}
+			if !writeEvent(c, "summary", summary) {
+				return
+			}
+			summary = FeedSummary{Since: now, Channels: map[string]map[string]int{}}
+		case o := <-sub.outcomes:
+			if !filter.match(o) {
+				continue
+			}
+			if summary.Channels[o.Channel] == nil {
+				summary.Channels[o.Channel] = map[string]int{}
+			}
+			summary.Channels[o.Channel][o.Status]++
+			if !writeEvent(c, "outcome", o) {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// writeEvent writes v as a server-sent event, and reports whether the
+// client is still there.
+func writeEvent(c *gin.Context, event string, v any) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return true
+	}
+	_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data)
+	return err == nil
+}
@@ -0,0 +1,122 @@
+package notifications
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestFeedDropsSlowSubscribers(t *testing.T) {
+	feed := NewFeed()
+	sub := feed.subscribe()
+	for i := 0; i <= feedBuffer; i++ {
+		feed.Record(Outcome{Status: StatusSent, Channel: "email"})
+	}
+	select {
+	case <-sub.done:
+	default:
+		t.Fatal("Expected a subscriber that fell behind to be dropped")
+	}
+	if n := feed.Subscribers(); n != 0 {
+		t.Errorf("Expected no subscribers, got: %d", n)
+	}
+}
+
+func TestFeedHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	dispatcher := NewDispatcher(store, &flakySender{failures: 2}, events.LogPublisher{}, nil, nil, nil, "")
+	runner := jobs.New()
+	runner.Queue("retries", 1, 10)
+	router := gin.New()
+	var roles []string
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: roles}) })
+	NewFeedHandler(dispatcher, runner.Metrics(), 50*time.Millisecond).RegisterRoutes(router)
+
+	roles = []string{auth.RoleCustomer}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics/deliveries/stream", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected customers to be refused, got: %d", w.Code)
+	}
+
+	roles = []string{auth.RoleAdmin}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/metrics/deliveries/stream?channel=email&status=failed", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || !strings.HasPrefix(lines.Text(), "retry:") {
+		t.Fatalf("Expected retry line, got: %q", lines.Text())
+	}
+
+	for _, n := range []*Notification{
+		{Notification: models.Notification{Recipient: "+15550100", Channel: "sms", Body: "Hi"}},
+		{Notification: models.Notification{Recipient: "a@example.com", Channel: "email", Subject: "Hi", Body: "Hi"}},
+		{Notification: models.Notification{Recipient: "b@example.com", Channel: "email", Subject: "Hi", Body: "Hi"}},
+	} {
+		if err := dispatcher.Dispatch(ctx, n); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	// The sms attempt and the first email fail; only the email matches.
+	var outcomes []Outcome
+	var summary *FeedSummary
+	event := ""
+	for summary == nil && lines.Scan() {
+		text := lines.Text()
+		switch {
+		case strings.HasPrefix(text, "event: "):
+			event = strings.TrimPrefix(text, "event: ")
+		case strings.HasPrefix(text, "data: ") && event == "outcome":
+			var o Outcome
+			json.Unmarshal([]byte(strings.TrimPrefix(text, "data: ")), &o)
+			outcomes = append(outcomes, o)
+		case strings.HasPrefix(text, "data: ") && event == "summary":
+			var s FeedSummary
+			json.Unmarshal([]byte(strings.TrimPrefix(text, "data: ")), &s)
+			if len(s.Channels) > 0 {
+				summary = &s
+			}
+		}
+	}
+	if len(outcomes) != 1 || outcomes[0].NotificationID != 2 || outcomes[0].Detail != "provider unavailable" {
+		t.Fatalf("Expected only the failed email, got: %+v", outcomes)
+	}
+	if summary == nil || summary.Channels["email"][StatusFailed] != 1 || len(summary.Channels) != 1 {
+		t.Fatalf("Expected a summary counting the failed email, got: %+v", summary)
+	}
+	if len(summary.Providers) != 1 || summary.Providers[0].Failures != 2 {
+		t.Errorf("Expected provider stats in the summary, got: %+v", summary.Providers)
+	}
+	if len(summary.Queues) != 1 || summary.Queues[0].Name != "retries" {
+		t.Errorf("Expected queue depths in the summary, got: %+v", summary.Queues)
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for dispatcher.Feed().Subscribers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := dispatcher.Feed().Subscribers(); n != 0 {
+		t.Errorf("Expected the subscription to be released, got: %d", n)
+	}
+}
@@ -0,0 +1,151 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/i18n"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/templates"
+	"github.com/gin-gonic/gin"
+)
+
+// BodyRenderer prepares HTML bodies for delivery (asset URLs, inlined CSS).
+type BodyRenderer interface {
+	HTML(ctx context.Context, body string, data any) (string, error)
+}
+
+type Handler struct {
+	store      Store
+	dispatcher *Dispatcher
+	renderer   BodyRenderer
+	templates  *templates.Library
+}
+
+func NewHandler(store Store, dispatcher *Dispatcher, renderer BodyRenderer, library *templates.Library) *Handler {
+	return &Handler{store: store, dispatcher: dispatcher, renderer: renderer, templates: library}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/notifications", h.list)
+	router.GET("/notifications/threads", h.listThreads)
+	router.GET("/notifications/threads/:id", h.getThread)
+	router.POST("/notifications", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.create)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id query parameter is required"})
+		return
+	}
+	if !auth.AuthorizeUser(c, userID) {
+		return
+	}
+
+	notifications, err := h.store.ListByUser(c.Request.Context(), userID, 20)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications})
+}
+
+type createRequest struct {
+	UserID    *int   `json:"user_id"`
+	Recipient string `json:"recipient" binding:"required"`
+	Channel   string `json:"channel"`
+	// Type is one of Types, general by default.
+	Type    string `json:"type"`
+	Subject string `json:"subject" binding:"required_without=Template"`
+	Body    string `json:"body" binding:"required_without=Template"`
+	// Format is "text" (default) or "html". HTML bodies are rendered as
+	// templates with Data before sending.
+	Format string         `json:"format"`
+	Data   map[string]any `json:"data"`
+	// Template names an embedded template to render with Data in place of
+	// Subject and Body.
+	Template string `json:"template"`
+	// Locale picks the template's variant, the caller's Accept-Language by
+	// default.
+	Locale string `json:"locale"`
+	// ContextType and ContextID route replies, e.g. "order" and "42".
+	ContextType string `json:"context_type" binding:"max=32"`
+	ContextID   string `json:"context_id" binding:"max=64"`
+}
+
+func (h *Handler) create(c *gin.Context) {
+	var req createRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Channel == "" {
+		req.Channel = "email"
+	}
+	if req.Type == "" {
+		req.Type = TypeGeneral
+	}
+	if !KnownType(req.Type) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be one of " + strings.Join(Types, ", ")})
+		return
+	}
+	if req.Locale == "" {
+		req.Locale = i18n.FromContext(c.Request.Context())
+	}
+	switch {
+	case req.Template != "":
+		if req.Subject != "" || req.Body != "" || req.Format != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "template cannot be combined with subject, body or format"})
+			return
+		}
+		msg, err := h.templates.Render(c.Request.Context(), req.Template, req.Locale, req.Data)
+		var missing *templates.MissingError
+		if errors.Is(err, templates.ErrNotFound) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown template " + strconv.Quote(req.Template)})
+			return
+		}
+		if errors.As(err, &missing) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "missing": missing.Missing})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to render template: " + err.Error()})
+			return
+		}
+		req.Subject, req.Body = msg.Subject, msg.Body
+	case req.Format == "" || req.Format == "text":
+	case req.Format == "html":
+		body, err := h.renderer.HTML(c.Request.Context(), req.Body, req.Data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to render body: " + err.Error()})
+			return
+		}
+		req.Body = body
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be text or html"})
+		return
+	}
+
+	n := &Notification{Notification: models.Notification{
+		UserID:      req.UserID,
+		Recipient:   req.Recipient,
+		Channel:     req.Channel,
+		Type:        req.Type,
+		Subject:     req.Subject,
+		Body:        req.Body,
+		ContextType: req.ContextType,
+		ContextID:   req.ContextID,
+	}}
+	if err := h.dispatcher.Dispatch(c.Request.Context(), n); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, n)
+}
@@ -0,0 +1,26 @@
+package notifications
+
+import (
+	"context"
+	"crypto"
+)
+
+// Identity is who an email is sent as. DKIM is nil when the sender leaves
+// signing to the provider, as it does for the platform domain.
+type Identity struct {
+	From string
+	DKIM *DKIM
+}
+
+// DKIM is the key a sender signs with, published in DNS as
+// <Selector>._domainkey.<Domain>.
+type DKIM struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+}
+
+// Identities picks the identity for the tenant on ctx.
+type Identities interface {
+	Identity(ctx context.Context) Identity
+}
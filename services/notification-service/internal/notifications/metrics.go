@@ -0,0 +1,86 @@
+package notifications
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProviderMetrics counts delivery attempts per provider in memory since the
+// process started.
+type ProviderMetrics struct {
+	mu        sync.Mutex
+	providers map[string]*ProviderStats
+}
+
+type ProviderStats struct {
+	Provider string `json:"provider"`
+	Attempts int64  `json:"attempts"`
+	Failures int64  `json:"failures"`
+	// FailureRate is Failures over Attempts.
+	FailureRate float64 `json:"failure_rate"`
+	// DeadLettered counts notifications whose last attempt was with the
+	// provider and which ran out of attempts.
+	DeadLettered  int64      `json:"dead_lettered"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+func NewProviderMetrics() *ProviderMetrics {
+	return &ProviderMetrics{providers: map[string]*ProviderStats{}}
+}
+
+func (m *ProviderMetrics) stats(provider string) *ProviderStats {
+	s, ok := m.providers[provider]
+	if !ok {
+		s = &ProviderStats{Provider: provider}
+		m.providers[provider] = s
+	}
+	return s
+}
+
+func (m *ProviderMetrics) attempt(a Attempt) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.stats(a.Provider)
+	s.Attempts++
+	if a.Status == StatusFailed {
+		now := time.Now()
+		s.Failures++
+		s.LastError, s.LastFailureAt = a.Error, &now
+	}
+}
+
+func (m *ProviderMetrics) deadLettered(provider string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats(provider).DeadLettered++
+}
+
+// Snapshot returns the stats for every provider, by provider.
+func (m *ProviderMetrics) Snapshot() []ProviderStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]ProviderStats, 0, len(m.providers))
+	for _, s := range m.providers {
+		row := *s
+		if s.Attempts > 0 {
+			row.FailureRate = float64(s.Failures) / float64(s.Attempts)
+		}
+		out = append(out, row)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Provider < out[j].Provider })
+	return out
+}
+
+// Handler serves the metrics.
+func (m *ProviderMetrics) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"providers": m.Snapshot()})
+	}
+}
@@ -0,0 +1,100 @@
+package notifications
+
+import (
+	"context"
+	"time"
+)
+
+// Notification types, which users opt in and out of per channel. Sends
+// through the API are general unless they name another type.
+const (
+	TypeGeneral      = "general"
+	TypeProfileNudge = "profile_nudge"
+	TypeWinBack      = "win_back"
+	TypeStockAlert   = "stock_alert"
+	TypeBackInStock  = "back_in_stock"
+	TypeShipment     = "shipment"
+)
+
+var Types = []string{TypeGeneral, TypeProfileNudge, TypeWinBack, TypeStockAlert, TypeBackInStock, TypeShipment}
+
+// TypeSecurity is for sign-in codes and alerts. It is not one of Types:
+// users cannot opt out of it, and it ignores quiet hours.
+const TypeSecurity = "security"
+
+// TypeDigest is for digests gathering a user's batched notifications. It is
+// not one of Types either: users choose digests per type of what they
+// gather, and digests wait out quiet hours like any other notification.
+const TypeDigest = "digest"
+
+// DigestTypes are the low-priority types users can have batched into
+// hourly or daily digests instead of sent one by one.
+var DigestTypes = []string{TypeGeneral, TypeProfileNudge, TypeWinBack, TypeStockAlert}
+
+func Digestible(t string) bool {
+	for _, known := range DigestTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+func KnownType(t string) bool {
+	for _, known := range Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// OptInChannels are the channels besides email. Users get a type of
+// notification on them only once they turn it on there, and only at the
+// devices they registered.
+var OptInChannels = []string{"sms", "push"}
+
+// ChannelSelector picks the OptInChannels a user wants a type of
+// notification on, in addition to email.
+type ChannelSelector interface {
+	Channels(ctx context.Context, userID int, typ string) ([]string, error)
+}
+
+// Contacts are where users receive notifications on channels other than
+// email.
+type Contacts interface {
+	// Recipients returns the user's recipients on channel, none if they
+	// registered no device there.
+	Recipients(ctx context.Context, userID int, channel string) ([]string, error)
+}
+
+// Decision is what a user's preferences say about a notification.
+type Decision struct {
+	// Suppress means the user opted out of the notification's type on its
+	// channel.
+	Suppress bool
+	// Until, if set, holds the notification until the user's quiet hours
+	// end.
+	Until time.Time
+	// Digest, if set, batches the notification into the user's digest due
+	// then.
+	Digest time.Time
+	// UnsubscribeURL opts the user out of the notification's type on its
+	// channel.
+	UnsubscribeURL string
+}
+
+// Preferences decides whether and when a user's notification is sent. Only
+// notifications with a UserID are checked.
+type Preferences interface {
+	Decide(ctx context.Context, n *Notification, now time.Time) (Decision, error)
+}
+
+// Suppressions are the compliance lists of recipients nothing may be sent
+// to, such as addresses that bounced or complained. Unlike preferences they
+// apply to every notification, whether or not it has a UserID.
+type Suppressions interface {
+	// Suppressed returns why n's recipient is suppressed on its channel, or
+	// "" if it may be sent.
+	Suppressed(ctx context.Context, n *Notification) (string, error)
+}
@@ -0,0 +1,99 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// RetryStore finds failed and deferred notifications and claims them for
+// another delivery attempt, and dead-letters those out of attempts.
+type RetryStore interface {
+	// ListRetryable returns failed notifications with fewer than maxAttempts
+	// attempts whose last attempt is at least backoff old, doubled for every
+	// attempt after the first, and deferred notifications whose
+	// DeliverAfter has passed.
+	ListRetryable(ctx context.Context, maxAttempts int, backoff time.Duration, limit int) ([]Notification, error)
+	// ClaimRetry moves a failed or deferred notification back to queued, or
+	// returns ErrNotFound if it is neither any more, so concurrent retriers
+	// never send it twice.
+	ClaimRetry(ctx context.Context, id int) error
+	// DeadLetter moves up to limit failed notifications with maxAttempts
+	// attempts or more to the dead-letter queue and returns them.
+	DeadLetter(ctx context.Context, maxAttempts, limit int) ([]DeadLetter, error)
+}
+
+// Retrier resends failed notifications and sends deferred ones once they
+// are due. Sweep runs as a scheduled job and hands each notification due
+// an attempt to a queue, whose workers deliver it through the dispatcher.
+// Notifications that fail maxAttempts times are dead-lettered by the next
+// sweep.
+type Retrier struct {
+	store       RetryStore
+	dispatcher  *Dispatcher
+	queue       *jobs.Queue
+	maxAttempts int
+	backoff     time.Duration
+	batchSize   int
+}
+
+func NewRetrier(store RetryStore, dispatcher *Dispatcher, queue *jobs.Queue, maxAttempts int, backoff time.Duration) *Retrier {
+	return &Retrier{store: store, dispatcher: dispatcher, queue: queue, maxAttempts: maxAttempts, backoff: backoff, batchSize: 100}
+}
+
+// Sweep dead-letters one batch of exhausted notifications and queues one
+// batch due a retry. Notifications still queued from an earlier sweep are
+// skipped.
+func (r *Retrier) Sweep(ctx context.Context) error {
+	dead, err := r.store.DeadLetter(ctx, r.maxAttempts, r.batchSize)
+	if err != nil {
+		return err
+	}
+	for _, d := range dead {
+		if d.Provider != "" {
+			r.dispatcher.metrics.deadLettered(d.Provider)
+		}
+		r.dispatcher.feed.Record(Outcome{Status: OutcomeDeadLettered, NotificationID: d.NotificationID, Channel: d.Channel,
+			Provider: d.Provider, Detail: d.Error})
+	}
+	if len(dead) > 0 {
+		log.Printf("Dead-lettered %d notifications after %d attempts", len(dead), r.maxAttempts)
+	}
+
+	due, err := r.store.ListRetryable(ctx, r.maxAttempts, r.backoff, r.batchSize)
+	if err != nil {
+		return err
+	}
+	queued := 0
+	for i := range due {
+		n := due[i]
+		if r.queue.Enqueue(strconv.Itoa(n.ID), func(ctx context.Context) error { return r.retry(ctx, &n) }) {
+			queued++
+		}
+	}
+	if queued > 0 {
+		log.Printf("Queued %d failed or deferred notifications for delivery", queued)
+	}
+	return nil
+}
+
+func (r *Retrier) retry(ctx context.Context, n *Notification) error {
+	if err := r.store.ClaimRetry(ctx, n.ID); errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if n.Tenant != "" {
+		ctx = tenant.NewContext(ctx, n.Tenant)
+	}
+	r.dispatcher.deliver(ctx, n)
+	if n.Status == StatusFailed && n.Attempts >= r.maxAttempts {
+		log.Printf("Giving up on notification %d after %d attempts, it will be dead-lettered", n.ID, n.Attempts)
+	}
+	return nil
+}
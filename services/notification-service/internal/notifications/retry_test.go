@@ -0,0 +1,289 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/models"
+)
+
+type memStore struct {
+	mu      sync.Mutex
+	created []Notification
+	history map[int][]Attempt
+	dead    []DeadLetter
+}
+
+func (s *memStore) Create(ctx context.Context, n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n.ID = len(s.created) + 1
+	s.created = append(s.created, *n)
+	return nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, id int, a Attempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := &s.created[id-1]
+	n.Status, n.Provider, n.LastError = a.Status, a.Provider, a.Error
+	n.Attempts++
+	if s.history == nil {
+		s.history = map[int][]Attempt{}
+	}
+	a.At = time.Now()
+	s.history[id] = append(s.history[id], a)
+	return nil
+}
+
+func (s *memStore) Hold(ctx context.Context, id int, status string, until *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.created[id-1].Status, s.created[id-1].DeliverAfter = status, until
+	return nil
+}
+
+func (s *memStore) ListByUser(ctx context.Context, userID, limit int) ([]Notification, error) {
+	return nil, nil
+}
+
+func (s *memStore) FindByReplyToken(ctx context.Context, token string) (*Notification, error) {
+	return nil, ErrNotFound
+}
+
+func (s *memStore) ListThreads(ctx context.Context, userID, limit int) ([]Thread, error) {
+	return nil, nil
+}
+
+func (s *memStore) GetThread(ctx context.Context, id int64) (*Thread, error) {
+	return nil, ErrNotFound
+}
+
+func (s *memStore) ListRetryable(ctx context.Context, maxAttempts int, backoff time.Duration, limit int) ([]Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Notification{}
+	for _, n := range s.created {
+		due := n.Status == StatusDeferred && !n.DeliverAfter.After(time.Now())
+		if due || n.Status == StatusFailed && n.Attempts < maxAttempts {
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) ClaimRetry(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.created[id-1].Status; status != StatusFailed && status != StatusDeferred {
+		return ErrNotFound
+	}
+	s.created[id-1].Status = StatusQueued
+	return nil
+}
+
+func (s *memStore) DeadLetter(ctx context.Context, maxAttempts, limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []DeadLetter{}
+	for i := range s.created {
+		n := &s.created[i]
+		if n.Status != StatusFailed || n.Attempts < maxAttempts || len(out) == limit {
+			continue
+		}
+		n.Status = StatusDeadLettered
+		d := DeadLetter{ID: int64(len(s.dead) + 1), NotificationID: n.ID, Recipient: n.Recipient, Channel: n.Channel, Type: n.Type,
+			Subject: n.Subject, Provider: n.Provider, Error: n.LastError, Attempts: n.Attempts, DeadLetteredAt: time.Now()}
+		s.dead = append(s.dead, d)
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func (s *memStore) get(id int) Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.created[id-1]
+}
+
+// flakySender fails the first failures sends.
+type flakySender struct {
+	mu       sync.Mutex
+	failures int
+	sent     int
+}
+
+func (s *flakySender) Send(ctx context.Context, n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("provider unavailable")
+	}
+	s.sent++
+	return nil
+}
+
+func TestRetrier(t *testing.T) {
+	store := &memStore{}
+	sender := &flakySender{failures: 2}
+	dispatcher := NewDispatcher(store, sender, events.LogPublisher{}, nil, nil, nil, "")
+	if err := dispatcher.Dispatch(context.Background(), &Notification{Notification: models.Notification{Recipient: "a@example.com", Channel: "email", Subject: "Hi", Body: "Hi"}}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if n := store.get(1); n.Status != StatusFailed || n.Attempts != 1 {
+		t.Fatalf("Expected the first attempt to fail, got: %+v", n)
+	}
+
+	runner := jobs.New()
+	retrier := NewRetrier(store, dispatcher, runner.Queue("retries", 1, 10), 3, time.Minute)
+	runner.Start(context.Background())
+	for i := 0; i < 3; i++ {
+		if err := retrier.Sweep(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatalf("Expected the runner to stop, got: %v", err)
+	}
+
+	if n := store.get(1); n.Status != StatusSent || n.Attempts != 3 || sender.sent != 1 {
+		t.Errorf("Expected delivery on the third attempt and no more, got: %+v, %d sends", n, sender.sent)
+	}
+}
+
+// stubPreferences returns its decisions in turn, then empty ones.
+type stubPreferences struct {
+	decisions []Decision
+}
+
+func (p *stubPreferences) Decide(ctx context.Context, n *Notification, now time.Time) (Decision, error) {
+	if len(p.decisions) == 0 {
+		return Decision{}, nil
+	}
+	d := p.decisions[0]
+	p.decisions = p.decisions[1:]
+	return d, nil
+}
+
+func TestDispatchPreferences(t *testing.T) {
+	userID := 7
+	store := &memStore{}
+	sender := &flakySender{}
+	prefs := &stubPreferences{decisions: []Decision{
+		{Suppress: true},
+		{Until: time.Now().Add(-time.Second)},
+		{UnsubscribeURL: "https://example.com/unsubscribe?token=t"},
+	}}
+	dispatcher := NewDispatcher(store, sender, events.LogPublisher{}, nil, prefs, nil, "")
+	for i := 0; i < 2; i++ {
+		if err := dispatcher.Dispatch(context.Background(), &Notification{Notification: models.Notification{UserID: &userID, Recipient: "a@example.com", Channel: "email", Subject: "Hi", Body: "Hi"}}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if n := store.get(1); n.Status != StatusSuppressed || n.Attempts != 0 || n.Type != TypeGeneral {
+		t.Errorf("Expected the first notification to be suppressed unsent, got: %+v", n)
+	}
+	if n := store.get(2); n.Status != StatusDeferred || n.DeliverAfter == nil {
+		t.Fatalf("Expected the second notification to be deferred, got: %+v", n)
+	}
+
+	runner := jobs.New()
+	retrier := NewRetrier(store, dispatcher, runner.Queue("retries", 1, 10), 3, time.Minute)
+	runner.Start(context.Background())
+	if err := retrier.Sweep(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatalf("Expected the runner to stop, got: %v", err)
+	}
+	if n := store.get(2); n.Status != StatusSent || n.Attempts != 1 || sender.sent != 1 {
+		t.Errorf("Expected the deferred notification to be sent once due, got: %+v, %d sends", n, sender.sent)
+	}
+	if n := store.get(1); n.Status != StatusSuppressed {
+		t.Errorf("Expected the suppressed notification to stay suppressed, got: %+v", n)
+	}
+}
+
+// stubSuppressions suppresses the recipients it lists.
+type stubSuppressions map[string]string
+
+func (s stubSuppressions) Suppressed(ctx context.Context, n *Notification) (string, error) {
+	return s[n.Recipient], nil
+}
+
+func TestDispatchSuppressions(t *testing.T) {
+	userID := 7
+	store := &memStore{}
+	sender := &flakySender{}
+	prefs := &stubPreferences{}
+	dispatcher := NewDispatcher(store, sender, events.LogPublisher{}, nil, prefs, stubSuppressions{"b@example.com": "bounced"}, "")
+	for _, recipient := range []string{"b@example.com", "a@example.com"} {
+		if err := dispatcher.Dispatch(context.Background(), &Notification{Notification: models.Notification{UserID: &userID, Recipient: recipient, Channel: "email", Subject: "Hi", Body: "Hi"}}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if n := store.get(1); n.Status != StatusSuppressed || n.LastError != "recipient suppressed: bounced" || n.Provider != "" {
+		t.Errorf("Expected the suppressed recipient's notification recorded unsent, got: %+v", n)
+	}
+	if n := store.get(2); n.Status != StatusSent || sender.sent != 1 {
+		t.Errorf("Expected the other notification to be sent, got: %+v, %d sends", n, sender.sent)
+	}
+}
+
+type rejectingSender struct{}
+
+func (rejectingSender) Provider() string { return "push" }
+
+func (rejectingSender) Send(ctx context.Context, n *Notification) error {
+	return fmt.Errorf("%w: token unregistered", ErrInvalidRecipient)
+}
+
+type stubChannels []string
+
+func (c stubChannels) Channels(ctx context.Context, userID int, typ string) ([]string, error) {
+	return c, nil
+}
+
+type stubContacts map[string][]string
+
+func (c stubContacts) Recipients(ctx context.Context, userID int, channel string) ([]string, error) {
+	return c[channel], nil
+}
+
+func TestDispatchCopies(t *testing.T) {
+	userID := 7
+	store := &memStore{}
+	email := &flakySender{}
+	senders := ChannelSenders{Default: email, ByChannel: map[string]Sender{"push": rejectingSender{}}}
+	dispatcher := NewDispatcher(store, senders, events.LogPublisher{}, nil, &stubPreferences{}, nil, "")
+	dispatcher.CopyToChannels(stubChannels{"sms", "push"}, stubContacts{"push": {"fcm:a", "apns:b"}})
+	n := &Notification{Notification: models.Notification{UserID: &userID, Recipient: "a@example.com", Channel: "email", Type: TypeShipment, Subject: "Delivered", Body: "Order #42",
+		ContextType: "order", ContextID: "42"}}
+	if err := dispatcher.Dispatch(context.Background(), n); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(store.created) != 3 {
+		t.Fatalf("Expected the email and a copy per push device, got: %+v", store.created)
+	}
+	if n := store.get(1); n.Status != StatusSent || n.Provider != "default" {
+		t.Errorf("Expected the email sent through the default sender, got: %+v", n)
+	}
+	for i, recipient := range []string{"fcm:a", "apns:b"} {
+		c := store.get(i + 2)
+		if c.Channel != "push" || c.Recipient != recipient || c.Subject != "Delivered" || c.Body != "" || c.Type != TypeShipment || c.ContextID != "42" {
+			t.Errorf("Expected a push copy to %s with the subject alone, got: %+v", recipient, c)
+		}
+		if c.Status != StatusSuppressed || c.Provider != "push" || c.Attempts != 1 {
+			t.Errorf("Expected the rejected token suppressed rather than retried, got: %+v", c)
+		}
+	}
+}
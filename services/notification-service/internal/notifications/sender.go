@@ -0,0 +1,69 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// Sender delivers a notification over its channel.
+type Sender interface {
+	Send(ctx context.Context, n *Notification) error
+}
+
+// ErrInvalidRecipient is returned, wrapped, by a Sender whose provider
+// says the recipient does not exist, such as a push token for an app that
+// was uninstalled. Trying again would fail the same way, so the
+// notification is suppressed instead of retried.
+var ErrInvalidRecipient = errors.New("recipient rejected by provider")
+
+// A Sender may name its provider, which labels its delivery attempts,
+// dead letters and failure metrics. A Sender without a name is "default".
+type Provider interface {
+	Provider() string
+}
+
+// providerName names the provider s sends notifications on channel
+// through.
+func providerName(s Sender, channel string) string {
+	if c, ok := s.(ChannelSenders); ok {
+		s = c.sender(channel)
+	}
+	if p, ok := s.(Provider); ok {
+		return p.Provider()
+	}
+	return "default"
+}
+
+// ChannelSenders sends each notification through the Sender for its
+// channel, or through Default if the channel has none.
+type ChannelSenders struct {
+	Default   Sender
+	ByChannel map[string]Sender
+}
+
+func (c ChannelSenders) sender(channel string) Sender {
+	if s, ok := c.ByChannel[channel]; ok {
+		return s
+	}
+	return c.Default
+}
+
+func (c ChannelSenders) Send(ctx context.Context, n *Notification) error {
+	return c.sender(n.Channel).Send(ctx, n)
+}
+
+// LogSender writes notifications to the service log instead of delivering
+// them. It is the default until a real provider is configured.
+type LogSender struct{}
+
+func (LogSender) Provider() string { return "log" }
+
+func (LogSender) Send(ctx context.Context, n *Notification) error {
+	signed := "unsigned"
+	if n.DKIM != nil {
+		signed = "signed d=" + n.DKIM.Domain + " s=" + n.DKIM.Selector
+	}
+	log.Printf("Sending %s notification %d from %q (%s) to %s (reply to %q, in reply to %q, unsubscribe %q): %s", n.Channel, n.ID, n.From, signed, n.Recipient, n.ReplyTo, n.InReplyTo, n.UnsubscribeURL, n.Subject)
+	return nil
+}
@@ -0,0 +1,252 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// A suppressed notification is one the user opted out of; it is never
+// sent. A deferred one waits for the user's quiet hours to end. A batched
+// one waits for the user's next digest, and is digested once the digest
+// gathering it is sent instead.
+const (
+	StatusQueued     = "queued"
+	StatusSent       = "sent"
+	StatusFailed     = "failed"
+	StatusSuppressed = "suppressed"
+	StatusDeferred   = "deferred"
+	StatusBatched    = "batched"
+	StatusDigested   = "digested"
+	// StatusDeadLettered marks a notification that failed every attempt
+	// and waits in the dead-letter queue to be inspected or re-driven.
+	StatusDeadLettered = "dead_lettered"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type Notification struct {
+	models.Notification
+	// ReplyToken identifies the notification when a reply comes back
+	// through the inbound webhook; ReplyTo and MessageID carry it.
+	ReplyToken string `json:"-"`
+	// DKIM signs deliveries from From, settled with it on each attempt.
+	DKIM *DKIM `json:"-"`
+	// Tenant is only read back for retries, which run outside a request.
+	Tenant string `json:"-"`
+	// ThreadTokens are the reply tokens of the last 10 earlier
+	// notifications in the thread, oldest first, which InReplyTo and
+	// References are built from.
+	ThreadTokens []string `json:"-"`
+	// UnsubscribeURL opts the user out of the notification's type on its
+	// channel. Email senders put it in the List-Unsubscribe header.
+	UnsubscribeURL string `json:"-"`
+}
+
+// threadTokens reads the comma-separated reply tokens of the notification's
+// predecessors in its thread. It bounds the References header of long
+// threads to 10 message IDs.
+const threadTokens = `COALESCE((SELECT string_agg(recent.reply_token, ',' ORDER BY recent.id)
+		FROM (SELECT p.id, p.reply_token FROM notification_service.notifications p
+			WHERE p.thread_id = notifications.thread_id AND p.id < notifications.id
+			ORDER BY p.id DESC LIMIT 10) recent), '')`
+
+const notificationColumns = `id, user_id, recipient, channel, type, subject, body, status, created_at, sent_at, attempts,
+	COALESCE(context_type, ''), COALESCE(context_id, ''), reply_token, tenant_id, thread_id, deliver_after,
+	COALESCE(provider, ''), COALESCE(last_error, ''), digest_id, ` + threadTokens
+
+func scanNotification(row interface{ Scan(...any) error }) (*Notification, error) {
+	var n Notification
+	var tokens string
+	if err := row.Scan(&n.ID, &n.UserID, &n.Recipient, &n.Channel, &n.Type, &n.Subject, &n.Body, &n.Status, &n.CreatedAt, &n.SentAt, &n.Attempts,
+		&n.ContextType, &n.ContextID, &n.ReplyToken, &n.Tenant, &n.ThreadID, &n.DeliverAfter,
+		&n.Provider, &n.LastError, &n.DigestID, &tokens); err != nil {
+		return nil, err
+	}
+	n.ThreadTokens = splitTokens(tokens)
+	return &n, nil
+}
+
+func splitTokens(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+type Store interface {
+	Create(ctx context.Context, n *Notification) error
+	// RecordAttempt stores the outcome of a delivery attempt as the
+	// notification's status and adds it to its attempt history.
+	RecordAttempt(ctx context.Context, id int, a Attempt) error
+	// Hold records that a notification was not sent, suppressed, deferred
+	// or batched until until, without counting a delivery attempt.
+	Hold(ctx context.Context, id int, status string, until *time.Time) error
+	ListByUser(ctx context.Context, userID, limit int) ([]Notification, error)
+	FindByReplyToken(ctx context.Context, token string) (*Notification, error)
+	ListThreads(ctx context.Context, userID, limit int) ([]Thread, error)
+	// GetThread returns the thread with its notifications, oldest first.
+	GetThread(ctx context.Context, id int64) (*Thread, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Create adds n to its thread, starting one if needed, and loads
+// ThreadTokens. The thread row stays locked until the insert commits, so
+// concurrent notifications to one thread see each other in order.
+func (s *PostgresStore) Create(ctx context.Context, n *Notification) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tenantID := tenant.FromContext(ctx)
+	const thread string = `INSERT INTO notification_service.notification_threads
+		(tenant_id, user_id, recipient, context_type, context_id, subject)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6)
+		ON CONFLICT (tenant_id, recipient, context_type, context_id) DO UPDATE
+		SET message_count = notification_threads.message_count + 1, last_message_at = NOW(),
+			user_id = COALESCE(notification_threads.user_id, EXCLUDED.user_id)
+		RETURNING id`
+	if err := tx.QueryRowContext(ctx, thread, tenantID, n.UserID, n.Recipient, n.ContextType, n.ContextID, n.Subject).
+		Scan(&n.ThreadID); err != nil {
+		return err
+	}
+
+	const query string = `INSERT INTO notification_service.notifications
+		(user_id, recipient, channel, type, subject, body, status, context_type, context_id, reply_token, tenant_id, thread_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), $10, $11, $12) RETURNING id, created_at`
+	if err := tx.QueryRowContext(ctx, query, n.UserID, n.Recipient, n.Channel, n.Type, n.Subject, n.Body, n.Status,
+		n.ContextType, n.ContextID, n.ReplyToken, tenantID, n.ThreadID).
+		Scan(&n.ID, &n.CreatedAt); err != nil {
+		return err
+	}
+
+	const tokens string = `SELECT ` + threadTokens + ` FROM notification_service.notifications WHERE id = $1`
+	var joined string
+	if err := tx.QueryRowContext(ctx, tokens, n.ID).Scan(&joined); err != nil {
+		return err
+	}
+	n.ThreadTokens = splitTokens(joined)
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RecordAttempt(ctx context.Context, id int, a Attempt) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `WITH attempted AS (
+			UPDATE notification_service.notifications
+			SET status = $2, sent_at = CASE WHEN $2 = 'sent' THEN NOW() ELSE sent_at END,
+				attempts = attempts + 1, last_attempt_at = NOW(), provider = NULLIF($3, ''), last_error = NULLIF($4, '')
+			WHERE id = $1 RETURNING id)
+		INSERT INTO notification_service.notification_attempts (notification_id, status, provider, error)
+		SELECT id, $2, $3, $4 FROM attempted`
+	_, err := s.db.ExecContext(ctx, query, id, a.Status, a.Provider, a.Error)
+	return err
+}
+
+func (s *PostgresStore) Hold(ctx context.Context, id int, status string, until *time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.notifications SET status = $2, deliver_after = $3 WHERE id = $1`
+	_, err := s.db.ExecContext(ctx, query, id, status, until)
+	return err
+}
+
+func (s *PostgresStore) ListByUser(ctx context.Context, userID, limit int) ([]Notification, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + notificationColumns + `
+		FROM notification_service.notifications WHERE tenant_id = $3 AND user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`
+	rows, err := s.db.QueryContext(ctx, query, userID, limit, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, *n)
+	}
+	return notifications, rows.Err()
+}
+
+func (s *PostgresStore) FindByReplyToken(ctx context.Context, token string) (*Notification, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + notificationColumns + ` FROM notification_service.notifications WHERE reply_token = $1`
+	n, err := scanNotification(s.db.QueryRowContext(ctx, query, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return n, err
+}
+
+func (s *PostgresStore) ListRetryable(ctx context.Context, maxAttempts int, backoff time.Duration, limit int) ([]Notification, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + notificationColumns + `
+		FROM notification_service.notifications
+		WHERE (status = 'failed' AND attempts < $1 AND (last_attempt_at IS NULL
+				OR last_attempt_at + make_interval(secs => $2 * power(2, attempts - 1)) <= NOW()))
+			OR (status = 'deferred' AND deliver_after <= NOW())
+		ORDER BY COALESCE(last_attempt_at, deliver_after), id LIMIT $3`
+	rows, err := s.db.QueryContext(ctx, query, maxAttempts, backoff.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, *n)
+	}
+	return notifications, rows.Err()
+}
+
+func (s *PostgresStore) ClaimRetry(ctx context.Context, id int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.notifications SET status = 'queued'
+		WHERE id = $1 AND status IN ('failed', 'deferred')`
+	res, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// Thread is a conversation in the inbox: every notification to one recipient
+// about one context, such as all messages about order 123. Subject is the
+// first notification's.
+type Thread struct {
+	ID            int64          `json:"id"`
+	UserID        *int           `json:"user_id,omitempty"`
+	Recipient     string         `json:"recipient"`
+	ContextType   string         `json:"context_type,omitempty"`
+	ContextID     string         `json:"context_id,omitempty"`
+	Subject       string         `json:"subject"`
+	MessageCount  int            `json:"message_count"`
+	CreatedAt     time.Time      `json:"created_at"`
+	LastMessageAt time.Time      `json:"last_message_at"`
+	Notifications []Notification `json:"notifications,omitempty"`
+}
+
+const threadColumns = `id, user_id, recipient, COALESCE(context_type, ''), COALESCE(context_id, ''), subject,
+	message_count, created_at, last_message_at`
+
+func scanThread(row interface{ Scan(...any) error }) (*Thread, error) {
+	var t Thread
+	if err := row.Scan(&t.ID, &t.UserID, &t.Recipient, &t.ContextType, &t.ContextID, &t.Subject,
+		&t.MessageCount, &t.CreatedAt, &t.LastMessageAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *PostgresStore) ListThreads(ctx context.Context, userID, limit int) ([]Thread, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + threadColumns + `
+		FROM notification_service.notification_threads WHERE tenant_id = $3 AND user_id = $1
+		ORDER BY last_message_at DESC, id DESC LIMIT $2`
+	rows, err := s.db.QueryContext(ctx, query, userID, limit, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threads := []Thread{}
+	for rows.Next() {
+		t, err := scanThread(rows)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, *t)
+	}
+	return threads, rows.Err()
+}
+
+func (s *PostgresStore) GetThread(ctx context.Context, id int64) (*Thread, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + threadColumns + `
+		FROM notification_service.notification_threads WHERE id = $1 AND tenant_id = $2`
+	t, err := scanThread(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	const messages string = `SELECT ` + notificationColumns + `
+		FROM notification_service.notifications WHERE thread_id = $1 ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, messages, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t.Notifications = []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		t.Notifications = append(t.Notifications, *n)
+	}
+	return t, rows.Err()
+}
+
+func (h *Handler) listThreads(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id query parameter is required"})
+		return
+	}
+	if !auth.AuthorizeUser(c, userID) {
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	threads, err := h.store.ListThreads(c.Request.Context(), userID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"threads": threads})
+}
+
+func (h *Handler) getThread(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid thread id"})
+		return
+	}
+	t, err := h.store.GetThread(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "thread not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Threads sent to no user, only an address, are for admins and services.
+	owner := 0
+	if t.UserID != nil {
+		owner = *t.UserID
+	}
+	if !auth.AuthorizeUser(c, owner) {
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
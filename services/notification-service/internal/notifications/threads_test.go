@@ -0,0 +1,109 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// threadStore threads notifications by recipient and context like
+// PostgresStore.
+type threadStore struct {
+	memStore
+	threads map[string]*Thread
+	byID    map[int64]*Thread
+}
+
+func (s *threadStore) Create(ctx context.Context, n *Notification) error {
+	key := n.Recipient + "|" + n.ContextType + "|" + n.ContextID
+	t, ok := s.threads[key]
+	if !ok || n.ContextType == "" {
+		t = &Thread{ID: int64(len(s.byID) + 1), UserID: n.UserID, Recipient: n.Recipient, ContextType: n.ContextType, ContextID: n.ContextID, Subject: n.Subject}
+		s.threads[key], s.byID[t.ID] = t, t
+	}
+	n.ThreadID = t.ID
+	n.ThreadTokens = nil
+	for _, prev := range t.Notifications {
+		n.ThreadTokens = append(n.ThreadTokens, prev.ReplyToken)
+	}
+	if err := s.memStore.Create(ctx, n); err != nil {
+		return err
+	}
+	t.MessageCount++
+	t.Notifications = append(t.Notifications, *n)
+	return nil
+}
+
+func (s *threadStore) GetThread(ctx context.Context, id int64) (*Thread, error) {
+	t, ok := s.byID[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+func TestDispatchThreadsEmails(t *testing.T) {
+	store := &threadStore{threads: map[string]*Thread{}, byID: map[int64]*Thread{}}
+	dispatcher := NewDispatcher(store, LogSender{}, events.LogPublisher{}, nil, nil, nil, "replies.example.com")
+	userID := 7
+	send := func(subject, contextID string) *Notification {
+		n := &Notification{Notification: models.Notification{UserID: &userID, Recipient: "ada@example.com", Channel: "email", Subject: subject, Body: subject,
+			ContextType: "order", ContextID: contextID}}
+		if err := dispatcher.Dispatch(context.Background(), n); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		return n
+	}
+
+	placed := send("Order #123 placed", "123")
+	if placed.InReplyTo != "" || len(placed.References) != 0 {
+		t.Errorf("Expected the first email to start the thread, got: %q %v", placed.InReplyTo, placed.References)
+	}
+	shipped := send("Order #123 shipped", "123")
+	other := send("Order #124 placed", "124")
+	delivered := send("Order #123 delivered", "123")
+
+	if shipped.ThreadID != placed.ThreadID || delivered.ThreadID != placed.ThreadID || other.ThreadID == placed.ThreadID {
+		t.Fatalf("Expected order 123's notifications in one thread, got: %d %d %d %d", placed.ThreadID, shipped.ThreadID, delivered.ThreadID, other.ThreadID)
+	}
+	if delivered.InReplyTo != shipped.MessageID {
+		t.Errorf("Expected In-Reply-To %q, got: %q", shipped.MessageID, delivered.InReplyTo)
+	}
+	if len(delivered.References) != 2 || delivered.References[0] != placed.MessageID || delivered.References[1] != shipped.MessageID {
+		t.Errorf("Expected References to both earlier emails, got: %v", delivered.References)
+	}
+	if other.InReplyTo != "" {
+		t.Errorf("Expected order 124 to start its own thread, got: %q", other.InReplyTo)
+	}
+
+	gin.SetMode(gin.TestMode)
+	get := func(p *auth.Principal, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, dispatcher, nil, nil).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	w := get(&auth.Principal{UserID: 7, Roles: []string{"customer"}}, "/notifications/threads/1")
+	var thread Thread
+	if err := json.Unmarshal(w.Body.Bytes(), &thread); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the thread, got: %d %s", w.Code, w.Body.String())
+	}
+	if thread.MessageCount != 3 || len(thread.Notifications) != 3 || thread.Subject != "Order #123 placed" {
+		t.Errorf("Expected three notifications under the first subject, got: %+v", thread)
+	}
+	if w := get(&auth.Principal{UserID: 8, Roles: []string{"customer"}}, "/notifications/threads/1"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's thread to be forbidden, got: %d", w.Code)
+	}
+	if w := get(&auth.Principal{UserID: 7, Roles: []string{"customer"}}, "/notifications/threads/9"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown thread to be 404, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,97 @@
+// Package nudges turns user-service profile and onboarding events into
+// reminder notifications.
+package nudges
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+const queue = "notification-service.profile-nudges"
+
+type Consumer struct {
+	dispatcher *notifications.Dispatcher
+}
+
+func NewConsumer(dispatcher *notifications.Dispatcher) *Consumer {
+	return &Consumer{dispatcher: dispatcher}
+}
+
+// Run consumes profile and onboarding events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	patterns := []string{events.UserProfileIncomplete, events.UserOnboardingStalled}
+	return subscriber.Subscribe(ctx, queue, patterns, c.Handle)
+}
+
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	switch e.Type {
+	case events.UserProfileIncomplete:
+		var payload events.ProfileIncomplete
+		if err := e.Decode(&payload); err != nil {
+			return err
+		}
+		return c.dispatcher.Dispatch(ctx, nudge(payload))
+	case events.UserOnboardingStalled:
+		var payload events.OnboardingStalled
+		if err := e.Decode(&payload); err != nil {
+			return err
+		}
+		if payload.Tenant != "" {
+			ctx = tenant.NewContext(ctx, payload.Tenant)
+		}
+		return c.dispatcher.Dispatch(ctx, onboardingNudge(payload))
+	}
+	return nil
+}
+
+func nudge(p events.ProfileIncomplete) *notifications.Notification {
+	var body strings.Builder
+	name := greeting(p.Username)
+	fmt.Fprintf(&body, "Hi %s, your profile is %d%% complete. A few more details will finish it:\n\n", name, p.Percent)
+	for _, m := range p.Missing {
+		fmt.Fprintf(&body, "- %s\n", m.Hint)
+	}
+
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:    &userID,
+		Recipient: p.Email,
+		Channel:   "email",
+		Type:      notifications.TypeProfileNudge,
+		Subject:   "Finish setting up your profile",
+		Body:      body.String(),
+	}}
+}
+
+// onboardingNudge reminds the user of the step they stalled on. It is sent as
+// a profile nudge, so users who opted out of those are not sent it either.
+func onboardingNudge(p events.OnboardingStalled) *notifications.Notification {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s, you have done %d of %d steps to get set up. Next up: %s.\n", greeting(p.Username), p.Completed, p.Total, p.Title)
+	if p.Hint != "" {
+		fmt.Fprintf(&body, "\n%s\n", p.Hint)
+	}
+
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:    &userID,
+		Recipient: p.Email,
+		Channel:   "email",
+		Type:      notifications.TypeProfileNudge,
+		Subject:   p.Title,
+		Body:      body.String(),
+	}}
+}
+
+func greeting(username string) string {
+	if username == "" {
+		return "there"
+	}
+	return username
+}
@@ -0,0 +1,110 @@
+package nudges
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+type memStore struct {
+	created []notifications.Notification
+}
+
+func (s *memStore) Create(ctx context.Context, n *notifications.Notification) error {
+	n.ID = len(s.created) + 1
+	s.created = append(s.created, *n)
+	return nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, id int, a notifications.Attempt) error {
+	s.created[id-1].Status = a.Status
+	return nil
+}
+
+func (s *memStore) Hold(ctx context.Context, id int, status string, until *time.Time) error {
+	s.created[id-1].Status = status
+	return nil
+}
+
+func (s *memStore) ListByUser(ctx context.Context, userID, limit int) ([]notifications.Notification, error) {
+	return s.created, nil
+}
+
+func (s *memStore) FindByReplyToken(ctx context.Context, token string) (*notifications.Notification, error) {
+	return nil, notifications.ErrNotFound
+}
+
+func (s *memStore) ListThreads(ctx context.Context, userID, limit int) ([]notifications.Thread, error) {
+	return nil, nil
+}
+
+func (s *memStore) GetThread(ctx context.Context, id int64) (*notifications.Thread, error) {
+	return nil, notifications.ErrNotFound
+}
+
+func TestHandleSendsNudge(t *testing.T) {
+	store := &memStore{}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, ""))
+
+	e, err := events.New(events.UserProfileIncomplete, "user-service", events.ProfileIncomplete{
+		UserID:   2,
+		Email:    "ada@acme.example.com",
+		Username: "acmeadmin",
+		Percent:  50,
+		Missing:  []events.MissingField{{Field: "phone", Hint: "Add a phone number"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	if err := consumer.Handle(context.Background(), e); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(store.created) != 1 {
+		t.Fatalf("Expected 1 notification, got: %d", len(store.created))
+	}
+	n := store.created[0]
+	if n.Recipient != "ada@acme.example.com" || *n.UserID != 2 || n.Status != notifications.StatusSent {
+		t.Errorf("Expected sent nudge for user 2, got: %+v", n)
+	}
+	if !strings.Contains(n.Body, "50%") || !strings.Contains(n.Body, "Add a phone number") {
+		t.Errorf("Expected body to include progress and hints, got: %q", n.Body)
+	}
+}
+
+func TestHandleSendsOnboardingNudge(t *testing.T) {
+	store := &memStore{}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, ""))
+
+	e, err := events.New(events.UserOnboardingStalled, "user-service", events.OnboardingStalled{
+		UserID:    3,
+		Tenant:    "acme",
+		Email:     "new@acme.example.com",
+		Step:      "place_first_order",
+		Title:     "Place your first order",
+		Hint:      "Browse the catalog and check out your first order.",
+		Completed: 2,
+		Total:     3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	if err := consumer.Handle(context.Background(), e); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(store.created) != 1 {
+		t.Fatalf("Expected 1 notification, got: %d", len(store.created))
+	}
+	n := store.created[0]
+	if n.Recipient != "new@acme.example.com" || n.Type != notifications.TypeProfileNudge || n.Subject != "Place your first order" {
+		t.Errorf("Expected onboarding nudge for user 3, got: %+v", n)
+	}
+	if !strings.Contains(n.Body, "Hi there") || !strings.Contains(n.Body, "2 of 3") || !strings.Contains(n.Body, "Browse the catalog") {
+		t.Errorf("Expected body to include progress and hint, got: %q", n.Body)
+	}
+}
@@ -0,0 +1,233 @@
+package preferences
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	manager *Manager
+}
+
+func NewHandler(manager *Manager) *Handler {
+	return &Handler{manager: manager}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Users manage their own preferences; the unsubscribe routes need only the
+// token from the email.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/notifications/preferences", h.get)
+	router.PUT("/notifications/preferences", h.set)
+	router.DELETE("/notifications/preferences", h.reset)
+	router.PUT("/notifications/preferences/quiet-hours", h.setQuietHours)
+	router.DELETE("/notifications/preferences/quiet-hours", h.removeQuietHours)
+	router.GET("/notifications/unsubscribe", h.checkUnsubscribe)
+	router.POST("/notifications/unsubscribe", h.unsubscribe)
+}
+
+// queryUser reads and authorizes the user_id query parameter.
+func queryUser(c *gin.Context) (int, bool) {
+	userID, err := strconv.Atoi(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id query parameter is required"})
+		return 0, false
+	}
+	return userID, auth.AuthorizeUser(c, userID)
+}
+
+func validate(typ, channel string) error {
+	if !notifications.KnownType(typ) {
+		return errors.New("type must be one of " + strings.Join(notifications.Types, ", "))
+	}
+	if !validChannel.MatchString(channel) {
+		return errors.New("channel must be lowercase letters, digits and underscores")
+	}
+	return nil
+}
+
+type settingsResponse struct {
+	*Settings
+	Types []string `json:"types"`
+}
+
+func (h *Handler) get(c *gin.Context) {
+	userID, ok := queryUser(c)
+	if !ok {
+		return
+	}
+	settings, err := h.manager.store.Get(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settingsResponse{Settings: settings, Types: notifications.Types})
+}
+
+type setRequest struct {
+	UserID  int    `json:"user_id" binding:"required"`
+	Type    string `json:"type" binding:"required"`
+	Channel string `json:"channel" binding:"required"`
+	Enabled *bool  `json:"enabled" binding:"required"`
+	Digest  string `json:"digest"`
+}
+
+// validateDigest allows digests of the low-priority types, on email, where
+// the digest template renders.
+func validateDigest(typ, channel, schedule string) error {
+	switch {
+	case schedule == "":
+		return nil
+	case schedule != DigestHourly && schedule != DigestDaily:
+		return errors.New("digest must be " + DigestHourly + " or " + DigestDaily)
+	case !notifications.Digestible(typ):
+		return errors.New("digests are only available for " + strings.Join(notifications.DigestTypes, ", "))
+	case channel != "email":
+		return errors.New("digests are only available on the email channel")
+	}
+	return nil
+}
+
+func (h *Handler) set(c *gin.Context) {
+	var req setRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, req.UserID) {
+		return
+	}
+	if err := validate(req.Type, req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateDigest(req.Type, req.Channel, req.Digest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p := &Preference{Type: req.Type, Channel: req.Channel, Enabled: *req.Enabled, Digest: req.Digest}
+	if err := h.manager.store.SetPreference(c.Request.Context(), req.UserID, p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// reset removes a preference, so the type is on again for the channel.
+func (h *Handler) reset(c *gin.Context) {
+	userID, ok := queryUser(c)
+	if !ok {
+		return
+	}
+	err := h.manager.store.DeletePreference(c.Request.Context(), userID, c.Query("type"), c.Query("channel"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "preference not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type quietHoursRequest struct {
+	UserID   int      `json:"user_id" binding:"required"`
+	Start    string   `json:"start" binding:"required"`
+	End      string   `json:"end" binding:"required"`
+	TimeZone string   `json:"time_zone"`
+	Channels []string `json:"channels"`
+}
+
+func (h *Handler) setQuietHours(c *gin.Context) {
+	var req quietHoursRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, req.UserID) {
+		return
+	}
+	q := &QuietHours{Start: req.Start, End: req.End, TimeZone: req.TimeZone, Channels: req.Channels}
+	if err := q.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.manager.store.SetQuietHours(c.Request.Context(), req.UserID, q); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+func (h *Handler) removeQuietHours(c *gin.Context) {
+	userID, ok := queryUser(c)
+	if !ok {
+		return
+	}
+	err := h.manager.store.DeleteQuietHours(c.Request.Context(), userID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no quiet hours are set"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// token reads the unsubscribe token and puts its tenant on the request.
+func (h *Handler) token(c *gin.Context) (unsubscribe, bool) {
+	u, err := h.manager.parse(c.Query("token"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return u, false
+	}
+	c.Request = c.Request.WithContext(tenant.NewContext(c.Request.Context(), u.Tenant))
+	return u, true
+}
+
+type unsubscribeResponse struct {
+	Type       string `json:"type"`
+	Channel    string `json:"channel"`
+	Subscribed bool   `json:"subscribed"`
+}
+
+// checkUnsubscribe tells the page an unsubscribe link opens what the link
+// is for. Opening the link changes nothing, so mail scanners that follow
+// links cannot unsubscribe anyone.
+func (h *Handler) checkUnsubscribe(c *gin.Context) {
+	u, ok := h.token(c)
+	if !ok {
+		return
+	}
+	settings, err := h.manager.store.Get(c.Request.Context(), u.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, unsubscribeResponse{Type: u.Type, Channel: u.Channel, Subscribed: settings.enabled(u.Type, u.Channel)})
+}
+
+// unsubscribe turns the token's type off for its channel. Mail clients'
+// one-click unsubscribe (RFC 8058) posts here too.
+func (h *Handler) unsubscribe(c *gin.Context) {
+	u, ok := h.token(c)
+	if !ok {
+		return
+	}
+	p := &Preference{Type: u.Type, Channel: u.Channel, Enabled: false}
+	if err := h.manager.store.SetPreference(c.Request.Context(), u.UserID, p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, unsubscribeResponse{Type: u.Type, Channel: u.Channel})
+}
@@ -0,0 +1,289 @@
+// Package preferences lets users choose which notifications they receive:
+// each notification type can be turned off per channel, and quiet hours
+// hold notifications until a time of day. Low-priority types can be
+// batched into an hourly or daily digest instead of sent one by one. Emails
+// carry a signed unsubscribe link that turns their type off for the email
+// channel without signing in. Turning a type on for SMS or push copies its
+// emails there.
+package preferences
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+var ErrNotFound = errors.New("not found")
+
+var validChannel = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// Digest schedules. Hourly digests go out on the hour; daily ones at
+// dailyDigestHour in the user's quiet hours time zone, or UTC.
+const (
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+)
+
+const dailyDigestHour = 8
+
+// Preference turns one type of notification on or off on one channel.
+// Types and channels without a preference are on, but emails are only
+// copied to one of notifications.OptInChannels once it is turned on there.
+// Digest, if set, batches an enabled type into a digest on its schedule.
+type Preference struct {
+	Type      string    `json:"type"`
+	Channel   string    `json:"channel"`
+	Enabled   bool      `json:"enabled"`
+	Digest    string    `json:"digest,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// QuietHours hold notifications from Start until End, times of day in
+// TimeZone, on Channels or on every channel if it is empty. A Start after
+// End spans midnight.
+type QuietHours struct {
+	Start     string    `json:"start"`
+	End       string    `json:"end"`
+	TimeZone  string    `json:"time_zone"`
+	Channels  []string  `json:"channels"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Settings are a user's preferences and quiet hours, nil if they have none.
+type Settings struct {
+	UserID      int          `json:"user_id"`
+	Preferences []Preference `json:"preferences"`
+	QuietHours  *QuietHours  `json:"quiet_hours"`
+}
+
+func (s *Settings) enabled(typ, channel string) bool {
+	for _, p := range s.Preferences {
+		if p.Type == typ && p.Channel == channel {
+			return p.Enabled
+		}
+	}
+	return true
+}
+
+func (s *Settings) digest(typ, channel string) string {
+	for _, p := range s.Preferences {
+		if p.Type == typ && p.Channel == channel {
+			return p.Digest
+		}
+	}
+	return ""
+}
+
+// nextDigest returns when the first digest on schedule after now is due,
+// in loc.
+func nextDigest(now time.Time, schedule string, loc *time.Location) time.Time {
+	local := now.In(loc)
+	if schedule == DigestHourly {
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour()+1, 0, 0, 0, loc)
+	}
+	at := time.Date(local.Year(), local.Month(), local.Day(), dailyDigestHour, 0, 0, 0, loc)
+	if !at.After(local) {
+		at = time.Date(local.Year(), local.Month(), local.Day()+1, dailyDigestHour, 0, 0, 0, loc)
+	}
+	return at
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *QuietHours) validate() error {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return errors.New("quiet hours must start and end at different times")
+	}
+	if q.TimeZone == "" {
+		q.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(q.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone %q", q.TimeZone)
+	}
+	if q.Channels == nil {
+		q.Channels = []string{}
+	}
+	for _, ch := range q.Channels {
+		if !validChannel.MatchString(ch) {
+			return fmt.Errorf("invalid channel %q", ch)
+		}
+	}
+	return nil
+}
+
+// until returns when the quiet hours in effect at now end on channel, or
+// the zero time if they are not in effect.
+func (q *QuietHours) until(now time.Time, channel string) time.Time {
+	if len(q.Channels) > 0 {
+		applies := false
+		for _, ch := range q.Channels {
+			applies = applies || ch == channel
+		}
+		if !applies {
+			return time.Time{}
+		}
+	}
+	loc, err := time.LoadLocation(q.TimeZone)
+	if err != nil {
+		return time.Time{}
+	}
+	start, errStart := parseClock(q.Start)
+	end, errEnd := parseClock(q.End)
+	if errStart != nil || errEnd != nil {
+		return time.Time{}
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	quiet := start <= minute && minute < end
+	if start > end {
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return time.Time{}
+	}
+	at := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, loc)
+	if !at.After(local) {
+		at = time.Date(local.Year(), local.Month(), local.Day()+1, end/60, end%60, 0, 0, loc)
+	}
+	return at
+}
+
+// Manager decides on notifications for the dispatcher and signs unsubscribe
+// links.
+type Manager struct {
+	store          Store
+	secret         []byte
+	unsubscribeURL string
+}
+
+var _ notifications.Preferences = (*Manager)(nil)
+
+// NewManager signs unsubscribe tokens with secret and links them from
+// unsubscribeURL. Without a secret, emails carry no unsubscribe link.
+func NewManager(store Store, secret, unsubscribeURL string) *Manager {
+	return &Manager{store: store, secret: []byte(secret), unsubscribeURL: unsubscribeURL}
+}
+
+func (m *Manager) Decide(ctx context.Context, n *notifications.Notification, now time.Time) (notifications.Decision, error) {
+	var d notifications.Decision
+	settings, err := m.store.Get(ctx, *n.UserID)
+	if err != nil {
+		return d, err
+	}
+	if !settings.enabled(n.Type, n.Channel) {
+		d.Suppress = true
+		return d, nil
+	}
+	if settings.QuietHours != nil {
+		d.Until = settings.QuietHours.until(now, n.Channel)
+	}
+	// A digest's items carry the unsubscribe links; there is no opting out
+	// of the digest itself, only of what it gathers.
+	if n.Type == notifications.TypeDigest {
+		return d, nil
+	}
+	if schedule := settings.digest(n.Type, n.Channel); schedule != "" && notifications.Digestible(n.Type) {
+		loc := time.UTC
+		if settings.QuietHours != nil {
+			if l, err := time.LoadLocation(settings.QuietHours.TimeZone); err == nil {
+				loc = l
+			}
+		}
+		d.Digest = nextDigest(now, schedule, loc)
+	}
+	if len(m.secret) > 0 {
+		token := m.sign(unsubscribe{Tenant: tenant.FromContext(ctx), UserID: *n.UserID, Type: n.Type, Channel: n.Channel})
+		d.UnsubscribeURL = m.unsubscribeURL + "?token=" + token
+	}
+	return d, nil
+}
+
+var _ notifications.ChannelSelector = (*Manager)(nil)
+
+// Channels returns the OptInChannels the user turned typ on for.
+func (m *Manager) Channels(ctx context.Context, userID int, typ string) ([]string, error) {
+	settings, err := m.store.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var channels []string
+	for _, channel := range notifications.OptInChannels {
+		for _, p := range settings.Preferences {
+			if p.Type == typ && p.Channel == channel && p.Enabled {
+				channels = append(channels, channel)
+			}
+		}
+	}
+	return channels, nil
+}
+
+// unsubscribe is what an unsubscribe token opts out of. Tokens are signed
+// rather than stored and do not expire, so the link in an old email still
+// works.
+type unsubscribe struct {
+	Tenant  string
+	UserID  int
+	Type    string
+	Channel string
+}
+
+var encoding = base64.RawURLEncoding
+
+func (m *Manager) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (m *Manager) sign(u unsubscribe) string {
+	payload := encoding.EncodeToString([]byte(strings.Join([]string{u.Tenant, strconv.Itoa(u.UserID), u.Type, u.Channel}, "\n")))
+	return payload + "." + encoding.EncodeToString(m.mac(payload))
+}
+
+var errInvalidToken = errors.New("invalid unsubscribe token")
+
+func (m *Manager) parse(token string) (unsubscribe, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	want, err := encoding.DecodeString(sig)
+	if !ok || err != nil || len(m.secret) == 0 || !hmac.Equal(want, m.mac(payload)) {
+		return unsubscribe{}, errInvalidToken
+	}
+	raw, err := encoding.DecodeString(payload)
+	if err != nil {
+		return unsubscribe{}, errInvalidToken
+	}
+	parts := strings.Split(string(raw), "\n")
+	if len(parts) != 4 {
+		return unsubscribe{}, errInvalidToken
+	}
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return unsubscribe{}, errInvalidToken
+	}
+	return unsubscribe{Tenant: parts[0], UserID: userID, Type: parts[2], Channel: parts[3]}, nil
+}
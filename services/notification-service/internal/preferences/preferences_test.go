@@ -0,0 +1,281 @@
+package preferences
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps settings per tenant and user.
+type memStore struct {
+	settings map[string]*Settings
+}
+
+func (s *memStore) key(ctx context.Context, userID int) string {
+	return fmt.Sprintf("%s/%d", tenant.FromContext(ctx), userID)
+}
+
+func (s *memStore) Get(ctx context.Context, userID int) (*Settings, error) {
+	if settings, ok := s.settings[s.key(ctx, userID)]; ok {
+		return settings, nil
+	}
+	return &Settings{UserID: userID, Preferences: []Preference{}}, nil
+}
+
+func (s *memStore) SetPreference(ctx context.Context, userID int, p *Preference) error {
+	settings, _ := s.Get(ctx, userID)
+	s.settings[s.key(ctx, userID)] = settings
+	for i := range settings.Preferences {
+		if settings.Preferences[i].Type == p.Type && settings.Preferences[i].Channel == p.Channel {
+			settings.Preferences[i] = *p
+			return nil
+		}
+	}
+	settings.Preferences = append(settings.Preferences, *p)
+	return nil
+}
+
+func (s *memStore) DeletePreference(ctx context.Context, userID int, typ, channel string) error {
+	settings, _ := s.Get(ctx, userID)
+	for i, p := range settings.Preferences {
+		if p.Type == typ && p.Channel == channel {
+			settings.Preferences = append(settings.Preferences[:i], settings.Preferences[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memStore) SetQuietHours(ctx context.Context, userID int, q *QuietHours) error {
+	settings, _ := s.Get(ctx, userID)
+	s.settings[s.key(ctx, userID)] = settings
+	settings.QuietHours = q
+	return nil
+}
+
+func (s *memStore) DeleteQuietHours(ctx context.Context, userID int) error {
+	settings, _ := s.Get(ctx, userID)
+	if settings.QuietHours == nil {
+		return ErrNotFound
+	}
+	settings.QuietHours = nil
+	return nil
+}
+
+func TestQuietHoursUntil(t *testing.T) {
+	night := &QuietHours{Start: "22:00", End: "07:30", TimeZone: "Europe/London"}
+	if err := night.validate(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	london, _ := time.LoadLocation("Europe/London")
+	for _, tc := range []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{time.Date(2026, 10, 14, 23, 15, 0, 0, london), time.Date(2026, 10, 15, 7, 30, 0, 0, london)},
+		{time.Date(2026, 10, 15, 6, 0, 0, 0, london), time.Date(2026, 10, 15, 7, 30, 0, 0, london)},
+		{time.Date(2026, 10, 15, 7, 30, 0, 0, london), time.Time{}},
+		{time.Date(2026, 10, 15, 12, 0, 0, 0, london), time.Time{}},
+		// 21:30 UTC is 22:30 in London during summer time.
+		{time.Date(2026, 7, 1, 21, 30, 0, 0, time.UTC), time.Date(2026, 7, 2, 7, 30, 0, 0, london)},
+	} {
+		if got := night.until(tc.now, "email"); !got.Equal(tc.want) {
+			t.Errorf("Expected quiet hours at %v to end at %v, got: %v", tc.now, tc.want, got)
+		}
+	}
+
+	pushOnly := &QuietHours{Start: "09:00", End: "17:00", TimeZone: "UTC", Channels: []string{"push"}}
+	at := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	if got := pushOnly.until(at, "email"); !got.IsZero() {
+		t.Errorf("Expected email to be outside push-only quiet hours, got: %v", got)
+	}
+	if got := pushOnly.until(at, "push"); !got.Equal(time.Date(2026, 10, 15, 17, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected push to wait until 17:00, got: %v", got)
+	}
+
+	for _, bad := range []QuietHours{{Start: "25:00", End: "07:00"}, {Start: "07:00", End: "07:00"}, {Start: "22:00", End: "07:00", TimeZone: "Mars/Olympus"}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", bad)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	store := &memStore{settings: map[string]*Settings{}}
+	manager := NewManager(store, "secret", "https://example.com/unsubscribe")
+	ctx := tenant.NewContext(context.Background(), "acme")
+	userID := 7
+	n := &notifications.Notification{Notification: models.Notification{UserID: &userID, Channel: "email", Type: notifications.TypeWinBack}}
+	noon := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	d, err := manager.Decide(ctx, n, noon)
+	if err != nil || d.Suppress || !d.Until.IsZero() {
+		t.Fatalf("Expected a user without preferences to get everything now, got: %+v, %v", d, err)
+	}
+	token := strings.TrimPrefix(d.UnsubscribeURL, "https://example.com/unsubscribe?token=")
+	if u, err := manager.parse(token); err != nil || u != (unsubscribe{Tenant: "acme", UserID: 7, Type: notifications.TypeWinBack, Channel: "email"}) {
+		t.Errorf("Expected the link to unsubscribe from win-back emails, got: %+v, %v", u, err)
+	}
+	if _, err := manager.parse(token[:len(token)-2] + "xx"); err == nil {
+		t.Error("Expected a tampered token to be rejected")
+	}
+	if _, err := NewManager(store, "other", "").parse(token); err == nil {
+		t.Error("Expected a token signed with another secret to be rejected")
+	}
+
+	store.SetQuietHours(ctx, userID, &QuietHours{Start: "11:00", End: "13:00", TimeZone: "UTC"})
+	if d, _ := manager.Decide(ctx, n, noon); !d.Until.Equal(time.Date(2026, 10, 15, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the notification to wait for quiet hours to end, got: %+v", d)
+	}
+	store.SetPreference(ctx, userID, &Preference{Type: notifications.TypeWinBack, Channel: "email", Enabled: false})
+	if d, _ := manager.Decide(ctx, n, noon); !d.Suppress {
+		t.Errorf("Expected the opted-out type to be suppressed, got: %+v", d)
+	}
+	n.Type = notifications.TypeGeneral
+	if d, _ := manager.Decide(ctx, n, noon); d.Suppress {
+		t.Errorf("Expected other types to be unaffected, got: %+v", d)
+	}
+}
+
+func TestDecideDigests(t *testing.T) {
+	store := &memStore{settings: map[string]*Settings{}}
+	manager := NewManager(store, "secret", "https://example.com/unsubscribe")
+	ctx := tenant.NewContext(context.Background(), "acme")
+	userID := 7
+	n := &notifications.Notification{Notification: models.Notification{UserID: &userID, Channel: "email", Type: notifications.TypeStockAlert}}
+	now := time.Date(2026, 10, 15, 12, 20, 0, 0, time.UTC)
+
+	store.SetPreference(ctx, userID, &Preference{Type: notifications.TypeStockAlert, Channel: "email", Enabled: true, Digest: DigestHourly})
+	if d, _ := manager.Decide(ctx, n, now); !d.Digest.Equal(time.Date(2026, 10, 15, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the alert batched until the top of the hour, got: %+v", d)
+	}
+
+	// Daily digests go out at 08:00 in the quiet hours' time zone.
+	store.SetPreference(ctx, userID, &Preference{Type: notifications.TypeStockAlert, Channel: "email", Enabled: true, Digest: DigestDaily})
+	store.SetQuietHours(ctx, userID, &QuietHours{Start: "22:00", End: "07:00", TimeZone: "America/New_York"})
+	newYork, _ := time.LoadLocation("America/New_York")
+	if d, _ := manager.Decide(ctx, n, now); !d.Digest.Equal(time.Date(2026, 10, 16, 8, 0, 0, 0, newYork)) {
+		t.Errorf("Expected the alert batched until 08:00 the next day in New York, got: %+v", d)
+	}
+	early := time.Date(2026, 10, 15, 11, 0, 0, 0, time.UTC)
+	if d, _ := manager.Decide(ctx, n, early); !d.Digest.Equal(time.Date(2026, 10, 15, 8, 0, 0, 0, newYork)) {
+		t.Errorf("Expected the alert batched until 08:00 the same day in New York, got: %+v", d)
+	}
+
+	n.Type = notifications.TypeDigest
+	if d, _ := manager.Decide(ctx, n, now); !d.Digest.IsZero() || d.UnsubscribeURL != "" {
+		t.Errorf("Expected the digest itself to be sent without an unsubscribe link, got: %+v", d)
+	}
+	night := time.Date(2026, 10, 16, 3, 0, 0, 0, time.UTC)
+	if d, _ := manager.Decide(ctx, n, night); !d.Until.Equal(time.Date(2026, 10, 16, 7, 0, 0, 0, newYork)) {
+		t.Errorf("Expected the digest to wait out quiet hours, got: %+v", d)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	store := &memStore{settings: map[string]*Settings{}}
+	manager := NewManager(store, "", "")
+	ctx := context.Background()
+	userID := 7
+
+	if channels, err := manager.Channels(ctx, userID, notifications.TypeShipment); err != nil || len(channels) != 0 {
+		t.Errorf("Expected no channels besides email by default, got: %v, %v", channels, err)
+	}
+	store.SetPreference(ctx, userID, &Preference{Type: notifications.TypeShipment, Channel: "push", Enabled: true})
+	store.SetPreference(ctx, userID, &Preference{Type: notifications.TypeShipment, Channel: "sms", Enabled: false})
+	store.SetPreference(ctx, userID, &Preference{Type: notifications.TypeWinBack, Channel: "sms", Enabled: true})
+	if channels, _ := manager.Channels(ctx, userID, notifications.TypeShipment); strings.Join(channels, ",") != "push" {
+		t.Errorf("Expected shipments on push only, got: %v", channels)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{settings: map[string]*Settings{}}
+	manager := NewManager(store, "secret", "https://example.com/unsubscribe")
+	do := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		if p != nil {
+			router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		}
+		NewHandler(manager).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	ada := &auth.Principal{UserID: 7, Roles: []string{"customer"}}
+
+	if w := do(ada, http.MethodPut, "/notifications/preferences", `{"user_id": 7, "type": "profile_nudge", "channel": "email", "enabled": false}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the preference to be saved, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(ada, http.MethodPut, "/notifications/preferences", `{"user_id": 7, "type": "newsletter", "channel": "email", "enabled": false}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown type to be 400, got: %d", w.Code)
+	}
+	if w := do(ada, http.MethodPut, "/notifications/preferences", `{"user_id": 7, "type": "win_back", "channel": "email", "enabled": true, "digest": "daily"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"digest":"daily"`) {
+		t.Errorf("Expected the digest preference to be saved, got: %d %s", w.Code, w.Body.String())
+	}
+	for _, body := range []string{
+		`{"user_id": 7, "type": "win_back", "channel": "email", "enabled": true, "digest": "weekly"}`,
+		`{"user_id": 7, "type": "back_in_stock", "channel": "email", "enabled": true, "digest": "daily"}`,
+		`{"user_id": 7, "type": "win_back", "channel": "sms", "enabled": true, "digest": "daily"}`,
+	} {
+		if w := do(ada, http.MethodPut, "/notifications/preferences", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be 400, got: %d", body, w.Code)
+		}
+	}
+	if w := do(ada, http.MethodDelete, "/notifications/preferences?user_id=7&type=win_back&channel=email", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the digest preference to be reset, got: %d", w.Code)
+	}
+	if w := do(ada, http.MethodPut, "/notifications/preferences", `{"user_id": 8, "type": "general", "channel": "email", "enabled": false}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's preferences to be forbidden, got: %d", w.Code)
+	}
+	if w := do(ada, http.MethodPut, "/notifications/preferences/quiet-hours", `{"user_id": 7, "start": "22:00", "end": "07:00", "time_zone": "Nope/Nowhere"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown time zone to be 400, got: %d", w.Code)
+	}
+	if w := do(ada, http.MethodPut, "/notifications/preferences/quiet-hours", `{"user_id": 7, "start": "22:00", "end": "07:00"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected quiet hours to be saved, got: %d %s", w.Code, w.Body.String())
+	}
+
+	w := do(ada, http.MethodGet, "/notifications/preferences?user_id=7", "")
+	var settings settingsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the settings, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(settings.Preferences) != 1 || settings.Preferences[0].Enabled || settings.QuietHours == nil || settings.QuietHours.TimeZone != "UTC" {
+		t.Errorf("Expected the opt-out and quiet hours in UTC, got: %s", w.Body.String())
+	}
+
+	if w := do(ada, http.MethodDelete, "/notifications/preferences?user_id=7&type=profile_nudge&channel=email", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the preference to be reset, got: %d", w.Code)
+	}
+	if w := do(ada, http.MethodDelete, "/notifications/preferences?user_id=7&type=profile_nudge&channel=email", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a second reset to be 404, got: %d", w.Code)
+	}
+
+	token := manager.sign(unsubscribe{Tenant: tenant.FromContext(context.Background()), UserID: 7, Type: notifications.TypeGeneral, Channel: "email"})
+	path := "/notifications/unsubscribe?token=" + url.QueryEscape(token)
+	if w := do(nil, http.MethodGet, path, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"subscribed":true`) {
+		t.Errorf("Expected opening the link to change nothing, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(nil, http.MethodPost, path, "List-Unsubscribe=One-Click"); w.Code != http.StatusOK {
+		t.Errorf("Expected the one-click unsubscribe to succeed without signing in, got: %d %s", w.Code, w.Body.String())
+	}
+	if s, _ := store.Get(context.Background(), 7); s.enabled(notifications.TypeGeneral, "email") {
+		t.Error("Expected general emails to be turned off")
+	}
+	if w := do(nil, http.MethodPost, "/notifications/unsubscribe?token=bogus", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid token to be 400, got: %d", w.Code)
+	}
+}
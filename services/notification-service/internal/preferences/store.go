@@ -0,0 +1,128 @@
+package preferences
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+type Store interface {
+	// Get returns the user's settings, empty if they have none.
+	Get(ctx context.Context, userID int) (*Settings, error)
+	SetPreference(ctx context.Context, userID int, p *Preference) error
+	// DeletePreference turns the type back on for the channel, returning
+	// ErrNotFound if there was no preference.
+	DeletePreference(ctx context.Context, userID int, typ, channel string) error
+	SetQuietHours(ctx context.Context, userID int, q *QuietHours) error
+	DeleteQuietHours(ctx context.Context, userID int) error
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Get(ctx context.Context, userID int) (*Settings, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT type, channel, enabled, COALESCE(digest, ''), updated_at FROM notification_service.notification_preferences
+		WHERE tenant_id = $1 AND user_id = $2 ORDER BY type, channel`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := &Settings{UserID: userID, Preferences: []Preference{}}
+	for rows.Next() {
+		var p Preference
+		if err := rows.Scan(&p.Type, &p.Channel, &p.Enabled, &p.Digest, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		settings.Preferences = append(settings.Preferences, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	const quiet string = `SELECT to_char(starts_at, 'HH24:MI'), to_char(ends_at, 'HH24:MI'), time_zone, channels, updated_at
+		FROM notification_service.quiet_hours WHERE tenant_id = $1 AND user_id = $2`
+	var q QuietHours
+	err = s.db.QueryRowContext(ctx, quiet, tenant.FromContext(ctx), userID).
+		Scan(&q.Start, &q.End, &q.TimeZone, pq.Array(&q.Channels), &q.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if q.Channels == nil {
+		q.Channels = []string{}
+	}
+	settings.QuietHours = &q
+	return settings, nil
+}
+
+func (s *PostgresStore) SetPreference(ctx context.Context, userID int, p *Preference) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO notification_service.notification_preferences (tenant_id, user_id, type, channel, enabled, digest)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+		ON CONFLICT (tenant_id, user_id, type, channel) DO UPDATE SET enabled = EXCLUDED.enabled, digest = EXCLUDED.digest,
+			updated_at = NOW()
+		RETURNING updated_at`
+	return s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), userID, p.Type, p.Channel, p.Enabled, p.Digest).Scan(&p.UpdatedAt)
+}
+
+func (s *PostgresStore) DeletePreference(ctx context.Context, userID int, typ, channel string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM notification_service.notification_preferences
+		WHERE tenant_id = $1 AND user_id = $2 AND type = $3 AND channel = $4`
+	res, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx), userID, typ, channel)
+	return deleted(res, err)
+}
+
+func (s *PostgresStore) SetQuietHours(ctx context.Context, userID int, q *QuietHours) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO notification_service.quiet_hours (tenant_id, user_id, starts_at, ends_at, time_zone, channels)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tenant_id, user_id) DO UPDATE SET starts_at = EXCLUDED.starts_at, ends_at = EXCLUDED.ends_at,
+			time_zone = EXCLUDED.time_zone, channels = EXCLUDED.channels, updated_at = NOW()
+		RETURNING updated_at`
+	return s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), userID, q.Start, q.End, q.TimeZone, pq.Array(q.Channels)).
+		Scan(&q.UpdatedAt)
+}
+
+func (s *PostgresStore) DeleteQuietHours(ctx context.Context, userID int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM notification_service.quiet_hours WHERE tenant_id = $1 AND user_id = $2`
+	res, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx), userID)
+	return deleted(res, err)
+}
+
+func deleted(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	apnsProduction = "https://api.push.apple.com"
+	apnsSandbox    = "https://api.sandbox.push.apple.com"
+	// apnsTokenTTL is how long a provider token is reused. APNs rejects
+	// tokens older than an hour and refreshing more often than every 20
+	// minutes.
+	apnsTokenTTL = 50 * time.Minute
+)
+
+// APNs sends push notifications through the Apple Push Notification
+// service over HTTP/2, authenticated with a token signed by the team's
+// .p8 key.
+type APNs struct {
+	baseURL string
+	keyID   string
+	teamID  string
+	topic   string
+	key     *ecdsa.PrivateKey
+	client  *http.Client
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+// NewAPNs signs with key, the PEM contents of a .p8 file, and sends to the
+// app with bundle ID topic. Without production, it sends through the
+// sandbox, which development builds of the app register with. A
+// notification must be accepted within timeout.
+func NewAPNs(key []byte, keyID, teamID, topic string, production bool, timeout time.Duration) (*APNs, error) {
+	signer, err := jwt.ParseECPrivateKeyFromPEM(key)
+	if err != nil {
+		return nil, fmt.Errorf("apns key: %w", err)
+	}
+	baseURL := apnsSandbox
+	if production {
+		baseURL = apnsProduction
+	}
+	cfg := httpclient.ConfigFromEnv()
+	cfg.Timeout = timeout
+	return &APNs{baseURL: baseURL, keyID: keyID, teamID: teamID, topic: topic, key: signer, client: httpclient.NewWithConfig(cfg)}, nil
+}
+
+func (a *APNs) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Since(a.issued) < apnsTokenTTL {
+		return a.token, nil
+	}
+	now := time.Now()
+	t := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": a.teamID, "iat": now.Unix()})
+	t.Header["kid"] = a.keyID
+	signed, err := t.SignedString(a.key)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.issued = signed, now
+	return signed, nil
+}
+
+// send pushes n to the device with token, returning ErrInvalidRecipient if
+// APNs says the token is not, or no longer, valid for the app.
+func (a *APNs) send(ctx context.Context, token string, n *notifications.Notification) error {
+	auth, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]any{"aps": map[string]any{
+		"alert": map[string]string{"title": n.Subject, "body": n.Body},
+	}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.baseURL+"/3/device/"+url.PathEscape(token), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+auth)
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", "alert")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	var answer struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(body, &answer)
+	switch {
+	case resp.StatusCode == http.StatusGone, answer.Reason == "BadDeviceToken", answer.Reason == "DeviceTokenNotForTopic":
+		return fmt.Errorf("%w: apns: %d %s", notifications.ErrInvalidRecipient, resp.StatusCode, answer.Reason)
+	case answer.Reason == "ExpiredProviderToken":
+		a.mu.Lock()
+		a.token = ""
+		a.mu.Unlock()
+	}
+	return fmt.Errorf("apns answered %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+}
@@ -0,0 +1,173 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fcmURL   = "https://fcm.googleapis.com"
+	fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+// serviceAccount is the part of a Google service account key file FCM
+// needs.
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// FCM sends push notifications through Firebase Cloud Messaging's HTTP v1
+// API as a service account. The account's access token is fetched with a
+// signed assertion and reused until shortly before it expires.
+type FCM struct {
+	baseURL string
+	account serviceAccount
+	key     *rsa.PrivateKey
+	client  *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+// NewFCM reads credentials, the JSON key file of a service account allowed
+// to send messages for its project. A message must be accepted within
+// timeout.
+func NewFCM(credentials []byte, timeout time.Duration) (*FCM, error) {
+	var account serviceAccount
+	if err := json.Unmarshal(credentials, &account); err != nil {
+		return nil, fmt.Errorf("fcm credentials: %w", err)
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, errors.New("fcm credentials: want project_id, client_email and token_uri")
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("fcm credentials: private_key: %w", err)
+	}
+	cfg := httpclient.ConfigFromEnv()
+	cfg.Timeout = timeout
+	return &FCM{baseURL: fcmURL, account: account, key: key, client: httpclient.NewWithConfig(cfg)}, nil
+}
+
+// token returns an access token that is valid for at least another
+// minute.
+func (f *FCM) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accessToken != "" && time.Until(f.expires) > time.Minute {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   f.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(f.key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("fcm access token: %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	var grant struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&grant); err != nil {
+		return "", fmt.Errorf("fcm access token: %w", err)
+	}
+	f.accessToken, f.expires = grant.AccessToken, now.Add(time.Duration(grant.ExpiresIn)*time.Second)
+	return f.accessToken, nil
+}
+
+type fcmError struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// send pushes n to the device with token, returning ErrInvalidRecipient if
+// FCM no longer knows it.
+func (f *FCM) send(ctx context.Context, token string, n *notifications.Notification) error {
+	access, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]any{"message": map[string]any{
+		"token":        token,
+		"notification": map[string]string{"title": n.Subject, "body": n.Body},
+	}})
+	if err != nil {
+		return err
+	}
+	endpoint := f.baseURL + "/v1/projects/" + url.PathEscape(f.account.ProjectID) + "/messages:send"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+access)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var answer fcmError
+	json.Unmarshal(body, &answer)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: fcm: %s", notifications.ErrInvalidRecipient, answer.Error.Message)
+	}
+	for _, d := range answer.Error.Details {
+		if d.ErrorCode == "UNREGISTERED" {
+			return fmt.Errorf("%w: fcm: %s", notifications.ErrInvalidRecipient, answer.Error.Message)
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		f.mu.Lock()
+		f.accessToken = ""
+		f.mu.Unlock()
+	}
+	return fmt.Errorf("fcm answered %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+}
@@ -0,0 +1,186 @@
+package providers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestSMS(t *testing.T) {
+	var got http.Request
+	var form string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *r
+		body, _ := io.ReadAll(r.Body)
+		form = string(body)
+		if strings.Contains(form, "To=%2B15550000000") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "invalid number"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	sms := NewSMS(srv.URL, "AC123", "secret", "+447700900000", time.Second)
+	n := &notifications.Notification{Notification: models.Notification{Recipient: "+447700900123", Subject: "Your order was delivered", Body: "Order #42"}}
+	if err := sms.Send(context.Background(), n); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if user, pass, ok := got.BasicAuth(); !ok || user != "AC123" || pass != "secret" {
+		t.Errorf("Expected basic auth with the account, got: %q %q", user, pass)
+	}
+	if form != "Body=Your+order+was+delivered%0A%0AOrder+%2342&From=%2B447700900000&To=%2B447700900123" {
+		t.Errorf("Expected the message as a form, got: %s", form)
+	}
+	n.Recipient = "+15550000000"
+	if err := sms.Send(context.Background(), n); err == nil || !strings.Contains(err.Error(), "invalid number") {
+		t.Errorf("Expected the provider's error, got: %v", err)
+	}
+}
+
+type forgotten []string
+
+func (f *forgotten) Forget(ctx context.Context, platform, token string) error {
+	*f = append(*f, platform+":"+token)
+	return nil
+}
+
+func TestFCM(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	tokenRequests := 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokenRequests++
+			r.ParseForm()
+			claims := jwt.MapClaims{}
+			if _, err := jwt.ParseWithClaims(r.Form.Get("assertion"), claims, func(*jwt.Token) (any, error) { return &key.PublicKey, nil }); err != nil ||
+				claims["iss"] != "push@project.iam.gserviceaccount.com" || claims["aud"] != srv.URL+"/token" {
+				t.Errorf("Expected a signed assertion for the account, got: %v %v", claims, err)
+			}
+			w.Write([]byte(`{"access_token": "access-1", "expires_in": 3600}`))
+		case "/v1/projects/shop/messages:send":
+			if r.Header.Get("Authorization") != "Bearer access-1" {
+				t.Errorf("Expected the access token, got: %q", r.Header.Get("Authorization"))
+			}
+			var body struct {
+				Message struct {
+					Token        string            `json:"token"`
+					Notification map[string]string `json:"notification"`
+				} `json:"message"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Message.Token == "gone" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": {"status": "NOT_FOUND", "message": "Requested entity was not found.", "details": [{"errorCode": "UNREGISTERED"}]}}`))
+				return
+			}
+			if body.Message.Notification["title"] != "Delivered" {
+				t.Errorf("Expected the subject as the title, got: %+v", body.Message)
+			}
+			w.Write([]byte(`{"name": "projects/shop/messages/1"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	credentials, _ := json.Marshal(serviceAccount{ProjectID: "shop", ClientEmail: "push@project.iam.gserviceaccount.com",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), TokenURI: srv.URL + "/token"})
+	fcm, err := NewFCM(credentials, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read credentials: %v", err)
+	}
+	fcm.baseURL = srv.URL
+	var tokens forgotten
+	push := NewPush(fcm, nil, &tokens)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := push.Send(ctx, &notifications.Notification{Notification: models.Notification{Recipient: "fcm:abc", Subject: "Delivered"}}); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("Expected the access token to be reused, fetched %d", tokenRequests)
+	}
+	err = push.Send(ctx, &notifications.Notification{Notification: models.Notification{Recipient: "fcm:gone", Subject: "Delivered"}})
+	if !errors.Is(err, notifications.ErrInvalidRecipient) || strings.Join(tokens, ",") != "fcm:gone" {
+		t.Errorf("Expected the unregistered token to be rejected and forgotten, got: %v %v", err, tokens)
+	}
+	if err := push.Send(ctx, &notifications.Notification{Notification: models.Notification{Recipient: "apns:abc"}}); err == nil || errors.Is(err, notifications.ErrInvalidRecipient) {
+		t.Errorf("Expected an unconfigured platform to fail for a retry, got: %v", err)
+	}
+	if err := push.Send(ctx, &notifications.Notification{Notification: models.Notification{Recipient: "abc"}}); !errors.Is(err, notifications.ErrInvalidRecipient) {
+		t.Errorf("Expected a recipient without a platform to be invalid, got: %v", err)
+	}
+}
+
+func TestAPNs(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parsed, err := jwt.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "), func(*jwt.Token) (any, error) { return &key.PublicKey, nil })
+		if err != nil || parsed.Header["kid"] != "KEY123" || r.Header.Get("apns-topic") != "com.example.shop" {
+			t.Errorf("Expected a provider token for the key and the app's topic, got: %v %v", parsed, err)
+		}
+		switch r.URL.Path {
+		case "/3/device/gone":
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason": "Unregistered"}`))
+		case "/3/device/busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"reason": "TooManyRequests"}`))
+		default:
+			var body struct {
+				APS struct {
+					Alert map[string]string `json:"alert"`
+				} `json:"aps"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.APS.Alert["title"] != "Delivered" || body.APS.Alert["body"] != "Order #42" {
+				t.Errorf("Expected the subject and body as the alert, got: %+v", body)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	apns, err := NewAPNs(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), "KEY123", "TEAM123", "com.example.shop", false, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	apns.baseURL = srv.URL
+	var tokens forgotten
+	push := NewPush(nil, apns, &tokens)
+	ctx := context.Background()
+
+	if err := push.Send(ctx, &notifications.Notification{Notification: models.Notification{Recipient: "apns:abc", Subject: "Delivered", Body: "Order #42"}}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if err := push.Send(ctx, &notifications.Notification{Notification: models.Notification{Recipient: "apns:busy"}}); err == nil || errors.Is(err, notifications.ErrInvalidRecipient) {
+		t.Errorf("Expected throttling to fail for a retry, got: %v", err)
+	}
+	err = push.Send(ctx, &notifications.Notification{Notification: models.Notification{Recipient: "apns:gone"}})
+	if !errors.Is(err, notifications.ErrInvalidRecipient) || strings.Join(tokens, ",") != "apns:gone" {
+		t.Errorf("Expected the unregistered token to be rejected and forgotten, got: %v %v", err, tokens)
+	}
+}
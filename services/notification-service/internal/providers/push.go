@@ -0,0 +1,59 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+// Tokens forgets the push tokens providers reject. devices.Registry is
+// one.
+type Tokens interface {
+	Forget(ctx context.Context, platform, token string) error
+}
+
+// Push sends notifications on the push channel through the provider their
+// recipient names, "fcm:<token>" or "apns:<token>". It sends the subject
+// as the title and the body as the text.
+type Push struct {
+	fcm    *FCM
+	apns   *APNs
+	tokens Tokens
+}
+
+// NewPush sends through fcm and apns, either of which may be nil if it is
+// not configured. Tokens either rejects are forgotten in tokens.
+func NewPush(fcm *FCM, apns *APNs, tokens Tokens) *Push {
+	return &Push{fcm: fcm, apns: apns, tokens: tokens}
+}
+
+func (p *Push) Provider() string {
+	return "push"
+}
+
+// Send fails for a platform that is not configured, so the notification
+// is retried until it is.
+func (p *Push) Send(ctx context.Context, n *notifications.Notification) error {
+	platform, token, _ := strings.Cut(n.Recipient, ":")
+	var err error
+	switch {
+	case token == "" || (platform != "fcm" && platform != "apns"):
+		return fmt.Errorf("%w: want fcm:<token> or apns:<token>", notifications.ErrInvalidRecipient)
+	case platform == "fcm" && p.fcm != nil:
+		err = p.fcm.send(ctx, token, n)
+	case platform == "apns" && p.apns != nil:
+		err = p.apns.send(ctx, token, n)
+	default:
+		return fmt.Errorf("no %s credentials are configured", platform)
+	}
+	if errors.Is(err, notifications.ErrInvalidRecipient) && p.tokens != nil {
+		if forgetErr := p.tokens.Forget(ctx, platform, token); forgetErr != nil {
+			log.Printf("Failed to forget rejected %s token: %v", platform, forgetErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+// Package providers delivers notifications on the channels besides email:
+// SMS through an HTTP messaging API, and push through Firebase Cloud
+// Messaging and the Apple Push Notification service.
+package providers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+// SMS sends text messages through an HTTP API in the style of Twilio's.
+// Each message is posted to the API's URL as a form with To, From and
+// Body, with the account ID and auth token as basic auth, and any 2xx
+// answer means it was accepted.
+type SMS struct {
+	url       string
+	accountID string
+	token     string
+	from      string
+	client    *http.Client
+}
+
+// NewSMS sends from the number or sender ID from. A message must be
+// accepted within timeout.
+func NewSMS(url, accountID, token, from string, timeout time.Duration) *SMS {
+	cfg := httpclient.ConfigFromEnv()
+	cfg.Timeout = timeout
+	return &SMS{url: url, accountID: accountID, token: token, from: from, client: httpclient.NewWithConfig(cfg)}
+}
+
+func (s *SMS) Provider() string {
+	return "sms"
+}
+
+// Send texts the subject, followed by the body if there is one.
+func (s *SMS) Send(ctx context.Context, n *notifications.Notification) error {
+	text := n.Subject
+	if n.Body != "" {
+		text += "\n\n" + n.Body
+	}
+	form := url.Values{"To": {n.Recipient}, "From": {s.from}, "Body": {text}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.accountID, s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sms provider answered %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
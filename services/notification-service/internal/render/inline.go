@@ -0,0 +1,254 @@
+package render
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+func (s selector) specificity() int {
+	n := len(s.classes) * 10
+	if s.id != "" {
+		n += 100
+	}
+	if s.tag != "" {
+		n++
+	}
+	return n
+}
+
+func (s selector) matches(n *html.Node) bool {
+	if s.tag != "" && s.tag != n.Data {
+		return false
+	}
+	if s.id != "" && attr(n, "id") != s.id {
+		return false
+	}
+	classes := strings.Fields(attr(n, "class"))
+	for _, want := range s.classes {
+		found := false
+		for _, have := range classes {
+			if have == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type rule struct {
+	sel   selector
+	decls string
+	order int
+}
+
+// parseSelector accepts compound selectors made of a tag, an #id and
+// .classes. Anything else (descendants, pseudo-classes, attributes) cannot be
+// inlined and is reported as not ok.
+func parseSelector(raw string) (selector, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || strings.ContainsAny(raw, " >+~:[*") {
+		return selector{}, false
+	}
+
+	var s selector
+	for raw != "" {
+		end := strings.IndexAny(raw[1:], ".#") + 1
+		if end == 0 {
+			end = len(raw)
+		}
+		part := raw[:end]
+		raw = raw[end:]
+		switch part[0] {
+		case '.':
+			s.classes = append(s.classes, part[1:])
+		case '#':
+			s.id = part[1:]
+		default:
+			s.tag = strings.ToLower(part)
+		}
+	}
+	return s, true
+}
+
+// parseCSS splits a stylesheet into inlinable rules and the remaining CSS
+// (at-rules and complex selectors) that has to stay in a <style> block.
+func parseCSS(css string, order *int) ([]rule, string) {
+	css = cssComment.ReplaceAllString(css, "")
+	var rules []rule
+	var leftover strings.Builder
+
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+
+		if css[0] == '@' {
+			end := blockEnd(css)
+			leftover.WriteString(css[:end])
+			leftover.WriteString("\n")
+			css = css[end:]
+			continue
+		}
+
+		open := strings.Index(css, "{")
+		close := strings.Index(css, "}")
+		if open < 0 || close < open {
+			break
+		}
+		selectors := css[:open]
+		decls := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(css[open+1:close]), ";"))
+		css = css[close+1:]
+
+		for _, raw := range strings.Split(selectors, ",") {
+			sel, ok := parseSelector(raw)
+			if !ok {
+				leftover.WriteString(strings.TrimSpace(raw) + " { " + decls + " }\n")
+				continue
+			}
+			*order++
+			rules = append(rules, rule{sel: sel, decls: decls, order: *order})
+		}
+	}
+
+	return rules, leftover.String()
+}
+
+// blockEnd returns the index just past the brace block starting at the first
+// "{" in css, or past the terminating ";" for block-less at-rules.
+func blockEnd(css string) int {
+	depth := 0
+	for i, r := range css {
+		switch r {
+		case ';':
+			if depth == 0 {
+				return i + 1
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(css)
+}
+
+// InlineCSS moves the rules of every <style> element onto the style attribute
+// of the elements they match, since many email clients ignore stylesheets.
+// Existing inline styles win over stylesheet rules.
+func InlineCSS(document string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(document))
+	if err != nil {
+		return "", err
+	}
+
+	var styles []*html.Node
+	walk(doc, func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Style {
+			styles = append(styles, n)
+		}
+	})
+	if len(styles) == 0 {
+		return document, nil
+	}
+
+	var rules []rule
+	var order int
+	for _, s := range styles {
+		var css strings.Builder
+		for c := s.FirstChild; c != nil; c = c.NextSibling {
+			css.WriteString(c.Data)
+		}
+		parsed, leftover := parseCSS(css.String(), &order)
+		rules = append(rules, parsed...)
+
+		if strings.TrimSpace(leftover) == "" {
+			s.Parent.RemoveChild(s)
+			continue
+		}
+		for c := s.FirstChild; c != nil; {
+			next := c.NextSibling
+			s.RemoveChild(c)
+			c = next
+		}
+		s.AppendChild(&html.Node{Type: html.TextNode, Data: leftover})
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		si, sj := rules[i].sel.specificity(), rules[j].sel.specificity()
+		if si != sj {
+			return si < sj
+		}
+		return rules[i].order < rules[j].order
+	})
+
+	walk(doc, func(n *html.Node) {
+		if n.Type != html.ElementNode {
+			return
+		}
+		var decls []string
+		for _, r := range rules {
+			if r.sel.matches(n) && r.decls != "" {
+				decls = append(decls, r.decls)
+			}
+		}
+		if len(decls) == 0 {
+			return
+		}
+		if existing := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(attr(n, "style")), ";")); existing != "" {
+			decls = append(decls, existing)
+		}
+		setAttr(n, "style", strings.Join(decls, "; "))
+	})
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func walk(n *html.Node, fn func(*html.Node)) {
+	fn(n)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walk(c, fn)
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
@@ -0,0 +1,82 @@
+// Package render turns HTML notification bodies into email-ready markup:
+// asset references are resolved to versioned URLs and stylesheets are inlined.
+package render
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+)
+
+type AssetResolver interface {
+	URL(ctx context.Context, name string) (string, error)
+	Content(ctx context.Context, name string) ([]byte, error)
+}
+
+type Renderer struct {
+	assets AssetResolver
+}
+
+func NewRenderer(assets AssetResolver) *Renderer {
+	return &Renderer{assets: assets}
+}
+
+// HTML executes body as an html/template with the asset and stylesheet
+// functions available, then inlines the resulting CSS.
+//
+//	<style>{{stylesheet "email.css"}}</style>
+//	<img src="{{asset "logo.png"}}">
+func (r *Renderer) HTML(ctx context.Context, body string, data any) (string, error) {
+	return r.Compose(ctx, data, body)
+}
+
+// Compose is HTML for a page assembled from several sources, parsed in order
+// into one template set. Each source can {{define}} templates for the others
+// to call, and a later definition replaces an earlier one, so a layout can
+// mark override points with {{block}} for a later source to fill. The page
+// is the last source with content outside any {{define}}. dict builds a map
+// to pass to a called template:
+//
+//	{{template "button" dict "url" .link "label" "Open"}}
+func (r *Renderer) Compose(ctx context.Context, data any, sources ...string) (string, error) {
+	funcs := template.FuncMap{
+		"asset": func(name string) (string, error) {
+			return r.assets.URL(ctx, name)
+		},
+		"stylesheet": func(name string) (template.CSS, error) {
+			css, err := r.assets.Content(ctx, name)
+			return template.CSS(css), err
+		},
+		"dict": dict,
+	}
+
+	tmpl := template.New("body").Funcs(funcs)
+	for _, source := range sources {
+		if _, err := tmpl.Parse(source); err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return InlineCSS(buf.String())
+}
+
+func dict(pairs ...any) (map[string]any, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict needs key and value pairs")
+	}
+	m := make(map[string]any, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict key %v is not a string", pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
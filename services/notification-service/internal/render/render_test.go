@@ -0,0 +1,79 @@
+package render
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type fakeAssets map[string]string
+
+func (f fakeAssets) URL(ctx context.Context, name string) (string, error) {
+	return "https://cdn.example.com/" + name, nil
+}
+
+func (f fakeAssets) Content(ctx context.Context, name string) ([]byte, error) {
+	return []byte(f[name]), nil
+}
+
+func TestInlineCSS(t *testing.T) {
+	doc := `<html><head><style>
+		p { color: red; }
+		.note { color: blue; font-weight: bold }
+		a:hover { color: green }
+		@media (max-width: 600px) { p { font-size: 12px } }
+	</style></head><body><p class="note" style="margin: 0">hi</p><p>plain</p></body></html>`
+
+	out, err := InlineCSS(doc)
+	if err != nil {
+		t.Fatalf("InlineCSS failed: %v", err)
+	}
+
+	if !strings.Contains(out, `<p class="note" style="color: red; color: blue; font-weight: bold; margin: 0">`) {
+		t.Errorf("Expected note paragraph to be inlined by specificity, got: %s", out)
+	}
+	if !strings.Contains(out, `<p style="color: red">plain</p>`) {
+		t.Errorf("Expected plain paragraph to be inlined, got: %s", out)
+	}
+	if !strings.Contains(out, "@media") || !strings.Contains(out, "a:hover") {
+		t.Errorf("Expected non-inlinable rules to stay in <style>, got: %s", out)
+	}
+}
+
+func TestInlineCSSRemovesFullyInlinedStyle(t *testing.T) {
+	out, err := InlineCSS(`<style>h1 { margin: 0 }</style><h1>Title</h1>`)
+	if err != nil {
+		t.Fatalf("InlineCSS failed: %v", err)
+	}
+	if strings.Contains(out, "<style>") {
+		t.Errorf("Expected <style> to be removed, got: %s", out)
+	}
+}
+
+func TestRendererHTML(t *testing.T) {
+	r := NewRenderer(fakeAssets{"email.css": "img { border: 0 }"})
+	out, err := r.HTML(context.Background(), `<style>{{stylesheet "email.css"}}</style><img src="{{asset "logo.png"}}">`, nil)
+	if err != nil {
+		t.Fatalf("HTML failed: %v", err)
+	}
+	if !strings.Contains(out, `<img src="https://cdn.example.com/logo.png" style="border: 0"/>`) {
+		t.Errorf("Unexpected render output: %s", out)
+	}
+}
+
+func TestRendererCompose(t *testing.T) {
+	r := NewRenderer(fakeAssets{})
+	out, err := r.Compose(context.Background(), map[string]any{"name": "Ada"},
+		`{{define "button"}}<a href="{{.url}}">{{.label}}</a>{{end}}`,
+		`<h1>{{block "title" .}}Hello{{end}}</h1>{{template "button" dict "url" "https://example.com" "label" .name}}`,
+		`{{define "title"}}Hi {{.name}}{{end}}`)
+	if err != nil {
+		t.Fatalf("Compose failed: %v", err)
+	}
+	if out != `<h1>Hi Ada</h1><a href="https://example.com">Ada</a>` {
+		t.Errorf("Expected the later title to win and the partial to be called, got: %s", out)
+	}
+	if _, err := r.Compose(context.Background(), nil, `{{template "x" dict "odd"}}{{define "x"}}{{end}}`); err == nil {
+		t.Error("Expected an error for dict without a value")
+	}
+}
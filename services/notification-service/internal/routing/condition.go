@@ -0,0 +1,419 @@
+package routing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Condition is a parsed rule condition. Conditions test fields of the
+// event's payload, named by their JSON keys and joined with dots to reach
+// into objects and lists:
+//
+//	notify_email != "" and available < reorder_point
+//	reason in ["found_cheaper", "delivery_too_slow"] or not tier == "gold"
+//	reasons contains "new_country"
+//
+// Comparisons are ==, !=, <, <=, >, >=, contains and in, combined with
+// and, or, not and parentheses. Literals are double-quoted strings,
+// numbers, true, false and null. A field on its own is true when it is
+// set and not false, zero or empty. Missing fields are null.
+type Condition struct {
+	root node
+}
+
+// ParseCondition parses source. The empty condition matches every event.
+func ParseCondition(source string) (*Condition, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return &Condition{}, nil
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.unexpected()
+	}
+	return &Condition{root: root}, nil
+}
+
+// Match evaluates the condition against a decoded JSON payload.
+func (c *Condition) Match(payload map[string]any) bool {
+	return c.root == nil || truthy(c.root.eval(payload))
+}
+
+type tokenKind int
+
+const (
+	tokenField tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenKeyword
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	value  any
+	offset int
+}
+
+var keywords = map[string]bool{"and": true, "or": true, "not": true, "in": true, "contains": true, "true": true, "false": true, "null": true}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			s, err := strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: source[i : end+1], value: s, offset: i})
+			i = end + 1
+		case c == '-' || unicode.IsDigit(c):
+			end := i + 1
+			for end < len(source) && (unicode.IsDigit(rune(source[end])) || source[end] == '.') {
+				end++
+			}
+			n, err := strconv.ParseFloat(source[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at offset %d", source[i:end], i)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[i:end], value: n, offset: i})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(source) && (source[end] == '_' || source[end] == '.' || unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			word := source[i:end]
+			kind := tokenField
+			if keywords[word] {
+				kind = tokenKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: word, offset: i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "<", ">", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(source[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, offset: i})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind != tokenString && p.tokens[p.pos].text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.peek(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) unexpected() error {
+	if p.pos >= len(p.tokens) {
+		return fmt.Errorf("unexpected end of condition")
+	}
+	t := p.tokens[p.pos]
+	return fmt.Errorf("unexpected %s at offset %d", t.text, t.offset)
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for err == nil && p.accept("or") {
+		var right node
+		if right, err = p.and(); err == nil {
+			left = orNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.not()
+	for err == nil && p.accept("and") {
+		var right node
+		if right, err = p.not(); err == nil {
+			left = andNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) not() (node, error) {
+	if p.accept("not") {
+		operand, err := p.not()
+		return notNode{operand}, err
+	}
+	return p.comparison()
+}
+
+var comparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "contains": true}
+
+func (p *parser) comparison() (node, error) {
+	if p.accept("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.unexpected()
+		}
+		return inner, nil
+	}
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("in") {
+		list, err := p.list()
+		return inNode{left, list}, err
+	}
+	if p.pos < len(p.tokens) && comparisons[p.tokens[p.pos].text] && p.tokens[p.pos].kind != tokenString {
+		op := p.tokens[p.pos].text
+		p.pos++
+		right, err := p.operand()
+		return compareNode{op, left, right}, err
+	}
+	return left, nil
+}
+
+func (p *parser) operand() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.unexpected()
+	}
+	t := p.tokens[p.pos]
+	switch {
+	case t.kind == tokenField:
+		p.pos++
+		return fieldNode(strings.Split(t.text, ".")), nil
+	case t.kind == tokenString || t.kind == tokenNumber:
+		p.pos++
+		return literal{t.value}, nil
+	case t.text == "true" || t.text == "false":
+		p.pos++
+		return literal{t.text == "true"}, nil
+	case t.text == "null":
+		p.pos++
+		return literal{nil}, nil
+	}
+	return nil, p.unexpected()
+}
+
+func (p *parser) list() ([]any, error) {
+	if !p.accept("[") {
+		return nil, p.unexpected()
+	}
+	var values []any
+	for !p.accept("]") {
+		if len(values) > 0 && !p.accept(",") {
+			return nil, p.unexpected()
+		}
+		n, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := n.(literal)
+		if !ok {
+			return nil, fmt.Errorf("lists may only hold literals")
+		}
+		values = append(values, lit.value)
+	}
+	return values, nil
+}
+
+type node interface {
+	eval(payload map[string]any) any
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(payload map[string]any) any {
+	return truthy(n.left.eval(payload)) || truthy(n.right.eval(payload))
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(payload map[string]any) any {
+	return truthy(n.left.eval(payload)) && truthy(n.right.eval(payload))
+}
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(payload map[string]any) any {
+	return !truthy(n.operand.eval(payload))
+}
+
+type literal struct{ value any }
+
+func (n literal) eval(map[string]any) any {
+	return n.value
+}
+
+// fieldNode is a dotted path into the payload. Numeric parts index lists.
+type fieldNode []string
+
+func (n fieldNode) eval(payload map[string]any) any {
+	var v any = payload
+	for _, part := range n {
+		switch container := v.(type) {
+		case map[string]any:
+			v = container[part]
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(container) {
+				return nil
+			}
+			v = container[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n compareNode) eval(payload map[string]any) any {
+	a, b := n.left.eval(payload), n.right.eval(payload)
+	switch n.op {
+	case "==":
+		return equal(a, b)
+	case "!=":
+		return !equal(a, b)
+	case "contains":
+		switch container := a.(type) {
+		case string:
+			s, ok := b.(string)
+			return ok && strings.Contains(container, s)
+		case []any:
+			return in(b, container)
+		}
+		return false
+	}
+	cmp, ok := order(a, b)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+type inNode struct {
+	operand node
+	list    []any
+}
+
+func (n inNode) eval(payload map[string]any) any {
+	return in(n.operand.eval(payload), n.list)
+}
+
+func in(v any, list []any) bool {
+	for _, candidate := range list {
+		if equal(v, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal compares scalars; lists and objects only equal null when missing.
+func equal(a, b any) bool {
+	switch a.(type) {
+	case nil, string, float64, bool:
+		switch b.(type) {
+		case nil, string, float64, bool:
+			return a == b
+		}
+	}
+	return false
+}
+
+// order compares two numbers or two strings.
+func order(a, b any) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case map[string]any:
+		return len(v) > 0
+	}
+	return true
+}
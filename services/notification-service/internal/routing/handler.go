@@ -0,0 +1,310 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/audit"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/gin-gonic/gin"
+)
+
+// maxRules bounds how many routing rules a tenant may have.
+const maxRules = 100
+
+// Handler lets the tenant's admins manage routing rules and try them out.
+type Handler struct {
+	engine *Engine
+}
+
+func NewHandler(engine *Engine) *Handler {
+	return &Handler{engine: engine}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/routing-rules", auth.RequireRole(auth.RoleAdmin))
+	group.GET("", h.list)
+	group.POST("", h.create)
+	group.POST("/dry-run", h.dryRun)
+	group.GET("/:id", h.get)
+	group.PUT("/:id", h.update)
+	group.DELETE("/:id", h.remove)
+	group.GET("/:id/versions", h.listVersions)
+	group.POST("/:id/versions/:version/restore", h.restore)
+}
+
+type ruleRequest struct {
+	Name        string `json:"name" binding:"required,max=255"`
+	EventType   string `json:"event_type" binding:"required,max=100"`
+	Condition   string `json:"condition" binding:"max=2000"`
+	Channel     string `json:"channel" binding:"max=50"`
+	Type        string `json:"type" binding:"max=50"`
+	Template    string `json:"template" binding:"required,max=100"`
+	Locale      string `json:"locale" binding:"max=100"`
+	Recipient   string `json:"recipient" binding:"required,max=255"`
+	UserID      string `json:"user_id" binding:"max=100"`
+	ContextType string `json:"context_type" binding:"max=50"`
+	ContextID   string `json:"context_id" binding:"max=255"`
+	Priority    *int   `json:"priority"`
+	Enabled     *bool  `json:"enabled"`
+}
+
+func (req ruleRequest) rule() *Rule {
+	r := &Rule{
+		Name:        req.Name,
+		EventType:   req.EventType,
+		Condition:   req.Condition,
+		Channel:     req.Channel,
+		Type:        req.Type,
+		Template:    req.Template,
+		Locale:      req.Locale,
+		Recipient:   req.Recipient,
+		UserID:      req.UserID,
+		ContextType: req.ContextType,
+		ContextID:   req.ContextID,
+		Priority:    100,
+		Enabled:     true,
+	}
+	if req.Priority != nil {
+		r.Priority = *req.Priority
+	}
+	if req.Enabled != nil {
+		r.Enabled = *req.Enabled
+	}
+	return r
+}
+
+// bind reads a rule from the body, writing a 400 if it is invalid.
+func (h *Handler) bind(c *gin.Context) (*Rule, bool) {
+	var req ruleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	r := req.rule()
+	if err := h.engine.Validate(r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if p, ok := auth.FromContext(c); ok {
+		r.UpdatedBy = "user:" + strconv.Itoa(p.UserID)
+	}
+	return r, true
+}
+
+func (h *Handler) list(c *gin.Context) {
+	rules, err := h.engine.store.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (h *Handler) create(c *gin.Context) {
+	r, ok := h.bind(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	existing, err := h.engine.store.List(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(existing) >= maxRules {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "a tenant may have at most " + strconv.Itoa(maxRules) + " routing rules"})
+		return
+	}
+	if err := h.engine.store.Create(ctx, r); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("ETag", etag.Format(r.Version))
+	c.JSON(http.StatusCreated, r)
+}
+
+type dryRunRequest struct {
+	EventType string         `json:"event_type"`
+	Payload   map[string]any `json:"payload"`
+	Rule      *ruleRequest   `json:"rule"`
+}
+
+// dryRun reports what the tenant's enabled rules for event_type would send
+// for payload, without sending anything. With rule, only that unsaved rule
+// is tried for its own event type, so a change can be checked before it is
+// saved.
+func (h *Handler) dryRun(c *gin.Context) {
+	var req dryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Round-trip the payload so its numbers are float64, as they are when
+	// an event is decoded.
+	raw, _ := json.Marshal(req.Payload)
+	payload, err := decode(raw)
+	if err != nil || req.Payload == nil {
+		payload = map[string]any{}
+	}
+
+	ctx := c.Request.Context()
+	var rules []Rule
+	if req.Rule != nil {
+		r := req.Rule.rule()
+		if err := h.engine.Validate(r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.EventType, rules = r.EventType, []Rule{*r}
+	} else if req.EventType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event_type or rule is required"})
+		return
+	} else if rules, err = h.engine.Matching(ctx, req.EventType); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"event_type": req.EventType, "outcomes": h.engine.Evaluate(ctx, rules, payload)})
+}
+
+// ruleID parses the :id parameter, writing a 400 if it is invalid.
+func ruleID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, ok := ruleID(c)
+	if !ok {
+		return
+	}
+	r, err := h.engine.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if etag.NotModified(c, r.Version) {
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// update saves the rule as its next version. It requires If-Match with the
+// ETag of the version being replaced.
+func (h *Handler) update(c *gin.Context) {
+	id, ok := ruleID(c)
+	if !ok {
+		return
+	}
+	version, ok := etag.IfMatch(c)
+	if !ok {
+		return
+	}
+	r, ok := h.bind(c)
+	if !ok {
+		return
+	}
+	r.ID = id
+	h.save(c, r, version)
+}
+
+// restore saves an earlier version of the rule as its next one.
+func (h *Handler) restore(c *gin.Context) {
+	id, ok := ruleID(c)
+	if !ok {
+		return
+	}
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	rev, err := h.engine.store.Revision(c.Request.Context(), id, version)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule version not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	r := rev.Rule
+	// The templates or event types an old version used may be gone.
+	if err := h.engine.Validate(&r); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "version " + strconv.FormatInt(version, 10) + " can no longer be used: " + err.Error()})
+		return
+	}
+	r.UpdatedBy = ""
+	if p, ok := auth.FromContext(c); ok {
+		r.UpdatedBy = "user:" + strconv.Itoa(p.UserID)
+	}
+	h.save(c, &r, etag.Any)
+}
+
+func (h *Handler) save(c *gin.Context, r *Rule, version int64) {
+	ctx := c.Request.Context()
+	if old, err := h.engine.store.Get(ctx, r.ID); err == nil {
+		audit.SetBefore(c, old)
+	}
+	err := h.engine.store.Update(ctx, r, version)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	if errors.Is(err, etag.ErrMismatch) {
+		etag.Failed(c)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("ETag", etag.Format(r.Version))
+	c.JSON(http.StatusOK, r)
+}
+
+func (h *Handler) remove(c *gin.Context) {
+	id, ok := ruleID(c)
+	if !ok {
+		return
+	}
+	err := h.engine.store.Delete(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listVersions returns the rule's versions, newest first.
+func (h *Handler) listVersions(c *gin.Context) {
+	id, ok := ruleID(c)
+	if !ok {
+		return
+	}
+	revisions, err := h.engine.store.Revisions(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": revisions})
+}
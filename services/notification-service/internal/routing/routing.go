@@ -0,0 +1,296 @@
+// Package routing sends notifications for events by rules that tenant
+// admins manage, rather than by code wired up for each event. A rule names
+// an event type, a condition over the event's payload, and the template,
+// channel and recipient of the notification to send; every enabled rule
+// that matches sends its own. Saving a rule keeps its earlier versions,
+// and rules can be tried against a sample payload without sending
+// anything.
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/templates"
+)
+
+const queue = "notification-service.routing"
+
+// Rule sends a notification for each event of EventType whose payload
+// matches Condition. Recipient, UserID, Locale and ContextID may name
+// payload fields as {{field}}, such as "{{notify_email}}"; the payload is
+// also the template's data. Rules run by Priority, lowest first.
+type Rule struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	EventType   string    `json:"event_type"`
+	Condition   string    `json:"condition"`
+	Channel     string    `json:"channel"`
+	Type        string    `json:"type"`
+	Template    string    `json:"template"`
+	Locale      string    `json:"locale,omitempty"`
+	Recipient   string    `json:"recipient"`
+	UserID      string    `json:"user_id,omitempty"`
+	ContextType string    `json:"context_type,omitempty"`
+	ContextID   string    `json:"context_id,omitempty"`
+	Priority    int       `json:"priority"`
+	Enabled     bool      `json:"enabled"`
+	Version     int64     `json:"version"`
+	UpdatedBy   string    `json:"updated_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Revision is a rule as one of its versions saved it.
+type Revision struct {
+	Rule      Rule      `json:"rule"`
+	ChangedBy string    `json:"changed_by,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Preview is the notification a rule sends for an event.
+type Preview struct {
+	Recipient   string `json:"recipient"`
+	UserID      *int   `json:"user_id,omitempty"`
+	Channel     string `json:"channel"`
+	Type        string `json:"type"`
+	Template    string `json:"template"`
+	Locale      string `json:"locale"`
+	Subject     string `json:"subject"`
+	Body        string `json:"body"`
+	ContextType string `json:"context_type,omitempty"`
+	ContextID   string `json:"context_id,omitempty"`
+}
+
+// Outcome is what a rule made of an event. Error is set when the rule
+// matched but its notification could not be built, such as for a payload
+// missing the template's variables.
+type Outcome struct {
+	RuleID       int64    `json:"rule_id"`
+	Name         string   `json:"name"`
+	Version      int64    `json:"version"`
+	Matched      bool     `json:"matched"`
+	Notification *Preview `json:"notification,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// Renderer is the template library rules send from.
+type Renderer interface {
+	Lookup(name, locale string) (*templates.Template, error)
+	Render(ctx context.Context, name, locale string, data map[string]any) (*templates.Message, error)
+}
+
+var _ Renderer = (*templates.Library)(nil)
+
+// Engine evaluates rules and sends the notifications they produce.
+type Engine struct {
+	store      Store
+	templates  Renderer
+	dispatcher *notifications.Dispatcher
+}
+
+func NewEngine(store Store, library Renderer, dispatcher *notifications.Dispatcher) *Engine {
+	return &Engine{store: store, templates: library, dispatcher: dispatcher}
+}
+
+// Run consumes events matching patterns until ctx is cancelled.
+func (e *Engine) Run(ctx context.Context, subscriber events.Subscriber, patterns []string) error {
+	return subscriber.Subscribe(ctx, queue, patterns, e.Handle)
+}
+
+// Handle sends what the enabled rules for ev make of it, under the tenant
+// its payload names; events naming none use the default tenant's rules, as
+// do tenants without rules of their own for ev (see Matching). A rule
+// whose notification cannot be built is logged and skipped, since
+// retrying the event would not fix it. Notification-service's own events
+// are ignored, so no rule can feed on the notifications it sends.
+func (e *Engine) Handle(ctx context.Context, ev events.Event) error {
+	if ownEvent(ev.Type) {
+		return nil
+	}
+	payload, err := decode(ev.Data)
+	if err != nil {
+		return nil
+	}
+	if t, ok := payload["tenant"].(string); ok && t != "" {
+		ctx = tenant.NewContext(ctx, t)
+	}
+	rules, err := e.Matching(ctx, ev.Type)
+	if err != nil {
+		return err
+	}
+	for _, o := range e.Evaluate(ctx, rules, payload) {
+		if o.Error != "" {
+			log.Printf("Routing rule %d (%s) failed on event %s: %s", o.RuleID, o.Name, ev.ID, o.Error)
+			continue
+		}
+		if !o.Matched {
+			continue
+		}
+		p := o.Notification
+		n := &notifications.Notification{Notification: models.Notification{
+			UserID:      p.UserID,
+			Recipient:   p.Recipient,
+			Channel:     p.Channel,
+			Type:        p.Type,
+			Subject:     p.Subject,
+			Body:        p.Body,
+			ContextType: p.ContextType,
+			ContextID:   p.ContextID,
+		}}
+		if err := e.dispatcher.Dispatch(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matching returns the tenant's enabled rules for eventType, or the default
+// tenant's when the tenant has no rules for it at all. The rules seeded for
+// the default tenant, such as low-stock alerts, so reach every tenant until
+// it sets its own; a tenant that wants none saves its rule disabled.
+func (e *Engine) Matching(ctx context.Context, eventType string) ([]Rule, error) {
+	rules, err := e.store.Matching(ctx, eventType)
+	if err != nil || len(rules) > 0 || tenant.FromContext(ctx) == tenant.Default {
+		return rules, err
+	}
+	own, err := e.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range own {
+		if r.EventType == eventType {
+			return rules, nil
+		}
+	}
+	return e.store.Matching(tenant.NewContext(ctx, tenant.Default), eventType)
+}
+
+// Evaluate reports what each rule makes of payload, rendering the
+// notifications of those that match without sending them.
+func (e *Engine) Evaluate(ctx context.Context, rules []Rule, payload map[string]any) []Outcome {
+	outcomes := make([]Outcome, 0, len(rules))
+	for _, r := range rules {
+		o := Outcome{RuleID: r.ID, Name: r.Name, Version: r.Version}
+		cond, err := ParseCondition(r.Condition)
+		if err != nil {
+			o.Error = err.Error()
+		} else if o.Matched = cond.Match(payload); o.Matched {
+			if o.Notification, err = e.preview(ctx, &r, payload); err != nil {
+				o.Error = err.Error()
+			}
+		}
+		outcomes = append(outcomes, o)
+	}
+	return outcomes
+}
+
+func (e *Engine) preview(ctx context.Context, r *Rule, payload map[string]any) (*Preview, error) {
+	p := &Preview{
+		Recipient:   interpolate(r.Recipient, payload),
+		Channel:     r.Channel,
+		Type:        r.Type,
+		Template:    r.Template,
+		ContextType: r.ContextType,
+		ContextID:   interpolate(r.ContextID, payload),
+	}
+	if p.Recipient == "" {
+		return nil, errors.New("recipient is empty")
+	}
+	if s := interpolate(r.UserID, payload); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("user_id %q is not a user ID", s)
+		}
+		p.UserID = &id
+	}
+	msg, err := e.templates.Render(ctx, r.Template, interpolate(r.Locale, payload), payload)
+	if err != nil {
+		return nil, err
+	}
+	p.Locale, p.Subject, p.Body = msg.Locale, msg.Subject, msg.Body
+	return p, nil
+}
+
+var (
+	validEventType = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)+$`)
+	// placeholder is a {{field}} reference in a rule's recipient, user ID,
+	// locale or context ID.
+	placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_.]*)\s*\}\}`)
+)
+
+// Validate fills in r's defaults and checks it can be evaluated.
+func (e *Engine) Validate(r *Rule) error {
+	r.Name, r.EventType = strings.TrimSpace(r.Name), strings.TrimSpace(r.EventType)
+	if r.Channel == "" {
+		r.Channel = "email"
+	}
+	if r.Type == "" {
+		r.Type = notifications.TypeGeneral
+	}
+	switch {
+	case r.Name == "":
+		return errors.New("name is required")
+	case !validEventType.MatchString(r.EventType):
+		return errors.New("event_type must be an event type such as inventory.low_stock")
+	case ownEvent(r.EventType):
+		return errors.New("rules cannot route notification-service's own events")
+	case !notifications.KnownType(r.Type):
+		return errors.New("type must be one of " + strings.Join(notifications.Types, ", "))
+	case strings.TrimSpace(r.Recipient) == "":
+		return errors.New("recipient is required")
+	}
+	if _, err := ParseCondition(r.Condition); err != nil {
+		return fmt.Errorf("invalid condition: %w", err)
+	}
+	for name, text := range map[string]string{"recipient": r.Recipient, "user_id": r.UserID, "locale": r.Locale, "context_id": r.ContextID} {
+		if strings.Contains(placeholder.ReplaceAllString(text, ""), "{{") {
+			return fmt.Errorf("%s may only reference fields as {{field}}", name)
+		}
+	}
+	if _, err := e.templates.Lookup(r.Template, templates.DefaultLocale); err != nil {
+		return fmt.Errorf("unknown template %q", r.Template)
+	}
+	return nil
+}
+
+// interpolate replaces each {{field}} in text with the payload's value.
+func interpolate(text string, payload map[string]any) string {
+	return strings.TrimSpace(placeholder.ReplaceAllStringFunc(text, func(m string) string {
+		path := placeholder.FindStringSubmatch(m)[1]
+		switch v := fieldNode(strings.Split(path, ".")).eval(payload).(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			out, _ := json.Marshal(v)
+			return string(out)
+		}
+	}))
+}
+
+func decode(data []byte) (map[string]any, error) {
+	payload := map[string]any{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func ownEvent(eventType string) bool {
+	return strings.HasPrefix(eventType, "notification.")
+}
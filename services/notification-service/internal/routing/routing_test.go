@@ -0,0 +1,364 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/render"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/templates"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps rules and their versions in memory. Only List and
+// Matching tell tenants apart.
+type memStore struct {
+	rules     []*Rule
+	revisions []Revision
+	tenants   map[int64]string
+}
+
+func (s *memStore) List(ctx context.Context) ([]Rule, error) {
+	rules := []Rule{}
+	for _, r := range s.rules {
+		if s.tenants[r.ID] == tenant.FromContext(ctx) {
+			rules = append(rules, *r)
+		}
+	}
+	return rules, nil
+}
+
+func (s *memStore) Get(ctx context.Context, id int64) (*Rule, error) {
+	for _, r := range s.rules {
+		if r.ID == id {
+			copied := *r
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Matching(ctx context.Context, eventType string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, r := range s.rules {
+		if r.Enabled && r.EventType == eventType && s.tenants[r.ID] == tenant.FromContext(ctx) {
+			rules = append(rules, *r)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority < rules[j].Priority })
+	return rules, nil
+}
+
+func (s *memStore) Create(ctx context.Context, r *Rule) error {
+	r.ID, r.Version = int64(len(s.rules)+1), 1
+	if s.tenants == nil {
+		s.tenants = map[int64]string{}
+	}
+	s.tenants[r.ID] = tenant.FromContext(ctx)
+	r.CreatedAt, r.UpdatedAt = time.Now(), time.Now()
+	copied := *r
+	s.rules = append(s.rules, &copied)
+	s.revisions = append(s.revisions, Revision{Rule: copied, ChangedBy: r.UpdatedBy, ChangedAt: r.UpdatedAt})
+	return nil
+}
+
+func (s *memStore) Update(ctx context.Context, r *Rule, version int64) error {
+	for _, existing := range s.rules {
+		if existing.ID != r.ID {
+			continue
+		}
+		if version != etag.Any && existing.Version != version {
+			return etag.ErrMismatch
+		}
+		r.Version, r.CreatedAt, r.UpdatedAt = existing.Version+1, existing.CreatedAt, time.Now()
+		*existing = *r
+		s.revisions = append(s.revisions, Revision{Rule: *r, ChangedBy: r.UpdatedBy, ChangedAt: r.UpdatedAt})
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (s *memStore) Delete(ctx context.Context, id int64) error {
+	for i, r := range s.rules {
+		if r.ID == id {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memStore) Revisions(ctx context.Context, id int64) ([]Revision, error) {
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	revisions := []Revision{}
+	for i := len(s.revisions) - 1; i >= 0; i-- {
+		if s.revisions[i].Rule.ID == id {
+			revisions = append(revisions, s.revisions[i])
+		}
+	}
+	return revisions, nil
+}
+
+func (s *memStore) Revision(ctx context.Context, id, version int64) (*Revision, error) {
+	for _, rev := range s.revisions {
+		if rev.Rule.ID == id && rev.Rule.Version == version {
+			return &rev, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type notificationStore struct {
+	notifications.Store
+	created []notifications.Notification
+}
+
+func (s *notificationStore) Create(ctx context.Context, n *notifications.Notification) error {
+	n.ID = len(s.created) + 1
+	s.created = append(s.created, *n)
+	return nil
+}
+
+func (s *notificationStore) RecordAttempt(ctx context.Context, id int, a notifications.Attempt) error {
+	s.created[id-1].Status = a.Status
+	return nil
+}
+
+type noAssets struct{}
+
+func (noAssets) URL(ctx context.Context, name string) (string, error) {
+	return "https://cdn.example.com/" + name, nil
+}
+
+func (noAssets) Content(ctx context.Context, name string) ([]byte, error) {
+	return nil, nil
+}
+
+func newEngine(store Store) (*Engine, *notificationStore) {
+	sent := &notificationStore{}
+	dispatcher := notifications.NewDispatcher(sent, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, "")
+	return NewEngine(store, templates.NewLibrary(render.NewRenderer(noAssets{})), dispatcher), sent
+}
+
+// lowStockRule is the rule the default tenant is seeded with.
+func lowStockRule() *Rule {
+	return &Rule{
+		Name:        "Low stock alerts",
+		EventType:   events.InventoryLowStock,
+		Condition:   `notify_email != ""`,
+		Channel:     "email",
+		Type:        notifications.TypeStockAlert,
+		Template:    "low_stock",
+		Recipient:   "{{notify_email}}",
+		ContextType: "sku",
+		ContextID:   "{{sku}}",
+		Priority:    100,
+		Enabled:     true,
+	}
+}
+
+func TestCondition(t *testing.T) {
+	payload := map[string]any{
+		"sku":       "SKU-001",
+		"available": float64(8),
+		"reorder":   float64(24),
+		"tier":      "gold",
+		"reasons":   []any{"new_country", "new_device"},
+		"address":   map[string]any{"country": "NZ"},
+		"paused":    false,
+	}
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{"", true},
+		{`sku == "SKU-001"`, true},
+		{`available < reorder`, true},
+		{`available >= 10`, false},
+		{`tier in ["gold", "silver"] and not paused`, true},
+		{`reasons contains "new_device"`, true},
+		{`reasons.0 == "new_country"`, true},
+		{`address.country != "NZ" or (available <= 8 and sku contains "001")`, true},
+		{`missing == null and not missing`, true},
+		{`paused or missing`, false},
+		{`sku == 8`, false},
+	}
+	for _, tt := range tests {
+		c, err := ParseCondition(tt.condition)
+		if err != nil {
+			t.Fatalf("%q: expected it to parse, got: %v", tt.condition, err)
+		}
+		if got := c.Match(payload); got != tt.want {
+			t.Errorf("%q: expected %v, got: %v", tt.condition, tt.want, got)
+		}
+	}
+
+	for _, invalid := range []string{`sku ==`, `sku = "x"`, `(sku == "x"`, `tier in "gold"`, `tier in [sku]`, `"unterminated`, `sku and and tier`} {
+		if _, err := ParseCondition(invalid); err == nil {
+			t.Errorf("%q: expected a parse error", invalid)
+		}
+	}
+}
+
+func TestHandleSendsLowStockAlert(t *testing.T) {
+	store := &memStore{}
+	store.Create(context.Background(), lowStockRule())
+	engine, sent := newEngine(store)
+
+	for _, recipient := range []string{"buyer@example.com", ""} {
+		e, err := events.New(events.InventoryLowStock, "inventory-service", events.LowStock{
+			SKU:             "SKU-001",
+			Name:            "Widget",
+			Available:       8,
+			ReorderPoint:    24,
+			ReorderQuantity: 96,
+			NotifyEmail:     recipient,
+		})
+		if err != nil {
+			t.Fatalf("Failed to build event: %v", err)
+		}
+		if err := engine.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	if len(sent.created) != 1 {
+		t.Fatalf("Expected 1 notification for the alert with a recipient, got: %d", len(sent.created))
+	}
+	n := sent.created[0]
+	if n.Recipient != "buyer@example.com" || n.ContextType != "sku" || n.ContextID != "SKU-001" || n.Subject != "Low stock: SKU-001" {
+		t.Errorf("Expected alert to buyer about SKU-001, got: %+v", n)
+	}
+	if !strings.Contains(n.Body, "down to 8") || !strings.Contains(n.Body, "reorder: 96") {
+		t.Errorf("Expected body to include stock and reorder quantity, got: %q", n.Body)
+	}
+
+	// Tenants without low-stock rules of their own get the default
+	// tenant's; one that disabled its own gets none.
+	acme, _ := events.New(events.InventoryLowStock, "inventory-service", events.LowStock{
+		SKU: "SKU-002", Name: "Gadget", Available: 1, ReorderPoint: 5, ReorderQuantity: 10, NotifyEmail: "acme@example.com", Tenant: "acme",
+	})
+	if err := engine.Handle(context.Background(), acme); err != nil || len(sent.created) != 2 || sent.created[1].Recipient != "acme@example.com" {
+		t.Fatalf("Expected acme's alert to be sent by the default tenant's rule, got: %v, %+v", err, sent.created)
+	}
+	disabled := lowStockRule()
+	disabled.Enabled = false
+	store.Create(tenant.NewContext(context.Background(), "acme"), disabled)
+	if err := engine.Handle(context.Background(), acme); err != nil || len(sent.created) != 2 {
+		t.Errorf("Expected a tenant's disabled rule to stop its alerts, got: %v, %d notifications", err, len(sent.created))
+	}
+
+	own, _ := events.New(events.NotificationCreated, "notification-service", map[string]any{"notify_email": "buyer@example.com"})
+	store.rules[0].EventType = events.NotificationCreated
+	if err := engine.Handle(context.Background(), own); err != nil || len(sent.created) != 2 {
+		t.Errorf("Expected notification-service's own events to be ignored, got: %v, %d notifications", err, len(sent.created))
+	}
+}
+
+func TestRoutingRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	engine, sent := newEngine(store)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 5, Roles: []string{auth.RoleAdmin}})
+	})
+	router.Use(tenant.Middleware())
+	NewHandler(engine).RegisterRoutes(router)
+	serve := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, invalid := range []string{
+		`{"name": "x", "event_type": "inventory.low_stock", "template": "missing", "recipient": "{{notify_email}}"}`,
+		`{"name": "x", "event_type": "inventory.low_stock", "template": "low_stock", "recipient": "{{notify_email}}", "condition": "available <"}`,
+		`{"name": "x", "event_type": "notification.created", "template": "low_stock", "recipient": "ops@example.com"}`,
+		`{"name": "x", "event_type": "inventory.low_stock", "template": "low_stock", "recipient": "{{.notify_email}}"}`,
+	} {
+		if w := serve(http.MethodPost, "/routing-rules", invalid); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got: %d %s", invalid, w.Code, w.Body)
+		}
+	}
+
+	body := `{"name": "Low stock", "event_type": "inventory.low_stock", "condition": "notify_email != \"\"", "type": "stock_alert",
+		"template": "low_stock", "recipient": "{{notify_email}}", "context_type": "sku", "context_id": "{{sku}}"}`
+	w := serve(http.MethodPost, "/routing-rules", body)
+	var rule Rule
+	if err := json.Unmarshal(w.Body.Bytes(), &rule); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("Expected the rule to be created, got: %d %s", w.Code, w.Body)
+	}
+	if rule.Version != 1 || rule.Channel != "email" || !rule.Enabled || rule.UpdatedBy != "user:5" || w.Header().Get("ETag") != `"1"` {
+		t.Errorf("Expected version 1 of an enabled email rule, got: %+v", rule)
+	}
+	if w := serve(http.MethodGet, "/routing-rules/1", "", "If-None-Match", `"1"`); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for the current version, got: %d", w.Code)
+	}
+
+	dryRun := `{"event_type": "inventory.low_stock", "payload": {"sku": "SKU-001", "name": "Widget", "available": 8, "reorder_point": 24, "notify_email": "buyer@example.com"}}`
+	w = serve(http.MethodPost, "/routing-rules/dry-run", dryRun)
+	var result struct {
+		Outcomes []Outcome `json:"outcomes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK || len(result.Outcomes) != 1 {
+		t.Fatalf("Expected one outcome, got: %d %s", w.Code, w.Body)
+	}
+	if o := result.Outcomes[0]; !o.Matched || o.Notification == nil || o.Notification.Recipient != "buyer@example.com" || o.Notification.ContextID != "SKU-001" {
+		t.Errorf("Expected the rule to match and address the buyer, got: %+v", o)
+	}
+	if len(sent.created) != 0 {
+		t.Errorf("Expected a dry run to send nothing, got: %d notifications", len(sent.created))
+	}
+	w = serve(http.MethodPost, "/routing-rules/dry-run", `{"payload": {"sku": "SKU-001", "notify_email": "buyer@example.com"},
+		"rule": {"name": "Draft", "event_type": "inventory.low_stock", "template": "low_stock", "recipient": "{{notify_email}}", "condition": "available < 5"}}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result.Outcomes) != 1 || result.Outcomes[0].Matched || result.Outcomes[0].Name != "Draft" {
+		t.Errorf("Expected the draft rule alone not to match, got: %d %s", w.Code, w.Body)
+	}
+
+	renamed := strings.Replace(body, `"Low stock"`, `"Reorder alerts"`, 1)
+	if w := serve(http.MethodPut, "/routing-rules/1", renamed); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected an edit without If-Match to be refused, got: %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/routing-rules/1", renamed, "If-Match", `"1"`); w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected the edit to save version 2, got: %d %s", w.Code, w.Body)
+	}
+	if w := serve(http.MethodPut, "/routing-rules/1", renamed, "If-Match", `"1"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected an edit of a stale version to be refused, got: %d", w.Code)
+	}
+
+	w = serve(http.MethodGet, "/routing-rules/1/versions", "")
+	var history struct {
+		Versions []Revision `json:"versions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history.Versions) != 2 || history.Versions[0].Rule.Name != "Reorder alerts" {
+		t.Fatalf("Expected both versions, newest first, got: %d %s", w.Code, w.Body)
+	}
+	w = serve(http.MethodPost, "/routing-rules/1/versions/1/restore", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &rule); err != nil || w.Code != http.StatusOK || rule.Version != 3 || rule.Name != "Low stock" {
+		t.Errorf("Expected version 1 to be restored as version 3, got: %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(http.MethodDelete, "/routing-rules/1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the rule to be deleted, got: %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/routing-rules/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the deleted rule to be gone, got: %d", w.Code)
+	}
+}
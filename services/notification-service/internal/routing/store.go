@@ -0,0 +1,235 @@
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Store keeps the tenant's rules and every version of them.
+type Store interface {
+	List(ctx context.Context) ([]Rule, error)
+	Get(ctx context.Context, id int64) (*Rule, error)
+	// Matching returns the enabled rules for eventType, by priority.
+	Matching(ctx context.Context, eventType string) ([]Rule, error)
+	// Create saves r as version 1, filling in its ID and timestamps.
+	Create(ctx context.Context, r *Rule) error
+	// Update saves r as the rule's next version and fills in the rest of
+	// r from it. Unless version is etag.Any, a rule whose version has
+	// moved on is etag.ErrMismatch.
+	Update(ctx context.Context, r *Rule, version int64) error
+	// Delete removes the rule with its versions.
+	Delete(ctx context.Context, id int64) error
+	// Revisions returns the rule's versions, newest first.
+	Revisions(ctx context.Context, id int64) ([]Revision, error)
+	Revision(ctx context.Context, id, version int64) (*Revision, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const ruleColumns = `id, name, event_type, condition, channel, type, template, locale, recipient, user_id, context_type, context_id,
+	priority, enabled, version, COALESCE(updated_by, ''), created_at, updated_at`
+
+func scanRule(row interface{ Scan(...any) error }) (*Rule, error) {
+	var r Rule
+	if err := row.Scan(&r.ID, &r.Name, &r.EventType, &r.Condition, &r.Channel, &r.Type, &r.Template, &r.Locale, &r.Recipient,
+		&r.UserID, &r.ContextType, &r.ContextID, &r.Priority, &r.Enabled, &r.Version, &r.UpdatedBy, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *PostgresStore) List(ctx context.Context) ([]Rule, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + ruleColumns + ` FROM notification_service.routing_rules
+		WHERE tenant_id = $1 ORDER BY event_type, priority, id`
+	return s.queryRules(ctx, query, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int64) (*Rule, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + ruleColumns + ` FROM notification_service.routing_rules WHERE id = $1 AND tenant_id = $2`
+	r, err := scanRule(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *PostgresStore) Matching(ctx context.Context, eventType string) ([]Rule, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + ruleColumns + ` FROM notification_service.routing_rules
+		WHERE tenant_id = $1 AND event_type = $2 AND enabled ORDER BY priority, id`
+	return s.queryRules(ctx, query, tenant.FromContext(ctx), eventType)
+}
+
+func (s *PostgresStore) queryRules(ctx context.Context, query string, args ...any) ([]Rule, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *r)
+	}
+	return rules, rows.Err()
+}
+
+// recordVersion copies the rule as it now stands into its history.
+const recordVersion string = `INSERT INTO notification_service.routing_rule_versions
+		(rule_id, version, name, event_type, condition, channel, type, template, locale, recipient, user_id,
+		 context_type, context_id, priority, enabled, changed_by, changed_at)
+	SELECT id, version, name, event_type, condition, channel, type, template, locale, recipient, user_id,
+		context_type, context_id, priority, enabled, updated_by, updated_at
+	FROM notification_service.routing_rules WHERE id = $1`
+
+func (s *PostgresStore) Create(ctx context.Context, r *Rule) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const insert string = `INSERT INTO notification_service.routing_rules
+				(tenant_id, name, event_type, condition, channel, type, template, locale, recipient, user_id,
+				 context_type, context_id, priority, enabled, updated_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NULLIF($15, ''))
+			RETURNING ` + ruleColumns
+		saved, err := scanRule(tx.QueryRowContext(ctx, insert, tenant.FromContext(ctx), r.Name, r.EventType, r.Condition, r.Channel,
+			r.Type, r.Template, r.Locale, r.Recipient, r.UserID, r.ContextType, r.ContextID, r.Priority, r.Enabled, r.UpdatedBy))
+		if err != nil {
+			return err
+		}
+		*r = *saved
+		_, err = tx.ExecContext(ctx, recordVersion, r.ID)
+		return err
+	})
+}
+
+func (s *PostgresStore) Update(ctx context.Context, r *Rule, version int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const update string = `UPDATE notification_service.routing_rules
+			SET name = $4, event_type = $5, condition = $6, channel = $7, type = $8, template = $9, locale = $10,
+				recipient = $11, user_id = $12, context_type = $13, context_id = $14, priority = $15, enabled = $16,
+				updated_by = NULLIF($17, ''), version = version + 1, updated_at = NOW()
+			WHERE id = $1 AND tenant_id = $2 AND ($3 = 0 OR version = $3)
+			RETURNING ` + ruleColumns
+		saved, err := scanRule(tx.QueryRowContext(ctx, update, r.ID, tenant.FromContext(ctx), version, r.Name, r.EventType, r.Condition,
+			r.Channel, r.Type, r.Template, r.Locale, r.Recipient, r.UserID, r.ContextType, r.ContextID, r.Priority, r.Enabled, r.UpdatedBy))
+		if errors.Is(err, sql.ErrNoRows) {
+			if version == etag.Any {
+				return ErrNotFound
+			}
+			// Tell a stale version apart from a missing rule.
+			const exists string = `SELECT EXISTS (SELECT 1 FROM notification_service.routing_rules WHERE id = $1 AND tenant_id = $2)`
+			var found bool
+			if err := tx.QueryRowContext(ctx, exists, r.ID, tenant.FromContext(ctx)).Scan(&found); err != nil {
+				return err
+			}
+			if found {
+				return etag.ErrMismatch
+			}
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		*r = *saved
+		_, err = tx.ExecContext(ctx, recordVersion, r.ID)
+		return err
+	})
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "DELETE FROM notification_service.routing_rules WHERE id = $1 AND tenant_id = $2"
+	res, err := s.db.ExecContext(ctx, query, id, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const revisionColumns = `v.rule_id, v.name, v.event_type, v.condition, v.channel, v.type, v.template, v.locale, v.recipient, v.user_id,
+	v.context_type, v.context_id, v.priority, v.enabled, v.version, COALESCE(v.changed_by, ''), v.changed_at`
+
+func scanRevision(row interface{ Scan(...any) error }) (*Revision, error) {
+	var rev Revision
+	r := &rev.Rule
+	if err := row.Scan(&r.ID, &r.Name, &r.EventType, &r.Condition, &r.Channel, &r.Type, &r.Template, &r.Locale, &r.Recipient,
+		&r.UserID, &r.ContextType, &r.ContextID, &r.Priority, &r.Enabled, &r.Version, &rev.ChangedBy, &rev.ChangedAt); err != nil {
+		return nil, err
+	}
+	r.UpdatedBy, r.UpdatedAt = rev.ChangedBy, rev.ChangedAt
+	return &rev, nil
+}
+
+func (s *PostgresStore) Revisions(ctx context.Context, id int64) ([]Revision, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	const query string = `SELECT ` + revisionColumns + ` FROM notification_service.routing_rule_versions v
+		WHERE v.rule_id = $1 ORDER BY v.version DESC`
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, *rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *PostgresStore) Revision(ctx context.Context, id, version int64) (*Revision, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + revisionColumns + ` FROM notification_service.routing_rule_versions v
+		JOIN notification_service.routing_rules r ON r.id = v.rule_id
+		WHERE v.rule_id = $1 AND r.tenant_id = $2 AND v.version = $3`
+	rev, err := scanRevision(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx), version))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return rev, err
+}
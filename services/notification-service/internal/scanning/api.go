@@ -0,0 +1,66 @@
+package scanning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+)
+
+// API scans through an external scanning service. Each file is posted to
+// the service's URL as the raw request body, with its name in X-Filename,
+// and the service answers {"infected": bool, "signature": "..."}.
+type API struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+// NewAPI sends key, if set, as a bearer token. A scan must finish within
+// timeout.
+func NewAPI(url, key string, timeout time.Duration) *API {
+	cfg := httpclient.ConfigFromEnv()
+	cfg.Timeout = timeout
+	return &API{url: url, key: key, client: httpclient.NewWithConfig(cfg)}
+}
+
+func (s *API) Name() string {
+	return "api"
+}
+
+type apiVerdict struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature"`
+}
+
+func (s *API) Scan(ctx context.Context, filename string, data []byte) (Verdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Filename", filename)
+	if s.key != "" {
+		req.Header.Set("Authorization", "Bearer "+s.key)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Verdict{}, fmt.Errorf("scanning service answered %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var v apiVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return Verdict{}, fmt.Errorf("scanning service answer: %w", err)
+	}
+	return Verdict{Infected: v.Infected, Signature: v.Signature}, nil
+}
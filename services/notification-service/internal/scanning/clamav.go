@@ -0,0 +1,82 @@
+package scanning
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunk is the most INSTREAM sends in one chunk.
+const clamdChunk = 64 << 10
+
+// ClamAV scans through a clamd daemon's INSTREAM command, over TCP. clamd's
+// StreamMaxLength must allow the largest file scanned, or every larger
+// file fails to scan.
+type ClamAV struct {
+	address string
+	timeout time.Duration
+}
+
+// NewClamAV connects to clamd at address, such as clamav:3310, for each
+// scan, which must finish within timeout.
+func NewClamAV(address string, timeout time.Duration) *ClamAV {
+	return &ClamAV{address: address, timeout: timeout}
+}
+
+func (s *ClamAV) Name() string {
+	return "clamav"
+}
+
+func (s *ClamAV) Scan(ctx context.Context, filename string, data []byte) (Verdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		n := min(len(data), clamdChunk)
+		binary.BigEndian.PutUint32(size, uint32(n))
+		w.Write(size)
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err := w.Flush(); err != nil {
+		return Verdict{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return Verdict{}, err
+	}
+	return parseClamd(reply)
+}
+
+// parseClamd reads clamd's answer to INSTREAM, such as "stream: OK" or
+// "stream: Eicar-Test-Signature FOUND".
+func parseClamd(reply string) (Verdict, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(strings.TrimRight(reply, "\x00\n"), "stream:"))
+	switch {
+	case result == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	}
+	return Verdict{}, fmt.Errorf("clamd: %s", result)
+}
@@ -0,0 +1,177 @@
+package scanning
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// Releaser lets a released file through to where it was headed, such as
+// publishing an asset whose upload was quarantined.
+type Releaser func(ctx context.Context, item *Item) error
+
+// Handler is the admin review queue for the tenant's quarantine.
+type Handler struct {
+	store     Store
+	releasers map[string]Releaser
+}
+
+// NewHandler runs the releaser for an item's source, if there is one, when
+// it is released. Sources without one, such as inbound attachments, are
+// only marked released, and their content stays downloadable.
+func NewHandler(store Store, releasers map[string]Releaser) *Handler {
+	return &Handler{store: store, releasers: releasers}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/notifications/quarantine", auth.RequireRole(auth.RoleAdmin))
+	group.GET("", h.list)
+	group.GET("/:id", h.get)
+	group.GET("/:id/content", h.content)
+	group.POST("/:id/release", h.release)
+	group.DELETE("/:id", h.remove)
+}
+
+// list pages through the quarantine newest first. Pass next_before from a
+// page as ?before= to get the next one.
+func (h *Handler) list(c *gin.Context) {
+	f := Filter{Status: c.Query("status"), Source: c.Query("source")}
+	switch f.Status {
+	case "", StatusPending, StatusReleased, StatusDeleted:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, released or deleted"})
+		return
+	}
+	if raw := c.Query("before"); raw != "" {
+		var err error
+		if f.Before, err = strconv.ParseInt(raw, 10, 64); err != nil || f.Before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a quarantined file id"})
+			return
+		}
+	}
+	f.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+	if f.Limit <= 0 || f.Limit > maxListLimit {
+		f.Limit = defaultListLimit
+	}
+
+	// One extra item tells whether there is another page.
+	limit := f.Limit
+	f.Limit++
+	items, err := h.store.List(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"files": items}
+	if len(items) > limit {
+		items = items[:limit]
+		resp["files"] = items
+		resp["next_before"] = items[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// item loads the item named in the path, writing the error response if
+// there is none.
+func (h *Handler) item(c *gin.Context) (*Item, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quarantined file id"})
+		return nil, false
+	}
+	it, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return it, true
+}
+
+func (h *Handler) get(c *gin.Context) {
+	if it, ok := h.item(c); ok {
+		c.JSON(http.StatusOK, it)
+	}
+}
+
+// content downloads the flagged file for a closer look. It is always sent
+// as an attachment of an opaque type, so a browser never opens or runs it.
+func (h *Handler) content(c *gin.Context) {
+	it, ok := h.item(c)
+	if !ok {
+		return
+	}
+	if it.Status == StatusDeleted {
+		c.JSON(http.StatusGone, gin.H{"error": "the file was deleted"})
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": it.Filename}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "application/octet-stream", it.Content)
+}
+
+func reviewer(c *gin.Context) string {
+	if p, ok := auth.FromContext(c); ok {
+		return "user:" + strconv.Itoa(p.UserID)
+	}
+	return "admin"
+}
+
+// release lets a false positive through. The releaser runs first, so a
+// release that fails can be tried again.
+func (h *Handler) release(c *gin.Context) {
+	it, ok := h.item(c)
+	if !ok {
+		return
+	}
+	if it.Status != StatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrReviewed.Error()})
+		return
+	}
+	if release, ok := h.releasers[it.Source]; ok {
+		if err := release(c.Request.Context(), it); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	h.review(c, it.ID, StatusReleased)
+}
+
+func (h *Handler) remove(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quarantined file id"})
+		return
+	}
+	h.review(c, id, StatusDeleted)
+}
+
+func (h *Handler) review(c *gin.Context, id int64, status string) {
+	it, err := h.store.Review(c.Request.Context(), id, status, reviewer(c))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrReviewed) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, it)
+}
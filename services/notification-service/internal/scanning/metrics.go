@@ -0,0 +1,81 @@
+package scanning
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics counts scan outcomes per source in memory since the process
+// started.
+type Metrics struct {
+	mu      sync.Mutex
+	sources map[string]*SourceStats
+	elapsed map[string]time.Duration
+}
+
+type SourceStats struct {
+	Source   string `json:"source"`
+	Scans    int64  `json:"scans"`
+	Clean    int64  `json:"clean"`
+	Infected int64  `json:"infected"`
+	// Errors counts files the scanner could not scan, which were turned
+	// away.
+	Errors         int64      `json:"errors"`
+	AverageMillis  float64    `json:"average_ms"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastInfectedAt *time.Time `json:"last_infected_at,omitempty"`
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{sources: map[string]*SourceStats{}, elapsed: map[string]time.Duration{}}
+}
+
+func (m *Metrics) record(source string, v Verdict, err error, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sources[source]
+	if !ok {
+		s = &SourceStats{Source: source}
+		m.sources[source] = s
+	}
+	s.Scans++
+	m.elapsed[source] += took
+	switch {
+	case err != nil:
+		s.Errors++
+		s.LastError = err.Error()
+	case v.Infected:
+		now := time.Now()
+		s.Infected++
+		s.LastInfectedAt = &now
+	default:
+		s.Clean++
+	}
+}
+
+// Snapshot returns the stats for every source, by source.
+func (m *Metrics) Snapshot() []SourceStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]SourceStats, 0, len(m.sources))
+	for source, s := range m.sources {
+		row := *s
+		row.AverageMillis = float64(m.elapsed[source]) / float64(time.Millisecond) / float64(s.Scans)
+		out = append(out, row)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Source < out[j].Source })
+	return out
+}
+
+// Handler serves the metrics.
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"sources": m.Snapshot()})
+	}
+}
@@ -0,0 +1,137 @@
+// Package scanning checks files for malware before notification-service
+// accepts them: uploaded assets, which go out in every email that uses
+// them, and the attachments of inbound replies. A Scanner does the
+// checking, through clamd or an external API. Flagged files are kept in a
+// quarantine for admins to review, who can release a false positive or
+// delete the file.
+package scanning
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sources of scanned files.
+const (
+	SourceAsset   = "asset"
+	SourceInbound = "inbound"
+)
+
+// Quarantine statuses. A pending file waits for review; a released one was
+// a false positive and was let through, and a deleted one has had its
+// content removed.
+const (
+	StatusPending  = "pending"
+	StatusReleased = "released"
+	StatusDeleted  = "deleted"
+)
+
+var (
+	ErrNotFound = errors.New("quarantined file not found")
+	// ErrReviewed is returned for a file that was already released or
+	// deleted.
+	ErrReviewed = errors.New("quarantined file already reviewed")
+)
+
+// Verdict is a scanner's finding on one file.
+type Verdict struct {
+	Infected bool
+	// Signature names what was found, such as Eicar-Test-Signature.
+	Signature string
+}
+
+// Scanner checks a file's content. It returns an error only if the file
+// could not be scanned.
+type Scanner interface {
+	Name() string
+	Scan(ctx context.Context, filename string, data []byte) (Verdict, error)
+}
+
+// File is content to scan. Reference is what it came with: the asset's
+// name, or the inbound email's Message-ID.
+type File struct {
+	Source      string
+	Reference   string
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Item is a quarantined file.
+type Item struct {
+	ID          int64      `json:"id"`
+	Source      string     `json:"source"`
+	Reference   string     `json:"reference"`
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"content_type"`
+	Size        int        `json:"size"`
+	SHA256      string     `json:"sha256"`
+	Scanner     string     `json:"scanner"`
+	Signature   string     `json:"signature"`
+	Status      string     `json:"status"`
+	ReviewedBy  string     `json:"reviewed_by,omitempty"`
+	ReviewedAt  *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// Content is only loaded by Store.Get, and is gone once the item is
+	// deleted.
+	Content []byte `json:"-"`
+}
+
+// Guard scans files before they are accepted and quarantines the ones
+// found infected.
+type Guard struct {
+	scanner Scanner
+	store   Store
+	metrics *Metrics
+}
+
+func NewGuard(scanner Scanner, store Store) *Guard {
+	return &Guard{scanner: scanner, store: store, metrics: NewMetrics()}
+}
+
+// Metrics counts the guard's scans by source and outcome.
+func (g *Guard) Metrics() *Metrics {
+	return g.metrics
+}
+
+// Check returns the quarantined item if f is infected, or nil if it is
+// clean. A file that cannot be scanned is not accepted either: Check
+// returns the error, and the caller should turn the file away for now.
+// Quarantining the same file from the same reference again returns the
+// existing item, so retried uploads and webhooks are not queued twice, and
+// a file an admin released is let through.
+func (g *Guard) Check(ctx context.Context, f File) (*Item, error) {
+	start := time.Now()
+	v, err := g.scanner.Scan(ctx, f.Filename, f.Data)
+	g.metrics.record(f.Source, v, err, time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("scan %s: %w", f.Filename, err)
+	}
+	if !v.Infected {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256(f.Data)
+	item := &Item{
+		Source:      f.Source,
+		Reference:   f.Reference,
+		Filename:    f.Filename,
+		ContentType: f.ContentType,
+		Size:        len(f.Data),
+		SHA256:      hex.EncodeToString(sum[:]),
+		Scanner:     g.scanner.Name(),
+		Signature:   v.Signature,
+		Content:     f.Data,
+	}
+	if err := g.store.Quarantine(ctx, item); err != nil {
+		return nil, err
+	}
+	if item.Status == StatusReleased {
+		return nil, nil
+	}
+	return item, nil
+}
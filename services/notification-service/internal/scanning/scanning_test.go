@@ -0,0 +1,113 @@
+package scanning
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// eicar is the standard antivirus test file.
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+type fakeScanner struct {
+	err error
+}
+
+func (s *fakeScanner) Name() string {
+	return "fake"
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, filename string, data []byte) (Verdict, error) {
+	if s.err != nil {
+		return Verdict{}, s.err
+	}
+	if bytes.Contains(data, []byte("EICAR")) {
+		return Verdict{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+	return Verdict{}, nil
+}
+
+type memStore struct {
+	Store
+	items []*Item
+}
+
+func (s *memStore) Quarantine(ctx context.Context, item *Item) error {
+	for _, it := range s.items {
+		if it.Source == item.Source && it.Reference == item.Reference && it.SHA256 == item.SHA256 {
+			*item = *it
+			return nil
+		}
+	}
+	item.ID = int64(len(s.items) + 1)
+	item.Status = StatusPending
+	stored := *item
+	s.items = append(s.items, &stored)
+	return nil
+}
+
+func TestGuardCheck(t *testing.T) {
+	ctx := context.Background()
+	scanner := &fakeScanner{}
+	store := &memStore{}
+	guard := NewGuard(scanner, store)
+
+	clean := File{Source: SourceAsset, Reference: "logo.png", Filename: "logo.png", Data: []byte("\x89PNG")}
+	if item, err := guard.Check(ctx, clean); err != nil || item != nil {
+		t.Fatalf("Expected a clean file to pass, got: %+v, %v", item, err)
+	}
+
+	infected := File{Source: SourceInbound, Reference: "<abc@mail.example.com>", Filename: "invoice.com", Data: eicar}
+	item, err := guard.Check(ctx, infected)
+	if err != nil || item == nil {
+		t.Fatalf("Expected the infected file to be quarantined, got: %+v, %v", item, err)
+	}
+	if item.Signature != "Eicar-Test-Signature" || item.Scanner != "fake" || item.Size != len(eicar) || len(item.SHA256) != 64 {
+		t.Errorf("Expected the verdict and file details on the item, got: %+v", item)
+	}
+
+	again, err := guard.Check(ctx, infected)
+	if err != nil || again == nil || again.ID != item.ID || len(store.items) != 1 {
+		t.Errorf("Expected a redelivery to find the same item, got: %+v, %v with %d items", again, err, len(store.items))
+	}
+
+	store.items[0].Status = StatusReleased
+	if released, err := guard.Check(ctx, infected); err != nil || released != nil {
+		t.Errorf("Expected a released file to pass, got: %+v, %v", released, err)
+	}
+
+	scanner.err = errors.New("connection refused")
+	if _, err := guard.Check(ctx, clean); err == nil {
+		t.Error("Expected a file that cannot be scanned to be turned away")
+	}
+
+	stats := guard.Metrics().Snapshot()
+	if len(stats) != 2 || stats[0].Source != SourceAsset || stats[1].Source != SourceInbound {
+		t.Fatalf("Expected stats for both sources, got: %+v", stats)
+	}
+	if stats[0].Clean != 1 || stats[0].Errors != 1 || stats[0].LastError != "connection refused" {
+		t.Errorf("Expected one clean asset and one error, got: %+v", stats[0])
+	}
+	if stats[1].Infected != 3 || stats[1].LastInfectedAt == nil {
+		t.Errorf("Expected three infected inbound scans, got: %+v", stats[1])
+	}
+}
+
+func TestParseClamd(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    Verdict
+		wantErr bool
+	}{
+		{reply: "stream: OK\x00", want: Verdict{}},
+		{reply: "stream: Eicar-Test-Signature FOUND\x00", want: Verdict{Infected: true, Signature: "Eicar-Test-Signature"}},
+		{reply: "INSTREAM size limit exceeded. ERROR\x00", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClamd(tt.reply)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseClamd(%q) = %+v, %v; want %+v, error %v", tt.reply, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
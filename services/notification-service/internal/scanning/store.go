@@ -0,0 +1,141 @@
+package scanning
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// Filter narrows List. Empty fields match everything; Before pages by ID.
+type Filter struct {
+	Status string
+	Source string
+	Before int64
+	Limit  int
+}
+
+// Store keeps the tenant's quarantine.
+type Store interface {
+	// Quarantine adds item, or loads the existing item for the same content
+	// from the same source and reference into it.
+	Quarantine(ctx context.Context, item *Item) error
+	// List returns items newest first, without their content.
+	List(ctx context.Context, f Filter) ([]Item, error)
+	// Get returns the item with its content.
+	Get(ctx context.Context, id int64) (*Item, error)
+	// Review moves a pending item to released or deleted, dropping the
+	// content of a deleted one. It returns ErrReviewed if the item is not
+	// pending any more.
+	Review(ctx context.Context, id int64, status, by string) (*Item, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const itemColumns = `id, source, reference, filename, content_type, size, sha256, scanner, signature, status,
+	COALESCE(reviewed_by, ''), reviewed_at, created_at`
+
+func scanItem(row interface{ Scan(...any) error }, extra ...any) (*Item, error) {
+	var it Item
+	dest := []any{&it.ID, &it.Source, &it.Reference, &it.Filename, &it.ContentType, &it.Size, &it.SHA256, &it.Scanner, &it.Signature,
+		&it.Status, &it.ReviewedBy, &it.ReviewedAt, &it.CreatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+func (s *PostgresStore) Quarantine(ctx context.Context, item *Item) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tenantID := tenant.FromContext(ctx)
+	const insert string = `INSERT INTO notification_service.quarantined_files
+		(tenant_id, source, reference, filename, content_type, size, sha256, scanner, signature, content)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (tenant_id, source, reference, sha256) DO NOTHING
+		RETURNING id, status, created_at`
+	err := s.db.QueryRowContext(ctx, insert, tenantID, item.Source, item.Reference, item.Filename, item.ContentType, item.Size,
+		item.SHA256, item.Scanner, item.Signature, item.Content).Scan(&item.ID, &item.Status, &item.CreatedAt)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	const existing string = `SELECT ` + itemColumns + ` FROM notification_service.quarantined_files
+		WHERE tenant_id = $1 AND source = $2 AND reference = $3 AND sha256 = $4`
+	found, err := scanItem(s.db.QueryRowContext(ctx, existing, tenantID, item.Source, item.Reference, item.SHA256))
+	if err != nil {
+		return err
+	}
+	found.Content = item.Content
+	*item = *found
+	return nil
+}
+
+func (s *PostgresStore) List(ctx context.Context, f Filter) ([]Item, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + itemColumns + ` FROM notification_service.quarantined_files
+		WHERE tenant_id = $1 AND ($2 = '' OR status = $2) AND ($3 = '' OR source = $3) AND ($4 = 0 OR id < $4)
+		ORDER BY id DESC LIMIT $5`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), f.Status, f.Source, f.Before, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		it, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *it)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int64) (*Item, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + itemColumns + `, content FROM notification_service.quarantined_files
+		WHERE tenant_id = $1 AND id = $2`
+	var content []byte
+	it, err := scanItem(s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), id), &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.Content = content
+	return it, nil
+}
+
+func (s *PostgresStore) Review(ctx context.Context, id int64, status, by string) (*Item, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.quarantined_files
+		SET status = $3, reviewed_by = $4, reviewed_at = NOW(), content = CASE WHEN $3 = 'deleted' THEN NULL ELSE content END
+		WHERE tenant_id = $1 AND id = $2 AND status = 'pending'
+		RETURNING ` + itemColumns
+	it, err := scanItem(s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), id, status, by))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return it, err
+	}
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	return nil, ErrReviewed
+}
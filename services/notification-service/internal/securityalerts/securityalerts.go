@@ -0,0 +1,185 @@
+// Package securityalerts emails users the one-time codes that confirm risky
+// sign-ins, warns them about unusual ones, and sends the links that verify
+// their email address or reset their password, from user-service events.
+package securityalerts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+const queue = "notification-service.security-alerts"
+
+type Consumer struct {
+	dispatcher *notifications.Dispatcher
+	now        func() time.Time
+}
+
+func NewConsumer(dispatcher *notifications.Dispatcher) *Consumer {
+	return &Consumer{dispatcher: dispatcher, now: time.Now}
+}
+
+// Run consumes login challenge, login anomaly, verification request and
+// password reset request events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, queue, []string{events.UserLoginChallenged, events.UserLoginAnomaly, events.UserVerificationRequested, events.UserPasswordResetRequested}, c.Handle)
+}
+
+// Handle drops codes and links that expired before they arrived, since the user can no longer use them.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	switch e.Type {
+	case events.UserLoginChallenged:
+		var payload events.LoginChallenge
+		if err := e.Decode(&payload); err != nil {
+			return err
+		}
+		if !payload.ExpiresAt.After(c.now()) {
+			log.Printf("Dropping expired login code for user %d", payload.UserID)
+			return nil
+		}
+		if payload.Tenant != "" {
+			ctx = tenant.NewContext(ctx, payload.Tenant)
+		}
+		return c.dispatcher.Dispatch(ctx, code(payload, c.now()))
+	case events.UserLoginAnomaly:
+		var payload events.LoginAnomaly
+		if err := e.Decode(&payload); err != nil {
+			return err
+		}
+		if payload.Tenant != "" {
+			ctx = tenant.NewContext(ctx, payload.Tenant)
+		}
+		return c.dispatcher.Dispatch(ctx, anomaly(payload))
+	case events.UserVerificationRequested:
+		var payload events.VerificationRequest
+		if err := e.Decode(&payload); err != nil {
+			return err
+		}
+		if !payload.ExpiresAt.After(c.now()) {
+			log.Printf("Dropping expired verification link for user %d", payload.UserID)
+			return nil
+		}
+		if payload.Tenant != "" {
+			ctx = tenant.NewContext(ctx, payload.Tenant)
+		}
+		return c.dispatcher.Dispatch(ctx, verification(payload, c.now()))
+	case events.UserPasswordResetRequested:
+		var payload events.PasswordResetRequest
+		if err := e.Decode(&payload); err != nil {
+			return err
+		}
+		if !payload.ExpiresAt.After(c.now()) {
+			log.Printf("Dropping expired password reset link for user %d", payload.UserID)
+			return nil
+		}
+		if payload.Tenant != "" {
+			ctx = tenant.NewContext(ctx, payload.Tenant)
+		}
+		return c.dispatcher.Dispatch(ctx, passwordReset(payload, c.now()))
+	}
+	return nil
+}
+
+// from describes where a sign-in came from.
+func from(clientIP, country string) string {
+	if country == "" {
+		return clientIP
+	}
+	return clientIP + " (" + country + ")"
+}
+
+func code(p events.LoginChallenge, now time.Time) *notifications.Notification {
+	minutes := max(int(p.ExpiresAt.Sub(now).Round(time.Minute).Minutes()), 1)
+	body := fmt.Sprintf("Your sign-in code is %s. It expires in %d %s.\n\n", p.Code, minutes, plural(minutes, "minute"))
+	body += fmt.Sprintf("Someone signed in to your account from %s with your password. If it was not you, change your password now.", from(p.ClientIP, p.Country))
+
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:    &userID,
+		Recipient: p.Email,
+		Channel:   "email",
+		Type:      notifications.TypeSecurity,
+		Subject:   "Your sign-in code",
+		Body:      body,
+	}}
+}
+
+// reasons explains the login rules a sign-in tripped.
+var reasons = map[string]string{
+	"impossible_travel": "it came from too far away to reach since your last sign-in",
+	"new_country":       "it came from a country you have not signed in from before",
+	"unusual_hour":      "it came at a time of day you do not usually sign in",
+}
+
+func anomaly(p events.LoginAnomaly) *notifications.Notification {
+	var body strings.Builder
+	fmt.Fprintf(&body, "We noticed an unusual sign-in to your account from %s.\n\n", from(p.ClientIP, p.Country))
+	for _, r := range p.Reasons {
+		if reason, ok := reasons[r]; ok {
+			fmt.Fprintf(&body, "- %s\n", reason)
+		}
+	}
+	if p.Challenged {
+		body.WriteString("\nWe sent a code to this address to confirm it. If you did not try to sign in, do not share the code, and change your password.")
+	} else {
+		body.WriteString("\nIf this was you, there is nothing to do. If not, change your password now.")
+	}
+
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:    &userID,
+		Recipient: p.Email,
+		Channel:   "email",
+		Type:      notifications.TypeSecurity,
+		Subject:   "Unusual sign-in to your account",
+		Body:      body.String(),
+	}}
+}
+
+func verification(p events.VerificationRequest, now time.Time) *notifications.Notification {
+	hours := max(int(p.ExpiresAt.Sub(now).Round(time.Hour).Hours()), 1)
+	body := fmt.Sprintf("Confirm that this is your email address by opening this link:\n\n%s\n\nThe link expires in %d %s. ", p.URL, hours, plural(hours, "hour"))
+	body += "If you did not create an account, you can ignore this email."
+
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:    &userID,
+		Recipient: p.Email,
+		Channel:   "email",
+		Type:      notifications.TypeSecurity,
+		Subject:   "Verify your email address",
+		Body:      body,
+	}}
+}
+
+func passwordReset(p events.PasswordResetRequest, now time.Time) *notifications.Notification {
+	minutes := max(int(p.ExpiresAt.Sub(now).Round(time.Minute).Minutes()), 1)
+	body := fmt.Sprintf("Someone asked to reset the password of your account. Choose a new password by opening this link:\n\n%s\n\n", p.URL)
+	body += fmt.Sprintf("The link works once and expires in %d %s. Resetting your password signs you out everywhere. ", minutes, plural(minutes, "minute"))
+	body += "If you did not ask for this, you can ignore this email; your password has not changed."
+
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:    &userID,
+		Recipient: p.Email,
+		Channel:   "email",
+		Type:      notifications.TypeSecurity,
+		Subject:   "Reset your password",
+		Body:      body,
+	}}
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
@@ -0,0 +1,93 @@
+package securityalerts
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+type memStore struct {
+	notifications.Store
+	created []notifications.Notification
+}
+
+func (s *memStore) Create(ctx context.Context, n *notifications.Notification) error {
+	n.ID = len(s.created) + 1
+	s.created = append(s.created, *n)
+	return nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, id int, a notifications.Attempt) error {
+	s.created[id-1].Status = a.Status
+	return nil
+}
+
+// optedOut stands in for a user who turned everything off.
+type optedOut struct{}
+
+func (optedOut) Decide(ctx context.Context, n *notifications.Notification, now time.Time) (notifications.Decision, error) {
+	return notifications.Decision{Suppress: true}, nil
+}
+
+func TestHandle(t *testing.T) {
+	store := &memStore{}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, optedOut{}, nil, ""))
+	now := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	consumer.now = func() time.Time { return now }
+
+	for _, expires := range []time.Time{now.Add(10 * time.Minute), now.Add(-time.Second)} {
+		e, _ := events.New(events.UserLoginChallenged, "user-service", events.LoginChallenge{
+			UserID: 1, Email: "john@example.com", Code: "042137", ExpiresAt: expires, ClientIP: "200.160.1.1", Country: "BR",
+		})
+		if err := consumer.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	e, _ := events.New(events.UserLoginAnomaly, "user-service", events.LoginAnomaly{
+		UserID: 1, Email: "john@example.com", ClientIP: "200.160.1.1", Country: "BR", Score: 30, Reasons: []string{"new_country"},
+	})
+	if err := consumer.Handle(context.Background(), e); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for _, expires := range []time.Time{now.Add(24 * time.Hour), now.Add(-time.Second)} {
+		e, _ := events.New(events.UserVerificationRequested, "user-service", events.VerificationRequest{
+			UserID: 1, Email: "john@example.com", URL: "https://shop.example/verify?token=t1", ExpiresAt: expires,
+		})
+		if err := consumer.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	for _, expires := range []time.Time{now.Add(time.Hour), now.Add(-time.Second)} {
+		e, _ := events.New(events.UserPasswordResetRequested, "user-service", events.PasswordResetRequest{
+			UserID: 1, Email: "john@example.com", URL: "https://shop.example/reset?token=t2", ExpiresAt: expires,
+		})
+		if err := consumer.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	if len(store.created) != 4 {
+		t.Fatalf("Expected a code, an alert and two links, and the expired ones dropped, got: %+v", store.created)
+	}
+	code, alert, link, reset := store.created[0], store.created[1], store.created[2], store.created[3]
+	if code.Status != notifications.StatusSent || code.Type != notifications.TypeSecurity || !strings.Contains(code.Body, "042137") ||
+		!strings.Contains(code.Body, "10 minutes") || !strings.Contains(code.Body, "200.160.1.1 (BR)") {
+		t.Errorf("Expected the code to be sent despite the user's preferences, got: %+v", code)
+	}
+	if alert.Status != notifications.StatusSent || alert.Recipient != "john@example.com" || !strings.Contains(alert.Body, "a country you have not signed in from") {
+		t.Errorf("Expected the alert to explain the new country, got: %+v", alert)
+	}
+	if link.Status != notifications.StatusSent || !strings.Contains(link.Body, "https://shop.example/verify?token=t1") || !strings.Contains(link.Body, "24 hours") {
+		t.Errorf("Expected the verification link to be sent, got: %+v", link)
+	}
+	if reset.Status != notifications.StatusSent || reset.Subject != "Reset your password" ||
+		!strings.Contains(reset.Body, "https://shop.example/reset?token=t2") || !strings.Contains(reset.Body, "60 minutes") {
+		t.Errorf("Expected the password reset link to be sent, got: %+v", reset)
+	}
+}
@@ -0,0 +1,58 @@
+// Package stockalerts emails inventory-service lot expiry warnings to the
+// address inventory-service names on them. Low-stock alerts are sent by a
+// routing rule; see package routing.
+package stockalerts
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+const queue = "notification-service.low-stock"
+
+type Consumer struct {
+	dispatcher *notifications.Dispatcher
+}
+
+func NewConsumer(dispatcher *notifications.Dispatcher) *Consumer {
+	return &Consumer{dispatcher: dispatcher}
+}
+
+// Run consumes lot expiry events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, queue, []string{events.InventoryLotExpiring}, c.Handle)
+}
+
+// Handle drops alerts without a recipient; they remain on the event bus for
+// other consumers.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	if e.Type != events.InventoryLotExpiring {
+		return nil
+	}
+	var payload events.LotExpiring
+	if err := e.Decode(&payload); err != nil {
+		return err
+	}
+	if payload.NotifyEmail == "" {
+		log.Printf("Lot expiry alert for %s lot %s has no recipient", payload.SKU, payload.LotCode)
+		return nil
+	}
+	return c.dispatcher.Dispatch(ctx, expiring(payload))
+}
+
+func expiring(p events.LotExpiring) *notifications.Notification {
+	return &notifications.Notification{Notification: models.Notification{
+		Recipient:   p.NotifyEmail,
+		Channel:     "email",
+		Type:        notifications.TypeStockAlert,
+		Subject:     "Lot expiring: " + p.SKU + " " + p.LotCode,
+		Body:        fmt.Sprintf("Lot %s of %s (%s) expires on %s with %d left. It will be quarantined the day after.", p.LotCode, p.Name, p.SKU, p.ExpiresOn, p.Quantity),
+		ContextType: "sku",
+		ContextID:   p.SKU,
+	}}
+}
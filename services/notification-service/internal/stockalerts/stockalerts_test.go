@@ -0,0 +1,54 @@
+package stockalerts
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+type memStore struct {
+	notifications.Store
+	created []notifications.Notification
+}
+
+func (s *memStore) Create(ctx context.Context, n *notifications.Notification) error {
+	n.ID = len(s.created) + 1
+	s.created = append(s.created, *n)
+	return nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, id int, a notifications.Attempt) error {
+	s.created[id-1].Status = a.Status
+	return nil
+}
+
+func TestHandleEmailsLotExpiry(t *testing.T) {
+	store := &memStore{}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, ""))
+
+	e, err := events.New(events.InventoryLotExpiring, "inventory-service", events.LotExpiring{
+		LotID:       7,
+		SKU:         "SKU-001",
+		Name:        "Widget",
+		LotCode:     "L-42",
+		ExpiresOn:   "2026-11-01",
+		Quantity:    12,
+		NotifyEmail: "buyer@example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	if err := consumer.Handle(context.Background(), e); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(store.created) != 1 {
+		t.Fatalf("Expected 1 notification, got: %d", len(store.created))
+	}
+	if n := store.created[0]; n.Recipient != "buyer@example.com" || !strings.Contains(n.Body, "expires on 2026-11-01 with 12 left") {
+		t.Errorf("Expected expiry warning to buyer, got: %+v", n)
+	}
+}
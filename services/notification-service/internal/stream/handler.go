@@ -0,0 +1,181 @@
+package stream
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const writeTimeout = 10 * time.Second
+
+type Handler struct {
+	hub       *Hub
+	tokens    *auth.Tokens
+	heartbeat time.Duration
+	upgrader  websocket.Upgrader
+}
+
+// NewHandler sends a heartbeat (an SSE comment or a WebSocket ping) every
+// heartbeat interval, which keeps proxies from closing idle connections and
+// detects clients that went away.
+func NewHandler(hub *Hub, tokens *auth.Tokens, heartbeat time.Duration) *Handler {
+	return &Handler{
+		hub:       hub,
+		tokens:    tokens,
+		heartbeat: heartbeat,
+		// Browsers cannot send an Authorization header on WebSocket upgrades,
+		// so access is controlled by the token rather than the origin.
+		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+	}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/notifications/stream", h.stream)
+}
+
+// principal accepts the token from ?access_token= as well, since neither
+// EventSource nor the browser WebSocket API can set request headers.
+func (h *Handler) principal(c *gin.Context) (*auth.Principal, bool) {
+	if p, ok := auth.FromContext(c); ok {
+		return p, true
+	}
+	if token := c.Query("access_token"); token != "" {
+		if p, err := h.tokens.Parse(token); err == nil {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// stream serves the caller's own events; admins and services may watch
+// another user with ?user_id=. Requests with an Upgrade: websocket header
+// get a WebSocket, everything else server-sent events.
+func (h *Handler) stream(c *gin.Context) {
+	p, ok := h.principal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+		return
+	}
+	userID := p.UserID
+	if raw := c.Query("user_id"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			return
+		}
+		userID = id
+	}
+	if userID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id query parameter is required"})
+		return
+	}
+	if !p.CanActFor(userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to access this user"})
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		h.websocket(c, userID)
+		return
+	}
+	h.sse(c, userID)
+}
+
+func (h *Handler) sse(c *gin.Context, userID int) {
+	sub := h.hub.subscribe(userID)
+	defer h.hub.unsubscribe(userID, sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// Tell the client how long to wait before reconnecting.
+	fmt.Fprintf(c.Writer, "retry: 3000\n\n")
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-sub.done:
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		case e := <-sub.events:
+			data, err := frame(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+func (h *Handler) websocket(c *gin.Context, userID int) {
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already written an error response.
+		return
+	}
+	defer conn.Close()
+
+	sub := h.hub.subscribe(userID)
+	defer h.hub.unsubscribe(userID, sub)
+
+	// The client sends nothing but pongs and close frames; a client that
+	// misses two heartbeats is considered gone.
+	pongWait := 2 * h.heartbeat
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-sub.done:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too far behind, reconnect"),
+				time.Now().Add(writeTimeout))
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case e := <-sub.events:
+			data, err := frame(e)
+			if err != nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package stream pushes events to users over long-lived WebSocket and
+// server-sent event connections.
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+)
+
+// Hub fans events out to the connections of the user they concern. Each
+// connection has a bounded buffer; a client that falls that far behind is
+// disconnected rather than allowed to slow the hub, and should reconnect.
+type Hub struct {
+	buffer int
+
+	mu    sync.Mutex
+	conns map[int]map[*subscription]struct{}
+}
+
+type subscription struct {
+	events chan events.Event
+	// done is closed when the hub drops the subscription.
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *subscription) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func NewHub(buffer int) *Hub {
+	return &Hub{buffer: buffer, conns: map[int]map[*subscription]struct{}{}}
+}
+
+func (h *Hub) subscribe(userID int) *subscription {
+	s := &subscription{events: make(chan events.Event, h.buffer), done: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[userID] == nil {
+		h.conns[userID] = map[*subscription]struct{}{}
+	}
+	h.conns[userID][s] = struct{}{}
+	return s
+}
+
+func (h *Hub) unsubscribe(userID int, s *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns[userID], s)
+	if len(h.conns[userID]) == 0 {
+		delete(h.conns, userID)
+	}
+	s.close()
+}
+
+// Connections returns the number of open connections.
+func (h *Hub) Connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, subs := range h.conns {
+		n += len(subs)
+	}
+	return n
+}
+
+// Handle delivers e to the connections of the user named by the user_id
+// field of its payload. Events without one are ignored.
+func (h *Hub) Handle(ctx context.Context, e events.Event) error {
+	var target struct {
+		UserID *int `json:"user_id"`
+	}
+	if err := e.Decode(&target); err != nil || target.UserID == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.conns[*target.UserID] {
+		select {
+		case s.events <- e:
+		default:
+			delete(h.conns[*target.UserID], s)
+			s.close()
+		}
+	}
+	return nil
+}
+
+// Run feeds the hub from the event bus until ctx is cancelled. Every replica
+// needs every event, since any of them may hold the user's connection, so it
+// subscribes with a private queue.
+func (h *Hub) Run(ctx context.Context, subscriber events.Subscriber, patterns []string) error {
+	return subscriber.Subscribe(ctx, "", patterns, h.Handle)
+}
+
+// frame is what clients receive for each event.
+func frame(e events.Event) ([]byte, error) {
+	return json.Marshal(e)
+}
@@ -0,0 +1,139 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+func notificationFor(t *testing.T, userID int) events.Event {
+	t.Helper()
+	e, err := events.New(events.NotificationCreated, "notification-service", events.NotificationRecord{
+		ID:      1,
+		UserID:  &userID,
+		Channel: "email",
+		Subject: "Order shipped",
+	})
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	return e
+}
+
+func TestHubRoutesByUser(t *testing.T) {
+	hub := NewHub(1)
+	mine := hub.subscribe(1)
+	other := hub.subscribe(2)
+
+	hub.Handle(context.Background(), notificationFor(t, 1))
+	if len(mine.events) != 1 || len(other.events) != 0 {
+		t.Errorf("Expected event only for user 1, got: %d and %d", len(mine.events), len(other.events))
+	}
+
+	// A second event overflows user 1's buffer and drops the connection.
+	hub.Handle(context.Background(), notificationFor(t, 1))
+	select {
+	case <-mine.done:
+	default:
+		t.Fatal("Expected slow subscriber to be dropped")
+	}
+	if hub.Connections() != 1 {
+		t.Errorf("Expected 1 connection left, got: %d", hub.Connections())
+	}
+	hub.unsubscribe(1, mine)
+}
+
+func setup(t *testing.T) (*gin.Engine, *Hub, *auth.Tokens) {
+	gin.SetMode(gin.TestMode)
+	tokens, err := auth.NewTokens("test-secret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create tokens: %v", err)
+	}
+	hub := NewHub(8)
+	router := gin.New()
+	router.Use(auth.Authenticate(tokens))
+	NewHandler(hub, tokens, time.Minute).RegisterRoutes(router)
+	return router, hub, tokens
+}
+
+func TestStreamRequiresAccess(t *testing.T) {
+	router, _, tokens := setup(t)
+	token, _, _ := tokens.IssueUser(1, nil)
+
+	tests := []struct {
+		name, query string
+		want        int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"bad token", "?access_token=nope", http.StatusUnauthorized},
+		{"other user", "?access_token=" + token + "&user_id=2", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/notifications/stream"+tt.query, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: Expected status %d, got: %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	router, hub, tokens := setup(t)
+	token, _, _ := tokens.IssueUser(1, nil)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/notifications/stream?access_token="+token, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got: %s", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || !strings.HasPrefix(lines.Text(), "retry:") {
+		t.Fatalf("Expected retry line, got: %q", lines.Text())
+	}
+
+	e := notificationFor(t, 1)
+	hub.Handle(ctx, e)
+	var got []string
+	for lines.Scan() {
+		if lines.Text() == "" {
+			continue
+		}
+		got = append(got, lines.Text())
+		if strings.HasPrefix(lines.Text(), "data:") {
+			break
+		}
+	}
+	if len(got) != 3 || got[0] != "id: "+e.ID || got[1] != "event: "+events.NotificationCreated {
+		t.Fatalf("Expected id, event and data lines, got: %q", got)
+	}
+	if !strings.Contains(got[2], `"subject":"Order shipped"`) {
+		t.Errorf("Expected notification payload in data, got: %s", got[2])
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for hub.Connections() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hub.Connections() != 0 {
+		t.Errorf("Expected connection to be released, got: %d", hub.Connections())
+	}
+}
@@ -0,0 +1,204 @@
+package suppression
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FeedbackSignatureHeader = "X-Feedback-Signature"
+	maxFeedbackBytes        = 1 << 20
+)
+
+// Feedback types a provider reports.
+const (
+	FeedbackBounce      = "bounce"
+	FeedbackComplaint   = "complaint"
+	FeedbackUnsubscribe = "unsubscribe"
+)
+
+// Feedback is the provider-neutral feedback loop payload. BounceType is
+// hard or soft; only hard bounces suppress the recipient, since a soft one
+// such as a full mailbox may clear. MessageID is the Message-ID of the
+// notification the feedback is about, when the provider reports it.
+type Feedback struct {
+	Type       string `json:"type"`
+	Channel    string `json:"channel"`
+	Recipient  string `json:"recipient"`
+	BounceType string `json:"bounce_type"`
+	Provider   string `json:"provider"`
+	MessageID  string `json:"message_id"`
+}
+
+// Notifications finds the notification a reply token was issued for.
+type Notifications interface {
+	FindByReplyToken(ctx context.Context, token string) (*notifications.Notification, error)
+}
+
+// FeedbackHandler receives provider feedback loops and adds the recipients
+// to the suppression lists.
+type FeedbackHandler struct {
+	store         Store
+	notifications Notifications
+	feed          *notifications.Feed
+	secret        []byte
+	messageID     *regexp.Regexp
+}
+
+// NewFeedbackHandler accepts webhooks signed with secret. Feedback naming a
+// Message-ID on replyDomain, as notifications.Dispatcher issues them, is
+// credited to the tenant that sent the notification. Bounces, soft ones
+// included, and complaints are recorded on feed, unless it is nil.
+func NewFeedbackHandler(store Store, notifications Notifications, feed *notifications.Feed, replyDomain, secret string) *FeedbackHandler {
+	h := &FeedbackHandler{store: store, notifications: notifications, feed: feed, secret: []byte(secret)}
+	if replyDomain != "" {
+		h.messageID = regexp.MustCompile(`<?([0-9a-f]{32})@` + regexp.QuoteMeta(strings.ToLower(replyDomain)) + `>?`)
+	}
+	return h
+}
+
+func (h *FeedbackHandler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/inbound/feedback", h.receive)
+}
+
+// verify checks the hex HMAC-SHA256 of the raw body in
+// FeedbackSignatureHeader.
+func (h *FeedbackHandler) verify(body []byte, signature string) bool {
+	want, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// scope decides which list feedback goes on. Hard bounces are about the
+// address, so they go on the global list. Complaints and unsubscribes are
+// about what a tenant sent, so they go on that tenant's list, or the global
+// one if the notification cannot be found.
+func (h *FeedbackHandler) scope(ctx context.Context, f Feedback) (context.Context, bool, error) {
+	if f.Type == FeedbackBounce || h.messageID == nil {
+		return ctx, true, nil
+	}
+	m := h.messageID.FindStringSubmatch(strings.ToLower(f.MessageID))
+	if m == nil {
+		return ctx, true, nil
+	}
+	n, err := h.notifications.FindByReplyToken(ctx, m[1])
+	if errors.Is(err, notifications.ErrNotFound) {
+		return ctx, true, nil
+	}
+	if err != nil {
+		return ctx, false, err
+	}
+	return tenant.NewContext(ctx, n.Tenant), false, nil
+}
+
+// record puts bounces and complaints on the feed.
+func (h *FeedbackHandler) record(f Feedback) {
+	if h.feed == nil {
+		return
+	}
+	o := notifications.Outcome{Channel: strings.TrimSpace(strings.ToLower(f.Channel)), Provider: f.Provider}
+	if o.Channel == "" {
+		o.Channel = "email"
+	}
+	switch f.Type {
+	case FeedbackBounce:
+		o.Status, o.Detail = notifications.OutcomeBounced, f.BounceType
+		if o.Detail == "" {
+			o.Detail = "hard"
+		}
+	case FeedbackComplaint:
+		o.Status = notifications.OutcomeComplained
+	default:
+		return
+	}
+	h.feed.Record(o)
+}
+
+// receive always answers 2xx for feedback it ignores, so the provider does
+// not retry it, and 5xx only when retrying can help. Repeated feedback for
+// a recipient leaves the entry it added.
+func (h *FeedbackHandler) receive(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxFeedbackBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.verify(body, c.GetHeader(FeedbackSignatureHeader)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid webhook signature"})
+		return
+	}
+
+	var f Feedback
+	if err := json.Unmarshal(body, &f); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if f.Type == "" || f.Recipient == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type and recipient are required"})
+		return
+	}
+
+	h.record(f)
+
+	var reason string
+	switch f.Type {
+	case FeedbackBounce:
+		if f.BounceType != "" && f.BounceType != "hard" {
+			c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+			return
+		}
+		reason = ReasonBounced
+	case FeedbackComplaint:
+		reason = ReasonComplained
+	case FeedbackUnsubscribe:
+		reason = ReasonUnsubscribed
+	default:
+		log.Printf("Ignoring %s feedback of unknown type %q", f.Provider, f.Type)
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+
+	ctx, global, err := h.scope(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	e := &Entry{Global: global, Channel: f.Channel, Recipient: f.Recipient, Reason: reason, Source: SourceFeedback,
+		CreatedBy: "feedback"}
+	if f.Provider != "" {
+		e.CreatedBy += ":" + f.Provider
+	}
+	if f.MessageID != "" {
+		e.Note = "message " + f.MessageID
+	}
+	if err := e.prepare(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	added, err := h.store.Add(ctx, e)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if added {
+		log.Printf("Suppressed %s recipient %s for %s from %s feedback", e.Channel, e.Recipient, e.Reason, f.Provider)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "suppressed", "suppression": e})
+}
@@ -0,0 +1,335 @@
+package suppression
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultListLimit  = 100
+	maxListLimit      = 1000
+	importBatch       = 500
+	maxReportedErrors = 1000
+	exportPageSize    = 1000
+)
+
+// columns is the CSV header of exports. Imports need channel, recipient
+// and reason; the other columns are optional and id, source, created_by and
+// created_at are ignored.
+var columns = []string{"id", "channel", "recipient", "reason", "source", "note", "created_by", "created_at"}
+
+// Handler manages the tenant's list for its admins and services, and the
+// global list through the admin token.
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes mounts the tenant's list. Only admins may lift a legal
+// hold.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	h.routes(router.Group("/notifications/suppressions", auth.RequireRole(auth.RoleAdmin, auth.RoleService)), false)
+}
+
+// RegisterAdminRoutes mounts the global list on the admin group.
+func (h *Handler) RegisterAdminRoutes(admin gin.IRouter) {
+	h.routes(admin.Group("/suppressions"), true)
+}
+
+func (h *Handler) routes(group gin.IRouter, global bool) {
+	group.GET("", func(c *gin.Context) { h.list(c, global) })
+	group.POST("", func(c *gin.Context) { h.add(c, global) })
+	group.DELETE("/:id", func(c *gin.Context) { h.remove(c, global) })
+	group.POST("/import", func(c *gin.Context) { h.importCSV(c, global) })
+	group.GET("/export", func(c *gin.Context) { h.exportCSV(c, global) })
+}
+
+// actor names who changed a list: the request's user or service, or the
+// admin token for the global list.
+func actor(c *gin.Context) string {
+	p, ok := auth.FromContext(c)
+	switch {
+	case !ok:
+		return "admin"
+	case p.Service != "":
+		return "service:" + p.Service
+	default:
+		return "user:" + strconv.Itoa(p.UserID)
+	}
+}
+
+// list pages through entries oldest first. Pass next_after from a page as
+// ?after= to get the next one.
+func (h *Handler) list(c *gin.Context, global bool) {
+	f := Filter{Global: global, Channel: c.Query("channel"), Reason: c.Query("reason")}
+	f.Recipient = Normalize(f.Channel, c.Query("recipient"))
+	if raw := c.Query("after"); raw != "" {
+		var err error
+		if f.AfterID, err = strconv.ParseInt(raw, 10, 64); err != nil || f.AfterID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after must be a suppression id"})
+			return
+		}
+	}
+	f.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+	if f.Limit <= 0 || f.Limit > maxListLimit {
+		f.Limit = defaultListLimit
+	}
+
+	// One extra entry tells whether there is another page.
+	limit := f.Limit
+	f.Limit++
+	entries, err := h.store.List(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"suppressions": entries}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		resp["suppressions"] = entries
+		resp["next_after"] = entries[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type addRequest struct {
+	Channel   string `json:"channel"`
+	Recipient string `json:"recipient" binding:"required"`
+	Reason    string `json:"reason" binding:"required"`
+	Note      string `json:"note"`
+}
+
+// add answers 201 for a new entry and 200 with the existing one if the
+// recipient is already suppressed for that reason.
+func (h *Handler) add(c *gin.Context, global bool) {
+	var req addRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	e := &Entry{Global: global, Channel: req.Channel, Recipient: req.Recipient, Reason: req.Reason,
+		Source: SourceManual, Note: strings.TrimSpace(req.Note), CreatedBy: actor(c)}
+	if err := e.prepare(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	added, err := h.store.Add(c.Request.Context(), e)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if added {
+		log.Printf("Suppressed %s recipient %s for %s, by %s", e.Channel, e.Recipient, e.Reason, e.CreatedBy)
+		c.JSON(http.StatusCreated, e)
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+func (h *Handler) remove(c *gin.Context, global bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid suppression id"})
+		return
+	}
+	ctx := c.Request.Context()
+	e, err := h.store.Get(ctx, global, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "suppression not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if p, ok := auth.FromContext(c); ok && e.Reason == ReasonLegalHold && !p.HasRole(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only admins can lift a legal hold"})
+		return
+	}
+	err = h.store.Remove(ctx, global, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "suppression not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Lifted %s suppression of %s recipient %s, by %s", e.Reason, e.Channel, e.Recipient, actor(c))
+	c.Status(http.StatusNoContent)
+}
+
+type importError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type importReport struct {
+	Imported int `json:"imported"`
+	// Existing counts rows already on the list.
+	Existing        int           `json:"existing"`
+	Failed          int           `json:"failed"`
+	Errors          []importError `json:"errors"`
+	ErrorsTruncated bool          `json:"errors_truncated"`
+}
+
+func (r *importReport) fail(row int, err error) {
+	r.Failed++
+	if len(r.Errors) == maxReportedErrors {
+		r.ErrorsTruncated = true
+		return
+	}
+	r.Errors = append(r.Errors, importError{Row: row, Error: err.Error()})
+}
+
+// importCSV adds the rows of a text/csv body with a header row, committing
+// every importBatch valid rows. Rows are numbered from 1, not counting the
+// header. Bad rows are reported and skipped; an unreadable body or a failure
+// writing a batch stops the import, and batches already committed stay.
+func (h *Handler) importCSV(c *gin.Context, global bool) {
+	if c.ContentType() != "text/csv" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be text/csv"})
+		return
+	}
+	r := csv.NewReader(c.Request.Body)
+	header, err := r.Read()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("reading csv header: %v", err)})
+		return
+	}
+	index := map[string]int{}
+	for i, col := range header {
+		col = strings.TrimSpace(strings.ToLower(col))
+		if !contains(columns, col) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown csv column %q", col)})
+			return
+		}
+		index[col] = i
+	}
+	for _, required := range []string{"channel", "recipient", "reason"} {
+		if _, ok := index[required]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "csv header must include channel, recipient and reason"})
+			return
+		}
+	}
+	field := func(fields []string, col string) string {
+		if i, ok := index[col]; ok {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	report := importReport{Errors: []importError{}}
+	createdBy := actor(c)
+	batch := make([]Entry, 0, importBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		added, err := h.store.AddBatch(c.Request.Context(), batch)
+		if err != nil {
+			return err
+		}
+		report.Imported += added
+		report.Existing += len(batch) - added
+		batch = batch[:0]
+		return nil
+	}
+
+	for row := 1; ; row++ {
+		fields, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			report.fail(row, errors.New("wrong number of fields"))
+			continue
+		}
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				err = flushErr
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("row %d: %v", row, err), "report": report})
+			return
+		}
+		e := Entry{Global: global, Channel: field(fields, "channel"), Recipient: field(fields, "recipient"),
+			Reason: field(fields, "reason"), Source: SourceImport, Note: field(fields, "note"), CreatedBy: createdBy}
+		if err := e.prepare(); err != nil {
+			report.fail(row, err)
+			continue
+		}
+		batch = append(batch, e)
+		if len(batch) == importBatch {
+			if err := flush(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	log.Printf("Imported %d suppressions, by %s", report.Imported, createdBy)
+	c.JSON(http.StatusOK, report)
+}
+
+// exportCSV streams the list a page at a time, so a slow client slows the
+// export instead of buffering the list in memory.
+func (h *Handler) exportCSV(c *gin.Context, global bool) {
+	ctx := c.Request.Context()
+	f := Filter{Global: global, Channel: c.Query("channel"), Reason: c.Query("reason"), Limit: exportPageSize}
+	page, err := h.store.List(ctx, f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="suppressions.csv"`)
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	if err := w.Write(columns); err != nil {
+		return
+	}
+	for len(page) > 0 {
+		for _, e := range page {
+			if err := w.Write(csvRow(e)); err != nil {
+				return
+			}
+		}
+		if w.Flush(); w.Error() != nil {
+			return
+		}
+		c.Writer.Flush()
+
+		if len(page) < exportPageSize || ctx.Err() != nil {
+			return
+		}
+		f.AfterID = page[len(page)-1].ID
+		if page, err = h.store.List(ctx, f); err != nil {
+			// Headers are already sent; the client sees a truncated body.
+			log.Printf("suppression export aborted: %v", err)
+			return
+		}
+	}
+	w.Flush()
+}
+
+func csvRow(e Entry) []string {
+	return []string{strconv.FormatInt(e.ID, 10), e.Channel, e.Recipient, e.Reason, e.Source, e.Note, e.CreatedBy,
+		e.CreatedAt.UTC().Format(time.RFC3339)}
+}
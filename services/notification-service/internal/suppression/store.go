@@ -0,0 +1,198 @@
+package suppression
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// Filter selects entries from one list, the request tenant's or the global
+// one, in ID order after AfterID.
+type Filter struct {
+	Global    bool
+	Channel   string
+	Recipient string
+	Reason    string
+	AfterID   int64
+	Limit     int
+}
+
+type Store interface {
+	// Match returns the reasons recipient is suppressed on channel, from
+	// the request tenant's list and the global one.
+	Match(ctx context.Context, channel, recipient string) ([]string, error)
+	// Add stores e, filling in its ID and CreatedAt, and reports whether it
+	// is new. An entry already on the list is left as it was and returned
+	// in e.
+	Add(ctx context.Context, e *Entry) (bool, error)
+	// AddBatch adds entries in one transaction and returns how many were
+	// new.
+	AddBatch(ctx context.Context, entries []Entry) (int, error)
+	Get(ctx context.Context, global bool, id int64) (*Entry, error)
+	// Remove returns ErrNotFound if the list has no entry id.
+	Remove(ctx context.Context, global bool, id int64) error
+	List(ctx context.Context, f Filter) ([]Entry, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// scope is the tenant_id of a list: NULL for the global one.
+func scope(ctx context.Context, global bool) sql.NullString {
+	if global {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: tenant.FromContext(ctx), Valid: true}
+}
+
+const entryColumns = `id, tenant_id IS NULL, channel, recipient, reason, source, note, created_by, created_at`
+
+func scanEntry(row interface{ Scan(...any) error }) (*Entry, error) {
+	var e Entry
+	if err := row.Scan(&e.ID, &e.Global, &e.Channel, &e.Recipient, &e.Reason, &e.Source, &e.Note, &e.CreatedBy, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *PostgresStore) Match(ctx context.Context, channel, recipient string) ([]string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT DISTINCT reason FROM notification_service.suppressions
+		WHERE channel = $1 AND recipient = $2 AND (tenant_id IS NULL OR tenant_id = $3)`
+	rows, err := s.db.QueryContext(ctx, query, channel, recipient, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reasons []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		reasons = append(reasons, r)
+	}
+	return reasons, rows.Err()
+}
+
+// insertEntry conflicts on idx_suppressions_entry, one entry per list,
+// recipient and reason. The no-op update returns an existing row, and xmax
+// is 0 only for a freshly inserted one.
+const insertEntry string = `INSERT INTO notification_service.suppressions
+		(tenant_id, channel, recipient, reason, source, note, created_by)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT ((COALESCE(tenant_id, '')), channel, recipient, reason) DO UPDATE SET reason = EXCLUDED.reason
+	RETURNING xmax = 0, ` + entryColumns
+
+func (s *PostgresStore) Add(ctx context.Context, e *Entry) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var added bool
+	err := s.db.QueryRowContext(ctx, insertEntry, scope(ctx, e.Global), e.Channel, e.Recipient, e.Reason, e.Source, e.Note, e.CreatedBy).
+		Scan(&added, &e.ID, &e.Global, &e.Channel, &e.Recipient, &e.Reason, &e.Source, &e.Note, &e.CreatedBy, &e.CreatedAt)
+	return added, err
+}
+
+func (s *PostgresStore) AddBatch(ctx context.Context, entries []Entry) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const query string = `INSERT INTO notification_service.suppressions
+			(tenant_id, channel, recipient, reason, source, note, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT ((COALESCE(tenant_id, '')), channel, recipient, reason) DO NOTHING`
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	added := 0
+	for _, e := range entries {
+		res, err := stmt.ExecContext(ctx, scope(ctx, e.Global), e.Channel, e.Recipient, e.Reason, e.Source, e.Note, e.CreatedBy)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		added += int(n)
+	}
+	return added, tx.Commit()
+}
+
+func (s *PostgresStore) Get(ctx context.Context, global bool, id int64) (*Entry, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + entryColumns + ` FROM notification_service.suppressions
+		WHERE id = $1 AND tenant_id IS NOT DISTINCT FROM $2`
+	e, err := scanEntry(s.db.QueryRowContext(ctx, query, id, scope(ctx, global)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return e, err
+}
+
+func (s *PostgresStore) Remove(ctx context.Context, global bool, id int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM notification_service.suppressions WHERE id = $1 AND tenant_id IS NOT DISTINCT FROM $2`
+	res, err := s.db.ExecContext(ctx, query, id, scope(ctx, global))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) List(ctx context.Context, f Filter) ([]Entry, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + entryColumns + ` FROM notification_service.suppressions
+		WHERE tenant_id IS NOT DISTINCT FROM $1 AND id > $2
+			AND ($3 = '' OR channel = $3) AND ($4 = '' OR recipient = $4) AND ($5 = '' OR reason = $5)
+		ORDER BY id LIMIT $6`
+	rows, err := s.db.QueryContext(ctx, query, scope(ctx, f.Global), f.AfterID, f.Channel, f.Recipient, f.Reason, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,135 @@
+// Package suppression keeps the compliance lists of recipients the service
+// must not send to: addresses that unsubscribed, bounced or complained, and
+// those under a legal hold. Entries are per tenant or global, and the
+// dispatcher checks both before every delivery attempt. Lists can be
+// imported and exported as CSV, and provider feedback loops add to them
+// through a signed webhook.
+package suppression
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Reasons a recipient is suppressed.
+const (
+	ReasonUnsubscribed = "unsubscribed"
+	ReasonBounced      = "bounced"
+	ReasonComplained   = "complained"
+	ReasonLegalHold    = "legal_hold"
+)
+
+// Reasons are in the order a recipient's suppression is reported when
+// several apply.
+var Reasons = []string{ReasonLegalHold, ReasonBounced, ReasonComplained, ReasonUnsubscribed}
+
+// Sources of an entry.
+const (
+	SourceManual   = "manual"
+	SourceImport   = "import"
+	SourceFeedback = "feedback"
+)
+
+var validChannel = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// Entry suppresses Recipient on Channel for Reason, in the tenant it was
+// added in or, when Global, in every tenant.
+type Entry struct {
+	ID        int64     `json:"id"`
+	Global    bool      `json:"global"`
+	Channel   string    `json:"channel"`
+	Recipient string    `json:"recipient"`
+	Reason    string    `json:"reason"`
+	Source    string    `json:"source"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func knownReason(reason string) bool {
+	for _, r := range Reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize is how recipients are stored and matched: trimmed, and
+// lowercased on the email channel, where addresses are case-insensitive.
+func Normalize(channel, recipient string) string {
+	recipient = strings.TrimSpace(recipient)
+	if channel == "email" {
+		recipient = strings.ToLower(recipient)
+	}
+	return recipient
+}
+
+// prepare normalizes and validates e before it is added.
+func (e *Entry) prepare() error {
+	e.Channel = strings.TrimSpace(strings.ToLower(e.Channel))
+	if e.Channel == "" {
+		e.Channel = "email"
+	}
+	if !validChannel.MatchString(e.Channel) {
+		return errors.New("channel must be lowercase letters, digits and underscores")
+	}
+	e.Recipient = Normalize(e.Channel, e.Recipient)
+	if e.Recipient == "" || len(e.Recipient) > 320 {
+		return errors.New("recipient is required and at most 320 characters")
+	}
+	if !knownReason(e.Reason) {
+		return errors.New("reason must be one of " + strings.Join(Reasons, ", "))
+	}
+	if len(e.Note) > 500 {
+		return errors.New("note must be at most 500 characters")
+	}
+	return nil
+}
+
+// Checker answers the dispatcher from the store.
+type Checker struct {
+	store Store
+}
+
+var _ notifications.Suppressions = (*Checker)(nil)
+
+func NewChecker(store Store) *Checker {
+	return &Checker{store: store}
+}
+
+// Suppressed checks the tenant's list and the global one. Security
+// notifications such as sign-in codes are only blocked by bounces and legal
+// holds: an unsubscribe or complaint must not lock a user out.
+func (c *Checker) Suppressed(ctx context.Context, n *notifications.Notification) (string, error) {
+	reasons, err := c.store.Match(ctx, n.Channel, Normalize(n.Channel, n.Recipient))
+	if err != nil || len(reasons) == 0 {
+		return "", err
+	}
+	for _, r := range Reasons {
+		if !contains(reasons, r) {
+			continue
+		}
+		if n.Type == notifications.TypeSecurity && r != ReasonBounced && r != ReasonLegalHold {
+			continue
+		}
+		return r, nil
+	}
+	return "", nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
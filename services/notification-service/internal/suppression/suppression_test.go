@@ -0,0 +1,237 @@
+package suppression
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps entries with the tenant they were added in, "" for the
+// global list.
+type memStore struct {
+	entries []Entry
+	tenants []string
+}
+
+func (s *memStore) owner(ctx context.Context, global bool) string {
+	if global {
+		return ""
+	}
+	return tenant.FromContext(ctx)
+}
+
+func (s *memStore) Match(ctx context.Context, channel, recipient string) ([]string, error) {
+	var reasons []string
+	for i, e := range s.entries {
+		if e.Channel == channel && e.Recipient == recipient && (s.tenants[i] == "" || s.tenants[i] == tenant.FromContext(ctx)) {
+			reasons = append(reasons, e.Reason)
+		}
+	}
+	return reasons, nil
+}
+
+func (s *memStore) Add(ctx context.Context, e *Entry) (bool, error) {
+	owner := s.owner(ctx, e.Global)
+	for i, have := range s.entries {
+		if s.tenants[i] == owner && have.Channel == e.Channel && have.Recipient == e.Recipient && have.Reason == e.Reason {
+			*e = have
+			return false, nil
+		}
+	}
+	e.ID, e.CreatedAt = int64(len(s.entries)+1), time.Now()
+	s.entries, s.tenants = append(s.entries, *e), append(s.tenants, owner)
+	return true, nil
+}
+
+func (s *memStore) AddBatch(ctx context.Context, entries []Entry) (int, error) {
+	added := 0
+	for i := range entries {
+		ok, _ := s.Add(ctx, &entries[i])
+		if ok {
+			added++
+		}
+	}
+	return added, nil
+}
+
+func (s *memStore) Get(ctx context.Context, global bool, id int64) (*Entry, error) {
+	for i, e := range s.entries {
+		if e.ID == id && s.tenants[i] == s.owner(ctx, global) {
+			return &e, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Remove(ctx context.Context, global bool, id int64) error {
+	for i, e := range s.entries {
+		if e.ID == id && s.tenants[i] == s.owner(ctx, global) {
+			s.entries, s.tenants = append(s.entries[:i], s.entries[i+1:]...), append(s.tenants[:i], s.tenants[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memStore) List(ctx context.Context, f Filter) ([]Entry, error) {
+	entries := []Entry{}
+	for i, e := range s.entries {
+		if s.tenants[i] != s.owner(ctx, f.Global) || e.ID <= f.AfterID || (f.Reason != "" && e.Reason != f.Reason) {
+			continue
+		}
+		if len(entries) == f.Limit {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func TestChecker(t *testing.T) {
+	store := &memStore{}
+	ctx := tenant.NewContext(context.Background(), "acme")
+	store.Add(ctx, &Entry{Channel: "email", Recipient: "a@example.com", Reason: ReasonUnsubscribed})
+	store.Add(context.Background(), &Entry{Global: true, Channel: "email", Recipient: "b@example.com", Reason: ReasonBounced})
+	checker := NewChecker(store)
+
+	for _, tc := range []struct {
+		ctx       context.Context
+		recipient string
+		typ       string
+		want      string
+	}{
+		{ctx, " A@Example.com", notifications.TypeGeneral, ReasonUnsubscribed},
+		{context.Background(), "a@example.com", notifications.TypeGeneral, ""},
+		{ctx, "a@example.com", notifications.TypeSecurity, ""},
+		{context.Background(), "b@example.com", notifications.TypeSecurity, ReasonBounced},
+		{ctx, "b@example.com", notifications.TypeGeneral, ReasonBounced},
+	} {
+		got, err := checker.Suppressed(tc.ctx, &notifications.Notification{Notification: models.Notification{Channel: "email", Recipient: tc.recipient, Type: tc.typ}})
+		if err != nil || got != tc.want {
+			t.Errorf("Expected %s %s in %s to be suppressed for %q, got: %q, %v", tc.typ, tc.recipient, tenant.FromContext(tc.ctx), tc.want, got, err)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	h := NewHandler(store)
+	roles := []string{auth.RoleAdmin}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: roles}) })
+	h.RegisterRoutes(router)
+	h.RegisterAdminRoutes(router.Group("/admin"))
+
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodPost, "/notifications/suppressions", "application/json", `{"recipient":"a@example.com","reason":"spam"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown reason to be refused, got: %d", w.Code)
+	}
+	w := do(http.MethodPost, "/notifications/suppressions", "application/json", `{"recipient":"Hold@Example.com","reason":"legal_hold"}`)
+	if w.Code != http.StatusCreated || store.entries[0].Recipient != "hold@example.com" || store.entries[0].CreatedBy != "user:1" {
+		t.Fatalf("Expected the legal hold to be added, got: %d, %+v", w.Code, store.entries)
+	}
+	if w := do(http.MethodPost, "/notifications/suppressions", "application/json", `{"recipient":"hold@example.com","reason":"legal_hold"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected an existing entry to answer 200, got: %d", w.Code)
+	}
+
+	csv := "channel,recipient,reason,note\nemail,b@example.com,bounced,\nemail,,bounced,\nsms,+15550100,unsubscribed,by phone\nemail,hold@example.com,legal_hold,\n"
+	w = do(http.MethodPost, "/notifications/suppressions/import", "text/csv", csv)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"imported":2,"existing":1,"failed":1`) {
+		t.Errorf("Expected two rows imported, one existing and one failed, got: %d %s", w.Code, w.Body.String())
+	}
+	w = do(http.MethodGet, "/notifications/suppressions/export", "", "")
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[3], "3,sms,+15550100,unsubscribed,import,by phone,user:1,") {
+		t.Errorf("Expected three exported rows, got: %s", w.Body.String())
+	}
+	if w := do(http.MethodGet, "/admin/suppressions", "", ""); !strings.Contains(w.Body.String(), `"suppressions":[]`) {
+		t.Errorf("Expected the global list to be separate, got: %s", w.Body.String())
+	}
+
+	roles = []string{auth.RoleService}
+	if w := do(http.MethodDelete, "/notifications/suppressions/1", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected only admins to lift a legal hold, got: %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/notifications/suppressions/2", "", ""); w.Code != http.StatusNoContent || len(store.entries) != 2 {
+		t.Errorf("Expected the bounce to be removed, got: %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/admin/suppressions/1", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a tenant entry to be missing from the global list, got: %d", w.Code)
+	}
+}
+
+type replyTokens map[string]*notifications.Notification
+
+func (r replyTokens) FindByReplyToken(ctx context.Context, token string) (*notifications.Notification, error) {
+	if n, ok := r[token]; ok {
+		return n, nil
+	}
+	return nil, notifications.ErrNotFound
+}
+
+func TestFeedback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	token := strings.Repeat("ab", 16)
+	h := NewFeedbackHandler(store, replyTokens{token: {Notification: models.Notification{ID: 1}, Tenant: "acme"}}, nil, "replies.example.com", "secret")
+	router := gin.New()
+	h.RegisterRoutes(router)
+
+	post := func(body string, sign bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/inbound/feedback", strings.NewReader(body))
+		if sign {
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(body))
+			req.Header.Set(FeedbackSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(`{"type":"bounce","recipient":"a@example.com"}`, false); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned webhook to be refused, got: %d", code)
+	}
+	for _, body := range []string{
+		`{"type":"bounce","bounce_type":"soft","recipient":"a@example.com"}`,
+		`{"type":"delivered","recipient":"a@example.com"}`,
+		`{"type":"bounce","bounce_type":"hard","recipient":"a@example.com","provider":"ses"}`,
+		`{"type":"complaint","recipient":"b@example.com","message_id":"<` + token + `@replies.example.com>"}`,
+		`{"type":"unsubscribe","recipient":"c@example.com","message_id":"<unknown@elsewhere.com>"}`,
+	} {
+		if code := post(body, true); code != http.StatusOK {
+			t.Errorf("Expected %s to be accepted, got: %d", body, code)
+		}
+	}
+	if len(store.entries) != 3 {
+		t.Fatalf("Expected soft bounces and unknown types to be ignored, got: %+v", store.entries)
+	}
+	if e := store.entries[0]; store.tenants[0] != "" || e.Reason != ReasonBounced || e.Source != SourceFeedback || e.CreatedBy != "feedback:ses" {
+		t.Errorf("Expected a hard bounce on the global list, got: %+v", e)
+	}
+	if e := store.entries[1]; store.tenants[1] != "acme" || e.Reason != ReasonComplained {
+		t.Errorf("Expected the complaint on the sending tenant's list, got: %+v in %q", e, store.tenants[1])
+	}
+	if e := store.entries[2]; store.tenants[2] != "" || e.Reason != ReasonUnsubscribed {
+		t.Errorf("Expected an unmatched unsubscribe on the global list, got: %+v", e)
+	}
+}
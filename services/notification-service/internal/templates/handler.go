@@ -0,0 +1,50 @@
+package templates
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/i18n"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	library *Library
+}
+
+func NewHandler(library *Library) *Handler {
+	return &Handler{library: library}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/templates/:name/preview", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.preview)
+}
+
+// preview renders a template with its variables taken from the query
+// string, e.g. /templates/low_stock/preview?locale=es&sku=SKU-001. Without
+// ?locale= it renders in the locale Accept-Language asks for.
+func (h *Handler) preview(c *gin.Context) {
+	data := map[string]any{}
+	for key, values := range c.Request.URL.Query() {
+		if key != "locale" && len(values) > 0 {
+			data[key] = values[0]
+		}
+	}
+	locale := c.DefaultQuery("locale", i18n.FromContext(c.Request.Context()))
+	msg, err := h.library.Render(c.Request.Context(), c.Param("name"), locale, data)
+	var missing *MissingError
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+		return
+	}
+	if errors.As(err, &missing) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "missing": missing.Missing})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, msg)
+}
@@ -0,0 +1,277 @@
+// Package templates holds the named email templates notifications can be
+// sent from. Templates are embedded in the binary, one file per locale.
+package templates
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/textproto"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	tparse "text/template/parse"
+
+	"github.com/alux444/go-microserv-test/pkg/i18n"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// DefaultLocale is used when a template has no variant for the requested
+// locale or its language.
+const DefaultLocale = i18n.DefaultLocale
+
+var ErrNotFound = errors.New("template not found")
+
+// MissingError lists required variables a render was not given.
+type MissingError struct {
+	Missing []string
+}
+
+func (e *MissingError) Error() string {
+	return "missing template variables: " + strings.Join(e.Missing, ", ")
+}
+
+// files holds one <name>.<locale>.html file per variant. Each starts with
+// Subject and Requires header lines and a blank line, followed by the HTML
+// body:
+//
+//	Subject: Low stock: {{.sku}}
+//	Requires: sku, name
+//
+//	<p>{{.name}} is running low.</p>
+//
+// A variant with a Layout header renders inside files/layouts/<layout>.html
+// instead, and its body only defines the layout's blocks, at least
+// "content":
+//
+//	Subject: Low stock: {{.sku}}
+//	Requires: sku, name
+//	Layout: base
+//
+//	{{define "content"}}<p>{{.name}} is running low.</p>{{end}}
+//
+// Every body can call the partials in files/partials, each named after its
+// file, such as {{template "button" dict "url" .url "label" "Open"}}.
+// files/brands/<tenant>.html redefines blocks and partials for one tenant's
+// emails, such as "brand_name" or "footer". Definitions are applied from
+// the partials, through the layout and the variant, to the brand, and the
+// last one wins.
+//
+//go:embed files
+var files embed.FS
+
+var embedded = mustParse(files)
+
+// Template is one locale's variant of a named template.
+type Template struct {
+	Name     string
+	Locale   string
+	Required []string
+	Layout   string
+	subject  *template.Template
+	body     string
+}
+
+// catalog is everything parsed from files.
+type catalog struct {
+	templates map[string]map[string]*Template
+	layouts   map[string]string
+	// partials are wrapped in their {{define}}, sorted by name.
+	partials []string
+	brands   map[string]string
+}
+
+// Message is a rendered template, ready to send.
+type Message struct {
+	Template string `json:"template"`
+	Locale   string `json:"locale"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+}
+
+// BodyRenderer renders an HTML body assembled from sources (see
+// render.Renderer.Compose), resolving assets and inlining CSS.
+type BodyRenderer interface {
+	Compose(ctx context.Context, data any, sources ...string) (string, error)
+}
+
+type Library struct {
+	catalog
+	renderer BodyRenderer
+}
+
+func NewLibrary(renderer BodyRenderer) *Library {
+	return &Library{catalog: embedded, renderer: renderer}
+}
+
+// Lookup returns the variant of name for locale, falling back along
+// i18n.Chain from a regional locale such as es-MX to its language and then
+// to DefaultLocale.
+func (l *Library) Lookup(name, locale string) (*Template, error) {
+	variants, ok := l.templates[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, candidate := range i18n.Chain(locale) {
+		if t, ok := variants[candidate]; ok {
+			return t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Render renders name in locale with data, branded for the tenant on ctx.
+// It returns a *MissingError without rendering if a required variable is
+// absent or empty.
+func (l *Library) Render(ctx context.Context, name, locale string, data map[string]any) (*Message, error) {
+	t, err := l.Lookup(name, locale)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, key := range t.Required {
+		if v, ok := data[key]; !ok || v == nil || v == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &MissingError{Missing: missing}
+	}
+
+	var subject bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	body, err := l.renderer.Compose(ctx, data, l.sources(t, tenant.FromContext(ctx))...)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Template: t.Name, Locale: t.Locale, Subject: subject.String(), Body: body}, nil
+}
+
+// sources lists what t's body is assembled from, in the order definitions
+// apply.
+func (l *Library) sources(t *Template, tenantID string) []string {
+	sources := append([]string{}, l.partials...)
+	if t.Layout != "" {
+		sources = append(sources, l.layouts[t.Layout])
+	}
+	sources = append(sources, t.body)
+	if brand, ok := l.brands[tenantID]; ok {
+		sources = append(sources, brand)
+	}
+	return sources
+}
+
+func mustParse(fsys fs.FS) catalog {
+	c := catalog{templates: map[string]map[string]*Template{}, layouts: map[string]string{}, brands: map[string]string{}}
+	for _, dir := range []string{"layouts", "partials", "brands"} {
+		paths, err := fs.Glob(fsys, "files/"+dir+"/*.html")
+		if err != nil {
+			panic(err)
+		}
+		for _, p := range paths {
+			name := strings.TrimSuffix(path.Base(p), ".html")
+			raw, err := fs.ReadFile(fsys, p)
+			if err == nil {
+				err = checkSyntax(name, string(raw), dir == "brands")
+			}
+			if err != nil {
+				panic(fmt.Sprintf("templates: %s: %v", p, err))
+			}
+			switch dir {
+			case "layouts":
+				c.layouts[name] = string(raw)
+			case "partials":
+				c.partials = append(c.partials, `{{define "`+name+`"}}`+string(raw)+`{{end}}`)
+			case "brands":
+				c.brands[name] = string(raw)
+			}
+		}
+	}
+
+	paths, err := fs.Glob(fsys, "files/*.html")
+	if err != nil {
+		panic(err)
+	}
+	for _, p := range paths {
+		t, err := parse(fsys, p)
+		if err == nil && t.Layout != "" {
+			if _, ok := c.layouts[t.Layout]; !ok {
+				err = fmt.Errorf("unknown layout %q", t.Layout)
+			}
+		}
+		if err != nil {
+			panic(fmt.Sprintf("templates: %s: %v", p, err))
+		}
+		if c.templates[t.Name] == nil {
+			c.templates[t.Name] = map[string]*Template{}
+		}
+		c.templates[t.Name][t.Locale] = t
+	}
+	for name, variants := range c.templates {
+		if _, ok := variants[DefaultLocale]; !ok {
+			panic(fmt.Sprintf("templates: %s has no %s variant", name, DefaultLocale))
+		}
+	}
+	return c
+}
+
+// checkSyntax parses text without knowing the renderer's functions. With
+// definesOnly, text may only {{define}} templates: anything outside them
+// would replace the page being assembled.
+func checkSyntax(name, text string, definesOnly bool) error {
+	tree := tparse.New(name)
+	tree.Mode = tparse.SkipFuncCheck
+	trees := map[string]*tparse.Tree{}
+	if _, err := tree.Parse(text, "", "", trees); err != nil {
+		return err
+	}
+	if root, ok := trees[name]; definesOnly && ok && !tparse.IsEmptyTree(root.Root) {
+		return errors.New(`only {{define}} blocks are allowed here`)
+	}
+	return nil
+}
+
+func parse(fsys fs.FS, p string) (*Template, error) {
+	name, locale, ok := strings.Cut(strings.TrimSuffix(path.Base(p), ".html"), ".")
+	if !ok {
+		return nil, errors.New("file name must be <name>.<locale>.html")
+	}
+	raw, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r.R)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := template.New(name).Parse(header.Get("Subject"))
+	if err != nil {
+		return nil, err
+	}
+	layout := header.Get("Layout")
+	if err := checkSyntax(name, string(body), layout != ""); err != nil {
+		return nil, err
+	}
+	var required []string
+	for _, key := range strings.Split(header.Get("Requires"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			required = append(required, key)
+		}
+	}
+	sort.Strings(required)
+	return &Template{Name: name, Locale: strings.ToLower(locale), Required: required, Layout: layout, subject: subject, body: string(body)}, nil
+}
@@ -0,0 +1,180 @@
+package templates
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/i18n"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/render"
+	"github.com/gin-gonic/gin"
+)
+
+type noAssets struct{}
+
+func (noAssets) URL(ctx context.Context, name string) (string, error) {
+	return "https://cdn.example.com/" + name, nil
+}
+
+func (noAssets) Content(ctx context.Context, name string) ([]byte, error) {
+	return nil, nil
+}
+
+func TestEveryTemplateRenders(t *testing.T) {
+	library := NewLibrary(render.NewRenderer(noAssets{}))
+	tenants := []string{tenant.Default}
+	for brand := range library.brands {
+		tenants = append(tenants, brand)
+	}
+	for name, variants := range library.templates {
+		for locale, tmpl := range variants {
+			if !reflect.DeepEqual(tmpl.Required, variants[DefaultLocale].Required) {
+				t.Errorf("%s.%s: expected the same required variables as %s, got: %v", name, locale, DefaultLocale, tmpl.Required)
+			}
+			data := map[string]any{}
+			for _, key := range tmpl.Required {
+				data[key] = "value-" + key
+			}
+			for _, tenantID := range tenants {
+				msg, err := library.Render(tenant.NewContext(context.Background(), tenantID), name, locale, data)
+				if err != nil {
+					t.Errorf("%s.%s for %s: expected no error, got: %v", name, locale, tenantID, err)
+					continue
+				}
+				if msg.Subject == "" || !strings.Contains(msg.Body, "value-") {
+					t.Errorf("%s.%s for %s: expected a subject and the variables in the body, got: %+v", name, locale, tenantID, msg)
+				}
+			}
+		}
+	}
+}
+
+func TestLayoutsAndBrands(t *testing.T) {
+	fsys := fstest.MapFS{
+		"files/layouts/base.html":    {Data: []byte(`<h1>{{block "title" .}}Shop{{end}}</h1>{{block "content" .}}{{end}}{{template "footer" .}}`)},
+		"files/partials/footer.html": {Data: []byte(`<p>{{block "brand_name" .}}Shop{{end}} · {{template "button" dict "url" "https://example.com/help" "label" "Help"}}</p>`)},
+		"files/partials/button.html": {Data: []byte(`<a href="{{.url}}">{{.label}}</a>`)},
+		"files/brands/acme.html":     {Data: []byte(`{{define "brand_name"}}Acme{{end}}{{define "title"}}Acme Supplies{{end}}`)},
+		"files/welcome.en.html":      {Data: []byte("Subject: Welcome\nLayout: base\n\n{{define \"content\"}}<p>Hi {{.name}}</p>{{end}}")},
+		"files/receipt.en.html":      {Data: []byte("Subject: Receipt\nLayout: base\n\n{{define \"title\"}}Your receipt{{end}}{{define \"content\"}}<p>Paid</p>{{end}}")},
+	}
+	library := &Library{catalog: mustParse(fsys), renderer: render.NewRenderer(noAssets{})}
+	acme := tenant.NewContext(context.Background(), "acme")
+
+	tests := []struct {
+		ctx  context.Context
+		name string
+		want string
+	}{
+		{context.Background(), "welcome", `<h1>Shop</h1><p>Hi Ada</p><p>Shop · <a href="https://example.com/help">Help</a></p>`},
+		{context.Background(), "receipt", `<h1>Your receipt</h1><p>Paid</p><p>Shop · `},
+		{acme, "welcome", `<h1>Acme Supplies</h1><p>Hi Ada</p><p>Acme · `},
+		// The brand is applied last, so it wins over the template's own title.
+		{acme, "receipt", `<h1>Acme Supplies</h1><p>Paid</p><p>Acme · `},
+	}
+	for _, tt := range tests {
+		msg, err := library.Render(tt.ctx, tt.name, "en", map[string]any{"name": "Ada"})
+		if err != nil {
+			t.Errorf("%s for %s: expected no error, got: %v", tt.name, tenant.FromContext(tt.ctx), err)
+			continue
+		}
+		if !strings.Contains(msg.Body, tt.want) {
+			t.Errorf("%s for %s: expected the body to contain %s, got: %s", tt.name, tenant.FromContext(tt.ctx), tt.want, msg.Body)
+		}
+	}
+}
+
+func TestCheckSyntax(t *testing.T) {
+	tests := []struct {
+		text        string
+		definesOnly bool
+		valid       bool
+	}{
+		{`<p>{{template "button" dict "url" .url}}</p>`, false, true},
+		{`{{define "content"}}<p>Hi</p>{{end}}`, true, true},
+		{`<p>Hi</p>{{define "content"}}{{end}}`, true, false},
+		{`{{define "content"}}<p>{{.name}</p>{{end}}`, true, false},
+	}
+	for _, tt := range tests {
+		if err := checkSyntax("test", tt.text, tt.definesOnly); (err == nil) != tt.valid {
+			t.Errorf("checkSyntax(%s, %t): expected valid=%t, got: %v", tt.text, tt.definesOnly, tt.valid, err)
+		}
+	}
+}
+
+func TestLookupFallsBack(t *testing.T) {
+	library := NewLibrary(nil)
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{"es", "es"},
+		{"es-MX", "es"},
+		{"fr", DefaultLocale},
+		{"", DefaultLocale},
+	}
+	for _, tt := range tests {
+		tmpl, err := library.Lookup("profile_nudge", tt.locale)
+		if err != nil || tmpl.Locale != tt.want {
+			t.Errorf("Lookup(%q): expected locale %s, got: %+v, %v", tt.locale, tt.want, tmpl, err)
+		}
+	}
+	if _, err := library.Lookup("no_such_template", "en"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestRenderReportsMissingVariables(t *testing.T) {
+	library := NewLibrary(render.NewRenderer(noAssets{}))
+	_, err := library.Render(context.Background(), "low_stock", "en", map[string]any{"sku": "SKU-001", "name": ""})
+	var missing *MissingError
+	if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Missing, []string{"available", "name", "reorder_point"}) {
+		t.Errorf("Expected available, name and reorder_point to be missing, got: %v", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	library := NewLibrary(render.NewRenderer(noAssets{}))
+
+	tests := []struct {
+		roles    []string
+		path     string
+		locale   string
+		want     int
+		contains string
+	}{
+		{roles: []string{auth.RoleAdmin}, path: "/templates/profile_nudge/preview?locale=es&name=Ada&percent=60", want: http.StatusOK, contains: "Hola Ada"},
+		{roles: []string{auth.RoleAdmin}, path: "/templates/low_stock/preview?sku=A1&name=Mug&available=2&reorder_point=5", locale: "es-mx", want: http.StatusOK, contains: "Stock bajo: A1"},
+		{roles: []string{auth.RoleAdmin}, path: "/templates/profile_nudge/preview?name=Ada", want: http.StatusUnprocessableEntity, contains: `"missing":["percent"]`},
+		{roles: []string{auth.RoleAdmin}, path: "/templates/unknown/preview", want: http.StatusNotFound},
+		{roles: []string{auth.RoleCustomer}, path: "/templates/profile_nudge/preview?name=Ada&percent=60", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		p := &auth.Principal{UserID: 1, Roles: tt.roles}
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			auth.WithPrincipal(c, p)
+			if tt.locale != "" {
+				c.Request = c.Request.WithContext(i18n.NewContext(c.Request.Context(), tt.locale))
+			}
+		})
+		NewHandler(library).RegisterRoutes(router)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s: expected status %d, got: %d %s", tt.path, tt.want, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("GET %s: expected body to contain %s, got: %s", tt.path, tt.contains, w.Body)
+		}
+	}
+}
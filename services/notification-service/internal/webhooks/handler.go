@@ -0,0 +1,352 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/audit"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+	// maxSubscriptions bounds how many subscriptions a tenant may have.
+	maxSubscriptions = 20
+)
+
+// Handler lets the tenant's admins manage webhook subscriptions and read
+// their delivery logs, and developers do the same for the subscriptions they
+// created.
+type Handler struct {
+	store     Store
+	deliverer *Deliverer
+	// allowHTTP accepts plain http:// URLs, for local development.
+	allowHTTP bool
+}
+
+// NewHandler queues redeliveries on deliverer straight away when it is
+// non-nil; otherwise the next sweep picks them up.
+func NewHandler(store Store, deliverer *Deliverer, allowHTTP bool) *Handler {
+	return &Handler{store: store, deliverer: deliverer, allowHTTP: allowHTTP}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/webhooks", auth.RequireRole(auth.RoleAdmin, auth.RoleDeveloper))
+	group.GET("", h.list)
+	group.POST("", h.create)
+	group.GET("/events", h.listEvents)
+	group.GET("/:id", h.get)
+	group.PUT("/:id", h.update)
+	group.DELETE("/:id", h.remove)
+	group.POST("/:id/rotate-secret", h.rotateSecret)
+	group.GET("/:id/deliveries", h.listDeliveries)
+	group.GET("/:id/deliveries/:delivery", h.getDelivery)
+	group.POST("/:id/deliveries/:delivery/redeliver", h.redeliver)
+}
+
+type subscriptionRequest struct {
+	URL         string   `json:"url" binding:"required,max=2048"`
+	Events      []string `json:"events" binding:"required,min=1"`
+	Description string   `json:"description" binding:"max=255"`
+	Active      *bool    `json:"active"`
+}
+
+// bind reads a subscription from the body, writing a 400 if it is invalid.
+func (h *Handler) bind(c *gin.Context) (*Subscription, bool) {
+	var req subscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Host == "" || u.User != nil || (u.Scheme != "https" && !(h.allowHTTP && u.Scheme == "http")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute https URL without credentials"})
+		return nil, false
+	}
+	seen := map[string]bool{}
+	types := []string{}
+	for _, e := range req.Events {
+		if !knownEvent(e) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown event type " + e + "; see GET /webhooks/events"})
+			return nil, false
+		}
+		if !seen[e] {
+			seen[e] = true
+			types = append(types, e)
+		}
+	}
+	s := &Subscription{URL: u.String(), Events: types, Description: strings.TrimSpace(req.Description), Active: true}
+	if req.Active != nil {
+		s.Active = *req.Active
+	}
+	return s, true
+}
+
+func (h *Handler) listEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"events": Events})
+}
+
+func (h *Handler) list(c *gin.Context) {
+	subs, err := h.store.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	owned := []Subscription{}
+	for _, s := range subs {
+		if owns(c, &s) {
+			owned = append(owned, s)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"subscriptions": owned})
+}
+
+// creator names the caller as a subscription's creator.
+func creator(p *auth.Principal) string {
+	return "user:" + strconv.Itoa(p.UserID)
+}
+
+// owns reports whether the caller may manage s: admins may manage any of
+// the tenant's subscriptions, developers only those they created.
+func owns(c *gin.Context, s *Subscription) bool {
+	p, ok := auth.FromContext(c)
+	return ok && (p.HasRole(auth.RoleAdmin) || s.CreatedBy == creator(p))
+}
+
+// create responds with the subscription's signing secret, which is not
+// shown again.
+func (h *Handler) create(c *gin.Context) {
+	s, ok := h.bind(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	existing, err := h.store.List(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(existing) >= maxSubscriptions {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "a tenant may have at most " + strconv.Itoa(maxSubscriptions) + " webhook subscriptions"})
+		return
+	}
+	s.Secret = newSecret()
+	if p, ok := auth.FromContext(c); ok {
+		s.CreatedBy = creator(p)
+	}
+	if err := h.store.Create(ctx, s); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+// subscriptionID parses the :id parameter, writing a 400 if it is invalid.
+func subscriptionID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid subscription id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// subscription looks up the :id subscription, writing an error response if
+// ok is false. Subscriptions the caller may not manage are not found.
+func (h *Handler) subscription(c *gin.Context) (*Subscription, bool) {
+	id, ok := subscriptionID(c)
+	if !ok {
+		return nil, false
+	}
+	s, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) || (err == nil && !owns(c, s)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return s, true
+}
+
+func (h *Handler) get(c *gin.Context) {
+	s, ok := h.subscription(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// update replaces the subscription's URL, events and description, and
+// pauses or resumes it with active. Deliveries pending for a paused
+// subscription wait until it is resumed.
+func (h *Handler) update(c *gin.Context) {
+	old, ok := h.subscription(c)
+	if !ok {
+		return
+	}
+	s, ok := h.bind(c)
+	if !ok {
+		return
+	}
+	s.ID = old.ID
+	audit.SetBefore(c, old)
+	err := h.store.Update(c.Request.Context(), s)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func (h *Handler) remove(c *gin.Context) {
+	s, ok := h.subscription(c)
+	if !ok {
+		return
+	}
+	err := h.store.Delete(c.Request.Context(), s.ID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// rotateSecret replaces the signing secret; deliveries from now on are
+// signed with the new one.
+func (h *Handler) rotateSecret(c *gin.Context) {
+	s, ok := h.subscription(c)
+	if !ok {
+		return
+	}
+	id, secret := s.ID, newSecret()
+	err := h.store.SetSecret(c.Request.Context(), id, secret)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "secret": secret})
+}
+
+// listDeliveries pages through the subscription's deliveries newest
+// first. Pass next_before from a page as ?before= to get the next one.
+// ?status= is pending, delivered or failed.
+func (h *Handler) listDeliveries(c *gin.Context) {
+	s, ok := h.subscription(c)
+	if !ok {
+		return
+	}
+	f := DeliveryFilter{SubscriptionID: s.ID, Status: c.Query("status")}
+	switch f.Status {
+	case "", StatusPending, StatusDelivered, StatusFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, delivered or failed"})
+		return
+	}
+	if raw := c.Query("before"); raw != "" {
+		var err error
+		if f.Before, err = strconv.ParseInt(raw, 10, 64); err != nil || f.Before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a delivery id"})
+			return
+		}
+	}
+	f.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDeliveryLimit)))
+	if f.Limit <= 0 || f.Limit > maxDeliveryLimit {
+		f.Limit = defaultDeliveryLimit
+	}
+
+	// One extra delivery tells whether there is another page.
+	limit := f.Limit
+	f.Limit++
+	deliveries, err := h.store.ListDeliveries(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"deliveries": deliveries}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		resp["deliveries"] = deliveries
+		resp["next_before"] = deliveries[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// delivery looks up the :delivery parameter within the :id subscription,
+// writing an error response if ok is false.
+func (h *Handler) delivery(c *gin.Context) (*Delivery, bool) {
+	s, ok := h.subscription(c)
+	if !ok {
+		return nil, false
+	}
+	deliveryID, err := strconv.ParseInt(c.Param("delivery"), 10, 64)
+	if err != nil || deliveryID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delivery id"})
+		return nil, false
+	}
+	d, err := h.store.GetDelivery(c.Request.Context(), deliveryID)
+	if errors.Is(err, ErrNotFound) || (err == nil && d.SubscriptionID != s.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return d, true
+}
+
+// getDelivery returns the delivery with every attempt at it: when it was
+// made, the status code and the start of the response, or why there was
+// none.
+func (h *Handler) getDelivery(c *gin.Context) {
+	d, ok := h.delivery(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// redeliver sends a delivered or failed delivery again, as a receiver that
+// lost or mishandled it would ask for.
+func (h *Handler) redeliver(c *gin.Context) {
+	d, ok := h.delivery(c)
+	if !ok {
+		return
+	}
+	if d.Status == StatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "delivery is still pending"})
+		return
+	}
+	d, err := h.store.Redeliver(c.Request.Context(), d.ID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "delivery is still pending"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if h.deliverer != nil {
+		h.deliverer.Enqueue(*d)
+	}
+	c.JSON(http.StatusAccepted, d)
+}
@@ -0,0 +1,349 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+// DeliveryFilter selects a subscription's deliveries, newest first, before
+// the delivery ID Before when it is set.
+type DeliveryFilter struct {
+	SubscriptionID int64
+	Status         string
+	Before         int64
+	Limit          int
+}
+
+// Store keeps the tenant's subscriptions and their deliveries.
+type Store interface {
+	// Create stores s with its secret, filling in its ID and timestamps.
+	Create(ctx context.Context, s *Subscription) error
+	Get(ctx context.Context, id int64) (*Subscription, error)
+	List(ctx context.Context) ([]Subscription, error)
+	// Update saves s's URL, events, description and active flag.
+	Update(ctx context.Context, s *Subscription) error
+	SetSecret(ctx context.Context, id int64, secret string) error
+	// Delete removes the subscription with its deliveries.
+	Delete(ctx context.Context, id int64) error
+	// Matching returns the active subscriptions to eventType.
+	Matching(ctx context.Context, eventType string) ([]Subscription, error)
+
+	// Enqueue adds a pending delivery of e, as payload, to the
+	// subscription and returns it, reporting false if the subscription
+	// already had one for e.
+	Enqueue(ctx context.Context, subscriptionID int64, e events.Event, payload []byte) (*Delivery, bool, error)
+	// Due returns pending deliveries to active subscriptions whose next
+	// attempt is at or before now, across tenants, soonest first.
+	Due(ctx context.Context, now time.Time, limit int) ([]Delivery, error)
+	// Claim pushes a delivery that is due at now back to until and returns
+	// it for sending, or returns ErrNotFound if it is not due or its
+	// subscription is paused, so concurrent workers never send it twice.
+	Claim(ctx context.Context, id int64, now, until time.Time) (*Outbound, error)
+	// RecordAttempt logs a and moves the delivery to status, to be tried
+	// again at next when it is still pending.
+	RecordAttempt(ctx context.Context, id int64, a *Attempt, status string, next *time.Time) error
+	ListDeliveries(ctx context.Context, f DeliveryFilter) ([]Delivery, error)
+	// GetDelivery returns the delivery with its History, oldest attempt
+	// first.
+	GetDelivery(ctx context.Context, id int64) (*Delivery, error)
+	// Redeliver makes a delivered or failed delivery pending again, due
+	// now with its attempts reset, and returns it. A pending delivery is
+	// ErrNotFound.
+	Redeliver(ctx context.Context, id int64) (*Delivery, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const subscriptionColumns = `id, url, events, description, active, COALESCE(created_by, ''), created_at, updated_at`
+
+func scanSubscription(row interface{ Scan(...any) error }) (*Subscription, error) {
+	var s Subscription
+	if err := row.Scan(&s.ID, &s.URL, pq.Array(&s.Events), &s.Description, &s.Active, &s.CreatedBy, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *PostgresStore) Create(ctx context.Context, sub *Subscription) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO notification_service.webhook_subscriptions (tenant_id, url, events, description, secret, active, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')) RETURNING id, created_at, updated_at`
+	return s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), sub.URL, pq.Array(sub.Events), sub.Description, sub.Secret, sub.Active, sub.CreatedBy).
+		Scan(&sub.ID, &sub.CreatedAt, &sub.UpdatedAt)
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int64) (*Subscription, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + subscriptionColumns + ` FROM notification_service.webhook_subscriptions
+		WHERE id = $1 AND tenant_id = $2`
+	sub, err := scanSubscription(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return sub, err
+}
+
+func (s *PostgresStore) List(ctx context.Context) ([]Subscription, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + subscriptionColumns + ` FROM notification_service.webhook_subscriptions
+		WHERE tenant_id = $1 ORDER BY id`
+	return s.querySubscriptions(ctx, query, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) Matching(ctx context.Context, eventType string) ([]Subscription, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + subscriptionColumns + ` FROM notification_service.webhook_subscriptions
+		WHERE tenant_id = $1 AND active AND $2 = ANY(events) ORDER BY id`
+	return s.querySubscriptions(ctx, query, tenant.FromContext(ctx), eventType)
+}
+
+func (s *PostgresStore) querySubscriptions(ctx context.Context, query string, args ...any) ([]Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *PostgresStore) Update(ctx context.Context, sub *Subscription) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.webhook_subscriptions
+		SET url = $3, events = $4, description = $5, active = $6, updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 RETURNING ` + subscriptionColumns
+	saved, err := scanSubscription(s.db.QueryRowContext(ctx, query, sub.ID, tenant.FromContext(ctx),
+		sub.URL, pq.Array(sub.Events), sub.Description, sub.Active))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	*sub = *saved
+	return nil
+}
+
+func (s *PostgresStore) SetSecret(ctx context.Context, id int64, secret string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.webhook_subscriptions SET secret = $3, updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2`
+	return expectRow(s.db.ExecContext(ctx, query, id, tenant.FromContext(ctx), secret))
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "DELETE FROM notification_service.webhook_subscriptions WHERE id = $1 AND tenant_id = $2"
+	return expectRow(s.db.ExecContext(ctx, query, id, tenant.FromContext(ctx)))
+}
+
+// expectRow turns an update that matched nothing into ErrNotFound.
+func expectRow(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+const deliveryColumns = `id, subscription_id, event_id, event_type, status, attempts, next_attempt_at,
+	COALESCE(last_status_code, 0), COALESCE(last_error, ''), created_at, delivered_at, tenant_id`
+
+func scanDelivery(row interface{ Scan(...any) error }) (*Delivery, error) {
+	var d Delivery
+	var next, delivered sql.NullTime
+	if err := row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &next,
+		&d.LastStatusCode, &d.LastError, &d.CreatedAt, &delivered, &d.Tenant); err != nil {
+		return nil, err
+	}
+	if next.Valid {
+		d.NextAttemptAt = &next.Time
+	}
+	if delivered.Valid {
+		d.DeliveredAt = &delivered.Time
+	}
+	return &d, nil
+}
+
+func (s *PostgresStore) Enqueue(ctx context.Context, subscriptionID int64, e events.Event, payload []byte) (*Delivery, bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO notification_service.webhook_deliveries
+			(subscription_id, tenant_id, event_id, event_type, payload, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (subscription_id, event_id) DO NOTHING
+		RETURNING ` + deliveryColumns
+	d, err := scanDelivery(s.db.QueryRowContext(ctx, query, subscriptionID, tenant.FromContext(ctx), e.ID, e.Type, payload))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return d, true, nil
+}
+
+func (s *PostgresStore) Due(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + deliveryColumns + ` FROM notification_service.webhook_deliveries d
+		WHERE status = 'pending' AND next_attempt_at <= $1
+			AND EXISTS (SELECT 1 FROM notification_service.webhook_subscriptions s WHERE s.id = d.subscription_id AND s.active)
+		ORDER BY next_attempt_at, id LIMIT $2`
+	return s.queryDeliveries(ctx, query, now, limit)
+}
+
+func (s *PostgresStore) queryDeliveries(ctx context.Context, query string, args ...any) ([]Delivery, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *PostgresStore) Claim(ctx context.Context, id int64, now, until time.Time) (*Outbound, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.webhook_deliveries d SET next_attempt_at = $3
+		FROM notification_service.webhook_subscriptions s
+		WHERE d.id = $1 AND d.tenant_id = $4 AND d.status = 'pending' AND d.next_attempt_at <= $2
+			AND s.id = d.subscription_id AND s.active
+		RETURNING d.id, d.subscription_id, d.event_id, d.event_type, d.status, d.attempts, d.created_at, s.url, s.secret, d.payload`
+	var out Outbound
+	err := s.db.QueryRowContext(ctx, query, id, now, until, tenant.FromContext(ctx)).Scan(&out.ID, &out.SubscriptionID,
+		&out.EventID, &out.EventType, &out.Status, &out.Attempts, &out.CreatedAt, &out.URL, &out.Secret, &out.Payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (s *PostgresStore) RecordAttempt(ctx context.Context, id int64, a *Attempt, status string, next *time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const insert string = `INSERT INTO notification_service.webhook_attempts
+				(delivery_id, attempted_at, status_code, error, response, duration_ms)
+			VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, ''), $5, $6)`
+		if _, err := tx.ExecContext(ctx, insert, id, a.AttemptedAt, a.StatusCode, a.Error, a.Response, a.DurationMS); err != nil {
+			return err
+		}
+		const update string = `UPDATE notification_service.webhook_deliveries
+			SET status = $2, attempts = attempts + 1, next_attempt_at = $3,
+				last_status_code = NULLIF($4, 0), last_error = NULLIF($5, ''),
+				delivered_at = CASE WHEN $2 = 'delivered' THEN $6 ELSE delivered_at END
+			WHERE id = $1`
+		return expectRow(tx.ExecContext(ctx, update, id, status, next, a.StatusCode, a.Error, a.AttemptedAt))
+	})
+}
+
+func (s *PostgresStore) ListDeliveries(ctx context.Context, f DeliveryFilter) ([]Delivery, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + deliveryColumns + ` FROM notification_service.webhook_deliveries
+		WHERE tenant_id = $1 AND subscription_id = $2 AND ($3 = '' OR status = $3) AND ($4 = 0 OR id < $4)
+		ORDER BY id DESC LIMIT $5`
+	return s.queryDeliveries(ctx, query, tenant.FromContext(ctx), f.SubscriptionID, f.Status, f.Before, f.Limit)
+}
+
+func (s *PostgresStore) GetDelivery(ctx context.Context, id int64) (*Delivery, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + deliveryColumns + ` FROM notification_service.webhook_deliveries
+		WHERE id = $1 AND tenant_id = $2`
+	d, err := scanDelivery(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	const attempts string = `SELECT attempted_at, COALESCE(status_code, 0), COALESCE(error, ''), response, duration_ms
+		FROM notification_service.webhook_attempts WHERE delivery_id = $1 ORDER BY attempted_at, id`
+	rows, err := s.db.QueryContext(ctx, attempts, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	d.History = []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		if err := rows.Scan(&a.AttemptedAt, &a.StatusCode, &a.Error, &a.Response, &a.DurationMS); err != nil {
+			return nil, err
+		}
+		d.History = append(d.History, a)
+	}
+	return d, rows.Err()
+}
+
+func (s *PostgresStore) Redeliver(ctx context.Context, id int64) (*Delivery, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE notification_service.webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 AND status <> 'pending' RETURNING ` + deliveryColumns
+	d, err := scanDelivery(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return d, err
+}
@@ -0,0 +1,338 @@
+// Package webhooks delivers events to URLs that external integrators
+// subscribe, so their systems can react to orders, payments and stock
+// changes. Each delivery is signed with the subscription's secret, retried
+// with exponential backoff until the endpoint accepts it or attempts run
+// out, and every attempt is logged with the response it got.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Headers sent with every delivery.
+const (
+	// SignatureHeader carries "t=<unix time>,v1=<hex HMAC-SHA256>" of
+	// "<unix time>.<body>" under the subscription's secret, as Stripe signs
+	// its webhooks, so receivers can reject forged and replayed requests.
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	// DeliveryHeader is the same on every attempt at one delivery, so
+	// receivers can drop repeats.
+	DeliveryHeader = "X-Webhook-Delivery"
+)
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+const (
+	queue = "notification-service.webhooks"
+	// claimLease is how long a claimed delivery is left alone by sweeps, so
+	// a replica that dies mid-attempt only delays it.
+	claimLease = 5 * time.Minute
+	// maxResponseExcerpt is how much of an endpoint's response is logged.
+	maxResponseExcerpt = 512
+)
+
+// Events are the event types integrators may subscribe to.
+var Events = []string{
+	events.OrderPlaced,
+	events.OrderCancelled,
+	events.PaymentSucceeded,
+	events.PaymentFailed,
+	events.InventoryStockChanged,
+	events.InventoryLowStock,
+	events.InventorySKUMerged,
+	events.OrderShipmentDelivered,
+}
+
+func knownEvent(eventType string) bool {
+	for _, e := range Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription sends the tenant's events of the given types to URL. Secret
+// is only shown when it is created or rotated.
+type Subscription struct {
+	ID          int64     `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description,omitempty"`
+	Active      bool      `json:"active"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Delivery is one event on its way to one subscription. NextAttemptAt is
+// set while it is pending. History is only filled in for a single delivery.
+type Delivery struct {
+	ID             int64      `json:"id"`
+	SubscriptionID int64      `json:"subscription_id"`
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	History        []Attempt  `json:"history,omitempty"`
+	Tenant         string     `json:"-"`
+}
+
+// Attempt is one request to the endpoint. StatusCode is 0 when no response
+// came back, and Error says why.
+type Attempt struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+}
+
+// Outbound is a claimed delivery with what it takes to send it.
+type Outbound struct {
+	Delivery
+	URL     string
+	Secret  string
+	Payload []byte
+}
+
+// Sign returns the SignatureHeader value for body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// NewClient returns the client deliveries are sent with. Unless
+// allowPrivate is set it refuses to connect to loopback, private and
+// link-local addresses, so a subscription cannot point the service at its
+// own network.
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = publicOnly
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// A redirect could lead anywhere; receivers must answer themselves.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// publicOnly runs on the resolved address, so hostnames that resolve to a
+// private address are caught as well as literal ones.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// Deliverer sends pending deliveries. Sweep runs as a scheduled job and
+// hands deliveries that are due an attempt to a queue, whose workers send
+// them; new deliveries are queued straight away. A delivery that gets no
+// 2xx response is retried after backoff, doubled for every attempt after
+// the first, and fails for good after maxAttempts.
+type Deliverer struct {
+	store       Store
+	client      *http.Client
+	queue       *jobs.Queue
+	maxAttempts int
+	backoff     time.Duration
+	batchSize   int
+	now         func() time.Time
+}
+
+func NewDeliverer(store Store, client *http.Client, queue *jobs.Queue, maxAttempts int, backoff time.Duration) *Deliverer {
+	return &Deliverer{store: store, client: client, queue: queue, maxAttempts: maxAttempts, backoff: backoff, batchSize: 100, now: time.Now}
+}
+
+// Sweep queues one batch of deliveries due an attempt. Deliveries still
+// queued from an earlier sweep are skipped.
+func (d *Deliverer) Sweep(ctx context.Context) error {
+	due, err := d.store.Due(ctx, d.now(), d.batchSize)
+	if err != nil {
+		return err
+	}
+	queued := 0
+	for _, delivery := range due {
+		if d.Enqueue(delivery) {
+			queued++
+		}
+	}
+	if queued > 0 {
+		log.Printf("Queued %d webhook deliveries", queued)
+	}
+	return nil
+}
+
+// Enqueue queues an attempt at delivery and reports whether it was queued.
+func (d *Deliverer) Enqueue(delivery Delivery) bool {
+	id, tenantID := delivery.ID, delivery.Tenant
+	return d.queue.Enqueue("webhook-"+strconv.FormatInt(id, 10), func(ctx context.Context) error {
+		if tenantID != "" {
+			ctx = tenant.NewContext(ctx, tenantID)
+		}
+		return d.Attempt(ctx, id)
+	})
+}
+
+// Attempt claims the delivery, sends it once and records the outcome. A
+// delivery that is no longer due, or whose subscription was paused, is
+// left alone.
+func (d *Deliverer) Attempt(ctx context.Context, id int64) error {
+	now := d.now()
+	out, err := d.store.Claim(ctx, id, now, now.Add(claimLease))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	a := d.send(ctx, out)
+	status, next := StatusDelivered, (*time.Time)(nil)
+	if a.StatusCode < 200 || a.StatusCode > 299 {
+		status = StatusFailed
+		if attempts := out.Attempts + 1; attempts < d.maxAttempts {
+			status = StatusPending
+			at := a.AttemptedAt.Add(d.backoff << (attempts - 1))
+			next = &at
+		} else {
+			log.Printf("Giving up on webhook delivery %d to subscription %d after %d attempts", out.ID, out.SubscriptionID, attempts)
+		}
+	}
+	return d.store.RecordAttempt(ctx, id, a, status, next)
+}
+
+func (d *Deliverer) send(ctx context.Context, out *Outbound) *Attempt {
+	a := &Attempt{AttemptedAt: d.now()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, out.URL, bytes.NewReader(out.Payload))
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-microserv-webhooks/1")
+	req.Header.Set(EventHeader, out.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(out.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(out.Secret, a.AttemptedAt, out.Payload))
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	a.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	defer resp.Body.Close()
+	excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseExcerpt))
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	a.StatusCode = resp.StatusCode
+	a.Response = string(bytes.ToValidUTF8(excerpt, nil))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		a.Error = "HTTP " + strconv.Itoa(resp.StatusCode)
+	}
+	return a
+}
+
+// Consumer turns events into deliveries for the subscriptions of the
+// event's tenant.
+type Consumer struct {
+	store     Store
+	deliverer *Deliverer
+}
+
+func NewConsumer(store Store, deliverer *Deliverer) *Consumer {
+	return &Consumer{store: store, deliverer: deliverer}
+}
+
+// Run consumes the events in Events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, queue, Events, events.IgnoreReplays(c.Handle))
+}
+
+// Handle drops events that name no tenant rather than guess whose they
+// are, such as stock changes made by jobs sweeping every tenant. A
+// redelivered event adds no deliveries it already made.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	var scope struct {
+		Tenant string `json:"tenant"`
+	}
+	if err := json.Unmarshal(e.Data, &scope); err != nil || scope.Tenant == "" {
+		return nil
+	}
+	ctx = tenant.NewContext(ctx, scope.Tenant)
+
+	subs, err := c.store.Matching(ctx, e.Type)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for _, s := range subs {
+		delivery, created, err := c.store.Enqueue(ctx, s.ID, e, payload)
+		if err != nil {
+			return err
+		}
+		if created && c.deliverer != nil {
+			c.deliverer.Enqueue(*delivery)
+		}
+	}
+	return nil
+}
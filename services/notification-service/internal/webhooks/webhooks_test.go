@@ -0,0 +1,355 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps subscriptions and deliveries in memory, ignoring
+// tenants other than for Matching.
+type memStore struct {
+	Store
+	mu         sync.Mutex
+	subs       []*Subscription
+	tenants    map[int64]string
+	deliveries []*Delivery
+	payloads   map[int64][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{tenants: map[int64]string{}, payloads: map[int64][]byte{}}
+}
+
+func (s *memStore) Create(ctx context.Context, sub *Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub.ID = int64(len(s.subs) + 1)
+	saved := *sub
+	s.subs = append(s.subs, &saved)
+	s.tenants[sub.ID] = tenant.FromContext(ctx)
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context) ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := []Subscription{}
+	for _, sub := range s.subs {
+		subs = append(subs, *sub)
+	}
+	return subs, nil
+}
+
+func (s *memStore) Get(ctx context.Context, id int64) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || int(id) > len(s.subs) {
+		return nil, ErrNotFound
+	}
+	sub := *s.subs[id-1]
+	return &sub, nil
+}
+
+func (s *memStore) SetSecret(ctx context.Context, id int64, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || int(id) > len(s.subs) {
+		return ErrNotFound
+	}
+	s.subs[id-1].Secret = secret
+	return nil
+}
+
+func (s *memStore) Matching(ctx context.Context, eventType string) ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := []Subscription{}
+	for _, sub := range s.subs {
+		if sub.Active && s.tenants[sub.ID] == tenant.FromContext(ctx) && knownIn(sub.Events, eventType) {
+			subs = append(subs, *sub)
+		}
+	}
+	return subs, nil
+}
+
+func knownIn(types []string, t string) bool {
+	for _, e := range types {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memStore) Enqueue(ctx context.Context, subscriptionID int64, e events.Event, payload []byte) (*Delivery, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.deliveries {
+		if d.SubscriptionID == subscriptionID && d.EventID == e.ID {
+			return nil, false, nil
+		}
+	}
+	now := time.Now()
+	d := &Delivery{ID: int64(len(s.deliveries) + 1), SubscriptionID: subscriptionID, EventID: e.ID, EventType: e.Type,
+		Status: StatusPending, NextAttemptAt: &now, Tenant: tenant.FromContext(ctx)}
+	s.deliveries = append(s.deliveries, d)
+	s.payloads[d.ID] = payload
+	copied := *d
+	return &copied, true, nil
+}
+
+func (s *memStore) Due(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := []Delivery{}
+	for _, d := range s.deliveries {
+		if d.Status == StatusPending && !d.NextAttemptAt.After(now) {
+			due = append(due, *d)
+		}
+	}
+	return due, nil
+}
+
+func (s *memStore) Claim(ctx context.Context, id int64, now, until time.Time) (*Outbound, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.deliveries[id-1]
+	if d.Status != StatusPending || d.NextAttemptAt.After(now) {
+		return nil, ErrNotFound
+	}
+	d.NextAttemptAt = &until
+	sub := s.subs[d.SubscriptionID-1]
+	return &Outbound{Delivery: *d, URL: sub.URL, Secret: sub.Secret, Payload: s.payloads[id]}, nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, id int64, a *Attempt, status string, next *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.deliveries[id-1]
+	d.Status, d.NextAttemptAt, d.LastStatusCode, d.LastError = status, next, a.StatusCode, a.Error
+	d.Attempts++
+	d.History = append(d.History, *a)
+	return nil
+}
+
+func (s *memStore) GetDelivery(ctx context.Context, id int64) (*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || int(id) > len(s.deliveries) {
+		return nil, ErrNotFound
+	}
+	d := *s.deliveries[id-1]
+	return &d, nil
+}
+
+func (s *memStore) Redeliver(ctx context.Context, id int64) (*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.deliveries[id-1]
+	now := time.Now()
+	d.Status, d.Attempts, d.NextAttemptAt = StatusPending, 0, &now
+	copied := *d
+	return &copied, nil
+}
+
+func TestSign(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	got := Sign("whsec_test", at, []byte(`{"id":"1"}`))
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(`1700000000.{"id":"1"}`))
+	if want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Fatalf("Expected %s, got: %s", want, got)
+	}
+	if Sign("whsec_test", at, []byte(`{"id":"2"}`)) == got || Sign("whsec_other", at, []byte(`{"id":"1"}`)) == got {
+		t.Error("Expected the signature to depend on the body and the secret")
+	}
+}
+
+func TestPublicOnlyClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	if _, err := NewClient(time.Second, false).Get(server.URL); err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("Expected loopback to be refused, got: %v", err)
+	}
+	resp, err := NewClient(time.Second, true).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected loopback to be allowed when asked, got: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestWebhooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	status := http.StatusInternalServerError
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+		io.WriteString(w, "try later")
+	}))
+	defer receiver.Close()
+
+	store := newMemStore()
+	runner := jobs.New()
+	deliverer := NewDeliverer(store, NewClient(time.Second, true), runner.Queue("webhooks", 1, 10), 2, time.Minute)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 5, Roles: []string{auth.RoleAdmin}})
+	})
+	router.Use(tenant.Middleware())
+	NewHandler(store, deliverer, false).RegisterRoutes(router)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(tenant.Header, "acme")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(http.MethodPost, "/webhooks", `{"url": "`+receiver.URL+`", "events": ["order.placed"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a plain http URL to be refused, got: %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "/webhooks", `{"url": "https://example.com/hook", "events": ["user.logged_in"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an event integrators cannot have to be refused, got: %d", w.Code)
+	}
+	w := serve(http.MethodPost, "/webhooks", `{"url": "https://example.com/hook", "events": ["order.placed", "order.placed"]}`)
+	var sub Subscription
+	if err := json.Unmarshal(w.Body.Bytes(), &sub); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("Expected the subscription to be created, got: %d %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(sub.Secret, "whsec_") || len(sub.Events) != 1 || sub.CreatedBy != "user:5" || !sub.Active {
+		t.Errorf("Expected an active subscription with its secret, got: %+v", sub)
+	}
+	// The handler refuses http URLs, so point the subscription at the test
+	// receiver directly.
+	store.subs[0].URL = receiver.URL
+	store.Create(tenant.NewContext(context.Background(), "other"), &Subscription{URL: receiver.URL, Events: []string{events.OrderPlaced}, Active: true})
+
+	consumer := NewConsumer(store, nil)
+	e, _ := events.New(events.OrderPlaced, "order-service", events.OrderPlacement{OrderID: 9, Tenant: "acme"})
+	for i := 0; i < 2; i++ {
+		if err := consumer.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if len(store.deliveries) != 1 || store.deliveries[0].SubscriptionID != sub.ID {
+		t.Fatalf("Expected one delivery to the tenant's subscription, got: %+v", store.deliveries)
+	}
+
+	ctx := tenant.NewContext(context.Background(), "acme")
+	if err := deliverer.Attempt(ctx, 1); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	d := store.deliveries[0]
+	if d.Status != StatusPending || d.Attempts != 1 || d.LastStatusCode != 500 || d.NextAttemptAt.Sub(d.History[0].AttemptedAt) != time.Minute {
+		t.Fatalf("Expected the failed attempt to be retried a minute later, got: %+v", d)
+	}
+	r := received[0]
+	if r.Header.Get(EventHeader) != events.OrderPlaced || r.Header.Get(DeliveryHeader) != "1" {
+		t.Errorf("Expected the event and delivery headers, got: %v", r.Header)
+	}
+	if r.Header.Get(SignatureHeader) != Sign(sub.Secret, d.History[0].AttemptedAt, bodies[0]) {
+		t.Errorf("Expected the body to be signed with the subscription's secret, got: %s", r.Header.Get(SignatureHeader))
+	}
+	var sent events.Event
+	if err := json.Unmarshal(bodies[0], &sent); err != nil || sent.ID != e.ID {
+		t.Errorf("Expected the event envelope as the body, got: %s", bodies[0])
+	}
+	if err := deliverer.Attempt(ctx, 1); err != nil || len(received) != 1 {
+		t.Errorf("Expected a delivery that is not due yet to be left alone, got: %v, %d requests", err, len(received))
+	}
+
+	*d.NextAttemptAt = time.Now()
+	deliverer.Attempt(ctx, 1)
+	if d.Status != StatusFailed || d.Attempts != 2 || d.NextAttemptAt != nil {
+		t.Fatalf("Expected the delivery to fail after its last attempt, got: %+v", d)
+	}
+
+	w = serve(http.MethodGet, "/webhooks/1/deliveries/1", "")
+	var logged Delivery
+	if err := json.Unmarshal(w.Body.Bytes(), &logged); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the delivery log, got: %d %s", w.Code, w.Body)
+	}
+	if len(logged.History) != 2 || logged.History[1].StatusCode != 500 || logged.History[1].Response != "try later" {
+		t.Errorf("Expected both attempts with their responses, got: %+v", logged.History)
+	}
+
+	status = http.StatusNoContent
+	runner.Start(ctx)
+	defer runner.Stop(context.Background())
+	if w := serve(http.MethodPost, "/webhooks/1/deliveries/1/redeliver", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the redelivery to be queued, got: %d %s", w.Code, w.Body)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := store.GetDelivery(ctx, 1)
+		if got.Status == StatusDelivered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the redelivery to be delivered, got: %+v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDevelopersManageTheirOwnSubscriptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newMemStore()
+	ctx := tenant.NewContext(context.Background(), "acme")
+	store.Create(ctx, &Subscription{URL: "https://example.com/admin", Events: []string{events.OrderPlaced}, CreatedBy: "user:5"})
+	store.Create(ctx, &Subscription{URL: "https://example.com/mine", Events: []string{events.OrderPlaced}, CreatedBy: "user:7"})
+
+	serve := func(p *auth.Principal, method, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, nil, false).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	developer := &auth.Principal{UserID: 7, Roles: []string{auth.RoleDeveloper}}
+	admin := &auth.Principal{UserID: 5, Roles: []string{auth.RoleAdmin}}
+
+	w := serve(developer, http.MethodGet, "/webhooks")
+	var listed struct {
+		Subscriptions []Subscription `json:"subscriptions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed.Subscriptions) != 1 || listed.Subscriptions[0].ID != 2 {
+		t.Errorf("Expected the developer to see only their subscription, got: %d %s", w.Code, w.Body)
+	}
+	if w := serve(developer, http.MethodPost, "/webhooks/1/rotate-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another's subscription to be hidden, got: %d", w.Code)
+	}
+	if w := serve(developer, http.MethodPost, "/webhooks/2/rotate-secret"); w.Code != http.StatusOK {
+		t.Errorf("Expected the developer to rotate their own secret, got: %d %s", w.Code, w.Body)
+	}
+	if w := serve(admin, http.MethodGet, "/webhooks/2"); w.Code != http.StatusOK {
+		t.Errorf("Expected admins to see every subscription, got: %d", w.Code)
+	}
+	if w := serve(&auth.Principal{UserID: 8, Roles: []string{auth.RoleCustomer}}, http.MethodGet, "/webhooks"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be refused, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,127 @@
+// Package winback emails customers who cancelled an order, for the
+// cancellation reasons a campaign is running for.
+package winback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+const queue = "notification-service.win-back"
+
+// Directory looks up the customer to email.
+type Directory interface {
+	GetUser(ctx context.Context, id int) (*clients.User, error)
+}
+
+var _ Directory = (*clients.UserClient)(nil)
+
+type message struct {
+	subject string
+	body    string
+}
+
+// messages are the campaigns by order-service cancellation reason. A reason
+// without one gets the generic message.
+var messages = map[string]message{
+	"found_cheaper": {
+		subject: "We'd like another chance at your order",
+		body:    "You cancelled order #%d because you found it cheaper elsewhere. Reply to this email with the lower price and we'll do our best to match it.",
+	},
+	"delivery_too_slow": {
+		subject: "Faster delivery on your next order",
+		body:    "You cancelled order #%d because delivery would have taken too long. Reply to this email and we'll look for a faster way to get it to you.",
+	},
+	"changed_mind": {
+		subject: "Still thinking it over?",
+		body:    "You cancelled order #%d. If you change your mind again, everything you picked is still in stock.",
+	},
+}
+
+var generic = message{
+	subject: "Sorry to see your order go",
+	body:    "You cancelled order #%d. If something went wrong, reply to this email and tell us what we could do better.",
+}
+
+type Consumer struct {
+	dispatcher *notifications.Dispatcher
+	directory  Directory
+	reasons    map[string]bool
+}
+
+// NewConsumer runs the campaign for the listed reasons only.
+func NewConsumer(dispatcher *notifications.Dispatcher, directory Directory, reasons []string) *Consumer {
+	c := &Consumer{dispatcher: dispatcher, directory: directory, reasons: map[string]bool{}}
+	for _, r := range reasons {
+		if r = strings.TrimSpace(r); r != "" {
+			c.reasons[r] = true
+		}
+	}
+	return c
+}
+
+// Run consumes cancellation events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, queue, []string{events.OrderCancelled}, events.IgnoreReplays(c.Handle))
+}
+
+// Handle skips reasons without a campaign and customers who no longer
+// exist. A failed lookup is retried by returning the error.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	if e.Type != events.OrderCancelled {
+		return nil
+	}
+	var payload events.OrderCancellation
+	if err := e.Decode(&payload); err != nil {
+		return err
+	}
+	if !c.reasons[payload.Reason] {
+		return nil
+	}
+	if payload.Tenant != "" {
+		ctx = tenant.NewContext(ctx, payload.Tenant)
+	}
+	user, err := c.directory.GetUser(ctx, payload.UserID)
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		log.Printf("Win-back for order %d skipped: user %d not found", payload.OrderID, payload.UserID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("look up user %d: %w", payload.UserID, err)
+	}
+	if user.Email == "" {
+		log.Printf("Win-back for order %d skipped: user %d has no email", payload.OrderID, payload.UserID)
+		return nil
+	}
+	return c.dispatcher.Dispatch(ctx, winBack(payload, user.Email))
+}
+
+func winBack(p events.OrderCancellation, email string) *notifications.Notification {
+	m, ok := messages[p.Reason]
+	if !ok {
+		m = generic
+	}
+	userID := p.UserID
+	return &notifications.Notification{Notification: models.Notification{
+		UserID:      &userID,
+		Recipient:   email,
+		Channel:     "email",
+		Type:        notifications.TypeWinBack,
+		Subject:     m.subject,
+		Body:        fmt.Sprintf(m.body, p.OrderID),
+		ContextType: "order",
+		ContextID:   strconv.Itoa(p.OrderID),
+	}}
+}
@@ -0,0 +1,111 @@
+package winback
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/notification-service/internal/notifications"
+)
+
+type memStore struct {
+	notifications.Store
+	created []notifications.Notification
+}
+
+func (s *memStore) Create(ctx context.Context, n *notifications.Notification) error {
+	n.ID = len(s.created) + 1
+	s.created = append(s.created, *n)
+	return nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, id int, a notifications.Attempt) error {
+	s.created[id-1].Status = a.Status
+	return nil
+}
+
+type directory struct {
+	users  map[int]*clients.User
+	tenant string
+	err    error
+}
+
+func (d *directory) GetUser(ctx context.Context, id int) (*clients.User, error) {
+	d.tenant = tenant.FromContext(ctx)
+	if d.err != nil {
+		return nil, d.err
+	}
+	u, ok := d.users[id]
+	if !ok {
+		return nil, &clients.APIError{StatusCode: http.StatusNotFound, Message: "user not found"}
+	}
+	return u, nil
+}
+
+func cancellation(t *testing.T, userID int, reason string) events.Event {
+	e, err := events.New(events.OrderCancelled, "order-service", events.OrderCancellation{
+		OrderID: 42, UserID: userID, Tenant: "acme", Reason: reason, CustomerTier: "returning", SKUs: []string{"SKU-001"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	return e
+}
+
+func TestHandleSendsWinBack(t *testing.T) {
+	store := &memStore{}
+	dir := &directory{users: map[int]*clients.User{7: {ID: 7, Email: "ada@example.com"}}}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, ""), dir,
+		[]string{"found_cheaper", " delivery_too_slow"})
+
+	for _, reason := range []string{"ordered_by_mistake", "other"} {
+		if err := consumer.Handle(context.Background(), cancellation(t, 7, reason)); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if len(store.created) != 0 {
+		t.Fatalf("Expected reasons without a campaign to be skipped, got: %d notifications", len(store.created))
+	}
+
+	if err := consumer.Handle(context.Background(), cancellation(t, 7, "found_cheaper")); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := consumer.Handle(context.Background(), cancellation(t, 7, "delivery_too_slow")); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(store.created) != 2 {
+		t.Fatalf("Expected 2 notifications, got: %d", len(store.created))
+	}
+	n := store.created[0]
+	if n.Recipient != "ada@example.com" || *n.UserID != 7 || n.ContextType != "order" || n.ContextID != "42" {
+		t.Errorf("Expected a win-back to user 7 about order 42, got: %+v", n)
+	}
+	if !strings.Contains(n.Body, "order #42") || !strings.Contains(n.Body, "match") {
+		t.Errorf("Expected the price match offer, got: %s", n.Body)
+	}
+	if dir.tenant != "acme" {
+		t.Errorf("Expected the user to be looked up in the order's tenant, got: %q", dir.tenant)
+	}
+}
+
+func TestHandleLookupFailures(t *testing.T) {
+	store := &memStore{}
+	dir := &directory{users: map[int]*clients.User{}}
+	consumer := NewConsumer(notifications.NewDispatcher(store, notifications.LogSender{}, events.LogPublisher{}, nil, nil, nil, ""), dir, []string{"found_cheaper"})
+
+	if err := consumer.Handle(context.Background(), cancellation(t, 8, "found_cheaper")); err != nil {
+		t.Errorf("Expected a deleted user to be skipped, got: %v", err)
+	}
+	dir.err = errors.New("connection refused")
+	if err := consumer.Handle(context.Background(), cancellation(t, 8, "found_cheaper")); err == nil {
+		t.Error("Expected a failed lookup to be retried")
+	}
+	if len(store.created) != 0 {
+		t.Errorf("Expected no notifications, got: %d", len(store.created))
+	}
+}
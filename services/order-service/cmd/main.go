@@ -1,22 +1,303 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"log"
-	"net/http"
+	"time"
 
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+	"github.com/alux444/go-microserv-test/pkg/flags"
+	"github.com/alux444/go-microserv-test/pkg/idempotency"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/redis"
+	"github.com/alux444/go-microserv-test/pkg/service"
+	"github.com/alux444/go-microserv-test/pkg/startup"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/order-service/api"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/fulfillment"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/messages"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/orders"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/projections"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/reports"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/shipments"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/shipping"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/tracking"
 	"github.com/gin-gonic/gin"
 )
 
+func setupRouter(db *sql.DB, stock *orders.StockCache, products orders.ProductSource, pricing *orders.Pricing, promises *orders.Promises,
+	backInStock *orders.BackInStock, reservations *orders.Reservations, refunds *orders.Refunds, quotes *orders.Quotes, carts orders.CartStore, quoter *shipping.Quoter, warehouse *fulfillment.Worker, salesReports *reports.Worker, tokens *auth.Tokens, keys idempotency.Store, featureFlags *flags.Flags, publisher events.Publisher) *service.Router {
+	router := service.NewRouter(service.Config{
+		Name:            "order-service",
+		DB:              db,
+		Tokens:          tokens,
+		Spec:            api.Spec,
+		Messages:        messages.Files,
+		AuditLog:        "order_service.audit_log",
+		Middleware:      []gin.HandlerFunc{featureFlags.Middleware(), idempotency.Middleware(keys, idempotencyTTL())},
+		AdminMiddleware: []gin.HandlerFunc{tenant.Middleware(), idempotency.Middleware(keys, idempotencyTTL())},
+	})
+
+	userClient := clients.NewUserClient(config.GetEnv("USER_SERVICE_URL", "http://user-service:50054"),
+		auth.NewServiceClient(tokens, "order-service", "user-service"))
+	notificationClient := clients.NewNotificationClient(config.GetEnv("NOTIFICATION_SERVICE_URL", "http://notification-service:50052"),
+		auth.NewServiceClient(tokens, "order-service", "notification-service"))
+
+	store := orders.NewPostgresStore(db)
+	approvals := orders.NewApprovals(store, userClient, notificationClient,
+		int64(config.GetInt("ORDER_APPROVAL_THRESHOLD_CENTS", 100000)))
+	duplicates, err := orders.NewDuplicates(
+		config.GetEnv("ORDER_DUPLICATE_MODE", orders.DuplicatesWarn),
+		config.GetDuration("ORDER_DUPLICATE_WINDOW", 10*time.Minute))
+	if err != nil {
+		log.Fatalf("Invalid duplicate order config: %v", err)
+	}
+	var emails *orders.EmailPolicy
+	if config.GetEnv("ORDER_REQUIRE_VERIFIED_EMAIL", "false") == "true" {
+		emails = orders.NewEmailPolicy(userClient)
+	}
+	handler := orders.NewHandler(store, approvals, duplicates, stock, products, pricing, promises, backInStock, reservations, refunds, emails, quotes, publisher)
+	handler.RegisterRoutes(router)
+	orders.NewCartHandler(carts, handler).RegisterRoutes(router)
+
+	handler.RegisterAdminRoutes(router.Admin)
+	if quoter != nil {
+		shipping.NewHandler(quoter).RegisterRoutes(router)
+	}
+	fulfillment.NewHandler(fulfillment.NewPostgresStore(db), warehouse).RegisterRoutes(router)
+	webhookSecret := config.GetEnv("SHIPMENT_WEBHOOK_SECRET", "")
+	if webhookSecret == "" {
+		log.Println("SHIPMENT_WEBHOOK_SECRET not set, carrier tracking webhooks are disabled")
+	}
+	shipments.NewHandler(shipments.NewPostgresStore(db), publisher, webhookSecret).RegisterRoutes(router)
+	projections.NewHandler(projections.NewPostgresStore(db)).RegisterRoutes(router)
+	reports.NewHandler(reports.NewPostgresStore(db), salesReports, config.GetInt("REPORT_SYNC_DAYS", 31)).RegisterRoutes(router)
+	flags.NewHandler(featureFlags).RegisterAdminRoutes(router.Admin)
+
+	return router
+}
+
+func idempotencyTTL() time.Duration {
+	return config.GetDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+}
+
 func main() {
-	router := gin.Default()
+	ctx, stop := service.Init("order-service")
+	defer stop()
 
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "healthy",
-			"service": "order-service",
-		})
-	})
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	log.Println("Connected to db successfully")
+
+	tokens := service.Tokens("order-service")
+
+	keys := idempotency.NewPostgresStore(db, "order_service.idempotency_keys")
+	go idempotency.Purger(context.Background(), keys, idempotencyTTL(), time.Hour)
+
+	publisher, subscriber, closeEvents := schema.Connect(config.GetEnv("RABBITMQ_URL", ""), "events")
+	defer closeEvents()
+
+	inventoryClient := clients.NewInventoryClient(config.GetEnv("INVENTORY_SERVICE_URL", "http://inventory-service:50051"),
+		auth.NewServiceClient(tokens, "order-service", "inventory-service"))
+	// Orders are always priced from the catalog, never from the client.
+	var products orders.ProductSource = inventoryClient
+	var stock *orders.StockCache
+	if config.GetEnv("ORDER_STOCK_CHECK", "true") == "true" {
+		stock = orders.NewStockCache(inventoryClient, config.GetDuration("STOCK_CACHE_MAX_TTL", time.Minute))
+		if subscriber != nil {
+			go func() {
+				if err := stock.Run(context.Background(), subscriber); err != nil {
+					log.Printf("Stock cache consumer stopped: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Orders reserve their stock when placed, so it cannot be sold twice
+	// while they wait on payment.
+	var reservations *orders.Reservations
+	if config.GetEnv("ORDER_STOCK_RESERVATION", "true") == "true" {
+		reservations = orders.NewReservations(orders.NewPostgresStore(db), inventoryClient, publisher,
+			config.GetDuration("ORDER_RESERVATION_TTL", 30*time.Minute))
+		if subscriber != nil {
+			go func() {
+				if err := reservations.Run(context.Background(), subscriber); err != nil {
+					log.Printf("Reservation expiry consumer stopped: %v", err)
+				}
+			}()
+		}
+	}
+
+	fiscalYear, err := orders.NewFiscalYear(config.GetInt("ORDER_FISCAL_YEAR_START", 1))
+	if err != nil {
+		log.Fatalf("Invalid ORDER_FISCAL_YEAR_START: %v", err)
+	}
+	if subscriber != nil {
+		go func() {
+			if err := orders.NewPaymentConsumer(orders.NewPostgresStore(db), fiscalYear, reservations).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Payment consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			if err := orders.NewSKUMergeConsumer(orders.NewPostgresStore(db)).Run(context.Background(), subscriber); err != nil {
+				log.Printf("SKU merge consumer stopped: %v", err)
+			}
+		}()
+	}
+
+	carriers, err := orders.ParseCarriers(config.GetEnv("ORDER_CARRIER_SLAS", "standard=3,express=1"))
+	if err != nil {
+		log.Fatalf("Invalid ORDER_CARRIER_SLAS: %v", err)
+	}
+	promises, err := orders.NewPromises(config.GetEnv("ORDER_WAREHOUSE_LOCATION", "UTC"), config.GetEnv("ORDER_SHIP_CUTOFF", "14:00"), carriers)
+	if err != nil {
+		log.Fatalf("Invalid delivery promise config: %v", err)
+	}
+	var quoter *shipping.Quoter
+	if spec := config.GetEnv("ORDER_SHIPPING_RATES", "standard=499+99,express=1299+199"); spec != "" {
+		rates, err := shipping.ParseRates(spec)
+		if err != nil {
+			log.Fatalf("Invalid ORDER_SHIPPING_RATES: %v", err)
+		}
+		quoter, err = shipping.NewQuoter(inventoryClient, rates, config.GetInt("ORDER_DIM_WEIGHT_DIVISOR", shipping.DefaultDivisor))
+		if err != nil {
+			log.Fatalf("Invalid shipping quote config: %v", err)
+		}
+	}
+	var tax orders.TaxCalculator
+	if spec := config.GetEnv("ORDER_TAX_RATES", ""); spec != "" {
+		rates, err := orders.ParseTaxRates(spec)
+		if err != nil {
+			log.Fatalf("Invalid ORDER_TAX_RATES: %v", err)
+		}
+		tax = rates
+	}
+	var shippingCharges orders.ShippingQuoter
+	if config.GetEnv("ORDER_CHARGE_SHIPPING", "false") == "true" {
+		if quoter == nil {
+			log.Fatal("ORDER_CHARGE_SHIPPING needs ORDER_SHIPPING_RATES")
+		}
+		shippingCharges = quoter
+	}
+	pricing, err := orders.NewPricing(config.GetEnv("ORDER_CURRENCY", orders.DefaultCurrency), tax, shippingCharges)
+	if err != nil {
+		log.Fatalf("Invalid ORDER_CURRENCY: %v", err)
+	}
+	// Quotes hold an order to the prices a cart showed until it is placed.
+	var quotes *orders.Quotes
+	if secret := config.GetEnv("ORDER_QUOTE_SECRET", ""); secret != "" {
+		quotes = orders.NewQuotes(secret, config.GetDuration("ORDER_QUOTE_TTL", 15*time.Minute))
+	} else {
+		log.Println("ORDER_QUOTE_SECRET not set, order quotes are disabled")
+	}
+	var carts orders.CartStore
+	cartTTL := config.GetDuration("CART_TTL", 7*24*time.Hour)
+	if client := redis.FromEnv(); client != nil {
+		carts = orders.NewRedisCartStore(client, cartTTL)
+	} else {
+		log.Println("REDIS_HOST not set, carts are kept in memory on each replica")
+		carts = orders.NewMemoryCartStore(cartTTL)
+	}
+	runner := jobs.New()
+	userClient := clients.NewUserClient(config.GetEnv("USER_SERVICE_URL", "http://user-service:50054"),
+		auth.NewServiceClient(tokens, "order-service", "user-service"))
+	notificationClient := clients.NewNotificationClient(config.GetEnv("NOTIFICATION_SERVICE_URL", "http://notification-service:50052"),
+		auth.NewServiceClient(tokens, "order-service", "notification-service"))
+	backInStock := orders.NewBackInStock(orders.NewPostgresStore(db), inventoryClient, userClient, notificationClient,
+		config.GetDuration("BACK_IN_STOCK_HOLD", 30*time.Minute))
+	// Paid orders are cancelled as a saga: the refund is taken last, and
+	// the cancellation and restock are undone if it fails.
+	var restocker orders.Restocker
+	if reservations != nil {
+		restocker = inventoryClient
+	}
+	refunds := orders.NewRefunds(orders.NewPostgresStore(db),
+		clients.NewPaymentClient(config.GetEnv("PAYMENT_SERVICE_URL", "http://payment-service:50055"),
+			auth.NewServiceClient(tokens, "order-service", "payment-service")),
+		restocker, userClient, notificationClient)
+	if subscriber != nil {
+		go func() {
+			if err := backInStock.Run(context.Background(), subscriber); err != nil {
+				log.Printf("Back-in-stock consumer stopped: %v", err)
+			}
+		}()
+	}
+	runner.Schedule("back-in-stock-holds", jobs.Every(time.Minute), backInStock.Job())
+	runner.Schedule("delivery-promise-risk", jobs.Every(config.GetDuration("ORDER_PROMISE_CHECK_INTERVAL", 15*time.Minute)),
+		orders.NewPromiseMonitor(orders.NewPostgresStore(db), publisher, config.GetDuration("ORDER_PROMISE_RISK_WINDOW", 2*time.Hour)).Job())
+	warehouse := fulfillment.NewWorker(fulfillment.NewPostgresStore(db), inventoryClient,
+		runner.Queue("fulfillment", config.GetInt("FULFILLMENT_WORKERS", 2), 100))
+	runner.Schedule("fulfillment-sweep", jobs.Every(config.GetDuration("FULFILLMENT_SWEEP_INTERVAL", time.Minute)), warehouse.Sweep)
+	runner.Schedule("order-projections", jobs.Every(config.GetDuration("ORDER_PROJECTION_INTERVAL", time.Minute)),
+		projections.NewProjector(projections.NewPostgresStore(db), 1000).Job())
+	salesReports := reports.NewWorker(reports.NewPostgresStore(db), runner.Queue("reports", config.GetInt("REPORT_WORKERS", 1), 20),
+		config.GetDuration("REPORT_TIMEOUT", 5*time.Minute), config.GetDuration("REPORT_RETENTION", 24*time.Hour))
+	runner.Schedule("report-sweep", jobs.Every(time.Minute), salesReports.Sweep)
+	// Completed orders leave the hot tables once they have not changed for
+	// ORDER_ARCHIVE_AFTER_MONTHS; 0 keeps them there.
+	if months := config.GetInt("ORDER_ARCHIVE_AFTER_MONTHS", 12); months > 0 {
+		runner.Schedule("order-archive", jobs.Every(config.GetDuration("ORDER_ARCHIVE_INTERVAL", time.Hour)),
+			orders.NewArchiver(orders.NewPostgresStore(db), months, 500).Job())
+	}
+	runner.Start(ctx)
+
+	selfCheck := startup.New("order-service",
+		startup.Env("JWT_SECRET"),
+		startup.Config(startup.Duration("JWT_TTL"), startup.Duration("IDEMPOTENCY_TTL"), startup.Int("ORDER_APPROVAL_THRESHOLD_CENTS"),
+			startup.Bytes("MAX_REQUEST_BODY"), startup.Duration("MAINTENANCE_RETRY_AFTER"),
+			startup.Duration("ORDER_DUPLICATE_WINDOW"), startup.Duration("STOCK_CACHE_MAX_TTL"), startup.Int("ORDER_FISCAL_YEAR_START"),
+			startup.Duration("FEATURE_FLAGS_REFRESH_INTERVAL"), startup.Duration("ORDER_PROMISE_CHECK_INTERVAL"), startup.Duration("ORDER_PROMISE_RISK_WINDOW"),
+			startup.Duration("BACK_IN_STOCK_HOLD"), startup.Int("ORDER_DIM_WEIGHT_DIVISOR"), startup.Int("FULFILLMENT_WORKERS"),
+			startup.Duration("FULFILLMENT_SWEEP_INTERVAL"), startup.Duration("CART_TTL"), startup.Duration("SHUTDOWN_TIMEOUT"),
+			startup.Duration("ORDER_TRACKING_TTL"), startup.Duration("ORDER_RESERVATION_TTL"), startup.Duration("ORDER_QUOTE_TTL"),
+			startup.Duration("ORDER_PROJECTION_INTERVAL"), startup.Int("REPORT_SYNC_DAYS"), startup.Int("REPORT_WORKERS"),
+			startup.Duration("REPORT_TIMEOUT"), startup.Duration("REPORT_RETENTION"),
+			startup.Int("ORDER_ARCHIVE_AFTER_MONTHS"), startup.Duration("ORDER_ARCHIVE_INTERVAL")),
+		startup.Tables(db, "order_service.orders", "order_service.order_items", "order_service.org_approval_policies",
+			"order_service.order_approvals", "order_service.order_status_history", "order_service.idempotency_keys", "order_service.saved_views",
+			"order_service.invoice_sequences", "order_service.order_cancellations", "order_service.delivery_promises",
+			"order_service.wishlist_items", "order_service.pick_lines", "order_service.fulfillment_documents", "order_service.audit_log",
+			"order_service.tracking_links", "order_service.order_reservations", "order_service.shipments",
+			"order_service.shipment_lines", "order_service.shipment_events",
+			"order_service.projection_generations", "order_service.report_jobs",
+			"order_service.orders_archive", "order_service.order_items_archive", "order_service.order_status_history_archive"),
+		startup.Service("user-service", config.GetEnv("USER_SERVICE_URL", "http://user-service:50054")),
+		startup.Service("notification-service", config.GetEnv("NOTIFICATION_SERVICE_URL", "http://notification-service:50052")),
+		startup.Service("inventory-service", config.GetEnv("INVENTORY_SERVICE_URL", "http://inventory-service:50051")),
+		startup.Service("payment-service", config.GetEnv("PAYMENT_SERVICE_URL", "http://payment-service:50055")),
+		startup.Broker(publisher, config.GetEnv("RABBITMQ_URL", "")),
+	)
+	go selfCheck.Run(context.Background())
+
+	featureFlags, err := flags.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid feature flags: %v", err)
+	}
+	if err := featureFlags.Refresh(context.Background()); err != nil {
+		log.Printf("Failed to load runtime feature flags, using the defaults: %v", err)
+	}
+	go featureFlags.Run(context.Background(), config.GetDuration("FEATURE_FLAGS_REFRESH_INTERVAL", 10*time.Second))
+
+	router := setupRouter(db, stock, products, pricing, promises, backInStock, reservations, refunds, quotes, carts, quoter, warehouse, salesReports, tokens, keys, featureFlags, publisher)
+	router.Saturation.AddJobs(runner.Metrics())
+	router.GET("/health/startup-report", selfCheck.Handler())
+	router.GET("/metrics/jobs", runner.Handler())
+	if secret := config.GetEnv("ORDER_TRACKING_SECRET", ""); secret != "" {
+		links := tracking.NewLinks(tracking.NewPostgresStore(db), secret,
+			config.GetEnv("ORDER_TRACKING_URL", "http://localhost:8080/api/track"), config.GetDuration("ORDER_TRACKING_TTL", 90*24*time.Hour))
+		tracking.NewHandler(links).RegisterRoutes(router)
+	} else {
+		log.Println("ORDER_TRACKING_SECRET not set, order tracking links are disabled")
+	}
 
-	log.Println("Order service starting on :50053")
-	router.Run(":50053")
+	service.Serve(ctx, "order-service", ":50053", router, runner.Stop)
 }
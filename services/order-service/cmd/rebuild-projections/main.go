@@ -0,0 +1,107 @@
+// Command rebuild-projections rebuilds order-service's read models by
+// replaying the order event stream into a new generation of each, then
+// swapping it in for the live one. It can be stopped at any point: the next
+// run resumes the half-built generation from its checkpoint, and the live
+// generation keeps serving until the swap.
+//
+//	rebuild-projections [-projection name] [-batch n] [-restart] [-no-swap] [-list]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/service"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/projections"
+)
+
+func main() {
+	name := flag.String("projection", "", "rebuild only this projection")
+	batch := flag.Int("batch", 1000, "events applied per transaction")
+	restart := flag.Bool("restart", false, "discard a half-built generation instead of resuming it")
+	noSwap := flag.Bool("no-swap", false, "build the new generation but leave the live one serving")
+	list := flag.Bool("list", false, "list generations and exit")
+	flag.Parse()
+
+	ctx, stop := service.Init("rebuild-projections")
+	defer stop()
+
+	targets := projections.All()
+	if *name != "" {
+		p, err := projections.Find(*name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets = []projections.Projection{p}
+	}
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	store := projections.NewPostgresStore(db)
+
+	if *list {
+		for _, p := range targets {
+			if err := printGenerations(ctx, store, p); err != nil {
+				log.Fatalf("Failed to list %s: %v", p.Name(), err)
+			}
+		}
+		return
+	}
+
+	projector := projections.NewProjector(store, *batch)
+	for _, p := range targets {
+		g, err := projector.Rebuild(ctx, p, projections.RebuildOptions{Restart: *restart, NoSwap: *noSwap, Progress: progress()})
+		if err != nil {
+			log.Fatalf("Failed to rebuild %s: %v (run again to resume from the last checkpoint)", p.Name(), err)
+		}
+		if *noSwap {
+			fmt.Printf("%s generation %d built up to event %d; run again without -no-swap to make it live\n", p.Name(), g.Number, g.LastEventID)
+			continue
+		}
+		fmt.Printf("%s generation %d is live, up to event %d\n", p.Name(), g.Number, g.LastEventID)
+	}
+}
+
+// progress prints how far a replay has got, at most once a second and
+// after its last batch.
+func progress() func(projections.Progress) {
+	var printed time.Time
+	return func(p projections.Progress) {
+		if time.Since(printed) < time.Second && p.Applied < p.Total {
+			return
+		}
+		printed = time.Now()
+		percent := 100.0
+		if p.Total > 0 {
+			percent = float64(p.Applied) / float64(p.Total) * 100
+		}
+		rate := 0.0
+		if p.Elapsed > 0 {
+			rate = float64(p.Applied) / p.Elapsed.Seconds()
+		}
+		fmt.Printf("%s generation %d: %d/%d events (%.1f%%), %.0f events/s, last event %d\n",
+			p.Generation.Projection, p.Generation.Number, p.Applied, p.Total, percent, rate, p.Generation.LastEventID)
+	}
+}
+
+func printGenerations(ctx context.Context, store *projections.PostgresStore, p projections.Projection) error {
+	gens, err := store.List(ctx, p.Name())
+	if err != nil {
+		return err
+	}
+	if len(gens) == 0 {
+		fmt.Printf("%s: never built\n", p.Name())
+	}
+	for _, g := range gens {
+		fmt.Printf("%s generation %d: %s, up to event %d, started %s, updated %s\n",
+			g.Projection, g.Number, g.State, g.LastEventID, g.StartedAt.Format(time.RFC3339), g.UpdatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package fulfillment
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// orderHeading names the order as printed on both documents.
+func orderHeading(o *Order) string {
+	heading := "Order " + strconv.Itoa(o.ID)
+	if o.InvoiceNumber != "" {
+		heading += "  Invoice " + o.InvoiceNumber
+	}
+	return heading + "  Placed " + o.CreatedAt.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// renderPickList prints lines, in walking order, under a heading per zone,
+// with a box to tick per line.
+func renderPickList(o *Order, lines []Line) []byte {
+	text := []string{orderHeading(o), fmt.Sprintf("%d lines", len(lines))}
+	zone := ""
+	for _, l := range lines {
+		if l.Zone != zone {
+			zone = l.Zone
+			text = append(text, "", "ZONE "+zone, fmt.Sprintf("    %-12s %-16s %-24s %-8s %s", "BIN", "SKU", "ITEM", "UNIT", "QTY"))
+		}
+		text = append(text, fmt.Sprintf("[ ] %-12s %-16s %-24s %-8s %d", l.Bin, l.SKU, truncate(l.Name, 24), l.Unit, l.Quantity))
+	}
+	return renderPDF("PICK LIST", text)
+}
+
+// renderPackingSlip prints what goes in the parcel: the quantity ordered
+// and, once a line is short, what was found of it.
+func renderPackingSlip(o *Order, lines []Line) []byte {
+	text := []string{orderHeading(o), "", fmt.Sprintf("%-16s %-28s %-8s %8s %8s", "SKU", "ITEM", "UNIT", "ORDERED", "PACKED")}
+	short := 0
+	for _, l := range lines {
+		packed := l.Quantity
+		if l.Status == LineShort {
+			packed = l.PickedQuantity
+			short++
+		}
+		text = append(text, fmt.Sprintf("%-16s %-28s %-8s %8d %8d", l.SKU, truncate(l.Name, 28), l.Unit, l.Quantity, packed))
+	}
+	if short > 0 {
+		text = append(text, "", fmt.Sprintf("%d of %d lines could not be packed in full.", short, len(lines)))
+	}
+	return renderPDF("PACKING SLIP", text)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "~"
+}
@@ -0,0 +1,375 @@
+package fulfillment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore holds one tenant's orders, all paid.
+type memStore struct {
+	mu       sync.Mutex
+	orders   map[int]*Order
+	lines    map[int][]Line
+	docs     map[int]map[string]Document
+	reported int
+	nextID   int64
+}
+
+func newMemStore(orders ...*Order) *memStore {
+	s := &memStore{orders: map[int]*Order{}, lines: map[int][]Line{}, docs: map[int]map[string]Document{}}
+	for _, o := range orders {
+		s.orders[o.ID] = o
+	}
+	return s
+}
+
+func (s *memStore) Unprepared(ctx context.Context, limit int) ([]Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := []Order{}
+	for id, o := range s.orders {
+		if s.lines[id] == nil {
+			found = append(found, *o)
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) Get(ctx context.Context, orderID int) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[orderID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return o, nil
+}
+
+func (s *memStore) Save(ctx context.Context, orderID int, lines []Line, docs []Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lines[orderID] != nil {
+		return ErrInvalidState
+	}
+	for i := range lines {
+		s.nextID++
+		lines[i].ID, lines[i].OrderID, lines[i].Tenant = s.nextID, orderID, tenant.FromContext(ctx)
+	}
+	s.lines[orderID] = lines
+	s.docs[orderID] = map[string]Document{}
+	for _, d := range docs {
+		s.docs[orderID][d.Kind] = d
+	}
+	return nil
+}
+
+func (s *memStore) Lines(ctx context.Context, orderID int) ([]Line, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lines[orderID] == nil {
+		return nil, ErrNotFound
+	}
+	return append([]Line(nil), s.lines[orderID]...), nil
+}
+
+func (s *memStore) Document(ctx context.Context, orderID int, kind string) (*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.docs[orderID][kind]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &d, nil
+}
+
+func (s *memStore) Pick(ctx context.Context, orderID int, lineID int64, actor string, at time.Time) (*Line, error) {
+	return s.finish(orderID, lineID, LinePicked, -1, actor, at)
+}
+
+func (s *memStore) Short(ctx context.Context, orderID int, lineID int64, picked int, actor string, at time.Time) (*Line, error) {
+	return s.finish(orderID, lineID, LineShort, picked, actor, at)
+}
+
+func (s *memStore) finish(orderID int, lineID int64, status string, picked int, actor string, at time.Time) (*Line, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.lines[orderID] {
+		l := &s.lines[orderID][i]
+		if l.ID != lineID {
+			continue
+		}
+		if l.Status != LinePending {
+			return nil, ErrInvalidState
+		}
+		if picked < 0 {
+			picked = l.Quantity
+		}
+		l.Status, l.PickedQuantity, l.PickedBy, l.PickedAt = status, picked, actor, &at
+		found := *l
+		return &found, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Reported(ctx context.Context, l *Line, slip Document, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.lines[l.OrderID] {
+		if s.lines[l.OrderID][i].ID == l.ID {
+			s.lines[l.OrderID][i].ReportedAt = &at
+		}
+	}
+	s.docs[l.OrderID][slip.Kind] = slip
+	s.reported++
+	return nil
+}
+
+func (s *memStore) Unreported(ctx context.Context, limit int) ([]Line, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := []Line{}
+	for _, lines := range s.lines {
+		for _, l := range lines {
+			if l.Status == LineShort && l.ReportedAt == nil {
+				found = append(found, l)
+			}
+		}
+	}
+	return found, nil
+}
+
+// fakeInventory knows where SKU-A1, SKU-A2 and SKU-B1 are kept, and fails
+// shortage reports while down.
+type fakeInventory struct {
+	mu        sync.Mutex
+	down      bool
+	shortages []string
+}
+
+func (f *fakeInventory) GetLocations(ctx context.Context, skus []string) ([]clients.Location, []string, error) {
+	known := map[string]clients.Location{
+		"SKU-A1": {SKU: "SKU-A1", Zone: "A", Bin: "A-01"},
+		"SKU-A2": {SKU: "SKU-A2", Zone: "A", Bin: "A-07"},
+		"SKU-B1": {SKU: "SKU-B1", Zone: "B", Bin: "B-02"},
+	}
+	found, missing := []clients.Location{}, []string{}
+	for _, sku := range skus {
+		if l, ok := known[sku]; ok {
+			found = append(found, l)
+		} else {
+			missing = append(missing, sku)
+		}
+	}
+	return found, missing, nil
+}
+
+func (f *fakeInventory) ReportShortage(ctx context.Context, sku string, quantity int, unit, reference string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("inventory-service is down")
+	}
+	f.shortages = append(f.shortages, strings.Join([]string{tenant.FromContext(ctx), sku, strconv.Itoa(quantity), unit, reference}, " "))
+	return nil
+}
+
+// sweep runs one sweep and waits for what it queued.
+func sweep(t *testing.T, store Store, inventory Inventory) {
+	t.Helper()
+	runner := jobs.New()
+	worker := NewWorker(store, inventory, runner.Queue("fulfillment", 1, 10))
+	runner.Start(context.Background())
+	if err := worker.Sweep(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatalf("Expected the runner to stop, got: %v", err)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	store := newMemStore(&Order{Order: models.Order{ID: 42, UserID: 7, InvoiceNumber: "INV-2024-000001",
+		CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Items: []Item{
+			{SKU: "SKU-NEW", Name: "Unshelved", Unit: "each", Quantity: 1},
+			{SKU: "SKU-B1", Name: "Bolt (M6)", Unit: "case", Quantity: 2},
+			{SKU: "SKU-A2", Name: "Widget", Unit: "each", Quantity: 3},
+			{SKU: "SKU-A1", Name: "Gadget", Unit: "each", Quantity: 1},
+		}}, Tenant: "acme"})
+	inventory := &fakeInventory{}
+	sweep(t, store, inventory)
+
+	lines, err := store.Lines(context.Background(), 42)
+	if err != nil {
+		t.Fatalf("Expected a pick list, got: %v", err)
+	}
+	var order []string
+	for _, l := range lines {
+		order = append(order, l.Zone+" "+l.Bin+" "+l.SKU)
+		if l.Tenant != "acme" {
+			t.Errorf("Expected the order to be prepared in its tenant, got: %+v", l)
+		}
+	}
+	if got := strings.Join(order, ", "); got != "A A-01 SKU-A1, A A-07 SKU-A2, B B-02 SKU-B1, UNASSIGNED  SKU-NEW" {
+		t.Errorf("Expected lines by zone then bin, unassigned last, got: %s", got)
+	}
+
+	for _, kind := range []string{KindPickList, KindPackingSlip} {
+		d, err := store.Document(context.Background(), 42, kind)
+		if err != nil {
+			t.Fatalf("Expected a %s, got: %v", kind, err)
+		}
+		checkPDF(t, d.Content)
+	}
+	pickList, _ := store.Document(context.Background(), 42, KindPickList)
+	for _, want := range []string{"(ZONE A) Tj", "(ZONE UNASSIGNED) Tj", `Bolt \(M6\)`, "INV-2024-000001"} {
+		if !bytes.Contains(pickList.Content, []byte(want)) {
+			t.Errorf("Expected the pick list to contain %q", want)
+		}
+	}
+
+	sweep(t, store, inventory)
+	if len(store.lines) != 1 || len(store.lines[42]) != 4 {
+		t.Errorf("Expected a prepared order to be left alone, got: %+v", store.lines)
+	}
+}
+
+// checkPDF checks content is a PDF whose cross-reference table points at
+// each of its objects.
+func checkPDF(t *testing.T, content []byte) {
+	t.Helper()
+	if !bytes.HasPrefix(content, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(content, []byte("%%EOF\n")) {
+		t.Fatalf("Expected a PDF, got: %q", content)
+	}
+	start := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(content)
+	if start == nil {
+		t.Fatal("Expected startxref")
+	}
+	xref, _ := strconv.Atoi(string(start[1]))
+	if !bytes.HasPrefix(content[xref:], []byte("xref\n")) {
+		t.Fatalf("Expected startxref to point at the xref table, got: %q", content[xref:min(xref+20, len(content))])
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(content[xref:], -1)
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(string(e[1]))
+		if want := strconv.Itoa(i+1) + " 0 obj\n"; !bytes.HasPrefix(content[offset:], []byte(want)) {
+			t.Errorf("Expected xref entry %d to point at %q, got: %q", i+1, want, content[offset:min(offset+20, len(content))])
+		}
+	}
+}
+
+func TestRenderPDFPages(t *testing.T) {
+	text := make([]string, 3*linesPerPage)
+	for i := range text {
+		text[i] = "line " + strconv.Itoa(i)
+	}
+	content := renderPDF("PICK LIST", text)
+	checkPDF(t, content)
+	if !bytes.Contains(content, []byte("/Count 4")) || !bytes.Contains(content, []byte("(PICK LIST  \\(page 4 of 4\\)) Tj")) {
+		t.Errorf("Expected a long list to run over 4 pages, got: %s", content)
+	}
+	if !bytes.Equal(content, renderPDF("PICK LIST", text)) {
+		t.Error("Expected a document to render the same every time")
+	}
+}
+
+func TestPicking(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newMemStore(&Order{Order: models.Order{ID: 42, UserID: 7, Items: []Item{
+		{SKU: "SKU-A1", Name: "Gadget", Unit: "each", Quantity: 1},
+		{SKU: "SKU-B1", Name: "Bolt", Unit: "case", Quantity: 3},
+	}}, Tenant: "acme"})
+	inventory := &fakeInventory{down: true}
+	sweep(t, store, inventory)
+	lines, _ := store.Lines(context.Background(), 42)
+	gadget, bolt := strconv.FormatInt(lines[0].ID, 10), strconv.FormatInt(lines[1].ID, 10)
+
+	runner := jobs.New()
+	worker := NewWorker(store, inventory, runner.Queue("fulfillment", 1, 10))
+	runner.Start(context.Background())
+	defer runner.Stop(context.Background())
+	warehouse := &auth.Principal{UserID: 3, Roles: []string{auth.RoleWarehouse}}
+	customer := &auth.Principal{UserID: 7, Roles: []string{auth.RoleCustomer}}
+	do := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, worker).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		want      int
+		contains  string
+	}{
+		{principal: customer, method: http.MethodGet, path: "/orders/42/pick-list", want: http.StatusForbidden},
+		{principal: warehouse, method: http.MethodGet, path: "/orders/43/pick-list", want: http.StatusNotFound},
+		{principal: warehouse, method: http.MethodGet, path: "/orders/42/pick-list", want: http.StatusOK,
+			contains: `"pending":2,"zones":[{"zone":"A","lines":[{"id":` + gadget},
+		{principal: warehouse, method: http.MethodGet, path: "/orders/42/documents/pick-list", want: http.StatusOK, contains: "%PDF-1.4"},
+		{principal: warehouse, method: http.MethodGet, path: "/orders/42/documents/invoice", want: http.StatusNotFound},
+
+		{principal: warehouse, method: http.MethodPost, path: "/orders/42/pick-lines/" + gadget + "/pick", want: http.StatusOK,
+			contains: `"status":"picked","picked_quantity":1,"picked_by":"user:3"`},
+		{principal: warehouse, method: http.MethodPost, path: "/orders/42/pick-lines/" + gadget + "/pick", want: http.StatusConflict},
+		{principal: warehouse, method: http.MethodPost, path: "/orders/42/pick-lines/999/pick", want: http.StatusNotFound},
+		{principal: warehouse, method: http.MethodPost, path: "/orders/42/pick-lines/" + bolt + "/short", body: `{"picked_quantity": 3}`,
+			want: http.StatusBadRequest},
+		{principal: warehouse, method: http.MethodPost, path: "/orders/42/pick-lines/" + bolt + "/short", body: `{"picked_quantity": 1}`,
+			want: http.StatusOK, contains: `"status":"short","picked_quantity":1`},
+		{principal: warehouse, method: http.MethodGet, path: "/orders/42/pick-list", want: http.StatusOK, contains: `"pending":0`},
+	}
+	for _, tt := range tests {
+		w := do(tt.principal, tt.method, tt.path, tt.body)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected status %d with %s, got: %d %s", tt.method, tt.path, tt.want, tt.contains, w.Code, w.Body)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if store.reported != 0 {
+		t.Fatal("Expected the shortage to stay unreported while inventory-service is down")
+	}
+	inventory.mu.Lock()
+	inventory.down = false
+	inventory.mu.Unlock()
+	sweep(t, store, inventory)
+	want := "acme SKU-B1 2 case order-42-line-" + bolt
+	if len(inventory.shortages) != 1 || inventory.shortages[0] != want || store.reported != 1 {
+		t.Errorf("Expected the sweep to report %q once, got: %v", want, inventory.shortages)
+	}
+	slip, _ := store.Document(context.Background(), 42, KindPackingSlip)
+	if !bytes.Contains(slip.Content, []byte("1 of 2 lines could not be packed in full.")) {
+		t.Error("Expected the packing slip to be reprinted with the shortage")
+	}
+
+	w := do(warehouse, http.MethodGet, "/orders/42/pick-list", "")
+	var resp struct {
+		Zones []Zone `json:"zones"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Zones[1].Lines[0].ReportedAt == nil {
+		t.Errorf("Expected the line to show the shortage reported, got: %s", w.Body)
+	}
+}
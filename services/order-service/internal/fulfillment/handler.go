@@ -0,0 +1,184 @@
+package fulfillment
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// Zone is a zone's lines on the pick list, sorted by bin.
+type Zone struct {
+	Zone  string `json:"zone"`
+	Lines []Line `json:"lines"`
+}
+
+type Handler struct {
+	store  Store
+	worker *Worker
+	now    func() time.Time
+}
+
+func NewHandler(store Store, worker *Worker) *Handler {
+	return &Handler{store: store, worker: worker, now: time.Now}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// They are for warehouse staff and admins.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	group := router.Group("/orders/:id", auth.RequireRole(auth.RoleAdmin, auth.RoleWarehouse))
+	group.GET("/pick-list", h.pickList)
+	group.GET("/documents/:kind", h.document)
+	group.POST("/pick-lines/:line/pick", h.pick)
+	group.POST("/pick-lines/:line/short", h.short)
+}
+
+func (h *Handler) pickList(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	lines, err := h.store.Lines(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no pick list for this order yet"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	zones := []Zone{}
+	pending := 0
+	for _, l := range lines {
+		if len(zones) == 0 || zones[len(zones)-1].Zone != l.Zone {
+			zones = append(zones, Zone{Zone: l.Zone})
+		}
+		zones[len(zones)-1].Lines = append(zones[len(zones)-1].Lines, l)
+		if l.Status == LinePending {
+			pending++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"order_id": id, "pending": pending, "zones": zones})
+}
+
+func (h *Handler) document(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	kind := c.Param("kind")
+	if kind != KindPickList && kind != KindPackingSlip {
+		c.JSON(http.StatusNotFound, gin.H{"error": "documents are pick-list and packing-slip"})
+		return
+	}
+	d, err := h.store.Document(c.Request.Context(), id, kind)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "document not ready for this order yet"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="order-%d-%s.pdf"`, id, kind))
+	c.Header("Last-Modified", d.CreatedAt.UTC().Format(http.TimeFormat))
+	c.Data(http.StatusOK, "application/pdf", d.Content)
+}
+
+func (h *Handler) pick(c *gin.Context) {
+	id, lineID, ok := paramLine(c)
+	if !ok {
+		return
+	}
+	l, err := h.store.Pick(c.Request.Context(), id, lineID, actor(c), h.now())
+	if !h.finished(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+// short marks a line short with what was found of it, and queues booking
+// the rest off inventory. The line stays short if that fails; the worker's
+// sweep retries the report.
+func (h *Handler) short(c *gin.Context) {
+	id, lineID, ok := paramLine(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		PickedQuantity int `json:"picked_quantity" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	lines, err := h.store.Lines(c.Request.Context(), id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, l := range lines {
+		if l.ID == lineID && req.PickedQuantity >= l.Quantity {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("picked_quantity must be less than the %d ordered", l.Quantity)})
+			return
+		}
+	}
+
+	l, err := h.store.Short(c.Request.Context(), id, lineID, req.PickedQuantity, actor(c), h.now())
+	if !h.finished(c, err) {
+		return
+	}
+	if h.worker != nil {
+		h.worker.EnqueueShortage(*l)
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+// finished writes the response for a line that could not be picked or
+// marked short.
+func (h *Handler) finished(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "pick line not found"})
+	case errors.Is(err, ErrInvalidState):
+		c.JSON(http.StatusConflict, gin.H{"error": "pick line has been picked or marked short already"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+// actor names who picked a line.
+func actor(c *gin.Context) string {
+	p, _ := auth.FromContext(c)
+	return "user:" + strconv.Itoa(p.UserID)
+}
+
+func paramID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func paramLine(c *gin.Context) (int, int64, bool) {
+	id, ok := paramID(c)
+	if !ok {
+		return 0, 0, false
+	}
+	lineID, err := strconv.ParseInt(c.Param("line"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pick line id"})
+		return 0, 0, false
+	}
+	return id, lineID, true
+}
@@ -0,0 +1,88 @@
+package fulfillment
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 in points, with text set in 10pt Courier so columns line up by
+// padding.
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	pageMargin   = 50
+	lineHeight   = 14
+	fontSize     = 10
+	linesPerPage = (pageHeight - 2*pageMargin) / lineHeight
+)
+
+// renderPDF lays text out one line per row, over as many pages as it
+// takes, with title and the page number heading every page. Only printable
+// ASCII is kept; anything else prints as '?'. The output depends on nothing
+// but its input, so a document renders the same every time.
+func renderPDF(title string, text []string) []byte {
+	rows := linesPerPage - 2
+	pages := [][]string{}
+	for len(text) > rows {
+		pages = append(pages, text[:rows])
+		text = text[rows:]
+	}
+	pages = append(pages, text)
+
+	var buf bytes.Buffer
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1 to 3 are the catalog, the page tree and the font; each page
+	// then takes a page object and a content stream.
+	buf.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+	for i, page := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 5+2*i))
+
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", fontSize, lineHeight, pageMargin, pageHeight-pageMargin)
+		heading := append([]string{fmt.Sprintf("%s  (page %d of %d)", title, i+1, len(pages)), ""}, page...)
+		for _, line := range heading {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", escapePDF(line))
+		}
+		content.WriteString("ET")
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// escapePDF makes s safe inside a PDF string literal.
+func escapePDF(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < ' ' || r > '~':
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
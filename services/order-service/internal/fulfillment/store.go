@@ -0,0 +1,344 @@
+// Package fulfillment gets paid orders out of the warehouse. Each order gets
+// a pick list, its lines grouped by the zone their items are kept in and
+// sorted by bin so a picker walks each zone once, and a printable pick list
+// and packing slip. Pickers mark lines picked or short, and shortages are
+// booked off inventory.
+package fulfillment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+const (
+	LinePending = "pending"
+	LinePicked  = "picked"
+	LineShort   = "short"
+
+	KindPickList    = "pick-list"
+	KindPackingSlip = "packing-slip"
+
+	// UnassignedZone collects lines whose item has no recorded location.
+	// It sorts last on the pick list.
+	UnassignedZone = "UNASSIGNED"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidState is returned for a line that has been picked or
+	// marked short already, or an order that has a pick list already or is
+	// no longer paid.
+	ErrInvalidState = errors.New("invalid state")
+)
+
+// Order is a paid order to prepare, with its lines as ordered. Only its
+// ID, user, invoice number, lines and creation time are loaded.
+type Order struct {
+	models.Order
+	Tenant string
+}
+
+type Item = models.OrderItem
+
+// Line is a pick list line: Quantity of an order line's Unit to take from
+// Bin in Zone. A short line records what was found in PickedQuantity.
+type Line struct {
+	ID             int64      `json:"id"`
+	OrderID        int        `json:"order_id"`
+	SKU            string     `json:"sku"`
+	Name           string     `json:"name,omitempty"`
+	Unit           string     `json:"unit"`
+	Quantity       int        `json:"quantity"`
+	Zone           string     `json:"zone"`
+	Bin            string     `json:"bin"`
+	Status         string     `json:"status"`
+	PickedQuantity int        `json:"picked_quantity"`
+	PickedBy       string     `json:"picked_by,omitempty"`
+	PickedAt       *time.Time `json:"picked_at,omitempty"`
+	// ReportedAt is when a shortage was booked off inventory.
+	ReportedAt *time.Time `json:"shortage_reported_at,omitempty"`
+	Tenant     string     `json:"-"`
+}
+
+// Document is a rendered PDF.
+type Document struct {
+	Kind      string
+	Content   []byte
+	CreatedAt time.Time
+}
+
+type Store interface {
+	// Unprepared returns paid, unshipped orders without a pick list, across
+	// tenants, oldest first.
+	Unprepared(ctx context.Context, limit int) ([]Order, error)
+	// Get returns an order, without its items.
+	Get(ctx context.Context, orderID int) (*Order, error)
+	// Save stores an order's pick list, in walking order, and its
+	// documents. An order with a pick list already, or no longer paid, is
+	// ErrInvalidState.
+	Save(ctx context.Context, orderID int, lines []Line, docs []Document) error
+	// Lines returns an order's pick list in walking order, or ErrNotFound
+	// if it has none yet.
+	Lines(ctx context.Context, orderID int) ([]Line, error)
+	Document(ctx context.Context, orderID int, kind string) (*Document, error)
+	// Pick marks a pending line picked in full. Short marks it short with
+	// picked of its Quantity found. Either returns ErrInvalidState for a
+	// line that is not pending.
+	Pick(ctx context.Context, orderID int, lineID int64, actor string, at time.Time) (*Line, error)
+	Short(ctx context.Context, orderID int, lineID int64, picked int, actor string, at time.Time) (*Line, error)
+	// Reported records that a short line was booked off inventory and
+	// replaces the order's packing slip with slip, atomically.
+	Reported(ctx context.Context, l *Line, slip Document, at time.Time) error
+	// Unreported returns short lines not yet booked off inventory, across
+	// tenants.
+	Unreported(ctx context.Context, limit int) ([]Line, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// prepared matches the orders o that go to the warehouse: paid and not
+// shipped yet.
+const prepared = "o.status = 'paid' AND NOT EXISTS (SELECT 1 FROM order_service.delivery_promises p WHERE p.order_id = o.id AND p.shipped_at IS NOT NULL)"
+
+func (s *PostgresStore) Unprepared(ctx context.Context, limit int) ([]Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT o.id, o.user_id, o.tenant_id, COALESCE(o.invoice_number, ''), o.created_at
+		FROM order_service.orders o
+		WHERE ` + prepared + ` AND NOT EXISTS (SELECT 1 FROM order_service.pick_lines l WHERE l.order_id = o.id)
+		ORDER BY o.id LIMIT $1`
+	rows, err := s.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Tenant, &o.InvoiceNumber, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	const itemsQuery string = `SELECT sku, name, unit, quantity FROM order_service.order_items WHERE order_id = $1 ORDER BY id`
+	for i := range orders {
+		items, err := s.db.QueryContext(ctx, itemsQuery, orders[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for items.Next() {
+			var item Item
+			if err := items.Scan(&item.SKU, &item.Name, &item.Unit, &item.Quantity); err != nil {
+				items.Close()
+				return nil, err
+			}
+			orders[i].Items = append(orders[i].Items, item)
+		}
+		items.Close()
+		if err := items.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, orderID int) (*Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT o.id, o.user_id, o.tenant_id, COALESCE(o.invoice_number, ''), o.created_at
+		FROM order_service.orders o WHERE o.id = $1 AND o.tenant_id = $2`
+	var o Order
+	err := s.db.QueryRowContext(ctx, query, orderID, tenant.FromContext(ctx)).
+		Scan(&o.ID, &o.UserID, &o.Tenant, &o.InvoiceNumber, &o.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// Save locks the order first, so two replicas preparing it at once cannot
+// both store a pick list.
+func (s *PostgresStore) Save(ctx context.Context, orderID int, lines []Line, docs []Document) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const lock string = `SELECT EXISTS (SELECT 1 FROM order_service.pick_lines WHERE order_id = o.id)
+			FROM order_service.orders o WHERE o.id = $1 AND o.tenant_id = $2 AND ` + prepared + ` FOR UPDATE OF o`
+		var exists bool
+		err := tx.QueryRowContext(ctx, lock, orderID, tenant.FromContext(ctx)).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) || exists {
+			return ErrInvalidState
+		}
+		if err != nil {
+			return err
+		}
+
+		const insertLine string = `INSERT INTO order_service.pick_lines (order_id, position, sku, name, unit, quantity, zone, bin)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, status`
+		for i := range lines {
+			l := &lines[i]
+			if err := tx.QueryRowContext(ctx, insertLine, orderID, i+1, l.SKU, l.Name, l.Unit, l.Quantity, l.Zone, l.Bin).
+				Scan(&l.ID, &l.Status); err != nil {
+				return err
+			}
+		}
+		const insertDocument string = `INSERT INTO order_service.fulfillment_documents (order_id, kind, content)
+			VALUES ($1, $2, $3) RETURNING created_at`
+		for i := range docs {
+			if err := tx.QueryRowContext(ctx, insertDocument, orderID, docs[i].Kind, docs[i].Content).Scan(&docs[i].CreatedAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const lineColumns = `l.id, l.order_id, l.sku, l.name, l.unit, l.quantity, l.zone, l.bin, l.status, l.picked_quantity,
+	COALESCE(l.picked_by, ''), l.picked_at, l.shortage_reported_at, o.tenant_id`
+
+func scanLine(row interface{ Scan(...any) error }) (*Line, error) {
+	var l Line
+	if err := row.Scan(&l.ID, &l.OrderID, &l.SKU, &l.Name, &l.Unit, &l.Quantity, &l.Zone, &l.Bin, &l.Status, &l.PickedQuantity,
+		&l.PickedBy, &l.PickedAt, &l.ReportedAt, &l.Tenant); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (s *PostgresStore) queryLines(ctx context.Context, query string, args ...any) ([]Line, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []Line{}
+	for rows.Next() {
+		l, err := scanLine(rows)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, *l)
+	}
+	return lines, rows.Err()
+}
+
+func (s *PostgresStore) Lines(ctx context.Context, orderID int) ([]Line, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + lineColumns + ` FROM order_service.pick_lines l
+		JOIN order_service.orders o ON o.id = l.order_id
+		WHERE l.order_id = $1 AND o.tenant_id = $2 ORDER BY l.position`
+	lines, err := s.queryLines(ctx, query, orderID, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, ErrNotFound
+	}
+	return lines, nil
+}
+
+func (s *PostgresStore) Document(ctx context.Context, orderID int, kind string) (*Document, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT d.kind, d.content, d.created_at FROM order_service.fulfillment_documents d
+		JOIN order_service.orders o ON o.id = d.order_id
+		WHERE d.order_id = $1 AND d.kind = $2 AND o.tenant_id = $3`
+	var d Document
+	err := s.db.QueryRowContext(ctx, query, orderID, kind, tenant.FromContext(ctx)).Scan(&d.Kind, &d.Content, &d.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *PostgresStore) Pick(ctx context.Context, orderID int, lineID int64, actor string, at time.Time) (*Line, error) {
+	return s.finish(ctx, orderID, lineID, LinePicked, -1, actor, at)
+}
+
+func (s *PostgresStore) Short(ctx context.Context, orderID int, lineID int64, picked int, actor string, at time.Time) (*Line, error) {
+	return s.finish(ctx, orderID, lineID, LineShort, picked, actor, at)
+}
+
+// finish moves a pending line to status with picked found, or its whole
+// quantity when picked is negative.
+func (s *PostgresStore) finish(ctx context.Context, orderID int, lineID int64, status string, picked int, actor string, at time.Time) (*Line, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const update string = `UPDATE order_service.pick_lines l
+		SET status = $4, picked_quantity = CASE WHEN $5 < 0 THEN l.quantity ELSE $5 END, picked_by = $6, picked_at = $7
+		FROM order_service.orders o
+		WHERE l.id = $1 AND l.order_id = $2 AND o.id = l.order_id AND o.tenant_id = $3 AND l.status = 'pending'
+		RETURNING ` + lineColumns
+	l, err := scanLine(s.db.QueryRowContext(ctx, update, lineID, orderID, tenant.FromContext(ctx), status, picked, actor, at))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return l, err
+	}
+	const exists string = `SELECT EXISTS (SELECT 1 FROM order_service.pick_lines l JOIN order_service.orders o ON o.id = l.order_id
+		WHERE l.id = $1 AND l.order_id = $2 AND o.tenant_id = $3)`
+	var found bool
+	if err := s.db.QueryRowContext(ctx, exists, lineID, orderID, tenant.FromContext(ctx)).Scan(&found); err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, ErrInvalidState
+	}
+	return nil, ErrNotFound
+}
+
+func (s *PostgresStore) Reported(ctx context.Context, l *Line, slip Document, at time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const update string = `UPDATE order_service.pick_lines SET shortage_reported_at = $2
+			WHERE id = $1 AND status = 'short' AND shortage_reported_at IS NULL`
+		if _, err := tx.ExecContext(ctx, update, l.ID, at); err != nil {
+			return err
+		}
+		const replace string = `UPDATE order_service.fulfillment_documents SET content = $3, created_at = $4
+			WHERE order_id = $1 AND kind = $2`
+		_, err := tx.ExecContext(ctx, replace, l.OrderID, slip.Kind, slip.Content, at)
+		return err
+	})
+}
+
+func (s *PostgresStore) Unreported(ctx context.Context, limit int) ([]Line, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + lineColumns + ` FROM order_service.pick_lines l
+		JOIN order_service.orders o ON o.id = l.order_id
+		WHERE l.status = 'short' AND l.shortage_reported_at IS NULL ORDER BY l.id LIMIT $1`
+	return s.queryLines(ctx, query, limit)
+}
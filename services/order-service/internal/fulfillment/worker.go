@@ -0,0 +1,161 @@
+package fulfillment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// maxLocations is how many SKUs inventory-service looks up per call.
+const maxLocations = 100
+
+// Inventory is where items are kept and where shortages are booked.
+type Inventory interface {
+	GetLocations(ctx context.Context, skus []string) (found []clients.Location, missing []string, err error)
+	ReportShortage(ctx context.Context, sku string, quantity int, unit, reference string) error
+}
+
+var _ Inventory = (*clients.InventoryClient)(nil)
+
+// Worker prepares orders and reports shortages on a queue. Sweep runs as a
+// scheduled job and queues every paid order without a pick list and every
+// shortage not yet booked off inventory, so a shortage whose report failed
+// is retried by the next sweep. Shortages are also queued as soon as they
+// are marked.
+type Worker struct {
+	store     Store
+	inventory Inventory
+	queue     *jobs.Queue
+	batchSize int
+	now       func() time.Time
+}
+
+func NewWorker(store Store, inventory Inventory, queue *jobs.Queue) *Worker {
+	return &Worker{store: store, inventory: inventory, queue: queue, batchSize: 100, now: time.Now}
+}
+
+func (w *Worker) Sweep(ctx context.Context) error {
+	orders, err := w.store.Unprepared(ctx, w.batchSize)
+	if err != nil {
+		return err
+	}
+	for i := range orders {
+		o := orders[i]
+		w.queue.Enqueue("order-"+strconv.Itoa(o.ID), func(ctx context.Context) error { return w.prepare(ctx, &o) })
+	}
+
+	short, err := w.store.Unreported(ctx, w.batchSize)
+	if err != nil {
+		return err
+	}
+	for _, l := range short {
+		w.EnqueueShortage(l)
+	}
+	return nil
+}
+
+// EnqueueShortage queues booking a short line off inventory, unless it is
+// already queued or running.
+func (w *Worker) EnqueueShortage(l Line) bool {
+	return w.queue.Enqueue("shortage-"+strconv.FormatInt(l.ID, 10), func(ctx context.Context) error { return w.report(ctx, &l) })
+}
+
+// prepare makes o's pick list and renders its documents. An order prepared
+// in the meantime by another replica, or cancelled, is left alone.
+func (w *Worker) prepare(ctx context.Context, o *Order) error {
+	ctx = tenant.NewContext(ctx, o.Tenant)
+	lines, err := w.pickLines(ctx, o.Items)
+	if err != nil {
+		return fmt.Errorf("order %d: %w", o.ID, err)
+	}
+	docs := []Document{
+		{Kind: KindPickList, Content: renderPickList(o, lines)},
+		{Kind: KindPackingSlip, Content: renderPackingSlip(o, lines)},
+	}
+	err = w.store.Save(ctx, o.ID, lines, docs)
+	if errors.Is(err, ErrInvalidState) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Prepared pick list for order %d: %d lines", o.ID, len(lines))
+	return nil
+}
+
+// pickLines puts items in walking order: by zone, with unassigned items
+// last, then by bin.
+func (w *Worker) pickLines(ctx context.Context, items []Item) ([]Line, error) {
+	skus := []string{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if !seen[item.SKU] {
+			seen[item.SKU] = true
+			skus = append(skus, item.SKU)
+		}
+	}
+	locations := map[string]clients.Location{}
+	for start := 0; start < len(skus); start += maxLocations {
+		end := min(start+maxLocations, len(skus))
+		found, _, err := w.inventory.GetLocations(ctx, skus[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range found {
+			locations[l.SKU] = l
+		}
+	}
+
+	lines := make([]Line, len(items))
+	for i, item := range items {
+		lines[i] = Line{SKU: item.SKU, Name: item.Name, Unit: item.Unit, Quantity: item.Quantity, Zone: UnassignedZone, Status: LinePending}
+		if l, ok := locations[item.SKU]; ok {
+			lines[i].Zone, lines[i].Bin = l.Zone, l.Bin
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if (a.Zone == UnassignedZone) != (b.Zone == UnassignedZone) {
+			return b.Zone == UnassignedZone
+		}
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		return a.Bin < b.Bin
+	})
+	return lines, nil
+}
+
+// report books what was not found of l off inventory, then reprints the
+// packing slip with it. Reports carry the line as their reference, so a
+// retry after a lost response is not booked twice.
+func (w *Worker) report(ctx context.Context, l *Line) error {
+	ctx = tenant.NewContext(ctx, l.Tenant)
+	reference := fmt.Sprintf("order-%d-line-%d", l.OrderID, l.ID)
+	if err := w.inventory.ReportShortage(ctx, l.SKU, l.Quantity-l.PickedQuantity, l.Unit, reference); err != nil {
+		return fmt.Errorf("shortage %s: %w", reference, err)
+	}
+
+	o, err := w.store.Get(ctx, l.OrderID)
+	if err != nil {
+		return err
+	}
+	lines, err := w.store.Lines(ctx, l.OrderID)
+	if err != nil {
+		return err
+	}
+	slip := Document{Kind: KindPackingSlip, Content: renderPackingSlip(o, lines)}
+	if err := w.store.Reported(ctx, l, slip, w.now()); err != nil {
+		return err
+	}
+	log.Printf("Reported shortage of %d %s of %s for order %d", l.Quantity-l.PickedQuantity, l.Unit, l.SKU, l.OrderID)
+	return nil
+}
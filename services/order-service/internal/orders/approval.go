@@ -0,0 +1,243 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/gin-gonic/gin"
+)
+
+// ApproverDirectory resolves the org a user orders for and the admins
+// allowed to approve that org's orders.
+type ApproverDirectory interface {
+	GetMembership(ctx context.Context, userID int) (*clients.Membership, error)
+	ListOrgAdmins(ctx context.Context, orgID int) ([]clients.User, error)
+}
+
+type Notifier interface {
+	Send(ctx context.Context, req clients.SendNotificationRequest) (*clients.Notification, error)
+}
+
+var (
+	_ ApproverDirectory = (*clients.UserClient)(nil)
+	_ Notifier          = (*clients.NotificationClient)(nil)
+)
+
+// Approvals holds org orders above a spending threshold until an org admin
+// approves or rejects them.
+type Approvals struct {
+	store            Store
+	directory        ApproverDirectory
+	notifier         Notifier
+	defaultThreshold int64
+}
+
+func NewApprovals(store Store, directory ApproverDirectory, notifier Notifier, defaultThresholdCents int64) *Approvals {
+	return &Approvals{
+		store:            store,
+		directory:        directory,
+		notifier:         notifier,
+		defaultThreshold: defaultThresholdCents,
+	}
+}
+
+func (a *Approvals) threshold(ctx context.Context, orgID int) (int64, error) {
+	threshold, ok, err := a.store.ApprovalThreshold(ctx, orgID)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return a.defaultThreshold, nil
+	}
+	return threshold, nil
+}
+
+func requiresApproval(totalCents, thresholdCents int64) bool {
+	return totalCents > thresholdCents
+}
+
+// requestApproval notifies every admin of the order's org. Failures are only
+// logged: the approval request is already persisted and can be acted on.
+func (a *Approvals) requestApproval(ctx context.Context, o *Order) {
+	admins, err := a.directory.ListOrgAdmins(ctx, *o.OrgID)
+	if err != nil {
+		log.Printf("Failed to look up admins for org %d: %v", *o.OrgID, err)
+		return
+	}
+
+	for _, admin := range admins {
+		adminID := admin.ID
+		// Keyed per order and admin so a retried approval request never
+		// notifies the same admin twice.
+		key := fmt.Sprintf("order-%d-approval-admin-%d", o.ID, adminID)
+		_, err := a.notifier.Send(clients.WithIdempotencyKey(ctx, key), clients.SendNotificationRequest{
+			UserID:    &adminID,
+			Recipient: admin.Email,
+			Subject:   fmt.Sprintf("Order #%d needs your approval", o.ID),
+			Body: fmt.Sprintf("Order #%d placed by user %d totals %d cents, which is above your organization's approval threshold.",
+				o.ID, o.UserID, o.TotalCents),
+			ContextType: "order",
+			ContextID:   strconv.Itoa(o.ID),
+		})
+		if err != nil {
+			log.Printf("Failed to notify admin %d about order %d: %v", admin.ID, o.ID, err)
+		}
+	}
+}
+
+// resolveOrg puts the order in the org its user belongs to in user-service,
+// whatever the request says: an order that left its org out would skip
+// approval, and one naming another org would ask that org's admins to
+// approve it. A request naming an org the user is not in is refused. It
+// writes the response when the order cannot be placed.
+func (h *Handler) resolveOrg(c *gin.Context, req createRequest, o *Order) bool {
+	if h.approvals == nil {
+		return true
+	}
+	m, err := h.approvals.directory.GetMembership(c.Request.Context(), req.UserID)
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "user not found"})
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to look up the org of user %d: %v", req.UserID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "user directory is unavailable"})
+		return false
+	}
+	if req.OrgID != nil && (m.OrgID == nil || *m.OrgID != *req.OrgID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("user does not belong to org %d", *req.OrgID)})
+		return false
+	}
+	o.OrgID = m.OrgID
+	return true
+}
+
+func (a *Approvals) isOrgAdmin(ctx context.Context, orgID, userID int) (bool, error) {
+	admins, err := a.directory.ListOrgAdmins(ctx, orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, admin := range admins {
+		if admin.ID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type decisionRequest struct {
+	ApproverID int    `json:"approver_id" binding:"required"`
+	Reason     string `json:"reason"`
+}
+
+func (h *Handler) approve(c *gin.Context) {
+	h.decide(c, "approved", StatusPending)
+}
+
+func (h *Handler) reject(c *gin.Context) {
+	h.decide(c, "rejected", StatusRejected)
+}
+
+func (h *Handler) decide(c *gin.Context, decision, orderStatus string) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	var req decisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, req.ApproverID) {
+		return
+	}
+
+	approval, err := h.store.GetApproval(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no approval request for this order"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if approval.Status != "pending" {
+		c.JSON(http.StatusConflict, gin.H{"error": "approval already " + approval.Status})
+		return
+	}
+
+	isAdmin, err := h.approvals.isOrgAdmin(c.Request.Context(), approval.OrgID, req.ApproverID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "approver is not an admin of the order's organization"})
+		return
+	}
+
+	approval.Status = decision
+	approval.DecidedBy = &req.ApproverID
+	approval.Reason = req.Reason
+	ch := Change{Actor: actor(c), Reason: req.Reason}
+	if err := h.store.DecideApproval(c.Request.Context(), approval, orderStatus, ch); err != nil {
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidState) {
+			c.JSON(http.StatusConflict, gin.H{"error": "approval already decided"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if orderStatus == StatusRejected {
+		h.releaseStock(c.Request.Context(), id)
+	} else {
+		h.holdStock(c.Request.Context(), id)
+	}
+	c.JSON(http.StatusOK, approval)
+}
+
+func (h *Handler) getApprovalPolicy(c *gin.Context) {
+	orgID, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	threshold, err := h.approvals.threshold(c.Request.Context(), orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"org_id": orgID, "threshold_cents": threshold})
+}
+
+func (h *Handler) setApprovalPolicy(c *gin.Context) {
+	orgID, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ThresholdCents *int64 `json:"threshold_cents" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || *req.ThresholdCents < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "threshold_cents must be a non-negative integer"})
+		return
+	}
+
+	if err := h.store.SetApprovalThreshold(c.Request.Context(), orgID, *req.ThresholdCents); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"org_id": orgID, "threshold_cents": *req.ThresholdCents})
+}
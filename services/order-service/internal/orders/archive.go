@@ -0,0 +1,136 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+// archivedStatuses are the statuses an order is done with, so it can leave
+// the hot tables. A payment_failed order may still be paid.
+var archivedStatuses = []string{StatusPaid, StatusCancelled, StatusRejected, StatusVoided}
+
+// Archiver moves completed orders out of the hot tables once they have not
+// changed for a number of months, keeping those tables small as orders pile
+// up. Reads of a single order, a customer's orders, an order's history and
+// the reports built from them still find archived orders.
+type Archiver struct {
+	store     Store
+	months    int
+	batchSize int
+	now       func() time.Time
+}
+
+// NewArchiver archives orders that have not changed for months months.
+func NewArchiver(store Store, months, batchSize int) *Archiver {
+	return &Archiver{store: store, months: months, batchSize: batchSize, now: time.Now}
+}
+
+// Job runs Sweep and logs what it did.
+func (a *Archiver) Job() jobs.Func {
+	return func(ctx context.Context) error {
+		archived, err := a.Sweep(ctx)
+		if archived > 0 {
+			log.Printf("Archived %d orders not changed for %d months", archived, a.months)
+		}
+		return err
+	}
+}
+
+// Sweep archives orders a batch at a time, each batch in its own
+// transaction, until none are due.
+func (a *Archiver) Sweep(ctx context.Context) (int, error) {
+	cutoff := a.now().AddDate(0, -a.months, 0)
+	archived := 0
+	for {
+		n, err := a.store.ArchiveOrders(ctx, cutoff, a.batchSize)
+		archived += n
+		if err != nil || n < a.batchSize {
+			return archived, err
+		}
+		if ctx.Err() != nil {
+			return archived, ctx.Err()
+		}
+	}
+}
+
+// ArchiveOrders copies the orders with their items and history into the
+// archive tables and deletes them, which takes their reservations,
+// approvals, delivery promises, pick lines, documents, tracking links and
+// shipments with them. An order that another order in the hot table is
+// flagged as a duplicate of stays until that one is archived too.
+func (s *PostgresStore) ArchiveOrders(ctx context.Context, before time.Time, limit int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	archived := 0
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const due string = `SELECT o.id FROM order_service.orders o
+			WHERE o.status = ANY($1) AND o.updated_at < $2
+				AND NOT EXISTS (SELECT 1 FROM order_service.orders d WHERE d.duplicate_of = o.id)
+			ORDER BY o.id LIMIT $3 FOR UPDATE SKIP LOCKED`
+		rows, err := tx.QueryContext(ctx, due, pq.Array(archivedStatuses), before, limit)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// The history trigger lets this transaction, and no other, delete
+		// the transitions it has just copied.
+		if _, err := tx.ExecContext(ctx, `SET LOCAL order_service.archiving = 'on'`); err != nil {
+			return err
+		}
+		statements := []string{
+			`INSERT INTO order_service.orders_archive SELECT o.*, NOW() FROM order_service.orders o WHERE o.id = ANY($1)`,
+			`INSERT INTO order_service.order_items_archive SELECT * FROM order_service.order_items WHERE order_id = ANY($1)`,
+			`INSERT INTO order_service.order_status_history_archive SELECT * FROM order_service.order_status_history WHERE order_id = ANY($1)`,
+			`DELETE FROM order_service.order_status_history WHERE order_id = ANY($1)`,
+			`DELETE FROM order_service.orders WHERE id = ANY($1)`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt, pq.Array(ids)); err != nil {
+				return err
+			}
+		}
+		archived = len(ids)
+		return nil
+	})
+	return archived, err
+}
+
+// getArchived reads an order from the archive. Its delivery promise went
+// with the hot row, so it has none.
+func (s *PostgresStore) getArchived(ctx context.Context, id int) (*Order, error) {
+	const query string = "SELECT " + orderColumns + " FROM order_service.orders_archive WHERE id = $1 AND tenant_id = $2"
+	o, err := scanOrder(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.Archived = true
+	if o.Items, err = listItemsFrom(ctx, s.db, "order_service.order_items_archive", id); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
@@ -0,0 +1,240 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+const (
+	backInStockQueue = "order-service.back-in-stock"
+	// backInStockBatch caps the users alerted per stock change. The rest
+	// wait for the next one, such as a hold expiring.
+	backInStockBatch = 500
+	typeBackInStock  = "back_in_stock"
+)
+
+// Inventory is the part of inventory-service back-in-stock alerts use.
+type Inventory interface {
+	GetStock(ctx context.Context, sku string) (*clients.Stock, error)
+	Reserve(ctx context.Context, sku string, quantity int, reference string) (*clients.Reservation, error)
+	ReleaseReservation(ctx context.Context, id int64) error
+}
+
+// UserDirectory looks up where to reach users, many at a time.
+type UserDirectory interface {
+	GetUsers(ctx context.Context, ids []int) (map[int]clients.User, error)
+}
+
+var (
+	_ Inventory     = (*clients.InventoryClient)(nil)
+	_ UserDirectory = (*clients.UserClient)(nil)
+)
+
+// BackInStock alerts users waiting on a wishlisted SKU when a stock change
+// leaves it available. With a hold window it also reserves a unit for each
+// user alerted, while stock lasts, and gives it back when the window ends
+// unless the user ordered the SKU first.
+type BackInStock struct {
+	store     Store
+	inventory Inventory
+	users     UserDirectory
+	notifier  Notifier
+	hold      time.Duration
+	now       func() time.Time
+}
+
+// NewBackInStock holds stock for alerted users for hold; zero holds none.
+func NewBackInStock(store Store, inventory Inventory, users UserDirectory, notifier Notifier, hold time.Duration) *BackInStock {
+	return &BackInStock{store: store, inventory: inventory, users: users, notifier: notifier, hold: hold, now: time.Now}
+}
+
+// Run consumes stock change events until ctx is cancelled. Replicas share
+// the queue, so each change is handled once.
+func (b *BackInStock) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, backInStockQueue, []string{events.InventoryStockChanged}, b.Handle)
+}
+
+func (b *BackInStock) Handle(ctx context.Context, e events.Event) error {
+	var change events.StockChange
+	if err := e.Decode(&change); err != nil {
+		log.Printf("Dropping malformed stock change %s: %v", e.ID, err)
+		return nil
+	}
+	if change.Tenant != "" {
+		ctx = tenant.NewContext(ctx, change.Tenant)
+	}
+	n, err := b.Restocked(ctx, change.SKU)
+	if n > 0 {
+		log.Printf("Sent %d back-in-stock alerts for %s", n, change.SKU)
+	}
+	return err
+}
+
+// Restocked alerts the users waiting on the SKU if it is available, and
+// returns how many it alerted. A user whose alert cannot be sent is put back
+// to wait for the next change.
+func (b *BackInStock) Restocked(ctx context.Context, sku string) (int, error) {
+	stock, err := b.inventory.GetStock(ctx, sku)
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if stock.Available <= 0 {
+		return 0, nil
+	}
+
+	waiting, err := b.store.ClaimWaiting(ctx, sku, backInStockBatch)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int, len(waiting))
+	for i, item := range waiting {
+		ids[i] = item.UserID
+	}
+	users, err := b.users.GetUsers(ctx, ids)
+	if err != nil {
+		for _, item := range waiting {
+			if err := b.store.RearmWishlistItem(ctx, item.ID); err != nil {
+				log.Printf("Failed to re-arm wishlist item %d: %v", item.ID, err)
+			}
+		}
+		return 0, fmt.Errorf("look up users waiting on %s: %w", sku, err)
+	}
+	sent := 0
+	holding := b.hold > 0
+	for i := range waiting {
+		item := &waiting[i]
+		var hold *Hold
+		if holding {
+			if hold, err = b.holdFor(ctx, item); err != nil {
+				log.Printf("Stopped holding %s for wishlists: %v", sku, err)
+				holding = false
+			}
+		}
+		if err := b.alert(ctx, item, users, stock, hold); err != nil {
+			log.Printf("Failed to alert user %d that %s is back: %v", item.UserID, sku, err)
+			if hold != nil {
+				if _, err := b.store.TakeHolds(ctx, item.UserID, []string{sku}); err == nil {
+					b.release(ctx, *hold)
+				}
+			}
+			if err := b.store.RearmWishlistItem(ctx, item.ID); err != nil {
+				log.Printf("Failed to re-arm wishlist item %d: %v", item.ID, err)
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// holdFor reserves a unit for the item's user. Running out of stock ends
+// holding for the rest of the batch.
+func (b *BackInStock) holdFor(ctx context.Context, item *WishlistItem) (*Hold, error) {
+	r, err := b.inventory.Reserve(ctx, item.SKU, 1, holdReference(item.ID))
+	if err != nil {
+		return nil, err
+	}
+	hold := &Hold{ItemID: item.ID, UserID: item.UserID, SKU: item.SKU, ReservationID: r.ID, Tenant: tenant.FromContext(ctx)}
+	until := b.now().Add(b.hold)
+	if err := b.store.SetHold(ctx, item.ID, r.ID, until); err != nil {
+		b.release(ctx, *hold)
+		return nil, err
+	}
+	item.HeldUntil = &until
+	return hold, nil
+}
+
+func (b *BackInStock) alert(ctx context.Context, item *WishlistItem, users map[int]clients.User, stock *clients.Stock, hold *Hold) error {
+	u, ok := users[item.UserID]
+	if !ok {
+		return errors.New("user not found")
+	}
+	name := stock.Name
+	if name == "" {
+		name = item.SKU
+	}
+	body := fmt.Sprintf("%s (%s) from your wishlist is back in stock.", name, item.SKU)
+	if hold != nil {
+		body += fmt.Sprintf(" We are holding one for you until %s.", item.HeldUntil.UTC().Format("15:04 UTC on Jan 2"))
+	}
+
+	// Keyed per item and alert, so a redelivered stock change never sends
+	// the same alert twice but a re-armed item is alerted again.
+	notified := b.now()
+	if item.NotifiedAt != nil {
+		notified = *item.NotifiedAt
+	}
+	key := fmt.Sprintf("wishlist-%d-back-in-stock-%d", item.ID, notified.Unix())
+	userID := item.UserID
+	_, err := b.notifier.Send(clients.WithIdempotencyKey(ctx, key), clients.SendNotificationRequest{
+		UserID:      &userID,
+		Recipient:   u.Email,
+		Channel:     item.Channel,
+		Type:        typeBackInStock,
+		Subject:     name + " is back in stock",
+		Body:        body,
+		ContextType: "sku",
+		ContextID:   item.SKU,
+	})
+	return err
+}
+
+// release gives a hold's stock back. A failure is only logged: the
+// reservation is left for inventory's operators to release.
+func (b *BackInStock) release(ctx context.Context, hold Hold) {
+	if hold.Tenant != "" {
+		ctx = tenant.NewContext(ctx, hold.Tenant)
+	}
+	err := b.inventory.ReleaseReservation(ctx, hold.ReservationID)
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusConflict) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to release reservation %d held for user %d on %s: %v", hold.ReservationID, hold.UserID, hold.SKU, err)
+	}
+}
+
+// releaseUserHolds releases the user's holds on the SKUs and returns the
+// SKUs it released stock for.
+func (b *BackInStock) releaseUserHolds(ctx context.Context, userID int, skus []string) []string {
+	holds, err := b.store.TakeHolds(ctx, userID, skus)
+	if err != nil {
+		log.Printf("Failed to release holds for user %d: %v", userID, err)
+		return nil
+	}
+	var released []string
+	for _, hold := range holds {
+		b.release(ctx, hold)
+		released = append(released, hold.SKU)
+	}
+	return released
+}
+
+// Job releases holds whose window ended. Inventory announces each release,
+// so stock given back goes to the next users waiting.
+func (b *BackInStock) Job() jobs.Func {
+	return func(ctx context.Context) error {
+		holds, err := b.store.TakeExpiredHolds(ctx, b.now(), backInStockBatch)
+		for _, hold := range holds {
+			b.release(ctx, hold)
+		}
+		if len(holds) > 0 {
+			log.Printf("Released %d expired back-in-stock holds", len(holds))
+		}
+		return err
+	}
+}
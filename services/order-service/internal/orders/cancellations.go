@@ -0,0 +1,378 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/saga"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// Cancellation reasons a customer picks from. ReasonOther needs a note.
+const (
+	ReasonChangedMind      = "changed_mind"
+	ReasonFoundCheaper     = "found_cheaper"
+	ReasonDeliveryTooSlow  = "delivery_too_slow"
+	ReasonOrderedByMistake = "ordered_by_mistake"
+	ReasonPaymentIssue     = "payment_issue"
+	ReasonOther            = "other"
+)
+
+var cancellationReasons = []string{ReasonChangedMind, ReasonFoundCheaper, ReasonDeliveryTooSlow, ReasonOrderedByMistake, ReasonPaymentIssue, ReasonOther}
+
+// Customer tiers, from the customer's paid orders when they cancel.
+const (
+	TierNew       = "new"
+	TierReturning = "returning"
+	TierVIP       = "vip"
+)
+
+// vipSpendCents is the lifetime paid spend that makes a customer a VIP.
+const vipSpendCents = 100000
+
+func customerTier(paidOrders int, paidCents int64) string {
+	switch {
+	case paidCents >= vipSpendCents:
+		return TierVIP
+	case paidOrders > 0:
+		return TierReturning
+	}
+	return TierNew
+}
+
+// Cancellation is why a customer cancelled an order. CustomerTier is kept
+// as it was at the time, so reports do not shift as customers buy more.
+type Cancellation struct {
+	OrderID      int       `json:"order_id"`
+	Reason       string    `json:"reason"`
+	Note         string    `json:"note,omitempty"`
+	CustomerTier string    `json:"customer_tier"`
+	CancelledAt  time.Time `json:"cancelled_at"`
+}
+
+// Report groupings and periods.
+const (
+	GroupByPeriod = "period"
+	GroupBySKU    = "sku"
+	GroupByTier   = "tier"
+)
+
+var reportPeriods = []string{"day", "week", "month"}
+
+// ReportQuery selects cancellations from From up to, but not including, To.
+// Period applies when grouping by period.
+type ReportQuery struct {
+	From    time.Time
+	To      time.Time
+	GroupBy string
+	Period  string
+}
+
+// ReportRow counts the orders cancelled for one reason within one group:
+// a period's start date, a SKU or a customer tier. TotalCents is the value
+// of those orders or, by SKU, of their lines for the SKU.
+type ReportRow struct {
+	Key        string `json:"key"`
+	Reason     string `json:"reason"`
+	Orders     int    `json:"orders"`
+	TotalCents int64  `json:"total_cents"`
+}
+
+// cancellable are the statuses a customer may still cancel from.
+var cancellable = []string{StatusPending, StatusPendingApproval, StatusHeldDuplicate, StatusPaymentFailed}
+
+func (s *PostgresStore) Cancel(ctx context.Context, id int, c *Cancellation, ch Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		t, err := transition(ctx, tx, id, StatusCancelled, ch, cancellable...)
+		if err != nil {
+			return err
+		}
+		return recordCancellation(ctx, tx, id, t, c)
+	})
+}
+
+func (s *PostgresStore) CancelPaid(ctx context.Context, id int, c *Cancellation, ch Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		t, err := transition(ctx, tx, id, StatusCancelled, ch, StatusPaid)
+		if err != nil {
+			return err
+		}
+		const shipped string = `SELECT EXISTS (SELECT 1 FROM order_service.delivery_promises WHERE order_id = $1 AND shipped_at IS NOT NULL)`
+		var isShipped bool
+		if err := tx.QueryRowContext(ctx, shipped, id).Scan(&isShipped); err != nil {
+			return err
+		}
+		if isShipped {
+			return ErrInvalidState
+		}
+		return recordCancellation(ctx, tx, id, t, c)
+	})
+}
+
+func (s *PostgresStore) Reopen(ctx context.Context, id int, status string, ch Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := transition(ctx, tx, id, status, ch, StatusCancelled); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM order_service.order_cancellations WHERE order_id = $1`, id)
+		return err
+	})
+}
+
+// recordCancellation closes any pending approval for the order cancelled
+// by t and records c.
+func recordCancellation(ctx context.Context, tx *sql.Tx, id int, t *Transition, c *Cancellation) error {
+	const cancelApproval string = `UPDATE order_service.order_approvals SET status = 'cancelled', decided_at = NOW()
+		WHERE order_id = $1 AND status = 'pending'`
+	if _, err := tx.ExecContext(ctx, cancelApproval, id); err != nil {
+		return err
+	}
+
+	const paid string = `SELECT COUNT(*), COALESCE(SUM(total_cents), 0) FROM order_service.orders
+		WHERE tenant_id = $2 AND status = 'paid' AND user_id = (SELECT user_id FROM order_service.orders WHERE id = $1)`
+	var paidOrders int
+	var paidCents int64
+	if err := tx.QueryRowContext(ctx, paid, id, tenant.FromContext(ctx)).Scan(&paidOrders, &paidCents); err != nil {
+		return err
+	}
+	c.OrderID, c.CustomerTier, c.CancelledAt = id, customerTier(paidOrders, paidCents), t.CreatedAt
+
+	const insert string = `INSERT INTO order_service.order_cancellations (order_id, tenant_id, reason, note, customer_tier, cancelled_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)`
+	_, err := tx.ExecContext(ctx, insert, id, tenant.FromContext(ctx), c.Reason, c.Note, c.CustomerTier, c.CancelledAt)
+	return err
+}
+
+// reportQueries count cancellations by reason for each grouping, archived
+// orders included. By SKU, an order counts once for each SKU on it.
+var reportQueries = map[string]string{
+	GroupByPeriod: `SELECT to_char(date_trunc($4, c.cancelled_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD'), c.reason, COUNT(*), COALESCE(SUM(o.total_cents), 0)
+		FROM order_service.order_cancellations c JOIN order_service.all_orders o ON o.id = c.order_id
+		WHERE c.tenant_id = $1 AND c.cancelled_at >= $2 AND c.cancelled_at < $3
+		GROUP BY 1, 2 ORDER BY 1, 2`,
+	GroupBySKU: `SELECT i.sku, c.reason, COUNT(DISTINCT c.order_id), COALESCE(SUM(i.quantity * i.unit_price_cents), 0)
+		FROM order_service.order_cancellations c JOIN order_service.all_order_items i ON i.order_id = c.order_id
+		WHERE c.tenant_id = $1 AND c.cancelled_at >= $2 AND c.cancelled_at < $3
+		GROUP BY 1, 2 ORDER BY 1, 2`,
+	GroupByTier: `SELECT c.customer_tier, c.reason, COUNT(*), COALESCE(SUM(o.total_cents), 0)
+		FROM order_service.order_cancellations c JOIN order_service.all_orders o ON o.id = c.order_id
+		WHERE c.tenant_id = $1 AND c.cancelled_at >= $2 AND c.cancelled_at < $3
+		GROUP BY 1, 2 ORDER BY 1, 2`,
+}
+
+func (s *PostgresStore) CancellationReport(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	query, ok := reportQueries[q.GroupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown grouping %q", q.GroupBy)
+	}
+	args := []any{tenant.FromContext(ctx), q.From, q.To}
+	if q.GroupBy == GroupByPeriod {
+		args = append(args, q.Period)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []ReportRow{}
+	for rows.Next() {
+		var r ReportRow
+		if err := rows.Scan(&r.Key, &r.Reason, &r.Orders, &r.TotalCents); err != nil {
+			return nil, err
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
+
+type cancelRequest struct {
+	Reason string `json:"reason" binding:"required"`
+	Note   string `json:"note" binding:"max=500"`
+}
+
+func (h *Handler) cancel(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	var req cancelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if !contains(cancellationReasons, req.Reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be one of " + strings.Join(cancellationReasons, ", ")})
+		return
+	}
+	if req.Reason == ReasonOther && req.Note == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a note is required when the reason is other"})
+		return
+	}
+
+	o, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, o.UserID) {
+		return
+	}
+
+	cn := &Cancellation{Reason: req.Reason, Note: req.Note}
+	ch := Change{Actor: actor(c), Reason: "cancelled by the customer: " + req.Reason}
+	if o.Status == StatusPaid && h.refunds != nil {
+		h.cancelPaid(c, o, cn, ch)
+		return
+	}
+	err = h.store.Cancel(c.Request.Context(), id, cn, ch)
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "order can no longer be cancelled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	announceCancellation(c.Request.Context(), h.publisher, o, cn, 0)
+	h.releaseStock(c.Request.Context(), id)
+	c.JSON(http.StatusOK, gin.H{"id": id, "status": StatusCancelled, "cancellation": cn})
+}
+
+// cancelPaid cancels a paid order that has not shipped and refunds it. If
+// any step fails, those done are undone and the order stays paid.
+func (h *Handler) cancelPaid(c *gin.Context, o *Order, cn *Cancellation, ch Change) {
+	payment, err := h.refunds.cancel(c.Request.Context(), o, cn, ch)
+	if errors.Is(err, ErrInvalidState) || unrefundable(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "order can no longer be cancelled"})
+		return
+	}
+	var serr *saga.Error
+	if errors.As(err, &serr) && serr.Step != "cancel order" {
+		log.Printf("Failed to cancel paid order %d: %v", o.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "order was not cancelled: " + serr.Step + " failed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	announceCancellation(c.Request.Context(), h.publisher, o, cn, payment.AmountCents)
+	c.JSON(http.StatusOK, gin.H{"id": o.ID, "status": StatusCancelled, "cancellation": cn, "refund": payment})
+}
+
+// announceCancellation publishes an OrderCancelled event, with the amount
+// refunded if the order was paid. The cancellation is already saved, so a
+// failure is only logged.
+func announceCancellation(ctx context.Context, publisher events.Publisher, o *Order, cn *Cancellation, refundedCents int64) {
+	if publisher == nil {
+		return
+	}
+	skus := make([]string, 0, len(o.Items))
+	for _, item := range o.Items {
+		if !contains(skus, item.SKU) {
+			skus = append(skus, item.SKU)
+		}
+	}
+	e, err := events.New(events.OrderCancelled, "order-service", events.OrderCancellation{
+		OrderID:       o.ID,
+		UserID:        o.UserID,
+		Tenant:        tenant.FromContext(ctx),
+		Reason:        cn.Reason,
+		Note:          cn.Note,
+		CustomerTier:  cn.CustomerTier,
+		TotalCents:    o.TotalCents,
+		RefundedCents: refundedCents,
+		SKUs:          skus,
+	})
+	if err == nil {
+		err = publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish cancellation of order %d: %v", o.ID, err)
+	}
+}
+
+// cancellationReport counts cancellations by reason over ?from= and ?to=
+// (dates or RFC 3339 timestamps; the last 30 days by default), grouped by
+// ?group_by=period (with ?period=day, week or month), sku or tier.
+func (h *Handler) cancellationReport(c *gin.Context) {
+	q := ReportQuery{GroupBy: c.DefaultQuery("group_by", GroupByPeriod), Period: c.DefaultQuery("period", "day")}
+	if _, ok := reportQueries[q.GroupBy]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must be period, sku or tier"})
+		return
+	}
+	if !contains(reportPeriods, q.Period) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day, week or month"})
+		return
+	}
+	var ok bool
+	if q.To, ok = reportTime(c, "to", time.Now().UTC()); !ok {
+		return
+	}
+	if q.From, ok = reportTime(c, "from", q.To.AddDate(0, 0, -30)); !ok {
+		return
+	}
+	if !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	rows, err := h.store.CancellationReport(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"from": q.From, "to": q.To, "group_by": q.GroupBy, "rows": rows}
+	if q.GroupBy == GroupByPeriod {
+		resp["period"] = q.Period
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// reportTime parses a report bound. A date such as 2026-03-01 is midnight
+// UTC at its start.
+func reportTime(c *gin.Context, name string, fallback time.Time) (time.Time, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return fallback, true
+	}
+	if t, err := time.Parse(time.DateOnly, raw); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a date or an RFC 3339 timestamp"})
+		return time.Time{}, false
+	}
+	return t, true
+}
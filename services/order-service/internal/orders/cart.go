@@ -0,0 +1,361 @@
+package orders
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// CartHeader carries a guest's cart ID. Carts of signed-in users are found
+// from their token instead.
+const CartHeader = "X-Cart-ID"
+
+// maxCartItems is how many SKUs a cart may hold.
+const maxCartItems = 100
+
+// guestCartID matches the IDs newGuestCartID makes.
+var guestCartID = regexp.MustCompile(`^guest-[0-9a-f]{32}$`)
+
+// CartItem is a SKU in a cart. UnitPriceCents is only kept for checkouts
+// that are not priced from the catalog; otherwise the catalog's price at
+// checkout wins, as it does for orders.
+type CartItem struct {
+	SKU            string    `json:"sku"`
+	Unit           string    `json:"unit"`
+	Quantity       int       `json:"quantity"`
+	UnitPriceCents int64     `json:"unit_price_cents,omitempty"`
+	AddedAt        time.Time `json:"added_at"`
+}
+
+// Cart is a user's or a guest's items ahead of placing an order, oldest
+// first.
+type Cart struct {
+	ID    string     `json:"id,omitempty"`
+	Items []CartItem `json:"items"`
+}
+
+// CartHandler serves the caller's cart and checks it out through the order
+// handler, so a cart is placed exactly as POST /orders would place it.
+type CartHandler struct {
+	carts  CartStore
+	orders *Handler
+	now    func() time.Time
+}
+
+func NewCartHandler(carts CartStore, orders *Handler) *CartHandler {
+	return &CartHandler{carts: carts, orders: orders, now: time.Now}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Guests may use a cart, but must sign in, and merge it, to check out.
+func (h *CartHandler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/cart", h.get)
+	router.DELETE("/cart", h.clear)
+	router.POST("/cart/items", h.addItem)
+	router.PUT("/cart/items/:sku", h.setItem)
+	router.DELETE("/cart/items/:sku", h.removeItem)
+	router.POST("/cart/merge", h.merge)
+	router.POST("/cart/checkout", h.checkout)
+}
+
+func userCartID(userID int) string {
+	return "user-" + strconv.Itoa(userID)
+}
+
+func newGuestCartID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "guest-" + hex.EncodeToString(b)
+}
+
+// cartID is the caller's cart: a signed-in user's own, or the guest cart
+// named in CartHeader. With create, a guest without one is given a new
+// cart, named in the response's CartHeader. An empty ID means the caller
+// has no cart yet; a response has been written if ok is false.
+func (h *CartHandler) cartID(c *gin.Context, create bool) (id string, ok bool) {
+	if p, signedIn := auth.FromContext(c); signedIn && p.UserID != 0 {
+		return userCartID(p.UserID), true
+	}
+	id = c.GetHeader(CartHeader)
+	switch {
+	case id == "" && create:
+		id = newGuestCartID()
+		c.Header(CartHeader, id)
+	case id != "" && !guestCartID.MatchString(id):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + CartHeader})
+		return "", false
+	}
+	return id, true
+}
+
+func (h *CartHandler) get(c *gin.Context) {
+	id, ok := h.cartID(c, false)
+	if !ok {
+		return
+	}
+	if id == "" {
+		c.JSON(http.StatusOK, Cart{Items: []CartItem{}})
+		return
+	}
+	h.respond(c, id)
+}
+
+func (h *CartHandler) clear(c *gin.Context) {
+	id, ok := h.cartID(c, false)
+	if !ok {
+		return
+	}
+	if id != "" {
+		if err := h.carts.Delete(c.Request.Context(), id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type cartItemRequest struct {
+	SKU            string `json:"sku"`
+	Quantity       int    `json:"quantity" binding:"required,min=1"`
+	Unit           string `json:"unit"`
+	UnitPriceCents int64  `json:"unit_price_cents" binding:"min=0"`
+}
+
+// bindItem reads a cart item from the body, with the SKU from the path
+// when there is one.
+func bindItem(c *gin.Context) (*CartItem, bool) {
+	var req cartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if sku := c.Param("sku"); sku != "" {
+		req.SKU = sku
+	}
+	if req.Unit == "" {
+		req.Unit = "each"
+	}
+	if req.SKU == "" || len(req.SKU) > 64 || len(req.Unit) > 32 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "each item needs a sku of at most 64 characters and a unit of at most 32"})
+		return nil, false
+	}
+	return &CartItem{SKU: req.SKU, Unit: req.Unit, Quantity: req.Quantity, UnitPriceCents: req.UnitPriceCents}, true
+}
+
+// addItem adds to the quantity already in the cart when the SKU is there
+// in the same unit, and otherwise puts the item in the cart.
+func (h *CartHandler) addItem(c *gin.Context) {
+	item, ok := bindItem(c)
+	if !ok {
+		return
+	}
+	id, ok := h.cartID(c, true)
+	if !ok {
+		return
+	}
+	cart, err := h.carts.Get(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if existing := cart.item(item.SKU); existing != nil && existing.Unit == item.Unit {
+		item.Quantity += existing.Quantity
+	}
+	h.put(c, id, cart, item)
+}
+
+// setItem replaces the SKU's quantity and unit.
+func (h *CartHandler) setItem(c *gin.Context) {
+	item, ok := bindItem(c)
+	if !ok {
+		return
+	}
+	id, ok := h.cartID(c, true)
+	if !ok {
+		return
+	}
+	cart, err := h.carts.Get(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.put(c, id, cart, item)
+}
+
+// put saves item in cart, keeping when it was first added, and responds
+// with the cart.
+func (h *CartHandler) put(c *gin.Context, id string, cart *Cart, item *CartItem) {
+	item.AddedAt = h.now()
+	if existing := cart.item(item.SKU); existing != nil {
+		item.AddedAt = existing.AddedAt
+	} else if len(cart.Items) >= maxCartItems {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "a cart holds at most " + strconv.Itoa(maxCartItems) + " items"})
+		return
+	}
+	if err := h.carts.Put(c.Request.Context(), id, *item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respond(c, id)
+}
+
+func (h *CartHandler) removeItem(c *gin.Context) {
+	id, ok := h.cartID(c, false)
+	if !ok {
+		return
+	}
+	err := ErrNotFound
+	if id != "" {
+		err = h.carts.Remove(c.Request.Context(), id, c.Param("sku"))
+	}
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item is not in the cart"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respond(c, id)
+}
+
+// merge moves a guest cart into the signed-in user's, as clients do right
+// after signing in. A SKU in both carts in the same unit gets both
+// quantities; in different units, the guest's line wins, as the more
+// recent choice. The guest cart is deleted.
+func (h *CartHandler) merge(c *gin.Context) {
+	p, ok := auth.FromContext(c)
+	if !ok || p.UserID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in to merge a guest cart"})
+		return
+	}
+	var req struct {
+		CartID string `json:"cart_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !guestCartID.MatchString(req.CartID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cart_id must be a guest cart"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	id := userCartID(p.UserID)
+	guest, err := h.carts.Get(ctx, req.CartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cart, err := h.carts.Get(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	room := maxCartItems - len(cart.Items)
+	for _, item := range guest.Items {
+		existing := cart.item(item.SKU)
+		switch {
+		case existing != nil && existing.Unit == item.Unit:
+			item.Quantity += existing.Quantity
+			item.AddedAt = existing.AddedAt
+		case existing == nil && room == 0:
+			continue
+		case existing == nil:
+			room--
+		}
+		if err := h.carts.Put(ctx, id, item); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := h.carts.Delete(ctx, req.CartID); err != nil {
+		log.Printf("Failed to delete merged guest cart %s: %v", req.CartID, err)
+	}
+	h.respond(c, id)
+}
+
+type checkoutRequest struct {
+	OrgID      *int   `json:"org_id"`
+	Carrier    string `json:"carrier"`
+	Currency   string `json:"currency"`
+	QuoteToken string `json:"quote_token"`
+}
+
+// checkout places the signed-in user's cart as an order and empties the
+// cart once the order is saved.
+func (h *CartHandler) checkout(c *gin.Context) {
+	p, ok := auth.FromContext(c)
+	if !ok || p.UserID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in to check out"})
+		return
+	}
+	var req checkoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	id := userCartID(p.UserID)
+	cart, err := h.carts.Get(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(cart.Items) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "cart is empty"})
+		return
+	}
+
+	order := createRequest{UserID: p.UserID, OrgID: req.OrgID, Carrier: req.Carrier, Currency: req.Currency, QuoteToken: req.QuoteToken}
+	for _, item := range cart.Items {
+		order.Items = append(order.Items, Item{SKU: item.SKU, Unit: item.Unit, Quantity: item.Quantity, UnitPriceCents: item.UnitPriceCents})
+	}
+	o, ok := h.orders.place(c, order)
+	if !ok {
+		return
+	}
+	if err := h.carts.Delete(c.Request.Context(), id); err != nil {
+		log.Printf("Failed to empty cart %s after placing order %d: %v", id, o.ID, err)
+	}
+	c.JSON(http.StatusCreated, o)
+}
+
+func (h *CartHandler) respond(c *gin.Context, id string) {
+	cart, err := h.carts.Get(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
+func (c *Cart) item(sku string) *CartItem {
+	for i := range c.Items {
+		if c.Items[i].SKU == sku {
+			return &c.Items[i]
+		}
+	}
+	return nil
+}
+
+// sortCart puts a cart's items in the order they were added.
+func sortCart(items []CartItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].AddedAt.Equal(items[j].AddedAt) {
+			return items[i].AddedAt.Before(items[j].AddedAt)
+		}
+		return items[i].SKU < items[j].SKU
+	})
+}
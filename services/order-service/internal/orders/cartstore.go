@@ -0,0 +1,170 @@
+package orders
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/redis"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// CartStore keeps carts, by ID, within the tenant. A cart expires ttl after
+// it last changed; an expired or unknown cart reads as empty.
+type CartStore interface {
+	Get(ctx context.Context, id string) (*Cart, error)
+	// Put adds item to the cart, or replaces the cart's line for its SKU.
+	Put(ctx context.Context, id string, item CartItem) error
+	// Remove returns ErrNotFound if the SKU is not in the cart.
+	Remove(ctx context.Context, id, sku string) error
+	Delete(ctx context.Context, id string) error
+}
+
+// RedisCartStore keeps each cart as a Redis hash of JSON-encoded items by
+// SKU, which Redis expires.
+type RedisCartStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisCartStore(client *redis.Client, ttl time.Duration) *RedisCartStore {
+	return &RedisCartStore{client: client, ttl: ttl}
+}
+
+func cartKey(ctx context.Context, id string) string {
+	return "cart:" + tenant.FromContext(ctx) + ":" + id
+}
+
+func (s *RedisCartStore) Get(ctx context.Context, id string) (*Cart, error) {
+	reply, err := s.client.Do(ctx, "HGETALL", cartKey(ctx, id))
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]any)
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("unexpected HGETALL reply %v", reply)
+	}
+	cart := &Cart{ID: id, Items: []CartItem{}}
+	for i := 0; i < len(fields); i += 2 {
+		value, _ := fields[i+1].(string)
+		var item CartItem
+		if err := json.Unmarshal([]byte(value), &item); err != nil {
+			return nil, fmt.Errorf("decode cart item %v: %w", fields[i], err)
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	sortCart(cart.Items)
+	return cart, nil
+}
+
+func (s *RedisCartStore) Put(ctx context.Context, id string, item CartItem) error {
+	value, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	key := cartKey(ctx, id)
+	if _, err := s.client.Do(ctx, "HSET", key, item.SKU, string(value)); err != nil {
+		return err
+	}
+	_, err = s.client.Do(ctx, "EXPIRE", key, strconv.Itoa(int(s.ttl/time.Second)))
+	return err
+}
+
+func (s *RedisCartStore) Remove(ctx context.Context, id, sku string) error {
+	key := cartKey(ctx, id)
+	reply, err := s.client.Do(ctx, "HDEL", key, sku)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrNotFound
+	}
+	_, err = s.client.Do(ctx, "EXPIRE", key, strconv.Itoa(int(s.ttl/time.Second)))
+	return err
+}
+
+func (s *RedisCartStore) Delete(ctx context.Context, id string) error {
+	_, err := s.client.Do(ctx, "DEL", cartKey(ctx, id))
+	return err
+}
+
+// MemoryCartStore keeps carts in this process, so each replica has its own
+// and they are lost on restart. It is for running without Redis.
+type MemoryCartStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	carts map[string]*memoryCart
+}
+
+type memoryCart struct {
+	items     map[string]CartItem
+	expiresAt time.Time
+}
+
+func NewMemoryCartStore(ttl time.Duration) *MemoryCartStore {
+	return &MemoryCartStore{ttl: ttl, now: time.Now, carts: map[string]*memoryCart{}}
+}
+
+// cart returns the live cart at key, dropping it if it has expired.
+func (s *MemoryCartStore) cart(key string) *memoryCart {
+	m, ok := s.carts[key]
+	if ok && !s.now().Before(m.expiresAt) {
+		delete(s.carts, key)
+		return nil
+	}
+	return m
+}
+
+func (s *MemoryCartStore) Get(ctx context.Context, id string) (*Cart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart := &Cart{ID: id, Items: []CartItem{}}
+	if m := s.cart(cartKey(ctx, id)); m != nil {
+		for _, item := range m.items {
+			cart.Items = append(cart.Items, item)
+		}
+	}
+	sortCart(cart.Items)
+	return cart, nil
+}
+
+func (s *MemoryCartStore) Put(ctx context.Context, id string, item CartItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := cartKey(ctx, id)
+	m := s.cart(key)
+	if m == nil {
+		m = &memoryCart{items: map[string]CartItem{}}
+		s.carts[key] = m
+	}
+	m.items[item.SKU] = item
+	m.expiresAt = s.now().Add(s.ttl)
+	return nil
+}
+
+func (s *MemoryCartStore) Remove(ctx context.Context, id, sku string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.cart(cartKey(ctx, id))
+	if m == nil {
+		return ErrNotFound
+	}
+	if _, ok := m.items[sku]; !ok {
+		return ErrNotFound
+	}
+	delete(m.items, sku)
+	m.expiresAt = s.now().Add(s.ttl)
+	return nil
+}
+
+func (s *MemoryCartStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.carts, cartKey(ctx, id))
+	return nil
+}
@@ -0,0 +1,47 @@
+package orders
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients/contracttest"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/testfactory"
+	"github.com/gin-gonic/gin"
+)
+
+type listStore struct {
+	Store
+	orders []Order
+}
+
+func (s *listStore) ListByUser(ctx context.Context, userID, limit int) ([]Order, error) {
+	return s.orders, nil
+}
+
+func (s *listStore) StreamByUser(ctx context.Context, userID int, fn func(Order) error) error {
+	for _, o := range s.orders {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestGatewayContract checks the answers the gateway's dashboard relies on.
+// The gateway forwards the customer's own token.
+func TestGatewayContract(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	orgID := 3
+	store := &listStore{orders: []Order{{Order: models.Order{
+		ID: 42, UserID: 7, OrgID: &orgID, Status: StatusPaid, TotalCents: 2500,
+		Items:         []Item{{SKU: "SKU-001", Unit: "each", Quantity: 1, UnitPriceCents: 2500}},
+		InvoiceNumber: "INV-2026-000001", CreatedAt: testfactory.Time, UpdatedAt: testfactory.Time,
+	}}}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, &auth.Principal{UserID: 7, Roles: []string{"customer"}}) })
+	NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+	contracttest.Verify(t, router, contracttest.Load(t, "api-gateway", "order-service"))
+}
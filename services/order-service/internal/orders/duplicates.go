@@ -0,0 +1,226 @@
+package orders
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// Duplicate handling modes.
+const (
+	DuplicatesOff  = "off"
+	DuplicatesWarn = "warn"
+	DuplicatesHold = "hold"
+)
+
+// Duplicates flags orders that repeat one the same user placed within the
+// window. In warn mode the order is created and flagged; in hold mode it is
+// parked as StatusHeldDuplicate until the customer confirms it.
+type Duplicates struct {
+	mode   string
+	window time.Duration
+	now    func() time.Time
+}
+
+func NewDuplicates(mode string, window time.Duration) (*Duplicates, error) {
+	switch mode {
+	case DuplicatesOff, DuplicatesWarn, DuplicatesHold:
+	default:
+		return nil, fmt.Errorf("duplicate mode must be off, warn or hold, got %q", mode)
+	}
+	return &Duplicates{mode: mode, window: window, now: time.Now}, nil
+}
+
+// fingerprint identifies an order by customer and item quantities per
+// SKU and unit, independent of item order. Prices are left out so a repeat at a changed
+// price still counts.
+func fingerprint(userID int, items []Item) string {
+	quantities := map[string]int{}
+	for _, item := range items {
+		quantities[item.SKU+"/"+item.Unit] += item.Quantity
+	}
+	parts := make([]string, 0, len(quantities))
+	for line, qty := range quantities {
+		parts = append(parts, fmt.Sprintf("%s:%d", line, qty))
+	}
+	sort.Strings(parts)
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s", userID, strings.Join(parts, ","))))
+	return hex.EncodeToString(sum[:])
+}
+
+// check fingerprints o and flags it if it duplicates a recent order. It
+// reports whether the order should be held.
+func (d *Duplicates) check(ctx context.Context, store Store, o *Order) (bool, error) {
+	o.Fingerprint = fingerprint(o.UserID, o.Items)
+	if d.mode == DuplicatesOff {
+		return false, nil
+	}
+
+	original, err := store.FindDuplicate(ctx, o.UserID, o.Fingerprint, d.now().Add(-d.window))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	o.DuplicateOf = &original.ID
+	return d.mode == DuplicatesHold, nil
+}
+
+// releaseStatus is the status an order moves to once it is no longer held:
+// pending, or pending_approval when its org's threshold requires it.
+func (h *Handler) releaseStatus(ctx context.Context, o *Order, totalCents int64) (string, error) {
+	if o.OrgID == nil {
+		return StatusPending, nil
+	}
+	threshold, err := h.approvals.threshold(ctx, *o.OrgID)
+	if err != nil {
+		return "", err
+	}
+	if requiresApproval(totalCents, threshold) {
+		return StatusPendingApproval, nil
+	}
+	return StatusPending, nil
+}
+
+// confirm releases a held duplicate the customer says is intentional.
+func (h *Handler) confirm(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	o, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, o.UserID) {
+		return
+	}
+	if o.Status != StatusHeldDuplicate {
+		c.JSON(http.StatusConflict, gin.H{"error": "order is not held as a duplicate"})
+		return
+	}
+
+	status, err := h.releaseStatus(c.Request.Context(), o, o.TotalCents)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ch := Change{Actor: actor(c), Reason: "confirmed by the customer"}
+	if err := h.store.Release(c.Request.Context(), o, status, ch); err != nil {
+		if errors.Is(err, ErrInvalidState) {
+			c.JSON(http.StatusConflict, gin.H{"error": "order is not held as a duplicate"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if o.Status == StatusPendingApproval {
+		h.approvals.requestApproval(c.Request.Context(), o)
+	}
+	h.holdStock(c.Request.Context(), id)
+	hideTags(c, o)
+	c.JSON(http.StatusOK, o)
+}
+
+func (h *Handler) listDuplicates(c *gin.Context) {
+	orders, err := h.store.ListDuplicates(c.Request.Context(), 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": orders})
+}
+
+func (h *Handler) void(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	err := h.store.Void(c.Request.Context(), id, Change{Actor: actor(c), Reason: "voided as a duplicate"})
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "only live orders flagged as duplicates can be voided"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.releaseStock(c.Request.Context(), id)
+	c.JSON(http.StatusOK, gin.H{"id": id, "status": StatusVoided})
+}
+
+// merge folds a duplicate's items into the order it duplicates and voids it.
+// A pending target that crosses its org's approval threshold goes to approval.
+func (h *Handler) merge(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	dup, err := h.store.Get(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if dup.DuplicateOf == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "order is not flagged as a duplicate"})
+		return
+	}
+
+	target, err := h.store.Get(ctx, *dup.DuplicateOf)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status := target.Status
+	if status == StatusPending {
+		if status, err = h.releaseStatus(ctx, target, target.TotalCents+dup.TotalCents); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ch := Change{Actor: actor(c), Reason: fmt.Sprintf("order %d merged into order %d", id, target.ID)}
+	merged, err := h.store.Merge(ctx, id, status, ch)
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "duplicate or its original is no longer live"})
+		return
+	}
+	if errors.Is(err, ErrCurrencyMismatch) {
+		c.JSON(http.StatusConflict, gin.H{"error": "duplicate and its original are in different currencies"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if target.Status != StatusPendingApproval && merged.Status == StatusPendingApproval {
+		h.approvals.requestApproval(ctx, merged)
+	}
+	c.JSON(http.StatusOK, merged)
+}
@@ -0,0 +1,377 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/fields"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/ndjson"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store        Store
+	approvals    *Approvals
+	duplicates   *Duplicates
+	stock        *StockCache
+	products     ProductSource
+	pricing      *Pricing
+	promises     *Promises
+	backInStock  *BackInStock
+	reservations *Reservations
+	refunds      *Refunds
+	emails       *EmailPolicy
+	quotes       *Quotes
+	publisher    events.Publisher
+}
+
+// NewHandler checks new orders against stock when stock is non-nil, and
+// against the product catalog, which prices them, when products is
+// non-nil. New orders are taxed and charged shipping as pricing says, when
+// it is non-nil. They are promised a delivery date when promises is
+// non-nil, and announced on publisher when it is non-nil. Stock held for a
+// user by backInStock, when non-nil, is released when they order it or drop
+// it from their wishlist. New orders reserve their stock through
+// reservations when it is non-nil. Customers may cancel paid orders, and
+// be refunded, when refunds is non-nil. Users must have verified their
+// email to place orders when emails is non-nil. Orders can be quoted, and
+// placed at the quoted price, when quotes is non-nil.
+func NewHandler(store Store, approvals *Approvals, duplicates *Duplicates, stock *StockCache, products ProductSource, pricing *Pricing,
+	promises *Promises, backInStock *BackInStock, reservations *Reservations, refunds *Refunds, emails *EmailPolicy, quotes *Quotes, publisher events.Publisher) *Handler {
+	return &Handler{store: store, approvals: approvals, duplicates: duplicates, stock: stock, products: products, pricing: pricing,
+		promises: promises, backInStock: backInStock, reservations: reservations, refunds: refunds, emails: emails, quotes: quotes, publisher: publisher}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Customers may only see and act on their own orders.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/orders", h.list)
+	router.POST("/orders", h.create)
+	router.POST("/orders/quote", h.quote)
+	router.GET("/orders/search", auth.RequireRole(auth.RoleAdmin), h.search)
+	router.GET("/orders/views", auth.RequireRole(auth.RoleAdmin), h.listViews)
+	router.POST("/orders/views", auth.RequireRole(auth.RoleAdmin), h.saveView)
+	router.DELETE("/orders/views/:id", auth.RequireRole(auth.RoleAdmin), h.deleteView)
+	router.GET("/orders/views/:id/orders", auth.RequireRole(auth.RoleAdmin), h.viewOrders)
+	router.GET("/orders/cancellations/report", auth.RequireRole(auth.RoleAdmin), h.cancellationReport)
+	router.GET("/orders/:id", h.get)
+	router.GET("/orders/:id/history", h.history)
+	router.POST("/orders/:id/confirm", h.confirm)
+	router.POST("/orders/:id/approve", h.approve)
+	router.POST("/orders/:id/reject", h.reject)
+	router.POST("/orders/:id/cancel", h.cancel)
+	router.POST("/orders/:id/ship", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.ship)
+	router.POST("/orders/:id/tags", auth.RequireRole(auth.RoleAdmin), h.addTags)
+	router.DELETE("/orders/:id/tags/:tag", auth.RequireRole(auth.RoleAdmin), h.removeTag)
+	router.GET("/orgs/:id/approval-policy", h.getApprovalPolicy)
+	router.PUT("/orgs/:id/approval-policy", auth.RequireRole(auth.RoleAdmin), h.setApprovalPolicy)
+	router.GET("/users/:id/wishlist", h.listWishlist)
+	router.PUT("/users/:id/wishlist/:sku", h.saveWishlistItem)
+	router.DELETE("/users/:id/wishlist/:sku", h.removeWishlistItem)
+}
+
+// RegisterAdminRoutes mounts duplicate review endpoints on an
+// operator-only group.
+func (h *Handler) RegisterAdminRoutes(admin gin.IRouter) {
+	admin.GET("/duplicates", h.listDuplicates)
+	admin.POST("/orders/:id/merge", h.merge)
+	admin.POST("/orders/:id/void", h.void)
+}
+
+type createRequest struct {
+	UserID int `json:"user_id" binding:"required"`
+	// OrgID is only checked against the user's org, which the order is
+	// placed for either way.
+	OrgID *int   `json:"org_id"`
+	Items []Item `json:"items" binding:"required,min=1,dive"`
+	// Carrier delivers the order; the default carrier when empty.
+	Carrier string `json:"carrier"`
+	// Currency is an ISO 4217 code; the default currency when empty.
+	Currency string `json:"currency"`
+	// QuoteToken places the order at the prices of a quote for it.
+	QuoteToken string `json:"quote_token"`
+}
+
+func (h *Handler) create(c *gin.Context) {
+	var req createRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, req.UserID) {
+		return
+	}
+	if o, ok := h.place(c, req); ok {
+		c.JSON(http.StatusCreated, o)
+	}
+}
+
+// place checks, prices and saves the order req describes, as create and
+// cart checkouts do. It writes the response unless the order is placed.
+func (h *Handler) place(c *gin.Context, req createRequest) (*Order, bool) {
+	if !h.emails.allow(c, req.UserID) {
+		return nil, false
+	}
+	o, ok := h.prepare(c, req)
+	if !ok || !h.resolveOrg(c, req, o) {
+		return nil, false
+	}
+	h.releaseHolds(c.Request.Context(), req.UserID, o.Items)
+	if !h.checkStock(c, o.Items) {
+		return nil, false
+	}
+	if req.QuoteToken != "" {
+		if !h.applyQuote(c, o, req.QuoteToken, req.Carrier) {
+			return nil, false
+		}
+	} else if !h.price(c, o, req.Carrier) {
+		return nil, false
+	}
+
+	hold, err := h.duplicates.check(c.Request.Context(), h.store, o)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if hold {
+		o.Status = StatusHeldDuplicate
+	} else if o.Status, err = h.releaseStatus(c.Request.Context(), o, o.TotalCents); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	ch := Change{Actor: actor(c)}
+	switch {
+	case o.DuplicateOf != nil:
+		ch.Reason = fmt.Sprintf("possible duplicate of order %d", *o.DuplicateOf)
+	case o.Status == StatusPendingApproval:
+		ch.Reason = "total above the organization's approval threshold"
+	}
+	if h.reservations != nil {
+		var ok bool
+		if o.Reservations, ok = h.reservations.reserve(c, o.UserID, o.Items); !ok {
+			return nil, false
+		}
+	}
+	if err := h.store.Create(c.Request.Context(), o, ch); err != nil {
+		h.releaseReserved(c.Request.Context(), o.Reservations)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if o.Status == StatusPendingApproval {
+		h.approvals.requestApproval(c.Request.Context(), o)
+	}
+	h.announce(c.Request.Context(), o)
+
+	if o.DuplicateOf != nil {
+		c.Header("Warning", fmt.Sprintf(`199 order-service "possible duplicate of order %d"`, *o.DuplicateOf))
+	}
+	return o, true
+}
+
+// prepare checks the lines and currency of the order req describes and
+// prices its lines from the catalog, as placing and quoting it both start
+// with. It writes the response when the order cannot be placed.
+func (h *Handler) prepare(c *gin.Context, req createRequest) (*Order, bool) {
+	for i, item := range req.Items {
+		if item.SKU == "" || item.Quantity <= 0 || item.UnitPriceCents < 0 || len(item.Unit) > 32 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "each item needs a sku, a positive quantity and a non-negative unit price"})
+			return nil, false
+		}
+		if item.Unit == "" {
+			req.Items[i].Unit = "each"
+		}
+	}
+	currency := strings.ToUpper(req.Currency)
+	if currency == "" {
+		currency = h.pricing.defaultCurrency()
+	}
+	if !validCurrency(currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "currency must be an ISO 4217 code"})
+		return nil, false
+	}
+	var promise *Promise
+	if h.promises != nil {
+		var err error
+		if promise, err = h.promises.Promise(h.promises.now(), req.Carrier); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "carrier must be one of " + strings.Join(h.promises.Carriers(), ", ")})
+			return nil, false
+		}
+	}
+	factors, ok := h.checkProducts(c, req.Items, currency)
+	if !ok {
+		return nil, false
+	}
+	return &Order{
+		Order: models.Order{
+			UserID:   req.UserID,
+			Status:   StatusPending,
+			Currency: currency,
+			Items:    req.Items,
+		},
+		Promise: promise,
+		factors: factors,
+	}, true
+}
+
+// releaseReserved gives back stock reserved for an order that was not
+// placed.
+func (h *Handler) releaseReserved(ctx context.Context, reserved []OrderReservation) {
+	if h.reservations != nil {
+		h.reservations.release(ctx, reserved)
+	}
+}
+
+// releaseStock gives back the stock reserved for an order that will not be
+// paid.
+func (h *Handler) releaseStock(ctx context.Context, orderID int) {
+	if h.reservations != nil {
+		h.reservations.releaseOrder(ctx, orderID)
+	}
+}
+
+// holdStock keeps an order's stock reserved for another reservation TTL,
+// once it waits on payment again.
+func (h *Handler) holdStock(ctx context.Context, orderID int) {
+	if h.reservations != nil {
+		h.reservations.extendOrder(ctx, orderID)
+	}
+}
+
+// announce publishes an OrderPlaced event. The order is already saved, so a
+// failure is only logged.
+func (h *Handler) announce(ctx context.Context, o *Order) {
+	if h.publisher == nil {
+		return
+	}
+	e, err := events.New(events.OrderPlaced, "order-service", events.OrderPlacement{
+		OrderID:    o.ID,
+		UserID:     o.UserID,
+		Tenant:     tenant.FromContext(ctx),
+		Status:     o.Status,
+		Currency:   o.Currency,
+		TotalCents: o.TotalCents,
+		ItemCount:  len(o.Items),
+	})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish order %d placed: %v", o.ID, err)
+	}
+}
+
+// orderFields are the fields of an order ?fields= may select.
+var orderFields = fields.Allow("id", "user_id", "org_id", "status", "currency", "subtotal_cents", "shipping_cents",
+	"tax_cents", "total_cents", "items", "duplicate_of", "tags", "invoice_number", "delivery_promise", "archived",
+	"created_at", "updated_at")
+
+// list answers the user's 20 most recent orders, or every one of them as
+// NDJSON when the client accepts it. Filtering by tag answers a page of
+// search results either way, with every field.
+func (h *Handler) list(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id query parameter is required"})
+		return
+	}
+	if !auth.AuthorizeUser(c, userID) {
+		return
+	}
+	sel, ok := orderFields.Bind(c)
+	if !ok {
+		return
+	}
+	if tags := c.QueryArray("tag"); len(tags) > 0 {
+		if !seesTags(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can filter by tag"})
+			return
+		}
+		f := Filter{Tags: tags, UserID: &userID}
+		if msg := f.normalize(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		h.respondSearch(c, f, 20)
+		return
+	}
+
+	if ndjson.Accepted(c.Request) {
+		s := ndjson.Start(c)
+		s.Close(h.store.StreamByUser(c.Request.Context(), userID, func(o Order) error {
+			hideTags(c, &o)
+			return s.Write(sel.Apply(o))
+		}))
+		return
+	}
+	orders, err := h.store.ListByUser(c.Request.Context(), userID, 20)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range orders {
+		hideTags(c, &orders[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{"orders": fields.ApplyEach(sel, orders)})
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	sel, ok := orderFields.Bind(c)
+	if !ok {
+		return
+	}
+
+	o, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, o.UserID) {
+		return
+	}
+	hideTags(c, o)
+
+	cachetags.Set(c, cachetags.Order(o.ID), cachetags.User(o.UserID))
+	if etag.NotModified(c, o.Version) {
+		return
+	}
+	c.JSON(http.StatusOK, sel.Apply(o))
+}
+
+func orderTotal(items []Item) int64 {
+	var total int64
+	for _, item := range items {
+		total += int64(item.Quantity) * item.UnitPriceCents
+	}
+	return total
+}
+
+func paramID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return 0, false
+	}
+	return id, true
+}
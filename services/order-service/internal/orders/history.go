@@ -0,0 +1,167 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// Transition is one entry in an order's status history. From is empty for
+// the entry recording the order's creation. Entries are never changed once
+// written.
+type Transition struct {
+	ID        int64     `json:"id"`
+	OrderID   int       `json:"order_id"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Change says who is changing an order's status and why. The store records
+// it with the statuses as a Transition, in the same transaction as the
+// change itself.
+type Change struct {
+	Actor  string
+	Reason string
+}
+
+// transitions is the order state machine. Live orders may transition to
+// their own status when a merge changes their contents; an order whose
+// payment failed can be paid again; customers may cancel any order that is
+// not yet closed, a paid one only until it ships; a cancelled paid order is
+// reopened as paid if its refund fails; rejected and voided orders are
+// final.
+var transitions = map[string][]string{
+	"":                    {StatusPending, StatusPendingApproval, StatusHeldDuplicate},
+	StatusPending:         {StatusPending, StatusPendingApproval, StatusVoided, StatusPaid, StatusPaymentFailed, StatusCancelled},
+	StatusPendingApproval: {StatusPendingApproval, StatusPending, StatusRejected, StatusVoided, StatusCancelled},
+	StatusHeldDuplicate:   {StatusHeldDuplicate, StatusPending, StatusPendingApproval, StatusVoided, StatusCancelled},
+	StatusPaymentFailed:   {StatusPaid, StatusPaymentFailed, StatusCancelled},
+	StatusPaid:            {StatusCancelled},
+	StatusCancelled:       {StatusPaid},
+}
+
+// CanTransition reports whether an order may move from one status to
+// another. An empty from is a new order.
+func CanTransition(from, to string) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func recordTransition(ctx context.Context, tx *sql.Tx, t *Transition) error {
+	if !CanTransition(t.From, t.To) {
+		return ErrInvalidState
+	}
+	const query string = `INSERT INTO order_service.order_status_history (order_id, from_status, to_status, actor, reason, created_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), $6) RETURNING id`
+	return tx.QueryRowContext(ctx, query, t.OrderID, t.From, t.To, t.Actor, t.Reason, t.CreatedAt).Scan(&t.ID)
+}
+
+// transition locks the order, moves it to status and records the change.
+// With from given, the order must currently be in one of those statuses.
+func transition(ctx context.Context, tx *sql.Tx, id int, status string, ch Change, from ...string) (*Transition, error) {
+	const lock string = "SELECT status FROM order_service.orders WHERE id = $1 AND tenant_id = $2 FOR UPDATE"
+	t := &Transition{OrderID: id, To: status, Actor: ch.Actor, Reason: ch.Reason}
+	err := tx.QueryRowContext(ctx, lock, id, tenant.FromContext(ctx)).Scan(&t.From)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(from) > 0 && !contains(from, t.From) {
+		return nil, ErrInvalidState
+	}
+
+	const update string = `UPDATE order_service.orders SET status = $2, updated_at = NOW() WHERE id = $1 RETURNING updated_at`
+	if err := tx.QueryRowContext(ctx, update, id, status).Scan(&t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return t, recordTransition(ctx, tx, t)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PostgresStore) History(ctx context.Context, orderID int) ([]Transition, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT id, order_id, COALESCE(from_status, ''), to_status, actor, COALESCE(reason, ''), created_at
+		FROM order_service.all_order_status_history WHERE order_id = $1 ORDER BY created_at, id`
+	rows, err := s.db.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []Transition{}
+	for rows.Next() {
+		var t Transition
+		if err := rows.Scan(&t.ID, &t.OrderID, &t.From, &t.To, &t.Actor, &t.Reason, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, t)
+	}
+	return history, rows.Err()
+}
+
+// actor identifies the caller in the status history, as user:<id> or
+// service:<name>.
+func actor(c *gin.Context) string {
+	p, ok := auth.FromContext(c)
+	if !ok {
+		return "anonymous"
+	}
+	if p.Service != "" {
+		return "service:" + p.Service
+	}
+	return "user:" + strconv.Itoa(p.UserID)
+}
+
+func (h *Handler) history(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+
+	o, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, o.UserID) {
+		return
+	}
+
+	history, err := h.store.History(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"order_id": id, "status": o.Status, "history": history})
+}
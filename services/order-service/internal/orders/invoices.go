@@ -0,0 +1,62 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// FiscalYear says when the fiscal year invoices are numbered in starts. A fiscal year is named
+// after the calendar year it ends in, so with StartMonth April, April 2026
+// to March 2027 is fiscal year 2027.
+type FiscalYear struct {
+	StartMonth time.Month
+}
+
+// NewFiscalYear returns the fiscal year starting in startMonth, 1 to 12.
+func NewFiscalYear(startMonth int) (FiscalYear, error) {
+	if startMonth < 1 || startMonth > 12 {
+		return FiscalYear{}, fmt.Errorf("fiscal year start month must be 1 to 12, got %d", startMonth)
+	}
+	return FiscalYear{StartMonth: time.Month(startMonth)}, nil
+}
+
+// Of returns the fiscal year t falls in.
+func (f FiscalYear) Of(t time.Time) int {
+	if f.StartMonth > time.January && t.Month() >= f.StartMonth {
+		return t.Year() + 1
+	}
+	return t.Year()
+}
+
+// InvoiceNumber formats the nth invoice of a fiscal year, such as
+// INV-2026-000042.
+func InvoiceNumber(fiscalYear, n int) string {
+	return fmt.Sprintf("INV-%d-%06d", fiscalYear, n)
+}
+
+// issueInvoice gives the order the next number in its tenant's sequence for
+// fiscalYear. The upsert takes a row lock on the sequence that is held until
+// tx ends, so payments completing at once on different replicas queue for
+// it, and a rolled-back payment hands its number back rather than leaving a
+// gap the way a Postgres SEQUENCE would.
+func issueInvoice(ctx context.Context, tx *sql.Tx, orderID, fiscalYear int) (string, error) {
+	const next string = `INSERT INTO order_service.invoice_sequences (tenant_id, fiscal_year, last_number)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (tenant_id, fiscal_year) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+		RETURNING last_number`
+	var n int
+	if err := tx.QueryRowContext(ctx, next, tenant.FromContext(ctx), fiscalYear).Scan(&n); err != nil {
+		return "", err
+	}
+
+	number := InvoiceNumber(fiscalYear, n)
+	const assign string = "UPDATE order_service.orders SET invoice_number = $2 WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, assign, orderID, number); err != nil {
+		return "", err
+	}
+	return number, nil
+}
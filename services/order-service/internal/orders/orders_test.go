@@ -0,0 +1,2094 @@
+package orders
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/redis"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/pkg/tracing"
+	"github.com/alux444/go-microserv-test/pkg/tracing/tracingtest"
+	"github.com/alux444/go-microserv-test/services/order-service/internal/shipping"
+	"github.com/gin-gonic/gin"
+)
+
+func TestOrderTotal(t *testing.T) {
+	items := []Item{
+		{SKU: "A", Quantity: 2, UnitPriceCents: 1500},
+		{SKU: "B", Quantity: 1, UnitPriceCents: 250},
+	}
+	if got := orderTotal(items); got != 3250 {
+		t.Errorf("Expected total 3250, got: %d", got)
+	}
+}
+
+func TestRequiresApproval(t *testing.T) {
+	tests := []struct {
+		total, threshold int64
+		want             bool
+	}{
+		{total: 999, threshold: 1000, want: false},
+		{total: 1000, threshold: 1000, want: false},
+		{total: 1001, threshold: 1000, want: true},
+		{total: 1, threshold: 0, want: true},
+	}
+	for _, tt := range tests {
+		if got := requiresApproval(tt.total, tt.threshold); got != tt.want {
+			t.Errorf("requiresApproval(%d, %d) = %v, want %v", tt.total, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintIgnoresItemOrderAndPrice(t *testing.T) {
+	a := fingerprint(1, []Item{{SKU: "A", Quantity: 2, UnitPriceCents: 100}, {SKU: "B", Quantity: 1}})
+	b := fingerprint(1, []Item{{SKU: "B", Quantity: 1, UnitPriceCents: 999}, {SKU: "A", Quantity: 1}, {SKU: "A", Quantity: 1}})
+	if a != b {
+		t.Errorf("Expected equal fingerprints, got: %s and %s", a, b)
+	}
+	if a == fingerprint(2, []Item{{SKU: "A", Quantity: 2}, {SKU: "B", Quantity: 1}}) {
+		t.Error("Expected different users to have different fingerprints")
+	}
+	if a == fingerprint(1, []Item{{SKU: "A", Quantity: 3}, {SKU: "B", Quantity: 1}}) {
+		t.Error("Expected different quantities to have different fingerprints")
+	}
+	if a == fingerprint(1, []Item{{SKU: "A", Unit: "case", Quantity: 2}, {SKU: "B", Quantity: 1}}) {
+		t.Error("Expected different units to have different fingerprints")
+	}
+}
+
+// duplicateStore implements only FindDuplicate; other Store methods panic.
+type duplicateStore struct {
+	Store
+	original *Order
+	since    time.Time
+}
+
+func (s *duplicateStore) FindDuplicate(ctx context.Context, userID int, fp string, since time.Time) (*Order, error) {
+	s.since = since
+	if s.original == nil || fingerprint(s.original.UserID, s.original.Items) != fp {
+		return nil, ErrNotFound
+	}
+	return s.original, nil
+}
+
+func TestDuplicatesCheck(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	items := []Item{{SKU: "A", Quantity: 1, UnitPriceCents: 100}}
+	original := &Order{Order: models.Order{ID: 7, UserID: 1, Items: items}}
+
+	tests := []struct {
+		mode      string
+		original  *Order
+		wantHold  bool
+		wantDupOf bool
+	}{
+		{mode: DuplicatesOff, original: original},
+		{mode: DuplicatesWarn, original: nil},
+		{mode: DuplicatesWarn, original: original, wantDupOf: true},
+		{mode: DuplicatesHold, original: original, wantHold: true, wantDupOf: true},
+	}
+	for _, tt := range tests {
+		d, err := NewDuplicates(tt.mode, 10*time.Minute)
+		if err != nil {
+			t.Fatalf("Expected valid mode %q, got: %v", tt.mode, err)
+		}
+		d.now = func() time.Time { return now }
+		store := &duplicateStore{original: tt.original}
+		o := &Order{Order: models.Order{UserID: 1, Items: items}}
+
+		hold, err := d.check(context.Background(), store, o)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if hold != tt.wantHold || (o.DuplicateOf != nil) != tt.wantDupOf {
+			t.Errorf("Mode %s: expected hold=%v dup=%v, got hold=%v dup=%v", tt.mode, tt.wantHold, tt.wantDupOf, hold, o.DuplicateOf)
+		}
+		if o.Fingerprint == "" {
+			t.Errorf("Mode %s: expected fingerprint to be set", tt.mode)
+		}
+		if tt.mode != DuplicatesOff && !store.since.Equal(now.Add(-10*time.Minute)) {
+			t.Errorf("Mode %s: expected lookup since %v, got: %v", tt.mode, now.Add(-10*time.Minute), store.since)
+		}
+	}
+
+	if _, err := NewDuplicates("block", time.Minute); err == nil {
+		t.Error("Expected unknown mode to be rejected")
+	}
+}
+
+// getStore implements only Get; other Store methods panic.
+type getStore struct {
+	Store
+	orders map[int]*Order
+}
+
+func (s *getStore) Get(ctx context.Context, id int) (*Order, error) {
+	o, ok := s.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return o, nil
+}
+
+func TestCustomersOnlySeeTheirOwnOrders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &getStore{orders: map[int]*Order{1: {Order: models.Order{ID: 1, UserID: 1}}, 2: {Order: models.Order{ID: 2, UserID: 2}}}}
+
+	tests := []struct {
+		principal *auth.Principal
+		path      string
+		want      int
+	}{
+		{principal: nil, path: "/orders/1", want: http.StatusUnauthorized},
+		{principal: &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}, path: "/orders/1", want: http.StatusOK},
+		{principal: &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}, path: "/orders/2", want: http.StatusForbidden},
+		{principal: &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}, path: "/orders?user_id=2", want: http.StatusForbidden},
+		{principal: &auth.Principal{UserID: 9, Roles: []string{auth.RoleAdmin}}, path: "/orders/2", want: http.StatusOK},
+		{principal: &auth.Principal{Service: "api-gateway", Roles: []string{auth.RoleService}}, path: "/orders/2", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		router := gin.New()
+		if tt.principal != nil {
+			p := tt.principal
+			router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		}
+		NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s as %+v: expected status %d, got: %d", tt.path, tt.principal, tt.want, w.Code)
+		}
+	}
+}
+
+func TestListNDJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &listStore{orders: []Order{{Order: models.Order{ID: 3, UserID: 1, Tags: []string{"vip"}}}, {Order: models.Order{ID: 2, UserID: 1}}, {Order: models.Order{ID: 1, UserID: 1}}}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+	req := httptest.NewRequest(http.MethodGet, "/orders?user_id=1", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || len(lines) != 3 || !strings.HasPrefix(lines[0], `{"id":3,`) {
+		t.Fatalf("Expected an order per line, got: %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "vip") {
+		t.Errorf("Expected tags to be hidden from the customer, got: %s", w.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/orders?user_id=1&fields=id,tags", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); lines[0] != `{"id":3}` {
+		t.Errorf("Expected only the selected fields the customer may see, got: %s", w.Body)
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"", StatusPending, true},
+		{"", StatusHeldDuplicate, true},
+		{"", StatusVoided, false},
+		{StatusHeldDuplicate, StatusPendingApproval, true},
+		{StatusPendingApproval, StatusRejected, true},
+		{StatusPending, StatusRejected, false},
+		{StatusPending, StatusPending, true},
+		{StatusRejected, StatusPending, false},
+		{StatusVoided, StatusPending, false},
+		{StatusVoided, StatusVoided, false},
+		{StatusPending, StatusPaid, true},
+		{StatusPendingApproval, StatusPaid, false},
+		{StatusPaymentFailed, StatusPaid, true},
+		{StatusPaid, StatusPaymentFailed, false},
+		{StatusPaymentFailed, StatusCancelled, true},
+		{StatusPaid, StatusCancelled, true},
+		{StatusCancelled, StatusPaid, true},
+		{StatusCancelled, StatusPending, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%q, %q): expected %v, got: %v", tt.from, tt.to, tt.want, got)
+		}
+	}
+}
+
+type historyStore struct {
+	getStore
+	history []Transition
+}
+
+func (s *historyStore) History(ctx context.Context, orderID int) ([]Transition, error) {
+	return s.history, nil
+}
+
+func TestHistoryIsOwnedByTheCustomer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &historyStore{
+		getStore: getStore{orders: map[int]*Order{1: {Order: models.Order{ID: 1, UserID: 1, Status: StatusPending}}}},
+		history: []Transition{
+			{ID: 1, OrderID: 1, To: StatusHeldDuplicate, Actor: "user:1"},
+			{ID: 2, OrderID: 1, From: StatusHeldDuplicate, To: StatusPending, Actor: "user:1", Reason: "confirmed by the customer"},
+		},
+	}
+
+	for userID, want := range map[int]int{1: http.StatusOK, 2: http.StatusForbidden} {
+		p := &auth.Principal{UserID: userID, Roles: []string{auth.RoleCustomer}}
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders/1/history", nil))
+		if w.Code != want {
+			t.Errorf("User %d: expected status %d, got: %d", userID, want, w.Code)
+		}
+		if want == http.StatusOK && !strings.Contains(w.Body.String(), `"from":"held_duplicate","to":"pending"`) {
+			t.Errorf("Expected the release transition in the history, got: %s", w.Body)
+		}
+	}
+}
+
+type tagStore struct {
+	getStore
+}
+
+func (s *tagStore) AddTags(ctx context.Context, id int, tags []string) ([]string, error) {
+	o := s.orders[id]
+	for _, tag := range tags {
+		if !contains(o.Tags, tag) {
+			o.Tags = append(o.Tags, tag)
+		}
+	}
+	return o.Tags, nil
+}
+
+func TestOrderTags(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	full := make([]string, maxTags)
+	for i := range full {
+		full[i] = "t" + strconv.Itoa(i)
+	}
+	store := &tagStore{getStore{orders: map[int]*Order{
+		1: {Order: models.Order{ID: 1, UserID: 1, Tags: []string{"vip"}}},
+		2: {Order: models.Order{ID: 2, UserID: 1, Tags: full}},
+	}}}
+	admin := &auth.Principal{UserID: 9, Roles: []string{auth.RoleAdmin}}
+	customer := &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+
+	tests := []struct {
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		want      int
+		contains  string
+	}{
+		{principal: customer, method: http.MethodPost, path: "/orders/1/tags", body: `{"tags":["fraud-check"]}`, want: http.StatusForbidden},
+		{principal: admin, method: http.MethodPost, path: "/orders/1/tags", body: `{"tags":["Fraud-Check"," vip"]}`, want: http.StatusOK, contains: `"tags":["vip","fraud-check"]`},
+		{principal: admin, method: http.MethodPost, path: "/orders/1/tags", body: `{"tags":["no spaces"]}`, want: http.StatusBadRequest},
+		{principal: admin, method: http.MethodPost, path: "/orders/2/tags", body: `{"tags":["one-more"]}`, want: http.StatusBadRequest},
+		{principal: admin, method: http.MethodPost, path: "/orders/2/tags", body: `{"tags":["t0"]}`, want: http.StatusOK},
+		{principal: admin, method: http.MethodGet, path: "/orders/1", want: http.StatusOK, contains: `"tags":["vip","fraud-check"]`},
+		{principal: customer, method: http.MethodGet, path: "/orders?user_id=1&tag=vip", want: http.StatusForbidden},
+		{principal: &auth.Principal{Service: "api-gateway", Roles: []string{auth.RoleService}}, method: http.MethodGet, path: "/orders/views", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		p := tt.principal
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%s %s %s: expected status %d, got: %d %s", tt.method, tt.path, tt.body, tt.want, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected body to contain %s, got: %s", tt.method, tt.path, tt.contains, w.Body)
+		}
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, customer) })
+	NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "tags") {
+		t.Errorf("Expected tags to be hidden from the customer, got: %d %s", w.Code, w.Body)
+	}
+}
+
+type countingStock struct {
+	available int
+	maxAge    time.Duration
+	calls     int
+}
+
+func (s *countingStock) GetStockInUnit(ctx context.Context, sku, unit string) (*clients.Stock, error) {
+	s.calls++
+	if sku != "SKU-001" {
+		return nil, &clients.APIError{StatusCode: http.StatusNotFound, Message: "item not found"}
+	}
+	return &clients.Stock{Stock: models.Stock{SKU: sku, Available: s.available}, MaxAge: s.maxAge}, nil
+}
+
+func TestStockCache(t *testing.T) {
+	source := &countingStock{available: 10, maxAge: 30 * time.Second}
+	cache := NewStockCache(source, 10*time.Second)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if n, err := cache.Available(ctx, "SKU-001", "each"); err != nil || n != 10 {
+			t.Fatalf("Expected 10 available, got: %d %v", n, err)
+		}
+	}
+	if source.calls != 1 {
+		t.Errorf("Expected the second read to be cached, got %d calls", source.calls)
+	}
+
+	e, _ := events.New(events.InventoryStockChanged, "inventory-service", events.StockChange{SKU: "SKU-001"})
+	cache.Handle(ctx, e)
+	source.available = 4
+	if n, _ := cache.Available(ctx, "SKU-001", "each"); n != 4 || source.calls != 2 {
+		t.Errorf("Expected a fresh read after a stock change, got: %d after %d calls", n, source.calls)
+	}
+
+	now = now.Add(11 * time.Second)
+	cache.Available(ctx, "SKU-001", "each")
+	if source.calls != 3 {
+		t.Errorf("Expected the max TTL to cap inventory's hint, got %d calls", source.calls)
+	}
+
+	source.maxAge = 0
+	cache.Invalidate("SKU-001")
+	cache.Available(ctx, "SKU-001", "each")
+	cache.Available(ctx, "SKU-001", "each")
+	if source.calls != 5 {
+		t.Errorf("Expected uncacheable answers to be read every time, got %d calls", source.calls)
+	}
+}
+
+func TestCreateChecksStock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	source := &countingStock{available: 3, maxAge: time.Minute}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	NewHandler(&getStore{}, nil, nil, NewStockCache(source, time.Minute), anyCatalog{}, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 2}, {"sku": "SKU-001", "quantity": 2}]}`, http.StatusConflict},
+		{`{"user_id": 1, "items": [{"sku": "SKU-404", "quantity": 1}]}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("POST %s: expected status %d, got: %d %s", tt.body, tt.want, w.Code, w.Body)
+		}
+	}
+}
+
+type createStore struct {
+	Store
+	created *Order
+}
+
+func (s *createStore) Create(ctx context.Context, o *Order, ch Change) error {
+	o.ID = 1
+	s.created = o
+	return nil
+}
+
+// verifiedUsers knows users 1 and 2, and that only user 1 has verified
+// their email.
+type verifiedUsers struct{ err error }
+
+func (u verifiedUsers) GetUsers(ctx context.Context, ids []int) (map[int]clients.User, error) {
+	verifiedAt := time.Now()
+	return map[int]clients.User{1: {ID: 1, VerifiedAt: &verifiedAt}, 2: {ID: 2}}, u.err
+}
+
+func TestCreateRequiresVerifiedEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	users := &verifiedUsers{}
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 99, Roles: []string{auth.RoleAdmin}})
+	})
+	NewHandler(&createStore{}, nil, duplicates, nil, anyCatalog{}, nil, nil, nil, nil, nil, NewEmailPolicy(users), nil, nil).RegisterRoutes(router)
+
+	place := func(userID int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"user_id": %d, "items": [{"sku": "SKU-001", "quantity": 1, "unit_price_cents": 100}]}`, userID)
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		return w
+	}
+	for userID, want := range map[int]int{1: http.StatusCreated, 2: http.StatusForbidden, 3: http.StatusForbidden} {
+		if w := place(userID); w.Code != want {
+			t.Errorf("User %d: expected %d, got: %d %s", userID, want, w.Code, w.Body)
+		}
+	}
+	users.err = errors.New("connection refused")
+	if w := place(1); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected orders to fail while user-service is unreachable, got: %d", w.Code)
+	}
+}
+
+// orgDirectory puts user 1 in org 3, with admin 10, and user 2 in none.
+type orgDirectory struct{ err error }
+
+func (d orgDirectory) GetMembership(ctx context.Context, userID int) (*clients.Membership, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if userID == 1 {
+		orgID := 3
+		return &clients.Membership{UserID: userID, OrgID: &orgID, OrgRole: "member"}, nil
+	}
+	return &clients.Membership{UserID: userID, OrgRole: "member"}, nil
+}
+
+func (orgDirectory) ListOrgAdmins(ctx context.Context, orgID int) ([]clients.User, error) {
+	if orgID != 3 {
+		return []clients.User{}, nil
+	}
+	return []clients.User{{ID: 10, Email: "admin@example.com"}}, nil
+}
+
+type recordingNotifier struct {
+	sent []clients.SendNotificationRequest
+}
+
+func (n *recordingNotifier) Send(ctx context.Context, req clients.SendNotificationRequest) (*clients.Notification, error) {
+	n.sent = append(n.sent, req)
+	return &clients.Notification{}, nil
+}
+
+// approvalStore has no thresholds of its own, so every org gets the default.
+type approvalStore struct{ createStore }
+
+func (s *approvalStore) ApprovalThreshold(ctx context.Context, orgID int) (int64, bool, error) {
+	return 0, false, nil
+}
+
+func TestCreateTakesOrgFromUserService(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	place := func(directory orgDirectory, body string) (*httptest.ResponseRecorder, *approvalStore, *recordingNotifier) {
+		store, notifier := &approvalStore{}, &recordingNotifier{}
+		duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			auth.WithPrincipal(c, &auth.Principal{UserID: 99, Roles: []string{auth.RoleAdmin}})
+		})
+		NewHandler(store, NewApprovals(store, directory, notifier, 50), duplicates, nil, anyCatalog{}, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		return w, store, notifier
+	}
+
+	w, store, notifier := place(orgDirectory{}, `{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 1}]}`)
+	if w.Code != http.StatusCreated || store.created.OrgID == nil || *store.created.OrgID != 3 || store.created.Status != StatusPendingApproval {
+		t.Fatalf("Expected an order leaving its org out to be held for org 3's approval, got: %d %s", w.Code, w.Body)
+	}
+	if len(notifier.sent) != 1 || *notifier.sent[0].UserID != 10 {
+		t.Errorf("Expected org 3's admin to be asked for approval, got: %+v", notifier.sent)
+	}
+
+	w, store, notifier = place(orgDirectory{}, `{"user_id": 1, "org_id": 4, "items": [{"sku": "SKU-001", "quantity": 1}]}`)
+	if w.Code != http.StatusForbidden || store.created != nil || len(notifier.sent) != 0 {
+		t.Errorf("Expected an order naming another org to be refused, got: %d %s, %d notifications", w.Code, w.Body, len(notifier.sent))
+	}
+	if w, _, _ = place(orgDirectory{}, `{"user_id": 2, "org_id": 3, "items": [{"sku": "SKU-001", "quantity": 1}]}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a user outside any org to be refused an org's order, got: %d %s", w.Code, w.Body)
+	}
+	w, store, _ = place(orgDirectory{}, `{"user_id": 1, "org_id": 3, "items": [{"sku": "SKU-001", "quantity": 1}]}`)
+	if w.Code != http.StatusCreated || *store.created.OrgID != 3 {
+		t.Errorf("Expected an order naming the user's own org to be placed, got: %d %s", w.Code, w.Body)
+	}
+	w, store, _ = place(orgDirectory{}, `{"user_id": 2, "items": [{"sku": "SKU-001", "quantity": 1}]}`)
+	if w.Code != http.StatusCreated || store.created.OrgID != nil || store.created.Status != StatusPending {
+		t.Errorf("Expected a user outside any org to order without approval, got: %d %s", w.Code, w.Body)
+	}
+	if w, _, _ = place(orgDirectory{err: errors.New("connection refused")}, `{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 1}]}`); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected orders to fail while user-service is unreachable, got: %d", w.Code)
+	}
+}
+
+func TestCreateOrderTrace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	spans := tracingtest.Record(t)
+
+	inventory := gin.New()
+	inventory.Use(tracing.Middleware("inventory-service"))
+	inventory.GET("/stock/:sku", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"sku": c.Param("sku"), "available": 5, "in_unit": gin.H{"unit": "each", "factor": 1, "available": 5}})
+	})
+	srv := httptest.NewServer(inventory)
+	defer srv.Close()
+
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	stock := NewStockCache(clients.NewInventoryClient(srv.URL, nil), time.Minute)
+	router := gin.New()
+	router.Use(tracing.Middleware("order-service"))
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	NewHandler(&createStore{}, nil, duplicates, stock, anyCatalog{}, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders",
+		strings.NewReader(`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 2}]}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got: %d %s", w.Code, w.Body)
+	}
+
+	create := spans.Span("order-service", "POST /orders")
+	check := spans.Span("inventory-service", "GET /stock/:sku")
+	spans.AssertWithin(check, create)
+	spans.AssertAttribute(create, "http.response.status_code", "201")
+}
+
+// anyCatalog sells every SKU for 100 USD cents each, for tests that are
+// not about pricing.
+type anyCatalog struct{}
+
+func (anyCatalog) GetProduct(ctx context.Context, sku string) (*clients.Product, error) {
+	return &clients.Product{SKU: sku, Name: sku, PriceCents: 100, Currency: "USD", Active: true}, nil
+}
+
+func (anyCatalog) GetUnits(ctx context.Context, sku string) ([]clients.Unit, error) {
+	return []clients.Unit{{Name: "each", Factor: 1}}, nil
+}
+
+type catalogSource map[string]*clients.Product
+
+func (s catalogSource) GetProduct(ctx context.Context, sku string) (*clients.Product, error) {
+	if sku == "SKU-DOWN" {
+		return nil, errors.New("connection refused")
+	}
+	p, ok := s[sku]
+	if !ok {
+		return nil, &clients.APIError{StatusCode: http.StatusNotFound, Message: "product not found"}
+	}
+	return p, nil
+}
+
+func (s catalogSource) GetUnits(ctx context.Context, sku string) ([]clients.Unit, error) {
+	return []clients.Unit{{Name: "each", Factor: 1}, {Name: "case", Factor: 12}}, nil
+}
+
+func TestCreateChecksProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &createStore{}
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	products := catalogSource{
+		"SKU-001": {SKU: "SKU-001", Name: "Widget", PriceCents: 250, Currency: "USD", Active: true},
+		"SKU-002": {SKU: "SKU-002", Name: "Gadget", PriceCents: 100, Currency: "USD", Active: false},
+		"SKU-003": {SKU: "SKU-003", Name: "Gizmo", PriceCents: 900, Currency: "EUR", Active: true},
+	}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	NewHandler(store, nil, duplicates, nil, products, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 1}, {"sku": "SKU-404", "quantity": 1}]}`, http.StatusUnprocessableEntity},
+		{`{"user_id": 1, "items": [{"sku": "SKU-002", "quantity": 1}]}`, http.StatusUnprocessableEntity},
+		{`{"user_id": 1, "items": [{"sku": "SKU-003", "quantity": 1}]}`, http.StatusUnprocessableEntity},
+		{`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 1, "unit": "pallet"}]}`, http.StatusUnprocessableEntity},
+		{`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 1}, {"sku": "SKU-DOWN", "quantity": 1}]}`, http.StatusBadGateway},
+		{`{"user_id": 1, "currency": "eur", "items": [{"sku": "SKU-003", "quantity": 1, "unit_price_cents": 1}]}`, http.StatusCreated},
+		{`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 2, "unit_price_cents": 1}, {"sku": "SKU-001", "quantity": 1, "unit": "case"}]}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("POST %s: expected status %d, got: %d %s", tt.body, tt.want, w.Code, w.Body)
+		}
+	}
+	o := store.created
+	if o.Items[0].Name != "Widget" || o.Items[0].UnitPriceCents != 250 || o.Items[1].UnitPriceCents != 3000 {
+		t.Errorf("Expected lines to be named and priced after their products, got: %+v", o.Items)
+	}
+	if o.Currency != "USD" || o.SubtotalCents != 3500 || o.TotalCents != 3500 {
+		t.Errorf("Expected a USD order totalling 3500, got: %s %d %d", o.Currency, o.SubtotalCents, o.TotalCents)
+	}
+
+	// Without a catalog, the client's prices are never trusted.
+	router = gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	NewHandler(&createStore{}, nil, duplicates, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders",
+		strings.NewReader(`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 1, "unit_price_cents": 1}]}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected orders to be refused without a catalog, got: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &createStore{}
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	products := catalogSource{"SKU-001": {SKU: "SKU-001", Name: "Widget", PriceCents: 250, Currency: "USD", Active: true}}
+	pricing, _ := NewPricing("USD", RateTax{"USD": 1000}, nil)
+	quotes := NewQuotes("quote-secret", 15*time.Minute)
+	now := time.Now()
+	quotes.now = func() time.Time { return now }
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	stock := NewStockCache(&countingStock{available: 3, maxAge: time.Minute}, time.Minute)
+	NewHandler(store, nil, duplicates, stock, products, pricing, nil, nil, nil, nil, nil, quotes, nil).RegisterRoutes(router)
+	send := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := send("/orders/quote", `{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 2}, {"sku": "SKU-001", "quantity": 2}]}`)
+	var q Quote
+	if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a quote, got: %d %s", w.Code, w.Body)
+	}
+	if q.TotalCents != 1100 || q.TaxCents != 100 || q.InStock || q.Items[0].Available == nil || *q.Items[0].Available != 3 {
+		t.Errorf("Expected 1000 plus tax and too little stock, got: %+v", q)
+	}
+	if store.created != nil {
+		t.Error("Expected a quote not to place an order")
+	}
+	if w := send("/orders/quote", `{"user_id": 2, "items": [{"sku": "SKU-001", "quantity": 1}]}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's quote to be forbidden, got: %d", w.Code)
+	}
+
+	w = send("/orders/quote", `{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 2}]}`)
+	json.Unmarshal(w.Body.Bytes(), &q)
+	if !q.InStock || q.Token == "" || !q.ExpiresAt.Equal(now.Add(15*time.Minute).Truncate(time.Second)) {
+		t.Fatalf("Expected an in-stock quote with a token, got: %s", w.Body)
+	}
+	products["SKU-001"].PriceCents = 400
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"user_id": 1, "quote_token": "` + q.Token + `", "items": [{"sku": "SKU-001", "quantity": 3}]}`, http.StatusUnprocessableEntity},
+		{`{"user_id": 1, "quote_token": "` + q.Token + `", "currency": "EUR", "items": [{"sku": "SKU-001", "quantity": 2}]}`, http.StatusUnprocessableEntity},
+		{`{"user_id": 1, "quote_token": "x` + q.Token + `", "items": [{"sku": "SKU-001", "quantity": 2}]}`, http.StatusUnprocessableEntity},
+		{`{"user_id": 1, "quote_token": "` + q.Token + `", "items": [{"sku": "SKU-001", "quantity": 2}]}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if w := send("/orders", tt.body); w.Code != tt.want {
+			t.Errorf("POST %s: expected status %d, got: %d %s", tt.body, tt.want, w.Code, w.Body)
+		}
+	}
+	if o := store.created; o == nil || o.Items[0].UnitPriceCents != 250 || o.TaxCents != 50 || o.TotalCents != 550 {
+		t.Errorf("Expected the order at the quoted prices, got: %+v", o)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if w := send("/orders", `{"user_id": 1, "quote_token": "`+q.Token+`", "items": [{"sku": "SKU-001", "quantity": 2}]}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected an expired quote to be refused, got: %d %s", w.Code, w.Body)
+	}
+}
+
+type fixedQuoter struct {
+	priceCents int64
+	quoted     []shipping.Item
+}
+
+func (q *fixedQuoter) Quote(ctx context.Context, items []shipping.Item, carrier string) ([]shipping.Quote, error) {
+	if carrier != "" && carrier != "standard" {
+		return nil, shipping.ErrUnknownCarrier
+	}
+	q.quoted = items
+	if carrier == "" {
+		return []shipping.Quote{{Carrier: "express", PriceCents: q.priceCents + 400}, {Carrier: "standard", PriceCents: q.priceCents}}, nil
+	}
+	return []shipping.Quote{{Carrier: "standard", PriceCents: q.priceCents}}, nil
+}
+
+func TestPricing(t *testing.T) {
+	if _, err := ParseTaxRates("USD=0,usd=100"); err == nil {
+		t.Error("Expected a currency given twice to be rejected")
+	}
+	for _, spec := range []string{"", "USD", "USD=-1", "USD=10001", "DOLLARS=100"} {
+		if _, err := ParseTaxRates(spec); err == nil {
+			t.Errorf("Expected tax rates %q to be rejected", spec)
+		}
+	}
+	rates, err := ParseTaxRates("usd=825, EUR=2000")
+	if err != nil {
+		t.Fatalf("Expected tax rates to parse, got: %v", err)
+	}
+
+	quoter := &fixedQuoter{priceCents: 599}
+	pricing, err := NewPricing("usd", rates, quoter)
+	if err != nil {
+		t.Fatalf("Expected pricing to be created, got: %v", err)
+	}
+	o := &Order{Order: models.Order{Currency: "USD", Items: []Item{
+		{SKU: "A", Unit: "each", Quantity: 3, UnitPriceCents: 333},
+		{SKU: "B", Unit: "case", Quantity: 2, UnitPriceCents: 1200},
+	}}, factors: map[string]map[string]int{"B": {"case": 6}}}
+	if err := pricing.total(context.Background(), o, ""); err != nil {
+		t.Fatalf("Expected the order to be priced, got: %v", err)
+	}
+	// 8.25% of 3399 is 280.4175. Without a carrier, the cheapest quote
+	// is charged.
+	if o.SubtotalCents != 3399 || o.ShippingCents != 599 || o.TaxCents != 280 || o.TotalCents != 4278 {
+		t.Errorf("Expected 3399 + 599 shipping + 280 tax = 4278, got: %+v", o)
+	}
+	if want := []shipping.Item{{SKU: "A", Quantity: 3}, {SKU: "B", Quantity: 12}}; !reflect.DeepEqual(quoter.quoted, want) {
+		t.Errorf("Expected shipping to be quoted in base units %v, got: %v", want, quoter.quoted)
+	}
+
+	tests := []struct {
+		o       *Order
+		carrier string
+		want    error
+	}{
+		{o: &Order{Order: models.Order{Currency: "EUR", Items: []Item{{SKU: "A", Unit: "each", Quantity: 1}}}}},
+		{o: &Order{Order: models.Order{Currency: "USD", Items: []Item{{SKU: "A", Unit: "case", Quantity: 1}}}}, want: ErrUnknownFactor},
+		{o: &Order{Order: models.Order{Currency: "USD", Items: []Item{{SKU: "A", Unit: "each", Quantity: 1}}}}, carrier: "drone", want: shipping.ErrUnknownCarrier},
+	}
+	for _, tt := range tests {
+		err := pricing.total(context.Background(), tt.o, tt.carrier)
+		var currency *ShippingCurrencyError
+		if tt.want == nil && !errors.As(err, &currency) || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("Pricing %+v: expected error %v, got: %v", tt.o, tt.want, err)
+		}
+	}
+
+	untaxed, _ := NewPricing("GBP", rates, nil)
+	if err := untaxed.total(context.Background(), &Order{Order: models.Order{Currency: "GBP"}}, ""); !errors.Is(err, ErrUnsupportedCurrency) {
+		t.Errorf("Expected a currency without a tax rate to be rejected, got: %v", err)
+	}
+	if err := (*Pricing)(nil).total(context.Background(), o, ""); err != nil || o.TotalCents != 3399 {
+		t.Errorf("Expected no pricing to charge the subtotal only, got: %d %v", o.TotalCents, err)
+	}
+}
+
+type paymentStore struct {
+	Store
+	statuses map[int]string
+	tenants  []string
+	reasons  []string
+	invoices map[string]int
+	issued   []string
+}
+
+func (s *paymentStore) RecordPayment(ctx context.Context, id int, status string, fiscalYear int, ch Change) (string, error) {
+	from, ok := s.statuses[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	if (from != StatusPending && from != StatusPaymentFailed) || !CanTransition(from, status) {
+		return "", ErrInvalidState
+	}
+	s.statuses[id] = status
+	s.tenants = append(s.tenants, tenant.FromContext(ctx))
+	s.reasons = append(s.reasons, ch.Reason)
+	if status != StatusPaid {
+		return "", nil
+	}
+	s.invoices[tenant.FromContext(ctx)]++
+	number := InvoiceNumber(fiscalYear, s.invoices[tenant.FromContext(ctx)])
+	s.issued = append(s.issued, number)
+	return number, nil
+}
+
+func TestFiscalYear(t *testing.T) {
+	tests := []struct {
+		start time.Month
+		at    time.Time
+		want  int
+	}{
+		{start: time.January, at: time.Date(2026, time.December, 31, 23, 0, 0, 0, time.UTC), want: 2026},
+		{start: time.April, at: time.Date(2026, time.March, 31, 0, 0, 0, 0, time.UTC), want: 2026},
+		{start: time.April, at: time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC), want: 2027},
+		{start: time.October, at: time.Date(2026, time.November, 15, 0, 0, 0, 0, time.UTC), want: 2027},
+	}
+	for _, tt := range tests {
+		if got := (FiscalYear{StartMonth: tt.start}).Of(tt.at); got != tt.want {
+			t.Errorf("Fiscal year starting %s, %s: expected %d, got: %d", tt.start, tt.at.Format("2006-01-02"), tt.want, got)
+		}
+	}
+	if _, err := NewFiscalYear(13); err == nil {
+		t.Error("Expected an error for start month 13")
+	}
+	if got := InvoiceNumber(2026, 42); got != "INV-2026-000042" {
+		t.Errorf("Expected INV-2026-000042, got: %s", got)
+	}
+}
+
+func TestPaymentConsumer(t *testing.T) {
+	store := &paymentStore{statuses: map[int]string{4: StatusPending, 5: StatusPendingApproval}, invoices: map[string]int{}}
+	consumer := NewPaymentConsumer(store, FiscalYear{StartMonth: time.April}, nil)
+	handle := func(eventType string, result events.PaymentResult) error {
+		e, _ := events.New(eventType, "payment-service", result)
+		e.OccurredAt = time.Date(2026, time.May, 3, 0, 0, 0, 0, time.UTC)
+		return consumer.Handle(context.Background(), e)
+	}
+
+	if err := handle(events.PaymentFailed, events.PaymentResult{PaymentID: 1, OrderID: 4, Tenant: "acme", Reason: "card declined"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := handle(events.PaymentSucceeded, events.PaymentResult{PaymentID: 2, OrderID: 4, Tenant: "acme"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if store.statuses[4] != StatusPaid {
+		t.Errorf("Expected order 4 to be paid, got: %s", store.statuses[4])
+	}
+	if store.reasons[0] != "payment 1 failed: card declined" || store.tenants[1] != "acme" {
+		t.Errorf("Expected the payments to be recorded in the order's tenant, got: %v in %v", store.reasons, store.tenants)
+	}
+	if len(store.issued) != 1 || store.issued[0] != "INV-2027-000001" {
+		t.Errorf("Expected one invoice in fiscal year 2027, got: %v", store.issued)
+	}
+
+	// Redeliveries and orders that cannot be paid are dropped, not retried.
+	for _, result := range []events.PaymentResult{{PaymentID: 2, OrderID: 4}, {PaymentID: 3, OrderID: 5}, {PaymentID: 4, OrderID: 404}} {
+		if err := handle(events.PaymentSucceeded, result); err != nil {
+			t.Errorf("Expected payment %d to be dropped, got: %v", result.PaymentID, err)
+		}
+	}
+	if store.statuses[5] != StatusPendingApproval {
+		t.Errorf("Expected an unapproved order not to be paid, got: %s", store.statuses[5])
+	}
+}
+
+// reservingInventory reserves from available stock per SKU. Reservations it
+// has expired answer 409, as inventory does.
+type reservingInventory struct {
+	available map[string]int
+	expired   map[int64]bool
+	released  []int64
+	committed []int64
+	nextID    int64
+}
+
+func (f *reservingInventory) ReserveFor(ctx context.Context, sku string, quantity int, unit, reference string, ttl time.Duration) (*clients.Reservation, error) {
+	if f.available[sku] < quantity {
+		return nil, &clients.APIError{StatusCode: http.StatusConflict, Message: "insufficient stock"}
+	}
+	f.available[sku] -= quantity
+	f.nextID++
+	return &clients.Reservation{ID: f.nextID, SKU: sku, Quantity: quantity, Reference: reference}, nil
+}
+
+func (f *reservingInventory) ReleaseReservation(ctx context.Context, id int64) error {
+	if f.expired[id] {
+		return &clients.APIError{StatusCode: http.StatusConflict, Message: "reservation already committed, released or expired"}
+	}
+	f.released = append(f.released, id)
+	return nil
+}
+
+func (f *reservingInventory) CommitReservation(ctx context.Context, id int64) error {
+	f.committed = append(f.committed, id)
+	return nil
+}
+
+func (f *reservingInventory) ExtendReservation(ctx context.Context, id int64, ttl time.Duration) (*clients.Reservation, error) {
+	return &clients.Reservation{ID: id}, nil
+}
+
+type reservationStore struct {
+	cancelStore
+	links   map[int64]int
+	created *Order
+}
+
+func (s *reservationStore) Create(ctx context.Context, o *Order, ch Change) error {
+	o.ID = 1
+	s.created = o
+	return nil
+}
+
+func (s *reservationStore) Reservations(ctx context.Context, orderID int) ([]OrderReservation, error) {
+	var rs []OrderReservation
+	for id, linked := range s.links {
+		if linked == orderID {
+			rs = append(rs, OrderReservation{ReservationID: id, SKU: "SKU-001"})
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ReservationID < rs[j].ReservationID })
+	return rs, nil
+}
+
+func (s *reservationStore) OrderForReservation(ctx context.Context, reservationID int64) (int, error) {
+	id, ok := s.links[reservationID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
+
+func TestCreateReservesStock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	inventory := &reservingInventory{available: map[string]int{"SKU-001": 5}}
+	store := &reservationStore{}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	reservations := NewReservations(store, inventory, nil, time.Minute)
+	NewHandler(store, nil, duplicates, nil, anyCatalog{}, nil, nil, nil, reservations, nil, nil, nil, nil).RegisterRoutes(router)
+	place := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		return w
+	}
+
+	w := place(`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 2}, {"sku": "SKU-002", "quantity": 1}]}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"sku":"SKU-002"`) {
+		t.Fatalf("Expected 409 for SKU-002, got: %d %s", w.Code, w.Body)
+	}
+	if len(inventory.released) != 1 || inventory.released[0] != 1 || store.created != nil {
+		t.Errorf("Expected the SKU-001 reservation to be released and no order saved, got: %v", inventory.released)
+	}
+
+	if w := place(`{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 2}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got: %d %s", w.Code, w.Body)
+	}
+	if store.created == nil || len(store.created.Reservations) != 1 || store.created.Reservations[0].ReservationID != 2 {
+		t.Errorf("Expected the order to keep its reservation, got: %+v", store.created)
+	}
+}
+
+func TestReservationExpiryCancelsOrder(t *testing.T) {
+	store := &reservationStore{
+		cancelStore: cancelStore{
+			getStore: getStore{orders: map[int]*Order{
+				1: {Order: models.Order{ID: 1, UserID: 1, Status: StatusPending, Items: []Item{{SKU: "SKU-001"}, {SKU: "SKU-002"}}}},
+				2: {Order: models.Order{ID: 2, UserID: 1, Status: StatusPaid}},
+			}},
+			cancelled: map[int]*Cancellation{},
+		},
+		links: map[int64]int{1: 1, 2: 1, 3: 2},
+	}
+	inventory := &reservingInventory{expired: map[int64]bool{1: true, 3: true}}
+	publisher := &recordingPublisher{}
+	reservations := NewReservations(store, inventory, publisher, time.Minute)
+	expire := func(id int64) error {
+		e, _ := events.New(events.InventoryReservationExpired, "inventory-service", events.ReservationExpired{ReservationID: id, SKU: "SKU-001", Quantity: 1})
+		return reservations.Handle(context.Background(), e)
+	}
+
+	if err := expire(1); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c := store.cancelled[1]; c == nil || c.Reason != ReasonReservationExpired {
+		t.Fatalf("Expected order 1 to be cancelled for its expired reservation, got: %+v", c)
+	}
+	if len(inventory.released) != 1 || inventory.released[0] != 2 {
+		t.Errorf("Expected the order's other reservation to be released, got: %v", inventory.released)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].Type != events.OrderCancelled {
+		t.Errorf("Expected one order.cancelled event, got: %+v", publisher.published)
+	}
+
+	// Paid orders and reservations no order made are left alone.
+	for _, id := range []int64{3, 99} {
+		if err := expire(id); err != nil {
+			t.Errorf("Expected the expiry of reservation %d to be dropped, got: %v", id, err)
+		}
+	}
+	if store.orders[2].Status != StatusPaid || len(publisher.published) != 1 {
+		t.Errorf("Expected the paid order to stay paid, got: %s", store.orders[2].Status)
+	}
+}
+
+func TestPaymentCommitsReservations(t *testing.T) {
+	inventory := &reservingInventory{}
+	reservations := NewReservations(&reservationStore{links: map[int64]int{7: 4, 8: 4, 9: 5}}, inventory, nil, time.Minute)
+	store := &paymentStore{statuses: map[int]string{4: StatusPending}, invoices: map[string]int{}}
+	consumer := NewPaymentConsumer(store, FiscalYear{StartMonth: time.January}, reservations)
+
+	e, _ := events.New(events.PaymentSucceeded, "payment-service", events.PaymentResult{PaymentID: 1, OrderID: 4})
+	if err := consumer.Handle(context.Background(), e); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(inventory.committed) != 2 || inventory.committed[0] != 7 || inventory.committed[1] != 8 {
+		t.Errorf("Expected the paid order's reservations to be committed, got: %v", inventory.committed)
+	}
+}
+
+type renameStore struct {
+	Store
+	renames []string
+}
+
+func (s *renameStore) RenameSKU(ctx context.Context, sku, survivor string) (int, error) {
+	s.renames = append(s.renames, tenant.FromContext(ctx)+":"+sku+">"+survivor)
+	return 1, nil
+}
+
+func TestSKUMergeConsumer(t *testing.T) {
+	store := &renameStore{}
+	consumer := NewSKUMergeConsumer(store)
+	e, _ := events.New(events.InventorySKUMerged, "inventory-service", events.SKUMerged{SKU: "SKU-002", Survivor: "SKU-001", Tenant: "acme"})
+	if err := consumer.Handle(context.Background(), e); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	e, _ = events.New(events.InventorySKUMerged, "inventory-service", events.SKUMerged{SKU: "SKU-003"})
+	if err := consumer.Handle(context.Background(), e); err != nil {
+		t.Errorf("Expected a merge without a survivor to be dropped, got: %v", err)
+	}
+	if len(store.renames) != 1 || store.renames[0] != "acme:SKU-002>SKU-001" {
+		t.Errorf("Expected one rename in the merge's tenant, got: %v", store.renames)
+	}
+}
+
+type cancelStore struct {
+	getStore
+	cancelled map[int]*Cancellation
+	report    ReportQuery
+}
+
+func (s *cancelStore) Cancel(ctx context.Context, id int, c *Cancellation, ch Change) error {
+	o := s.orders[id]
+	if !contains(cancellable, o.Status) {
+		return ErrInvalidState
+	}
+	o.Status = StatusCancelled
+	c.OrderID, c.CustomerTier, c.CancelledAt = id, TierReturning, time.Now()
+	s.cancelled[id] = c
+	return nil
+}
+
+func (s *cancelStore) CancelPaid(ctx context.Context, id int, c *Cancellation, ch Change) error {
+	o := s.orders[id]
+	if o.Status != StatusPaid || (o.Promise != nil && o.Promise.ShippedAt != nil) {
+		return ErrInvalidState
+	}
+	o.Status = StatusCancelled
+	c.OrderID, c.CustomerTier, c.CancelledAt = id, TierReturning, time.Now()
+	s.cancelled[id] = c
+	return nil
+}
+
+func (s *cancelStore) Reopen(ctx context.Context, id int, status string, ch Change) error {
+	s.orders[id].Status = status
+	delete(s.cancelled, id)
+	return nil
+}
+
+func (s *cancelStore) CancellationReport(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	s.report = q
+	return []ReportRow{{Key: "SKU-001", Reason: ReasonFoundCheaper, Orders: 2, TotalCents: 3998}}, nil
+}
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+func TestCancel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &cancelStore{
+		getStore: getStore{orders: map[int]*Order{
+			1: {Order: models.Order{ID: 1, UserID: 1, Status: StatusPending, TotalCents: 2999, Items: []Item{{SKU: "SKU-001"}, {SKU: "SKU-002"}, {SKU: "SKU-001"}}}},
+			2: {Order: models.Order{ID: 2, UserID: 1, Status: StatusPaid}},
+			3: {Order: models.Order{ID: 3, UserID: 2, Status: StatusPending}},
+		}},
+		cancelled: map[int]*Cancellation{},
+	}
+	publisher := &recordingPublisher{}
+	p := &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+	NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, publisher).RegisterRoutes(router)
+	cancel := func(id int, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/"+strconv.Itoa(id)+"/cancel", strings.NewReader(body)))
+		return w
+	}
+
+	for _, body := range []string{`{}`, `{"reason": "bored"}`, `{"reason": "other", "note": "  "}`} {
+		if w := cancel(1, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got: %d", body, w.Code)
+		}
+	}
+	if w := cancel(3, `{"reason": "changed_mind"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another customer's order to be forbidden, got: %d", w.Code)
+	}
+	if w := cancel(2, `{"reason": "changed_mind"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a paid order to be final, got: %d", w.Code)
+	}
+
+	w := cancel(1, `{"reason": "found_cheaper", "note": "half price elsewhere"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"customer_tier":"returning"`) {
+		t.Fatalf("Expected the order to be cancelled, got: %d %s", w.Code, w.Body.String())
+	}
+	if c := store.cancelled[1]; c == nil || c.Reason != ReasonFoundCheaper || c.Note != "half price elsewhere" {
+		t.Errorf("Expected the reason and note to be recorded, got: %+v", c)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].Type != events.OrderCancelled {
+		t.Fatalf("Expected one order.cancelled event, got: %+v", publisher.published)
+	}
+	var payload events.OrderCancellation
+	if err := publisher.published[0].Decode(&payload); err != nil {
+		t.Fatalf("Failed to decode the event: %v", err)
+	}
+	if payload.Reason != ReasonFoundCheaper || payload.CustomerTier != TierReturning || strings.Join(payload.SKUs, ",") != "SKU-001,SKU-002" {
+		t.Errorf("Expected the reason, tier and distinct SKUs in the event, got: %+v", payload)
+	}
+	if w := cancel(1, `{"reason": "changed_mind"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a cancelled order to be final, got: %d", w.Code)
+	}
+}
+
+type fakeRefunder struct {
+	err      error
+	refunded []int
+}
+
+func (f *fakeRefunder) RefundOrder(ctx context.Context, orderID int, reason string) (*clients.Payment, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.refunded = append(f.refunded, orderID)
+	return &clients.Payment{ID: 7, OrderID: orderID, AmountCents: 2999, Currency: "USD", Status: "refunded"}, nil
+}
+
+type recordingRestocker struct {
+	movements []string
+}
+
+func (r *recordingRestocker) RecordMovement(ctx context.Context, sku string, delta int, unit, reason, reference string) error {
+	r.movements = append(r.movements, fmt.Sprintf("%s %+d %s %s", sku, delta, reason, reference))
+	return nil
+}
+
+func TestCancelPaid(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	shipped := time.Now()
+	store := &reservationStore{
+		cancelStore: cancelStore{
+			getStore: getStore{orders: map[int]*Order{
+				1: {Order: models.Order{ID: 1, UserID: 1, Status: StatusPaid, TotalCents: 2999, Items: []Item{{SKU: "SKU-001", Unit: "each", Quantity: 2}}}},
+				2: {Order: models.Order{ID: 2, UserID: 1, Status: StatusPaid}, Promise: &Promise{ShippedAt: &shipped}},
+			}},
+			cancelled: map[int]*Cancellation{},
+		},
+		links: map[int64]int{1: 1},
+	}
+	payments := &fakeRefunder{err: &clients.APIError{StatusCode: http.StatusBadGateway, Message: "provider unavailable"}}
+	inventory := &recordingRestocker{}
+	notifier := &fakeNotifier{}
+	publisher := &recordingPublisher{}
+	p := &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+	refunds := NewRefunds(store, payments, inventory, fakeUsers{}, notifier)
+	NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, refunds, nil, nil, publisher).RegisterRoutes(router)
+	cancel := func(id int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/"+strconv.Itoa(id)+"/cancel", strings.NewReader(`{"reason": "changed_mind"}`)))
+		return w
+	}
+
+	// A failed refund undoes the restock and reopens the order.
+	if w := cancel(1); w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected the failed refund to be reported, got: %d %s", w.Code, w.Body.String())
+	}
+	if store.orders[1].Status != StatusPaid || store.cancelled[1] != nil || len(publisher.published) != 0 {
+		t.Errorf("Expected the order to stay paid, got: %s %+v", store.orders[1].Status, store.cancelled[1])
+	}
+	if want := "SKU-001 +2 order_cancelled order:1,SKU-001 -2 order_cancel_reverted order:1"; strings.Join(inventory.movements, ",") != want {
+		t.Errorf("Expected the restock to be reverted, got: %v", inventory.movements)
+	}
+
+	payments.err, inventory.movements = nil, nil
+	w := cancel(1)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"refund":{"id":7`) {
+		t.Fatalf("Expected the order to be cancelled and refunded, got: %d %s", w.Code, w.Body.String())
+	}
+	if store.orders[1].Status != StatusCancelled || len(inventory.movements) != 1 || len(notifier.sent) != 1 || notifier.sent[0].Recipient != "user1@example.com" {
+		t.Errorf("Expected the order cancelled, restocked and the customer told, got: %s %v %+v", store.orders[1].Status, inventory.movements, notifier.sent)
+	}
+	var payload events.OrderCancellation
+	if len(publisher.published) != 1 || publisher.published[0].Decode(&payload) != nil || payload.RefundedCents != 2999 {
+		t.Errorf("Expected order.cancelled with the amount refunded, got: %+v", payload)
+	}
+
+	if w := cancel(2); w.Code != http.StatusConflict || len(payments.refunded) != 1 {
+		t.Errorf("Expected a shipped order to be final, got: %d", w.Code)
+	}
+}
+
+func TestCancellationReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &cancelStore{}
+	p := &auth.Principal{UserID: 9, Roles: []string{auth.RoleAdmin}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+	NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	report := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders/cancellations/report"+query, nil))
+		return w
+	}
+
+	w := report("?group_by=sku&from=2026-03-01&to=2026-04-01T00:00:00Z")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"key":"SKU-001","reason":"found_cheaper","orders":2`) {
+		t.Fatalf("Expected the report rows, got: %d %s", w.Code, w.Body.String())
+	}
+	if want := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC); !store.report.From.Equal(want) || store.report.GroupBy != GroupBySKU {
+		t.Errorf("Expected the report from %s by sku, got: %+v", want, store.report)
+	}
+
+	if w := report(""); w.Code != http.StatusOK || store.report.To.Sub(store.report.From) != 30*24*time.Hour || store.report.Period != "day" {
+		t.Errorf("Expected the last 30 days by day by default, got: %d %+v", w.Code, store.report)
+	}
+	for _, query := range []string{"?group_by=colour", "?period=year", "?from=yesterday", "?from=2026-04-01&to=2026-03-01"} {
+		if w := report(query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got: %d", query, w.Code)
+		}
+	}
+
+	p.Roles = []string{auth.RoleCustomer}
+	if w := report(""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be refused the report, got: %d", w.Code)
+	}
+}
+
+func TestCustomerTier(t *testing.T) {
+	tests := []struct {
+		orders int
+		cents  int64
+		want   string
+	}{
+		{0, 0, TierNew},
+		{1, 1999, TierReturning},
+		{2, vipSpendCents, TierVIP},
+	}
+	for _, tt := range tests {
+		if got := customerTier(tt.orders, tt.cents); got != tt.want {
+			t.Errorf("customerTier(%d, %d): expected %s, got: %s", tt.orders, tt.cents, tt.want, got)
+		}
+	}
+}
+
+func newTestPromises(t *testing.T, now time.Time) *Promises {
+	t.Helper()
+	carriers, err := ParseCarriers("standard=3, express=1")
+	if err != nil {
+		t.Fatalf("Failed to parse carriers: %v", err)
+	}
+	p, err := NewPromises("Europe/London", "14:00", carriers)
+	if err != nil {
+		t.Fatalf("Failed to create promises: %v", err)
+	}
+	p.now = func() time.Time { return now }
+	return p
+}
+
+func TestDeliveryPromise(t *testing.T) {
+	p := newTestPromises(t, time.Time{})
+	tests := []struct {
+		placed   time.Time
+		carrier  string
+		wantShip time.Time
+		wantDate string
+	}{
+		// Monday morning ships the same day.
+		{time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC), "", time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC), "2026-03-05"},
+		{time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC), "express", time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC), "2026-03-03"},
+		// Friday after the cutoff, and the weekend, ship on Monday.
+		{time.Date(2026, 3, 6, 15, 0, 0, 0, time.UTC), "", time.Date(2026, 3, 9, 14, 0, 0, 0, time.UTC), "2026-03-12"},
+		{time.Date(2026, 3, 7, 9, 0, 0, 0, time.UTC), "express", time.Date(2026, 3, 9, 14, 0, 0, 0, time.UTC), "2026-03-10"},
+		// After the clocks go forward, 13:30 UTC is past the 14:00 cutoff in London.
+		{time.Date(2026, 3, 30, 13, 30, 0, 0, time.UTC), "express", time.Date(2026, 3, 31, 13, 0, 0, 0, time.UTC), "2026-04-01"},
+	}
+	for _, tt := range tests {
+		got, err := p.Promise(tt.placed, tt.carrier)
+		if err != nil {
+			t.Fatalf("Failed to promise: %v", err)
+		}
+		if !got.ShipBy.Equal(tt.wantShip) || got.PromisedDate != tt.wantDate {
+			t.Errorf("Placed %s with %q: expected to ship by %s for %s, got: %s for %s", tt.placed, tt.carrier, tt.wantShip, tt.wantDate, got.ShipBy, got.PromisedDate)
+		}
+	}
+	if _, err := p.Promise(time.Now(), "pigeon"); !errors.Is(err, ErrUnknownCarrier) {
+		t.Errorf("Expected ErrUnknownCarrier, got: %v", err)
+	}
+	for _, s := range []string{"", "standard", "standard=fast", "=2", "standard=-1"} {
+		if _, err := ParseCarriers(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+	if _, err := NewPromises("Europe/London", "2pm", []Carrier{{Name: "standard"}}); err == nil {
+		t.Error("Expected an invalid cutoff to be rejected")
+	}
+}
+
+func TestCreatePromisesDelivery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &createStore{}
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	promises := newTestPromises(t, time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC))
+	NewHandler(store, nil, duplicates, nil, anyCatalog{}, nil, promises, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"user_id": 1, "carrier": "express", "items": [{"sku": "SKU-001", "quantity": 1}]}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"promised_date":"2026-03-03"`) {
+		t.Fatalf("Expected the promise in the response, got: %d %s", w.Code, w.Body)
+	}
+	if p := store.created.Promise; p == nil || p.Carrier != "express" {
+		t.Errorf("Expected the promise to be saved with the order, got: %+v", p)
+	}
+	if w := post(`{"user_id": 1, "carrier": "pigeon", "items": [{"sku": "SKU-001", "quantity": 1}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown carrier to be rejected, got: %d", w.Code)
+	}
+}
+
+type promiseStore struct {
+	getStore
+	promises map[int]*Promise
+	risks    []PromiseRisk
+	atRisk   map[int]time.Time
+}
+
+func (s *promiseStore) MarkShipped(ctx context.Context, id int, at time.Time) (*Promise, error) {
+	p, ok := s.promises[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if p.ShippedAt != nil {
+		return nil, ErrInvalidState
+	}
+	p.ShippedAt = &at
+	return p, nil
+}
+
+func (s *promiseStore) PromisesAtRisk(ctx context.Context, shipBy time.Time, limit int) ([]PromiseRisk, error) {
+	risks := []PromiseRisk{}
+	for _, r := range s.risks {
+		if _, alerted := s.atRisk[r.OrderID]; !alerted && !r.ShipBy.After(shipBy) && len(risks) < limit {
+			risks = append(risks, r)
+		}
+	}
+	return risks, nil
+}
+
+func (s *promiseStore) MarkPromiseAtRisk(ctx context.Context, orderID int, at time.Time) error {
+	s.atRisk[orderID] = at
+	return nil
+}
+
+func TestShipAlertsWhenLate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	shipBy := time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC)
+	store := &promiseStore{
+		getStore: getStore{orders: map[int]*Order{1: {Order: models.Order{ID: 1, UserID: 1}}, 2: {Order: models.Order{ID: 2, UserID: 2}}, 3: {Order: models.Order{ID: 3, UserID: 3}}}},
+		promises: map[int]*Promise{
+			1: {Carrier: "standard", ShipBy: shipBy, PromisedDate: "2026-03-05"},
+			2: {Carrier: "standard", ShipBy: shipBy, PromisedDate: "2026-03-06"},
+		},
+		atRisk: map[int]time.Time{},
+	}
+	publisher := &recordingPublisher{}
+	p := &auth.Principal{Service: "warehouse", Roles: []string{auth.RoleService}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+	// Shipped on Monday after the cutoff, so the carrier collects on Tuesday.
+	NewHandler(store, nil, nil, nil, nil, nil, newTestPromises(t, shipBy.Add(time.Hour)), nil, nil, nil, nil, nil, publisher).RegisterRoutes(router)
+	ship := func(id int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/"+strconv.Itoa(id)+"/ship", nil))
+		return w
+	}
+
+	if w := ship(1); w.Code != http.StatusOK {
+		t.Fatalf("Expected the order to ship, got: %d %s", w.Code, w.Body)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].Type != events.OrderDeliveryAtRisk {
+		t.Fatalf("Expected one order.delivery_at_risk event, got: %+v", publisher.published)
+	}
+	var payload events.DeliveryAtRisk
+	if err := publisher.published[0].Decode(&payload); err != nil {
+		t.Fatalf("Failed to decode the event: %v", err)
+	}
+	if payload.OrderID != 1 || payload.PromisedDate != "2026-03-05" || payload.ExpectedDate != "2026-03-06" {
+		t.Errorf("Expected the promised and the expected date, got: %+v", payload)
+	}
+	if _, ok := store.atRisk[1]; !ok {
+		t.Error("Expected the promise to be marked at risk")
+	}
+
+	// A day of slack absorbs the late shipment.
+	if w := ship(2); w.Code != http.StatusOK || len(publisher.published) != 1 {
+		t.Errorf("Expected no alert for a shipment still on time, got: %d %d events", w.Code, len(publisher.published))
+	}
+	if w := ship(2); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second shipment to conflict, got: %d", w.Code)
+	}
+	if w := ship(3); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an order without a promise to be not found, got: %d", w.Code)
+	}
+	p.Roles = []string{auth.RoleCustomer}
+	if w := ship(1); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be refused, got: %d", w.Code)
+	}
+}
+
+func TestPromiseMonitor(t *testing.T) {
+	now := time.Date(2026, 3, 2, 13, 0, 0, 0, time.UTC)
+	store := &promiseStore{
+		risks: []PromiseRisk{
+			{OrderID: 1, UserID: 1, Tenant: "acme", Promise: Promise{Carrier: "standard", ShipBy: now.Add(-time.Hour), PromisedDate: "2026-03-05"}},
+			{OrderID: 2, UserID: 2, Tenant: "acme", Promise: Promise{Carrier: "standard", ShipBy: now.Add(time.Hour), PromisedDate: "2026-03-05"}},
+			{OrderID: 3, UserID: 3, Tenant: "acme", Promise: Promise{Carrier: "standard", ShipBy: now.Add(24 * time.Hour), PromisedDate: "2026-03-06"}},
+		},
+		atRisk: map[int]time.Time{},
+	}
+	publisher := &recordingPublisher{}
+	m := NewPromiseMonitor(store, publisher, 2*time.Hour)
+	m.now = func() time.Time { return now }
+	m.batchSize = 1
+
+	alerted, err := m.Sweep(context.Background())
+	if err != nil || alerted != 2 {
+		t.Fatalf("Expected the missed and the near cutoff to be alerted on, got: %d %v", alerted, err)
+	}
+	var payload events.DeliveryAtRisk
+	if err := publisher.published[1].Decode(&payload); err != nil {
+		t.Fatalf("Failed to decode the event: %v", err)
+	}
+	if payload.OrderID != 2 || payload.Tenant != "acme" || !strings.HasPrefix(payload.Reason, "not shipped yet") {
+		t.Errorf("Expected the upcoming cutoff in the alert, got: %+v", payload)
+	}
+	if alerted, _ := m.Sweep(context.Background()); alerted != 0 {
+		t.Errorf("Expected each promise to be alerted on once, got: %d", alerted)
+	}
+}
+
+type archiveStore struct {
+	Store
+	due     []Order
+	before  time.Time
+	batches int
+}
+
+func (s *archiveStore) ArchiveOrders(ctx context.Context, before time.Time, limit int) (int, error) {
+	s.before = before
+	s.batches++
+	n := 0
+	for len(s.due) > 0 && n < limit {
+		s.due = s.due[1:]
+		n++
+	}
+	return n, nil
+}
+
+func TestArchiverSweepsInBatches(t *testing.T) {
+	store := &archiveStore{due: []Order{{Order: models.Order{ID: 1}}, {Order: models.Order{ID: 2}}, {Order: models.Order{ID: 3}}, {Order: models.Order{ID: 4}}}}
+	a := NewArchiver(store, 12, 2)
+	a.now = func() time.Time { return time.Date(2026, 10, 15, 3, 0, 0, 0, time.UTC) }
+
+	archived, err := a.Sweep(context.Background())
+	if err != nil || archived != 4 {
+		t.Fatalf("Expected every due order to be archived, got: %d %v", archived, err)
+	}
+	if store.batches != 3 {
+		t.Errorf("Expected batches until one comes back short, got: %d", store.batches)
+	}
+	if want := time.Date(2025, 10, 15, 3, 0, 0, 0, time.UTC); !store.before.Equal(want) {
+		t.Errorf("Expected orders unchanged for 12 months, got cutoff: %v", store.before)
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	day := func(s string) time.Time {
+		at, _ := time.Parse("2006-01-02", s)
+		return at
+	}
+	var f Filter
+	if err := f.applyQuery("status:pending,paid total>50 total<=100.5 created>=2026-01-01 created<2026-02-01 sku:ABC-1 tag:vip user:7"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(f.Status) != 2 || f.Status[1] != StatusPaid || *f.MinTotalCents != 5001 || *f.MaxTotalCents != 10050 ||
+		!f.CreatedFrom.Equal(day("2026-01-01")) || !f.CreatedBefore.Equal(day("2026-02-01")) ||
+		f.SKU != "ABC-1" || f.Tags[0] != "vip" || *f.UserID != 7 {
+		t.Errorf("Expected every term to apply, got: %+v", f)
+	}
+
+	f = Filter{}
+	if err := f.applyQuery("created:2026-03-01 total:20"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !f.CreatedFrom.Equal(day("2026-03-01")) || !f.CreatedBefore.Equal(day("2026-03-02")) || *f.MinTotalCents != 2000 || *f.MaxTotalCents != 2000 {
+		t.Errorf("Expected exact matches to cover the day and the amount, got: %+v", f)
+	}
+
+	f = Filter{}
+	if err := f.applyQuery("created>2026-03-01T10:00:00Z"); err != nil || !f.CreatedFrom.Equal(time.Date(2026, 3, 1, 10, 0, 0, 1000, time.UTC)) {
+		t.Errorf("Expected a strict bound just after the time, got: %v %v", f.CreatedFrom, err)
+	}
+
+	for _, q := range []string{"pending", "status>pending", "colour:red", "total>5.005", "total>abc", "created<yesterday", "user:me", "sku:"} {
+		f := Filter{}
+		if err := f.applyQuery(q); err == nil {
+			t.Errorf("Expected %q to be rejected", q)
+		}
+	}
+}
+
+type searchStore struct {
+	Store
+	filter Filter
+}
+
+func (s *searchStore) Search(ctx context.Context, f Filter, limit int) ([]Order, error) {
+	s.filter = f
+	return []Order{}, nil
+}
+
+func TestSearchOrders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &searchStore{}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 9, Roles: []string{auth.RoleAdmin}})
+	})
+	NewHandler(store, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	search := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders/search?"+query, nil))
+		return w
+	}
+
+	if w := search("status=pending&min_total_cents=1000&created_before=2026-02-01&sku=ABC-1&q=" + url.QueryEscape("status:paid total<=50")); w.Code != http.StatusOK {
+		t.Fatalf("Expected the search to succeed, got: %d %s", w.Code, w.Body)
+	}
+	f := store.filter
+	if len(f.Status) != 2 || *f.MinTotalCents != 1000 || *f.MaxTotalCents != 5000 || f.CreatedBefore == nil || f.SKU != "ABC-1" {
+		t.Errorf("Expected parameters and query terms combined, got: %+v", f)
+	}
+
+	for _, query := range []string{"min_total_cents=ten", "created_from=next-week", "q=status:shipped", "q=colour:red",
+		"min_total_cents=500&max_total_cents=100", "created_from=2026-02-01&created_before=2026-01-01"} {
+		if w := search(query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected, got: %d", query, w.Code)
+		}
+	}
+}
+
+type wishlistStore struct {
+	createStore
+	items  []*WishlistItem
+	nextID int64
+}
+
+func (s *wishlistStore) find(userID int, sku string) *WishlistItem {
+	for _, it := range s.items {
+		if it.UserID == userID && it.SKU == sku {
+			return it
+		}
+	}
+	return nil
+}
+
+func (s *wishlistStore) SaveWishlistItem(ctx context.Context, it *WishlistItem) error {
+	saved := s.find(it.UserID, it.SKU)
+	if saved == nil {
+		s.nextID++
+		saved = &WishlistItem{ID: s.nextID, UserID: it.UserID, SKU: it.SKU, CreatedAt: time.Now()}
+		s.items = append(s.items, saved)
+	}
+	saved.Notify, saved.Channel = it.Notify, it.Channel
+	if it.Notify {
+		saved.NotifiedAt = nil
+	}
+	*it = *saved
+	return nil
+}
+
+func (s *wishlistStore) ListWishlist(ctx context.Context, userID int) ([]WishlistItem, error) {
+	items := []WishlistItem{}
+	for _, it := range s.items {
+		if it.UserID == userID {
+			items = append(items, *it)
+		}
+	}
+	return items, nil
+}
+
+func (s *wishlistStore) RemoveWishlistItem(ctx context.Context, userID int, sku string) (*WishlistItem, error) {
+	for i, it := range s.items {
+		if it.UserID == userID && it.SKU == sku {
+			s.items = append(s.items[:i], s.items[i+1:]...)
+			return it, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *wishlistStore) ClaimWaiting(ctx context.Context, sku string, limit int) ([]WishlistItem, error) {
+	var claimed []WishlistItem
+	for _, it := range s.items {
+		if it.SKU == sku && it.Notify && it.NotifiedAt == nil && len(claimed) < limit {
+			now := time.Now()
+			it.NotifiedAt = &now
+			claimed = append(claimed, *it)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *wishlistStore) RearmWishlistItem(ctx context.Context, id int64) error {
+	for _, it := range s.items {
+		if it.ID == id {
+			it.NotifiedAt = nil
+		}
+	}
+	return nil
+}
+
+func (s *wishlistStore) SetHold(ctx context.Context, id, reservationID int64, expiresAt time.Time) error {
+	for _, it := range s.items {
+		if it.ID == id {
+			it.holdID, it.HeldUntil = &reservationID, &expiresAt
+		}
+	}
+	return nil
+}
+
+func (s *wishlistStore) takeHolds(match func(*WishlistItem) bool) []Hold {
+	holds := []Hold{}
+	for _, it := range s.items {
+		if it.holdID != nil && match(it) {
+			holds = append(holds, Hold{ItemID: it.ID, UserID: it.UserID, SKU: it.SKU, ReservationID: *it.holdID})
+			it.holdID, it.HeldUntil = nil, nil
+		}
+	}
+	return holds
+}
+
+func (s *wishlistStore) TakeHolds(ctx context.Context, userID int, skus []string) ([]Hold, error) {
+	return s.takeHolds(func(it *WishlistItem) bool {
+		for _, sku := range skus {
+			if it.UserID == userID && it.SKU == sku {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (s *wishlistStore) TakeExpiredHolds(ctx context.Context, now time.Time, limit int) ([]Hold, error) {
+	return s.takeHolds(func(it *WishlistItem) bool { return !it.HeldUntil.After(now) }), nil
+}
+
+// fakeInventory has available units of SKU-001 and reserves them one by
+// one.
+type fakeInventory struct {
+	available int
+	released  []int64
+	nextID    int64
+}
+
+func (f *fakeInventory) GetStock(ctx context.Context, sku string) (*clients.Stock, error) {
+	if sku != "SKU-001" {
+		return nil, &clients.APIError{StatusCode: http.StatusNotFound, Message: "item not found"}
+	}
+	return &clients.Stock{Stock: models.Stock{SKU: sku, Name: "Widget", Available: f.available}}, nil
+}
+
+func (f *fakeInventory) Reserve(ctx context.Context, sku string, quantity int, reference string) (*clients.Reservation, error) {
+	if f.available < quantity {
+		return nil, &clients.APIError{StatusCode: http.StatusConflict, Message: "insufficient stock"}
+	}
+	f.available -= quantity
+	f.nextID++
+	return &clients.Reservation{ID: f.nextID, SKU: sku, Quantity: quantity, Reference: reference}, nil
+}
+
+func (f *fakeInventory) ReleaseReservation(ctx context.Context, id int64) error {
+	f.available++
+	f.released = append(f.released, id)
+	return nil
+}
+
+type fakeUsers struct{}
+
+func (fakeUsers) GetUsers(ctx context.Context, ids []int) (map[int]clients.User, error) {
+	users := map[int]clients.User{}
+	for _, id := range ids {
+		users[id] = clients.User{ID: id, Email: "user" + strconv.Itoa(id) + "@example.com"}
+	}
+	return users, nil
+}
+
+type fakeNotifier struct {
+	sent    []clients.SendNotificationRequest
+	failFor string
+}
+
+func (n *fakeNotifier) Send(ctx context.Context, req clients.SendNotificationRequest) (*clients.Notification, error) {
+	if req.Recipient == n.failFor {
+		return nil, errors.New("notification-service unavailable")
+	}
+	n.sent = append(n.sent, req)
+	return &clients.Notification{ID: len(n.sent)}, nil
+}
+
+func TestWishlist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &wishlistStore{}
+	inventory := &fakeInventory{available: 1}
+	backInStock := NewBackInStock(store, inventory, fakeUsers{}, &fakeNotifier{}, time.Minute)
+	products := catalogSource{"SKU-001": {SKU: "SKU-001", Name: "Widget", Currency: "USD", Active: true}}
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	})
+	NewHandler(store, nil, duplicates, nil, products, nil, nil, backInStock, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := send(http.MethodPut, "/users/1/wishlist/SKU-001", `{"notify": true}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"channel":"email"`) {
+		t.Fatalf("Expected the item saved with email alerts, got: %d %s", w.Code, w.Body)
+	}
+	for path, want := range map[string]int{
+		"/users/2/wishlist/SKU-001": http.StatusForbidden,
+		"/users/1/wishlist/SKU-404": http.StatusUnprocessableEntity,
+	} {
+		if w := send(http.MethodPut, path, `{}`); w.Code != want {
+			t.Errorf("PUT %s: expected %d, got: %d %s", path, want, w.Code, w.Body)
+		}
+	}
+	if w := send(http.MethodPut, "/users/1/wishlist/SKU-001", `{"notify": true, "channel": "SMS!"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid channel to be rejected, got: %d", w.Code)
+	}
+
+	if _, err := backInStock.Restocked(context.Background(), "SKU-001"); err != nil || store.items[0].holdID == nil {
+		t.Fatalf("Expected a unit held for the user, got: %+v %v", store.items[0], err)
+	}
+	if w := send(http.MethodGet, "/users/1/wishlist", ""); !strings.Contains(w.Body.String(), `"held_until"`) {
+		t.Errorf("Expected the wishlist to show the hold, got: %s", w.Body)
+	}
+
+	// Ordering the SKU gives the held unit back first, so the order is not
+	// checked against stock the user's own hold took.
+	if w := send(http.MethodPost, "/orders", `{"user_id": 1, "items": [{"sku": "SKU-001", "quantity": 1}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the order to be created, got: %d %s", w.Code, w.Body)
+	}
+	if len(inventory.released) != 1 || store.items[0].holdID != nil {
+		t.Errorf("Expected the hold released on checkout, got: %v", inventory.released)
+	}
+
+	if w := send(http.MethodDelete, "/users/1/wishlist/SKU-001", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got: %d", w.Code)
+	}
+	if w := send(http.MethodDelete, "/users/1/wishlist/SKU-001", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a missing item to be 404, got: %d", w.Code)
+	}
+}
+
+func TestBackInStock(t *testing.T) {
+	store := &wishlistStore{}
+	ctx := context.Background()
+	for userID := 1; userID <= 3; userID++ {
+		store.SaveWishlistItem(ctx, &WishlistItem{UserID: userID, SKU: "SKU-001", Notify: true, Channel: "email"})
+	}
+	store.SaveWishlistItem(ctx, &WishlistItem{UserID: 4, SKU: "SKU-001", Channel: "email"})
+	inventory := &fakeInventory{}
+	notifier := &fakeNotifier{failFor: "user3@example.com"}
+	b := NewBackInStock(store, inventory, fakeUsers{}, notifier, 15*time.Minute)
+
+	if n, err := b.Restocked(ctx, "SKU-001"); n != 0 || err != nil || len(notifier.sent) != 0 {
+		t.Fatalf("Expected no alerts while out of stock, got: %d %v", n, err)
+	}
+	if n, err := b.Restocked(ctx, "SKU-404"); n != 0 || err != nil {
+		t.Errorf("Expected an unknown SKU to be dropped, got: %d %v", n, err)
+	}
+
+	inventory.available = 1
+	n, err := b.Restocked(ctx, "SKU-001")
+	if err != nil || n != 2 {
+		t.Fatalf("Expected users 1 and 2 alerted, got: %d %v", n, err)
+	}
+	first := notifier.sent[0]
+	if *first.UserID != 1 || first.Type != typeBackInStock || first.Channel != "email" || !strings.Contains(first.Body, "holding one for you") {
+		t.Errorf("Expected user 1 alerted with a hold, got: %+v", first)
+	}
+	if strings.Contains(notifier.sent[1].Body, "holding") || store.items[1].holdID != nil {
+		t.Errorf("Expected no hold for user 2 once stock ran out, got: %+v", notifier.sent[1])
+	}
+	if store.items[2].NotifiedAt != nil || store.items[3].NotifiedAt != nil {
+		t.Error("Expected the failed alert re-armed and the item without notify left alone")
+	}
+
+	if n, _ := b.Restocked(ctx, "SKU-001"); n != 0 {
+		t.Errorf("Expected alerted users not to be alerted again, got: %d", n)
+	}
+
+	b.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if err := b.Job()(ctx); err != nil || len(inventory.released) != 1 || inventory.available != 1 {
+		t.Errorf("Expected the expired hold released, got: %v %v", inventory.released, err)
+	}
+}
+
+func TestCart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &createStore{}
+	duplicates, _ := NewDuplicates(DuplicatesOff, time.Minute)
+	products := catalogSource{
+		"SKU-001": {SKU: "SKU-001", Name: "Widget", PriceCents: 250, Currency: "USD", Active: true},
+		"SKU-002": {SKU: "SKU-002", Name: "Gadget", PriceCents: 100, Currency: "USD", Active: false},
+	}
+	carts := NewMemoryCartStore(time.Hour)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+		}
+	})
+	NewCartHandler(carts, NewHandler(store, nil, duplicates, nil, products, nil, nil, nil, nil, nil, nil, nil, nil)).RegisterRoutes(router)
+	send := func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	signedIn := []string{"Authorization", "Bearer user"}
+
+	// A guest is given a cart with their first item.
+	w := send(http.MethodPost, "/cart/items", `{"sku": "SKU-001", "quantity": 2}`)
+	guest := w.Header().Get(CartHeader)
+	if w.Code != http.StatusOK || !guestCartID.MatchString(guest) {
+		t.Fatalf("Expected a new guest cart, got: %d %q %s", w.Code, guest, w.Body)
+	}
+	if w := send(http.MethodPost, "/cart/items", `{"sku": "SKU-001", "quantity": 1}`, CartHeader, guest); !strings.Contains(w.Body.String(), `"quantity":3`) {
+		t.Errorf("Expected adding a SKU again to add to its quantity, got: %s", w.Body)
+	}
+	if w := send(http.MethodPut, "/cart/items/SKU-009", `{"quantity": 1}`, CartHeader, guest); w.Code != http.StatusOK {
+		t.Errorf("Expected an item to be set, got: %d %s", w.Code, w.Body)
+	}
+	if w := send(http.MethodDelete, "/cart/items/SKU-009", "", CartHeader, guest); w.Code != http.StatusOK {
+		t.Errorf("Expected the item removed, got: %d %s", w.Code, w.Body)
+	}
+	if w := send(http.MethodDelete, "/cart/items/SKU-009", "", CartHeader, guest); w.Code != http.StatusNotFound {
+		t.Errorf("Expected removing a missing item to 404, got: %d", w.Code)
+	}
+	if w := send(http.MethodGet, "/cart", "", CartHeader, "user-1"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a guest not to name a user's cart, got: %d", w.Code)
+	}
+	if w := send(http.MethodPost, "/cart/checkout", "", CartHeader, guest); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a guest checkout to be refused, got: %d", w.Code)
+	}
+
+	// Signing in merges the guest cart into the user's.
+	send(http.MethodPut, "/cart/items/SKU-001", `{"quantity": 1}`, signedIn...)
+	send(http.MethodPut, "/cart/items/SKU-002", `{"quantity": 1}`, signedIn...)
+	w = send(http.MethodPost, "/cart/merge", `{"cart_id": "`+guest+`"}`, signedIn...)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"sku":"SKU-001","unit":"each","quantity":4`) {
+		t.Fatalf("Expected the quantities merged, got: %d %s", w.Code, w.Body)
+	}
+	if w := send(http.MethodGet, "/cart", "", CartHeader, guest); strings.Contains(w.Body.String(), "SKU-001") {
+		t.Errorf("Expected the guest cart deleted, got: %s", w.Body)
+	}
+
+	// Checkout goes through order placement, which refuses the inactive
+	// product and leaves the cart as it was.
+	if w := send(http.MethodPost, "/cart/checkout", "", signedIn...); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected the inactive product to fail checkout, got: %d %s", w.Code, w.Body)
+	}
+	send(http.MethodDelete, "/cart/items/SKU-002", "", signedIn...)
+	w = send(http.MethodPost, "/cart/checkout", `{"currency": "usd"}`, signedIn...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the cart placed as an order, got: %d %s", w.Code, w.Body)
+	}
+	if o := store.created; o.UserID != 1 || len(o.Items) != 1 || o.Items[0].Quantity != 4 || o.TotalCents != 1000 {
+		t.Errorf("Expected an order for the cart priced from the catalog, got: %+v", o)
+	}
+	if w := send(http.MethodPost, "/cart/checkout", "", signedIn...); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected the cart emptied by checkout, got: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMemoryCartStoreExpires(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	carts := NewMemoryCartStore(time.Hour)
+	carts.now = func() time.Time { return now }
+	carts.Put(ctx, "user-1", CartItem{SKU: "SKU-001", Unit: "each", Quantity: 1})
+	if cart, _ := carts.Get(tenant.NewContext(ctx, "acme"), "user-1"); len(cart.Items) != 0 {
+		t.Errorf("Expected carts to be kept per tenant, got: %+v", cart)
+	}
+	now = now.Add(time.Hour)
+	if cart, _ := carts.Get(ctx, "user-1"); len(cart.Items) != 0 {
+		t.Errorf("Expected the cart to expire, got: %+v", cart)
+	}
+}
+
+// fakeRedis answers HSET, HGETALL, HDEL, EXPIRE and DEL, and records EXPIRE
+// calls.
+func fakeRedis(t *testing.T) (addr string, expires func() []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	hashes := map[string]map[string]string{}
+	var expired []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					reply, err := redis.ReadReply(r)
+					if err != nil {
+						return
+					}
+					args := []string{}
+					for _, a := range reply.([]any) {
+						args = append(args, a.(string))
+					}
+					mu.Lock()
+					hash := hashes[args[1]]
+					switch args[0] {
+					case "HGETALL":
+						fmt.Fprintf(conn, "*%d\r\n", 2*len(hash))
+						for k, v := range hash {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+						}
+					case "HSET":
+						if hash == nil {
+							hash = map[string]string{}
+							hashes[args[1]] = hash
+						}
+						hash[args[2]] = args[3]
+						fmt.Fprint(conn, ":1\r\n")
+					case "HDEL":
+						_, ok := hash[args[2]]
+						delete(hash, args[2])
+						if ok {
+							fmt.Fprint(conn, ":1\r\n")
+						} else {
+							fmt.Fprint(conn, ":0\r\n")
+						}
+					case "EXPIRE":
+						expired = append(expired, args[1]+" "+args[2])
+						fmt.Fprint(conn, ":1\r\n")
+					case "DEL":
+						delete(hashes, args[1])
+						fmt.Fprint(conn, ":1\r\n")
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), expired...)
+	}
+}
+
+func TestRedisCartStore(t *testing.T) {
+	ctx := tenant.NewContext(context.Background(), "acme")
+	addr, expires := fakeRedis(t)
+	carts := NewRedisCartStore(redis.NewClient(addr, ""), 2*time.Hour)
+
+	added := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := carts.Put(ctx, "user-1", CartItem{SKU: "SKU-002", Unit: "case", Quantity: 2, AddedAt: added.Add(time.Minute)}); err != nil {
+		t.Fatalf("Expected HSET to succeed, got: %v", err)
+	}
+	carts.Put(ctx, "user-1", CartItem{SKU: "SKU-001", Unit: "each", Quantity: 1, AddedAt: added})
+	cart, err := carts.Get(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("Expected HGETALL to succeed, got: %v", err)
+	}
+	if len(cart.Items) != 2 || cart.Items[0].SKU != "SKU-001" || cart.Items[1].Unit != "case" || !cart.Items[0].AddedAt.Equal(added) {
+		t.Errorf("Expected both items back in the order they were added, got: %+v", cart.Items)
+	}
+	if got := expires(); len(got) != 2 || got[0] != "cart:acme:user-1 7200" {
+		t.Errorf("Expected every write to push the cart's expiry out, got: %v", got)
+	}
+	if err := carts.Remove(ctx, "user-1", "SKU-404"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing SKU, got: %v", err)
+	}
+	if err := carts.Delete(ctx, "user-1"); err != nil {
+		t.Fatalf("Expected DEL to succeed, got: %v", err)
+	}
+	if cart, _ := carts.Get(ctx, "user-1"); len(cart.Items) != 0 {
+		t.Errorf("Expected an empty cart after delete, got: %+v", cart.Items)
+	}
+}
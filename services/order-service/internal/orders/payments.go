@@ -0,0 +1,81 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+const paymentsQueue = "order-service.payments"
+
+// PaymentConsumer marks orders paid or payment_failed from payment-service's
+// events, invoicing paid orders in the fiscal year the payment completed.
+// The stock reserved for a paid order is committed through reservations
+// when it is non-nil.
+type PaymentConsumer struct {
+	store        Store
+	fiscalYear   FiscalYear
+	reservations *Reservations
+}
+
+func NewPaymentConsumer(store Store, fiscalYear FiscalYear, reservations *Reservations) *PaymentConsumer {
+	return &PaymentConsumer{store: store, fiscalYear: fiscalYear, reservations: reservations}
+}
+
+// Run consumes payment events until ctx is cancelled.
+func (p *PaymentConsumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, paymentsQueue, []string{events.PaymentSucceeded, events.PaymentFailed}, p.Handle)
+}
+
+// Handle drops events for orders that are gone or cannot take the payment,
+// such as a redelivered success for an order already paid; retrying them
+// cannot help.
+func (p *PaymentConsumer) Handle(ctx context.Context, e events.Event) error {
+	var result events.PaymentResult
+	if err := e.Decode(&result); err != nil {
+		log.Printf("Dropping malformed payment event %s: %v", e.ID, err)
+		return nil
+	}
+
+	status := StatusPaid
+	ch := Change{Actor: "service:payment-service", Reason: fmt.Sprintf("payment %d succeeded", result.PaymentID)}
+	switch e.Type {
+	case events.PaymentSucceeded:
+	case events.PaymentFailed:
+		status = StatusPaymentFailed
+		ch.Reason = fmt.Sprintf("payment %d failed", result.PaymentID)
+		if result.Reason != "" {
+			ch.Reason += ": " + result.Reason
+		}
+	default:
+		return nil
+	}
+
+	if result.Tenant != "" {
+		ctx = tenant.NewContext(ctx, result.Tenant)
+	}
+	completed := e.OccurredAt
+	if completed.IsZero() {
+		completed = time.Now()
+	}
+	invoice, err := p.store.RecordPayment(ctx, result.OrderID, status, p.fiscalYear.Of(completed), ch)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidState) {
+		log.Printf("Dropping payment %d for order %d: %v", result.PaymentID, result.OrderID, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if invoice != "" {
+		log.Printf("Issued invoice %s for order %d", invoice, result.OrderID)
+	}
+	if status == StatusPaid && p.reservations != nil {
+		p.reservations.commitOrder(ctx, result.OrderID)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/services/order-service/internal/shipping"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCurrency is the currency of orders placed without one when no
+// other default is configured.
+const DefaultCurrency = "USD"
+
+var (
+	// ErrUnsupportedCurrency is returned by a TaxCalculator that cannot tax
+	// orders in the order's currency.
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	// ErrUnknownFactor is returned when shipping is quoted for a line whose
+	// unit was not resolved to base units against the catalog.
+	ErrUnknownFactor = errors.New("unit not resolved to base units")
+)
+
+// validCurrency reports whether code looks like an ISO 4217 code.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// TaxCalculator works out the tax on an order, in the minor unit of its
+// currency. It is called with Currency, Items, SubtotalCents and
+// ShippingCents filled in.
+type TaxCalculator interface {
+	Tax(ctx context.Context, o *Order) (int64, error)
+}
+
+// RateTax charges a flat rate on the subtotal, in basis points, per
+// currency. Shipping is not taxed. Orders in a currency without a rate are
+// ErrUnsupportedCurrency, so the rates double as the currencies accepted.
+type RateTax map[string]int64
+
+// ParseTaxRates parses "currency=basis points" pairs separated by commas,
+// e.g. "USD=0,EUR=2000" for no tax on dollars and 20% on euros.
+func ParseTaxRates(s string) (RateTax, error) {
+	rates := RateTax{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(part, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		bps, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if !ok || !validCurrency(code) || err != nil || bps < 0 || bps > 10000 {
+			return nil, fmt.Errorf("invalid tax rate %q, want currency=basis points", part)
+		}
+		if _, ok := rates[code]; ok {
+			return nil, fmt.Errorf("tax rate for %s given twice", code)
+		}
+		rates[code] = bps
+	}
+	if len(rates) == 0 {
+		return nil, errors.New("no tax rates configured")
+	}
+	return rates, nil
+}
+
+// Tax rounds half cents up.
+func (t RateTax) Tax(ctx context.Context, o *Order) (int64, error) {
+	bps, ok := t[o.Currency]
+	if !ok {
+		return 0, ErrUnsupportedCurrency
+	}
+	return (o.SubtotalCents*bps + 5000) / 10000, nil
+}
+
+// ShippingQuoter prices shipping items in base units with a carrier, or
+// with every carrier when carrier is empty.
+type ShippingQuoter interface {
+	Quote(ctx context.Context, items []shipping.Item, carrier string) ([]shipping.Quote, error)
+}
+
+var _ ShippingQuoter = (*shipping.Quoter)(nil)
+
+// ShippingCurrencyError is returned for an order in another currency than
+// the shipping rates.
+type ShippingCurrencyError struct {
+	Currency string
+}
+
+func (e *ShippingCurrencyError) Error() string {
+	return "shipping is only quoted in " + e.Currency
+}
+
+// Pricing works out an order's totals from its lines, leaving nothing to
+// the client but what it orders.
+type Pricing struct {
+	currency string
+	tax      TaxCalculator
+	shipping ShippingQuoter
+}
+
+// NewPricing prices orders placed without a currency in currency. Orders
+// are taxed when tax is non-nil and charged shipping, quoted in currency,
+// when shipping is non-nil.
+func NewPricing(currency string, tax TaxCalculator, shipping ShippingQuoter) (*Pricing, error) {
+	currency = strings.ToUpper(currency)
+	if !validCurrency(currency) {
+		return nil, fmt.Errorf("invalid currency %q, want an ISO 4217 code", currency)
+	}
+	return &Pricing{currency: currency, tax: tax, shipping: shipping}, nil
+}
+
+// total fills in o's subtotal, shipping, tax and grand total. Shipping is
+// charged for one parcel with carrier, or with the cheapest carrier when
+// empty.
+func (p *Pricing) total(ctx context.Context, o *Order, carrier string) error {
+	o.SubtotalCents = orderTotal(o.Items)
+	o.ShippingCents, o.TaxCents = 0, 0
+	if p != nil && p.shipping != nil {
+		if o.Currency != p.currency {
+			return &ShippingCurrencyError{Currency: p.currency}
+		}
+		items := make([]shipping.Item, len(o.Items))
+		for i, item := range o.Items {
+			factor := o.factor(item)
+			if factor == 0 {
+				return fmt.Errorf("%s in %s: %w", item.SKU, item.Unit, ErrUnknownFactor)
+			}
+			items[i] = shipping.Item{SKU: item.SKU, Quantity: item.Quantity * factor}
+		}
+		quotes, err := p.shipping.Quote(ctx, items, carrier)
+		if err != nil {
+			return err
+		}
+		o.ShippingCents = quotes[0].PriceCents
+		for _, q := range quotes[1:] {
+			o.ShippingCents = min(o.ShippingCents, q.PriceCents)
+		}
+	}
+	if p != nil && p.tax != nil {
+		tax, err := p.tax.Tax(ctx, o)
+		if err != nil {
+			return err
+		}
+		o.TaxCents = tax
+	}
+	o.TotalCents = o.SubtotalCents + o.ShippingCents + o.TaxCents
+	return nil
+}
+
+// defaultCurrency is the currency of orders placed without one.
+func (p *Pricing) defaultCurrency() string {
+	if p == nil {
+		return DefaultCurrency
+	}
+	return p.currency
+}
+
+// price works out o's totals, writing the response when it cannot be
+// priced. Shipping that cannot be quoted fails the order rather than being
+// guessed at.
+func (h *Handler) price(c *gin.Context, o *Order, carrier string) bool {
+	err := h.pricing.total(c.Request.Context(), o, carrier)
+	var missing *shipping.MissingDimensionsError
+	var currency *ShippingCurrencyError
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrUnsupportedCurrency):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "orders cannot be placed in " + o.Currency})
+	case errors.As(err, &currency), errors.Is(err, ErrUnknownFactor):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, shipping.ErrUnknownCarrier):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "shipping is not quoted for carrier " + carrier})
+	case errors.As(err, &missing):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "shipping cannot be quoted until these items have dimensions", "missing": missing.SKUs})
+	default:
+		log.Printf("Failed to price order for user %d: %v", o.UserID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "order cannot be priced"})
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/gin-gonic/gin"
+)
+
+// ProductSource reads a SKU's catalog entry and units from
+// inventory-service.
+type ProductSource interface {
+	GetProduct(ctx context.Context, sku string) (*clients.Product, error)
+	GetUnits(ctx context.Context, sku string) ([]clients.Unit, error)
+}
+
+var _ ProductSource = (*clients.InventoryClient)(nil)
+
+// checkProducts rejects an order for a SKU the catalog does not sell, or
+// sells in another currency, and names and prices each line from its
+// product: the catalog's price per base unit times the base units in the
+// line's unit. Whatever price the client sent is replaced. It returns the
+// base units per unit of each SKU ordered by other than the each. Without a
+// catalog, or with an unreachable one, the order cannot be priced and is
+// refused.
+func (h *Handler) checkProducts(c *gin.Context, items []Item, currency string) (map[string]map[string]int, bool) {
+	if h.products == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "orders cannot be priced without the product catalog"})
+		return nil, false
+	}
+
+	products := map[string]*clients.Product{}
+	factors := map[string]map[string]int{}
+	for _, item := range items {
+		p, ok := products[item.SKU]
+		if !ok {
+			var err error
+			p, err = h.products.GetProduct(c.Request.Context(), item.SKU)
+			if !h.catalogAnswered(c, item.SKU, err) {
+				return nil, false
+			}
+			if !p.Active {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "product is not available", "sku": item.SKU})
+				return nil, false
+			}
+			if p.Currency != currency {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "product is priced in " + p.Currency, "sku": item.SKU})
+				return nil, false
+			}
+			products[item.SKU] = p
+		}
+		if item.Unit == "each" || factors[item.SKU] != nil {
+			continue
+		}
+		units, err := h.products.GetUnits(c.Request.Context(), item.SKU)
+		if !h.catalogAnswered(c, item.SKU, err) {
+			return nil, false
+		}
+		factors[item.SKU] = map[string]int{}
+		for _, u := range units {
+			factors[item.SKU][u.Name] = u.Factor
+		}
+	}
+
+	for i, item := range items {
+		factor := 1
+		if item.Unit != "each" {
+			factor = factors[item.SKU][item.Unit]
+		}
+		if factor == 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown unit", "sku": item.SKU, "unit": item.Unit})
+			return nil, false
+		}
+		p := products[item.SKU]
+		items[i].Name, items[i].UnitPriceCents = p.Name, p.PriceCents*int64(factor)
+	}
+	return factors, true
+}
+
+// catalogAnswered writes the response for a failed catalog lookup.
+func (h *Handler) catalogAnswered(c *gin.Context, sku string, err error) bool {
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown product", "sku": sku})
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to price %s from the catalog: %v", sku, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "product catalog is unavailable", "sku": sku})
+		return false
+	}
+	return true
+}
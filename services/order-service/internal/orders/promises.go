@@ -0,0 +1,420 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// ErrUnknownCarrier is returned for a carrier with no configured SLA.
+var ErrUnknownCarrier = errors.New("unknown carrier")
+
+// Promise is the delivery date an order was promised at checkout. ShipBy
+// is the warehouse cutoff the order must ship by to keep it, and
+// PromisedDate the day, in the warehouse's time zone, the carrier delivers
+// by. AtRiskSince is set once the promise has been alerted on.
+type Promise struct {
+	Carrier      string     `json:"carrier"`
+	ShipBy       time.Time  `json:"ship_by"`
+	PromisedDate string     `json:"promised_date"`
+	ShippedAt    *time.Time `json:"shipped_at,omitempty"`
+	AtRiskSince  *time.Time `json:"at_risk_since,omitempty"`
+}
+
+// Carrier delivers TransitDays weekdays after an order ships.
+type Carrier struct {
+	Name        string
+	TransitDays int
+}
+
+// ParseCarriers parses "name=days" pairs separated by commas, e.g.
+// "standard=3,express=1". The first carrier is the default.
+func ParseCarriers(s string) ([]Carrier, error) {
+	var carriers []Carrier
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		days, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || name == "" || len(name) > 32 || err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid carrier SLA %q, want name=days", part)
+		}
+		carriers = append(carriers, Carrier{Name: name, TransitDays: days})
+	}
+	if len(carriers) == 0 {
+		return nil, errors.New("no carriers configured")
+	}
+	return carriers, nil
+}
+
+// Promises computes delivery promises for orders shipped from one
+// warehouse. The warehouse ships on weekdays in its own time zone: an order
+// placed before the day's cutoff ships that day, and any later order the
+// next weekday.
+type Promises struct {
+	location *time.Location
+	cutoff   time.Duration
+	carriers []Carrier
+	now      func() time.Time
+}
+
+// NewPromises takes the warehouse's IANA time zone, such as
+// "Europe/London", and its daily cutoff as "15:04" local time.
+func NewPromises(location, cutoff string, carriers []Carrier) (*Promises, error) {
+	loc, err := time.LoadLocation(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid warehouse location %q: %w", location, err)
+	}
+	at, err := time.Parse("15:04", cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ship cutoff %q, want HH:MM", cutoff)
+	}
+	if len(carriers) == 0 {
+		return nil, errors.New("no carriers configured")
+	}
+	return &Promises{
+		location: loc,
+		cutoff:   time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute,
+		carriers: carriers,
+		now:      time.Now,
+	}, nil
+}
+
+// Carriers returns the configured carrier names, the default first.
+func (p *Promises) Carriers() []string {
+	names := make([]string, len(p.carriers))
+	for i, c := range p.carriers {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func (p *Promises) carrier(name string) (Carrier, error) {
+	if name == "" {
+		return p.carriers[0], nil
+	}
+	for _, c := range p.carriers {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return Carrier{}, ErrUnknownCarrier
+}
+
+// Promise returns the promise for an order placed at placed with carrier,
+// or the default carrier when carrier is empty.
+func (p *Promises) Promise(placed time.Time, carrier string) (*Promise, error) {
+	c, err := p.carrier(carrier)
+	if err != nil {
+		return nil, err
+	}
+	shipBy := p.shipBy(placed)
+	return &Promise{Carrier: c.Name, ShipBy: shipBy, PromisedDate: p.deliveredOn(shipBy, c)}, nil
+}
+
+// Delivers returns the date carrier delivers an order shipped at shipped:
+// after the cutoff it goes out with the next weekday's collection.
+func (p *Promises) Delivers(shipped time.Time, carrier string) (string, error) {
+	c, err := p.carrier(carrier)
+	if err != nil {
+		return "", err
+	}
+	return p.deliveredOn(p.shipBy(shipped), c), nil
+}
+
+// shipBy returns the first weekday cutoff at or after t.
+func (p *Promises) shipBy(t time.Time) time.Time {
+	local := t.In(p.location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, p.location)
+	for {
+		cutoff := p.cutoffOn(day)
+		if weekday(day) && !local.After(cutoff) {
+			return cutoff
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+}
+
+// cutoffOn is the cutoff on day, counted as wall-clock time so it holds
+// across daylight saving changes.
+func (p *Promises) cutoffOn(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, int(p.cutoff/time.Minute), 0, 0, p.location)
+}
+
+func (p *Promises) deliveredOn(shipBy time.Time, c Carrier) string {
+	day := shipBy
+	for n := 0; n < c.TransitDays; {
+		day = day.AddDate(0, 0, 1)
+		if weekday(day) {
+			n++
+		}
+	}
+	return day.Format(time.DateOnly)
+}
+
+func weekday(t time.Time) bool {
+	return t.Weekday() != time.Saturday && t.Weekday() != time.Sunday
+}
+
+// promised are the statuses an order still has to ship from.
+var promised = []string{StatusPending, StatusPendingApproval, StatusHeldDuplicate, StatusPaid}
+
+func insertPromise(ctx context.Context, tx *sql.Tx, o *Order) error {
+	if o.Promise == nil {
+		return nil
+	}
+	const insert string = `INSERT INTO order_service.delivery_promises (order_id, carrier, ship_by, promised_date)
+		VALUES ($1, $2, $3, $4)`
+	_, err := tx.ExecContext(ctx, insert, o.ID, o.Promise.Carrier, o.Promise.ShipBy, o.Promise.PromisedDate)
+	return err
+}
+
+const promiseColumns = "p.carrier, p.ship_by, to_char(p.promised_date, 'YYYY-MM-DD'), p.shipped_at, p.at_risk_since"
+
+func scanPromise(row scanner, extra ...any) (*Promise, error) {
+	var p Promise
+	var shippedAt, atRiskSince sql.NullTime
+	if err := row.Scan(append([]any{&p.Carrier, &p.ShipBy, &p.PromisedDate, &shippedAt, &atRiskSince}, extra...)...); err != nil {
+		return nil, err
+	}
+	if shippedAt.Valid {
+		p.ShippedAt = &shippedAt.Time
+	}
+	if atRiskSince.Valid {
+		p.AtRiskSince = &atRiskSince.Time
+	}
+	return &p, nil
+}
+
+// promise returns the order's promise, or nil for orders placed without
+// one.
+func (s *PostgresStore) promise(ctx context.Context, orderID int) (*Promise, error) {
+	const query string = "SELECT " + promiseColumns + " FROM order_service.delivery_promises p WHERE p.order_id = $1"
+	p, err := scanPromise(s.db.QueryRowContext(ctx, query, orderID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return p, err
+}
+
+func (s *PostgresStore) MarkShipped(ctx context.Context, id int, at time.Time) (*Promise, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const update string = `UPDATE order_service.delivery_promises p SET shipped_at = $2
+		FROM order_service.orders o
+		WHERE p.order_id = $1 AND o.id = p.order_id AND o.tenant_id = $3 AND p.shipped_at IS NULL AND o.status = ANY($4)
+		RETURNING ` + promiseColumns
+	p, err := scanPromise(s.db.QueryRowContext(ctx, update, id, at, tenant.FromContext(ctx), pq.Array(promised)))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return p, err
+	}
+	const exists string = `SELECT EXISTS (SELECT 1 FROM order_service.delivery_promises p
+		JOIN order_service.orders o ON o.id = p.order_id WHERE p.order_id = $1 AND o.tenant_id = $2)`
+	var found bool
+	if err := s.db.QueryRowContext(ctx, exists, id, tenant.FromContext(ctx)).Scan(&found); err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, ErrInvalidState
+	}
+	return nil, ErrNotFound
+}
+
+// PromiseRisk is a promise not shipped in time, with the order it is for.
+type PromiseRisk struct {
+	OrderID int
+	UserID  int
+	Tenant  string
+	Promise
+}
+
+func (s *PostgresStore) PromisesAtRisk(ctx context.Context, shipBy time.Time, limit int) ([]PromiseRisk, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + promiseColumns + `, o.id, o.user_id, o.tenant_id
+		FROM order_service.delivery_promises p JOIN order_service.orders o ON o.id = p.order_id
+		WHERE p.shipped_at IS NULL AND p.at_risk_since IS NULL AND p.ship_by <= $1 AND o.status = ANY($3)
+		ORDER BY p.ship_by, p.order_id
+		LIMIT $2`
+	rows, err := s.db.QueryContext(ctx, query, shipBy, limit, pq.Array(promised))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	risks := []PromiseRisk{}
+	for rows.Next() {
+		var r PromiseRisk
+		p, err := scanPromise(rows, &r.OrderID, &r.UserID, &r.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		r.Promise = *p
+		risks = append(risks, r)
+	}
+	return risks, rows.Err()
+}
+
+func (s *PostgresStore) MarkPromiseAtRisk(ctx context.Context, orderID int, at time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const update string = `UPDATE order_service.delivery_promises SET at_risk_since = COALESCE(at_risk_since, $2) WHERE order_id = $1`
+	_, err := s.db.ExecContext(ctx, update, orderID, at)
+	return err
+}
+
+// atRisk builds a DeliveryAtRisk alert. expected is when the order will now
+// arrive, if known.
+func atRisk(r PromiseRisk, expected, reason string) (events.Event, error) {
+	return events.New(events.OrderDeliveryAtRisk, "order-service", events.DeliveryAtRisk{
+		OrderID:      r.OrderID,
+		UserID:       r.UserID,
+		Tenant:       r.Tenant,
+		Carrier:      r.Carrier,
+		ShipBy:       r.ShipBy,
+		PromisedDate: r.PromisedDate,
+		ExpectedDate: expected,
+		Reason:       reason,
+	})
+}
+
+// PromiseMonitor alerts on orders that have not shipped within window of
+// their ship-by cutoff. Each promise is alerted on once.
+type PromiseMonitor struct {
+	store     Store
+	publisher events.Publisher
+	window    time.Duration
+	batchSize int
+	now       func() time.Time
+}
+
+func NewPromiseMonitor(store Store, publisher events.Publisher, window time.Duration) *PromiseMonitor {
+	return &PromiseMonitor{store: store, publisher: publisher, window: window, batchSize: 100, now: time.Now}
+}
+
+// Job runs Sweep and logs what it did.
+func (m *PromiseMonitor) Job() jobs.Func {
+	return func(ctx context.Context) error {
+		alerted, err := m.Sweep(ctx)
+		if alerted > 0 {
+			log.Printf("Alerted on %d delivery promises at risk", alerted)
+		}
+		return err
+	}
+}
+
+// Sweep publishes an OrderDeliveryAtRisk event for every unshipped order
+// whose cutoff is within the window, across tenants, and returns how many it
+// alerted on.
+func (m *PromiseMonitor) Sweep(ctx context.Context) (int, error) {
+	alerted := 0
+	for {
+		risks, err := m.store.PromisesAtRisk(ctx, m.now().Add(m.window), m.batchSize)
+		if err != nil {
+			return alerted, err
+		}
+		for _, r := range risks {
+			reason := "not shipped by " + r.ShipBy.Format(time.RFC3339)
+			if m.now().Before(r.ShipBy) {
+				reason = "not shipped yet, cutoff at " + r.ShipBy.Format(time.RFC3339)
+			}
+			e, err := atRisk(r, "", reason)
+			if err != nil {
+				return alerted, err
+			}
+			if err := m.publisher.Publish(ctx, e); err != nil {
+				return alerted, err
+			}
+			if err := m.store.MarkPromiseAtRisk(ctx, r.OrderID, m.now()); err != nil {
+				return alerted, err
+			}
+			alerted++
+		}
+		if len(risks) < m.batchSize {
+			return alerted, nil
+		}
+	}
+}
+
+// ship records that the order left the warehouse. Shipping after the
+// cutoff can still keep the promise when the carrier has slack; when it
+// cannot, the order is alerted on straight away with its new date.
+func (h *Handler) ship(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	o, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	shipped := time.Now()
+	if h.promises != nil {
+		shipped = h.promises.now()
+	}
+	p, err := h.store.MarkShipped(c.Request.Context(), id, shipped)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order has no delivery promise"})
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "order has already shipped or can no longer ship"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if h.promises != nil {
+		expected, err := h.promises.Delivers(shipped, p.Carrier)
+		if err == nil && expected > p.PromisedDate {
+			h.shippedLate(c.Request.Context(), PromiseRisk{OrderID: o.ID, UserID: o.UserID, Tenant: tenant.FromContext(c.Request.Context()), Promise: *p}, expected)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "delivery_promise": p})
+}
+
+// shippedLate alerts on an order that shipped too late to arrive when
+// promised. The shipment is already saved, so failures are only logged.
+func (h *Handler) shippedLate(ctx context.Context, r PromiseRisk, expected string) {
+	log.Printf("Order %d shipped late: promised for %s, now arriving %s", r.OrderID, r.PromisedDate, expected)
+	if h.publisher == nil {
+		return
+	}
+	e, err := atRisk(r, expected, "shipped after "+r.ShipBy.Format(time.RFC3339))
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err == nil {
+		err = h.store.MarkPromiseAtRisk(ctx, r.OrderID, time.Now())
+	}
+	if err != nil {
+		log.Printf("Failed to alert on late shipment of order %d: %v", r.OrderID, err)
+	}
+}
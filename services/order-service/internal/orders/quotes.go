@@ -0,0 +1,239 @@
+package orders
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrInvalidQuote is returned for a quote token that is malformed,
+	// expired, or was issued in another tenant.
+	ErrInvalidQuote = errors.New("invalid or expired quote")
+	// ErrQuoteMismatch is returned when an order is placed with a quote for
+	// other lines, another user, currency or carrier.
+	ErrQuoteMismatch = errors.New("order does not match its quote")
+)
+
+// Quotes issues the tokens POST /orders/quote answers with. An order placed
+// with one before it expires is charged what the quote said, even if the
+// catalog, tax or shipping rates changed in between, so the price a cart
+// showed is the price checkout charges. Tokens are signed rather than
+// stored, and carry every price they lock.
+type Quotes struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewQuotes signs quotes with secret, valid for ttl.
+func NewQuotes(secret string, ttl time.Duration) *Quotes {
+	return &Quotes{secret: []byte(secret), ttl: ttl, now: time.Now}
+}
+
+// Quote is an order priced as it would be placed now. InStock is false when
+// inventory has less of a line than it asks for; lines are only checked
+// against stock when the service checks orders against it, and Available
+// is left out for lines inventory could not be asked about.
+type Quote struct {
+	UserID        int         `json:"user_id"`
+	Currency      string      `json:"currency"`
+	Carrier       string      `json:"carrier,omitempty"`
+	Items         []QuoteLine `json:"items"`
+	SubtotalCents int64       `json:"subtotal_cents"`
+	ShippingCents int64       `json:"shipping_cents"`
+	TaxCents      int64       `json:"tax_cents"`
+	TotalCents    int64       `json:"total_cents"`
+	InStock       bool        `json:"in_stock"`
+	Promise       *Promise    `json:"delivery_promise,omitempty"`
+	Token         string      `json:"token"`
+	ExpiresAt     time.Time   `json:"expires_at"`
+}
+
+type QuoteLine struct {
+	Item
+	Available *int `json:"available,omitempty"`
+}
+
+// quoteToken is what a quote locks. Lines must be ordered as quoted.
+type quoteToken struct {
+	Tenant        string       `json:"tenant"`
+	UserID        int          `json:"user_id"`
+	Currency      string       `json:"currency"`
+	Carrier       string       `json:"carrier,omitempty"`
+	Lines         []quotedLine `json:"lines"`
+	ShippingCents int64        `json:"shipping_cents"`
+	TaxCents      int64        `json:"tax_cents"`
+	ExpiresAt     int64        `json:"expires_at"`
+}
+
+type quotedLine struct {
+	SKU            string `json:"sku"`
+	Unit           string `json:"unit"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+}
+
+// issue signs a quote for o, priced and for carrier, and returns the token
+// and when it expires.
+func (q *Quotes) issue(ctx context.Context, o *Order, carrier string) (string, time.Time) {
+	expires := q.now().Add(q.ttl).Truncate(time.Second).UTC()
+	t := quoteToken{
+		Tenant:        tenant.FromContext(ctx),
+		UserID:        o.UserID,
+		Currency:      o.Currency,
+		Carrier:       carrier,
+		ShippingCents: o.ShippingCents,
+		TaxCents:      o.TaxCents,
+		ExpiresAt:     expires.Unix(),
+	}
+	for _, item := range o.Items {
+		t.Lines = append(t.Lines, quotedLine{SKU: item.SKU, Unit: item.Unit, Quantity: item.Quantity, UnitPriceCents: item.UnitPriceCents})
+	}
+	return q.sign(t), expires
+}
+
+// apply prices o, bound for carrier, as the quote signed says.
+func (q *Quotes) apply(ctx context.Context, signed string, o *Order, carrier string) error {
+	t, err := q.parse(signed)
+	if err != nil {
+		return err
+	}
+	if t.Tenant != tenant.FromContext(ctx) {
+		return ErrInvalidQuote
+	}
+	if t.UserID != o.UserID || t.Currency != o.Currency || t.Carrier != carrier || len(t.Lines) != len(o.Items) {
+		return ErrQuoteMismatch
+	}
+	for i, line := range t.Lines {
+		if item := o.Items[i]; item.SKU != line.SKU || item.Unit != line.Unit || item.Quantity != line.Quantity {
+			return ErrQuoteMismatch
+		}
+	}
+	for i, line := range t.Lines {
+		o.Items[i].UnitPriceCents = line.UnitPriceCents
+	}
+	o.SubtotalCents = orderTotal(o.Items)
+	o.ShippingCents, o.TaxCents = t.ShippingCents, t.TaxCents
+	o.TotalCents = o.SubtotalCents + o.ShippingCents + o.TaxCents
+	return nil
+}
+
+var quoteEncoding = base64.RawURLEncoding
+
+func (q *Quotes) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, q.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (q *Quotes) sign(t quoteToken) string {
+	raw, _ := json.Marshal(t)
+	payload := quoteEncoding.EncodeToString(raw)
+	return payload + "." + quoteEncoding.EncodeToString(q.mac(payload))
+}
+
+// parse returns the token signed, or ErrInvalidQuote if it is not one of
+// ours or has expired.
+func (q *Quotes) parse(signed string) (quoteToken, error) {
+	payload, sig, ok := strings.Cut(signed, ".")
+	want, err := quoteEncoding.DecodeString(sig)
+	if !ok || err != nil || len(q.secret) == 0 || !hmac.Equal(want, q.mac(payload)) {
+		return quoteToken{}, ErrInvalidQuote
+	}
+	raw, err := quoteEncoding.DecodeString(payload)
+	if err != nil {
+		return quoteToken{}, ErrInvalidQuote
+	}
+	var t quoteToken
+	if err := json.Unmarshal(raw, &t); err != nil || !q.now().Before(time.Unix(t.ExpiresAt, 0)) {
+		return quoteToken{}, ErrInvalidQuote
+	}
+	return t, nil
+}
+
+// quote answers what the order req describes would cost if placed now,
+// with a token that holds it to that price for a while. Nothing is saved
+// or reserved.
+func (h *Handler) quote(c *gin.Context) {
+	if h.quotes == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order quotes are not enabled"})
+		return
+	}
+	var req createRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, req.UserID) {
+		return
+	}
+	o, ok := h.prepare(c, req)
+	if !ok {
+		return
+	}
+	levels, ok := h.stockLevels(c, o.Items)
+	if !ok {
+		return
+	}
+	if !h.price(c, o, req.Carrier) {
+		return
+	}
+
+	q := &Quote{
+		UserID:        o.UserID,
+		Currency:      o.Currency,
+		Carrier:       req.Carrier,
+		SubtotalCents: o.SubtotalCents,
+		ShippingCents: o.ShippingCents,
+		TaxCents:      o.TaxCents,
+		TotalCents:    o.TotalCents,
+		InStock:       true,
+		Promise:       o.Promise,
+	}
+	for _, l := range levels {
+		if l.known && l.available < l.wanted {
+			q.InStock = false
+		}
+	}
+	for _, item := range o.Items {
+		line := QuoteLine{Item: item}
+		for i, l := range levels {
+			if l.known && l.sku == item.SKU && l.unit == item.Unit {
+				line.Available = &levels[i].available
+			}
+		}
+		q.Items = append(q.Items, line)
+	}
+	q.Token, q.ExpiresAt = h.quotes.issue(c.Request.Context(), o, req.Carrier)
+	c.JSON(http.StatusOK, q)
+}
+
+// applyQuote prices o as the quote token says instead of pricing it now,
+// writing the response when the quote cannot be used.
+func (h *Handler) applyQuote(c *gin.Context, o *Order, token, carrier string) bool {
+	if h.quotes == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order quotes are not enabled"})
+		return false
+	}
+	err := h.quotes.apply(c.Request.Context(), token, o, carrier)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrQuoteMismatch):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "order does not match its quote"})
+	default:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "quote is invalid or has expired"})
+	}
+	return false
+}
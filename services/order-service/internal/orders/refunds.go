@@ -0,0 +1,156 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/saga"
+)
+
+const (
+	// Movement reasons for stock a cancelled paid order puts back, and for
+	// taking it out again when the cancellation is undone.
+	reasonOrderCancelled      = "order_cancelled"
+	reasonOrderCancelReverted = "order_cancel_reverted"
+
+	typeOrderCancelled = "order_cancelled"
+)
+
+// Refunder is the part of payment-service refunds use.
+type Refunder interface {
+	RefundOrder(ctx context.Context, orderID int, reason string) (*clients.Payment, error)
+}
+
+// Restocker books stock into or out of inventory.
+type Restocker interface {
+	RecordMovement(ctx context.Context, sku string, delta int, unit, reason, reference string) error
+}
+
+var (
+	_ Refunder  = (*clients.PaymentClient)(nil)
+	_ Restocker = (*clients.InventoryClient)(nil)
+)
+
+// Refunds cancels paid orders that have not shipped. The order is
+// cancelled, its stock put back and its payment refunded as one saga: if
+// the refund fails, the stock is taken out again and the order reopened,
+// so the customer is never left with a cancelled order they paid for.
+type Refunds struct {
+	store     Store
+	payments  Refunder
+	inventory Restocker
+	users     UserDirectory
+	notifier  Notifier
+}
+
+// NewRefunds puts stock back through inventory, which may be nil when
+// orders do not book their stock out of it.
+func NewRefunds(store Store, payments Refunder, inventory Restocker, users UserDirectory, notifier Notifier) *Refunds {
+	return &Refunds{store: store, payments: payments, inventory: inventory, users: users, notifier: notifier}
+}
+
+// cancel runs the saga for the paid order o and returns the payment
+// refunded. A failed step comes back as a *saga.Error.
+func (r *Refunds) cancel(ctx context.Context, o *Order, cn *Cancellation, ch Change) (*clients.Payment, error) {
+	var payment *clients.Payment
+	steps := []saga.Step{{
+		Name: "cancel order",
+		Do:   func(ctx context.Context) error { return r.store.CancelPaid(ctx, o.ID, cn, ch) },
+		Compensate: func(ctx context.Context) error {
+			return r.store.Reopen(ctx, o.ID, StatusPaid, Change{Actor: ch.Actor, Reason: "cancellation undone: refund failed"})
+		},
+	}}
+	restock, err := r.restocks(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	if restock {
+		steps = append(steps, saga.Step{
+			Name:       "restock",
+			Do:         func(ctx context.Context) error { return r.restock(ctx, o, 1, reasonOrderCancelled) },
+			Compensate: func(ctx context.Context) error { return r.restock(ctx, o, -1, reasonOrderCancelReverted) },
+		})
+	}
+	// The refund goes last: once the provider has taken it, it cannot be
+	// undone.
+	steps = append(steps, saga.Step{
+		Name: "refund",
+		Do: func(ctx context.Context) error {
+			var err error
+			payment, err = r.payments.RefundOrder(ctx, o.ID, "cancelled by the customer: "+cn.Reason)
+			return err
+		},
+	})
+
+	if err := saga.Run(ctx, fmt.Sprintf("cancel order %d", o.ID), steps...); err != nil {
+		return nil, err
+	}
+	r.notify(ctx, o, payment)
+	return payment, nil
+}
+
+// restocks reports whether the order's stock was booked out of inventory,
+// which it was if it was reserved when placed.
+func (r *Refunds) restocks(ctx context.Context, o *Order) (bool, error) {
+	if r.inventory == nil {
+		return false, nil
+	}
+	reservations, err := r.store.Reservations(ctx, o.ID)
+	return len(reservations) > 0, err
+}
+
+// restock books each line's quantity, times sign, into inventory.
+func (r *Refunds) restock(ctx context.Context, o *Order, sign int, reason string) error {
+	reference := "order:" + strconv.Itoa(o.ID)
+	for _, item := range o.Items {
+		if err := r.inventory.RecordMovement(ctx, item.SKU, sign*item.Quantity, item.Unit, reason, reference); err != nil {
+			return fmt.Errorf("%s: %w", item.SKU, err)
+		}
+	}
+	return nil
+}
+
+// notify tells the customer their order was cancelled and refunded. The
+// refund has gone through, so a failure is only logged.
+func (r *Refunds) notify(ctx context.Context, o *Order, payment *clients.Payment) {
+	if r.users == nil || r.notifier == nil {
+		return
+	}
+	users, err := r.users.GetUsers(ctx, []int{o.UserID})
+	if err != nil {
+		log.Printf("Failed to look up user %d to confirm the refund of order %d: %v", o.UserID, o.ID, err)
+		return
+	}
+	u, ok := users[o.UserID]
+	if !ok {
+		return
+	}
+	userID := o.UserID
+	key := fmt.Sprintf("order-%d-cancelled-refund", o.ID)
+	_, err = r.notifier.Send(clients.WithIdempotencyKey(ctx, key), clients.SendNotificationRequest{
+		UserID:    &userID,
+		Recipient: u.Email,
+		Type:      typeOrderCancelled,
+		Subject:   fmt.Sprintf("Order #%d has been cancelled", o.ID),
+		Body: fmt.Sprintf("Order #%d has been cancelled and %d cents (%s) refunded to your original payment method.",
+			o.ID, payment.AmountCents, payment.Currency),
+		ContextType: "order",
+		ContextID:   strconv.Itoa(o.ID),
+	})
+	if err != nil {
+		log.Printf("Failed to notify user %d about the refund of order %d: %v", o.UserID, o.ID, err)
+	}
+}
+
+// unrefundable reports whether payment-service found no payment to refund,
+// or one it cannot, such as a payment still being taken.
+func unrefundable(err error) bool {
+	var apiErr *clients.APIError
+	return saga.Failed(err, "refund") && errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusConflict)
+}
@@ -0,0 +1,201 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const reservationsQueue = "order-service.reservations"
+
+// ReasonReservationExpired cancels an order whose stock reservation ran out
+// before it was paid. Customers cannot pick it.
+const ReasonReservationExpired = "reservation_expired"
+
+// StockReserver is the part of inventory-service order placement reserves
+// stock with.
+type StockReserver interface {
+	ReserveFor(ctx context.Context, sku string, quantity int, unit, reference string, ttl time.Duration) (*clients.Reservation, error)
+	ReleaseReservation(ctx context.Context, id int64) error
+	CommitReservation(ctx context.Context, id int64) error
+	ExtendReservation(ctx context.Context, id int64, ttl time.Duration) (*clients.Reservation, error)
+}
+
+var _ StockReserver = (*clients.InventoryClient)(nil)
+
+// OrderReservation is an inventory reservation holding one of an order's
+// lines.
+type OrderReservation struct {
+	ReservationID int64  `json:"reservation_id"`
+	SKU           string `json:"sku"`
+}
+
+// Reservations runs the stock side of placing an order. Each line is
+// reserved for ttl before the order is saved, and the reservations are
+// committed when the order is paid and released when it is cancelled,
+// rejected or voided. An order whose reservation expires while it is still
+// unpaid is cancelled, since its stock may have been sold since.
+type Reservations struct {
+	store     Store
+	inventory StockReserver
+	publisher events.Publisher
+	ttl       time.Duration
+}
+
+// NewReservations holds stock for ttl, or inventory's default TTL when
+// zero. Orders cancelled on expiry are announced on publisher when it is
+// non-nil.
+func NewReservations(store Store, inventory StockReserver, publisher events.Publisher, ttl time.Duration) *Reservations {
+	return &Reservations{store: store, inventory: inventory, publisher: publisher, ttl: ttl}
+}
+
+// reserve reserves each of the items, writing the response and giving back
+// what it reserved if inventory lacks the stock for any. When inventory
+// cannot be reached the order goes through with what was reserved, as the
+// stock pre-check lets it.
+func (r *Reservations) reserve(c *gin.Context, userID int, items []Item) ([]OrderReservation, bool) {
+	ctx := c.Request.Context()
+	reference := "order-placement:user:" + strconv.Itoa(userID)
+	var reserved []OrderReservation
+	for _, item := range items {
+		res, err := r.inventory.ReserveFor(ctx, item.SKU, item.Quantity, item.Unit, reference, r.ttl)
+		var apiErr *clients.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode < http.StatusInternalServerError {
+			r.release(ctx, reserved)
+			switch apiErr.StatusCode {
+			case http.StatusConflict:
+				c.JSON(http.StatusConflict, gin.H{"error": "insufficient stock", "sku": item.SKU, "unit": item.Unit})
+			case http.StatusNotFound, http.StatusBadRequest:
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": apiErr.Message, "sku": item.SKU, "unit": item.Unit})
+			default:
+				c.JSON(http.StatusBadGateway, gin.H{"error": apiErr.Message})
+			}
+			return nil, false
+		}
+		if err != nil {
+			log.Printf("Skipping stock reservation for %s: %v", item.SKU, err)
+			continue
+		}
+		reserved = append(reserved, OrderReservation{ReservationID: res.ID, SKU: item.SKU})
+	}
+	return reserved, true
+}
+
+// settled reports whether err says the reservation is already settled or
+// gone, which leaves nothing to do.
+func settled(err error) bool {
+	var apiErr *clients.APIError
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusConflict)
+}
+
+// release gives the reservations' stock back. Failures are only logged:
+// the reservations still expire.
+func (r *Reservations) release(ctx context.Context, reservations []OrderReservation) {
+	for _, res := range reservations {
+		if err := r.inventory.ReleaseReservation(ctx, res.ReservationID); err != nil && !settled(err) {
+			log.Printf("Failed to release reservation %d on %s: %v", res.ReservationID, res.SKU, err)
+		}
+	}
+}
+
+// releaseOrder gives back the stock reserved for an order that will not
+// be paid.
+func (r *Reservations) releaseOrder(ctx context.Context, orderID int) {
+	reservations, err := r.store.Reservations(ctx, orderID)
+	if err != nil {
+		log.Printf("Failed to look up the reservations of order %d: %v", orderID, err)
+		return
+	}
+	r.release(ctx, reservations)
+}
+
+// commitOrder books the stock reserved for a paid order out of inventory.
+// A reservation that expired first cannot be committed; the order is paid
+// all the same, so it is logged for the warehouse to check.
+func (r *Reservations) commitOrder(ctx context.Context, orderID int) {
+	reservations, err := r.store.Reservations(ctx, orderID)
+	if err != nil {
+		log.Printf("Failed to look up the reservations of order %d: %v", orderID, err)
+		return
+	}
+	for _, res := range reservations {
+		if err := r.inventory.CommitReservation(ctx, res.ReservationID); err != nil {
+			log.Printf("Failed to commit reservation %d on %s for paid order %d: %v", res.ReservationID, res.SKU, orderID, err)
+		}
+	}
+}
+
+// extendOrder holds an order's stock for another ttl, for an order that
+// has just been approved or confirmed and now waits on payment.
+func (r *Reservations) extendOrder(ctx context.Context, orderID int) {
+	if r.ttl <= 0 {
+		return
+	}
+	reservations, err := r.store.Reservations(ctx, orderID)
+	if err != nil {
+		log.Printf("Failed to look up the reservations of order %d: %v", orderID, err)
+		return
+	}
+	for _, res := range reservations {
+		if _, err := r.inventory.ExtendReservation(ctx, res.ReservationID, r.ttl); err != nil && !settled(err) {
+			log.Printf("Failed to extend reservation %d on %s for order %d: %v", res.ReservationID, res.SKU, orderID, err)
+		}
+	}
+}
+
+// Run consumes reservation expiries until ctx is cancelled. Replicas share
+// the queue, so each expiry is handled once.
+func (r *Reservations) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, reservationsQueue, []string{events.InventoryReservationExpired}, r.Handle)
+}
+
+// Handle cancels the unpaid order an expired reservation held stock for
+// and gives back the rest of its stock. Expiries of reservations no order
+// made, and of orders already paid or cancelled, are dropped.
+func (r *Reservations) Handle(ctx context.Context, e events.Event) error {
+	var expiry events.ReservationExpired
+	if err := e.Decode(&expiry); err != nil {
+		log.Printf("Dropping malformed reservation expiry %s: %v", e.ID, err)
+		return nil
+	}
+	if expiry.Tenant != "" {
+		ctx = tenant.NewContext(ctx, expiry.Tenant)
+	}
+	orderID, err := r.store.OrderForReservation(ctx, expiry.ReservationID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	o, err := r.store.Get(ctx, orderID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cn := &Cancellation{Reason: ReasonReservationExpired}
+	ch := Change{Actor: "service:inventory-service", Reason: fmt.Sprintf("stock reservation %d for %s expired before payment", expiry.ReservationID, expiry.SKU)}
+	err = r.store.Cancel(ctx, orderID, cn, ch)
+	if errors.Is(err, ErrInvalidState) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Cancelled order %d: %s", orderID, ch.Reason)
+	announceCancellation(ctx, r.publisher, o, cn, 0)
+	r.releaseOrder(ctx, orderID)
+	return nil
+}
@@ -0,0 +1,130 @@
+package orders
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSearchTime reads a date, taken as midnight UTC, or an RFC 3339 time.
+// step is the smallest difference the value can express, so a strict bound
+// can be turned into an inclusive one.
+func parseSearchTime(s string) (at time.Time, step time.Duration, err error) {
+	if at, err = time.Parse("2006-01-02", s); err == nil {
+		return at, 24 * time.Hour, nil
+	}
+	if at, err = time.Parse(time.RFC3339, s); err == nil {
+		return at, time.Microsecond, nil
+	}
+	return time.Time{}, 0, err
+}
+
+// parseAmount reads an amount in major units with up to two decimals, such
+// as "50" or "49.99", as cents.
+func parseAmount(s string) (int64, error) {
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || (hasFrac && (frac == "" || len(frac) > 2)) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	cents, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || cents < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return cents, nil
+}
+
+// searchOperators are tried longest first so "total>=50" is not read as
+// "total>" and "=50".
+var searchOperators = []string{">=", "<=", ":", ">", "<"}
+
+// applyQuery narrows f by the whitespace-separated terms of q, such as
+// "status:pending total>50 created>=2026-01-01 sku:ABC-1 tag:vip":
+//
+//   - status:S[,S...], tag:T, user:ID, org:ID and sku:SKU match like the
+//     query parameters of the same name; statuses and tags add to them.
+//   - total compares the order total in major units with >, >=, <, <= or ":"
+//     for an exact amount.
+//   - created compares the creation time, a date in UTC or an RFC 3339 time,
+//     with the same operators; created:2026-01-01 is that whole day.
+//
+// Bounds from q replace the query parameters'.
+func (f *Filter) applyQuery(q string) error {
+	for _, term := range strings.Fields(q) {
+		field, op, value := "", "", ""
+		for _, candidate := range searchOperators {
+			if i := strings.Index(term, candidate); i > 0 && (op == "" || i < len(field)) {
+				field, op, value = term[:i], candidate, term[i+len(candidate):]
+			}
+		}
+		if op == "" || value == "" {
+			return fmt.Errorf("invalid search term %q, want field:value or field>value", term)
+		}
+		field = strings.ToLower(field)
+		if op != ":" && field != "total" && field != "created" {
+			return fmt.Errorf("invalid search term %q, only total and created can be compared", term)
+		}
+
+		switch field {
+		case "status":
+			f.Status = append(f.Status, strings.Split(value, ",")...)
+		case "tag":
+			f.Tags = append(f.Tags, value)
+		case "sku":
+			f.SKU = value
+		case "user", "org":
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s id %q", field, value)
+			}
+			if field == "user" {
+				f.UserID = &id
+			} else {
+				f.OrgID = &id
+			}
+		case "total":
+			cents, err := parseAmount(value)
+			if err != nil {
+				return err
+			}
+			switch op {
+			case ">":
+				cents++
+				f.MinTotalCents = &cents
+			case ">=":
+				f.MinTotalCents = &cents
+			case "<":
+				cents--
+				f.MaxTotalCents = &cents
+			case "<=":
+				f.MaxTotalCents = &cents
+			default:
+				f.MinTotalCents, f.MaxTotalCents = &cents, &cents
+			}
+		case "created":
+			at, step, err := parseSearchTime(value)
+			if err != nil {
+				return fmt.Errorf("invalid created time %q, want a date or an RFC 3339 time", value)
+			}
+			from, before := at, at.Add(step)
+			switch op {
+			case ">":
+				f.CreatedFrom = &before
+			case ">=":
+				f.CreatedFrom = &from
+			case "<":
+				f.CreatedBefore = &from
+			case "<=":
+				f.CreatedBefore = &before
+			default:
+				f.CreatedFrom, f.CreatedBefore = &from, &before
+			}
+		default:
+			return fmt.Errorf("unknown search field %q, want status, tag, user, org, sku, total or created", field)
+		}
+	}
+	return nil
+}
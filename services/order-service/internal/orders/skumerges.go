@@ -0,0 +1,104 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+const skuMergesQueue = "order-service.sku-merges"
+
+// SKUMergeConsumer moves orders and wishlists off SKUs that inventory
+// merged into another, so searches by SKU and back-in-stock alerts follow
+// the surviving SKU.
+type SKUMergeConsumer struct {
+	store Store
+}
+
+func NewSKUMergeConsumer(store Store) *SKUMergeConsumer {
+	return &SKUMergeConsumer{store: store}
+}
+
+// Run consumes merge events until ctx is cancelled.
+func (m *SKUMergeConsumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, skuMergesQueue, []string{events.InventorySKUMerged}, m.Handle)
+}
+
+// Handle is safe to redeliver: a second pass finds nothing left to move.
+func (m *SKUMergeConsumer) Handle(ctx context.Context, e events.Event) error {
+	var merged events.SKUMerged
+	if err := e.Decode(&merged); err != nil || merged.SKU == "" || merged.Survivor == "" {
+		log.Printf("Dropping malformed SKU merge event %s: %v", e.ID, err)
+		return nil
+	}
+	if merged.Tenant != "" {
+		ctx = tenant.NewContext(ctx, merged.Tenant)
+	}
+	n, err := m.store.RenameSKU(ctx, merged.SKU, merged.Survivor)
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved %d order lines and wishlist items from %s to %s", n, merged.SKU, merged.Survivor)
+	return nil
+}
+
+func (s *PostgresStore) RenameSKU(ctx context.Context, sku, survivor string) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var moved int
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		moved = 0
+		id := tenant.FromContext(ctx)
+		const orderItems string = `UPDATE order_service.order_items i SET sku = $2
+			FROM order_service.orders o WHERE o.id = i.order_id AND o.tenant_id = $3 AND i.sku = $1`
+		res, err := tx.ExecContext(ctx, orderItems, sku, survivor, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		moved += int(n)
+
+		// Where a user saved both SKUs, their item for the survivor takes
+		// over the other's alert and hold, unless it has its own.
+		const mergeWishlist string = `UPDATE order_service.wishlist_items keep SET
+				notify = keep.notify OR gone.notify,
+				notified_at = CASE WHEN gone.notify AND gone.notified_at IS NULL THEN NULL ELSE keep.notified_at END,
+				hold_reservation_id = COALESCE(keep.hold_reservation_id, gone.hold_reservation_id),
+				hold_expires_at = CASE WHEN keep.hold_reservation_id IS NULL THEN gone.hold_expires_at ELSE keep.hold_expires_at END
+			FROM order_service.wishlist_items gone
+			WHERE keep.tenant_id = $3 AND keep.sku = $2 AND gone.tenant_id = $3 AND gone.sku = $1 AND gone.user_id = keep.user_id`
+		if _, err := tx.ExecContext(ctx, mergeWishlist, sku, survivor, id); err != nil {
+			return err
+		}
+		const dropDuplicates string = `DELETE FROM order_service.wishlist_items gone
+			USING order_service.wishlist_items keep
+			WHERE gone.tenant_id = $3 AND gone.sku = $1 AND keep.tenant_id = $3 AND keep.sku = $2 AND keep.user_id = gone.user_id`
+		res, err = tx.ExecContext(ctx, dropDuplicates, sku, survivor, id)
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		moved += int(n)
+		const wishlist string = "UPDATE order_service.wishlist_items SET sku = $2 WHERE tenant_id = $3 AND sku = $1"
+		res, err = tx.ExecContext(ctx, wishlist, sku, survivor, id)
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		moved += int(n)
+		return nil
+	})
+	return moved, err
+}
@@ -0,0 +1,177 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+// StockSource reads a SKU's stock from inventory-service.
+type StockSource interface {
+	GetStockInUnit(ctx context.Context, sku, unit string) (*clients.Stock, error)
+}
+
+var _ StockSource = (*clients.InventoryClient)(nil)
+
+// StockCache keeps inventory's availability answers per SKU and unit for as
+// long as inventory's max-age hint allows, capped at maxTTL. A stock change
+// event for a SKU drops it straight away, so the TTL only bounds staleness
+// when events are lost or the broker is down.
+type StockCache struct {
+	source StockSource
+	maxTTL time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]map[string]cachedStock
+	// generations counts invalidations per SKU, so an answer fetched while
+	// its SKU was invalidated is not cached.
+	generations map[string]int
+}
+
+type cachedStock struct {
+	available int
+	expires   time.Time
+}
+
+func NewStockCache(source StockSource, maxTTL time.Duration) *StockCache {
+	return &StockCache{
+		source:      source,
+		maxTTL:      maxTTL,
+		now:         time.Now,
+		entries:     map[string]map[string]cachedStock{},
+		generations: map[string]int{},
+	}
+}
+
+// Available returns the SKU's available stock in whole units of unit.
+func (c *StockCache) Available(ctx context.Context, sku, unit string) (int, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[sku][unit]
+	generation := c.generations[sku]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.available, nil
+	}
+
+	stock, err := c.source.GetStockInUnit(ctx, sku, unit)
+	if err != nil {
+		return 0, err
+	}
+	available := stock.Available
+	if stock.InUnit != nil {
+		available = stock.InUnit.Available
+	}
+
+	ttl := stock.MaxAge
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		if c.generations[sku] == generation {
+			if c.entries[sku] == nil {
+				c.entries[sku] = map[string]cachedStock{}
+			}
+			c.entries[sku][unit] = cachedStock{available: available, expires: c.now().Add(ttl)}
+		}
+		c.mu.Unlock()
+	}
+	return available, nil
+}
+
+// Invalidate drops every cached answer for the SKU.
+func (c *StockCache) Invalidate(sku string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, sku)
+	c.generations[sku]++
+}
+
+func (c *StockCache) Handle(ctx context.Context, e events.Event) error {
+	var change events.StockChange
+	if err := e.Decode(&change); err != nil {
+		log.Printf("Dropping malformed stock change %s: %v", e.ID, err)
+		return nil
+	}
+	c.Invalidate(change.SKU)
+	return nil
+}
+
+// Run invalidates the cache from stock change events until ctx is
+// cancelled. Every replica keeps its own cache, so it subscribes with a
+// private queue.
+func (c *StockCache) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, "", []string{events.InventoryStockChanged}, c.Handle)
+}
+
+// checkStock rejects an order asking for more of a SKU than inventory has
+// available. It is only a pre-check and reserves nothing. When inventory
+// cannot be reached the order goes through rather than failing checkout.
+func (h *Handler) checkStock(c *gin.Context, items []Item) bool {
+	levels, ok := h.stockLevels(c, items)
+	if !ok {
+		return false
+	}
+	for _, l := range levels {
+		if l.known && l.available < l.wanted {
+			c.JSON(http.StatusConflict, gin.H{"error": "insufficient stock", "sku": l.sku, "unit": l.unit, "available": l.available})
+			return false
+		}
+	}
+	return true
+}
+
+// stockLevel is how much of a SKU in a unit an order wants and inventory
+// has. Known is false when inventory could not be asked.
+type stockLevel struct {
+	sku, unit string
+	wanted    int
+	available int
+	known     bool
+}
+
+// stockLevels adds up what items want of each SKU and unit, in the order
+// they first appear, and asks inventory what it has of each. It writes the
+// response for a SKU or unit inventory does not know. Without a stock
+// cache there is nothing to check.
+func (h *Handler) stockLevels(c *gin.Context, items []Item) ([]stockLevel, bool) {
+	if h.stock == nil {
+		return nil, true
+	}
+
+	var levels []stockLevel
+	index := map[[2]string]int{}
+	for _, item := range items {
+		key := [2]string{item.SKU, item.Unit}
+		i, ok := index[key]
+		if !ok {
+			i = len(levels)
+			index[key] = i
+			levels = append(levels, stockLevel{sku: item.SKU, unit: item.Unit})
+		}
+		levels[i].wanted += item.Quantity
+	}
+
+	for i, l := range levels {
+		available, err := h.stock.Available(c.Request.Context(), l.sku, l.unit)
+		var apiErr *clients.APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusBadRequest) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": apiErr.Message, "sku": l.sku, "unit": l.unit})
+			return nil, false
+		}
+		if err != nil {
+			log.Printf("Skipping stock check for %s: %v", l.sku, err)
+			continue
+		}
+		levels[i].available, levels[i].known = available, true
+	}
+	return levels, true
+}
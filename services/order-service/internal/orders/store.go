@@ -0,0 +1,838 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+const (
+	StatusPending         = "pending"
+	StatusPendingApproval = "pending_approval"
+	StatusRejected        = "rejected"
+	StatusHeldDuplicate   = "held_duplicate"
+	StatusVoided          = "voided"
+	StatusPaid            = "paid"
+	StatusPaymentFailed   = "payment_failed"
+	StatusCancelled       = "cancelled"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidState is returned when an order is not in a status that
+	// allows the requested transition.
+	ErrInvalidState = errors.New("invalid order state")
+	// ErrViewExists is returned when the admin already has a saved view
+	// with that name.
+	ErrViewExists = errors.New("view already exists")
+	// ErrCurrencyMismatch is returned when merging orders placed in
+	// different currencies.
+	ErrCurrencyMismatch = errors.New("orders are in different currencies")
+)
+
+// Item is an order line, priced per unit.
+type Item = models.OrderItem
+
+type Order struct {
+	models.Order
+	// Promise is the delivery date promised at checkout. It is only loaded
+	// with a single order.
+	Promise     *Promise `json:"delivery_promise,omitempty"`
+	Fingerprint string   `json:"-"`
+	// Reservations hold the order's stock in inventory until it is paid.
+	// They are only set on an order being placed.
+	Reservations []OrderReservation `json:"-"`
+	// Version is sent as the order's ETag. Changes to the delivery promise
+	// bump it too.
+	Version int64 `json:"-"`
+	// factors are base units per unit of each SKU ordered by other than
+	// the each, when the order was priced from the catalog.
+	factors map[string]map[string]int
+}
+
+// factor returns the base units in one of item's Unit, or 0 if the order
+// was not priced in it.
+func (o *Order) factor(item Item) int {
+	if item.Unit == "each" {
+		return 1
+	}
+	return o.factors[item.SKU][item.Unit]
+}
+
+type Approval struct {
+	OrderID     int        `json:"order_id"`
+	OrgID       int        `json:"org_id"`
+	Status      string     `json:"status"`
+	DecidedBy   *int       `json:"decided_by,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	RequestedAt time.Time  `json:"requested_at"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+}
+
+type Store interface {
+	// Create inserts the order with its items and delivery promise, plus a
+	// pending approval request when the order's status is
+	// StatusPendingApproval.
+	Create(ctx context.Context, o *Order, ch Change) error
+	Get(ctx context.Context, id int) (*Order, error)
+	// ListByUser returns the user's most recent orders, newest first, without
+	// their items.
+	ListByUser(ctx context.Context, userID, limit int) ([]Order, error)
+	// StreamByUser calls fn with every one of the user's orders, newest
+	// first and without their items, as the rows are scanned, and stops at
+	// fn's first error.
+	StreamByUser(ctx context.Context, userID int, fn func(Order) error) error
+	GetApproval(ctx context.Context, orderID int) (*Approval, error)
+	// DecideApproval records the approver's decision and moves the order to
+	// orderStatus.
+	DecideApproval(ctx context.Context, a *Approval, orderStatus string, ch Change) error
+	ApprovalThreshold(ctx context.Context, orgID int) (int64, bool, error)
+	SetApprovalThreshold(ctx context.Context, orgID int, thresholdCents int64) error
+	// FindDuplicate returns the user's most recent live order created since
+	// the given time with the same fingerprint.
+	FindDuplicate(ctx context.Context, userID int, fingerprint string, since time.Time) (*Order, error)
+	// ListDuplicates returns live orders flagged as duplicates, newest first.
+	ListDuplicates(ctx context.Context, limit int) ([]Order, error)
+	// Release moves a held duplicate to status, opening an approval request
+	// when status is StatusPendingApproval.
+	Release(ctx context.Context, o *Order, status string, ch Change) error
+	// Void cancels a flagged duplicate and any pending approval for it.
+	Void(ctx context.Context, id int, ch Change) error
+	// Merge adds the duplicate's items and amounts to the order it
+	// duplicates, voids the duplicate and moves the target to targetStatus.
+	// ch is recorded against both orders. Orders in different currencies are
+	// ErrCurrencyMismatch.
+	Merge(ctx context.Context, duplicateID int, targetStatus string, ch Change) (*Order, error)
+	// History returns the order's status transitions, oldest first.
+	History(ctx context.Context, orderID int) ([]Transition, error)
+	// RecordPayment moves a pending or payment_failed order to status,
+	// StatusPaid or StatusPaymentFailed. A paid order is issued the next
+	// invoice number of fiscalYear, which is returned.
+	RecordPayment(ctx context.Context, id int, status string, fiscalYear int, ch Change) (string, error)
+
+	// AddTags adds tags the order does not have yet and returns all of its
+	// tags, sorted.
+	AddTags(ctx context.Context, id int, tags []string) ([]string, error)
+	// RemoveTag removes the tag if the order has it and returns the rest.
+	RemoveTag(ctx context.Context, id int, tag string) ([]string, error)
+	// Search returns orders matching f, newest first, without their items.
+	Search(ctx context.Context, f Filter, limit int) ([]Order, error)
+
+	SaveView(ctx context.Context, v *View) error
+	// ListViews returns the owner's saved views by name.
+	ListViews(ctx context.Context, ownerID int) ([]View, error)
+	GetView(ctx context.Context, ownerID, id int) (*View, error)
+	DeleteView(ctx context.Context, ownerID, id int) error
+
+	// Cancel moves a live or payment_failed order to StatusCancelled, closes
+	// any pending approval for it and records c, filling in its order ID,
+	// customer tier and time.
+	Cancel(ctx context.Context, id int, c *Cancellation, ch Change) error
+	// CancelPaid cancels a paid order as Cancel does, unless it has
+	// shipped, which is ErrInvalidState.
+	CancelPaid(ctx context.Context, id int, c *Cancellation, ch Change) error
+	// Reopen moves a cancelled order back to status and forgets its
+	// cancellation, undoing CancelPaid when the refund fails.
+	Reopen(ctx context.Context, id int, status string, ch Change) error
+	// CancellationReport counts cancellations by reason as q groups them.
+	CancellationReport(ctx context.Context, q ReportQuery) ([]ReportRow, error)
+
+	// MarkShipped records that an order still to ship has shipped and
+	// returns its promise. Orders without a promise are ErrNotFound; orders
+	// already shipped, or cancelled, rejected or voided, ErrInvalidState.
+	MarkShipped(ctx context.Context, id int, at time.Time) (*Promise, error)
+	// PromisesAtRisk returns unshipped orders with a ship-by cutoff at or
+	// before shipBy that have not been alerted on, across tenants, soonest
+	// cutoff first.
+	PromisesAtRisk(ctx context.Context, shipBy time.Time, limit int) ([]PromiseRisk, error)
+	MarkPromiseAtRisk(ctx context.Context, orderID int, at time.Time) error
+
+	// SaveWishlistItem adds the SKU to the user's wishlist or updates it.
+	// Saving an item with Notify re-arms an alert that was already sent.
+	SaveWishlistItem(ctx context.Context, it *WishlistItem) error
+	// ListWishlist returns the user's wishlist, oldest first.
+	ListWishlist(ctx context.Context, userID int) ([]WishlistItem, error)
+	// RemoveWishlistItem deletes the item and returns it, hold included.
+	RemoveWishlistItem(ctx context.Context, userID int, sku string) (*WishlistItem, error)
+	// ClaimWaiting marks up to limit items waiting for the SKU as notified
+	// and returns them, oldest first.
+	ClaimWaiting(ctx context.Context, sku string, limit int) ([]WishlistItem, error)
+	// RearmWishlistItem puts a claimed item back to waiting.
+	RearmWishlistItem(ctx context.Context, id int64) error
+	SetHold(ctx context.Context, id, reservationID int64, expiresAt time.Time) error
+	// TakeHolds clears the user's holds on the SKUs and returns them.
+	TakeHolds(ctx context.Context, userID int, skus []string) ([]Hold, error)
+	// TakeExpiredHolds clears up to limit holds that ended at or before now,
+	// across tenants, and returns them.
+	TakeExpiredHolds(ctx context.Context, now time.Time, limit int) ([]Hold, error)
+
+	// RenameSKU moves the tenant's order lines and wishlist items from sku
+	// to survivor and returns how many rows moved. A user with both keeps
+	// one wishlist item, notified if either was to be.
+	RenameSKU(ctx context.Context, sku, survivor string) (int, error)
+
+	// Reservations returns the inventory reservations made for the order
+	// when it was placed, and for any duplicates merged into it.
+	Reservations(ctx context.Context, orderID int) ([]OrderReservation, error)
+	// OrderForReservation returns the ID of the order a reservation was
+	// made for; reservations of no order are ErrNotFound.
+	OrderForReservation(ctx context.Context, reservationID int64) (int, error)
+
+	// ArchiveOrders moves up to limit completed orders, across tenants,
+	// last changed before the given time to the archive, and returns how
+	// many it moved.
+	ArchiveOrders(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Create(ctx context.Context, o *Order, ch Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const insertOrder string = `INSERT INTO order_service.orders (user_id, org_id, status, currency, subtotal_cents, shipping_cents, tax_cents, total_cents,
+				fingerprint, duplicate_of, tenant_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11) RETURNING id, created_at, updated_at`
+		if err := tx.QueryRowContext(ctx, insertOrder, o.UserID, o.OrgID, o.Status, o.Currency, o.SubtotalCents, o.ShippingCents, o.TaxCents, o.TotalCents,
+			o.Fingerprint, o.DuplicateOf, tenant.FromContext(ctx)).Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			return err
+		}
+
+		const insertItem string = `INSERT INTO order_service.order_items (order_id, sku, name, unit, quantity, unit_price_cents)
+			VALUES ($1, $2, $3, $4, $5, $6)`
+		for _, item := range o.Items {
+			if _, err := tx.ExecContext(ctx, insertItem, o.ID, item.SKU, item.Name, item.Unit, item.Quantity, item.UnitPriceCents); err != nil {
+				return err
+			}
+		}
+
+		const insertReservation string = `INSERT INTO order_service.order_reservations (reservation_id, order_id, sku)
+			VALUES ($1, $2, $3)`
+		for _, r := range o.Reservations {
+			if _, err := tx.ExecContext(ctx, insertReservation, r.ReservationID, o.ID, r.SKU); err != nil {
+				return err
+			}
+		}
+
+		if err := insertPromise(ctx, tx, o); err != nil {
+			return err
+		}
+
+		created := &Transition{OrderID: o.ID, To: o.Status, Actor: ch.Actor, Reason: ch.Reason, CreatedAt: o.CreatedAt}
+		if err := recordTransition(ctx, tx, created); err != nil {
+			return err
+		}
+
+		return openApproval(ctx, tx, o)
+	})
+}
+
+func openApproval(ctx context.Context, tx *sql.Tx, o *Order) error {
+	if o.Status != StatusPendingApproval || o.OrgID == nil {
+		return nil
+	}
+	const insertApproval string = `INSERT INTO order_service.order_approvals (order_id, org_id, status)
+		VALUES ($1, $2, 'pending')`
+	_, err := tx.ExecContext(ctx, insertApproval, o.ID, *o.OrgID)
+	return err
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int) (*Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + orderColumns + " FROM order_service.orders WHERE id = $1 AND tenant_id = $2"
+	o, err := scanOrder(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.getArchived(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.Items, err = listItems(ctx, s.db, id); err != nil {
+		return nil, err
+	}
+	if o.Promise, err = s.promise(ctx, id); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func listItems(ctx context.Context, q queryer, orderID int) ([]Item, error) {
+	return listItemsFrom(ctx, q, "order_service.order_items", orderID)
+}
+
+// listItemsFrom reads the order's items from table, the hot table or the
+// archive.
+func listItemsFrom(ctx context.Context, q queryer, table string, orderID int) ([]Item, error) {
+	itemsQuery := `SELECT sku, name, unit, quantity, unit_price_cents FROM ` + table + `
+		WHERE order_id = $1 ORDER BY id`
+	rows, err := q.QueryContext(ctx, itemsQuery, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		var item Item
+		if err := rows.Scan(&item.SKU, &item.Name, &item.Unit, &item.Quantity, &item.UnitPriceCents); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) ListByUser(ctx context.Context, userID, limit int) ([]Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + orderColumns + ` FROM order_service.all_orders
+		WHERE tenant_id = $3 AND user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`
+	return s.queryOrders(ctx, query, userID, limit, tenant.FromContext(ctx))
+}
+
+// StreamByUser is not bound by the query timeout, which is meant for
+// single queries, since a large listing takes as long as the client reads
+// it. The client going away still cancels it.
+func (s *PostgresStore) StreamByUser(ctx context.Context, userID int, fn func(Order) error) error {
+	const query string = "SELECT " + orderColumns + ` FROM order_service.all_orders
+		WHERE tenant_id = $2 AND user_id = $1 ORDER BY created_at DESC, id DESC`
+	rows, err := s.db.QueryContext(ctx, query, userID, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(*o); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+const orderColumns = "id, user_id, org_id, status, currency, subtotal_cents, shipping_cents, tax_cents, total_cents, duplicate_of, " +
+	"created_at, updated_at, tags, invoice_number, version"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanOrder(row scanner) (*Order, error) {
+	var o Order
+	var orgID, duplicateOf sql.NullInt64
+	var invoice sql.NullString
+	if err := row.Scan(&o.ID, &o.UserID, &orgID, &o.Status, &o.Currency, &o.SubtotalCents, &o.ShippingCents, &o.TaxCents, &o.TotalCents,
+		&duplicateOf, &o.CreatedAt, &o.UpdatedAt, pq.Array(&o.Tags), &invoice, &o.Version); err != nil {
+		return nil, err
+	}
+	o.InvoiceNumber = invoice.String
+	if orgID.Valid {
+		v := int(orgID.Int64)
+		o.OrgID = &v
+	}
+	if duplicateOf.Valid {
+		v := int(duplicateOf.Int64)
+		o.DuplicateOf = &v
+	}
+	return &o, nil
+}
+
+func (s *PostgresStore) queryOrders(ctx context.Context, query string, args ...any) ([]Order, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *o)
+	}
+	return orders, rows.Err()
+}
+
+func (s *PostgresStore) GetApproval(ctx context.Context, orderID int) (*Approval, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT order_id, org_id, status, decided_by, COALESCE(reason, ''), requested_at, decided_at
+		FROM order_service.order_approvals WHERE order_id = $1`
+	var a Approval
+	var decidedBy sql.NullInt64
+	var decidedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, query, orderID).
+		Scan(&a.OrderID, &a.OrgID, &a.Status, &decidedBy, &a.Reason, &a.RequestedAt, &decidedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if decidedBy.Valid {
+		v := int(decidedBy.Int64)
+		a.DecidedBy = &v
+	}
+	if decidedAt.Valid {
+		a.DecidedAt = &decidedAt.Time
+	}
+	return &a, nil
+}
+
+func (s *PostgresStore) DecideApproval(ctx context.Context, a *Approval, orderStatus string, ch Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const updateApproval string = `UPDATE order_service.order_approvals
+			SET status = $2, decided_by = $3, reason = $4, decided_at = NOW()
+			WHERE order_id = $1 AND status = 'pending'
+			RETURNING decided_at`
+		var decidedAt time.Time
+		err := tx.QueryRowContext(ctx, updateApproval, a.OrderID, a.Status, a.DecidedBy, a.Reason).Scan(&decidedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		a.DecidedAt = &decidedAt
+
+		_, err = transition(ctx, tx, a.OrderID, orderStatus, ch, StatusPendingApproval)
+		return err
+	})
+}
+
+func (s *PostgresStore) ApprovalThreshold(ctx context.Context, orgID int) (int64, bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT threshold_cents FROM order_service.org_approval_policies WHERE org_id = $1`
+	var threshold int64
+	err := s.db.QueryRowContext(ctx, query, orgID).Scan(&threshold)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return threshold, true, nil
+}
+
+func (s *PostgresStore) SetApprovalThreshold(ctx context.Context, orgID int, thresholdCents int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO order_service.org_approval_policies (org_id, threshold_cents)
+		VALUES ($1, $2)
+		ON CONFLICT (org_id) DO UPDATE SET threshold_cents = EXCLUDED.threshold_cents, updated_at = NOW()`
+	_, err := s.db.ExecContext(ctx, query, orgID, thresholdCents)
+	return err
+}
+
+// liveStatuses are the statuses in which an order can still be fulfilled and
+// so can be duplicated, merged into or voided.
+const liveStatuses = "('pending', 'pending_approval', 'held_duplicate')"
+
+func (s *PostgresStore) FindDuplicate(ctx context.Context, userID int, fingerprint string, since time.Time) (*Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + orderColumns + ` FROM order_service.orders
+		WHERE tenant_id = $4 AND user_id = $1 AND fingerprint = $2 AND created_at >= $3 AND status IN ` + liveStatuses + `
+		ORDER BY created_at DESC, id DESC LIMIT 1`
+	o, err := scanOrder(s.db.QueryRowContext(ctx, query, userID, fingerprint, since, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return o, err
+}
+
+func (s *PostgresStore) ListDuplicates(ctx context.Context, limit int) ([]Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + orderColumns + ` FROM order_service.orders
+		WHERE tenant_id = $2 AND duplicate_of IS NOT NULL AND status IN ` + liveStatuses + `
+		ORDER BY created_at DESC, id DESC LIMIT $1`
+	return s.queryOrders(ctx, query, limit, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) Release(ctx context.Context, o *Order, status string, ch Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		t, err := transition(ctx, tx, o.ID, status, ch, StatusHeldDuplicate)
+		if errors.Is(err, ErrNotFound) {
+			return ErrInvalidState
+		}
+		if err != nil {
+			return err
+		}
+		o.Status, o.UpdatedAt = status, t.CreatedAt
+
+		return openApproval(ctx, tx, o)
+	})
+}
+
+func (s *PostgresStore) Void(ctx context.Context, id int, ch Change) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		return voidDuplicate(ctx, tx, id, ch)
+	})
+}
+
+func (s *PostgresStore) RecordPayment(ctx context.Context, id int, status string, fiscalYear int, ch Change) (string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var invoice string
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := transition(ctx, tx, id, status, ch, StatusPending, StatusPaymentFailed); err != nil {
+			return err
+		}
+		if status != StatusPaid {
+			return nil
+		}
+		var err error
+		invoice, err = issueInvoice(ctx, tx, id, fiscalYear)
+		return err
+	})
+	return invoice, err
+}
+
+func voidDuplicate(ctx context.Context, tx *sql.Tx, id int, ch Change) error {
+	const flagged string = "SELECT duplicate_of IS NOT NULL FROM order_service.orders WHERE id = $1 AND tenant_id = $2 FOR UPDATE"
+	var isDuplicate bool
+	err := tx.QueryRowContext(ctx, flagged, id, tenant.FromContext(ctx)).Scan(&isDuplicate)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !isDuplicate) {
+		return ErrInvalidState
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := transition(ctx, tx, id, StatusVoided, ch, StatusPending, StatusPendingApproval, StatusHeldDuplicate); err != nil {
+		return err
+	}
+
+	const cancelApproval string = `UPDATE order_service.order_approvals SET status = 'cancelled', decided_at = NOW()
+		WHERE order_id = $1 AND status = 'pending'`
+	_, err = tx.ExecContext(ctx, cancelApproval, id)
+	return err
+}
+
+func (s *PostgresStore) Merge(ctx context.Context, duplicateID int, targetStatus string, ch Change) (*Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var merged *Order
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const lockDuplicate string = "SELECT " + orderColumns + " FROM order_service.orders WHERE id = $1 AND tenant_id = $2 FOR UPDATE"
+		dup, err := scanOrder(tx.QueryRowContext(ctx, lockDuplicate, duplicateID, tenant.FromContext(ctx)))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if dup.DuplicateOf == nil {
+			return ErrInvalidState
+		}
+
+		const lockTarget string = "SELECT " + orderColumns + " FROM order_service.orders WHERE id = $1 AND tenant_id = $2 AND status IN " + liveStatuses + " FOR UPDATE"
+		target, err := scanOrder(tx.QueryRowContext(ctx, lockTarget, *dup.DuplicateOf, tenant.FromContext(ctx)))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidState
+		}
+		if err != nil {
+			return err
+		}
+		if target.Currency != dup.Currency {
+			return ErrCurrencyMismatch
+		}
+
+		items, err := listItems(ctx, tx, dup.ID)
+		if err != nil {
+			return err
+		}
+		const addQuantity string = `UPDATE order_service.order_items SET quantity = quantity + $5
+			WHERE order_id = $1 AND sku = $2 AND unit = $3 AND unit_price_cents = $4`
+		const insertItem string = `INSERT INTO order_service.order_items (order_id, sku, name, unit, quantity, unit_price_cents)
+			VALUES ($1, $2, $3, $4, $5, $6)`
+		for _, item := range items {
+			res, err := tx.ExecContext(ctx, addQuantity, target.ID, item.SKU, item.Unit, item.UnitPriceCents, item.Quantity)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				if _, err := tx.ExecContext(ctx, insertItem, target.ID, item.SKU, item.Name, item.Unit, item.Quantity, item.UnitPriceCents); err != nil {
+					return err
+				}
+			}
+		}
+
+		const addTotal string = `UPDATE order_service.orders SET subtotal_cents = subtotal_cents + $2,
+				shipping_cents = shipping_cents + $3, tax_cents = tax_cents + $4, total_cents = total_cents + $5
+			WHERE id = $1 RETURNING subtotal_cents, shipping_cents, tax_cents, total_cents`
+		if err := tx.QueryRowContext(ctx, addTotal, target.ID, dup.SubtotalCents, dup.ShippingCents, dup.TaxCents, dup.TotalCents).
+			Scan(&target.SubtotalCents, &target.ShippingCents, &target.TaxCents, &target.TotalCents); err != nil {
+			return err
+		}
+		moved, err := transition(ctx, tx, target.ID, targetStatus, ch)
+		if err != nil {
+			return err
+		}
+		openNew := targetStatus == StatusPendingApproval && target.Status != StatusPendingApproval
+		target.Status, target.UpdatedAt = targetStatus, moved.CreatedAt
+		if openNew {
+			if err := openApproval(ctx, tx, target); err != nil {
+				return err
+			}
+		}
+
+		if err := voidDuplicate(ctx, tx, dup.ID, ch); err != nil {
+			return err
+		}
+		// The duplicate's stock now belongs to the order it was merged into.
+		const moveReservations string = "UPDATE order_service.order_reservations SET order_id = $2 WHERE order_id = $1"
+		if _, err := tx.ExecContext(ctx, moveReservations, dup.ID, target.ID); err != nil {
+			return err
+		}
+
+		if target.Items, err = listItems(ctx, tx, target.ID); err != nil {
+			return err
+		}
+		merged = target
+		return nil
+	})
+	return merged, err
+}
+
+func (s *PostgresStore) Reservations(ctx context.Context, orderID int) ([]OrderReservation, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT r.reservation_id, r.sku FROM order_service.order_reservations r
+		JOIN order_service.orders o ON o.id = r.order_id
+		WHERE r.order_id = $1 AND o.tenant_id = $2 ORDER BY r.reservation_id`
+	rows, err := s.db.QueryContext(ctx, query, orderID, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []OrderReservation{}
+	for rows.Next() {
+		var r OrderReservation
+		if err := rows.Scan(&r.ReservationID, &r.SKU); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+func (s *PostgresStore) OrderForReservation(ctx context.Context, reservationID int64) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT r.order_id FROM order_service.order_reservations r
+		JOIN order_service.orders o ON o.id = r.order_id
+		WHERE r.reservation_id = $1 AND o.tenant_id = $2`
+	var orderID int
+	err := s.db.QueryRowContext(ctx, query, reservationID, tenant.FromContext(ctx)).Scan(&orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return orderID, err
+}
+
+func (s *PostgresStore) AddTags(ctx context.Context, id int, tags []string) ([]string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE order_service.orders
+		SET tags = ARRAY(SELECT DISTINCT t FROM unnest(tags || $2::text[]) t ORDER BY t)
+		WHERE id = $1 AND tenant_id = $3 RETURNING tags`
+	return s.updateTags(ctx, query, id, pq.Array(tags), tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) RemoveTag(ctx context.Context, id int, tag string) ([]string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE order_service.orders SET tags = array_remove(tags, $2)
+		WHERE id = $1 AND tenant_id = $3 RETURNING tags`
+	return s.updateTags(ctx, query, id, tag, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) updateTags(ctx context.Context, query string, args ...any) ([]string, error) {
+	tags := []string{}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(pq.Array(&tags))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return tags, err
+}
+
+func (s *PostgresStore) Search(ctx context.Context, f Filter, limit int) ([]Order, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	args := []any{tenant.FromContext(ctx)}
+	where := []string{"tenant_id = $1"}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if len(f.Tags) > 0 {
+		add("tags @> $%d", pq.Array(f.Tags))
+	}
+	if len(f.Status) > 0 {
+		add("status = ANY($%d)", pq.Array(f.Status))
+	}
+	if f.UserID != nil {
+		add("user_id = $%d", *f.UserID)
+	}
+	if f.OrgID != nil {
+		add("org_id = $%d", *f.OrgID)
+	}
+	if f.CreatedFrom != nil {
+		add("created_at >= $%d", *f.CreatedFrom)
+	}
+	if f.CreatedBefore != nil {
+		add("created_at < $%d", *f.CreatedBefore)
+	}
+	if f.MinTotalCents != nil {
+		add("total_cents >= $%d", *f.MinTotalCents)
+	}
+	if f.MaxTotalCents != nil {
+		add("total_cents <= $%d", *f.MaxTotalCents)
+	}
+	if f.SKU != "" {
+		add("EXISTS (SELECT 1 FROM order_service.order_items i WHERE i.order_id = orders.id AND i.sku = $%d)", f.SKU)
+	}
+	args = append(args, limit)
+	query := "SELECT " + orderColumns + " FROM order_service.orders WHERE " + strings.Join(where, " AND ") +
+		fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+	return s.queryOrders(ctx, query, args...)
+}
+
+func (s *PostgresStore) SaveView(ctx context.Context, v *View) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	filter, err := json.Marshal(v.Filter)
+	if err != nil {
+		return err
+	}
+	const query string = `INSERT INTO order_service.saved_views (tenant_id, owner_id, name, filter)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (tenant_id, owner_id, name) DO NOTHING RETURNING id, created_at`
+	err = s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), v.OwnerID, v.Name, filter).Scan(&v.ID, &v.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrViewExists
+	}
+	return err
+}
+
+const viewColumns = "id, owner_id, name, filter, created_at"
+
+func scanView(row scanner) (*View, error) {
+	var v View
+	var filter []byte
+	if err := row.Scan(&v.ID, &v.OwnerID, &v.Name, &filter, &v.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(filter, &v.Filter); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (s *PostgresStore) ListViews(ctx context.Context, ownerID int) ([]View, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + viewColumns + ` FROM order_service.saved_views
+		WHERE tenant_id = $1 AND owner_id = $2 ORDER BY name`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []View{}
+	for rows.Next() {
+		v, err := scanView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, *v)
+	}
+	return views, rows.Err()
+}
+
+func (s *PostgresStore) GetView(ctx context.Context, ownerID, id int) (*View, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + viewColumns + ` FROM order_service.saved_views
+		WHERE id = $1 AND tenant_id = $2 AND owner_id = $3`
+	v, err := scanView(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx), ownerID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+func (s *PostgresStore) DeleteView(ctx context.Context, ownerID, id int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "DELETE FROM order_service.saved_views WHERE id = $1 AND tenant_id = $2 AND owner_id = $3"
+	res, err := s.db.ExecContext(ctx, query, id, tenant.FromContext(ctx), ownerID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package orders
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// maxTags bounds how many tags one order can carry.
+const maxTags = 20
+
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9:_-]{0,31}$`)
+
+// Filter selects orders for a search or a saved view. Orders must carry
+// every tag and be in one of the statuses; empty fields match everything.
+// CreatedFrom and the total bounds are inclusive, CreatedBefore is not. SKU
+// matches orders with a line for it.
+type Filter struct {
+	Tags          []string   `json:"tags,omitempty"`
+	Status        []string   `json:"status,omitempty"`
+	UserID        *int       `json:"user_id,omitempty"`
+	OrgID         *int       `json:"org_id,omitempty"`
+	CreatedFrom   *time.Time `json:"created_from,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	MinTotalCents *int64     `json:"min_total_cents,omitempty"`
+	MaxTotalCents *int64     `json:"max_total_cents,omitempty"`
+	SKU           string     `json:"sku,omitempty"`
+}
+
+var knownStatuses = []string{StatusPending, StatusPendingApproval, StatusRejected, StatusHeldDuplicate, StatusVoided,
+	StatusPaid, StatusPaymentFailed, StatusCancelled}
+
+// normalize lowercases tags and checks the filter, returning a message for
+// the caller when it is invalid.
+func (f *Filter) normalize() string {
+	for i, tag := range f.Tags {
+		f.Tags[i] = strings.ToLower(strings.TrimSpace(tag))
+		if !validTag.MatchString(f.Tags[i]) {
+			return "invalid tag " + strconv.Quote(tag)
+		}
+	}
+	for _, status := range f.Status {
+		if !contains(knownStatuses, status) {
+			return "unknown status " + strconv.Quote(status)
+		}
+	}
+	f.SKU = strings.TrimSpace(f.SKU)
+	switch {
+	case len(f.SKU) > 64:
+		return "sku must be at most 64 characters"
+	case f.CreatedFrom != nil && f.CreatedBefore != nil && !f.CreatedFrom.Before(*f.CreatedBefore):
+		return "created_from must be before created_before"
+	case f.MinTotalCents != nil && f.MaxTotalCents != nil && *f.MinTotalCents > *f.MaxTotalCents:
+		return "min_total_cents must not be above max_total_cents"
+	}
+	return ""
+}
+
+// filterFromQuery reads repeated tag and status parameters, user_id, org_id,
+// created_from, created_before, min_total_cents, max_total_cents and sku,
+// then narrows the result by the terms of q.
+func filterFromQuery(c *gin.Context) (Filter, bool) {
+	f := Filter{Tags: c.QueryArray("tag"), Status: c.QueryArray("status"), SKU: c.Query("sku")}
+	var ok bool
+	if f.UserID, ok = optionalInt(c, "user_id"); !ok {
+		return Filter{}, false
+	}
+	if f.OrgID, ok = optionalInt(c, "org_id"); !ok {
+		return Filter{}, false
+	}
+	if f.MinTotalCents, ok = optionalInt64(c, "min_total_cents"); !ok {
+		return Filter{}, false
+	}
+	if f.MaxTotalCents, ok = optionalInt64(c, "max_total_cents"); !ok {
+		return Filter{}, false
+	}
+	for name, dst := range map[string]**time.Time{"created_from": &f.CreatedFrom, "created_before": &f.CreatedBefore} {
+		if raw := c.Query(name); raw != "" {
+			at, _, err := parseSearchTime(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name + ", want a date or an RFC 3339 time"})
+				return Filter{}, false
+			}
+			*dst = &at
+		}
+	}
+	if err := f.applyQuery(c.Query("q")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return Filter{}, false
+	}
+	if msg := f.normalize(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return Filter{}, false
+	}
+	return f, true
+}
+
+func optionalInt(c *gin.Context, name string) (*int, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, true
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+		return nil, false
+	}
+	return &v, true
+}
+
+func optionalInt64(c *gin.Context, name string) (*int64, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, true
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+		return nil, false
+	}
+	return &v, true
+}
+
+// seesTags reports whether the caller may see order tags, which are for
+// internal triage only.
+func seesTags(c *gin.Context) bool {
+	p, ok := auth.FromContext(c)
+	return ok && (p.HasRole(auth.RoleAdmin) || p.HasRole(auth.RoleService))
+}
+
+// hideTags strips tags from orders the caller may not see them on.
+func hideTags(c *gin.Context, orders ...*Order) {
+	if seesTags(c) {
+		return
+	}
+	for _, o := range orders {
+		o.Tags = nil
+	}
+}
+
+type tagsRequest struct {
+	Tags []string `json:"tags" binding:"required,min=1"`
+}
+
+func (h *Handler) addTags(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	var req tagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f := Filter{Tags: req.Tags}
+	if msg := f.normalize(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	o, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	count := len(o.Tags)
+	for _, tag := range f.Tags {
+		if !contains(o.Tags, tag) {
+			count++
+		}
+	}
+	if count > maxTags {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "an order can have at most " + strconv.Itoa(maxTags) + " tags"})
+		return
+	}
+
+	tags, err := h.store.AddTags(c.Request.Context(), id, f.Tags)
+	h.respondTags(c, id, tags, err)
+}
+
+func (h *Handler) removeTag(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	tags, err := h.store.RemoveTag(c.Request.Context(), id, strings.ToLower(c.Param("tag")))
+	h.respondTags(c, id, tags, err)
+}
+
+func (h *Handler) respondTags(c *gin.Context, id int, tags []string, err error) {
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "tags": tags})
+}
+
+// searchLimit reads the limit parameter, 50 by default and at most 200.
+func searchLimit(c *gin.Context) (int, bool) {
+	limit := 50
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > 200 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return 0, false
+		}
+		limit = v
+	}
+	return limit, true
+}
+
+// search lists orders across customers for admins, filtered by tag, status,
+// user, org, creation time, total and SKU.
+func (h *Handler) search(c *gin.Context) {
+	f, ok := filterFromQuery(c)
+	if !ok {
+		return
+	}
+	limit, ok := searchLimit(c)
+	if !ok {
+		return
+	}
+	h.respondSearch(c, f, limit)
+}
+
+func (h *Handler) respondSearch(c *gin.Context, f Filter, limit int) {
+	orders, err := h.store.Search(c.Request.Context(), f, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": orders})
+}
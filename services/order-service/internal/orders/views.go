@@ -0,0 +1,124 @@
+package orders
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// View is an order search an admin saved under a name, so a triage queue
+// such as "held duplicates tagged vip" is one request away.
+type View struct {
+	ID        int       `json:"id"`
+	OwnerID   int       `json:"owner_id"`
+	Name      string    `json:"name"`
+	Filter    Filter    `json:"filter"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// viewOwner returns the admin user the caller's views belong to. Service
+// tokens have no user and so no views.
+func viewOwner(c *gin.Context) (int, bool) {
+	p, ok := auth.FromContext(c)
+	if !ok || p.UserID == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "saved views belong to admin users"})
+		return 0, false
+	}
+	return p.UserID, true
+}
+
+func (h *Handler) listViews(c *gin.Context) {
+	owner, ok := viewOwner(c)
+	if !ok {
+		return
+	}
+	views, err := h.store.ListViews(c.Request.Context(), owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"views": views})
+}
+
+type viewRequest struct {
+	Name   string `json:"name" binding:"required,max=64"`
+	Filter Filter `json:"filter"`
+}
+
+func (h *Handler) saveView(c *gin.Context) {
+	owner, ok := viewOwner(c)
+	if !ok {
+		return
+	}
+	var req viewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := req.Filter.normalize(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	v := &View{OwnerID: owner, Name: req.Name, Filter: req.Filter}
+	err := h.store.SaveView(c.Request.Context(), v)
+	if errors.Is(err, ErrViewExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "a view with that name already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, v)
+}
+
+func (h *Handler) deleteView(c *gin.Context) {
+	owner, ok := viewOwner(c)
+	if !ok {
+		return
+	}
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	err := h.store.DeleteView(c.Request.Context(), owner, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "view not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// viewOrders runs a saved view's search.
+func (h *Handler) viewOrders(c *gin.Context) {
+	owner, ok := viewOwner(c)
+	if !ok {
+		return
+	}
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	limit, ok := searchLimit(c)
+	if !ok {
+		return
+	}
+	v, err := h.store.GetView(c.Request.Context(), owner, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "view not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondSearch(c, v.Filter, limit)
+}
@@ -0,0 +1,324 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// WishlistItem is a SKU a user saved for later. With Notify set the user is
+// told once, on Channel, when the SKU is back in stock: NotifiedAt records
+// that, and saving the item again re-arms the alert. HeldUntil is set while
+// a unit is reserved for the user after the alert.
+type WishlistItem struct {
+	ID         int64      `json:"id"`
+	UserID     int        `json:"user_id"`
+	SKU        string     `json:"sku"`
+	Notify     bool       `json:"notify"`
+	Channel    string     `json:"channel"`
+	NotifiedAt *time.Time `json:"notified_at,omitempty"`
+	HeldUntil  *time.Time `json:"held_until,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	holdID     *int64
+}
+
+// Hold is inventory stock reserved for a wishlist item's user.
+type Hold struct {
+	ItemID        int64
+	UserID        int
+	SKU           string
+	ReservationID int64
+	Tenant        string
+}
+
+// validChannel matches notification-service's channel names.
+var validChannel = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+func (h *Handler) listWishlist(c *gin.Context) {
+	userID, ok := paramID(c)
+	if !ok || !auth.AuthorizeUser(c, userID) {
+		return
+	}
+	items, err := h.store.ListWishlist(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+type wishlistRequest struct {
+	Notify bool `json:"notify"`
+	// Channel is the notification channel back-in-stock alerts go out on,
+	// email by default.
+	Channel string `json:"channel"`
+}
+
+func (h *Handler) saveWishlistItem(c *gin.Context) {
+	userID, ok := paramID(c)
+	if !ok || !auth.AuthorizeUser(c, userID) {
+		return
+	}
+	var req wishlistRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Channel == "" {
+		req.Channel = "email"
+	}
+	if !validChannel.MatchString(req.Channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "channel must be lowercase letters, digits and underscores"})
+		return
+	}
+	sku := c.Param("sku")
+	if len(sku) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sku must be at most 64 characters"})
+		return
+	}
+	if h.products != nil {
+		_, err := h.products.GetProduct(c.Request.Context(), sku)
+		var apiErr *clients.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown product", "sku": sku})
+			return
+		}
+	}
+
+	item := &WishlistItem{UserID: userID, SKU: sku, Notify: req.Notify, Channel: req.Channel}
+	if err := h.store.SaveWishlistItem(c.Request.Context(), item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, item)
+}
+
+func (h *Handler) removeWishlistItem(c *gin.Context) {
+	userID, ok := paramID(c)
+	if !ok || !auth.AuthorizeUser(c, userID) {
+		return
+	}
+	item, err := h.store.RemoveWishlistItem(c.Request.Context(), userID, c.Param("sku"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item is not on the wishlist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if item.holdID != nil && h.backInStock != nil {
+		h.backInStock.release(c.Request.Context(), Hold{ItemID: item.ID, UserID: userID, SKU: item.SKU, ReservationID: *item.holdID})
+		h.invalidateStock(item.SKU)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// releaseHolds gives back the stock held for the user on the SKUs, so their
+// own hold does not fail the stock check of the order they are placing.
+func (h *Handler) releaseHolds(ctx context.Context, userID int, items []Item) {
+	if h.backInStock == nil {
+		return
+	}
+	var skus []string
+	for _, item := range items {
+		skus = append(skus, item.SKU)
+	}
+	for _, sku := range h.backInStock.releaseUserHolds(ctx, userID, skus) {
+		h.invalidateStock(sku)
+	}
+}
+
+func (h *Handler) invalidateStock(sku string) {
+	if h.stock != nil {
+		h.stock.Invalidate(sku)
+	}
+}
+
+const wishlistColumns = "id, user_id, sku, notify, channel, notified_at, hold_expires_at, created_at, hold_reservation_id"
+
+func scanWishlistItem(row scanner) (*WishlistItem, error) {
+	var it WishlistItem
+	var notifiedAt, heldUntil sql.NullTime
+	var holdID sql.NullInt64
+	if err := row.Scan(&it.ID, &it.UserID, &it.SKU, &it.Notify, &it.Channel, &notifiedAt, &heldUntil, &it.CreatedAt, &holdID); err != nil {
+		return nil, err
+	}
+	if notifiedAt.Valid {
+		it.NotifiedAt = &notifiedAt.Time
+	}
+	if heldUntil.Valid {
+		it.HeldUntil = &heldUntil.Time
+	}
+	if holdID.Valid {
+		it.holdID = &holdID.Int64
+	}
+	return &it, nil
+}
+
+func (s *PostgresStore) queryWishlist(ctx context.Context, query string, args ...any) ([]WishlistItem, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []WishlistItem{}
+	for rows.Next() {
+		it, err := scanWishlistItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *it)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) SaveWishlistItem(ctx context.Context, it *WishlistItem) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO order_service.wishlist_items (tenant_id, user_id, sku, notify, channel)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id, user_id, sku) DO UPDATE SET notify = EXCLUDED.notify, channel = EXCLUDED.channel,
+			notified_at = CASE WHEN EXCLUDED.notify THEN NULL ELSE wishlist_items.notified_at END
+		RETURNING ` + wishlistColumns
+	saved, err := scanWishlistItem(s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), it.UserID, it.SKU, it.Notify, it.Channel))
+	if err != nil {
+		return err
+	}
+	*it = *saved
+	return nil
+}
+
+func (s *PostgresStore) ListWishlist(ctx context.Context, userID int) ([]WishlistItem, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + wishlistColumns + ` FROM order_service.wishlist_items
+		WHERE tenant_id = $1 AND user_id = $2 ORDER BY created_at, id`
+	return s.queryWishlist(ctx, query, tenant.FromContext(ctx), userID)
+}
+
+func (s *PostgresStore) RemoveWishlistItem(ctx context.Context, userID int, sku string) (*WishlistItem, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM order_service.wishlist_items WHERE tenant_id = $1 AND user_id = $2 AND sku = $3
+		RETURNING ` + wishlistColumns
+	it, err := scanWishlistItem(s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), userID, sku))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return it, err
+}
+
+func (s *PostgresStore) ClaimWaiting(ctx context.Context, sku string, limit int) ([]WishlistItem, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// SKIP LOCKED lets replicas handling the same restock split the waiting
+	// users between them instead of alerting anyone twice.
+	const query string = `UPDATE order_service.wishlist_items SET notified_at = NOW()
+		WHERE id IN (SELECT id FROM order_service.wishlist_items
+			WHERE tenant_id = $1 AND sku = $2 AND notify AND notified_at IS NULL
+			ORDER BY created_at, id LIMIT $3 FOR UPDATE SKIP LOCKED)
+		RETURNING ` + wishlistColumns
+	items, err := s.queryWishlist(ctx, query, tenant.FromContext(ctx), sku, limit)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items, nil
+}
+
+func (s *PostgresStore) RearmWishlistItem(ctx context.Context, id int64) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const update string = "UPDATE order_service.wishlist_items SET notified_at = NULL WHERE id = $1 AND tenant_id = $2"
+	_, err := s.db.ExecContext(ctx, update, id, tenant.FromContext(ctx))
+	return err
+}
+
+func (s *PostgresStore) SetHold(ctx context.Context, id, reservationID int64, expiresAt time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const update string = `UPDATE order_service.wishlist_items SET hold_reservation_id = $2, hold_expires_at = $3
+		WHERE id = $1 AND tenant_id = $4`
+	res, err := s.db.ExecContext(ctx, update, id, reservationID, expiresAt, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// takeHolds clears the holds picked by the where clause, which is given the
+// query's arguments from $2 on, and returns what they held.
+func (s *PostgresStore) takeHolds(ctx context.Context, where string, args ...any) ([]Hold, error) {
+	query := `UPDATE order_service.wishlist_items w SET hold_reservation_id = NULL, hold_expires_at = NULL
+		FROM (SELECT id, hold_reservation_id FROM order_service.wishlist_items
+			WHERE hold_reservation_id IS NOT NULL AND ` + where + ` ORDER BY hold_expires_at LIMIT $1 FOR UPDATE SKIP LOCKED) held
+		WHERE w.id = held.id
+		RETURNING w.id, w.user_id, w.sku, held.hold_reservation_id, w.tenant_id`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []Hold{}
+	for rows.Next() {
+		var h Hold
+		if err := rows.Scan(&h.ItemID, &h.UserID, &h.SKU, &h.ReservationID, &h.Tenant); err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+func (s *PostgresStore) TakeHolds(ctx context.Context, userID int, skus []string) ([]Hold, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return s.takeHolds(ctx, "tenant_id = $2 AND user_id = $3 AND sku = ANY($4)",
+		len(skus), tenant.FromContext(ctx), userID, pq.Array(skus))
+}
+
+func (s *PostgresStore) TakeExpiredHolds(ctx context.Context, now time.Time, limit int) ([]Hold, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return s.takeHolds(ctx, "hold_expires_at <= $2", limit, now)
+}
+
+// holdReference names the reservation held for a wishlist item, so it can
+// be traced in inventory.
+func holdReference(itemID int64) string {
+	return "back-in-stock:" + strconv.FormatInt(itemID, 10)
+}
@@ -0,0 +1,65 @@
+package projections
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/orders/status/report", auth.RequireRole(auth.RoleAdmin), h.statusReport)
+}
+
+// statusReport reads the order_status_daily read model, which trails the
+// order history by up to the catch-up interval; updated_at says how far.
+func (h *Handler) statusReport(c *gin.Context) {
+	to, ok := reportDay(c, "to", time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1))
+	if !ok {
+		return
+	}
+	from, ok := reportDay(c, "from", to.AddDate(0, 0, -30))
+	if !ok {
+		return
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	rows, updatedAt, err := h.store.StatusReport(c.Request.Context(), from, to)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the order status report has not been built yet"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from.Format(time.DateOnly), "to": to.Format(time.DateOnly), "updated_at": updatedAt, "rows": rows})
+}
+
+// reportDay parses a report bound given as a date such as 2026-03-01.
+func reportDay(c *gin.Context, name string, fallback time.Time) (time.Time, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return fallback, true
+	}
+	t, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a date such as 2026-03-01"})
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,215 @@
+// Package projections builds order-service's read models from the order
+// event stream, the append-only order_service.order_status_history. Each
+// read model is a Projection, kept in numbered generation tables behind a
+// view named after it. A rebuild replays the stream into a new generation
+// while the live one keeps serving, checkpointing after every batch so an
+// interrupted rebuild resumes where it stopped, and then swaps the view
+// over in one transaction.
+package projections
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrBuilding is returned when starting a generation while another is
+	// still being built.
+	ErrBuilding = errors.New("a generation is already being built")
+	// ErrStale is returned when a generation's checkpoint moved on since it
+	// was read, because another replica or rebuild applied the events first.
+	ErrStale = errors.New("generation checkpoint moved on")
+)
+
+// Event is one entry of the order event stream.
+type Event struct {
+	ID      int64
+	OrderID int
+	Tenant  string
+	From    string
+	To      string
+	At      time.Time
+}
+
+// Projection folds the event stream into a read model.
+type Projection interface {
+	// Name names the view the read model is queried through.
+	Name() string
+	// Schema returns the statement that creates an empty generation table.
+	Schema(table string) string
+	// Apply folds events, in order, into table. It runs in the transaction
+	// that advances the generation's checkpoint, so each event is applied
+	// to a generation once.
+	Apply(ctx context.Context, tx *sql.Tx, table string, events []Event) error
+}
+
+// All lists the projections order-service maintains.
+func All() []Projection {
+	return []Projection{StatusDaily{}}
+}
+
+// Find returns the projection called name.
+func Find(name string) (Projection, error) {
+	for _, p := range All() {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown projection %q", name)
+}
+
+// Generation states. A projection has at most one live generation, which
+// its view points at, and at most one being built.
+const (
+	StateBuilding = "building"
+	StateLive     = "live"
+	StateRetired  = "retired"
+)
+
+// Generation is one build of a projection and its checkpoint, the ID of
+// the last event applied to it.
+type Generation struct {
+	Projection  string    `json:"projection"`
+	Number      int       `json:"generation"`
+	State       string    `json:"state"`
+	LastEventID int64     `json:"last_event_id"`
+	StartedAt   time.Time `json:"started_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Table is the table the generation's read model is kept in.
+func (g *Generation) Table() string {
+	return fmt.Sprintf("order_service.%s_g%d", g.Projection, g.Number)
+}
+
+// Progress is reported after each batch a replay applies.
+type Progress struct {
+	Generation *Generation
+	Applied    int64
+	Total      int64
+	Elapsed    time.Duration
+}
+
+// RebuildOptions controls a rebuild. Restart discards a generation left
+// half built instead of resuming it, and NoSwap leaves the new generation
+// built but not live, for checking before a later rebuild swaps it in.
+type RebuildOptions struct {
+	Restart  bool
+	NoSwap   bool
+	Progress func(Progress)
+}
+
+// Projector replays the event stream into projections batch events at a
+// time.
+type Projector struct {
+	store Store
+	batch int
+	now   func() time.Time
+}
+
+func NewProjector(store Store, batch int) *Projector {
+	if batch <= 0 {
+		batch = 1000
+	}
+	return &Projector{store: store, batch: batch, now: time.Now}
+}
+
+// Rebuild builds p from the start of the stream into a new generation, or
+// resumes the one a previous rebuild left half built, and makes it live.
+// The old generation serves until the swap and is dropped by it.
+func (pr *Projector) Rebuild(ctx context.Context, p Projection, opts RebuildOptions) (*Generation, error) {
+	_, building, err := pr.store.Generations(ctx, p.Name())
+	if err != nil {
+		return nil, err
+	}
+	if building != nil && opts.Restart {
+		if err := pr.store.Discard(ctx, p, building); err != nil {
+			return nil, err
+		}
+		building = nil
+	}
+	g := building
+	if g == nil {
+		if g, err = pr.store.Start(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	if err := pr.replay(ctx, p, g, opts.Progress); err != nil {
+		return nil, err
+	}
+	if opts.NoSwap {
+		return g, nil
+	}
+	return pr.store.Swap(ctx, p, g)
+}
+
+// CatchUp applies the events recorded since p's live generation was last
+// updated. A projection with no live generation yet is rebuilt, resuming
+// any build already started.
+func (pr *Projector) CatchUp(ctx context.Context, p Projection) error {
+	live, _, err := pr.store.Generations(ctx, p.Name())
+	if err != nil {
+		return err
+	}
+	if live != nil {
+		err = pr.replay(ctx, p, live, nil)
+	} else {
+		_, err = pr.Rebuild(ctx, p, RebuildOptions{})
+	}
+	// Replicas run the job side by side; whichever applies a batch first
+	// wins and the others pick up from there on their next run.
+	if errors.Is(err, ErrStale) || errors.Is(err, ErrBuilding) {
+		return nil
+	}
+	return err
+}
+
+// Job catches up every projection, for running on a schedule.
+func (pr *Projector) Job() jobs.Func {
+	return func(ctx context.Context) error {
+		var failed error
+		for _, p := range All() {
+			if err := pr.CatchUp(ctx, p); err != nil {
+				log.Printf("Failed to catch up projection %s: %v", p.Name(), err)
+				failed = err
+			}
+		}
+		return failed
+	}
+}
+
+// replay applies the events after g's checkpoint up to the head of the
+// stream as it stands when the replay starts.
+func (pr *Projector) replay(ctx context.Context, p Projection, g *Generation, progress func(Progress)) error {
+	head, total, err := pr.store.Pending(ctx, g.LastEventID)
+	if err != nil {
+		return err
+	}
+	started := pr.now()
+	var applied int64
+	for g.LastEventID < head {
+		batch, err := pr.store.Events(ctx, g.LastEventID, head, pr.batch)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if err := pr.store.Apply(ctx, p, g, batch); err != nil {
+			return err
+		}
+		g.LastEventID = batch[len(batch)-1].ID
+		applied += int64(len(batch))
+		if progress != nil {
+			progress(Progress{Generation: g, Applied: applied, Total: total, Elapsed: pr.now().Sub(started)})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package projections
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps a stream of events and each generation's applied events.
+type memStore struct {
+	events      []Event
+	generations []*Generation
+	applied     map[int][]int64
+	failAfter   int
+	swaps       int
+}
+
+func newMemStore(n int) *memStore {
+	s := &memStore{applied: map[int][]int64{}}
+	for i := 1; i <= n; i++ {
+		s.events = append(s.events, Event{ID: int64(i * 10), OrderID: i, Tenant: "acme", To: "pending"})
+	}
+	return s
+}
+
+func (s *memStore) Generations(ctx context.Context, projection string) (*Generation, *Generation, error) {
+	var live, building *Generation
+	for _, g := range s.generations {
+		copied := *g
+		switch g.State {
+		case StateLive:
+			live = &copied
+		case StateBuilding:
+			building = &copied
+		}
+	}
+	return live, building, nil
+}
+
+func (s *memStore) List(ctx context.Context, projection string) ([]Generation, error) {
+	return nil, nil
+}
+
+func (s *memStore) Pending(ctx context.Context, after int64) (int64, int64, error) {
+	head, count := after, int64(0)
+	for _, e := range s.events {
+		if e.ID > after {
+			head, count = e.ID, count+1
+		}
+	}
+	return head, count, nil
+}
+
+func (s *memStore) Events(ctx context.Context, after, upTo int64, limit int) ([]Event, error) {
+	var batch []Event
+	for _, e := range s.events {
+		if e.ID > after && e.ID <= upTo && len(batch) < limit {
+			batch = append(batch, e)
+		}
+	}
+	return batch, nil
+}
+
+func (s *memStore) Start(ctx context.Context, p Projection) (*Generation, error) {
+	for _, g := range s.generations {
+		if g.State == StateBuilding {
+			return nil, ErrBuilding
+		}
+	}
+	g := &Generation{Projection: p.Name(), Number: len(s.generations) + 1, State: StateBuilding}
+	s.generations = append(s.generations, g)
+	copied := *g
+	return &copied, nil
+}
+
+func (s *memStore) find(number int) *Generation {
+	return s.generations[number-1]
+}
+
+func (s *memStore) Discard(ctx context.Context, p Projection, g *Generation) error {
+	s.find(g.Number).State = StateRetired
+	return nil
+}
+
+func (s *memStore) Apply(ctx context.Context, p Projection, g *Generation, batch []Event) error {
+	stored := s.find(g.Number)
+	if stored.LastEventID != g.LastEventID || stored.State == StateRetired {
+		return ErrStale
+	}
+	if s.failAfter > 0 && len(s.applied[g.Number]) >= s.failAfter {
+		return context.Canceled
+	}
+	for _, e := range batch {
+		s.applied[g.Number] = append(s.applied[g.Number], e.ID)
+	}
+	stored.LastEventID = batch[len(batch)-1].ID
+	return nil
+}
+
+func (s *memStore) Swap(ctx context.Context, p Projection, g *Generation) (*Generation, error) {
+	for _, old := range s.generations {
+		if old.State == StateLive {
+			old.State = StateRetired
+		}
+	}
+	stored := s.find(g.Number)
+	stored.State = StateLive
+	s.swaps++
+	copied := *stored
+	return &copied, nil
+}
+
+func (s *memStore) StatusReport(ctx context.Context, from, to time.Time) ([]StatusCount, time.Time, error) {
+	if s.swaps == 0 {
+		return nil, time.Time{}, ErrNotFound
+	}
+	return []StatusCount{{Day: from.Format(time.DateOnly), Status: "paid", Orders: 3}}, time.Date(2026, time.March, 2, 0, 0, 0, 0, time.UTC), nil
+}
+
+func TestRebuildResumesFromCheckpoint(t *testing.T) {
+	store := newMemStore(5)
+	store.failAfter = 2
+	projector := NewProjector(store, 2)
+
+	if _, err := projector.Rebuild(context.Background(), StatusDaily{}, RebuildOptions{}); err == nil {
+		t.Fatal("Expected the interrupted rebuild to fail")
+	}
+	if got := store.find(1).LastEventID; got != 20 {
+		t.Fatalf("Expected the checkpoint after the first batch, got: %d", got)
+	}
+
+	store.failAfter = 0
+	var reports []Progress
+	g, err := projector.Rebuild(context.Background(), StatusDaily{}, RebuildOptions{Progress: func(p Progress) { reports = append(reports, p) }})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if g.Number != 1 || g.State != StateLive || g.LastEventID != 50 {
+		t.Errorf("Expected generation 1 to be resumed and made live, got: %+v", g)
+	}
+	if want := []int64{10, 20, 30, 40, 50}; !reflect.DeepEqual(store.applied[1], want) {
+		t.Errorf("Expected each event applied once, got: %v", store.applied[1])
+	}
+	if len(reports) != 2 || reports[1].Applied != 3 || reports[1].Total != 3 {
+		t.Errorf("Expected progress over the three remaining events, got: %+v", reports)
+	}
+}
+
+func TestRebuildSwapsGenerations(t *testing.T) {
+	store := newMemStore(3)
+	projector := NewProjector(store, 10)
+	if _, err := projector.Rebuild(context.Background(), StatusDaily{}, RebuildOptions{}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// A build left half done is discarded on restart, and the live
+	// generation serves until the new one is swapped in.
+	if _, err := store.Start(context.Background(), StatusDaily{}); err != nil {
+		t.Fatal(err)
+	}
+	g, err := projector.Rebuild(context.Background(), StatusDaily{}, RebuildOptions{Restart: true, NoSwap: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if g.Number != 3 || store.find(2).State != StateRetired || store.find(1).State != StateLive {
+		t.Fatalf("Expected generation 3 built beside live generation 1, got: %+v", store.generations)
+	}
+	if g, err = projector.Rebuild(context.Background(), StatusDaily{}, RebuildOptions{}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if g.Number != 3 || store.find(3).State != StateLive || store.find(1).State != StateRetired {
+		t.Errorf("Expected generation 3 to replace generation 1, got: %+v", store.generations)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	store := newMemStore(2)
+	projector := NewProjector(store, 10)
+
+	// The first run builds the projection.
+	if err := projector.CatchUp(context.Background(), StatusDaily{}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if store.swaps != 1 {
+		t.Fatalf("Expected the projection to be built, got %d swaps", store.swaps)
+	}
+
+	store.events = append(store.events, Event{ID: 30, Tenant: "acme", To: "paid"})
+	if err := projector.CatchUp(context.Background(), StatusDaily{}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if want := []int64{10, 20, 30}; !reflect.DeepEqual(store.applied[1], want) || store.swaps != 1 {
+		t.Errorf("Expected the new event applied to the live generation, got: %v", store.applied[1])
+	}
+
+	// Another replica got there first.
+	store.events = append(store.events, Event{ID: 40, Tenant: "acme", To: "shipped"})
+	stale := &staleStore{memStore: store}
+	if err := NewProjector(stale, 10).CatchUp(context.Background(), StatusDaily{}); err != nil {
+		t.Errorf("Expected a stale checkpoint to be left for the next run, got: %v", err)
+	}
+}
+
+// staleStore loses every race to apply a batch.
+type staleStore struct {
+	*memStore
+}
+
+func (s *staleStore) Apply(ctx context.Context, p Projection, g *Generation, batch []Event) error {
+	return ErrStale
+}
+
+func TestDailyCounts(t *testing.T) {
+	day := time.Date(2026, time.March, 1, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60))
+	counts := dailyCounts([]Event{
+		{Tenant: "acme", To: "paid", At: day},
+		{Tenant: "acme", To: "pending", At: day},
+		{Tenant: "acme", To: "paid", At: day.Add(time.Minute)},
+		{Tenant: "globex", To: "paid", At: day},
+	})
+	want := []tenantCount{
+		{tenant: "acme", StatusCount: StatusCount{Day: "2026-03-02", Status: "paid", Orders: 2}},
+		{tenant: "acme", StatusCount: StatusCount{Day: "2026-03-02", Status: "pending", Orders: 1}},
+		{tenant: "globex", StatusCount: StatusCount{Day: "2026-03-02", Status: "paid", Orders: 1}},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("Expected counts per tenant, UTC day and status, got: %+v", counts)
+	}
+}
+
+func TestStatusReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newMemStore(0)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.WithPrincipal(c, &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}})
+	})
+	NewHandler(store).RegisterRoutes(router)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders/status/report"+query, nil))
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the projection is built, got: %d", w.Code)
+	}
+	store.swaps = 1
+	for _, query := range []string{"?from=yesterday", "?from=2026-03-02&to=2026-03-01"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got: %d", query, w.Code)
+		}
+	}
+	w := get("?from=2026-03-01&to=2026-03-08")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `{"day":"2026-03-01","status":"paid","orders":3}`) {
+		t.Errorf("Expected the report rows, got: %d %s", w.Code, w.Body)
+	}
+}
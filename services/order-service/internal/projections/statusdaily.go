@@ -0,0 +1,78 @@
+package projections
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// StatusDaily counts, per tenant and UTC day, the orders that moved into
+// each status.
+type StatusDaily struct{}
+
+// StatusCount is one row of the order_status_daily read model.
+type StatusCount struct {
+	Day    string `json:"day"`
+	Status string `json:"status"`
+	Orders int    `json:"orders"`
+}
+
+func (StatusDaily) Name() string {
+	return "order_status_daily"
+}
+
+func (StatusDaily) Schema(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+		tenant_id VARCHAR(63) NOT NULL,
+		day DATE NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		orders INTEGER NOT NULL,
+		PRIMARY KEY (tenant_id, day, status)
+	)`, table)
+}
+
+func (StatusDaily) Apply(ctx context.Context, tx *sql.Tx, table string, events []Event) error {
+	query := fmt.Sprintf(`INSERT INTO %s (tenant_id, day, status, orders) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, day, status) DO UPDATE SET orders = %s.orders + EXCLUDED.orders`, table, table)
+	for _, row := range dailyCounts(events) {
+		if _, err := tx.ExecContext(ctx, query, row.tenant, row.Day, row.Status, row.Orders); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tenantCount struct {
+	tenant string
+	StatusCount
+}
+
+// dailyCounts folds a batch into one count per tenant, day and status, so
+// a batch costs one upsert per row it touches rather than per event.
+func dailyCounts(events []Event) []tenantCount {
+	index := map[tenantCount]int{}
+	var counts []tenantCount
+	for _, e := range events {
+		key := tenantCount{tenant: e.Tenant, StatusCount: StatusCount{Day: e.At.UTC().Format(time.DateOnly), Status: e.To}}
+		i, ok := index[key]
+		if !ok {
+			i = len(counts)
+			index[key] = i
+			counts = append(counts, key)
+		}
+		counts[i].Orders++
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if a.tenant != b.tenant {
+			return a.tenant < b.tenant
+		}
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return a.Status < b.Status
+	})
+	return counts
+}
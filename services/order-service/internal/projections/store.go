@@ -0,0 +1,339 @@
+package projections
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+type Store interface {
+	// Generations returns the projection's live generation and the one
+	// being built; either is nil when there is none.
+	Generations(ctx context.Context, projection string) (live, building *Generation, err error)
+	// List returns every generation of the projection, newest first.
+	List(ctx context.Context, projection string) ([]Generation, error)
+	// Pending returns the ID of the last settled event and how many
+	// settled events follow after.
+	Pending(ctx context.Context, after int64) (head, count int64, err error)
+	// Events returns up to limit events after after and up to upTo, in
+	// order.
+	Events(ctx context.Context, after, upTo int64, limit int) ([]Event, error)
+	// Start creates an empty generation to build, or returns ErrBuilding.
+	Start(ctx context.Context, p Projection) (*Generation, error)
+	// Discard retires a generation being built and drops its table.
+	Discard(ctx context.Context, p Projection, g *Generation) error
+	// Apply folds events into g and moves its checkpoint to the last of
+	// them, or returns ErrStale if the checkpoint is no longer where g
+	// says.
+	Apply(ctx context.Context, p Projection, g *Generation, events []Event) error
+	// Swap applies the events recorded since g's checkpoint, points the
+	// projection's view at g and retires the live generation, dropping its
+	// table, all in one transaction.
+	Swap(ctx context.Context, p Projection, g *Generation) (*Generation, error)
+	// StatusReport returns the tenant's order_status_daily rows for days
+	// in [from, to), and when the live generation was last updated.
+	StatusReport(ctx context.Context, from, to time.Time) ([]StatusCount, time.Time, error)
+}
+
+// settled holds back the latest events: an event's ID is taken before its
+// transaction commits, so one committing late could otherwise be passed
+// over by a replay that has already seen a higher ID.
+const settled = `h.created_at < NOW() - INTERVAL '1 minute'`
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const generationColumns = `projection, generation, state, last_event_id, started_at, updated_at`
+
+func scanGeneration(row interface{ Scan(...any) error }) (*Generation, error) {
+	var g Generation
+	err := row.Scan(&g.Projection, &g.Number, &g.State, &g.LastEventID, &g.StartedAt, &g.UpdatedAt)
+	return &g, err
+}
+
+func (s *PostgresStore) Generations(ctx context.Context, projection string) (*Generation, *Generation, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + generationColumns + ` FROM order_service.projection_generations
+		WHERE projection = $1 AND state IN ('live', 'building')`
+	rows, err := s.db.QueryContext(ctx, query, projection)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var live, building *Generation
+	for rows.Next() {
+		g, err := scanGeneration(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if g.State == StateLive {
+			live = g
+		} else {
+			building = g
+		}
+	}
+	return live, building, rows.Err()
+}
+
+func (s *PostgresStore) List(ctx context.Context, projection string) ([]Generation, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + generationColumns + ` FROM order_service.projection_generations
+		WHERE projection = $1 ORDER BY generation DESC`
+	rows, err := s.db.QueryContext(ctx, query, projection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gens []Generation
+	for rows.Next() {
+		g, err := scanGeneration(rows)
+		if err != nil {
+			return nil, err
+		}
+		gens = append(gens, *g)
+	}
+	return gens, rows.Err()
+}
+
+func (s *PostgresStore) Pending(ctx context.Context, after int64) (int64, int64, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	return pending(ctx, s.db, after)
+}
+
+func pending(ctx context.Context, q queryer, after int64) (int64, int64, error) {
+	const query string = `SELECT COALESCE(MAX(h.id), $1), COUNT(*) FROM order_service.all_order_status_history h
+		WHERE h.id > $1 AND ` + settled
+	var head, count int64
+	err := q.QueryRowContext(ctx, query, after).Scan(&head, &count)
+	return head, count, err
+}
+
+func (s *PostgresStore) Events(ctx context.Context, after, upTo int64, limit int) ([]Event, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	return events(ctx, s.db, after, upTo, limit)
+}
+
+// events reads the stream across tenants, tagging each event with its
+// order's tenant for the projections to key their rows by. Archived
+// orders' events are read from the archive, so a rebuild still sees them.
+func events(ctx context.Context, q queryer, after, upTo int64, limit int) ([]Event, error) {
+	const query string = `SELECT h.id, h.order_id, o.tenant_id, COALESCE(h.from_status, ''), h.to_status, h.created_at
+		FROM order_service.all_order_status_history h
+		JOIN order_service.all_orders o ON o.id = h.order_id
+		WHERE h.id > $1 AND h.id <= $2
+		ORDER BY h.id LIMIT $3`
+	rows, err := q.QueryContext(ctx, query, after, upTo, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.Tenant, &e.From, &e.To, &e.At); err != nil {
+			return nil, err
+		}
+		batch = append(batch, e)
+	}
+	return batch, rows.Err()
+}
+
+func (s *PostgresStore) Start(ctx context.Context, p Projection) (*Generation, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var g *Generation
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const query string = `INSERT INTO order_service.projection_generations (projection, generation)
+			SELECT $1, COALESCE(MAX(generation), 0) + 1 FROM order_service.projection_generations WHERE projection = $1
+			RETURNING ` + generationColumns
+		var err error
+		if g, err = scanGeneration(tx.QueryRowContext(ctx, query, p.Name())); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, p.Schema(g.Table()))
+		return err
+	})
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return nil, ErrBuilding
+	}
+	return g, err
+}
+
+func (s *PostgresStore) Discard(ctx context.Context, p Projection, g *Generation) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const query string = `UPDATE order_service.projection_generations SET state = 'retired', updated_at = NOW()
+			WHERE projection = $1 AND generation = $2 AND state = 'building'`
+		res, err := tx.ExecContext(ctx, query, g.Projection, g.Number)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.ExecContext(ctx, `DROP TABLE IF EXISTS `+g.Table())
+		return err
+	})
+}
+
+func (s *PostgresStore) Apply(ctx context.Context, p Projection, g *Generation, batch []Event) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		return apply(ctx, tx, p, g, g.LastEventID, batch)
+	})
+}
+
+// apply moves g's checkpoint from after to the last event of batch first,
+// which locks the row against anyone applying the same events at once.
+func apply(ctx context.Context, tx *sql.Tx, p Projection, g *Generation, after int64, batch []Event) error {
+	const query string = `UPDATE order_service.projection_generations SET last_event_id = $4, updated_at = NOW()
+		WHERE projection = $1 AND generation = $2 AND last_event_id = $3 AND state <> 'retired'`
+	res, err := tx.ExecContext(ctx, query, g.Projection, g.Number, after, batch[len(batch)-1].ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrStale
+	}
+	return p.Apply(ctx, tx, g.Table(), batch)
+}
+
+func (s *PostgresStore) Swap(ctx context.Context, p Projection, g *Generation) (*Generation, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var swapped *Generation
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		// Locking both generations holds off the catch-up job until the
+		// view points at the new one.
+		const lock string = `SELECT ` + generationColumns + ` FROM order_service.projection_generations
+			WHERE projection = $1 AND state IN ('live', 'building') ORDER BY generation FOR UPDATE`
+		rows, err := tx.QueryContext(ctx, lock, g.Projection)
+		if err != nil {
+			return err
+		}
+		var live, building *Generation
+		for rows.Next() {
+			locked, err := scanGeneration(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if locked.State == StateLive {
+				live = locked
+			} else {
+				building = locked
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if building == nil || building.Number != g.Number || building.LastEventID != g.LastEventID {
+			return ErrStale
+		}
+
+		head, _, err := pending(ctx, tx, building.LastEventID)
+		if err != nil {
+			return err
+		}
+		for building.LastEventID < head {
+			batch, err := events(ctx, tx, building.LastEventID, head, 1000)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			if err := apply(ctx, tx, p, building, building.LastEventID, batch); err != nil {
+				return err
+			}
+			building.LastEventID = batch[len(batch)-1].ID
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE OR REPLACE VIEW order_service.%s AS SELECT * FROM %s`, p.Name(), building.Table())); err != nil {
+			return err
+		}
+		const retire string = `UPDATE order_service.projection_generations SET state = 'retired', updated_at = NOW()
+			WHERE projection = $1 AND state = 'live'`
+		if _, err := tx.ExecContext(ctx, retire, g.Projection); err != nil {
+			return err
+		}
+		const promote string = `UPDATE order_service.projection_generations SET state = 'live', swapped_at = NOW(), updated_at = NOW()
+			WHERE projection = $1 AND generation = $2
+			RETURNING ` + generationColumns
+		if swapped, err = scanGeneration(tx.QueryRowContext(ctx, promote, g.Projection, g.Number)); err != nil {
+			return err
+		}
+		if live != nil {
+			_, err = tx.ExecContext(ctx, `DROP TABLE IF EXISTS `+live.Table())
+		}
+		return err
+	})
+	return swapped, err
+}
+
+func (s *PostgresStore) StatusReport(ctx context.Context, from, to time.Time) ([]StatusCount, time.Time, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const asOf string = `SELECT updated_at FROM order_service.projection_generations WHERE projection = $1 AND state = 'live'`
+	var updatedAt time.Time
+	err := s.db.QueryRowContext(ctx, asOf, StatusDaily{}.Name()).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	const query string = `SELECT to_char(day, 'YYYY-MM-DD'), status, orders FROM order_service.order_status_daily
+		WHERE tenant_id = $1 AND day >= $2 AND day < $3
+		ORDER BY day, status`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), from, to)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	counts := []StatusCount{}
+	for rows.Next() {
+		var sc StatusCount
+		if err := rows.Scan(&sc.Day, &sc.Status, &sc.Orders); err != nil {
+			return nil, time.Time{}, err
+		}
+		counts = append(counts, sc)
+	}
+	return counts, updatedAt, rows.Err()
+}
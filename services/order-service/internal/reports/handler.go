@@ -0,0 +1,140 @@
+package reports
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store    Store
+	worker   *Worker
+	syncDays int
+	now      func() time.Time
+}
+
+// NewHandler builds reports of up to syncDays days while the caller waits,
+// and queues longer ones on worker.
+func NewHandler(store Store, worker *Worker, syncDays int) *Handler {
+	return &Handler{store: store, worker: worker, syncDays: syncDays, now: time.Now}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Only admins see sales reports.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	admin := auth.RequireRole(auth.RoleAdmin)
+	router.GET("/orders/report", admin, h.report)
+	router.GET("/orders/report/:id", admin, h.get)
+	router.GET("/orders/report/:id/download", admin, h.download)
+}
+
+// report answers with the file for a short range, and 202 with the job to
+// follow for a long one or when ?async=true asks for a job.
+func (h *Handler) report(c *gin.Context) {
+	format := c.DefaultQuery("format", FormatCSV)
+	if format != FormatCSV && format != FormatXLSX {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
+		return
+	}
+	to, ok := reportDay(c, "to", h.now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1))
+	if !ok {
+		return
+	}
+	from, ok := reportDay(c, "from", to.AddDate(0, 0, -30))
+	if !ok {
+		return
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	fromDay, toDay := from.Format(time.DateOnly), to.Format(time.DateOnly)
+	days := int(to.Sub(from).Hours() / 24)
+	if days <= h.syncDays && c.Query("async") != "true" {
+		content, err := generate(c.Request.Context(), h.store, fromDay, toDay, format)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename(fromDay, toDay, format)))
+		c.Data(http.StatusOK, contentType(format), content)
+		return
+	}
+
+	p, _ := auth.FromContext(c)
+	j := &Job{Format: format, From: fromDay, To: toDay, RequestedBy: "user:" + strconv.Itoa(p.UserID)}
+	if err := h.store.Create(c.Request.Context(), j); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.worker.Enqueue(*j)
+	c.Header("Location", fmt.Sprintf("/orders/report/%d", j.ID))
+	c.JSON(http.StatusAccepted, j)
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	j, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, j)
+}
+
+// download serves a ready report's file. Expired reports are deleted, so
+// they are not found.
+func (h *Handler) download(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	j, content, err := h.store.Content(c.Request.Context(), id)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+	case errors.Is(err, ErrInvalidState):
+		c.JSON(http.StatusConflict, gin.H{"error": "report is " + j.Status, "job": j})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, j.Filename()))
+		c.Data(http.StatusOK, contentType(j.Format), content)
+	}
+}
+
+func paramID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+		return 0, false
+	}
+	return id, true
+}
+
+// reportDay parses a report bound given as a date such as 2026-03-01.
+func reportDay(c *gin.Context, name string, fallback time.Time) (time.Time, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return fallback, true
+	}
+	t, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a date such as 2026-03-01"})
+		return time.Time{}, false
+	}
+	return t, true
+}
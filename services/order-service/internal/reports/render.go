@@ -0,0 +1,152 @@
+package reports
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	dayHeader = []string{"day", "currency", "orders", "revenue"}
+	skuHeader = []string{"rank", "sku", "name", "unit", "currency", "units", "orders", "revenue"}
+)
+
+// render builds the report file in format.
+func render(s *Sales, format string) ([]byte, error) {
+	if format == FormatXLSX {
+		return renderXLSX(s)
+	}
+	return renderCSV(s)
+}
+
+// rows lays out the report's two tables, with amounts in major units.
+func rows(s *Sales) (days, skus [][]string) {
+	for _, d := range s.Days {
+		days = append(days, []string{d.Day, d.Currency, strconv.Itoa(d.Orders), amount(d.RevenueCents)})
+	}
+	for i, k := range s.TopSKUs {
+		skus = append(skus, []string{strconv.Itoa(i + 1), k.SKU, k.Name, k.Unit, k.Currency,
+			strconv.Itoa(k.Units), strconv.Itoa(k.Orders), amount(k.RevenueCents)})
+	}
+	return days, skus
+}
+
+func amount(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// renderCSV writes the daily table, a blank line, then the top SKUs, each
+// with its own header row.
+func renderCSV(s *Sales) ([]byte, error) {
+	days, skus := rows(s)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(dayHeader)
+	w.WriteAll(days)
+	buf.WriteString("\n")
+	w.Write(skuHeader)
+	w.WriteAll(skus)
+	return buf.Bytes(), w.Error()
+}
+
+// renderXLSX writes a workbook with a Daily and a Top SKUs sheet. Text is
+// stored inline in each cell and numbers as numbers, so no shared strings
+// or styles are needed.
+func renderXLSX(s *Sales) ([]byte, error) {
+	days, skus := rows(s)
+	// Columns holding numbers: orders and revenue on Daily; rank, units,
+	// orders and revenue on Top SKUs.
+	sheets := []struct {
+		name    string
+		rows    [][]string
+		numbers map[int]bool
+	}{
+		{"Daily", append([][]string{dayHeader}, days...), map[int]bool{2: true, 3: true}},
+		{"Top SKUs", append([][]string{skuHeader}, skus...), map[int]bool{0: true, 5: true, 6: true, 7: true}},
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	add := func(name, body string) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write([]byte(xml.Header + body))
+		return err
+	}
+
+	var types, entries, rels strings.Builder
+	for i, sheet := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&entries, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, escapeXML(sheet.name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+		if err := add(fmt.Sprintf("xl/worksheets/sheet%d.xml", n), worksheet(sheet.rows, sheet.numbers)); err != nil {
+			return nil, err
+		}
+	}
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			types.String() + `</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>` + entries.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			rels.String() + `</Relationships>`},
+	}
+	for _, p := range parts {
+		if err := add(p.name, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// worksheet lays rows out as cells A1 onwards. The header row is always
+// text.
+func worksheet(rows [][]string, numbers map[int]bool) string {
+	var b strings.Builder
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		fmt.Fprintf(&b, `<row r="%d">`, i+1)
+		for j, v := range row {
+			ref := column(j) + strconv.Itoa(i+1)
+			if i > 0 && numbers[j] {
+				fmt.Fprintf(&b, `<c r="%s"><v>%s</v></c>`, ref, v)
+			} else {
+				fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, escapeXML(v))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String()
+}
+
+// column names the zero-based column i as A to Z, then AA onwards.
+func column(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
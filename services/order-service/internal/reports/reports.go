@@ -0,0 +1,95 @@
+// Package reports builds sales reports over a range of days as CSV or
+// Excel files: paid orders and revenue per day, and the best-selling SKUs.
+// A short range is built while the caller waits. A longer one becomes a job
+// that is queued on the background job runner, kept with its file until it
+// expires, and downloaded once it is ready.
+package reports
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// Job statuses. A pending job is queued, or will be by the next sweep.
+const (
+	StatusPending = "pending"
+	StatusReady   = "ready"
+	StatusFailed  = "failed"
+)
+
+// topSKUs is how many SKUs a report ranks.
+const topSKUs = 20
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidState is returned when downloading a report that is not
+	// ready, or finishing a job that is no longer pending.
+	ErrInvalidState = errors.New("invalid state")
+)
+
+// Sales is a tenant's paid orders placed on days in [From, To). Amounts
+// are never added up across currencies, so rows are per currency.
+type Sales struct {
+	From    time.Time
+	To      time.Time
+	Days    []DaySales
+	TopSKUs []SKUSales
+}
+
+// DaySales is the orders placed on one UTC day in one currency.
+type DaySales struct {
+	Day          string
+	Currency     string
+	Orders       int
+	RevenueCents int64
+}
+
+// SKUSales is what one SKU sold, in one unit and currency.
+type SKUSales struct {
+	SKU          string
+	Name         string
+	Unit         string
+	Currency     string
+	Units        int
+	Orders       int
+	RevenueCents int64
+}
+
+// Job is a report built in the background. The file is only held by the
+// store, and is kept until ExpiresAt.
+type Job struct {
+	ID          int64      `json:"id"`
+	Format      string     `json:"format"`
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Size        int        `json:"size_bytes,omitempty"`
+	RequestedBy string     `json:"requested_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Tenant      string     `json:"-"`
+}
+
+// Filename is what the job's file is downloaded as.
+func (j *Job) Filename() string {
+	return filename(j.From, j.To, j.Format)
+}
+
+func filename(from, to, format string) string {
+	return "sales-" + from + "-to-" + to + "." + format
+}
+
+// contentType is the media type of a report in format.
+func contentType(format string) string {
+	if format == FormatXLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
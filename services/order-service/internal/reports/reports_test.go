@@ -0,0 +1,239 @@
+package reports
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore sells the same in every range: two days in USD, and one SKU
+// whose name needs escaping.
+type memStore struct {
+	jobs     []*Job
+	contents map[int64][]byte
+	failWith error
+	asked    [2]time.Time
+}
+
+func (s *memStore) Sales(ctx context.Context, from, to time.Time, top int) (*Sales, error) {
+	if s.failWith != nil {
+		return nil, s.failWith
+	}
+	s.asked = [2]time.Time{from, to}
+	return &Sales{
+		From: from,
+		To:   to,
+		Days: []DaySales{{Day: "2026-10-01", Currency: "USD", Orders: 3, RevenueCents: 12050}, {Day: "2026-10-02", Currency: "USD", Orders: 1, RevenueCents: 999}},
+		TopSKUs: []SKUSales{{SKU: "ABC", Name: `Mug "large" & <blue>`, Unit: "each", Currency: "USD", Units: 4, Orders: 2, RevenueCents: 8000},
+			{SKU: "XYZ", Name: "Tea, loose", Unit: "case", Currency: "USD", Units: 1, Orders: 1, RevenueCents: 4050}},
+	}, nil
+}
+
+func (s *memStore) Create(ctx context.Context, j *Job) error {
+	j.ID, j.Status, j.Tenant = int64(len(s.jobs)+1), StatusPending, tenant.FromContext(ctx)
+	s.jobs = append(s.jobs, j)
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, id int64) (*Job, error) {
+	if id < 1 || int(id) > len(s.jobs) || s.jobs[id-1].Tenant != tenant.FromContext(ctx) {
+		return nil, ErrNotFound
+	}
+	j := *s.jobs[id-1]
+	return &j, nil
+}
+
+func (s *memStore) Content(ctx context.Context, id int64) (*Job, []byte, error) {
+	j, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if j.Status != StatusReady {
+		return j, nil, ErrInvalidState
+	}
+	return j, s.contents[id], nil
+}
+
+func (s *memStore) Pending(ctx context.Context, limit int) ([]Job, error) {
+	var pending []Job
+	for _, j := range s.jobs {
+		if j.Status == StatusPending {
+			pending = append(pending, *j)
+		}
+	}
+	return pending, nil
+}
+
+func (s *memStore) Finish(ctx context.Context, j *Job, content []byte, failure string, at, expiresAt time.Time) error {
+	stored := s.jobs[j.ID-1]
+	if stored.Status != StatusPending {
+		return ErrInvalidState
+	}
+	stored.Status, stored.Error, stored.Size, stored.CompletedAt, stored.ExpiresAt = StatusReady, failure, len(content), &at, &expiresAt
+	if content == nil {
+		stored.Status = StatusFailed
+	}
+	s.contents[j.ID] = content
+	return nil
+}
+
+func (s *memStore) Expire(ctx context.Context, at time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestRenderCSV(t *testing.T) {
+	sales, _ := (&memStore{}).Sales(context.Background(), time.Time{}, time.Time{}, topSKUs)
+	content, err := renderCSV(sales)
+	if err != nil {
+		t.Fatalf("Failed to render CSV: %v", err)
+	}
+	want := "day,currency,orders,revenue\n" +
+		"2026-10-01,USD,3,120.50\n" +
+		"2026-10-02,USD,1,9.99\n" +
+		"\n" +
+		"rank,sku,name,unit,currency,units,orders,revenue\n" +
+		"1,ABC,\"Mug \"\"large\"\" & <blue>\",each,USD,4,2,80.00\n" +
+		"2,XYZ,\"Tea, loose\",case,USD,1,1,40.50\n"
+	if string(content) != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, content)
+	}
+}
+
+func TestRenderXLSX(t *testing.T) {
+	sales, _ := (&memStore{}).Sales(context.Background(), time.Time{}, time.Time{}, topSKUs)
+	content, err := renderXLSX(sales)
+	if err != nil {
+		t.Fatalf("Failed to render workbook: %v", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Expected a zip archive: %v", err)
+	}
+	parts := map[string]string{}
+	for _, f := range z.File {
+		r, _ := f.Open()
+		body, _ := io.ReadAll(r)
+		r.Close()
+		parts[f.Name] = string(body)
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml", "xl/worksheets/sheet2.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("Expected %s in the workbook", name)
+		}
+	}
+	if !strings.Contains(parts["xl/workbook.xml"], `<sheet name="Top SKUs" sheetId="2" r:id="rId2"/>`) {
+		t.Errorf("Expected a Top SKUs sheet, got: %s", parts["xl/workbook.xml"])
+	}
+	if daily := parts["xl/worksheets/sheet1.xml"]; !strings.Contains(daily, `<c r="D2"><v>120.50</v></c>`) ||
+		!strings.Contains(daily, `<c r="D1" t="inlineStr"><is><t>revenue</t></is></c>`) {
+		t.Errorf("Expected revenue as a number under a text header, got: %s", daily)
+	}
+	if skus := parts["xl/worksheets/sheet2.xml"]; !strings.Contains(skus, `<t>Mug &#34;large&#34; &amp; &lt;blue&gt;</t>`) {
+		t.Errorf("Expected the name escaped, got: %s", skus)
+	}
+}
+
+func TestColumn(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 7: "H", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		if got := column(i); got != want {
+			t.Errorf("column(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestReports(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{contents: map[int64][]byte{}}
+	runner := jobs.New()
+	worker := NewWorker(store, runner.Queue("reports", 1, 10), time.Minute, 24*time.Hour)
+	h := NewHandler(store, worker, 31)
+	h.now = func() time.Time { return time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC) }
+	send := func(p *auth.Principal, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			auth.WithPrincipal(c, p)
+			c.Request = c.Request.WithContext(tenant.NewContext(c.Request.Context(), "acme"))
+		})
+		h.RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	admin := &auth.Principal{UserID: 1, Roles: []string{auth.RoleAdmin}}
+
+	if w := send(&auth.Principal{UserID: 7, Roles: []string{auth.RoleCustomer}}, "/orders/report"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be kept out, got: %d", w.Code)
+	}
+	if w := send(admin, "/orders/report?format=pdf"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown format to be refused, got: %d", w.Code)
+	}
+	if w := send(admin, "/orders/report?from=2026-10-10&to=2026-10-01"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a backwards range to be refused, got: %d", w.Code)
+	}
+
+	w := send(admin, "/orders/report")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "day,currency,orders,revenue\n") ||
+		w.Header().Get("Content-Disposition") != `attachment; filename="sales-2026-09-16-to-2026-10-16.csv"` {
+		t.Errorf("Expected the last 30 days as CSV, got: %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	if !store.asked[0].Equal(time.Date(2026, 9, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the report to start 30 days back, got: %v", store.asked[0])
+	}
+
+	w = send(admin, "/orders/report?from=2026-01-01&to=2026-10-01&format=xlsx")
+	var job Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || w.Code != http.StatusAccepted || job.Status != StatusPending ||
+		job.RequestedBy != "user:1" || w.Header().Get("Location") != "/orders/report/1" {
+		t.Fatalf("Expected a long range to become a job, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := send(admin, "/orders/report/1/download"); w.Code != http.StatusConflict {
+		t.Errorf("Expected a pending report not to download, got: %d", w.Code)
+	}
+
+	runner.Start(context.Background())
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatalf("Failed to run the queued report: %v", err)
+	}
+	if w := send(admin, "/orders/report/1"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"ready"`) {
+		t.Errorf("Expected the report to be ready, got: %d %s", w.Code, w.Body.String())
+	}
+	w = send(admin, "/orders/report/1/download")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "PK") ||
+		w.Header().Get("Content-Type") != "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet" {
+		t.Errorf("Expected the workbook, got: %d %v", w.Code, w.Header())
+	}
+	if w := send(admin, "/orders/report/2"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown report not to be found, got: %d", w.Code)
+	}
+}
+
+func TestWorkerStoresFailures(t *testing.T) {
+	store := &memStore{contents: map[int64][]byte{}, failWith: errors.New("canceling statement due to statement timeout")}
+	ctx := tenant.NewContext(context.Background(), "acme")
+	j := &Job{Format: FormatCSV, From: "2025-01-01", To: "2026-01-01"}
+	store.Create(ctx, j)
+
+	worker := NewWorker(store, nil, time.Minute, time.Hour)
+	if err := worker.build(context.Background(), j); err != nil {
+		t.Fatalf("Expected a failed report to be stored rather than retried, got: %v", err)
+	}
+	if stored := store.jobs[0]; stored.Status != StatusFailed || stored.Error == "" || stored.ExpiresAt == nil {
+		t.Errorf("Expected the job to be failed with its error, got: %+v", stored)
+	}
+	if err := worker.build(context.Background(), j); err != nil {
+		t.Errorf("Expected a finished job to be left alone, got: %v", err)
+	}
+}
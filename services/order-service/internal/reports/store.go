@@ -0,0 +1,199 @@
+package reports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+type Store interface {
+	// Sales sums the tenant's paid orders placed on days in [from, to),
+	// with up to top SKUs by revenue.
+	Sales(ctx context.Context, from, to time.Time, top int) (*Sales, error)
+	// Create records a pending job, setting its ID, Status and CreatedAt.
+	Create(ctx context.Context, j *Job) error
+	Get(ctx context.Context, id int64) (*Job, error)
+	// Content returns a ready job's file, or ErrInvalidState if it is not
+	// ready.
+	Content(ctx context.Context, id int64) (*Job, []byte, error)
+	// Pending returns pending jobs across tenants, oldest first.
+	Pending(ctx context.Context, limit int) ([]Job, error)
+	// Finish stores a pending job's file, or the error it failed with when
+	// content is nil, and when it expires. A job that is no longer pending
+	// is ErrInvalidState.
+	Finish(ctx context.Context, j *Job, content []byte, failure string, at, expiresAt time.Time) error
+	// Expire deletes jobs, and their files, that expired before at.
+	Expire(ctx context.Context, at time.Time) (int64, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Sales reads archived orders as well as hot ones. It is bounded by ctx
+// alone rather than the query timeout, since a wide range can take longer:
+// the caller's deadline for a report built while it waits, REPORT_TIMEOUT
+// for a job.
+func (s *PostgresStore) Sales(ctx context.Context, from, to time.Time, top int) (*Sales, error) {
+	t := tenant.FromContext(ctx)
+	sales := &Sales{From: from, To: to, Days: []DaySales{}, TopSKUs: []SKUSales{}}
+
+	const daysQuery string = `SELECT TO_CHAR(o.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, o.currency,
+			COUNT(*), COALESCE(SUM(o.total_cents), 0)
+		FROM order_service.all_orders o
+		WHERE o.tenant_id = $1 AND o.status = 'paid' AND o.created_at >= $2 AND o.created_at < $3
+		GROUP BY day, o.currency ORDER BY day, o.currency`
+	rows, err := s.db.QueryContext(ctx, daysQuery, t, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DaySales
+		if err := rows.Scan(&d.Day, &d.Currency, &d.Orders, &d.RevenueCents); err != nil {
+			return nil, err
+		}
+		sales.Days = append(sales.Days, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	const skusQuery string = `SELECT i.sku, MAX(i.name), i.unit, o.currency, SUM(i.quantity), COUNT(DISTINCT o.id),
+			SUM(i.quantity * i.unit_price_cents) AS revenue
+		FROM order_service.all_order_items i JOIN order_service.all_orders o ON o.id = i.order_id
+		WHERE o.tenant_id = $1 AND o.status = 'paid' AND o.created_at >= $2 AND o.created_at < $3
+		GROUP BY i.sku, i.unit, o.currency ORDER BY revenue DESC, i.sku LIMIT $4`
+	skus, err := s.db.QueryContext(ctx, skusQuery, t, from, to, top)
+	if err != nil {
+		return nil, err
+	}
+	defer skus.Close()
+	for skus.Next() {
+		var k SKUSales
+		if err := skus.Scan(&k.SKU, &k.Name, &k.Unit, &k.Currency, &k.Units, &k.Orders, &k.RevenueCents); err != nil {
+			return nil, err
+		}
+		sales.TopSKUs = append(sales.TopSKUs, k)
+	}
+	return sales, skus.Err()
+}
+
+const jobColumns = `id, format, TO_CHAR(range_from, 'YYYY-MM-DD'), TO_CHAR(range_to, 'YYYY-MM-DD'), status, COALESCE(error, ''),
+	COALESCE(size_bytes, 0), requested_by, created_at, completed_at, expires_at, tenant_id`
+
+func scanJob(row interface{ Scan(...any) error }, extra ...any) (*Job, error) {
+	var j Job
+	err := row.Scan(append([]any{&j.ID, &j.Format, &j.From, &j.To, &j.Status, &j.Error,
+		&j.Size, &j.RequestedBy, &j.CreatedAt, &j.CompletedAt, &j.ExpiresAt, &j.Tenant}, extra...)...)
+	return &j, err
+}
+
+func (s *PostgresStore) Create(ctx context.Context, j *Job) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO order_service.report_jobs (tenant_id, format, range_from, range_to, requested_by)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, status, created_at`
+	j.Tenant = tenant.FromContext(ctx)
+	return s.db.QueryRowContext(ctx, query, j.Tenant, j.Format, j.From, j.To, j.RequestedBy).Scan(&j.ID, &j.Status, &j.CreatedAt)
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int64) (*Job, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + jobColumns + ` FROM order_service.report_jobs WHERE id = $1 AND tenant_id = $2`
+	j, err := scanJob(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (s *PostgresStore) Content(ctx context.Context, id int64) (*Job, []byte, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + jobColumns + `, content FROM order_service.report_jobs WHERE id = $1 AND tenant_id = $2`
+	var content []byte
+	j, err := scanJob(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)), &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if j.Status != StatusReady {
+		return j, nil, ErrInvalidState
+	}
+	return j, content, nil
+}
+
+func (s *PostgresStore) Pending(ctx context.Context, limit int) ([]Job, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + jobColumns + ` FROM order_service.report_jobs WHERE status = 'pending' ORDER BY id LIMIT $1`
+	rows, err := s.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *PostgresStore) Finish(ctx context.Context, j *Job, content []byte, failure string, at, expiresAt time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	status, size := StatusReady, sql.NullInt64{Int64: int64(len(content)), Valid: content != nil}
+	if content == nil {
+		status = StatusFailed
+	}
+	const query string = `UPDATE order_service.report_jobs
+		SET status = $3, content = $4, size_bytes = $5, error = NULLIF($6, ''), completed_at = $7, expires_at = $8
+		WHERE id = $1 AND tenant_id = $2 AND status = 'pending'`
+	res, err := s.db.ExecContext(ctx, query, j.ID, j.Tenant, status, content, size, failure, at, expiresAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrInvalidState
+		}
+		return err
+	}
+	j.Status, j.Error, j.Size, j.CompletedAt, j.ExpiresAt = status, failure, len(content), &at, &expiresAt
+	return nil
+}
+
+func (s *PostgresStore) Expire(ctx context.Context, at time.Time) (int64, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM order_service.report_jobs WHERE expires_at < $1`, at)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
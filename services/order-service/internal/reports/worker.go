@@ -0,0 +1,104 @@
+package reports
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// Worker builds report jobs on a queue. Jobs are queued as soon as they
+// are created, and Sweep runs as a scheduled job to queue any a restart
+// interrupted and delete the ones that expired. Two replicas can build the
+// same job; the first to finish keeps its file.
+type Worker struct {
+	store     Store
+	queue     *jobs.Queue
+	timeout   time.Duration
+	retention time.Duration
+	now       func() time.Time
+}
+
+// NewWorker gives each job up to timeout to build and keeps its file for
+// retention.
+func NewWorker(store Store, queue *jobs.Queue, timeout, retention time.Duration) *Worker {
+	return &Worker{store: store, queue: queue, timeout: timeout, retention: retention, now: time.Now}
+}
+
+// Enqueue queues j unless it is already queued or running.
+func (w *Worker) Enqueue(j Job) bool {
+	return w.queue.Enqueue(strconv.FormatInt(j.ID, 10), func(ctx context.Context) error { return w.build(ctx, &j) })
+}
+
+func (w *Worker) Sweep(ctx context.Context) error {
+	expired, err := w.store.Expire(ctx, w.now())
+	if err != nil {
+		return err
+	}
+	if expired > 0 {
+		log.Printf("Deleted %d expired sales reports", expired)
+	}
+	pending, err := w.store.Pending(ctx, 100)
+	if err != nil {
+		return err
+	}
+	for _, j := range pending {
+		w.Enqueue(j)
+	}
+	return nil
+}
+
+// build renders j and stores the file. A report that cannot be built, such
+// as one that runs out of time, is stored as failed rather than retried,
+// since trying again would likely fail the same way. Only a failure to
+// store the outcome leaves it pending for the next sweep.
+func (w *Worker) build(ctx context.Context, j *Job) error {
+	ctx = tenant.NewContext(ctx, j.Tenant)
+	buildCtx, cancel := context.WithTimeout(ctx, w.timeout)
+	content, err := generate(buildCtx, w.store, j.From, j.To, j.Format)
+	cancel()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	failure := ""
+	if err != nil {
+		failure = err.Error()
+		content = nil
+	}
+	now := w.now()
+	err = w.store.Finish(ctx, j, content, failure, now, now.Add(w.retention))
+	if errors.Is(err, ErrInvalidState) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if failure != "" {
+		log.Printf("Failed to build sales report %d: %s", j.ID, failure)
+	} else {
+		log.Printf("Built sales report %d for %s to %s: %d bytes", j.ID, j.From, j.To, j.Size)
+	}
+	return nil
+}
+
+// generate renders the sales report for days from up to, but not including,
+// to, given as dates such as 2026-03-01.
+func generate(ctx context.Context, store Store, from, to, format string) ([]byte, error) {
+	start, err := time.Parse(time.DateOnly, from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse(time.DateOnly, to)
+	if err != nil {
+		return nil, err
+	}
+	sales, err := store.Sales(ctx, start, end, topSKUs)
+	if err != nil {
+		return nil, err
+	}
+	return render(sales, format)
+}
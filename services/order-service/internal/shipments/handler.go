@@ -0,0 +1,303 @@
+package shipments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WebhookSignatureHeader = "X-Carrier-Signature"
+	maxWebhookBytes        = 1 << 20
+)
+
+type Handler struct {
+	store     Store
+	publisher events.Publisher
+	secret    []byte
+	now       func() time.Time
+}
+
+// NewHandler announces delivered shipments through publisher, unless it is
+// nil, and accepts carrier webhooks signed with webhookSecret. Without a
+// secret, the webhook route is not mounted.
+func NewHandler(store Store, publisher events.Publisher, webhookSecret string) *Handler {
+	return &Handler{store: store, publisher: publisher, secret: []byte(webhookSecret), now: time.Now}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Warehouse staff and admins create and update shipments; the order's
+// customer can read them. The webhook checks its signature instead.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	staff := auth.RequireRole(auth.RoleAdmin, auth.RoleWarehouse)
+	router.POST("/orders/:id/shipments", staff, h.create)
+	router.GET("/orders/:id/shipments", h.list)
+	router.GET("/shipments/:id", h.get)
+	router.PATCH("/shipments/:id", staff, h.update)
+	if len(h.secret) > 0 {
+		router.POST("/shipments/webhooks/:carrier", h.webhook)
+	}
+}
+
+func (h *Handler) create(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		Carrier        string `json:"carrier" binding:"required,max=32"`
+		TrackingNumber string `json:"tracking_number" binding:"required,max=64"`
+		// Lines allocate order lines to the shipment. Without them it
+		// carries everything left to ship.
+		Lines []struct {
+			ItemID   int `json:"item_id" binding:"required"`
+			Quantity int `json:"quantity" binding:"required,min=1"`
+		} `json:"lines" binding:"dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sh := &Shipment{OrderID: id, Carrier: normalizeCarrier(req.Carrier), TrackingNumber: strings.TrimSpace(req.TrackingNumber),
+		Status: StatusLabelCreated, CreatedBy: actor(c)}
+	for _, l := range req.Lines {
+		sh.Lines = append(sh.Lines, Line{ItemID: l.ItemID, Quantity: l.Quantity})
+	}
+	err = h.store.Create(c.Request.Context(), sh)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	case errors.Is(err, ErrUnknownItem):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrOverAllocated):
+		c.JSON(http.StatusConflict, gin.H{"error": "lines ship more of an item than is left to ship"})
+	case errors.Is(err, ErrInvalidState):
+		c.JSON(http.StatusConflict, gin.H{"error": "order is not paid or has nothing left to ship"})
+	case errors.Is(err, ErrAlreadyExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "carrier's tracking number is on another shipment already"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusCreated, sh)
+	}
+}
+
+func (h *Handler) list(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	owner, err := h.store.Owner(c.Request.Context(), id)
+	if !found(c, err) || !canView(c, owner) {
+		return
+	}
+	shipments, err := h.store.List(c.Request.Context(), id)
+	if !found(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"order_id": id, "shipments": shipments})
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	sh, err := h.store.Get(c.Request.Context(), id)
+	if !found(c, err) || !canView(c, sh.UserID) {
+		return
+	}
+	c.JSON(http.StatusOK, sh)
+}
+
+// update records a checkpoint by hand, for carriers without a webhook.
+func (h *Handler) update(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Status   string     `json:"status" binding:"required,oneof=in_transit out_for_delivery delivered exception returned"`
+		Location string     `json:"location" binding:"max=255"`
+		Note     string     `json:"note" binding:"max=1000"`
+		At       *time.Time `json:"at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cp := Checkpoint{Status: req.Status, Location: req.Location, Note: req.Note, Source: SourceManual, Actor: actor(c), At: h.now()}
+	if req.At != nil {
+		if req.At.After(cp.At) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at cannot be in the future"})
+			return
+		}
+		cp.At = *req.At
+	}
+
+	sh, err := h.store.Advance(c.Request.Context(), id, cp)
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "shipment cannot move to " + req.Status})
+		return
+	}
+	if !found(c, err) {
+		return
+	}
+	h.announce(c.Request.Context(), sh)
+	c.JSON(http.StatusOK, sh)
+}
+
+// Webhook is the carrier-neutral tracking update carriers post, through an
+// adapter where their own format differs.
+type Webhook struct {
+	TrackingNumber string    `json:"tracking_number"`
+	Status         string    `json:"status"`
+	Location       string    `json:"location"`
+	Description    string    `json:"description"`
+	OccurredAt     time.Time `json:"occurred_at"`
+}
+
+// verify checks the hex HMAC-SHA256 of the raw body in
+// WebhookSignatureHeader.
+func (h *Handler) verify(body []byte, signature string) bool {
+	want, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// webhook always answers 2xx for updates it ignores, such as unknown
+// tracking numbers and updates that arrive after a later status, so the
+// carrier does not retry them, and 5xx only when retrying can help.
+func (h *Handler) webhook(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.verify(body, c.GetHeader(WebhookSignatureHeader)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid webhook signature"})
+		return
+	}
+	var w Webhook
+	if err := json.Unmarshal(body, &w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if w.TrackingNumber == "" || !knownStatus(w.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tracking_number and a known status are required"})
+		return
+	}
+
+	carrier := normalizeCarrier(c.Param("carrier"))
+	sh, err := h.store.Find(c.Request.Context(), carrier, strings.TrimSpace(w.TrackingNumber))
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("Ignoring %s update for unknown tracking number %s", carrier, w.TrackingNumber)
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cp := Checkpoint{Status: w.Status, Location: w.Location, Note: w.Description, Source: SourceWebhook, Actor: "carrier:" + carrier, At: w.OccurredAt}
+	if cp.At.IsZero() || cp.At.After(h.now()) {
+		cp.At = h.now()
+	}
+	ctx := tenant.NewContext(c.Request.Context(), sh.Tenant)
+	sh, err = h.store.Advance(ctx, sh.ID, cp)
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.announce(ctx, sh)
+	c.JSON(http.StatusOK, gin.H{"status": "updated", "shipment_id": sh.ID})
+}
+
+// announce publishes ShipmentDelivered once a shipment is delivered. The
+// checkpoint is already saved, so a failure is only logged.
+func (h *Handler) announce(ctx context.Context, sh *Shipment) {
+	if h.publisher == nil || sh.Status != StatusDelivered || sh.DeliveredAt == nil {
+		return
+	}
+	items := make([]events.ShipmentItem, len(sh.Lines))
+	for i, l := range sh.Lines {
+		items[i] = events.ShipmentItem{SKU: l.SKU, Name: l.Name, Unit: l.Unit, Quantity: l.Quantity}
+	}
+	e, err := events.New(events.OrderShipmentDelivered, "order-service", events.ShipmentDelivered{
+		ShipmentID:     sh.ID,
+		OrderID:        sh.OrderID,
+		UserID:         sh.UserID,
+		Tenant:         sh.Tenant,
+		Carrier:        sh.Carrier,
+		TrackingNumber: sh.TrackingNumber,
+		DeliveredAt:    *sh.DeliveredAt,
+		Items:          items,
+	})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to announce delivery of shipment %d: %v", sh.ID, err)
+	}
+}
+
+// canView lets staff see any order's shipments, and customers their own.
+func canView(c *gin.Context, owner int) bool {
+	if p, ok := auth.FromContext(c); ok && p.HasRole(auth.RoleWarehouse) {
+		return true
+	}
+	return auth.AuthorizeUser(c, owner)
+}
+
+// actor names who recorded a shipment or checkpoint.
+func actor(c *gin.Context) string {
+	p, _ := auth.FromContext(c)
+	return "user:" + strconv.Itoa(p.UserID)
+}
+
+func paramID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func found(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Package shipments records the parcels a paid order leaves the warehouse
+// in. Each shipment names its carrier and tracking number and which of the
+// order's lines it carries, so an order can ship in several parts. Its
+// status follows the parcel to the door, moved on by warehouse staff or by
+// the carrier's webhook, and a delivered shipment is announced so the
+// customer hears about it.
+package shipments
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Shipment statuses, in the order a parcel normally goes through them.
+// Delivered and returned are final. An exception, such as a failed
+// delivery attempt, can happen at any point before then and be followed by
+// any other status.
+const (
+	StatusLabelCreated   = "label_created"
+	StatusInTransit      = "in_transit"
+	StatusOutForDelivery = "out_for_delivery"
+	StatusDelivered      = "delivered"
+	StatusException      = "exception"
+	StatusReturned       = "returned"
+)
+
+// Sources of a checkpoint.
+const (
+	SourceManual  = "manual"
+	SourceWebhook = "webhook"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidState is returned for an order that is not paid, has
+	// nothing left to ship, or a shipment that cannot move to the status
+	// asked for.
+	ErrInvalidState = errors.New("invalid state")
+	// ErrAlreadyExists is returned for a tracking number the carrier has
+	// been given already.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrUnknownItem is returned for a line naming an item not on the order.
+	ErrUnknownItem = errors.New("item is not on the order")
+	// ErrOverAllocated is returned for lines that ship more of an item than
+	// is left to ship.
+	ErrOverAllocated = errors.New("more than is left to ship")
+)
+
+// Shipment is one parcel of an order. UserID and Tenant are the order's.
+type Shipment struct {
+	ID             int64        `json:"id"`
+	OrderID        int          `json:"order_id"`
+	Carrier        string       `json:"carrier"`
+	TrackingNumber string       `json:"tracking_number"`
+	Status         string       `json:"status"`
+	Lines          []Line       `json:"lines"`
+	History        []Checkpoint `json:"history"`
+	CreatedBy      string       `json:"created_by,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+	DeliveredAt    *time.Time   `json:"delivered_at,omitempty"`
+	UserID         int          `json:"-"`
+	Tenant         string       `json:"-"`
+}
+
+// Line is Quantity of an order line's unit in the shipment.
+type Line struct {
+	ItemID   int    `json:"item_id"`
+	SKU      string `json:"sku"`
+	Name     string `json:"name,omitempty"`
+	Unit     string `json:"unit"`
+	Quantity int    `json:"quantity"`
+}
+
+// Checkpoint is a status the shipment reached, where and when the carrier
+// says it did.
+type Checkpoint struct {
+	Status   string    `json:"status"`
+	Location string    `json:"location,omitempty"`
+	Note     string    `json:"note,omitempty"`
+	Source   string    `json:"source"`
+	Actor    string    `json:"actor,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// rank orders the statuses a parcel moves forward through.
+var rank = map[string]int{
+	StatusLabelCreated:   1,
+	StatusInTransit:      2,
+	StatusOutForDelivery: 3,
+	StatusDelivered:      4,
+	StatusReturned:       4,
+}
+
+func knownStatus(status string) bool {
+	_, ok := rank[status]
+	return ok || status == StatusException
+}
+
+// canMove reports whether a shipment can go from one status to another.
+// Going back is refused, since carriers deliver webhooks out of order and a
+// late in_transit must not undo out_for_delivery.
+func canMove(from, to string) bool {
+	switch {
+	case from == StatusDelivered || from == StatusReturned || from == to || !knownStatus(to):
+		return false
+	case from == StatusException || to == StatusException:
+		return to != StatusLabelCreated
+	}
+	return rank[to] > rank[from]
+}
+
+// normalizeCarrier makes carrier names match regardless of case and
+// spacing.
+func normalizeCarrier(carrier string) string {
+	return strings.ToLower(strings.TrimSpace(carrier))
+}
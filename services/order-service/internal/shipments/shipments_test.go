@@ -0,0 +1,251 @@
+package shipments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore holds order 1, placed by user 7 in tenant acme, with 3 each of
+// item 10 and 1 case of item 11.
+type memStore struct {
+	shipments []*Shipment
+	created   *Shipment
+}
+
+var orderLines = []Line{{ItemID: 10, SKU: "ABC", Unit: "each", Quantity: 3}, {ItemID: 11, SKU: "XYZ", Unit: "case", Quantity: 1}}
+
+func (s *memStore) Owner(ctx context.Context, orderID int) (int, error) {
+	if orderID != 1 || tenant.FromContext(ctx) != "acme" {
+		return 0, ErrNotFound
+	}
+	return 7, nil
+}
+
+func (s *memStore) Create(ctx context.Context, sh *Shipment) error {
+	owner, err := s.Owner(ctx, sh.OrderID)
+	if err != nil {
+		return err
+	}
+	if sh.Lines, err = allocate(orderLines, sh.Lines); err != nil {
+		return err
+	}
+	sh.ID, sh.UserID, sh.Tenant = int64(len(s.shipments)+1), owner, "acme"
+	s.created = sh
+	s.shipments = append(s.shipments, sh)
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, orderID int) ([]Shipment, error) {
+	var list []Shipment
+	for _, sh := range s.shipments {
+		list = append(list, *sh)
+	}
+	return list, nil
+}
+
+func (s *memStore) Get(ctx context.Context, id int64) (*Shipment, error) {
+	if id < 1 || int(id) > len(s.shipments) || tenant.FromContext(ctx) != s.shipments[id-1].Tenant {
+		return nil, ErrNotFound
+	}
+	return s.shipments[id-1], nil
+}
+
+func (s *memStore) Find(ctx context.Context, carrier, trackingNumber string) (*Shipment, error) {
+	for _, sh := range s.shipments {
+		if sh.Carrier == carrier && sh.TrackingNumber == trackingNumber {
+			return sh, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Advance(ctx context.Context, id int64, c Checkpoint) (*Shipment, error) {
+	sh, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !canMove(sh.Status, c.Status) {
+		return nil, ErrInvalidState
+	}
+	sh.Status = c.Status
+	if c.Status == StatusDelivered {
+		at := c.At
+		sh.DeliveredAt = &at
+	}
+	sh.History = append(sh.History, c)
+	return sh, nil
+}
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+func TestCanMove(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{StatusLabelCreated, StatusInTransit, true},
+		{StatusLabelCreated, StatusDelivered, true},
+		{StatusOutForDelivery, StatusInTransit, false},
+		{StatusInTransit, StatusInTransit, false},
+		{StatusInTransit, StatusException, true},
+		{StatusException, StatusInTransit, true},
+		{StatusException, StatusLabelCreated, false},
+		{StatusDelivered, StatusException, false},
+		{StatusReturned, StatusDelivered, false},
+		{StatusInTransit, "lost", false},
+	}
+	for _, tt := range tests {
+		if got := canMove(tt.from, tt.to); got != tt.want {
+			t.Errorf("canMove(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	remaining := []Line{{ItemID: 10, Quantity: 3}, {ItemID: 11, Quantity: 0}}
+
+	lines, err := allocate(remaining, nil)
+	if err != nil || len(lines) != 1 || lines[0].ItemID != 10 || lines[0].Quantity != 3 {
+		t.Errorf("Expected everything left to ship, got: %+v %v", lines, err)
+	}
+	lines, err = allocate(remaining, []Line{{ItemID: 10, Quantity: 1}, {ItemID: 10, Quantity: 2}})
+	if err != nil || len(lines) != 1 || lines[0].Quantity != 3 {
+		t.Errorf("Expected requests for one item to be added up, got: %+v %v", lines, err)
+	}
+	if _, err := allocate(remaining, []Line{{ItemID: 10, Quantity: 2}, {ItemID: 10, Quantity: 2}}); err != ErrOverAllocated {
+		t.Errorf("Expected more than is left to be refused, got: %v", err)
+	}
+	if _, err := allocate(remaining, []Line{{ItemID: 12, Quantity: 1}}); err != ErrUnknownItem {
+		t.Errorf("Expected an item not on the order to be refused, got: %v", err)
+	}
+	if _, err := allocate([]Line{{ItemID: 10, Quantity: 0}}, nil); err != ErrInvalidState {
+		t.Errorf("Expected a fully shipped order to be refused, got: %v", err)
+	}
+}
+
+func TestShipments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	publisher := &recordingPublisher{}
+	h := NewHandler(store, publisher, "carrier-secret")
+	now := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+	send := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			if p != nil {
+				auth.WithPrincipal(c, p)
+				c.Request = c.Request.WithContext(tenant.NewContext(c.Request.Context(), "acme"))
+			}
+		})
+		h.RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	picker := &auth.Principal{UserID: 3, Roles: []string{auth.RoleWarehouse}}
+	customer := &auth.Principal{UserID: 7, Roles: []string{auth.RoleCustomer}}
+
+	if w := send(customer, http.MethodPost, "/orders/1/shipments", `{"carrier": "nzpost", "tracking_number": "NZ1"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be kept from recording shipments, got: %d", w.Code)
+	}
+	if w := send(picker, http.MethodPost, "/orders/1/shipments", `{"carrier": "nzpost", "tracking_number": "NZ1", "lines": [{"item_id": 10, "quantity": 4}]}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected shipping more than was ordered to be refused, got: %d", w.Code)
+	}
+	w := send(picker, http.MethodPost, "/orders/1/shipments", `{"carrier": " NZPost ", "tracking_number": "NZ1", "lines": [{"item_id": 10, "quantity": 2}]}`)
+	if sh := store.created; w.Code != http.StatusCreated || sh.Carrier != "nzpost" || sh.Status != StatusLabelCreated ||
+		sh.CreatedBy != "user:3" || len(sh.Lines) != 1 || sh.Lines[0].SKU != "ABC" || sh.Lines[0].Quantity != 2 {
+		t.Fatalf("Expected 2 of ABC shipped with nzpost, got: %d %+v", w.Code, store.created)
+	}
+
+	if w := send(&auth.Principal{UserID: 8, Roles: []string{auth.RoleCustomer}}, http.MethodGet, "/shipments/1", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected other customers to be kept out, got: %d", w.Code)
+	}
+	if w := send(customer, http.MethodGet, "/orders/1/shipments", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"tracking_number":"NZ1"`) {
+		t.Errorf("Expected the customer to see their shipments, got: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := send(picker, http.MethodPatch, "/shipments/1", `{"status": "out_for_delivery", "location": "Wellington"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the status to be recorded, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := send(picker, http.MethodPatch, "/shipments/1", `{"status": "in_transit"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a shipment not to move backwards, got: %d", w.Code)
+	}
+	if len(publisher.published) != 0 {
+		t.Errorf("Expected nothing published before delivery, got: %d events", len(publisher.published))
+	}
+
+	webhook := func(body, signature string) *httptest.ResponseRecorder {
+		router := gin.New()
+		h.RegisterRoutes(router)
+		req := httptest.NewRequest(http.MethodPost, "/shipments/webhooks/NZPost", strings.NewReader(body))
+		req.Header.Set(WebhookSignatureHeader, signature)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte("carrier-secret"))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	delivered := `{"tracking_number": "NZ1", "status": "delivered", "location": "Front door", "occurred_at": "2026-10-14T08:30:00Z"}`
+	if w := webhook(delivered, sign(`{}`)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a bad signature to be refused, got: %d", w.Code)
+	}
+	unknown := `{"tracking_number": "NZ9", "status": "delivered"}`
+	if w := webhook(unknown, sign(unknown)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ignored") {
+		t.Errorf("Expected an unknown tracking number to be ignored, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := webhook(delivered, sign(delivered)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "updated") {
+		t.Fatalf("Expected the delivery to be recorded, got: %d %s", w.Code, w.Body.String())
+	}
+	sh := store.shipments[0]
+	if last := sh.History[len(sh.History)-1]; last.Source != SourceWebhook || last.Actor != "carrier:nzpost" || !last.At.Equal(now.Add(-30*time.Minute)) {
+		t.Errorf("Expected the carrier's checkpoint at its own time, got: %+v", last)
+	}
+	if w := webhook(delivered, sign(delivered)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ignored") {
+		t.Errorf("Expected a repeated delivery to be ignored, got: %d %s", w.Code, w.Body.String())
+	}
+
+	if len(publisher.published) != 1 {
+		t.Fatalf("Expected one delivery announced, got: %d", len(publisher.published))
+	}
+	var payload events.ShipmentDelivered
+	if err := publisher.published[0].Decode(&payload); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if payload.OrderID != 1 || payload.UserID != 7 || payload.Tenant != "acme" || len(payload.Items) != 1 || payload.Items[0].Quantity != 2 {
+		t.Errorf("Expected order 1's delivery to user 7 with 2 of ABC, got: %+v", payload)
+	}
+}
+
+func TestWebhookNeedsSecret(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	NewHandler(&memStore{}, nil, "").RegisterRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/shipments/webhooks/nzpost", strings.NewReader(`{}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected no webhook without a secret, got: %d", w.Code)
+	}
+}
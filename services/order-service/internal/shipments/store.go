@@ -0,0 +1,364 @@
+package shipments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+type Store interface {
+	// Owner returns the ID of the user who placed the order.
+	Owner(ctx context.Context, orderID int) (int, error)
+	// Create saves s and its first checkpoint, and marks the order's
+	// delivery promise shipped if it is not yet. Without lines, s carries
+	// all that is left to ship of the order. An order that is not paid or
+	// has nothing left to ship is ErrInvalidState.
+	Create(ctx context.Context, s *Shipment) error
+	// List returns the order's shipments, oldest first.
+	List(ctx context.Context, orderID int) ([]Shipment, error)
+	Get(ctx context.Context, id int64) (*Shipment, error)
+	// Find returns the shipment with a carrier's tracking number, in any
+	// tenant.
+	Find(ctx context.Context, carrier, trackingNumber string) (*Shipment, error)
+	// Advance moves the shipment to c.Status and records c, or returns
+	// ErrInvalidState if it cannot move there.
+	Advance(ctx context.Context, id int64, c Checkpoint) (*Shipment, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Owner(ctx context.Context, orderID int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT user_id FROM order_service.orders WHERE id = $1 AND tenant_id = $2`
+	var userID int
+	err := s.db.QueryRowContext(ctx, query, orderID, tenant.FromContext(ctx)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return userID, err
+}
+
+func (s *PostgresStore) Create(ctx context.Context, sh *Shipment) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		// Locking the order keeps two shipments from taking the same items.
+		const lock string = `SELECT user_id, status FROM order_service.orders WHERE id = $1 AND tenant_id = $2 FOR UPDATE`
+		var status string
+		err := tx.QueryRowContext(ctx, lock, sh.OrderID, tenant.FromContext(ctx)).Scan(&sh.UserID, &status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if status != "paid" {
+			return ErrInvalidState
+		}
+
+		remaining, err := unshipped(ctx, tx, sh.OrderID)
+		if err != nil {
+			return err
+		}
+		if sh.Lines, err = allocate(remaining, sh.Lines); err != nil {
+			return err
+		}
+
+		const insert string = `INSERT INTO order_service.shipments (order_id, tenant_id, carrier, tracking_number, status, created_by)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) ON CONFLICT (carrier, tracking_number) DO NOTHING
+			RETURNING id, created_at, updated_at`
+		sh.Tenant = tenant.FromContext(ctx)
+		err = tx.QueryRowContext(ctx, insert, sh.OrderID, sh.Tenant, sh.Carrier, sh.TrackingNumber, sh.Status, sh.CreatedBy).
+			Scan(&sh.ID, &sh.CreatedAt, &sh.UpdatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAlreadyExists
+		}
+		if err != nil {
+			return err
+		}
+		const insertLine string = `INSERT INTO order_service.shipment_lines (shipment_id, item_id, quantity) VALUES ($1, $2, $3)`
+		for _, l := range sh.Lines {
+			if _, err := tx.ExecContext(ctx, insertLine, sh.ID, l.ItemID, l.Quantity); err != nil {
+				return err
+			}
+		}
+		sh.History = []Checkpoint{{Status: sh.Status, Source: SourceManual, Actor: sh.CreatedBy, At: sh.CreatedAt}}
+		if err := checkpoint(ctx, tx, sh.ID, sh.History[0]); err != nil {
+			return err
+		}
+
+		const shipped string = `UPDATE order_service.delivery_promises SET shipped_at = $2 WHERE order_id = $1 AND shipped_at IS NULL`
+		_, err = tx.ExecContext(ctx, shipped, sh.OrderID, sh.CreatedAt)
+		return err
+	})
+}
+
+// unshipped returns the order's lines with the quantity of each not in a
+// shipment yet. Returned shipments still count: their items came back to
+// the warehouse, not to the customer.
+func unshipped(ctx context.Context, tx *sql.Tx, orderID int) ([]Line, error) {
+	const query string = `SELECT i.id, i.sku, i.name, i.unit, i.quantity - COALESCE(SUM(l.quantity), 0)
+		FROM order_service.order_items i LEFT JOIN order_service.shipment_lines l ON l.item_id = i.id
+		WHERE i.order_id = $1 GROUP BY i.id ORDER BY i.id`
+	rows, err := tx.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []Line
+	for rows.Next() {
+		var l Line
+		if err := rows.Scan(&l.ItemID, &l.SKU, &l.Name, &l.Unit, &l.Quantity); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// allocate fills in requested from the order's remaining lines, or takes
+// all of remaining when nothing is requested. Requests for the same item
+// are added up.
+func allocate(remaining, requested []Line) ([]Line, error) {
+	if len(requested) == 0 {
+		var all []Line
+		for _, l := range remaining {
+			if l.Quantity > 0 {
+				all = append(all, l)
+			}
+		}
+		if len(all) == 0 {
+			return nil, ErrInvalidState
+		}
+		return all, nil
+	}
+
+	left := map[int]Line{}
+	for _, l := range remaining {
+		left[l.ItemID] = l
+	}
+	var lines []Line
+	at := map[int]int{}
+	for _, r := range requested {
+		l, ok := left[r.ItemID]
+		if !ok {
+			return nil, ErrUnknownItem
+		}
+		i, seen := at[r.ItemID]
+		if !seen {
+			i, l.Quantity = len(lines), 0
+			at[r.ItemID] = i
+			lines = append(lines, l)
+		}
+		if lines[i].Quantity += r.Quantity; lines[i].Quantity > left[r.ItemID].Quantity {
+			return nil, ErrOverAllocated
+		}
+	}
+	return lines, nil
+}
+
+func checkpoint(ctx context.Context, tx *sql.Tx, shipmentID int64, c Checkpoint) error {
+	const query string = `INSERT INTO order_service.shipment_events (shipment_id, status, location, note, source, actor, occurred_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, NULLIF($6, ''), $7)`
+	_, err := tx.ExecContext(ctx, query, shipmentID, c.Status, c.Location, c.Note, c.Source, c.Actor, c.At)
+	return err
+}
+
+const shipmentColumns = `s.id, s.order_id, s.carrier, s.tracking_number, s.status, COALESCE(s.created_by, ''),
+	s.created_at, s.updated_at, s.delivered_at, o.user_id, s.tenant_id`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanShipment(row scanner) (*Shipment, error) {
+	var sh Shipment
+	var deliveredAt sql.NullTime
+	if err := row.Scan(&sh.ID, &sh.OrderID, &sh.Carrier, &sh.TrackingNumber, &sh.Status, &sh.CreatedBy,
+		&sh.CreatedAt, &sh.UpdatedAt, &deliveredAt, &sh.UserID, &sh.Tenant); err != nil {
+		return nil, err
+	}
+	if deliveredAt.Valid {
+		sh.DeliveredAt = &deliveredAt.Time
+	}
+	return &sh, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// details loads the shipments' lines and history.
+func details(ctx context.Context, q queryer, shipments []Shipment) error {
+	if len(shipments) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(shipments))
+	index := map[int64]int{}
+	for i := range shipments {
+		ids[i], index[shipments[i].ID] = shipments[i].ID, i
+		shipments[i].Lines, shipments[i].History = []Line{}, []Checkpoint{}
+	}
+
+	const lines string = `SELECT l.shipment_id, i.id, i.sku, i.name, i.unit, l.quantity
+		FROM order_service.shipment_lines l JOIN order_service.order_items i ON i.id = l.item_id
+		WHERE l.shipment_id = ANY($1) ORDER BY l.shipment_id, i.id`
+	rows, err := q.QueryContext(ctx, lines, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var l Line
+		if err := rows.Scan(&id, &l.ItemID, &l.SKU, &l.Name, &l.Unit, &l.Quantity); err != nil {
+			return err
+		}
+		sh := &shipments[index[id]]
+		sh.Lines = append(sh.Lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	const history string = `SELECT shipment_id, status, COALESCE(location, ''), COALESCE(note, ''), source, COALESCE(actor, ''), occurred_at
+		FROM order_service.shipment_events WHERE shipment_id = ANY($1) ORDER BY shipment_id, occurred_at, id`
+	events, err := q.QueryContext(ctx, history, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+	for events.Next() {
+		var id int64
+		var c Checkpoint
+		if err := events.Scan(&id, &c.Status, &c.Location, &c.Note, &c.Source, &c.Actor, &c.At); err != nil {
+			return err
+		}
+		sh := &shipments[index[id]]
+		sh.History = append(sh.History, c)
+	}
+	return events.Err()
+}
+
+func (s *PostgresStore) List(ctx context.Context, orderID int) ([]Shipment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	db := database.Reader(ctx, s.db)
+	const query string = "SELECT " + shipmentColumns + ` FROM order_service.shipments s
+		JOIN order_service.orders o ON o.id = s.order_id
+		WHERE s.order_id = $1 AND s.tenant_id = $2 ORDER BY s.id`
+	rows, err := db.QueryContext(ctx, query, orderID, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shipments := []Shipment{}
+	for rows.Next() {
+		sh, err := scanShipment(rows)
+		if err != nil {
+			return nil, err
+		}
+		shipments = append(shipments, *sh)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return shipments, details(ctx, db, shipments)
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int64) (*Shipment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + shipmentColumns + ` FROM order_service.shipments s
+		JOIN order_service.orders o ON o.id = s.order_id WHERE s.id = $1 AND s.tenant_id = $2`
+	return s.one(ctx, s.db, query, id, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) Find(ctx context.Context, carrier, trackingNumber string) (*Shipment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + shipmentColumns + ` FROM order_service.shipments s
+		JOIN order_service.orders o ON o.id = s.order_id WHERE s.carrier = $1 AND s.tracking_number = $2`
+	return s.one(ctx, s.db, query, carrier, trackingNumber)
+}
+
+type rowQueryer interface {
+	queryer
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *PostgresStore) one(ctx context.Context, q rowQueryer, query string, args ...any) (*Shipment, error) {
+	sh, err := scanShipment(q.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	shipments := []Shipment{*sh}
+	if err := details(ctx, q, shipments); err != nil {
+		return nil, err
+	}
+	return &shipments[0], nil
+}
+
+func (s *PostgresStore) Advance(ctx context.Context, id int64, c Checkpoint) (*Shipment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var sh *Shipment
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const lock string = `SELECT status FROM order_service.shipments WHERE id = $1 AND tenant_id = $2 FOR UPDATE`
+		var status string
+		err := tx.QueryRowContext(ctx, lock, id, tenant.FromContext(ctx)).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !canMove(status, c.Status) {
+			return ErrInvalidState
+		}
+
+		var deliveredAt *time.Time
+		if c.Status == StatusDelivered {
+			deliveredAt = &c.At
+		}
+		const update string = `UPDATE order_service.shipments SET status = $2, delivered_at = COALESCE($3, delivered_at), updated_at = NOW()
+			WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, update, id, c.Status, deliveredAt); err != nil {
+			return err
+		}
+		if err := checkpoint(ctx, tx, id, c); err != nil {
+			return err
+		}
+		const query string = "SELECT " + shipmentColumns + ` FROM order_service.shipments s
+			JOIN order_service.orders o ON o.id = s.order_id WHERE s.id = $1`
+		sh, err = s.one(ctx, tx, query, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
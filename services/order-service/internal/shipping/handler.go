@@ -0,0 +1,65 @@
+package shipping
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	quoter *Quoter
+}
+
+func NewHandler(quoter *Quoter) *Handler {
+	return &Handler{quoter: quoter}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/shipping/quotes", h.quote)
+}
+
+type quoteRequest struct {
+	Items   []Item `json:"items" binding:"required,min=1,max=100"`
+	Carrier string `json:"carrier" binding:"max=32"`
+}
+
+// quote prices shipping the items as one parcel, with the carrier asked
+// for or every configured one. Items missing dimensions are named in a 422
+// so they can be filled in; the quote is never guessed.
+func (h *Handler) quote(c *gin.Context) {
+	var req quoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, it := range req.Items {
+		if it.SKU == "" || len(it.SKU) > 64 || it.Quantity <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "each item needs a sku and a positive quantity"})
+			return
+		}
+		if it.Unit != "" && it.Unit != "each" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quantities must be in base units, each"})
+			return
+		}
+	}
+
+	quotes, err := h.quoter.Quote(c.Request.Context(), req.Items, req.Carrier)
+	if errors.Is(err, ErrUnknownCarrier) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown carrier"})
+		return
+	}
+	var missing *MissingDimensionsError
+	if errors.As(err, &missing) {
+		log.Printf("Shipping quote blocked, no dimensions for %v", missing.SKUs)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "shipping cannot be quoted until these items have dimensions", "missing": missing.SKUs})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"quotes": quotes})
+}
@@ -0,0 +1,166 @@
+// Package shipping quotes what carriers charge to ship a set of items, from
+// each SKU's packed dimensions and weight in inventory-service. Carriers
+// bill the greater of the actual weight and the dimensional weight, the
+// parcel's volume divided by a divisor, so a SKU without dimensions blocks
+// the quote rather than being guessed at.
+package shipping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/models"
+)
+
+// DefaultDivisor is the common carrier divisor, in cubic centimetres per
+// kilogram, for dimensional weight.
+const DefaultDivisor = 5000
+
+// Rate is what a carrier charges for a parcel: BaseCents plus PerKgCents
+// for each started kilogram of billable weight.
+type Rate struct {
+	Carrier    string
+	BaseCents  int64
+	PerKgCents int64
+}
+
+// ParseRates parses "name=base+perkg" pairs in cents separated by commas,
+// e.g. "standard=499+99,express=1299+199". The first carrier is the
+// default.
+func ParseRates(s string) ([]Rate, error) {
+	var rates []Rate
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		base, perKg, ok2 := strings.Cut(value, "+")
+		baseCents, err := strconv.ParseInt(strings.TrimSpace(base), 10, 64)
+		perKgCents, err2 := strconv.ParseInt(strings.TrimSpace(perKg), 10, 64)
+		if !ok || !ok2 || name == "" || len(name) > 32 || err != nil || err2 != nil || baseCents < 0 || perKgCents < 0 {
+			return nil, fmt.Errorf("invalid shipping rate %q, want name=base+perkg in cents", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("shipping rate for %s given twice", name)
+		}
+		seen[name] = true
+		rates = append(rates, Rate{Carrier: name, BaseCents: baseCents, PerKgCents: perKgCents})
+	}
+	if len(rates) == 0 {
+		return nil, errors.New("no shipping rates configured")
+	}
+	return rates, nil
+}
+
+// DimensionSource reads SKU dimensions from inventory-service.
+type DimensionSource interface {
+	GetDimensions(ctx context.Context, skus []string) ([]clients.Dimensions, []string, error)
+}
+
+var _ DimensionSource = (*clients.InventoryClient)(nil)
+
+// MissingDimensionsError lists the SKUs a quote needs dimensions for.
+type MissingDimensionsError struct {
+	SKUs []string
+}
+
+func (e *MissingDimensionsError) Error() string {
+	return "no dimensions recorded for " + strings.Join(e.SKUs, ", ")
+}
+
+var ErrUnknownCarrier = errors.New("unknown carrier")
+
+// Item is Quantity base units of a SKU. Unit must be empty or "each", the
+// base unit; Name and UnitPriceCents are not used.
+type Item = models.OrderItem
+
+// Quote is one carrier's price for the items as one parcel. Weights are in
+// grams; BillableGrams is what the price is worked out from.
+type Quote struct {
+	Carrier          string `json:"carrier"`
+	ActualGrams      int64  `json:"actual_grams"`
+	DimensionalGrams int64  `json:"dimensional_grams"`
+	BillableGrams    int64  `json:"billable_grams"`
+	PriceCents       int64  `json:"price_cents"`
+}
+
+type Quoter struct {
+	source  DimensionSource
+	rates   []Rate
+	divisor int64
+}
+
+// NewQuoter takes the dimensional weight divisor in cubic centimetres per
+// kilogram.
+func NewQuoter(source DimensionSource, rates []Rate, divisor int) (*Quoter, error) {
+	if len(rates) == 0 {
+		return nil, errors.New("no shipping rates configured")
+	}
+	if divisor <= 0 {
+		return nil, fmt.Errorf("dimensional weight divisor must be positive, got %d", divisor)
+	}
+	return &Quoter{source: source, rates: rates, divisor: int64(divisor)}, nil
+}
+
+// Quote prices items with carrier, or with every carrier when carrier is
+// empty. It returns a *MissingDimensionsError if any SKU has no dimensions.
+func (q *Quoter) Quote(ctx context.Context, items []Item, carrier string) ([]Quote, error) {
+	rates := q.rates
+	if carrier != "" {
+		rates = nil
+		for _, r := range q.rates {
+			if r.Carrier == carrier {
+				rates = []Rate{r}
+			}
+		}
+		if rates == nil {
+			return nil, ErrUnknownCarrier
+		}
+	}
+
+	quantities := map[string]int64{}
+	skus := []string{}
+	for _, it := range items {
+		if _, ok := quantities[it.SKU]; !ok {
+			skus = append(skus, it.SKU)
+		}
+		quantities[it.SKU] += int64(it.Quantity)
+	}
+	found, missing, err := q.source.GetDimensions(ctx, skus)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, &MissingDimensionsError{SKUs: missing}
+	}
+
+	var actual, cubicMM int64
+	for _, d := range found {
+		n := quantities[d.SKU]
+		actual += n * int64(d.WeightGrams)
+		cubicMM += n * int64(d.LengthMM) * int64(d.WidthMM) * int64(d.HeightMM)
+	}
+	// cm³ * 1000 g/kg / divisor, with cm³ = mm³ / 1000.
+	dimensional := (cubicMM + q.divisor - 1) / q.divisor
+	billable := max(actual, dimensional)
+	kilograms := (billable + 999) / 1000
+
+	quotes := make([]Quote, len(rates))
+	for i, r := range rates {
+		quotes[i] = Quote{
+			Carrier:          r.Carrier,
+			ActualGrams:      actual,
+			DimensionalGrams: dimensional,
+			BillableGrams:    billable,
+			PriceCents:       r.BaseCents + kilograms*r.PerKgCents,
+		}
+	}
+	return quotes, nil
+}
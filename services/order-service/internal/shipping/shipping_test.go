@@ -0,0 +1,119 @@
+package shipping
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/gin-gonic/gin"
+)
+
+// stubDimensions knows SKU-001, a 1.5 kg box of 30x20x10 cm, and SKU-002,
+// a 200 g cushion of 60x40x40 cm.
+type stubDimensions struct {
+	err error
+}
+
+func (s stubDimensions) GetDimensions(ctx context.Context, skus []string) ([]clients.Dimensions, []string, error) {
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	known := map[string]clients.Dimensions{
+		"SKU-001": {SKU: "SKU-001", LengthMM: 300, WidthMM: 200, HeightMM: 100, WeightGrams: 1500},
+		"SKU-002": {SKU: "SKU-002", LengthMM: 600, WidthMM: 400, HeightMM: 400, WeightGrams: 200},
+	}
+	var found []clients.Dimensions
+	missing := []string{}
+	for _, sku := range skus {
+		if d, ok := known[sku]; ok {
+			found = append(found, d)
+		} else {
+			missing = append(missing, sku)
+		}
+	}
+	return found, missing, nil
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates(" standard=499+99, express=1299+199 ")
+	if err != nil || len(rates) != 2 || rates[1] != (Rate{Carrier: "express", BaseCents: 1299, PerKgCents: 199}) {
+		t.Errorf("Expected two rates, got: %+v, %v", rates, err)
+	}
+	for _, bad := range []string{"", "standard=499", "standard=a+1", "standard=-1+1", "=1+1", "standard=1+1,standard=2+2"} {
+		if _, err := ParseRates(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	rates, _ := ParseRates("standard=499+99,express=1299+199")
+	q, err := NewQuoter(stubDimensions{}, rates, DefaultDivisor)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// Two boxes weigh 3 kg and take 2.4 kg of dimensional weight.
+	quotes, err := q.Quote(context.Background(), []Item{{SKU: "SKU-001", Quantity: 1}, {SKU: "SKU-001", Quantity: 1}}, "")
+	if err != nil || len(quotes) != 2 {
+		t.Fatalf("Expected a quote per carrier, got: %+v, %v", quotes, err)
+	}
+	if want := (Quote{Carrier: "standard", ActualGrams: 3000, DimensionalGrams: 2400, BillableGrams: 3000, PriceCents: 499 + 3*99}); quotes[0] != want {
+		t.Errorf("Expected %+v, got: %+v", want, quotes[0])
+	}
+	// The cushion is light but bulky, so it is billed on its 19.2 kg volume.
+	quotes, err = q.Quote(context.Background(), []Item{{SKU: "SKU-002", Quantity: 1}}, "express")
+	if err != nil || len(quotes) != 1 || quotes[0].BillableGrams != 19200 || quotes[0].PriceCents != 1299+20*199 {
+		t.Errorf("Expected the dimensional weight billed, got: %+v, %v", quotes, err)
+	}
+
+	_, err = q.Quote(context.Background(), []Item{{SKU: "SKU-001", Quantity: 1}, {SKU: "SKU-009", Quantity: 1}}, "")
+	var missing *MissingDimensionsError
+	if !errors.As(err, &missing) || strings.Join(missing.SKUs, ",") != "SKU-009" {
+		t.Errorf("Expected SKU-009 to block the quote, got: %v", err)
+	}
+	if _, err := q.Quote(context.Background(), []Item{{SKU: "SKU-001", Quantity: 1}}, "pigeon"); !errors.Is(err, ErrUnknownCarrier) {
+		t.Errorf("Expected ErrUnknownCarrier, got: %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rates, _ := ParseRates("standard=499+99")
+	quote := func(source DimensionSource, body string) *httptest.ResponseRecorder {
+		q, _ := NewQuoter(source, rates, DefaultDivisor)
+		router := gin.New()
+		NewHandler(q).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/shipping/quotes", strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		source   DimensionSource
+		body     string
+		want     int
+		contains string
+	}{
+		{stubDimensions{}, `{"items": [{"sku": "SKU-001", "quantity": 2}]}`, http.StatusOK, `"billable_grams":3000,"price_cents":796`},
+		{stubDimensions{}, `{"items": [{"sku": "SKU-001", "quantity": 1}, {"sku": "SKU-404", "quantity": 1}]}`, http.StatusUnprocessableEntity, `"missing":["SKU-404"]`},
+		{stubDimensions{}, `{"items": [{"sku": "SKU-001", "quantity": 1}], "carrier": "express"}`, http.StatusBadRequest, "unknown carrier"},
+		{stubDimensions{}, `{"items": [{"sku": "SKU-001", "quantity": 0}]}`, http.StatusBadRequest, "positive quantity"},
+		{stubDimensions{}, `{"items": [{"sku": "SKU-001", "unit": "case", "quantity": 1}]}`, http.StatusBadRequest, "base units"},
+		{stubDimensions{}, `{"items": []}`, http.StatusBadRequest, ""},
+		{stubDimensions{err: errors.New("connection refused")}, `{"items": [{"sku": "SKU-001", "quantity": 1}]}`, http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		w := quote(tt.source, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected status %d, got: %d %s", tt.body, tt.want, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s: expected body to contain %s, got: %s", tt.body, tt.contains, w.Body)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tracking
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	links *Links
+}
+
+func NewHandler(links *Links) *Handler {
+	return &Handler{links: links}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// The order's customer and admins manage its links; the tracking page
+// needs only the token.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/orders/:id/tracking-link", h.issue)
+	router.DELETE("/orders/:id/tracking-link", h.revoke)
+	router.GET("/tracking/:token", h.page)
+}
+
+func (h *Handler) issue(c *gin.Context) {
+	id, ok := h.authorize(c)
+	if !ok {
+		return
+	}
+	link, err := h.links.Issue(c.Request.Context(), id)
+	if !found(c, err) {
+		return
+	}
+	c.JSON(http.StatusCreated, link)
+}
+
+// revoke stops every link issued for the order so far. Links issued
+// afterwards work again.
+func (h *Handler) revoke(c *gin.Context) {
+	id, ok := h.authorize(c)
+	if !ok {
+		return
+	}
+	if !found(c, h.links.Revoke(c.Request.Context(), id)) {
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// page is never cached, so a revoked link stops working at once.
+func (h *Handler) page(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	p, err := h.links.Page(c.Request.Context(), c.Param("token"))
+	if errors.Is(err, ErrInvalidToken) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// authorize reads the order ID and checks the caller may manage the
+// order's links.
+func (h *Handler) authorize(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return 0, false
+	}
+	owner, err := h.links.store.Owner(c.Request.Context(), id)
+	if !found(c, err) {
+		return 0, false
+	}
+	return id, auth.AuthorizeUser(c, owner)
+}
+
+func found(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package tracking
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type Store interface {
+	// Owner returns the ID of the user who placed the order.
+	Owner(ctx context.Context, orderID int) (int, error)
+	// Generation returns the order's current link generation, starting it
+	// at 1 for an order that has had no links yet.
+	Generation(ctx context.Context, orderID int) (int, error)
+	// Revoke moves the order to its next link generation.
+	Revoke(ctx context.Context, orderID int) error
+	// Page returns the order's tracking page, or ErrNotFound unless the
+	// order has links and generation is current.
+	Page(ctx context.Context, orderID, generation int) (*Page, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Owner(ctx context.Context, orderID int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT user_id FROM order_service.orders WHERE id = $1 AND tenant_id = $2`
+	var userID int
+	err := s.db.QueryRowContext(ctx, query, orderID, tenant.FromContext(ctx)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return userID, err
+}
+
+func (s *PostgresStore) Generation(ctx context.Context, orderID int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// The no-op update makes RETURNING yield the existing row too.
+	const query string = `INSERT INTO order_service.tracking_links (order_id, tenant_id)
+		SELECT id, tenant_id FROM order_service.orders WHERE id = $1 AND tenant_id = $2
+		ON CONFLICT (order_id) DO UPDATE SET generation = order_service.tracking_links.generation
+		RETURNING generation`
+	var generation int
+	err := s.db.QueryRowContext(ctx, query, orderID, tenant.FromContext(ctx)).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return generation, err
+}
+
+func (s *PostgresStore) Revoke(ctx context.Context, orderID int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO order_service.tracking_links (order_id, tenant_id, generation, revoked_at)
+		SELECT id, tenant_id, 2, NOW() FROM order_service.orders WHERE id = $1 AND tenant_id = $2
+		ON CONFLICT (order_id) DO UPDATE SET generation = order_service.tracking_links.generation + 1, revoked_at = NOW()`
+	res, err := s.db.ExecContext(ctx, query, orderID, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) Page(ctx context.Context, orderID, generation int) (*Page, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT o.id, o.status, o.created_at, o.updated_at,
+			COALESCE(p.carrier, ''), COALESCE(to_char(p.promised_date, 'YYYY-MM-DD'), ''), p.shipped_at,
+			EXISTS (SELECT 1 FROM order_service.pick_lines l WHERE l.order_id = o.id)
+		FROM order_service.tracking_links t
+		JOIN order_service.orders o ON o.id = t.order_id
+		LEFT JOIN order_service.delivery_promises p ON p.order_id = o.id
+		WHERE t.order_id = $1 AND t.tenant_id = $2 AND t.generation = $3`
+	var p Page
+	var shippedAt sql.NullTime
+	var picking bool
+	err := s.db.QueryRowContext(ctx, query, orderID, tenant.FromContext(ctx), generation).Scan(
+		&p.OrderID, &p.Status, &p.CreatedAt, &p.UpdatedAt,
+		&p.Shipment.Carrier, &p.Shipment.PromisedDate, &shippedAt, &picking)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case shippedAt.Valid:
+		at := shippedAt.Time
+		p.Shipment.Status, p.Shipment.ShippedAt = ShipmentShipped, &at
+	case picking:
+		p.Shipment.Status = ShipmentPicking
+	default:
+		p.Shipment.Status = ShipmentPending
+	}
+
+	const itemsQuery string = `SELECT sku, name, unit, quantity FROM order_service.order_items WHERE order_id = $1 ORDER BY id`
+	items, err := s.db.QueryContext(ctx, itemsQuery, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer items.Close()
+	p.Items = []Item{}
+	for items.Next() {
+		var it Item
+		if err := items.Scan(&it.SKU, &it.Name, &it.Unit, &it.Quantity); err != nil {
+			return nil, err
+		}
+		p.Items = append(p.Items, it)
+	}
+	if err := items.Err(); err != nil {
+		return nil, err
+	}
+
+	const historyQuery string = `SELECT to_status, created_at FROM order_service.order_status_history
+		WHERE order_id = $1 ORDER BY created_at, id`
+	rows, err := s.db.QueryContext(ctx, historyQuery, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	p.History = []Step{}
+	for rows.Next() {
+		var step Step
+		if err := rows.Scan(&step.Status, &step.At); err != nil {
+			return nil, err
+		}
+		p.History = append(p.History, step)
+	}
+	return &p, rows.Err()
+}
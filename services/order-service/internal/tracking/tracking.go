@@ -0,0 +1,152 @@
+// Package tracking gives customers a link to follow an order without
+// logging in. Links carry a signed token naming the order, so anyone
+// holding one can see its progress; the page they open shows statuses,
+// items and the delivery promise, and nothing about who ordered or what
+// they paid. Revoking an order's links makes every token issued for it so
+// far stop working.
+package tracking
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+const (
+	ShipmentPending = "pending"
+	ShipmentPicking = "picking"
+	ShipmentShipped = "shipped"
+)
+
+// Link is a tracking link for an order.
+type Link struct {
+	OrderID   int       `json:"order_id"`
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Page is what a tracking link shows.
+type (
+	Page     = models.TrackingPage
+	Item     = models.TrackingItem
+	Shipment = models.Shipment
+	Step     = models.TrackingStep
+)
+
+// Links issues and reads tracking links.
+type Links struct {
+	store   Store
+	secret  []byte
+	baseURL string
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// NewLinks signs tokens with secret and links them from baseURL, the
+// public tracking route. Tokens expire ttl after they are issued.
+func NewLinks(store Store, secret, baseURL string, ttl time.Duration) *Links {
+	return &Links{store: store, secret: []byte(secret), baseURL: strings.TrimSuffix(baseURL, "/"), ttl: ttl, now: time.Now}
+}
+
+// Issue returns a link to the order. The token names the order's current
+// generation, which Revoke moves past.
+func (l *Links) Issue(ctx context.Context, orderID int) (*Link, error) {
+	generation, err := l.store.Generation(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	t := token{
+		Tenant:     tenant.FromContext(ctx),
+		OrderID:    orderID,
+		Generation: generation,
+		ExpiresAt:  l.now().Add(l.ttl).Truncate(time.Second).UTC(),
+	}
+	signed := l.sign(t)
+	return &Link{OrderID: orderID, Token: signed, URL: l.baseURL + "/" + signed, ExpiresAt: t.ExpiresAt}, nil
+}
+
+// Revoke stops every link issued for the order so far from working.
+func (l *Links) Revoke(ctx context.Context, orderID int) error {
+	return l.store.Revoke(ctx, orderID)
+}
+
+// Page returns the page a token opens. Tokens that are malformed, expired
+// or revoked are ErrInvalidToken.
+func (l *Links) Page(ctx context.Context, signed string) (*Page, error) {
+	t, err := l.parse(signed)
+	if err != nil {
+		return nil, err
+	}
+	if !l.now().Before(t.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	p, err := l.store.Page(tenant.NewContext(ctx, t.Tenant), t.OrderID, t.Generation)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	return p, err
+}
+
+// token is what a tracking token grants. Tokens are signed rather than
+// stored; the generation is what lets them be revoked.
+type token struct {
+	Tenant     string
+	OrderID    int
+	Generation int
+	ExpiresAt  time.Time
+}
+
+var ErrInvalidToken = errors.New("invalid or revoked tracking token")
+
+var encoding = base64.RawURLEncoding
+
+func (l *Links) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (l *Links) sign(t token) string {
+	payload := encoding.EncodeToString([]byte(strings.Join([]string{
+		t.Tenant, strconv.Itoa(t.OrderID), strconv.Itoa(t.Generation), strconv.FormatInt(t.ExpiresAt.Unix(), 10),
+	}, "\n")))
+	return payload + "." + encoding.EncodeToString(l.mac(payload))
+}
+
+func (l *Links) parse(signed string) (token, error) {
+	payload, sig, ok := strings.Cut(signed, ".")
+	want, err := encoding.DecodeString(sig)
+	if !ok || err != nil || len(l.secret) == 0 || !hmac.Equal(want, l.mac(payload)) {
+		return token{}, ErrInvalidToken
+	}
+	raw, err := encoding.DecodeString(payload)
+	if err != nil {
+		return token{}, ErrInvalidToken
+	}
+	parts := strings.Split(string(raw), "\n")
+	if len(parts) != 4 {
+		return token{}, ErrInvalidToken
+	}
+	orderID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return token{}, ErrInvalidToken
+	}
+	generation, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return token{}, ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return token{}, ErrInvalidToken
+	}
+	return token{Tenant: parts[0], OrderID: orderID, Generation: generation, ExpiresAt: time.Unix(expires, 0).UTC()}, nil
+}
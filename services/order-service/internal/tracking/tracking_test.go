@@ -0,0 +1,120 @@
+package tracking
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore holds order 1, placed by user 7 in tenant acme.
+type memStore struct {
+	generations map[int]int
+}
+
+func (s *memStore) Owner(ctx context.Context, orderID int) (int, error) {
+	if orderID != 1 || tenant.FromContext(ctx) != "acme" {
+		return 0, ErrNotFound
+	}
+	return 7, nil
+}
+
+func (s *memStore) Generation(ctx context.Context, orderID int) (int, error) {
+	if _, err := s.Owner(ctx, orderID); err != nil {
+		return 0, err
+	}
+	if s.generations[orderID] == 0 {
+		s.generations[orderID] = 1
+	}
+	return s.generations[orderID], nil
+}
+
+func (s *memStore) Revoke(ctx context.Context, orderID int) error {
+	if _, err := s.Owner(ctx, orderID); err != nil {
+		return err
+	}
+	s.generations[orderID]++
+	return nil
+}
+
+func (s *memStore) Page(ctx context.Context, orderID, generation int) (*Page, error) {
+	if _, err := s.Owner(ctx, orderID); err != nil || s.generations[orderID] != generation {
+		return nil, ErrNotFound
+	}
+	return &Page{OrderID: orderID, Status: "paid", Items: []Item{{SKU: "ABC", Unit: "each", Quantity: 2}},
+		Shipment: Shipment{Status: ShipmentPending}, History: []Step{{Status: "pending"}, {Status: "paid"}}}, nil
+}
+
+func TestTracking(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	links := NewLinks(&memStore{generations: map[int]int{}}, "tracking-secret", "https://shop.example.com/api/track/", 24*time.Hour)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	links.now = func() time.Time { return now }
+	do := func(p *auth.Principal, method, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		// Customers sign in to the order's tenant. Anonymous requests
+		// arrive in the default tenant, and the token names the order's.
+		router.Use(func(c *gin.Context) {
+			if p != nil {
+				auth.WithPrincipal(c, p)
+				c.Request = c.Request.WithContext(tenant.NewContext(c.Request.Context(), "acme"))
+			}
+		})
+		NewHandler(links).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	customer := &auth.Principal{UserID: 7, Roles: []string{auth.RoleCustomer}}
+
+	if w := do(&auth.Principal{UserID: 8, Roles: []string{auth.RoleCustomer}}, http.MethodPost, "/orders/1/tracking-link"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected other customers to be refused a link, got: %d", w.Code)
+	}
+	if w := do(customer, http.MethodPost, "/orders/2/tracking-link"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown order to be not found, got: %d", w.Code)
+	}
+	w := do(customer, http.MethodPost, "/orders/1/tracking-link")
+	var link Link
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("Expected a tracking link, got: %d %s", w.Code, w.Body)
+	}
+	if link.URL != "https://shop.example.com/api/track/"+link.Token || !link.ExpiresAt.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("Expected the link to point at the tracking route and expire in a day, got: %+v", link)
+	}
+
+	w = do(nil, http.MethodGet, "/tracking/"+link.Token)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected the page without logging in, uncached, got: %d %s", w.Code, w.Header())
+	}
+	if strings.Contains(w.Body.String(), "user_id") || !strings.Contains(w.Body.String(), `"shipment":{"status":"pending"}`) {
+		t.Errorf("Expected the shipment status and no customer details, got: %s", w.Body)
+	}
+
+	forged := link.Token[:len(link.Token)-2] + "xx"
+	if w := do(nil, http.MethodGet, "/tracking/"+forged); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a forged token to be refused, got: %d", w.Code)
+	}
+	now = now.Add(25 * time.Hour)
+	if w := do(nil, http.MethodGet, "/tracking/"+link.Token); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an expired token to be refused, got: %d", w.Code)
+	}
+	now = now.Add(-25 * time.Hour)
+
+	if w := do(customer, http.MethodDelete, "/orders/1/tracking-link"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the links to be revoked, got: %d %s", w.Code, w.Body)
+	}
+	if w := do(nil, http.MethodGet, "/tracking/"+link.Token); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a revoked token to be refused, got: %d", w.Code)
+	}
+	json.Unmarshal(do(customer, http.MethodPost, "/orders/1/tracking-link").Body.Bytes(), &link)
+	if w := do(nil, http.MethodGet, "/tracking/"+link.Token); w.Code != http.StatusOK {
+		t.Errorf("Expected a link issued after revoking to work, got: %d", w.Code)
+	}
+}
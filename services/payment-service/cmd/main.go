@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/bodylimit"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+	"github.com/alux444/go-microserv-test/pkg/httpclient"
+	"github.com/alux444/go-microserv-test/pkg/idempotency"
+	"github.com/alux444/go-microserv-test/pkg/service"
+	"github.com/alux444/go-microserv-test/pkg/startup"
+	"github.com/alux444/go-microserv-test/services/payment-service/api"
+	"github.com/alux444/go-microserv-test/services/payment-service/internal/messages"
+	"github.com/alux444/go-microserv-test/services/payment-service/internal/payments"
+	"github.com/alux444/go-microserv-test/services/payment-service/internal/providers"
+	"github.com/gin-gonic/gin"
+)
+
+func setupRouter(db *sql.DB, handler *payments.Handler, tokens *auth.Tokens, keys idempotency.Store) *gin.Engine {
+	router := service.NewRouter(service.Config{
+		Name:       "payment-service",
+		DB:         db,
+		Tokens:     tokens,
+		Spec:       api.Spec,
+		Messages:   messages.Files,
+		AuditLog:   "payment_service.audit_log",
+		Middleware: []gin.HandlerFunc{idempotency.Middleware(keys, idempotencyTTL())},
+	})
+	// Providers sign the raw body, which the handler checks before it
+	// parses anything.
+	router.Bodies.SetRoute("POST /webhooks/:provider", bodylimit.Rule{Types: []string{bodylimit.AnyType}})
+
+	handler.RegisterRoutes(router)
+
+	return router.Engine
+}
+
+func idempotencyTTL() time.Duration {
+	return config.GetDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+}
+
+// configuredProviders returns the providers that have credentials, with
+// PAYMENT_PROVIDER first so it is the default.
+func configuredProviders() ([]providers.Provider, error) {
+	var configured []providers.Provider
+	if secret := config.GetEnv("MOCK_WEBHOOK_SECRET", ""); secret != "" {
+		configured = append(configured, providers.NewMock(secret))
+	}
+	if key, secret := config.GetEnv("STRIPE_API_KEY", ""), config.GetEnv("STRIPE_WEBHOOK_SECRET", ""); key != "" && secret != "" {
+		configured = append(configured, providers.NewStripe(key, secret, httpclient.New()))
+	}
+
+	fallback := config.GetEnv("PAYMENT_PROVIDER", "mock")
+	for i, p := range configured {
+		if p.Name() == fallback {
+			configured[0], configured[i] = configured[i], configured[0]
+			return configured, nil
+		}
+	}
+	return nil, errors.New("PAYMENT_PROVIDER " + fallback + " is not configured")
+}
+
+func main() {
+	ctx, stop := service.Init("payment-service")
+	defer stop()
+
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	log.Println("Connected to db successfully")
+
+	tokens := service.Tokens("payment-service")
+
+	available, err := configuredProviders()
+	if err != nil {
+		log.Fatalf("Invalid payment provider config: %v", err)
+	}
+
+	keys := idempotency.NewPostgresStore(db, "payment_service.idempotency_keys")
+	go idempotency.Purger(context.Background(), keys, idempotencyTTL(), time.Hour)
+
+	publisher, _, closeEvents := schema.Connect(config.GetEnv("RABBITMQ_URL", ""), "events")
+	defer closeEvents()
+
+	orderClient := clients.NewOrderClient(config.GetEnv("ORDER_SERVICE_URL", "http://order-service:50053"),
+		auth.NewServiceClient(tokens, "payment-service", "order-service"))
+	handler := payments.NewHandler(payments.NewPostgresStore(db), orderClient, publisher,
+		config.GetEnv("PAYMENT_CURRENCY", "USD"), available...)
+
+	selfCheck := startup.New("payment-service",
+		startup.Env("JWT_SECRET"),
+		startup.Config(startup.Duration("JWT_TTL"), startup.Duration("IDEMPOTENCY_TTL"), startup.Duration("SHUTDOWN_TIMEOUT"),
+			startup.Bytes("MAX_REQUEST_BODY"), startup.Duration("MAINTENANCE_RETRY_AFTER")),
+		startup.Tables(db, "payment_service.payments", "payment_service.idempotency_keys", "payment_service.audit_log"),
+		startup.Service("order-service", config.GetEnv("ORDER_SERVICE_URL", "http://order-service:50053")),
+		startup.Broker(publisher, config.GetEnv("RABBITMQ_URL", "")),
+	)
+	go selfCheck.Run(context.Background())
+
+	router := setupRouter(db, handler, tokens, keys)
+	router.GET("/health/startup-report", selfCheck.Handler())
+
+	service.Serve(ctx, "payment-service", ":50055", router)
+}
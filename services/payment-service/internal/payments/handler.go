@@ -0,0 +1,326 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/services/payment-service/internal/providers"
+	"github.com/gin-gonic/gin"
+)
+
+const maxWebhookBytes = 1 << 20
+
+// payable are the order statuses a payment can be taken in. An order whose
+// last payment failed can be paid again.
+var payable = map[string]bool{"pending": true, "payment_failed": true}
+
+// OrderSource reads the order being paid from order-service.
+type OrderSource interface {
+	GetOrder(ctx context.Context, id int) (*clients.Order, error)
+}
+
+var _ OrderSource = (*clients.OrderClient)(nil)
+
+type Handler struct {
+	store     Store
+	orders    OrderSource
+	publisher events.Publisher
+	currency  string
+	providers map[string]providers.Provider
+	fallback  string
+}
+
+// NewHandler charges through the named providers, in the order's currency
+// or, for orders that carry none, in currency. Payments that name no
+// provider use the first.
+func NewHandler(store Store, orders OrderSource, publisher events.Publisher, currency string, available ...providers.Provider) *Handler {
+	h := &Handler{store: store, orders: orders, publisher: publisher, currency: currency, providers: map[string]providers.Provider{}}
+	for _, p := range available {
+		if h.fallback == "" {
+			h.fallback = p.Name()
+		}
+		h.providers[p.Name()] = p
+	}
+	return h
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Customers may only pay and see payments for their own orders, and only
+// admins and services, order-service cancelling a paid order, may refund.
+// Webhooks are authenticated by the provider's signature instead of a
+// token.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/payments", h.create)
+	router.POST("/payments/refunds", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.refund)
+	router.GET("/payments/:id", h.get)
+	router.POST("/webhooks/:provider", h.webhook)
+}
+
+type createRequest struct {
+	OrderID  int    `json:"order_id" binding:"required"`
+	Provider string `json:"provider"`
+}
+
+// create charges the order's total as order-service reports it, so a
+// client cannot choose what it pays.
+func (h *Handler) create(c *gin.Context) {
+	if _, ok := auth.FromContext(c); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+		return
+	}
+	var req createRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Provider == "" {
+		req.Provider = h.fallback
+	}
+	provider, ok := h.providers[req.Provider]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown payment provider"})
+		return
+	}
+
+	o, err := h.orders.GetOrder(c.Request.Context(), req.OrderID)
+	var apiErr *clients.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read order %d: %v", req.OrderID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "order-service is unavailable"})
+		return
+	}
+	if !auth.AuthorizeUser(c, o.UserID) {
+		return
+	}
+	if !payable[o.Status] {
+		c.JSON(http.StatusConflict, gin.H{"error": "order cannot be paid while " + o.Status})
+		return
+	}
+	if o.TotalCents <= 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "order has nothing to pay"})
+		return
+	}
+
+	currency := o.Currency
+	if currency == "" {
+		currency = h.currency
+	}
+	p := &Payment{
+		OrderID:     o.ID,
+		UserID:      o.UserID,
+		AmountCents: o.TotalCents,
+		Currency:    currency,
+		Provider:    provider.Name(),
+		Status:      providers.StatusPending,
+	}
+	if err := h.store.Create(c.Request.Context(), p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	charge, err := provider.Charge(c.Request.Context(), providers.ChargeRequest{
+		PaymentID:   p.ID,
+		AmountCents: p.AmountCents,
+		Currency:    p.Currency,
+		Description: fmt.Sprintf("Order %d", o.ID),
+	})
+	if err != nil {
+		log.Printf("Provider %s refused payment %d: %v", p.Provider, p.ID, err)
+		p.Status, p.FailureReason = providers.StatusFailed, "provider error"
+		if err := h.store.Update(c.Request.Context(), p); err != nil {
+			log.Printf("Failed to mark payment %d failed: %v", p.ID, err)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "payment provider is unavailable", "payment": p})
+		return
+	}
+	p.Reference, p.Status = charge.Reference, charge.Status
+	if err := h.store.Update(c.Request.Context(), p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p.ClientSecret = charge.ClientSecret
+	c.JSON(http.StatusCreated, p)
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payment id"})
+		return
+	}
+	p, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "payment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.AuthorizeUser(c, p.UserID) {
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// webhook answers 2xx for notifications it cannot use, so the provider does
+// not retry them, and 5xx only when retrying can help. A retry of a settled
+// payment whose event was not published publishes it.
+func (h *Handler) webhook(c *gin.Context) {
+	provider, ok := h.providers[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown payment provider"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	w, err := provider.ParseWebhook(c.Request.Header, body)
+	if errors.Is(err, providers.ErrInvalidSignature) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if w.Status == "" {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+
+	p, err := h.store.Settle(c.Request.Context(), provider.Name(), w.Reference, w.Status, w.Reason)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("Webhook %s from %s matches no payment", w.EventID, provider.Name())
+		c.JSON(http.StatusOK, gin.H{"status": "unmatched"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if p.Status != w.Status {
+		log.Printf("Webhook %s says payment %d %s, but it already %s", w.EventID, p.ID, w.Status, p.Status)
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+	if !p.Published {
+		if err := h.publish(c.Request.Context(), p); err != nil {
+			log.Printf("Failed to publish payment %d: %v", p.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to publish payment event"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "processed", "payment": p})
+}
+
+type refundRequest struct {
+	OrderID int    `json:"order_id" binding:"required"`
+	Reason  string `json:"reason" binding:"max=255"`
+}
+
+// refund gives back the order's succeeded payment in full. The provider
+// deduplicates on the payment, so a retry after a failure part way
+// through refunds once, and refunding a refunded payment returns it.
+func (h *Handler) refund(c *gin.Context) {
+	var req refundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := h.store.Settled(c.Request.Context(), req.OrderID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order has no succeeded payment"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if p.Status == StatusRefunded {
+		h.finishRefund(c, p)
+		return
+	}
+	provider, ok := h.providers[p.Provider]
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "payment provider " + p.Provider + " is not configured"})
+		return
+	}
+
+	refund, err := provider.Refund(c.Request.Context(), providers.RefundRequest{
+		PaymentID:   p.ID,
+		Reference:   p.Reference,
+		AmountCents: p.AmountCents,
+		Currency:    p.Currency,
+		Reason:      req.Reason,
+	})
+	if err != nil {
+		log.Printf("Provider %s refused to refund payment %d: %v", p.Provider, p.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "payment provider is unavailable"})
+		return
+	}
+	p, err = h.store.Refund(c.Request.Context(), p.ID, refund.Reference, req.Reason)
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "payment can no longer be refunded"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Refunded payment %d for order %d as %s", p.ID, p.OrderID, p.RefundRef)
+	h.finishRefund(c, p)
+}
+
+// finishRefund publishes the refund if that has not happened yet. A
+// retry publishes it when it failed the first time.
+func (h *Handler) finishRefund(c *gin.Context, p *Payment) {
+	if !p.Published {
+		if err := h.publish(c.Request.Context(), p); err != nil {
+			log.Printf("Failed to publish refund of payment %d: %v", p.ID, err)
+		}
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func (h *Handler) publish(ctx context.Context, p *Payment) error {
+	eventType, reason := events.PaymentSucceeded, ""
+	switch p.Status {
+	case providers.StatusFailed:
+		eventType, reason = events.PaymentFailed, p.FailureReason
+	case StatusRefunded:
+		eventType, reason = events.PaymentRefunded, p.RefundReason
+	}
+	e, err := events.New(eventType, "payment-service", events.PaymentResult{
+		PaymentID:   p.ID,
+		OrderID:     p.OrderID,
+		UserID:      p.UserID,
+		Tenant:      p.Tenant,
+		AmountCents: p.AmountCents,
+		Currency:    p.Currency,
+		Provider:    p.Provider,
+		Reason:      reason,
+	})
+	if err != nil {
+		return err
+	}
+	if err := h.publisher.Publish(ctx, e); err != nil {
+		return err
+	}
+	p.Published = true
+	return h.store.MarkPublished(ctx, p.ID)
+}
@@ -0,0 +1,218 @@
+package payments
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/pkg/testfactory"
+	"github.com/alux444/go-microserv-test/services/payment-service/internal/providers"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	payments map[int]*Payment
+}
+
+func (s *memStore) Create(ctx context.Context, p *Payment) error {
+	p.ID = len(s.payments) + 1
+	p.Tenant = tenant.FromContext(ctx)
+	saved := *p
+	s.payments[p.ID] = &saved
+	return nil
+}
+
+func (s *memStore) Update(ctx context.Context, p *Payment) error {
+	saved := *p
+	s.payments[p.ID] = &saved
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, id int) (*Payment, error) {
+	p, ok := s.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memStore) Settle(ctx context.Context, provider, reference, status, reason string) (*Payment, error) {
+	for _, p := range s.payments {
+		if p.Provider == provider && p.Reference == reference {
+			if canSettle(p.Status, status) {
+				p.Status, p.FailureReason, p.Published = status, reason, false
+			}
+			found := *p
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) MarkPublished(ctx context.Context, id int) error {
+	s.payments[id].Published = true
+	return nil
+}
+
+func (s *memStore) Settled(ctx context.Context, orderID int) (*Payment, error) {
+	for _, p := range s.payments {
+		if p.OrderID == orderID && (p.Status == providers.StatusSucceeded || p.Status == StatusRefunded) {
+			return p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Refund(ctx context.Context, id int, refundRef, reason string) (*Payment, error) {
+	p := s.payments[id]
+	if p.Status != providers.StatusSucceeded {
+		return nil, ErrInvalidState
+	}
+	p.Status, p.RefundRef, p.RefundReason, p.Published = StatusRefunded, refundRef, reason, false
+	return p, nil
+}
+
+type orderLookup map[int]*clients.Order
+
+func (o orderLookup) GetOrder(ctx context.Context, id int) (*clients.Order, error) {
+	order, ok := o[id]
+	if !ok {
+		return nil, &clients.APIError{StatusCode: http.StatusNotFound, Message: "order not found"}
+	}
+	return order, nil
+}
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+func TestPayments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{payments: map[int]*Payment{}}
+	publisher := &recordingPublisher{}
+	mock := providers.NewMock("mock-secret")
+	orders := orderLookup{
+		4: testfactory.Order(testfactory.OrderID(4), testfactory.WithItems(testfactory.Item(testfactory.Quantity(2)))),
+		5: testfactory.Order(testfactory.OrderID(5), testfactory.OrderStatus("paid")),
+		6: testfactory.Order(testfactory.OrderID(6), testfactory.ForUser(2)),
+	}
+	h := NewHandler(store, orders, publisher, "USD", mock)
+	do := func(p *auth.Principal, path, body string, header http.Header) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(tenant.Middleware())
+		if p != nil {
+			router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		}
+		h.RegisterRoutes(router)
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		for k, values := range header {
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	customer := &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+	acme := http.Header{tenant.Header: {"acme"}}
+
+	tests := []struct {
+		principal *auth.Principal
+		body      string
+		want      int
+	}{
+		{principal: nil, body: `{"order_id": 4}`, want: http.StatusUnauthorized},
+		{principal: customer, body: `{"order_id": 4, "provider": "stripe"}`, want: http.StatusBadRequest},
+		{principal: customer, body: `{"order_id": 404}`, want: http.StatusNotFound},
+		{principal: customer, body: `{"order_id": 6}`, want: http.StatusForbidden},
+		{principal: customer, body: `{"order_id": 5}`, want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if w := do(tt.principal, "/payments", tt.body, nil); w.Code != tt.want {
+			t.Errorf("POST /payments %s: expected status %d, got: %d %s", tt.body, tt.want, w.Code, w.Body)
+		}
+	}
+
+	w := do(customer, "/payments", `{"order_id": 4}`, acme)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"amount_cents":3998,"currency":"USD","provider":"mock"`) {
+		t.Fatalf("Expected the order's total to be charged, got: %d %s", w.Code, w.Body)
+	}
+	ref := store.payments[1].Reference
+	if store.payments[1].Status != providers.StatusPending || !strings.HasPrefix(ref, "mock_") {
+		t.Fatalf("Expected a pending mock payment, got: %+v", store.payments[1])
+	}
+
+	webhook := func(id, status, reason string) *httptest.ResponseRecorder {
+		body := `{"id": "` + id + `", "reference": "` + ref + `", "status": "` + status + `", "reason": "` + reason + `"}`
+		return do(nil, "/webhooks/mock", body, http.Header{providers.MockSignatureHeader: {mock.Sign([]byte(body))}})
+	}
+	if w := do(nil, "/webhooks/mock", `{"id": "evt_0", "reference": "`+ref+`", "status": "succeeded"}`,
+		http.Header{providers.MockSignatureHeader: {"00"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a bad signature, got: %d", w.Code)
+	}
+	if w := webhook("evt_1", "failed", "card declined"); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", w.Code, w.Body)
+	}
+	if w := webhook("evt_2", "succeeded", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", w.Code, w.Body)
+	}
+	// A redelivered success and a late failure change nothing.
+	webhook("evt_2", "succeeded", "")
+	if w := webhook("evt_3", "failed", "too late"); !strings.Contains(w.Body.String(), `"ignored"`) {
+		t.Errorf("Expected a failure after success to be ignored, got: %s", w.Body)
+	}
+
+	if len(publisher.published) != 2 || publisher.published[0].Type != events.PaymentFailed || publisher.published[1].Type != events.PaymentSucceeded {
+		t.Fatalf("Expected payment.failed then payment.succeeded, got: %+v", publisher.published)
+	}
+	var failed, succeeded events.PaymentResult
+	publisher.published[0].Decode(&failed)
+	publisher.published[1].Decode(&succeeded)
+	if failed.Reason != "card declined" || succeeded.OrderID != 4 || succeeded.Tenant != "acme" || succeeded.AmountCents != 3998 {
+		t.Errorf("Expected the events to describe the payment, got: %+v and %+v", failed, succeeded)
+	}
+
+	if w := do(nil, "/webhooks/mock", `{"id": "evt_4", "reference": "mock_unknown", "status": "succeeded"}`,
+		http.Header{providers.MockSignatureHeader: {mock.Sign([]byte(`{"id": "evt_4", "reference": "mock_unknown", "status": "succeeded"}`))}}); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for an unmatched webhook, got: %d", w.Code)
+	}
+	if w := do(nil, "/webhooks/paypal", `{}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown provider, got: %d", w.Code)
+	}
+
+	// Order-service refunds a paid order it cancels, once however often it
+	// asks.
+	service := &auth.Principal{Service: "order-service", Roles: []string{auth.RoleService}}
+	if w := do(customer, "/payments/refunds", `{"order_id": 4}`, acme); w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers not to refund, got: %d", w.Code)
+	}
+	if w := do(service, "/payments/refunds", `{"order_id": 6}`, acme); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an order with no succeeded payment, got: %d", w.Code)
+	}
+	for i := 0; i < 2; i++ {
+		w := do(service, "/payments/refunds", `{"order_id": 4, "reason": "changed_mind"}`, acme)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"refunded"`) {
+			t.Fatalf("Expected the payment refunded, got: %d %s", w.Code, w.Body)
+		}
+	}
+	if len(publisher.published) != 3 || publisher.published[2].Type != events.PaymentRefunded {
+		t.Fatalf("Expected one payment.refunded, got: %+v", publisher.published)
+	}
+	var refunded events.PaymentResult
+	publisher.published[2].Decode(&refunded)
+	if refunded.OrderID != 4 || refunded.Reason != "changed_mind" || !strings.HasPrefix(store.payments[1].RefundRef, "mock_re_") {
+		t.Errorf("Expected the refund to be recorded and described, got: %+v and %+v", refunded, store.payments[1])
+	}
+}
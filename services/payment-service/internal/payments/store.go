@@ -0,0 +1,246 @@
+// Package payments takes payments for orders through a payment provider and
+// publishes payment.succeeded and payment.failed once the provider's webhook
+// settles them. Order-service moves the order along from those events, and
+// refunds a paid order it cancels through here, which publishes
+// payment.refunded.
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/payment-service/internal/providers"
+	"github.com/alux444/go-microserv-test/services/payment-service/internal/store/gen"
+)
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrInvalidState = errors.New("invalid payment state")
+)
+
+// StatusRefunded is a succeeded payment given back to the customer.
+const StatusRefunded = "refunded"
+
+// Payment is one attempt to pay an order's total. ClientSecret is only
+// returned when the payment is created and is never stored.
+type Payment struct {
+	ID            int        `json:"id"`
+	OrderID       int        `json:"order_id"`
+	UserID        int        `json:"user_id"`
+	AmountCents   int64      `json:"amount_cents"`
+	Currency      string     `json:"currency"`
+	Provider      string     `json:"provider"`
+	Reference     string     `json:"provider_ref,omitempty"`
+	ClientSecret  string     `json:"client_secret,omitempty"`
+	Status        string     `json:"status"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+	RefundRef     string     `json:"refund_ref,omitempty"`
+	RefundReason  string     `json:"refund_reason,omitempty"`
+	RefundedAt    *time.Time `json:"refunded_at,omitempty"`
+	Tenant        string     `json:"-"`
+	Published     bool       `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type Store interface {
+	Create(ctx context.Context, p *Payment) error
+	// Update saves the provider's reference and the payment's status after
+	// the charge is started.
+	Update(ctx context.Context, p *Payment) error
+	Get(ctx context.Context, id int) (*Payment, error)
+	// Settle applies a webhook's outcome to the payment the provider knows
+	// as reference and returns the payment afterwards. Pending payments may
+	// succeed or fail, and failed ones may still succeed when the customer
+	// retries; any other outcome leaves the payment as it was. Webhooks
+	// carry no tenant, so the payment is found in any tenant.
+	Settle(ctx context.Context, provider, reference, status, reason string) (*Payment, error)
+	// MarkPublished records that the payment's outcome event went out.
+	MarkPublished(ctx context.Context, id int) error
+	// Settled returns the order's succeeded or refunded payment, or
+	// ErrNotFound when it has none.
+	Settled(ctx context.Context, orderID int) (*Payment, error)
+	// Refund records that a succeeded payment was refunded as refundRef
+	// and returns it. A payment refunded already is returned as it is, and
+	// any other gives ErrInvalidState.
+	Refund(ctx context.Context, id int, refundRef, reason string) (*Payment, error)
+}
+
+type PostgresStore struct {
+	db      *sql.DB
+	queries *gen.Queries
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db, queries: gen.New(db)}
+}
+
+// fromRow converts a row of payment_service.payments to a Payment. A
+// missing row is ErrNotFound.
+func fromRow(row gen.PaymentServicePayment, err error) (*Payment, error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &Payment{
+		ID:            int(row.ID),
+		OrderID:       int(row.OrderID),
+		UserID:        int(row.UserID),
+		AmountCents:   row.AmountCents,
+		Currency:      row.Currency,
+		Provider:      row.Provider,
+		Reference:     row.ProviderRef.String,
+		Status:        row.Status,
+		FailureReason: row.FailureReason.String,
+		RefundRef:     row.RefundRef.String,
+		RefundReason:  row.RefundReason.String,
+		Tenant:        row.TenantID,
+		Published:     row.Published,
+		CreatedAt:     row.CreatedAt.Time,
+		UpdatedAt:     row.UpdatedAt.Time,
+	}
+	if row.RefundedAt.Valid {
+		p.RefundedAt = &row.RefundedAt.Time
+	}
+	return p, nil
+}
+
+func (s *PostgresStore) Create(ctx context.Context, p *Payment) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	p.Tenant = tenant.FromContext(ctx)
+	row, err := s.queries.CreatePayment(ctx, gen.CreatePaymentParams{
+		TenantID:    p.Tenant,
+		OrderID:     int32(p.OrderID),
+		UserID:      int32(p.UserID),
+		AmountCents: p.AmountCents,
+		Currency:    p.Currency,
+		Provider:    p.Provider,
+		Status:      p.Status,
+	})
+	if err != nil {
+		return err
+	}
+	p.ID, p.CreatedAt, p.UpdatedAt = int(row.ID), row.CreatedAt.Time, row.UpdatedAt.Time
+	return nil
+}
+
+func (s *PostgresStore) Update(ctx context.Context, p *Payment) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	updatedAt, err := s.queries.UpdatePayment(ctx, gen.UpdatePaymentParams{
+		ProviderRef:   p.Reference,
+		Status:        p.Status,
+		FailureReason: p.FailureReason,
+		ID:            int32(p.ID),
+		TenantID:      tenant.FromContext(ctx),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	p.UpdatedAt = updatedAt.Time
+	return nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int) (*Payment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return fromRow(s.queries.GetPayment(ctx, gen.GetPaymentParams{ID: int32(id), TenantID: tenant.FromContext(ctx)}))
+}
+
+func (s *PostgresStore) Settle(ctx context.Context, provider, reference, status, reason string) (*Payment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	queries := s.queries.WithTx(tx)
+
+	p, err := fromRow(queries.LockPaymentByReference(ctx, gen.LockPaymentByReferenceParams{Provider: provider, ProviderRef: reference}))
+	if err != nil {
+		return nil, err
+	}
+	if !canSettle(p.Status, status) {
+		return p, nil
+	}
+
+	updatedAt, err := queries.SettlePayment(ctx, gen.SettlePaymentParams{Status: status, FailureReason: reason, ID: int32(p.ID)})
+	if err != nil {
+		return nil, err
+	}
+	p.Status, p.FailureReason, p.Published, p.UpdatedAt = status, reason, false, updatedAt.Time
+	return p, tx.Commit()
+}
+
+// canSettle reports whether a webhook's status may replace a payment's.
+func canSettle(from, to string) bool {
+	switch from {
+	case providers.StatusPending:
+		return to == providers.StatusSucceeded || to == providers.StatusFailed
+	case providers.StatusFailed:
+		return to == providers.StatusSucceeded
+	}
+	return false
+}
+
+func (s *PostgresStore) MarkPublished(ctx context.Context, id int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return s.queries.MarkPaymentPublished(ctx, int32(id))
+}
+
+func (s *PostgresStore) Settled(ctx context.Context, orderID int) (*Payment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return fromRow(s.queries.GetSettledPayment(ctx, gen.GetSettledPaymentParams{OrderID: int32(orderID), TenantID: tenant.FromContext(ctx)}))
+}
+
+func (s *PostgresStore) Refund(ctx context.Context, id int, refundRef, reason string) (*Payment, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var p *Payment
+	err := database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		queries := s.queries.WithTx(tx)
+		var err error
+		if p, err = fromRow(queries.LockPayment(ctx, gen.LockPaymentParams{ID: int32(id), TenantID: tenant.FromContext(ctx)})); err != nil {
+			return err
+		}
+		switch p.Status {
+		case StatusRefunded:
+			return nil
+		case providers.StatusSucceeded:
+		default:
+			return ErrInvalidState
+		}
+
+		row, err := queries.RefundPayment(ctx, gen.RefundPaymentParams{RefundRef: refundRef, RefundReason: reason, ID: int32(id)})
+		if err != nil {
+			return err
+		}
+		p.Status, p.RefundRef, p.RefundReason, p.Published = StatusRefunded, refundRef, reason, false
+		p.RefundedAt, p.UpdatedAt = &row.RefundedAt.Time, row.UpdatedAt.Time
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,84 @@
+package providers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const MockSignatureHeader = "X-Mock-Signature"
+
+// Mock accepts every charge and leaves it pending until a webhook settles
+// it, and accepts every refund, so local setups and tests can drive either outcome. Webhooks are JSON
+// signed with the hex HMAC-SHA256 of the body in MockSignatureHeader:
+//
+//	{"id": "evt_1", "reference": "mock_...", "status": "failed", "reason": "card declined"}
+type Mock struct {
+	secret []byte
+}
+
+func NewMock(secret string) *Mock {
+	return &Mock{secret: []byte(secret)}
+}
+
+func (m *Mock) Name() string {
+	return "mock"
+}
+
+func (m *Mock) Charge(ctx context.Context, req ChargeRequest) (*Charge, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Charge{Reference: "mock_" + hex.EncodeToString(id), Status: StatusPending}, nil
+}
+
+// Refund accepts every refund straight away.
+func (m *Mock) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Refund{Reference: "mock_re_" + hex.EncodeToString(id)}, nil
+}
+
+// Sign returns the signature the mock expects for body.
+func (m *Mock) Sign(body []byte) string {
+	return hex.EncodeToString(m.mac(body))
+}
+
+func (m *Mock) mac(body []byte) []byte {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (m *Mock) ParseWebhook(header http.Header, body []byte) (*Webhook, error) {
+	want, err := hex.DecodeString(strings.TrimPrefix(header.Get(MockSignatureHeader), "sha256="))
+	if err != nil || !hmac.Equal(want, m.mac(body)) {
+		return nil, ErrInvalidSignature
+	}
+	var event struct {
+		ID        string `json:"id"`
+		Reference string `json:"reference"`
+		Status    string `json:"status"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.ID == "" || event.Reference == "" {
+		return nil, errors.New("mock webhook needs an id and a reference")
+	}
+	w := &Webhook{EventID: event.ID, Reference: event.Reference, Reason: event.Reason}
+	if event.Status == StatusSucceeded || event.Status == StatusFailed {
+		w.Status = event.Status
+	}
+	return w, nil
+}
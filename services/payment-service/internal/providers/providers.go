@@ -0,0 +1,73 @@
+// Package providers puts payment providers behind one interface: start a
+// charge, learn how it ended from the provider's signed webhook, and refund
+// it.
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Charge and webhook statuses.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// ChargeRequest asks a provider to collect an amount in the currency's minor
+// unit. PaymentID makes repeated requests for the same payment start one
+// charge.
+type ChargeRequest struct {
+	PaymentID   int
+	AmountCents int64
+	Currency    string
+	Description string
+}
+
+// Charge is a charge the provider has accepted. Reference is the provider's
+// ID for it, which its webhooks quote. ClientSecret, when set, lets the
+// customer's browser confirm the charge with the provider directly.
+type Charge struct {
+	Reference    string
+	ClientSecret string
+	Status       string
+}
+
+// RefundRequest asks a provider to give back a succeeded charge in full.
+// PaymentID makes repeated requests for the same payment make one refund.
+type RefundRequest struct {
+	PaymentID   int
+	Reference   string
+	AmountCents int64
+	Currency    string
+	Reason      string
+}
+
+// Refund is a refund the provider has accepted. Reference is the
+// provider's ID for it.
+type Refund struct {
+	Reference string
+}
+
+// Webhook is a verified provider notification. Status is empty for
+// notifications that do not settle a charge.
+type Webhook struct {
+	EventID   string
+	Reference string
+	Status    string
+	Reason    string
+}
+
+type Provider interface {
+	Name() string
+	Charge(ctx context.Context, req ChargeRequest) (*Charge, error)
+	Refund(ctx context.Context, req RefundRequest) (*Refund, error)
+	// ParseWebhook checks the notification's signature and decodes it. It
+	// returns ErrInvalidSignature for notifications the provider did not
+	// sign.
+	ParseWebhook(header http.Header, body []byte) (*Webhook, error)
+}
@@ -0,0 +1,155 @@
+package providers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMockWebhook(t *testing.T) {
+	mock := NewMock("mock-secret")
+	body := []byte(`{"id": "evt_1", "reference": "mock_abc", "status": "failed", "reason": "card declined"}`)
+
+	header := http.Header{}
+	header.Set(MockSignatureHeader, "sha256="+mock.Sign(body))
+	w, err := mock.ParseWebhook(header, body)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if w.EventID != "evt_1" || w.Reference != "mock_abc" || w.Status != StatusFailed || w.Reason != "card declined" {
+		t.Errorf("Expected the webhook to be decoded, got: %+v", w)
+	}
+
+	header.Set(MockSignatureHeader, NewMock("other-secret").Sign(body))
+	if _, err := mock.ParseWebhook(header, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature, got: %v", err)
+	}
+}
+
+// stripeSignature signs body at the given time with each secret, the way
+// Stripe does while a secret is being rolled.
+func stripeSignature(at time.Time, body string, secrets ...string) string {
+	timestamp := fmt.Sprint(at.Unix())
+	header := "t=" + timestamp
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "." + body))
+		header += ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return header
+}
+
+func TestStripeWebhook(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	stripe := NewStripe("sk_test", "whsec_test", nil)
+	stripe.now = func() time.Time { return now }
+
+	failed := `{"id": "evt_1", "type": "payment_intent.payment_failed",
+		"data": {"object": {"id": "pi_1", "last_payment_error": {"message": "Your card was declined."}}}}`
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+		want      *Webhook
+	}{
+		{name: "payment failed", signature: stripeSignature(now, failed, "whsec_test"), body: failed,
+			want: &Webhook{EventID: "evt_1", Reference: "pi_1", Status: StatusFailed, Reason: "Your card was declined."}},
+		{name: "one of several signatures matches", signature: stripeSignature(now, failed, "whsec_old", "whsec_test"), body: failed,
+			want: &Webhook{EventID: "evt_1", Reference: "pi_1", Status: StatusFailed, Reason: "Your card was declined."}},
+		{name: "other events settle nothing", signature: stripeSignature(now, `{"id": "evt_2", "type": "charge.refunded"}`, "whsec_test"),
+			body: `{"id": "evt_2", "type": "charge.refunded"}`, want: &Webhook{EventID: "evt_2"}},
+		{name: "wrong secret", signature: stripeSignature(now, failed, "whsec_other"), body: failed},
+		{name: "stale timestamp", signature: stripeSignature(now.Add(-6*time.Minute), failed, "whsec_test"), body: failed},
+		{name: "tampered body", signature: stripeSignature(now, failed, "whsec_test"), body: failed + " "},
+		{name: "missing header", body: failed},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set(StripeSignatureHeader, tt.signature)
+		got, err := stripe.ParseWebhook(header, []byte(tt.body))
+		if tt.want == nil {
+			if !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("%s: expected ErrInvalidSignature, got: %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || *got != *tt.want {
+			t.Errorf("%s: expected %+v, got: %+v %v", tt.name, tt.want, got, err)
+		}
+	}
+}
+
+func TestStripeCharge(t *testing.T) {
+	var form map[string]string
+	var idempotencyKey string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/payment_intents" || r.Header.Get("Authorization") != "Bearer sk_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"message": "Invalid API Key provided"}}`)
+			return
+		}
+		r.ParseForm()
+		form = map[string]string{}
+		for k := range r.PostForm {
+			form[k] = r.PostForm.Get(k)
+		}
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+		fmt.Fprint(w, `{"id": "pi_1", "client_secret": "pi_1_secret_2", "status": "requires_payment_method"}`)
+	}))
+	defer api.Close()
+
+	stripe := NewStripe("sk_test", "whsec_test", api.Client())
+	stripe.baseURL = api.URL
+	charge, err := stripe.Charge(context.Background(), ChargeRequest{PaymentID: 9, AmountCents: 1999, Currency: "USD", Description: "Order 4"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if charge.Reference != "pi_1" || charge.ClientSecret != "pi_1_secret_2" || charge.Status != StatusPending {
+		t.Errorf("Expected a pending charge for pi_1, got: %+v", charge)
+	}
+	if form["amount"] != "1999" || form["currency"] != "usd" || form["metadata[payment_id]"] != "9" || idempotencyKey != "payment-9" {
+		t.Errorf("Expected the intent to carry the payment, got: %v with key %q", form, idempotencyKey)
+	}
+
+	stripe.apiKey = "sk_wrong"
+	if _, err := stripe.Charge(context.Background(), ChargeRequest{PaymentID: 9, AmountCents: 1999, Currency: "USD"}); err == nil {
+		t.Errorf("Expected an error for a rejected API key")
+	}
+}
+
+func TestStripeRefund(t *testing.T) {
+	var form map[string]string
+	var idempotencyKey string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/refunds" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"message": "Unrecognized request URL"}}`)
+			return
+		}
+		r.ParseForm()
+		form = map[string]string{}
+		for k := range r.PostForm {
+			form[k] = r.PostForm.Get(k)
+		}
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+		fmt.Fprint(w, `{"id": "re_1", "status": "succeeded"}`)
+	}))
+	defer api.Close()
+
+	stripe := NewStripe("sk_test", "whsec_test", api.Client())
+	stripe.baseURL = api.URL
+	refund, err := stripe.Refund(context.Background(), RefundRequest{PaymentID: 9, Reference: "pi_1", AmountCents: 1999, Currency: "USD", Reason: "changed_mind"})
+	if err != nil || refund.Reference != "re_1" {
+		t.Fatalf("Expected refund re_1, got: %+v, %v", refund, err)
+	}
+	if form["payment_intent"] != "pi_1" || form["amount"] != "1999" || form["metadata[reason]"] != "changed_mind" || idempotencyKey != "refund-9" {
+		t.Errorf("Expected the refund to carry the payment, got: %v with key %q", form, idempotencyKey)
+	}
+}
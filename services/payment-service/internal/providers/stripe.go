@@ -0,0 +1,196 @@
+package providers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StripeSignatureHeader = "Stripe-Signature"
+	// stripeTolerance is how old a webhook's timestamp may be, which bounds
+	// replays of a captured webhook.
+	stripeTolerance = 5 * time.Minute
+)
+
+// Stripe charges through Stripe PaymentIntents. The customer confirms the
+// intent in the browser with Charge.ClientSecret, and Stripe reports the
+// outcome with payment_intent.succeeded and payment_intent.payment_failed
+// webhooks.
+type Stripe struct {
+	apiKey        string
+	webhookSecret []byte
+	client        *http.Client
+	baseURL       string
+	now           func() time.Time
+}
+
+func NewStripe(apiKey, webhookSecret string, client *http.Client) *Stripe {
+	return &Stripe{
+		apiKey:        apiKey,
+		webhookSecret: []byte(webhookSecret),
+		client:        client,
+		baseURL:       "https://api.stripe.com",
+		now:           time.Now,
+	}
+}
+
+func (s *Stripe) Name() string {
+	return "stripe"
+}
+
+func (s *Stripe) Charge(ctx context.Context, req ChargeRequest) (*Charge, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(req.AmountCents, 10))
+	form.Set("currency", strings.ToLower(req.Currency))
+	form.Set("description", req.Description)
+	form.Set("metadata[payment_id]", strconv.Itoa(req.PaymentID))
+	form.Set("automatic_payment_methods[enabled]", "true")
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/v1/payment_intents", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+s.apiKey)
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Stripe deduplicates on the key, and it lets our client retry the POST.
+	httpReq.Header.Set("Idempotency-Key", fmt.Sprintf("payment-%d", req.PaymentID))
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var intent struct {
+		ID           string `json:"id"`
+		ClientSecret string `json:"client_secret"`
+		Error        struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&intent); err != nil {
+		return nil, fmt.Errorf("stripe: status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("stripe: status %d: %s", resp.StatusCode, intent.Error.Message)
+	}
+	return &Charge{Reference: intent.ID, ClientSecret: intent.ClientSecret, Status: StatusPending}, nil
+}
+
+// Refund refunds the PaymentIntent in full through /v1/refunds.
+func (s *Stripe) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", req.Reference)
+	form.Set("amount", strconv.FormatInt(req.AmountCents, 10))
+	form.Set("metadata[payment_id]", strconv.Itoa(req.PaymentID))
+	if req.Reason != "" {
+		form.Set("metadata[reason]", req.Reason)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/v1/refunds", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+s.apiKey)
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Idempotency-Key", fmt.Sprintf("refund-%d", req.PaymentID))
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var refund struct {
+		ID    string `json:"id"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&refund); err != nil {
+		return nil, fmt.Errorf("stripe: status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("stripe: status %d: %s", resp.StatusCode, refund.Error.Message)
+	}
+	return &Refund{Reference: refund.ID}, nil
+}
+
+// verify checks a Stripe-Signature header of the form t=<unix>,v1=<hex>,...
+// against the HMAC-SHA256 of "<t>.<body>". Any v1 signature may match, since
+// Stripe signs with every active secret while one is being rolled.
+func (s *Stripe) verify(header string, body []byte) bool {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := s.now().Sub(time.Unix(unix, 0)); age > stripeTolerance || age < -stripeTolerance {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, s.webhookSecret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := mac.Sum(nil)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Stripe) ParseWebhook(header http.Header, body []byte) (*Webhook, error) {
+	if !s.verify(header.Get(StripeSignatureHeader), body) {
+		return nil, ErrInvalidSignature
+	}
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID               string `json:"id"`
+				LastPaymentError *struct {
+					Message string `json:"message"`
+				} `json:"last_payment_error"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	w := &Webhook{EventID: event.ID, Reference: event.Data.Object.ID}
+	switch event.Type {
+	case "payment_intent.succeeded":
+		w.Status = StatusSucceeded
+	case "payment_intent.payment_failed":
+		w.Status = StatusFailed
+		if e := event.Data.Object.LastPaymentError; e != nil {
+			w.Reason = e.Message
+		}
+	}
+	return w, nil
+}
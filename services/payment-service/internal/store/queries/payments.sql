@@ -0,0 +1,47 @@
+-- name: CreatePayment :one
+INSERT INTO payment_service.payments (tenant_id, order_id, user_id, amount_cents, currency, provider, status)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id, created_at, updated_at;
+
+-- name: UpdatePayment :one
+UPDATE payment_service.payments
+SET provider_ref = NULLIF(sqlc.arg(provider_ref)::text, ''), status = sqlc.arg(status),
+    failure_reason = NULLIF(sqlc.arg(failure_reason)::text, ''), updated_at = NOW()
+WHERE id = sqlc.arg(id) AND tenant_id = sqlc.arg(tenant_id)
+RETURNING updated_at;
+
+-- name: GetPayment :one
+SELECT * FROM payment_service.payments
+WHERE id = $1 AND tenant_id = $2;
+
+-- name: LockPayment :one
+SELECT * FROM payment_service.payments
+WHERE id = $1 AND tenant_id = $2
+FOR UPDATE;
+
+-- name: LockPaymentByReference :one
+SELECT * FROM payment_service.payments
+WHERE provider = sqlc.arg(provider) AND provider_ref = sqlc.arg(provider_ref)::text
+FOR UPDATE;
+
+-- name: SettlePayment :one
+UPDATE payment_service.payments
+SET status = sqlc.arg(status), failure_reason = NULLIF(sqlc.arg(failure_reason)::text, ''), published = FALSE, updated_at = NOW()
+WHERE id = sqlc.arg(id)
+RETURNING updated_at;
+
+-- name: MarkPaymentPublished :exec
+UPDATE payment_service.payments SET published = TRUE WHERE id = $1;
+
+-- name: GetSettledPayment :one
+SELECT * FROM payment_service.payments
+WHERE order_id = $1 AND tenant_id = $2 AND status IN ('succeeded', 'refunded')
+ORDER BY id DESC
+LIMIT 1;
+
+-- name: RefundPayment :one
+UPDATE payment_service.payments
+SET status = 'refunded', refund_ref = sqlc.arg(refund_ref)::text, refund_reason = NULLIF(sqlc.arg(refund_reason)::text, ''),
+    refunded_at = NOW(), published = FALSE, updated_at = NOW()
+WHERE id = sqlc.arg(id)
+RETURNING refunded_at, updated_at;
@@ -1,64 +1,245 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
-	"net/http"
+	"time"
 
-	"github.com/alux444/go-microserv-test/services/user-service/internal/database"
-	"github.com/gin-gonic/gin"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/bodylimit"
+	"github.com/alux444/go-microserv-test/pkg/config"
+	"github.com/alux444/go-microserv-test/pkg/crypto"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/events/schema"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/service"
+	"github.com/alux444/go-microserv-test/pkg/startup"
+	"github.com/alux444/go-microserv-test/services/user-service/api"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/activity"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/addresses"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/logins"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/messages"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/oidc"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/onboarding"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/profile"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/publicprofile"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/recovery"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/referrals"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/rolechanges"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/sessions"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
 )
 
-func setupRouter(db *sql.DB) *gin.Engine {
-	router := gin.Default()
+const defaultProfileFields = "first_name,last_name"
 
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "healthy",
-			"service": "user-service",
-		})
+func setupRouter(db *sql.DB, replicas *database.Replicas, cipher *pii.Cipher, tracker *profile.Tracker, checklists *onboarding.Tracker, tokens *auth.Tokens, roleChanges *rolechanges.Worker, publisher events.Publisher, locator logins.Locator, sessions users.Sessions, external users.ExternalLogin) *service.Router {
+	router := service.NewRouter(service.Config{
+		Name:     "user-service",
+		DB:       db,
+		Replicas: replicas,
+		Tokens:   tokens,
+		Spec:     api.Spec,
+		Messages: messages.Files,
+		AuditLog: "user_service.audit_log",
+		// Personal data and security answers are kept out of the log, like
+		// passwords.
+		Redact: []string{"phone", "recipient", "line1", "line2", "city", "region", "postal_code", "answer", "answers"},
 	})
+	router.Bodies.SetRoute("POST /users/import", bodylimit.Rule{MaxBytes: config.GetBytes("USER_IMPORT_MAX_BODY", 100<<20),
+		Types: []string{"text/csv", "application/x-ndjson", "application/ndjson"}})
+	piiHandler := pii.NewHandler(cipher, pii.NewReencrypter(cipher))
+	piiHandler.RegisterAdminRoutes(router.Admin)
 
-	router.GET("/users", func(c *gin.Context) {
-		const query string = "SELECT id, email, username FROM user_service.users LIMIT 10"
-		rows, err := db.Query(query)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-			})
-		}
-		defer rows.Close()
-
-		type User struct {
-			ID       int    `json:"id"`
-			Email    string `json:"email"`
-			Username string `json:"username"`
-		}
-
-		users := []User{}
-		for rows.Next() {
-			var u User
-			if err := rows.Scan(&u.ID, &u.Email, &u.Username); err != nil {
-				continue
-			}
-			users = append(users, u)
-		}
-
-		c.JSON(http.StatusOK, gin.H{"users": users})
-	})
+	// Login codes are sent through events, so sign-ins are only assessed
+	// when there is a publisher.
+	var guard users.LoginGuard
+	if publisher != nil {
+		guard = logins.NewGuard(logins.NewPostgresStore(db), locator, loginRules(), publisher,
+			config.GetDuration("LOGIN_CODE_TTL", 10*time.Minute), config.GetInt("LOGIN_CODE_MAX_ATTEMPTS", 5))
+	}
+	// So are verification links, which also need a secret to sign them.
+	var verification *users.Verification
+	if secret := config.GetEnv("EMAIL_VERIFICATION_SECRET", ""); secret != "" && publisher != nil {
+		verification = users.NewVerification([]byte(secret), config.GetDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+			config.GetEnv("EMAIL_VERIFICATION_URL", "http://localhost:8080/verify-email"), publisher)
+	} else {
+		log.Println("EMAIL_VERIFICATION_SECRET or RABBITMQ_URL not set, email verification is disabled")
+	}
+	recoveryStore := recovery.NewPostgresStore(db)
+	users.NewHandler(users.NewPostgresStore(db, cipher), tokens, publisher, guard, sessions, external, verification,
+		recovery.NewIssuer(recoveryStore)).RegisterRoutes(router)
+	logins.NewHandler(logins.NewPostgresStore(db)).RegisterRoutes(router)
+	profile.NewHandler(tracker, publisher).RegisterRoutes(router)
+	onboarding.NewHandler(checklists).RegisterRoutes(router)
+	publicprofile.NewHandler(publicprofile.NewPostgresStore(db), publisher,
+		config.GetDuration("PUBLIC_PROFILE_MAX_AGE", 5*time.Minute)).RegisterRoutes(router)
+	addresses.NewHandler(addresses.NewPostgresStore(db, cipher)).RegisterRoutes(router)
+	piiHandler.RegisterRoutes(router)
+	trail.NewHandler(trail.NewPostgresStore(db)).RegisterRoutes(router)
+	rolechanges.NewHandler(rolechanges.NewPostgresStore(db), roleChanges).RegisterRoutes(router)
+	activity.NewHandler(activity.NewPostgresStore(db)).RegisterRoutes(router)
+	referrals.NewHandler(referrals.NewPostgresStore(db), config.GetDuration("REFERRAL_CLAIM_WINDOW", 30*24*time.Hour)).RegisterRoutes(router)
+	// Reset links are emailed through notification-service too.
+	var resets *recovery.Resets
+	if publisher != nil {
+		resets = recovery.NewResets(publisher, config.GetDuration("PASSWORD_RESET_TTL", time.Hour),
+			config.GetEnv("PASSWORD_RESET_URL", "http://localhost:8080/reset-password"),
+			config.GetInt("PASSWORD_RESET_MAX_REQUESTS", 3), config.GetDuration("PASSWORD_RESET_WINDOW", time.Hour))
+	} else {
+		log.Println("RABBITMQ_URL not set, password reset is disabled")
+	}
+	recovery.NewHandler(recoveryStore,
+		config.GetInt("RECOVERY_MAX_ATTEMPTS", 5),
+		config.GetDuration("RECOVERY_LOCKOUT_WINDOW", time.Hour),
+		resets,
+	).RegisterRoutes(router)
 
 	return router
 }
 
+// loginRules reads the login rules' scores and thresholds, a score of 0
+// turning a rule off.
+func loginRules() logins.Rules {
+	rules := logins.DefaultRules()
+	rules.StepUpScore = config.GetInt("LOGIN_STEP_UP_SCORE", rules.StepUpScore)
+	rules.AlertScore = config.GetInt("LOGIN_ALERT_SCORE", rules.AlertScore)
+	rules.ImpossibleTravel = config.GetInt("LOGIN_IMPOSSIBLE_TRAVEL_SCORE", rules.ImpossibleTravel)
+	rules.MaxSpeedKMH = float64(config.GetInt("LOGIN_MAX_TRAVEL_KMH", int(rules.MaxSpeedKMH)))
+	rules.NewCountry = config.GetInt("LOGIN_NEW_COUNTRY_SCORE", rules.NewCountry)
+	rules.UnusualHour = config.GetInt("LOGIN_UNUSUAL_HOUR_SCORE", rules.UnusualHour)
+	rules.UnusualHourMinLogins = config.GetInt("LOGIN_UNUSUAL_HOUR_MIN_LOGINS", rules.UnusualHourMinLogins)
+	return rules
+}
+
 func main() {
+	ctx, stop := service.Init("user-service")
+	defer stop()
+
 	db, err := database.Connect()
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	defer db.Close()
 	log.Println("Connected to db successfully")
+	replicas, err := database.ConnectReplicas()
+	if err != nil {
+		log.Fatalf("Failed to open database replicas: %v", err)
+	}
+	defer replicas.Close()
+
+	tokens := service.Tokens("user-service")
+
+	keyProvider, err := crypto.ProviderFromEnv("PII_")
+	if err != nil {
+		log.Fatalf("Invalid PII key provider: %v", err)
+	}
+	cipher := pii.NewCipher(pii.NewPostgresStore(db), keyProvider)
+
+	profileFields, err := profile.ParseFields(config.GetEnv("PROFILE_REQUIRED_FIELDS", defaultProfileFields))
+	if err != nil {
+		log.Fatalf("Invalid PROFILE_REQUIRED_FIELDS: %v", err)
+	}
+	tracker := profile.NewTracker(profile.NewPostgresStore(db, cipher), profileFields)
+
+	checklists := onboarding.NewTracker(onboarding.NewPostgresStore(db))
+
+	publisher, subscriber, closeEvents := schema.Connect(config.GetEnv("RABBITMQ_URL", ""), "events")
+	defer closeEvents()
+	if subscriber != nil {
+		go func() {
+			if err := onboarding.NewConsumer(onboarding.NewPostgresStore(db), tracker).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Onboarding consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			if err := activity.NewConsumer(activity.NewPostgresStore(db)).Run(context.Background(), subscriber); err != nil {
+				log.Printf("Activity consumer stopped: %v", err)
+			}
+		}()
+		go func() {
+			consumer := referrals.NewConsumer(referrals.NewPostgresStore(db), int64(config.GetInt("REFERRAL_REWARD_CENTS", 1000)))
+			if err := consumer.Run(context.Background(), subscriber); err != nil {
+				log.Printf("Referrals consumer stopped: %v", err)
+			}
+		}()
+	}
+
+	var locator logins.Locator
+	if path := config.GetEnv("LOGIN_GEO_FILE", ""); path != "" {
+		networks, err := logins.LoadLocator(path)
+		if err != nil {
+			log.Fatalf("Invalid LOGIN_GEO_FILE: %v", err)
+		}
+		locator = networks
+	} else {
+		log.Println("LOGIN_GEO_FILE not set, sign-ins are not located and only the unusual hour rule applies")
+	}
+
+	providers, err := oidc.ProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid OIDC provider config: %v", err)
+	}
+
+	nudger := profile.NewNudger(tracker, publisher, config.GetDuration("PROFILE_NUDGE_COOLDOWN", 7*24*time.Hour))
+	go nudger.Run(context.Background(), config.GetDuration("PROFILE_NUDGE_INTERVAL", time.Hour))
+	onboardingNudger := onboarding.NewNudger(checklists, publisher, config.GetDuration("ONBOARDING_WINDOW", 30*24*time.Hour))
+	go onboardingNudger.Run(context.Background(), config.GetDuration("ONBOARDING_NUDGE_INTERVAL", time.Hour))
+
+	go replicas.Run(ctx, config.GetDuration("DB_REPLICA_CHECK_INTERVAL", 5*time.Second))
+
+	runner := jobs.New()
+	roleChanges := rolechanges.NewWorker(rolechanges.NewPostgresStore(db), publisher,
+		runner.Queue("role-changes", config.GetInt("ROLE_CHANGE_WORKERS", 2), 100))
+	runner.Schedule("role-change-sweep", jobs.Every(config.GetDuration("ROLE_CHANGE_SWEEP_INTERVAL", time.Minute)), roleChanges.Sweep)
+	runner.Schedule("pii-reencrypt", jobs.Every(config.GetDuration("PII_REENCRYPT_INTERVAL", time.Hour)), pii.NewReencrypter(cipher).Job())
+	sessionManager := sessions.NewManager(sessions.NewPostgresStore(db), config.GetDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour))
+	runner.Schedule("refresh-token-prune", jobs.Every(time.Hour), sessionManager.Job())
+	// Without providers the OIDC routes answer 404, leaving password sign-in.
+	var external users.ExternalLogin
+	if len(providers) > 0 {
+		connector := oidc.NewConnector(oidc.NewPostgresStore(db), providers, config.GetDuration("OIDC_STATE_TTL", 10*time.Minute))
+		runner.Schedule("oidc-state-prune", jobs.Every(time.Hour), connector.Job())
+		external = connector
+	}
+	runner.Start(ctx)
+
+	required := []string{"JWT_SECRET", "PII_MASTER_KEYS"}
+	if config.GetEnv("PII_KEY_PROVIDER", "local") == "vault" {
+		required = []string{"JWT_SECRET", "VAULT_ADDR", "VAULT_TOKEN", "PII_VAULT_KEY"}
+	}
+	selfCheck := startup.New("user-service",
+		startup.Env(required...),
+		startup.Config(startup.Duration("JWT_TTL"), startup.Int("RECOVERY_MAX_ATTEMPTS"), startup.Duration("RECOVERY_LOCKOUT_WINDOW"),
+			startup.Bytes("MAX_REQUEST_BODY"), startup.Duration("MAINTENANCE_RETRY_AFTER"), startup.Bytes("USER_IMPORT_MAX_BODY"),
+			startup.Duration("PROFILE_NUDGE_COOLDOWN"), startup.Duration("PROFILE_NUDGE_INTERVAL"), startup.Int("ROLE_CHANGE_WORKERS"),
+			startup.Duration("ROLE_CHANGE_SWEEP_INTERVAL"), startup.Duration("PII_REENCRYPT_INTERVAL"), startup.Duration("SHUTDOWN_TIMEOUT"),
+			startup.Duration("LOGIN_CODE_TTL"), startup.Int("LOGIN_CODE_MAX_ATTEMPTS"), startup.Int("LOGIN_STEP_UP_SCORE"),
+			startup.Int("LOGIN_ALERT_SCORE"), startup.Int("LOGIN_MAX_TRAVEL_KMH"),
+			startup.Duration("REFRESH_TOKEN_TTL"), startup.Duration("OIDC_STATE_TTL"),
+			startup.Duration("REFERRAL_CLAIM_WINDOW"), startup.Int("REFERRAL_REWARD_CENTS"), startup.Duration("PUBLIC_PROFILE_MAX_AGE"),
+			startup.Duration("ONBOARDING_WINDOW"), startup.Duration("ONBOARDING_NUDGE_INTERVAL"), startup.Duration("EMAIL_VERIFICATION_TTL"),
+			startup.Duration("PASSWORD_RESET_TTL"), startup.Int("PASSWORD_RESET_MAX_REQUESTS"), startup.Duration("PASSWORD_RESET_WINDOW")),
+		startup.Tables(db, "user_service.organizations", "user_service.users", "user_service.profile_requirements",
+			"user_service.profile_nudges", "user_service.user_roles", "user_service.recovery_codes",
+			"user_service.security_questions", "user_service.recovery_attempts", "user_service.password_resets", "user_service.addresses",
+			"user_service.role_change_jobs", "user_service.role_change_results", "user_service.activity",
+			"user_service.data_keys", "user_service.pii_access_log", "user_service.login_history", "user_service.login_challenges",
+			"user_service.user_identities", "user_service.sessions", "user_service.refresh_tokens", "user_service.oidc_states",
+			"user_service.referral_codes", "user_service.referrals", "user_service.store_credit", "user_service.audit_log",
+			"user_service.account_changes", "user_service.public_profiles", "user_service.onboarding_steps",
+			"user_service.onboarding_progress", "user_service.onboarding_nudges"),
+		startup.Broker(publisher, config.GetEnv("RABBITMQ_URL", "")),
+	)
+	go selfCheck.Run(context.Background())
+
+	router := setupRouter(db, replicas, cipher, tracker, checklists, tokens, roleChanges, publisher, locator, sessionManager, external)
+	router.Saturation.AddJobs(runner.Metrics())
+	router.GET("/health/startup-report", selfCheck.Handler())
+	router.GET("/metrics/jobs", runner.Handler())
 
-	router := setupRouter(db)
-	log.Println("User service starting on :50054")
-	router.Run(":50054")
+	service.Serve(ctx, "user-service", ":50054", router, runner.Stop)
 }
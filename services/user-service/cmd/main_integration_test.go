@@ -1,3 +1,5 @@
+//go:build integration
+
 package main
 
 import (
@@ -6,29 +8,52 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
-	"github.com/alux444/go-microserv-test/services/user-service/internal/database"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/crypto"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/testfactory"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/profile"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/rolechanges"
 )
 
+func TestMain(m *testing.M) {
+	os.Exit(testfactory.Main(m))
+}
+
 func TestUsersEndpointIntegration(t *testing.T) {
-	os.Setenv("POSTGRES_HOST", "localhost")
-	os.Setenv("POSTGRES_PORT", "5432")
-	os.Setenv("POSTGRES_USER", "postgres")
-	os.Setenv("POSTGRES_PASSWORD", "postgres")
-	os.Setenv("POSTGRES_DB", "microservice_db")
+	db := testfactory.DB(t)
+	user := testfactory.User()
+	testfactory.Insert(t, db, "user_service.users", testfactory.Row{
+		"email": user.Email, "username": user.Username, "password_hash": "not-a-real-hash",
+	})
 
-	db, err := database.Connect()
+	tokens, err := auth.NewTokens("integration-secret", time.Hour)
 	if err != nil {
-		t.Errorf("Error in integration test - database not available: %v", err)
-		return
+		t.Fatalf("Failed to create tokens: %v", err)
 	}
-	defer db.Close()
-
-	router := setupRouter(db)
+	keys, err := crypto.NewLocalKeys([]crypto.MasterKey{{ID: "test", Key: make([]byte, 32)}})
+	if err != nil {
+		t.Fatalf("Failed to create keys: %v", err)
+	}
+	cipher := pii.NewCipher(pii.NewPostgresStore(db), keys)
+	roleChanges := rolechanges.NewWorker(rolechanges.NewPostgresStore(db), nil, jobs.New().Queue("role-changes", 1, 10))
+	router := setupRouter(db, nil, cipher, profile.NewTracker(profile.NewPostgresStore(db, cipher), []string{"first_name", "last_name"}), tokens, roleChanges, nil, nil, nil, nil)
 
 	req, _ := http.NewRequest("GET", "/users", nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous list to get status 401, got: %d", w.Code)
+	}
+
+	token, _, _ := tokens.IssueUser(1, []string{auth.RoleAdmin})
+	req, _ = http.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got: %d", w.Code)
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/crypto"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/onboarding"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/profile"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/rolechanges"
+	"github.com/gin-gonic/gin"
+)
+
+// TestRouterWiring checks the routes that never reach the database, so it
+// runs without one; TestUsersEndpointIntegration covers the rest.
+func TestRouterWiring(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_TOKEN", "test-admin-token")
+	tokens, err := auth.NewTokens("wiring-secret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create tokens: %v", err)
+	}
+	keys, err := crypto.NewLocalKeys([]crypto.MasterKey{{ID: "test", Key: make([]byte, 32)}})
+	if err != nil {
+		t.Fatalf("Failed to create keys: %v", err)
+	}
+	cipher := pii.NewCipher(pii.NewPostgresStore(nil), keys)
+	roleChanges := rolechanges.NewWorker(rolechanges.NewPostgresStore(nil), nil, jobs.New().Queue("role-changes", 1, 10))
+	router := setupRouter(nil, nil, cipher, profile.NewTracker(profile.NewPostgresStore(nil, cipher), []string{"first_name"}),
+		onboarding.NewTracker(onboarding.NewPostgresStore(nil)), tokens, roleChanges, nil, nil, nil, nil)
+
+	tests := []struct {
+		name, path, token string
+		want              int
+	}{
+		{"health is public", "/health", "", http.StatusOK},
+		{"users need a token", "/users", "", http.StatusUnauthorized},
+		{"a forged token is rejected", "/users", "not-a-jwt", http.StatusUnauthorized},
+		{"admin routes take the admin token", "/admin/log-level", "test-admin-token", http.StatusOK},
+		{"admin routes reject other tokens", "/admin/log-level", "not-the-admin-token", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got: %d", tt.want, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package activity
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps entries in ID order, deduplicating by event as the
+// Postgres store does.
+type memStore struct {
+	entries []Entry
+}
+
+func (s *memStore) Record(ctx context.Context, e *Entry) error {
+	for _, existing := range s.entries {
+		if existing.EventID == e.EventID {
+			return nil
+		}
+	}
+	e.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, *e)
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, userID int, q Query) ([]Entry, error) {
+	entries := []Entry{}
+	for i := len(s.entries) - 1; i >= 0 && len(entries) < q.Limit; i-- {
+		e := s.entries[i]
+		if e.UserID != userID || (q.Before != 0 && e.ID >= q.Before) {
+			continue
+		}
+		if len(q.Categories) > 0 {
+			found := false
+			for _, c := range q.Categories {
+				found = found || c == e.Category
+			}
+			if !found {
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func event(t *testing.T, eventType string, data any) events.Event {
+	t.Helper()
+	e, err := events.New(eventType, "test", data)
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	return e
+}
+
+func TestFromEvent(t *testing.T) {
+	userID := 1
+	tests := []struct {
+		event    events.Event
+		category string
+		summary  string
+	}{
+		{event(t, events.OrderPlaced, events.OrderPlacement{OrderID: 7, UserID: 1, Status: "pending_approval", ItemCount: 3}),
+			CategoryOrders, "Placed order 7 with 3 items, awaiting approval"},
+		{event(t, events.PaymentFailed, events.PaymentResult{OrderID: 7, UserID: 1, AmountCents: 1205, Currency: "usd"}),
+			CategoryOrders, "Payment of 12.05 USD for order 7 failed"},
+		{event(t, events.OrderCancelled, events.OrderCancellation{OrderID: 7, UserID: 1, Reason: "found_cheaper"}),
+			CategoryOrders, "Cancelled order 7: found cheaper"},
+		{event(t, events.PaymentRefunded, events.PaymentResult{OrderID: 7, UserID: 1, AmountCents: 500, Currency: "usd"}),
+			CategoryOrders, "Refunded 5.00 USD for order 7"},
+		{event(t, events.OrderShipmentDelivered, events.ShipmentDelivered{ShipmentID: 3, OrderID: 7, UserID: 1, Carrier: "ups"}),
+			CategoryShipping, "Order 7 delivered by ups"},
+		{event(t, events.NotificationCreated, events.NotificationRecord{ID: 9, UserID: &userID, Channel: "email", Subject: "Your order shipped"}),
+			CategoryNotifications, "Sent an email: Your order shipped"},
+		{event(t, events.UserLoggedIn, events.Login{UserID: 1, ClientIP: "203.0.113.9"}),
+			CategorySecurity, "Signed in from 203.0.113.9"},
+		{event(t, events.UserLoginAnomaly, events.LoginAnomaly{UserID: 1, ClientIP: "203.0.113.9", Country: "BR", Challenged: true}),
+			CategorySecurity, "Unusual sign-in from 203.0.113.9 in BR, asked for a code"},
+		{event(t, events.UserProfileUpdated, events.ProfileUpdate{UserID: 1, Fields: []string{"last_name", "phone"}}),
+			CategoryProfile, "Updated last_name, phone"},
+		{event(t, events.UserRoleChanged, events.RoleChanged{UserID: 1, Role: "admin", Granted: true}),
+			CategorySecurity, "Granted the admin role"},
+	}
+	for _, tt := range tests {
+		entry, err := FromEvent(tt.event)
+		if err != nil || entry == nil {
+			t.Fatalf("Expected an entry for %s, got: %v", tt.event.Type, err)
+		}
+		if entry.UserID != 1 || entry.Category != tt.category || entry.Summary != tt.summary {
+			t.Errorf("Expected %s %q for %s, got: %+v", tt.category, tt.summary, tt.event.Type, entry)
+		}
+	}
+
+	if entry, _ := FromEvent(event(t, events.InventoryLowStock, events.LowStock{SKU: "A"})); entry != nil {
+		t.Errorf("Expected no entry for an unrelated event, got: %+v", entry)
+	}
+	if entry, _ := FromEvent(event(t, events.NotificationCreated, events.NotificationRecord{ID: 9, Channel: "email"})); entry != nil {
+		t.Errorf("Expected no entry for a notification to no user, got: %+v", entry)
+	}
+	delivered := time.Date(2026, 10, 1, 14, 0, 0, 0, time.UTC)
+	entry, _ := FromEvent(event(t, events.OrderShipmentDelivered, events.ShipmentDelivered{OrderID: 7, UserID: 1, DeliveredAt: delivered}))
+	if !entry.OccurredAt.Equal(delivered) {
+		t.Errorf("Expected a delivery to be dated when it was delivered, got: %v", entry.OccurredAt)
+	}
+	var login map[string]any
+	entry, _ = FromEvent(event(t, events.UserLoggedIn, events.Login{UserID: 1, Tenant: "acme", ClientIP: "203.0.113.9"}))
+	json.Unmarshal(entry.Details, &login)
+	if _, ok := login["tenant"]; ok || login["client_ip"] != "203.0.113.9" {
+		t.Errorf("Expected curated login details, got: %s", entry.Details)
+	}
+}
+
+func TestConsumerDeduplicates(t *testing.T) {
+	store := &memStore{}
+	consumer := NewConsumer(store)
+	e := event(t, events.UserLoggedIn, events.Login{UserID: 1, ClientIP: "203.0.113.9"})
+	for i := 0; i < 2; i++ {
+		if err := consumer.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Expected the event to be recorded, got: %v", err)
+		}
+	}
+	if err := consumer.Handle(context.Background(), events.Event{ID: "bad", Type: events.OrderPlaced, Data: []byte("{")}); err != nil {
+		t.Errorf("Expected a malformed event to be dropped, got: %v", err)
+	}
+	if len(store.entries) != 1 {
+		t.Errorf("Expected one entry after a redelivery, got: %d", len(store.entries))
+	}
+}
+
+func TestListActivity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	now := time.Now()
+	for i, category := range []string{CategoryOrders, CategorySecurity, CategoryOrders, CategoryProfile, CategoryOrders} {
+		store.Record(context.Background(), &Entry{UserID: 1, Category: category, Type: "t", Summary: "s",
+			OccurredAt: now, EventID: string(rune('a' + i))})
+	}
+	do := func(p *auth.Principal, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	owner := &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+
+	var page struct {
+		Activity   []Entry `json:"activity"`
+		NextBefore int64   `json:"next_before"`
+	}
+	w := do(owner, "/users/1/activity?category=orders&limit=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Activity) != 2 || page.Activity[0].ID != 5 || page.Activity[1].ID != 3 || page.NextBefore != 3 {
+		t.Fatalf("Expected orders 5 and 3 with a next page, got: %s", w.Body.String())
+	}
+
+	page.NextBefore = 0
+	w = do(owner, "/users/1/activity?category=orders&limit=2&before=3")
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Activity) != 1 || page.Activity[0].ID != 1 || page.NextBefore != 0 {
+		t.Errorf("Expected the last order and no next page, got: %s", w.Body.String())
+	}
+
+	w = do(owner, "/users/1/activity?category=profile,security")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"category"`) != 2 {
+		t.Errorf("Expected comma-separated categories to be combined, got: %s", w.Body.String())
+	}
+	if w := do(owner, "/users/1/activity?category=billing"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown category to be rejected, got: %d", w.Code)
+	}
+	if w := do(owner, "/users/1/activity?before=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid cursor to be rejected, got: %d", w.Code)
+	}
+	if w := do(owner, "/users/2/activity"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's feed to be forbidden, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,187 @@
+package activity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+)
+
+const activityQueue = "user-service.activity"
+
+// Consumer records the events that make up users' feeds.
+type Consumer struct {
+	store Store
+}
+
+func NewConsumer(store Store) *Consumer {
+	return &Consumer{store: store}
+}
+
+// Run consumes events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	patterns := []string{events.OrderPlaced, events.OrderCancelled, events.PaymentSucceeded, events.PaymentFailed,
+		events.PaymentRefunded, events.OrderShipmentDelivered, events.NotificationCreated, events.UserLoggedIn, events.UserLoginAnomaly, events.UserProfileUpdated, events.UserRoleChanged}
+	return subscriber.Subscribe(ctx, activityQueue, patterns, c.Handle)
+}
+
+// Handle drops events it cannot decode, since retrying them cannot help.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	entry, err := FromEvent(e)
+	if err != nil {
+		log.Printf("Dropping malformed %s event %s: %v", e.Type, e.ID, err)
+		return nil
+	}
+	if entry == nil {
+		return nil
+	}
+	return c.store.Record(ctx, entry)
+}
+
+// FromEvent builds the feed entry for e, or returns nil for events that are
+// not about a user.
+func FromEvent(e events.Event) (*Entry, error) {
+	entry := &Entry{Type: e.Type, OccurredAt: e.OccurredAt, EventID: e.ID}
+	if entry.OccurredAt.IsZero() {
+		entry.OccurredAt = time.Now()
+	}
+	var details any
+	switch e.Type {
+	case events.OrderPlaced:
+		var o events.OrderPlacement
+		if err := e.Decode(&o); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = o.UserID, CategoryOrders
+		entry.Summary = fmt.Sprintf("Placed order %d with %d %s", o.OrderID, o.ItemCount, plural(o.ItemCount, "item"))
+		if o.Status == "pending_approval" {
+			entry.Summary += ", awaiting approval"
+		}
+		details = map[string]any{"order_id": o.OrderID, "status": o.Status, "total_cents": o.TotalCents}
+	case events.OrderCancelled:
+		var o events.OrderCancellation
+		if err := e.Decode(&o); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = o.UserID, CategoryOrders
+		entry.Summary = fmt.Sprintf("Cancelled order %d", o.OrderID)
+		if o.Reason != "" {
+			entry.Summary += ": " + strings.ReplaceAll(o.Reason, "_", " ")
+		}
+		details = map[string]any{"order_id": o.OrderID, "reason": o.Reason, "refunded_cents": o.RefundedCents}
+	case events.PaymentSucceeded, events.PaymentFailed, events.PaymentRefunded:
+		var p events.PaymentResult
+		if err := e.Decode(&p); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = p.UserID, CategoryOrders
+		amount := fmt.Sprintf("%d.%02d %s", p.AmountCents/100, p.AmountCents%100, strings.ToUpper(p.Currency))
+		switch e.Type {
+		case events.PaymentSucceeded:
+			entry.Summary = fmt.Sprintf("Paid %s for order %d", amount, p.OrderID)
+		case events.PaymentRefunded:
+			entry.Summary = fmt.Sprintf("Refunded %s for order %d", amount, p.OrderID)
+		default:
+			entry.Summary = fmt.Sprintf("Payment of %s for order %d failed", amount, p.OrderID)
+		}
+		details = map[string]any{"order_id": p.OrderID, "payment_id": p.PaymentID, "amount_cents": p.AmountCents, "currency": p.Currency}
+	case events.OrderShipmentDelivered:
+		var s events.ShipmentDelivered
+		if err := e.Decode(&s); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = s.UserID, CategoryShipping
+		entry.Summary = fmt.Sprintf("Order %d delivered by %s", s.OrderID, s.Carrier)
+		if !s.DeliveredAt.IsZero() {
+			entry.OccurredAt = s.DeliveredAt
+		}
+		details = map[string]any{"order_id": s.OrderID, "shipment_id": s.ShipmentID, "carrier": s.Carrier,
+			"tracking_number": s.TrackingNumber, "items": len(s.Items)}
+	case events.NotificationCreated:
+		// The body is left out: it is the notification's to keep, and may
+		// hold links meant for the recipient alone.
+		var n events.NotificationRecord
+		if err := e.Decode(&n); err != nil {
+			return nil, err
+		}
+		if n.UserID == nil {
+			return nil, nil
+		}
+		entry.UserID, entry.Category = *n.UserID, CategoryNotifications
+		entry.Summary = fmt.Sprintf("Sent %s: %s", channelName(n.Channel), n.Subject)
+		details = map[string]any{"notification_id": n.ID, "channel": n.Channel, "status": n.Status}
+	case events.UserLoggedIn:
+		var l events.Login
+		if err := e.Decode(&l); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = l.UserID, CategorySecurity
+		entry.Summary = "Signed in from " + l.ClientIP
+		details = map[string]any{"client_ip": l.ClientIP, "user_agent": l.UserAgent}
+	case events.UserLoginAnomaly:
+		var l events.LoginAnomaly
+		if err := e.Decode(&l); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = l.UserID, CategorySecurity
+		entry.Summary = "Unusual sign-in from " + l.ClientIP
+		if l.Country != "" {
+			entry.Summary += " in " + l.Country
+		}
+		if l.Challenged {
+			entry.Summary += ", asked for a code"
+		}
+		details = map[string]any{"client_ip": l.ClientIP, "country": l.Country, "score": l.Score, "reasons": l.Reasons, "challenged": l.Challenged}
+	case events.UserProfileUpdated:
+		var p events.ProfileUpdate
+		if err := e.Decode(&p); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = p.UserID, CategoryProfile
+		entry.Summary = "Updated " + strings.Join(p.Fields, ", ")
+		details = map[string]any{"fields": p.Fields}
+	case events.UserRoleChanged:
+		var r events.RoleChanged
+		if err := e.Decode(&r); err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.Category = r.UserID, CategorySecurity
+		if r.Granted {
+			entry.Summary = fmt.Sprintf("Granted the %s role", r.Role)
+		} else {
+			entry.Summary = fmt.Sprintf("Lost the %s role", r.Role)
+		}
+		details = map[string]any{"role": r.Role, "granted": r.Granted, "actor": r.Actor}
+	default:
+		return nil, nil
+	}
+	if entry.UserID == 0 {
+		return nil, nil
+	}
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	entry.Details = raw
+	return entry, nil
+}
+
+// channelName reads a notification channel in a summary, such as "an
+// email".
+func channelName(channel string) string {
+	if channel == "email" {
+		return "an email"
+	}
+	return "a " + channel + " notification"
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
@@ -0,0 +1,82 @@
+package activity
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Users see their own feed; admins and services may read anyone's.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/activity", h.list)
+}
+
+// list pages through the feed newest first. Pass next_before from a page as
+// ?before= to get the next one. ?category= filters by one or more
+// categories, repeated or comma-separated.
+func (h *Handler) list(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	q := Query{Categories: []string{}}
+	for _, raw := range c.QueryArray("category") {
+		for _, category := range strings.Split(raw, ",") {
+			category = strings.TrimSpace(category)
+			if !slices.Contains(Categories, category) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "category must be one of " + strings.Join(Categories, ", ")})
+				return
+			}
+			q.Categories = append(q.Categories, category)
+		}
+	}
+	if raw := c.Query("before"); raw != "" {
+		if q.Before, err = strconv.ParseInt(raw, 10, 64); err != nil || q.Before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be an activity id"})
+			return
+		}
+	}
+	q.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if q.Limit <= 0 || q.Limit > maxLimit {
+		q.Limit = defaultLimit
+	}
+
+	// One extra entry tells whether there is another page.
+	limit := q.Limit
+	q.Limit++
+	entries, err := h.store.List(c.Request.Context(), id, q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"activity": entries}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		resp["activity"] = entries
+		resp["next_before"] = entries[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,114 @@
+// Package activity keeps a feed of what each user did and what happened to
+// them across the services, such as placing orders, deliveries, the
+// notifications they were sent, changing their profile and signing in. It
+// is filled from domain events, so it trails the actions themselves by
+// however long the events take to arrive.
+package activity
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+// Categories a feed can be filtered by.
+const (
+	CategoryOrders        = "orders"
+	CategoryShipping      = "shipping"
+	CategoryNotifications = "notifications"
+	CategoryProfile       = "profile"
+	CategorySecurity      = "security"
+)
+
+// Categories lists every category, in the order they are documented.
+var Categories = []string{CategoryOrders, CategoryShipping, CategoryNotifications, CategoryProfile, CategorySecurity}
+
+type Entry struct {
+	ID         int64           `json:"id"`
+	UserID     int             `json:"user_id"`
+	Category   string          `json:"category"`
+	Type       string          `json:"type"`
+	Summary    string          `json:"summary"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	// EventID is the event the entry was recorded from, so a redelivered
+	// event is only recorded once.
+	EventID string `json:"-"`
+}
+
+// Query pages through a feed, newest first.
+type Query struct {
+	// Categories keeps only these categories; empty keeps all.
+	Categories []string
+	// Before returns entries older than this entry ID; 0 starts from the
+	// newest.
+	Before int64
+	Limit  int
+}
+
+type Store interface {
+	// Record adds e, doing nothing if its event was already recorded or its
+	// user does not exist or was erased.
+	Record(ctx context.Context, e *Entry) error
+	List(ctx context.Context, userID int, q Query) ([]Entry, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Record(ctx context.Context, e *Entry) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	details := []byte(e.Details)
+	if len(details) == 0 {
+		details = []byte("{}")
+	}
+	const query string = `INSERT INTO user_service.activity (user_id, category, type, summary, details, occurred_at, event_id)
+		SELECT id, $2, $3, $4, $5, $6, $7 FROM user_service.users WHERE id = $1 AND status <> 'deleted'
+		ON CONFLICT (event_id) DO NOTHING`
+	_, err := s.db.ExecContext(ctx, query, e.UserID, e.Category, e.Type, e.Summary, details, e.OccurredAt, e.EventID)
+	return err
+}
+
+func (s *PostgresStore) List(ctx context.Context, userID int, q Query) ([]Entry, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT a.id, a.user_id, a.category, a.type, a.summary, a.details, a.occurred_at
+		FROM user_service.activity a
+		JOIN user_service.users u ON u.id = a.user_id AND u.tenant_id = $2
+		WHERE a.user_id = $1
+		  AND (cardinality($3::text[]) = 0 OR a.category = ANY($3))
+		  AND ($4 = 0 OR a.id < $4)
+		ORDER BY a.id DESC LIMIT $5`
+	rows, err := s.db.QueryContext(ctx, query, userID, tenant.FromContext(ctx), pq.Array(q.Categories), q.Before, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Category, &e.Type, &e.Summary, &details, &e.OccurredAt); err != nil {
+			return nil, err
+		}
+		if string(details) != "{}" {
+			e.Details = details
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,90 @@
+package addresses
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps addresses for user 1 only, applying the default rules the
+// Store interface documents.
+type memStore struct {
+	Store
+	addresses []*Address
+}
+
+func (s *memStore) Create(ctx context.Context, a *Address) error {
+	if a.UserID != 1 {
+		return ErrNotFound
+	}
+	if len(s.addresses) == 0 {
+		a.IsDefault = true
+	}
+	if a.IsDefault {
+		for _, other := range s.addresses {
+			other.IsDefault = false
+		}
+	}
+	a.ID = len(s.addresses) + 1
+	s.addresses = append(s.addresses, a)
+	return nil
+}
+
+func (s *memStore) Default(ctx context.Context, userID int) (*Address, error) {
+	for _, a := range s.addresses {
+		if a.UserID == userID && a.IsDefault {
+			return a, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func TestAddressBook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	do := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	owner := &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+	service := &auth.Principal{Service: "order-service", Roles: []string{auth.RoleService}}
+	home := `{"label": "Home", "recipient": "John Doe", "line1": "1 High St", "city": "London", "postal_code": "N1 1AA", "country": "gb"}`
+	work := `{"label": "Work", "recipient": "John Doe", "line1": "2 Low Rd", "city": "London", "country": "GB", "is_default": true}`
+
+	tests := []struct {
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		want      int
+		contains  string
+	}{
+		{principal: service, method: http.MethodGet, path: "/users/1/addresses/default", want: http.StatusNotFound},
+		{principal: owner, method: http.MethodPost, path: "/users/1/addresses", body: home, want: http.StatusCreated, contains: `"country":"GB","is_default":true`},
+		{principal: service, method: http.MethodGet, path: "/users/1/addresses/default", want: http.StatusOK, contains: `"label":"Home"`},
+		{principal: owner, method: http.MethodPost, path: "/users/1/addresses", body: work, want: http.StatusCreated},
+		{principal: service, method: http.MethodGet, path: "/users/1/addresses/default", want: http.StatusOK, contains: `"label":"Work"`},
+		{principal: owner, method: http.MethodPost, path: "/users/1/addresses", body: `{"recipient": "John Doe", "line1": "1 High St", "city": "London", "country": "GBR"}`, want: http.StatusBadRequest},
+		{principal: owner, method: http.MethodPost, path: "/users/1/addresses", body: `{"recipient": "John Doe", "city": "London", "country": "GB"}`, want: http.StatusBadRequest},
+		{principal: owner, method: http.MethodGet, path: "/users/2/addresses/default", want: http.StatusForbidden},
+		{principal: owner, method: http.MethodPost, path: "/users/2/addresses", body: home, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := do(tt.principal, tt.method, tt.path, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %d, got: %d %s", tt.method, tt.path, tt.want, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected body to contain %s, got: %s", tt.method, tt.path, tt.contains, w.Body)
+		}
+	}
+}
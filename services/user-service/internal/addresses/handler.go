@@ -0,0 +1,208 @@
+package addresses
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Users manage their own book; admins and services may act for anyone, and
+// order-service reads the default address at checkout.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/addresses", h.list)
+	router.POST("/users/:id/addresses", h.create)
+	router.GET("/users/:id/addresses/default", h.getDefault)
+	router.GET("/users/:id/addresses/:address_id", h.get)
+	router.PUT("/users/:id/addresses/:address_id", h.update)
+	router.DELETE("/users/:id/addresses/:address_id", h.remove)
+}
+
+// pathUser reads and authorizes the :id parameter.
+func pathUser(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	return id, auth.AuthorizeUser(c, id)
+}
+
+func addressID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("address_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid address id"})
+		return 0, false
+	}
+	return id, true
+}
+
+type addressRequest struct {
+	Label      string `json:"label" binding:"max=64"`
+	Recipient  string `json:"recipient" binding:"required,max=255"`
+	Line1      string `json:"line1" binding:"required,max=255"`
+	Line2      string `json:"line2" binding:"max=255"`
+	City       string `json:"city" binding:"required,max=128"`
+	Region     string `json:"region" binding:"max=128"`
+	PostalCode string `json:"postal_code" binding:"max=32"`
+	// Country is an ISO 3166-1 alpha-2 code, such as GB or US.
+	Country   string `json:"country" binding:"required,len=2,alpha"`
+	Phone     string `json:"phone" binding:"max=32"`
+	IsDefault bool   `json:"is_default"`
+}
+
+func bindAddress(c *gin.Context, userID int) (*Address, bool) {
+	var req addressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &Address{
+		UserID:     userID,
+		Label:      strings.TrimSpace(req.Label),
+		Recipient:  strings.TrimSpace(req.Recipient),
+		Line1:      strings.TrimSpace(req.Line1),
+		Line2:      strings.TrimSpace(req.Line2),
+		City:       strings.TrimSpace(req.City),
+		Region:     strings.TrimSpace(req.Region),
+		PostalCode: strings.TrimSpace(req.PostalCode),
+		Country:    strings.ToUpper(req.Country),
+		Phone:      strings.TrimSpace(req.Phone),
+		IsDefault:  req.IsDefault,
+	}, true
+}
+
+func (h *Handler) list(c *gin.Context) {
+	userID, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	addresses, err := h.store.List(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"addresses": addresses})
+}
+
+func (h *Handler) create(c *gin.Context) {
+	userID, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	a, ok := bindAddress(c, userID)
+	if !ok {
+		return
+	}
+	err := h.store.Create(c.Request.Context(), a)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if errors.Is(err, ErrLimitReached) {
+		c.JSON(http.StatusConflict, gin.H{"error": "a user can keep at most " + strconv.Itoa(MaxAddresses) + " addresses"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, a)
+}
+
+func (h *Handler) getDefault(c *gin.Context) {
+	userID, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	a, err := h.store.Default(c.Request.Context(), userID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no default address"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func (h *Handler) get(c *gin.Context) {
+	userID, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	id, ok := addressID(c)
+	if !ok {
+		return
+	}
+	a, err := h.store.Get(c.Request.Context(), userID, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "address not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func (h *Handler) update(c *gin.Context) {
+	userID, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	id, ok := addressID(c)
+	if !ok {
+		return
+	}
+	a, ok := bindAddress(c, userID)
+	if !ok {
+		return
+	}
+	a.ID = id
+	err := h.store.Update(c.Request.Context(), a)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "address not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func (h *Handler) remove(c *gin.Context) {
+	userID, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	id, ok := addressID(c)
+	if !ok {
+		return
+	}
+	err := h.store.Delete(c.Request.Context(), userID, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "address not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
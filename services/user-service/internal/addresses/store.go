@@ -0,0 +1,312 @@
+// Package addresses keeps each user's address book. One address per user is
+// the default, which order-service ships to unless an order says otherwise.
+package addresses
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrLimitReached is returned when a user already has MaxAddresses
+	// addresses.
+	ErrLimitReached = errors.New("address book full")
+)
+
+// MaxAddresses bounds how many addresses one user can keep.
+const MaxAddresses = 20
+
+type Address struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Label      string    `json:"label,omitempty"`
+	Recipient  string    `json:"recipient"`
+	Line1      string    `json:"line1"`
+	Line2      string    `json:"line2,omitempty"`
+	City       string    `json:"city"`
+	Region     string    `json:"region,omitempty"`
+	PostalCode string    `json:"postal_code,omitempty"`
+	Country    string    `json:"country"`
+	Phone      string    `json:"phone,omitempty"`
+	IsDefault  bool      `json:"is_default"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type Store interface {
+	// List returns the user's addresses, the default first.
+	List(ctx context.Context, userID int) ([]Address, error)
+	Get(ctx context.Context, userID, id int) (*Address, error)
+	// Default returns the user's default address, or ErrNotFound if they
+	// have none.
+	Default(ctx context.Context, userID int) (*Address, error)
+	// Create adds a to the user's book. The first address becomes the
+	// default, and a.IsDefault moves the default to it.
+	Create(ctx context.Context, a *Address) error
+	// Update replaces a's fields. a.IsDefault moves the default to it;
+	// clearing it on the default address has no effect.
+	Update(ctx context.Context, a *Address) error
+	// Delete removes the address. Deleting the default makes the oldest
+	// remaining address the default.
+	Delete(ctx context.Context, userID, id int) error
+}
+
+type PostgresStore struct {
+	db     *sql.DB
+	cipher *pii.Cipher
+}
+
+// NewPostgresStore encrypts everything but an address's label and country
+// with cipher.
+func NewPostgresStore(db *sql.DB, cipher *pii.Cipher) *PostgresStore {
+	return &PostgresStore{db: db, cipher: cipher}
+}
+
+type field struct {
+	column pii.Column
+	value  *string
+}
+
+func encrypted(a *Address) []field {
+	return []field{
+		{pii.AddressRecipient, &a.Recipient},
+		{pii.AddressLine1, &a.Line1},
+		{pii.AddressLine2, &a.Line2},
+		{pii.AddressCity, &a.City},
+		{pii.AddressRegion, &a.Region},
+		{pii.AddressPostalCode, &a.PostalCode},
+		{pii.AddressPhone, &a.Phone},
+	}
+}
+
+// seal returns a copy of a with its encrypted fields sealed.
+func (s *PostgresStore) seal(ctx context.Context, a *Address) (*Address, error) {
+	sealed := *a
+	for _, f := range encrypted(&sealed) {
+		v, err := s.cipher.Encrypt(ctx, f.column, *f.value)
+		if err != nil {
+			return nil, err
+		}
+		*f.value = v
+	}
+	return &sealed, nil
+}
+
+// open decrypts the addresses in place, auditing the read.
+func (s *PostgresStore) open(ctx context.Context, addresses ...*Address) error {
+	r := s.cipher.Reader(ctx)
+	for _, a := range addresses {
+		for _, f := range encrypted(a) {
+			r.Open(a.UserID, f.column, f.value)
+		}
+	}
+	return r.Close()
+}
+
+const addressColumns = `a.id, a.user_id, COALESCE(a.label, ''), a.recipient, a.line1, COALESCE(a.line2, ''), a.city,
+	COALESCE(a.region, ''), COALESCE(a.postal_code, ''), a.country, COALESCE(a.phone, ''), a.is_default, a.created_at, a.updated_at`
+
+// inTenant restricts a join on user_service.users u to the request's tenant.
+const inTenant = "u.id = a.user_id AND u.tenant_id = $2"
+
+func scanAddress(row interface{ Scan(...any) error }) (*Address, error) {
+	var a Address
+	if err := row.Scan(&a.ID, &a.UserID, &a.Label, &a.Recipient, &a.Line1, &a.Line2, &a.City,
+		&a.Region, &a.PostalCode, &a.Country, &a.Phone, &a.IsDefault, &a.CreatedAt, &a.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *PostgresStore) List(ctx context.Context, userID int) ([]Address, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + addressColumns + ` FROM user_service.addresses a
+		JOIN user_service.users u ON ` + inTenant + `
+		WHERE a.user_id = $1 ORDER BY a.is_default DESC, a.created_at, a.id`
+	rows, err := s.db.QueryContext(ctx, query, userID, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []Address{}
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	opened := make([]*Address, len(addresses))
+	for i := range addresses {
+		opened[i] = &addresses[i]
+	}
+	return addresses, s.open(ctx, opened...)
+}
+
+func (s *PostgresStore) Get(ctx context.Context, userID, id int) (*Address, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + addressColumns + ` FROM user_service.addresses a
+		JOIN user_service.users u ON ` + inTenant + `
+		WHERE a.user_id = $1 AND a.id = $3`
+	a, err := scanAddress(s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, s.open(ctx, a)
+}
+
+func (s *PostgresStore) Default(ctx context.Context, userID int) (*Address, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + addressColumns + ` FROM user_service.addresses a
+		JOIN user_service.users u ON ` + inTenant + `
+		WHERE a.user_id = $1 AND a.is_default`
+	a, err := scanAddress(s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, s.open(ctx, a)
+}
+
+// lockUser serializes address book changes per user, so the default and the
+// limit are checked against a stable book.
+func lockUser(ctx context.Context, tx *sql.Tx, userID int) error {
+	const query string = `SELECT id FROM user_service.users
+		WHERE id = $1 AND tenant_id = $2 AND status <> 'deleted' FOR UPDATE`
+	var id int
+	err := tx.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func clearDefault(ctx context.Context, tx *sql.Tx, userID int) error {
+	const query string = "UPDATE user_service.addresses SET is_default = FALSE WHERE user_id = $1 AND is_default"
+	_, err := tx.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (s *PostgresStore) Create(ctx context.Context, a *Address) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// A retried transaction starts over from the default the caller asked for.
+	isDefault := a.IsDefault
+	return trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		a.IsDefault = isDefault
+		if err := lockUser(ctx, tx, a.UserID); err != nil {
+			return err
+		}
+		const count string = "SELECT COUNT(*) FROM user_service.addresses WHERE user_id = $1"
+		var n int
+		if err := tx.QueryRowContext(ctx, count, a.UserID).Scan(&n); err != nil {
+			return err
+		}
+		if n >= MaxAddresses {
+			return ErrLimitReached
+		}
+		if n == 0 {
+			a.IsDefault = true
+		} else if a.IsDefault {
+			if err := clearDefault(ctx, tx, a.UserID); err != nil {
+				return err
+			}
+		}
+
+		const insert string = `INSERT INTO user_service.addresses
+				(user_id, label, recipient, line1, line2, city, region, postal_code, country, phone, is_default)
+			VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), $6, NULLIF($7, ''), NULLIF($8, ''), $9, NULLIF($10, ''), $11)
+			RETURNING id, created_at, updated_at`
+		sealed, err := s.seal(ctx, a)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, insert, a.UserID, a.Label, sealed.Recipient, sealed.Line1, sealed.Line2, sealed.City,
+			sealed.Region, sealed.PostalCode, a.Country, sealed.Phone, a.IsDefault).Scan(&a.ID, &a.CreatedAt, &a.UpdatedAt)
+	})
+}
+
+func (s *PostgresStore) Update(ctx context.Context, a *Address) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		if err := lockUser(ctx, tx, a.UserID); err != nil {
+			return err
+		}
+		if a.IsDefault {
+			if err := clearDefault(ctx, tx, a.UserID); err != nil {
+				return err
+			}
+		}
+
+		const update string = `UPDATE user_service.addresses
+			SET label = NULLIF($3, ''), recipient = $4, line1 = $5, line2 = NULLIF($6, ''), city = $7,
+				region = NULLIF($8, ''), postal_code = NULLIF($9, ''), country = $10, phone = NULLIF($11, ''),
+				is_default = is_default OR $12, updated_at = NOW()
+			WHERE id = $1 AND user_id = $2
+			RETURNING is_default, created_at, updated_at`
+		sealed, err := s.seal(ctx, a)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, update, a.ID, a.UserID, a.Label, sealed.Recipient, sealed.Line1, sealed.Line2, sealed.City,
+			sealed.Region, sealed.PostalCode, a.Country, sealed.Phone, a.IsDefault).Scan(&a.IsDefault, &a.CreatedAt, &a.UpdatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	})
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, userID, id int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		if err := lockUser(ctx, tx, userID); err != nil {
+			return err
+		}
+		const remove string = "DELETE FROM user_service.addresses WHERE id = $1 AND user_id = $2 RETURNING is_default"
+		var wasDefault bool
+		err := tx.QueryRowContext(ctx, remove, id, userID).Scan(&wasDefault)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if wasDefault {
+			const promote string = `UPDATE user_service.addresses SET is_default = TRUE, updated_at = NOW()
+				WHERE id = (SELECT id FROM user_service.addresses WHERE user_id = $1 ORDER BY created_at, id LIMIT 1)`
+			if _, err := tx.ExecContext(ctx, promote, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -1,24 +0,0 @@
-package database
-
-import (
-	"os"
-	"testing"
-)
-
-func TestConnect(t *testing.T) {
-	os.Setenv("POSTGRES_HOST", "localhost")
-	os.Setenv("POSTGRES_PORT", "5432")
-	os.Setenv("POSTGRES_USER", "postgres")
-	os.Setenv("POSTGRES_PASSWORD", "postgres")
-	os.Setenv("POSTGRES_DB", "microservice_db")
-
-	db, err := Connect()
-	if err != nil {
-		t.Fatalf("Failed to connect to database: %v", err)
-	}
-	defer db.Close()
-
-	if err := db.Ping(); err != nil {
-		t.Fatalf("Failed to ping database: %v", err)
-	}
-}
@@ -0,0 +1,119 @@
+package logins
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Location is where an IP address is, as far as the locator knows.
+// Coordinates are zero when only the country is known.
+type Location struct {
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"-"`
+	Longitude float64 `json:"-"`
+	// Precise is set when the coordinates are known.
+	Precise bool `json:"-"`
+}
+
+// Locator finds where a client IP is, returning false if it cannot.
+type Locator interface {
+	Locate(ip string) (Location, bool)
+}
+
+type network struct {
+	prefix   netip.Prefix
+	location Location
+}
+
+// NetworkLocator looks IPs up in a table of networks, the most specific
+// matching network winning.
+type NetworkLocator struct {
+	networks []network
+}
+
+// LoadLocator reads a CSV of network,country[,latitude,longitude] rows,
+// such as 81.2.69.0/24,GB,51.51,-0.09, in the shape of the common GeoIP
+// exports. Lines starting with # are comments.
+func LoadLocator(path string) (*NetworkLocator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseLocator(f)
+}
+
+func ParseLocator(r io.Reader) (*NetworkLocator, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	l := &NetworkLocator{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != 2 && len(record) != 4 {
+			return nil, fmt.Errorf("line %d: want network,country[,latitude,longitude]", line)
+		}
+		prefix, err := netip.ParsePrefix(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		country := strings.ToUpper(record[1])
+		if len(country) != 2 {
+			return nil, fmt.Errorf("line %d: country must be an ISO 3166-1 alpha-2 code", line)
+		}
+		loc := Location{Country: country}
+		if len(record) == 4 {
+			lat, errLat := strconv.ParseFloat(record[2], 64)
+			lon, errLon := strconv.ParseFloat(record[3], 64)
+			if errLat != nil || errLon != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+				return nil, fmt.Errorf("line %d: invalid coordinates", line)
+			}
+			loc.Latitude, loc.Longitude, loc.Precise = lat, lon, true
+		}
+		l.networks = append(l.networks, network{prefix: prefix.Masked(), location: loc})
+	}
+	// Longest prefixes first, so the first match is the most specific.
+	sort.SliceStable(l.networks, func(i, j int) bool {
+		return l.networks[i].prefix.Bits() > l.networks[j].prefix.Bits()
+	})
+	return l, nil
+}
+
+func (l *NetworkLocator) Locate(ip string) (Location, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Location{}, false
+	}
+	addr = addr.Unmap()
+	for _, n := range l.networks {
+		if n.prefix.Contains(addr) {
+			return n.location, true
+		}
+	}
+	return Location{}, false
+}
+
+// distanceKM is the great-circle distance between two locations.
+func distanceKM(a, b Location) float64 {
+	const earthRadiusKM = 6371
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
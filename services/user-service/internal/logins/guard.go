@@ -0,0 +1,178 @@
+// Package logins keeps each user's sign-in history and scores new sign-ins
+// against it. A sign-in from an impossible distance, a new country or at an
+// unusual hour must be confirmed with a one-time code sent by email, and
+// the user is told about it.
+package logins
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+)
+
+// historySize is how many earlier sign-ins a sign-in is compared with.
+const historySize = 100
+
+// Guard assesses sign-ins for the users handler.
+type Guard struct {
+	store       Store
+	locator     Locator
+	rules       Rules
+	publisher   events.Publisher
+	codeTTL     time.Duration
+	maxAttempts int
+	now         func() time.Time
+}
+
+var _ users.LoginGuard = (*Guard)(nil)
+
+// NewGuard places sign-ins with locator, which may be nil to skip the
+// location rules. Codes last codeTTL and allow maxAttempts guesses.
+// publisher carries the codes and alerts to notification-service.
+func NewGuard(store Store, locator Locator, rules Rules, publisher events.Publisher, codeTTL time.Duration, maxAttempts int) *Guard {
+	return &Guard{store: store, locator: locator, rules: rules, publisher: publisher,
+		codeTTL: codeTTL, maxAttempts: maxAttempts, now: time.Now}
+}
+
+// Assess records the sign-in with its score. One scoring StepUpScore or
+// more is challenged, and one scoring AlertScore or more is reported to the
+// user.
+func (g *Guard) Assess(ctx context.Context, attempt users.LoginAttempt) (*users.StepUp, error) {
+	login := &Login{
+		UserID:    attempt.UserID,
+		ClientIP:  attempt.ClientIP,
+		UserAgent: attempt.UserAgent,
+		Outcome:   OutcomeAllowed,
+		CreatedAt: g.now(),
+	}
+	if g.locator != nil {
+		login.Location, _ = g.locator.Locate(attempt.ClientIP)
+	}
+	history, err := g.store.History(ctx, attempt.UserID, historySize)
+	if err != nil {
+		return nil, err
+	}
+	a := g.rules.Assess(login, history)
+	login.RiskScore, login.Reasons = a.Score, a.Reasons
+	challenged := g.rules.StepUpScore > 0 && a.Score >= g.rules.StepUpScore
+	if challenged {
+		login.Outcome = OutcomeChallenged
+	}
+	if err := g.store.Record(ctx, login); err != nil {
+		return nil, err
+	}
+
+	var stepUp *users.StepUp
+	if challenged {
+		if stepUp, err = g.challenge(ctx, attempt, login); err != nil {
+			return nil, err
+		}
+	}
+	if g.rules.AlertScore > 0 && a.Score >= g.rules.AlertScore {
+		g.alert(ctx, attempt, login)
+	}
+	return stepUp, nil
+}
+
+// challenge sends a code for login. The sign-in cannot go on without it, so
+// failing to publish the code fails the sign-in.
+func (g *Guard) challenge(ctx context.Context, attempt users.LoginAttempt, login *Login) (*users.StepUp, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return nil, err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	c := &Challenge{
+		ID:        hex.EncodeToString(id),
+		UserID:    attempt.UserID,
+		LoginID:   login.ID,
+		CodeHash:  hashCode(code),
+		ExpiresAt: login.CreatedAt.Add(g.codeTTL),
+	}
+	if err := g.store.CreateChallenge(ctx, c); err != nil {
+		return nil, err
+	}
+
+	e, err := events.New(events.UserLoginChallenged, "user-service", events.LoginChallenge{
+		UserID:    attempt.UserID,
+		Tenant:    tenant.FromContext(ctx),
+		Email:     attempt.Email,
+		Code:      code,
+		ExpiresAt: c.ExpiresAt,
+		ClientIP:  attempt.ClientIP,
+		Country:   login.Country,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := g.publisher.Publish(ctx, e); err != nil {
+		return nil, fmt.Errorf("send login code: %w", err)
+	}
+	return &users.StepUp{ChallengeID: c.ID, ExpiresAt: c.ExpiresAt, Reasons: login.Reasons}, nil
+}
+
+// alert tells the user about an unusual sign-in. Signing in does not depend
+// on it, so a failure is only logged.
+func (g *Guard) alert(ctx context.Context, attempt users.LoginAttempt, login *Login) {
+	e, err := events.New(events.UserLoginAnomaly, "user-service", events.LoginAnomaly{
+		UserID:     attempt.UserID,
+		Tenant:     tenant.FromContext(ctx),
+		Email:      attempt.Email,
+		ClientIP:   attempt.ClientIP,
+		UserAgent:  attempt.UserAgent,
+		Country:    login.Country,
+		Score:      login.RiskScore,
+		Reasons:    login.Reasons,
+		Challenged: login.Outcome == OutcomeChallenged,
+	})
+	if err == nil {
+		err = g.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish login anomaly for user %d: %v", attempt.UserID, err)
+	}
+}
+
+// Verify counts every guess against the challenge, right or wrong, so a
+// code cannot be guessed in more than maxAttempts tries.
+func (g *Guard) Verify(ctx context.Context, challengeID, code string) (int, error) {
+	c, err := g.store.AttemptChallenge(ctx, challengeID, g.maxAttempts)
+	if errors.Is(err, ErrNotFound) {
+		return 0, users.ErrInvalidChallenge
+	}
+	if err != nil {
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashCode(code)), []byte(c.CodeHash)) != 1 {
+		return 0, users.ErrInvalidChallenge
+	}
+	if err := g.store.CompleteChallenge(ctx, c); errors.Is(err, ErrNotFound) {
+		return 0, users.ErrInvalidChallenge
+	} else if err != nil {
+		return 0, err
+	}
+	return c.UserID, nil
+}
+
+// hashCode hashes a code for storage. Six digits are easy to brute-force
+// offline, so the hash only keeps codes out of plain sight; the expiry and
+// guess limit are what protect them.
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,51 @@
+package logins
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+)
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Users see their own sign-ins; admins and services may read anyone's.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/logins", h.list)
+}
+
+// list returns the user's recent sign-ins with their risk, newest first.
+func (h *Handler) list(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if limit <= 0 || limit > maxLimit {
+		limit = defaultLimit
+	}
+	logins, err := h.store.List(c.Request.Context(), id, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"logins": logins})
+}
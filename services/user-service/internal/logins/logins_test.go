@@ -0,0 +1,256 @@
+package logins
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	logins     []Login
+	challenges map[string]*memChallenge
+}
+
+type memChallenge struct {
+	Challenge
+	attempts int
+	used     bool
+}
+
+func newStore() *memStore {
+	return &memStore{challenges: map[string]*memChallenge{}}
+}
+
+func (s *memStore) History(ctx context.Context, userID, limit int) ([]Login, error) {
+	out := []Login{}
+	for _, l := range s.logins {
+		if l.UserID == userID && l.Outcome != OutcomeChallenged {
+			out = append([]Login{l}, out...)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) List(ctx context.Context, userID, limit int) ([]Login, error) {
+	out := []Login{}
+	for _, l := range s.logins {
+		if l.UserID == userID {
+			out = append([]Login{l}, out...)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) Record(ctx context.Context, l *Login) error {
+	l.ID = int64(len(s.logins) + 1)
+	s.logins = append(s.logins, *l)
+	return nil
+}
+
+func (s *memStore) CreateChallenge(ctx context.Context, c *Challenge) error {
+	s.challenges[c.ID] = &memChallenge{Challenge: *c}
+	return nil
+}
+
+func (s *memStore) AttemptChallenge(ctx context.Context, id string, maxAttempts int) (*Challenge, error) {
+	c, ok := s.challenges[id]
+	if !ok || c.used || c.attempts >= maxAttempts || !c.ExpiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	c.attempts++
+	challenge := c.Challenge
+	return &challenge, nil
+}
+
+func (s *memStore) CompleteChallenge(ctx context.Context, c *Challenge) error {
+	stored := s.challenges[c.ID]
+	if stored.used {
+		return ErrNotFound
+	}
+	stored.used = true
+	s.logins[c.LoginID-1].Outcome = OutcomeVerified
+	return nil
+}
+
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.events = append(p.events, e)
+	return nil
+}
+
+const geo = `# network,country,latitude,longitude
+81.2.69.0/24,GB,51.51,-0.09
+81.2.0.0/16,GB
+200.160.0.0/16,BR,-23.55,-46.63
+2001:db8::/32,NZ,-36.85,174.76
+`
+
+func TestLocator(t *testing.T) {
+	locator, err := ParseLocator(strings.NewReader(geo))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if loc, ok := locator.Locate("81.2.69.142"); !ok || loc.Country != "GB" || !loc.Precise {
+		t.Errorf("Expected the most specific network to win, got: %+v, %v", loc, ok)
+	}
+	if loc, ok := locator.Locate("81.2.1.1"); !ok || loc.Country != "GB" || loc.Precise {
+		t.Errorf("Expected the country without coordinates, got: %+v, %v", loc, ok)
+	}
+	if loc, ok := locator.Locate("::ffff:200.160.1.1"); !ok || loc.Country != "BR" {
+		t.Errorf("Expected an IPv4-mapped address to be located, got: %+v, %v", loc, ok)
+	}
+	if _, ok := locator.Locate("10.0.0.1"); ok {
+		t.Error("Expected an unknown address not to be located")
+	}
+	for _, bad := range []string{"81.2.69.0/24,GBR\n", "not-a-network,GB\n", "81.2.69.0/24,GB,91,0\n", "81.2.69.0/24,GB,51\n"} {
+		if _, err := ParseLocator(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	london := Location{Country: "GB", Latitude: 51.51, Longitude: -0.09, Precise: true}
+	saoPaulo := Location{Country: "BR", Latitude: -23.55, Longitude: -46.63, Precise: true}
+	base := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	history := []Login{{Location: london, CreatedAt: base}}
+	rules := DefaultRules()
+
+	a := rules.Assess(&Login{Location: saoPaulo, CreatedAt: base.Add(2 * time.Hour)}, history)
+	if a.Score != 90 || strings.Join(a.Reasons, ",") != "impossible_travel,new_country" {
+		t.Errorf("Expected impossible travel to a new country, got: %+v", a)
+	}
+	if a := rules.Assess(&Login{Location: saoPaulo, CreatedAt: base.Add(24 * time.Hour)}, history); strings.Join(a.Reasons, ",") != "new_country" {
+		t.Errorf("Expected a day to be long enough for the flight, got: %+v", a)
+	}
+	if a := rules.Assess(&Login{Location: london, CreatedAt: base.Add(time.Minute)}, history); a.Score != 0 {
+		t.Errorf("Expected a sign-in from the usual place to be safe, got: %+v", a)
+	}
+	if a := rules.Assess(&Login{Location: saoPaulo, CreatedAt: base}, nil); a.Score != 0 {
+		t.Errorf("Expected a first sign-in to be safe, got: %+v", a)
+	}
+
+	daily := []Login{}
+	for i := 0; i < rules.UnusualHourMinLogins; i++ {
+		daily = append(daily, Login{CreatedAt: base.AddDate(0, 0, -i)})
+	}
+	if a := rules.Assess(&Login{CreatedAt: base.Add(50 * time.Minute)}, daily); a.Score != 0 {
+		t.Errorf("Expected a sign-in near the usual hour to be safe, got: %+v", a)
+	}
+	if a := rules.Assess(&Login{CreatedAt: base.Add(15 * time.Hour)}, daily); strings.Join(a.Reasons, ",") != "unusual_hour" || a.Score != 20 {
+		t.Errorf("Expected a sign-in at midnight to be unusual, got: %+v", a)
+	}
+	if a := rules.Assess(&Login{CreatedAt: base.Add(15 * time.Hour)}, daily[:3]); a.Score != 0 {
+		t.Errorf("Expected too short a history to say nothing about hours, got: %+v", a)
+	}
+
+	rules.NewCountry = 0
+	if a := rules.Assess(&Login{Location: saoPaulo, CreatedAt: base.Add(24 * time.Hour)}, history); a.Score != 0 {
+		t.Errorf("Expected a rule with no score to be off, got: %+v", a)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	locator, _ := ParseLocator(strings.NewReader(geo))
+	store := newStore()
+	publisher := &recordingPublisher{}
+	guard := NewGuard(store, locator, DefaultRules(), publisher, 10*time.Minute, 3)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+	ctx := context.Background()
+	attempt := users.LoginAttempt{UserID: 1, Email: "john@example.com", ClientIP: "81.2.69.142"}
+
+	if stepUp, err := guard.Assess(ctx, attempt); err != nil || stepUp != nil {
+		t.Fatalf("Expected the first sign-in to go straight through, got: %+v, %v", stepUp, err)
+	}
+	now = now.Add(time.Hour)
+	attempt.ClientIP = "200.160.1.1"
+	stepUp, err := guard.Assess(ctx, attempt)
+	if err != nil || stepUp == nil || !stepUp.ExpiresAt.Equal(now.Add(10*time.Minute)) {
+		t.Fatalf("Expected a sign-in from Brazil an hour later to be challenged, got: %+v, %v", stepUp, err)
+	}
+	if l := store.logins[1]; l.Outcome != OutcomeChallenged || l.RiskScore != 90 || l.Country != "BR" {
+		t.Errorf("Expected the challenge to be recorded with its risk, got: %+v", l)
+	}
+
+	if len(publisher.events) != 2 || publisher.events[0].Type != events.UserLoginChallenged || publisher.events[1].Type != events.UserLoginAnomaly {
+		t.Fatalf("Expected a code and an alert to be published, got: %+v", publisher.events)
+	}
+	var challenge events.LoginChallenge
+	publisher.events[0].Decode(&challenge)
+	var anomaly events.LoginAnomaly
+	publisher.events[1].Decode(&anomaly)
+	if len(challenge.Code) != 6 || challenge.Email != "john@example.com" || !anomaly.Challenged || anomaly.Country != "BR" {
+		t.Errorf("Expected the code and the alert for john, got: %+v, %+v", challenge, anomaly)
+	}
+
+	if _, err := guard.Verify(ctx, stepUp.ChallengeID, "not-it"); !errors.Is(err, users.ErrInvalidChallenge) {
+		t.Errorf("Expected a wrong code to be rejected, got: %v", err)
+	}
+	if userID, err := guard.Verify(ctx, stepUp.ChallengeID, challenge.Code); err != nil || userID != 1 {
+		t.Fatalf("Expected the code to confirm the sign-in, got: %d, %v", userID, err)
+	}
+	if _, err := guard.Verify(ctx, stepUp.ChallengeID, challenge.Code); !errors.Is(err, users.ErrInvalidChallenge) {
+		t.Errorf("Expected a used code to be rejected, got: %v", err)
+	}
+	if store.logins[1].Outcome != OutcomeVerified {
+		t.Errorf("Expected the sign-in to be verified, got: %+v", store.logins[1])
+	}
+
+	// Brazil is now one of john's places, so signing in from there again
+	// is fine.
+	now = now.Add(time.Hour)
+	if stepUp, err := guard.Assess(ctx, attempt); err != nil || stepUp != nil {
+		t.Errorf("Expected a verified location to be trusted, got: %+v, %v", stepUp, err)
+	}
+}
+
+func TestGuardLimitsGuesses(t *testing.T) {
+	store := newStore()
+	guard := NewGuard(store, nil, DefaultRules(), &recordingPublisher{}, 10*time.Minute, 2)
+	store.logins = []Login{{ID: 1, UserID: 1, Outcome: OutcomeChallenged}}
+	store.CreateChallenge(context.Background(), &Challenge{ID: "c", UserID: 1, LoginID: 1, CodeHash: hashCode("123456"), ExpiresAt: time.Now().Add(time.Minute)})
+
+	for _, code := range []string{"000000", "111111", "123456"} {
+		if _, err := guard.Verify(context.Background(), "c", code); !errors.Is(err, users.ErrInvalidChallenge) {
+			t.Errorf("Expected %s to be rejected, got: %v", code, err)
+		}
+	}
+	store.challenges["c"].attempts = 0
+	store.challenges["c"].ExpiresAt = time.Now().Add(-time.Second)
+	if _, err := guard.Verify(context.Background(), "c", "123456"); !errors.Is(err, users.ErrInvalidChallenge) {
+		t.Errorf("Expected an expired code to be rejected, got: %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newStore()
+	store.Record(context.Background(), &Login{UserID: 1, ClientIP: "81.2.69.142", Reasons: []string{}, Outcome: OutcomeAllowed})
+	do := func(p *auth.Principal, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	if w := do(&auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}, "/users/1/logins"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"client_ip":"81.2.69.142"`) {
+		t.Errorf("Expected the user's own sign-ins, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(&auth.Principal{UserID: 2, Roles: []string{auth.RoleCustomer}}, "/users/1/logins"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's sign-ins to be forbidden, got: %d", w.Code)
+	}
+}
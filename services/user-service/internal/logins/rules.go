@@ -0,0 +1,120 @@
+package logins
+
+import (
+	"math"
+	"time"
+)
+
+// Reasons a sign-in is risky, one per rule.
+const (
+	ReasonImpossibleTravel = "impossible_travel"
+	ReasonNewCountry       = "new_country"
+	ReasonUnusualHour      = "unusual_hour"
+)
+
+// minTravelKM is the shortest distance impossible travel is checked over.
+// Nearby addresses are often placed tens of kilometres apart, and a
+// short hop can look impossibly fast between two sign-ins a minute apart.
+const minTravelKM = 200
+
+// Rules score a sign-in against the user's earlier ones. Each rule adds its
+// score when it trips, and a rule with a score of 0 is off.
+type Rules struct {
+	// StepUpScore is the score at which a sign-in must be confirmed with a
+	// one-time code, and AlertScore the score at which the user is told
+	// about it.
+	StepUpScore int
+	AlertScore  int
+	// ImpossibleTravel trips when getting from the last sign-in's location
+	// to this one would mean travelling faster than MaxSpeedKMH.
+	ImpossibleTravel int
+	MaxSpeedKMH      float64
+	// NewCountry trips for a country none of the user's earlier sign-ins
+	// came from.
+	NewCountry int
+	// UnusualHour trips for a sign-in more than an hour, in UTC, from the
+	// time of day of every earlier one. It needs at least
+	// UnusualHourMinLogins earlier sign-ins to know the user's habits.
+	UnusualHour          int
+	UnusualHourMinLogins int
+}
+
+func DefaultRules() Rules {
+	return Rules{
+		StepUpScore:          50,
+		AlertScore:           30,
+		ImpossibleTravel:     60,
+		MaxSpeedKMH:          900,
+		NewCountry:           30,
+		UnusualHour:          20,
+		UnusualHourMinLogins: 10,
+	}
+}
+
+// Assessment is the risk of a sign-in, 0 to 100.
+type Assessment struct {
+	Score   int
+	Reasons []string
+}
+
+// Assess scores login against history, the user's earlier trusted sign-ins,
+// newest first.
+func (r Rules) Assess(login *Login, history []Login) Assessment {
+	a := Assessment{Reasons: []string{}}
+	trip := func(score int, reason string) {
+		if score > 0 {
+			a.Score += score
+			a.Reasons = append(a.Reasons, reason)
+		}
+	}
+
+	if login.Precise {
+		for _, prev := range history {
+			if !prev.Precise {
+				continue
+			}
+			km := distanceKM(prev.Location, login.Location)
+			hours := math.Max(login.CreatedAt.Sub(prev.CreatedAt).Hours(), 1.0/60)
+			if km >= minTravelKM && km/hours > r.MaxSpeedKMH {
+				trip(r.ImpossibleTravel, ReasonImpossibleTravel)
+			}
+			break
+		}
+	}
+
+	if login.Country != "" {
+		seen, known := false, false
+		for _, prev := range history {
+			known = known || prev.Country != ""
+			seen = seen || prev.Country == login.Country
+		}
+		if known && !seen {
+			trip(r.NewCountry, ReasonNewCountry)
+		}
+	}
+
+	if len(history) >= r.UnusualHourMinLogins {
+		usual := false
+		for _, prev := range history {
+			usual = usual || minutesApart(prev.CreatedAt, login.CreatedAt) <= 60
+		}
+		if !usual {
+			trip(r.UnusualHour, ReasonUnusualHour)
+		}
+	}
+
+	if a.Score > 100 {
+		a.Score = 100
+	}
+	return a
+}
+
+// minutesApart is how far apart two times are on a 24-hour clock in UTC.
+func minutesApart(a, b time.Time) int {
+	a, b = a.UTC(), b.UTC()
+	diff := a.Hour()*60 + a.Minute() - b.Hour()*60 - b.Minute()
+	if diff < 0 {
+		diff = -diff
+	}
+	return min(diff, 24*60-diff)
+}
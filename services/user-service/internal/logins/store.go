@@ -0,0 +1,184 @@
+package logins
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Outcomes of a sign-in. A challenged sign-in becomes verified once its code
+// is confirmed; only allowed and verified ones count as the user's own.
+const (
+	OutcomeAllowed    = "allowed"
+	OutcomeChallenged = "challenged"
+	OutcomeVerified   = "verified"
+)
+
+// Login is a sign-in that passed the password check.
+type Login struct {
+	ID        int64  `json:"id"`
+	UserID    int    `json:"user_id"`
+	ClientIP  string `json:"client_ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Location
+	RiskScore int       `json:"risk_score"`
+	Reasons   []string  `json:"reasons"`
+	Outcome   string    `json:"outcome"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Challenge is a one-time code a challenged sign-in must be confirmed with.
+type Challenge struct {
+	ID        string
+	UserID    int
+	LoginID   int64
+	CodeHash  string
+	ExpiresAt time.Time
+}
+
+type Store interface {
+	// History returns up to limit of the user's allowed and verified
+	// sign-ins, newest first.
+	History(ctx context.Context, userID, limit int) ([]Login, error)
+	// List returns up to limit of the user's sign-ins of any outcome,
+	// newest first.
+	List(ctx context.Context, userID, limit int) ([]Login, error)
+	Record(ctx context.Context, l *Login) error
+	CreateChallenge(ctx context.Context, c *Challenge) error
+	// AttemptChallenge counts a guess at the tenant's challenge and returns
+	// it, or ErrNotFound if it has expired, been used or run out of
+	// guesses.
+	AttemptChallenge(ctx context.Context, id string, maxAttempts int) (*Challenge, error)
+	// CompleteChallenge uses up the challenge and marks its sign-in
+	// verified, returning ErrNotFound if it was already used.
+	CompleteChallenge(ctx context.Context, c *Challenge) error
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) History(ctx context.Context, userID, limit int) ([]Login, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + loginColumns + ` FROM user_service.login_history
+		WHERE user_id = $1 AND outcome IN ('allowed', 'verified') ORDER BY created_at DESC LIMIT $2`
+	return s.query(ctx, query, userID, limit)
+}
+
+func (s *PostgresStore) List(ctx context.Context, userID, limit int) ([]Login, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + loginColumns + " FROM user_service.login_history WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2"
+	return s.query(ctx, query, userID, limit)
+}
+
+const loginColumns = "id, user_id, client_ip, COALESCE(user_agent, ''), COALESCE(country, ''), latitude, longitude, risk_score, reasons, outcome, created_at"
+
+func (s *PostgresStore) query(ctx context.Context, query string, args ...any) ([]Login, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logins := []Login{}
+	for rows.Next() {
+		var l Login
+		var lat, lon sql.NullFloat64
+		if err := rows.Scan(&l.ID, &l.UserID, &l.ClientIP, &l.UserAgent, &l.Country, &lat, &lon,
+			&l.RiskScore, pq.Array(&l.Reasons), &l.Outcome, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		if lat.Valid && lon.Valid {
+			l.Latitude, l.Longitude, l.Precise = lat.Float64, lon.Float64, true
+		}
+		if l.Reasons == nil {
+			l.Reasons = []string{}
+		}
+		logins = append(logins, l)
+	}
+	return logins, rows.Err()
+}
+
+func (s *PostgresStore) Record(ctx context.Context, l *Login) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var lat, lon sql.NullFloat64
+	if l.Precise {
+		lat, lon = sql.NullFloat64{Float64: l.Latitude, Valid: true}, sql.NullFloat64{Float64: l.Longitude, Valid: true}
+	}
+	const query string = `INSERT INTO user_service.login_history
+			(user_id, client_ip, user_agent, country, latitude, longitude, risk_score, reasons, outcome, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8, $9, $10)
+		RETURNING id`
+	return s.db.QueryRowContext(ctx, query, l.UserID, l.ClientIP, l.UserAgent, l.Country, lat, lon,
+		l.RiskScore, pq.Array(l.Reasons), l.Outcome, l.CreatedAt).Scan(&l.ID)
+}
+
+func (s *PostgresStore) CreateChallenge(ctx context.Context, c *Challenge) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.login_challenges (id, tenant_id, user_id, login_id, code_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := s.db.ExecContext(ctx, query, c.ID, tenant.FromContext(ctx), c.UserID, c.LoginID, c.CodeHash, c.ExpiresAt)
+	return err
+}
+
+func (s *PostgresStore) AttemptChallenge(ctx context.Context, id string, maxAttempts int) (*Challenge, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE user_service.login_challenges SET attempts = attempts + 1
+		WHERE id = $1 AND tenant_id = $2 AND verified_at IS NULL AND expires_at > NOW() AND attempts < $3
+		RETURNING user_id, login_id, code_hash, expires_at`
+	c := &Challenge{ID: id}
+	err := s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx), maxAttempts).
+		Scan(&c.UserID, &c.LoginID, &c.CodeHash, &c.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return c, err
+}
+
+func (s *PostgresStore) CompleteChallenge(ctx context.Context, c *Challenge) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const complete string = "UPDATE user_service.login_challenges SET verified_at = NOW() WHERE id = $1 AND verified_at IS NULL"
+	res, err := tx.ExecContext(ctx, complete, c.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	const verify string = "UPDATE user_service.login_history SET outcome = 'verified' WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, verify, c.LoginID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,139 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+)
+
+type memStore struct {
+	states map[string]State
+}
+
+func (s *memStore) Save(ctx context.Context, st State) error {
+	s.states[st.Hash] = st
+	return nil
+}
+
+func (s *memStore) Take(ctx context.Context, hash string) (*State, error) {
+	st, ok := s.states[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(s.states, hash)
+	return &st, nil
+}
+
+func (s *memStore) DeleteExpired(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+// fakeProvider accepts code "good" with the PKCE verifier matching the
+// challenge it was sent, and serves a GitHub-style user and email list.
+func fakeProvider(challenge *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			r.ParseForm()
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if r.PostForm.Get("code") != "good" || r.PostForm.Get("client_secret") != "secret" ||
+				base64.RawURLEncoding.EncodeToString(sum[:]) != *challenge {
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"at","token_type":"bearer"}`))
+		case "/user", "/emails":
+			if r.Header.Get("Authorization") != "Bearer at" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Path == "/user" {
+				w.Write([]byte(`{"id":583231,"login":"octocat","email":null}`))
+				return
+			}
+			w.Write([]byte(`[{"email":"old@example.com","primary":false,"verified":true},{"email":"octo@example.com","primary":true,"verified":true}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestConnector(t *testing.T) {
+	var challenge string
+	idp := fakeProvider(&challenge)
+	defer idp.Close()
+
+	store := &memStore{states: map[string]State{}}
+	c := NewConnector(store, []Provider{{
+		Name: "github", ClientID: "client", ClientSecret: "secret",
+		AuthURL: idp.URL + "/authorize", TokenURL: idp.URL + "/token", UserInfoURL: idp.URL + "/user", EmailsURL: idp.URL + "/emails",
+		Scopes: []string{"read:user", "user:email"}, RedirectURL: "https://shop.example/auth/oidc/github/callback",
+	}}, time.Minute)
+	ctx := tenant.NewContext(context.Background(), "acme")
+
+	if _, err := c.AuthURL(ctx, "google"); !errors.Is(err, users.ErrUnknownProvider) {
+		t.Errorf("Expected an unconfigured provider to be unknown, got: %v", err)
+	}
+	raw, err := c.AuthURL(ctx, "github")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	u, _ := url.Parse(raw)
+	q := u.Query()
+	state, challenge := q.Get("state"), q.Get("code_challenge")
+	if !strings.HasPrefix(raw, idp.URL+"/authorize?") || q.Get("client_id") != "client" || q.Get("scope") != "read:user user:email" ||
+		q.Get("code_challenge_method") != "S256" || state == "" || challenge == "" {
+		t.Fatalf("Expected an authorization URL with state and PKCE, got: %s", raw)
+	}
+	if _, ok := store.states[state]; ok {
+		t.Error("Expected the state to be stored hashed")
+	}
+
+	if _, err := c.Identify(ctx, "github", "forged", "good"); !errors.Is(err, users.ErrInvalidLoginState) {
+		t.Errorf("Expected a forged state to be refused, got: %v", err)
+	}
+	identity, err := c.Identify(context.Background(), "github", state, "good")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	want := users.ExternalIdentity{Provider: "github", Subject: "583231", Email: "octo@example.com", EmailVerified: true, Tenant: "acme"}
+	if *identity != want {
+		t.Errorf("Expected %+v, got: %+v", want, *identity)
+	}
+	if _, err := c.Identify(ctx, "github", state, "good"); !errors.Is(err, users.ErrInvalidLoginState) {
+		t.Errorf("Expected a state to be used only once, got: %v", err)
+	}
+
+	raw, _ = c.AuthURL(ctx, "github")
+	u, _ = url.Parse(raw)
+	if _, err := c.Identify(ctx, "github", u.Query().Get("state"), "stolen"); err == nil || errors.Is(err, users.ErrInvalidLoginState) {
+		t.Errorf("Expected a rejected code to fail the exchange, got: %v", err)
+	}
+
+	c.now = func() time.Time { return time.Now().Add(-2 * time.Minute) }
+	raw, _ = c.AuthURL(ctx, "github")
+	c.now = time.Now
+	u, _ = url.Parse(raw)
+	if _, err := c.Identify(ctx, "github", u.Query().Get("state"), "good"); !errors.Is(err, users.ErrInvalidLoginState) {
+		t.Errorf("Expected an expired state to be refused, got: %v", err)
+	}
+}
+
+func TestVerified(t *testing.T) {
+	for raw, want := range map[string]bool{`true`: true, `"true"`: true, `false`: false, `"false"`: false, ``: false, `null`: false} {
+		if got := verified([]byte(raw)); got != want {
+			t.Errorf("verified(%s): expected %t, got: %t", raw, want, got)
+		}
+	}
+}
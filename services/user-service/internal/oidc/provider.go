@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/config"
+)
+
+// Provider is an identity provider's OAuth 2.0 endpoints and this service's
+// client registration with it.
+type Provider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	// UserInfoURL returns the signed-in user's claims: sub, email and
+	// email_verified for OpenID Connect providers, or id and email for
+	// GitHub.
+	UserInfoURL string
+	// EmailsURL, when set, lists the user's addresses and whether each is
+	// verified, for providers whose user info leaves that out.
+	EmailsURL   string
+	Scopes      []string
+	RedirectURL string
+}
+
+// presets fill in the endpoints of well-known providers, so only the client
+// registration has to be configured.
+var presets = map[string]Provider{
+	"google": {
+		AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:    "https://oauth2.googleapis.com/token",
+		UserInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+		Scopes:      []string{"openid", "email", "profile"},
+	},
+	"github": {
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		EmailsURL:   "https://api.github.com/user/emails",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+}
+
+// ProvidersFromEnv reads the providers named in the comma-separated
+// OIDC_PROVIDERS. Each is configured by OIDC_<NAME>_CLIENT_ID and
+// OIDC_<NAME>_CLIENT_SECRET, and for providers without a preset by
+// OIDC_<NAME>_AUTH_URL, _TOKEN_URL and _USERINFO_URL, with _EMAILS_URL and
+// _SCOPES optional. Callbacks are expected at OIDC_REDIRECT_BASE_URL followed
+// by /auth/oidc/<name>/callback.
+func ProvidersFromEnv() ([]Provider, error) {
+	names := config.GetEnv("OIDC_PROVIDERS", "")
+	if names == "" {
+		return nil, nil
+	}
+	base := strings.TrimSuffix(config.GetEnv("OIDC_REDIRECT_BASE_URL", ""), "/")
+	if base == "" {
+		return nil, errors.New("OIDC_REDIRECT_BASE_URL must be set to use OIDC_PROVIDERS")
+	}
+
+	var providers []Provider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		p := presets[name]
+		p.Name = name
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		p.ClientID = config.GetEnv(prefix+"CLIENT_ID", "")
+		p.ClientSecret = config.GetEnv(prefix+"CLIENT_SECRET", "")
+		p.AuthURL = config.GetEnv(prefix+"AUTH_URL", p.AuthURL)
+		p.TokenURL = config.GetEnv(prefix+"TOKEN_URL", p.TokenURL)
+		p.UserInfoURL = config.GetEnv(prefix+"USERINFO_URL", p.UserInfoURL)
+		p.EmailsURL = config.GetEnv(prefix+"EMAILS_URL", p.EmailsURL)
+		if scopes := config.GetEnv(prefix+"SCOPES", ""); scopes != "" {
+			p.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+		p.RedirectURL = base + "/auth/oidc/" + name + "/callback"
+
+		if p.ClientID == "" || p.ClientSecret == "" {
+			return nil, fmt.Errorf("provider %s needs %sCLIENT_ID and %sCLIENT_SECRET", name, prefix, prefix)
+		}
+		if p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+			return nil, fmt.Errorf("provider %s needs %sAUTH_URL, %sTOKEN_URL and %sUSERINFO_URL", name, prefix, prefix, prefix)
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
@@ -0,0 +1,75 @@
+package oidc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+)
+
+var ErrNotFound = errors.New("sign-in state not found")
+
+// State is a sign-in waiting for the provider's callback. Verifier is the
+// PKCE secret the code is exchanged with.
+type State struct {
+	Hash      string
+	Provider  string
+	Tenant    string
+	Verifier  string
+	ExpiresAt time.Time
+}
+
+type Store interface {
+	Save(ctx context.Context, s State) error
+	// Take returns and deletes the state with hash, so it is used once.
+	Take(ctx context.Context, hash string) (*State, error)
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Save(ctx context.Context, st State) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.oidc_states (state_hash, provider, tenant_id, verifier, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`
+	_, err := s.db.ExecContext(ctx, query, st.Hash, st.Provider, st.Tenant, st.Verifier, st.ExpiresAt)
+	return err
+}
+
+func (s *PostgresStore) Take(ctx context.Context, hash string) (*State, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `DELETE FROM user_service.oidc_states WHERE state_hash = $1
+		RETURNING state_hash, provider, tenant_id, verifier, expires_at`
+	var st State
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(&st.Hash, &st.Provider, &st.Tenant, &st.Verifier, &st.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *PostgresStore) DeleteExpired(ctx context.Context) (int64, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM user_service.oidc_states WHERE expires_at <= NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
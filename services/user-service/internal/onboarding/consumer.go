@@ -0,0 +1,112 @@
+package onboarding
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/profile"
+)
+
+const onboardingQueue = "user-service.onboarding"
+
+// Profiles scores a user's profile against what their organization
+// requires.
+type Profiles interface {
+	Completeness(ctx context.Context, userID int) (*profile.Completeness, error)
+}
+
+// Consumer records onboarding progress from the events that complete
+// steps.
+type Consumer struct {
+	store    Store
+	profiles Profiles
+}
+
+func NewConsumer(store Store, profiles Profiles) *Consumer {
+	return &Consumer{store: store, profiles: profiles}
+}
+
+// Run consumes events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	patterns := []string{events.UserEmailVerified, events.UserProfileUpdated, events.OrderPlaced}
+	return subscriber.Subscribe(ctx, onboardingQueue, patterns, c.Handle)
+}
+
+// Handle drops events it cannot decode, since retrying them cannot help,
+// and events for users it does not know. Redelivered events change
+// nothing, as each trigger is recorded once per user.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	var userID int
+	var tenantID, trigger string
+	switch e.Type {
+	case events.UserEmailVerified:
+		var v events.EmailVerification
+		if err := e.Decode(&v); err != nil {
+			log.Printf("Dropping malformed %s event %s: %v", e.Type, e.ID, err)
+			return nil
+		}
+		userID, tenantID, trigger = v.UserID, v.Tenant, TriggerEmailVerified
+	case events.UserProfileUpdated:
+		var u events.ProfileUpdate
+		if err := e.Decode(&u); err != nil {
+			log.Printf("Dropping malformed %s event %s: %v", e.Type, e.ID, err)
+			return nil
+		}
+		userID, tenantID, trigger = u.UserID, u.Tenant, TriggerProfileComplete
+	case events.OrderPlaced:
+		var o events.OrderPlacement
+		if err := e.Decode(&o); err != nil {
+			log.Printf("Dropping malformed %s event %s: %v", e.Type, e.ID, err)
+			return nil
+		}
+		userID, tenantID, trigger = o.UserID, o.Tenant, TriggerFirstOrder
+	default:
+		return nil
+	}
+
+	ctx = withTenant(ctx, tenantID)
+	if trigger == TriggerProfileComplete {
+		// The update only completes the step if nothing required is
+		// still missing.
+		score, err := c.profiles.Completeness(ctx, userID)
+		if errors.Is(err, profile.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !score.Complete {
+			return nil
+		}
+	}
+
+	at := e.OccurredAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	added, err := c.store.Complete(ctx, userID, trigger, at)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("Dropping %s event %s for unknown user %d", e.Type, e.ID, userID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if added {
+		log.Printf("User %d completed onboarding trigger %s", userID, trigger)
+	}
+	return nil
+}
+
+// withTenant scopes ctx to the event's tenant, or leaves it on the default
+// tenant for events published before they carried one.
+func withTenant(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return tenant.NewContext(ctx, id)
+}
@@ -0,0 +1,94 @@
+package onboarding
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	tracker *Tracker
+}
+
+func NewHandler(tracker *Tracker) *Handler {
+	return &Handler{tracker: tracker}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Users see their own checklist; admins define the tenant's steps.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/onboarding", h.checklist)
+	router.GET("/onboarding/steps", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.steps)
+	router.PUT("/onboarding/steps", auth.RequireRole(auth.RoleAdmin), h.setSteps)
+	router.DELETE("/onboarding/steps", auth.RequireRole(auth.RoleAdmin), h.resetSteps)
+}
+
+func (h *Handler) checklist(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+	checklist, err := h.tracker.Checklist(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, checklist)
+}
+
+func (h *Handler) steps(c *gin.Context) {
+	steps, custom, err := h.tracker.Steps(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"steps": steps, "custom": custom, "triggers": Triggers})
+}
+
+type stepsRequest struct {
+	Steps []Step `json:"steps" binding:"required"`
+}
+
+// setSteps replaces the tenant's checklist. Progress is kept by trigger, so
+// users keep the steps they have done under new keys or titles.
+func (h *Handler) setSteps(c *gin.Context) {
+	var req stepsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ValidateSteps(req.Steps); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	if err := h.tracker.store.SetSteps(ctx, req.Steps); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Onboarding checklist of tenant %s set to %d steps", tenant.FromContext(ctx), len(req.Steps))
+	c.JSON(http.StatusOK, gin.H{"steps": req.Steps, "custom": true, "triggers": Triggers})
+}
+
+func (h *Handler) resetSteps(c *gin.Context) {
+	ctx := c.Request.Context()
+	if err := h.tracker.store.SetSteps(ctx, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Onboarding checklist of tenant %s reset to the defaults", tenant.FromContext(ctx))
+	c.JSON(http.StatusOK, gin.H{"steps": DefaultSteps, "custom": false, "triggers": Triggers})
+}
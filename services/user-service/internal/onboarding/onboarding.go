@@ -0,0 +1,122 @@
+// Package onboarding walks new users through a checklist of first steps,
+// such as verifying their email and placing a first order. Each tenant can
+// define its own steps; progress comes from the domain events that show a
+// step was done, and users who stall on a step are nudged once.
+package onboarding
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Triggers are the events that complete a step.
+const (
+	// TriggerEmailVerified is a user.email_verified event for the user.
+	TriggerEmailVerified = "email_verified"
+	// TriggerProfileComplete is a profile update that leaves every field
+	// the user's organization requires filled in.
+	TriggerProfileComplete = "profile_complete"
+	// TriggerFirstOrder is the user's first order.placed event.
+	TriggerFirstOrder = "first_order"
+)
+
+var Triggers = []string{TriggerEmailVerified, TriggerProfileComplete, TriggerFirstOrder}
+
+// MaxSteps bounds a tenant's checklist.
+const MaxSteps = 20
+
+var validKey = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// Step is one item of a checklist. A user is nudged about it once, when
+// NudgeAfterHours have passed since they signed up without it being done;
+// 0 never nudges.
+type Step struct {
+	Key             string `json:"key"`
+	Title           string `json:"title"`
+	Hint            string `json:"hint,omitempty"`
+	Trigger         string `json:"trigger"`
+	NudgeAfterHours int    `json:"nudge_after_hours"`
+}
+
+// DefaultSteps are the checklist of tenants that have not defined their
+// own.
+var DefaultSteps = []Step{
+	{Key: "verify_email", Title: "Verify your email", Hint: "Sign in with a provider that confirms your address.",
+		Trigger: TriggerEmailVerified, NudgeAfterHours: 24},
+	{Key: "complete_profile", Title: "Complete your profile", Hint: "Fill in the details your organization asks for.",
+		Trigger: TriggerProfileComplete, NudgeAfterHours: 72},
+	{Key: "place_first_order", Title: "Place your first order", Hint: "Browse the catalog and check out your first order.",
+		Trigger: TriggerFirstOrder, NudgeAfterHours: 7 * 24},
+}
+
+func knownTrigger(trigger string) bool {
+	for _, t := range Triggers {
+		if t == trigger {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateSteps checks a checklist and trims its text in place.
+func ValidateSteps(steps []Step) error {
+	if len(steps) == 0 || len(steps) > MaxSteps {
+		return fmt.Errorf("a checklist must have 1 to %d steps", MaxSteps)
+	}
+	seen := map[string]bool{}
+	for i := range steps {
+		s := &steps[i]
+		s.Key, s.Title, s.Hint = strings.TrimSpace(s.Key), strings.TrimSpace(s.Title), strings.TrimSpace(s.Hint)
+		switch {
+		case !validKey.MatchString(s.Key):
+			return fmt.Errorf("step key %q must be lowercase letters, digits and underscores, starting with a letter", s.Key)
+		case seen[s.Key]:
+			return fmt.Errorf("step %s is given twice", s.Key)
+		case s.Title == "" || len(s.Title) > 255:
+			return fmt.Errorf("title of step %s must be 1 to 255 characters", s.Key)
+		case len(s.Hint) > 1000:
+			return fmt.Errorf("hint of step %s must be at most 1000 characters", s.Key)
+		case !knownTrigger(s.Trigger):
+			return fmt.Errorf("trigger of step %s must be one of %s", s.Key, strings.Join(Triggers, ", "))
+		case s.NudgeAfterHours < 0 || s.NudgeAfterHours > 90*24:
+			return fmt.Errorf("nudge_after_hours of step %s must be 0 to %d", s.Key, 90*24)
+		}
+		seen[s.Key] = true
+	}
+	return nil
+}
+
+// StepProgress is a step of a user's checklist, with when they did it.
+type StepProgress struct {
+	Step
+	Done        bool       `json:"done"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type Checklist struct {
+	UserID    int            `json:"user_id"`
+	Steps     []StepProgress `json:"steps"`
+	Completed int            `json:"completed"`
+	Total     int            `json:"total"`
+	Complete  bool           `json:"complete"`
+}
+
+// Build lays steps out against the times the user fired each trigger.
+func Build(userID int, steps []Step, done map[string]time.Time) Checklist {
+	c := Checklist{UserID: userID, Steps: make([]StepProgress, 0, len(steps)), Total: len(steps)}
+	for _, s := range steps {
+		p := StepProgress{Step: s}
+		if at, ok := done[s.Trigger]; ok {
+			p.Done, p.CompletedAt = true, &at
+			c.Completed++
+		}
+		c.Steps = append(c.Steps, p)
+	}
+	c.Complete = c.Completed == c.Total
+	return c
+}
@@ -0,0 +1,264 @@
+package onboarding
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/profile"
+	"github.com/gin-gonic/gin"
+)
+
+type user struct {
+	tenant    string
+	email     string
+	createdAt time.Time
+}
+
+type memStore struct {
+	users    map[int]user
+	steps    map[string][]Step
+	progress map[int]map[string]time.Time
+	nudged   map[int]map[string]bool
+}
+
+func newStore(now time.Time) *memStore {
+	return &memStore{
+		users: map[int]user{
+			1: {tenant: tenant.Default, email: "new@example.com", createdAt: now.Add(-30 * time.Hour)},
+			2: {tenant: tenant.Default, email: "old@example.com", createdAt: now.Add(-60 * 24 * time.Hour)},
+			3: {tenant: "acme", email: "ada@acme.example.com", createdAt: now.Add(-2 * time.Hour)},
+		},
+		steps:    map[string][]Step{},
+		progress: map[int]map[string]time.Time{},
+		nudged:   map[int]map[string]bool{},
+	}
+}
+
+func (s *memStore) Steps(ctx context.Context) ([]Step, error) {
+	return s.steps[tenant.FromContext(ctx)], nil
+}
+
+func (s *memStore) SetSteps(ctx context.Context, steps []Step) error {
+	s.steps[tenant.FromContext(ctx)] = steps
+	return nil
+}
+
+func (s *memStore) known(ctx context.Context, userID int) bool {
+	u, ok := s.users[userID]
+	return ok && u.tenant == tenant.FromContext(ctx)
+}
+
+func (s *memStore) Progress(ctx context.Context, userID int) (map[string]time.Time, error) {
+	if !s.known(ctx, userID) {
+		return nil, ErrNotFound
+	}
+	done := map[string]time.Time{}
+	for trigger, at := range s.progress[userID] {
+		done[trigger] = at
+	}
+	return done, nil
+}
+
+func (s *memStore) Complete(ctx context.Context, userID int, trigger string, at time.Time) (bool, error) {
+	if !s.known(ctx, userID) {
+		return false, ErrNotFound
+	}
+	if s.progress[userID] == nil {
+		s.progress[userID] = map[string]time.Time{}
+	}
+	if _, ok := s.progress[userID][trigger]; ok {
+		return false, nil
+	}
+	s.progress[userID][trigger] = at
+	return true, nil
+}
+
+func (s *memStore) Tenants(ctx context.Context, since time.Time) ([]string, error) {
+	seen := map[string]bool{}
+	var tenants []string
+	for _, u := range s.users {
+		if u.createdAt.After(since) && !seen[u.tenant] {
+			seen[u.tenant] = true
+			tenants = append(tenants, u.tenant)
+		}
+	}
+	return tenants, nil
+}
+
+func (s *memStore) Stalled(ctx context.Context, step Step, after, before time.Time, limit int) ([]Stalled, error) {
+	stalled := []Stalled{}
+	for id, u := range s.users {
+		_, done := s.progress[id][step.Trigger]
+		if u.tenant == tenant.FromContext(ctx) && u.createdAt.After(after) && !u.createdAt.After(before) && !done && !s.nudged[id][step.Key] {
+			stalled = append(stalled, Stalled{UserID: id, Email: u.email})
+		}
+	}
+	return stalled, nil
+}
+
+func (s *memStore) MarkNudged(ctx context.Context, userID int, stepKey string, at time.Time) error {
+	if s.nudged[userID] == nil {
+		s.nudged[userID] = map[string]bool{}
+	}
+	s.nudged[userID][stepKey] = true
+	return nil
+}
+
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.events = append(p.events, e)
+	return nil
+}
+
+// completeProfiles reports user 1's profile complete and any other
+// incomplete.
+type completeProfiles struct{}
+
+func (completeProfiles) Completeness(ctx context.Context, userID int) (*profile.Completeness, error) {
+	return &profile.Completeness{UserID: userID, Complete: userID == 1}, nil
+}
+
+func TestValidateSteps(t *testing.T) {
+	valid := Step{Key: "verify_email", Title: "Verify", Trigger: TriggerEmailVerified, NudgeAfterHours: 24}
+	tests := []struct {
+		name  string
+		steps []Step
+	}{
+		{"no steps", nil},
+		{"bad key", []Step{{Key: "Verify-Email", Title: "Verify", Trigger: TriggerEmailVerified}}},
+		{"duplicate key", []Step{valid, valid}},
+		{"no title", []Step{{Key: "verify", Title: " ", Trigger: TriggerEmailVerified}}},
+		{"unknown trigger", []Step{{Key: "verify", Title: "Verify", Trigger: "logged_in"}}},
+		{"negative nudge", []Step{{Key: "verify", Title: "Verify", Trigger: TriggerEmailVerified, NudgeAfterHours: -1}}},
+	}
+	for _, tt := range tests {
+		if err := ValidateSteps(tt.steps); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if err := ValidateSteps(append([]Step{}, DefaultSteps...)); err != nil {
+		t.Errorf("Expected the default steps to be valid, got: %v", err)
+	}
+}
+
+func TestConsumerRecordsProgress(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newStore(now)
+	consumer := NewConsumer(store, completeProfiles{})
+	handle := func(eventType string, payload any) {
+		e, err := events.New(eventType, "test", payload)
+		if err != nil {
+			t.Fatalf("Failed to build event: %v", err)
+		}
+		if err := consumer.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Failed to handle %s: %v", eventType, err)
+		}
+	}
+
+	handle(events.UserEmailVerified, events.EmailVerification{UserID: 1, Tenant: tenant.Default})
+	handle(events.UserProfileUpdated, events.ProfileUpdate{UserID: 1, Tenant: tenant.Default, Fields: []string{"first_name"}})
+	handle(events.UserProfileUpdated, events.ProfileUpdate{UserID: 2, Tenant: tenant.Default, Fields: []string{"first_name"}})
+	handle(events.OrderPlaced, events.OrderPlacement{OrderID: 9, UserID: 3, Tenant: "acme"})
+	// User 3 is not in the default tenant, so this is dropped.
+	handle(events.UserEmailVerified, events.EmailVerification{UserID: 3, Tenant: tenant.Default})
+
+	tracker := NewTracker(store)
+	c, err := tracker.Checklist(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Failed to get checklist: %v", err)
+	}
+	if c.Completed != 2 || c.Total != 3 || c.Complete || !c.Steps[0].Done || c.Steps[2].Done {
+		t.Errorf("Expected email and profile done, got: %+v", c)
+	}
+	if len(store.progress[2]) != 0 {
+		t.Errorf("Expected an incomplete profile not to count, got: %v", store.progress[2])
+	}
+	if _, ok := store.progress[3][TriggerFirstOrder]; !ok || len(store.progress[3]) != 1 {
+		t.Errorf("Expected only user 3's first order, got: %v", store.progress[3])
+	}
+}
+
+func TestSweepNudgesStalledStepsOnce(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newStore(now)
+	store.steps["acme"] = []Step{{Key: "first_order", Title: "Order something", Trigger: TriggerFirstOrder, NudgeAfterHours: 1}}
+	publisher := &recordingPublisher{}
+	nudger := NewNudger(NewTracker(store), publisher, 30*24*time.Hour)
+	nudger.now = func() time.Time { return now }
+
+	// User 1 is 30 hours in and has verified nothing; user 2 signed up
+	// before the window; user 3 is past acme's one hour.
+	sent, err := nudger.Sweep(context.Background())
+	if err != nil || sent != 2 {
+		t.Fatalf("Expected 2 nudges, got: %d, %v", sent, err)
+	}
+	nudges := map[int]events.OnboardingStalled{}
+	for _, e := range publisher.events {
+		var payload events.OnboardingStalled
+		if err := e.Decode(&payload); err != nil || e.Type != events.UserOnboardingStalled {
+			t.Fatalf("Unexpected event %s: %v", e.Type, err)
+		}
+		nudges[payload.UserID] = payload
+	}
+	if n := nudges[1]; n.Step != "verify_email" || n.Total != 3 || n.Tenant != tenant.Default {
+		t.Errorf("Expected user 1 to be nudged to verify their email, got: %+v", n)
+	}
+	if n := nudges[3]; n.Step != "first_order" || n.Total != 1 || n.Tenant != "acme" {
+		t.Errorf("Expected user 3 to be nudged with acme's step, got: %+v", n)
+	}
+
+	if sent, _ := nudger.Sweep(context.Background()); sent != 0 {
+		t.Errorf("Expected each step to be nudged once, got: %d", sent)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newStore(time.Now())
+	admin := &auth.Principal{UserID: 100, Roles: []string{auth.RoleAdmin}}
+	customer := &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+
+	tests := []struct {
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		want      int
+		contains  string
+	}{
+		{principal: customer, method: http.MethodGet, path: "/users/1/onboarding", want: http.StatusOK, contains: `"completed":0,"total":3`},
+		{principal: customer, method: http.MethodGet, path: "/users/2/onboarding", want: http.StatusForbidden},
+		{principal: admin, method: http.MethodGet, path: "/users/3/onboarding", want: http.StatusNotFound},
+		{principal: admin, method: http.MethodGet, path: "/onboarding/steps", want: http.StatusOK, contains: `"custom":false`},
+		{principal: admin, method: http.MethodPut, path: "/onboarding/steps", body: `{"steps": [{"key": "order", "title": "Order", "trigger": "unknown"}]}`,
+			want: http.StatusBadRequest},
+		{principal: customer, method: http.MethodPut, path: "/onboarding/steps", body: `{"steps": [{"key": "order", "title": "Order", "trigger": "first_order"}]}`,
+			want: http.StatusForbidden},
+		{principal: admin, method: http.MethodPut, path: "/onboarding/steps", body: `{"steps": [{"key": "order", "title": " Order ", "trigger": "first_order"}]}`,
+			want: http.StatusOK, contains: `"title":"Order"`},
+		{principal: customer, method: http.MethodGet, path: "/users/1/onboarding", want: http.StatusOK, contains: `"completed":0,"total":1`},
+		{principal: admin, method: http.MethodDelete, path: "/onboarding/steps", want: http.StatusOK, contains: `"custom":false`},
+	}
+	for _, tt := range tests {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, tt.principal) })
+		NewHandler(NewTracker(store)).RegisterRoutes(router)
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected status %d with %s, got: %d %s", tt.method, tt.path, tt.want, tt.contains, w.Code, w.Body)
+		}
+	}
+}
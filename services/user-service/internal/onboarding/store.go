@@ -0,0 +1,202 @@
+package onboarding
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// Stalled is a user due a nudge about a step.
+type Stalled struct {
+	UserID   int
+	Email    string
+	Username string
+}
+
+type Store interface {
+	// Steps returns the request tenant's own checklist, or nil if it has
+	// not defined one.
+	Steps(ctx context.Context) ([]Step, error)
+	// SetSteps replaces the tenant's checklist; nil goes back to the
+	// defaults.
+	SetSteps(ctx context.Context, steps []Step) error
+	// Progress returns when the user fired each trigger, or ErrNotFound if
+	// there is no such user in the tenant.
+	Progress(ctx context.Context, userID int) (map[string]time.Time, error)
+	// Complete records that the user fired trigger at at, keeping the
+	// first time, and reports whether it was new. It returns ErrNotFound if
+	// there is no such user in the tenant.
+	Complete(ctx context.Context, userID int, trigger string, at time.Time) (bool, error)
+	// Tenants returns the tenants with active users who signed up after
+	// since.
+	Tenants(ctx context.Context, since time.Time) ([]string, error)
+	// Stalled returns active users of the tenant who signed up between
+	// after and before without firing step's trigger and have not been
+	// nudged about it.
+	Stalled(ctx context.Context, step Step, after, before time.Time, limit int) ([]Stalled, error)
+	MarkNudged(ctx context.Context, userID int, stepKey string, at time.Time) error
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Steps(ctx context.Context) ([]Step, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT key, title, hint, trigger, nudge_after_hours FROM user_service.onboarding_steps
+		WHERE tenant_id = $1 ORDER BY position`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []Step
+	for rows.Next() {
+		var st Step
+		if err := rows.Scan(&st.Key, &st.Title, &st.Hint, &st.Trigger, &st.NudgeAfterHours); err != nil {
+			return nil, err
+		}
+		steps = append(steps, st)
+	}
+	return steps, rows.Err()
+}
+
+func (s *PostgresStore) SetSteps(ctx context.Context, steps []Step) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return database.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		tenantID := tenant.FromContext(ctx)
+		if _, err := tx.ExecContext(ctx, "DELETE FROM user_service.onboarding_steps WHERE tenant_id = $1", tenantID); err != nil {
+			return err
+		}
+		const insert string = `INSERT INTO user_service.onboarding_steps (tenant_id, position, key, title, hint, trigger, nudge_after_hours)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		for i, st := range steps {
+			if _, err := tx.ExecContext(ctx, insert, tenantID, i, st.Key, st.Title, st.Hint, st.Trigger, st.NudgeAfterHours); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStore) Progress(ctx context.Context, userID int) (map[string]time.Time, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const user string = `SELECT EXISTS (SELECT 1 FROM user_service.users WHERE id = $1 AND tenant_id = $2)`
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, user, userID, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT trigger, completed_at FROM user_service.onboarding_progress WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := map[string]time.Time{}
+	for rows.Next() {
+		var trigger string
+		var at time.Time
+		if err := rows.Scan(&trigger, &at); err != nil {
+			return nil, err
+		}
+		done[trigger] = at
+	}
+	return done, rows.Err()
+}
+
+func (s *PostgresStore) Complete(ctx context.Context, userID int, trigger string, at time.Time) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// The insert only selects a user of the tenant, so an unknown user
+	// inserts nothing, as does a trigger already recorded.
+	const query string = `WITH u AS (SELECT id FROM user_service.users WHERE id = $1 AND tenant_id = $2),
+		ins AS (INSERT INTO user_service.onboarding_progress (user_id, trigger, completed_at)
+			SELECT id, $3, $4 FROM u ON CONFLICT (user_id, trigger) DO NOTHING RETURNING user_id)
+		SELECT EXISTS (SELECT 1 FROM u), EXISTS (SELECT 1 FROM ins)`
+	var exists, inserted bool
+	if err := s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx), trigger, at).Scan(&exists, &inserted); err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, ErrNotFound
+	}
+	return inserted, nil
+}
+
+func (s *PostgresStore) Tenants(ctx context.Context, since time.Time) ([]string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT DISTINCT tenant_id FROM user_service.users
+		WHERE status = 'active' AND created_at > $1 ORDER BY tenant_id`
+	rows, err := s.db.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, id)
+	}
+	return tenants, rows.Err()
+}
+
+func (s *PostgresStore) Stalled(ctx context.Context, step Step, after, before time.Time, limit int) ([]Stalled, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT u.id, u.email, u.username FROM user_service.users u
+		WHERE u.tenant_id = $1 AND u.status = 'active' AND u.created_at > $2 AND u.created_at <= $3
+			AND NOT EXISTS (SELECT 1 FROM user_service.onboarding_progress p WHERE p.user_id = u.id AND p.trigger = $4)
+			AND NOT EXISTS (SELECT 1 FROM user_service.onboarding_nudges n WHERE n.user_id = u.id AND n.step_key = $5)
+		ORDER BY u.created_at, u.id LIMIT $6`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), after, before, step.Trigger, step.Key, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stalled := []Stalled{}
+	for rows.Next() {
+		var u Stalled
+		if err := rows.Scan(&u.UserID, &u.Email, &u.Username); err != nil {
+			return nil, err
+		}
+		stalled = append(stalled, u)
+	}
+	return stalled, rows.Err()
+}
+
+func (s *PostgresStore) MarkNudged(ctx context.Context, userID int, stepKey string, at time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.onboarding_nudges (user_id, step_key, nudged_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, step_key) DO NOTHING`
+	_, err := s.db.ExecContext(ctx, query, userID, stepKey, at)
+	return err
+}
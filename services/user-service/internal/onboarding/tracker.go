@@ -0,0 +1,149 @@
+package onboarding
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+// Tracker lays out users' checklists from their tenant's steps, falling
+// back to DefaultSteps for tenants without their own.
+type Tracker struct {
+	store Store
+}
+
+func NewTracker(store Store) *Tracker {
+	return &Tracker{store: store}
+}
+
+// Steps returns the request tenant's checklist and whether it is the
+// tenant's own.
+func (t *Tracker) Steps(ctx context.Context) ([]Step, bool, error) {
+	steps, err := t.store.Steps(ctx)
+	if err != nil || steps == nil {
+		return DefaultSteps, false, err
+	}
+	return steps, true, nil
+}
+
+func (t *Tracker) Checklist(ctx context.Context, userID int) (*Checklist, error) {
+	done, err := t.store.Progress(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	steps, _, err := t.Steps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := Build(userID, steps, done)
+	return &c, nil
+}
+
+// Nudger periodically publishes an OnboardingStalled event for each user
+// who has not done a step in the time it allows, once per user and step.
+// Only users who signed up within the window are nudged, so turning
+// onboarding on does not nudge every existing user.
+type Nudger struct {
+	tracker   *Tracker
+	publisher events.Publisher
+	window    time.Duration
+	batchSize int
+	now       func() time.Time
+}
+
+func NewNudger(tracker *Tracker, publisher events.Publisher, window time.Duration) *Nudger {
+	return &Nudger{tracker: tracker, publisher: publisher, window: window, batchSize: 100, now: time.Now}
+}
+
+// Run sweeps every interval until ctx is cancelled.
+func (n *Nudger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if sent, err := n.Sweep(ctx); err != nil {
+			log.Printf("Onboarding nudge sweep failed: %v", err)
+		} else if sent > 0 {
+			log.Printf("Sent %d onboarding nudges", sent)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep nudges up to one batch of stalled users and returns how many it
+// nudged. A user stalled on several steps is nudged about the first of
+// them, and about the next on a later sweep.
+func (n *Nudger) Sweep(ctx context.Context) (int, error) {
+	now := n.now()
+	after := now.Add(-n.window)
+	tenants, err := n.tracker.store.Tenants(ctx, after)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, id := range tenants {
+		ctx := tenant.NewContext(ctx, id)
+		steps, _, err := n.tracker.Steps(ctx)
+		if err != nil {
+			return sent, err
+		}
+		nudged := map[int]bool{}
+		for _, step := range steps {
+			if step.NudgeAfterHours == 0 {
+				continue
+			}
+			before := now.Add(-time.Duration(step.NudgeAfterHours) * time.Hour)
+			stalled, err := n.tracker.store.Stalled(ctx, step, after, before, n.batchSize-sent)
+			if err != nil {
+				return sent, err
+			}
+			for _, u := range stalled {
+				if nudged[u.UserID] {
+					continue
+				}
+				if err := n.nudge(ctx, id, steps, step, u); err != nil {
+					return sent, err
+				}
+				if err := n.tracker.store.MarkNudged(ctx, u.UserID, step.Key, now); err != nil {
+					return sent, err
+				}
+				nudged[u.UserID] = true
+				sent++
+			}
+			if sent >= n.batchSize {
+				return sent, nil
+			}
+		}
+	}
+	return sent, nil
+}
+
+func (n *Nudger) nudge(ctx context.Context, tenantID string, steps []Step, step Step, u Stalled) error {
+	done, err := n.tracker.store.Progress(ctx, u.UserID)
+	if err != nil {
+		return err
+	}
+	c := Build(u.UserID, steps, done)
+	e, err := events.New(events.UserOnboardingStalled, "user-service", events.OnboardingStalled{
+		UserID:    u.UserID,
+		Tenant:    tenantID,
+		Email:     u.Email,
+		Username:  u.Username,
+		Step:      step.Key,
+		Title:     step.Title,
+		Hint:      step.Hint,
+		Completed: c.Completed,
+		Total:     c.Total,
+	})
+	if err != nil {
+		return err
+	}
+	return n.publisher.Publish(ctx, e)
+}
@@ -0,0 +1,88 @@
+package pii
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAccessLimit = 100
+	maxAccessLimit     = 1000
+)
+
+type Handler struct {
+	cipher      *Cipher
+	reencrypter *Reencrypter
+}
+
+func NewHandler(cipher *Cipher, reencrypter *Reencrypter) *Handler {
+	return &Handler{cipher: cipher, reencrypter: reencrypter}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes. Only
+// admins can see who read a user's data.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/pii-access", auth.RequireRole(auth.RoleAdmin), h.accesses)
+}
+
+// RegisterAdminRoutes mounts key management on an admin-token-protected
+// group. Data keys are shared by every tenant.
+func (h *Handler) RegisterAdminRoutes(admin gin.IRouter) {
+	admin.GET("/pii/keys", h.keys)
+	admin.POST("/pii/keys/rotate", h.rotate)
+	admin.POST("/pii/reencrypt", h.reencrypt)
+}
+
+func (h *Handler) accesses(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	limit := defaultAccessLimit
+	if s := c.Query("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxAccessLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+	}
+	accesses, err := h.cipher.store.Accesses(c.Request.Context(), userID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"accesses": accesses})
+}
+
+func (h *Handler) keys(c *gin.Context) {
+	keys, err := h.cipher.Keys(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys, "primary_master_key_id": h.cipher.provider.Primary()})
+}
+
+func (h *Handler) rotate(c *gin.Context) {
+	k, rewrapped, err := h.cipher.Rotate(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "rewrapped": rewrapped})
+		return
+	}
+	log.Printf("Rotated PII data key to %d under master key %s, rewrapped %d, from %s", k.ID, k.MasterKeyID, rewrapped, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"key": k, "rewrapped": rewrapped})
+}
+
+func (h *Handler) reencrypt(c *gin.Context) {
+	n, err := h.reencrypter.Reencrypt(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "reencrypted": n})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reencrypted": n})
+}
@@ -0,0 +1,395 @@
+// Package pii encrypts personal data, such as phone numbers and postal
+// addresses, before user-service stores it, with the envelope encryption of
+// pkg/crypto: values are sealed under a data key, and data keys are stored
+// wrapped by a master key the database never sees. Every decryption is
+// audited.
+package pii
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/crypto"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrUnknownKey is returned for a value sealed under a data key that is
+	// not stored, or that is wrapped by a master key the service no longer
+	// has.
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// prefix marks a sealed value: pii1:<data key id>:<base64 nonce and
+// ciphertext>. Anything else is plaintext written before encryption was
+// turned on, which the re-encryption job seals.
+const prefix = "pii1:"
+
+// Column is an encrypted column. Its qualified name is the additional
+// data of every value in it, so a value copied into another column does not
+// decrypt. Every table listed has an integer id primary key.
+type Column struct {
+	Table string
+	Name  string
+}
+
+func (c Column) String() string {
+	return c.Table + "." + c.Name
+}
+
+var (
+	UserPhone         = Column{"user_service.users", "phone"}
+	AddressRecipient  = Column{"user_service.addresses", "recipient"}
+	AddressLine1      = Column{"user_service.addresses", "line1"}
+	AddressLine2      = Column{"user_service.addresses", "line2"}
+	AddressCity       = Column{"user_service.addresses", "city"}
+	AddressRegion     = Column{"user_service.addresses", "region"}
+	AddressPostalCode = Column{"user_service.addresses", "postal_code"}
+	AddressPhone      = Column{"user_service.addresses", "phone"}
+)
+
+// Columns lists every encrypted column, for the re-encryption job.
+var Columns = []Column{UserPhone, AddressRecipient, AddressLine1, AddressLine2, AddressCity,
+	AddressRegion, AddressPostalCode, AddressPhone}
+
+// DataKey is a data-encryption key as stored: wrapped by a master key.
+type DataKey struct {
+	ID          int       `json:"id"`
+	MasterKeyID string    `json:"master_key_id"`
+	Wrapped     []byte    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	Current     bool      `json:"current"`
+}
+
+// Access is one audited read: Actor saw Fields of UserID's data.
+type Access struct {
+	ID         int64     `json:"id"`
+	Actor      string    `json:"actor"`
+	UserID     int       `json:"user_id"`
+	Fields     []string  `json:"fields"`
+	RequestID  string    `json:"request_id,omitempty"`
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+type Store interface {
+	// DataKeys returns every data key, oldest first.
+	DataKeys(ctx context.Context) ([]DataKey, error)
+	CreateDataKey(ctx context.Context, k *DataKey) error
+	RewrapDataKey(ctx context.Context, k *DataKey) error
+	// RecordAccess audits reads, in the request's tenant.
+	RecordAccess(ctx context.Context, accesses []Access) error
+	// Accesses returns the audited reads of userID's data, newest first.
+	Accesses(ctx context.Context, userID, limit int) ([]Access, error)
+	// Stale returns up to limit rows of column that hold a value not sealed
+	// under the data key with keyPrefix, after afterID, by id.
+	Stale(ctx context.Context, column Column, keyPrefix string, afterID, limit int) ([]Row, error)
+	// Replace sets the row's value to sealed unless it changed since it was
+	// read, and reports whether it did.
+	Replace(ctx context.Context, column Column, row Row, sealed string) (bool, error)
+}
+
+// Row is a stored value of an encrypted column.
+type Row struct {
+	ID    int
+	Value string
+}
+
+// Cipher seals and opens values. It loads the data keys on first use and
+// again whenever it meets a value sealed under a key it has not loaded, so
+// replicas pick up a key another replica created.
+type Cipher struct {
+	store    Store
+	provider crypto.KeyProvider
+
+	mu      sync.Mutex
+	keys    map[int]cipher.AEAD
+	current int
+}
+
+// NewCipher wraps data keys with provider.
+func NewCipher(store Store, provider crypto.KeyProvider) *Cipher {
+	return &Cipher{store: store, provider: provider}
+}
+
+// wrapAD is the additional data of a wrapped data key, so nothing else
+// sealed under a master key can pass for one.
+var wrapAD = []byte("user-service data key")
+
+// load reads every data key, creating the first if there are none. c.mu
+// must be held.
+func (c *Cipher) load(ctx context.Context) error {
+	stored, err := c.store.DataKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		k, err := c.create(ctx)
+		if err != nil {
+			return err
+		}
+		stored = []DataKey{*k}
+	}
+	keys := make(map[int]cipher.AEAD, len(stored))
+	for _, k := range stored {
+		raw, err := c.provider.Unwrap(ctx, crypto.WrappedKey{MasterKeyID: k.MasterKeyID, Wrapped: k.Wrapped}, wrapAD)
+		if errors.Is(err, crypto.ErrUnknownKey) {
+			// Values under this key fail with ErrUnknownKey; the rest work.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unwrap data key %d: %w", k.ID, err)
+		}
+		aead, err := crypto.NewAEAD(raw)
+		if err != nil {
+			return err
+		}
+		keys[k.ID] = aead
+	}
+	newest := stored[len(stored)-1].ID
+	if _, ok := keys[newest]; !ok {
+		return fmt.Errorf("newest data key %d: %w", newest, ErrUnknownKey)
+	}
+	c.keys, c.current = keys, newest
+	return nil
+}
+
+// create stores a new data key wrapped under the primary master key.
+func (c *Cipher) create(ctx context.Context) (*DataKey, error) {
+	raw, err := crypto.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := c.provider.Wrap(ctx, raw, wrapAD)
+	if err != nil {
+		return nil, err
+	}
+	k := &DataKey{MasterKeyID: wrapped.MasterKeyID, Wrapped: wrapped.Wrapped}
+	if err := c.store.CreateDataKey(ctx, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (c *Cipher) key(ctx context.Context, id int) (cipher.AEAD, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		if err := c.load(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+	if id == 0 {
+		id = c.current
+	}
+	k, ok := c.keys[id]
+	if !ok && id > c.current {
+		if err := c.load(ctx); err != nil {
+			return nil, 0, err
+		}
+		k, ok = c.keys[id]
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("data key %d: %w", id, ErrUnknownKey)
+	}
+	return k, id, nil
+}
+
+// Encrypt seals plaintext for column under the current data key. The empty
+// string stays empty, so NULLIF(..., ”) still stores NULL.
+func (c *Cipher) Encrypt(ctx context.Context, column Column, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	aead, id, err := c.key(ctx, 0)
+	if err != nil {
+		return "", err
+	}
+	sealed := crypto.Seal(aead, []byte(plaintext), []byte(column.String()))
+	return prefix + strconv.Itoa(id) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// keyID returns the data key a value is sealed under, or 0 for plaintext.
+func keyID(value string) (int, string, bool) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return 0, "", false
+	}
+	id, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil || n <= 0 {
+		return 0, "", false
+	}
+	return n, encoded, true
+}
+
+// decrypt opens value without auditing it. Plaintext is returned as is.
+func (c *Cipher) decrypt(ctx context.Context, column Column, value string) (string, error) {
+	id, encoded, ok := keyID(value)
+	if !ok {
+		return value, nil
+	}
+	aead, _, err := c.key(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s: %w", column, err)
+	}
+	plaintext, err := crypto.Open(aead, sealed, []byte(column.String()))
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// Reader opens the values one read returns and audits them together when
+// closed. It is not safe for concurrent use.
+type Reader struct {
+	ctx      context.Context
+	cipher   *Cipher
+	fields   map[int][]string
+	subjects []int
+	err      error
+}
+
+func (c *Cipher) Reader(ctx context.Context) *Reader {
+	return &Reader{ctx: ctx, cipher: c, fields: map[int][]string{}}
+}
+
+// Open decrypts *value, a column of userID's data, in place. Empty values
+// reveal nothing and are not audited. The first error sticks and is
+// returned by Close.
+func (r *Reader) Open(userID int, column Column, value *string) {
+	if r.err != nil || *value == "" {
+		return
+	}
+	plaintext, err := r.cipher.decrypt(r.ctx, column, *value)
+	if err != nil {
+		r.err = err
+		return
+	}
+	*value = plaintext
+	if _, ok := r.fields[userID]; !ok {
+		r.subjects = append(r.subjects, userID)
+	}
+	name := column.String()
+	for _, f := range r.fields[userID] {
+		if f == name {
+			return
+		}
+	}
+	r.fields[userID] = append(r.fields[userID], name)
+}
+
+// Close records one audit entry per user whose data was opened. A read that
+// cannot be audited fails, so nothing is revealed unaudited.
+func (r *Reader) Close() error {
+	if r.err != nil || len(r.subjects) == 0 {
+		return r.err
+	}
+	actor := Actor(r.ctx)
+	requestID := requestid.FromContext(r.ctx)
+	accesses := make([]Access, 0, len(r.subjects))
+	for _, id := range r.subjects {
+		accesses = append(accesses, Access{Actor: actor, UserID: id, Fields: r.fields[id], RequestID: requestID})
+	}
+	return r.cipher.store.RecordAccess(r.ctx, accesses)
+}
+
+// Actor names who is reading: the request's user or service, or "system"
+// for background work.
+func Actor(ctx context.Context) string {
+	p, ok := auth.PrincipalFromContext(ctx)
+	switch {
+	case !ok:
+		return "system"
+	case p.Service != "":
+		return "service:" + p.Service
+	default:
+		return "user:" + strconv.Itoa(p.UserID)
+	}
+}
+
+// Keys returns the data keys, marking the current one, and reloads them.
+func (c *Cipher) Keys(ctx context.Context) ([]DataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	stored, err := c.store.DataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stored {
+		stored[i].Current = stored[i].ID == c.current
+	}
+	return stored, nil
+}
+
+// Rotate creates a new current data key and rewraps every data key wrapped
+// by an older master key, or an older version of it, under the primary one. Values sealed under older
+// data keys keep opening; the re-encryption job moves them to the new key.
+// Rotate returns how many keys it rewrapped.
+func (c *Cipher) Rotate(ctx context.Context) (*DataKey, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(ctx); err != nil {
+		return nil, 0, err
+	}
+	stored, err := c.store.DataKeys(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	rewrapped := 0
+	for _, k := range stored {
+		if _, ok := c.keys[k.ID]; !ok {
+			continue
+		}
+		w, ok, err := c.provider.Rewrap(ctx, crypto.WrappedKey{MasterKeyID: k.MasterKeyID, Wrapped: k.Wrapped}, wrapAD)
+		if err != nil {
+			return nil, rewrapped, err
+		}
+		if !ok {
+			continue
+		}
+		k.MasterKeyID, k.Wrapped = w.MasterKeyID, w.Wrapped
+		if err := c.store.RewrapDataKey(ctx, &k); err != nil {
+			return nil, rewrapped, err
+		}
+		rewrapped++
+	}
+	k, err := c.create(ctx)
+	if err != nil {
+		return nil, rewrapped, err
+	}
+	if err := c.load(ctx); err != nil {
+		return nil, rewrapped, err
+	}
+	k.Current = true
+	return k, rewrapped, nil
+}
+
+// currentPrefix is the prefix of values sealed under the current data key,
+// after reloading the keys.
+func (c *Cipher) currentPrefix(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(ctx); err != nil {
+		return "", err
+	}
+	return prefix + strconv.Itoa(c.current) + ":", nil
+}
@@ -0,0 +1,240 @@
+package pii
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/crypto"
+)
+
+// fakeStore keeps data keys, the audit log and one table of rows in memory.
+type fakeStore struct {
+	Store
+	keys     []DataKey
+	accesses []Access
+	rows     map[Column][]Row
+}
+
+func (f *fakeStore) DataKeys(ctx context.Context) ([]DataKey, error) {
+	return append([]DataKey(nil), f.keys...), nil
+}
+
+func (f *fakeStore) CreateDataKey(ctx context.Context, k *DataKey) error {
+	k.ID = len(f.keys) + 1
+	f.keys = append(f.keys, *k)
+	return nil
+}
+
+func (f *fakeStore) RewrapDataKey(ctx context.Context, k *DataKey) error {
+	f.keys[k.ID-1].MasterKeyID, f.keys[k.ID-1].Wrapped = k.MasterKeyID, k.Wrapped
+	return nil
+}
+
+func (f *fakeStore) RecordAccess(ctx context.Context, accesses []Access) error {
+	f.accesses = append(f.accesses, accesses...)
+	return nil
+}
+
+func (f *fakeStore) Stale(ctx context.Context, column Column, keyPrefix string, afterID, limit int) ([]Row, error) {
+	stale := []Row{}
+	for _, r := range f.rows[column] {
+		if r.ID > afterID && r.Value != "" && !strings.HasPrefix(r.Value, keyPrefix) && len(stale) < limit {
+			stale = append(stale, r)
+		}
+	}
+	return stale, nil
+}
+
+func (f *fakeStore) Replace(ctx context.Context, column Column, row Row, sealed string) (bool, error) {
+	for i, r := range f.rows[column] {
+		if r.ID == row.ID && r.Value == row.Value {
+			f.rows[column][i].Value = sealed
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func masterKey(id string, b byte) crypto.MasterKey {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = b
+	}
+	return crypto.MasterKey{ID: id, Key: key}
+}
+
+func newCipher(t *testing.T, store *fakeStore, keys ...crypto.MasterKey) *Cipher {
+	t.Helper()
+	provider, err := crypto.NewLocalKeys(keys)
+	if err != nil {
+		t.Fatalf("Failed to create keys: %v", err)
+	}
+	return NewCipher(store, provider)
+}
+
+func TestRoundTrip(t *testing.T) {
+	store := &fakeStore{}
+	c := newCipher(t, store, masterKey("k1", 1))
+	ctx := context.Background()
+
+	sealed, err := c.Encrypt(ctx, UserPhone, "+44 20 7946 0000")
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	if !strings.HasPrefix(sealed, "pii1:1:") || strings.Contains(sealed, "7946") {
+		t.Errorf("Expected a sealed value under data key 1, got: %s", sealed)
+	}
+	if empty, _ := c.Encrypt(ctx, UserPhone, ""); empty != "" {
+		t.Errorf("Expected an empty value to stay empty, got: %s", empty)
+	}
+
+	r := c.Reader(ctx)
+	value, legacy := sealed, "+1 555 0100"
+	r.Open(7, UserPhone, &value)
+	r.Open(7, AddressPhone, &legacy)
+	if err := r.Close(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if value != "+44 20 7946 0000" || legacy != "+1 555 0100" {
+		t.Errorf("Expected the sealed and the plaintext value to open, got: %q %q", value, legacy)
+	}
+
+	// A value moved to another column, or tampered with, fails.
+	moved := sealed
+	r = c.Reader(ctx)
+	r.Open(7, AddressPhone, &moved)
+	if err := r.Close(); err == nil {
+		t.Error("Expected a value copied into another column not to open")
+	}
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+	r = c.Reader(ctx)
+	r.Open(7, UserPhone, &tampered)
+	if err := r.Close(); err == nil {
+		t.Error("Expected a tampered value not to open")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	store := &fakeStore{}
+	c := newCipher(t, store, masterKey("k1", 1))
+	ctx := context.Background()
+	phone, _ := c.Encrypt(ctx, UserPhone, "+1 555 0100")
+	city, _ := c.Encrypt(ctx, AddressCity, "Leeds")
+
+	r := c.Reader(ctx)
+	a, b, empty := phone, city, ""
+	r.Open(7, UserPhone, &a)
+	r.Open(7, AddressCity, &b)
+	r.Open(7, AddressCity, &b)
+	r.Open(8, AddressLine2, &empty)
+	if err := r.Close(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if len(store.accesses) != 1 {
+		t.Fatalf("Expected one entry for the one user whose data was revealed, got: %+v", store.accesses)
+	}
+	got := store.accesses[0]
+	if got.Actor != "system" || got.UserID != 7 || strings.Join(got.Fields, ",") != "user_service.users.phone,user_service.addresses.city" {
+		t.Errorf("Expected the fields read by the system, got: %+v", got)
+	}
+
+	if actor := Actor(auth.ContextWithPrincipal(ctx, &auth.Principal{UserID: 3})); actor != "user:3" {
+		t.Errorf("Expected a user actor, got: %s", actor)
+	}
+	if actor := Actor(auth.ContextWithPrincipal(ctx, &auth.Principal{Service: "order-service"})); actor != "service:order-service" {
+		t.Errorf("Expected a service actor, got: %s", actor)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	store := &fakeStore{}
+	ctx := context.Background()
+	old := newCipher(t, store, masterKey("k1", 1))
+	before, _ := old.Encrypt(ctx, UserPhone, "+1 555 0100")
+
+	// A new primary master key is deployed with the old one kept to unwrap.
+	c := newCipher(t, store, masterKey("k2", 2), masterKey("k1", 1))
+	replica := newCipher(t, store, masterKey("k2", 2), masterKey("k1", 1))
+	if _, err := replica.Encrypt(ctx, UserPhone, "x"); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	k, rewrapped, err := c.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+	if k.ID != 2 || k.MasterKeyID != "k2" || rewrapped != 1 {
+		t.Errorf("Expected a new data key and the old one rewrapped, got: %+v %d", k, rewrapped)
+	}
+	after, _ := c.Encrypt(ctx, UserPhone, "+1 555 0199")
+	if !strings.HasPrefix(after, "pii1:2:") {
+		t.Errorf("Expected new values under the new data key, got: %s", after)
+	}
+
+	// The old master key can now be retired.
+	retired := newCipher(t, store, masterKey("k2", 2))
+	r := retired.Reader(ctx)
+	a, b := before, after
+	r.Open(1, UserPhone, &a)
+	r.Open(1, UserPhone, &b)
+	if err := r.Close(); err != nil || a != "+1 555 0100" || b != "+1 555 0199" {
+		t.Errorf("Expected values under both data keys to open, got: %q %q %v", a, b, err)
+	}
+
+	// Another replica still on data key 1 picks up key 2 when it meets it.
+	r = replica.Reader(ctx)
+	b = after
+	r.Open(1, UserPhone, &b)
+	if err := r.Close(); err != nil || b != "+1 555 0199" {
+		t.Errorf("Expected a stale replica to load the new data key, got: %q %v", b, err)
+	}
+
+	unknown := newCipher(t, &fakeStore{keys: store.keys}, masterKey("k3", 3))
+	if _, err := unknown.Encrypt(ctx, UserPhone, "x"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey without the master key, got: %v", err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	store := &fakeStore{}
+	ctx := context.Background()
+	c := newCipher(t, store, masterKey("k1", 1))
+	old, _ := c.Encrypt(ctx, AddressCity, "Leeds")
+	store.rows = map[Column][]Row{
+		AddressCity:  {{ID: 1, Value: old}, {ID: 2, Value: "York"}, {ID: 3, Value: ""}},
+		AddressPhone: {{ID: 1, Value: "pii1:99:bm9wZQ=="}},
+	}
+	if _, _, err := c.Rotate(ctx); err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+
+	n, err := NewReencrypter(c).Reencrypt(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected the old and the plaintext value to be resealed, got: %d %v", n, err)
+	}
+	r := c.Reader(ctx)
+	for i, want := range []string{"Leeds", "York"} {
+		v := store.rows[AddressCity][i].Value
+		if !strings.HasPrefix(v, "pii1:2:") {
+			t.Errorf("Expected row %d under data key 2, got: %s", i+1, v)
+		}
+		r.Open(1, AddressCity, &v)
+		if v != want {
+			t.Errorf("Expected row %d to open to %s, got: %s", i+1, want, v)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if store.rows[AddressPhone][0].Value != "pii1:99:bm9wZQ==" {
+		t.Error("Expected a value that does not open to be left as is")
+	}
+	if n, err := NewReencrypter(c).Reencrypt(ctx); err != nil || n != 0 {
+		t.Errorf("Expected nothing left to reseal, got: %d %v", n, err)
+	}
+}
@@ -0,0 +1,159 @@
+package pii
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) DataKeys(ctx context.Context) ([]DataKey, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT id, master_key_id, wrapped, created_at FROM user_service.data_keys ORDER BY id"
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []DataKey{}
+	for rows.Next() {
+		var k DataKey
+		if err := rows.Scan(&k.ID, &k.MasterKeyID, &k.Wrapped, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgresStore) CreateDataKey(ctx context.Context, k *DataKey) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.data_keys (master_key_id, wrapped) VALUES ($1, $2)
+		RETURNING id, created_at`
+	return s.db.QueryRowContext(ctx, query, k.MasterKeyID, k.Wrapped).Scan(&k.ID, &k.CreatedAt)
+}
+
+func (s *PostgresStore) RewrapDataKey(ctx context.Context, k *DataKey) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "UPDATE user_service.data_keys SET master_key_id = $2, wrapped = $3 WHERE id = $1"
+	res, err := s.db.ExecContext(ctx, query, k.ID, k.MasterKeyID, k.Wrapped)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) RecordAccess(ctx context.Context, accesses []Access) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.pii_access_log (tenant_id, actor, user_id, fields, request_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))`
+	for _, a := range accesses {
+		if _, err := s.db.ExecContext(ctx, query, tenant.FromContext(ctx), a.Actor, a.UserID, pq.Array(a.Fields), a.RequestID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) Accesses(ctx context.Context, userID, limit int) ([]Access, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT id, actor, user_id, fields, COALESCE(request_id, ''), accessed_at
+		FROM user_service.pii_access_log WHERE user_id = $1 AND tenant_id = $2
+		ORDER BY accessed_at DESC, id DESC LIMIT $3`
+	rows, err := s.db.QueryContext(ctx, query, userID, tenant.FromContext(ctx), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accesses := []Access{}
+	for rows.Next() {
+		var a Access
+		if err := rows.Scan(&a.ID, &a.Actor, &a.UserID, pq.Array(&a.Fields), &a.RequestID, &a.AccessedAt); err != nil {
+			return nil, err
+		}
+		accesses = append(accesses, a)
+	}
+	return accesses, rows.Err()
+}
+
+// Stale and Replace build their queries from Columns, never from input.
+
+func (s *PostgresStore) Stale(ctx context.Context, column Column, keyPrefix string, afterID, limit int) ([]Row, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`SELECT id, %[2]s FROM %[1]s
+		WHERE id > $1 AND %[2]s IS NOT NULL AND %[2]s <> '' AND left(%[2]s, length($2)) <> $2
+		ORDER BY id LIMIT $3`, column.Table, column.Name)
+	rows, err := s.db.QueryContext(ctx, query, afterID, keyPrefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stale := []Row{}
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.ID, &r.Value); err != nil {
+			return nil, err
+		}
+		stale = append(stale, r)
+	}
+	return stale, rows.Err()
+}
+
+func (s *PostgresStore) Replace(ctx context.Context, column Column, row Row, sealed string) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// The value is the same under the new key, so the account's change
+	// trail is left alone.
+	if _, err := tx.ExecContext(ctx, "SELECT set_config('app.capture', 'off', true)"); err != nil {
+		return false, err
+	}
+	query := fmt.Sprintf("UPDATE %[1]s SET %[2]s = $3 WHERE id = $1 AND %[2]s = $2", column.Table, column.Name)
+	res, err := tx.ExecContext(ctx, query, row.ID, row.Value, sealed)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
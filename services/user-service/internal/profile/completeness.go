@@ -0,0 +1,29 @@
+package profile
+
+import "github.com/alux444/go-microserv-test/pkg/events"
+
+type Completeness struct {
+	UserID   int                   `json:"user_id"`
+	Percent  int                   `json:"percent"`
+	Complete bool                  `json:"complete"`
+	Required []string              `json:"required"`
+	Missing  []events.MissingField `json:"missing"`
+}
+
+// Compute scores a profile against the required fields. Every required
+// field carries equal weight.
+func Compute(p Profile, required []string) Completeness {
+	c := Completeness{UserID: p.UserID, Required: required, Missing: []events.MissingField{}}
+	for _, name := range required {
+		if p.Values[name] == "" {
+			c.Missing = append(c.Missing, events.MissingField{Field: name, Hint: fields[name].hint})
+		}
+	}
+	if len(required) == 0 {
+		c.Percent = 100
+	} else {
+		c.Percent = (len(required) - len(c.Missing)) * 100 / len(required)
+	}
+	c.Complete = len(c.Missing) == 0
+	return c
+}
@@ -0,0 +1,95 @@
+// Package profile tracks how complete a user's profile is against the fields
+// their organization requires and nudges users to fill in the rest.
+package profile
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+)
+
+type field struct {
+	column string
+	hint   string
+	maxLen int
+	// valid checks a non-empty value; nil accepts any value up to maxLen.
+	valid func(string) bool
+	// encrypted is the column's pii.Column when it is stored encrypted.
+	encrypted *pii.Column
+}
+
+var (
+	validPhone  = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{2,31}$`).MatchString
+	validLocale = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`).MatchString
+)
+
+func validAvatarURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// fields lists every profile field that can be required or edited, keyed by
+// the name used in the API.
+var fields = map[string]field{
+	"first_name": {column: "first_name", hint: "Add your first name so teammates can recognise you", maxLen: 255},
+	"last_name":  {column: "last_name", hint: "Add your last name", maxLen: 255},
+	"phone":      {column: "phone", hint: "Add a phone number for delivery and account recovery", maxLen: 32, valid: validPhone, encrypted: &pii.UserPhone},
+	"avatar_url": {column: "avatar_url", hint: "Upload a profile picture", maxLen: 2048, valid: validAvatarURL},
+	"locale":     {column: "locale", hint: "Choose your preferred language", maxLen: 16, valid: validLocale},
+}
+
+// fieldOrder keeps responses and queries deterministic.
+var fieldOrder = []string{"first_name", "last_name", "phone", "avatar_url", "locale"}
+
+// ParseFields parses a comma-separated field list, rejecting unknown fields.
+func ParseFields(s string) ([]string, error) {
+	var out []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		out = append(out, name)
+	}
+	return out, ValidateFields(out)
+}
+
+func ValidateFields(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("at least one profile field is required")
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("unknown profile field %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate profile field %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// ValidateValues checks profile edits. An empty value clears the field.
+func ValidateValues(values map[string]string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("at least one profile field is required")
+	}
+	for name, value := range values {
+		f, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown profile field %q", name)
+		}
+		if value == "" {
+			continue
+		}
+		if len(value) > f.maxLen || (f.valid != nil && !f.valid(value)) {
+			return fmt.Errorf("invalid %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package profile
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	tracker   *Tracker
+	publisher events.Publisher
+}
+
+// NewHandler announces profile changes on publisher when it is non-nil.
+func NewHandler(tracker *Tracker, publisher events.Publisher) *Handler {
+	return &Handler{tracker: tracker, publisher: publisher}
+}
+
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/profile", h.get)
+	router.PATCH("/users/:id/profile", h.update)
+	router.GET("/users/:id/profile-completeness", h.completeness)
+	router.GET("/orgs/:id/profile-requirements", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.getRequirements)
+	router.PUT("/orgs/:id/profile-requirements", auth.RequireRole(auth.RoleAdmin), h.setRequirements)
+}
+
+// profileResponse flattens the profile's fields next to the user ID.
+func profileResponse(p *Profile) gin.H {
+	resp := gin.H{"user_id": p.UserID}
+	for _, name := range fieldOrder {
+		resp[name] = p.Values[name]
+	}
+	return resp
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	p, err := h.tracker.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cachetags.Set(c, cachetags.User(id))
+	if etag.NotModified(c, p.Version) {
+		return
+	}
+	c.JSON(http.StatusOK, profileResponse(p))
+}
+
+// update changes only the fields in the body; "" clears a field. If-Match
+// must name the version the caller read, so an edit made from a stale read
+// is refused rather than overwriting the one before it.
+func (h *Handler) update(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	var values map[string]string
+	if err := c.ShouldBindJSON(&values); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ValidateValues(values); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version, ok := etag.IfMatch(c)
+	if !ok {
+		return
+	}
+
+	p, err := h.tracker.store.Update(c.Request.Context(), id, version, values)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if errors.Is(err, etag.ErrMismatch) {
+		etag.Failed(c)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(values) > 0 {
+		h.announce(c.Request.Context(), id, values)
+	}
+	c.Header("ETag", etag.Format(p.Version))
+	c.JSON(http.StatusOK, profileResponse(p))
+}
+
+// announce publishes a ProfileUpdate naming the changed fields. The update
+// is already saved, so a failure is only logged.
+func (h *Handler) announce(ctx context.Context, userID int, values map[string]string) {
+	if h.publisher == nil {
+		return
+	}
+	fields := make([]string, 0, len(values))
+	for name := range values {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	e, err := events.New(events.UserProfileUpdated, "user-service", events.ProfileUpdate{
+		UserID: userID,
+		Tenant: tenant.FromContext(ctx),
+		Fields: fields,
+	})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish profile update of user %d: %v", userID, err)
+	}
+}
+
+func (h *Handler) completeness(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	completeness, err := h.tracker.Completeness(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, completeness)
+}
+
+func (h *Handler) getRequirements(c *gin.Context) {
+	orgID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid org id"})
+		return
+	}
+
+	fields, err := h.tracker.store.RequiredFields(c.Request.Context(), orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if fields == nil {
+		c.JSON(http.StatusOK, gin.H{"org_id": orgID, "fields": h.tracker.defaults, "default": true})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"org_id": orgID, "fields": fields, "default": false})
+}
+
+type requirementsRequest struct {
+	Fields []string `json:"fields" binding:"required"`
+}
+
+func (h *Handler) setRequirements(c *gin.Context) {
+	orgID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid org id"})
+		return
+	}
+
+	var req requirementsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ValidateFields(req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = h.tracker.store.SetRequiredFields(c.Request.Context(), orgID, req.Fields)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"org_id": orgID, "fields": req.Fields, "default": false})
+}
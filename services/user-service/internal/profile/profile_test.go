@@ -0,0 +1,284 @@
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	profiles     map[int]*Profile
+	requirements map[int][]string
+	nudged       map[int]time.Time
+}
+
+func (s *memStore) Get(ctx context.Context, userID int) (*Profile, error) {
+	p, ok := s.profiles[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memStore) RequiredFields(ctx context.Context, orgID int) ([]string, error) {
+	return s.requirements[orgID], nil
+}
+
+func (s *memStore) SetRequiredFields(ctx context.Context, orgID int, fields []string) error {
+	s.requirements[orgID] = fields
+	return nil
+}
+
+func (s *memStore) Update(ctx context.Context, userID int, version int64, values map[string]string) (*Profile, error) {
+	p, ok := s.profiles[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if version != etag.Any && version != p.Version {
+		return nil, etag.ErrMismatch
+	}
+	for name, value := range values {
+		p.Values[name] = value
+	}
+	p.Version++
+	return p, nil
+}
+
+func (s *memStore) NudgeCandidates(ctx context.Context, since time.Time, limit int) ([]Profile, error) {
+	out := []Profile{}
+	for id, p := range s.profiles {
+		if at, ok := s.nudged[id]; !ok || at.Before(since) {
+			out = append(out, *p)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) MarkNudged(ctx context.Context, userID int, at time.Time) error {
+	s.nudged[userID] = at
+	return nil
+}
+
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.events = append(p.events, e)
+	return nil
+}
+
+func newStore() *memStore {
+	acme := 1
+	return &memStore{
+		profiles: map[int]*Profile{
+			1: {UserID: 1, Email: "john@example.com", Values: map[string]string{"first_name": "John", "last_name": "Doe"}, Version: 1},
+			2: {UserID: 2, Email: "ada@acme.example.com", OrgID: &acme, Values: map[string]string{"first_name": "Ada", "last_name": "Admin"}, Version: 1},
+		},
+		requirements: map[int][]string{1: {"first_name", "last_name", "phone", "avatar_url"}},
+		nudged:       map[int]time.Time{},
+	}
+}
+
+func TestCompute(t *testing.T) {
+	p := Profile{UserID: 1, Values: map[string]string{"first_name": "John"}}
+	c := Compute(p, []string{"first_name", "last_name", "phone"})
+	if c.Percent != 33 || c.Complete {
+		t.Errorf("Expected 33%% incomplete, got: %+v", c)
+	}
+	if len(c.Missing) != 2 || c.Missing[0].Field != "last_name" || c.Missing[0].Hint == "" {
+		t.Errorf("Expected last_name and phone missing with hints, got: %+v", c.Missing)
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	got, err := ParseFields("first_name, phone")
+	if err != nil || len(got) != 2 || got[1] != "phone" {
+		t.Errorf("Expected [first_name phone], got: %v, %v", got, err)
+	}
+	for _, bad := range []string{"", "nickname", "phone,phone"} {
+		if _, err := ParseFields(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// asPrincipal authenticates every request on the router as p.
+func asPrincipal(router *gin.Engine, p *auth.Principal) {
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+}
+
+func TestCompletenessUsesOrgRequirements(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	asPrincipal(router, &auth.Principal{Service: "test", Roles: []string{auth.RoleService}})
+	NewHandler(NewTracker(newStore(), []string{"first_name", "last_name"}), nil).RegisterRoutes(router)
+
+	tests := []struct {
+		userID  string
+		percent int
+		missing int
+	}{
+		{userID: "1", percent: 100, missing: 0},
+		{userID: "2", percent: 50, missing: 2},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/"+tt.userID+"/profile-completeness", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d", w.Code)
+		}
+		var c Completeness
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if c.Percent != tt.percent || len(c.Missing) != tt.missing {
+			t.Errorf("User %s: expected %d%% with %d missing, got: %+v", tt.userID, tt.percent, tt.missing, c)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/99/profile-completeness", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got: %d", w.Code)
+	}
+}
+
+func TestCompletenessRequiresSelfOrAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	asPrincipal(router, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	NewHandler(NewTracker(newStore(), []string{"first_name"}), nil).RegisterRoutes(router)
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{method: http.MethodGet, path: "/users/1/profile-completeness", want: http.StatusOK},
+		{method: http.MethodGet, path: "/users/2/profile-completeness", want: http.StatusForbidden},
+		{method: http.MethodPut, path: "/orgs/1/profile-requirements", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"fields":["phone"]}`)))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %d, got: %d", tt.method, tt.path, tt.want, w.Code)
+		}
+	}
+}
+
+func TestSetRequirementsRejectsUnknownFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	asPrincipal(router, &auth.Principal{UserID: 9, Roles: []string{auth.RoleAdmin}})
+	NewHandler(NewTracker(newStore(), []string{"first_name"}), nil).RegisterRoutes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/orgs/1/profile-requirements", strings.NewReader(`{"fields":["shoe_size"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got: %d", w.Code)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	asPrincipal(router, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	store := newStore()
+	NewHandler(NewTracker(store, []string{"first_name"}), nil).RegisterRoutes(router)
+
+	tests := []struct {
+		path, body string
+		want       int
+	}{
+		{path: "/users/1/profile", body: `{"locale": "pt-BR", "avatar_url": "https://cdn.example.com/john.png", "last_name": ""}`, want: http.StatusOK},
+		{path: "/users/1/profile", body: `{"avatar_url": "javascript:alert(1)"}`, want: http.StatusBadRequest},
+		{path: "/users/1/profile", body: `{"locale": "Portuguese"}`, want: http.StatusBadRequest},
+		{path: "/users/1/profile", body: `{"shoe_size": "10"}`, want: http.StatusBadRequest},
+		{path: "/users/2/profile", body: `{"locale": "en"}`, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPatch, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("If-Match", "*")
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("PATCH %s %s: expected status %d, got: %d", tt.path, tt.body, tt.want, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/1/profile", nil))
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if got["first_name"] != "John" || got["last_name"] != "" || got["locale"] != "pt-BR" {
+		t.Errorf("Expected the edits to apply and other fields to stay, got: %v", got)
+	}
+}
+
+func TestUpdateProfileRequiresCurrentVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	asPrincipal(router, &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}})
+	NewHandler(NewTracker(newStore(), nil), nil).RegisterRoutes(router)
+	do := func(method, header, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/users/1/profile", strings.NewReader(`{"locale": "en"}`))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	read := do(http.MethodGet, "", "").Header().Get("ETag")
+	if read != `"1"` {
+		t.Fatalf("Expected the profile's version as its ETag, got: %q", read)
+	}
+	if w := do(http.MethodPatch, "", ""); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected an edit without If-Match to be refused, got: %d", w.Code)
+	}
+	w := do(http.MethodPatch, "If-Match", read)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected the edit to apply and return the new version, got: %d %s", w.Code, w.Header())
+	}
+	if w := do(http.MethodPatch, "If-Match", read); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a second edit from the same read to be refused, got: %d", w.Code)
+	}
+	if w := do(http.MethodGet, "If-None-Match", `"2"`); w.Code != http.StatusNotModified {
+		t.Errorf("Expected the current version to be not modified, got: %d", w.Code)
+	}
+}
+
+func TestSweepNudgesIncompleteProfilesOnce(t *testing.T) {
+	store := newStore()
+	publisher := &recordingPublisher{}
+	nudger := NewNudger(NewTracker(store, []string{"first_name", "last_name"}), publisher, 24*time.Hour)
+
+	sent, err := nudger.Sweep(context.Background())
+	if err != nil || sent != 1 {
+		t.Fatalf("Expected 1 nudge, got: %d, %v", sent, err)
+	}
+	var payload events.ProfileIncomplete
+	if err := publisher.events[0].Decode(&payload); err != nil {
+		t.Fatalf("Failed to decode payload: %v", err)
+	}
+	if publisher.events[0].Type != events.UserProfileIncomplete || payload.UserID != 2 || len(payload.Missing) != 2 {
+		t.Errorf("Expected nudge for user 2 with 2 missing fields, got: %+v", payload)
+	}
+
+	if sent, _ := nudger.Sweep(context.Background()); sent != 0 {
+		t.Errorf("Expected no nudges within cooldown, got: %d", sent)
+	}
+}
@@ -0,0 +1,237 @@
+package profile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type Profile struct {
+	UserID   int
+	Email    string
+	Username string
+	OrgID    *int
+	Values   map[string]string
+	// Version is the user's, sent as the profile's ETag.
+	Version int64
+}
+
+type Store interface {
+	Get(ctx context.Context, userID int) (*Profile, error)
+	// RequiredFields returns the organization's required fields, or nil when
+	// it has not configured any.
+	RequiredFields(ctx context.Context, orgID int) ([]string, error)
+	SetRequiredFields(ctx context.Context, orgID int, fields []string) error
+	// Update sets the given profile fields, clearing those set to "", and
+	// returns the updated profile. Unless version is etag.Any, a user whose
+	// version has moved on is etag.ErrMismatch.
+	Update(ctx context.Context, userID int, version int64, values map[string]string) (*Profile, error)
+	// NudgeCandidates lists users not nudged since the given time, oldest
+	// nudge first. Encrypted fields are left sealed: nudging only needs to
+	// know whether they are set.
+	NudgeCandidates(ctx context.Context, notNudgedSince time.Time, limit int) ([]Profile, error)
+	MarkNudged(ctx context.Context, userID int, at time.Time) error
+}
+
+type PostgresStore struct {
+	db     *sql.DB
+	cipher *pii.Cipher
+}
+
+// NewPostgresStore encrypts the fields marked encrypted with cipher.
+func NewPostgresStore(db *sql.DB, cipher *pii.Cipher) *PostgresStore {
+	return &PostgresStore{db: db, cipher: cipher}
+}
+
+// open decrypts p's encrypted fields, auditing the read.
+func (s *PostgresStore) open(ctx context.Context, p *Profile) error {
+	r := s.cipher.Reader(ctx)
+	for _, name := range fieldOrder {
+		if column := fields[name].encrypted; column != nil {
+			value := p.Values[name]
+			r.Open(p.UserID, *column, &value)
+			p.Values[name] = value
+		}
+	}
+	return r.Close()
+}
+
+var profileColumns = func() string {
+	cols := make([]string, len(fieldOrder))
+	for i, name := range fieldOrder {
+		cols[i] = "COALESCE(u." + fields[name].column + ", '')"
+	}
+	return strings.Join(cols, ", ")
+}()
+
+func (s *PostgresStore) Get(ctx context.Context, userID int) (*Profile, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf("SELECT u.id, u.email, u.username, u.org_id, u.version, %s FROM user_service.users u WHERE u.id = $1 AND u.tenant_id = $2", profileColumns)
+	p, err := scanProfile(s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, s.open(ctx, p)
+}
+
+func (s *PostgresStore) Update(ctx context.Context, userID int, version int64, values map[string]string) (*Profile, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	args := []any{userID, tenant.FromContext(ctx), version}
+	var set []string
+	for _, name := range fieldOrder {
+		if value, ok := values[name]; ok {
+			if column := fields[name].encrypted; column != nil {
+				sealed, err := s.cipher.Encrypt(ctx, *column, value)
+				if err != nil {
+					return nil, err
+				}
+				value = sealed
+			}
+			args = append(args, value)
+			set = append(set, fmt.Sprintf("%s = NULLIF($%d, '')", fields[name].column, len(args)))
+		}
+	}
+	query := fmt.Sprintf(`UPDATE user_service.users u SET %s
+		WHERE u.id = $1 AND u.tenant_id = $2 AND u.status <> 'deleted' AND ($3 = 0 OR u.version = $3)
+		RETURNING u.id, u.email, u.username, u.org_id, u.version, %s`, strings.Join(set, ", "), profileColumns)
+	var p *Profile
+	err := trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		p, err = scanProfile(tx.QueryRowContext(ctx, query, args...))
+		if errors.Is(err, sql.ErrNoRows) && version != etag.Any {
+			// Tell a stale version apart from a missing user.
+			const exists string = "SELECT EXISTS (SELECT 1 FROM user_service.users WHERE id = $1 AND tenant_id = $2 AND status <> 'deleted')"
+			var found bool
+			if err := tx.QueryRowContext(ctx, exists, userID, tenant.FromContext(ctx)).Scan(&found); err != nil {
+				return err
+			}
+			if found {
+				return etag.ErrMismatch
+			}
+			return ErrNotFound
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, s.open(ctx, p)
+}
+
+func (s *PostgresStore) RequiredFields(ctx context.Context, orgID int) ([]string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT fields FROM user_service.profile_requirements WHERE org_id = $1"
+	var out []string
+	err := s.db.QueryRowContext(ctx, query, orgID).Scan(pq.Array(&out))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return out, err
+}
+
+func (s *PostgresStore) SetRequiredFields(ctx context.Context, orgID int, fields []string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.profile_requirements (org_id, fields, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (org_id) DO UPDATE SET fields = EXCLUDED.fields, updated_at = NOW()`
+	_, err := s.db.ExecContext(ctx, query, orgID, pq.Array(fields))
+	if isForeignKeyViolation(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) NudgeCandidates(ctx context.Context, notNudgedSince time.Time, limit int) ([]Profile, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`SELECT u.id, u.email, u.username, u.org_id, u.version, %s
+		FROM user_service.users u
+		LEFT JOIN user_service.profile_nudges n ON n.user_id = u.id
+		WHERE u.status = 'active' AND (n.last_nudged_at IS NULL OR n.last_nudged_at < $1)
+		ORDER BY n.last_nudged_at NULLS FIRST, u.id
+		LIMIT $2`, profileColumns)
+	rows, err := s.db.QueryContext(ctx, query, notNudgedSince, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := []Profile{}
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, *p)
+	}
+	return profiles, rows.Err()
+}
+
+func (s *PostgresStore) MarkNudged(ctx context.Context, userID int, at time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.profile_nudges (user_id, last_nudged_at)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET last_nudged_at = EXCLUDED.last_nudged_at`
+	_, err := s.db.ExecContext(ctx, query, userID, at)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProfile(row scanner) (*Profile, error) {
+	var p Profile
+	var orgID sql.NullInt64
+	values := make([]string, len(fieldOrder))
+	dest := []any{&p.UserID, &p.Email, &p.Username, &orgID, &p.Version}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if orgID.Valid {
+		id := int(orgID.Int64)
+		p.OrgID = &id
+	}
+	p.Values = make(map[string]string, len(fieldOrder))
+	for i, name := range fieldOrder {
+		p.Values[name] = values[i]
+	}
+	return &p, nil
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
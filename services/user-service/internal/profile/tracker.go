@@ -0,0 +1,117 @@
+package profile
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+)
+
+// Tracker scores profiles against their organization's required fields,
+// falling back to the service defaults for users without an organization or
+// organizations that have not configured their own list.
+type Tracker struct {
+	store    Store
+	defaults []string
+}
+
+func NewTracker(store Store, defaults []string) *Tracker {
+	return &Tracker{store: store, defaults: defaults}
+}
+
+func (t *Tracker) Completeness(ctx context.Context, userID int) (*Completeness, error) {
+	p, err := t.store.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	required, err := t.requiredFor(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	c := Compute(*p, required)
+	return &c, nil
+}
+
+func (t *Tracker) requiredFor(ctx context.Context, p *Profile) ([]string, error) {
+	if p.OrgID == nil {
+		return t.defaults, nil
+	}
+	required, err := t.store.RequiredFields(ctx, *p.OrgID)
+	if err != nil || required == nil {
+		return t.defaults, err
+	}
+	return required, nil
+}
+
+// Nudger periodically publishes a ProfileIncomplete event for each user with
+// missing fields, at most once per cooldown per user.
+type Nudger struct {
+	tracker   *Tracker
+	publisher events.Publisher
+	cooldown  time.Duration
+	batchSize int
+	now       func() time.Time
+}
+
+func NewNudger(tracker *Tracker, publisher events.Publisher, cooldown time.Duration) *Nudger {
+	return &Nudger{tracker: tracker, publisher: publisher, cooldown: cooldown, batchSize: 100, now: time.Now}
+}
+
+// Run sweeps every interval until ctx is cancelled.
+func (n *Nudger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if sent, err := n.Sweep(ctx); err != nil {
+			log.Printf("Profile nudge sweep failed: %v", err)
+		} else if sent > 0 {
+			log.Printf("Sent %d profile nudges", sent)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep checks one batch of users due a nudge and returns how many were
+// nudged. Complete profiles are marked too so they are not rechecked until
+// the cooldown passes.
+func (n *Nudger) Sweep(ctx context.Context) (int, error) {
+	now := n.now()
+	candidates, err := n.tracker.store.NudgeCandidates(ctx, now.Add(-n.cooldown), n.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, p := range candidates {
+		required, err := n.tracker.requiredFor(ctx, &p)
+		if err != nil {
+			return sent, err
+		}
+		c := Compute(p, required)
+		if !c.Complete {
+			e, err := events.New(events.UserProfileIncomplete, "user-service", events.ProfileIncomplete{
+				UserID:   p.UserID,
+				Email:    p.Email,
+				Username: p.Username,
+				Percent:  c.Percent,
+				Missing:  c.Missing,
+			})
+			if err != nil {
+				return sent, err
+			}
+			if err := n.publisher.Publish(ctx, e); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		if err := n.tracker.store.MarkNudged(ctx, p.UserID, now); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,158 @@
+package publicprofile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store     Store
+	publisher events.Publisher
+	maxAge    time.Duration
+}
+
+// NewHandler lets caches keep public profiles for maxAge, and announces
+// settings changes on publisher when it is non-nil so the gateway drops
+// the copies it holds.
+func NewHandler(store Store, publisher events.Publisher, maxAge time.Duration) *Handler {
+	return &Handler{store: store, publisher: publisher, maxAge: maxAge}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Public profiles need no token, like login.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/profiles/:username", h.public)
+	router.GET("/users/:id/public-profile", h.getSettings)
+	router.PUT("/users/:id/public-profile", h.setSettings)
+}
+
+func (h *Handler) public(c *gin.Context) {
+	p, err := h.store.Public(c.Request.Context(), c.Param("username"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "profile not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cachetags.Set(c, cachetags.User(p.UserID))
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.maxAge.Seconds())))
+	resp := gin.H{"username": p.Username}
+	for name, value := range p.Shown() {
+		resp[name] = value
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// pathUser reads and authorizes the :id parameter.
+func pathUser(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	return id, auth.AuthorizeUser(c, id)
+}
+
+func (h *Handler) getSettings(c *gin.Context) {
+	id, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	settings, err := h.store.Settings(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+type settingsRequest struct {
+	Enabled bool     `json:"enabled"`
+	Fields  []string `json:"fields"`
+}
+
+// ValidateFields checks the fields a user chose to show.
+func ValidateFields(names []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := Fields[name]; !ok {
+			return fmt.Errorf("field %q cannot be shown publicly", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate field %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// setSettings replaces the user's settings. Fields can be chosen while the
+// profile is disabled, ready for when it is enabled.
+func (h *Handler) setSettings(c *gin.Context) {
+	id, ok := pathUser(c)
+	if !ok {
+		return
+	}
+	var req settingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ValidateFields(req.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Fields == nil {
+		req.Fields = []string{}
+	}
+
+	settings := &Settings{UserID: id, Enabled: req.Enabled, Fields: req.Fields}
+	err := h.store.SetSettings(c.Request.Context(), settings)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.announce(c.Request.Context(), id)
+	c.JSON(http.StatusOK, settings)
+}
+
+// announce publishes a ProfileUpdate for the public profile. The settings
+// are already saved, so a failure is only logged; cached copies then last
+// until they expire.
+func (h *Handler) announce(ctx context.Context, userID int) {
+	if h.publisher == nil {
+		return
+	}
+	e, err := events.New(events.UserProfileUpdated, "user-service", events.ProfileUpdate{
+		UserID: userID,
+		Tenant: tenant.FromContext(ctx),
+		Fields: []string{"public_profile"},
+	})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish public profile update of user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,124 @@
+package publicprofile
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+type memStore struct {
+	users    map[int]*Profile
+	active   map[int]bool
+	settings map[int]*Settings
+}
+
+func (s *memStore) Settings(ctx context.Context, userID int) (*Settings, error) {
+	if _, ok := s.users[userID]; !ok {
+		return nil, ErrNotFound
+	}
+	if settings, ok := s.settings[userID]; ok {
+		return settings, nil
+	}
+	return &Settings{UserID: userID, Fields: []string{}}, nil
+}
+
+func (s *memStore) SetSettings(ctx context.Context, settings *Settings) error {
+	if _, ok := s.users[settings.UserID]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	settings.UpdatedAt = &now
+	s.settings[settings.UserID] = settings
+	return nil
+}
+
+func (s *memStore) Public(ctx context.Context, username string) (*Profile, error) {
+	for id, u := range s.users {
+		settings, ok := s.settings[id]
+		if strings.EqualFold(u.Username, username) && s.active[id] && ok && settings.Enabled {
+			p := *u
+			p.Fields = settings.Fields
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.events = append(p.events, e)
+	return nil
+}
+
+func TestPublicProfile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{
+		users: map[int]*Profile{
+			1: {UserID: 1, Username: "Ada", Values: map[string]string{"first_name": "Ada", "last_name": "Lovelace", "locale": "en-GB"}},
+			2: {UserID: 2, Username: "gone", Values: map[string]string{"first_name": "Gone"}},
+		},
+		active:   map[int]bool{1: true},
+		settings: map[int]*Settings{2: {UserID: 2, Enabled: true, Fields: []string{"first_name"}}},
+	}
+	publisher := &recordingPublisher{}
+	var principal *auth.Principal
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if principal != nil {
+			auth.WithPrincipal(c, principal)
+		}
+	})
+	NewHandler(store, publisher, 5*time.Minute).RegisterRoutes(router)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodGet, "/profiles/ada", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a profile not opted in to be hidden, got: %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/profiles/gone", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an inactive user's profile to be hidden, got: %d", w.Code)
+	}
+
+	principal = &auth.Principal{UserID: 2, Roles: []string{auth.RoleCustomer}}
+	if w := do(http.MethodPut, "/users/1/public-profile", `{"enabled":true,"fields":["first_name"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's settings to be refused, got: %d", w.Code)
+	}
+	principal = &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}
+	for _, bad := range []string{`{"enabled":true,"fields":["email"]}`, `{"enabled":true,"fields":["phone"]}`, `{"fields":["locale","locale"]}`} {
+		if w := do(http.MethodPut, "/users/1/public-profile", bad); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got: %d", bad, w.Code)
+		}
+	}
+	w := do(http.MethodPut, "/users/1/public-profile", `{"enabled":true,"fields":["first_name","avatar_url","member_since"]}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":true`) {
+		t.Fatalf("Expected the settings saved, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(publisher.events) != 1 || publisher.events[0].Type != events.UserProfileUpdated {
+		t.Errorf("Expected a profile update announced, got: %+v", publisher.events)
+	}
+
+	principal = nil
+	w = do(http.MethodGet, "/profiles/ADA", "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"first_name":"Ada","username":"Ada"}` {
+		t.Errorf("Expected only the chosen fields that are set, got: %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=300" || w.Header().Get(cachetags.Header) != cachetags.User(1) {
+		t.Errorf("Expected the profile to be cacheable and tagged, got: %v", w.Header())
+	}
+}
@@ -0,0 +1,161 @@
+// Package publicprofile serves the profiles users choose to show to
+// anyone, by username and without a token. A user opts in and picks the
+// fields to show; nothing else about the account is ever returned.
+package publicprofile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Fields are the fields a user may show, keyed by their name in the API,
+// with the users column each is read from. Contact details and encrypted
+// fields are never among them.
+var Fields = map[string]string{
+	"first_name":   "u.first_name",
+	"last_name":    "u.last_name",
+	"avatar_url":   "u.avatar_url",
+	"locale":       "u.locale",
+	"member_since": "to_char(u.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD\"T\"HH24:MI:SS\"Z\"')",
+}
+
+// fieldOrder keeps responses and queries deterministic.
+var fieldOrder = []string{"first_name", "last_name", "avatar_url", "locale", "member_since"}
+
+// Settings are what a user shows publicly. A user who has never set them
+// shows nothing.
+type Settings struct {
+	UserID    int        `json:"user_id"`
+	Enabled   bool       `json:"enabled"`
+	Fields    []string   `json:"fields"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// Profile is a user with a public profile. Values holds every field that
+// can be shown, and Fields those its user chose.
+type Profile struct {
+	UserID   int
+	Username string
+	Fields   []string
+	Values   map[string]string
+}
+
+// Shown returns the fields the user chose, unset ones left out.
+func (p *Profile) Shown() map[string]string {
+	shown := map[string]string{}
+	for _, name := range p.Fields {
+		if value := p.Values[name]; value != "" {
+			shown[name] = value
+		}
+	}
+	return shown
+}
+
+type Store interface {
+	Settings(ctx context.Context, userID int) (*Settings, error)
+	// SetSettings saves s, filling in UpdatedAt. A missing or erased user
+	// is ErrNotFound.
+	SetSettings(ctx context.Context, s *Settings) error
+	// Public returns the profile of the active user with username,
+	// compared without case, if they have enabled it. Otherwise it is
+	// ErrNotFound, so a disabled profile cannot be told apart from a
+	// missing user.
+	Public(ctx context.Context, username string) (*Profile, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Settings(ctx context.Context, userID int) (*Settings, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT COALESCE(p.enabled, FALSE), COALESCE(p.fields, '{}'), p.updated_at
+		FROM user_service.users u
+		LEFT JOIN user_service.public_profiles p ON p.user_id = u.id
+		WHERE u.id = $1 AND u.tenant_id = $2 AND u.status <> 'deleted'`
+	settings := Settings{UserID: userID}
+	var updatedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)).Scan(&settings.Enabled, pq.Array(&settings.Fields), &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		settings.UpdatedAt = &updatedAt.Time
+	}
+	return &settings, nil
+}
+
+func (s *PostgresStore) SetSettings(ctx context.Context, settings *Settings) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `INSERT INTO user_service.public_profiles (user_id, enabled, fields, updated_at)
+		SELECT id, $3, $4, NOW() FROM user_service.users WHERE id = $1 AND tenant_id = $2 AND status <> 'deleted'
+		ON CONFLICT (user_id) DO UPDATE SET enabled = EXCLUDED.enabled, fields = EXCLUDED.fields, updated_at = NOW()
+		RETURNING updated_at`
+	var updatedAt time.Time
+	err := s.db.QueryRowContext(ctx, query, settings.UserID, tenant.FromContext(ctx), settings.Enabled, pq.Array(settings.Fields)).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	settings.UpdatedAt = &updatedAt
+	return nil
+}
+
+var publicColumns = func() string {
+	cols := make([]string, len(fieldOrder))
+	for i, name := range fieldOrder {
+		cols[i] = "COALESCE(" + Fields[name] + ", '')"
+	}
+	return strings.Join(cols, ", ")
+}()
+
+func (s *PostgresStore) Public(ctx context.Context, username string) (*Profile, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`SELECT u.id, u.username, p.fields, %s
+		FROM user_service.users u
+		JOIN user_service.public_profiles p ON p.user_id = u.id
+		WHERE u.tenant_id = $1 AND lower(u.username) = lower($2) AND u.status = 'active' AND p.enabled`, publicColumns)
+	var p Profile
+	values := make([]string, len(fieldOrder))
+	dest := []any{&p.UserID, &p.Username, pq.Array(&p.Fields)}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	err := s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), username).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Values = make(map[string]string, len(fieldOrder))
+	for i, name := range fieldOrder {
+		p.Values[name] = values[i]
+	}
+	return &p, nil
+}
@@ -0,0 +1,86 @@
+// Package recovery lets users regain access to their account when they have
+// lost their password: by a reset link sent to their email, or, when they
+// have lost access to that too, with a one-time recovery code together with
+// answers to their security questions.
+package recovery
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	codeCount = 10
+	// codeAlphabet leaves out 0, 1, l and o, which are easily confused when
+	// read back from paper.
+	codeAlphabet = "23456789abcdefghijkmnpqrstuvwxyz"
+)
+
+// GenerateCodes returns n random codes of the form xxxxx-xxxxx, 50 bits
+// each.
+func GenerateCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	buf := make([]byte, 10)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		for j, v := range buf {
+			if j == 5 {
+				b.WriteByte('-')
+			}
+			b.WriteByte(codeAlphabet[int(v)%len(codeAlphabet)])
+		}
+		codes[i] = b.String()
+	}
+	return codes, nil
+}
+
+// Issuer gives users a new set of recovery codes.
+type Issuer struct {
+	store Store
+}
+
+func NewIssuer(store Store) *Issuer {
+	return &Issuer{store: store}
+}
+
+// Issue replaces the user's recovery codes and returns the new ones. The
+// store keeps only their hashes, so this is the one time they can be shown.
+func (i *Issuer) Issue(ctx context.Context, userID int) ([]string, error) {
+	codes, err := GenerateCodes(codeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for j, code := range codes {
+		hashes[j] = HashCode(code)
+	}
+	if err := i.store.ReplaceCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// HashCode hashes a code as typed by the user, ignoring case, spaces and
+// dashes. Codes carry enough entropy that a fast hash is safe, and it lets
+// the store look a code up directly.
+func HashCode(code string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeAnswer makes answers match regardless of case and spacing.
+func normalizeAnswer(answer string) string {
+	return strings.Join(strings.Fields(strings.ToLower(answer)), " ")
+}
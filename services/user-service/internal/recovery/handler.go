@@ -0,0 +1,318 @@
+package recovery
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Handler struct {
+	store       Store
+	maxAttempts int
+	window      time.Duration
+	resets      *Resets
+	now         func() time.Time
+}
+
+// NewHandler locks an account out of recovery after maxAttempts failed
+// attempts within window. Without resets, the password reset routes answer
+// 404.
+func NewHandler(store Store, maxAttempts int, window time.Duration, resets *Resets) *Handler {
+	return &Handler{store: store, maxAttempts: maxAttempts, window: window, resets: resets, now: time.Now}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes. The
+// /auth routes are for users who cannot sign in and need no token.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/users/:id/recovery-codes", h.generateCodes)
+	router.GET("/users/:id/recovery-codes", h.codeStatus)
+	router.GET("/users/:id/security-questions", h.listQuestions)
+	router.PUT("/users/:id/security-questions", h.setQuestions)
+	router.POST("/auth/recovery/questions", h.recoveryQuestions)
+	router.POST("/auth/recovery", h.recover)
+	router.POST("/auth/forgot-password", h.forgotPassword)
+	router.POST("/auth/reset-password", h.resetPassword)
+}
+
+// reauthenticate lets only the user themselves through, and only with their
+// current password, since the result is what protects their account. Admins
+// cannot act for users here.
+func (h *Handler) reauthenticate(c *gin.Context, password string) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	p, ok := auth.FromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+		return 0, false
+	}
+	if p.UserID != id {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the account owner can change its recovery settings"})
+		return 0, false
+	}
+
+	hash, err := h.store.PasswordHash(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid password"})
+		return 0, false
+	}
+	return id, true
+}
+
+// generateCodes replaces the user's recovery codes, such as the ones they
+// were given when their account was created.
+func (h *Handler) generateCodes(c *gin.Context) {
+	var req struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, ok := h.reauthenticate(c, req.Password)
+	if !ok {
+		return
+	}
+
+	codes, err := NewIssuer(h.store).Issue(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"codes": codes, "remaining": len(codes)})
+}
+
+func (h *Handler) codeStatus(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	remaining, err := h.store.RemainingCodes(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"remaining": remaining})
+}
+
+func (h *Handler) listQuestions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	questions, err := h.store.Questions(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"questions": questions})
+}
+
+func (h *Handler) setQuestions(c *gin.Context) {
+	var req struct {
+		Password  string `json:"password" binding:"required"`
+		Questions []struct {
+			Question string `json:"question" binding:"required,max=255"`
+			Answer   string `json:"answer" binding:"required,min=3,max=255"`
+		} `json:"questions" binding:"required,min=2,max=5,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, ok := h.reauthenticate(c, req.Password)
+	if !ok {
+		return
+	}
+
+	questions := make([]Question, len(req.Questions))
+	for i, q := range req.Questions {
+		hash, err := bcrypt.GenerateFromPassword([]byte(normalizeAnswer(q.Answer)), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		questions[i] = Question{Question: q.Question, AnswerHash: string(hash)}
+	}
+	if err := h.store.SetQuestions(c.Request.Context(), id, questions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"questions": questions})
+}
+
+// verifyCode resolves the account for an unauthenticated recovery request
+// and checks its code without using it up. Unknown emails and wrong codes
+// get the same response, so the endpoint cannot be used to find accounts.
+func (h *Handler) verifyCode(c *gin.Context, email, code string) (int, bool) {
+	id, err := h.store.UserID(c.Request.Context(), email)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid recovery details"})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+
+	failed, err := h.store.FailedAttempts(c.Request.Context(), id, h.now().Add(-h.window))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if failed >= h.maxAttempts {
+		c.Header("Retry-After", strconv.Itoa(int(h.window.Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many recovery attempts, try again later"})
+		return 0, false
+	}
+
+	valid, err := h.store.HasCode(c.Request.Context(), id, HashCode(code))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if !valid {
+		h.fail(c, id)
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *Handler) fail(c *gin.Context, userID int) {
+	if err := h.store.RecordAttempt(c.Request.Context(), userID, false); err != nil {
+		log.Printf("Failed to record recovery attempt for user %d: %v", userID, err)
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid recovery details"})
+}
+
+// questionsFor loads the questions recovery must answer. Accounts without
+// any cannot be recovered with a code alone and need support.
+func (h *Handler) questionsFor(c *gin.Context, userID int) ([]Question, bool) {
+	questions, err := h.store.Questions(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if len(questions) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account has no security questions set, contact support to recover it"})
+		return nil, false
+	}
+	return questions, true
+}
+
+type recoveryRequest struct {
+	Email        string `json:"email" binding:"required"`
+	RecoveryCode string `json:"recovery_code" binding:"required"`
+}
+
+// recoveryQuestions returns the questions to ask once the caller has shown a
+// valid recovery code.
+func (h *Handler) recoveryQuestions(c *gin.Context) {
+	var req recoveryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, ok := h.verifyCode(c, req.Email, req.RecoveryCode)
+	if !ok {
+		return
+	}
+	questions, ok := h.questionsFor(c, id)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"questions": questions})
+}
+
+// recover sets a new password for a user who has lost both their password
+// and any second factor. It takes an unused recovery code and the answers to
+// every security question, in order, and uses the code up.
+func (h *Handler) recover(c *gin.Context) {
+	var req struct {
+		recoveryRequest
+		Answers     []string `json:"answers" binding:"required"`
+		NewPassword string   `json:"new_password" binding:"required,min=8,max=72"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, ok := h.verifyCode(c, req.Email, req.RecoveryCode)
+	if !ok {
+		return
+	}
+	questions, ok := h.questionsFor(c, id)
+	if !ok {
+		return
+	}
+	if len(req.Answers) != len(questions) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "answers must match the number of security questions"})
+		return
+	}
+
+	// Check every answer so the response time does not reveal which one was
+	// wrong.
+	correct := true
+	for i, q := range questions {
+		if bcrypt.CompareHashAndPassword([]byte(q.AnswerHash), []byte(normalizeAnswer(req.Answers[i]))) != nil {
+			correct = false
+		}
+	}
+	if !correct {
+		h.fail(c, id)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revoked, err := h.store.Recover(c.Request.Context(), id, HashCode(req.RecoveryCode), string(hash))
+	if errors.Is(err, ErrInvalidCode) {
+		// Used by a concurrent request since it was verified, or the account
+		// is no longer active.
+		h.fail(c, id)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.store.RecordAttempt(c.Request.Context(), id, true); err != nil {
+		log.Printf("Failed to record recovery attempt for user %d: %v", id, err)
+	}
+
+	remaining, err := h.store.RemainingCodes(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "recovered", "remaining_codes": remaining, "sessions_revoked": revoked})
+}
@@ -0,0 +1,327 @@
+package recovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type memStore struct {
+	password  string
+	codes     map[string]bool
+	questions []Question
+	failed    int
+	resets    map[string]*reset
+	sessions  int
+	inactive  bool
+}
+
+type reset struct {
+	createdAt time.Time
+	expiresAt time.Time
+	used      bool
+}
+
+func (s *memStore) UserID(ctx context.Context, email string) (int, error) {
+	if email != "jane.doe@example.com" {
+		return 0, ErrNotFound
+	}
+	return 2, nil
+}
+
+func (s *memStore) PasswordHash(ctx context.Context, userID int) (string, error) {
+	return s.password, nil
+}
+
+func (s *memStore) ReplaceCodes(ctx context.Context, userID int, hashes []string) error {
+	s.codes = map[string]bool{}
+	for _, h := range hashes {
+		s.codes[h] = false
+	}
+	return nil
+}
+
+func (s *memStore) RemainingCodes(ctx context.Context, userID int) (int, error) {
+	n := 0
+	for _, used := range s.codes {
+		if !used {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStore) HasCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	used, ok := s.codes[codeHash]
+	return ok && !used, nil
+}
+
+func (s *memStore) SetQuestions(ctx context.Context, userID int, questions []Question) error {
+	s.questions = questions
+	return nil
+}
+
+func (s *memStore) Questions(ctx context.Context, userID int) ([]Question, error) {
+	return s.questions, nil
+}
+
+func (s *memStore) FailedAttempts(ctx context.Context, userID int, since time.Time) (int, error) {
+	return s.failed, nil
+}
+
+func (s *memStore) RecordAttempt(ctx context.Context, userID int, succeeded bool) error {
+	if !succeeded {
+		s.failed++
+	}
+	return nil
+}
+
+func (s *memStore) Recover(ctx context.Context, userID int, codeHash, passwordHash string) (int, error) {
+	if used, ok := s.codes[codeHash]; !ok || used || s.inactive {
+		return 0, ErrInvalidCode
+	}
+	s.codes[codeHash] = true
+	s.password = passwordHash
+	revoked := s.sessions
+	s.sessions = 0
+	return revoked, nil
+}
+
+func (s *memStore) CreateReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	if s.resets == nil {
+		s.resets = map[string]*reset{}
+	}
+	s.resets[tokenHash] = &reset{createdAt: time.Now(), expiresAt: expiresAt}
+	return nil
+}
+
+func (s *memStore) ResetsSince(ctx context.Context, userID int, since time.Time) (int, error) {
+	n := 0
+	for _, r := range s.resets {
+		if r.createdAt.After(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStore) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int, error) {
+	r, ok := s.resets[tokenHash]
+	if !ok || r.used || !time.Now().Before(r.expiresAt) {
+		return 0, ErrInvalidToken
+	}
+	for _, r := range s.resets {
+		r.used = true
+	}
+	s.password = passwordHash
+	revoked := s.sessions
+	s.sessions = 0
+	return revoked, nil
+}
+
+type recordingPublisher struct {
+	published []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.published = append(p.published, e)
+	return nil
+}
+
+func setup(t *testing.T) (*gin.Engine, *memStore, string) {
+	gin.SetMode(gin.TestMode)
+	tokens, err := auth.NewTokens("test-secret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create tokens: %v", err)
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	store := &memStore{password: string(hash)}
+
+	router := gin.New()
+	router.Use(auth.Authenticate(tokens))
+	NewHandler(store, 3, time.Hour, nil).RegisterRoutes(router)
+
+	token, _, _ := tokens.IssueUser(2, []string{auth.RoleCustomer})
+	return router, store, token
+}
+
+func do(router *gin.Engine, method, path, token, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestHashCodeNormalizes(t *testing.T) {
+	codes, err := GenerateCodes(2)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(codes[0]) != 11 || codes[0][5] != '-' || codes[0] == codes[1] {
+		t.Errorf("Expected two distinct xxxxx-xxxxx codes, got: %v", codes)
+	}
+	if HashCode("ABCDE-FGHIJ") != HashCode("abcde fghij") {
+		t.Error("Expected codes to hash the same regardless of case, spaces and dashes")
+	}
+}
+
+func TestEnrollmentRequiresOwnerAndPassword(t *testing.T) {
+	router, store, token := setup(t)
+
+	if w := do(router, "POST", "/users/3/recovery-codes", token, `{"password": "password123"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for another user's codes, got: %d", w.Code)
+	}
+	if w := do(router, "POST", "/users/2/recovery-codes", token, `{"password": "wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password, got: %d", w.Code)
+	}
+
+	w := do(router, "POST", "/users/2/recovery-codes", token, `{"password": "password123"}`)
+	var body struct {
+		Codes []string `json:"codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusCreated || len(body.Codes) != codeCount {
+		t.Fatalf("Expected %d codes, got: %d %s", codeCount, w.Code, w.Body)
+	}
+	if _, ok := store.codes[HashCode(body.Codes[0])]; !ok {
+		t.Error("Expected codes to be stored hashed")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	router, store, token := setup(t)
+	w := do(router, "POST", "/users/2/recovery-codes", token, `{"password": "password123"}`)
+	var enrolled struct {
+		Codes []string `json:"codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enrolled)
+	code := strings.ToUpper(enrolled.Codes[0])
+
+	recoverBody := `{"email": "jane.doe@example.com", "recovery_code": "` + code + `", "answers": ["  Fluffy ", "paris"], "new_password": "n3w-password"}`
+	if w := do(router, "POST", "/auth/recovery", "", recoverBody); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without security questions, got: %d", w.Code)
+	}
+
+	w = do(router, "PUT", "/users/2/security-questions", token, `{"password": "password123", "questions": [
+		{"question": "First pet?", "answer": "fluffy"},
+		{"question": "Birth city?", "answer": "Paris"}]}`)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "fluffy") {
+		t.Fatalf("Expected questions saved without answers echoed, got: %d %s", w.Code, w.Body)
+	}
+
+	w = do(router, "POST", "/auth/recovery/questions", "", `{"email": "jane.doe@example.com", "recovery_code": "`+code+`"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "First pet?") {
+		t.Errorf("Expected questions for a valid code, got: %d %s", w.Code, w.Body)
+	}
+
+	wrong := strings.Replace(recoverBody, "paris", "london", 1)
+	if w := do(router, "POST", "/auth/recovery", "", wrong); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong answer, got: %d", w.Code)
+	}
+
+	store.sessions = 2
+	w = do(router, "POST", "/auth/recovery", "", recoverBody)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"remaining_codes":9`) ||
+		!strings.Contains(w.Body.String(), `"sessions_revoked":2`) {
+		t.Fatalf("Expected recovery with 9 codes left and both sessions revoked, got: %d %s", w.Code, w.Body)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(store.password), []byte("n3w-password")) != nil {
+		t.Error("Expected the new password to be set")
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do(router, "POST", "/auth/recovery", "", recoverBody); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a used code, got: %d", w.Code)
+		}
+	}
+	if w := do(router, "POST", "/auth/recovery", "", recoverBody); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected lockout after 3 failed attempts, got: %d", w.Code)
+	}
+}
+
+func TestRecoverInactiveAccount(t *testing.T) {
+	router, store, token := setup(t)
+	w := do(router, "POST", "/users/2/recovery-codes", token, `{"password": "password123"}`)
+	var enrolled struct {
+		Codes []string `json:"codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enrolled)
+	do(router, "PUT", "/users/2/security-questions", token, `{"password": "password123", "questions": [
+		{"question": "First pet?", "answer": "fluffy"},
+		{"question": "Birth city?", "answer": "paris"}]}`)
+
+	// Deactivated after the code was checked but before the password is set.
+	store.inactive = true
+	password := store.password
+	w = do(router, "POST", "/auth/recovery", "", `{"email": "jane.doe@example.com", "recovery_code": "`+enrolled.Codes[0]+`", "answers": ["fluffy", "paris"], "new_password": "n3w-password"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an inactive account, got: %d %s", w.Code, w.Body)
+	}
+	if store.password != password {
+		t.Error("Expected the password of an inactive account left unchanged")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{sessions: 2}
+	publisher := &recordingPublisher{}
+	router := gin.New()
+	NewHandler(store, 3, time.Hour, NewResets(publisher, time.Hour, "https://shop.example/reset", 2, time.Hour)).RegisterRoutes(router)
+
+	if w := do(router, "POST", "/auth/forgot-password", "", `{"email": "nobody@example.com"}`); w.Code != http.StatusAccepted || len(publisher.published) != 0 {
+		t.Errorf("Expected 202 and no email for an unknown account, got: %d %d", w.Code, len(publisher.published))
+	}
+	for i := 0; i < 3; i++ {
+		if w := do(router, "POST", "/auth/forgot-password", "", `{"email": "jane.doe@example.com"}`); w.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got: %d %s", w.Code, w.Body)
+		}
+	}
+	if len(publisher.published) != 2 || len(store.resets) != 2 {
+		t.Fatalf("Expected 2 links sent and the third request dropped, got: %d", len(publisher.published))
+	}
+
+	var links []events.PasswordResetRequest
+	for _, e := range publisher.published {
+		var p events.PasswordResetRequest
+		e.Decode(&p)
+		links = append(links, p)
+	}
+	token := strings.TrimPrefix(links[1].URL, "https://shop.example/reset?token=")
+	if links[1].UserID != 2 || links[1].Email != "jane.doe@example.com" || len(token) != 64 {
+		t.Fatalf("Expected a link with a 64 character token, got: %+v", links[1])
+	}
+	if _, ok := store.resets[HashCode(token)]; !ok {
+		t.Error("Expected the token to be stored hashed")
+	}
+
+	if w := do(router, "POST", "/auth/reset-password", "", `{"token": "`+token+`", "new_password": "short"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a short password, got: %d", w.Code)
+	}
+	w := do(router, "POST", "/auth/reset-password", "", `{"token": "`+token+`", "new_password": "n3w-password"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"sessions_revoked":2`) {
+		t.Fatalf("Expected the password reset and both sessions revoked, got: %d %s", w.Code, w.Body)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(store.password), []byte("n3w-password")) != nil {
+		t.Error("Expected the new password to be set")
+	}
+
+	earlier := strings.TrimPrefix(links[0].URL, "https://shop.example/reset?token=")
+	for _, used := range []string{token, earlier} {
+		if w := do(router, "POST", "/auth/reset-password", "", `{"token": "`+used+`", "new_password": "an0ther-password"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for a used or superseded token, got: %d", w.Code)
+		}
+	}
+}
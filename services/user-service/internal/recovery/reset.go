@@ -0,0 +1,222 @@
+package recovery
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidToken is returned for a password reset token that is unknown,
+// expired or already used.
+var ErrInvalidToken = errors.New("invalid or expired reset token")
+
+// Resets emails users who have forgotten their password a link to set a new
+// one. Each link carries a random token that works once; the store keeps
+// only its hash.
+type Resets struct {
+	publisher   events.Publisher
+	ttl         time.Duration
+	baseURL     string
+	maxRequests int
+	window      time.Duration
+}
+
+// NewResets sends links through publisher to notification-service, valid
+// for ttl. Links point at baseURL with the token in ?token=, for a page that
+// posts it to POST /auth/reset-password. An account is sent at most
+// maxRequests links within window.
+func NewResets(publisher events.Publisher, ttl time.Duration, baseURL string, maxRequests int, window time.Duration) *Resets {
+	return &Resets{publisher: publisher, ttl: ttl, baseURL: baseURL, maxRequests: maxRequests, window: window}
+}
+
+// newResetToken returns 256 random bits as hex, which HashCode leaves as
+// they are.
+func newResetToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// forgotPassword emails the account with the given email a reset link. It
+// answers 202 whether or not there is such an account, and whether or not
+// the account has been sent too many links already, so it cannot be used to
+// find accounts.
+func (h *Handler) forgotPassword(c *gin.Context) {
+	if h.resets == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "password reset is not enabled"})
+		return
+	}
+	var req struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	accepted := gin.H{"status": "if an account uses this email, a reset link has been sent to it"}
+
+	ctx := c.Request.Context()
+	id, err := h.store.UserID(ctx, req.Email)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := h.now()
+	sent, err := h.store.ResetsSince(ctx, id, now.Add(-h.resets.window))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if sent >= h.resets.maxRequests {
+		log.Printf("Not sending user %d another password reset link, %d sent in the last %s", id, sent, h.resets.window)
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+
+	token, err := newResetToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	expiresAt := now.Add(h.resets.ttl).UTC()
+	if err := h.store.CreateReset(ctx, id, HashCode(token), expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	e, err := events.New(events.UserPasswordResetRequested, "user-service", events.PasswordResetRequest{
+		UserID:    id,
+		Tenant:    tenant.FromContext(ctx),
+		Email:     req.Email,
+		URL:       h.resets.baseURL + "?token=" + token,
+		ExpiresAt: expiresAt,
+	})
+	if err == nil {
+		err = h.resets.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		// Answering differently here would tell the caller the account
+		// exists. The user can ask again once the broker is back.
+		log.Printf("Failed to send password reset link to user %d: %v", id, err)
+	}
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+// resetPassword sets a new password with a token from a reset link, and
+// signs the user out everywhere, since whoever had their old password may
+// still hold a session.
+func (h *Handler) resetPassword(c *gin.Context) {
+	if h.resets == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "password reset is not enabled"})
+		return
+	}
+	var req struct {
+		Token       string `json:"token" binding:"required"`
+		NewPassword string `json:"new_password" binding:"required,min=8,max=72"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revoked, err := h.store.ResetPassword(c.Request.Context(), HashCode(req.Token), string(hash))
+	if errors.Is(err, ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reset", "sessions_revoked": revoked})
+}
+
+func (s *PostgresStore) CreateReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "INSERT INTO user_service.password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)"
+	_, err := s.db.ExecContext(ctx, query, userID, tokenHash, expiresAt)
+	return err
+}
+
+func (s *PostgresStore) ResetsSince(ctx context.Context, userID int, since time.Time) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT COUNT(*) FROM user_service.password_resets WHERE user_id = $1 AND created_at > $2"
+	var n int
+	err := s.db.QueryRowContext(ctx, query, userID, since).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var revoked int
+	err := trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const use string = `UPDATE user_service.password_resets SET used_at = NOW()
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() RETURNING user_id`
+		var userID int
+		err := tx.QueryRowContext(ctx, use, tokenHash).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+
+		const setPassword string = "UPDATE user_service.users SET password_hash = $2 WHERE id = $1 AND status = 'active'"
+		res, err := tx.ExecContext(ctx, setPassword, userID, passwordHash)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrInvalidToken
+		}
+
+		// Links sent before this one would otherwise still set the password.
+		const expireOthers string = "UPDATE user_service.password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL"
+		if _, err := tx.ExecContext(ctx, expireOthers, userID); err != nil {
+			return err
+		}
+		const revoke string = "UPDATE user_service.sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL"
+		res, err = tx.ExecContext(ctx, revoke, userID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		revoked = int(n)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
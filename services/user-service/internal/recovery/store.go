@@ -0,0 +1,242 @@
+package recovery
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidCode is returned when a recovery code does not exist for the
+	// user or has already been used.
+	ErrInvalidCode = errors.New("invalid recovery code")
+)
+
+// Question is a security question with the bcrypt hash of its normalized
+// answer.
+type Question struct {
+	Question   string `json:"question"`
+	AnswerHash string `json:"-"`
+}
+
+type Store interface {
+	UserID(ctx context.Context, email string) (int, error)
+	PasswordHash(ctx context.Context, userID int) (string, error)
+	// ReplaceCodes discards the user's codes, used or not, and stores hashes
+	// as their new set.
+	ReplaceCodes(ctx context.Context, userID int, hashes []string) error
+	RemainingCodes(ctx context.Context, userID int) (int, error)
+	// HasCode reports whether the user has an unused code with codeHash.
+	HasCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	SetQuestions(ctx context.Context, userID int, questions []Question) error
+	// Questions returns the user's questions in the order they were set.
+	Questions(ctx context.Context, userID int) ([]Question, error)
+	// FailedAttempts counts failed recovery attempts for the user since the
+	// given time.
+	FailedAttempts(ctx context.Context, userID int, since time.Time) (int, error)
+	RecordAttempt(ctx context.Context, userID int, succeeded bool) error
+	// Recover uses up the code with codeHash, sets the password of the
+	// active user and revokes their sessions, atomically. It returns the
+	// number of sessions revoked.
+	Recover(ctx context.Context, userID int, codeHash, passwordHash string) (int, error)
+	// CreateReset stores the hash of a password reset token for the user.
+	CreateReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+	// ResetsSince counts the reset tokens created for the user since the
+	// given time.
+	ResetsSince(ctx context.Context, userID int, since time.Time) (int, error)
+	// ResetPassword uses up the live token with tokenHash, sets its user's
+	// password, expires their other tokens and revokes all their sessions,
+	// atomically. It returns the number of sessions revoked.
+	ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) UserID(ctx context.Context, email string) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT id FROM user_service.users WHERE email = $1 AND tenant_id = $2 AND status = 'active'"
+	var id int
+	err := s.db.QueryRowContext(ctx, query, email, tenant.FromContext(ctx)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (s *PostgresStore) PasswordHash(ctx context.Context, userID int) (string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT password_hash FROM user_service.users WHERE id = $1"
+	var hash string
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return hash, err
+}
+
+func (s *PostgresStore) ReplaceCodes(ctx context.Context, userID int, hashes []string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const clear string = "DELETE FROM user_service.recovery_codes WHERE user_id = $1"
+	if _, err := tx.ExecContext(ctx, clear, userID); err != nil {
+		return err
+	}
+	const insert string = "INSERT INTO user_service.recovery_codes (user_id, code_hash) VALUES ($1, $2)"
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, insert, userID, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RemainingCodes(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT COUNT(*) FROM user_service.recovery_codes WHERE user_id = $1 AND used_at IS NULL"
+	var n int
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) HasCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT EXISTS (SELECT 1 FROM user_service.recovery_codes
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL)`
+	var exists bool
+	err := s.db.QueryRowContext(ctx, query, userID, codeHash).Scan(&exists)
+	return exists, err
+}
+
+func (s *PostgresStore) SetQuestions(ctx context.Context, userID int, questions []Question) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const clear string = "DELETE FROM user_service.security_questions WHERE user_id = $1"
+		if _, err := tx.ExecContext(ctx, clear, userID); err != nil {
+			return err
+		}
+		const insert string = `INSERT INTO user_service.security_questions (user_id, position, question, answer_hash)
+			VALUES ($1, $2, $3, $4)`
+		for i, q := range questions {
+			if _, err := tx.ExecContext(ctx, insert, userID, i, q.Question, q.AnswerHash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStore) Questions(ctx context.Context, userID int) ([]Question, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT question, answer_hash FROM user_service.security_questions WHERE user_id = $1 ORDER BY position"
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	questions := []Question{}
+	for rows.Next() {
+		var q Question
+		if err := rows.Scan(&q.Question, &q.AnswerHash); err != nil {
+			return nil, err
+		}
+		questions = append(questions, q)
+	}
+	return questions, rows.Err()
+}
+
+func (s *PostgresStore) FailedAttempts(ctx context.Context, userID int, since time.Time) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT COUNT(*) FROM user_service.recovery_attempts
+		WHERE user_id = $1 AND NOT succeeded AND created_at > $2`
+	var n int
+	err := s.db.QueryRowContext(ctx, query, userID, since).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) RecordAttempt(ctx context.Context, userID int, succeeded bool) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "INSERT INTO user_service.recovery_attempts (user_id, succeeded) VALUES ($1, $2)"
+	_, err := s.db.ExecContext(ctx, query, userID, succeeded)
+	return err
+}
+
+func (s *PostgresStore) Recover(ctx context.Context, userID int, codeHash, passwordHash string) (int, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var revoked int
+	err := trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const use string = `UPDATE user_service.recovery_codes SET used_at = NOW()
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+		res, err := tx.ExecContext(ctx, use, userID, codeHash)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrInvalidCode
+		}
+
+		const setPassword string = "UPDATE user_service.users SET password_hash = $2 WHERE id = $1 AND status = 'active'"
+		res, err = tx.ExecContext(ctx, setPassword, userID, passwordHash)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrInvalidCode
+		}
+
+		// Whoever holds the lost password or second factor may still be signed in.
+		const revoke string = "UPDATE user_service.sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL"
+		res, err = tx.ExecContext(ctx, revoke, userID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		revoked = int(n)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
@@ -0,0 +1,76 @@
+package referrals
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+const referralsQueue = "user-service.referrals"
+
+// Consumer rewards referrers when the users they referred place their
+// first order, and takes the reward back if that order is cancelled.
+type Consumer struct {
+	store       Store
+	rewardCents int64
+}
+
+func NewConsumer(store Store, rewardCents int64) *Consumer {
+	return &Consumer{store: store, rewardCents: rewardCents}
+}
+
+// Run consumes events until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, subscriber events.Subscriber) error {
+	return subscriber.Subscribe(ctx, referralsQueue, []string{events.OrderPlaced, events.OrderCancelled}, c.Handle)
+}
+
+// Handle drops events it cannot decode, since retrying them cannot help.
+// Redelivered events change nothing, as the store records each first order
+// and reversal once.
+func (c *Consumer) Handle(ctx context.Context, e events.Event) error {
+	switch e.Type {
+	case events.OrderPlaced:
+		var o events.OrderPlacement
+		if err := e.Decode(&o); err != nil {
+			log.Printf("Dropping malformed %s event %s: %v", e.Type, e.ID, err)
+			return nil
+		}
+		at := e.OccurredAt
+		if at.IsZero() {
+			at = time.Now()
+		}
+		ref, err := c.store.FirstOrder(withTenant(ctx, o.Tenant), o.UserID, o.OrderID, at, c.rewardCents)
+		if err != nil {
+			return err
+		}
+		if ref != nil {
+			log.Printf("Credited user %d %d cents for referring user %d, who placed order %d", ref.ReferrerID, c.rewardCents, o.UserID, o.OrderID)
+		}
+	case events.OrderCancelled:
+		var o events.OrderCancellation
+		if err := e.Decode(&o); err != nil {
+			log.Printf("Dropping malformed %s event %s: %v", e.Type, e.ID, err)
+			return nil
+		}
+		ref, err := c.store.CancelOrder(withTenant(ctx, o.Tenant), o.UserID, o.OrderID)
+		if err != nil {
+			return err
+		}
+		if ref != nil {
+			log.Printf("Reversed user %d's referral credit for cancelled order %d", ref.ReferrerID, o.OrderID)
+		}
+	}
+	return nil
+}
+
+// withTenant scopes ctx to the event's tenant, or leaves it on the default
+// tenant for events published before they carried one.
+func withTenant(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return tenant.NewContext(ctx, id)
+}
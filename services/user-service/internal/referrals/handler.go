@@ -0,0 +1,215 @@
+package referrals
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+	// codeAlphabet leaves out 0, 1, I and O, which are easily misread when
+	// a code is shared by hand.
+	codeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	codeLength   = 8
+)
+
+type Handler struct {
+	store  Store
+	window time.Duration
+}
+
+// NewHandler lets users give a referral code up to window after their
+// account was created.
+func NewHandler(store Store, window time.Duration) *Handler {
+	return &Handler{store: store, window: window}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+// Users see their own referrals and credit; admins and services may act for
+// anyone.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/referrals", h.stats)
+	router.POST("/users/:id/referrer", h.attribute)
+	router.GET("/users/:id/credit", h.credits)
+}
+
+func userID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	return id, auth.AuthorizeUser(c, id)
+}
+
+func page(c *gin.Context) int {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if limit <= 0 || limit > maxLimit {
+		limit = defaultLimit
+	}
+	return limit
+}
+
+// generateCode returns a random code of codeLength characters, 40 bits.
+func generateCode() (string, error) {
+	buf := make([]byte, codeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, v := range buf {
+		buf[i] = codeAlphabet[int(v)%len(codeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// normalizeCode makes codes match regardless of case, spaces and dashes.
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+// stats returns the user's code, creating it on first use, with how their
+// referrals are doing and the users they referred, newest first. Pass
+// next_before from a page as ?before= to get the next one.
+func (h *Handler) stats(c *gin.Context) {
+	id, ok := userID(c)
+	if !ok {
+		return
+	}
+	before, err := strconv.Atoi(c.DefaultQuery("before", "0"))
+	if err != nil || before < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a user id"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	code, err := "", errCodeTaken
+	for attempt := 0; attempt < 3 && errors.Is(err, errCodeTaken); attempt++ {
+		var candidate string
+		if candidate, err = generateCode(); err == nil {
+			code, err = h.store.Code(ctx, id, candidate)
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stats, err := h.store.Stats(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stats.Code = code
+
+	limit := page(c)
+	referrals, err := h.store.Referrals(ctx, id, before, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"stats": stats, "referrals": referrals}
+	if len(referrals) > limit {
+		referrals = referrals[:limit]
+		resp["referrals"] = referrals
+		resp["next_before"] = referrals[limit-1].UserID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type attributeRequest struct {
+	Code string `json:"code" binding:"required,max=32"`
+}
+
+// attribute records who referred the user, from the code they were given.
+// It is meant for sign-up, so it is refused once the claim window has
+// passed or a referrer was already recorded.
+func (h *Handler) attribute(c *gin.Context) {
+	id, ok := userID(c)
+	if !ok {
+		return
+	}
+	var req attributeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	referral, err := h.store.Attribute(c.Request.Context(), id, normalizeCode(req.Code), h.window)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if errors.Is(err, ErrUnknownCode) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrAlreadyReferred) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrSelfReferral) || errors.Is(err, ErrClaimExpired) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("User %d was referred by user %d", referral.UserID, referral.ReferrerID)
+	c.JSON(http.StatusCreated, referral)
+}
+
+// credits pages through the user's store credit ledger newest first, with
+// the balance. Pass next_before from a page as ?before= to get the next one.
+func (h *Handler) credits(c *gin.Context) {
+	id, ok := userID(c)
+	if !ok {
+		return
+	}
+	before, err := strconv.ParseInt(c.DefaultQuery("before", "0"), 10, 64)
+	if err != nil || before < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a credit entry id"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	stats, err := h.store.Stats(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	limit := page(c)
+	credits, err := h.store.Credits(ctx, id, before, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"balance_cents": stats.BalanceCents, "credits": credits}
+	if len(credits) > limit {
+		credits = credits[:limit]
+		resp["credits"] = credits
+		resp["next_before"] = credits[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,240 @@
+package referrals
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps users 1 to 3 and 9; user 9 signed up long ago.
+type memStore struct {
+	codes     map[int]string
+	referrals map[int]*Referral
+	credits   []Credit
+}
+
+var signedUp = map[int]time.Time{1: time.Now(), 2: time.Now(), 3: time.Now(), 9: time.Now().AddDate(-1, 0, 0)}
+
+func newMemStore() *memStore {
+	return &memStore{codes: map[int]string{}, referrals: map[int]*Referral{}}
+}
+
+func (s *memStore) Code(ctx context.Context, userID int, candidate string) (string, error) {
+	if _, ok := signedUp[userID]; !ok {
+		return "", ErrNotFound
+	}
+	if code, ok := s.codes[userID]; ok {
+		return code, nil
+	}
+	s.codes[userID] = candidate
+	return candidate, nil
+}
+
+func (s *memStore) Attribute(ctx context.Context, userID int, code string, window time.Duration) (*Referral, error) {
+	createdAt, ok := signedUp[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	referrerID := 0
+	for id, c := range s.codes {
+		if c == code {
+			referrerID = id
+		}
+	}
+	if referrerID == 0 {
+		return nil, ErrUnknownCode
+	}
+	if referrerID == userID {
+		return nil, ErrSelfReferral
+	}
+	if time.Since(createdAt) > window {
+		return nil, ErrClaimExpired
+	}
+	if _, ok := s.referrals[userID]; ok {
+		return nil, ErrAlreadyReferred
+	}
+	r := &Referral{UserID: userID, ReferrerID: referrerID, ReferredAt: time.Now()}
+	s.referrals[userID] = r
+	return r, nil
+}
+
+func (s *memStore) credited(reason string, orderID int) bool {
+	for _, c := range s.credits {
+		if c.Reason == reason && *c.OrderID == orderID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memStore) credit(userID int, amountCents int64, reason string, orderID int) {
+	if !s.credited(reason, orderID) {
+		s.credits = append(s.credits, Credit{ID: int64(len(s.credits) + 1), UserID: userID, AmountCents: amountCents, Reason: reason, OrderID: &orderID})
+	}
+}
+
+func (s *memStore) FirstOrder(ctx context.Context, userID, orderID int, at time.Time, rewardCents int64) (*Referral, error) {
+	r, ok := s.referrals[userID]
+	if !ok || r.FirstOrderID != nil || s.credited(ReasonReferralReversed, orderID) {
+		return nil, nil
+	}
+	r.FirstOrderID, r.FirstOrderedAt, r.RewardCents = &orderID, &at, rewardCents
+	s.credit(r.ReferrerID, rewardCents, ReasonReferral, orderID)
+	return r, nil
+}
+
+func (s *memStore) CancelOrder(ctx context.Context, userID, orderID int) (*Referral, error) {
+	r, ok := s.referrals[userID]
+	if !ok || r.FirstOrderID == nil || *r.FirstOrderID != orderID {
+		return nil, nil
+	}
+	s.credit(r.ReferrerID, -r.RewardCents, ReasonReferralReversed, orderID)
+	r.FirstOrderID, r.FirstOrderedAt, r.RewardCents = nil, nil, 0
+	return r, nil
+}
+
+func (s *memStore) Stats(ctx context.Context, userID int) (*Stats, error) {
+	if _, ok := signedUp[userID]; !ok {
+		return nil, ErrNotFound
+	}
+	st := &Stats{Code: s.codes[userID]}
+	for _, r := range s.referrals {
+		if r.ReferrerID != userID {
+			continue
+		}
+		st.Referred++
+		if r.FirstOrderID != nil {
+			st.Ordered++
+		}
+		st.RewardedCents += r.RewardCents
+	}
+	for _, c := range s.credits {
+		if c.UserID == userID {
+			st.BalanceCents += c.AmountCents
+		}
+	}
+	return st, nil
+}
+
+func (s *memStore) Referrals(ctx context.Context, userID, before, limit int) ([]Referral, error) {
+	referrals := []Referral{}
+	for id := 100; id > 0 && len(referrals) < limit; id-- {
+		if r, ok := s.referrals[id]; ok && r.ReferrerID == userID && (before == 0 || id < before) {
+			referrals = append(referrals, *r)
+		}
+	}
+	return referrals, nil
+}
+
+func (s *memStore) Credits(ctx context.Context, userID int, before int64, limit int) ([]Credit, error) {
+	credits := []Credit{}
+	for i := len(s.credits) - 1; i >= 0 && len(credits) < limit; i-- {
+		if c := s.credits[i]; c.UserID == userID && (before == 0 || c.ID < before) {
+			credits = append(credits, c)
+		}
+	}
+	return credits, nil
+}
+
+func event(t *testing.T, eventType string, data any) events.Event {
+	t.Helper()
+	e, err := events.New(eventType, "test", data)
+	if err != nil {
+		t.Fatalf("Failed to build event: %v", err)
+	}
+	return e
+}
+
+func TestReferrals(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newMemStore()
+	do := func(userID int, method, path, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			auth.WithPrincipal(c, &auth.Principal{UserID: userID, Roles: []string{auth.RoleCustomer}})
+		})
+		NewHandler(store, 30*24*time.Hour).RegisterRoutes(router)
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(1, http.MethodGet, "/users/1/referrals", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d %s", w.Code, w.Body)
+	}
+	code := store.codes[1]
+	if len(code) != codeLength {
+		t.Fatalf("Expected a %d character code, got: %q", codeLength, code)
+	}
+	do(1, http.MethodGet, "/users/1/referrals", "")
+	if store.codes[1] != code {
+		t.Errorf("Expected the code to stay %s, got: %s", code, store.codes[1])
+	}
+	do(9, http.MethodGet, "/users/9/referrals", "")
+
+	spaced := strings.ToLower(code[:4]) + "-" + code[4:]
+	tests := []struct {
+		userID int
+		path   string
+		code   string
+		want   int
+	}{
+		{userID: 2, path: "/users/2/referrer", code: spaced, want: http.StatusCreated},
+		{userID: 2, path: "/users/2/referrer", code: code, want: http.StatusConflict},
+		{userID: 3, path: "/users/3/referrer", code: "NOPE2345", want: http.StatusNotFound},
+		{userID: 1, path: "/users/1/referrer", code: code, want: http.StatusUnprocessableEntity},
+		{userID: 9, path: "/users/9/referrer", code: code, want: http.StatusUnprocessableEntity},
+		{userID: 3, path: "/users/2/referrer", code: code, want: http.StatusForbidden},
+		{userID: 3, path: "/users/3/referrer", code: store.codes[9], want: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if w := do(tt.userID, http.MethodPost, tt.path, `{"code": "`+tt.code+`"}`); w.Code != tt.want {
+			t.Errorf("User %d POST %s with %s: expected status %d, got: %d %s", tt.userID, tt.path, tt.code, tt.want, w.Code, w.Body)
+		}
+	}
+
+	consumer := NewConsumer(store, 1000)
+	for _, e := range []events.Event{
+		event(t, events.OrderPlaced, events.OrderPlacement{OrderID: 70, UserID: 2}),
+		event(t, events.OrderPlaced, events.OrderPlacement{OrderID: 70, UserID: 2}),
+		event(t, events.OrderPlaced, events.OrderPlacement{OrderID: 71, UserID: 2}),
+		event(t, events.OrderPlaced, events.OrderPlacement{OrderID: 80, UserID: 3}),
+		event(t, events.OrderCancelled, events.OrderCancellation{OrderID: 80, UserID: 3}),
+		event(t, events.OrderPlaced, events.OrderPlacement{OrderID: 80, UserID: 3}),
+		event(t, events.OrderPlaced, events.OrderPlacement{OrderID: 5, UserID: 1}),
+	} {
+		if err := consumer.Handle(context.Background(), e); err != nil {
+			t.Fatalf("Expected %s to be handled, got: %v", e.Type, err)
+		}
+	}
+	if id := store.referrals[2].FirstOrderID; id == nil || *id != 70 {
+		t.Errorf("Expected order 70 to be user 2's first order, got: %v", id)
+	}
+	if store.referrals[3].FirstOrderID != nil {
+		t.Errorf("Expected the cancelled order not to count, even when redelivered, got: %v", *store.referrals[3].FirstOrderID)
+	}
+
+	w := do(1, http.MethodGet, "/users/1/referrals", "")
+	if want := `"stats":{"code":"` + code + `","referred":1,"ordered":1,"rewarded_cents":1000,"credit_balance_cents":1000}`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Expected stats %s, got: %s", want, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"user_id":2,"referrer_id":1`) {
+		t.Errorf("Expected user 2 among user 1's referrals, got: %s", w.Body)
+	}
+	w = do(9, http.MethodGet, "/users/9/credit?limit=1", "")
+	if !strings.Contains(w.Body.String(), `"balance_cents":0`) || !strings.Contains(w.Body.String(), `"reason":"referral_reversed"`) || !strings.Contains(w.Body.String(), `"next_before":3`) {
+		t.Errorf("Expected the reversed reward to leave a zero balance, got: %s", w.Body)
+	}
+	if w := do(4, http.MethodGet, "/users/4/credit", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown user, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,328 @@
+// Package referrals runs the referral program. Each user has a code to
+// share; a new user who gives one within the claim window is attributed
+// to its owner, and when they place their first order the referrer earns
+// store credit. First orders come from order-service's events, so rewards
+// trail the orders by however long the events take to arrive.
+package referrals
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrNotFound        = errors.New("user not found")
+	ErrUnknownCode     = errors.New("unknown referral code")
+	ErrSelfReferral    = errors.New("users cannot refer themselves")
+	ErrAlreadyReferred = errors.New("user was already referred")
+	ErrClaimExpired    = errors.New("referral codes can only be given shortly after signing up")
+	errCodeTaken       = errors.New("referral code already taken")
+)
+
+// Reasons a store credit entry was made for.
+const (
+	ReasonReferral         = "referral"
+	ReasonReferralReversed = "referral_reversed"
+)
+
+// Referral is a user signing up with another user's code. FirstOrderID is
+// set once they place an order, and RewardCents is what their referrer
+// was credited for it.
+type Referral struct {
+	UserID         int        `json:"user_id"`
+	ReferrerID     int        `json:"referrer_id"`
+	ReferredAt     time.Time  `json:"referred_at"`
+	FirstOrderID   *int       `json:"first_order_id,omitempty"`
+	FirstOrderedAt *time.Time `json:"first_ordered_at,omitempty"`
+	RewardCents    int64      `json:"reward_cents"`
+}
+
+// Stats sums up a referrer's program: how many users signed up with their
+// code, how many of those went on to order, and what they earned.
+type Stats struct {
+	Code          string `json:"code"`
+	Referred      int    `json:"referred"`
+	Ordered       int    `json:"ordered"`
+	RewardedCents int64  `json:"rewarded_cents"`
+	BalanceCents  int64  `json:"credit_balance_cents"`
+}
+
+// Credit is an entry in a user's store credit ledger. Rewards are
+// positive and reversals negative; the balance is their sum.
+type Credit struct {
+	ID          int64     `json:"id"`
+	UserID      int       `json:"user_id"`
+	AmountCents int64     `json:"amount_cents"`
+	Reason      string    `json:"reason"`
+	OrderID     *int      `json:"order_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Store interface {
+	// Code returns the user's referral code, saving candidate as it if they
+	// have none yet. It returns errCodeTaken if another user holds
+	// candidate.
+	Code(ctx context.Context, userID int, candidate string) (string, error)
+	// Attribute records userID as referred by the owner of code, if
+	// userID signed up within window and was not referred before.
+	Attribute(ctx context.Context, userID int, code string, window time.Duration) (*Referral, error)
+	// FirstOrder marks orderID as the referred user's first order and
+	// credits their referrer rewardCents, both at most once. It returns
+	// nil if the user was not referred or already has a first order.
+	FirstOrder(ctx context.Context, userID, orderID int, at time.Time, rewardCents int64) (*Referral, error)
+	// CancelOrder reverses the reward for orderID if it was a referred
+	// user's first order, so their next order counts instead. It returns
+	// nil if there was nothing to reverse.
+	CancelOrder(ctx context.Context, userID, orderID int) (*Referral, error)
+	Stats(ctx context.Context, userID int) (*Stats, error)
+	// Referrals lists the users userID referred, newest first, before the
+	// given user ID (0 starts from the newest).
+	Referrals(ctx context.Context, userID, before, limit int) ([]Referral, error)
+	// Credits pages through userID's ledger newest first, before the given
+	// entry ID (0 starts from the newest).
+	Credits(ctx context.Context, userID int, before int64, limit int) ([]Credit, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Code(ctx context.Context, userID int, candidate string) (string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const insert string = `INSERT INTO user_service.referral_codes (user_id, tenant_id, code)
+		SELECT id, tenant_id, $3 FROM user_service.users WHERE id = $1 AND tenant_id = $2 AND status = 'active'
+		ON CONFLICT (user_id) DO NOTHING`
+	if _, err := s.db.ExecContext(ctx, insert, userID, tenant.FromContext(ctx), candidate); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return "", errCodeTaken
+		}
+		return "", err
+	}
+
+	const query string = `SELECT r.code FROM user_service.referral_codes r
+		JOIN user_service.users u ON u.id = r.user_id AND u.tenant_id = $2 AND u.status = 'active'
+		WHERE r.user_id = $1`
+	var code string
+	err := s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)).Scan(&code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return code, err
+}
+
+func (s *PostgresStore) Attribute(ctx context.Context, userID int, code string, window time.Duration) (*Referral, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tenantID := tenant.FromContext(ctx)
+	var createdAt time.Time
+	const user string = `SELECT created_at FROM user_service.users WHERE id = $1 AND tenant_id = $2 AND status = 'active'`
+	if err := tx.QueryRowContext(ctx, user, userID, tenantID).Scan(&createdAt); errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var referrerID int
+	const owner string = `SELECT r.user_id FROM user_service.referral_codes r
+		JOIN user_service.users u ON u.id = r.user_id AND u.status = 'active'
+		WHERE r.tenant_id = $1 AND r.code = $2`
+	if err := tx.QueryRowContext(ctx, owner, tenantID, code).Scan(&referrerID); errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownCode
+	} else if err != nil {
+		return nil, err
+	}
+	if referrerID == userID {
+		return nil, ErrSelfReferral
+	}
+	if time.Since(createdAt) > window {
+		return nil, ErrClaimExpired
+	}
+
+	r := &Referral{UserID: userID, ReferrerID: referrerID}
+	const insert string = `INSERT INTO user_service.referrals (user_id, referrer_id) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO NOTHING RETURNING referred_at`
+	if err := tx.QueryRowContext(ctx, insert, userID, referrerID).Scan(&r.ReferredAt); errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAlreadyReferred
+	} else if err != nil {
+		return nil, err
+	}
+	return r, tx.Commit()
+}
+
+func (s *PostgresStore) FirstOrder(ctx context.Context, userID, orderID int, at time.Time, rewardCents int64) (*Referral, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// An order whose reward was reversed never counts again, even if its
+	// placement is redelivered after the cancellation.
+	const update string = `UPDATE user_service.referrals r
+		SET first_order_id = $3, first_ordered_at = $4, reward_cents = $5
+		FROM user_service.users u
+		WHERE r.user_id = $1 AND u.id = r.user_id AND u.tenant_id = $2 AND r.first_order_id IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM user_service.store_credit WHERE reason = 'referral_reversed' AND order_id = $3)
+		RETURNING r.referrer_id, r.referred_at`
+	ref := &Referral{UserID: userID, FirstOrderID: &orderID, FirstOrderedAt: &at, RewardCents: rewardCents}
+	err = tx.QueryRowContext(ctx, update, userID, tenant.FromContext(ctx), orderID, at, rewardCents).Scan(&ref.ReferrerID, &ref.ReferredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := credit(ctx, tx, ref.ReferrerID, rewardCents, ReasonReferral, orderID); err != nil {
+		return nil, err
+	}
+	return ref, tx.Commit()
+}
+
+func (s *PostgresStore) CancelOrder(ctx context.Context, userID, orderID int) (*Referral, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const query string = `SELECT r.referrer_id, r.referred_at, r.reward_cents FROM user_service.referrals r
+		JOIN user_service.users u ON u.id = r.user_id AND u.tenant_id = $2
+		WHERE r.user_id = $1 AND r.first_order_id = $3
+		FOR UPDATE OF r`
+	ref := &Referral{UserID: userID}
+	var reward int64
+	err = tx.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx), orderID).Scan(&ref.ReferrerID, &ref.ReferredAt, &reward)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	const update string = `UPDATE user_service.referrals SET first_order_id = NULL, first_ordered_at = NULL, reward_cents = 0
+		WHERE user_id = $1`
+	if _, err := tx.ExecContext(ctx, update, userID); err != nil {
+		return nil, err
+	}
+	if err := credit(ctx, tx, ref.ReferrerID, -reward, ReasonReferralReversed, orderID); err != nil {
+		return nil, err
+	}
+	return ref, tx.Commit()
+}
+
+// credit adds a ledger entry, at most one per reason and order.
+func credit(ctx context.Context, tx *sql.Tx, userID int, amountCents int64, reason string, orderID int) error {
+	const query string = `INSERT INTO user_service.store_credit (user_id, amount_cents, reason, order_id)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (reason, order_id) DO NOTHING`
+	_, err := tx.ExecContext(ctx, query, userID, amountCents, reason, orderID)
+	return err
+}
+
+func (s *PostgresStore) Stats(ctx context.Context, userID int) (*Stats, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT COALESCE((SELECT code FROM user_service.referral_codes WHERE user_id = u.id), ''),
+			(SELECT COUNT(*) FROM user_service.referrals WHERE referrer_id = u.id),
+			(SELECT COUNT(*) FROM user_service.referrals WHERE referrer_id = u.id AND first_order_id IS NOT NULL),
+			(SELECT COALESCE(SUM(reward_cents), 0) FROM user_service.referrals WHERE referrer_id = u.id),
+			(SELECT COALESCE(SUM(amount_cents), 0) FROM user_service.store_credit WHERE user_id = u.id)
+		FROM user_service.users u WHERE u.id = $1 AND u.tenant_id = $2 AND u.status <> 'deleted'`
+	var st Stats
+	err := s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)).Scan(&st.Code, &st.Referred, &st.Ordered, &st.RewardedCents, &st.BalanceCents)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *PostgresStore) Referrals(ctx context.Context, userID, before, limit int) ([]Referral, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT r.user_id, r.referrer_id, r.referred_at, r.first_order_id, r.first_ordered_at, r.reward_cents
+		FROM user_service.referrals r
+		JOIN user_service.users u ON u.id = r.referrer_id AND u.tenant_id = $2
+		WHERE r.referrer_id = $1 AND ($3 = 0 OR r.user_id < $3)
+		ORDER BY r.user_id DESC LIMIT $4`
+	rows, err := s.db.QueryContext(ctx, query, userID, tenant.FromContext(ctx), before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referrals := []Referral{}
+	for rows.Next() {
+		var r Referral
+		var orderID sql.NullInt64
+		var orderedAt sql.NullTime
+		if err := rows.Scan(&r.UserID, &r.ReferrerID, &r.ReferredAt, &orderID, &orderedAt, &r.RewardCents); err != nil {
+			return nil, err
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			r.FirstOrderID, r.FirstOrderedAt = &id, &orderedAt.Time
+		}
+		referrals = append(referrals, r)
+	}
+	return referrals, rows.Err()
+}
+
+func (s *PostgresStore) Credits(ctx context.Context, userID int, before int64, limit int) ([]Credit, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT c.id, c.user_id, c.amount_cents, c.reason, c.order_id, c.created_at
+		FROM user_service.store_credit c
+		JOIN user_service.users u ON u.id = c.user_id AND u.tenant_id = $2
+		WHERE c.user_id = $1 AND ($3 = 0 OR c.id < $3)
+		ORDER BY c.id DESC LIMIT $4`
+	rows, err := s.db.QueryContext(ctx, query, userID, tenant.FromContext(ctx), before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := []Credit{}
+	for rows.Next() {
+		var c Credit
+		var orderID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.UserID, &c.AmountCents, &c.Reason, &orderID, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			c.OrderID = &id
+		}
+		credits = append(credits, c)
+	}
+	return credits, rows.Err()
+}
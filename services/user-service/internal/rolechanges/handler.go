@@ -0,0 +1,190 @@
+package rolechanges
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultResultsLimit = 100
+	maxResultsLimit     = 1000
+)
+
+type Handler struct {
+	store  Store
+	worker *Worker
+}
+
+func NewHandler(store Store, worker *Worker) *Handler {
+	return &Handler{store: store, worker: worker}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes. Only
+// admins can change roles in bulk.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	admin := auth.RequireRole(auth.RoleAdmin)
+	router.GET("/role-changes", admin, h.list)
+	router.POST("/role-changes", admin, h.create)
+	router.GET("/role-changes/:id", admin, h.get)
+	router.GET("/role-changes/:id/results", admin, h.results)
+	router.POST("/role-changes/:id/rollback", admin, h.rollback)
+}
+
+type createRequest struct {
+	Action string `json:"action" binding:"required,oneof=grant revoke"`
+	Role   string `json:"role" binding:"required"`
+	Filter Filter `json:"filter"`
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+func (h *Handler) create(c *gin.Context) {
+	var req createRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Users may lose the service role in bulk but never be granted it.
+	roles := auth.Roles
+	if req.Action == ActionGrant {
+		roles = auth.GrantableRoles
+	}
+	if !slices.Contains(roles, req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of " + strings.Join(roles, ", ")})
+		return
+	}
+	if req.Filter.HasRole != "" && !auth.ValidRole(req.Filter.HasRole) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filter has_role must be one of " + strings.Join(auth.Roles, ", ")})
+		return
+	}
+	// An empty filter would match every user in the tenant, which is more
+	// likely a mistake than a request.
+	if req.Filter.OrgID == nil && req.Filter.HasRole == "" && len(req.Filter.UserIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filter must set org_id, has_role or user_ids"})
+		return
+	}
+
+	j := &Job{Action: req.Action, Role: req.Role, Filter: req.Filter, Reason: strings.TrimSpace(req.Reason), Actor: actor(c)}
+	err := h.store.Create(c.Request.Context(), j)
+	if errors.Is(err, ErrNoUsers) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "no active users match the filter"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.worker.Enqueue(*j)
+	c.JSON(http.StatusAccepted, j)
+}
+
+func (h *Handler) list(c *gin.Context) {
+	jobs, err := h.store.List(c.Request.Context(), 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"role_changes": jobs})
+}
+
+func paramID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role change id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	j, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role change not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, j)
+}
+
+// results pages through a job's per-user results by user ID. Pass the last
+// user_id of a page as ?after= to get the next one.
+func (h *Handler) results(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	status := c.Query("status")
+	switch status {
+	case "", ResultPending, ResultApplied, ResultUnchanged, ResultFailed, ResultRolledBack:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, applied, unchanged, failed or rolled_back"})
+		return
+	}
+	after, _ := strconv.Atoi(c.Query("after"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultResultsLimit)))
+	if limit <= 0 || limit > maxResultsLimit {
+		limit = defaultResultsLimit
+	}
+
+	ctx := c.Request.Context()
+	if _, err := h.store.Get(ctx, id); errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role change not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	results, err := h.store.Results(ctx, id, status, after, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// rollback reverses a completed job for the users it changed. Users it left
+// unchanged, because they already had (or lacked) the role, are not touched.
+func (h *Handler) rollback(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		return
+	}
+	j, err := h.store.StartRollback(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role change not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": "only completed role changes can be rolled back"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.worker.Enqueue(*j)
+	c.JSON(http.StatusAccepted, j)
+}
+
+func actor(c *gin.Context) string {
+	p, ok := auth.FromContext(c)
+	if !ok {
+		return "anonymous"
+	}
+	if p.Service != "" {
+		return "service:" + p.Service
+	}
+	return "user:" + strconv.Itoa(p.UserID)
+}
@@ -0,0 +1,240 @@
+package rolechanges
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/gin-gonic/gin"
+)
+
+type memUser struct {
+	orgID   int
+	deleted bool
+	roles   map[string]bool
+}
+
+// memStore applies the same result rules as PostgresStore.Step.
+type memStore struct {
+	Store
+	users   map[int]*memUser
+	jobs    map[int]*Job
+	results map[int]map[int]*Result
+	// eraseAfterMatch is deleted once a job has matched them, as if erased
+	// before the worker got to them.
+	eraseAfterMatch int
+}
+
+func (s *memStore) Create(ctx context.Context, j *Job) error {
+	j.ID, j.Status = len(s.jobs)+1, StatusRunning
+	results := map[int]*Result{}
+	for id, u := range s.users {
+		if !u.deleted && (j.Filter.OrgID == nil || u.orgID == *j.Filter.OrgID) && (j.Filter.HasRole == "" || u.roles[j.Filter.HasRole]) {
+			results[id] = &Result{UserID: id, Status: ResultPending}
+		}
+	}
+	if len(results) == 0 {
+		return ErrNoUsers
+	}
+	j.Total = len(results)
+	if u, ok := s.users[s.eraseAfterMatch]; ok {
+		u.deleted = true
+	}
+	stored := *j
+	s.jobs[j.ID], s.results[j.ID] = &stored, results
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, id int) (*Job, error) {
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *j
+	out.Progress = Progress{}
+	for _, r := range s.results[id] {
+		switch r.Status {
+		case ResultPending:
+			out.Progress.Pending++
+		case ResultApplied:
+			out.Progress.Applied++
+		case ResultUnchanged:
+			out.Progress.Unchanged++
+		case ResultFailed:
+			out.Progress.Failed++
+		case ResultRolledBack:
+			out.Progress.RolledBack++
+		}
+	}
+	return &out, nil
+}
+
+func (s *memStore) Results(ctx context.Context, jobID int, status string, afterUserID, limit int) ([]Result, error) {
+	out := []Result{}
+	for _, r := range s.results[jobID] {
+		if (status == "" || r.Status == status) && r.UserID > afterUserID {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].UserID < out[k].UserID })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *memStore) Step(ctx context.Context, j *Job, limit int) ([]Result, error) {
+	from := ResultPending
+	if j.Status == StatusRollingBack {
+		from = ResultApplied
+	}
+	pending, _ := s.Results(ctx, j.ID, from, 0, limit)
+	for i := range pending {
+		r, u := &pending[i], s.users[pending[i].UserID]
+		grant := (j.Action == ActionGrant) != (j.Status == StatusRollingBack)
+		switch {
+		case u.deleted:
+			r.Status, r.Error = ResultFailed, "user is deleted"
+		case j.Status == StatusRollingBack:
+			u.roles[j.Role] = grant
+			r.Status = ResultRolledBack
+		case u.roles[j.Role] == grant:
+			r.Status = ResultUnchanged
+		default:
+			u.roles[j.Role] = grant
+			r.Status = ResultApplied
+		}
+		*s.results[j.ID][r.UserID] = *r
+	}
+	return pending, nil
+}
+
+func (s *memStore) Finish(ctx context.Context, j *Job) error {
+	j.Status = map[string]string{StatusRunning: StatusCompleted, StatusRollingBack: StatusRolledBack}[j.Status]
+	s.jobs[j.ID].Status = j.Status
+	return nil
+}
+
+func (s *memStore) StartRollback(ctx context.Context, id int) (*Job, error) {
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if j.Status != StatusCompleted {
+		return nil, ErrInvalidState
+	}
+	j.Status = StatusRollingBack
+	return s.Get(ctx, id)
+}
+
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.events = append(p.events, e)
+	return nil
+}
+
+func TestBulkRoleChange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{
+		users: map[int]*memUser{
+			1: {orgID: 1, roles: map[string]bool{auth.RoleCustomer: true}},
+			2: {orgID: 1, roles: map[string]bool{auth.RoleCustomer: true, auth.RoleAdmin: true}},
+			3: {orgID: 2, roles: map[string]bool{auth.RoleCustomer: true}},
+			4: {orgID: 1, roles: map[string]bool{auth.RoleCustomer: true}},
+		},
+		jobs:            map[int]*Job{},
+		results:         map[int]map[int]*Result{},
+		eraseAfterMatch: 4,
+	}
+	publisher := &recordingPublisher{}
+	admin := &auth.Principal{UserID: 2, Roles: []string{auth.RoleAdmin}}
+
+	// do serves one request, then drains whatever it queued.
+	do := func(p *auth.Principal, method, path, body string) *httptest.ResponseRecorder {
+		runner := jobs.New()
+		worker := NewWorker(store, publisher, runner.Queue("role-changes", 1, 10))
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store, worker).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		runner.Start(context.Background())
+		if err := runner.Stop(context.Background()); err != nil {
+			t.Fatalf("Expected queued work to finish, got: %v", err)
+		}
+		return w
+	}
+
+	w := do(admin, http.MethodPost, "/role-changes", `{"action": "grant", "role": "admin", "filter": {"org_id": 1}, "reason": "acme staff"}`)
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"total":3`) {
+		t.Fatalf("Expected the job to cover the three users in org 1, got: %d %s", w.Code, w.Body)
+	}
+
+	var job Job
+	json.Unmarshal(do(admin, http.MethodGet, "/role-changes/1", "").Body.Bytes(), &job)
+	want := Progress{Applied: 1, Unchanged: 1, Failed: 1}
+	if job.Status != StatusCompleted || job.Progress != want {
+		t.Errorf("Expected a completed job with %+v, got: %s %+v", want, job.Status, job.Progress)
+	}
+	if !store.users[1].roles[auth.RoleAdmin] || store.users[3].roles[auth.RoleAdmin] {
+		t.Errorf("Expected only user 1 to be granted admin")
+	}
+	if w := do(admin, http.MethodGet, "/role-changes/1/results?status=failed", ""); !strings.Contains(w.Body.String(), `"user_id":4,"status":"failed","error":"user is deleted"`) {
+		t.Errorf("Expected user 4's failure in the results, got: %s", w.Body)
+	}
+
+	if w := do(admin, http.MethodPost, "/role-changes/1/rollback", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got: %d %s", w.Code, w.Body)
+	}
+	if store.users[1].roles[auth.RoleAdmin] || !store.users[2].roles[auth.RoleAdmin] {
+		t.Errorf("Expected the rollback to revoke admin from user 1 only")
+	}
+	if store.jobs[1].Status != StatusRolledBack {
+		t.Errorf("Expected the job to be rolled back, got: %s", store.jobs[1].Status)
+	}
+	if w := do(admin, http.MethodPost, "/role-changes/1/rollback", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 rolling back twice, got: %d", w.Code)
+	}
+
+	if len(publisher.events) != 2 {
+		t.Fatalf("Expected a grant and a rollback event, got: %d", len(publisher.events))
+	}
+	var granted, rolledBack events.RoleChanged
+	publisher.events[0].Decode(&granted)
+	publisher.events[1].Decode(&rolledBack)
+	if granted.UserID != 1 || !granted.Granted || granted.Actor != "user:2" || granted.Reason != "acme staff" {
+		t.Errorf("Expected user 1 to be granted admin by user:2, got: %+v", granted)
+	}
+	if rolledBack.UserID != 1 || rolledBack.Granted || !rolledBack.RolledBack {
+		t.Errorf("Expected the grant to user 1 to be rolled back, got: %+v", rolledBack)
+	}
+
+	tests := []struct {
+		principal *auth.Principal
+		body      string
+		want      int
+	}{
+		{principal: admin, body: `{"action": "grant", "role": "admin", "filter": {}, "reason": "everyone"}`, want: http.StatusBadRequest},
+		{principal: admin, body: `{"action": "grant", "role": "owner", "filter": {"org_id": 1}, "reason": "acme staff"}`, want: http.StatusBadRequest},
+		{principal: admin, body: `{"action": "grant", "role": "service", "filter": {"org_id": 1}, "reason": "acme staff"}`, want: http.StatusBadRequest},
+		{principal: admin, body: `{"action": "revoke", "role": "service", "filter": {"org_id": 9}, "reason": "no such org"}`, want: http.StatusUnprocessableEntity},
+		{principal: admin, body: `{"action": "revoke", "role": "admin", "filter": {"org_id": 1}}`, want: http.StatusBadRequest},
+		{principal: admin, body: `{"action": "revoke", "role": "admin", "filter": {"org_id": 9}, "reason": "no such org"}`, want: http.StatusUnprocessableEntity},
+		{principal: &auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}, body: `{"action": "grant", "role": "admin", "filter": {"org_id": 1}, "reason": "me"}`, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := do(tt.principal, http.MethodPost, "/role-changes", tt.body); w.Code != tt.want {
+			t.Errorf("POST %s: expected status %d, got: %d %s", tt.body, tt.want, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+// Package rolechanges grants or revokes a role for every user a filter
+// matches, such as all users in an organization. The matched users are
+// fixed when the change is created, then worked through in the background
+// with a result recorded per user, so a change can be followed while it runs
+// and rolled back afterwards.
+package rolechanges
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+	"github.com/lib/pq"
+)
+
+const (
+	ActionGrant  = "grant"
+	ActionRevoke = "revoke"
+)
+
+// Job statuses. A running job becomes completed once every user has a
+// result; a rollback moves a completed job through rolling_back to
+// rolled_back.
+const (
+	StatusRunning     = "running"
+	StatusCompleted   = "completed"
+	StatusRollingBack = "rolling_back"
+	StatusRolledBack  = "rolled_back"
+)
+
+// Result statuses. Only applied results changed a user's roles, so they are
+// the ones a rollback reverses.
+const (
+	ResultPending    = "pending"
+	ResultApplied    = "applied"
+	ResultUnchanged  = "unchanged"
+	ResultFailed     = "failed"
+	ResultRolledBack = "rolled_back"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrNoUsers is returned when a new job's filter matches no active
+	// users.
+	ErrNoUsers = errors.New("no users match")
+	// ErrInvalidState is returned when a job is not in a status that allows
+	// the requested change.
+	ErrInvalidState = errors.New("invalid job state")
+)
+
+// Filter selects active users in the current tenant. Every field that is
+// set must match.
+type Filter struct {
+	OrgID   *int   `json:"org_id,omitempty"`
+	HasRole string `json:"has_role,omitempty"`
+	UserIDs []int  `json:"user_ids,omitempty"`
+}
+
+// Progress counts a job's users by result status.
+type Progress struct {
+	Pending    int `json:"pending"`
+	Applied    int `json:"applied"`
+	Unchanged  int `json:"unchanged"`
+	Failed     int `json:"failed"`
+	RolledBack int `json:"rolled_back"`
+}
+
+type Job struct {
+	ID          int        `json:"id"`
+	Action      string     `json:"action"`
+	Role        string     `json:"role"`
+	Filter      Filter     `json:"filter"`
+	Reason      string     `json:"reason"`
+	Actor       string     `json:"actor"`
+	Status      string     `json:"status"`
+	Total       int        `json:"total"`
+	Progress    Progress   `json:"progress"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type Result struct {
+	UserID    int       `json:"user_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Store interface {
+	// Create records j and a pending result for every user its filter
+	// matches, setting j.ID, j.Total and j.Status.
+	Create(ctx context.Context, j *Job) error
+	Get(ctx context.Context, id int) (*Job, error)
+	// List returns up to limit jobs, newest first.
+	List(ctx context.Context, limit int) ([]Job, error)
+	// Results returns up to limit of the job's results with a user ID above
+	// afterUserID, by user ID. An empty status returns every result.
+	Results(ctx context.Context, jobID int, status string, afterUserID, limit int) ([]Result, error)
+	// Unfinished returns running and rolling back jobs in every tenant, for
+	// the worker to resume.
+	Unfinished(ctx context.Context, limit int) ([]Job, error)
+	// Step works through up to limit of the job's outstanding users in one
+	// transaction: pending ones while it is running, applied ones while it
+	// is rolling back. It returns the results it recorded.
+	Step(ctx context.Context, j *Job, limit int) ([]Result, error)
+	// Finish moves a job whose users all have a result to completed or
+	// rolled_back. It returns ErrInvalidState while work is outstanding.
+	Finish(ctx context.Context, j *Job) error
+	// StartRollback moves a completed job to rolling_back.
+	StartRollback(ctx context.Context, id int) (*Job, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Create(ctx context.Context, j *Job) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	filter, err := json.Marshal(j.Filter)
+	if err != nil {
+		return err
+	}
+	userIDs := make(pq.Int64Array, 0, len(j.Filter.UserIDs))
+	for _, id := range j.Filter.UserIDs {
+		userIDs = append(userIDs, int64(id))
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const insert string = `INSERT INTO user_service.role_change_jobs (tenant_id, action, role, filter, reason, actor, total)
+		VALUES ($1, $2, $3, $4, $5, $6, 0) RETURNING id, status, created_at, updated_at`
+	if err := tx.QueryRowContext(ctx, insert, tenant.FromContext(ctx), j.Action, j.Role, filter, j.Reason, j.Actor).
+		Scan(&j.ID, &j.Status, &j.CreatedAt, &j.UpdatedAt); err != nil {
+		return err
+	}
+
+	const match string = `INSERT INTO user_service.role_change_results (job_id, user_id)
+		SELECT $1, u.id FROM user_service.users u
+		WHERE u.tenant_id = $2 AND u.status = 'active'
+			AND ($3::INTEGER IS NULL OR u.org_id = $3)
+			AND ($4 = '' OR EXISTS (SELECT 1 FROM user_service.user_roles r WHERE r.user_id = u.id AND r.role = $4))
+			AND (CARDINALITY($5::INTEGER[]) = 0 OR u.id = ANY($5))`
+	res, err := tx.ExecContext(ctx, match, j.ID, tenant.FromContext(ctx), j.Filter.OrgID, j.Filter.HasRole, userIDs)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoUsers
+	}
+	j.Total = int(n)
+	j.Progress = Progress{Pending: j.Total}
+
+	const total string = "UPDATE user_service.role_change_jobs SET total = $2 WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, total, j.ID, j.Total); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const jobColumns = `j.id, j.action, j.role, j.filter, j.reason, j.actor, j.status, j.total, j.created_at, j.updated_at, j.completed_at,
+	COUNT(r.user_id) FILTER (WHERE r.status = 'pending'), COUNT(r.user_id) FILTER (WHERE r.status = 'applied'),
+	COUNT(r.user_id) FILTER (WHERE r.status = 'unchanged'), COUNT(r.user_id) FILTER (WHERE r.status = 'failed'),
+	COUNT(r.user_id) FILTER (WHERE r.status = 'rolled_back')`
+
+const jobsWithProgress = `user_service.role_change_jobs j
+	LEFT JOIN user_service.role_change_results r ON r.job_id = j.id`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row scanner) (*Job, error) {
+	var j Job
+	var filter []byte
+	var completedAt sql.NullTime
+	if err := row.Scan(&j.ID, &j.Action, &j.Role, &filter, &j.Reason, &j.Actor, &j.Status, &j.Total, &j.CreatedAt, &j.UpdatedAt,
+		&completedAt, &j.Progress.Pending, &j.Progress.Applied, &j.Progress.Unchanged, &j.Progress.Failed, &j.Progress.RolledBack); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(filter, &j.Filter); err != nil {
+		return nil, err
+	}
+	if completedAt.Valid {
+		j.CompletedAt = &completedAt.Time
+	}
+	return &j, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int) (*Job, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + jobColumns + " FROM " + jobsWithProgress + `
+		WHERE j.id = $1 AND j.tenant_id = $2 GROUP BY j.id`
+	j, err := scanJob(s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return j, err
+}
+
+func (s *PostgresStore) List(ctx context.Context, limit int) ([]Job, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + jobColumns + " FROM " + jobsWithProgress + `
+		WHERE j.tenant_id = $2 GROUP BY j.id ORDER BY j.id DESC LIMIT $1`
+	return s.queryJobs(ctx, query, limit, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) Unfinished(ctx context.Context, limit int) ([]Job, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + jobColumns + " FROM " + jobsWithProgress + `
+		WHERE j.status IN ('running', 'rolling_back') GROUP BY j.id ORDER BY j.id LIMIT $1`
+	return s.queryJobs(ctx, query, limit)
+}
+
+func (s *PostgresStore) queryJobs(ctx context.Context, query string, args ...any) ([]Job, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *PostgresStore) Results(ctx context.Context, jobID int, status string, afterUserID, limit int) ([]Result, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT r.user_id, r.status, COALESCE(r.error, ''), r.updated_at
+		FROM user_service.role_change_results r
+		JOIN user_service.role_change_jobs j ON j.id = r.job_id AND j.tenant_id = $2
+		WHERE r.job_id = $1 AND ($3 = '' OR r.status = $3) AND r.user_id > $4
+		ORDER BY r.user_id LIMIT $5`
+	rows, err := s.db.QueryContext(ctx, query, jobID, tenant.FromContext(ctx), status, afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []Result{}
+	for rows.Next() {
+		var r Result
+		if err := rows.Scan(&r.UserID, &r.Status, &r.Error, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+const (
+	grantRole  string = "INSERT INTO user_service.user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	revokeRole string = "DELETE FROM user_service.user_roles WHERE user_id = $1 AND role = $2"
+)
+
+func (s *PostgresStore) Step(ctx context.Context, j *Job, limit int) ([]Result, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	// A rollback reverses the job's action on the users it changed.
+	from, to, change := ResultPending, "", grantRole
+	if j.Action == ActionRevoke {
+		change = revokeRole
+	}
+	if j.Status == StatusRollingBack {
+		from, to = ResultApplied, ResultRolledBack
+		if j.Action == ActionGrant {
+			change = revokeRole
+		} else {
+			change = grantRole
+		}
+	}
+
+	var results []Result
+	err := trail.WithTxAs(ctx, s.db, j.Actor, func(ctx context.Context, tx *sql.Tx) error {
+		// SKIP LOCKED lets replicas work through one job side by side.
+		const claim string = `SELECT r.user_id, u.status FROM user_service.role_change_results r
+			JOIN user_service.users u ON u.id = r.user_id
+			WHERE r.job_id = $1 AND r.status = $2
+			ORDER BY r.user_id LIMIT $3
+			FOR UPDATE OF r SKIP LOCKED`
+		rows, err := tx.QueryContext(ctx, claim, j.ID, from, limit)
+		if err != nil {
+			return err
+		}
+		type claimed struct {
+			userID int
+			status string
+		}
+		var users []claimed
+		for rows.Next() {
+			var u claimed
+			if err := rows.Scan(&u.userID, &u.status); err != nil {
+				rows.Close()
+				return err
+			}
+			users = append(users, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		const record string = `UPDATE user_service.role_change_results
+			SET status = $3, error = NULLIF($4, ''), updated_at = NOW() WHERE job_id = $1 AND user_id = $2
+			RETURNING updated_at`
+		results = make([]Result, 0, len(users))
+		for _, u := range users {
+			r := Result{UserID: u.userID}
+			switch {
+			case u.status == "deleted":
+				// Erased users have no roles left, and must not get one back.
+				r.Status, r.Error = ResultFailed, "user is deleted"
+			default:
+				res, err := tx.ExecContext(ctx, change, u.userID, j.Role)
+				if err != nil {
+					return err
+				}
+				n, err := res.RowsAffected()
+				if err != nil {
+					return err
+				}
+				switch {
+				case to != "":
+					r.Status = to
+				case n == 0:
+					r.Status = ResultUnchanged
+				default:
+					r.Status = ResultApplied
+				}
+			}
+			if err := tx.QueryRowContext(ctx, record, j.ID, r.UserID, r.Status, r.Error).Scan(&r.UpdatedAt); err != nil {
+				return err
+			}
+			results = append(results, r)
+		}
+
+		if len(results) > 0 {
+			const touch string = "UPDATE user_service.role_change_jobs SET updated_at = NOW() WHERE id = $1"
+			if _, err := tx.ExecContext(ctx, touch, j.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *PostgresStore) Finish(ctx context.Context, j *Job) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	from, to, outstanding := StatusRunning, StatusCompleted, ResultPending
+	if j.Status == StatusRollingBack {
+		from, to, outstanding = StatusRollingBack, StatusRolledBack, ResultApplied
+	}
+	// Results another replica has claimed but not committed still count as
+	// outstanding here, so only the replica that records the last result
+	// finishes the job.
+	const query string = `UPDATE user_service.role_change_jobs
+		SET status = $3, updated_at = NOW(), completed_at = NOW()
+		WHERE id = $1 AND status = $2
+			AND NOT EXISTS (SELECT 1 FROM user_service.role_change_results WHERE job_id = $1 AND status = $4)`
+	res, err := s.db.ExecContext(ctx, query, j.ID, from, to, outstanding)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidState
+	}
+	j.Status = to
+	return nil
+}
+
+func (s *PostgresStore) StartRollback(ctx context.Context, id int) (*Job, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE user_service.role_change_jobs SET status = 'rolling_back', updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 AND status = 'completed'`
+	res, err := s.db.ExecContext(ctx, query, id, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if _, err := s.Get(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidState
+	}
+	return s.Get(ctx, id)
+}
@@ -0,0 +1,97 @@
+package rolechanges
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+)
+
+// Worker applies and rolls back jobs on a queue. Jobs are queued as soon as
+// they are created or rolled back, and Sweep runs as a scheduled job to pick
+// up any a restart interrupted.
+type Worker struct {
+	store     Store
+	publisher events.Publisher
+	queue     *jobs.Queue
+	batchSize int
+}
+
+func NewWorker(store Store, publisher events.Publisher, queue *jobs.Queue) *Worker {
+	return &Worker{store: store, publisher: publisher, queue: queue, batchSize: 100}
+}
+
+// Enqueue queues j unless it is already queued or running.
+func (w *Worker) Enqueue(j Job) bool {
+	return w.queue.Enqueue(strconv.Itoa(j.ID), func(ctx context.Context) error { return w.run(ctx, &j) })
+}
+
+// Sweep queues every unfinished job.
+func (w *Worker) Sweep(ctx context.Context) error {
+	unfinished, err := w.store.Unfinished(ctx, 100)
+	if err != nil {
+		return err
+	}
+	for _, j := range unfinished {
+		w.Enqueue(j)
+	}
+	return nil
+}
+
+// run works through j one batch at a time, so a shutdown waits for at most
+// one batch, until no users are left or another replica has finished it.
+func (w *Worker) run(ctx context.Context, j *Job) error {
+	for ctx.Err() == nil {
+		results, err := w.store.Step(ctx, j, w.batchSize)
+		if err != nil {
+			return err
+		}
+		w.audit(ctx, j, results)
+		if len(results) == w.batchSize {
+			continue
+		}
+		err = w.store.Finish(ctx, j)
+		if errors.Is(err, ErrInvalidState) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Role change %d is %s", j.ID, j.Status)
+		return nil
+	}
+	return ctx.Err()
+}
+
+// audit publishes an event for every user whose roles changed. The results
+// table is the record of the change, so publishing failures are only
+// logged.
+func (w *Worker) audit(ctx context.Context, j *Job, results []Result) {
+	if w.publisher == nil {
+		return
+	}
+	for _, r := range results {
+		if r.Status != ResultApplied && r.Status != ResultRolledBack {
+			continue
+		}
+		rolledBack := r.Status == ResultRolledBack
+		e, err := events.New(events.UserRoleChanged, "user-service", events.RoleChanged{
+			UserID:     r.UserID,
+			Role:       j.Role,
+			Granted:    (j.Action == ActionGrant) != rolledBack,
+			JobID:      j.ID,
+			RolledBack: rolledBack,
+			Actor:      j.Actor,
+			Reason:     j.Reason,
+		})
+		if err == nil {
+			err = w.publisher.Publish(ctx, e)
+		}
+		if err != nil {
+			log.Printf("Failed to publish role change %d for user %d: %v", j.ID, r.UserID, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package sessions keeps the refresh tokens that let users stay signed in
+// without signing in again each time their access token expires. Every
+// refresh token is good for one use and is exchanged for the next in its
+// session; a token presented a second time has leaked, so the whole session
+// is revoked. Users can list their sessions and end any of them.
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/jobs"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+)
+
+// Manager implements users.Sessions.
+type Manager struct {
+	store Store
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+// NewManager keeps a session alive as long as it is refreshed at least
+// every ttl.
+func NewManager(store Store, ttl time.Duration) *Manager {
+	return &Manager{store: store, ttl: ttl, now: time.Now}
+}
+
+func (m *Manager) Issue(ctx context.Context, userID int, clientIP, userAgent string) (*users.RefreshToken, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+	token, t, err := m.next(id, userID, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	s := users.Session{ID: id, UserID: userID, ClientIP: clientIP, UserAgent: userAgent, ExpiresAt: t.ExpiresAt}
+	if err := m.store.Create(ctx, s, t); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (m *Manager) Rotate(ctx context.Context, token string) (*users.RefreshToken, error) {
+	// The session and owner are only known once the old token is found, so
+	// the store fills them in.
+	next, t, err := m.next("", 0, "")
+	if err != nil {
+		return nil, err
+	}
+	used, err := m.store.Rotate(ctx, HashToken(token), t)
+	if errors.Is(err, ErrReused) {
+		log.Printf("Refresh token of user %d was used twice, revoked its session", used.UserID)
+		return nil, users.ErrInvalidRefreshToken
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, users.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	next.SessionID, next.UserID, next.Tenant = used.Session, used.UserID, used.Tenant
+	return next, nil
+}
+
+func (m *Manager) Revoke(ctx context.Context, token string) error {
+	return m.store.Revoke(ctx, HashToken(token))
+}
+
+func (m *Manager) List(ctx context.Context, userID int) ([]users.Session, error) {
+	return m.store.List(ctx, userID)
+}
+
+func (m *Manager) End(ctx context.Context, userID int, id string) error {
+	err := m.store.End(ctx, userID, id)
+	if errors.Is(err, ErrNotFound) {
+		return users.ErrSessionNotFound
+	}
+	return err
+}
+
+// Job deletes expired tokens and ended sessions, which can no longer be
+// used or reused.
+func (m *Manager) Job() jobs.Func {
+	return func(ctx context.Context) error {
+		n, err := m.store.DeleteExpired(ctx)
+		if n > 0 {
+			log.Printf("Deleted %d expired refresh tokens and sessions", n)
+		}
+		return err
+	}
+}
+
+// next generates a token valid for the manager's ttl from now.
+func (m *Manager) next(session string, userID int, tenantID string) (*users.RefreshToken, Token, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return nil, Token{}, err
+	}
+	expires := m.now().Add(m.ttl)
+	return &users.RefreshToken{Token: token, SessionID: session, UserID: userID, Tenant: tenantID, ExpiresAt: expires},
+		Token{Hash: HashToken(token), Session: session, UserID: userID, Tenant: tenantID, ExpiresAt: expires}, nil
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken hashes a refresh token for storage. Tokens carry 256 bits of
+// entropy, so a fast hash is safe and lets the store look them up directly.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+)
+
+type memToken struct {
+	Token
+	used bool
+}
+
+type memSession struct {
+	users.Session
+	tenant  string
+	revoked bool
+}
+
+type memStore struct {
+	sessions map[string]*memSession
+	tokens   map[string]*memToken
+}
+
+func (s *memStore) Create(ctx context.Context, sess users.Session, first Token) error {
+	s.sessions[sess.ID] = &memSession{Session: sess, tenant: tenant.FromContext(ctx)}
+	s.tokens[first.Hash] = &memToken{Token: first}
+	return nil
+}
+
+func (s *memStore) Rotate(ctx context.Context, hash string, next Token) (*Token, error) {
+	t, ok := s.tokens[hash]
+	if !ok || s.sessions[t.Session].revoked || !time.Now().Before(t.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	if t.used {
+		s.sessions[t.Session].revoked = true
+		return &t.Token, ErrReused
+	}
+	t.used = true
+	next.Session, next.UserID, next.Tenant = t.Session, t.UserID, t.Tenant
+	s.tokens[next.Hash] = &memToken{Token: next}
+	s.sessions[t.Session].LastUsedAt = time.Now()
+	return &t.Token, nil
+}
+
+func (s *memStore) Revoke(ctx context.Context, hash string) error {
+	if t, ok := s.tokens[hash]; ok {
+		s.sessions[t.Session].revoked = true
+	}
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, userID int) ([]users.Session, error) {
+	var live []users.Session
+	for _, sess := range s.sessions {
+		if sess.UserID == userID && sess.tenant == tenant.FromContext(ctx) && !sess.revoked {
+			live = append(live, sess.Session)
+		}
+	}
+	return live, nil
+}
+
+func (s *memStore) End(ctx context.Context, userID int, id string) error {
+	sess, ok := s.sessions[id]
+	if !ok || sess.UserID != userID || sess.tenant != tenant.FromContext(ctx) || sess.revoked {
+		return ErrNotFound
+	}
+	sess.revoked = true
+	return nil
+}
+
+func (s *memStore) DeleteExpired(ctx context.Context) (int64, error) {
+	var n int64
+	for hash, t := range s.tokens {
+		if !time.Now().Before(t.ExpiresAt) {
+			delete(s.tokens, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestRotate(t *testing.T) {
+	store := &memStore{sessions: map[string]*memSession{}, tokens: map[string]*memToken{}}
+	m := NewManager(store, time.Hour)
+	ctx := tenant.NewContext(context.Background(), "acme")
+
+	first, err := m.Issue(ctx, 1, "203.0.113.7", "test")
+	if err != nil || first.UserID != 1 || first.Tenant != "acme" || first.SessionID == "" {
+		t.Fatalf("Expected a token for user 1 in acme, got: %+v, %v", first, err)
+	}
+	if _, ok := store.tokens[first.Token]; ok {
+		t.Error("Expected the token to be stored hashed")
+	}
+	other, _ := m.Issue(ctx, 1, "203.0.113.7", "test")
+
+	second, err := m.Rotate(context.Background(), first.Token)
+	if err != nil || second.Token == first.Token || second.SessionID != first.SessionID || second.UserID != 1 || second.Tenant != "acme" {
+		t.Fatalf("Expected the next token in the session, got: %+v, %v", second, err)
+	}
+	third, err := m.Rotate(context.Background(), second.Token)
+	if err != nil {
+		t.Fatalf("Expected the next token to rotate too, got: %v", err)
+	}
+
+	// The first token turning up again means it leaked: the session ends, but
+	// the user's other sessions do not.
+	if _, err := m.Rotate(context.Background(), first.Token); !errors.Is(err, users.ErrInvalidRefreshToken) {
+		t.Errorf("Expected reuse to be refused, got: %v", err)
+	}
+	if _, err := m.Rotate(context.Background(), third.Token); !errors.Is(err, users.ErrInvalidRefreshToken) {
+		t.Errorf("Expected reuse to revoke the session's latest token, got: %v", err)
+	}
+	otherNext, err := m.Rotate(context.Background(), other.Token)
+	if err != nil {
+		t.Fatalf("Expected another session to be unaffected, got: %v", err)
+	}
+
+	if _, err := m.Rotate(context.Background(), "unknown"); !errors.Is(err, users.ErrInvalidRefreshToken) {
+		t.Errorf("Expected an unknown token to be refused, got: %v", err)
+	}
+
+	m.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	expired, _ := m.Issue(ctx, 2, "203.0.113.7", "test")
+	if _, err := m.Rotate(context.Background(), expired.Token); !errors.Is(err, users.ErrInvalidRefreshToken) {
+		t.Errorf("Expected an expired token to be refused, got: %v", err)
+	}
+	if err := m.Job()(context.Background()); err != nil || store.tokens[HashToken(expired.Token)] != nil {
+		t.Errorf("Expected expired tokens to be deleted, got: %v", err)
+	}
+
+	m.now = time.Now
+	last, _ := m.Issue(ctx, 3, "203.0.113.7", "test")
+	if err := m.Revoke(context.Background(), last.Token); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := m.Rotate(context.Background(), last.Token); !errors.Is(err, users.ErrInvalidRefreshToken) {
+		t.Errorf("Expected a signed-out session to be refused, got: %v", err)
+	}
+
+	live, err := m.List(ctx, 1)
+	if err != nil || len(live) != 1 || live[0].ID != other.SessionID || live[0].ClientIP != "203.0.113.7" {
+		t.Fatalf("Expected only the unaffected session of user 1 listed, got: %+v, %v", live, err)
+	}
+	if err := m.End(tenant.NewContext(context.Background(), "other"), 1, other.SessionID); !errors.Is(err, users.ErrSessionNotFound) {
+		t.Errorf("Expected another tenant's session not to be found, got: %v", err)
+	}
+	if err := m.End(ctx, 2, other.SessionID); !errors.Is(err, users.ErrSessionNotFound) {
+		t.Errorf("Expected another user's session not to be found, got: %v", err)
+	}
+	if err := m.End(ctx, 1, other.SessionID); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := m.Rotate(context.Background(), otherNext.Token); !errors.Is(err, users.ErrInvalidRefreshToken) {
+		t.Errorf("Expected an ended session to be refused, got: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+)
+
+var (
+	// ErrNotFound is returned for a token or session that is unknown,
+	// expired or revoked.
+	ErrNotFound = errors.New("refresh token not found")
+	// ErrReused is returned for a token that was already rotated.
+	ErrReused = errors.New("refresh token reused")
+)
+
+// Token is a stored refresh token of Session.
+type Token struct {
+	Hash      string
+	Session   string
+	UserID    int
+	Tenant    string
+	ExpiresAt time.Time
+}
+
+type Store interface {
+	// Create starts session s in ctx's tenant with its first token.
+	Create(ctx context.Context, s users.Session, first Token) error
+	// Rotate marks the token with hash used and stores next in its session,
+	// for its user and tenant, returning the used token. A token already
+	// used revokes its session and returns ErrReused along with it.
+	Rotate(ctx context.Context, hash string, next Token) (*Token, error)
+	// Revoke revokes the session of the token with hash.
+	Revoke(ctx context.Context, hash string) error
+	// List returns the user's live sessions, most recently used first.
+	List(ctx context.Context, userID int) ([]users.Session, error)
+	// End revokes the user's live session with id.
+	End(ctx context.Context, userID int, id string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Create(ctx context.Context, sess users.Session, first Token) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const insertSession string = `INSERT INTO user_service.sessions (id, tenant_id, user_id, client_ip, user_agent, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	if _, err := tx.ExecContext(ctx, insertSession, sess.ID, tenant.FromContext(ctx), sess.UserID, sess.ClientIP, sess.UserAgent, sess.ExpiresAt); err != nil {
+		return err
+	}
+	const insertToken string = "INSERT INTO user_service.refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3)"
+	if _, err := tx.ExecContext(ctx, insertToken, first.Hash, sess.ID, first.ExpiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rotate looks the token up without a tenant: the caller may no longer have
+// a valid access token to name one, and the token's hash is unique.
+func (s *PostgresStore) Rotate(ctx context.Context, hash string, next Token) (*Token, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the row makes concurrent uses of one token queue up, so the
+	// second sees the first's use.
+	const query string = `SELECT t.session_id, s.user_id, s.tenant_id, t.expires_at, t.used_at IS NOT NULL,
+			s.revoked_at IS NOT NULL OR t.expires_at <= NOW()
+		FROM user_service.refresh_tokens t JOIN user_service.sessions s ON s.id = t.session_id
+		WHERE t.token_hash = $1 FOR UPDATE OF t`
+	var used Token
+	var reused, invalid bool
+	err = tx.QueryRowContext(ctx, query, hash).Scan(&used.Session, &used.UserID, &used.Tenant, &used.ExpiresAt, &reused, &invalid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	used.Hash = hash
+	switch {
+	case invalid:
+		return nil, ErrNotFound
+	case reused:
+		const revoke string = "UPDATE user_service.sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL"
+		if _, err := tx.ExecContext(ctx, revoke, used.Session); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return &used, ErrReused
+	}
+
+	const use string = "UPDATE user_service.refresh_tokens SET used_at = NOW() WHERE token_hash = $1"
+	if _, err := tx.ExecContext(ctx, use, hash); err != nil {
+		return nil, err
+	}
+	const insert string = "INSERT INTO user_service.refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3)"
+	if _, err := tx.ExecContext(ctx, insert, next.Hash, used.Session, next.ExpiresAt); err != nil {
+		return nil, err
+	}
+	const touch string = "UPDATE user_service.sessions SET last_used_at = NOW(), expires_at = $2 WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, touch, used.Session, next.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return &used, tx.Commit()
+}
+
+func (s *PostgresStore) Revoke(ctx context.Context, hash string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE user_service.sessions SET revoked_at = NOW()
+		WHERE id = (SELECT session_id FROM user_service.refresh_tokens WHERE token_hash = $1) AND revoked_at IS NULL`
+	_, err := s.db.ExecContext(ctx, query, hash)
+	return err
+}
+
+func (s *PostgresStore) List(ctx context.Context, userID int) ([]users.Session, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT id, user_id, client_ip, user_agent, created_at, last_used_at, expires_at
+		FROM user_service.sessions
+		WHERE tenant_id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC, created_at DESC`
+	rows, err := s.db.QueryContext(ctx, query, tenant.FromContext(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []users.Session{}
+	for rows.Next() {
+		var sess users.Session
+		if err := rows.Scan(&sess.ID, &sess.UserID, &sess.ClientIP, &sess.UserAgent, &sess.CreatedAt, &sess.LastUsedAt, &sess.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *PostgresStore) End(ctx context.Context, userID int, id string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `UPDATE user_service.sessions SET revoked_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 AND user_id = $3 AND revoked_at IS NULL AND expires_at > NOW()`
+	res, err := s.db.ExecContext(ctx, query, id, tenant.FromContext(ctx), userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteExpired deletes ended sessions, and with them their tokens, then the
+// expired tokens of sessions still live.
+func (s *PostgresStore) DeleteExpired(ctx context.Context) (int64, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM user_service.sessions WHERE expires_at <= NOW() OR revoked_at IS NOT NULL")
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	res, err = s.db.ExecContext(ctx, "DELETE FROM user_service.refresh_tokens WHERE expires_at <= NOW()")
+	if err != nil {
+		return sessions, err
+	}
+	tokens, err := res.RowsAffected()
+	return sessions + tokens, err
+}
@@ -0,0 +1,359 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+)
+
+// UserStore is a users.Store over a map, for tests that do not need
+// Postgres. Users without a status count as active, every user signs in
+// with Hash, and IDs are handed out as len(Users)+1, so fixtures should be
+// numbered from 1. It is not safe for concurrent use.
+type UserStore struct {
+	Users map[int]users.User
+	// Hash is every user's password hash, Password's by default.
+	Hash string
+	// Granted holds each user's roles.
+	Granted map[int][]string
+	// Batches counts ImportBatch calls.
+	Batches int
+	// Identities maps "provider subject" to a user ID.
+	Identities map[string]int
+	// OrgID and OrgRole are every user's organization and role in it.
+	OrgID   *int
+	OrgRole string
+}
+
+var _ users.Store = (*UserStore)(nil)
+
+// NewUserStore holds us, keyed by ID, each signing in with Password.
+func NewUserStore(us ...users.User) *UserStore {
+	s := &UserStore{Users: map[int]users.User{}, Hash: passwordHash(), Granted: map[int][]string{}, Identities: map[string]int{}}
+	for _, u := range us {
+		s.Users[u.ID] = u
+	}
+	return s
+}
+
+func active(u users.User) bool {
+	return u.Status == "" || u.Status == users.StatusActive
+}
+
+func (s *UserStore) List(ctx context.Context, limit int) ([]users.User, error) {
+	out := []users.User{}
+	for id := 1; id <= len(s.Users) && len(out) < limit; id++ {
+		if u, ok := s.Users[id]; ok && active(u) {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+func (s *UserStore) Stream(ctx context.Context, fn func(users.User) error) error {
+	for id := 1; id <= len(s.Users); id++ {
+		if u, ok := s.Users[id]; ok && active(u) {
+			if err := fn(u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *UserStore) Get(ctx context.Context, id int) (*users.User, error) {
+	u, ok := s.Users[id]
+	if !ok {
+		return nil, users.ErrNotFound
+	}
+	return &u, nil
+}
+
+func (s *UserStore) GetMany(ctx context.Context, ids []int) ([]users.User, error) {
+	out := []users.User{}
+	for _, id := range ids {
+		if u, ok := s.Users[id]; ok {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+// ListOrgAdmins finds none; the fake has no orgs.
+func (s *UserStore) ListOrgAdmins(ctx context.Context, orgID int) ([]users.User, error) {
+	return []users.User{}, nil
+}
+
+// Membership puts every user in OrgID, or in no org if OrgID is nil, as
+// OrgRole or a member.
+func (s *UserStore) Membership(ctx context.Context, userID int) (*users.Membership, error) {
+	u, ok := s.Users[userID]
+	if !ok || !active(u) {
+		return nil, users.ErrNotFound
+	}
+	role := s.OrgRole
+	if role == "" {
+		role = "member"
+	}
+	return &users.Membership{UserID: userID, OrgID: s.OrgID, OrgRole: role}, nil
+}
+
+// Search matches substrings of the email and username, in ID order.
+func (s *UserStore) Search(ctx context.Context, q string, limit int) ([]users.Match, error) {
+	out := []users.Match{}
+	for id := 1; id <= len(s.Users) && len(out) < limit; id++ {
+		u, ok := s.Users[id]
+		if !ok || u.Status == users.StatusDeleted {
+			continue
+		}
+		if strings.Contains(strings.ToLower(u.Email+" "+u.Username), strings.ToLower(q)) {
+			out = append(out, users.Match{User: u, Score: 1})
+		}
+	}
+	return out, nil
+}
+
+func (s *UserStore) Credentials(ctx context.Context, email string) (*users.User, string, error) {
+	for _, u := range s.Users {
+		if u.Email == email && active(u) {
+			return &u, s.Hash, nil
+		}
+	}
+	return nil, "", users.ErrNotFound
+}
+
+func (s *UserStore) Availability(ctx context.Context, email, username string) (bool, bool, error) {
+	emailFree, usernameFree := true, true
+	for _, u := range s.Users {
+		emailFree = emailFree && (email == "" || u.Email != email)
+		usernameFree = usernameFree && (username == "" || !strings.EqualFold(u.Username, username))
+	}
+	return emailFree, usernameFree, nil
+}
+
+func (s *UserStore) Roles(ctx context.Context, userID int) ([]string, error) {
+	return s.Granted[userID], nil
+}
+
+func (s *UserStore) AddRole(ctx context.Context, userID int, role string) error {
+	if _, ok := s.Users[userID]; !ok {
+		return users.ErrNotFound
+	}
+	s.Granted[userID] = append(s.Granted[userID], role)
+	return nil
+}
+
+func (s *UserStore) RemoveRole(ctx context.Context, userID int, role string) error {
+	roles := s.Granted[userID]
+	for i, r := range roles {
+		if r == role {
+			s.Granted[userID] = append(roles[:i:i], roles[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *UserStore) ImportBatch(ctx context.Context, records []users.Record) ([]error, error) {
+	s.Batches++
+	errs := make([]error, len(records))
+	for i, r := range records {
+		for _, u := range s.Users {
+			switch {
+			case strings.EqualFold(u.Email, r.Email):
+				errs[i] = users.ErrEmailTaken
+			case strings.EqualFold(u.Username, r.Username):
+				errs[i] = users.ErrUsernameTaken
+			}
+		}
+		if errs[i] == nil {
+			id := len(s.Users) + 1
+			s.Users[id] = users.User{User: models.User{ID: id, Email: r.Email, Username: r.Username, Status: users.StatusActive}}
+		}
+	}
+	return errs, nil
+}
+
+func (s *UserStore) ExportPage(ctx context.Context, afterID, limit int) ([]users.Record, error) {
+	out := []users.Record{}
+	for id := afterID + 1; id <= len(s.Users) && len(out) < limit; id++ {
+		if u, ok := s.Users[id]; ok && active(u) {
+			out = append(out, users.Record{ID: u.ID, Email: u.Email, Username: u.Username})
+		}
+	}
+	return out, nil
+}
+
+func (s *UserStore) Deactivate(ctx context.Context, id int) (*users.User, error) {
+	return s.setStatus(id, users.StatusActive, users.StatusDeactivated)
+}
+
+func (s *UserStore) Reactivate(ctx context.Context, id int) (*users.User, error) {
+	return s.setStatus(id, users.StatusDeactivated, users.StatusActive)
+}
+
+func (s *UserStore) setStatus(id int, from, to string) (*users.User, error) {
+	u, ok := s.Users[id]
+	if !ok {
+		return nil, users.ErrNotFound
+	}
+	if (from == users.StatusActive && !active(u)) || (from != users.StatusActive && u.Status != from) {
+		return nil, users.ErrInvalidState
+	}
+	u.Status = to
+	s.Users[id] = u
+	return &u, nil
+}
+
+func (s *UserStore) Erase(ctx context.Context, id int) error {
+	if _, ok := s.Users[id]; !ok {
+		return users.ErrNotFound
+	}
+	s.Users[id] = users.User{User: models.User{ID: id, Email: fmt.Sprintf("deleted-%d@deleted.invalid", id), Username: fmt.Sprintf("deleted-%d", id), Status: users.StatusDeleted}}
+	delete(s.Granted, id)
+	for key, linked := range s.Identities {
+		if linked == id {
+			delete(s.Identities, key)
+		}
+	}
+	return nil
+}
+
+func (s *UserStore) ExternalUser(ctx context.Context, provider, subject string) (*users.User, error) {
+	id, ok := s.Identities[provider+" "+subject]
+	if !ok {
+		return nil, users.ErrNotFound
+	}
+	u := s.Users[id]
+	if !active(u) {
+		return nil, users.ErrInvalidState
+	}
+	return &u, nil
+}
+
+// LinkExternal names a user it creates after their email's local part.
+func (s *UserStore) LinkExternal(ctx context.Context, identity users.ExternalIdentity) (*users.User, bool, error) {
+	for _, u := range s.Users {
+		if strings.EqualFold(u.Email, identity.Email) {
+			if !active(u) {
+				return nil, false, users.ErrInvalidState
+			}
+			s.Identities[identity.Provider+" "+identity.Subject] = u.ID
+			return &u, false, nil
+		}
+	}
+	local, _, _ := strings.Cut(identity.Email, "@")
+	u := users.User{User: models.User{ID: len(s.Users) + 1, Email: identity.Email, Username: local, Status: users.StatusActive}}
+	s.Users[u.ID] = u
+	s.Identities[identity.Provider+" "+identity.Subject] = u.ID
+	return &u, true, nil
+}
+
+func (s *UserStore) MarkVerified(ctx context.Context, id int, email string) (*users.User, bool, error) {
+	u, ok := s.Users[id]
+	if !ok || !active(u) || u.Email != email {
+		return nil, false, users.ErrNotFound
+	}
+	if u.VerifiedAt != nil {
+		return &u, false, nil
+	}
+	now := time.Now()
+	u.VerifiedAt = &now
+	s.Users[id] = u
+	return &u, true, nil
+}
+
+// Sessions is a users.Sessions that issues r1, r2, ... each in a session
+// of its own, and revokes a token's session when it is used twice or
+// ended.
+type Sessions struct {
+	issued  int
+	tokens  map[string]*users.RefreshToken
+	used    map[string]bool
+	revoked map[string]bool
+}
+
+var _ users.Sessions = (*Sessions)(nil)
+
+func NewSessions() *Sessions {
+	return &Sessions{tokens: map[string]*users.RefreshToken{}, used: map[string]bool{}, revoked: map[string]bool{}}
+}
+
+func (s *Sessions) Issue(ctx context.Context, userID int, clientIP, userAgent string) (*users.RefreshToken, error) {
+	s.issued++
+	t := &users.RefreshToken{Token: fmt.Sprintf("r%d", s.issued), SessionID: fmt.Sprintf("s%d", s.issued), UserID: userID,
+		Tenant: tenant.FromContext(ctx), ExpiresAt: time.Now().Add(time.Hour)}
+	s.tokens[t.Token] = t
+	return t, nil
+}
+
+func (s *Sessions) Rotate(ctx context.Context, token string) (*users.RefreshToken, error) {
+	t, ok := s.tokens[token]
+	if !ok || s.revoked[t.SessionID] {
+		return nil, users.ErrInvalidRefreshToken
+	}
+	if s.used[token] {
+		s.revoked[t.SessionID] = true
+		return nil, users.ErrInvalidRefreshToken
+	}
+	s.used[token] = true
+	s.issued++
+	next := *t
+	next.Token = fmt.Sprintf("r%d", s.issued)
+	s.tokens[next.Token] = &next
+	return &next, nil
+}
+
+func (s *Sessions) Revoke(ctx context.Context, token string) error {
+	if t, ok := s.tokens[token]; ok {
+		s.revoked[t.SessionID] = true
+	}
+	return nil
+}
+
+func (s *Sessions) List(ctx context.Context, userID int) ([]users.Session, error) {
+	live := []users.Session{}
+	seen := map[string]bool{}
+	for _, t := range s.tokens {
+		if t.UserID == userID && !s.revoked[t.SessionID] && !seen[t.SessionID] {
+			seen[t.SessionID] = true
+			live = append(live, users.Session{ID: t.SessionID, UserID: userID})
+		}
+	}
+	return live, nil
+}
+
+func (s *Sessions) End(ctx context.Context, userID int, id string) error {
+	for _, t := range s.tokens {
+		if t.SessionID == id && t.UserID == userID && !s.revoked[id] {
+			s.revoked[id] = true
+			return nil
+		}
+	}
+	return users.ErrSessionNotFound
+}
+
+// Publisher records the events published on it.
+type Publisher struct {
+	Events []events.Event
+}
+
+func (p *Publisher) Publish(ctx context.Context, e events.Event) error {
+	p.Events = append(p.Events, e)
+	return nil
+}
+
+// Last returns the event published last, or the zero Event if there is
+// none.
+func (p *Publisher) Last() events.Event {
+	if len(p.Events) == 0 {
+		return events.Event{}
+	}
+	return p.Events[len(p.Events)-1]
+}
@@ -0,0 +1,144 @@
+// Package testutil holds fakes of the user-service's stores and fixtures
+// built on them, so handlers can be tested without Postgres:
+//
+//	store := testutil.NewUserStore(testutil.John(), testutil.Jane())
+//	tokens := testutil.Tokens(t)
+//	router := testutil.Router(tokens)
+//	users.NewHandler(store, tokens, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+//
+//	w := testutil.Do(router, http.MethodGet, "/users/1", testutil.Token(t, tokens, 1, auth.RoleCustomer), "")
+//
+// Builders take testfactory options, so any func(*users.User) sets a field
+// no helper covers.
+package testutil
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/pkg/testfactory"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password is what fixture users sign in with.
+const Password = "password123"
+
+// passwordHash hashes Password once per test binary, at bcrypt's lowest
+// cost.
+var passwordHash = sync.OnceValue(func() string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(hash)
+})
+
+// seq starts past the fixtures' IDs.
+var seq atomic.Int64
+
+// User is an active user with a unique ID, email and username.
+func User(opts ...testfactory.Option[users.User]) users.User {
+	n := int(seq.Add(1)) + 100
+	u := users.User{User: models.User{ID: n, Email: fmt.Sprintf("user%d@example.com", n), Username: fmt.Sprintf("user%d", n), Status: users.StatusActive}}
+	for _, opt := range opts {
+		opt(&u)
+	}
+	return u
+}
+
+// John is user 1, john.doe@example.com.
+func John(opts ...testfactory.Option[users.User]) users.User {
+	return User(append([]testfactory.Option[users.User]{ID(1), Email("john.doe@example.com"), Username("johndoe")}, opts...)...)
+}
+
+// Jane is user 2, jane.doe@example.com.
+func Jane(opts ...testfactory.Option[users.User]) users.User {
+	return User(append([]testfactory.Option[users.User]{ID(2), Email("jane.doe@example.com"), Username("janedoe")}, opts...)...)
+}
+
+func ID(id int) testfactory.Option[users.User] {
+	return func(u *users.User) { u.ID = id }
+}
+
+func Email(email string) testfactory.Option[users.User] {
+	return func(u *users.User) { u.Email = email }
+}
+
+func Username(username string) testfactory.Option[users.User] {
+	return func(u *users.User) { u.Username = username }
+}
+
+func Status(status string) testfactory.Option[users.User] {
+	return func(u *users.User) { u.Status = status }
+}
+
+// Verified marks the user's email verified at testfactory.Time.
+func Verified() testfactory.Option[users.User] {
+	return func(u *users.User) {
+		at := testfactory.Time
+		u.VerifiedAt = &at
+	}
+}
+
+// Tokens issues hour-long tokens signed with a test secret.
+func Tokens(t testing.TB) *auth.Tokens {
+	t.Helper()
+	tokens, err := auth.NewTokens("test-secret", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create tokens: %v", err)
+	}
+	return tokens
+}
+
+// Token is a user's access token with roles.
+func Token(t testing.TB, tokens *auth.Tokens, userID int, roles ...string) string {
+	t.Helper()
+	token, _, err := tokens.IssueUser(userID, roles)
+	if err != nil {
+		t.Fatalf("Failed to issue a token for user %d: %v", userID, err)
+	}
+	return token
+}
+
+// ServiceToken is a service's token for audience, or for any service that
+// does not check one when it is left out.
+func ServiceToken(t testing.TB, tokens *auth.Tokens, service string, audience ...string) string {
+	t.Helper()
+	token, _, err := tokens.IssueService(service, audience...)
+	if err != nil {
+		t.Fatalf("Failed to issue a token for %s: %v", service, err)
+	}
+	return token
+}
+
+// Router authenticates requests with tokens and resolves their tenant,
+// as the service does, ahead of the routes registered on it.
+func Router(tokens *auth.Tokens) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(auth.Authenticate(tokens))
+	router.Use(tenant.Middleware())
+	return router
+}
+
+// Do sends a request with a bearer token, if there is one, and returns the
+// response.
+func Do(router *gin.Engine, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,171 @@
+package trail
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLimit   = 100
+	maxLimit       = 1000
+	exportPageSize = 1000
+)
+
+var exportColumns = []string{"id", "changed_at", "actor", "request_id", "entity", "entity_key", "operation", "field", "before", "after"}
+
+type Handler struct {
+	store Store
+}
+
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes. Only
+// admins can read an account's history.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.GET("/users/:id/audit", auth.RequireRole(auth.RoleAdmin), h.list)
+	router.GET("/users/:id/audit/export", auth.RequireRole(auth.RoleAdmin), h.export)
+}
+
+// userID parses the route's user and checks the account exists, writing the
+// response when it does not.
+func (h *Handler) userID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	exists, err := h.store.UserExists(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+// list pages through the trail newest first. Pass next_before from a page
+// as ?before= to get the next one.
+func (h *Handler) list(c *gin.Context) {
+	id, ok := h.userID(c)
+	if !ok {
+		return
+	}
+	var before int64
+	if raw := c.Query("before"); raw != "" {
+		var err error
+		if before, err = strconv.ParseInt(raw, 10, 64); err != nil || before <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be an entry id"})
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if limit <= 0 || limit > maxLimit {
+		limit = defaultLimit
+	}
+
+	// One extra entry tells whether there is another page.
+	entries, err := h.store.List(c.Request.Context(), id, before, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"entries": entries}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		resp["entries"] = entries
+		resp["next_before"] = entries[limit-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// export streams the whole trail oldest first as CSV, one row per changed
+// field, for handing to the account holder or a regulator. Like the user
+// export, a page is read only once the previous one has been written.
+func (h *Handler) export(c *gin.Context) {
+	id, ok := h.userID(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	page, err := h.store.ExportPage(ctx, id, 0, exportPageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-audit.csv"`, id))
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	if err := w.Write(exportColumns); err != nil {
+		return
+	}
+	for len(page) > 0 {
+		for _, e := range page {
+			for _, row := range csvRows(e) {
+				if err := w.Write(row); err != nil {
+					return
+				}
+			}
+		}
+		if w.Flush(); w.Error() != nil {
+			return
+		}
+		c.Writer.Flush()
+
+		if len(page) < exportPageSize || ctx.Err() != nil {
+			return
+		}
+		page, err = h.store.ExportPage(ctx, id, page[len(page)-1].ID, exportPageSize)
+		if err != nil {
+			// Headers are already sent; the client sees a truncated body.
+			log.Printf("audit trail export for user %d aborted: %v", id, err)
+			return
+		}
+	}
+}
+
+// csvRows writes an entry as one row per field, in field order so exports
+// are stable.
+func csvRows(e Entry) [][]string {
+	fields := make([]string, 0, len(e.Changes))
+	for field := range e.Changes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	rows := make([][]string, 0, len(fields))
+	for _, field := range fields {
+		change := e.Changes[field]
+		rows = append(rows, []string{strconv.FormatInt(e.ID, 10), e.ChangedAt.UTC().Format(time.RFC3339), e.Actor,
+			e.RequestID, e.Entity, e.EntityKey, e.Operation, field, cell(change.Before), cell(change.After)})
+	}
+	return rows
+}
+
+// cell writes strings as they are and other values as JSON.
+func cell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		raw, _ := json.Marshal(v)
+		return string(raw)
+	}
+}
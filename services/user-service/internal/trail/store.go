@@ -0,0 +1,83 @@
+package trail
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+)
+
+type Store interface {
+	// UserExists reports whether the user has an account in this tenant,
+	// including an erased one.
+	UserExists(ctx context.Context, userID int) (bool, error)
+	// List returns a user's entries newest first, those with IDs below
+	// before when it is set.
+	List(ctx context.Context, userID int, before int64, limit int) ([]Entry, error)
+	// ExportPage returns a user's entries oldest first, from the one after
+	// afterID.
+	ExportPage(ctx context.Context, userID int, afterID int64, limit int) ([]Entry, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const entryColumns = "id, user_id, entity, COALESCE(entity_key, ''), operation, actor, COALESCE(request_id, ''), changes, changed_at"
+
+func (s *PostgresStore) UserExists(ctx context.Context, userID int) (bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT EXISTS (SELECT 1 FROM user_service.users WHERE id = $1 AND tenant_id = $2)"
+	var exists bool
+	err := s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)).Scan(&exists)
+	return exists, err
+}
+
+func (s *PostgresStore) List(ctx context.Context, userID int, before int64, limit int) ([]Entry, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + entryColumns + ` FROM user_service.account_changes
+		WHERE tenant_id = $1 AND user_id = $2 AND ($3::BIGINT = 0 OR id < $3) ORDER BY id DESC LIMIT $4`
+	return s.query(ctx, query, tenant.FromContext(ctx), userID, before, limit)
+}
+
+func (s *PostgresStore) ExportPage(ctx context.Context, userID int, afterID int64, limit int) ([]Entry, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + entryColumns + ` FROM user_service.account_changes
+		WHERE tenant_id = $1 AND user_id = $2 AND id > $3 ORDER BY id LIMIT $4`
+	return s.query(ctx, query, tenant.FromContext(ctx), userID, afterID, limit)
+}
+
+func (s *PostgresStore) query(ctx context.Context, query string, args ...any) ([]Entry, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var changes []byte
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Entity, &e.EntityKey, &e.Operation, &e.Actor, &e.RequestID,
+			&changes, &e.ChangedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
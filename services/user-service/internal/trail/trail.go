@@ -0,0 +1,75 @@
+// Package trail serves the change history of each account. Triggers in
+// scripts/init-db.sql capture every change to a user and the rows the
+// account owns (roles, addresses, security questions and linked
+// identities) field by field; writers name who made the change by running
+// their transactions through WithTx.
+package trail
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/audit"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/requestid"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+	"github.com/lib/pq"
+)
+
+// Erased replaces the values of identifying fields once an account is
+// erased.
+const Erased = "[erased]"
+
+// erased are the fields that say who the person was. Erasing an account
+// overwrites them throughout its trail, leaving what changed and when.
+var erased = []string{"email", "username", "first_name", "last_name", "avatar_url", "subject", "question"}
+
+// Entry is one captured write. Entity is the table written and EntityKey
+// the row within the account, such as the role granted or the address id;
+// it is empty for the user row itself. Changes holds each field that
+// changed, with encrypted and hashed fields shown as audit.Redacted.
+type Entry struct {
+	ID        int64                   `json:"id"`
+	UserID    int                     `json:"user_id"`
+	Entity    string                  `json:"entity"`
+	EntityKey string                  `json:"entity_key,omitempty"`
+	Operation string                  `json:"operation"`
+	Actor     string                  `json:"actor"`
+	RequestID string                  `json:"request_id,omitempty"`
+	Changes   map[string]audit.Change `json:"changes"`
+	ChangedAt time.Time               `json:"changed_at"`
+}
+
+// WithTx runs fn in a transaction, as database.WithTx does, whose writes
+// are attributed to the request's user or service, or to "system" for
+// background work. Writes to account tables outside such a transaction are
+// captured as made by "system".
+func WithTx(ctx context.Context, db *sql.DB, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	return WithTxAs(ctx, db, pii.Actor(ctx), fn)
+}
+
+// WithTxAs attributes the writes to actor, for background work done on
+// someone's behalf.
+func WithTxAs(ctx context.Context, db *sql.DB, actor string, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	return database.WithTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		const query string = "SELECT set_config('app.actor', $1, true), set_config('app.request_id', $2, true)"
+		if _, err := tx.ExecContext(ctx, query, actor, requestid.FromContext(ctx)); err != nil {
+			return err
+		}
+		return fn(ctx, tx)
+	})
+}
+
+// Erase overwrites the identifying fields in a user's trail, as part of
+// the transaction that erases the account.
+func Erase(ctx context.Context, tx *sql.Tx, userID int) error {
+	const query string = `UPDATE user_service.account_changes SET changes = (
+			SELECT jsonb_object_agg(key, CASE WHEN key = ANY ($2) THEN jsonb_strip_nulls(jsonb_build_object(
+				'before', CASE WHEN value ? 'before' THEN to_jsonb($3::text) END,
+				'after', CASE WHEN value ? 'after' THEN to_jsonb($3::text) END)) ELSE value END)
+			FROM jsonb_each(changes))
+		WHERE user_id = $1 AND changes ?| $2`
+	_, err := tx.ExecContext(ctx, query, userID, pq.Array(erased), Erased)
+	return err
+}
@@ -0,0 +1,118 @@
+package trail
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/audit"
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps the trail of user 1, oldest first.
+type memStore struct {
+	entries []Entry
+}
+
+func (s *memStore) UserExists(ctx context.Context, userID int) (bool, error) {
+	return userID == 1, nil
+}
+
+func (s *memStore) List(ctx context.Context, userID int, before int64, limit int) ([]Entry, error) {
+	entries := []Entry{}
+	for i := len(s.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		if e := s.entries[i]; e.UserID == userID && (before == 0 || e.ID < before) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (s *memStore) ExportPage(ctx context.Context, userID int, afterID int64, limit int) ([]Entry, error) {
+	entries := []Entry{}
+	for _, e := range s.entries {
+		if e.UserID == userID && e.ID > afterID && len(entries) < limit {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func TestTrail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := &memStore{entries: []Entry{
+		{ID: 1, UserID: 1, Entity: "users", Operation: "insert", Actor: "system", ChangedAt: at,
+			Changes: map[string]audit.Change{"email": {After: "a@example.com"}, "password_hash": {After: audit.Redacted}}},
+		{ID: 2, UserID: 1, Entity: "user_roles", EntityKey: "admin", Operation: "insert", Actor: "user:9", RequestID: "req-1",
+			ChangedAt: at.Add(time.Hour), Changes: map[string]audit.Change{"role": {After: "admin"}}},
+		{ID: 3, UserID: 1, Entity: "users", Operation: "update", Actor: "user:1", ChangedAt: at.Add(2 * time.Hour),
+			Changes: map[string]audit.Change{"org_id": {Before: float64(4), After: float64(5)}}},
+	}}
+	admin := &auth.Principal{UserID: 9, Roles: []string{auth.RoleAdmin}}
+	do := func(p *auth.Principal, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { auth.WithPrincipal(c, p) })
+		NewHandler(store).RegisterRoutes(router)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := do(&auth.Principal{UserID: 1, Roles: []string{auth.RoleCustomer}}, "/users/1/audit"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected users to be refused their own trail, got: %d", w.Code)
+	}
+	if w := do(admin, "/users/2/audit"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown user to be not found, got: %d", w.Code)
+	}
+	if w := do(admin, "/users/1/audit?before=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad cursor to be refused, got: %d", w.Code)
+	}
+
+	var page struct {
+		Entries    []Entry `json:"entries"`
+		NextBefore int64   `json:"next_before"`
+	}
+	w := do(admin, "/users/1/audit?limit=2")
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a page, got: %d %s", w.Code, w.Body)
+	}
+	if len(page.Entries) != 2 || page.Entries[0].ID != 3 || page.NextBefore != 2 {
+		t.Errorf("Expected the two newest entries and a next page, got: %+v", page)
+	}
+	page.Entries, page.NextBefore = nil, 0
+	json.Unmarshal(do(admin, "/users/1/audit?limit=2&before=2").Body.Bytes(), &page)
+	if len(page.Entries) != 1 || page.Entries[0].ID != 1 || page.NextBefore != 0 {
+		t.Errorf("Expected the oldest entry on the last page, got: %+v", page)
+	}
+
+	w = do(admin, "/users/1/audit/export")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("Expected a CSV export, got: %d %s", w.Code, w.Header())
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Expected valid CSV, got: %v", err)
+	}
+	want := [][]string{
+		exportColumns,
+		{"1", "2024-03-01T12:00:00Z", "system", "", "users", "", "insert", "email", "", "a@example.com"},
+		{"1", "2024-03-01T12:00:00Z", "system", "", "users", "", "insert", "password_hash", "", audit.Redacted},
+		{"2", "2024-03-01T13:00:00Z", "user:9", "req-1", "user_roles", "admin", "insert", "role", "", "admin"},
+		{"3", "2024-03-01T14:00:00Z", "user:1", "", "users", "", "update", "org_id", "4", "5"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("Expected %d rows, got: %v", len(want), rows)
+	}
+	for i := range want {
+		if strings.Join(rows[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("Expected row %d to be %v, got: %v", i, want[i], rows[i])
+		}
+	}
+}
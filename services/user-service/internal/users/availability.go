@@ -0,0 +1,120 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// The unique indexes behind case-insensitive emails and usernames, named in
+// scripts/init-db.sql.
+const (
+	emailIndex    = "users_tenant_email_key"
+	usernameIndex = "users_tenant_username_key"
+)
+
+var (
+	ErrEmailTaken    = errors.New("email already taken")
+	ErrUsernameTaken = errors.New("username already taken")
+)
+
+// normalizeEmail trims and lowercases an email, the form it is stored and
+// looked up in.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Usernames keep the case they were chosen in but are compared without it.
+func normalizeUsername(username string) string {
+	return strings.TrimSpace(username)
+}
+
+func validateEmail(email string) error {
+	if email == "" || len(email) > 255 || !strings.Contains(email, "@") {
+		return errors.New("email must be a valid address of at most 255 characters")
+	}
+	return nil
+}
+
+func validateUsername(username string) error {
+	if username == "" || len(username) > 255 {
+		return errors.New("username must be 1 to 255 characters")
+	}
+	return nil
+}
+
+// takenError names the field a unique violation on the users table is about.
+func takenError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Constraint {
+		case emailIndex:
+			return ErrEmailTaken
+		case usernameIndex:
+			return ErrUsernameTaken
+		}
+	}
+	return ErrAlreadyExists
+}
+
+// Availability reports whether a normalized email and username are free in
+// the tenant. An empty value is reported as free. Deleted users' addresses
+// are free again once anonymized; deactivated users keep theirs.
+func (s *PostgresStore) Availability(ctx context.Context, email, username string) (emailFree, usernameFree bool, err error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT
+		NOT EXISTS (SELECT 1 FROM user_service.users WHERE tenant_id = $1 AND $2 <> '' AND lower(email) = $2),
+		NOT EXISTS (SELECT 1 FROM user_service.users WHERE tenant_id = $1 AND $3 <> '' AND lower(username) = lower($3))`
+	err = s.db.QueryRowContext(ctx, query, tenant.FromContext(ctx), email, username).Scan(&emailFree, &usernameFree)
+	return emailFree, usernameFree, err
+}
+
+type fieldAvailability struct {
+	Value     string `json:"value"`
+	Available bool   `json:"available"`
+}
+
+// check lets sign-up forms validate an email and username before they are
+// submitted. It needs no token, like login; the gateway's rate limits keep
+// it from being used to enumerate accounts quickly.
+func (h *Handler) check(c *gin.Context) {
+	email, username := normalizeEmail(c.Query("email")), normalizeUsername(c.Query("username"))
+	if email == "" && username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email or username query parameter is required"})
+		return
+	}
+	if email != "" {
+		if err := validateEmail(email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if username != "" {
+		if err := validateUsername(username); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	emailFree, usernameFree, err := h.store.Availability(c.Request.Context(), email, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{}
+	if email != "" {
+		resp["email"] = fieldAvailability{Value: email, Available: emailFree}
+	}
+	if username != "" {
+		resp["username"] = fieldAvailability{Value: username, Available: usernameFree}
+	}
+	c.JSON(http.StatusOK, resp)
+}
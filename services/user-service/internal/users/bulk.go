@@ -0,0 +1,386 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultImportBatch = 500
+	maxImportBatch     = 5000
+	maxReportedErrors  = 1000
+	maxNDJSONLine      = 1 << 20
+	exportPageSize     = 1000
+)
+
+// Record is a user row as imported and exported. Password and PasswordHash
+// are only read on import; exports never include credentials.
+type Record struct {
+	ID           int        `json:"id,omitempty"`
+	Email        string     `json:"email"`
+	Username     string     `json:"username"`
+	FirstName    string     `json:"first_name,omitempty"`
+	LastName     string     `json:"last_name,omitempty"`
+	OrgID        *int       `json:"org_id,omitempty"`
+	OrgRole      string     `json:"org_role,omitempty"`
+	Phone        string     `json:"phone,omitempty"`
+	AvatarURL    string     `json:"avatar_url,omitempty"`
+	Locale       string     `json:"locale,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	Password     string     `json:"password,omitempty"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+}
+
+// exportColumns is the CSV header of exports. Imports accept the same
+// columns plus password and password_hash; id and created_at are ignored.
+var exportColumns = []string{"id", "email", "username", "first_name", "last_name", "org_id", "org_role", "phone", "avatar_url", "locale", "created_at"}
+
+var recordSetters = map[string]func(r *Record, v string) error{
+	"id":            func(r *Record, v string) error { return nil },
+	"created_at":    func(r *Record, v string) error { return nil },
+	"email":         func(r *Record, v string) error { r.Email = v; return nil },
+	"username":      func(r *Record, v string) error { r.Username = v; return nil },
+	"first_name":    func(r *Record, v string) error { r.FirstName = v; return nil },
+	"last_name":     func(r *Record, v string) error { r.LastName = v; return nil },
+	"org_role":      func(r *Record, v string) error { r.OrgRole = v; return nil },
+	"phone":         func(r *Record, v string) error { r.Phone = v; return nil },
+	"avatar_url":    func(r *Record, v string) error { r.AvatarURL = v; return nil },
+	"locale":        func(r *Record, v string) error { r.Locale = v; return nil },
+	"password":      func(r *Record, v string) error { r.Password = v; return nil },
+	"password_hash": func(r *Record, v string) error { r.PasswordHash = v; return nil },
+	"org_id": func(r *Record, v string) error {
+		if v == "" {
+			return nil
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("org_id must be an integer")
+		}
+		r.OrgID = &id
+		return nil
+	},
+}
+
+// rowError is a problem with a single input row; reading can continue past
+// it. Any other error from a recordReader ends the import.
+type rowError struct{ err error }
+
+func (e rowError) Error() string { return e.err.Error() }
+
+type recordReader interface {
+	// next returns io.EOF after the last record.
+	next() (Record, error)
+}
+
+type csvReader struct {
+	r       *csv.Reader
+	setters []func(r *Record, v string) error
+}
+
+func newCSVReader(body io.Reader) (*csvReader, error) {
+	r := csv.NewReader(body)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+
+	cr := &csvReader{r: r}
+	seen := map[string]bool{}
+	for _, col := range header {
+		col = strings.TrimSpace(strings.ToLower(col))
+		set, ok := recordSetters[col]
+		if !ok {
+			return nil, fmt.Errorf("unknown csv column %q", col)
+		}
+		seen[col] = true
+		cr.setters = append(cr.setters, set)
+	}
+	if !seen["email"] || !seen["username"] {
+		return nil, errors.New("csv header must include email and username")
+	}
+	return cr, nil
+}
+
+func (cr *csvReader) next() (Record, error) {
+	fields, err := cr.r.Read()
+	if errors.Is(err, csv.ErrFieldCount) {
+		return Record{}, rowError{errors.New("wrong number of fields")}
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	var rec Record
+	for i, v := range fields {
+		if err := cr.setters[i](&rec, strings.TrimSpace(v)); err != nil {
+			return Record{}, rowError{err}
+		}
+	}
+	return rec, nil
+}
+
+type ndjsonReader struct {
+	s *bufio.Scanner
+}
+
+func newNDJSONReader(body io.Reader) *ndjsonReader {
+	s := bufio.NewScanner(body)
+	s.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+	return &ndjsonReader{s: s}
+}
+
+// next skips blank lines, so they do not count as rows.
+func (nr *ndjsonReader) next() (Record, error) {
+	for nr.s.Scan() {
+		line := bytes.TrimSpace(nr.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			return Record{}, rowError{fmt.Errorf("invalid json: %w", err)}
+		}
+		return rec, nil
+	}
+	if err := nr.s.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+// prepare normalizes and validates an import record and replaces a plain
+// password with its hash. Records without either get a hash no password matches, so those
+// users cannot sign in until a password is set.
+func prepare(rec *Record) error {
+	rec.Email, rec.Username = normalizeEmail(rec.Email), normalizeUsername(rec.Username)
+	if err := validateEmail(rec.Email); err != nil {
+		return err
+	}
+	if err := validateUsername(rec.Username); err != nil {
+		return err
+	}
+	if rec.OrgRole != "" && rec.OrgRole != "member" && rec.OrgRole != "admin" {
+		return errors.New("org_role must be member or admin")
+	}
+	switch {
+	case rec.Password != "" && rec.PasswordHash != "":
+		return errors.New("set password or password_hash, not both")
+	case rec.Password != "":
+		hash, err := bcrypt.GenerateFromPassword([]byte(rec.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		rec.PasswordHash, rec.Password = string(hash), ""
+	case rec.PasswordHash != "":
+		if _, err := bcrypt.Cost([]byte(rec.PasswordHash)); err != nil {
+			return errors.New("password_hash must be a bcrypt hash")
+		}
+	default:
+		rec.PasswordHash = "!"
+	}
+	return nil
+}
+
+type importError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type importReport struct {
+	Imported        int           `json:"imported"`
+	Failed          int           `json:"failed"`
+	Errors          []importError `json:"errors"`
+	ErrorsTruncated bool          `json:"errors_truncated"`
+}
+
+func (r *importReport) fail(row int, err error) {
+	r.Failed++
+	if len(r.Errors) == maxReportedErrors {
+		r.ErrorsTruncated = true
+		return
+	}
+	r.Errors = append(r.Errors, importError{Row: row, Error: err.Error()})
+}
+
+// importUsers streams a CSV (text/csv, with a header row) or NDJSON body
+// into the users table, committing every batch_size valid rows in their own
+// transaction. Rows are numbered from 1, not counting the CSV header. Bad
+// rows are reported and skipped; an unreadable body or a failure writing a
+// batch stops the import, and rows already committed stay imported.
+func (h *Handler) importUsers(c *gin.Context) {
+	batchSize, _ := strconv.Atoi(c.DefaultQuery("batch_size", strconv.Itoa(defaultImportBatch)))
+	if batchSize <= 0 || batchSize > maxImportBatch {
+		batchSize = defaultImportBatch
+	}
+
+	var reader recordReader
+	switch c.ContentType() {
+	case "text/csv":
+		cr, err := newCSVReader(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		reader = cr
+	case "application/x-ndjson", "application/ndjson":
+		reader = newNDJSONReader(c.Request.Body)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be text/csv or application/x-ndjson"})
+		return
+	}
+
+	report := importReport{Errors: []importError{}}
+	batch := make([]Record, 0, batchSize)
+	rows := make([]int, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		errs, err := h.store.ImportBatch(c.Request.Context(), batch)
+		if err != nil {
+			return err
+		}
+		for i, rowErr := range errs {
+			switch {
+			case rowErr == nil:
+				report.Imported++
+			case errors.Is(rowErr, ErrEmailTaken):
+				report.fail(rows[i], errors.New("email already exists"))
+			case errors.Is(rowErr, ErrUsernameTaken):
+				report.fail(rows[i], errors.New("username already exists"))
+			case errors.Is(rowErr, ErrAlreadyExists):
+				report.fail(rows[i], errors.New("email or username already exists"))
+			case errors.Is(rowErr, ErrUnknownOrg):
+				report.fail(rows[i], errors.New("org_id does not exist"))
+			default:
+				report.fail(rows[i], rowErr)
+			}
+		}
+		batch, rows = batch[:0], rows[:0]
+		return nil
+	}
+
+	for row := 1; ; row++ {
+		rec, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var re rowError
+		if errors.As(err, &re) {
+			report.fail(row, re)
+			continue
+		}
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				err = flushErr
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("row %d: %v", row, err), "report": report})
+			return
+		}
+		if err := prepare(&rec); err != nil {
+			report.fail(row, err)
+			continue
+		}
+
+		batch = append(batch, rec)
+		rows = append(rows, row)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// exportUsers streams every user as CSV (the default) or NDJSON. Pages are
+// read from the database only once the previous one has been written, so a
+// slow client slows the export instead of buffering the table in memory.
+func (h *Handler) exportUsers(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "ndjson" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or ndjson"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	page, err := h.store.ExportPage(ctx, 0, exportPageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var write func(Record) error
+	var flush func() error
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		write = func(r Record) error { return w.Write(csvRow(r)) }
+		flush = func() error { w.Flush(); return w.Error() }
+		if err := w.Write(exportColumns); err != nil {
+			return
+		}
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(c.Writer)
+		write = func(r Record) error { return enc.Encode(r) }
+		flush = func() error { return nil }
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	c.Status(http.StatusOK)
+
+	for len(page) > 0 {
+		for _, r := range page {
+			if err := write(r); err != nil {
+				return
+			}
+		}
+		if err := flush(); err != nil {
+			return
+		}
+		c.Writer.Flush()
+
+		if len(page) < exportPageSize || ctx.Err() != nil {
+			return
+		}
+		page, err = h.store.ExportPage(ctx, page[len(page)-1].ID, exportPageSize)
+		if err != nil {
+			// Headers are already sent; the client sees a truncated body.
+			log.Printf("user export aborted: %v", err)
+			return
+		}
+	}
+}
+
+func csvRow(r Record) []string {
+	orgID, createdAt := "", ""
+	if r.OrgID != nil {
+		orgID = strconv.Itoa(*r.OrgID)
+	}
+	if r.CreatedAt != nil {
+		createdAt = r.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	return []string{strconv.Itoa(r.ID), r.Email, r.Username, r.FirstName, r.LastName, orgID, r.OrgRole,
+		r.Phone, r.AvatarURL, r.Locale, createdAt}
+}
@@ -0,0 +1,23 @@
+package users_test
+
+import (
+	"testing"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/clients/contracttest"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/testutil"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+// TestGatewayContract checks the answers the gateway's dashboard relies on.
+// The gateway forwards the customer's own token.
+func TestGatewayContract(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := testutil.NewUserStore(testutil.User(testutil.ID(7), testutil.Email("ada@example.com"), testutil.Username("ada")))
+	router := gin.New()
+	router.Use(func(c *gin.Context) { auth.WithPrincipal(c, &auth.Principal{UserID: 7, Roles: []string{"customer"}}) })
+	users.NewHandler(store, nil, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+
+	contracttest.Verify(t, router, contracttest.Load(t, "api-gateway", "user-service"))
+}
@@ -0,0 +1,11 @@
+package users
+
+import "time"
+
+// MaxLookup is the most users a batch lookup takes.
+const MaxLookup = maxLookup
+
+// SetClock sets the time verification tokens are checked against.
+func (v *Verification) SetClock(now func() time.Time) {
+	v.now = now
+}
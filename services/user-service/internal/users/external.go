@@ -0,0 +1,290 @@
+package users
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrInvalidLoginState is returned for a callback whose state was not
+	// issued, has expired or was already used.
+	ErrInvalidLoginState = errors.New("invalid or expired sign-in state")
+	// ErrEmailUnverified is returned when a provider does not vouch for the
+	// email of an identity that is not linked to a user yet.
+	ErrEmailUnverified = errors.New("email is not verified by the identity provider")
+)
+
+// ExternalIdentity is a user as an identity provider knows them. Tenant is
+// the tenant the sign-in was started in.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Tenant        string
+}
+
+// ExternalLogin signs users in through identity providers.
+type ExternalLogin interface {
+	// AuthURL starts a sign-in with provider in ctx's tenant and returns
+	// where to send the browser, or ErrUnknownProvider.
+	AuthURL(ctx context.Context, provider string) (string, error)
+	// Identify finishes a sign-in from the provider's callback, returning
+	// ErrUnknownProvider or ErrInvalidLoginState for a callback it did not
+	// start.
+	Identify(ctx context.Context, provider, state, code string) (*ExternalIdentity, error)
+}
+
+// oidcLogin sends the browser to the provider's consent page.
+func (h *Handler) oidcLogin(c *gin.Context) {
+	if h.external == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "external sign-in is not enabled"})
+		return
+	}
+	url, err := h.external.AuthURL(c.Request.Context(), c.Param("provider"))
+	if errors.Is(err, ErrUnknownProvider) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, url)
+}
+
+// RecoveryCodes gives users the one-time codes that recover their account
+// when they lose every other way into it.
+type RecoveryCodes interface {
+	// Issue replaces userID's recovery codes and returns the new ones.
+	Issue(ctx context.Context, userID int) ([]string, error)
+}
+
+// oidcCallback signs in the user the provider sent back, linking them to
+// the user with their email the first time, or creating one without a
+// password if there is none. A user it creates gets their recovery codes in
+// the response, the only time they are shown.
+func (h *Handler) oidcCallback(c *gin.Context) {
+	if h.external == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "external sign-in is not enabled"})
+		return
+	}
+	if reason := c.Query("error"); reason != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "sign-in was not completed: " + reason})
+		return
+	}
+
+	identity, err := h.external.Identify(c.Request.Context(), c.Param("provider"), c.Query("state"), c.Query("code"))
+	switch {
+	case errors.Is(err, ErrUnknownProvider):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ErrInvalidLoginState):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The provider redirects the browser without the tenant header, so the
+	// sign-in continues in the tenant it was started in.
+	ctx := tenant.NewContext(c.Request.Context(), identity.Tenant)
+	c.Request = c.Request.WithContext(ctx)
+	u, created, err := h.externalUser(ctx, identity)
+	switch {
+	case errors.Is(err, ErrEmailUnverified):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ErrInvalidState):
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is not active"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp, ok := h.startSession(c, u)
+	if !ok {
+		return
+	}
+	if created && h.recovery != nil {
+		codes, err := h.recovery.Issue(ctx, u.ID)
+		if err != nil {
+			// The user exists and is signed in either way.
+			log.Printf("Failed to issue recovery codes to user %d: %v", u.ID, err)
+		} else {
+			resp["recovery_codes"] = codes
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// externalUser finds or links the user behind identity, and reports whether
+// it created them.
+func (h *Handler) externalUser(ctx context.Context, identity *ExternalIdentity) (*User, bool, error) {
+	for retried := false; ; retried = true {
+		u, err := h.store.ExternalUser(ctx, identity.Provider, identity.Subject)
+		if !errors.Is(err, ErrNotFound) {
+			return u, false, err
+		}
+		// Anyone can register someone else's address with a provider that
+		// does not verify it, so only a verified email may claim a user.
+		if !identity.EmailVerified {
+			return nil, false, ErrEmailUnverified
+		}
+		u, created, err := h.store.LinkExternal(ctx, *identity)
+		// A concurrent sign-in linked or created the user first.
+		if errors.Is(err, ErrAlreadyExists) && !retried {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if created {
+			log.Printf("Created user %d from a %s sign-in", u.ID, identity.Provider)
+		} else {
+			log.Printf("Linked user %d to a %s identity", u.ID, identity.Provider)
+		}
+		h.announceVerifiedEmail(ctx, u)
+		return u, created, nil
+	}
+}
+
+// ExternalUser returns the user linked to a provider's subject, or
+// ErrInvalidState if they are no longer active.
+func (s *PostgresStore) ExternalUser(ctx context.Context, provider, subject string) (*User, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + userColumns + ` FROM user_service.users
+		WHERE tenant_id = $3 AND id = (SELECT user_id FROM user_service.user_identities
+			WHERE provider = $1 AND subject = $2 AND tenant_id = $3)`
+	u, err := scanUser(s.db.QueryRowContext(ctx, query, provider, subject, tenant.FromContext(ctx)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Status != StatusActive {
+		return nil, ErrInvalidState
+	}
+	return u, nil
+}
+
+// LinkExternal links identity to the user with its email, creating one
+// with no password when there is none, and reports whether it created one.
+// It returns ErrInvalidState if that user is not active, and
+// ErrAlreadyExists if the identity or email was claimed concurrently.
+func (s *PostgresStore) LinkExternal(ctx context.Context, identity ExternalIdentity) (*User, bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var u *User
+	var created bool
+	err := trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		email, tenantID := normalizeEmail(identity.Email), tenant.FromContext(ctx)
+		const byEmail string = "SELECT " + userColumns + " FROM user_service.users WHERE lower(email) = $1 AND tenant_id = $2 FOR UPDATE"
+		var err error
+		u, err = scanUser(tx.QueryRowContext(ctx, byEmail, email, tenantID))
+		created = errors.Is(err, sql.ErrNoRows)
+		switch {
+		case created:
+			if u, err = createExternal(ctx, tx, identity, email, tenantID); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case u.Status != StatusActive:
+			return ErrInvalidState
+		case u.VerifiedAt == nil:
+			// The provider verified the email this user was found by.
+			const verify string = "UPDATE user_service.users SET verified_at = NOW() WHERE id = $1 RETURNING " + userColumns
+			if u, err = scanUser(tx.QueryRowContext(ctx, verify, u.ID)); err != nil {
+				return err
+			}
+		}
+
+		const link string = `INSERT INTO user_service.user_identities (user_id, tenant_id, provider, subject, email)
+			VALUES ($1, $2, $3, $4, $5)`
+		if _, err := tx.ExecContext(ctx, link, u.ID, tenantID, identity.Provider, identity.Subject, email); isUniqueViolation(err) {
+			return ErrAlreadyExists
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return u, created, nil
+}
+
+// createExternal inserts a user who signs in only through providers, with
+// the email the provider verified. An empty password hash never matches a
+// password, so password sign-in stays closed to them.
+func createExternal(ctx context.Context, tx *sql.Tx, identity ExternalIdentity, email, tenantID string) (*User, error) {
+	username := externalUsername(email)
+	var taken bool
+	const exists string = "SELECT EXISTS (SELECT 1 FROM user_service.users WHERE tenant_id = $1 AND lower(username) = lower($2))"
+	if err := tx.QueryRowContext(ctx, exists, tenantID, username).Scan(&taken); err != nil {
+		return nil, err
+	}
+	if taken {
+		sum := sha256.Sum256([]byte(identity.Provider + ":" + identity.Subject))
+		username += "-" + hex.EncodeToString(sum[:3])
+	}
+
+	const insert string = `INSERT INTO user_service.users (email, username, password_hash, tenant_id, verified_at)
+		VALUES ($1, $2, '', $3, NOW()) RETURNING ` + userColumns
+	u, err := scanUser(tx.QueryRowContext(ctx, insert, email, username, tenantID))
+	if isUniqueViolation(err) {
+		return nil, ErrAlreadyExists
+	}
+	return u, err
+}
+
+// externalUsername derives a username from the local part of an email.
+func externalUsername(email string) string {
+	local, _, _ := strings.Cut(email, "@")
+	if local == "" {
+		local = "user"
+	}
+	if len(local) > 64 {
+		local = local[:64]
+	}
+	return local
+}
+
+// announceVerifiedEmail publishes an EmailVerification for a user linked
+// through a provider that verified their email. Signing in does not depend
+// on it, so a failure is only logged.
+func (h *Handler) announceVerifiedEmail(ctx context.Context, u *User) {
+	if h.publisher == nil {
+		return
+	}
+	e, err := events.New(events.UserEmailVerified, "user-service", events.EmailVerification{
+		UserID: u.ID,
+		Tenant: tenant.FromContext(ctx),
+		Email:  u.Email,
+	})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish email verification of user %d: %v", u.ID, err)
+	}
+}
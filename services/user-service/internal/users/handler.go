@@ -0,0 +1,156 @@
+package users
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/cachetags"
+	"github.com/alux444/go-microserv-test/pkg/etag"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/fields"
+	"github.com/alux444/go-microserv-test/pkg/ndjson"
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	store        Store
+	tokens       *auth.Tokens
+	publisher    events.Publisher
+	guard        LoginGuard
+	sessions     Sessions
+	external     ExternalLogin
+	verification *Verification
+	recovery     RecoveryCodes
+}
+
+// NewHandler announces sign-ins on publisher when it is non-nil. With a
+// guard, sign-ins it finds risky must be confirmed with a one-time code.
+// Sign-ins also get a refresh token when sessions is non-nil, and can go
+// through identity providers when external is. Users can verify their
+// email when verification is non-nil, and users created on sign-in are
+// given recovery codes when recovery is.
+func NewHandler(store Store, tokens *auth.Tokens, publisher events.Publisher, guard LoginGuard, sessions Sessions, external ExternalLogin, verification *Verification, recovery RecoveryCodes) *Handler {
+	return &Handler{store: store, tokens: tokens, publisher: publisher, guard: guard, sessions: sessions, external: external, verification: verification, recovery: recovery}
+}
+
+// RegisterRoutes expects auth.Authenticate to run before these routes.
+func (h *Handler) RegisterRoutes(router gin.IRouter) {
+	router.POST("/auth/login", h.login)
+	router.POST("/auth/login/verify", h.verifyLogin)
+	router.POST("/auth/refresh", h.refresh)
+	router.POST("/auth/logout", h.logout)
+	router.GET("/auth/oidc/:provider/login", h.oidcLogin)
+	router.GET("/auth/oidc/:provider/callback", h.oidcCallback)
+	router.GET("/users", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.list)
+	router.GET("/users/check", h.check)
+	router.POST("/users/verify", h.verifyEmail)
+	router.GET("/users/search", auth.RequireRole(auth.RoleAdmin), h.search)
+	router.POST("/users/import", auth.RequireRole(auth.RoleAdmin), h.importUsers)
+	router.GET("/users/export", auth.RequireRole(auth.RoleAdmin), h.exportUsers)
+	router.GET("/users/:id", h.get)
+	router.DELETE("/users/:id", h.erase)
+	router.POST("/users/:id/deactivate", auth.RequireRole(auth.RoleAdmin), h.deactivate)
+	router.POST("/users/:id/reactivate", auth.RequireRole(auth.RoleAdmin), h.reactivate)
+	router.POST("/users/:id/verification", h.requestVerification)
+	router.GET("/users/:id/org", h.membership)
+	router.GET("/users/:id/roles", h.listRoles)
+	router.POST("/users/:id/roles", auth.RequireRole(auth.RoleAdmin), h.addRole)
+	router.DELETE("/users/:id/roles/:role", auth.RequireRole(auth.RoleAdmin), h.removeRole)
+	router.GET("/users/:id/sessions", h.listSessions)
+	router.DELETE("/users/:id/sessions/:sid", h.endSession)
+	router.GET("/orgs/:id/admins", auth.RequireRole(auth.RoleAdmin, auth.RoleService), h.listOrgAdmins)
+	router.POST("/internal/users/batch", auth.InternalOnly(), h.lookup)
+}
+
+// userFields are the fields of a user ?fields= may select.
+var userFields = fields.Allow("id", "email", "username", "status", "deactivated_at", "verified_at")
+
+// list answers the first page of users, or every user as NDJSON when the
+// client accepts it.
+func (h *Handler) list(c *gin.Context) {
+	sel, ok := userFields.Bind(c)
+	if !ok {
+		return
+	}
+	if ndjson.Accepted(c.Request) {
+		s := ndjson.Start(c)
+		s.Close(h.store.Stream(c.Request.Context(), func(u User) error { return s.Write(sel.Apply(u)) }))
+		return
+	}
+	users, err := h.store.List(c.Request.Context(), 10)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": fields.ApplyEach(sel, users)})
+}
+
+func (h *Handler) get(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+	sel, ok := userFields.Bind(c)
+	if !ok {
+		return
+	}
+
+	u, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cachetags.Set(c, cachetags.User(u.ID))
+	if etag.NotModified(c, u.Version) {
+		return
+	}
+	c.JSON(http.StatusOK, sel.Apply(u))
+}
+
+// membership answers the organization the user belongs to, which services
+// such as order-service trust over an org named in a request.
+func (h *Handler) membership(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+	m, err := h.store.Membership(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+func (h *Handler) listOrgAdmins(c *gin.Context) {
+	orgID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid org id"})
+		return
+	}
+
+	admins, err := h.store.ListOrgAdmins(c.Request.Context(), orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"admins": admins})
+}
@@ -0,0 +1,721 @@
+package users_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/testutil"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+// newRouter serves John, a customer, and Jane from a fake store.
+func newRouter(t *testing.T) (*gin.Engine, *auth.Tokens) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John(), testutil.Jane())
+	store.Granted[1] = []string{auth.RoleCustomer}
+	router := testutil.Router(tokens)
+	users.NewHandler(store, tokens, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	return router, tokens
+}
+
+// importReport is the report POST /users/import answers with.
+type importReport struct {
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	Errors   []struct {
+		Row   int    `json:"row"`
+		Error string `json:"error"`
+	} `json:"errors"`
+}
+
+func TestLogin(t *testing.T) {
+	router, tokens := newRouter(t)
+
+	w := testutil.Do(router, http.MethodPost, "/auth/login", "", `{"email":"john.doe@example.com","password":"wrong"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a bad password, got: %d", w.Code)
+	}
+
+	w = testutil.Do(router, http.MethodPost, "/auth/login", "", `{"email":"john.doe@example.com","password":"password123"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", w.Code)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	p, err := tokens.Parse(resp.Token)
+	if err != nil || p.UserID != 1 || !p.HasRole(auth.RoleCustomer) || p.Tenant != tenant.Default {
+		t.Errorf("Expected customer token for user 1 in the default tenant, got: %+v, %v", p, err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email":"john.doe@example.com","password":"password123"}`))
+	req.Header.Set(tenant.Header, "acme")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if p, err := tokens.Parse(resp.Token); err != nil || p.Tenant != "acme" {
+		t.Errorf("Expected a token bound to tenant acme, got: %+v, %v", p, err)
+	}
+}
+
+// stubGuard challenges sign-ins from 198.51.100.1 with code 123456.
+type stubGuard struct {
+	verified bool
+}
+
+func (g *stubGuard) Assess(ctx context.Context, attempt users.LoginAttempt) (*users.StepUp, error) {
+	if attempt.ClientIP != "198.51.100.1" {
+		return nil, nil
+	}
+	return &users.StepUp{ChallengeID: "c1", ExpiresAt: time.Now().Add(time.Minute), Reasons: []string{"new_country"}}, nil
+}
+
+func (g *stubGuard) Verify(ctx context.Context, challengeID, code string) (int, error) {
+	if challengeID != "c1" || code != "123456" || g.verified {
+		return 0, users.ErrInvalidChallenge
+	}
+	g.verified = true
+	return 1, nil
+}
+
+func TestLoginStepUp(t *testing.T) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John())
+	router := testutil.Router(tokens)
+	users.NewHandler(store, tokens, nil, &stubGuard{}, nil, nil, nil, nil).RegisterRoutes(router)
+	login := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email":"john.doe@example.com","password":"password123"}`))
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := login("192.0.2.1"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"token"`) {
+		t.Errorf("Expected a usual sign-in to get a token, got: %d %s", w.Code, w.Body.String())
+	}
+	w := login("198.51.100.1")
+	if w.Code != http.StatusAccepted || strings.Contains(w.Body.String(), `"token"`) || !strings.Contains(w.Body.String(), `"challenge_id":"c1"`) {
+		t.Fatalf("Expected a risky sign-in to be challenged without a token, got: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := testutil.Do(router, http.MethodPost, "/auth/login/verify", "", `{"challenge_id":"c1","code":"000000"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong code to be 401, got: %d", w.Code)
+	}
+	w = testutil.Do(router, http.MethodPost, "/auth/login/verify", "", `{"challenge_id":"c1","code":"123456"}`)
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the code to sign in, got: %d %s", w.Code, w.Body.String())
+	}
+	if p, err := tokens.Parse(resp.Token); err != nil || p.UserID != 1 {
+		t.Errorf("Expected a token for user 1, got: %+v, %v", p, err)
+	}
+}
+
+func TestRoleAccess(t *testing.T) {
+	router, tokens := newRouter(t)
+	customer := testutil.Token(t, tokens, 1, auth.RoleCustomer)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+	service := testutil.ServiceToken(t, tokens, "order-service")
+
+	tests := []struct {
+		method, path, token, body string
+		want                      int
+	}{
+		{method: http.MethodGet, path: "/users", want: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/users", token: customer, want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/users", token: admin, want: http.StatusOK},
+		{method: http.MethodGet, path: "/users/1", token: customer, want: http.StatusOK},
+		{method: http.MethodGet, path: "/users/2", token: customer, want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/orgs/1/admins", token: service, want: http.StatusOK},
+		{method: http.MethodGet, path: "/orgs/1/admins", token: customer, want: http.StatusForbidden},
+		{method: http.MethodPost, path: "/users/2/roles", token: customer, body: `{"role":"admin"}`, want: http.StatusForbidden},
+		{method: http.MethodPost, path: "/users/2/roles", token: admin, body: `{"role":"superuser"}`, want: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/users/2/roles", token: admin, body: `{"role":"service"}`, want: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/users/2/roles", token: admin, body: `{"role":"admin"}`, want: http.StatusCreated},
+		{method: http.MethodPost, path: "/users/3/roles", token: admin, body: `{"role":"admin"}`, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := testutil.Do(router, tt.method, tt.path, tt.token, tt.body); w.Code != tt.want {
+			t.Errorf("%s %s: expected status %d, got: %d", tt.method, tt.path, tt.want, w.Code)
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John(), testutil.Jane(testutil.Status(users.StatusDeactivated)))
+	orgID := 3
+	store.OrgID = &orgID
+	router := testutil.Router(tokens)
+	users.NewHandler(store, tokens, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	service := testutil.ServiceToken(t, tokens, "order-service")
+
+	w := testutil.Do(router, http.MethodGet, "/users/1/org", service, "")
+	var m users.Membership
+	json.Unmarshal(w.Body.Bytes(), &m)
+	if w.Code != http.StatusOK || m.UserID != 1 || m.OrgID == nil || *m.OrgID != orgID || m.OrgRole != "member" {
+		t.Errorf("Expected user 1 to be a member of org %d, got: %d %s", orgID, w.Code, w.Body.String())
+	}
+	if w := testutil.Do(router, http.MethodGet, "/users/1/org", testutil.Token(t, tokens, 2, auth.RoleCustomer), ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's org to be forbidden, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodGet, "/users/2/org", service, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a deactivated user to have no org, got: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBatchLookup(t *testing.T) {
+	router, tokens := newRouter(t)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+	service := testutil.ServiceToken(t, tokens, "order-service")
+
+	if w := testutil.Do(router, http.MethodPost, "/internal/users/batch", admin, `{"ids":[1]}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the lookup to be for services only, got: %d", w.Code)
+	}
+	user := testutil.Token(t, tokens, 98, auth.RoleService)
+	if w := testutil.Do(router, http.MethodPost, "/internal/users/batch", user, `{"ids":[1]}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a user holding the service role to be refused, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/internal/users/batch", service, `{"ids":[]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty batch to be refused, got: %d", w.Code)
+	}
+	ids := strings.Repeat("1,", users.MaxLookup) + "2"
+	if w := testutil.Do(router, http.MethodPost, "/internal/users/batch", service, `{"ids":[`+ids+`]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a batch over %d to be refused, got: %d", users.MaxLookup, w.Code)
+	}
+
+	w := testutil.Do(router, http.MethodPost, "/internal/users/batch", service, `{"ids":[2,1,7]}`)
+	var resp struct {
+		Users map[int]users.User `json:"users"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the users, got: %d %s", w.Code, w.Body)
+	}
+	if len(resp.Users) != 2 || resp.Users[1].Username != "johndoe" || resp.Users[2].Email != "jane.doe@example.com" {
+		t.Errorf("Expected users 1 and 2 keyed by ID and 7 left out, got: %+v", resp.Users)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	router, tokens := newRouter(t)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+	customer := testutil.Token(t, tokens, 1, auth.RoleCustomer)
+
+	if w := testutil.Do(router, http.MethodGet, "/users/search?q=doe", customer, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected search to be for admins only, got: %d", w.Code)
+	}
+	for _, query := range []string{"", "q=+j+", "q=doe&limit=0", "q=doe&limit=abc"} {
+		if w := testutil.Do(router, http.MethodGet, "/users/search?"+query, admin, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be refused, got: %d", query, w.Code)
+		}
+	}
+
+	w := testutil.Do(router, http.MethodGet, "/users/search?q=JANE&limit=5", admin, "")
+	var resp struct {
+		Query   string        `json:"query"`
+		Results []users.Match `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected results, got: %d %s", w.Code, w.Body)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].User.ID != 2 {
+		t.Fatalf("Expected jane.doe only, got: %+v", resp.Results)
+	}
+	want := map[string]string{"email": "<mark>jane</mark>.doe@example.com", "username": "<mark>jane</mark>doe"}
+	if got := resp.Results[0].Highlights; len(got) != 2 || got["email"] != want["email"] || got["username"] != want["username"] {
+		t.Errorf("Expected the matches highlighted, got: %v", got)
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John())
+	router := testutil.Router(tokens)
+	users.NewHandler(store, tokens, nil, nil, nil, nil, nil, nil).RegisterRoutes(router)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+
+	body := "email,username,org_id,password_hash\n" +
+		"a@example.com,alice,,\n" +
+		" John.Doe@Example.com ,john2,,\n" +
+		"not-an-email,bob,,\n" +
+		"c@example.com,carol,x,\n" +
+		"d@example.com,dave,,plaintext\n" +
+		"e@example.com,erin\n" +
+		"f@example.com,frank,,\n"
+	req := httptest.NewRequest(http.MethodPost, "/users/import?batch_size=1", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	req.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d %s", w.Code, w.Body)
+	}
+
+	var report importReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Imported != 2 || report.Failed != 5 || store.Batches != 3 {
+		t.Errorf("Expected 2 imported and 5 failed over 3 batches, got: %+v in %d batches", report, store.Batches)
+	}
+	var rows []int
+	for _, e := range report.Errors {
+		rows = append(rows, e.Row)
+	}
+	if fmt.Sprint(rows) != "[2 3 4 5 6]" {
+		t.Errorf("Expected errors for rows 2 to 6, got: %+v", report.Errors)
+	}
+	if report.Errors[0].Error != "email already exists" {
+		t.Errorf("Expected row 2 to conflict on its email, got: %q", report.Errors[0].Error)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/users/import", strings.NewReader(
+		`{"email":"g@example.com","username":"gina","password":"secret"}`+"\n\n"+`{"email":"h@example.com","nickname":"h"}`+"\n"))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	report = importReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Imported != 1 || report.Failed != 1 || report.Errors[0].Row != 2 {
+		t.Errorf("Expected the unknown field on row 2 to fail, got: %+v", report)
+	}
+
+	w = testutil.Do(router, http.MethodPost, "/users/import", admin, "email,username\n")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415 without a content type, got: %d", w.Code)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	router, tokens := newRouter(t)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+
+	w := testutil.Do(router, http.MethodGet, "/users/export", admin, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", w.Code)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id,email,username") || !strings.HasPrefix(lines[2], "2,jane.doe@example.com,janedoe") {
+		t.Errorf("Expected a header and two users, got: %q", lines)
+	}
+
+	w = testutil.Do(router, http.MethodGet, "/users/export?format=ndjson", admin, "")
+	var first users.Record
+	if err := json.Unmarshal([]byte(strings.SplitN(w.Body.String(), "\n", 2)[0]), &first); err != nil || first.ID != 1 {
+		t.Errorf("Expected the first NDJSON line to be user 1, got: %+v, %v", first, err)
+	}
+}
+
+func TestListNDJSON(t *testing.T) {
+	router, tokens := newRouter(t)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected an NDJSON stream, got: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var ids []int
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var u users.User
+		if err := json.Unmarshal([]byte(line), &u); err != nil {
+			t.Fatalf("Expected a user per line, got %q: %v", line, err)
+		}
+		ids = append(ids, u.ID)
+	}
+	if fmt.Sprint(ids) != "[1 2]" {
+		t.Errorf("Expected every user in ID order, got: %v", ids)
+	}
+}
+
+func TestSparseFields(t *testing.T) {
+	router, tokens := newRouter(t)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+
+	if w := testutil.Do(router, http.MethodGet, "/users/1?fields=id,email", admin, ""); w.Body.String() != `{"email":"john.doe@example.com","id":1}` {
+		t.Errorf("Expected only the selected fields, got: %d %s", w.Code, w.Body)
+	}
+	if w := testutil.Do(router, http.MethodGet, "/users?fields=username", admin, ""); !strings.Contains(w.Body.String(), `{"username":"johndoe"}`) {
+		t.Errorf("Expected the fields selected on every listed user, got: %d %s", w.Code, w.Body)
+	}
+	if w := testutil.Do(router, http.MethodGet, "/users/1?fields=id,password_hash", admin, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a field not on the allowlist to be refused, got: %d", w.Code)
+	}
+}
+
+func TestDeactivateAndErase(t *testing.T) {
+	router, tokens := newRouter(t)
+	customer := testutil.Token(t, tokens, 1, auth.RoleCustomer)
+	admin := testutil.Token(t, tokens, 99, auth.RoleAdmin)
+	service := testutil.ServiceToken(t, tokens, "order-service")
+	login := `{"email":"john.doe@example.com","password":"password123"}`
+
+	if w := testutil.Do(router, http.MethodPost, "/users/1/deactivate", customer, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a customer deactivating, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/users/1/deactivate", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/users/1/deactivate", admin, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 deactivating twice, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/auth/login", "", login); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a deactivated user not to sign in, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodGet, "/users", admin, ""); strings.Contains(w.Body.String(), "johndoe") {
+		t.Errorf("Expected a deactivated user not to be listed, got: %s", w.Body)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/users/1/reactivate", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/auth/login", "", login); w.Code != http.StatusOK {
+		t.Errorf("Expected a reactivated user to sign in, got: %d", w.Code)
+	}
+
+	tests := []struct {
+		path, token string
+		want        int
+	}{
+		{path: "/users/2", token: customer, want: http.StatusForbidden},
+		{path: "/users/1", token: service, want: http.StatusForbidden},
+		{path: "/users/3", token: admin, want: http.StatusNotFound},
+		{path: "/users/1", token: customer, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if w := testutil.Do(router, http.MethodDelete, tt.path, tt.token, ""); w.Code != tt.want {
+			t.Errorf("DELETE %s: expected status %d, got: %d", tt.path, tt.want, w.Code)
+		}
+	}
+
+	w := testutil.Do(router, http.MethodGet, "/users/1", admin, "")
+	var u users.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatalf("Failed to decode user: %v", err)
+	}
+	if u.Status != users.StatusDeleted || strings.Contains(u.Email, "john") {
+		t.Errorf("Expected an anonymized deleted user, got: %+v", u)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/users/1/reactivate", admin, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 reactivating a deleted user, got: %d", w.Code)
+	}
+}
+
+func TestCheckAvailability(t *testing.T) {
+	router, _ := newRouter(t)
+
+	tests := []struct {
+		query string
+		want  int
+		body  string
+	}{
+		{query: "", want: http.StatusBadRequest},
+		{query: "email=not-an-email", want: http.StatusBadRequest},
+		{query: "email=%20John.Doe@Example.COM%20", want: http.StatusOK, body: `{"email":{"value":"john.doe@example.com","available":false}}`},
+		{query: "email=ada@example.com&username=JaneDoe", want: http.StatusOK,
+			body: `{"email":{"value":"ada@example.com","available":true},"username":{"value":"JaneDoe","available":false}}`},
+		{query: "username=ada", want: http.StatusOK, body: `{"username":{"value":"ada","available":true}}`},
+	}
+	for _, tt := range tests {
+		w := testutil.Do(router, http.MethodGet, "/users/check?"+tt.query, "", "")
+		if w.Code != tt.want {
+			t.Errorf("%s: expected status %d, got: %d %s", tt.query, tt.want, w.Code, w.Body)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: expected %s, got: %s", tt.query, tt.body, w.Body)
+		}
+	}
+
+	if w := testutil.Do(router, http.MethodPost, "/auth/login", "", `{"email":" JOHN.doe@example.com","password":"password123"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected login to ignore the email's case and spaces, got: %d", w.Code)
+	}
+}
+
+// stubExternal signs in as the identity named by the callback's code.
+type stubExternal struct{}
+
+func (stubExternal) AuthURL(ctx context.Context, provider string) (string, error) {
+	if provider != "example" {
+		return "", users.ErrUnknownProvider
+	}
+	return "https://idp.example/auth?state=s1", nil
+}
+
+func (stubExternal) Identify(ctx context.Context, provider, state, code string) (*users.ExternalIdentity, error) {
+	if provider != "example" {
+		return nil, users.ErrUnknownProvider
+	}
+	if state != "s1" {
+		return nil, users.ErrInvalidLoginState
+	}
+	identities := map[string]users.ExternalIdentity{
+		"john":    {Subject: "42", Email: "John.Doe@example.com", EmailVerified: true},
+		"jane":    {Subject: "9", Email: "jane.doe@example.com"},
+		"newuser": {Subject: "7", Email: "new@example.com", EmailVerified: true},
+	}
+	identity, ok := identities[code]
+	if !ok {
+		return nil, errors.New("provider rejected the code")
+	}
+	identity.Provider, identity.Tenant = provider, tenant.Default
+	return &identity, nil
+}
+
+// stubRecovery issues the same codes to every user and records who got them.
+type stubRecovery struct {
+	issued []int
+}
+
+func (r *stubRecovery) Issue(ctx context.Context, userID int) ([]string, error) {
+	r.issued = append(r.issued, userID)
+	return []string{"abcde-fghij", "kmnpq-rstuv"}, nil
+}
+
+func TestExternalLogin(t *testing.T) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John(), testutil.Jane())
+	sessions := testutil.NewSessions()
+	router := testutil.Router(tokens)
+	recovery := &stubRecovery{}
+	users.NewHandler(store, tokens, nil, nil, sessions, stubExternal{}, nil, recovery).RegisterRoutes(router)
+
+	if w := testutil.Do(router, http.MethodGet, "/auth/oidc/other/login", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown provider to be 404, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodGet, "/auth/oidc/example/login", "", ""); w.Code != http.StatusFound || w.Header().Get("Location") != "https://idp.example/auth?state=s1" {
+		t.Errorf("Expected a redirect to the provider, got: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	callback := func(query string) *httptest.ResponseRecorder {
+		return testutil.Do(router, http.MethodGet, "/auth/oidc/example/callback?"+query, "", "")
+	}
+	if w := callback("state=forged&code=john"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a forged state to be 400, got: %d", w.Code)
+	}
+	if w := callback("error=access_denied"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a declined consent to be 401, got: %d", w.Code)
+	}
+	if w := callback("state=s1&code=bad"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a failed exchange to be 502, got: %d", w.Code)
+	}
+	if w := callback("state=s1&code=jane"); w.Code != http.StatusForbidden || len(store.Identities) != 0 {
+		t.Errorf("Expected an unverified email not to claim a user, got: %d %v", w.Code, store.Identities)
+	}
+
+	var resp struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	w := callback("state=s1&code=john")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a verified email to sign in, got: %d %s", w.Code, w.Body.String())
+	}
+	if p, err := tokens.Parse(resp.Token); err != nil || p.UserID != 1 || store.Identities["example 42"] != 1 || resp.RefreshToken == "" {
+		t.Errorf("Expected user 1 to be linked and signed in with a refresh token, got: %+v, %v, %v, %q", p, err, store.Identities, resp.RefreshToken)
+	}
+
+	// Once linked, the identity signs in without looking at the email.
+	store.Users[1] = testutil.John(testutil.Email("john@elsewhere.example"))
+	if w := callback("state=s1&code=john"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id":1`) {
+		t.Errorf("Expected the linked identity to sign in as user 1, got: %d %s", w.Code, w.Body.String())
+	}
+
+	if strings.Contains(w.Body.String(), "recovery_codes") || len(recovery.issued) != 0 {
+		t.Errorf("Expected no recovery codes for a linked user, got: %s %v", w.Body.String(), recovery.issued)
+	}
+
+	w = callback("state=s1&code=newuser")
+	if w.Code != http.StatusOK || len(store.Users) != 3 || store.Users[3].Username != "new" {
+		t.Errorf("Expected a user to be created for a new email, got: %d %v", w.Code, store.Users)
+	}
+	if !strings.Contains(w.Body.String(), `"recovery_codes":["abcde-fghij","kmnpq-rstuv"]`) || len(recovery.issued) != 1 || recovery.issued[0] != 3 {
+		t.Errorf("Expected the new user to be given recovery codes, got: %s %v", w.Body.String(), recovery.issued)
+	}
+	if w := callback("state=s1&code=newuser"); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "recovery_codes") {
+		t.Errorf("Expected recovery codes only on the sign-in that created the user, got: %d %s", w.Code, w.Body.String())
+	}
+
+	store.Users[1] = testutil.John(testutil.Status(users.StatusDeactivated))
+	if w := callback("state=s1&code=john"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a deactivated user not to sign in, got: %d", w.Code)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John())
+	sessions := testutil.NewSessions()
+	router := testutil.Router(tokens)
+	users.NewHandler(store, tokens, nil, nil, sessions, nil, nil, nil).RegisterRoutes(router)
+
+	if w := testutil.Do(router, http.MethodGet, "/auth/oidc/example/login", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected external sign-in to be off without providers, got: %d", w.Code)
+	}
+
+	type tokenResponse struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	var login tokenResponse
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email":"john.doe@example.com","password":"password123"}`))
+	req.Header.Set(tenant.Header, "acme")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.RefreshToken == "" {
+		t.Fatalf("Expected sign-in to return a refresh token, got: %d %s", w.Code, w.Body.String())
+	}
+
+	var refreshed tokenResponse
+	w = testutil.Do(router, http.MethodPost, "/auth/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &refreshed); err != nil || w.Code != http.StatusOK || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("Expected the refresh token to be rotated, got: %d %s", w.Code, w.Body.String())
+	}
+	if p, err := tokens.Parse(refreshed.Token); err != nil || p.UserID != 1 || p.Tenant != "acme" {
+		t.Errorf("Expected a new token for user 1 in the tenant signed in to, got: %+v, %v", p, err)
+	}
+
+	if w := testutil.Do(router, http.MethodPost, "/auth/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used refresh token to be refused, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/auth/refresh", "", `{"refresh_token":"`+refreshed.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected reuse to revoke the whole session, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/auth/refresh", "", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing refresh token to be 400, got: %d", w.Code)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John())
+	router := testutil.Router(tokens)
+	users.NewHandler(store, tokens, nil, nil, testutil.NewSessions(), nil, nil, nil).RegisterRoutes(router)
+
+	var login struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		SessionID    string `json:"session_id"`
+	}
+	for i := 0; i < 2; i++ {
+		w := testutil.Do(router, http.MethodPost, "/auth/login", "", `{"email":"john.doe@example.com","password":"password123"}`)
+		if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.SessionID == "" {
+			t.Fatalf("Expected sign-in to name its session, got: %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	var list struct {
+		Sessions []users.Session `json:"sessions"`
+	}
+	w := testutil.Do(router, http.MethodGet, "/users/1/sessions", login.Token, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK || len(list.Sessions) != 2 {
+		t.Fatalf("Expected both sessions listed, got: %d %s", w.Code, w.Body.String())
+	}
+	other := testutil.Token(t, tokens, 2, auth.RoleCustomer)
+	if w := testutil.Do(router, http.MethodGet, "/users/1/sessions", other, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected another user's sessions to be forbidden, got: %d", w.Code)
+	}
+
+	if w := testutil.Do(router, http.MethodDelete, "/users/1/sessions/"+login.SessionID, login.Token, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got: %d %s", w.Code, w.Body.String())
+	}
+	if w := testutil.Do(router, http.MethodDelete, "/users/1/sessions/"+login.SessionID, login.Token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an ended session to be 404, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/auth/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an ended session not to refresh, got: %d", w.Code)
+	}
+	w = testutil.Do(router, http.MethodGet, "/users/1/sessions", login.Token, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Sessions) != 1 || list.Sessions[0].ID == login.SessionID {
+		t.Errorf("Expected only the other session left, got: %s", w.Body.String())
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	tokens := testutil.Tokens(t)
+	store := testutil.NewUserStore(testutil.John(), testutil.Jane())
+	publisher := &testutil.Publisher{}
+	verification := users.NewVerification([]byte("verify-secret"), time.Hour, "https://shop.example/verify", publisher)
+	router := testutil.Router(tokens)
+	users.NewHandler(store, tokens, publisher, nil, nil, nil, verification, nil).RegisterRoutes(router)
+
+	john := testutil.Token(t, tokens, 1, auth.RoleCustomer)
+	if w := testutil.Do(router, http.MethodPost, "/users/2/verification", john, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a link for another user to be refused, got: %d", w.Code)
+	}
+	send := func(id int, token string) string {
+		t.Helper()
+		if w := testutil.Do(router, http.MethodPost, fmt.Sprintf("/users/%d/verification", id), token, ""); w.Code != http.StatusAccepted {
+			t.Fatalf("Expected the link to be sent, got: %d %s", w.Code, w.Body.String())
+		}
+		var req events.VerificationRequest
+		last := publisher.Events[len(publisher.Events)-1]
+		if err := last.Decode(&req); err != nil || last.Type != events.UserVerificationRequested || req.UserID != id {
+			t.Fatalf("Expected a verification request for user %d, got: %+v, %v", id, last, err)
+		}
+		link, found := strings.CutPrefix(req.URL, "https://shop.example/verify?token=")
+		if !found {
+			t.Fatalf("Expected a link to the verification page, got: %s", req.URL)
+		}
+		return link
+	}
+	verify := func(token string) *httptest.ResponseRecorder {
+		return testutil.Do(router, http.MethodPost, "/users/verify", "", `{"token":"`+token+`"}`)
+	}
+	link := send(1, john)
+
+	if w := verify("bm90LWEtdG9rZW4.c2ln"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a forged token to be refused, got: %d", w.Code)
+	}
+	verification.SetClock(func() time.Time { return time.Now().Add(2 * time.Hour) })
+	if w := verify(link); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an expired token to be refused, got: %d", w.Code)
+	}
+	verification.SetClock(time.Now)
+
+	sent := len(publisher.Events)
+	if w := verify(link); w.Code != http.StatusOK || store.Users[1].VerifiedAt == nil {
+		t.Fatalf("Expected the email to be verified, got: %d %s", w.Code, w.Body.String())
+	}
+	if len(publisher.Events) != sent+1 || publisher.Events[sent].Type != events.UserEmailVerified {
+		t.Errorf("Expected the verification to be announced, got: %+v", publisher.Events[sent:])
+	}
+	if w := verify(link); w.Code != http.StatusOK || len(publisher.Events) != sent+1 {
+		t.Errorf("Expected a second click to succeed without announcing it again, got: %d", w.Code)
+	}
+	if w := testutil.Do(router, http.MethodPost, "/users/1/verification", john, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected no new link for a verified email, got: %d", w.Code)
+	}
+
+	jane := testutil.Token(t, tokens, 2, auth.RoleCustomer)
+	link = send(2, jane)
+	u := store.Users[2]
+	u.Email = "jane@elsewhere.example"
+	store.Users[2] = u
+	if w := verify(link); w.Code != http.StatusBadRequest || store.Users[2].VerifiedAt != nil {
+		t.Errorf("Expected a link sent to a previous email to be refused, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// maxLookup caps the IDs one batch lookup resolves.
+const maxLookup = 100
+
+type lookupRequest struct {
+	IDs []int `json:"ids" binding:"required"`
+}
+
+// lookup resolves many user IDs at once for other services, which would
+// otherwise call GET /users/{id} once per order or notification. Users
+// are keyed by ID; IDs of unknown users are absent.
+func (h *Handler) lookup(c *gin.Context) {
+	var req lookupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxLookup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ids must list 1 to %d users", maxLookup)})
+		return
+	}
+
+	found, err := h.store.GetMany(c.Request.Context(), req.IDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	users := make(map[string]User, len(found))
+	for _, u := range found {
+		users[strconv.Itoa(u.ID)] = u
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+func (s *PostgresStore) GetMany(ctx context.Context, ids []int) ([]User, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + userColumns + " FROM user_service.users WHERE id = ANY ($1) AND tenant_id = $2 ORDER BY id"
+	return s.query(ctx, database.Reader(ctx, s.db), query, pq.Array(ids), tenant.FromContext(ctx))
+}
@@ -0,0 +1,179 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for a refresh token that is
+	// unknown, expired, revoked or already used.
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrSessionNotFound is returned for a session that does not exist, has
+	// ended or belongs to another user.
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// RefreshToken is one link in a session's chain of refresh tokens.
+type RefreshToken struct {
+	Token     string
+	SessionID string
+	UserID    int
+	Tenant    string
+	ExpiresAt time.Time
+}
+
+// Session is a sign-in that is still being refreshed. ClientIP and
+// UserAgent are those it was started from.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	ClientIP   string    `json:"client_ip"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Sessions keeps users signed in beyond their access token's lifetime.
+type Sessions interface {
+	// Issue starts a session for userID in ctx's tenant, from the client
+	// with clientIP and userAgent.
+	Issue(ctx context.Context, userID int, clientIP, userAgent string) (*RefreshToken, error)
+	// Rotate exchanges token for the next one in its session. Using a token
+	// twice revokes the session, since one of the two parties holding it is
+	// not the user.
+	Rotate(ctx context.Context, token string) (*RefreshToken, error)
+	// Revoke ends token's session. Unknown tokens are ignored.
+	Revoke(ctx context.Context, token string) error
+	// List returns the user's sessions that have not ended, most recently
+	// used first.
+	List(ctx context.Context, userID int) ([]Session, error)
+	// End revokes the user's session with id, or returns ErrSessionNotFound.
+	End(ctx context.Context, userID int, id string) error
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// refresh trades a refresh token for a new access token and the next
+// refresh token. It needs no access token, as the old one has usually
+// expired by then.
+func (h *Handler) refresh(c *gin.Context) {
+	if h.sessions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "refresh tokens are not enabled"})
+		return
+	}
+	var req refreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	next, err := h.sessions.Rotate(c.Request.Context(), req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The session stays in the tenant it was started in.
+	ctx := tenant.NewContext(c.Request.Context(), next.Tenant)
+	c.Request = c.Request.WithContext(ctx)
+	u, err := h.store.Get(ctx, next.UserID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Deactivated users keep their sessions but cannot use them.
+	if err != nil || u.Status != StatusActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": ErrInvalidRefreshToken.Error()})
+		return
+	}
+	resp, err := h.tokenResponse(c, u, next)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// logout ends the session of the refresh token given. Access tokens already
+// issued stay valid until they expire.
+func (h *Handler) logout(c *gin.Context) {
+	if h.sessions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "refresh tokens are not enabled"})
+		return
+	}
+	var req refreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.sessions.Revoke(c.Request.Context(), req.RefreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) listSessions(c *gin.Context) {
+	id, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	if h.sessions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "refresh tokens are not enabled"})
+		return
+	}
+	sessions, err := h.sessions.List(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// endSession signs the user out of one session, such as a lost device. The
+// session's access tokens stay valid until they expire.
+func (h *Handler) endSession(c *gin.Context) {
+	id, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	if h.sessions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "refresh tokens are not enabled"})
+		return
+	}
+	err := h.sessions.End(c.Request.Context(), id, c.Param("sid"))
+	if errors.Is(err, ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// sessionUser reads and authorizes the user whose sessions are asked for.
+func sessionUser(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	return id, auth.AuthorizeUser(c, id)
+}
@@ -0,0 +1,210 @@
+package users
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type loginRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+func (h *Handler) login(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, hash, err := h.store.Credentials(c.Request.Context(), normalizeEmail(req.Email))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
+		return
+	}
+
+	if h.guard != nil {
+		stepUp, err := h.guard.Assess(c.Request.Context(), LoginAttempt{
+			UserID:    u.ID,
+			Email:     u.Email,
+			ClientIP:  c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if stepUp != nil {
+			c.JSON(http.StatusAccepted, stepUp)
+			return
+		}
+	}
+	h.signIn(c, u)
+}
+
+// signIn issues u a token, and a refresh token when sessions are enabled,
+// and announces the sign-in.
+func (h *Handler) signIn(c *gin.Context, u *User) {
+	if resp, ok := h.startSession(c, u); ok {
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// startSession does what signIn does but returns the response for the
+// caller to add to, having written an error if it returns false.
+func (h *Handler) startSession(c *gin.Context, u *User) (gin.H, bool) {
+	var refresh *RefreshToken
+	if h.sessions != nil {
+		var err error
+		if refresh, err = h.sessions.Issue(c.Request.Context(), u.ID, c.ClientIP(), c.Request.UserAgent()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return nil, false
+		}
+	}
+	resp, err := h.tokenResponse(c, u, refresh)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	h.announceLogin(c, u.ID)
+	return resp, true
+}
+
+// tokenResponse issues u an access token and describes it, along with
+// refresh if it is not nil.
+func (h *Handler) tokenResponse(c *gin.Context, u *User, refresh *RefreshToken) (gin.H, error) {
+	roles, err := h.store.Roles(c.Request.Context(), u.ID)
+	if err != nil {
+		return nil, err
+	}
+	// Users who were never granted a role sign in as plain customers.
+	if len(roles) == 0 {
+		roles = []string{auth.RoleCustomer}
+	}
+
+	// The token is bound to the tenant the user signed in to, so it cannot be
+	// replayed against another tenant's data.
+	token, expires, err := h.tokens.IssueTenantUser(u.ID, tenant.FromContext(c.Request.Context()), roles)
+	if err != nil {
+		return nil, err
+	}
+	resp := gin.H{
+		"token":      token,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+		"user":       u,
+		"roles":      roles,
+	}
+	if refresh != nil {
+		resp["refresh_token"] = refresh.Token
+		resp["session_id"] = refresh.SessionID
+		resp["refresh_expires_at"] = refresh.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return resp, nil
+}
+
+// announceLogin publishes a Login event. Signing in does not depend on it,
+// so a failure is only logged.
+func (h *Handler) announceLogin(c *gin.Context, userID int) {
+	if h.publisher == nil {
+		return
+	}
+	ctx := c.Request.Context()
+	e, err := events.New(events.UserLoggedIn, "user-service", events.Login{
+		UserID:    userID,
+		Tenant:    tenant.FromContext(ctx),
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	})
+	if err == nil {
+		err = h.publisher.Publish(ctx, e)
+	}
+	if err != nil {
+		log.Printf("Failed to publish login of user %d: %v", userID, err)
+	}
+}
+
+func (h *Handler) listRoles(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	roles, err := h.store.Roles(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": id, "roles": roles})
+}
+
+func (h *Handler) addRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.Grantable(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of " + strings.Join(auth.GrantableRoles, ", ")})
+		return
+	}
+
+	err = h.store.AddRole(c.Request.Context(), id, req.Role)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondRoles(c, id, http.StatusCreated)
+}
+
+func (h *Handler) removeRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	if err := h.store.RemoveRole(c.Request.Context(), id, c.Param("role")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondRoles(c, id, http.StatusOK)
+}
+
+func (h *Handler) respondRoles(c *gin.Context, id, status int) {
+	roles, err := h.store.Roles(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, gin.H{"user_id": id, "roles": roles})
+}
@@ -0,0 +1,163 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	minSearchQuery     = 2
+	maxSearchQuery     = 100
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Match is one user found by a search. Score is how closely the best of
+// the email, username and name matched, from 0 to 1. Highlights holds each
+// of those fields that contains a search term, HTML-escaped, with the term
+// wrapped in <mark>.
+type Match struct {
+	User       User              `json:"user"`
+	Name       string            `json:"name,omitempty"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// search finds users by part of their email, username or name, for support
+// agents who only have a fragment or a misspelling to go on. Users whose
+// fields contain the query come first, then near misses by trigram
+// similarity. Deleted users have nothing left to find and are skipped.
+func (h *Handler) search(c *gin.Context) {
+	q := strings.Join(strings.Fields(c.Query("q")), " ")
+	if n := utf8.RuneCountInString(q); n < minSearchQuery || n > maxSearchQuery {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("q must be %d to %d characters", minSearchQuery, maxSearchQuery)})
+		return
+	}
+	limit := defaultSearchLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be 1 to %d", maxSearchLimit)})
+			return
+		}
+		limit = n
+	}
+
+	matches, err := h.store.Search(c.Request.Context(), q, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	terms := strings.Fields(q)
+	for i := range matches {
+		m := &matches[i]
+		for field, value := range map[string]string{"email": m.User.Email, "username": m.User.Username, "name": m.Name} {
+			if marked, ok := highlight(value, terms); ok {
+				if m.Highlights == nil {
+					m.Highlights = map[string]string{}
+				}
+				m.Highlights[field] = marked
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"query": q, "results": matches})
+}
+
+// highlight wraps each case-insensitive occurrence of the terms in value
+// in <mark>, escaping the rest, and reports whether any matched.
+func highlight(value string, terms []string) (string, bool) {
+	runes := []rune(value)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	marked := make([]bool, len(runes))
+	found := false
+	for _, term := range terms {
+		t := []rune(strings.ToLower(term))
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) == string(t) {
+				for j := i; j < i+len(t); j++ {
+					marked[j] = true
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && marked[j] == marked[i] {
+			j++
+		}
+		text := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			text = "<mark>" + text + "</mark>"
+		}
+		b.WriteString(text)
+		i = j
+	}
+	return b.String(), true
+}
+
+// likePattern matches q anywhere in a value, with LIKE's wildcards in q
+// taken literally.
+func likePattern(q string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(q) + "%"
+}
+
+// Search uses the trigram indexes on email, username and full name: ILIKE
+// finds fragments of at least three characters through them, and <% finds
+// words close to the query.
+func (s *PostgresStore) Search(ctx context.Context, q string, limit int) ([]Match, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT ` + userColumns + `, name, score FROM (
+			SELECT *, GREATEST(word_similarity($1, email), word_similarity($1, username), word_similarity($1, name)) AS score,
+				(email ILIKE $2 OR username ILIKE $2 OR name ILIKE $2) AS contains
+			FROM (
+				SELECT ` + userColumns + `, coalesce(first_name, '') || ' ' || coalesce(last_name, '') AS name
+				FROM user_service.users
+				WHERE tenant_id = $3 AND status <> 'deleted'
+			) named
+			WHERE email ILIKE $2 OR username ILIKE $2 OR name ILIKE $2
+				OR $1 <% email OR $1 <% username OR $1 <% name
+		) scored
+		ORDER BY contains DESC, score DESC, id
+		LIMIT $4`
+	rows, err := database.Reader(ctx, s.db).QueryContext(ctx, query, q, likePattern(q), tenant.FromContext(ctx), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []Match{}
+	for rows.Next() {
+		var m Match
+		var name sql.NullString
+		u, err := scanUser(rows, &name, &m.Score)
+		if err != nil {
+			return nil, err
+		}
+		m.User, m.Name = *u, strings.TrimSpace(name.String)
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
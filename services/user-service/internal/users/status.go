@@ -0,0 +1,70 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) deactivate(c *gin.Context) {
+	h.setStatus(c, h.store.Deactivate, "user is not active")
+}
+
+func (h *Handler) reactivate(c *gin.Context) {
+	h.setStatus(c, h.store.Reactivate, "user is not deactivated")
+}
+
+func (h *Handler) setStatus(c *gin.Context, change func(context.Context, int) (*User, error), conflict string) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	u, err := change(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if errors.Is(err, ErrInvalidState) {
+		c.JSON(http.StatusConflict, gin.H{"error": conflict})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+// erase lets users delete their own account, and admins anyone's. Services
+// cannot erase users.
+func (h *Handler) erase(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if p, ok := auth.FromContext(c); ok && p.Service != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "services cannot delete users"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+
+	err = h.store.Erase(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
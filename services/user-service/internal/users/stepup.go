@@ -0,0 +1,79 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInvalidChallenge is returned for a login challenge that does not
+// exist, has expired or been used, or was given the wrong code.
+var ErrInvalidChallenge = errors.New("invalid or expired login challenge")
+
+// LoginAttempt is a sign-in whose password was correct.
+type LoginAttempt struct {
+	UserID    int
+	Email     string
+	ClientIP  string
+	UserAgent string
+}
+
+// StepUp asks for a one-time code before a risky sign-in gets a token.
+type StepUp struct {
+	ChallengeID string    `json:"challenge_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Reasons     []string  `json:"reasons"`
+}
+
+// LoginGuard assesses sign-ins and can require a second factor for risky
+// ones.
+type LoginGuard interface {
+	// Assess records the attempt and returns a StepUp if it needs one, or
+	// nil to sign in straight away.
+	Assess(ctx context.Context, attempt LoginAttempt) (*StepUp, error)
+	// Verify checks a challenge's code and returns its user, or
+	// ErrInvalidChallenge.
+	Verify(ctx context.Context, challengeID, code string) (int, error)
+}
+
+type verifyRequest struct {
+	ChallengeID string `json:"challenge_id" binding:"required"`
+	Code        string `json:"code" binding:"required"`
+}
+
+// verifyLogin finishes a sign-in that was asked to step up.
+func (h *Handler) verifyLogin(c *gin.Context) {
+	if h.guard == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "login challenges are not enabled"})
+		return
+	}
+	var req verifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := h.guard.Verify(c.Request.Context(), req.ChallengeID, req.Code)
+	if errors.Is(err, ErrInvalidChallenge) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := h.store.Get(c.Request.Context(), userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// The user may have been deactivated since the challenge was issued.
+	if err != nil || u.Status != StatusActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": ErrInvalidChallenge.Error()})
+		return
+	}
+	h.signIn(c, u)
+}
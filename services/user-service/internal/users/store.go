@@ -0,0 +1,473 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/coalesce"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/models"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/pii"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+	"github.com/lib/pq"
+)
+
+// Account statuses. Only active users are listed and can sign in. Deleted
+// users are anonymized but keep their row, so orders still reference them.
+const (
+	StatusActive      = "active"
+	StatusDeactivated = "deactivated"
+	StatusDeleted     = "deleted"
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrUnknownOrg    = errors.New("unknown org")
+	// ErrInvalidState is returned when a user is not in a status that allows
+	// the requested change.
+	ErrInvalidState = errors.New("invalid user state")
+)
+
+type User struct {
+	models.User
+	// Version is sent as the user's ETag.
+	Version int64 `json:"-"`
+}
+
+// Membership is what GET /users/{id}/org answers.
+type Membership = models.Membership
+
+type Store interface {
+	List(ctx context.Context, limit int) ([]User, error)
+	// Stream calls fn with every active user, by ID, as the rows are
+	// scanned, and stops at fn's first error.
+	Stream(ctx context.Context, fn func(User) error) error
+	Get(ctx context.Context, id int) (*User, error)
+	// GetMany returns the users with the given IDs, skipping unknown ones.
+	GetMany(ctx context.Context, ids []int) ([]User, error)
+	ListOrgAdmins(ctx context.Context, orgID int) ([]User, error)
+	// Membership returns the active user's organization and role in it.
+	Membership(ctx context.Context, userID int) (*Membership, error)
+	// Search returns up to limit users whose email, username or name
+	// contains q or comes close to it, best matches first.
+	Search(ctx context.Context, q string, limit int) ([]Match, error)
+	// Credentials looks a user up by normalized email.
+	Credentials(ctx context.Context, email string) (*User, string, error)
+	// Availability reports whether a normalized email and username are free.
+	Availability(ctx context.Context, email, username string) (emailFree, usernameFree bool, err error)
+	Roles(ctx context.Context, userID int) ([]string, error)
+	AddRole(ctx context.Context, userID int, role string) error
+	RemoveRole(ctx context.Context, userID int, role string) error
+	// ImportBatch inserts records in one transaction. A record that fails is
+	// skipped and its error returned at its index, ErrEmailTaken or
+	// ErrUsernameTaken for a conflict; the rest still commit.
+	ImportBatch(ctx context.Context, records []Record) ([]error, error)
+	// ExportPage returns up to limit active users with an ID above afterID,
+	// by ID.
+	ExportPage(ctx context.Context, afterID, limit int) ([]Record, error)
+	Deactivate(ctx context.Context, id int) (*User, error)
+	Reactivate(ctx context.Context, id int) (*User, error)
+	// Erase anonymizes the user's personal data and removes their roles,
+	// recovery settings, sign-in history, linked identities and sessions,
+	// leaving the row as StatusDeleted.
+	Erase(ctx context.Context, id int) error
+	// ExternalUser returns the user linked to a provider's subject.
+	ExternalUser(ctx context.Context, provider, subject string) (*User, error)
+	// LinkExternal links an identity to the user with its email, creating
+	// one without a password if there is none, and reports whether it did.
+	LinkExternal(ctx context.Context, identity ExternalIdentity) (*User, bool, error)
+	// MarkVerified records that the active user with id still has email and
+	// has verified it, and reports whether they had not already. It
+	// returns ErrNotFound if there is no such user.
+	MarkVerified(ctx context.Context, id int, email string) (*User, bool, error)
+}
+
+type PostgresStore struct {
+	db     *sql.DB
+	cipher *pii.Cipher
+}
+
+// NewPostgresStore encrypts phone numbers with cipher.
+func NewPostgresStore(db *sql.DB, cipher *pii.Cipher) *PostgresStore {
+	return &PostgresStore{db: db, cipher: cipher}
+}
+
+func (s *PostgresStore) List(ctx context.Context, limit int) ([]User, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + userColumns + " FROM user_service.users WHERE tenant_id = $2 AND status = 'active' ORDER BY id LIMIT $1"
+	return s.query(ctx, database.Reader(ctx, s.db), query, limit, tenant.FromContext(ctx))
+}
+
+// Stream is not bound by the query timeout, which is meant for single
+// queries, since a large listing takes as long as the client reads it.
+// The client going away still cancels it.
+func (s *PostgresStore) Stream(ctx context.Context, fn func(User) error) error {
+	const query string = "SELECT " + userColumns + " FROM user_service.users WHERE tenant_id = $1 AND status = 'active' ORDER BY id"
+	rows, err := database.Reader(ctx, s.db).QueryContext(ctx, query, tenant.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(*u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+const userColumns = "id, email, username, status, deactivated_at, verified_at, version"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner, extra ...any) (*User, error) {
+	var u User
+	var deactivatedAt, verifiedAt sql.NullTime
+	if err := row.Scan(append([]any{&u.ID, &u.Email, &u.Username, &u.Status, &deactivatedAt, &verifiedAt, &u.Version}, extra...)...); err != nil {
+		return nil, err
+	}
+	if deactivatedAt.Valid {
+		u.DeactivatedAt = &deactivatedAt.Time
+	}
+	if verifiedAt.Valid {
+		u.VerifiedAt = &verifiedAt.Time
+	}
+	return &u, nil
+}
+
+// gets shares concurrent reads of one user, which several services ask for
+// at once while serving the same customer.
+var gets = coalesce.New[*User]("users.get")
+
+// Get reads the user once for any number of concurrent GET requests for
+// them, each getting its own copy.
+func (s *PostgresStore) Get(ctx context.Context, id int) (*User, error) {
+	shared, err := gets.Do(ctx, strconv.Itoa(id), func() (*User, error) {
+		ctx, cancel := database.WithTimeout(ctx)
+		defer cancel()
+
+		const query string = "SELECT " + userColumns + " FROM user_service.users WHERE id = $1 AND tenant_id = $2"
+		u, err := scanUser(database.Reader(ctx, s.db).QueryRowContext(ctx, query, id, tenant.FromContext(ctx)))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return u, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	u := *shared
+	return &u, nil
+}
+
+func (s *PostgresStore) ListOrgAdmins(ctx context.Context, orgID int) ([]User, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + userColumns + ` FROM user_service.users
+		WHERE org_id = $1 AND tenant_id = $2 AND org_role = 'admin' AND status = 'active' ORDER BY id`
+	return s.query(ctx, s.db, query, orgID, tenant.FromContext(ctx))
+}
+
+func (s *PostgresStore) Membership(ctx context.Context, userID int) (*Membership, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT id, org_id, org_role FROM user_service.users WHERE id = $1 AND tenant_id = $2 AND status = 'active'`
+	var m Membership
+	var orgID sql.NullInt64
+	err := s.db.QueryRowContext(ctx, query, userID, tenant.FromContext(ctx)).Scan(&m.UserID, &orgID, &m.OrgRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if orgID.Valid {
+		id := int(orgID.Int64)
+		m.OrgID = &id
+	}
+	return &m, nil
+}
+
+func (s *PostgresStore) query(ctx context.Context, db *sql.DB, query string, args ...any) ([]User, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+// Credentials looks an active user up by email for login, returning their
+// password hash alongside.
+func (s *PostgresStore) Credentials(ctx context.Context, email string) (*User, string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = "SELECT " + userColumns + ", password_hash FROM user_service.users WHERE lower(email) = $1 AND tenant_id = $2 AND status = 'active'"
+	var hash string
+	u, err := scanUser(s.db.QueryRowContext(ctx, query, email, tenant.FromContext(ctx)), &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return u, hash, nil
+}
+
+func (s *PostgresStore) Roles(ctx context.Context, userID int) ([]string, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT r.role FROM user_service.user_roles r
+		JOIN user_service.users u ON u.id = r.user_id
+		WHERE r.user_id = $1 AND u.tenant_id = $2 ORDER BY r.role`
+	rows, err := s.db.QueryContext(ctx, query, userID, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s *PostgresStore) AddRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const query string = `INSERT INTO user_service.user_roles (user_id, role)
+			SELECT id, $2 FROM user_service.users WHERE id = $1 AND tenant_id = $3
+			ON CONFLICT DO NOTHING`
+		res, err := tx.ExecContext(ctx, query, userID, role, tenant.FromContext(ctx))
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// Either the role was already granted or the user is not in this
+			// tenant.
+			if _, err := s.Get(ctx, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStore) RemoveRole(ctx context.Context, userID int, role string) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const query string = `DELETE FROM user_service.user_roles r USING user_service.users u
+			WHERE r.user_id = $1 AND r.role = $2 AND u.id = r.user_id AND u.tenant_id = $3`
+		_, err := tx.ExecContext(ctx, query, userID, role, tenant.FromContext(ctx))
+		return err
+	})
+}
+
+func (s *PostgresStore) ImportBatch(ctx context.Context, records []Record) ([]error, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var errs []error
+	err := trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const insert string = `INSERT INTO user_service.users
+			(email, username, password_hash, first_name, last_name, org_id, org_role, phone, avatar_url, locale, tenant_id)
+			VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, COALESCE(NULLIF($7, ''), 'member'),
+				NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), $11)`
+		errs = make([]error, len(records))
+		for i, r := range records {
+			// A failed statement aborts the transaction, so each row gets a
+			// savepoint to roll back to.
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT import_row"); err != nil {
+				return err
+			}
+			phone, err := s.cipher.Encrypt(ctx, pii.UserPhone, r.Phone)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, insert, r.Email, r.Username, r.PasswordHash, r.FirstName, r.LastName,
+				r.OrgID, r.OrgRole, phone, r.AvatarURL, r.Locale, tenant.FromContext(ctx))
+			if err != nil {
+				if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_row"); rbErr != nil {
+					return rbErr
+				}
+				switch {
+				case isUniqueViolation(err):
+					errs[i] = takenError(err)
+				case isForeignKeyViolation(err):
+					errs[i] = ErrUnknownOrg
+				default:
+					errs[i] = err
+				}
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT import_row"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+func (s *PostgresStore) ExportPage(ctx context.Context, afterID, limit int) ([]Record, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	const query string = `SELECT id, email, username, COALESCE(first_name, ''), COALESCE(last_name, ''), org_id, org_role,
+			COALESCE(phone, ''), COALESCE(avatar_url, ''), COALESCE(locale, ''), created_at
+		FROM user_service.users WHERE id > $1 AND tenant_id = $3 AND status = 'active' ORDER BY id LIMIT $2`
+	rows, err := s.db.QueryContext(ctx, query, afterID, limit, tenant.FromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	reader := s.cipher.Reader(ctx)
+	for rows.Next() {
+		var r Record
+		var orgID sql.NullInt64
+		var createdAt time.Time
+		if err := rows.Scan(&r.ID, &r.Email, &r.Username, &r.FirstName, &r.LastName, &orgID, &r.OrgRole,
+			&r.Phone, &r.AvatarURL, &r.Locale, &createdAt); err != nil {
+			return nil, err
+		}
+		if orgID.Valid {
+			id := int(orgID.Int64)
+			r.OrgID = &id
+		}
+		r.CreatedAt = &createdAt
+		reader.Open(r.ID, pii.UserPhone, &r.Phone)
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, reader.Close()
+}
+
+func (s *PostgresStore) Deactivate(ctx context.Context, id int) (*User, error) {
+	return s.setStatus(ctx, id, StatusActive, StatusDeactivated)
+}
+
+func (s *PostgresStore) Reactivate(ctx context.Context, id int) (*User, error) {
+	return s.setStatus(ctx, id, StatusDeactivated, StatusActive)
+}
+
+func (s *PostgresStore) setStatus(ctx context.Context, id int, from, to string) (*User, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var u *User
+	err := trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const query string = `UPDATE user_service.users
+			SET status = $3, deactivated_at = CASE WHEN $3 = 'deactivated' THEN NOW() END
+			WHERE id = $1 AND tenant_id = $4 AND status = $2 RETURNING ` + userColumns
+		var err error
+		u, err = scanUser(tx.QueryRowContext(ctx, query, id, from, to, tenant.FromContext(ctx)))
+		if errors.Is(err, sql.ErrNoRows) {
+			return s.missingOrInvalid(ctx, id)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// missingOrInvalid explains why a conditional update matched no user.
+func (s *PostgresStore) missingOrInvalid(ctx context.Context, id int) error {
+	const query string = "SELECT EXISTS (SELECT 1 FROM user_service.users WHERE id = $1 AND tenant_id = $2)"
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, query, id, tenant.FromContext(ctx)).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrInvalidState
+}
+
+func (s *PostgresStore) Erase(ctx context.Context, id int) error {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	return trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		// The placeholder email and username keep the unique constraints
+		// satisfied, and an empty password hash never matches a password.
+		const anonymize string = `UPDATE user_service.users
+			SET email = 'deleted-' || id || '@deleted.invalid', username = 'deleted-' || id, password_hash = '', verified_at = NULL,
+				first_name = NULL, last_name = NULL, phone = NULL, avatar_url = NULL, locale = NULL,
+				org_id = NULL, org_role = 'member', status = 'deleted', deleted_at = COALESCE(deleted_at, NOW())
+			WHERE id = $1 AND tenant_id = $2`
+		res, err := tx.ExecContext(ctx, anonymize, id, tenant.FromContext(ctx))
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+
+		for _, table := range []string{"user_roles", "recovery_codes", "security_questions", "recovery_attempts", "password_resets", "profile_nudges", "addresses", "activity", "login_challenges", "login_history", "user_identities", "sessions", "referral_codes", "referrals", "store_credit", "onboarding_progress", "onboarding_nudges"} {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM user_service."+table+" WHERE user_id = $1", id); err != nil {
+				return err
+			}
+		}
+		// Last, so it also covers the changes captured above.
+		return trail.Erase(ctx, tx, id)
+	})
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
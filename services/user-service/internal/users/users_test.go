@@ -0,0 +1,25 @@
+package users
+
+import "testing"
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		value string
+		terms []string
+		want  string
+	}{
+		{"Jane Doe", []string{"jane", "doe"}, "<mark>Jane</mark> <mark>Doe</mark>"},
+		{"annabel", []string{"ann", "nab"}, "<mark>annab</mark>el"},
+		{"<b>ÉLODIE</b>", []string{"élo"}, "&lt;b&gt;<mark>ÉLO</mark>DIE&lt;/b&gt;"},
+		{"janedoe", []string{"smith"}, ""},
+	}
+	for _, tt := range tests {
+		got, ok := highlight(tt.value, tt.terms)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("highlight(%q, %q) = %q, %v; want %q", tt.value, tt.terms, got, ok, tt.want)
+		}
+	}
+	if got := likePattern(`50%_off\`); got != `%50\%\_off\\%` {
+		t.Errorf("Expected LIKE wildcards escaped, got: %s", got)
+	}
+}
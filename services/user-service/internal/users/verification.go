@@ -0,0 +1,239 @@
+package users
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alux444/go-microserv-test/pkg/auth"
+	"github.com/alux444/go-microserv-test/pkg/database"
+	"github.com/alux444/go-microserv-test/pkg/events"
+	"github.com/alux444/go-microserv-test/pkg/tenant"
+	"github.com/alux444/go-microserv-test/services/user-service/internal/trail"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInvalidVerification is returned for a verification token that is
+// malformed, expired, or was issued for an email the user no longer has.
+var ErrInvalidVerification = errors.New("invalid or expired verification token")
+
+// Verification sends users links that prove they own their email. Tokens
+// are signed rather than stored, and carry a hash of the email they were
+// sent to, so a link stops working once the user's email changes.
+type Verification struct {
+	secret    []byte
+	ttl       time.Duration
+	baseURL   string
+	publisher events.Publisher
+	now       func() time.Time
+}
+
+// NewVerification signs tokens with secret, valid for ttl. Links point at
+// baseURL with the token in ?token=, for a page that posts it to
+// POST /users/verify. They are sent through publisher to notification-service.
+func NewVerification(secret []byte, ttl time.Duration, baseURL string, publisher events.Publisher) *Verification {
+	return &Verification{secret: secret, ttl: ttl, baseURL: baseURL, publisher: publisher, now: time.Now}
+}
+
+// Send publishes a link for u to verify their email, and returns when it
+// expires.
+func (v *Verification) Send(ctx context.Context, u *User) (time.Time, error) {
+	t := verificationToken{Tenant: tenant.FromContext(ctx), UserID: u.ID, Email: emailHash(u.Email), ExpiresAt: v.now().Add(v.ttl).UTC()}
+	e, err := events.New(events.UserVerificationRequested, "user-service", events.VerificationRequest{
+		UserID:    u.ID,
+		Tenant:    t.Tenant,
+		Email:     u.Email,
+		URL:       v.baseURL + "?token=" + v.sign(t),
+		ExpiresAt: t.ExpiresAt,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.ExpiresAt, v.publisher.Publish(ctx, e)
+}
+
+// verificationToken is what a verification link proves: that whoever holds
+// it received mail at the address hashed in Email.
+type verificationToken struct {
+	Tenant    string
+	UserID    int
+	Email     string
+	ExpiresAt time.Time
+}
+
+// emailHash keeps the address itself out of links, which end up in
+// browser histories and proxy logs.
+func emailHash(email string) string {
+	sum := sha256.Sum256([]byte(normalizeEmail(email)))
+	return hex.EncodeToString(sum[:16])
+}
+
+var encoding = base64.RawURLEncoding
+
+func (v *Verification) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (v *Verification) sign(t verificationToken) string {
+	payload := encoding.EncodeToString([]byte(strings.Join([]string{
+		t.Tenant, strconv.Itoa(t.UserID), t.Email, strconv.FormatInt(t.ExpiresAt.Unix(), 10),
+	}, "\n")))
+	return payload + "." + encoding.EncodeToString(v.mac(payload))
+}
+
+// parse returns the token signed, or ErrInvalidVerification if it is not
+// one of ours or has expired.
+func (v *Verification) parse(signed string) (verificationToken, error) {
+	payload, sig, ok := strings.Cut(signed, ".")
+	want, err := encoding.DecodeString(sig)
+	if !ok || err != nil || len(v.secret) == 0 || !hmac.Equal(want, v.mac(payload)) {
+		return verificationToken{}, ErrInvalidVerification
+	}
+	raw, err := encoding.DecodeString(payload)
+	if err != nil {
+		return verificationToken{}, ErrInvalidVerification
+	}
+	parts := strings.Split(string(raw), "\n")
+	if len(parts) != 4 {
+		return verificationToken{}, ErrInvalidVerification
+	}
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return verificationToken{}, ErrInvalidVerification
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || !v.now().Before(time.Unix(expires, 0)) {
+		return verificationToken{}, ErrInvalidVerification
+	}
+	return verificationToken{Tenant: parts[0], UserID: userID, Email: parts[2], ExpiresAt: time.Unix(expires, 0)}, nil
+}
+
+// requestVerification sends the user a new verification link. Earlier
+// links keep working until they expire.
+func (h *Handler) requestVerification(c *gin.Context) {
+	if h.verification == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "email verification is not enabled"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	if !auth.AuthorizeUser(c, id) {
+		return
+	}
+	u, err := h.store.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch {
+	case u.Status != StatusActive:
+		c.JSON(http.StatusConflict, gin.H{"error": "account is not active"})
+		return
+	case u.VerifiedAt != nil:
+		c.JSON(http.StatusConflict, gin.H{"error": "email is already verified"})
+		return
+	}
+	expiresAt, err := h.verification.Send(c.Request.Context(), u)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to send the verification email: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"email": u.Email, "expires_at": expiresAt})
+}
+
+// verifyEmail marks the user a link was sent to as verified. It needs no
+// token of the user's, since the link may be opened on another device;
+// the signed token is the proof.
+func (h *Handler) verifyEmail(c *gin.Context) {
+	if h.verification == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "email verification is not enabled"})
+		return
+	}
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t, err := h.verification.parse(req.Token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The link may be opened without the tenant header, so the token says
+	// which tenant the user is in.
+	ctx := tenant.NewContext(c.Request.Context(), t.Tenant)
+	c.Request = c.Request.WithContext(ctx)
+	u, err := h.store.Get(ctx, t.UserID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil || emailHash(u.Email) != t.Email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidVerification.Error()})
+		return
+	}
+	u, verified, err := h.store.MarkVerified(ctx, u.ID, u.Email)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidVerification.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if verified {
+		h.announceVerifiedEmail(ctx, u)
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+func (s *PostgresStore) MarkVerified(ctx context.Context, id int, email string) (*User, bool, error) {
+	ctx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	var u *User
+	var verified bool
+	err := trail.WithTx(ctx, s.db, func(ctx context.Context, tx *sql.Tx) error {
+		const query string = "SELECT " + userColumns + ` FROM user_service.users
+			WHERE id = $1 AND tenant_id = $2 AND email = $3 AND status = 'active' FOR UPDATE`
+		var err error
+		u, err = scanUser(tx.QueryRowContext(ctx, query, id, tenant.FromContext(ctx), email))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil || u.VerifiedAt != nil {
+			verified = false
+			return err
+		}
+		const verify string = "UPDATE user_service.users SET verified_at = NOW() WHERE id = $1 RETURNING " + userColumns
+		if u, err = scanUser(tx.QueryRowContext(ctx, verify, id)); err != nil {
+			return err
+		}
+		verified = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return u, verified, nil
+}